@@ -38,10 +38,21 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
                 "proto/spearlet/function.proto",
                 "proto/spearlet/instance.proto",
                 "proto/spearlet/router_filter.proto",
+                "proto/spearlet/exec.proto",
             ],
             &["proto"],
         )?;
 
+    // Client for Google Speech-to-Text streaming recognition
+    // Google Speech-to-Text 流式识别客户端
+    tonic_build::configure()
+        .build_server(false)
+        .build_client(true)
+        .compile_protos(
+            &["proto/google/cloud/speech/v1/cloud_speech.proto"],
+            &["proto"],
+        )?;
+
     // Tell cargo to rerun this build script if proto files change
     // 告诉cargo在proto文件更改时重新运行此构建脚本
     println!("cargo:rerun-if-changed=proto/");
@@ -28,6 +28,7 @@ fn main() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     };
     let api = DefaultHostApi::new(cfg);
 
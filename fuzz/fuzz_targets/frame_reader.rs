@@ -0,0 +1,28 @@
+//! Reading frames off an agent connection / 从 agent 连接读取帧
+//!
+//! The input is the byte stream a guest sends. The reader must end with an error rather
+//! than panic or hand out a frame above the size limit, whatever the bytes are.
+//! 输入是 guest 发送的字节流。无论字节内容如何，读取器都必须以错误结束，而不是 panic 或交出超过大小
+//! 上限的帧。
+
+#![no_main]
+
+use libfuzzer_sys::fuzz_target;
+use spear_next::spearlet::execution::communication::framing::FrameReader;
+
+/// A small limit, so that oversized frames are reached / 较小的上限，以便触及超大帧
+const MAX_MESSAGE_SIZE: usize = 4096;
+
+fuzz_target!(|data: &[u8]| {
+    let mut reader = FrameReader::new(MAX_MESSAGE_SIZE);
+    let mut r = data;
+    futures::executor::block_on(async {
+        while let Ok(frame) = reader.read_frame(&mut r).await {
+            assert!(frame.len() <= MAX_MESSAGE_SIZE);
+            let format = reader.format().expect("format settled by the first byte");
+            if let Ok(message) = format.decode(&frame) {
+                let _ = message.validate(MAX_MESSAGE_SIZE);
+            }
+        }
+    });
+});
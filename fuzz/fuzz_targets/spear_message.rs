@@ -0,0 +1,45 @@
+//! Decoding and checking a single agent message / 解码并检查单个 agent 消息
+//!
+//! Covers both wire encodings of `SpearMessage` and the payload types the connection
+//! manager parses. Nothing here may panic, and a message that decodes must survive a
+//! round trip through the other encoding.
+//! 覆盖 `SpearMessage` 的两种线路编码以及连接管理器解析的负载类型。此处任何输入都不得 panic，且能解码的
+//! 消息必须能经另一种编码往返。
+
+#![no_main]
+
+use libfuzzer_sys::fuzz_target;
+use spear_next::spearlet::execution::communication::protocol::{
+    constants, AuthRequest, ErrorMessage, ExecuteRequest, ExecuteResponse, HeartbeatMessage,
+    SignalMessage, SpearMessage, StreamDataMessage,
+};
+
+fn check(message: SpearMessage) {
+    let _ = message.validate(constants::MAX_MESSAGE_SIZE);
+    let _ = message.parse_payload::<AuthRequest>();
+    let _ = message.parse_payload::<ExecuteRequest>();
+    let _ = message.parse_payload::<ExecuteResponse>();
+    let _ = message.parse_payload::<SignalMessage>();
+    let _ = message.parse_payload::<HeartbeatMessage>();
+    let _ = message.parse_payload::<ErrorMessage>();
+    let _ = message.parse_payload::<StreamDataMessage>();
+
+    let line = message.to_json_line().expect("encode as a JSON line");
+    let back = SpearMessage::from_json_line(&line).expect("decode own JSON line");
+    assert_eq!(back.message_type, message.message_type);
+    assert_eq!(back.request_id, message.request_id);
+    // JSON payloads are re-serialized, other payloads travel verbatim
+    // JSON 负载会被重新序列化，其他负载原样传输
+    if serde_json::from_slice::<serde_json::Value>(&message.payload).is_err() {
+        assert_eq!(back.payload, message.payload);
+    }
+}
+
+fuzz_target!(|data: &[u8]| {
+    if let Ok(message) = SpearMessage::deserialize(data) {
+        check(message);
+    }
+    if let Ok(message) = SpearMessage::from_json_line(data) {
+        check(message);
+    }
+});
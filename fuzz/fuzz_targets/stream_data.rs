@@ -0,0 +1,21 @@
+//! Stream data payloads / 流数据负载
+//!
+//! `StreamDataMessage::validate` and `SpearMessage::validate` must agree on every payload.
+//! `StreamDataMessage::validate` 与 `SpearMessage::validate` 对任何负载的结论必须一致。
+
+#![no_main]
+
+use libfuzzer_sys::fuzz_target;
+use spear_next::spearlet::execution::communication::protocol::{
+    constants, MessageType, SpearMessage, StreamDataMessage,
+};
+
+fuzz_target!(|data: &[u8]| {
+    let parsed = serde_json::from_slice::<StreamDataMessage>(data);
+    let message = SpearMessage::new(MessageType::StreamData, 1, data.to_vec());
+    let checked = message.validate(constants::MAX_MESSAGE_SIZE);
+    match parsed {
+        Ok(stream) => assert_eq!(stream.validate().is_ok(), checked.is_ok()),
+        Err(_) => assert!(checked.is_err()),
+    }
+});
@@ -20,12 +20,17 @@ enum {
     SPEAR_EAGAIN = 11,
     SPEAR_ENOMEM = 12,
     SPEAR_EFAULT = 14,
+    SPEAR_EEXIST = 17,
     SPEAR_EINVAL = 22,
+    SPEAR_EFBIG = 27,
     SPEAR_ENOSPC = 28,
     SPEAR_EPIPE = 32,
+    SPEAR_ENOSYS = 38,
     SPEAR_ECONNRESET = 104,
     SPEAR_ENOTCONN = 107,
+    SPEAR_ESHUTDOWN = 108,
     SPEAR_ETIMEDOUT = 110,
+    SPEAR_EDQUOT = 122,
 
     SPEAR_CCHAT_ERR_INVALID_FD = -SPEAR_EBADF,
     SPEAR_CCHAT_ERR_INVALID_PTR = -SPEAR_EFAULT,
@@ -42,10 +47,19 @@ enum {
 enum {
     SPEAR_CCHAT_SEND_FLAG_ENABLE_METRICS = 1 << 0,
     SPEAR_CCHAT_SEND_FLAG_AUTO_TOOL_CALL = 1 << 1,
+    SPEAR_CCHAT_SEND_FLAG_STREAM = 1 << 2,
 };
 
 #define AUTO_TOOL_CALL SPEAR_CCHAT_SEND_FLAG_AUTO_TOOL_CALL
 
+enum {
+    SPEAR_TTS_CTL_SET_PARAM = 1,
+};
+
+enum {
+    SPEAR_TTS_SEND_FLAG_STREAM = 1 << 2,
+};
+
 enum {
     SPEAR_RTA_CTL_SET_PARAM = 1,
     SPEAR_RTA_CTL_CONNECT = 2,
@@ -55,6 +69,18 @@ enum {
     SPEAR_RTA_CTL_CLEAR = 6,
     SPEAR_RTA_CTL_SET_AUTOFLUSH = 7,
     SPEAR_RTA_CTL_GET_AUTOFLUSH = 8,
+    SPEAR_RTA_CTL_GET_LANGUAGE = 9,
+    SPEAR_RTA_CTL_UPDATE_SESSION = 10,
+    SPEAR_RTA_CTL_FINISH = 11,
+};
+
+enum {
+    SPEAR_RTTTS_CTL_SET_PARAM = 1,
+    SPEAR_RTTTS_CTL_CONNECT = 2,
+    SPEAR_RTTTS_CTL_GET_STATUS = 3,
+    SPEAR_RTTTS_CTL_FLUSH = 4,
+    SPEAR_RTTTS_CTL_CLEAR = 5,
+    SPEAR_RTTTS_CTL_FINISH = 6,
 };
 
 enum {
@@ -62,9 +88,27 @@ enum {
     SPEAR_MIC_CTL_GET_STATUS = 2,
 };
 
+enum {
+    SPEAR_ONNX_CTL_LIST = 1,
+    SPEAR_ONNX_CTL_LOAD = 2,
+    SPEAR_ONNX_CTL_UNLOAD = 3,
+};
+
 SPEAR_IMPORT("time_now_ms")
 int64_t sp_time_now_ms(void);
 
+/* Device profile JSON of the host; section_len == 0 returns all sections */
+SPEAR_IMPORT("device_profile")
+int32_t sp_device_profile(int32_t section_ptr, int32_t section_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Run a configured ONNX model; request and result are JSON */
+SPEAR_IMPORT("onnx_infer")
+int32_t sp_onnx_infer(int32_t req_ptr, int32_t req_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* LIST writes JSON to arg; LOAD and UNLOAD read a model name from arg */
+SPEAR_IMPORT("onnx_ctl")
+int32_t sp_onnx_ctl(int32_t cmd, int32_t arg_ptr, int32_t arg_len_ptr);
+
 SPEAR_IMPORT("cchat_create")
 int32_t sp_cchat_create(void);
 
@@ -84,9 +128,172 @@ int32_t sp_cchat_send(int32_t fd, int32_t flags);
 SPEAR_IMPORT("cchat_recv")
 int32_t sp_cchat_recv(int32_t response_fd, int32_t out_ptr, int32_t out_len_ptr);
 
+SPEAR_IMPORT("cchat_recv_delta")
+int32_t sp_cchat_recv_delta(int32_t response_fd, int32_t out_ptr, int32_t out_len_ptr);
+
 SPEAR_IMPORT("cchat_close")
 int32_t sp_cchat_close(int32_t fd);
 
+SPEAR_IMPORT("tts_create")
+int32_t sp_tts_create(void);
+
+SPEAR_IMPORT("tts_write")
+int32_t sp_tts_write(int32_t fd, int32_t text_ptr, int32_t text_len);
+
+/* SET_PARAM keys: model, voice, format, speed, language, backend, timeout_ms */
+SPEAR_IMPORT("tts_ctl")
+int32_t sp_tts_ctl(int32_t fd, int32_t cmd, int32_t arg_ptr, int32_t arg_len_ptr);
+
+/* Returns an audio fd; with SPEAR_TTS_SEND_FLAG_STREAM audio arrives while it is synthesized */
+SPEAR_IMPORT("tts_send")
+int32_t sp_tts_send(int32_t fd, int32_t flags);
+
+/* Up to *out_len_ptr audio bytes; -SPEAR_EAGAIN until more arrives, -SPEAR_EPIPE at the end */
+SPEAR_IMPORT("tts_read")
+int32_t sp_tts_read(int32_t audio_fd, int32_t out_ptr, int32_t out_len_ptr);
+
+SPEAR_IMPORT("tts_close")
+int32_t sp_tts_close(int32_t fd);
+
+/* Embeddings for a text or a batch; request and result are JSON */
+SPEAR_IMPORT("embeddings")
+int32_t sp_embeddings(int32_t req_ptr, int32_t req_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Moderation verdicts for a text or a batch; request and result are JSON */
+SPEAR_IMPORT("moderate")
+int32_t sp_moderate(int32_t req_ptr, int32_t req_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Chat whose answer must match a JSON Schema; request and result are JSON */
+SPEAR_IMPORT("chat_structured")
+int32_t sp_chat_structured(int32_t req_ptr, int32_t req_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Images from a prompt as URLs or inline base64; request and result are JSON.
+ * -EFBIG when the inline images exceed max_inline_bytes */
+SPEAR_IMPORT("image_generate")
+int32_t sp_image_generate(int32_t req_ptr, int32_t req_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Builtin tools of the node: list them with their parameter schemas, or run one.
+ * tool_invoke takes {"name","arguments"}; -EINVAL when the arguments fail the schema */
+SPEAR_IMPORT("tool_list")
+int32_t sp_tool_list(int32_t out_ptr, int32_t out_len_ptr);
+SPEAR_IMPORT("tool_invoke")
+int32_t sp_tool_invoke(int32_t req_ptr, int32_t req_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Announce a compute-heavy phase: {"phase":"heavy"|"normal","resource":"cpu"|"gpu","duration_ms"};
+ * returns the granted boost in ms, 0 for "normal" */
+SPEAR_IMPORT("compute_hint")
+int32_t sp_compute_hint(int32_t req_ptr, int32_t req_len);
+
+/* Blob cache: hand large payloads to other tasks on the node by id */
+SPEAR_IMPORT("blob_put")
+int32_t sp_blob_put(int32_t data_ptr, int32_t data_len, int32_t out_ptr, int32_t out_len_ptr);
+
+SPEAR_IMPORT("blob_size")
+int32_t sp_blob_size(int32_t id_ptr, int32_t id_len);
+
+/* Reads at most *out_len_ptr bytes from offset; 0 at the end of the blob */
+SPEAR_IMPORT("blob_read")
+int32_t sp_blob_read(int32_t id_ptr, int32_t id_len, int32_t offset, int32_t out_ptr, int32_t out_len_ptr);
+
+SPEAR_IMPORT("blob_release")
+int32_t sp_blob_release(int32_t id_ptr, int32_t id_len);
+
+/* Vector store: per-task collections; requests are JSON */
+SPEAR_IMPORT("vs_create")
+int32_t sp_vs_create(int32_t req_ptr, int32_t req_len);
+
+/* Returns the number of records written */
+SPEAR_IMPORT("vs_insert")
+int32_t sp_vs_insert(int32_t req_ptr, int32_t req_len);
+
+SPEAR_IMPORT("vs_search")
+int32_t sp_vs_search(int32_t req_ptr, int32_t req_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Returns the number of records deleted */
+SPEAR_IMPORT("vs_delete")
+int32_t sp_vs_delete(int32_t req_ptr, int32_t req_len);
+
+SPEAR_IMPORT("vs_list")
+int32_t sp_vs_list(int32_t out_ptr, int32_t out_len_ptr);
+
+/* Key-value state kept for the task between invocations; -ENOENT for a missing key */
+SPEAR_IMPORT("kv_get")
+int32_t sp_kv_get(int32_t key_ptr, int32_t key_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* A ttl_s of 0 keeps the key until it is deleted */
+SPEAR_IMPORT("kv_set")
+int32_t sp_kv_set(int32_t key_ptr, int32_t key_len, int32_t val_ptr, int32_t val_len, int32_t ttl_s);
+
+SPEAR_IMPORT("kv_delete")
+int32_t sp_kv_delete(int32_t key_ptr, int32_t key_len);
+
+/* Keys starting with the prefix, as a JSON array */
+SPEAR_IMPORT("kv_list")
+int32_t sp_kv_list(int32_t prefix_ptr, int32_t prefix_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Message passing between tasks on the same spearlet. Registering a name creates the
+ * caller's mailbox; returns the mailbox id, or -EEXIST when another instance holds the name */
+SPEAR_IMPORT("mp_register")
+int32_t sp_mp_register(int32_t name_ptr, int32_t name_len);
+
+SPEAR_IMPORT("mp_lookup")
+int32_t sp_mp_lookup(int32_t name_ptr, int32_t name_len);
+
+/* Returns the message id; -EAGAIN when the mailbox is full */
+SPEAR_IMPORT("mp_send")
+int32_t sp_mp_send(int32_t mailbox, int32_t msg_ptr, int32_t msg_len);
+
+/* meta_ptr receives two u32: the message id and the sender's mailbox id (0 for none).
+ * timeout_ms of 0 polls (-EAGAIN), a negative one waits until a message arrives.
+ * A message larger than *out_len_ptr stays queued and -ENOSPC reports its length */
+SPEAR_IMPORT("mp_recv")
+int32_t sp_mp_recv(int32_t meta_ptr, int32_t out_ptr, int32_t out_len_ptr, int32_t timeout_ms);
+
+SPEAR_IMPORT("mp_ack")
+int32_t sp_mp_ack(int32_t msg_id);
+
+/* 0 once the receiver acknowledged; -EPIPE when its mailbox went away first */
+SPEAR_IMPORT("mp_wait_ack")
+int32_t sp_mp_wait_ack(int32_t msg_id, int32_t timeout_ms);
+
+/* Files of the task's scratch directory; paths under /mnt/<name>/ reach a shared mount */
+SPEAR_IMPORT("file_read")
+int32_t sp_file_read(int32_t path_ptr, int32_t path_len, int32_t out_ptr, int32_t out_len_ptr);
+
+/* Creates parent directories; -EACCES on a read-only mount, -ENOSPC past max_task_bytes */
+SPEAR_IMPORT("file_write")
+int32_t sp_file_write(int32_t path_ptr, int32_t path_len, int32_t data_ptr, int32_t data_len);
+
+/* Entries of a directory, as a JSON array of {name, size, dir} */
+SPEAR_IMPORT("file_list")
+int32_t sp_file_list(int32_t path_ptr, int32_t path_len, int32_t out_ptr, int32_t out_len_ptr);
+
+SPEAR_IMPORT("file_delete")
+int32_t sp_file_delete(int32_t path_ptr, int32_t path_len);
+
+/* Invoke another workload from a JSON request {task, method, input, stream, ...}; returns a handle */
+SPEAR_IMPORT("invoke_start")
+int32_t sp_invoke_start(int32_t req_ptr, int32_t req_len);
+
+/* Next child event as JSON: "frame" events while it streams, then one "done" closing the handle */
+SPEAR_IMPORT("invoke_next")
+int32_t sp_invoke_next(int32_t handle, int32_t out_ptr, int32_t out_len_ptr, int32_t timeout_ms);
+
+SPEAR_IMPORT("invoke_cancel")
+int32_t sp_invoke_cancel(int32_t handle);
+
+/* Schedule a later invocation from a JSON request {task, method, input, delay_ms | at_ms,
+ * interval_ms, ...}; writes the schedule id */
+SPEAR_IMPORT("schedule_create")
+int32_t sp_schedule_create(int32_t req_ptr, int32_t req_len, int32_t out_ptr, int32_t out_len_ptr);
+
+SPEAR_IMPORT("schedule_cancel")
+int32_t sp_schedule_cancel(int32_t id_ptr, int32_t id_len);
+
+/* The task's schedules as a JSON array, soonest first */
+SPEAR_IMPORT("schedule_list")
+int32_t sp_schedule_list(int32_t out_ptr, int32_t out_len_ptr);
+
 SPEAR_IMPORT("rtasr_create")
 int32_t sp_rtasr_create(void);
 
@@ -102,6 +309,22 @@ int32_t sp_rtasr_read(int32_t fd, int32_t out_ptr, int32_t out_len_ptr);
 SPEAR_IMPORT("rtasr_close")
 int32_t sp_rtasr_close(int32_t fd);
 
+/* Realtime TTS: write text deltas, read audio chunks as they are synthesized */
+SPEAR_IMPORT("rttts_create")
+int32_t sp_rttts_create(void);
+
+SPEAR_IMPORT("rttts_ctl")
+int32_t sp_rttts_ctl(int32_t fd, int32_t cmd, int32_t arg_ptr, int32_t arg_len_ptr);
+
+SPEAR_IMPORT("rttts_write")
+int32_t sp_rttts_write(int32_t fd, int32_t text_ptr, int32_t text_len);
+
+SPEAR_IMPORT("rttts_read")
+int32_t sp_rttts_read(int32_t fd, int32_t out_ptr, int32_t out_len_ptr);
+
+SPEAR_IMPORT("rttts_close")
+int32_t sp_rttts_close(int32_t fd);
+
 SPEAR_IMPORT("mic_create")
 int32_t sp_mic_create(void);
 
@@ -204,6 +427,19 @@ static inline int32_t sp_ep_close(int32_t epfd) {
 SPEAR_IMPORT("spear_fd_ctl")
 int32_t sp_fd_ctl(int32_t fd, int32_t cmd, int32_t arg_ptr, int32_t arg_len_ptr);
 
+/* Test-harness hostcalls; return -SPEAR_ENOSYS unless spearlet.test_hostcalls is enabled */
+SPEAR_IMPORT("test_echo")
+int32_t sp_test_echo(int32_t in_ptr, int32_t in_len, int32_t out_ptr, int32_t out_len_ptr);
+
+SPEAR_IMPORT("test_fail")
+int32_t sp_test_fail(int32_t errno_value);
+
+SPEAR_IMPORT("test_latency")
+int64_t sp_test_latency(int32_t ms);
+
+SPEAR_IMPORT("test_state")
+int32_t sp_test_state(int32_t out_ptr, int32_t out_len_ptr);
+
 static inline int32_t sp_cchat_write_msg_str(int32_t fd, const char *role, const char *content) {
     return sp_cchat_write_msg(fd, (int32_t)(uintptr_t)role, (int32_t)strlen(role),
                               (int32_t)(uintptr_t)content, (int32_t)strlen(content));
@@ -267,6 +503,24 @@ static inline uint8_t *sp_cchat_recv_alloc(int32_t resp_fd, uint32_t *out_len) {
     return NULL;
 }
 
+static inline int32_t sp_tts_write_str(int32_t fd, const char *text) {
+    return sp_tts_write(fd, (int32_t)(uintptr_t)text, (int32_t)strlen(text));
+}
+
+static inline int32_t sp_tts_set_param_json(int32_t fd, const char *json, uint32_t json_len) {
+    uint32_t len = json_len;
+    return sp_tts_ctl(fd, SPEAR_TTS_CTL_SET_PARAM, (int32_t)(uintptr_t)json, (int32_t)(uintptr_t)&len);
+}
+
+static inline int32_t sp_tts_set_param_string(int32_t fd, const char *key, const char *value) {
+    char buf[512];
+    int n = snprintf(buf, sizeof(buf), "{\"key\":\"%s\",\"value\":\"%s\"}", key, value);
+    if (n <= 0 || (size_t)n >= sizeof(buf)) {
+        return SPEAR_CCHAT_ERR_INTERNAL;
+    }
+    return sp_tts_set_param_json(fd, buf, (uint32_t)n);
+}
+
 static inline int32_t sp_rtasr_set_param_json(int32_t fd, const char *json, uint32_t json_len) {
     uint32_t len = json_len;
     return sp_rtasr_ctl(fd, SPEAR_RTA_CTL_SET_PARAM, (int32_t)(uintptr_t)json, (int32_t)(uintptr_t)&len);
@@ -21,13 +21,17 @@ pub mod constants {
     pub const SPEAR_EAGAIN: i32 = 11;
     pub const SPEAR_ENOMEM: i32 = 12;
     pub const SPEAR_EFAULT: i32 = 14;
+    pub const SPEAR_EEXIST: i32 = 17;
     pub const SPEAR_EINVAL: i32 = 22;
+    pub const SPEAR_EFBIG: i32 = 27;
     pub const SPEAR_ENOSPC: i32 = 28;
     pub const SPEAR_EPIPE: i32 = 32;
     pub const SPEAR_ENOSYS: i32 = 38;
     pub const SPEAR_ECONNRESET: i32 = 104;
     pub const SPEAR_ENOTCONN: i32 = 107;
+    pub const SPEAR_ESHUTDOWN: i32 = 108;
     pub const SPEAR_ETIMEDOUT: i32 = 110;
+    pub const SPEAR_EDQUOT: i32 = 122;
 
     pub const SPEAR_CCHAT_CTL_SET_PARAM: i32 = 1;
     pub const SPEAR_CCHAT_CTL_GET_METRICS: i32 = 2;
@@ -35,6 +39,9 @@ pub mod constants {
     pub const SPEAR_CCHAT_SEND_FLAG_ENABLE_METRICS: i32 = 1 << 0;
     pub const SPEAR_CCHAT_SEND_FLAG_AUTO_TOOL_CALL: i32 = 1 << 1;
 
+    pub const SPEAR_TTS_CTL_SET_PARAM: i32 = 1;
+    pub const SPEAR_TTS_SEND_FLAG_STREAM: i32 = 1 << 2;
+
     pub const SPEAR_RTA_CTL_SET_PARAM: i32 = 1;
     pub const SPEAR_RTA_CTL_CONNECT: i32 = 2;
     pub const SPEAR_RTA_CTL_GET_STATUS: i32 = 3;
@@ -43,6 +50,16 @@ pub mod constants {
     pub const SPEAR_RTA_CTL_CLEAR: i32 = 6;
     pub const SPEAR_RTA_CTL_SET_AUTOFLUSH: i32 = 7;
     pub const SPEAR_RTA_CTL_GET_AUTOFLUSH: i32 = 8;
+    pub const SPEAR_RTA_CTL_GET_LANGUAGE: i32 = 9;
+    pub const SPEAR_RTA_CTL_UPDATE_SESSION: i32 = 10;
+    pub const SPEAR_RTA_CTL_FINISH: i32 = 11;
+
+    pub const SPEAR_RTTTS_CTL_SET_PARAM: i32 = 1;
+    pub const SPEAR_RTTTS_CTL_CONNECT: i32 = 2;
+    pub const SPEAR_RTTTS_CTL_GET_STATUS: i32 = 3;
+    pub const SPEAR_RTTTS_CTL_FLUSH: i32 = 4;
+    pub const SPEAR_RTTTS_CTL_CLEAR: i32 = 5;
+    pub const SPEAR_RTTTS_CTL_FINISH: i32 = 6;
 
     pub const SPEAR_MIC_CTL_SET_PARAM: i32 = 1;
     pub const SPEAR_MIC_CTL_GET_STATUS: i32 = 2;
@@ -68,6 +85,10 @@ pub mod constants {
 
     pub const SPEAR_USER_STREAM_CTL_EVENT_STREAM_CONNECTED: i32 = 1;
     pub const SPEAR_USER_STREAM_CTL_EVENT_SESSION_CLOSED: i32 = 2;
+
+    pub const SPEAR_ONNX_CTL_LIST: i32 = 1;
+    pub const SPEAR_ONNX_CTL_LOAD: i32 = 2;
+    pub const SPEAR_ONNX_CTL_UNLOAD: i32 = 3;
 }
 
 #[cfg(target_arch = "wasm32")]
@@ -75,6 +96,10 @@ pub mod constants {
 extern "C" {
     pub fn time_now_ms() -> i64;
     pub fn wall_time_s() -> i64;
+    pub fn tz_offset_s() -> i64;
+    pub fn device_profile(section_ptr: i32, section_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn onnx_infer(req_ptr: i32, req_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn onnx_ctl(cmd: i32, arg_ptr: i32, arg_len_ptr: i32) -> i32;
     pub fn sleep_ms(ms: i32);
     pub fn random_i64() -> i64;
 
@@ -86,14 +111,73 @@ extern "C" {
     pub fn cchat_ctl(fd: i32, cmd: i32, arg_ptr: i32, arg_len_ptr: i32) -> i32;
     pub fn cchat_send(fd: i32, flags: i32) -> i32;
     pub fn cchat_recv(response_fd: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn cchat_recv_delta(response_fd: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
     pub fn cchat_close(fd: i32) -> i32;
 
+    pub fn tts_create() -> i32;
+    pub fn tts_write(fd: i32, text_ptr: i32, text_len: i32) -> i32;
+    pub fn tts_ctl(fd: i32, cmd: i32, arg_ptr: i32, arg_len_ptr: i32) -> i32;
+    pub fn tts_send(fd: i32, flags: i32) -> i32;
+    pub fn tts_read(audio_fd: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn tts_close(fd: i32) -> i32;
+
+    pub fn embeddings(req_ptr: i32, req_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn moderate(req_ptr: i32, req_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn chat_structured(req_ptr: i32, req_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn image_generate(req_ptr: i32, req_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+
+    pub fn tool_list(out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn tool_invoke(req_ptr: i32, req_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn compute_hint(req_ptr: i32, req_len: i32) -> i32;
+
+    pub fn blob_put(data_ptr: i32, data_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn blob_size(id_ptr: i32, id_len: i32) -> i32;
+    pub fn blob_read(id_ptr: i32, id_len: i32, offset: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn blob_release(id_ptr: i32, id_len: i32) -> i32;
+
+    pub fn vs_create(req_ptr: i32, req_len: i32) -> i32;
+    pub fn vs_insert(req_ptr: i32, req_len: i32) -> i32;
+    pub fn vs_search(req_ptr: i32, req_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn vs_delete(req_ptr: i32, req_len: i32) -> i32;
+    pub fn vs_list(out_ptr: i32, out_len_ptr: i32) -> i32;
+
+    pub fn kv_get(key_ptr: i32, key_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn kv_set(key_ptr: i32, key_len: i32, val_ptr: i32, val_len: i32, ttl_s: i32) -> i32;
+    pub fn kv_delete(key_ptr: i32, key_len: i32) -> i32;
+    pub fn kv_list(prefix_ptr: i32, prefix_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+
+    pub fn mp_register(name_ptr: i32, name_len: i32) -> i32;
+    pub fn mp_lookup(name_ptr: i32, name_len: i32) -> i32;
+    pub fn mp_send(mailbox: i32, msg_ptr: i32, msg_len: i32) -> i32;
+    pub fn mp_recv(meta_ptr: i32, out_ptr: i32, out_len_ptr: i32, timeout_ms: i32) -> i32;
+    pub fn mp_ack(msg_id: i32) -> i32;
+    pub fn mp_wait_ack(msg_id: i32, timeout_ms: i32) -> i32;
+
+    pub fn file_read(path_ptr: i32, path_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn file_write(path_ptr: i32, path_len: i32, data_ptr: i32, data_len: i32) -> i32;
+    pub fn file_list(path_ptr: i32, path_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn file_delete(path_ptr: i32, path_len: i32) -> i32;
+
+    pub fn invoke_start(req_ptr: i32, req_len: i32) -> i32;
+    pub fn invoke_next(handle: i32, out_ptr: i32, out_len_ptr: i32, timeout_ms: i32) -> i32;
+    pub fn invoke_cancel(handle: i32) -> i32;
+
+    pub fn schedule_create(req_ptr: i32, req_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn schedule_cancel(id_ptr: i32, id_len: i32) -> i32;
+    pub fn schedule_list(out_ptr: i32, out_len_ptr: i32) -> i32;
+
     pub fn rtasr_create() -> i32;
     pub fn rtasr_ctl(fd: i32, cmd: i32, arg_ptr: i32, arg_len_ptr: i32) -> i32;
     pub fn rtasr_write(fd: i32, buf_ptr: i32, buf_len: i32) -> i32;
     pub fn rtasr_read(fd: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
     pub fn rtasr_close(fd: i32) -> i32;
 
+    pub fn rttts_create() -> i32;
+    pub fn rttts_ctl(fd: i32, cmd: i32, arg_ptr: i32, arg_len_ptr: i32) -> i32;
+    pub fn rttts_write(fd: i32, text_ptr: i32, text_len: i32) -> i32;
+    pub fn rttts_read(fd: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn rttts_close(fd: i32) -> i32;
+
     pub fn mic_create() -> i32;
     pub fn mic_ctl(fd: i32, cmd: i32, arg_ptr: i32, arg_len_ptr: i32) -> i32;
     pub fn mic_read(fd: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
@@ -113,4 +197,9 @@ extern "C" {
 
     pub fn user_stream_ctl_open() -> i32;
     pub fn user_stream_ctl_read(fd: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+
+    pub fn test_echo(in_ptr: i32, in_len: i32, out_ptr: i32, out_len_ptr: i32) -> i32;
+    pub fn test_fail(errno: i32) -> i32;
+    pub fn test_latency(ms: i32) -> i64;
+    pub fn test_state(out_ptr: i32, out_len_ptr: i32) -> i32;
 }
@@ -40,9 +40,13 @@ fn errno_to_code(errno: i32) -> &'static str {
         constants::SPEAR_EINVAL => "invalid_cmd",
         constants::SPEAR_EIO => "internal",
         constants::SPEAR_EAGAIN => "eagain",
+        constants::SPEAR_EEXIST => "exists",
         constants::SPEAR_ENOTCONN => "not_connected",
         constants::SPEAR_ETIMEDOUT => "timeout",
         constants::SPEAR_ENOSYS => "unsupported",
+        constants::SPEAR_EFBIG => "too_large",
+        constants::SPEAR_EDQUOT => "budget_exhausted",
+        constants::SPEAR_ESHUTDOWN => "shutting_down",
         _ => "unknown",
     }
 }
@@ -549,6 +553,1237 @@ pub fn cchat_recv_alloc(response_fd: Fd) -> Result<Vec<u8>, SpearError> {
     }
 }
 
+/// Read the next event of a streamed response; `EAGAIN` until one arrives, `EPIPE` after the last
+/// 读取流式响应的下一个事件；事件到达前返回 `EAGAIN`，最后一个事件之后返回 `EPIPE`
+pub fn cchat_recv_delta_alloc(response_fd: Fd) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        recv_alloc_with(
+            "cchat_recv_delta",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::cchat_recv_delta(response_fd.0, out_ptr_i32, out_len_ptr_i32)
+            },
+            4 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = response_fd;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "cchat_recv_delta",
+        })
+    }
+}
+
+/// Close a TTS FD (session or audio)
+/// 关闭一个 TTS FD（会话或音频）
+pub fn tts_close(fd: Fd) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let rc = unsafe { spear_wasm_sys::tts_close(fd.0) };
+        rc_to_unit(rc, "tts_close")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = fd;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "tts_close",
+        })
+    }
+}
+
+/// Text-to-speech session wrapper / 文本转语音会话封装
+pub struct TtsSession {
+    fd: Fd,
+}
+
+impl TtsSession {
+    /// Create a new TTS session / 创建新的 TTS 会话
+    pub fn create() -> Result<Self, SpearError> {
+        #[cfg(target_arch = "wasm32")]
+        {
+            let fd = unsafe { spear_wasm_sys::tts_create() };
+            let fd = rc_to_result(fd, "tts_create")?;
+            return Ok(Self { fd: Fd(fd) });
+        }
+
+        #[cfg(not(target_arch = "wasm32"))]
+        {
+            Err(SpearError {
+                code: "unsupported_target",
+                errno: -libc::ENOSYS,
+                op: "tts_create",
+            })
+        }
+    }
+
+    pub fn fd(&self) -> Fd {
+        self.fd
+    }
+
+    /// Append text to speak / 追加待朗读的文本
+    pub fn write_text(&mut self, text: &str) -> Result<(), SpearError> {
+        #[cfg(target_arch = "wasm32")]
+        {
+            let (text_ptr, text_len) = cast_ptr_len(text.as_bytes());
+            let rc = unsafe { spear_wasm_sys::tts_write(self.fd.0, text_ptr, text_len) };
+            return rc_to_unit(rc, "tts_write");
+        }
+
+        #[cfg(not(target_arch = "wasm32"))]
+        {
+            let _ = text;
+            Err(SpearError {
+                code: "unsupported_target",
+                errno: -libc::ENOSYS,
+                op: "tts_write",
+            })
+        }
+    }
+
+    /// Set one parameter by JSON (`{"key":...,"value":...}`)
+    /// 通过 JSON 设置一个参数（`{"key":...,"value":...}`）
+    pub fn set_param_json(&mut self, json: &str) -> Result<(), SpearError> {
+        #[cfg(target_arch = "wasm32")]
+        {
+            let json_b = json.as_bytes();
+            let (json_ptr, _json_len) = cast_ptr_len(json_b);
+            let mut len_u32: u32 = json_b.len() as u32;
+            let len_ptr = (&mut len_u32 as *mut u32) as usize as i32;
+            let rc = unsafe {
+                spear_wasm_sys::tts_ctl(
+                    self.fd.0,
+                    constants::SPEAR_TTS_CTL_SET_PARAM,
+                    json_ptr,
+                    len_ptr,
+                )
+            };
+            return rc_to_unit(rc, "tts_ctl");
+        }
+
+        #[cfg(not(target_arch = "wasm32"))]
+        {
+            let _ = json;
+            Err(SpearError {
+                code: "unsupported_target",
+                errno: -libc::ENOSYS,
+                op: "tts_ctl",
+            })
+        }
+    }
+
+    /// Synthesize the written text and return the audio FD
+    /// 合成已写入的文本并返回音频 FD
+    pub fn send(&mut self, flags: i32) -> Result<Fd, SpearError> {
+        #[cfg(target_arch = "wasm32")]
+        {
+            let audio_fd = unsafe { spear_wasm_sys::tts_send(self.fd.0, flags) };
+            let audio_fd = rc_to_result(audio_fd, "tts_send")?;
+            return Ok(Fd(audio_fd));
+        }
+
+        #[cfg(not(target_arch = "wasm32"))]
+        {
+            let _ = flags;
+            Err(SpearError {
+                code: "unsupported_target",
+                errno: -libc::ENOSYS,
+                op: "tts_send",
+            })
+        }
+    }
+
+    /// Close the session FD
+    /// 关闭会话 FD
+    pub fn close(self) -> Result<(), SpearError> {
+        tts_close(self.fd)
+    }
+}
+
+/// Read audio into `buf`; `EAGAIN` until more arrives, `EPIPE` at the end
+/// 将音频读入 `buf`；有后续数据前返回 `EAGAIN`，结束时返回 `EPIPE`
+pub fn tts_read(audio_fd: Fd, buf: &mut [u8]) -> Result<usize, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let mut cap = buf.len() as u32;
+        let rc = unsafe {
+            let out_ptr_i32 = buf.as_mut_ptr() as usize as i32;
+            let out_len_ptr_i32 = (&mut cap as *mut u32) as usize as i32;
+            spear_wasm_sys::tts_read(audio_fd.0, out_ptr_i32, out_len_ptr_i32)
+        };
+        rc_to_result(rc, "tts_read").map(|n| n as usize)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = (audio_fd, buf);
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "tts_read",
+        })
+    }
+}
+
+/// Compute embeddings for a text or a batch; `request` and the result are JSON
+/// 为单个文本或一批文本计算嵌入向量；`request` 与结果均为 JSON
+pub fn embeddings(request: &[u8]) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        recv_alloc_with(
+            "embeddings",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::embeddings(req_ptr, req_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            16 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "embeddings",
+        })
+    }
+}
+
+/// Check a text or a batch with a moderation backend; `request` and the result are JSON
+/// 使用 moderation 后端检查单个文本或一批文本；`request` 与结果均为 JSON
+pub fn moderate(request: &[u8]) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        recv_alloc_with(
+            "moderate",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::moderate(req_ptr, req_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            4 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "moderate",
+        })
+    }
+}
+
+/// Run a chat whose answer must match a JSON Schema; `request` and the result are JSON
+/// 执行应答必须符合 JSON Schema 的对话；`request` 与结果均为 JSON
+pub fn chat_structured(request: &[u8]) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        recv_alloc_with(
+            "chat_structured",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::chat_structured(req_ptr, req_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            4 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "chat_structured",
+        })
+    }
+}
+
+/// Generate images from a prompt; `request` and the result are JSON. Fails with
+/// `too_large` when the inline images exceed the size cap
+/// 根据提示词生成图像；`request` 与结果均为 JSON。内联图像超出大小上限时返回 `too_large`
+pub fn image_generate(request: &[u8]) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        recv_alloc_with(
+            "image_generate",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::image_generate(req_ptr, req_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            16 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "image_generate",
+        })
+    }
+}
+
+/// The node's builtin tools with their parameter schemas, as JSON
+/// 以 JSON 返回节点的内置工具及其参数 schema
+pub fn tool_list() -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        recv_alloc_with(
+            "tool_list",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::tool_list(out_ptr_i32, out_len_ptr_i32)
+            },
+            4 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "tool_list",
+        })
+    }
+}
+
+/// Run a builtin tool; `request` is `{"name", "arguments"}` and the result is JSON. Fails
+/// with `-EINVAL` when the arguments do not match the tool's schema
+/// 运行内置工具；`request` 为 `{"name", "arguments"}`，结果为 JSON。参数不符合工具的 schema 时
+/// 以 `-EINVAL` 失败
+pub fn tool_invoke(request: &[u8]) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        recv_alloc_with(
+            "tool_invoke",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::tool_invoke(req_ptr, req_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            4 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "tool_invoke",
+        })
+    }
+}
+
+/// Announce a compute-heavy phase so other tasks make room for it; `request` is
+/// `{"phase": "heavy" | "normal", "resource": "cpu" | "gpu", "duration_ms"}`. Returns the
+/// granted boost in ms, 0 for `normal`
+/// 声明计算密集阶段，让其他任务为其让路；`request` 为
+/// `{"phase": "heavy" | "normal", "resource": "cpu" | "gpu", "duration_ms"}`。返回授予的提升
+/// 毫秒数，`normal` 时为 0
+pub fn compute_hint(request: &[u8]) -> Result<u32, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        let rc = unsafe { spear_wasm_sys::compute_hint(req_ptr, req_len) };
+        rc_to_result(rc, "compute_hint").map(|ms| ms as u32)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "compute_hint",
+        })
+    }
+}
+
+/// Store `data` in the node's blob cache and return its id / 将 `data` 存入节点的 blob 缓存并返回其 ID
+pub fn blob_put(data: &[u8]) -> Result<String, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (data_ptr, data_len) = cast_ptr_len(data);
+        let id = recv_alloc_with(
+            "blob_put",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::blob_put(data_ptr, data_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            64,
+            2,
+        )?;
+        Ok(String::from_utf8_lossy(&id).into_owned())
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = data;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "blob_put",
+        })
+    }
+}
+
+/// Read a chunk of a cached blob from `offset`; `Ok(0)` at the end
+/// 从 `offset` 起读取缓存 blob 的一段；到达末尾时返回 `Ok(0)`
+pub fn blob_read(id: &str, offset: usize, buf: &mut [u8]) -> Result<usize, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (id_ptr, id_len) = cast_ptr_len(id.as_bytes());
+        let mut cap = buf.len() as u32;
+        let rc = unsafe {
+            let out_ptr_i32 = buf.as_mut_ptr() as usize as i32;
+            let out_len_ptr_i32 = (&mut cap as *mut u32) as usize as i32;
+            spear_wasm_sys::blob_read(id_ptr, id_len, offset as i32, out_ptr_i32, out_len_ptr_i32)
+        };
+        rc_to_result(rc, "blob_read").map(|n| n as usize)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = (id, offset, buf);
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "blob_read",
+        })
+    }
+}
+
+/// Read a whole cached blob / 读取整个缓存 blob
+pub fn blob_read_all(id: &str) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (id_ptr, id_len) = cast_ptr_len(id.as_bytes());
+        let size = rc_to_result(unsafe { spear_wasm_sys::blob_size(id_ptr, id_len) }, "blob_size")?;
+        let mut out = vec![0u8; size as usize];
+        let mut offset = 0;
+        while offset < out.len() {
+            let n = blob_read(id, offset, &mut out[offset..])?;
+            if n == 0 {
+                break;
+            }
+            offset += n;
+        }
+        out.truncate(offset);
+        Ok(out)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = id;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "blob_read",
+        })
+    }
+}
+
+/// Drop a cached blob / 丢弃缓存 blob
+pub fn blob_release(id: &str) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (id_ptr, id_len) = cast_ptr_len(id.as_bytes());
+        let rc = unsafe { spear_wasm_sys::blob_release(id_ptr, id_len) };
+        rc_to_unit(rc, "blob_release")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = id;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "blob_release",
+        })
+    }
+}
+
+/// Create a vector collection; `spec` is JSON / 创建向量集合；`spec` 为 JSON
+pub fn vs_create(spec: &[u8]) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(spec);
+        let rc = unsafe { spear_wasm_sys::vs_create(req_ptr, req_len) };
+        rc_to_unit(rc, "vs_create")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = spec;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "vs_create",
+        })
+    }
+}
+
+/// Insert or replace vectors; returns how many were written / 插入或替换向量；返回写入数量
+pub fn vs_insert(request: &[u8]) -> Result<usize, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        let rc = unsafe { spear_wasm_sys::vs_insert(req_ptr, req_len) };
+        rc_to_result(rc, "vs_insert").map(|n| n as usize)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "vs_insert",
+        })
+    }
+}
+
+/// Search a collection; `request` and the matches are JSON / 检索集合；`request` 与匹配结果均为 JSON
+pub fn vs_search(request: &[u8]) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        recv_alloc_with(
+            "vs_search",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::vs_search(req_ptr, req_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            4 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "vs_search",
+        })
+    }
+}
+
+/// Delete vectors, or the collection when `ids` is absent; returns the vectors deleted
+/// 删除向量，未给出 `ids` 时删除集合；返回删除的向量数
+pub fn vs_delete(request: &[u8]) -> Result<usize, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        let rc = unsafe { spear_wasm_sys::vs_delete(req_ptr, req_len) };
+        rc_to_result(rc, "vs_delete").map(|n| n as usize)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "vs_delete",
+        })
+    }
+}
+
+/// The task's collections as JSON / 以 JSON 返回任务的集合
+pub fn vs_list() -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        recv_alloc_with(
+            "vs_list",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::vs_list(out_ptr_i32, out_len_ptr_i32)
+            },
+            1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "vs_list",
+        })
+    }
+}
+
+/// Value of a task key; fails with `-ENOENT` when it is not set
+/// 任务键的值；键不存在时以 `-ENOENT` 失败
+pub fn kv_get(key: &str) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (key_ptr, key_len) = cast_ptr_len(key.as_bytes());
+        recv_alloc_with(
+            "kv_get",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::kv_get(key_ptr, key_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = key;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "kv_get",
+        })
+    }
+}
+
+/// Set a task key; `ttl_s` of 0 keeps it until deleted / 设置任务键；`ttl_s` 为 0 时保留至删除
+pub fn kv_set(key: &str, value: &[u8], ttl_s: u32) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (key_ptr, key_len) = cast_ptr_len(key.as_bytes());
+        let (val_ptr, val_len) = cast_ptr_len(value);
+        let ttl_s = ttl_s.min(i32::MAX as u32) as i32;
+        let rc = unsafe { spear_wasm_sys::kv_set(key_ptr, key_len, val_ptr, val_len, ttl_s) };
+        rc_to_unit(rc, "kv_set")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = (key, value, ttl_s);
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "kv_set",
+        })
+    }
+}
+
+pub fn kv_delete(key: &str) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (key_ptr, key_len) = cast_ptr_len(key.as_bytes());
+        let rc = unsafe { spear_wasm_sys::kv_delete(key_ptr, key_len) };
+        rc_to_unit(rc, "kv_delete")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = key;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "kv_delete",
+        })
+    }
+}
+
+/// Task keys starting with `prefix` as a JSON array / 以 JSON 数组返回以 `prefix` 开头的任务键
+pub fn kv_list(prefix: &str) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (prefix_ptr, prefix_len) = cast_ptr_len(prefix.as_bytes());
+        recv_alloc_with(
+            "kv_list",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::kv_list(prefix_ptr, prefix_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = prefix;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "kv_list",
+        })
+    }
+}
+
+fn mp_unsupported<T>(op: &'static str) -> Result<T, SpearError> {
+    Err(SpearError {
+        code: "unsupported_target",
+        errno: -libc::ENOSYS,
+        op,
+    })
+}
+
+/// Register a name for this instance's mailbox; returns the mailbox id
+/// 为本实例的邮箱注册名称；返回邮箱 ID
+pub fn mp_register(name: &str) -> Result<u32, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (name_ptr, name_len) = cast_ptr_len(name.as_bytes());
+        let rc = unsafe { spear_wasm_sys::mp_register(name_ptr, name_len) };
+        rc_to_result(rc, "mp_register").map(|id| id as u32)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = name;
+        mp_unsupported("mp_register")
+    }
+}
+
+/// Mailbox id registered under `name` / 以 `name` 注册的邮箱 ID
+pub fn mp_lookup(name: &str) -> Result<u32, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (name_ptr, name_len) = cast_ptr_len(name.as_bytes());
+        let rc = unsafe { spear_wasm_sys::mp_lookup(name_ptr, name_len) };
+        rc_to_result(rc, "mp_lookup").map(|id| id as u32)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = name;
+        mp_unsupported("mp_lookup")
+    }
+}
+
+/// Queue a message for a mailbox; returns the message id / 向邮箱发送消息；返回消息 ID
+pub fn mp_send(mailbox: u32, msg: &[u8]) -> Result<u32, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (msg_ptr, msg_len) = cast_ptr_len(msg);
+        let rc = unsafe { spear_wasm_sys::mp_send(mailbox as i32, msg_ptr, msg_len) };
+        rc_to_result(rc, "mp_send").map(|id| id as u32)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = (mailbox, msg);
+        mp_unsupported("mp_send")
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MpMessage {
+    pub id: u32,
+    /// Sender's mailbox, 0 when it has none / 发送方的邮箱，无邮箱时为 0
+    pub from: u32,
+    pub data: Vec<u8>,
+}
+
+/// Next message of this instance's mailbox; `timeout_ms` of 0 polls and a negative one waits
+/// until a message arrives; returns `None` when none arrived in time
+/// 本实例邮箱中的下一条消息；`timeout_ms` 为 0 时轮询，负数时一直等待；超时未收到消息时返回 `None`
+pub fn mp_recv(timeout_ms: i32) -> Result<Option<MpMessage>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let mut meta = [0u32; 2];
+        let meta_ptr = meta.as_mut_ptr() as usize as i32;
+        let data = recv_alloc_with(
+            "mp_recv",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::mp_recv(meta_ptr, out_ptr_i32, out_len_ptr_i32, timeout_ms)
+            },
+            1024,
+            3,
+        );
+        match data {
+            Ok(data) => Ok(Some(MpMessage {
+                id: meta[0],
+                from: meta[1],
+                data,
+            })),
+            Err(e)
+                if e.errno == -constants::SPEAR_EAGAIN
+                    || e.errno == -constants::SPEAR_ETIMEDOUT =>
+            {
+                Ok(None)
+            }
+            Err(e) => Err(e),
+        }
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = timeout_ms;
+        mp_unsupported("mp_recv")
+    }
+}
+
+/// Acknowledge a received message / 确认已接收的消息
+pub fn mp_ack(msg_id: u32) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let rc = unsafe { spear_wasm_sys::mp_ack(msg_id as i32) };
+        rc_to_unit(rc, "mp_ack")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = msg_id;
+        mp_unsupported("mp_ack")
+    }
+}
+
+/// Wait until the receiver acknowledges a sent message; fails with `-EPIPE` when its
+/// mailbox went away first
+/// 等待接收方确认已发送的消息；接收方邮箱先行消失时以 `-EPIPE` 失败
+pub fn mp_wait_ack(msg_id: u32, timeout_ms: i32) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let rc = unsafe { spear_wasm_sys::mp_wait_ack(msg_id as i32, timeout_ms) };
+        rc_to_unit(rc, "mp_wait_ack")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = (msg_id, timeout_ms);
+        mp_unsupported("mp_wait_ack")
+    }
+}
+
+/// Contents of a file in the task's scratch directory, or of `/mnt/<name>/...` in a shared
+/// mount
+/// 任务临时目录中文件的内容，或共享挂载中 `/mnt/<name>/...` 的内容
+pub fn file_read(path: &str) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (path_ptr, path_len) = cast_ptr_len(path.as_bytes());
+        recv_alloc_with(
+            "file_read",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::file_read(path_ptr, path_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            64 * 1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = path;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "file_read",
+        })
+    }
+}
+
+/// Create or replace a file, creating its parent directories / 创建或替换文件，并创建其父目录
+pub fn file_write(path: &str, data: &[u8]) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (path_ptr, path_len) = cast_ptr_len(path.as_bytes());
+        let (data_ptr, data_len) = cast_ptr_len(data);
+        let rc = unsafe { spear_wasm_sys::file_write(path_ptr, path_len, data_ptr, data_len) };
+        rc_to_unit(rc, "file_write")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = (path, data);
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "file_write",
+        })
+    }
+}
+
+/// Entries of a directory as a JSON array / 以 JSON 数组返回目录中的条目
+pub fn file_list(path: &str) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (path_ptr, path_len) = cast_ptr_len(path.as_bytes());
+        recv_alloc_with(
+            "file_list",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::file_list(path_ptr, path_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = path;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "file_list",
+        })
+    }
+}
+
+/// Delete a file, or a directory with its contents / 删除文件，或删除目录及其内容
+pub fn file_delete(path: &str) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (path_ptr, path_len) = cast_ptr_len(path.as_bytes());
+        let rc = unsafe { spear_wasm_sys::file_delete(path_ptr, path_len) };
+        rc_to_unit(rc, "file_delete")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = path;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "file_delete",
+        })
+    }
+}
+
+/// Start invoking another workload; `request` is JSON such as
+/// `{"task":"tts","method":"speak","input":"hello","stream":true}`. Returns a handle for
+/// [`invoke_next`].
+/// 开始调用另一个工作负载；`request` 为 JSON，例如
+/// `{"task":"tts","method":"speak","input":"hello","stream":true}`。返回供 [`invoke_next`] 使用的句柄。
+pub fn invoke_start(request: &[u8]) -> Result<u32, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        let rc = unsafe { spear_wasm_sys::invoke_start(req_ptr, req_len) };
+        rc_to_result(rc, "invoke_start").map(|h| h as u32)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "invoke_start",
+        })
+    }
+}
+
+/// Next event of a child as JSON, `None` when none arrived within `timeout_ms`. A `done`
+/// event is the last one and closes the handle.
+/// 以 JSON 返回子调用的下一个事件；`timeout_ms` 内没有事件时返回 `None`。`done` 事件是最后一个，
+/// 并会关闭句柄。
+pub fn invoke_next(handle: u32, timeout_ms: i32) -> Result<Option<Vec<u8>>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let event = recv_alloc_with(
+            "invoke_next",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::invoke_next(handle as i32, out_ptr_i32, out_len_ptr_i32, timeout_ms)
+            },
+            4 * 1024,
+            3,
+        );
+        match event {
+            Ok(event) => Ok(Some(event)),
+            Err(e)
+                if e.errno == -constants::SPEAR_EAGAIN
+                    || e.errno == -constants::SPEAR_ETIMEDOUT =>
+            {
+                Ok(None)
+            }
+            Err(e) => Err(e),
+        }
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = (handle, timeout_ms);
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "invoke_next",
+        })
+    }
+}
+
+/// Cancel a child invocation / 取消子调用
+pub fn invoke_cancel(handle: u32) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let rc = unsafe { spear_wasm_sys::invoke_cancel(handle as i32) };
+        rc_to_unit(rc, "invoke_cancel")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = handle;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "invoke_cancel",
+        })
+    }
+}
+
+/// Schedule a later invocation; `request` is JSON such as
+/// `{"input":"check the oven","delay_ms":600000}`. Without `task` the calling task is
+/// invoked again. Returns the schedule id.
+/// 计划一次稍后的调用；`request` 为 JSON，例如 `{"input":"check the oven","delay_ms":600000}`。
+/// 未指定 `task` 时再次调用调用方任务。返回计划 ID。
+pub fn schedule_create(request: &[u8]) -> Result<String, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        let id = recv_alloc_with(
+            "schedule_create",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::schedule_create(req_ptr, req_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            64,
+            3,
+        )?;
+        Ok(String::from_utf8_lossy(&id).into_owned())
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "schedule_create",
+        })
+    }
+}
+
+/// Cancel one of the task's schedules / 取消任务的一个计划
+pub fn schedule_cancel(id: &str) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (id_ptr, id_len) = cast_ptr_len(id.as_bytes());
+        let rc = unsafe { spear_wasm_sys::schedule_cancel(id_ptr, id_len) };
+        rc_to_unit(rc, "schedule_cancel")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = id;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "schedule_cancel",
+        })
+    }
+}
+
+/// The task's schedules as a JSON array / 以 JSON 数组返回任务的计划
+pub fn schedule_list() -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        recv_alloc_with(
+            "schedule_list",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::schedule_list(out_ptr_i32, out_len_ptr_i32)
+            },
+            1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "schedule_list",
+        })
+    }
+}
+
+/// Run a configured ONNX model; `request` and the result are JSON
+/// 运行已配置的 ONNX 模型；`request` 与结果均为 JSON
+pub fn onnx_infer(request: &[u8]) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (req_ptr, req_len) = cast_ptr_len(request);
+        recv_alloc_with(
+            "onnx_infer",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::onnx_infer(req_ptr, req_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            4096,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = request;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "onnx_infer",
+        })
+    }
+}
+
+/// Echo bytes through the host (test harness)
+/// 经由宿主回显字节（测试工具）
+pub fn test_echo(input: &[u8]) -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let (in_ptr, in_len) = cast_ptr_len(input);
+        recv_alloc_with(
+            "test_echo",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::test_echo(in_ptr, in_len, out_ptr_i32, out_len_ptr_i32)
+            },
+            input.len().max(64),
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = input;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "test_echo",
+        })
+    }
+}
+
+/// Ask the host to fail with `errno` (test harness)
+/// 请求宿主以 `errno` 失败（测试工具）
+pub fn test_fail(errno: i32) -> Result<(), SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let rc = unsafe { spear_wasm_sys::test_fail(errno) };
+        rc_to_unit(rc, "test_fail")
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = errno;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "test_fail",
+        })
+    }
+}
+
+/// Block in the host for `ms` and return the observed latency (test harness)
+/// 在宿主中阻塞 `ms` 毫秒并返回实际耗时（测试工具）
+pub fn test_latency(ms: u32) -> Result<u64, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        let rc = unsafe { spear_wasm_sys::test_latency(ms.min(i32::MAX as u32) as i32) };
+        if rc < 0 {
+            let errno = rc as i32;
+            return Err(SpearError {
+                code: errno_to_code(errno),
+                errno,
+                op: "test_latency",
+            });
+        }
+        Ok(rc as u64)
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        let _ = ms;
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "test_latency",
+        })
+    }
+}
+
+/// Host state snapshot as JSON bytes (test harness)
+/// 宿主状态快照的 JSON 字节（测试工具）
+pub fn test_state() -> Result<Vec<u8>, SpearError> {
+    #[cfg(target_arch = "wasm32")]
+    {
+        recv_alloc_with(
+            "test_state",
+            |out_ptr, out_len| unsafe {
+                let out_ptr_i32 = out_ptr as usize as i32;
+                let out_len_ptr_i32 = (out_len as *mut u32) as usize as i32;
+                spear_wasm_sys::test_state(out_ptr_i32, out_len_ptr_i32)
+            },
+            1024,
+            3,
+        )
+    }
+
+    #[cfg(not(target_arch = "wasm32"))]
+    {
+        Err(SpearError {
+            code: "unsupported_target",
+            errno: -libc::ENOSYS,
+            op: "test_state",
+        })
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -558,6 +1793,7 @@ mod tests {
         assert_eq!(errno_to_code(-constants::SPEAR_EBADF), "invalid_fd");
         assert_eq!(errno_to_code(-constants::SPEAR_ENOSPC), "buffer_too_small");
         assert_eq!(errno_to_code(-constants::SPEAR_EAGAIN), "eagain");
+        assert_eq!(errno_to_code(-constants::SPEAR_EFBIG), "too_large");
     }
 
     #[test]
@@ -0,0 +1,138 @@
+//! SPEAR platform simulator main entry point
+//! SPEAR 平台模拟器主入口点
+
+use clap::Parser;
+use spear_next::config::init_tracing;
+use spear_next::sms::execution_logs::init_execution_logs_dir;
+use spear_next::sms::grpc_server::GrpcServer;
+use spear_next::sms::http_gateway::HttpGateway;
+use spear_next::sms::platform_sim::{self, SimArgs, SimPlan};
+use spear_next::sms::service::SmsServiceImpl;
+use spear_next::sms::services::{NodeService, ResourceService};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::sync::RwLock;
+
+#[tokio::main]
+async fn main() -> Result<(), Box<dyn std::error::Error>> {
+    let args = SimArgs::parse();
+    let plan = SimPlan::new(&args)?;
+    let config = Arc::new(plan.sms_config(&args.log_level));
+
+    std::env::set_var("SMS_FILES_DIR", config.files_dir.as_str());
+    init_execution_logs_dir(&config.execution_logs_dir);
+    init_tracing(&config.logging.to_logging_config()).unwrap();
+    plan.write_configs()?;
+
+    // Platform: an SMS whose nodes live in memory / 平台：节点保存在内存中的 SMS
+    let sms_service = SmsServiceImpl::new(
+        Arc::new(RwLock::new(NodeService::new())),
+        Arc::new(ResourceService::new()),
+        config.clone(),
+    )
+    .await;
+    let sms_for_liveness = sms_service.clone();
+
+    let grpc_server = GrpcServer::new(config.grpc.addr, sms_service);
+    let (shutdown_tx_grpc, shutdown_rx_grpc) = tokio::sync::oneshot::channel::<()>();
+    let grpc_handle = tokio::spawn(async move {
+        if let Err(e) = grpc_server
+            .start_with_shutdown(async move {
+                let _ = shutdown_rx_grpc.await;
+            })
+            .await
+        {
+            tracing::error!("gRPC server error: {}", e);
+        }
+    });
+
+    let http_gateway = HttpGateway::new(config.clone());
+    let (shutdown_tx_http, shutdown_rx_http) = tokio::sync::oneshot::channel::<()>();
+    let http_handle = tokio::spawn(async move {
+        if let Err(e) = http_gateway
+            .start_with_shutdown(async move {
+                let _ = shutdown_rx_http.await;
+            })
+            .await
+        {
+            tracing::error!("HTTP gateway error: {}", e);
+        }
+    });
+
+    let liveness_cfg = config.clone();
+    tokio::spawn(async move {
+        loop {
+            tokio::time::sleep(Duration::from_secs(liveness_cfg.cleanup_interval)).await;
+            sms_for_liveness
+                .refresh_node_liveness(liveness_cfg.heartbeat_timeout)
+                .await;
+        }
+    });
+
+    tracing::info!("Platform gRPC: {}", plan.sms_grpc);
+    tracing::info!("Platform HTTP: http://{}", plan.sms_http);
+
+    // Nodes / 节点
+    let bin = platform_sim::spearlet_bin(args.spearlet_bin.as_deref());
+    let mut nodes = Vec::new();
+    for node in &plan.nodes {
+        let child = platform_sim::spawn_node(&bin, node, &args.log_level)
+            .map_err(|e| format!("starting {} ({}): {}", node.name, bin.display(), e))?;
+        tracing::info!(
+            node = %node.name,
+            grpc = %node.grpc_addr,
+            http = %node.url(),
+            config = %node.config_path().display(),
+            "Simulated spearlet started"
+        );
+        nodes.push((node.name.clone(), child, false));
+    }
+    if plan.nodes.is_empty() {
+        tracing::info!(
+            "No nodes started; point spearlets at the platform with --sms-grpc-addr {} --sms-http-addr {}",
+            plan.sms_grpc,
+            plan.sms_http
+        );
+    }
+
+    // Report nodes that exit until interrupted / 持续报告退出的节点直到被中断
+    let ctrl_c = tokio::signal::ctrl_c();
+    tokio::pin!(ctrl_c);
+    loop {
+        tokio::select! {
+            _ = &mut ctrl_c => break,
+            _ = tokio::time::sleep(Duration::from_secs(1)) => {}
+        }
+        for (name, child, exited) in nodes.iter_mut() {
+            if *exited {
+                continue;
+            }
+            if let Ok(Some(status)) = child.try_wait() {
+                tracing::warn!(node = %name, status = %status, "Simulated spearlet exited");
+                *exited = true;
+            }
+        }
+    }
+
+    // Ctrl-C reaches the nodes too; give them time to deregister
+    // Ctrl-C 同样会发送到节点；给它们注销的时间
+    tracing::info!("Platform simulator shutting down");
+    for (name, child, _) in nodes.iter_mut() {
+        if tokio::time::timeout(Duration::from_secs(10), child.wait())
+            .await
+            .is_err()
+        {
+            tracing::warn!(node = %name, "Simulated spearlet did not stop, killing it");
+            let _ = child.kill().await;
+        }
+    }
+    let _ = shutdown_tx_grpc.send(());
+    let _ = shutdown_tx_http.send(());
+    let _ = tokio::time::timeout(Duration::from_secs(5), async {
+        let _ = grpc_handle.await;
+        let _ = http_handle.await;
+    })
+    .await;
+
+    Ok(())
+}
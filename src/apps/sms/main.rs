@@ -120,21 +120,8 @@ async fn main() -> Result<(), Box<dyn std::error::Error>> {
         let interval_secs = cleanup_cfg.cleanup_interval;
         loop {
             tokio::time::sleep(std::time::Duration::from_secs(interval_secs)).await;
-            let now = chrono::Utc::now().timestamp();
-            let timeout = cleanup_cfg.heartbeat_timeout as i64;
-            let node_service = sms_service_for_cleanup.node_service();
-            let mut ns = node_service.write().await;
-            let mut changed = 0u64;
-            let nodes = ns.list_nodes().await.unwrap_or_default();
-            for mut n in nodes {
-                let stale = now - n.last_heartbeat > timeout;
-                let new_status = if stale { "offline" } else { "online" };
-                if n.status != new_status {
-                    n.status = new_status.to_string();
-                    let _ = ns.update_node(n).await;
-                    changed += 1;
-                }
-            }
+            let timeout = cleanup_cfg.heartbeat_timeout;
+            let changed = sms_service_for_cleanup.refresh_node_liveness(timeout).await;
             if changed > 0 {
                 tracing::debug!(
                     "Cleanup updated node statuses, changed={} (timeout={}s)",
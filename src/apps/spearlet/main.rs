@@ -4,26 +4,52 @@
 use clap::Parser;
 use spear_next::config::init_tracing;
 use spear_next::spearlet::backend_reporter::BackendReporterService;
-use spear_next::spearlet::config::CliArgs;
-use spear_next::spearlet::grpc_server::GrpcServer;
-use spear_next::spearlet::http_gateway::HttpGateway;
-use spear_next::spearlet::local_models::{global_managed_backends, LocalModelController};
-use spear_next::spearlet::mcp::registry_sync::global_mcp_registry_sync_with_channel;
+use spear_next::spearlet::build_info;
+use spear_next::spearlet::clock;
+use spear_next::spearlet::config::{CliArgs, ConfigCommand, ExamplesCommand, SpearletCommand};
+use spear_next::spearlet::config_check;
+use spear_next::spearlet::crash;
+use spear_next::spearlet::debug_tunnel::DebugTunnel;
+use spear_next::spearlet::desired_state::DesiredStateReconciler;
+use spear_next::spearlet::device_profile;
+use spear_next::spearlet::embedded::Spearlet;
+use spear_next::spearlet::examples::{self, ExampleRunner, RunOptions};
+use spear_next::spearlet::local_models::{lifecycle as model_lifecycle, LocalModelController};
+use spear_next::spearlet::log_shipping::LogShipper;
+use spear_next::spearlet::metrics_export::MetricsExporter;
 use spear_next::spearlet::ollama_discovery::maybe_import_ollama_serving_models;
+use spear_next::spearlet::otel::init_global_tracer;
+use spear_next::spearlet::output_diff::{self, DiffRunner, DiffTarget};
 use spear_next::spearlet::registration::RegistrationService;
+use spear_next::spearlet::reload::{self, Reloader};
+use spear_next::spearlet::shutdown::{self, ShutdownDeadline};
 use spear_next::spearlet::sms_connector::sms_channel_lazy;
-use tonic::transport::Channel;
 
 use std::sync::Arc;
+use std::time::Duration;
 
 fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
     let args = CliArgs::parse();
+    if let Some(SpearletCommand::Version { features }) = &args.command {
+        print!("{}", build_info::render_version(*features));
+        return Ok(());
+    }
+    if let Some(SpearletCommand::Config { action }) = &args.command {
+        return run_config(&args, action);
+    }
+    if let Some(SpearletCommand::Examples { action }) = &args.command {
+        return run_examples(&args, action);
+    }
+    if let Some(SpearletCommand::Diff { .. }) = &args.command {
+        return run_diff(&args);
+    }
     let log_args = format!("{:?}", args);
 
     let app_cfg = spear_next::spearlet::config::AppConfig::load_with_cli(&args)?;
     let spearlet_cfg = app_cfg.spearlet;
 
     init_tracing(&spearlet_cfg.logging.to_logging_config()).unwrap();
+    crash::install_panic_hook(&spearlet_cfg);
 
     let max_blocking_threads = spearlet_cfg.max_blocking_threads.max(1);
     let runtime = tokio::runtime::Builder::new_multi_thread()
@@ -34,11 +60,135 @@ fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
     runtime.block_on(run(args, log_args, spearlet_cfg))
 }
 
+fn run_config(
+    args: &CliArgs,
+    action: &ConfigCommand,
+) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    let ConfigCommand::Validate { strict } = action;
+    let cfg = spear_next::spearlet::config::AppConfig::load_with_cli(args)?.spearlet;
+    let mut report = config_check::validate(&cfg);
+    if let Some(path) = &args.config {
+        let value =
+            spear_next::spearlet::config::AppConfig::file_value(std::path::Path::new(path))?;
+        for key in config_check::unknown_keys(&value) {
+            report.warnings.push(format!("unknown key: {}", key));
+        }
+    }
+    print!("{}", report.render());
+    let source = args
+        .config
+        .as_deref()
+        .unwrap_or("defaults, ~/.spear/config.toml and env");
+    if !report.is_ok(*strict) {
+        return Err(format!(
+            "{}: {} error(s), {} warning(s)",
+            source,
+            report.errors.len(),
+            report.warnings.len()
+        )
+        .into());
+    }
+    println!("{}: OK ({} warning(s))", source, report.warnings.len());
+    Ok(())
+}
+
+fn run_examples(
+    args: &CliArgs,
+    action: &ExamplesCommand,
+) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    match action {
+        ExamplesCommand::List { repo_root } => {
+            let samples_dir = std::path::Path::new(repo_root).join("samples");
+            print!("{}", examples::render_catalog(&samples_dir));
+            Ok(())
+        }
+        ExamplesCommand::Run {
+            name,
+            repo_root,
+            no_build,
+            payload,
+            api_key,
+        } => {
+            let example = examples::find_example(name).ok_or_else(|| {
+                format!("unknown example: {} (see `spearlet examples list`)", name)
+            })?;
+            let cfg = spear_next::spearlet::config::AppConfig::load_with_cli(args)?.spearlet;
+            let opts = RunOptions {
+                repo_root: repo_root.into(),
+                build: !no_build,
+                payload: payload.clone(),
+                api_key: api_key
+                    .clone()
+                    .or_else(|| std::env::var("SPEARLET_API_KEY").ok()),
+            };
+            let runtime = tokio::runtime::Builder::new_current_thread()
+                .enable_all()
+                .build()?;
+            let out = runtime.block_on(ExampleRunner::new(&cfg).run(example, &opts))?;
+            println!("{}", out);
+            Ok(())
+        }
+    }
+}
+
+fn run_diff(args: &CliArgs) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    let Some(SpearletCommand::Diff {
+        workload_a,
+        workload_b,
+        payloads,
+        metadata_a,
+        metadata_b,
+        format,
+        out,
+        fail_on_change,
+        api_key,
+    }) = &args.command
+    else {
+        return Ok(());
+    };
+    if format != "text" && format != "json" {
+        return Err(format!("unknown format: {} (expected text or json)", format).into());
+    }
+    let payloads = output_diff::load_payloads(std::path::Path::new(payloads))?;
+    let a = DiffTarget {
+        workload: workload_a.clone(),
+        metadata: output_diff::parse_metadata(metadata_a)?,
+    };
+    let b = DiffTarget {
+        workload: workload_b.clone().unwrap_or_else(|| workload_a.clone()),
+        metadata: output_diff::parse_metadata(metadata_b)?,
+    };
+    let cfg = spear_next::spearlet::config::AppConfig::load_with_cli(args)?.spearlet;
+    let api_key = api_key
+        .clone()
+        .or_else(|| std::env::var("SPEARLET_API_KEY").ok());
+    let runtime = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()?;
+    let report = runtime.block_on(DiffRunner::from_config(&cfg, api_key).run(&a, &b, &payloads));
+    let rendered = if format == "json" {
+        serde_json::to_string_pretty(&report)?
+    } else {
+        report.render_text()
+    };
+    match out {
+        Some(path) => std::fs::write(path, rendered)?,
+        None => print!("{}", rendered),
+    }
+    if *fail_on_change && report.changed > 0 {
+        return Err(format!("{} of {} outputs changed", report.changed, report.total).into());
+    }
+    Ok(())
+}
+
 async fn run(
     args: CliArgs,
     log_args: String,
     mut spearlet_cfg: spear_next::spearlet::config::SpearletConfig,
 ) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    // Reloads compare against the files, before startup-only additions
+    // 重新加载与文件内容比较，不含仅在启动时添加的内容
+    let loaded_cfg = spearlet_cfg.clone();
     if spearlet_cfg.llm.discovery.ollama.enabled {
         match maybe_import_ollama_serving_models(&mut spearlet_cfg).await {
             Ok(n) => {
@@ -70,56 +220,28 @@ async fn run(
         Some(sms_channel_lazy(&config)?)
     };
 
-    global_mcp_registry_sync_with_channel(config.clone(), sms_channel.clone());
-
-    let grpc_server = GrpcServer::new(config.clone(), sms_channel.clone()).await?;
-    let (shutdown_tx_grpc, shutdown_rx_grpc) = tokio::sync::oneshot::channel::<()>();
-
-    let object_service = grpc_server.get_object_service();
-    let function_service = grpc_server.get_function_service();
-    let health_service = spear_next::spearlet::grpc_server::HealthService::new(
-        object_service,
-        function_service.clone(),
-    );
-
-    let grpc_handle = tokio::spawn(async move {
-        if let Err(e) = grpc_server
-            .start_with_shutdown(async move {
-                let _ = shutdown_rx_grpc.await;
-            })
-            .await
-        {
-            tracing::error!("gRPC server error: {}", e);
-        }
-    });
-
-    let grpc_channel = Channel::from_shared(format!("http://{}", config.grpc.addr))?.connect_lazy();
-
-    let http_gateway = HttpGateway::new(
-        config.clone(),
-        Arc::new(health_service),
-        function_service.clone(),
-        spear_next::proto::spearlet::object_service_client::ObjectServiceClient::new(
-            grpc_channel.clone(),
-        ),
-        spear_next::proto::spearlet::invocation_service_client::InvocationServiceClient::new(
-            grpc_channel.clone(),
-        ),
-        spear_next::proto::spearlet::execution_service_client::ExecutionServiceClient::new(
-            grpc_channel,
-        ),
-    );
-    let (shutdown_tx_http, shutdown_rx_http) = tokio::sync::oneshot::channel::<()>();
-    let http_handle = tokio::spawn(async move {
-        if let Err(e) = http_gateway
-            .start_with_shutdown(async move {
-                let _ = shutdown_rx_http.await;
-            })
-            .await
-        {
-            tracing::error!("HTTP gateway error: {}", e);
-        }
-    });
+    if init_global_tracer(&config.otel).is_some() {
+        tracing::info!("  - OTLP trace export to: {}", config.otel.otlp_endpoint);
+    }
+    let log_shipper = LogShipper::new(config.clone());
+    log_shipper.start();
+    if crash::start_reporter(&config.crash).is_some() {
+        tracing::info!("  - Crash reports sent to Sentry");
+    }
+    clock::start_monitor(&config.clock);
+    for problem in device_profile::validate(&config.devices) {
+        tracing::warn!("Device profile: {}", problem);
+    }
+    if config.onnx.enabled {
+        tracing::info!("  - ONNX models: {}", config.onnx.models.len());
+    }
+    if config.model_store.enabled {
+        tracing::info!(
+            "  - Model store: {} models in {}",
+            config.model_store.models.len(),
+            model_lifecycle::store_dir(&config).display()
+        );
+    }
 
     let connect_requested = config.auto_register
         || args.sms_grpc_addr.is_some()
@@ -127,9 +249,56 @@ async fn run(
             .ok()
             .map(|v| !v.is_empty())
             .unwrap_or(false);
+    let mut builder = Spearlet::builder().with_config((*config).clone());
+    if let Some(channel) = sms_channel.clone() {
+        builder = builder.with_sms_channel(channel);
+    }
+    let spearlet = builder.build().await?;
+    let managed_backends = spearlet.node().managed_backends.clone();
+    // Backend services come up before the runtimes that call them (see `lifecycle`)
+    // 后端服务先于调用它们的运行时启动（见 `lifecycle`）
+    let local_models = connect_requested.then(|| {
+        let c = LocalModelController::new(
+            config.clone(),
+            sms_channel.clone(),
+            managed_backends.clone(),
+        );
+        c.start();
+        c
+    });
+
+    spearlet.start();
+    if config.energy.enabled {
+        let level = spearlet.node().energy.level().as_str();
+        tracing::info!("  - Energy level: {}", level);
+    }
+    let function_service = spearlet.function_service();
+
+    let reload_args = args.clone();
+    let reloader = Reloader::new(
+        Box::new(move || {
+            spear_next::spearlet::config::AppConfig::load_with_cli(&reload_args)
+                .map(|c| c.spearlet)
+                .map_err(|e| e.to_string())
+        }),
+        spear_next::spearlet::config::AppConfig::config_file(&args),
+        loaded_cfg,
+        function_service.get_execution_manager(),
+    );
+    reload::start(reloader).await;
+    if !config.reload.workloads_dir.is_empty() {
+        tracing::info!("  - Workloads from: {}", config.reload.workloads_dir);
+    }
+    let desired_state =
+        DesiredStateReconciler::new(config.clone(), function_service.get_execution_manager());
+    desired_state.start();
+
+    spearlet.serve()?;
+
+    let mut background_services = None;
     if connect_requested {
-        let managed_backends = global_managed_backends();
-        let registration_service = RegistrationService::new(config.clone(), sms_channel.clone());
+        let registration_service = RegistrationService::new(config.clone(), sms_channel.clone())
+            .with_node(spearlet.node().clone());
         if let Err(e) = registration_service.start().await {
             tracing::error!("Registration service start failed: {}", e);
             return Err(e);
@@ -146,28 +315,67 @@ async fn run(
         );
         subscriber.start().await;
 
-        let local_models = LocalModelController::new(
+        let backend_reporter = BackendReporterService::new(
             config.clone(),
             sms_channel.clone(),
-            managed_backends.clone(),
+            Some(managed_backends),
         );
-        local_models.start();
+        backend_reporter.start();
 
-        let backend_reporter = BackendReporterService::new(
+        let metrics_exporter = MetricsExporter::new(
             config.clone(),
             sms_channel.clone(),
-            Some(managed_backends),
+            Some(function_service.get_execution_manager()),
         );
-        backend_reporter.start();
+        metrics_exporter.start();
+
+        let debug_tunnel = DebugTunnel::new(config.clone(), sms_channel.clone())
+            .with_node(spearlet.node().clone());
+        debug_tunnel.start();
+        background_services = Some((
+            registration_service,
+            backend_reporter,
+            metrics_exporter,
+            debug_tunnel,
+        ));
     }
 
-    tokio::signal::ctrl_c().await?;
-    tracing::info!("SPEARlet shutting down");
-    let _ = shutdown_tx_grpc.send(());
-    let _ = shutdown_tx_http.send(());
-    let _ = grpc_handle.await;
-    let _ = http_handle.await;
+    let signal = shutdown::wait_for_signal().await;
+    tracing::info!(
+        signal,
+        timeout_ms = config.shutdown_timeout_ms,
+        "SPEARlet shutting down"
+    );
+    shutdown::exit_on_second_signal();
+    let deadline = ShutdownDeadline::new(Duration::from_millis(config.shutdown_timeout_ms));
+
+    // Stop accepting work and drain in-flight requests / 停止接收新工作并排空进行中的请求
+    spearlet.stop_serving(&deadline).await;
+
+    if let Some((registration_service, backend_reporter, metrics_exporter, debug_tunnel)) =
+        background_services
+    {
+        debug_tunnel.shutdown();
+        metrics_exporter.shutdown();
+        registration_service.shutdown();
+        backend_reporter.shutdown();
+    }
+
+    desired_state.shutdown();
+
+    // Stop workload instances and their runtimes / 停止工作负载实例及其运行时
+    let stopped = spearlet.stop(&deadline).await;
+    tracing::info!(stopped, "Workload instances stopped");
+
+    // Backend services outlive the runtimes that call them / 后端服务在调用它们的运行时之后停止
+    if let Some(local_models) = local_models {
+        deadline
+            .run("stop backend services", local_models.stop())
+            .await;
+    }
 
     tracing::info!("SPEARlet shutdown complete");
+    // Last, so the shutdown itself is shipped / 最后执行，使关闭过程本身也被投递
+    deadline.run("flush logs", log_shipper.shutdown()).await;
     Ok(())
 }
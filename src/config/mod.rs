@@ -110,7 +110,7 @@ impl Default for NetworkConfig {
 pub struct LoggingConfig {
     /// Log level (trace, debug, info, warn, error) / 日志级别
     pub level: String,
-    /// Log format (json, pretty) / 日志格式
+    /// Log format (json, text, compact, pretty) / 日志格式
     pub format: String,
     /// Enable file logging / 启用文件日志
     pub file_enabled: bool,
@@ -144,7 +144,10 @@ pub fn init_tracing(config: &LoggingConfig) -> Result<()> {
         }
     });
 
-    let registry = tracing_subscriber::registry().with(env_filter);
+    // Inert until the spearlet starts log shipping / 在 spearlet 启动日志投递前不做任何事
+    let registry = tracing_subscriber::registry()
+        .with(env_filter)
+        .with(crate::spearlet::log_shipping::ShipLayer);
 
     let file_writer = if config.file_enabled {
         if let Some(path) = config.file_path.as_ref() {
@@ -182,7 +185,8 @@ pub fn init_tracing(config: &LoggingConfig) -> Result<()> {
                 .with_writer(file_writer);
             registry.with(stdout_layer).with(file_layer).init();
         }
-        ("compact", Some(file_writer)) => {
+        // `text` is one line per event / `text` 每个事件一行
+        ("compact" | "text", Some(file_writer)) => {
             let stdout_layer = tracing_subscriber::fmt::layer()
                 .compact()
                 .with_target(true)
@@ -218,7 +222,7 @@ pub fn init_tracing(config: &LoggingConfig) -> Result<()> {
                 .with_level(true);
             registry.with(stdout_layer).init();
         }
-        ("compact", None) => {
+        ("compact" | "text", None) => {
             let stdout_layer = tracing_subscriber::fmt::layer()
                 .compact()
                 .with_target(true)
@@ -10,3 +10,9 @@ pub mod spearlet {
     //! Spearlet service protobuf definitions / Spearlet服务protobuf定义
     tonic::include_proto!("spearlet");
 }
+
+#[cfg(feature = "rt-asr")]
+pub mod google_speech {
+    //! Google Speech-to-Text v1 streaming client / Google Speech-to-Text v1 流式客户端
+    tonic::include_proto!("google.cloud.speech.v1");
+}
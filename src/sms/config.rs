@@ -81,10 +81,20 @@ pub struct CliArgs {
     )]
     pub log_level: Option<String>,
 
-    #[arg(long, value_name = "FORMAT")]
+    /// Log format / 日志格式
+    #[arg(
+        long,
+        value_name = "FORMAT",
+        help = "Log format (json, text, compact, pretty) / 日志格式"
+    )]
     pub log_format: Option<String>,
 
-    #[arg(long, value_name = "FILE")]
+    /// Also write logs to this file / 同时将日志写入该文件
+    #[arg(
+        long,
+        value_name = "FILE",
+        help = "Also write logs to this file / 同时将日志写入该文件"
+    )]
     pub log_file: Option<String>,
 
     /// Heartbeat timeout in seconds / 心跳超时时间（秒）
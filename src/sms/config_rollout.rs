@@ -0,0 +1,519 @@
+//! Canary configuration rollouts / 金丝雀配置发布
+//!
+//! An admin starts a rollout of a configuration overlay with a list of stages, each a
+//! percent of the fleet. The overlay is handed to the canary nodes of the current stage in
+//! their heartbeat responses, while every other node keeps the overlay of the last completed
+//! rollout. Canary nodes report the executions that finished and failed since they applied
+//! the overlay. A stage advances once it was held for `stage_hold_s` and served
+//! `min_executions`; the rollout halts, and canary nodes revert, when their error rate
+//! exceeds `max_error_rate` or a node rejects the overlay. Rollouts are kept in memory.
+//! 管理员以阶段列表开始配置覆盖的发布，每个阶段为集群节点的百分比。覆盖通过心跳响应交给当前阶段的
+//! 金丝雀节点，其余节点保持最近一次完成的发布的覆盖。金丝雀节点上报自应用覆盖以来完成与失败的执行
+//! 次数。阶段保持 `stage_hold_s` 且服务了 `min_executions` 次执行后进入下一阶段；金丝雀节点的错误率
+//! 超过 `max_error_rate` 或有节点拒绝覆盖时，发布中止且金丝雀节点回退。发布仅保存在内存中。
+
+use std::collections::HashMap;
+
+use parking_lot::Mutex;
+use sha2::{Digest, Sha256};
+use tonic::Status;
+use tracing::{info, warn};
+use uuid::Uuid;
+
+use crate::proto::sms::{ConfigRollout, ConfigRolloutAssignment, StartConfigRolloutRequest};
+use crate::sms::debug_tunnel::AUDIT_TARGET;
+use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::config_rollout::{
+    HEALTH_ERROR, HEALTH_EXECUTIONS, HEALTH_FAILURES, HEALTH_ROLLOUT_ID,
+};
+use crate::spearlet::reload;
+
+/// Stages when the admin gives none, in percent of the fleet
+/// 管理员未指定时的阶段，以集群节点百分比表示
+pub const DEFAULT_STAGES: &[u32] = &[5, 25, 100];
+
+pub const DEFAULT_STAGE_HOLD_S: u64 = 300;
+
+pub const DEFAULT_MAX_ERROR_RATE: f64 = 0.05;
+
+pub const DEFAULT_MIN_EXECUTIONS: u64 = 10;
+
+pub const STATUS_RUNNING: &str = "running";
+pub const STATUS_HALTED: &str = "halted";
+pub const STATUS_COMPLETED: &str = "completed";
+
+/// Nodes that sent a heartbeat this recently make up the fleet
+/// 最近在该时间内发送过心跳的节点构成集群
+const FLEET_WINDOW_MS: i64 = 5 * 60 * 1000;
+
+/// Finished rollouts kept for listing / 保留以供列出的已结束发布
+const MAX_HISTORY: usize = 50;
+
+#[derive(Debug, Default)]
+struct NodeReport {
+    executions: u64,
+    failures: u64,
+    error: Option<String>,
+}
+
+#[derive(Debug, Default)]
+struct State {
+    /// Oldest first / 最早的在前
+    rollouts: Vec<ConfigRollout>,
+    /// Last heartbeat of each node, in ms / 每个节点最近一次心跳，单位毫秒
+    fleet: HashMap<String, i64>,
+    /// Reports of canary nodes on the running rollout / 金丝雀节点对进行中发布的上报
+    reports: HashMap<String, NodeReport>,
+}
+
+impl State {
+    fn running(&self) -> Option<usize> {
+        self.rollouts
+            .iter()
+            .rposition(|r| r.status == STATUS_RUNNING)
+    }
+
+    /// The overlay every node runs outside of a canary stage / 金丝雀阶段之外所有节点运行的覆盖
+    fn baseline(&self) -> Option<usize> {
+        self.rollouts
+            .iter()
+            .rposition(|r| r.status == STATUS_COMPLETED)
+    }
+
+    fn trim_history(&mut self) {
+        while self.rollouts.len() > MAX_HISTORY {
+            let keep = (self.running(), self.baseline());
+            let Some(i) =
+                (0..self.rollouts.len()).find(|i| Some(*i) != keep.0 && Some(*i) != keep.1)
+            else {
+                return;
+            };
+            self.rollouts.remove(i);
+        }
+    }
+}
+
+/// Rank of a node in the canary order of a rollout / 节点在某次发布金丝雀顺序中的位次
+fn rank(rollout_id: &str, node_uuid: &str) -> [u8; 32] {
+    let mut h = Sha256::new();
+    h.update(rollout_id.as_bytes());
+    h.update(b":");
+    h.update(node_uuid.as_bytes());
+    h.finalize().into()
+}
+
+/// Canary nodes of a stage; at least one node once the fleet is not empty
+/// 某阶段的金丝雀节点数；集群非空时至少为一个节点
+fn canary_count(percent: u32, fleet: usize) -> usize {
+    if fleet == 0 {
+        return 0;
+    }
+    (percent as usize * fleet).div_ceil(100).max(1)
+}
+
+fn parse_report(health_info: &HashMap<String, String>) -> NodeReport {
+    let count = |key: &str| {
+        health_info
+            .get(key)
+            .and_then(|v| v.parse::<u64>().ok())
+            .unwrap_or(0)
+    };
+    NodeReport {
+        executions: count(HEALTH_EXECUTIONS),
+        failures: count(HEALTH_FAILURES),
+        error: health_info.get(HEALTH_ERROR).cloned(),
+    }
+}
+
+/// Check an overlay against the default spearlet configuration
+/// 以默认 spearlet 配置校验覆盖
+fn validate_overlay(overlay_json: &str) -> Result<(), String> {
+    let overlay: serde_json::Value =
+        serde_json::from_str(overlay_json).map_err(|e| format!("invalid overlay: {}", e))?;
+    if !overlay.as_object().is_some_and(|o| !o.is_empty()) {
+        return Err("overlay must be a non-empty JSON object".to_string());
+    }
+    let base = SpearletConfig::default();
+    let merged = reload::with_overlay(base.clone(), Some(&overlay))?;
+    let (_, restart) = reload::split_changes(&base, &merged);
+    if !restart.is_empty() {
+        return Err(format!(
+            "overlay changes settings that need a restart: {}",
+            restart.join(", ")
+        ));
+    }
+    Ok(())
+}
+
+fn validate_stages(stages: &[u32]) -> Result<(), String> {
+    if stages.iter().any(|p| *p == 0 || *p > 100) {
+        return Err("stages must be percents between 1 and 100".to_string());
+    }
+    if stages.windows(2).any(|w| w[0] >= w[1]) {
+        return Err("stages must increase".to_string());
+    }
+    if stages.last() != Some(&100) {
+        return Err("the last stage must be 100".to_string());
+    }
+    Ok(())
+}
+
+fn halt(r: &mut ConfigRollout, reason: String, now_ms: i64) {
+    r.status = STATUS_HALTED.to_string();
+    r.halt_reason = reason;
+    r.finished_at_ms = now_ms;
+}
+
+/// Rollouts started by admins and the fleet they go to / 管理员开始的发布及其目标集群
+#[derive(Debug, Default)]
+pub struct ConfigRolloutManager {
+    state: Mutex<State>,
+}
+
+impl ConfigRolloutManager {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Start a rollout; fails while another one is running / 开始发布；已有发布进行中时失败
+    pub fn start(
+        &self,
+        req: StartConfigRolloutRequest,
+        now_ms: i64,
+    ) -> Result<ConfigRollout, Status> {
+        validate_overlay(&req.overlay_json).map_err(Status::invalid_argument)?;
+        let stages = if req.stages.is_empty() {
+            DEFAULT_STAGES.to_vec()
+        } else {
+            req.stages
+        };
+        validate_stages(&stages).map_err(Status::invalid_argument)?;
+        if req.max_error_rate < 0.0 || req.max_error_rate > 1.0 {
+            return Err(Status::invalid_argument(
+                "max_error_rate must be between 0 and 1",
+            ));
+        }
+        let mut st = self.state.lock();
+        if let Some(i) = st.running() {
+            return Err(Status::failed_precondition(format!(
+                "rollout {} is still running",
+                st.rollouts[i].rollout_id
+            )));
+        }
+        let rollout = ConfigRollout {
+            rollout_id: Uuid::new_v4().to_string(),
+            overlay_json: req.overlay_json,
+            stages,
+            stage_hold_s: match req.stage_hold_s {
+                0 => DEFAULT_STAGE_HOLD_S,
+                s => s,
+            },
+            max_error_rate: if req.max_error_rate > 0.0 {
+                req.max_error_rate
+            } else {
+                DEFAULT_MAX_ERROR_RATE
+            },
+            min_executions: match req.min_executions {
+                0 => DEFAULT_MIN_EXECUTIONS,
+                n => n,
+            },
+            status: STATUS_RUNNING.to_string(),
+            operator: req.operator,
+            created_at_ms: now_ms,
+            stage_started_at_ms: now_ms,
+            ..Default::default()
+        };
+        info!(
+            target: AUDIT_TARGET,
+            rollout_id = %rollout.rollout_id,
+            operator = %rollout.operator,
+            stages = ?rollout.stages,
+            overlay = %rollout.overlay_json,
+            "config rollout started"
+        );
+        st.reports.clear();
+        st.rollouts.push(rollout);
+        Self::evaluate(&mut st, now_ms);
+        st.trim_history();
+        let i = st.running().unwrap_or(st.rollouts.len() - 1);
+        Ok(st.rollouts[i].clone())
+    }
+
+    /// Halt a running rollout; its canary nodes revert / 中止进行中的发布；其金丝雀节点回退
+    pub fn halt(
+        &self,
+        rollout_id: &str,
+        reason: &str,
+        now_ms: i64,
+    ) -> Result<ConfigRollout, Status> {
+        let mut st = self.state.lock();
+        let r = st
+            .rollouts
+            .iter_mut()
+            .find(|r| r.rollout_id == rollout_id)
+            .ok_or_else(|| Status::not_found(format!("rollout {} not found", rollout_id)))?;
+        if r.status != STATUS_RUNNING {
+            return Err(Status::failed_precondition(format!(
+                "rollout {} is {}",
+                rollout_id, r.status
+            )));
+        }
+        let reason = match reason.trim() {
+            "" => "halted by an admin".to_string(),
+            other => other.to_string(),
+        };
+        info!(target: AUDIT_TARGET, rollout_id, reason = %reason, "config rollout halted");
+        halt(r, reason, now_ms);
+        let r = r.clone();
+        st.reports.clear();
+        Ok(r)
+    }
+
+    /// Rollouts, newest first / 发布列表，最新的在前
+    pub fn list(&self, now_ms: i64) -> Vec<ConfigRollout> {
+        let mut st = self.state.lock();
+        Self::evaluate(&mut st, now_ms);
+        st.rollouts.iter().rev().cloned().collect()
+    }
+
+    /// Record a heartbeat and return the overlay the node should run; `None` before any rollout
+    /// 记录心跳并返回节点应运行的覆盖；尚无任何发布时为 `None`
+    pub fn heartbeat(
+        &self,
+        node_uuid: &str,
+        health_info: &HashMap<String, String>,
+        now_ms: i64,
+    ) -> Option<ConfigRolloutAssignment> {
+        let mut st = self.state.lock();
+        st.fleet.insert(node_uuid.to_string(), now_ms);
+        if st.rollouts.is_empty() {
+            return None;
+        }
+        if let Some(i) = st.running() {
+            let r = &st.rollouts[i];
+            let reported = health_info.get(HEALTH_ROLLOUT_ID) == Some(&r.rollout_id);
+            if reported && r.canary_nodes.iter().any(|n| n == node_uuid) {
+                let report = parse_report(health_info);
+                st.reports.insert(node_uuid.to_string(), report);
+            }
+        }
+        Self::evaluate(&mut st, now_ms);
+
+        let canary = st
+            .running()
+            .map(|i| &st.rollouts[i])
+            .filter(|r| r.canary_nodes.iter().any(|n| n == node_uuid));
+        let assigned = canary.or_else(|| st.baseline().map(|i| &st.rollouts[i]));
+        Some(match assigned {
+            Some(r) => ConfigRolloutAssignment {
+                rollout_id: r.rollout_id.clone(),
+                overlay_json: r.overlay_json.clone(),
+            },
+            None => ConfigRolloutAssignment::default(),
+        })
+    }
+
+    /// Grow the canary set, then halt, advance or complete the running rollout
+    /// 扩大金丝雀集合，然后中止、推进或完成进行中的发布
+    fn evaluate(st: &mut State, now_ms: i64) {
+        let Some(i) = st.running() else {
+            return;
+        };
+        let State {
+            rollouts,
+            fleet,
+            reports,
+        } = st;
+        fleet.retain(|_, seen| now_ms - *seen <= FLEET_WINDOW_MS);
+        let r = &mut rollouts[i];
+
+        let percent = r.stages[r.stage_index as usize];
+        let target = canary_count(percent, fleet.len());
+        if r.canary_nodes.len() < target {
+            let mut ranked: Vec<_> = fleet
+                .keys()
+                .filter(|n| !r.canary_nodes.contains(*n))
+                .map(|n| (rank(&r.rollout_id, n), n.clone()))
+                .collect();
+            ranked.sort();
+            let missing = target - r.canary_nodes.len();
+            r.canary_nodes
+                .extend(ranked.into_iter().take(missing).map(|(_, n)| n));
+        }
+
+        let (mut executions, mut failures, mut rejected) = (0, 0, None);
+        for node in &r.canary_nodes {
+            let Some(report) = reports.get(node) else {
+                continue;
+            };
+            executions += report.executions;
+            failures += report.failures;
+            if let Some(e) = &report.error {
+                rejected = Some(format!("node {} rejected the overlay: {}", node, e));
+            }
+        }
+        r.executions = executions;
+        r.failures = failures;
+
+        let error_rate = failures as f64 / executions.max(1) as f64;
+        let reason = rejected.or_else(|| {
+            (executions >= r.min_executions && error_rate > r.max_error_rate).then(|| {
+                format!(
+                    "error rate {:.3} above {:.3} over {} executions",
+                    error_rate, r.max_error_rate, executions
+                )
+            })
+        });
+        if let Some(reason) = reason {
+            warn!(
+                target: AUDIT_TARGET,
+                rollout_id = %r.rollout_id,
+                reason = %reason,
+                "config rollout halted automatically"
+            );
+            halt(r, reason, now_ms);
+            reports.clear();
+            return;
+        }
+
+        let held = now_ms - r.stage_started_at_ms >= (r.stage_hold_s as i64).saturating_mul(1000);
+        if !held || executions < r.min_executions || r.canary_nodes.len() < target {
+            return;
+        }
+        if (r.stage_index as usize) + 1 < r.stages.len() {
+            r.stage_index += 1;
+            r.stage_started_at_ms = now_ms;
+            info!(
+                target: AUDIT_TARGET,
+                rollout_id = %r.rollout_id,
+                percent = r.stages[r.stage_index as usize],
+                "config rollout advanced"
+            );
+        } else {
+            r.status = STATUS_COMPLETED.to_string();
+            r.finished_at_ms = now_ms;
+            info!(target: AUDIT_TARGET, rollout_id = %r.rollout_id, "config rollout completed");
+            reports.clear();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const OVERLAY: &str = r#"{"execution": {"max_concurrent_executions": 4}}"#;
+
+    fn start_req(stages: Vec<u32>) -> StartConfigRolloutRequest {
+        StartConfigRolloutRequest {
+            overlay_json: OVERLAY.to_string(),
+            stages,
+            stage_hold_s: 60,
+            max_error_rate: 0.1,
+            min_executions: 10,
+            operator: "ops".to_string(),
+        }
+    }
+
+    fn report(id: &str, executions: u64, failures: u64) -> HashMap<String, String> {
+        HashMap::from([
+            (HEALTH_ROLLOUT_ID.to_string(), id.to_string()),
+            (HEALTH_EXECUTIONS.to_string(), executions.to_string()),
+            (HEALTH_FAILURES.to_string(), failures.to_string()),
+        ])
+    }
+
+    fn fleet(m: &ConfigRolloutManager, n: usize, now_ms: i64) -> Vec<String> {
+        let nodes: Vec<String> = (0..n).map(|i| format!("node-{}", i)).collect();
+        for node in &nodes {
+            assert!(m.heartbeat(node, &HashMap::new(), now_ms).is_none());
+        }
+        nodes
+    }
+
+    #[test]
+    fn test_start_validation() {
+        let m = ConfigRolloutManager::new();
+        let mut req = start_req(vec![]);
+        req.overlay_json = r#"{"grpc": {"addr": "0.0.0.0:1"}}"#.to_string();
+        assert!(m.start(req, 0).unwrap_err().message().contains("restart"));
+        assert!(m.start(start_req(vec![50, 10, 100]), 0).is_err());
+        assert!(m.start(start_req(vec![10, 50]), 0).is_err());
+
+        let r = m.start(start_req(vec![]), 0).unwrap();
+        assert_eq!(r.stages, DEFAULT_STAGES);
+        let err = m.start(start_req(vec![]), 0).unwrap_err();
+        assert_eq!(err.code(), tonic::Code::FailedPrecondition);
+    }
+
+    #[test]
+    fn test_stages_advance_to_the_whole_fleet() {
+        let m = ConfigRolloutManager::new();
+        let nodes = fleet(&m, 10, 0);
+        let r = m.start(start_req(vec![10, 50, 100]), 0).unwrap();
+        assert_eq!(r.canary_nodes.len(), 1);
+        let canary = r.canary_nodes[0].clone();
+        let other = nodes.iter().find(|n| **n != canary).unwrap();
+
+        let a = m.heartbeat(&canary, &HashMap::new(), 1_000).unwrap();
+        assert_eq!(a.rollout_id, r.rollout_id);
+        assert_eq!(a.overlay_json, OVERLAY);
+        let a = m.heartbeat(other, &HashMap::new(), 1_000).unwrap();
+        assert!(a.rollout_id.is_empty() && a.overlay_json.is_empty());
+
+        // Held long enough but not enough executions yet / 保持时间已够但执行次数不足
+        m.heartbeat(&canary, &report(&r.rollout_id, 5, 0), 61_000);
+        assert_eq!(m.list(61_000)[0].stage_index, 0);
+
+        m.heartbeat(&canary, &report(&r.rollout_id, 20, 1), 62_000);
+        let r = m.list(62_000).remove(0);
+        assert_eq!(r.stage_index, 1);
+        assert_eq!(r.canary_nodes.len(), 5);
+        assert!(r.canary_nodes.contains(&canary));
+
+        for node in &nodes {
+            m.heartbeat(node, &report(&r.rollout_id, 20, 0), 123_000);
+        }
+        let r = m.list(123_000).remove(0);
+        assert_eq!(r.stage_index, 2);
+        assert_eq!(r.canary_nodes.len(), 10);
+        m.heartbeat(&canary, &report(&r.rollout_id, 20, 0), 184_000);
+        let r = m.list(184_000).remove(0);
+        assert_eq!(r.status, STATUS_COMPLETED);
+
+        // A node joining later gets the completed overlay / 之后加入的节点获得已完成的覆盖
+        let a = m.heartbeat("late", &HashMap::new(), 185_000).unwrap();
+        assert_eq!(a.rollout_id, r.rollout_id);
+    }
+
+    #[test]
+    fn test_halts_on_error_rate_and_rejection() {
+        let m = ConfigRolloutManager::new();
+        fleet(&m, 4, 0);
+        let r = m.start(start_req(vec![50, 100]), 0).unwrap();
+        let canary = r.canary_nodes[0].clone();
+        m.heartbeat(&canary, &report(&r.rollout_id, 20, 5), 1_000);
+        let r = m.list(1_000).remove(0);
+        assert_eq!(r.status, STATUS_HALTED);
+        assert!(
+            r.halt_reason.starts_with("error rate 0.250"),
+            "{}",
+            r.halt_reason
+        );
+        // Canary nodes revert to no overlay / 金丝雀节点回退到无覆盖
+        let a = m.heartbeat(&canary, &HashMap::new(), 2_000).unwrap();
+        assert!(a.rollout_id.is_empty());
+
+        let r = m.start(start_req(vec![50, 100]), 3_000).unwrap();
+        let canary = r.canary_nodes[0].clone();
+        let mut info = report(&r.rollout_id, 0, 0);
+        info.insert(HEALTH_ERROR.to_string(), "bad key".to_string());
+        m.heartbeat(&canary, &info, 4_000);
+        let r = m.list(4_000).remove(0);
+        assert_eq!(r.status, STATUS_HALTED);
+        assert!(r.halt_reason.contains("bad key"));
+
+        let err = m.halt(&r.rollout_id, "", 5_000).unwrap_err();
+        assert_eq!(err.code(), tonic::Code::FailedPrecondition);
+    }
+}
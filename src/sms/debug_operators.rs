@@ -0,0 +1,171 @@
+//! Operators allowed to use debug sessions
+//! 允许使用调试会话的操作人
+//!
+//! Debug sessions reach node internals, so the web admin authenticates every debug request,
+//! whether or not `SMS_WEB_ADMIN_TOKEN` is set. Operators and their tokens come from
+//! `SMS_DEBUG_OPERATORS` (`name:token,...`). A request presents its token in
+//! `x-operator-token` and acts, and is audited, as the matching operator. With no operators
+//! configured every debug request is refused.
+//! 调试会话可访问节点内部，因此无论是否设置了 `SMS_WEB_ADMIN_TOKEN`，Web Admin 都会认证每个调试
+//! 请求。操作人及其令牌来自 `SMS_DEBUG_OPERATORS`（`name:token,...`）。请求在 `x-operator-token`
+//! 中出示令牌，并以匹配的操作人身份执行与审计。未配置操作人时拒绝所有调试请求。
+
+use std::sync::Arc;
+
+use axum::{
+    body::Body,
+    extract::State,
+    http::{HeaderMap, Request, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Json,
+};
+use serde_json::json;
+
+use crate::spearlet::http_auth::constant_time_eq;
+
+/// Environment variable listing the operators / 列出操作人的环境变量
+pub const OPERATORS_ENV: &str = "SMS_DEBUG_OPERATORS";
+
+/// Request header carrying the operator token / 携带操作人令牌的请求头
+pub const TOKEN_HEADER: &str = "x-operator-token";
+
+/// Configured operators and their tokens / 已配置的操作人及其令牌
+#[derive(Debug, Clone, Default)]
+pub struct DebugOperators {
+    /// `(name, token)` pairs / `(name, token)` 对
+    operators: Arc<Vec<(String, String)>>,
+}
+
+impl DebugOperators {
+    pub fn from_env() -> Self {
+        Self::parse(&std::env::var(OPERATORS_ENV).unwrap_or_default())
+    }
+
+    /// Parse `name:token,...`; entries without a name or a token are skipped
+    /// 解析 `name:token,...`；缺少名称或令牌的条目会被跳过
+    pub fn parse(spec: &str) -> Self {
+        let operators = spec
+            .split(',')
+            .filter_map(|item| {
+                let (name, token) = item.trim().split_once(':')?;
+                let (name, token) = (name.trim(), token.trim());
+                if name.is_empty() || token.is_empty() {
+                    return None;
+                }
+                Some((name.to_string(), token.to_string()))
+            })
+            .collect();
+        Self {
+            operators: Arc::new(operators),
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.operators.is_empty()
+    }
+
+    /// Operator whose token the request presents / 请求所出示令牌对应的操作人
+    pub fn identify(&self, headers: &HeaderMap) -> Option<&str> {
+        let token = headers.get(TOKEN_HEADER)?.to_str().ok()?.trim();
+        self.operators
+            .iter()
+            .find(|(_, t)| constant_time_eq(t.as_bytes(), token.as_bytes()))
+            .map(|(name, _)| name.as_str())
+    }
+}
+
+/// Operator a debug request was authenticated as / 调试请求经认证的操作人
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Operator(pub String);
+
+/// Axum middleware admitting configured operators only / 仅放行已配置操作人的 axum 中间件
+///
+/// Attaches [`Operator`] to requests that pass.
+/// 为通过的请求附加 [`Operator`]。
+pub async fn require_operator(
+    State(operators): State<DebugOperators>,
+    mut req: Request<Body>,
+    next: Next,
+) -> Response {
+    if operators.is_empty() {
+        return (
+            StatusCode::FORBIDDEN,
+            Json(json!({
+                "success": false,
+                "message": format!("debug sessions are disabled: {} is not set", OPERATORS_ENV),
+            })),
+        )
+            .into_response();
+    }
+    let Some(name) = operators.identify(req.headers()).map(str::to_string) else {
+        return (
+            StatusCode::UNAUTHORIZED,
+            Json(json!({"success": false, "message": "unknown or missing operator token"})),
+        )
+            .into_response();
+    };
+    req.extensions_mut().insert(Operator(name));
+    next.run(req).await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::{routing::get, Extension, Router};
+    use tower::ServiceExt;
+
+    fn app(operators: DebugOperators) -> Router {
+        Router::new()
+            .route(
+                "/debug",
+                get(|Extension(op): Extension<Operator>| async move { op.0 }),
+            )
+            .route_layer(axum::middleware::from_fn_with_state(
+                operators,
+                require_operator,
+            ))
+    }
+
+    async fn call(app: Router, token: Option<&str>) -> (StatusCode, String) {
+        let mut req = Request::builder().uri("/debug");
+        if let Some(token) = token {
+            req = req.header(TOKEN_HEADER, token);
+        }
+        let resp = app.oneshot(req.body(Body::empty()).unwrap()).await.unwrap();
+        let status = resp.status();
+        let body = axum::body::to_bytes(resp.into_body(), 1024).await.unwrap();
+        (status, String::from_utf8_lossy(&body).to_string())
+    }
+
+    #[test]
+    fn test_parse_skips_incomplete_entries() {
+        let ops = DebugOperators::parse(" alice:t1, bob: t2 ,:t3,carol:,dave");
+        let mut h = HeaderMap::new();
+        h.insert(TOKEN_HEADER, "t2".parse().unwrap());
+        assert_eq!(ops.identify(&h), Some("bob"));
+        h.insert(TOKEN_HEADER, "t3".parse().unwrap());
+        assert_eq!(ops.identify(&h), None);
+        assert!(DebugOperators::parse("").is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_operator_taken_from_token() {
+        let app = app(DebugOperators::parse("alice:t1,bob:t2"));
+        assert_eq!(
+            call(app.clone(), Some("t2")).await,
+            (StatusCode::OK, "bob".to_string())
+        );
+        assert_eq!(
+            call(app.clone(), Some("nope")).await.0,
+            StatusCode::UNAUTHORIZED
+        );
+        assert_eq!(call(app, None).await.0, StatusCode::UNAUTHORIZED);
+    }
+
+    #[tokio::test]
+    async fn test_refused_without_operators() {
+        let app = app(DebugOperators::default());
+        assert_eq!(call(app, Some("t1")).await.0, StatusCode::FORBIDDEN);
+    }
+}
@@ -0,0 +1,475 @@
+//! Debug tunnels of spearlets / spearlet 的调试隧道
+//!
+//! A spearlet with `debug_tunnel.enabled` keeps a `DebugTunnel` stream open to the SMS, so
+//! support engineers can reach its admin and monitoring endpoints without a port being
+//! opened on the device. An admin opens a time-limited session on one node; requests sent
+//! through the session are forwarded over the stream and answered by the node. Every
+//! session change and request is written to the `audit` log target, here and on the node.
+//! 启用 `debug_tunnel.enabled` 的 spearlet 会保持一条到 SMS 的 `DebugTunnel` 流，使支持工程师无需
+//! 在设备上开放端口即可访问其管理与监控端点。管理员在某个节点上开启限时会话；通过会话发送的请求
+//! 经由该流转发并由节点应答。每次会话变化与请求都会写入 `audit` 日志目标，SMS 与节点两侧皆然。
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, Instant};
+
+use parking_lot::Mutex;
+use tokio::sync::{mpsc, oneshot};
+use tonic::Status;
+use tracing::info;
+use uuid::Uuid;
+
+use crate::proto::sms::{
+    debug_tunnel_down, debug_tunnel_up, DebugHttpRequest, DebugHttpResponse, DebugSession,
+    DebugSessionClose, DebugSessionOpen, DebugSessionState, DebugTunnelDown, DebugTunnelUp,
+};
+
+/// Log target of the audit trail / 审计记录的日志目标
+pub const AUDIT_TARGET: &str = "audit";
+
+/// Session length when the admin gives none / 管理员未指定时的会话时长
+pub const DEFAULT_SESSION_TTL_S: u64 = 900;
+
+/// Longest session an admin may request / 管理员可请求的最长会话
+pub const MAX_SESSION_TTL_S: u64 = 24 * 3600;
+
+/// Time a node has to answer / 节点应答的时限
+const REPLY_TIMEOUT: Duration = Duration::from_secs(30);
+
+type DownSender = mpsc::Sender<Result<DebugTunnelDown, Status>>;
+
+#[derive(Debug)]
+struct Tunnel {
+    conn_id: u64,
+    tx: DownSender,
+}
+
+#[derive(Debug)]
+enum Reply {
+    State(DebugSessionState),
+    Response(DebugHttpResponse),
+}
+
+#[derive(Debug)]
+struct Pending {
+    node_uuid: String,
+    tx: oneshot::Sender<Reply>,
+}
+
+/// Open tunnels, sessions and requests waiting for their node
+/// 已建立的隧道、会话以及等待节点应答的请求
+#[derive(Debug, Default)]
+pub struct DebugTunnelHub {
+    next_conn: AtomicU64,
+    tunnels: Mutex<HashMap<String, Tunnel>>,
+    sessions: Mutex<HashMap<String, DebugSession>>,
+    /// Keyed by session id while opening, by request id otherwise
+    /// 开启期间以会话 ID 为键，其余以请求 ID 为键
+    pending: Mutex<HashMap<String, Pending>>,
+}
+
+fn now_ms() -> i64 {
+    chrono::Utc::now().timestamp_millis()
+}
+
+impl DebugTunnelHub {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Register the tunnel of a node, replacing an older one
+    /// 注册节点的隧道，替换旧隧道
+    pub fn attach(
+        &self,
+        node_uuid: &str,
+    ) -> (u64, mpsc::Receiver<Result<DebugTunnelDown, Status>>) {
+        let (tx, rx) = mpsc::channel(64);
+        let conn_id = self.next_conn.fetch_add(1, Ordering::Relaxed) + 1;
+        let old = self
+            .tunnels
+            .lock()
+            .insert(node_uuid.to_string(), Tunnel { conn_id, tx });
+        if old.is_some() {
+            self.end_node(node_uuid, "tunnel replaced");
+        }
+        info!(node_uuid, "Debug tunnel connected");
+        (conn_id, rx)
+    }
+
+    /// Forget a tunnel unless it was already replaced / 注销隧道，已被替换时忽略
+    pub fn detach(&self, node_uuid: &str, conn_id: u64) {
+        {
+            let mut tunnels = self.tunnels.lock();
+            if tunnels.get(node_uuid).map(|t| t.conn_id) != Some(conn_id) {
+                return;
+            }
+            tunnels.remove(node_uuid);
+        }
+        self.end_node(node_uuid, "tunnel closed");
+        info!(node_uuid, "Debug tunnel disconnected");
+    }
+
+    /// End the sessions and waiting requests of a node / 结束节点的会话与等待中的请求
+    fn end_node(&self, node_uuid: &str, why: &str) {
+        // Dropping the senders wakes the waiters / 丢弃发送端即可唤醒等待者
+        self.pending.lock().retain(|_, p| p.node_uuid != node_uuid);
+        let ended: Vec<DebugSession> = {
+            let mut sessions = self.sessions.lock();
+            let ids: Vec<String> = sessions
+                .values()
+                .filter(|s| s.node_uuid == node_uuid)
+                .map(|s| s.session_id.clone())
+                .collect();
+            ids.iter().filter_map(|id| sessions.remove(id)).collect()
+        };
+        for s in ended {
+            audit_ended(&s, why);
+        }
+    }
+
+    /// Handle a frame received from a node / 处理从节点收到的帧
+    pub fn on_frame(&self, node_uuid: &str, frame: DebugTunnelUp) {
+        match frame.frame {
+            Some(debug_tunnel_up::Frame::State(st)) => {
+                if let Some(p) = self.pending.lock().remove(&st.session_id) {
+                    let _ = p.tx.send(Reply::State(st));
+                    return;
+                }
+                if st.active {
+                    return;
+                }
+                let ended = {
+                    let mut sessions = self.sessions.lock();
+                    match sessions.get(&st.session_id) {
+                        Some(s) if s.node_uuid == node_uuid => sessions.remove(&st.session_id),
+                        _ => None,
+                    }
+                };
+                if let Some(s) = ended {
+                    audit_ended(&s, &st.message);
+                }
+            }
+            Some(debug_tunnel_up::Frame::Response(r)) => {
+                if let Some(p) = self.pending.lock().remove(&r.request_id) {
+                    let _ = p.tx.send(Reply::Response(r));
+                }
+            }
+            Some(debug_tunnel_up::Frame::Hello(_)) | None => {}
+        }
+    }
+
+    fn sender(&self, node_uuid: &str) -> Result<DownSender, Status> {
+        self.tunnels
+            .lock()
+            .get(node_uuid)
+            .map(|t| t.tx.clone())
+            .ok_or_else(|| Status::failed_precondition("node has no debug tunnel open"))
+    }
+
+    /// Send a frame and wait for the node's reply under `key`
+    /// 发送帧并等待节点以 `key` 应答
+    async fn call(
+        &self,
+        node_uuid: &str,
+        key: String,
+        frame: debug_tunnel_down::Frame,
+    ) -> Result<Reply, Status> {
+        let tx = self.sender(node_uuid)?;
+        let (reply_tx, reply_rx) = oneshot::channel();
+        self.pending.lock().insert(
+            key.clone(),
+            Pending {
+                node_uuid: node_uuid.to_string(),
+                tx: reply_tx,
+            },
+        );
+        let out = if tx
+            .send(Ok(DebugTunnelDown { frame: Some(frame) }))
+            .await
+            .is_err()
+        {
+            Err(Status::unavailable("debug tunnel closed"))
+        } else {
+            match tokio::time::timeout(REPLY_TIMEOUT, reply_rx).await {
+                Ok(Ok(reply)) => Ok(reply),
+                Ok(Err(_)) => Err(Status::unavailable("debug tunnel closed")),
+                Err(_) => Err(Status::deadline_exceeded("node did not answer")),
+            }
+        };
+        self.pending.lock().remove(&key);
+        out
+    }
+
+    /// Open a session on a node / 在节点上开启会话
+    pub async fn open(
+        &self,
+        node_uuid: &str,
+        ttl_s: u64,
+        operator: &str,
+        reason: &str,
+    ) -> Result<DebugSession, Status> {
+        if operator.trim().is_empty() || reason.trim().is_empty() {
+            return Err(Status::invalid_argument("operator and reason are required"));
+        }
+        let ttl_s = if ttl_s == 0 {
+            DEFAULT_SESSION_TTL_S
+        } else {
+            ttl_s
+        };
+        if ttl_s > MAX_SESSION_TTL_S {
+            return Err(Status::invalid_argument(format!(
+                "ttl_s must not exceed {}",
+                MAX_SESSION_TTL_S
+            )));
+        }
+        let now = now_ms();
+        let mut session = DebugSession {
+            session_id: Uuid::new_v4().to_string(),
+            node_uuid: node_uuid.to_string(),
+            operator: operator.to_string(),
+            reason: reason.to_string(),
+            opened_at_ms: now,
+            expires_at_ms: now + (ttl_s * 1000) as i64,
+        };
+        let frame = debug_tunnel_down::Frame::Open(DebugSessionOpen {
+            session: Some(session.clone()),
+            ttl_s,
+        });
+        match self
+            .call(node_uuid, session.session_id.clone(), frame)
+            .await?
+        {
+            Reply::State(st) if st.active => {
+                // The node may shorten the session / 节点可能缩短会话
+                if st.expires_at_ms > 0 {
+                    session.expires_at_ms = session.expires_at_ms.min(st.expires_at_ms);
+                }
+                self.sessions
+                    .lock()
+                    .insert(session.session_id.clone(), session.clone());
+                info!(
+                    target: AUDIT_TARGET,
+                    session_id = %session.session_id,
+                    node_uuid,
+                    operator,
+                    reason,
+                    expires_at_ms = session.expires_at_ms,
+                    "debug session opened"
+                );
+                Ok(session)
+            }
+            Reply::State(st) => {
+                info!(
+                    target: AUDIT_TARGET,
+                    session_id = %session.session_id,
+                    node_uuid,
+                    operator,
+                    reason,
+                    refusal = %st.message,
+                    "debug session refused"
+                );
+                Err(Status::permission_denied(format!(
+                    "node refused debug session: {}",
+                    st.message
+                )))
+            }
+            Reply::Response(_) => Err(Status::internal("unexpected reply to session open")),
+        }
+    }
+
+    /// Close a session early; false when it is not open / 提前关闭会话；会话未开启时返回 false
+    pub async fn close(&self, node_uuid: &str, session_id: &str, operator: &str) -> bool {
+        let closed = {
+            let mut sessions = self.sessions.lock();
+            match sessions.get(session_id) {
+                Some(s) if s.node_uuid == node_uuid => sessions.remove(session_id),
+                _ => None,
+            }
+        };
+        let Some(session) = closed else {
+            return false;
+        };
+        audit_ended(&session, &format!("closed by {}", operator));
+        if let Ok(tx) = self.sender(node_uuid) {
+            let frame = debug_tunnel_down::Frame::Close(DebugSessionClose {
+                session_id: session_id.to_string(),
+                operator: operator.to_string(),
+            });
+            let _ = tx.send(Ok(DebugTunnelDown { frame: Some(frame) })).await;
+        }
+        true
+    }
+
+    fn expire(&self) {
+        let now = now_ms();
+        let expired: Vec<DebugSession> = {
+            let mut sessions = self.sessions.lock();
+            let ids: Vec<String> = sessions
+                .values()
+                .filter(|s| s.expires_at_ms <= now)
+                .map(|s| s.session_id.clone())
+                .collect();
+            ids.iter().filter_map(|id| sessions.remove(id)).collect()
+        };
+        for s in expired {
+            audit_ended(&s, "expired");
+        }
+    }
+
+    /// Open sessions, oldest first, and the nodes with a tunnel
+    /// 已开启的会话（最旧的在前）以及已建立隧道的节点
+    pub fn list(&self, node_uuid: &str) -> (Vec<DebugSession>, Vec<String>) {
+        self.expire();
+        let mut sessions: Vec<DebugSession> = self
+            .sessions
+            .lock()
+            .values()
+            .filter(|s| node_uuid.is_empty() || s.node_uuid == node_uuid)
+            .cloned()
+            .collect();
+        sessions.sort_by_key(|s| s.opened_at_ms);
+        let mut nodes: Vec<String> = self.tunnels.lock().keys().cloned().collect();
+        nodes.sort();
+        (sessions, nodes)
+    }
+
+    /// Forward an HTTP request through an open session / 通过已开启的会话转发 HTTP 请求
+    ///
+    /// Only the operator who opened the session may use it; other operators see no session.
+    /// 仅开启会话的操作人可以使用它；其他操作人看不到该会话。
+    pub async fn request(&self, mut req: DebugHttpRequest) -> Result<DebugHttpResponse, Status> {
+        self.expire();
+        let session = self
+            .sessions
+            .lock()
+            .get(&req.session_id)
+            .filter(|s| s.node_uuid == req.node_uuid && s.operator == req.operator)
+            .cloned()
+            .ok_or_else(|| Status::not_found("debug session not found or expired"))?;
+        if !req.path.starts_with('/') {
+            req.path = format!("/{}", req.path);
+        }
+        req.request_id = Uuid::new_v4().to_string();
+        let (method, path) = (req.method.clone(), req.path.clone());
+        let started = Instant::now();
+        let node_uuid = req.node_uuid.clone();
+        let key = req.request_id.clone();
+        let out = self
+            .call(&node_uuid, key, debug_tunnel_down::Frame::Request(req))
+            .await
+            .and_then(|reply| match reply {
+                Reply::Response(r) => Ok(r),
+                Reply::State(_) => Err(Status::internal("unexpected reply to request")),
+            });
+        let status = match &out {
+            Ok(r) => r.status.to_string(),
+            Err(e) => format!("{:?}", e.code()),
+        };
+        info!(
+            target: AUDIT_TARGET,
+            session_id = %session.session_id,
+            node_uuid = %node_uuid,
+            operator = %session.operator,
+            method = %method,
+            path = %path,
+            status = %status,
+            elapsed_ms = started.elapsed().as_millis() as u64,
+            "debug request"
+        );
+        out
+    }
+}
+
+fn audit_ended(s: &DebugSession, why: &str) {
+    info!(
+        target: AUDIT_TARGET,
+        session_id = %s.session_id,
+        node_uuid = %s.node_uuid,
+        operator = %s.operator,
+        why,
+        "debug session ended"
+    );
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn reply_to(hub: &DebugTunnelHub, node: &str, down: DebugTunnelDown) {
+        match down.frame {
+            Some(debug_tunnel_down::Frame::Open(o)) => {
+                let s = o.session.unwrap();
+                hub.on_frame(
+                    node,
+                    DebugTunnelUp {
+                        frame: Some(debug_tunnel_up::Frame::State(DebugSessionState {
+                            session_id: s.session_id,
+                            active: true,
+                            expires_at_ms: s.opened_at_ms + 1_000,
+                            message: String::new(),
+                        })),
+                    },
+                );
+            }
+            Some(debug_tunnel_down::Frame::Request(r)) => hub.on_frame(
+                node,
+                DebugTunnelUp {
+                    frame: Some(debug_tunnel_up::Frame::Response(DebugHttpResponse {
+                        request_id: r.request_id,
+                        status: 200,
+                        headers: HashMap::new(),
+                        body: r.path.into_bytes(),
+                    })),
+                },
+            ),
+            _ => {}
+        }
+    }
+
+    #[tokio::test]
+    async fn test_session_round_trip_through_tunnel() {
+        let hub = std::sync::Arc::new(DebugTunnelHub::new());
+        assert!(hub.open("n1", 60, "alice", "why").await.is_err());
+
+        let (conn_id, mut rx) = hub.attach("n1");
+        let node = hub.clone();
+        tokio::spawn(async move {
+            while let Some(Ok(down)) = rx.recv().await {
+                reply_to(&node, "n1", down);
+            }
+        });
+
+        assert_eq!(
+            hub.open("n1", 60, "", "why").await.unwrap_err().code(),
+            tonic::Code::InvalidArgument
+        );
+        let session = hub.open("n1", 60, "alice", "slow node").await.unwrap();
+        // Shortened by the node to one second / 被节点缩短为一秒
+        assert_eq!(session.expires_at_ms, session.opened_at_ms + 1_000);
+        assert_eq!(hub.list("").0.len(), 1);
+
+        let request = DebugHttpRequest {
+            node_uuid: "n1".to_string(),
+            session_id: session.session_id.clone(),
+            method: "GET".to_string(),
+            path: "admin/introspect".to_string(),
+            operator: "alice".to_string(),
+            ..Default::default()
+        };
+        let resp = hub.request(request.clone()).await.unwrap();
+        assert_eq!(resp.status, 200);
+        assert_eq!(resp.body, b"/admin/introspect");
+        let other = DebugHttpRequest {
+            operator: "mallory".to_string(),
+            ..request
+        };
+        assert_eq!(
+            hub.request(other).await.unwrap_err().code(),
+            tonic::Code::NotFound
+        );
+
+        hub.detach("n1", conn_id);
+        assert!(hub.list("").0.is_empty());
+        assert!(!hub.close("n1", &session.session_id, "alice").await);
+    }
+}
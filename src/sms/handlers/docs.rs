@@ -260,6 +260,33 @@ pub async fn openapi_spec() -> Json<serde_json::Value> {
                     }
                 }
             },
+            "/api/v1/nodes/{uuid}/metrics": {
+                "get": {
+                    "summary": "Get metrics windows reported by a node",
+                    "parameters": [
+                        {
+                            "name": "uuid",
+                            "in": "path",
+                            "required": true,
+                            "schema": {"type": "string"}
+                        },
+                        {
+                            "name": "since_ms",
+                            "in": "query",
+                            "schema": {"type": "integer", "format": "int64"},
+                            "description": "Only windows ending after this time (Unix ms)"
+                        }
+                    ],
+                    "responses": {
+                        "200": {
+                            "description": "Metrics windows, oldest first"
+                        },
+                        "404": {
+                            "description": "Node has not reported metrics"
+                        }
+                    }
+                }
+            },
             "/api/v1/tasks": {
                 "post": {
                     "summary": "Register a new task",
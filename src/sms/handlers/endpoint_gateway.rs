@@ -355,7 +355,10 @@ async fn invoke_on_node(
     let channel = tonic::transport::Channel::from_shared(url)
         .map_err(|e| format!("invalid node url: {e}"))?
         .connect_lazy();
-    let mut invc = InvocationServiceClient::new(channel);
+    let mut invc = InvocationServiceClient::with_interceptor(
+        channel,
+        crate::sms::spearlet_credentials::attach,
+    );
 
     let req = InvokeRequest {
         invocation_id: request_id.to_string(),
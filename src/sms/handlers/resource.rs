@@ -15,8 +15,8 @@ use std::collections::HashMap;
 use tracing::{info, warn};
 
 use crate::proto::sms::{
-    GetNodeResourceRequest, GetNodeWithResourceRequest, ListNodeResourcesRequest, NodeResource,
-    UpdateNodeResourceRequest,
+    GetNodeMetricsRequest, GetNodeResourceRequest, GetNodeWithResourceRequest,
+    ListNodeResourcesRequest, NodeMetricsWindow, NodeResource, UpdateNodeResourceRequest,
 };
 use crate::sms::gateway::GatewayState;
 
@@ -39,6 +39,13 @@ pub struct HttpUpdateNodeResourceRequest {
     pub resource_metadata: Option<HashMap<String, String>>,
 }
 
+/// Query parameters for node metrics / 节点指标的查询参数
+#[derive(Debug, Deserialize)]
+pub struct NodeMetricsQuery {
+    /// Only windows ending after this time (Unix ms) / 仅返回此后结束的窗口（Unix 毫秒）
+    pub since_ms: Option<i64>,
+}
+
 /// Query parameters for listing node resources / 列出节点资源的查询参数
 #[derive(Debug, Deserialize)]
 pub struct ListNodeResourcesQuery {
@@ -247,3 +254,64 @@ pub async fn get_node_with_resource(
         }
     }
 }
+
+fn metrics_window_json(w: &NodeMetricsWindow) -> serde_json::Value {
+    let tasks: serde_json::Map<String, serde_json::Value> = w
+        .tasks
+        .iter()
+        .map(|(id, t)| {
+            (
+                id.clone(),
+                json!({
+                    "executions": t.executions,
+                    "failed_executions": t.failed_executions,
+                    "execution_time_ms": t.execution_time_ms
+                }),
+            )
+        })
+        .collect();
+    json!({
+        "seq": w.seq,
+        "start_ms": w.start_ms,
+        "end_ms": w.end_ms,
+        "executions": w.executions,
+        "failed_executions": w.failed_executions,
+        "execution_time_ms": w.execution_time_ms,
+        "max_execution_time_ms": w.max_execution_time_ms,
+        "tasks": tasks,
+        "other_tasks": w.other_tasks,
+        "gauges": w.gauges
+    })
+}
+
+/// Get metrics windows reported by a node / 获取节点上报的指标窗口
+pub async fn get_node_metrics(
+    State(state): State<GatewayState>,
+    Path(uuid): Path<String>,
+    Query(query): Query<NodeMetricsQuery>,
+) -> Result<Json<serde_json::Value>, StatusCode> {
+    let mut client = state.node_client.clone();
+
+    let grpc_req = GetNodeMetricsRequest {
+        uuid: uuid.clone(),
+        since_ms: query.since_ms.unwrap_or(0),
+    };
+
+    match client.get_node_metrics(grpc_req).await {
+        Ok(response) => {
+            let resp = response.into_inner();
+            if !resp.found {
+                return Err(StatusCode::NOT_FOUND);
+            }
+            Ok(Json(json!({
+                "node_uuid": uuid,
+                "dropped_windows": resp.dropped_windows,
+                "windows": resp.windows.iter().map(metrics_window_json).collect::<Vec<_>>()
+            })))
+        }
+        Err(e) => {
+            warn!("Failed to get node metrics: {}", e);
+            Err(StatusCode::INTERNAL_SERVER_ERROR)
+        }
+    }
+}
@@ -39,6 +39,9 @@
 //! - `service`: Main SMS service implementation / 主要SMS服务实现
 
 pub mod config;
+pub mod config_rollout;
+pub mod debug_operators;
+pub mod debug_tunnel;
 pub mod events;
 pub mod execution_logs;
 pub mod gateway;
@@ -46,10 +49,13 @@ pub mod grpc_server;
 pub mod handlers;
 pub mod http_gateway;
 pub mod instance_execution_index;
+pub mod node_metrics;
+pub mod platform_sim;
 pub mod registry_watch;
 pub mod routes;
 pub mod service;
 pub mod services;
+pub mod spearlet_credentials;
 pub mod stream_mux;
 pub mod types;
 pub mod unified_events;
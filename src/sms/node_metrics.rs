@@ -0,0 +1,144 @@
+//! Metrics windows reported by spearlets / spearlet 上报的指标窗口
+//!
+//! Spearlets aggregate their own usage and send one summary per window over the node
+//! service instead of being scraped. The SMS keeps the most recent windows of each node
+//! in memory. A window resent after a lost acknowledgement is stored once.
+//! spearlet 自行聚合用量，并通过节点服务为每个窗口发送一份摘要，而不是被抓取。SMS 在内存中
+//! 保存每个节点最近的窗口。确认丢失后重发的窗口只保存一次。
+
+use std::collections::{HashMap, VecDeque};
+
+use tokio::sync::RwLock;
+
+use crate::proto::sms::NodeMetricsWindow;
+
+/// Windows kept per node, one day at the default 60 s window / 每个节点保留的窗口数，默认 60 秒窗口时为一天
+pub const DEFAULT_MAX_WINDOWS_PER_NODE: usize = 1440;
+
+#[derive(Debug, Default)]
+struct NodeMetrics {
+    /// Ordered by `start_ms` / 按 `start_ms` 排序
+    windows: VecDeque<NodeMetricsWindow>,
+    dropped_windows: u64,
+}
+
+#[derive(Debug)]
+pub struct NodeMetricsStore {
+    max_windows: usize,
+    nodes: RwLock<HashMap<String, NodeMetrics>>,
+}
+
+impl NodeMetricsStore {
+    pub fn new(max_windows: usize) -> Self {
+        Self {
+            max_windows: max_windows.max(1),
+            nodes: RwLock::new(HashMap::new()),
+        }
+    }
+
+    /// Store windows of a node; returns the highest seq received
+    /// 保存节点的窗口；返回收到的最大序号
+    pub async fn record(
+        &self,
+        node_uuid: &str,
+        windows: Vec<NodeMetricsWindow>,
+        dropped_windows: u64,
+    ) -> u64 {
+        let mut nodes = self.nodes.write().await;
+        let node = nodes.entry(node_uuid.to_string()).or_default();
+        node.dropped_windows = node.dropped_windows.max(dropped_windows);
+        let mut acked = 0;
+        for w in windows {
+            acked = acked.max(w.seq);
+            let pos = node.windows.partition_point(|x| x.start_ms < w.start_ms);
+            let duplicate = node
+                .windows
+                .iter()
+                .skip(pos)
+                .take_while(|x| x.start_ms == w.start_ms)
+                .any(|x| x.seq == w.seq);
+            if !duplicate {
+                node.windows.insert(pos, w);
+            }
+        }
+        while node.windows.len() > self.max_windows {
+            node.windows.pop_front();
+        }
+        acked
+    }
+
+    /// Windows of a node ending after `since_ms`, and the windows it dropped
+    /// 节点在 `since_ms` 之后结束的窗口，以及其丢弃的窗口数
+    pub async fn get(
+        &self,
+        node_uuid: &str,
+        since_ms: i64,
+    ) -> Option<(Vec<NodeMetricsWindow>, u64)> {
+        let nodes = self.nodes.read().await;
+        let node = nodes.get(node_uuid)?;
+        let windows = node
+            .windows
+            .iter()
+            .filter(|w| w.end_ms > since_ms)
+            .cloned()
+            .collect();
+        Some((windows, node.dropped_windows))
+    }
+
+    /// Forget a node, e.g. after it was deleted / 移除节点，例如在其被删除后
+    pub async fn remove(&self, node_uuid: &str) {
+        self.nodes.write().await.remove(node_uuid);
+    }
+}
+
+impl Default for NodeMetricsStore {
+    fn default() -> Self {
+        Self::new(DEFAULT_MAX_WINDOWS_PER_NODE)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn window(seq: u64, start_ms: i64) -> NodeMetricsWindow {
+        NodeMetricsWindow {
+            seq,
+            start_ms,
+            end_ms: start_ms + 60_000,
+            executions: seq,
+            ..Default::default()
+        }
+    }
+
+    #[tokio::test]
+    async fn test_record_dedups_orders_and_caps() {
+        let store = NodeMetricsStore::new(3);
+        assert_eq!(store.record("n1", vec![window(2, 60_000)], 0).await, 2);
+        // Resent window and an older one delivered late / 重发的窗口与迟到的旧窗口
+        let acked = store
+            .record(
+                "n1",
+                vec![window(1, 0), window(2, 60_000), window(3, 120_000)],
+                4,
+            )
+            .await;
+        assert_eq!(acked, 3);
+
+        let (windows, dropped) = store.get("n1", 0).await.unwrap();
+        assert_eq!(
+            windows.iter().map(|w| w.seq).collect::<Vec<_>>(),
+            vec![1, 2, 3]
+        );
+        assert_eq!(dropped, 4);
+
+        // A restarted spearlet counts from 1 again / 重启后的 spearlet 重新从 1 计数
+        store.record("n1", vec![window(1, 180_000)], 0).await;
+        let (windows, _) = store.get("n1", 60_000).await.unwrap();
+        assert_eq!(
+            windows.iter().map(|w| w.start_ms).collect::<Vec<_>>(),
+            vec![60_000, 120_000, 180_000]
+        );
+        assert!(store.get("n2", 0).await.is_none());
+    }
+}
@@ -0,0 +1,300 @@
+//! Local platform simulator / 本地平台模拟器
+//!
+//! `spear-platform-sim` runs what a cluster-mode spearlet expects from the platform on one
+//! machine: the SMS registration, heartbeat and node listing APIs (served by an in-process
+//! SMS whose state lives in memory) and, optionally, a number of spearlet processes
+//! configured against it. Each spearlet gets its own ports, node name and data directory,
+//! and message routing with peer discovery is turned on, so mailboxes on one node can be
+//! reached from the others without hand-written configuration.
+//! `spear-platform-sim` 在单机上提供集群模式 spearlet 所需的平台能力：SMS 的注册、心跳与节点列表
+//! API（由状态保存在内存中的进程内 SMS 提供），并可选地启动若干针对它配置好的 spearlet 进程。每个
+//! spearlet 拥有独立的端口、节点名与数据目录，并开启带对等发现的消息路由，因此无需手写配置即可从其他
+//! 节点访问某节点上的邮箱。
+//!
+//! Ports are assigned from `--base-port`: SMS gRPC on the base port, SMS HTTP on the next
+//! one, and node `n` (counting from 1) on `base + 8 + 2n` (gRPC) and `base + 9 + 2n` (HTTP).
+//! 端口从 `--base-port` 开始分配：SMS gRPC 使用基础端口，SMS HTTP 使用下一个端口，第 `n` 个节点
+//! （从 1 开始）使用 `base + 8 + 2n`（gRPC）与 `base + 9 + 2n`（HTTP）。
+
+use std::net::{IpAddr, SocketAddr};
+use std::path::{Path, PathBuf};
+use std::process::Stdio;
+
+use clap::Parser;
+use serde_json::json;
+use tokio::io::{AsyncBufReadExt, AsyncRead, BufReader};
+use tokio::process::{Child, Command};
+
+use crate::sms::config::SmsConfig;
+use crate::spearlet::config::StorageConfig;
+
+/// Peer refresh interval of simulated nodes / 模拟节点刷新对等节点的间隔
+const SYNC_INTERVAL_MS: u64 = 2_000;
+
+/// Command line of `spear-platform-sim` / `spear-platform-sim` 的命令行
+#[derive(Parser, Debug, Clone)]
+#[command(
+    name = "spear-platform-sim",
+    version = "0.1.0",
+    about = "Local SPEAR platform for multi-node testing\n用于多节点测试的本地 SPEAR 平台"
+)]
+pub struct SimArgs {
+    /// Spearlet processes to start; 0 runs the platform only
+    /// 启动的 spearlet 进程数；0 表示仅运行平台
+    #[arg(long, default_value_t = 2)]
+    pub nodes: usize,
+
+    /// Address everything binds to and advertises / 所有服务绑定并公布的地址
+    #[arg(long, default_value = "127.0.0.1")]
+    pub host: IpAddr,
+
+    /// First port of the simulated cluster / 模拟集群的第一个端口
+    #[arg(long, default_value_t = 52000)]
+    pub base_port: u16,
+
+    /// Spearlet binary (default: next to this binary, then PATH)
+    /// spearlet 可执行文件（默认：与本程序同目录，其次为 PATH）
+    #[arg(long, value_name = "PATH")]
+    pub spearlet_bin: Option<String>,
+
+    /// Directory for node configurations and data / 节点配置与数据的目录
+    #[arg(long, value_name = "PATH", default_value = "./data/platform-sim")]
+    pub work_dir: String,
+
+    /// Leave message routing between nodes off / 不开启节点间的消息路由
+    #[arg(long)]
+    pub no_routing: bool,
+
+    /// Seconds without a heartbeat before a node is shown offline / 节点无心跳多少秒后显示为离线
+    #[arg(long, default_value_t = 15)]
+    pub heartbeat_timeout: u64,
+
+    /// Log level of the platform and the nodes / 平台与节点的日志级别
+    #[arg(long, default_value = "info")]
+    pub log_level: String,
+}
+
+/// One simulated spearlet / 一个模拟的 spearlet
+#[derive(Debug, Clone, PartialEq)]
+pub struct SimNode {
+    pub name: String,
+    pub grpc_addr: SocketAddr,
+    pub http_addr: SocketAddr,
+    pub dir: PathBuf,
+}
+
+impl SimNode {
+    /// URL peers reach the node at / 对等节点访问该节点的 URL
+    pub fn url(&self) -> String {
+        format!("http://{}", self.http_addr)
+    }
+
+    /// Configuration file passed to the spearlet / 传给 spearlet 的配置文件
+    pub fn config_path(&self) -> PathBuf {
+        self.dir.join("spearlet.json")
+    }
+}
+
+/// Addresses and directories of a simulated cluster / 模拟集群的地址与目录
+#[derive(Debug, Clone)]
+pub struct SimPlan {
+    pub sms_grpc: SocketAddr,
+    pub sms_http: SocketAddr,
+    pub work_dir: PathBuf,
+    pub routing: bool,
+    pub heartbeat_timeout: u64,
+    pub nodes: Vec<SimNode>,
+}
+
+impl SimPlan {
+    pub fn new(args: &SimArgs) -> Result<Self, String> {
+        let base = args.base_port as u32;
+        let last = base + 9 + 2 * args.nodes.max(1) as u32;
+        if last > u16::MAX as u32 {
+            return Err(format!(
+                "{} nodes do not fit above port {}",
+                args.nodes, args.base_port
+            ));
+        }
+        let addr = |port: u32| SocketAddr::new(args.host, port as u16);
+        let work_dir = PathBuf::from(&args.work_dir);
+        let nodes = (1..=args.nodes)
+            .map(|n| {
+                let name = format!("sim-node-{}", n);
+                SimNode {
+                    grpc_addr: addr(base + 8 + 2 * n as u32),
+                    http_addr: addr(base + 9 + 2 * n as u32),
+                    dir: work_dir.join("nodes").join(&name),
+                    name,
+                }
+            })
+            .collect();
+        Ok(Self {
+            sms_grpc: addr(base),
+            sms_http: addr(base + 1),
+            work_dir,
+            routing: !args.no_routing,
+            heartbeat_timeout: args.heartbeat_timeout.max(3),
+            nodes,
+        })
+    }
+
+    /// Configuration of the in-process SMS / 进程内 SMS 的配置
+    pub fn sms_config(&self, log_level: &str) -> SmsConfig {
+        let mut config = SmsConfig::default();
+        config.grpc.addr = self.sms_grpc;
+        config.http.addr = self.sms_http;
+        config.logging.level = log_level.to_string();
+        config.logging.format = "compact".to_string();
+        config.enable_web_admin = false;
+        config.heartbeat_timeout = self.heartbeat_timeout;
+        config.cleanup_interval = (self.heartbeat_timeout / 3).max(1);
+        let sms_dir = self.work_dir.join("sms");
+        config.database.path = sms_dir.join("db").display().to_string();
+        config.files_dir = sms_dir.join("files").display().to_string();
+        config.execution_logs_dir = sms_dir.join("logs").display().to_string();
+        config
+    }
+
+    /// Configuration overlay of one node / 单个节点的配置覆盖
+    pub fn node_overlay(&self, node: &SimNode) -> serde_json::Value {
+        // Storage has no field defaults, so it is written out in full
+        // 存储配置没有字段默认值，因此完整写出
+        let storage = StorageConfig {
+            data_dir: node.dir.join("data").display().to_string(),
+            ..Default::default()
+        };
+        json!({
+            "spearlet": {
+                "node_name": node.name,
+                "sms_grpc_addr": self.sms_grpc.to_string(),
+                "sms_http_addr": self.sms_http.to_string(),
+                "auto_register": true,
+                "heartbeat_interval": (self.heartbeat_timeout / 3).max(1),
+                "grpc": { "addr": node.grpc_addr.to_string() },
+                "http": { "server": { "addr": node.http_addr.to_string() } },
+                "storage": storage,
+                "message_passing": {
+                    "enabled": self.routing,
+                    "routing": {
+                        "enabled": self.routing,
+                        "advertise_url": node.url(),
+                        "discover_peers": true,
+                        "sync_interval_ms": SYNC_INTERVAL_MS,
+                    },
+                },
+            }
+        })
+    }
+
+    /// Write every node's configuration file / 写入每个节点的配置文件
+    pub fn write_configs(&self) -> std::io::Result<()> {
+        for node in &self.nodes {
+            std::fs::create_dir_all(&node.dir)?;
+            let body = serde_json::to_vec_pretty(&self.node_overlay(node))?;
+            std::fs::write(node.config_path(), body)?;
+        }
+        Ok(())
+    }
+}
+
+/// The spearlet binary to start / 要启动的 spearlet 可执行文件
+pub fn spearlet_bin(explicit: Option<&str>) -> PathBuf {
+    if let Some(path) = explicit {
+        return PathBuf::from(path);
+    }
+    let name = format!("spearlet{}", std::env::consts::EXE_SUFFIX);
+    std::env::current_exe()
+        .ok()
+        .and_then(|exe| exe.parent().map(|dir| dir.join(&name)))
+        .filter(|p| p.is_file())
+        .unwrap_or_else(|| PathBuf::from(name))
+}
+
+/// Print a child's output line by line under the node name / 按行输出子进程的输出，并加上节点名前缀
+fn forward<R: AsyncRead + Unpin + Send + 'static>(name: String, out: R, stderr: bool) {
+    tokio::spawn(async move {
+        let mut lines = BufReader::new(out).lines();
+        while let Ok(Some(line)) = lines.next_line().await {
+            if stderr {
+                eprintln!("[{}] {}", name, line);
+            } else {
+                println!("[{}] {}", name, line);
+            }
+        }
+    });
+}
+
+/// Start the spearlet of one node / 启动单个节点的 spearlet
+pub fn spawn_node(bin: &Path, node: &SimNode, log_level: &str) -> std::io::Result<Child> {
+    let mut child = Command::new(bin)
+        .arg("--config")
+        .arg(node.config_path())
+        .args(["--log-level", log_level, "--log-format", "compact"])
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true)
+        .spawn()?;
+    if let Some(out) = child.stdout.take() {
+        forward(node.name.clone(), out, false);
+    }
+    if let Some(err) = child.stderr.take() {
+        forward(node.name.clone(), err, true);
+    }
+    Ok(child)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::config::AppConfig;
+
+    fn args(nodes: usize, base_port: u16, work_dir: &Path) -> SimArgs {
+        SimArgs::parse_from([
+            "spear-platform-sim".to_string(),
+            format!("--nodes={}", nodes),
+            format!("--base-port={}", base_port),
+            format!("--work-dir={}", work_dir.display()),
+        ])
+    }
+
+    #[test]
+    fn test_plan_assigns_distinct_ports() {
+        let plan = SimPlan::new(&args(3, 52000, Path::new("/tmp/sim"))).unwrap();
+        assert_eq!(plan.sms_grpc.port(), 52000);
+        assert_eq!(plan.sms_http.port(), 52001);
+        let mut ports = vec![plan.sms_grpc.port(), plan.sms_http.port()];
+        for node in &plan.nodes {
+            ports.extend([node.grpc_addr.port(), node.http_addr.port()]);
+        }
+        assert_eq!(ports[2..4], [52010, 52011]);
+        ports.sort();
+        ports.dedup();
+        assert_eq!(ports.len(), 8);
+        assert_eq!(plan.nodes[2].name, "sim-node-3");
+
+        assert!(SimPlan::new(&args(10, 65530, Path::new("/tmp/sim"))).is_err());
+    }
+
+    #[test]
+    fn test_node_config_loads_as_spearlet_config() {
+        let dir = tempfile::tempdir().unwrap();
+        let plan = SimPlan::new(&args(2, 53000, dir.path())).unwrap();
+        plan.write_configs().unwrap();
+        let node = &plan.nodes[1];
+        let cfg = AppConfig::default()
+            .overlay_file(&node.config_path())
+            .unwrap()
+            .spearlet;
+        assert_eq!(cfg.node_name, "sim-node-2");
+        assert_eq!(cfg.sms_grpc_addr, "127.0.0.1:53000");
+        assert_eq!(cfg.http.server.addr, node.http_addr);
+        assert!(cfg.message_passing.enabled && cfg.message_passing.routing.discover_peers);
+        assert_eq!(
+            cfg.message_passing.routing.advertise_url,
+            "http://127.0.0.1:53013"
+        );
+        assert_eq!(plan.sms_config("info").heartbeat_timeout, 15);
+    }
+}
@@ -12,7 +12,7 @@ use axum::{
 use super::gateway::GatewayState;
 use super::handlers::{
     console_index, console_static, create_stream_session, delete_file, delete_node, download_file,
-    endpoint_ws_proxy, get_execution, get_file_meta, get_node, get_node_resource,
+    endpoint_ws_proxy, get_execution, get_file_meta, get_node, get_node_metrics, get_node_resource,
     get_node_with_resource, get_task, health_check, heartbeat, list_files,
     list_instance_executions, list_node_resources, list_nodes, list_task_instances, list_tasks,
     openapi_spec, place_invocation, presign_upload, register_node, register_task,
@@ -46,6 +46,7 @@ pub(crate) fn create_routes(state: GatewayState) -> Router {
             "/api/v1/nodes/{uuid}/with-resource",
             get(get_node_with_resource),
         )
+        .route("/api/v1/nodes/{uuid}/metrics", get(get_node_metrics))
         // Task management endpoints / 任务管理端点
         .route("/api/v1/tasks", post(register_task))
         .route("/api/v1/tasks", get(list_tasks))
@@ -4,13 +4,16 @@ use std::sync::atomic::{AtomicU64, Ordering};
 use std::sync::Arc;
 use std::time::{SystemTime, UNIX_EPOCH};
 use tokio::sync::{broadcast, RwLock};
-use tonic::{Request, Response, Status};
+use tonic::{Request, Response, Status, Streaming};
 
 use uuid::Uuid;
 
 use crate::sms::config::SmsConfig;
+use crate::sms::config_rollout::ConfigRolloutManager;
+use crate::sms::debug_tunnel::DebugTunnelHub;
 use crate::sms::events::TaskEventBus;
 use crate::sms::instance_execution_index::InstanceExecutionIndex;
+use crate::sms::node_metrics::NodeMetricsStore;
 use crate::sms::services::{
     node_service::NodeService, resource_service::ResourceService,
     task_service::TaskService as TaskServiceImpl,
@@ -42,6 +45,12 @@ use crate::proto::sms::{
     AppendExecutionLogsRequest,
     AppendExecutionLogsResponse,
     BackendStatus,
+    CloseDebugSessionRequest,
+    CloseDebugSessionResponse,
+    DebugHttpRequest,
+    DebugHttpResponse,
+    DebugTunnelDown,
+    DebugTunnelUp,
     DeleteMcpServerRequest,
     DeleteMcpServerResponse,
     DeleteModelDeploymentRequest,
@@ -57,6 +66,8 @@ use crate::proto::sms::{
     GetExecutionResponse,
     GetNodeBackendsRequest,
     GetNodeBackendsResponse,
+    GetNodeMetricsRequest,
+    GetNodeMetricsResponse,
     GetNodeRequest,
     GetNodeResourceRequest,
     GetNodeResourceResponse,
@@ -65,10 +76,16 @@ use crate::proto::sms::{
     GetNodeWithResourceResponse,
     GetTaskRequest,
     GetTaskResponse,
+    HaltConfigRolloutRequest,
+    HaltConfigRolloutResponse,
     HeartbeatRequest,
     HeartbeatResponse,
     Instance,
     InvocationOutcomeClass,
+    ListConfigRolloutsRequest,
+    ListConfigRolloutsResponse,
+    ListDebugSessionsRequest,
+    ListDebugSessionsResponse,
     ListInstanceExecutionsRequest,
     ListInstanceExecutionsResponse,
     ListMcpServersRequest,
@@ -93,6 +110,8 @@ use crate::proto::sms::{
     ModelDeploymentStatus,
     NodeBackendSnapshot,
     NodeCandidate,
+    OpenDebugSessionRequest,
+    OpenDebugSessionResponse,
     PlaceInvocationRequest,
     PlaceInvocationResponse,
     // Node service messages / 节点服务消息
@@ -109,8 +128,12 @@ use crate::proto::sms::{
     ReportModelDeploymentStatusResponse,
     ReportNodeBackendsRequest,
     ReportNodeBackendsResponse,
+    ReportNodeMetricsRequest,
+    ReportNodeMetricsResponse,
     ResolveEndpointRequest,
     ResolveEndpointResponse,
+    StartConfigRolloutRequest,
+    StartConfigRolloutResponse,
     SubscribeEventsRequest,
     UnregisterTaskRequest,
     UnregisterTaskResponse,
@@ -215,6 +238,9 @@ pub struct SmsServiceImpl {
     placement_state: Arc<PlacementState>,
     mcp_registry: Arc<McpRegistryState>,
     backend_registry: Arc<BackendRegistryState>,
+    node_metrics: Arc<NodeMetricsStore>,
+    debug_tunnels: Arc<DebugTunnelHub>,
+    config_rollouts: Arc<ConfigRolloutManager>,
     model_deployment_registry: Arc<ModelDeploymentRegistryState>,
     router_filter_engine: Arc<RouterFilterEngine>,
 }
@@ -561,6 +587,9 @@ impl SmsServiceImpl {
             placement_state: Arc::new(PlacementState::new()),
             mcp_registry: Arc::new(McpRegistryState::new(1024, 1024)),
             backend_registry: Arc::new(BackendRegistryState::new()),
+            node_metrics: Arc::new(NodeMetricsStore::default()),
+            debug_tunnels: Arc::new(DebugTunnelHub::new()),
+            config_rollouts: Arc::new(ConfigRolloutManager::new()),
             model_deployment_registry: Arc::new(ModelDeploymentRegistryState::new(1024, 1024)),
             router_filter_engine: Arc::new(RouterFilterEngine::Builtin(
                 BuiltinRouterFilterEngine::default(),
@@ -648,6 +677,26 @@ impl SmsServiceImpl {
         self.node_service.clone()
     }
 
+    /// Mark nodes without a heartbeat for `timeout_secs` offline and the others online;
+    /// returns how many changed
+    /// 将超过 `timeout_secs` 未发送心跳的节点标记为离线，其余标记为在线；返回变化的数量
+    pub async fn refresh_node_liveness(&self, timeout_secs: u64) -> u64 {
+        let now = chrono::Utc::now().timestamp();
+        let mut ns = self.node_service.write().await;
+        let mut changed = 0u64;
+        let nodes = ns.list_nodes().await.unwrap_or_default();
+        for mut n in nodes {
+            let stale = now - n.last_heartbeat > timeout_secs as i64;
+            let new_status = if stale { "offline" } else { "online" };
+            if n.status != new_status {
+                n.status = new_status.to_string();
+                let _ = ns.update_node(n).await;
+                changed += 1;
+            }
+        }
+        changed
+    }
+
     /// Get resource service reference / 获取资源服务引用
     pub fn resource_service(&self) -> Arc<ResourceService> {
         self.resource_service.clone()
@@ -1130,6 +1179,10 @@ impl BackendRegistryServiceTrait for SmsServiceImpl {
 // Implement NodeService trait / 实现NodeService trait
 #[tonic::async_trait]
 impl NodeServiceTrait for SmsServiceImpl {
+    type DebugTunnelStream = std::pin::Pin<
+        Box<dyn tokio_stream::Stream<Item = Result<DebugTunnelDown, Status>> + Send + 'static>,
+    >;
+
     /// Register a new node / 注册新节点
     async fn register_node(
         &self,
@@ -1218,6 +1271,7 @@ impl NodeServiceTrait for SmsServiceImpl {
         match node_service.remove_node(&node_uuid.to_string()).await {
             Ok(_) => {
                 let _ = self.resource_service.remove_resource(&node_uuid).await;
+                self.node_metrics.remove(&node_uuid.to_string()).await;
                 tracing::info!(uuid = %node_uuid, "SPEARlet unregistered");
                 if let Err(e) = self
                     .unified_events
@@ -1259,10 +1313,16 @@ impl NodeServiceTrait for SmsServiceImpl {
                     }
                 }
                 tracing::debug!(uuid = %req.uuid, "Heartbeat received");
+                let now = chrono::Utc::now();
                 let response = HeartbeatResponse {
                     success: true,
                     message: "Heartbeat received".to_string(),
-                    server_timestamp: chrono::Utc::now().timestamp(),
+                    server_timestamp: now.timestamp(),
+                    config_rollout: self.config_rollouts.heartbeat(
+                        &req.uuid,
+                        &req.health_info,
+                        now.timestamp_millis(),
+                    ),
                 };
                 Ok(Response::new(response))
             }
@@ -1452,6 +1512,164 @@ impl NodeServiceTrait for SmsServiceImpl {
             (_, Err(e)) => Err(Status::internal(format!("Get resource failed: {}", e))),
         }
     }
+
+    /// Report aggregated metrics windows / 上报聚合指标窗口
+    async fn report_node_metrics(
+        &self,
+        request: Request<ReportNodeMetricsRequest>,
+    ) -> Result<Response<ReportNodeMetricsResponse>, Status> {
+        let req = request.into_inner();
+        if req.uuid.trim().is_empty() {
+            return Err(Status::invalid_argument("uuid is required"));
+        }
+        let windows = req.windows.len();
+        let acked_seq = self
+            .node_metrics
+            .record(&req.uuid, req.windows, req.dropped_windows)
+            .await;
+        debug!(uuid = %req.uuid, windows, acked_seq, "Node metrics received");
+        Ok(Response::new(ReportNodeMetricsResponse {
+            success: true,
+            acked_seq,
+        }))
+    }
+
+    /// Get recent metrics windows of a node / 获取节点最近的指标窗口
+    async fn get_node_metrics(
+        &self,
+        request: Request<GetNodeMetricsRequest>,
+    ) -> Result<Response<GetNodeMetricsResponse>, Status> {
+        let req = request.into_inner();
+        let response = match self.node_metrics.get(&req.uuid, req.since_ms).await {
+            Some((windows, dropped_windows)) => GetNodeMetricsResponse {
+                found: true,
+                windows,
+                dropped_windows,
+            },
+            None => GetNodeMetricsResponse::default(),
+        };
+        Ok(Response::new(response))
+    }
+
+    /// Tunnel kept open by a spearlet for debug sessions / spearlet 为调试会话保持的隧道
+    async fn debug_tunnel(
+        &self,
+        request: Request<Streaming<DebugTunnelUp>>,
+    ) -> Result<Response<Self::DebugTunnelStream>, Status> {
+        use crate::proto::sms::debug_tunnel_up::Frame;
+        let mut inbound = request.into_inner();
+        let node_uuid = match inbound.message().await? {
+            Some(DebugTunnelUp {
+                frame: Some(Frame::Hello(hello)),
+            }) if !hello.uuid.trim().is_empty() => hello.uuid,
+            _ => {
+                return Err(Status::invalid_argument(
+                    "first frame must be a hello with the node uuid",
+                ))
+            }
+        };
+        let hub = self.debug_tunnels.clone();
+        let (conn_id, rx) = hub.attach(&node_uuid);
+        tokio::spawn(async move {
+            while let Ok(Some(frame)) = inbound.message().await {
+                hub.on_frame(&node_uuid, frame);
+            }
+            hub.detach(&node_uuid, conn_id);
+        });
+        Ok(Response::new(Box::pin(
+            tokio_stream::wrappers::ReceiverStream::new(rx),
+        )))
+    }
+
+    /// Open a time-limited debug session on a node / 在节点上开启限时调试会话
+    async fn open_debug_session(
+        &self,
+        request: Request<OpenDebugSessionRequest>,
+    ) -> Result<Response<OpenDebugSessionResponse>, Status> {
+        let req = request.into_inner();
+        let session = self
+            .debug_tunnels
+            .open(&req.node_uuid, req.ttl_s, &req.operator, &req.reason)
+            .await?;
+        Ok(Response::new(OpenDebugSessionResponse {
+            session: Some(session),
+        }))
+    }
+
+    /// Close a debug session early / 提前关闭调试会话
+    async fn close_debug_session(
+        &self,
+        request: Request<CloseDebugSessionRequest>,
+    ) -> Result<Response<CloseDebugSessionResponse>, Status> {
+        let req = request.into_inner();
+        let success = self
+            .debug_tunnels
+            .close(&req.node_uuid, &req.session_id, &req.operator)
+            .await;
+        Ok(Response::new(CloseDebugSessionResponse { success }))
+    }
+
+    /// List open debug sessions / 列出已开启的调试会话
+    async fn list_debug_sessions(
+        &self,
+        request: Request<ListDebugSessionsRequest>,
+    ) -> Result<Response<ListDebugSessionsResponse>, Status> {
+        let req = request.into_inner();
+        let (sessions, connected_nodes) = self.debug_tunnels.list(&req.node_uuid);
+        Ok(Response::new(ListDebugSessionsResponse {
+            sessions,
+            connected_nodes,
+        }))
+    }
+
+    /// Send an HTTP request through a debug session / 通过调试会话发送 HTTP 请求
+    async fn proxy_debug_request(
+        &self,
+        request: Request<DebugHttpRequest>,
+    ) -> Result<Response<DebugHttpResponse>, Status> {
+        let resp = self.debug_tunnels.request(request.into_inner()).await?;
+        Ok(Response::new(resp))
+    }
+
+    /// Start a staged configuration rollout / 开始分阶段配置发布
+    async fn start_config_rollout(
+        &self,
+        request: Request<StartConfigRolloutRequest>,
+    ) -> Result<Response<StartConfigRolloutResponse>, Status> {
+        let rollout = self
+            .config_rollouts
+            .start(request.into_inner(), chrono::Utc::now().timestamp_millis())?;
+        Ok(Response::new(StartConfigRolloutResponse {
+            rollout: Some(rollout),
+        }))
+    }
+
+    /// List configuration rollouts / 列出配置发布
+    async fn list_config_rollouts(
+        &self,
+        _request: Request<ListConfigRolloutsRequest>,
+    ) -> Result<Response<ListConfigRolloutsResponse>, Status> {
+        let rollouts = self
+            .config_rollouts
+            .list(chrono::Utc::now().timestamp_millis());
+        Ok(Response::new(ListConfigRolloutsResponse { rollouts }))
+    }
+
+    /// Halt a running rollout / 中止进行中的发布
+    async fn halt_config_rollout(
+        &self,
+        request: Request<HaltConfigRolloutRequest>,
+    ) -> Result<Response<HaltConfigRolloutResponse>, Status> {
+        let req = request.into_inner();
+        let rollout = self.config_rollouts.halt(
+            &req.rollout_id,
+            &req.reason,
+            chrono::Utc::now().timestamp_millis(),
+        )?;
+        Ok(Response::new(HaltConfigRolloutResponse {
+            rollout: Some(rollout),
+        }))
+    }
 }
 
 // Implement TaskService trait / 实现TaskService trait
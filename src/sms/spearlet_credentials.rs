@@ -0,0 +1,31 @@
+//! Credential the SMS presents to spearlet gRPC services
+//! SMS 向 spearlet gRPC 服务出示的凭证
+//!
+//! Spearlets with `http.auth` enabled refuse gRPC calls without a credential. The SMS
+//! reads an API key from `SMS_SPEARLET_API_KEY` and attaches it to every call it makes to a
+//! node, and to requests it forwards through debug sessions; terminating executions,
+//! destroying instances and debug sessions need an `admin` key.
+//! 启用 `http.auth` 的 spearlet 会拒绝不带凭证的 gRPC 调用。SMS 从 `SMS_SPEARLET_API_KEY`
+//! 读取 API key，并附加到其对节点的每个调用以及经调试会话转发的请求上；终止执行、销毁实例与
+//! 调试会话需要 `admin` key。
+
+use tonic::{Request, Status};
+
+/// Environment variable holding the API key / 保存 API key 的环境变量
+pub const API_KEY_ENV: &str = "SMS_SPEARLET_API_KEY";
+
+/// The API key, if one is set / 已设置的 API key
+pub fn api_key() -> Option<String> {
+    std::env::var(API_KEY_ENV)
+        .ok()
+        .map(|k| k.trim().to_string())
+        .filter(|k| !k.is_empty())
+}
+
+/// Interceptor adding the API key, if one is set / 在设置了 API key 时附加它的拦截器
+pub fn attach(mut req: Request<()>) -> Result<Request<()>, Status> {
+    if let Some(key) = api_key().and_then(|k| k.parse().ok()) {
+        req.metadata_mut().insert("x-api-key", key);
+    }
+    Ok(req)
+}
@@ -7,7 +7,7 @@ use axum::response::IntoResponse;
 use axum::{
     extract::{Path, Query},
     response::{Html, Json},
-    Router,
+    Extension, Router,
 };
 use futures::StreamExt;
 use serde::Deserialize;
@@ -28,9 +28,11 @@ use crate::proto::sms::{
     node_service_client::NodeServiceClient, placement_service_client::PlacementServiceClient,
     ListNodesRequest,
 };
+use crate::sms::debug_operators::Operator;
 use crate::sms::gateway::GatewayState;
+use crate::sms::spearlet_credentials;
 pub use router::create_admin_router;
-use types::{AiModelsQuery, ListQuery, PageTokenQuery, StreamQuery};
+use types::{AiModelsQuery, DebugSessionsQuery, ListQuery, PageTokenQuery, StreamQuery};
 
 use crate::proto::spearlet::{
     execution_service_client::ExecutionServiceClient,
@@ -133,6 +135,9 @@ impl WebAdminServer {
             files_dir: self.files_dir.clone(),
         };
         let mut app = create_admin_router(state);
+        // Optional for the admin as a whole; debug session routes authenticate operators
+        // on their own either way (see `debug_operators`)
+        // 对整个管理界面是可选的；调试会话路由无论如何都会自行认证操作人（见 `debug_operators`）
         if let Ok(token) = std::env::var("SMS_WEB_ADMIN_TOKEN") {
             let bearer = format!("Bearer {}", token);
             app = app.layer(middleware::from_fn(
@@ -565,8 +570,12 @@ async fn list_ai_models(
                 b.provider.clone()
             } else if b.kind.starts_with("openai_") {
                 "openai".to_string()
-            } else if b.kind == "ollama_chat" {
+            } else if b.kind.starts_with("ollama_") {
                 "ollama".to_string()
+            } else if b.kind.starts_with("anthropic_") {
+                "anthropic".to_string()
+            } else if b.kind.starts_with("gemini_") {
+                "google".to_string()
             } else if b.kind == "stub" {
                 "internal".to_string()
             } else {
@@ -576,7 +585,7 @@ async fn list_ai_models(
             let mut model = b.model.clone();
             if model.trim().is_empty() {
                 model = "(dynamic)".to_string();
-                if b.kind == "ollama_chat" && b.name.contains('/') {
+                if b.kind.starts_with("ollama_") && b.name.contains('/') {
                     if let Some((_, rest)) = b.name.split_once('/') {
                         if !rest.trim().is_empty() {
                             model = rest.to_string();
@@ -1158,7 +1167,8 @@ pub(super) async fn terminate_execution_admin(
         return Json(json!({"success": false, "message": "invalid node url"}));
     };
 
-    let mut client = ExecutionServiceClient::new(channel);
+    let mut client =
+        ExecutionServiceClient::with_interceptor(channel, spearlet_credentials::attach);
     let reason = body.reason.unwrap_or_default();
     let resp = match client
         .terminate_execution(TerminateExecutionRequest {
@@ -1219,7 +1229,7 @@ pub(super) async fn destroy_instance_admin(
         return Json(json!({"success": false, "message": "invalid node url"}));
     };
 
-    let mut client = InstanceServiceClient::new(channel);
+    let mut client = InstanceServiceClient::with_interceptor(channel, spearlet_credentials::attach);
     let reason = body.reason.unwrap_or_default();
     let resp = match client
         .destroy_instance(DestroyInstanceRequest {
@@ -1286,7 +1296,8 @@ async fn create_invocation(
         let Some(channel) = channel else {
             return Json(json!({ "success": false, "message": "invalid node url" }));
         };
-        let mut invc = InvocationServiceClient::new(channel);
+        let mut invc =
+            InvocationServiceClient::with_interceptor(channel, spearlet_credentials::attach);
         let req = InvokeRequest {
             invocation_id: request_id.clone(),
             execution_id: execution_id.clone(),
@@ -1368,7 +1379,8 @@ async fn create_invocation(
                 .await;
             continue;
         };
-        let mut invc = InvocationServiceClient::new(channel);
+        let mut invc =
+            InvocationServiceClient::with_interceptor(channel, spearlet_credentials::attach);
         // Use ExistingTask invocation; Spearlet may fetch task from SMS when missing.
         // 使用 ExistingTask 调用；若节点本地缺 task，Spearlet 会从 SMS 拉取补齐后执行。
         let req = InvokeRequest {
@@ -2028,6 +2040,266 @@ async fn get_node_detail(state: GatewayState, Path(uuid): Path<String>) -> Json<
     Json(body)
 }
 
+/// The operator comes from the credential, never from the body / 操作人取自凭证，而非请求体
+#[derive(Deserialize)]
+pub(crate) struct OpenDebugSessionBody {
+    ttl_s: Option<u64>,
+    reason: String,
+}
+
+fn debug_session_json(s: &crate::proto::sms::DebugSession) -> serde_json::Value {
+    json!({
+        "session_id": s.session_id,
+        "node_uuid": s.node_uuid,
+        "operator": s.operator,
+        "reason": s.reason,
+        "opened_at_ms": s.opened_at_ms,
+        "expires_at_ms": s.expires_at_ms,
+    })
+}
+
+async fn list_debug_sessions(
+    state: GatewayState,
+    Query(q): Query<DebugSessionsQuery>,
+) -> Json<serde_json::Value> {
+    use crate::proto::sms::ListDebugSessionsRequest;
+    let mut client = state.node_client.clone();
+    match client
+        .list_debug_sessions(ListDebugSessionsRequest {
+            node_uuid: q.node_uuid.unwrap_or_default(),
+        })
+        .await
+    {
+        Ok(r) => {
+            let r = r.into_inner();
+            Json(json!({
+                "success": true,
+                "sessions": r.sessions.iter().map(debug_session_json).collect::<Vec<_>>(),
+                "connected_nodes": r.connected_nodes,
+            }))
+        }
+        Err(e) => Json(json!({"success": false, "message": e.message()})),
+    }
+}
+
+async fn open_debug_session(
+    state: GatewayState,
+    Path(uuid): Path<String>,
+    Extension(Operator(operator)): Extension<Operator>,
+    Json(body): Json<OpenDebugSessionBody>,
+) -> Json<serde_json::Value> {
+    use crate::proto::sms::OpenDebugSessionRequest;
+    let mut client = state.node_client.clone();
+    match client
+        .open_debug_session(OpenDebugSessionRequest {
+            node_uuid: uuid,
+            ttl_s: body.ttl_s.unwrap_or(0),
+            operator,
+            reason: body.reason,
+        })
+        .await
+    {
+        Ok(r) => match r.into_inner().session {
+            Some(s) => Json(json!({"success": true, "session": debug_session_json(&s)})),
+            None => Json(json!({"success": false, "message": "no session returned"})),
+        },
+        Err(e) => Json(json!({"success": false, "message": e.message()})),
+    }
+}
+
+async fn close_debug_session(
+    state: GatewayState,
+    Path((uuid, session_id)): Path<(String, String)>,
+    Extension(Operator(operator)): Extension<Operator>,
+) -> Json<serde_json::Value> {
+    use crate::proto::sms::CloseDebugSessionRequest;
+    let mut client = state.node_client.clone();
+    match client
+        .close_debug_session(CloseDebugSessionRequest {
+            node_uuid: uuid,
+            session_id,
+            operator,
+        })
+        .await
+    {
+        Ok(r) => Json(json!({"success": r.into_inner().success})),
+        Err(e) => Json(json!({"success": false, "message": e.message()})),
+    }
+}
+
+/// Request headers forwarded to the node / 转发给节点的请求头
+const DEBUG_FORWARDED_HEADERS: &[&str] = &["accept", "content-type", "x-api-key"];
+
+/// Forward a request to a node through its debug session / 通过调试会话将请求转发给节点
+async fn proxy_debug_request(
+    state: GatewayState,
+    Path((uuid, session_id, path)): Path<(String, String, String)>,
+    Extension(Operator(operator)): Extension<Operator>,
+    method: axum::http::Method,
+    axum::extract::RawQuery(query): axum::extract::RawQuery,
+    headers: HeaderMap,
+    body: axum::body::Bytes,
+) -> axum::response::Response {
+    use crate::proto::sms::DebugHttpRequest;
+    let path = match query {
+        Some(q) => format!("/{}?{}", path, q),
+        None => format!("/{}", path),
+    };
+    let mut forwarded: std::collections::HashMap<String, String> = DEBUG_FORWARDED_HEADERS
+        .iter()
+        .filter_map(|name| {
+            let v = headers.get(*name)?.to_str().ok()?;
+            Some((name.to_string(), v.to_string()))
+        })
+        .collect();
+    // Nodes authenticate tunnel requests; the SMS key stands in for operators without one
+    // 节点会认证隧道请求；操作人未提供 key 时使用 SMS 的 key
+    if let Some(key) = spearlet_credentials::api_key() {
+        forwarded.entry("x-api-key".to_string()).or_insert(key);
+    }
+    let mut client = state.node_client.clone();
+    let resp = match client
+        .proxy_debug_request(DebugHttpRequest {
+            node_uuid: uuid,
+            session_id,
+            request_id: String::new(),
+            method: method.to_string(),
+            path,
+            headers: forwarded,
+            body: body.to_vec(),
+            operator,
+        })
+        .await
+    {
+        Ok(r) => r.into_inner(),
+        Err(e) => {
+            let status = match e.code() {
+                tonic::Code::NotFound => StatusCode::NOT_FOUND,
+                tonic::Code::FailedPrecondition | tonic::Code::Unavailable => {
+                    StatusCode::BAD_GATEWAY
+                }
+                tonic::Code::DeadlineExceeded => StatusCode::GATEWAY_TIMEOUT,
+                _ => StatusCode::INTERNAL_SERVER_ERROR,
+            };
+            return (
+                status,
+                Json(json!({"success": false, "message": e.message()})),
+            )
+                .into_response();
+        }
+    };
+    let status = StatusCode::from_u16(resp.status as u16).unwrap_or(StatusCode::BAD_GATEWAY);
+    let mut out = (status, resp.body).into_response();
+    if let Some(ct) = resp
+        .headers
+        .get("content-type")
+        .and_then(|v| axum::http::HeaderValue::from_str(v).ok())
+    {
+        out.headers_mut().insert(CONTENT_TYPE, ct);
+    }
+    out
+}
+
+#[derive(Deserialize)]
+pub(crate) struct StartConfigRolloutBody {
+    /// Partial spearlet configuration / 部分 spearlet 配置
+    overlay: serde_json::Value,
+    stages: Option<Vec<u32>>,
+    stage_hold_s: Option<u64>,
+    max_error_rate: Option<f64>,
+    min_executions: Option<u64>,
+    operator: String,
+}
+
+#[derive(Deserialize)]
+pub(crate) struct HaltConfigRolloutBody {
+    reason: Option<String>,
+}
+
+fn config_rollout_json(r: &crate::proto::sms::ConfigRollout) -> serde_json::Value {
+    json!({
+        "rollout_id": r.rollout_id,
+        "overlay": serde_json::from_str::<serde_json::Value>(&r.overlay_json)
+            .unwrap_or(serde_json::Value::Null),
+        "stages": r.stages,
+        "stage_index": r.stage_index,
+        "stage_hold_s": r.stage_hold_s,
+        "max_error_rate": r.max_error_rate,
+        "min_executions": r.min_executions,
+        "status": r.status,
+        "canary_nodes": r.canary_nodes,
+        "executions": r.executions,
+        "failures": r.failures,
+        "halt_reason": r.halt_reason,
+        "operator": r.operator,
+        "created_at_ms": r.created_at_ms,
+        "stage_started_at_ms": r.stage_started_at_ms,
+        "finished_at_ms": r.finished_at_ms,
+    })
+}
+
+async fn list_config_rollouts(state: GatewayState) -> Json<serde_json::Value> {
+    use crate::proto::sms::ListConfigRolloutsRequest;
+    let mut client = state.node_client.clone();
+    match client
+        .list_config_rollouts(ListConfigRolloutsRequest {})
+        .await
+    {
+        Ok(r) => Json(json!({
+            "success": true,
+            "rollouts": r.into_inner().rollouts.iter().map(config_rollout_json).collect::<Vec<_>>(),
+        })),
+        Err(e) => Json(json!({"success": false, "message": e.message()})),
+    }
+}
+
+async fn start_config_rollout(
+    state: GatewayState,
+    Json(body): Json<StartConfigRolloutBody>,
+) -> Json<serde_json::Value> {
+    use crate::proto::sms::StartConfigRolloutRequest;
+    let mut client = state.node_client.clone();
+    match client
+        .start_config_rollout(StartConfigRolloutRequest {
+            overlay_json: body.overlay.to_string(),
+            stages: body.stages.unwrap_or_default(),
+            stage_hold_s: body.stage_hold_s.unwrap_or(0),
+            max_error_rate: body.max_error_rate.unwrap_or(0.0),
+            min_executions: body.min_executions.unwrap_or(0),
+            operator: body.operator,
+        })
+        .await
+    {
+        Ok(r) => match r.into_inner().rollout {
+            Some(r) => Json(json!({"success": true, "rollout": config_rollout_json(&r)})),
+            None => Json(json!({"success": false, "message": "no rollout returned"})),
+        },
+        Err(e) => Json(json!({"success": false, "message": e.message()})),
+    }
+}
+
+async fn halt_config_rollout(
+    state: GatewayState,
+    Path(rollout_id): Path<String>,
+    Json(body): Json<HaltConfigRolloutBody>,
+) -> Json<serde_json::Value> {
+    use crate::proto::sms::HaltConfigRolloutRequest;
+    let mut client = state.node_client.clone();
+    match client
+        .halt_config_rollout(HaltConfigRolloutRequest {
+            rollout_id,
+            reason: body.reason.unwrap_or_default(),
+        })
+        .await
+    {
+        Ok(r) => match r.into_inner().rollout {
+            Some(r) => Json(json!({"success": true, "rollout": config_rollout_json(&r)})),
+            None => Json(json!({"success": false, "message": "no rollout returned"})),
+        },
+        Err(e) => Json(json!({"success": false, "message": e.message()})),
+    }
+}
+
 async fn get_stats(state: GatewayState) -> Json<serde_json::Value> {
     use crate::proto::sms::ListNodesRequest;
     let mut client = state.node_client.clone();
@@ -1,9 +1,11 @@
 use axum::{
     extract::{Path, Query},
-    routing::{delete, get, post},
-    Json, Router,
+    middleware,
+    routing::{any, delete, get, post},
+    Extension, Json, Router,
 };
 
+use crate::sms::debug_operators::{require_operator, DebugOperators, Operator};
 use crate::sms::gateway::GatewayState;
 use crate::sms::handlers::{
     delete_file, download_execution_logs_admin, download_file, get_execution_logs_admin,
@@ -110,6 +112,28 @@ pub fn create_admin_router(state: GatewayState) -> Router {
                 }
             }),
         )
+        .route(
+            "/admin/api/config-rollouts",
+            get({
+                let state = state.clone();
+                move || super::list_config_rollouts(state.clone())
+            })
+            .post({
+                let state = state.clone();
+                move |body: Json<super::StartConfigRolloutBody>| {
+                    super::start_config_rollout(state.clone(), body)
+                }
+            }),
+        )
+        .route(
+            "/admin/api/config-rollouts/{rollout_id}/halt",
+            post({
+                let state = state.clone();
+                move |p: Path<String>, body: Json<super::HaltConfigRolloutBody>| {
+                    super::halt_config_rollout(state.clone(), p, body)
+                }
+            }),
+        )
         .route(
             "/admin/api/mcp/servers",
             get({
@@ -238,5 +262,59 @@ pub fn create_admin_router(state: GatewayState) -> Router {
         .route("/admin/api/files/{id}", get(download_file))
         .route("/admin/api/files/{id}", delete(delete_file))
         .route("/admin/api/files/{id}/meta", get(get_file_meta))
+        .merge(debug_session_routes(&state))
         .with_state(state)
 }
+
+/// Debug session routes; always authenticated, see [`crate::sms::debug_operators`]
+/// 调试会话路由；始终需要认证，见 [`crate::sms::debug_operators`]
+fn debug_session_routes(state: &GatewayState) -> Router<GatewayState> {
+    Router::new()
+        .route(
+            "/admin/api/debug-sessions",
+            get({
+                let state = state.clone();
+                move |q: Query<super::types::DebugSessionsQuery>| {
+                    super::list_debug_sessions(state.clone(), q)
+                }
+            }),
+        )
+        .route(
+            "/admin/api/nodes/{uuid}/debug-sessions",
+            post({
+                let state = state.clone();
+                move |p: Path<String>,
+                      op: Extension<Operator>,
+                      body: Json<super::OpenDebugSessionBody>| {
+                    super::open_debug_session(state.clone(), p, op, body)
+                }
+            }),
+        )
+        .route(
+            "/admin/api/nodes/{uuid}/debug-sessions/{session_id}",
+            delete({
+                let state = state.clone();
+                move |p: Path<(String, String)>, op: Extension<Operator>| {
+                    super::close_debug_session(state.clone(), p, op)
+                }
+            }),
+        )
+        .route(
+            "/admin/api/nodes/{uuid}/debug-sessions/{session_id}/proxy/{*path}",
+            any({
+                let state = state.clone();
+                move |p: Path<(String, String, String)>,
+                      op: Extension<Operator>,
+                      method: axum::http::Method,
+                      query: axum::extract::RawQuery,
+                      headers: axum::http::HeaderMap,
+                      body: axum::body::Bytes| {
+                    super::proxy_debug_request(state.clone(), p, op, method, query, headers, body)
+                }
+            }),
+        )
+        .route_layer(middleware::from_fn_with_state(
+            DebugOperators::from_env(),
+            require_operator,
+        ))
+}
@@ -30,3 +30,8 @@ pub(crate) struct PageTokenQuery {
 pub(crate) struct StreamQuery {
     pub(crate) once: Option<bool>,
 }
+
+#[derive(Deserialize)]
+pub(crate) struct DebugSessionsQuery {
+    pub(crate) node_uuid: Option<String>,
+}
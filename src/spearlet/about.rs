@@ -0,0 +1,185 @@
+//! Node capability document for SDKs / 面向 SDK 的节点能力文档
+//!
+//! `GET /about` describes in one document what this spearlet offers: its version and
+//! build features, the subsystems turned on in its config, the runtimes, stream classes,
+//! hostcalls and tools workloads can use, and the limits they run under. SDKs read it to
+//! check compatibility before deploying a workload. Unlike `/admin/introspect` it holds no
+//! workload, request or credential data, so it only needs the `invoke` role.
+//! `GET /about` 用一个文档描述本 spearlet 提供的能力：版本与构建 feature、配置中启用的子系统、
+//! 工作负载可用的运行时、流类别、hostcall 与工具，以及其运行所受的限制。SDK 在部署工作负载前读取
+//! 它以检查兼容性。与 `/admin/introspect` 不同，它不含工作负载、请求或凭证数据，因此只需要
+//! `invoke` 角色。
+
+use std::collections::BTreeMap;
+
+use serde::Serialize;
+
+use crate::spearlet::admin;
+use crate::spearlet::build_info;
+use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::execution::manager::TaskExecutionManager;
+
+/// Version of the document layout; bumped when fields change meaning or go away
+/// 文档结构的版本；字段含义变化或被移除时递增
+pub const ABOUT_SCHEMA_VERSION: u32 = 1;
+
+#[derive(Debug, Clone, Serialize)]
+pub struct About {
+    pub schema_version: u32,
+    pub service: &'static str,
+    pub version: &'static str,
+    pub build_profile: &'static str,
+    pub node_name: String,
+    /// Cargo features by name / 按名称列出的 Cargo feature
+    pub features: BTreeMap<&'static str, bool>,
+    /// Optional subsystems by config section / 按配置段列出的可选子系统
+    pub subsystems: BTreeMap<&'static str, bool>,
+    pub runtimes: Vec<&'static str>,
+    pub stream_classes: Vec<admin::StreamClassInfo>,
+    /// Hostcalls the policy lets workloads import / 策略允许工作负载导入的 hostcall
+    pub hostcalls: Vec<&'static str>,
+    pub hostcall_middleware: Vec<&'static str>,
+    pub tools: AboutTools,
+    pub limits: AboutLimits,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct AboutTools {
+    /// Tools from `tool_plugins`, without the `plugin__` prefix
+    /// 来自 `tool_plugins` 的工具，不含 `plugin__` 前缀
+    pub plugins: Vec<String>,
+    pub simulation: bool,
+    /// Namespaces of MCP server tools / MCP 服务工具的命名空间
+    pub mcp_namespaces: Vec<String>,
+}
+
+/// Limits workloads run under; 0 means unlimited / 工作负载运行所受的限制；0 表示不限制
+#[derive(Debug, Clone, Serialize)]
+pub struct AboutLimits {
+    pub max_concurrent_executions: usize,
+    pub max_instances_per_task: usize,
+    pub max_request_body_bytes: usize,
+    pub max_response_bytes: u64,
+    pub max_stream_ms: u64,
+    pub hostcall_timeout_ms: u64,
+    pub hostcall_pool_max_concurrent: usize,
+    pub hostcall_pool_max_per_task: usize,
+    pub child_invoke_max_depth: u32,
+    pub child_invoke_max_children: usize,
+}
+
+fn subsystems(cfg: &SpearletConfig) -> BTreeMap<&'static str, bool> {
+    BTreeMap::from([
+        ("async_journal", cfg.async_journal.enabled),
+        ("backend_autosuspend", cfg.backend_autosuspend.enabled),
+        ("blob_cache", cfg.blob_cache.enabled),
+        ("child_invoke", cfg.execution.child_invoke.enabled),
+        ("compute_hints", cfg.compute_hints.enabled),
+        ("energy", cfg.energy.enabled),
+        ("kv_state", cfg.kv_state.enabled),
+        ("message_passing", cfg.message_passing.enabled),
+        ("moderation", cfg.moderation.enabled),
+        ("onnx", cfg!(feature = "onnx") && cfg.onnx.enabled),
+        ("preemption", cfg.preemption.enabled),
+        ("response_cache", cfg.response_cache.enabled),
+        ("rtsp", cfg!(feature = "rtsp") && cfg.rtsp.enabled),
+        ("schedules", cfg.schedules.enabled),
+        ("scratch_files", cfg.scratch_files.enabled),
+        ("service_ports", cfg.service_ports.enabled),
+        (
+            "telephony",
+            cfg!(feature = "telephony") && cfg.telephony.enabled,
+        ),
+        ("temp_workspace", cfg.temp_workspace.enabled),
+        ("test_hostcalls", cfg.test_hostcalls),
+        ("usage", cfg.usage.enabled),
+        ("vector_store", cfg.vector_store.enabled),
+        ("webrtc", cfg!(feature = "webrtc") && cfg.webrtc.enabled),
+    ])
+}
+
+fn allowed_hostcalls(cfg: &SpearletConfig) -> Vec<&'static str> {
+    let policy = &cfg.execution.hostcall_policy;
+    admin::hostcalls()
+        .into_iter()
+        .filter(|m| policy.allows(m))
+        .collect()
+}
+
+/// Build the document from the live config and manager / 基于当前配置与管理器构建文档
+pub fn about(cfg: &SpearletConfig, mgr: &TaskExecutionManager) -> About {
+    let exec = &cfg.execution;
+    let tools = admin::tools();
+    let mut mcp_namespaces: Vec<String> = tools
+        .mcp_servers
+        .into_iter()
+        .map(|s| s.tool_namespace)
+        .collect();
+    mcp_namespaces.sort();
+    mcp_namespaces.dedup();
+    About {
+        schema_version: ABOUT_SCHEMA_VERSION,
+        service: "spearlet",
+        version: build_info::version(),
+        build_profile: build_info::build_profile(),
+        node_name: cfg.node_name.clone(),
+        features: build_info::capabilities()
+            .into_iter()
+            .map(|c| (c.feature, c.enabled))
+            .collect(),
+        subsystems: subsystems(cfg),
+        runtimes: admin::runtimes(mgr)
+            .into_iter()
+            .map(|r| r.runtime)
+            .collect(),
+        stream_classes: admin::streams(cfg, mgr.node()).classes,
+        hostcalls: allowed_hostcalls(cfg),
+        hostcall_middleware: mgr.node().hostcall_chain.names(),
+        tools: AboutTools {
+            plugins: tools.plugins,
+            simulation: tools.simulation,
+            mcp_namespaces,
+        },
+        limits: AboutLimits {
+            max_concurrent_executions: exec.max_concurrent_executions,
+            max_instances_per_task: exec.max_instances_per_task,
+            max_request_body_bytes: cfg.http.max_body_bytes,
+            max_response_bytes: exec.output_caps.max_response_bytes,
+            max_stream_ms: exec.output_caps.max_stream_ms,
+            hostcall_timeout_ms: exec.hostcall_timeouts.default_ms,
+            hostcall_pool_max_concurrent: exec.hostcall_pool.max_concurrent,
+            hostcall_pool_max_per_task: exec.hostcall_pool.max_per_task,
+            child_invoke_max_depth: exec.child_invoke.max_depth,
+            child_invoke_max_children: exec.child_invoke.max_children,
+        },
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_subsystems_follow_config() {
+        let mut cfg = SpearletConfig::default();
+        cfg.kv_state.enabled = !cfg.kv_state.enabled;
+        cfg.test_hostcalls = true;
+        cfg.rtsp.enabled = true;
+        let s = subsystems(&cfg);
+        assert_eq!(s["kv_state"], cfg.kv_state.enabled);
+        assert!(s["test_hostcalls"]);
+        assert_eq!(s["rtsp"], cfg!(feature = "rtsp"));
+        assert_eq!(s["child_invoke"], cfg.execution.child_invoke.enabled);
+    }
+
+    #[test]
+    fn test_hostcalls_follow_policy() {
+        let mut cfg = SpearletConfig::default();
+        assert_eq!(allowed_hostcalls(&cfg), admin::hostcalls());
+        cfg.execution.hostcall_policy.allow = vec!["time_now_ms".to_string()];
+        let allowed = allowed_hostcalls(&cfg);
+        assert!(allowed.iter().all(|m| *m == "time_now_ms"));
+        cfg.execution.hostcall_policy.deny = vec!["time_now_ms".to_string()];
+        assert!(allowed_hostcalls(&cfg).is_empty());
+    }
+}
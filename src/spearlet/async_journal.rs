@@ -0,0 +1,562 @@
+//! Journal of async invocations / 异步调用日志
+//!
+//! An async invocation is accepted before it runs, so without a record a spearlet restart
+//! loses every queued or running job, and a client that retries after a timeout may start a
+//! second one. With the journal on, each async request is written to a [`KvStore`] under the
+//! journal directory (sled by default), one store key per invocation, before it is queued,
+//! and marked done when it finishes; requests still pending at startup are submitted again
+//! under their execution id. A request may carry an idempotency key: while the journal
+//! remembers the key for that task, a repeated request returns the first execution instead
+//! of running again. Together this gives at-least-once execution with deduplicated
+//! submissions; a job cut off by a restart runs again from the start.
+//! 异步调用在运行前即被接受，因此若无记录，spearlet 重启会丢失所有排队或运行中的任务，而超时后重试的
+//! 客户端可能启动第二个任务。开启日志后，每个异步请求在排队前写入日志目录下的 [`KvStore`]（默认为
+//! sled），每次调用一个存储键，结束时标记为完成；启动时仍未完成的请求以原执行 ID 重新提交。请求可以
+//! 携带幂等键：日志仍记得该任务的该键时，重复请求返回首次的执行而不再运行。由此实现带去重提交的至少
+//! 一次执行；被重启打断的任务会从头再次运行。
+
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+use base64::{engine::general_purpose, Engine as _};
+use parking_lot::{Mutex, RwLock};
+use serde::{Deserialize, Serialize};
+
+use crate::proto::spearlet::{ExecutionMode, InvokeRequest, Payload};
+use crate::spearlet::config::{AsyncJournalConfig, SpearletConfig};
+use crate::spearlet::local_store::LocalStore;
+use crate::storage::kv::KvStore;
+
+/// Invocation metadata key of the idempotency key / 幂等键的调用元数据键
+pub const METADATA_IDEMPOTENCY_KEY: &str = "idempotency_key";
+
+/// Status of a job that has not finished / 尚未结束的任务状态
+pub const STATUS_PENDING: &str = "pending";
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum JournalError {
+    #[error("async journal is disabled")]
+    Disabled,
+    #[error("max_pending {0} async jobs are pending")]
+    Full(usize),
+    #[error("journal store error: {0}")]
+    Store(String),
+}
+
+/// An async request as written to the journal / 写入日志的异步请求
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct JournaledRequest {
+    pub invocation_id: String,
+    pub execution_id: String,
+    pub task_id: String,
+    pub function_name: String,
+    pub content_type: String,
+    pub input_base64: String,
+    pub headers: HashMap<String, String>,
+    pub environment: HashMap<String, String>,
+    pub timeout_ms: u64,
+    pub session_id: String,
+    pub force_new_instance: bool,
+    pub metadata: HashMap<String, String>,
+}
+
+impl JournaledRequest {
+    pub fn from_request(req: &InvokeRequest, execution_id: &str) -> Self {
+        let input = req.input.clone().unwrap_or_default();
+        Self {
+            invocation_id: req.invocation_id.clone(),
+            execution_id: execution_id.to_string(),
+            task_id: req.task_id.clone(),
+            function_name: req.function_name.clone(),
+            content_type: input.content_type,
+            input_base64: general_purpose::STANDARD.encode(input.data),
+            headers: req.headers.clone(),
+            environment: req.environment.clone(),
+            timeout_ms: req.timeout_ms,
+            session_id: req.session_id.clone(),
+            force_new_instance: req.force_new_instance,
+            metadata: req.metadata.clone(),
+        }
+    }
+
+    /// The async request to submit again / 用于重新提交的异步请求
+    pub fn to_request(&self) -> InvokeRequest {
+        InvokeRequest {
+            invocation_id: self.invocation_id.clone(),
+            execution_id: self.execution_id.clone(),
+            task_id: self.task_id.clone(),
+            function_name: self.function_name.clone(),
+            input: Some(Payload {
+                content_type: self.content_type.clone(),
+                data: general_purpose::STANDARD
+                    .decode(&self.input_base64)
+                    .unwrap_or_default(),
+            }),
+            headers: self.headers.clone(),
+            environment: self.environment.clone(),
+            timeout_ms: self.timeout_ms,
+            session_id: self.session_id.clone(),
+            mode: ExecutionMode::Async as i32,
+            force_new_instance: self.force_new_instance,
+            metadata: self.metadata.clone(),
+        }
+    }
+}
+
+/// Stored record of one async invocation / 单次异步调用的存储记录
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Entry {
+    execution_id: String,
+    task_id: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    idempotency_key: String,
+    status: String,
+    updated_at_ms: i64,
+    /// The request, dropped once the job finished / 请求；任务结束后丢弃
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    request: Option<JournaledRequest>,
+}
+
+impl Entry {
+    fn pending(&self) -> bool {
+        self.request.is_some()
+    }
+}
+
+/// What `accept` decided / `accept` 的决定
+#[derive(Debug, Clone, PartialEq)]
+pub enum Admission {
+    /// Recorded; queue the job / 已记录；将任务排队
+    Accepted,
+    /// The request repeats an earlier one / 请求与先前的请求重复
+    Duplicate {
+        execution_id: String,
+        status: String,
+    },
+}
+
+#[derive(Default)]
+struct State {
+    /// Entries by execution id / 按执行 ID 索引的记录
+    entries: HashMap<String, Entry>,
+    /// Execution ids by task and idempotency key / 按任务与幂等键索引的执行 ID
+    keys: HashMap<(String, String), String>,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct JournalStats {
+    pub enabled: bool,
+    pub backend: String,
+    pub dir: String,
+    pub pending: usize,
+    /// Finished jobs kept to answer repeated keys / 为应答重复键而保留的已结束任务
+    pub finished: usize,
+}
+
+/// Journal directory for a configuration / 配置对应的日志目录
+pub fn journal_dir(config: &SpearletConfig) -> PathBuf {
+    if config.async_journal.dir.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("async_journal")
+    } else {
+        PathBuf::from(&config.async_journal.dir)
+    }
+}
+
+/// Store key prefix of the journal entries / 日志记录的存储键前缀
+const ENTRY_PREFIX: &str = "job/";
+
+/// Store key of one invocation / 单次调用的存储键
+fn entry_key(execution_id: &str) -> String {
+    format!("{}{}", ENTRY_PREFIX, execution_id)
+}
+
+fn store_err(e: impl std::fmt::Display) -> JournalError {
+    JournalError::Store(e.to_string())
+}
+
+pub struct AsyncJournal {
+    config: RwLock<(AsyncJournalConfig, PathBuf)>,
+    store: LocalStore,
+    /// Entries read from the store on first use / 首次使用时从存储读取的记录
+    loaded: Mutex<Option<State>>,
+    /// Serializes calls so `max_pending` and key lookups hold
+    /// 串行化调用以保证 `max_pending` 与键查找
+    calls: tokio::sync::Mutex<()>,
+}
+
+impl AsyncJournal {
+    pub fn new(config: AsyncJournalConfig, dir: PathBuf) -> Self {
+        Self {
+            config: RwLock::new((config, dir)),
+            store: LocalStore::new(),
+            loaded: Mutex::new(None),
+            calls: tokio::sync::Mutex::new(()),
+        }
+    }
+
+    /// Apply a new configuration; entries are kept in the store and read again on next use
+    /// 应用新配置；记录保留在存储中，下次使用时重新读取
+    pub fn set_config(&self, config: AsyncJournalConfig, dir: PathBuf) {
+        *self.config.write() = (config, dir);
+        self.store.close();
+        *self.loaded.lock() = None;
+    }
+
+    pub fn enabled(&self) -> bool {
+        self.config.read().0.enabled
+    }
+
+    async fn load(store: &dyn KvStore) -> Result<State, JournalError> {
+        let mut state = State::default();
+        for pair in store.scan_prefix(ENTRY_PREFIX).await.map_err(store_err)? {
+            let entry: Entry = match serde_json::from_slice(&pair.value) {
+                Ok(entry) => entry,
+                Err(e) => {
+                    tracing::warn!(key = %pair.key, error = %e, "skipping unreadable journal entry");
+                    continue;
+                }
+            };
+            if !entry.idempotency_key.is_empty() {
+                state.keys.insert(
+                    (entry.task_id.clone(), entry.idempotency_key.clone()),
+                    entry.execution_id.clone(),
+                );
+            }
+            state.entries.insert(entry.execution_id.clone(), entry);
+        }
+        Ok(state)
+    }
+
+    async fn save(store: &dyn KvStore, entry: &Entry) -> Result<(), JournalError> {
+        let bytes = serde_json::to_vec(entry).map_err(store_err)?;
+        store
+            .put(&entry_key(&entry.execution_id), &bytes)
+            .await
+            .map_err(store_err)
+    }
+
+    /// Delete an entry from the store and from the loaded state
+    /// 从存储与已加载的状态中删除记录
+    async fn remove(&self, store: &dyn KvStore, execution_id: &str) -> Result<(), JournalError> {
+        store
+            .delete(&entry_key(execution_id))
+            .await
+            .map_err(store_err)?;
+        if let Some(state) = self.loaded.lock().as_mut() {
+            if let Some(e) = state.entries.remove(execution_id) {
+                state.keys.remove(&(e.task_id, e.idempotency_key));
+            }
+        }
+        Ok(())
+    }
+
+    /// Open the store and load the entries, dropping finished ones past `dedup_ttl_s`;
+    /// callers hold `calls`
+    /// 打开存储并加载记录，丢弃超过 `dedup_ttl_s` 的已结束记录；调用方需持有 `calls`
+    async fn open(&self) -> Result<(AsyncJournalConfig, Arc<dyn KvStore>, i64), JournalError> {
+        let (cfg, dir) = self.config.read().clone();
+        if !cfg.enabled {
+            return Err(JournalError::Disabled);
+        }
+        let store = self
+            .store
+            .get(&cfg.backend, &dir)
+            .await
+            .map_err(JournalError::Store)?;
+        if self.loaded.lock().is_none() {
+            let state = Self::load(store.as_ref()).await?;
+            *self.loaded.lock() = Some(state);
+        }
+        let now_ms = chrono::Utc::now().timestamp_millis();
+        let ttl_ms = i64::try_from(cfg.dedup_ttl_s.saturating_mul(1000)).unwrap_or(i64::MAX);
+        let expired: Vec<String> = self
+            .loaded
+            .lock()
+            .iter()
+            .flat_map(|s| s.entries.values())
+            .filter(|e| !e.pending() && e.updated_at_ms.saturating_add(ttl_ms) <= now_ms)
+            .map(|e| e.execution_id.clone())
+            .collect();
+        for id in expired {
+            self.remove(store.as_ref(), &id).await?;
+        }
+        Ok((cfg, store, now_ms))
+    }
+
+    /// Record an async request under `execution_id` unless it repeats an earlier one, by
+    /// idempotency key or by a caller-chosen execution id
+    /// 以 `execution_id` 记录异步请求，除非它按幂等键或调用方指定的执行 ID 重复了先前的请求
+    pub async fn accept(
+        &self,
+        req: &InvokeRequest,
+        execution_id: &str,
+    ) -> Result<Admission, JournalError> {
+        let _call = self.calls.lock().await;
+        let (cfg, store, now_ms) = self.open().await?;
+        let key = req
+            .metadata
+            .get(METADATA_IDEMPOTENCY_KEY)
+            .map(|k| k.trim().to_string())
+            .unwrap_or_default();
+        {
+            let loaded = self.loaded.lock();
+            let state = loaded.as_ref().expect("loaded by open");
+            let earlier = if key.is_empty() {
+                None
+            } else {
+                state.keys.get(&(req.task_id.clone(), key.clone()))
+            };
+            let earlier = earlier
+                .or_else(|| (!req.execution_id.is_empty()).then_some(&req.execution_id))
+                .and_then(|id| state.entries.get(id));
+            if let Some(e) = earlier {
+                return Ok(Admission::Duplicate {
+                    execution_id: e.execution_id.clone(),
+                    status: e.status.clone(),
+                });
+            }
+            let pending = state.entries.values().filter(|e| e.pending()).count();
+            if pending >= cfg.max_pending {
+                return Err(JournalError::Full(cfg.max_pending));
+            }
+        }
+        let entry = Entry {
+            execution_id: execution_id.to_string(),
+            task_id: req.task_id.clone(),
+            idempotency_key: key.clone(),
+            status: STATUS_PENDING.to_string(),
+            updated_at_ms: now_ms,
+            request: Some(JournaledRequest::from_request(req, execution_id)),
+        };
+        Self::save(store.as_ref(), &entry).await?;
+        let mut loaded = self.loaded.lock();
+        let state = loaded.get_or_insert_with(State::default);
+        if !key.is_empty() {
+            state
+                .keys
+                .insert((req.task_id.clone(), key), execution_id.to_string());
+        }
+        state.entries.insert(execution_id.to_string(), entry);
+        Ok(Admission::Accepted)
+    }
+
+    /// Mark a job finished; one without an idempotency key is dropped
+    /// 将任务标记为已结束；没有幂等键的任务直接丢弃
+    pub async fn complete(&self, execution_id: &str, status: &str) {
+        let r = async {
+            let _call = self.calls.lock().await;
+            let (_, store, now_ms) = self.open().await?;
+            let finished = {
+                let mut loaded = self.loaded.lock();
+                let Some(entry) = loaded
+                    .as_mut()
+                    .and_then(|s| s.entries.get_mut(execution_id))
+                else {
+                    return Ok(());
+                };
+                if entry.idempotency_key.is_empty() {
+                    None
+                } else {
+                    entry.request = None;
+                    entry.status = status.to_string();
+                    entry.updated_at_ms = now_ms;
+                    Some(entry.clone())
+                }
+            };
+            match finished {
+                Some(entry) => Self::save(store.as_ref(), &entry).await,
+                None => self.remove(store.as_ref(), execution_id).await,
+            }
+        }
+        .await;
+        if let Err(e) = r {
+            if e != JournalError::Disabled {
+                tracing::warn!(execution_id, error = %e, "recording async completion failed");
+            }
+        }
+    }
+
+    /// Drop a job that was never queued / 丢弃从未排队的任务
+    pub async fn forget(&self, execution_id: &str) {
+        let r = async {
+            let _call = self.calls.lock().await;
+            let (_, store, _) = self.open().await?;
+            self.remove(store.as_ref(), execution_id).await
+        }
+        .await;
+        if let Err(e) = r {
+            if e != JournalError::Disabled {
+                tracing::warn!(execution_id, error = %e, "dropping async journal entry failed");
+            }
+        }
+    }
+
+    /// Requests that have not finished, oldest first / 尚未结束的请求，最早者在前
+    pub async fn pending(&self) -> Vec<JournaledRequest> {
+        let r = async {
+            let _call = self.calls.lock().await;
+            self.open().await?;
+            let loaded = self.loaded.lock();
+            let mut pending: Vec<&Entry> = loaded
+                .iter()
+                .flat_map(|s| s.entries.values())
+                .filter(|e| e.pending())
+                .collect();
+            pending.sort_by_key(|e| e.updated_at_ms);
+            Ok::<_, JournalError>(
+                pending
+                    .into_iter()
+                    .filter_map(|e| e.request.clone())
+                    .collect(),
+            )
+        }
+        .await;
+        match r {
+            Ok(pending) => pending,
+            Err(JournalError::Disabled) => Vec::new(),
+            Err(e) => {
+                tracing::warn!(error = %e, "reading the async journal failed");
+                Vec::new()
+            }
+        }
+    }
+
+    pub fn stats(&self) -> JournalStats {
+        let (cfg, dir) = self.config.read().clone();
+        let loaded = self.loaded.lock();
+        let entries = loaded.iter().flat_map(|s| s.entries.values());
+        let pending = entries.clone().filter(|e| e.pending()).count();
+        JournalStats {
+            enabled: cfg.enabled,
+            backend: cfg.backend,
+            dir: dir.display().to_string(),
+            pending,
+            finished: entries.count() - pending,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn journal(dir: &Path, backend: &str) -> AsyncJournal {
+        AsyncJournal::new(
+            AsyncJournalConfig {
+                enabled: true,
+                backend: backend.to_string(),
+                max_pending: 2,
+                ..Default::default()
+            },
+            dir.to_path_buf(),
+        )
+    }
+
+    fn request(task_id: &str, key: Option<&str>) -> InvokeRequest {
+        let mut req = InvokeRequest {
+            task_id: task_id.to_string(),
+            input: Some(Payload {
+                content_type: "text/plain".to_string(),
+                data: b"job".to_vec(),
+            }),
+            mode: ExecutionMode::Async as i32,
+            ..Default::default()
+        };
+        if let Some(key) = key {
+            req.metadata
+                .insert(METADATA_IDEMPOTENCY_KEY.to_string(), key.to_string());
+        }
+        req
+    }
+
+    #[cfg(feature = "sled")]
+    #[tokio::test]
+    async fn test_pending_jobs_survive_restart() {
+        let dir = tempfile::tempdir().unwrap();
+        let j = journal(dir.path(), "sled");
+        assert_eq!(
+            j.accept(&request("t", None), "req-1").await.unwrap(),
+            Admission::Accepted
+        );
+        assert_eq!(
+            j.accept(&request("t", None), "req-2").await.unwrap(),
+            Admission::Accepted
+        );
+        assert_eq!(
+            j.accept(&request("t", None), "req-3").await,
+            Err(JournalError::Full(2))
+        );
+        j.complete("req-1", "completed").await;
+        drop(j);
+
+        // A new instance reads the journal back from the store / 新实例从存储读回日志
+        let j = journal(dir.path(), "sled");
+        let pending = j.pending().await;
+        assert_eq!(pending.len(), 1);
+        let again = pending[0].to_request();
+        assert_eq!(again.execution_id, "req-2");
+        assert_eq!(again.input.unwrap().data, b"job");
+        assert_eq!(again.mode, ExecutionMode::Async as i32);
+        assert_eq!(j.stats().finished, 0);
+    }
+
+    #[tokio::test]
+    async fn test_idempotency_key_dedups_per_task() {
+        let dir = tempfile::tempdir().unwrap();
+        let j = journal(dir.path(), "memory");
+        j.accept(&request("t", Some("order-7")), "req-1")
+            .await
+            .unwrap();
+        let dup = Admission::Duplicate {
+            execution_id: "req-1".to_string(),
+            status: STATUS_PENDING.to_string(),
+        };
+        assert_eq!(
+            j.accept(&request("t", Some("order-7")), "req-2")
+                .await
+                .unwrap(),
+            dup
+        );
+        assert_eq!(
+            j.accept(&request("other", Some("order-7")), "req-3")
+                .await
+                .unwrap(),
+            Admission::Accepted
+        );
+
+        // Finished jobs still answer repeats until the TTL passes
+        // 已结束的任务在 TTL 过期前仍应答重复请求
+        j.complete("req-1", "completed").await;
+        assert_eq!(
+            j.accept(&request("t", Some("order-7")), "req-4")
+                .await
+                .unwrap(),
+            Admission::Duplicate {
+                execution_id: "req-1".to_string(),
+                status: "completed".to_string(),
+            }
+        );
+        assert!(j.pending().await.iter().all(|r| r.execution_id == "req-3"));
+
+        let mut repeat = request("t", None);
+        repeat.execution_id = "req-3".to_string();
+        assert!(matches!(
+            j.accept(&repeat, "req-3").await.unwrap(),
+            Admission::Duplicate { .. }
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_disabled_journal_records_nothing() {
+        let dir = tempfile::tempdir().unwrap();
+        let j = AsyncJournal::new(AsyncJournalConfig::default(), dir.path().to_path_buf());
+        assert_eq!(
+            j.accept(&request("t", None), "req-1").await,
+            Err(JournalError::Disabled)
+        );
+        assert!(j.pending().await.is_empty());
+        assert!(std::fs::read_dir(dir.path()).unwrap().next().is_none());
+    }
+}
@@ -13,7 +13,11 @@ use crate::proto::sms::{
 };
 use crate::spearlet::config::{LlmBackendConfig, SpearletConfig};
 use crate::spearlet::execution::ai::backends::{
-    KIND_OLLAMA_CHAT, KIND_OPENAI_CHAT_COMPLETION, KIND_OPENAI_REALTIME_WS, KIND_STUB,
+    KIND_ANTHROPIC_MESSAGES, KIND_AZURE_SPEECH_WS, KIND_DEEPGRAM_LISTEN_WS, KIND_GEMINI_CHAT,
+    KIND_GEMINI_EMBEDDINGS, KIND_GOOGLE_SPEECH, KIND_HUGGINGFACE_EMBEDDINGS, KIND_LOCAL_MODERATION,
+    KIND_OLLAMA_CHAT, KIND_OLLAMA_EMBEDDINGS, KIND_OPENAI_CHAT_COMPLETION, KIND_OPENAI_EMBEDDINGS,
+    KIND_OPENAI_IMAGES, KIND_OPENAI_MODERATIONS, KIND_OPENAI_REALTIME_WS, KIND_OPENAI_RESPONSES,
+    KIND_OPENAI_SPEECH, KIND_STABILITY_IMAGE, KIND_STUB,
 };
 use crate::spearlet::local_models::ManagedBackendRegistry;
 
@@ -70,9 +74,21 @@ impl BackendReporterService {
 
 fn infer_provider(kind: &str) -> String {
     match kind {
-        KIND_OPENAI_CHAT_COMPLETION | KIND_OPENAI_REALTIME_WS => "openai".to_string(),
-        KIND_OLLAMA_CHAT => "ollama".to_string(),
-        KIND_STUB => "internal".to_string(),
+        KIND_OPENAI_CHAT_COMPLETION
+        | KIND_OPENAI_RESPONSES
+        | KIND_OPENAI_REALTIME_WS
+        | KIND_OPENAI_SPEECH
+        | KIND_OPENAI_EMBEDDINGS
+        | KIND_OPENAI_IMAGES
+        | KIND_OPENAI_MODERATIONS => "openai".to_string(),
+        KIND_HUGGINGFACE_EMBEDDINGS => "huggingface".to_string(),
+        KIND_STABILITY_IMAGE => "stability".to_string(),
+        KIND_ANTHROPIC_MESSAGES => "anthropic".to_string(),
+        KIND_GEMINI_CHAT | KIND_GEMINI_EMBEDDINGS | KIND_GOOGLE_SPEECH => "google".to_string(),
+        KIND_DEEPGRAM_LISTEN_WS => "deepgram".to_string(),
+        KIND_AZURE_SPEECH_WS => "azure".to_string(),
+        KIND_OLLAMA_CHAT | KIND_OLLAMA_EMBEDDINGS => "ollama".to_string(),
+        KIND_STUB | KIND_LOCAL_MODERATION => "internal".to_string(),
         _ => "unknown".to_string(),
     }
 }
@@ -0,0 +1,394 @@
+//! In-memory blob cache for co-located tasks / 同节点任务使用的内存 blob 缓存
+//!
+//! A task hands a large artifact (an image, an audio clip) to another task on the same node
+//! by putting it here and passing the returned id along, instead of serializing the bytes
+//! through the transport on both sides. The blob is kept once, in the spearlet's heap; it
+//! is not shared memory, so putting copies the guest's bytes in and each read copies a
+//! chunk out. The id is the capability: any task holding it may read or release the blob.
+//! Blobs nobody released expire after `ttl_s`.
+//! 任务将大型产物（图像、音频片段）放入此处并传递返回的 ID，从而交给同节点上的另一个任务，
+//! 无需在两端经由传输层序列化字节。blob 在 spearlet 的堆中只保存一份；它并非共享内存，放入时
+//! 复制 guest 的字节，每次读取复制出一段。ID 即访问凭证：持有 ID 的任务均可读取或释放该 blob。
+//! 无人释放的 blob 在 `ttl_s` 后过期。
+//!
+//! Content is kept by its SHA-256 digest, so putting the same bytes twice (the same
+//! generated image, the same TTS clip) stores them once. Each id still gets its own random
+//! id and TTL; the content is counted by reference and dropped with its last id. With
+//! `compression` on, content is stored zstd-compressed when that saves space.
+//! 内容按 SHA-256 摘要保存，因此同样的字节（同一张生成的图像、同一段 TTS 音频）放入两次只存储一份。
+//! 每次放入仍获得独立的随机 ID 与 TTL；内容按引用计数，随最后一个 ID 一起丢弃。开启 `compression`
+//! 后，若能节省空间，内容以 zstd 压缩形式保存。
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::{Mutex, RwLock};
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::config::BlobCacheConfig;
+
+/// Length of a blob id: `blob_` and 32 hex digits / blob ID 的长度：`blob_` 加 32 位十六进制数字
+pub const BLOB_ID_LEN: usize = 37;
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum BlobError {
+    #[error("blob cache is disabled")]
+    Disabled,
+    #[error("blob of {0} bytes exceeds max_blob_bytes")]
+    TooLarge(usize),
+    #[error("blob cache is full")]
+    Full,
+    #[error("unknown blob: {0}")]
+    NotFound(String),
+    #[error("blob content is corrupt: {0}")]
+    Corrupt(String),
+}
+
+type ContentKey = [u8; 32];
+
+/// Bytes shared by every id put with them / 以这些字节放入的所有 ID 共享的内容
+struct Content {
+    /// As stored, compressed or not / 存储形式，可能已压缩
+    stored: Arc<[u8]>,
+    compressed: bool,
+    len: usize,
+    refs: usize,
+}
+
+struct Blob {
+    key: ContentKey,
+    owner: String,
+    created_at_ms: i64,
+    expires_at: Instant,
+}
+
+#[derive(Default)]
+struct Blobs {
+    ids: HashMap<String, Blob>,
+    contents: HashMap<ContentKey, Content>,
+    /// Puts that found their content already stored / 内容已存在的放入次数
+    dedup_hits: u64,
+    /// Last decompressed content, so chunked reads decompress once
+    /// 最近解压的内容，使分块读取只解压一次
+    hot: Option<(ContentKey, Arc<[u8]>)>,
+}
+
+impl Blobs {
+    fn stored_bytes(&self) -> usize {
+        self.contents.values().map(|c| c.stored.len()).sum()
+    }
+
+    fn unref(&mut self, key: &ContentKey) {
+        let Some(c) = self.contents.get_mut(key) else {
+            return;
+        };
+        c.refs -= 1;
+        if c.refs == 0 {
+            self.contents.remove(key);
+            if self.hot.as_ref().is_some_and(|(k, _)| k == key) {
+                self.hot = None;
+            }
+        }
+    }
+
+    fn sweep(&mut self, now: Instant) {
+        let expired: Vec<String> = self
+            .ids
+            .iter()
+            .filter(|(_, b)| b.expires_at <= now)
+            .map(|(id, _)| id.clone())
+            .collect();
+        for id in expired {
+            if let Some(b) = self.ids.remove(&id) {
+                self.unref(&b.key);
+            }
+        }
+    }
+
+    fn add_id(&mut self, key: ContentKey, owner: &str, now: Instant, ttl_s: u64) -> String {
+        let id = format!("blob_{}", uuid::Uuid::new_v4().simple());
+        self.ids.insert(
+            id.clone(),
+            Blob {
+                key,
+                owner: owner.to_string(),
+                created_at_ms: chrono::Utc::now().timestamp_millis(),
+                expires_at: now + Duration::from_secs(ttl_s),
+            },
+        );
+        id
+    }
+}
+
+/// A stored blob as listed for operators / 面向运维列出的已存储 blob
+#[derive(Debug, Clone, Serialize)]
+pub struct BlobInfo {
+    pub id: String,
+    pub bytes: usize,
+    /// Task that put it / 放入该 blob 的任务
+    pub owner: String,
+    pub created_at_ms: i64,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct BlobStats {
+    pub enabled: bool,
+    pub blobs: usize,
+    /// Bytes as the tasks see them / 任务所见的字节数
+    pub bytes: usize,
+    /// Distinct contents behind the ids / ID 背后的不同内容数
+    pub contents: usize,
+    /// Bytes actually held, after deduplication and compression / 去重与压缩后实际占用的字节数
+    pub stored_bytes: usize,
+    pub dedup_hits: u64,
+    pub max_total_bytes: u64,
+    pub items: Vec<BlobInfo>,
+}
+
+pub struct BlobCache {
+    config: RwLock<BlobCacheConfig>,
+    blobs: Mutex<Blobs>,
+}
+
+/// Compress `data` when configured and worth it / 按配置且值得时压缩 `data`
+fn encode(cfg: &BlobCacheConfig, data: Vec<u8>) -> (Arc<[u8]>, bool) {
+    if cfg.compression && data.len() as u64 >= cfg.compress_min_bytes {
+        match zstd::bulk::compress(&data, cfg.compression_level) {
+            Ok(z) if z.len() < data.len() => return (z.into(), true),
+            Ok(_) => {}
+            Err(e) => tracing::debug!(error = %e, "blob compression failed; storing raw"),
+        }
+    }
+    (data.into(), false)
+}
+
+impl BlobCache {
+    pub fn new(config: BlobCacheConfig) -> Self {
+        Self {
+            config: RwLock::new(config),
+            blobs: Mutex::new(Blobs::default()),
+        }
+    }
+
+    pub fn set_config(&self, config: BlobCacheConfig) {
+        let enabled = config.enabled;
+        *self.config.write() = config;
+        if !enabled {
+            *self.blobs.lock() = Blobs::default();
+        }
+    }
+
+    /// Store `data` and return its id / 存储 `data` 并返回其 ID
+    pub fn put(&self, owner: &str, data: Vec<u8>) -> Result<String, BlobError> {
+        let cfg = self.config.read().clone();
+        if !cfg.enabled {
+            return Err(BlobError::Disabled);
+        }
+        if data.len() as u64 > cfg.max_blob_bytes {
+            return Err(BlobError::TooLarge(data.len()));
+        }
+        let key: ContentKey = Sha256::digest(&data).into();
+        let now = Instant::now();
+        {
+            let mut blobs = self.blobs.lock();
+            blobs.sweep(now);
+            if let Some(c) = blobs.contents.get_mut(&key) {
+                c.refs += 1;
+                blobs.dedup_hits += 1;
+                return Ok(blobs.add_id(key, owner, now, cfg.ttl_s));
+            }
+        }
+
+        // Compress outside the lock; another put of the same bytes may win the race
+        // 在锁外压缩；同样字节的另一次放入可能先完成
+        let len = data.len();
+        let (stored, compressed) = encode(&cfg, data);
+        let mut blobs = self.blobs.lock();
+        blobs.sweep(now);
+        if let Some(c) = blobs.contents.get_mut(&key) {
+            c.refs += 1;
+            blobs.dedup_hits += 1;
+        } else {
+            if (blobs.stored_bytes() + stored.len()) as u64 > cfg.max_total_bytes {
+                return Err(BlobError::Full);
+            }
+            blobs.contents.insert(
+                key,
+                Content {
+                    stored,
+                    compressed,
+                    len,
+                    refs: 1,
+                },
+            );
+        }
+        Ok(blobs.add_id(key, owner, now, cfg.ttl_s))
+    }
+
+    /// The blob's bytes, shared rather than copied / blob 的字节，共享而非复制
+    pub fn get(&self, id: &str) -> Result<Arc<[u8]>, BlobError> {
+        let (key, stored, len) = {
+            let mut blobs = self.blobs.lock();
+            blobs.sweep(Instant::now());
+            let key = blobs
+                .ids
+                .get(id)
+                .map(|b| b.key)
+                .ok_or_else(|| BlobError::NotFound(id.to_string()))?;
+            let c = &blobs.contents[&key];
+            if !c.compressed {
+                return Ok(c.stored.clone());
+            }
+            if let Some((k, data)) = &blobs.hot {
+                if *k == key {
+                    return Ok(data.clone());
+                }
+            }
+            (key, c.stored.clone(), c.len)
+        };
+        let data: Arc<[u8]> = zstd::bulk::decompress(&stored, len)
+            .map_err(|e| BlobError::Corrupt(e.to_string()))?
+            .into();
+        let mut blobs = self.blobs.lock();
+        if blobs.contents.contains_key(&key) {
+            blobs.hot = Some((key, data.clone()));
+        }
+        Ok(data)
+    }
+
+    /// Drop the id; the content goes with its last id. Readers holding its bytes keep them
+    /// 丢弃该 ID；内容随最后一个 ID 一起丢弃。已持有其字节的读者不受影响
+    pub fn release(&self, id: &str) -> Result<(), BlobError> {
+        let mut blobs = self.blobs.lock();
+        let b = blobs
+            .ids
+            .remove(id)
+            .ok_or_else(|| BlobError::NotFound(id.to_string()))?;
+        blobs.unref(&b.key);
+        Ok(())
+    }
+
+    pub fn stats(&self) -> BlobStats {
+        let cfg = self.config.read().clone();
+        let mut blobs = self.blobs.lock();
+        blobs.sweep(Instant::now());
+        let mut items: Vec<BlobInfo> = blobs
+            .ids
+            .iter()
+            .map(|(id, b)| BlobInfo {
+                id: id.clone(),
+                bytes: blobs.contents[&b.key].len,
+                owner: b.owner.clone(),
+                created_at_ms: b.created_at_ms,
+            })
+            .collect();
+        items.sort_by(|a, b| a.created_at_ms.cmp(&b.created_at_ms));
+        BlobStats {
+            enabled: cfg.enabled,
+            blobs: items.len(),
+            bytes: items.iter().map(|b| b.bytes).sum(),
+            contents: blobs.contents.len(),
+            stored_bytes: blobs.stored_bytes(),
+            dedup_hits: blobs.dedup_hits,
+            max_total_bytes: cfg.max_total_bytes,
+            items,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn store() -> BlobCache {
+        BlobCache::new(BlobCacheConfig {
+            enabled: true,
+            max_total_bytes: 10,
+            max_blob_bytes: 8,
+            ttl_s: 300,
+            ..Default::default()
+        })
+    }
+
+    #[test]
+    fn test_put_get_release() {
+        let s = store();
+        let id = s.put("producer", b"frame".to_vec()).unwrap();
+        assert_eq!(id.len(), BLOB_ID_LEN);
+        let a = s.get(&id).unwrap();
+        let b = s.get(&id).unwrap();
+        assert_eq!(&a[..], b"frame");
+        assert!(Arc::ptr_eq(&a, &b));
+        assert_eq!(s.stats().bytes, 5);
+
+        s.release(&id).unwrap();
+        assert_eq!(&a[..], b"frame");
+        assert_eq!(s.get(&id), Err(BlobError::NotFound(id.clone())));
+        assert_eq!(s.release(&id), Err(BlobError::NotFound(id)));
+    }
+
+    #[test]
+    fn test_limits_and_expiry() {
+        let s = store();
+        assert_eq!(s.put("t", vec![0; 9]), Err(BlobError::TooLarge(9)));
+        s.put("t", vec![0; 8]).unwrap();
+        assert_eq!(s.put("t", vec![0; 3]), Err(BlobError::Full));
+
+        let mut cfg = s.config.read().clone();
+        cfg.ttl_s = 0;
+        s.set_config(cfg.clone());
+        *s.blobs.lock() = Blobs::default();
+        let id = s.put("t", vec![1]).unwrap();
+        assert!(s.get(&id).is_err());
+
+        cfg.enabled = false;
+        s.set_config(cfg);
+        assert_eq!(s.put("t", vec![1]), Err(BlobError::Disabled));
+    }
+
+    #[test]
+    fn test_same_content_is_stored_once() {
+        let s = store();
+        let a = s.put("tts-1", b"clip".to_vec()).unwrap();
+        let b = s.put("tts-2", b"clip".to_vec()).unwrap();
+        assert_ne!(a, b);
+        // A third copy would not fit if it were stored again / 若再次存储，第三份将放不下
+        let c = s.put("tts-3", b"clip".to_vec()).unwrap();
+        let stats = s.stats();
+        assert_eq!((stats.blobs, stats.bytes), (3, 12));
+        assert_eq!(
+            (stats.contents, stats.stored_bytes, stats.dedup_hits),
+            (1, 4, 2)
+        );
+
+        s.release(&a).unwrap();
+        s.release(&b).unwrap();
+        assert_eq!(&s.get(&c).unwrap()[..], b"clip");
+        s.release(&c).unwrap();
+        let stats = s.stats();
+        assert_eq!((stats.contents, stats.stored_bytes), (0, 0));
+    }
+
+    #[test]
+    fn test_compressed_content_reads_back() {
+        let s = BlobCache::new(BlobCacheConfig {
+            enabled: true,
+            compression: true,
+            compress_min_bytes: 16,
+            ..Default::default()
+        });
+        let frame = vec![7u8; 64 * 1024];
+        let id = s.put("camera", frame.clone()).unwrap();
+        let small = s.put("camera", b"tiny".to_vec()).unwrap();
+        let stats = s.stats();
+        assert!(stats.stored_bytes < 4096, "{}", stats.stored_bytes);
+        assert_eq!(stats.bytes, frame.len() + 4);
+
+        let a = s.get(&id).unwrap();
+        assert_eq!(&a[..], &frame[..]);
+        assert!(Arc::ptr_eq(&a, &s.get(&id).unwrap()));
+        assert_eq!(&s.get(&small).unwrap()[..], b"tiny");
+    }
+}
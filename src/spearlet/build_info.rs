@@ -0,0 +1,185 @@
+//! Build information for `spearlet version`
+//! `spearlet version` 使用的构建信息
+//!
+//! Capabilities are selected at compile time through Cargo features. The
+//! `minimal`, `server` and `desktop` features are profile aggregates; the rest
+//! gate individual dependencies.
+//! 能力通过 Cargo feature 在编译期选择。`minimal`、`server`、`desktop` 为构建配置聚合，
+//! 其余 feature 控制单个依赖。
+
+/// A compile-time capability / 编译期能力
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Capability {
+    pub feature: &'static str,
+    pub description: &'static str,
+    pub enabled: bool,
+}
+
+/// Package version / 包版本
+pub fn version() -> &'static str {
+    env!("CARGO_PKG_VERSION")
+}
+
+/// Profile selected at build time / 构建时选择的构建配置
+pub fn build_profile() -> &'static str {
+    if cfg!(feature = "desktop") {
+        "desktop"
+    } else if cfg!(feature = "server") {
+        "server"
+    } else if cfg!(feature = "minimal") {
+        "minimal"
+    } else {
+        "custom"
+    }
+}
+
+/// All known capabilities with their compile-time state / 所有已知能力及其编译期状态
+pub fn capabilities() -> Vec<Capability> {
+    vec![
+        Capability {
+            feature: "wasmedge",
+            description: "WASM runtime (WasmEdge)",
+            enabled: cfg!(feature = "wasmedge"),
+        },
+        Capability {
+            feature: "mic-device",
+            description: "local microphone capture",
+            enabled: cfg!(feature = "mic-device"),
+        },
+        Capability {
+            feature: "sled",
+            description: "sled storage backend",
+            enabled: cfg!(feature = "sled"),
+        },
+        Capability {
+            feature: "rocksdb",
+            description: "RocksDB storage backend",
+            enabled: cfg!(feature = "rocksdb"),
+        },
+        Capability {
+            feature: "evmap",
+            description: "evmap storage backend",
+            enabled: cfg!(feature = "evmap"),
+        },
+        Capability {
+            feature: "pgvector",
+            description: "PostgreSQL pgvector store",
+            enabled: cfg!(feature = "pgvector"),
+        },
+        Capability {
+            feature: "vector-db",
+            description: "Qdrant and Milvus vector stores",
+            enabled: cfg!(feature = "vector-db"),
+        },
+        Capability {
+            feature: "onnx",
+            description: "in-process ONNX inference",
+            enabled: cfg!(feature = "onnx"),
+        },
+        Capability {
+            feature: "rtsp",
+            description: "RTSP camera ingest",
+            enabled: cfg!(feature = "rtsp"),
+        },
+        Capability {
+            feature: "webrtc",
+            description: "WebRTC audio ingest",
+            enabled: cfg!(feature = "webrtc"),
+        },
+        Capability {
+            feature: "telephony",
+            description: "Twilio telephony bridge",
+            enabled: cfg!(feature = "telephony"),
+        },
+        Capability {
+            feature: "rt-asr",
+            description: "Deepgram, Azure and Google speech",
+            enabled: cfg!(feature = "rt-asr"),
+        },
+    ]
+}
+
+/// Names of compiled-in capabilities / 已编译能力的名称
+pub fn enabled_features() -> Vec<&'static str> {
+    capabilities()
+        .into_iter()
+        .filter(|c| c.enabled)
+        .map(|c| c.feature)
+        .collect()
+}
+
+/// Render `spearlet version` output / 渲染 `spearlet version` 输出
+pub fn render_version(with_features: bool) -> String {
+    let mut out = format!("spearlet {} (profile: {})\n", version(), build_profile());
+    if with_features {
+        out.push_str("features:\n");
+        for c in capabilities() {
+            let mark = if c.enabled { "+" } else { "-" };
+            out.push_str(&format!("  {} {:<12} {}\n", mark, c.feature, c.description));
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_enabled_features_match_capabilities() {
+        let caps = capabilities();
+        let enabled = enabled_features();
+        assert_eq!(enabled.len(), caps.iter().filter(|c| c.enabled).count());
+        assert_eq!(enabled.contains(&"wasmedge"), cfg!(feature = "wasmedge"));
+        assert_eq!(enabled.contains(&"pgvector"), cfg!(feature = "pgvector"));
+    }
+
+    #[test]
+    fn test_capabilities_cover_cargo_features() {
+        let manifest: toml::Value = toml::from_str(include_str!("../../Cargo.toml")).unwrap();
+        let caps: Vec<&str> = capabilities().iter().map(|c| c.feature).collect();
+        for feature in manifest["features"].as_table().unwrap().keys() {
+            if ["default", "minimal", "server", "desktop"].contains(&feature.as_str()) {
+                continue;
+            }
+            assert!(caps.contains(&feature.as_str()), "{} missing", feature);
+        }
+    }
+
+    #[test]
+    fn test_profiles_select_known_capabilities() {
+        let manifest: toml::Value = toml::from_str(include_str!("../../Cargo.toml")).unwrap();
+        let features = manifest["features"].as_table().unwrap();
+        let caps: Vec<&str> = capabilities().iter().map(|c| c.feature).collect();
+        for profile in ["minimal", "server", "desktop"] {
+            for f in features[profile].as_array().unwrap() {
+                let f = f.as_str().unwrap();
+                assert!(
+                    caps.contains(&f) || features.contains_key(f),
+                    "{} selects unknown {}",
+                    profile,
+                    f
+                );
+            }
+        }
+        // minimal leaves the media ingest and the WASM runtime out / minimal 不含媒体接入与 WASM 运行时
+        let minimal = features["minimal"].as_array().unwrap();
+        for f in ["wasmedge", "rtsp", "webrtc", "telephony", "mic-device"] {
+            assert!(!minimal.iter().any(|v| v.as_str() == Some(f)), "{}", f);
+        }
+    }
+
+    #[test]
+    fn test_render_version() {
+        let short = render_version(false);
+        assert!(short.starts_with(&format!("spearlet {}", version())));
+        assert!(short.contains(build_profile()));
+        assert!(!short.contains("features:"));
+
+        let long = render_version(true);
+        assert!(long.contains("features:"));
+        for c in capabilities() {
+            assert!(long.contains(c.feature));
+        }
+    }
+}
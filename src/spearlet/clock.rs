@@ -0,0 +1,330 @@
+//! Clock health and monotonic timestamps
+//! 时钟健康与单调时间戳
+//!
+//! Edge devices often boot without a synchronized wall clock, and NTP may step it
+//! later. Wall-clock timestamps alone then do not order stream events or execution
+//! records. This module provides:
+//! 边缘设备常在墙上时钟未同步时启动，之后 NTP 可能会跳变时钟。仅凭墙上时钟无法为流事件与
+//! 执行记录排序。本模块提供：
+//!
+//! - `mono_ms`: milliseconds since process start, never going backwards, scoped by `boot_id`
+//!   `mono_ms`：进程启动以来的毫秒数，不会回退，以 `boot_id` 区分
+//! - an SNTP probe that measures the offset of the local clock against `clock.ntp_servers`
+//!   SNTP 探测，测量本地时钟相对 `clock.ntp_servers` 的偏差
+//! - wall-clock jump detection by comparing wall and monotonic progress
+//!   通过比较墙上时钟与单调时钟的进度检测时钟跳变
+//!
+//! The result is reported by `/readyz`.
+//! 结果通过 `/readyz` 报告。
+
+use std::sync::OnceLock;
+use std::time::{Duration, Instant};
+
+use parking_lot::RwLock;
+use serde::Serialize;
+use tokio::net::UdpSocket;
+
+use crate::spearlet::config::ClockConfig;
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
+
+/// Seconds between the NTP epoch (1900) and the Unix epoch / NTP 纪元（1900）与 Unix 纪元间的秒数
+const NTP_UNIX_OFFSET_SECS: i64 = 2_208_988_800;
+
+struct Anchor {
+    instant: Instant,
+    boot_id: String,
+}
+
+fn anchor() -> &'static Anchor {
+    static ANCHOR: OnceLock<Anchor> = OnceLock::new();
+    ANCHOR.get_or_init(|| Anchor {
+        instant: Instant::now(),
+        boot_id: uuid::Uuid::new_v4().to_string(),
+    })
+}
+
+/// Milliseconds since process start; monotonic / 进程启动以来的毫秒数；单调递增
+pub fn mono_ms() -> u64 {
+    anchor().instant.elapsed().as_millis() as u64
+}
+
+/// Random id of this process; `mono_ms` values are comparable only within one boot id
+/// 本进程的随机 ID；`mono_ms` 仅在同一 boot id 内可比较
+pub fn boot_id() -> &'static str {
+    &anchor().boot_id
+}
+
+fn wall_ms() -> i64 {
+    chrono::Utc::now().timestamp_millis()
+}
+
+/// Add `ts_ms` (wall clock) and `mono_ms` to a JSON event object
+/// 为 JSON 事件对象添加 `ts_ms`（墙上时钟）与 `mono_ms`
+pub fn stamp(event: &mut serde_json::Value) {
+    if let Some(obj) = event.as_object_mut() {
+        obj.insert("ts_ms".to_string(), wall_ms().into());
+        obj.insert("mono_ms".to_string(), mono_ms().into());
+    }
+}
+
+/// Clock health as reported by `/readyz` / `/readyz` 报告的时钟健康状态
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct ClockHealth {
+    /// `ok`, `skewed`, `unknown` or `disabled` / `ok`、`skewed`、`unknown` 或 `disabled`
+    pub status: String,
+    /// Local clock minus NTP time / 本地时钟减去 NTP 时间
+    pub offset_ms: Option<i64>,
+    pub round_trip_ms: Option<i64>,
+    pub server: Option<String>,
+    pub checked_at_ms: Option<i64>,
+    pub last_error: Option<String>,
+    /// Size of the last detected wall-clock step / 最近一次检测到的墙上时钟跳变幅度
+    pub last_jump_ms: Option<i64>,
+    pub last_jump_at_ms: Option<i64>,
+    pub max_offset_ms: u64,
+    pub boot_id: String,
+    pub mono_ms: u64,
+}
+
+fn health_cell() -> &'static RwLock<ClockHealth> {
+    static HEALTH: OnceLock<RwLock<ClockHealth>> = OnceLock::new();
+    HEALTH.get_or_init(|| {
+        RwLock::new(ClockHealth {
+            status: "disabled".to_string(),
+            ..Default::default()
+        })
+    })
+}
+
+/// Current clock health / 当前时钟健康状态
+pub fn health() -> ClockHealth {
+    let mut h = health_cell().read().clone();
+    h.boot_id = boot_id().to_string();
+    h.mono_ms = mono_ms();
+    h
+}
+
+/// One SNTP measurement / 一次 SNTP 测量
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct NtpSample {
+    pub offset_ms: i64,
+    pub round_trip_ms: i64,
+}
+
+fn to_ntp(unix_ms: i64) -> [u8; 8] {
+    let secs = unix_ms.div_euclid(1000) + NTP_UNIX_OFFSET_SECS;
+    let frac = ((unix_ms.rem_euclid(1000) as u64) << 32) / 1000;
+    let mut out = [0u8; 8];
+    out[..4].copy_from_slice(&(secs as u32).to_be_bytes());
+    out[4..].copy_from_slice(&(frac as u32).to_be_bytes());
+    out
+}
+
+fn from_ntp(b: &[u8]) -> i64 {
+    let secs = u32::from_be_bytes([b[0], b[1], b[2], b[3]]) as i64;
+    let frac = u32::from_be_bytes([b[4], b[5], b[6], b[7]]) as i64;
+    (secs - NTP_UNIX_OFFSET_SECS) * 1000 + ((frac * 1000) >> 32)
+}
+
+/// Client request sent at `t1_ms` / 在 `t1_ms` 发送的客户端请求
+pub fn build_request(t1_ms: i64) -> [u8; 48] {
+    let mut req = [0u8; 48];
+    // LI = 0, VN = 4, Mode = 3 (client)
+    req[0] = 0x23;
+    req[40..48].copy_from_slice(&to_ntp(t1_ms));
+    req
+}
+
+/// Offset and round trip from a server reply received at `t4_ms`
+/// 根据在 `t4_ms` 收到的服务端应答计算偏差与往返时间
+pub fn parse_response(
+    request: &[u8; 48],
+    resp: &[u8],
+    t1_ms: i64,
+    t4_ms: i64,
+) -> Result<NtpSample, String> {
+    if resp.len() < 48 {
+        return Err(format!("short NTP reply ({} bytes)", resp.len()));
+    }
+    if resp[0] & 0x07 != 4 {
+        return Err("NTP reply is not in server mode".to_string());
+    }
+    if resp[1] == 0 {
+        return Err("NTP server sent kiss-of-death".to_string());
+    }
+    if resp[24..32] != request[40..48] {
+        return Err("NTP reply does not match the request".to_string());
+    }
+    let t2 = from_ntp(&resp[32..40]);
+    let t3 = from_ntp(&resp[40..48]);
+    Ok(NtpSample {
+        offset_ms: ((t1_ms - t2) + (t4_ms - t3)) / 2,
+        round_trip_ms: (t4_ms - t1_ms) - (t3 - t2),
+    })
+}
+
+/// Query one SNTP server / 查询一个 SNTP 服务器
+pub async fn query(server: &str, timeout: Duration) -> Result<NtpSample, String> {
+    let addr = tokio::net::lookup_host(server)
+        .await
+        .map_err(|e| format!("resolve {}: {}", server, e))?
+        .next()
+        .ok_or_else(|| format!("resolve {}: no address", server))?;
+    let bind = if addr.is_ipv4() {
+        "0.0.0.0:0"
+    } else {
+        "[::]:0"
+    };
+    let socket = UdpSocket::bind(bind).await.map_err(|e| e.to_string())?;
+    socket.connect(addr).await.map_err(|e| e.to_string())?;
+
+    let t1 = wall_ms();
+    let req = build_request(t1);
+    socket.send(&req).await.map_err(|e| e.to_string())?;
+    let mut buf = [0u8; 512];
+    let n = tokio::time::timeout(timeout, socket.recv(&mut buf))
+        .await
+        .map_err(|_| format!("{}: timed out", server))?
+        .map_err(|e| e.to_string())?;
+    parse_response(&req, &buf[..n], t1, wall_ms())
+}
+
+/// Tracks wall-clock progress against monotonic progress / 对比墙上时钟与单调时钟的进度
+#[derive(Debug, Clone, Copy)]
+pub struct JumpDetector {
+    wall_ms: i64,
+    mono_ms: u64,
+}
+
+impl JumpDetector {
+    pub fn new(wall_ms: i64, mono_ms: u64) -> Self {
+        Self { wall_ms, mono_ms }
+    }
+
+    /// Step of the wall clock since the last observation / 自上次观测以来墙上时钟的跳变量
+    pub fn observe(&mut self, wall_ms: i64, mono_ms: u64) -> i64 {
+        let step = (wall_ms - self.wall_ms) - (mono_ms as i64 - self.mono_ms as i64);
+        self.wall_ms = wall_ms;
+        self.mono_ms = mono_ms;
+        step
+    }
+}
+
+async fn check_once(cfg: &ClockConfig, jumps: &mut JumpDetector) {
+    let step = jumps.observe(wall_ms(), mono_ms());
+    if step.unsigned_abs() > cfg.max_offset_ms {
+        tracing::warn!(step_ms = step, "Wall clock jumped");
+        let mut h = health_cell().write();
+        h.last_jump_ms = Some(step);
+        h.last_jump_at_ms = Some(wall_ms());
+    }
+
+    let timeout = Duration::from_millis(cfg.ntp_timeout_ms.max(1));
+    let mut last_error = None;
+    for server in &cfg.ntp_servers {
+        match query(server, timeout).await {
+            Ok(sample) => {
+                let skewed = sample.offset_ms.unsigned_abs() > cfg.max_offset_ms;
+                if skewed {
+                    tracing::warn!(
+                        server = %server,
+                        offset_ms = sample.offset_ms,
+                        max_offset_ms = cfg.max_offset_ms,
+                        "Local clock is skewed"
+                    );
+                }
+                let mut h = health_cell().write();
+                h.status = if skewed { "skewed" } else { "ok" }.to_string();
+                h.offset_ms = Some(sample.offset_ms);
+                h.round_trip_ms = Some(sample.round_trip_ms);
+                h.server = Some(server.clone());
+                h.checked_at_ms = Some(wall_ms());
+                h.last_error = None;
+                return;
+            }
+            Err(e) => {
+                tracing::debug!(server = %server, error = %e, "NTP query failed");
+                last_error = Some(e);
+            }
+        }
+    }
+    let mut h = health_cell().write();
+    h.status = "unknown".to_string();
+    h.checked_at_ms = Some(wall_ms());
+    h.last_error = last_error;
+}
+
+/// Start the periodic clock check; no-op when no NTP server is configured
+/// 启动周期性时钟检查；未配置 NTP 服务器时不做任何事
+pub fn start_monitor(cfg: &ClockConfig) {
+    // Pin the `mono_ms` origin to startup / 将 `mono_ms` 的起点固定在启动时
+    anchor();
+    {
+        let mut h = health_cell().write();
+        h.max_offset_ms = cfg.max_offset_ms;
+        if cfg.ntp_servers.is_empty() {
+            return;
+        }
+        h.status = "unknown".to_string();
+    }
+    let cfg = cfg.clone();
+    supervise("clock-monitor", RestartPolicy::default(), move || {
+        let cfg = cfg.clone();
+        async move {
+            let mut jumps = JumpDetector::new(wall_ms(), mono_ms());
+            let mut interval =
+                tokio::time::interval(Duration::from_millis(cfg.check_interval_ms.max(1000)));
+            loop {
+                interval.tick().await;
+                check_once(&cfg, &mut jumps).await;
+            }
+        }
+    });
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn server_reply(req: &[u8; 48], t2_ms: i64, t3_ms: i64) -> [u8; 48] {
+        let mut resp = [0u8; 48];
+        resp[0] = 0x24;
+        resp[1] = 2;
+        resp[24..32].copy_from_slice(&req[40..48]);
+        resp[32..40].copy_from_slice(&to_ntp(t2_ms));
+        resp[40..48].copy_from_slice(&to_ntp(t3_ms));
+        resp
+    }
+
+    #[test]
+    fn test_ntp_timestamp_roundtrip() {
+        let ms = 1_760_600_000_123;
+        assert!((from_ntp(&to_ntp(ms)) - ms).abs() <= 1);
+    }
+
+    #[test]
+    fn test_parse_response_offset() {
+        // Local clock 5 s ahead, 20 ms each way, 10 ms in the server
+        // 本地时钟快 5 秒，单程 20 毫秒，服务端处理 10 毫秒
+        let t1 = 1_760_600_005_000;
+        let req = build_request(t1);
+        let resp = server_reply(&req, 1_760_600_000_020, 1_760_600_000_030);
+        let sample = parse_response(&req, &resp, t1, 1_760_600_005_050).unwrap();
+        assert!((sample.offset_ms - 5_000).abs() <= 1);
+        assert!((sample.round_trip_ms - 40).abs() <= 1);
+
+        let other = build_request(t1 + 1);
+        assert!(parse_response(&other, &resp, t1, t1 + 50).is_err());
+        let mut kod = resp;
+        kod[1] = 0;
+        assert!(parse_response(&req, &kod, t1, t1 + 50).is_err());
+    }
+
+    #[test]
+    fn test_jump_detector() {
+        let mut d = JumpDetector::new(1_000, 0);
+        assert_eq!(d.observe(2_000, 1_000), 0);
+        assert_eq!(d.observe(-58_000, 2_000), -61_000);
+        assert!(mono_ms() <= mono_ms());
+    }
+}
@@ -0,0 +1,373 @@
+//! Compute hints: workloads announcing a compute-heavy phase
+//! 计算提示：工作负载声明计算密集阶段
+//!
+//! A task enters a boost through the `compute_hint` hostcall or the `compute.hint` task
+//! config. While any execution holds a boost, executions of other tasks make room for it:
+//! 任务可通过 `compute_hint` hostcall 或 `compute.hint` 任务配置进入提升状态。任一执行持有提升时，
+//! 其他任务的执行会为其让路：
+//!
+//! - their async invocations are held (`defer_async`)
+//!   其异步调用被暂缓（`defer_async`）
+//! - at most `max_other_concurrency` of their executions run at once
+//!   其执行同时最多运行 `max_other_concurrency` 个
+//!
+//! Executions of the boosted task are never held, every wait ends after `max_defer_ms`,
+//! and a boost ends with its execution or after `max_boost_ms`. Active boosts are reported
+//! by `/readyz`.
+//! 被提升任务的执行从不被暂缓，每次等待在 `max_defer_ms` 后结束，提升随其执行结束或在
+//! `max_boost_ms` 后结束。当前提升通过 `/readyz` 报告。
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::{Mutex, RwLock};
+use serde::Serialize;
+use tokio::sync::Notify;
+
+use crate::spearlet::config::ComputeHintsConfig;
+
+/// Task config key declaring a compute-heavy task / 声明计算密集任务的任务配置键
+pub const TASK_CONFIG_COMPUTE_HINT: &str = "compute.hint";
+
+/// Resource a compute-heavy phase leans on / 计算密集阶段主要依赖的资源
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ComputeResource {
+    #[default]
+    Cpu,
+    Gpu,
+}
+
+impl ComputeResource {
+    pub fn parse(s: &str) -> Option<Self> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "cpu" => Some(ComputeResource::Cpu),
+            "gpu" => Some(ComputeResource::Gpu),
+            _ => None,
+        }
+    }
+}
+
+/// One active boost / 一个生效中的提升
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct BoostStatus {
+    pub execution_id: String,
+    pub task_id: String,
+    pub resource: ComputeResource,
+    pub remaining_ms: u64,
+}
+
+/// Compute hint state reported by `/readyz` / `/readyz` 报告的计算提示状态
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct ComputeHintsStatus {
+    pub enabled: bool,
+    pub boosts: Vec<BoostStatus>,
+}
+
+struct Boost {
+    task_id: String,
+    resource: ComputeResource,
+    until: Instant,
+}
+
+#[derive(Default)]
+struct State {
+    /// Boosts by execution id / 按执行 id 索引的提升
+    boosts: HashMap<String, Boost>,
+    /// Admitted executions by task id / 按任务 id 统计的已放行执行
+    running: HashMap<String, usize>,
+}
+
+impl State {
+    fn prune(&mut self, now: Instant) {
+        self.boosts.retain(|_, b| b.until > now);
+    }
+
+    fn boosted(&self, task_id: &str) -> bool {
+        self.boosts.values().any(|b| b.task_id == task_id)
+    }
+
+    fn next_expiry(&self) -> Option<Instant> {
+        self.boosts.values().map(|b| b.until).min()
+    }
+}
+
+/// Compute boosts of one spearlet / 单个 spearlet 的计算提升
+pub struct ComputeHints {
+    config: RwLock<ComputeHintsConfig>,
+    state: Mutex<State>,
+    changed: Notify,
+}
+
+impl Default for ComputeHints {
+    fn default() -> Self {
+        Self::new(ComputeHintsConfig::default())
+    }
+}
+
+impl ComputeHints {
+    fn new(cfg: ComputeHintsConfig) -> Self {
+        Self {
+            config: RwLock::new(cfg),
+            state: Mutex::new(State::default()),
+            changed: Notify::new(),
+        }
+    }
+
+    /// Apply a configuration; disabling ends all boosts / 应用配置；关闭时结束所有提升
+    pub fn configure(&self, cfg: &ComputeHintsConfig) {
+        *self.config.write() = cfg.clone();
+        if !cfg.enabled {
+            self.state.lock().boosts.clear();
+        }
+        self.changed.notify_waiters();
+    }
+
+    /// Boost an execution, for `duration` or up to `max_boost_ms`
+    /// 提升一个执行，时长为 `duration`，最长 `max_boost_ms`
+    ///
+    /// Returns the granted length, or `None` while hints are disabled. A new hint from the
+    /// same execution replaces the previous one.
+    /// 返回授予的时长；提示关闭时返回 `None`。同一执行的新提示会替换之前的提示。
+    pub fn begin(
+        &self,
+        execution_id: &str,
+        task_id: &str,
+        resource: ComputeResource,
+        duration: Option<Duration>,
+    ) -> Option<Duration> {
+        let max = {
+            let cfg = self.config.read();
+            if !cfg.enabled {
+                return None;
+            }
+            Duration::from_millis(cfg.max_boost_ms)
+        };
+        let granted = duration.map(|d| d.min(max)).unwrap_or(max);
+        self.state.lock().boosts.insert(
+            execution_id.to_string(),
+            Boost {
+                task_id: task_id.to_string(),
+                resource,
+                until: Instant::now() + granted,
+            },
+        );
+        tracing::debug!(
+            execution_id = %execution_id,
+            task_id = %task_id,
+            resource = ?resource,
+            granted_ms = granted.as_millis() as u64,
+            "Compute boost started"
+        );
+        Some(granted)
+    }
+
+    /// End the boost of an execution, if any / 结束某个执行的提升（如有）
+    pub fn end(&self, execution_id: &str) {
+        if self.state.lock().boosts.remove(execution_id).is_some() {
+            self.changed.notify_waiters();
+        }
+    }
+
+    /// Admit now, or return when the caller should wake to check again
+    /// 立即放行，或返回调用方应再次检查的时刻
+    fn try_admit(
+        &self,
+        task_id: &str,
+        interactive: bool,
+        force: bool,
+    ) -> Result<(), Option<Instant>> {
+        let cfg = self.config.read().clone();
+        let mut st = self.state.lock();
+        st.prune(Instant::now());
+        let held = cfg.enabled
+            && !force
+            && !st.boosted(task_id)
+            && st.boosts.values().any(|b| b.task_id != task_id)
+            && ((!interactive && cfg.defer_async)
+                || (cfg.max_other_concurrency > 0
+                    && st
+                        .running
+                        .iter()
+                        .filter(|(t, _)| !st.boosted(t))
+                        .map(|(_, n)| *n)
+                        .sum::<usize>()
+                        >= cfg.max_other_concurrency));
+        if held {
+            return Err(st.next_expiry());
+        }
+        *st.running.entry(task_id.to_string()).or_default() += 1;
+        Ok(())
+    }
+
+    fn release(&self, task_id: &str) {
+        {
+            let mut st = self.state.lock();
+            if let Some(n) = st.running.get_mut(task_id) {
+                *n = n.saturating_sub(1);
+                if *n == 0 {
+                    st.running.remove(task_id);
+                }
+            }
+        }
+        self.changed.notify_waiters();
+    }
+
+    /// Wait until an execution of `task_id` may start; `interactive` is false for async work
+    /// 等待 `task_id` 的执行可以开始；异步工作的 `interactive` 为 false
+    ///
+    /// Returns the permit and how long the caller was held. / 返回许可与调用方被暂缓的时长。
+    pub async fn admit(
+        self: &Arc<Self>,
+        task_id: &str,
+        interactive: bool,
+    ) -> (ComputePermit, Duration) {
+        let max = Duration::from_millis(self.config.read().max_defer_ms);
+        let start = Instant::now();
+        loop {
+            let notified = self.changed.notified();
+            tokio::pin!(notified);
+            notified.as_mut().enable();
+            let force = start.elapsed() >= max;
+            match self.try_admit(task_id, interactive, force) {
+                Ok(()) => break,
+                Err(expiry) => {
+                    let mut left = max.saturating_sub(start.elapsed());
+                    if let Some(at) = expiry {
+                        left = left.min(at.saturating_duration_since(Instant::now()));
+                    }
+                    let _ = tokio::time::timeout(left, notified).await;
+                }
+            }
+        }
+        let permit = ComputePermit {
+            hints: self.clone(),
+            task_id: task_id.to_string(),
+        };
+        (permit, start.elapsed())
+    }
+
+    /// Current boosts / 当前提升
+    pub fn status(&self) -> ComputeHintsStatus {
+        let enabled = self.config.read().enabled;
+        let now = Instant::now();
+        let mut st = self.state.lock();
+        st.prune(now);
+        let mut boosts: Vec<BoostStatus> = st
+            .boosts
+            .iter()
+            .map(|(id, b)| BoostStatus {
+                execution_id: id.clone(),
+                task_id: b.task_id.clone(),
+                resource: b.resource,
+                remaining_ms: b.until.saturating_duration_since(now).as_millis() as u64,
+            })
+            .collect();
+        boosts.sort_by(|a, b| a.execution_id.cmp(&b.execution_id));
+        ComputeHintsStatus { enabled, boosts }
+    }
+}
+
+/// Execution counted while boosts decide who runs / 在提升决定放行时被计数的执行
+pub struct ComputePermit {
+    hints: Arc<ComputeHints>,
+    task_id: String,
+}
+
+impl std::fmt::Debug for ComputePermit {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ComputePermit")
+            .field("task_id", &self.task_id)
+            .finish()
+    }
+}
+
+impl Drop for ComputePermit {
+    fn drop(&mut self) {
+        self.hints.release(&self.task_id);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn hints(cfg: ComputeHintsConfig) -> Arc<ComputeHints> {
+        Arc::new(ComputeHints::new(cfg))
+    }
+
+    fn config(max_defer_ms: u64) -> ComputeHintsConfig {
+        ComputeHintsConfig {
+            max_defer_ms,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_parse_resource() {
+        assert_eq!(ComputeResource::parse(" GPU "), Some(ComputeResource::Gpu));
+        assert_eq!(ComputeResource::parse("cpu"), Some(ComputeResource::Cpu));
+        assert_eq!(ComputeResource::parse("tpu"), None);
+    }
+
+    #[test]
+    fn test_begin_caps_duration() {
+        let h = hints(config(1000));
+        let granted = h.begin(
+            "e1",
+            "t1",
+            ComputeResource::Gpu,
+            Some(Duration::from_secs(3600)),
+        );
+        assert_eq!(granted, Some(Duration::from_millis(30_000)));
+        let st = h.status();
+        assert_eq!(st.boosts.len(), 1);
+        assert_eq!(st.boosts[0].resource, ComputeResource::Gpu);
+
+        h.configure(&ComputeHintsConfig {
+            enabled: false,
+            ..Default::default()
+        });
+        assert!(h.status().boosts.is_empty());
+        assert_eq!(h.begin("e1", "t1", ComputeResource::Cpu, None), None);
+    }
+
+    #[tokio::test]
+    async fn test_admit_defers_other_tasks() {
+        let h = hints(config(5_000));
+        h.begin("e1", "voice", ComputeResource::Cpu, None);
+
+        // The boosted task and interactive work under the cap go straight through
+        // 被提升任务与上限内的交互式工作直接放行
+        let (_own, held) = h.admit("voice", false).await;
+        assert_eq!(held, Duration::ZERO);
+        let (other, held) = h.admit("batch", true).await;
+        assert_eq!(held, Duration::ZERO);
+
+        // Async work of another task waits for the boost to end
+        // 其他任务的异步工作等待提升结束
+        let waiter = {
+            let h = h.clone();
+            tokio::spawn(async move { h.admit("batch", false).await.1 })
+        };
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert!(!waiter.is_finished());
+        h.end("e1");
+        let held = waiter.await.unwrap();
+        assert!(held >= Duration::from_millis(50));
+        drop(other);
+    }
+
+    #[tokio::test]
+    async fn test_admit_caps_other_concurrency() {
+        let h = hints(config(100));
+        h.begin("e1", "voice", ComputeResource::Cpu, None);
+        let (_first, _) = h.admit("batch", true).await;
+
+        // A second interactive execution exceeds the cap and waits out `max_defer_ms`
+        // 第二个交互式执行超出上限，等待至 `max_defer_ms`
+        let (_second, held) = h.admit("other", true).await;
+        assert!(held >= Duration::from_millis(100));
+    }
+}
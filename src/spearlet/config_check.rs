@@ -0,0 +1,1556 @@
+//! Offline checks behind `spearlet config validate`
+//! `spearlet config validate` 背后的离线检查
+//!
+//! Loading only catches syntax and type errors. These checks catch settings that parse
+//! but would fail or be ignored at runtime, such as missing TLS files, unknown runtimes
+//! or misspelled keys.
+//! 加载只能发现语法与类型错误。这些检查发现能够解析但在运行时会失败或被忽略的设置，
+//! 例如缺失的 TLS 文件、未知运行时或拼错的键。
+
+use std::path::Path;
+
+use crate::spearlet::config::{AppConfig, LlmBackendConfig, SpearletConfig};
+use crate::spearlet::device_profile;
+use crate::spearlet::execution::ai::backends::{
+    KIND_AZURE_SPEECH_WS, KIND_DEEPGRAM_LISTEN_WS, KIND_GOOGLE_SPEECH, KIND_LOCAL_MODERATION,
+};
+use crate::spearlet::execution::runtime::RuntimeFactory;
+use crate::spearlet::http_error;
+use crate::spearlet::ip_allowlist::IpAllowlist;
+use crate::spearlet::local_models::lifecycle as model_lifecycle;
+use crate::spearlet::log_shipping;
+use crate::spearlet::preemption::{self, PreemptAction};
+use crate::spearlet::reload;
+use crate::spearlet::tls;
+
+/// Result of the checks / 检查结果
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ConfigReport {
+    /// Settings the spearlet cannot run with / spearlet 无法以此运行的设置
+    pub errors: Vec<String>,
+    /// Settings that are likely mistakes / 很可能有误的设置
+    pub warnings: Vec<String>,
+}
+
+impl ConfigReport {
+    pub fn is_ok(&self, strict: bool) -> bool {
+        self.errors.is_empty() && (!strict || self.warnings.is_empty())
+    }
+
+    /// One line per problem / 每个问题一行
+    pub fn render(&self) -> String {
+        let mut out = String::new();
+        for e in &self.errors {
+            out.push_str(&format!("error: {}\n", e));
+        }
+        for w in &self.warnings {
+            out.push_str(&format!("warning: {}\n", w));
+        }
+        out
+    }
+}
+
+/// Why a local KV store backend cannot be used, if it cannot / 本地 KV 存储后端不可用的原因（如不可用）
+fn unsupported_store_backend(backend: &str) -> Option<String> {
+    let supported = crate::storage::kv::get_kv_store_factory().supported_backends();
+    if supported.iter().any(|b| b == backend) {
+        return None;
+    }
+    Some(format!(
+        "backend {:?} is not compiled in (available: {})",
+        backend,
+        supported.join(", ")
+    ))
+}
+
+/// Check a loaded configuration / 检查已加载的配置
+pub fn validate(cfg: &SpearletConfig) -> ConfigReport {
+    let mut r = ConfigReport::default();
+
+    if !matches!(
+        cfg.logging.format.as_str(),
+        "json" | "text" | "compact" | "pretty"
+    ) {
+        r.warnings.push(format!(
+            "logging.format: unknown {:?}, using pretty (expected json or text)",
+            cfg.logging.format
+        ));
+    }
+
+    let tls_cfg = &cfg.tls;
+    if !tls_cfg.client_ca_path.is_empty() && !Path::new(&tls_cfg.client_ca_path).is_file() {
+        r.errors.push(format!(
+            "tls.client_ca_path: file not found: {}",
+            tls_cfg.client_ca_path
+        ));
+    }
+    if tls_cfg.require_client_cert && tls_cfg.client_ca_path.is_empty() {
+        r.errors
+            .push("tls.require_client_cert needs tls.client_ca_path".to_string());
+    }
+    if !matches!(tls_cfg.min_version.as_str(), "" | "1.2" | "1.3") {
+        r.errors.push(format!(
+            "tls.min_version: unsupported {:?} (expected 1.2 or 1.3)",
+            tls_cfg.min_version
+        ));
+    }
+    let suites = tls::known_cipher_suites();
+    for suite in &tls_cfg.cipher_suites {
+        if !suites.contains(&suite.as_str()) {
+            r.errors.push(format!(
+                "tls.cipher_suites: unknown suite {} (known: {})",
+                suite,
+                suites.join(", ")
+            ));
+        }
+    }
+    let tls_settings_ok = r.errors.is_empty();
+    let extra_listeners = [
+        ("http.listeners.admin", &cfg.http.listeners.admin),
+        ("http.listeners.metrics", &cfg.http.listeners.metrics),
+        ("http.listeners.provider", &cfg.http.listeners.provider),
+    ];
+    let mut servers = vec![("grpc", &cfg.grpc), ("http.server", &cfg.http.server)];
+    for (name, listener) in extra_listeners {
+        if let Some(l) = listener {
+            servers.push((name, &l.server));
+        }
+    }
+    for (i, (name, server)) in servers.iter().enumerate() {
+        if let Some((other, _)) = servers[..i].iter().find(|(_, s)| s.addr == server.addr) {
+            r.errors.push(format!(
+                "{}.addr and {}.addr are both {}",
+                other, name, server.addr
+            ));
+        }
+    }
+    for (listener, server) in servers.iter().copied() {
+        let (enabled, cert, key) = (&server.enable_tls, &server.cert_path, &server.key_path);
+        if !*enabled {
+            continue;
+        }
+        let mut files_ok = true;
+        for (field, path) in [("cert_path", cert), ("key_path", key)] {
+            let name = format!("{}.{}", listener, field);
+            match path.as_deref().filter(|p| !p.is_empty()) {
+                None => r
+                    .errors
+                    .push(format!("{} is required when TLS is enabled", name)),
+                Some(p) if !Path::new(p).is_file() => {
+                    r.errors.push(format!("{}: file not found: {}", name, p))
+                }
+                Some(_) => continue,
+            }
+            files_ok = false;
+        }
+        if files_ok && tls_settings_ok {
+            // Catches unreadable PEM, key mismatches and bad tls.* values
+            // 发现无法读取的 PEM、证书与私钥不匹配以及错误的 tls.* 取值
+            if let Err(e) = tls::build_server_config(
+                Path::new(cert.as_deref().unwrap_or_default()),
+                Path::new(key.as_deref().unwrap_or_default()),
+                &cfg.tls,
+                tls::ALPN_HTTP,
+            ) {
+                r.errors.push(format!("{}: {}", listener, e));
+            }
+        }
+    }
+    if !tls_cfg.client_ca_path.is_empty() && !servers.iter().any(|(_, s)| s.enable_tls) {
+        r.warnings
+            .push("tls.client_ca_path is set but no listener has TLS enabled".to_string());
+    }
+
+    if let Some(mtls) = cfg.http.auth.mtls.as_ref() {
+        if let Err(e) = IpAllowlist::parse(&mtls.trusted_proxies) {
+            r.errors
+                .push(format!("http.auth.mtls.trusted_proxies: {}", e));
+        }
+        let plain: Vec<&str> = servers
+            .iter()
+            .filter(|(name, s)| *name != "grpc" && !s.enable_tls)
+            .map(|(name, _)| *name)
+            .collect();
+        if cfg.http.auth.enabled && !plain.is_empty() {
+            if mtls.trusted_proxies.is_empty() {
+                r.warnings.push(format!(
+                    "http.auth.mtls: {} without TLS ignore {} (set http.auth.mtls.trusted_proxies to accept it from a TLS-terminating proxy)",
+                    plain.join(", "),
+                    mtls.subject_header
+                ));
+            } else {
+                r.warnings.push(format!(
+                    "http.auth.mtls: {} without TLS trust {} from {}; make sure clients cannot reach them directly",
+                    plain.join(", "),
+                    mtls.subject_header,
+                    mtls.trusted_proxies.join(", ")
+                ));
+            }
+        }
+    }
+
+    let rl = &cfg.http.rate_limit;
+    if let Err(e) = IpAllowlist::parse(&rl.trusted_proxies) {
+        r.errors
+            .push(format!("http.rate_limit.trusted_proxies: {}", e));
+    }
+    if rl.enabled && rl.trust_forwarded_for && rl.trusted_proxies.is_empty() {
+        r.warnings.push(
+            "http.rate_limit: trust_forwarded_for has no effect without trusted_proxies"
+                .to_string(),
+        );
+    }
+
+    let cors = &cfg.http.cors;
+    if cors.allow_credentials && cors.allowed_origins.iter().any(|o| o.trim() == "*") {
+        r.errors
+            .push("http.cors: allow_credentials cannot be used with origin \"*\"".to_string());
+    }
+    for m in &cors.allowed_methods {
+        if axum::http::Method::from_bytes(m.trim().to_ascii_uppercase().as_bytes()).is_err() {
+            r.errors
+                .push(format!("http.cors.allowed_methods: invalid method {:?}", m));
+        }
+    }
+    for (name, list) in [
+        ("allowed_headers", &cors.allowed_headers),
+        ("exposed_headers", &cors.exposed_headers),
+    ] {
+        for h in list {
+            if axum::http::HeaderName::from_bytes(h.trim().as_bytes()).is_err() {
+                r.errors
+                    .push(format!("http.cors.{}: invalid header {:?}", name, h));
+            }
+        }
+    }
+    if !cors.allowed_origins.is_empty() && !cfg.http.cors_enabled {
+        r.warnings
+            .push("http.cors.allowed_origins is set but http.cors_enabled is false".to_string());
+    }
+    if !http_error::FORMATS.contains(&cfg.http.error_format.as_str()) {
+        r.errors.push(format!(
+            "http.error_format: unknown format {:?}, expected json or text",
+            cfg.http.error_format
+        ));
+    }
+    if cfg.auto_register && cfg.sms_grpc_addr.trim().is_empty() {
+        r.errors
+            .push("auto_register needs sms_grpc_addr".to_string());
+    }
+
+    let known: Vec<&str> = RuntimeFactory::available_runtimes()
+        .iter()
+        .map(|rt| rt.as_str())
+        .collect();
+    for rt in &cfg.execution.runtimes {
+        if !known.iter().any(|k| k.eq_ignore_ascii_case(rt)) {
+            r.errors.push(format!(
+                "execution.runtimes: unknown runtime {:?} (expected one of {:?})",
+                rt, known
+            ));
+        }
+    }
+    if cfg.execution.max_concurrent_executions == 0 {
+        r.errors
+            .push("execution.max_concurrent_executions must be at least 1".to_string());
+    }
+    if cfg.execution.debug_trace.enabled && cfg.execution.debug_trace.max_events == 0 {
+        r.errors
+            .push("execution.debug_trace.max_events must be at least 1".to_string());
+    }
+    let ci = &cfg.execution.child_invoke;
+    if ci.enabled && (ci.max_depth == 0 || ci.max_children == 0) {
+        r.errors.push(
+            "execution.child_invoke: max_depth and max_children must be at least 1".to_string(),
+        );
+    }
+    for dir in &cfg.execution.search_paths {
+        if !Path::new(dir).is_dir() {
+            r.warnings
+                .push(format!("execution.search_paths: not a directory: {}", dir));
+        }
+    }
+
+    for b in &cfg.llm.backends {
+        // A local classifier is named by its path / 本地分类器以其路径指定
+        if b.kind == KIND_LOCAL_MODERATION {
+            if !Path::new(&b.base_url).is_file() {
+                r.warnings.push(format!(
+                    "llm backend {}: classifier not found: {:?}",
+                    b.name, b.base_url
+                ));
+            }
+        } else if !b.base_url.is_empty() && url::Url::parse(&b.base_url).is_err() {
+            r.errors.push(format!(
+                "llm backend {}: invalid base_url {:?}",
+                b.name, b.base_url
+            ));
+        }
+        let speech = [
+            KIND_DEEPGRAM_LISTEN_WS,
+            KIND_AZURE_SPEECH_WS,
+            KIND_GOOGLE_SPEECH,
+        ];
+        if speech.contains(&b.kind.as_str()) && !cfg!(feature = "rt-asr") {
+            r.errors.push(format!(
+                "llm backend {}: kind {} needs a build with the rt-asr feature",
+                b.name, b.kind
+            ));
+        }
+        if let Some(cred) = b.credential_ref.as_deref().filter(|c| !c.is_empty()) {
+            if !cfg.llm.credentials.iter().any(|c| c.name == cred) {
+                r.errors.push(format!(
+                    "llm backend {}: unknown credential_ref {}",
+                    b.name, cred
+                ));
+            }
+        }
+    }
+
+    let fo = &cfg.llm.failover;
+    if fo.enabled {
+        if fo.max_attempts == 0 || fo.failure_threshold == 0 {
+            r.errors.push(
+                "llm.failover: max_attempts and failure_threshold must be positive".to_string(),
+            );
+        }
+        if fo.backoff_initial_ms > fo.backoff_max_ms {
+            r.errors.push(format!(
+                "llm.failover: backoff_initial_ms {} exceeds backoff_max_ms {}",
+                fo.backoff_initial_ms, fo.backoff_max_ms
+            ));
+        }
+    }
+
+    let energy = &cfg.energy;
+    if energy.critical_battery_percent > energy.low_battery_percent {
+        r.errors.push(
+            "energy.critical_battery_percent is above energy.low_battery_percent".to_string(),
+        );
+    }
+    if energy.critical_temp_c < energy.hot_temp_c {
+        r.errors
+            .push("energy.critical_temp_c is below energy.hot_temp_c".to_string());
+    }
+
+    for problem in device_profile::validate(&cfg.devices) {
+        r.errors.push(format!("devices: {}", problem));
+    }
+
+    // Subsystems a build profile may leave out / 构建配置可能省略的子系统
+    for (section, enabled, built_in) in [
+        ("onnx", cfg.onnx.enabled, cfg!(feature = "onnx")),
+        ("rtsp", cfg.rtsp.enabled, cfg!(feature = "rtsp")),
+        ("webrtc", cfg.webrtc.enabled, cfg!(feature = "webrtc")),
+        (
+            "telephony",
+            cfg.telephony.enabled,
+            cfg!(feature = "telephony"),
+        ),
+    ] {
+        if enabled && !built_in {
+            r.errors.push(format!(
+                "{section}: enabled needs a build with the {section} feature"
+            ));
+        }
+    }
+
+    let webrtc = &cfg.webrtc;
+    if webrtc.port_min > webrtc.port_max {
+        r.errors
+            .push("webrtc.port_min is above webrtc.port_max".to_string());
+    }
+    for (i, server) in webrtc.ice_servers.iter().enumerate() {
+        for url in &server.urls {
+            if !["stun:", "stuns:", "turn:", "turns:"]
+                .iter()
+                .any(|scheme| url.starts_with(scheme))
+            {
+                r.errors.push(format!(
+                    "webrtc.ice_servers[{}]: {} is not a stun or turn url",
+                    i, url
+                ));
+            }
+        }
+    }
+    if webrtc.enabled && webrtc.advertise_host.is_empty() && webrtc.ice_servers.is_empty() {
+        r.warnings.push(
+            "webrtc.ice_servers and webrtc.advertise_host are empty; only peers that reach an interface address can connect"
+                .to_string(),
+        );
+    }
+
+    let rtsp = &cfg.rtsp;
+    let mut camera_names = std::collections::HashSet::new();
+    for (i, cam) in rtsp.cameras.iter().enumerate() {
+        if cam.name.is_empty() {
+            r.errors.push(format!("rtsp.cameras[{}]: name is empty", i));
+        } else if !camera_names.insert(cam.name.as_str()) {
+            r.errors
+                .push(format!("rtsp.cameras: duplicate name {}", cam.name));
+        }
+        #[cfg(feature = "rtsp")]
+        if let Err(e) = crate::spearlet::rtsp::client::CameraUrl::parse(&cam.url) {
+            r.errors
+                .push(format!("rtsp.cameras[{}] ({}): {}", i, cam.name, e));
+        }
+        if !cam.max_fps.is_finite() || cam.max_fps < 0.0 {
+            r.errors.push(format!(
+                "rtsp.cameras[{}] ({}): max_fps must be 0 or positive",
+                i, cam.name
+            ));
+        }
+        let motion = &cam.motion;
+        if !motion.threshold.is_finite() || motion.threshold <= 1.0 {
+            r.errors.push(format!(
+                "rtsp.cameras[{}] ({}): motion.threshold must be greater than 1",
+                i, cam.name
+            ));
+        }
+        if motion.enabled && motion.hold_ms == 0 {
+            r.warnings.push(format!(
+                "rtsp.cameras[{}] ({}): motion.hold_ms is 0; clips end at the first still frame",
+                i, cam.name
+            ));
+        }
+    }
+    if rtsp.enabled && rtsp.cameras.is_empty() {
+        r.warnings
+            .push("rtsp.enabled is set but no cameras are configured".to_string());
+    }
+
+    let onnx = &cfg.onnx;
+    let mut model_names = std::collections::HashSet::new();
+    for (i, m) in onnx.models.iter().enumerate() {
+        if m.name.is_empty() {
+            r.errors.push(format!("onnx.models[{}]: name is empty", i));
+        } else if !model_names.insert(m.name.as_str()) {
+            r.errors
+                .push(format!("onnx.models: duplicate name {}", m.name));
+        }
+        if !matches!(
+            m.task.as_str(),
+            "raw" | "classification" | "detection" | "embedding"
+        ) {
+            r.errors.push(format!(
+                "onnx.models[{}] ({}): unknown task {}",
+                i, m.name, m.task
+            ));
+        }
+        if !matches!(m.image.layout.as_str(), "nchw" | "nhwc") {
+            r.errors.push(format!(
+                "onnx.models[{}] ({}): image.layout must be nchw or nhwc",
+                i, m.name
+            ));
+        }
+        if !matches!(m.image.dtype.as_str(), "f32" | "u8") {
+            r.errors.push(format!(
+                "onnx.models[{}] ({}): image.dtype must be f32 or u8",
+                i, m.name
+            ));
+        }
+        if m.image.std.iter().any(|v| *v == 0.0) {
+            r.errors.push(format!(
+                "onnx.models[{}] ({}): image.std must not contain 0",
+                i, m.name
+            ));
+        }
+        if onnx.enabled {
+            for (key, path) in [("path", &m.path), ("labels_path", &m.labels_path)] {
+                if !path.is_empty() && !std::path::Path::new(path).exists() {
+                    r.warnings.push(format!(
+                        "onnx.models[{}] ({}): {} {} does not exist",
+                        i, m.name, key, path
+                    ));
+                }
+            }
+        }
+    }
+    let preloaded = onnx.models.iter().filter(|m| m.preload).count();
+    if preloaded > onnx.max_loaded_models {
+        r.warnings.push(format!(
+            "onnx: {} models are preloaded but max_loaded_models is {}",
+            preloaded, onnx.max_loaded_models
+        ));
+    }
+
+    let store = &cfg.model_store;
+    let mut store_names = std::collections::HashSet::new();
+    let mut store_files = std::collections::HashSet::new();
+    for (i, m) in store.models.iter().enumerate() {
+        if m.name.is_empty() {
+            r.errors
+                .push(format!("model_store.models[{}]: name is empty", i));
+        } else if !store_names.insert(m.name.as_str()) {
+            r.errors
+                .push(format!("model_store.models: duplicate name {}", m.name));
+        }
+        if !model_lifecycle::KINDS.contains(&m.kind.as_str()) {
+            r.errors.push(format!(
+                "model_store.models[{}] ({}): unknown kind {}",
+                i, m.name, m.kind
+            ));
+        }
+        let sha256 = m.sha256.trim();
+        if m.kind == model_lifecycle::KIND_OLLAMA {
+            if !sha256.is_empty() && (sha256.len() != 64 || !is_hex(sha256)) {
+                r.errors.push(format!(
+                    "model_store.models[{}] ({}): sha256 must be 64 hex digits",
+                    i, m.name
+                ));
+            }
+            continue;
+        }
+        if !(m.url.starts_with("http://") || m.url.starts_with("https://")) {
+            r.errors.push(format!(
+                "model_store.models[{}] ({}): url must be http(s)",
+                i, m.name
+            ));
+        }
+        let file = m.file_name();
+        if file.contains('/') || file.contains("..") || file.starts_with('.') {
+            r.errors.push(format!(
+                "model_store.models[{}] ({}): invalid file name {:?}",
+                i, m.name, file
+            ));
+        } else if !file.is_empty() && !store_files.insert(file) {
+            r.errors
+                .push(format!("model_store.models: file {} is used twice", file));
+        }
+        if sha256.is_empty() {
+            r.warnings.push(format!(
+                "model_store.models[{}] ({}): no sha256; the file is not verified",
+                i, m.name
+            ));
+        } else if sha256.len() != 64 || !is_hex(sha256) {
+            r.errors.push(format!(
+                "model_store.models[{}] ({}): sha256 must be 64 hex digits",
+                i, m.name
+            ));
+        }
+    }
+    if store.enabled && store.models.is_empty() {
+        r.warnings
+            .push("model_store.enabled is set but no models are listed".to_string());
+    }
+
+    let export = &cfg.metrics_export;
+    if export.enabled {
+        if export.window_s == 0 || export.flush_interval_s == 0 {
+            r.errors
+                .push("metrics_export: window_s and flush_interval_s must be positive".to_string());
+        }
+        if export.buffer_windows == 0 {
+            r.errors
+                .push("metrics_export.buffer_windows must be positive".to_string());
+        }
+        if export.flush_interval_s < export.window_s {
+            r.warnings.push(
+                "metrics_export.flush_interval_s is shorter than window_s; some uploads are empty"
+                    .to_string(),
+            );
+        }
+        if cfg.sms_grpc_addr.trim().is_empty() {
+            r.warnings
+                .push("metrics_export.enabled is set but sms_grpc_addr is empty".to_string());
+        }
+    }
+
+    let ship = &cfg.log_shipping;
+    if !log_shipping::PROTOCOLS.contains(&ship.protocol.as_str()) {
+        r.errors.push(format!(
+            "log_shipping.protocol: unknown protocol {:?}, expected loki or otlp",
+            ship.protocol
+        ));
+    }
+    if ship.level.parse::<tracing::Level>().is_err() {
+        r.errors.push(format!(
+            "log_shipping.level: unknown level {:?}",
+            ship.level
+        ));
+    }
+    if ship.enabled {
+        if ship.endpoint.trim().is_empty() {
+            r.errors
+                .push("log_shipping.enabled is set but endpoint is empty".to_string());
+        } else if url::Url::parse(&ship.endpoint).is_err() {
+            r.errors.push(format!(
+                "log_shipping.endpoint: invalid URL {:?}",
+                ship.endpoint
+            ));
+        }
+        if ship.batch_size == 0 || ship.queue_capacity == 0 {
+            r.errors
+                .push("log_shipping: batch_size and queue_capacity must be positive".to_string());
+        }
+        if ship.max_spool_bytes == 0 {
+            r.warnings.push(
+                "log_shipping.max_spool_bytes is 0; only the newest batch survives an outage"
+                    .to_string(),
+            );
+        }
+    }
+
+    let tunnel = &cfg.debug_tunnel;
+    if tunnel.enabled {
+        if tunnel.max_session_s == 0 {
+            r.errors
+                .push("debug_tunnel.max_session_s must be positive".to_string());
+        }
+        for path in &tunnel.allowed_paths {
+            if !path.starts_with('/') {
+                r.errors.push(format!(
+                    "debug_tunnel.allowed_paths: {:?} must start with /",
+                    path
+                ));
+            }
+        }
+        if tunnel.allowed_paths.is_empty() {
+            r.warnings
+                .push("debug_tunnel.allowed_paths is empty; sessions reach nothing".to_string());
+        }
+        if cfg.sms_grpc_addr.trim().is_empty() {
+            r.warnings
+                .push("debug_tunnel.enabled is set but sms_grpc_addr is empty".to_string());
+        }
+        let auth = &cfg.http.auth;
+        if auth.api_keys.is_empty() && auth.jwt.is_none() {
+            r.warnings.push(
+                "debug_tunnel: http.auth has no API key or JWT; tunnel requests are refused"
+                    .to_string(),
+            );
+        }
+    }
+
+    let desired = &cfg.desired_state;
+    if desired.enabled {
+        match desired.source.as_str() {
+            "git" | "file" => {}
+            "http" => {
+                if url::Url::parse(&desired.url).is_err() {
+                    r.errors
+                        .push(format!("desired_state.url: invalid URL {:?}", desired.url));
+                }
+            }
+            other => r.errors.push(format!(
+                "desired_state.source must be git, http or file, got {:?}",
+                other
+            )),
+        }
+        if desired.url.trim().is_empty() {
+            r.errors.push("desired_state.url is required".to_string());
+        }
+        if desired.source == "git" && desired.path.trim().is_empty() {
+            r.errors
+                .push("desired_state.path is required for a git source".to_string());
+        }
+        if desired.poll_interval_s == 0 {
+            r.errors
+                .push("desired_state.poll_interval_s must be positive".to_string());
+        }
+    }
+
+    let blobs = &cfg.blob_cache;
+    if blobs.enabled {
+        if blobs.max_blob_bytes > blobs.max_total_bytes {
+            r.errors.push(format!(
+                "blob_cache: max_blob_bytes {} exceeds max_total_bytes {}",
+                blobs.max_blob_bytes, blobs.max_total_bytes
+            ));
+        }
+        if blobs.max_blob_bytes > i32::MAX as u64 {
+            r.errors
+                .push("blob_cache.max_blob_bytes must fit a guest buffer (2 GiB)".to_string());
+        }
+        if blobs.ttl_s == 0 {
+            r.errors
+                .push("blob_cache.ttl_s must be positive".to_string());
+        }
+        if blobs.compression && !(1..=22).contains(&blobs.compression_level) {
+            r.errors.push(format!(
+                "blob_cache.compression_level {} is outside zstd's 1..=22",
+                blobs.compression_level
+            ));
+        }
+    }
+
+    let vs = &cfg.vector_store;
+    if vs.enabled {
+        if !crate::spearlet::vector_store::BACKENDS.contains(&vs.backend.as_str()) {
+            r.errors.push(format!(
+                "vector_store: unknown backend {:?} (expected one of {})",
+                vs.backend,
+                crate::spearlet::vector_store::BACKENDS.join(", ")
+            ));
+        } else if vs.backend != "memory" {
+            if vs.url.trim().is_empty() {
+                r.errors
+                    .push(format!("vector_store: backend {} needs a url", vs.backend));
+            }
+            let prefix_ok = vs
+                .collection_prefix
+                .chars()
+                .next()
+                .is_some_and(|c| c.is_ascii_alphabetic())
+                && vs
+                    .collection_prefix
+                    .chars()
+                    .all(|c| c.is_ascii_alphanumeric() || c == '_');
+            if !prefix_ok {
+                r.errors.push(format!(
+                    "vector_store: collection_prefix {:?} must be a letter followed by letters, digits or _",
+                    vs.collection_prefix
+                ));
+            }
+            if vs.batch_size == 0 || vs.timeout_ms == 0 {
+                r.errors
+                    .push("vector_store: batch_size and timeout_ms must be positive".to_string());
+            }
+            if !vs.token_env.trim().is_empty() && std::env::var(vs.token_env.trim()).is_err() {
+                r.warnings.push(format!(
+                    "vector_store: token_env {} is not set",
+                    vs.token_env.trim()
+                ));
+            }
+        }
+        if vs.backend == "pgvector" && !cfg!(feature = "pgvector") {
+            r.errors.push(
+                "vector_store: backend pgvector needs a build with the pgvector feature"
+                    .to_string(),
+            );
+        }
+        if matches!(vs.backend.as_str(), "qdrant" | "milvus") && !cfg!(feature = "vector-db") {
+            r.errors.push(format!(
+                "vector_store: backend {} needs a build with the vector-db feature",
+                vs.backend
+            ));
+        }
+        if vs.max_collections == 0 || vs.max_dimensions == 0 || vs.max_vectors == 0 {
+            r.errors.push(
+                "vector_store: max_collections, max_dimensions and max_vectors must be positive"
+                    .to_string(),
+            );
+        }
+    }
+
+    let kv = &cfg.kv_state;
+    if kv.enabled {
+        if let Some(e) = unsupported_store_backend(&kv.backend) {
+            r.errors.push(format!("kv_state.backend: {}", e));
+        }
+        if kv.max_key_bytes == 0 || kv.max_value_bytes == 0 {
+            r.errors
+                .push("kv_state: max_key_bytes and max_value_bytes must be positive".to_string());
+        }
+        if kv.max_key_bytes + kv.max_value_bytes > kv.max_namespace_bytes {
+            r.errors.push(format!(
+                "kv_state: max_namespace_bytes {} cannot hold one key of max_key_bytes plus a value of max_value_bytes",
+                kv.max_namespace_bytes
+            ));
+        }
+    }
+
+    let sc = &cfg.schedules;
+    if sc.enabled && (sc.max_per_task == 0 || sc.tick_ms == 0) {
+        r.errors
+            .push("schedules: max_per_task and tick_ms must be positive".to_string());
+    }
+
+    let aj = &cfg.async_journal;
+    if aj.enabled {
+        if let Some(e) = unsupported_store_backend(&aj.backend) {
+            r.errors.push(format!("async_journal.backend: {}", e));
+        }
+        if aj.max_pending == 0 {
+            r.errors
+                .push("async_journal: max_pending must be positive".to_string());
+        }
+    }
+
+    let mp = &cfg.message_passing;
+    if mp.enabled && (mp.max_names == 0 || mp.max_queue_messages == 0 || mp.max_message_bytes == 0)
+    {
+        r.errors.push(
+            "message_passing: max_names, max_queue_messages and max_message_bytes must be positive"
+                .to_string(),
+        );
+    }
+    let routing = &mp.routing;
+    if mp.enabled && routing.enabled {
+        if routing.advertise_url.is_empty() {
+            r.warnings.push(
+                "message_passing.routing.advertise_url is empty; peers cannot reach mailboxes on this node"
+                    .to_string(),
+            );
+        }
+        if routing.peers.is_empty() && !routing.discover_peers {
+            r.warnings
+                .push("message_passing.routing has no peers and discover_peers is off".to_string());
+        }
+        for peer in &routing.peers {
+            if !peer.starts_with("http://") && !peer.starts_with("https://") {
+                r.errors.push(format!(
+                    "message_passing.routing.peers: {:?} is not an http(s) URL",
+                    peer
+                ));
+            }
+        }
+    }
+
+    let sf = &cfg.scratch_files;
+    if sf.enabled {
+        if sf.max_file_bytes == 0 || sf.max_task_bytes == 0 {
+            r.errors.push(
+                "scratch_files: max_file_bytes and max_task_bytes must be positive".to_string(),
+            );
+        }
+        let mut names = std::collections::HashSet::new();
+        for m in &sf.mounts {
+            if m.name.is_empty() || m.name.contains('/') || !names.insert(m.name.as_str()) {
+                r.errors.push(format!(
+                    "scratch_files.mounts: name {:?} must be unique, non-empty and without '/'",
+                    m.name
+                ));
+            }
+            if m.path.is_empty() {
+                r.errors
+                    .push(format!("scratch_files.mounts: {:?} has no path", m.name));
+            } else if !Path::new(&m.path).is_dir() {
+                r.warnings.push(format!(
+                    "scratch_files.mounts: {:?} path {} is not a directory",
+                    m.name, m.path
+                ));
+            }
+        }
+    }
+
+    let tw = &cfg.temp_workspace;
+    if tw.enabled && tw.max_task_bytes > 0 && tw.max_task_bytes < 1024 * 1024 {
+        r.warnings.push(format!(
+            "temp_workspace: max_task_bytes {} leaves tools less than 1 MiB of temporary files",
+            tw.max_task_bytes
+        ));
+    }
+
+    let rc = &cfg.response_cache;
+    if rc.enabled {
+        for op in &rc.operations {
+            if !crate::spearlet::response_cache::OPERATIONS.contains(&op.as_str()) {
+                r.errors.push(format!(
+                    "response_cache.operations: {:?} is not one of {}",
+                    op,
+                    crate::spearlet::response_cache::OPERATIONS.join(", ")
+                ));
+            }
+        }
+        if rc.max_memory_bytes > 0 && rc.max_entry_bytes > rc.max_memory_bytes {
+            r.warnings.push(format!(
+                "response_cache: max_entry_bytes {} exceeds max_memory_bytes {}",
+                rc.max_entry_bytes, rc.max_memory_bytes
+            ));
+        }
+    }
+
+    let ba = &cfg.backend_autosuspend;
+    if ba.enabled {
+        if ba.idle_timeout_secs == 0 {
+            r.errors
+                .push("backend_autosuspend.idle_timeout_secs must be greater than 0".to_string());
+        }
+        if ba.check_interval_secs == 0 {
+            r.errors
+                .push("backend_autosuspend.check_interval_secs must be greater than 0".to_string());
+        }
+    }
+
+    let md = &cfg.moderation;
+    if md.enabled {
+        let serves = |b: &LlmBackendConfig| b.ops.iter().any(|o| o == "moderations");
+        if md.backend.is_empty() {
+            if !cfg.llm.backends.iter().any(serves) {
+                r.errors
+                    .push("moderation: no llm backend has ops = [\"moderations\"]".to_string());
+            }
+        } else if !cfg
+            .llm
+            .backends
+            .iter()
+            .any(|b| b.name == md.backend && serves(b))
+        {
+            r.errors.push(format!(
+                "moderation: backend {} is not an llm backend with ops = [\"moderations\"]",
+                md.backend
+            ));
+        }
+        if md.timeout_ms == 0 {
+            r.errors
+                .push("moderation: timeout_ms must be positive".to_string());
+        }
+    }
+
+    let pe = &cfg.preemption;
+    if pe.enabled {
+        let preemptor = preemption::parse_priority(&pe.min_preemptor_priority);
+        let victim = preemption::parse_priority(&pe.max_victim_priority);
+        for (key, p, name) in [
+            (
+                "min_preemptor_priority",
+                preemptor,
+                &pe.min_preemptor_priority,
+            ),
+            ("max_victim_priority", victim, &pe.max_victim_priority),
+        ] {
+            if p.is_none() {
+                r.errors.push(format!(
+                    "preemption.{}: unknown priority {:?} (low, normal, high, urgent)",
+                    key, name
+                ));
+            }
+        }
+        if let (Some(a), Some(v)) = (preemptor, victim) {
+            if v >= a {
+                r.errors.push(
+                    "preemption: max_victim_priority must be below min_preemptor_priority"
+                        .to_string(),
+                );
+            }
+        }
+        if PreemptAction::parse(&pe.action).is_none() {
+            r.errors.push(format!(
+                "preemption.action: unknown action {:?} (requeue, terminate)",
+                pe.action
+            ));
+        }
+    }
+
+    let us = &cfg.usage;
+    for (backend, p) in &us.prices {
+        let prices = [
+            p.per_call,
+            p.input_per_million_tokens,
+            p.output_per_million_tokens,
+            p.per_million_characters,
+            p.per_audio_minute,
+        ];
+        if prices.iter().any(|x| !x.is_finite() || *x < 0.0) {
+            r.errors
+                .push(format!("usage.prices: {:?} has a negative price", backend));
+        }
+    }
+    for (task, b) in &us.budgets {
+        if !b.max_cost.is_finite() || b.max_cost < 0.0 {
+            r.errors
+                .push(format!("usage.budgets: {:?} has a negative max_cost", task));
+        }
+    }
+    if !us.enabled && !us.budgets.is_empty() {
+        r.warnings
+            .push("usage: budgets are not enforced while usage is disabled".to_string());
+    }
+
+    let sp = &cfg.service_ports;
+    if sp.enabled {
+        if sp.port_min == 0 || sp.port_max < sp.port_min {
+            r.errors.push(format!(
+                "service_ports: port range {}..={} is empty or starts at 0",
+                sp.port_min, sp.port_max
+            ));
+        }
+        if sp.bind_host.trim().is_empty() {
+            r.errors
+                .push("service_ports: bind_host must not be empty".to_string());
+        }
+    }
+
+    let tel = &cfg.telephony;
+    if tel.enabled {
+        if tel.workload.is_empty() {
+            r.warnings.push(
+                "telephony.workload is empty; every webhook must pass ?workload=".to_string(),
+            );
+        }
+        if tel.webhook_token.is_empty() {
+            r.warnings
+                .push("telephony.webhook_token is empty; anyone can start calls".to_string());
+        }
+        if !tel.public_base_url.is_empty() && url::Url::parse(&tel.public_base_url).is_err() {
+            r.errors.push(format!(
+                "telephony.public_base_url: invalid url {:?}",
+                tel.public_base_url
+            ));
+        }
+        #[cfg(feature = "telephony")]
+        for path in [
+            crate::spearlet::telephony::TWILIO_VOICE_PATH,
+            crate::spearlet::telephony::TWILIO_MEDIA_PATH,
+        ] {
+            let public = &cfg.http.auth.public_paths;
+            if cfg.http.auth.enabled && !public.iter().any(|p| p == path) {
+                r.warnings.push(format!(
+                    "telephony: {} is not in http.auth.public_paths; Twilio cannot authenticate",
+                    path
+                ));
+            }
+        }
+    }
+
+    if !cfg.reload.workloads_dir.is_empty() {
+        let scan = reload::load_workloads(Path::new(&cfg.reload.workloads_dir));
+        for e in scan.errors {
+            r.errors.push(format!("reload: {}", e));
+        }
+    }
+    r
+}
+
+fn is_hex(s: &str) -> bool {
+    s.chars().all(|c| c.is_ascii_hexdigit())
+}
+
+/// Keys in a configuration file that no setting reads, e.g. misspelled ones
+/// 配置文件中没有任何设置读取的键，例如拼错的键
+///
+/// Keys are compared with the defaults. Maps, lists and unset optional sections are
+/// not descended into.
+/// 与默认配置比较键。不深入映射、列表与未设置的可选分区。
+pub fn unknown_keys(file: &serde_json::Value) -> Vec<String> {
+    let defaults = serde_json::to_value(AppConfig::default()).unwrap_or_default();
+    let mut out = Vec::new();
+    collect_unknown("", file, &defaults, &mut out);
+    out
+}
+
+fn collect_unknown(
+    prefix: &str,
+    file: &serde_json::Value,
+    defaults: &serde_json::Value,
+    out: &mut Vec<String>,
+) {
+    let (Some(file), Some(defaults)) = (file.as_object(), defaults.as_object()) else {
+        return;
+    };
+    // An empty default object is a map with free-form keys / 空的默认对象是键不固定的映射
+    if defaults.is_empty() {
+        return;
+    }
+    for (k, v) in file {
+        let path = if prefix.is_empty() {
+            k.clone()
+        } else {
+            format!("{}.{}", prefix, k)
+        };
+        match defaults.get(k) {
+            Some(d) => collect_unknown(&path, v, d, out),
+            None => out.push(path),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_default_config_is_valid() {
+        let report = validate(&SpearletConfig::default());
+        assert!(report.is_ok(true), "{}", report.render());
+    }
+
+    #[test]
+    fn test_validate_reports_problems() {
+        let mut cfg = SpearletConfig::default();
+        cfg.grpc.enable_tls = true;
+        cfg.grpc.cert_path = Some("/nonexistent/cert.pem".to_string());
+        cfg.execution.runtimes = vec!["wasm".to_string(), "docker".to_string()];
+        cfg.execution.search_paths = vec!["/nonexistent/bin".to_string()];
+        cfg.execution.debug_trace.max_events = 0;
+        cfg.llm.backends.push(LlmBackendConfig {
+            name: "cloud".to_string(),
+            base_url: "not a url".to_string(),
+            hosting: Some("remote".to_string()),
+            credential_ref: Some("missing".to_string()),
+            ..Default::default()
+        });
+        cfg.energy.critical_battery_percent = 50;
+        cfg.logging.format = "yaml".to_string();
+
+        let report = validate(&cfg);
+        assert_eq!(report.errors.len(), 7, "{}", report.render());
+        assert_eq!(report.warnings.len(), 2);
+        assert!(!report.is_ok(false));
+        assert!(report.render().contains("error: grpc.key_path is required"));
+    }
+
+    #[test]
+    fn test_validate_tls_settings() {
+        let mut cfg = SpearletConfig::default();
+        cfg.http.server.enable_tls = true;
+        cfg.tls.require_client_cert = true;
+        cfg.tls.min_version = "1.1".to_string();
+        cfg.tls.cipher_suites = vec!["TLS_RSA_WITH_RC4_128_SHA".to_string()];
+
+        let report = validate(&cfg);
+        let text = report.render();
+        assert_eq!(report.errors.len(), 5, "{}", text);
+        assert!(text.contains("error: http.server.cert_path is required"));
+        assert!(text.contains("tls.require_client_cert needs tls.client_ca_path"));
+        assert!(text.contains("tls.min_version"));
+        assert!(text.contains("unknown suite TLS_RSA_WITH_RC4_128_SHA"));
+    }
+
+    #[test]
+    fn test_validate_cors() {
+        let mut cfg = SpearletConfig::default();
+        cfg.http.cors.allowed_origins = vec!["*".to_string()];
+        cfg.http.cors.allow_credentials = true;
+        cfg.http.cors.allowed_methods.push("GE T".to_string());
+        cfg.http.cors.exposed_headers = vec!["x-request-id".to_string(), "bad header".to_string()];
+
+        let report = validate(&cfg);
+        assert_eq!(report.errors.len(), 3, "{}", report.render());
+        cfg.http.cors_enabled = false;
+        cfg.http.cors.allow_credentials = false;
+        cfg.http.cors.allowed_methods.pop();
+        cfg.http.cors.exposed_headers.pop();
+        let report = validate(&cfg);
+        assert!(report.errors.is_empty(), "{}", report.render());
+        assert_eq!(report.warnings.len(), 1);
+    }
+
+    #[cfg(feature = "rtsp")]
+    #[test]
+    fn test_validate_rtsp_cameras() {
+        let mut cfg = SpearletConfig::default();
+        let cam = |name: &str, url: &str| crate::spearlet::config::RtspCameraConfig {
+            name: name.to_string(),
+            url: url.to_string(),
+            max_fps: 5.0,
+            ..Default::default()
+        };
+        cfg.rtsp.cameras = vec![
+            cam("door", "rtsp://192.0.2.5/live"),
+            cam("door", "rtsp://192.0.2.6/live"),
+            cam("", "http://192.0.2.7/"),
+        ];
+        cfg.rtsp.cameras[0].motion.threshold = 0.5;
+        let report = validate(&cfg);
+        assert_eq!(report.errors.len(), 4, "{}", report.render());
+        assert!(report.render().contains("duplicate name door"));
+        assert!(report.render().contains("motion.threshold"));
+    }
+
+    #[test]
+    fn test_validate_subsystems_need_their_features() {
+        let mut cfg = SpearletConfig::default();
+        cfg.onnx.enabled = true;
+        cfg.rtsp.enabled = true;
+        cfg.webrtc.enabled = true;
+        cfg.telephony.enabled = true;
+        let built_in = [
+            cfg!(feature = "onnx"),
+            cfg!(feature = "rtsp"),
+            cfg!(feature = "webrtc"),
+            cfg!(feature = "telephony"),
+        ];
+        let r = validate(&cfg);
+        let missing = r
+            .errors
+            .iter()
+            .filter(|e| e.contains("needs a build with"))
+            .count();
+        assert_eq!(
+            missing,
+            built_in.iter().filter(|b| !**b).count(),
+            "{:?}",
+            r.errors
+        );
+    }
+
+    #[cfg(feature = "onnx")]
+    #[test]
+    fn test_validate_onnx_models() {
+        let mut cfg = SpearletConfig::default();
+        let model = |name: &str, task: &str| crate::spearlet::config::OnnxModelConfig {
+            name: name.to_string(),
+            path: "/nonexistent/model.onnx".to_string(),
+            task: task.to_string(),
+            preload: true,
+            ..Default::default()
+        };
+        cfg.onnx.enabled = true;
+        cfg.onnx.max_loaded_models = 1;
+        cfg.onnx.models = vec![
+            model("resnet", "classification"),
+            model("resnet", "segment"),
+        ];
+        cfg.onnx.models[0].image.layout = "chw".to_string();
+        let report = validate(&cfg);
+        let text = report.render();
+        assert_eq!(report.errors.len(), 3, "{}", text);
+        assert!(text.contains("duplicate name resnet"));
+        assert!(text.contains("unknown task segment"));
+        assert!(text.contains("image.layout"));
+        assert!(text.contains("max_loaded_models is 1"));
+    }
+
+    #[test]
+    fn test_validate_model_store() {
+        use crate::spearlet::config::ManagedModelConfig;
+        let file = |name: &str, url: &str, sha256: &str| ManagedModelConfig {
+            name: name.to_string(),
+            url: url.to_string(),
+            sha256: sha256.to_string(),
+            ..Default::default()
+        };
+        let mut cfg = SpearletConfig::default();
+        cfg.model_store.models = vec![
+            file("base.bin", "https://example.com/base.bin", &"a".repeat(64)),
+            file("base.bin", "ftp://example.com/x", "xyz"),
+            file("../voice", "https://example.com/v.onnx", ""),
+            ManagedModelConfig {
+                name: "llama3".to_string(),
+                kind: "ollama".to_string(),
+                ..Default::default()
+            },
+        ];
+        let r = validate(&cfg);
+        let text = r.render();
+        assert_eq!(r.errors.len(), 5, "{}", text);
+        assert!(text.contains("duplicate name base.bin"));
+        assert!(text.contains("url must be http(s)"));
+        assert!(text.contains("invalid file name"));
+        assert!(text.contains("no sha256"));
+    }
+
+    #[test]
+    fn test_validate_http_listeners() {
+        use crate::spearlet::config::HttpListenerConfig;
+        let mut cfg = SpearletConfig::default();
+        let mut admin = HttpListenerConfig::default();
+        admin.server.addr = cfg.http.server.addr;
+        admin.server.enable_tls = true;
+        cfg.http.listeners.admin = Some(admin);
+        let mut metrics = HttpListenerConfig::default();
+        metrics.server.addr = "127.0.0.1:9102".parse().unwrap();
+        cfg.http.listeners.metrics = Some(metrics);
+        let r = validate(&cfg);
+        let text = r.render();
+        assert_eq!(r.errors.len(), 3, "{}", text);
+        assert!(text.contains("http.server.addr and http.listeners.admin.addr are both"));
+        assert!(text.contains("http.listeners.admin.cert_path is required"));
+    }
+
+    #[test]
+    fn test_validate_mtls_on_plain_listeners() {
+        use crate::spearlet::config::HttpMtlsAuthConfig;
+        let mut cfg = SpearletConfig::default();
+        cfg.http.auth.enabled = true;
+        cfg.http.auth.mtls = Some(HttpMtlsAuthConfig::default());
+        let r = validate(&cfg);
+        assert!(r.errors.is_empty(), "{}", r.render());
+        assert!(r.render().contains("http.server without TLS ignore"));
+
+        cfg.http.auth.mtls.as_mut().unwrap().trusted_proxies =
+            vec!["10.0.0.0/8".to_string(), "proxy".to_string()];
+        let text = validate(&cfg).render();
+        assert!(text.contains("http.auth.mtls.trusted_proxies: invalid address"));
+        assert!(text.contains("make sure clients cannot reach them directly"));
+    }
+
+    #[test]
+    fn test_validate_rate_limit_proxies() {
+        let mut cfg = SpearletConfig::default();
+        cfg.http.rate_limit.enabled = true;
+        cfg.http.rate_limit.trust_forwarded_for = true;
+        assert!(validate(&cfg)
+            .render()
+            .contains("trust_forwarded_for has no effect"));
+        cfg.http.rate_limit.trusted_proxies = vec!["10.0.0.0/40".to_string()];
+        let r = validate(&cfg);
+        assert!(r.errors[0].contains("http.rate_limit.trusted_proxies"));
+    }
+
+    #[test]
+    fn test_validate_log_shipping() {
+        let mut cfg = SpearletConfig::default();
+        cfg.log_shipping.enabled = true;
+        cfg.log_shipping.protocol = "syslog".to_string();
+        cfg.log_shipping.level = "loud".to_string();
+        let r = validate(&cfg);
+        assert_eq!(r.errors.len(), 3, "{:?}", r.errors);
+        assert!(r.errors.iter().any(|e| e.contains("endpoint is empty")));
+
+        cfg.log_shipping.protocol = "otlp".to_string();
+        cfg.log_shipping.level = "warn".to_string();
+        cfg.log_shipping.endpoint = "http://collector:4318".to_string();
+        assert!(validate(&cfg).errors.is_empty());
+    }
+
+    #[test]
+    fn test_validate_debug_tunnel() {
+        let mut cfg = SpearletConfig::default();
+        cfg.debug_tunnel.enabled = true;
+        cfg.debug_tunnel.max_session_s = 0;
+        cfg.debug_tunnel.allowed_paths = vec!["admin/".to_string()];
+        let r = validate(&cfg);
+        assert_eq!(r.errors.len(), 2, "{:?}", r.errors);
+        assert!(r.errors.iter().any(|e| e.contains("must start with /")));
+
+        cfg.debug_tunnel = Default::default();
+        cfg.debug_tunnel.enabled = true;
+        let r = validate(&cfg);
+        assert!(r.errors.is_empty());
+        assert!(r
+            .warnings
+            .iter()
+            .any(|w| w.contains("tunnel requests are refused")));
+    }
+
+    #[test]
+    fn test_validate_desired_state() {
+        let mut cfg = SpearletConfig::default();
+        cfg.desired_state.enabled = true;
+        cfg.desired_state.source = "svn".to_string();
+        let r = validate(&cfg);
+        assert_eq!(r.errors.len(), 2, "{:?}", r.errors);
+
+        cfg.desired_state.source = "http".to_string();
+        cfg.desired_state.url = "https://fleet.example.com/nodes/edge-1".to_string();
+        assert!(validate(&cfg).errors.is_empty());
+    }
+
+    #[cfg(feature = "vector-db")]
+    #[test]
+    fn test_validate_vector_store() {
+        let mut cfg = SpearletConfig::default();
+        cfg.vector_store.enabled = true;
+        cfg.vector_store.backend = "qdrant".to_string();
+        cfg.vector_store.collection_prefix = "1spear".to_string();
+        let r = validate(&cfg);
+        assert_eq!(r.errors.len(), 2, "{:?}", r.errors);
+
+        cfg.vector_store.url = "http://qdrant:6333".to_string();
+        cfg.vector_store.collection_prefix = "spear".to_string();
+        assert!(validate(&cfg).errors.is_empty());
+
+        cfg.vector_store.backend = "faiss".to_string();
+        assert_eq!(validate(&cfg).errors.len(), 1);
+    }
+
+    #[test]
+    fn test_validate_kv_state() {
+        let mut cfg = SpearletConfig::default();
+        cfg.kv_state.enabled = true;
+        assert!(validate(&cfg).errors.is_empty());
+
+        cfg.kv_state.max_namespace_bytes = 1024;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+
+        cfg.kv_state = Default::default();
+        cfg.kv_state.enabled = true;
+        cfg.kv_state.backend = "etcd".to_string();
+        assert!(validate(&cfg).errors[0].contains("kv_state.backend: backend \"etcd\""));
+    }
+
+    #[test]
+    fn test_validate_schedules() {
+        let mut cfg = SpearletConfig::default();
+        cfg.schedules.enabled = true;
+        assert!(validate(&cfg).errors.is_empty());
+
+        cfg.schedules.max_per_task = 0;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+    }
+
+    #[test]
+    fn test_validate_async_journal() {
+        let mut cfg = SpearletConfig::default();
+        cfg.async_journal.enabled = true;
+        assert!(validate(&cfg).errors.is_empty());
+
+        cfg.async_journal.max_pending = 0;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+
+        cfg.async_journal = Default::default();
+        cfg.async_journal.enabled = true;
+        cfg.async_journal.backend = "etcd".to_string();
+        assert!(validate(&cfg).errors[0].contains("async_journal.backend: backend \"etcd\""));
+    }
+
+    #[test]
+    fn test_validate_child_invoke() {
+        let mut cfg = SpearletConfig::default();
+        assert!(validate(&cfg).errors.is_empty());
+        cfg.execution.child_invoke.max_depth = 0;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+        cfg.execution.child_invoke.enabled = false;
+        assert!(validate(&cfg).errors.is_empty());
+    }
+
+    #[test]
+    fn test_validate_service_ports() {
+        let mut cfg = SpearletConfig::default();
+        assert!(validate(&cfg).errors.is_empty());
+        cfg.service_ports.port_max = cfg.service_ports.port_min - 1;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+        cfg.service_ports.enabled = false;
+        assert!(validate(&cfg).errors.is_empty());
+    }
+
+    #[test]
+    fn test_validate_scratch_files() {
+        let mut cfg = SpearletConfig::default();
+        cfg.scratch_files.enabled = true;
+        assert!(validate(&cfg).errors.is_empty());
+
+        let dir = tempfile::tempdir().unwrap();
+        let mount = |name: &str| crate::spearlet::config::SharedMountConfig {
+            name: name.to_string(),
+            path: dir.path().display().to_string(),
+            read_only: false,
+        };
+        cfg.scratch_files.mounts = vec![mount("shared"), mount("shared"), mount("a/b")];
+        assert_eq!(validate(&cfg).errors.len(), 2);
+    }
+
+    #[test]
+    fn test_validate_llm_failover() {
+        let mut cfg = SpearletConfig::default();
+        assert!(validate(&cfg).errors.is_empty());
+        cfg.llm.failover.max_attempts = 0;
+        cfg.llm.failover.backoff_initial_ms = cfg.llm.failover.backoff_max_ms + 1;
+        assert_eq!(validate(&cfg).errors.len(), 2);
+        cfg.llm.failover.enabled = false;
+        assert!(validate(&cfg).errors.is_empty());
+    }
+
+    #[test]
+    fn test_validate_temp_workspace() {
+        let mut cfg = SpearletConfig::default();
+        let base = validate(&cfg).warnings.len();
+        cfg.temp_workspace.max_task_bytes = 4096;
+        assert_eq!(validate(&cfg).warnings.len(), base + 1);
+        cfg.temp_workspace.max_task_bytes = 0;
+        assert_eq!(validate(&cfg).warnings.len(), base);
+    }
+
+    #[test]
+    fn test_validate_response_cache() {
+        let mut cfg = SpearletConfig::default();
+        cfg.response_cache.operations = vec!["chat_completions".to_string()];
+        assert!(validate(&cfg).errors.is_empty());
+        cfg.response_cache.enabled = true;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+        cfg.response_cache.operations = vec!["embeddings".to_string()];
+        assert!(validate(&cfg).errors.is_empty());
+    }
+
+    #[test]
+    fn test_validate_backend_autosuspend() {
+        let mut cfg = SpearletConfig::default();
+        cfg.backend_autosuspend.idle_timeout_secs = 0;
+        assert!(validate(&cfg).errors.is_empty());
+        cfg.backend_autosuspend.enabled = true;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+        cfg.backend_autosuspend.idle_timeout_secs = 300;
+        assert!(validate(&cfg).errors.is_empty());
+    }
+
+    #[test]
+    fn test_validate_moderation() {
+        let mut cfg = SpearletConfig::default();
+        cfg.moderation.enabled = true;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+
+        cfg.llm.backends.push(LlmBackendConfig {
+            name: "guard".to_string(),
+            kind: "local_moderation".to_string(),
+            base_url: "/nonexistent/classifier".to_string(),
+            ops: vec!["moderations".to_string()],
+            ..Default::default()
+        });
+        let r = validate(&cfg);
+        assert!(r.errors.is_empty());
+        assert!(r
+            .warnings
+            .iter()
+            .any(|w| w.contains("classifier not found")));
+
+        cfg.moderation.backend = "other".to_string();
+        assert_eq!(validate(&cfg).errors.len(), 1);
+    }
+
+    #[test]
+    fn test_validate_preemption() {
+        let mut cfg = SpearletConfig::default();
+        cfg.preemption.enabled = true;
+        assert!(validate(&cfg).errors.is_empty());
+
+        cfg.preemption.max_victim_priority = "high".to_string();
+        assert_eq!(validate(&cfg).errors.len(), 1);
+        cfg.preemption.max_victim_priority = "lowest".to_string();
+        cfg.preemption.action = "kill".to_string();
+        assert_eq!(validate(&cfg).errors.len(), 2);
+    }
+
+    #[test]
+    fn test_validate_usage() {
+        use crate::spearlet::config::{UsageBudgetConfig, UsagePriceConfig};
+
+        let mut cfg = SpearletConfig::default();
+        let base = validate(&cfg).warnings.len();
+        cfg.usage.prices.insert(
+            "openai".to_string(),
+            UsagePriceConfig {
+                per_audio_minute: -1.0,
+                ..Default::default()
+            },
+        );
+        cfg.usage
+            .budgets
+            .insert("agent".to_string(), UsageBudgetConfig::default());
+        assert_eq!(validate(&cfg).errors.len(), 1);
+        cfg.usage.prices.clear();
+        cfg.usage.enabled = false;
+        let r = validate(&cfg);
+        assert!(r.errors.is_empty());
+        assert_eq!(r.warnings.len(), base + 1);
+    }
+
+    #[test]
+    fn test_validate_message_passing() {
+        let mut cfg = SpearletConfig::default();
+        cfg.message_passing.enabled = true;
+        assert!(validate(&cfg).errors.is_empty());
+
+        cfg.message_passing.max_queue_messages = 0;
+        assert_eq!(validate(&cfg).errors.len(), 1);
+
+        cfg.message_passing.max_queue_messages = 16;
+        cfg.message_passing.routing.enabled = true;
+        cfg.message_passing.routing.peers = vec!["10.0.0.2:8081".to_string()];
+        let r = validate(&cfg);
+        assert_eq!(r.errors.len(), 1);
+        assert!(r.warnings.iter().any(|w| w.contains("advertise_url")));
+    }
+
+    #[test]
+    fn test_unknown_keys() {
+        let file = serde_json::json!({
+            "spearlet": {
+                "node_name": "edge-1",
+                "htpp": { "addr": "0.0.0.0:8081" },
+                "grpc": { "addr": "0.0.0.0:50052", "enable_tsl": true },
+                "energy": { "model_overrides": { "gpt-4o": "gpt-4o-mini" } },
+                "llm": { "backends": [{ "name": "a", "whatever": 1 }] }
+            },
+            "sms": {}
+        });
+        let mut keys = unknown_keys(&file);
+        keys.sort();
+        assert_eq!(
+            keys,
+            vec!["sms", "spearlet.grpc.enable_tsl", "spearlet.htpp"]
+        );
+    }
+}
@@ -0,0 +1,162 @@
+//! Canary configuration rollouts / 金丝雀配置发布
+//!
+//! With `config_rollout.enabled` the spearlet applies the configuration overlay the SMS
+//! assigns to it in heartbeat responses, live and through the reloader. Overlays may only
+//! change settings that apply without a restart. While an overlay is running, the node
+//! reports in its heartbeats how many executions finished and failed since it was applied,
+//! so the SMS can halt a rollout before it reaches the whole fleet.
+//! 启用 `config_rollout.enabled` 后，spearlet 通过重载器即时应用 SMS 在心跳响应中分配给它的配置
+//! 覆盖。覆盖只能变更无需重启即可生效的设置。覆盖运行期间，节点在心跳中上报自应用以来完成与失败的
+//! 执行次数，使 SMS 能在发布覆盖整个集群之前将其中止。
+
+use std::collections::HashMap;
+
+use parking_lot::Mutex;
+use serde::Serialize;
+use serde_json::Value;
+use tracing::{info, warn};
+
+use crate::proto::sms::ConfigRolloutAssignment;
+use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::node_services::NodeServices;
+
+/// Health info key: rollout whose overlay the node runs / 健康信息键：节点所运行覆盖的发布
+pub const HEALTH_ROLLOUT_ID: &str = "config_rollout.id";
+
+/// Health info key: executions finished since the overlay was applied
+/// 健康信息键：自应用覆盖以来完成的执行次数
+pub const HEALTH_EXECUTIONS: &str = "config_rollout.executions";
+
+/// Health info key: executions failed since the overlay was applied
+/// 健康信息键：自应用覆盖以来失败的执行次数
+pub const HEALTH_FAILURES: &str = "config_rollout.failures";
+
+/// Health info key: why the overlay was rejected / 健康信息键：覆盖被拒绝的原因
+pub const HEALTH_ERROR: &str = "config_rollout.error";
+
+/// Overlay the node last took / 节点最近接收的覆盖
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct RolloutStatus {
+    /// Empty while the node runs its own configuration / 节点使用自身配置时为空
+    pub rollout_id: String,
+    /// Set when the overlay could not be applied / 覆盖无法应用时设置
+    pub error: Option<String>,
+    pub applied_at_ms: i64,
+    /// Completed and failed executions when it was applied / 应用时已完成与失败的执行次数
+    #[serde(skip)]
+    baseline: (u64, u64),
+}
+
+/// Overlay one spearlet took / 单个 spearlet 接收的覆盖
+#[derive(Default)]
+pub struct ConfigRollout {
+    status: Mutex<RolloutStatus>,
+}
+
+impl ConfigRollout {
+    /// Overlay the node last took / 节点最近接收的覆盖
+    pub fn status(&self) -> RolloutStatus {
+        self.status.lock().clone()
+    }
+}
+
+/// Health info sent with each heartbeat / 随每次心跳发送的健康信息
+pub fn health_info(node: &NodeServices, config: &SpearletConfig) -> HashMap<String, String> {
+    let mut info = HashMap::new();
+    let status = node.config_rollout.status();
+    if !config.config_rollout.enabled || status.rollout_id.is_empty() {
+        return info;
+    }
+    info.insert(HEALTH_ROLLOUT_ID.to_string(), status.rollout_id);
+    if let Some(e) = status.error {
+        info.insert(HEALTH_ERROR.to_string(), e);
+    } else if let Some(reloader) = node.live_config.reloader() {
+        let stats = reloader.manager().get_statistics();
+        let (completed, failed) = status.baseline;
+        info.insert(
+            HEALTH_EXECUTIONS.to_string(),
+            stats
+                .completed_executions
+                .saturating_sub(completed)
+                .to_string(),
+        );
+        info.insert(
+            HEALTH_FAILURES.to_string(),
+            stats.failed_executions.saturating_sub(failed).to_string(),
+        );
+    }
+    info
+}
+
+/// Apply the overlay assigned by the SMS when it differs from the one the node took
+/// 当 SMS 分配的覆盖与节点已接收的不同时应用该覆盖
+///
+/// No assignment leaves the node as it is; an empty one returns it to its own configuration.
+/// 未分配时节点保持现状；空的分配使节点恢复自身配置。
+pub async fn offer(
+    node: &NodeServices,
+    config: &SpearletConfig,
+    assignment: Option<ConfigRolloutAssignment>,
+) {
+    let Some(assignment) = assignment else {
+        return;
+    };
+    if !config.config_rollout.enabled
+        || node.config_rollout.status.lock().rollout_id == assignment.rollout_id
+    {
+        return;
+    }
+    let Some(reloader) = node.live_config.reloader() else {
+        return;
+    };
+    let overlay: Result<Option<Value>, String> = match assignment.overlay_json.trim() {
+        "" => Ok(None),
+        json => serde_json::from_str(json)
+            .map(Some)
+            .map_err(|e| format!("invalid overlay: {}", e)),
+    };
+    let result = match overlay {
+        Ok(overlay) => reloader.set_overlay(overlay).await,
+        Err(e) => Err(e),
+    };
+    let stats = reloader.manager().get_statistics();
+    let rollout_id = assignment.rollout_id;
+    match &result {
+        Ok(report) => info!(
+            rollout_id = %rollout_id,
+            applied = ?report.applied,
+            "Configuration overlay applied"
+        ),
+        Err(e) => warn!(rollout_id = %rollout_id, error = %e, "Configuration overlay rejected"),
+    }
+    *node.config_rollout.status.lock() = RolloutStatus {
+        rollout_id,
+        error: result.err(),
+        applied_at_ms: chrono::Utc::now().timestamp_millis(),
+        baseline: (stats.completed_executions, stats.failed_executions),
+    };
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_offer_without_reloader_or_opt_in() {
+        let mut config = SpearletConfig::default();
+        let assignment = ConfigRolloutAssignment {
+            rollout_id: "r1".to_string(),
+            overlay_json: r#"{"energy": {"enabled": true}}"#.to_string(),
+        };
+        let node = NodeServices::default();
+        offer(&node, &config, Some(assignment.clone())).await;
+        assert!(node.config_rollout.status().rollout_id.is_empty());
+        assert!(health_info(&node, &config).is_empty());
+
+        // Opted in but no reloader running: the overlay is left for a later heartbeat
+        // 已启用但重载器未运行：覆盖留待之后的心跳
+        config.config_rollout.enabled = true;
+        offer(&node, &config, Some(assignment)).await;
+        assert!(node.config_rollout.status().rollout_id.is_empty());
+    }
+}
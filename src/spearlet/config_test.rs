@@ -26,6 +26,8 @@ mod tests {
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         assert_eq!(args.config, None);
@@ -119,6 +121,8 @@ mod tests {
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -193,6 +197,8 @@ file = "/tmp/spearlet.log"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -281,6 +287,8 @@ format = "json"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -361,6 +369,8 @@ file = "/tmp/home-spearlet.log"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -408,6 +418,8 @@ file = "/tmp/home-spearlet.log"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -486,6 +498,8 @@ file = "/tmp/home-spearlet.log"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -562,6 +576,8 @@ addr = "127.0.0.1:9000"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
         let result = AppConfig::load_with_cli(&args);
         assert!(result.is_ok());
@@ -637,6 +653,8 @@ addr = "127.0.0.1:9100"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
         let result = AppConfig::load_with_cli(&args);
         assert!(result.is_ok());
@@ -673,6 +691,8 @@ addr = "127.0.0.1:9100"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -699,6 +719,8 @@ addr = "127.0.0.1:9100"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -730,6 +752,8 @@ addr = "127.0.0.1:9100"
             sms_connect_timeout_ms: None,
             sms_connect_retry_ms: None,
             reconnect_total_timeout_ms: None,
+            shutdown_timeout_ms: None,
+            command: None,
         };
 
         let result = AppConfig::load_with_cli(&args);
@@ -772,4 +796,88 @@ transports = ["http"]
             Some("openai_chat")
         );
     }
+
+    #[test]
+    fn test_overlay_file_keeps_unset_keys() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("spearlet.toml");
+        let content = r#"
+[spearlet.grpc]
+addr = "127.0.0.1:60000"
+
+[spearlet.execution]
+runtimes = ["wasm"]
+"#;
+        fs::write(&path, content).unwrap();
+
+        // Stands in for values set by environment variables / 代替环境变量设置的值
+        let mut base = AppConfig::default();
+        base.spearlet.node_name = "env-node".to_string();
+        base.spearlet.execution.max_concurrent_executions = 8;
+
+        let cfg = base.overlay_file(&path).unwrap();
+        assert_eq!(cfg.spearlet.grpc.addr.to_string(), "127.0.0.1:60000");
+        assert_eq!(cfg.spearlet.execution.runtimes, vec!["wasm".to_string()]);
+        assert!(!cfg.spearlet.execution.runtime_enabled("process"));
+        assert_eq!(cfg.spearlet.node_name, "env-node");
+        assert_eq!(cfg.spearlet.execution.max_concurrent_executions, 8);
+
+        let json = dir.path().join("spearlet.json");
+        fs::write(&json, r#"{"spearlet": {"node_name": "json-node"}}"#).unwrap();
+        assert_eq!(
+            AppConfig::from_file(&json).unwrap().spearlet.node_name,
+            "json-node"
+        );
+    }
+
+    #[test]
+    fn test_overlay_yaml_file() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("spearlet.yaml");
+        let content = r#"
+spearlet:
+  grpc:
+    addr: "127.0.0.1:60001"
+  execution:
+    runtimes: [wasm]
+"#;
+        fs::write(&path, content).unwrap();
+
+        let mut base = AppConfig::default();
+        base.spearlet.node_name = "env-node".to_string();
+        let cfg = base.overlay_file(&path).unwrap();
+        assert_eq!(cfg.spearlet.grpc.addr.to_string(), "127.0.0.1:60001");
+        assert_eq!(cfg.spearlet.execution.runtimes, vec!["wasm".to_string()]);
+        assert_eq!(cfg.spearlet.node_name, "env-node");
+
+        // Round-trip: a dumped config reads back the same / 往返：导出的配置读回后相同
+        let yml = dir.path().join("dump.yml");
+        fs::write(&yml, serde_yaml::to_string(&cfg).unwrap()).unwrap();
+        let back = AppConfig::default().overlay_file(&yml).unwrap();
+        assert_eq!(
+            serde_json::to_value(&back).unwrap(),
+            serde_json::to_value(&cfg).unwrap()
+        );
+
+        let bad = dir.path().join("bad.yaml");
+        fs::write(&bad, "spearlet: {grpc: {addr: nope}}\n").unwrap();
+        assert!(AppConfig::from_file(&bad).is_err());
+    }
+
+    #[test]
+    fn test_ollama_host_base_url() {
+        let url = OllamaDiscoveryConfig::base_url_from_ollama_host;
+        assert_eq!(url("0.0.0.0").as_deref(), Some("http://127.0.0.1:11434"));
+        assert_eq!(url(":8080").as_deref(), Some("http://127.0.0.1:8080"));
+        assert_eq!(
+            url("http://gpu-box:11434/").as_deref(),
+            Some("http://gpu-box:11434")
+        );
+        assert_eq!(
+            url("https://ollama.lan").as_deref(),
+            Some("https://ollama.lan")
+        );
+        assert_eq!(url("[::1]:11434").as_deref(), Some("http://[::1]:11434"));
+        assert_eq!(url(" "), None);
+    }
 }
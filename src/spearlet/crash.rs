@@ -0,0 +1,414 @@
+//! Panic capture and crash reporting
+//! panic 捕获与崩溃上报
+//!
+//! A process-wide panic hook turns every panic into a [`CrashReport`]: it records
+//! the component the panicking code ran in (HTTP handler, communication worker,
+//! user stream, WASM worker...), the location, a backtrace and the active trace
+//! context, and writes it to a JSON dump file before anything else happens. Dumps
+//! are kept even when the panic takes the process down, and are forwarded to Sentry
+//! (and as error spans to OTLP) by a background reporter, including dumps left by a
+//! previous run.
+//! 进程级 panic hook 将每次 panic 转为 [`CrashReport`]：记录 panic 所在组件（HTTP 处理函数、
+//! 通信 worker、user stream、WASM worker 等）、位置、回溯与当前链路上下文，并首先写入
+//! JSON 转储文件。即使 panic 导致进程退出，转储也会保留，并由后台上报器转发到 Sentry
+//! （以及作为错误 span 发往 OTLP），包括上一次运行遗留的转储。
+
+use std::cell::Cell;
+use std::future::Future;
+use std::path::{Path, PathBuf};
+use std::sync::{Mutex, OnceLock};
+use std::time::Duration;
+
+use serde::{Deserialize, Serialize};
+use tokio::sync::mpsc;
+
+use crate::spearlet::config::{CrashConfig, SpearletConfig};
+use crate::spearlet::otel;
+
+/// Suffix of dump files already delivered to Sentry / 已投递到 Sentry 的转储文件后缀
+const REPORTED_SUFFIX: &str = ".reported";
+
+tokio::task_local! {
+    static TASK_COMPONENT: &'static str;
+}
+
+thread_local! {
+    static THREAD_COMPONENT: Cell<Option<&'static str>> = const { Cell::new(None) };
+}
+
+/// Tag the current thread with a component name / 为当前线程标记组件名
+pub fn set_thread_component(component: &'static str) {
+    THREAD_COMPONENT.with(|c| c.set(Some(component)));
+}
+
+/// Run a future tagged with a component name / 以组件名标记运行 future
+pub async fn scope<F: Future>(component: &'static str, fut: F) -> F::Output {
+    TASK_COMPONENT.scope(component, fut).await
+}
+
+/// `tokio::spawn` with the task tagged by component / 以组件标记任务的 `tokio::spawn`
+pub fn spawn<F>(component: &'static str, fut: F) -> tokio::task::JoinHandle<F::Output>
+where
+    F: Future + Send + 'static,
+    F::Output: Send + 'static,
+{
+    tokio::spawn(TASK_COMPONENT.scope(component, fut))
+}
+
+/// Component of the running code / 正在运行代码所属的组件
+pub fn current_component() -> &'static str {
+    TASK_COMPONENT
+        .try_with(|c| *c)
+        .ok()
+        .or_else(|| THREAD_COMPONENT.with(|c| c.get()))
+        .unwrap_or("unknown")
+}
+
+/// One captured panic / 一次捕获的 panic
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct CrashReport {
+    pub id: String,
+    pub timestamp: String,
+    pub node_name: String,
+    pub spearlet_version: String,
+    pub component: String,
+    pub thread: String,
+    pub message: String,
+    /// `file:line:column` / `文件:行:列`
+    pub location: Option<String>,
+    pub trace_id: Option<String>,
+    pub backtrace: String,
+}
+
+impl CrashReport {
+    fn capture(info: &std::panic::PanicHookInfo<'_>, node_name: &str) -> Self {
+        let payload = info.payload();
+        let message = payload
+            .downcast_ref::<&str>()
+            .map(|s| s.to_string())
+            .or_else(|| payload.downcast_ref::<String>().cloned())
+            .unwrap_or_else(|| "non-string panic payload".to_string());
+        Self {
+            id: uuid::Uuid::new_v4().simple().to_string(),
+            timestamp: chrono::Utc::now().to_rfc3339(),
+            node_name: node_name.to_string(),
+            spearlet_version: crate::spearlet::build_info::version().to_string(),
+            component: current_component().to_string(),
+            thread: std::thread::current()
+                .name()
+                .unwrap_or("unnamed")
+                .to_string(),
+            message,
+            location: info
+                .location()
+                .map(|l| format!("{}:{}:{}", l.file(), l.line(), l.column())),
+            trace_id: otel::current()
+                .and_then(|c| c.to_traceparent().split('-').nth(1).map(str::to_string)),
+            backtrace: std::backtrace::Backtrace::force_capture().to_string(),
+        }
+    }
+
+    fn file_name(&self) -> String {
+        format!(
+            "crash-{}-{}.json",
+            self.timestamp.replace([':', '.', '+'], "-"),
+            self.id
+        )
+    }
+}
+
+struct HookState {
+    dir: PathBuf,
+    max_dumps: usize,
+    node_name: String,
+    otlp: bool,
+    tx: Mutex<Option<mpsc::UnboundedSender<PathBuf>>>,
+}
+
+static HOOK: OnceLock<HookState> = OnceLock::new();
+
+/// Dump directory for a configuration / 配置对应的转储目录
+pub fn dump_dir(config: &SpearletConfig) -> PathBuf {
+    if config.crash.dump_dir.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("crashes")
+    } else {
+        PathBuf::from(&config.crash.dump_dir)
+    }
+}
+
+/// Install the panic hook; the previous hook still runs afterwards
+/// 安装 panic hook；之前的 hook 之后仍会执行
+pub fn install_panic_hook(config: &SpearletConfig) {
+    if !config.crash.enabled {
+        return;
+    }
+    let state = HookState {
+        dir: dump_dir(config),
+        max_dumps: config.crash.max_dumps.max(1),
+        node_name: config.node_name.clone(),
+        otlp: config.crash.otlp,
+        tx: Mutex::new(None),
+    };
+    if HOOK.set(state).is_err() {
+        return;
+    }
+    let prev = std::panic::take_hook();
+    std::panic::set_hook(Box::new(move |info| {
+        if let Some(state) = HOOK.get() {
+            handle_panic(state, info);
+        }
+        prev(info);
+    }));
+}
+
+fn handle_panic(state: &HookState, info: &std::panic::PanicHookInfo<'_>) {
+    let report = CrashReport::capture(info, &state.node_name);
+    if state.otlp {
+        let parent = otel::current();
+        let mut span = otel::Span::start("panic", otel::SpanKind::Internal, parent.as_ref());
+        span.set_attr("spear.crash.id", report.id.clone());
+        span.set_attr("spear.component", report.component.clone());
+        if let Some(loc) = &report.location {
+            span.set_attr("code.location", loc.clone());
+        }
+        span.set_error(report.message.clone());
+    }
+    match write_dump(&state.dir, &report, state.max_dumps) {
+        Ok(path) => {
+            let tx = state.tx.lock().ok().and_then(|g| g.clone());
+            if let Some(tx) = tx {
+                let _ = tx.send(path);
+            }
+        }
+        Err(e) => eprintln!("spearlet: failed to write crash dump: {}", e),
+    }
+}
+
+/// Write a dump and prune the oldest beyond `max_dumps` / 写入转储并清理超出 `max_dumps` 的最旧转储
+pub fn write_dump(dir: &Path, report: &CrashReport, max_dumps: usize) -> std::io::Result<PathBuf> {
+    std::fs::create_dir_all(dir)?;
+    let path = dir.join(report.file_name());
+    std::fs::write(&path, serde_json::to_vec_pretty(report)?)?;
+    let mut dumps = list_dumps(dir);
+    if dumps.len() > max_dumps {
+        dumps.sort();
+        for old in &dumps[..dumps.len() - max_dumps] {
+            let _ = std::fs::remove_file(old);
+            let _ = std::fs::remove_file(reported_marker(old));
+        }
+    }
+    Ok(path)
+}
+
+fn list_dumps(dir: &Path) -> Vec<PathBuf> {
+    std::fs::read_dir(dir)
+        .map(|rd| {
+            rd.filter_map(|e| e.ok().map(|e| e.path()))
+                .filter(|p| {
+                    p.file_name()
+                        .and_then(|n| n.to_str())
+                        .is_some_and(|n| n.starts_with("crash-") && n.ends_with(".json"))
+                })
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+fn reported_marker(dump: &Path) -> PathBuf {
+    let mut s = dump.as_os_str().to_os_string();
+    s.push(REPORTED_SUFFIX);
+    PathBuf::from(s)
+}
+
+/// Parsed Sentry DSN / 解析后的 Sentry DSN
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SentryDsn {
+    pub public_key: String,
+    pub store_url: String,
+}
+
+impl SentryDsn {
+    /// Parse `scheme://<key>@<host>[/<path>]/<project>` / 解析 `scheme://<key>@<host>[/<path>]/<project>`
+    pub fn parse(dsn: &str) -> Option<Self> {
+        let url = url::Url::parse(dsn.trim()).ok()?;
+        let key = url.username();
+        if key.is_empty() {
+            return None;
+        }
+        let path = url.path().trim_end_matches('/');
+        let (prefix, project) = path.rsplit_once('/')?;
+        if project.is_empty() {
+            return None;
+        }
+        let port = url.port().map(|p| format!(":{}", p)).unwrap_or_default();
+        Some(Self {
+            public_key: key.to_string(),
+            store_url: format!(
+                "{}://{}{}{}/api/{}/store/",
+                url.scheme(),
+                url.host_str()?,
+                port,
+                prefix,
+                project
+            ),
+        })
+    }
+}
+
+/// Sentry event for a crash report / 崩溃报告对应的 Sentry 事件
+pub fn sentry_event(report: &CrashReport, environment: &str) -> serde_json::Value {
+    serde_json::json!({
+        "event_id": report.id,
+        "timestamp": report.timestamp,
+        "platform": "native",
+        "level": "fatal",
+        "logger": "spearlet.panic",
+        "server_name": report.node_name,
+        "release": format!("spearlet@{}", report.spearlet_version),
+        "environment": environment,
+        "message": {"formatted": report.message},
+        "tags": {
+            "component": report.component,
+            "thread": report.thread,
+            "trace_id": report.trace_id,
+        },
+        "extra": {
+            "location": report.location,
+            "backtrace": report.backtrace,
+        },
+    })
+}
+
+/// Start the background reporter that forwards dumps to Sentry
+/// 启动将转储转发到 Sentry 的后台上报器
+///
+/// Dumps written by earlier runs and not yet delivered are sent first.
+/// 先发送之前运行写入但尚未投递的转储。
+pub fn start_reporter(config: &CrashConfig) -> Option<tokio::task::JoinHandle<()>> {
+    let state = HOOK.get()?;
+    let dsn = config
+        .sentry_dsn
+        .as_deref()
+        .filter(|d| !d.trim().is_empty())?;
+    let Some(dsn) = SentryDsn::parse(dsn) else {
+        tracing::warn!("invalid crash.sentry_dsn, crash reports stay local");
+        return None;
+    };
+    let (tx, mut rx) = mpsc::unbounded_channel();
+    if let Ok(mut g) = state.tx.lock() {
+        *g = Some(tx);
+    }
+    let environment = config.environment.clone();
+    let dir = state.dir.clone();
+    Some(spawn("crash-reporter", async move {
+        let client = reqwest::Client::builder()
+            .timeout(Duration::from_secs(10))
+            .build()
+            .unwrap_or_default();
+        let mut pending: Vec<PathBuf> = list_dumps(&dir)
+            .into_iter()
+            .filter(|p| !reported_marker(p).exists())
+            .collect();
+        pending.sort();
+        for path in pending {
+            send_dump(&client, &dsn, &environment, &path).await;
+        }
+        while let Some(path) = rx.recv().await {
+            send_dump(&client, &dsn, &environment, &path).await;
+        }
+    }))
+}
+
+async fn send_dump(client: &reqwest::Client, dsn: &SentryDsn, environment: &str, path: &Path) {
+    let report: CrashReport = match std::fs::read(path)
+        .ok()
+        .and_then(|b| serde_json::from_slice(&b).ok())
+    {
+        Some(r) => r,
+        None => return,
+    };
+    let auth = format!(
+        "Sentry sentry_version=7, sentry_key={}, sentry_client=spearlet/{}",
+        dsn.public_key,
+        crate::spearlet::build_info::version()
+    );
+    let resp = client
+        .post(&dsn.store_url)
+        .header("X-Sentry-Auth", auth)
+        .json(&sentry_event(&report, environment))
+        .send()
+        .await;
+    match resp {
+        Ok(r) if r.status().is_success() => {
+            let _ = std::fs::write(reported_marker(path), b"");
+        }
+        Ok(r) => {
+            tracing::warn!(status = %r.status(), crash_id = %report.id, "Sentry rejected crash report")
+        }
+        Err(e) => tracing::warn!(error = %e, crash_id = %report.id, "Failed to send crash report"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn report(id: &str, ts: &str) -> CrashReport {
+        CrashReport {
+            id: id.to_string(),
+            timestamp: ts.to_string(),
+            node_name: "n1".to_string(),
+            spearlet_version: "0.1.0".to_string(),
+            component: "http".to_string(),
+            thread: "main".to_string(),
+            message: "boom".to_string(),
+            location: Some("src/x.rs:1:1".to_string()),
+            trace_id: None,
+            backtrace: String::new(),
+        }
+    }
+
+    #[test]
+    fn test_sentry_dsn_parse() {
+        let d = SentryDsn::parse("https://abc@o1.ingest.sentry.io/42").unwrap();
+        assert_eq!(d.public_key, "abc");
+        assert_eq!(d.store_url, "https://o1.ingest.sentry.io/api/42/store/");
+        let d = SentryDsn::parse("http://k@sentry.local:9000/base/7").unwrap();
+        assert_eq!(d.store_url, "http://sentry.local:9000/base/api/7/store/");
+        assert!(SentryDsn::parse("https://sentry.io/42").is_none());
+    }
+
+    #[test]
+    fn test_write_dump_prunes_oldest() {
+        let dir = tempfile::tempdir().unwrap();
+        for i in 0..4 {
+            let r = report(&format!("id{}", i), &format!("2026-01-01T00:00:0{}Z", i));
+            write_dump(dir.path(), &r, 2).unwrap();
+        }
+        let mut names: Vec<String> = list_dumps(dir.path())
+            .iter()
+            .map(|p| p.file_name().unwrap().to_string_lossy().to_string())
+            .collect();
+        names.sort();
+        assert_eq!(names.len(), 2);
+        assert!(names[0].ends_with("id2.json"));
+        let back: CrashReport =
+            serde_json::from_slice(&std::fs::read(dir.path().join(&names[1])).unwrap()).unwrap();
+        assert_eq!(back.id, "id3");
+    }
+
+    #[tokio::test]
+    async fn test_component_scopes() {
+        assert_eq!(current_component(), "unknown");
+        assert_eq!(scope("http", async { current_component() }).await, "http");
+        let c = spawn("comm-worker", async { current_component() })
+            .await
+            .unwrap();
+        assert_eq!(c, "comm-worker");
+        let t = std::thread::spawn(|| {
+            set_thread_component("wasm-worker");
+            current_component()
+        });
+        assert_eq!(t.join().unwrap(), "wasm-worker");
+    }
+}
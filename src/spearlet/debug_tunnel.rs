@@ -0,0 +1,495 @@
+//! Debug tunnel to the SMS / 到 SMS 的调试隧道
+//!
+//! With `debug_tunnel.enabled` the spearlet dials a `DebugTunnel` stream to the SMS and keeps
+//! it open, so no port has to be opened on the device. An admin opens a time-limited session
+//! from the SMS; requests sent through it are answered in-process by the admin and monitoring
+//! routes of the HTTP gateway, only under `debug_tunnel.allowed_paths`. They must carry an
+//! `http.auth` credential even when the listeners do not check one, so a node without
+//! credentials refuses them all. Sessions end when they expire, when the admin closes them and
+//! when the tunnel drops. Every session change and request is written to the `audit` target.
+//! 启用 `debug_tunnel.enabled` 后，spearlet 主动建立到 SMS 的 `DebugTunnel` 流并保持开启，设备上无需
+//! 开放端口。管理员从 SMS 开启限时会话；通过会话发送的请求由 HTTP 网关的管理与监控路由在进程内
+//! 应答，且仅限 `debug_tunnel.allowed_paths` 下的路径。即使监听器不校验凭证，这些请求也必须携带
+//! `http.auth` 凭证，因此没有凭证的节点会全部拒绝。会话在过期、被管理员关闭或隧道断开时结束。
+//! 每次会话变化与请求都会写入 `audit` 日志目标。
+
+use std::collections::HashMap;
+use std::sync::{Arc, OnceLock};
+use std::time::Duration;
+
+use axum::body::Body;
+use axum::http::{HeaderName, HeaderValue, Method, Request};
+use axum::Router;
+use tokio::sync::mpsc;
+use tokio::time::{interval, MissedTickBehavior};
+use tokio_stream::wrappers::ReceiverStream;
+use tokio_util::sync::CancellationToken;
+use tonic::transport::Channel;
+use tower::ServiceExt;
+use tracing::{info, warn};
+
+use crate::proto::sms::{
+    debug_tunnel_down, debug_tunnel_up, node_service_client::NodeServiceClient, DebugHttpRequest,
+    DebugHttpResponse, DebugSession, DebugSessionState, DebugTunnelDown, DebugTunnelHello,
+    DebugTunnelUp,
+};
+use crate::spearlet::config::{DebugTunnelConfig, HttpAuthConfig, HttpConfig, SpearletConfig};
+use crate::spearlet::http_auth::auth_middleware;
+use crate::spearlet::http_listeners::{ListenerPlan, RouteGroup};
+use crate::spearlet::node_services::NodeServices;
+
+/// Log target of the audit trail / 审计记录的日志目标
+pub const AUDIT_TARGET: &str = "audit";
+
+const MIN_BACKOFF: Duration = Duration::from_secs(1);
+const MAX_BACKOFF: Duration = Duration::from_secs(60);
+
+/// Routes of one spearlet reachable through its tunnel; set once by the HTTP gateway
+/// 单个 spearlet 可通过其隧道访问的路由；由 HTTP 网关设置一次
+#[derive(Default)]
+pub struct TunnelRoutes {
+    router: OnceLock<Router>,
+}
+
+impl TunnelRoutes {
+    pub(crate) fn set(&self, router: Router) {
+        let _ = self.router.set(router);
+    }
+
+    fn get(&self) -> Option<Router> {
+        self.router.get().cloned()
+    }
+}
+
+/// Admin and monitoring routes with auth, without rate limiting or CORS
+/// 管理与监控路由，含认证，不含限流与 CORS
+pub fn listener_plan(http: &HttpConfig) -> ListenerPlan {
+    ListenerPlan {
+        name: "debug_tunnel",
+        server: http.server.clone(),
+        groups: vec![RouteGroup::Admin, RouteGroup::Metrics],
+        auth: true,
+        rate_limit: false,
+        cors: false,
+    }
+}
+
+/// Tunnel routes that authenticate even with `http.auth.enabled` off
+/// 即使关闭 `http.auth.enabled` 也会认证的隧道路由
+///
+/// No TLS peer vouches for a tunnel request, so the client-certificate subject header is
+/// dropped before auth.
+/// 隧道请求没有 TLS 对端为其担保，因此客户端证书主题请求头会在认证之前被移除。
+pub fn authenticated(router: Router, auth: &HttpAuthConfig) -> Router {
+    // With auth enabled the plan already applies it / 启用认证时计划已应用它
+    let router = if auth.enabled {
+        router
+    } else {
+        router.layer(axum::middleware::from_fn_with_state(
+            Arc::new(auth.clone()),
+            auth_middleware,
+        ))
+    };
+    let Some(subject) = auth.mtls.as_ref().map(|m| m.subject_header.clone()) else {
+        return router;
+    };
+    router.layer(axum::middleware::map_request(
+        move |mut req: Request<Body>| {
+            req.headers_mut().remove(subject.as_str());
+            async move { req }
+        },
+    ))
+}
+
+/// Whether `path` falls under one of the allowed prefixes / `path` 是否位于允许的前缀之下
+pub fn path_allowed(cfg: &DebugTunnelConfig, path: &str) -> bool {
+    let path = path.split('?').next().unwrap_or_default();
+    if path.split('/').any(|seg| seg == "..") {
+        return false;
+    }
+    cfg.allowed_paths
+        .iter()
+        .any(|p| path.starts_with(p.as_str()))
+}
+
+/// Expiry of a session, shortened to `max_session_s` / 会话的过期时间，缩短至 `max_session_s`
+fn capped_expiry(cfg: &DebugTunnelConfig, now_ms: i64, ttl_s: u64) -> i64 {
+    let ttl_s = ttl_s.min(cfg.max_session_s);
+    now_ms + (ttl_s * 1000) as i64
+}
+
+fn now_ms() -> i64 {
+    chrono::Utc::now().timestamp_millis()
+}
+
+fn audit_ended(s: &DebugSession, why: &str) {
+    info!(
+        target: AUDIT_TARGET,
+        session_id = %s.session_id,
+        operator = %s.operator,
+        why,
+        "debug session ended"
+    );
+}
+
+/// Keeps the tunnel to the SMS open / 保持到 SMS 的隧道开启
+pub struct DebugTunnel {
+    config: Arc<SpearletConfig>,
+    sms_channel: Option<Channel>,
+    node: Arc<NodeServices>,
+    cancel: CancellationToken,
+}
+
+impl DebugTunnel {
+    pub fn new(config: Arc<SpearletConfig>, sms_channel: Option<Channel>) -> Self {
+        Self {
+            config,
+            sms_channel,
+            node: NodeServices::new(),
+            cancel: CancellationToken::new(),
+        }
+    }
+
+    /// Answer with the routes of the spearlet owning `node` / 使用持有 `node` 的 spearlet 的路由应答
+    pub fn with_node(mut self, node: Arc<NodeServices>) -> Self {
+        self.node = node;
+        self
+    }
+
+    pub fn shutdown(&self) {
+        self.cancel.cancel();
+    }
+
+    pub fn start(&self) {
+        let cfg = self.config.debug_tunnel.clone();
+        if !cfg.enabled {
+            return;
+        }
+        let Some(channel) = self.sms_channel.clone() else {
+            warn!("debug tunnel enabled but no SMS channel");
+            return;
+        };
+        info!(
+            max_session_s = cfg.max_session_s,
+            allowed_paths = ?cfg.allowed_paths,
+            "Debug tunnel started"
+        );
+        let node_uuid = self.config.compute_node_uuid();
+        let node = self.node.clone();
+        let cancel = self.cancel.clone();
+        tokio::spawn(tunnel_loop(cfg, node_uuid, node, channel, cancel));
+    }
+}
+
+async fn tunnel_loop(
+    cfg: DebugTunnelConfig,
+    node_uuid: String,
+    node: Arc<NodeServices>,
+    channel: Channel,
+    cancel: CancellationToken,
+) {
+    let mut backoff = MIN_BACKOFF;
+    loop {
+        let mut sessions = HashMap::new();
+        let result = tokio::select! {
+            _ = cancel.cancelled() => Ok(()),
+            r = run_tunnel(&cfg, &node_uuid, &node, channel.clone(), &mut sessions) => r,
+        };
+        // Sessions never outlive their tunnel / 会话不会比其隧道存活更久
+        let why = if cancel.is_cancelled() {
+            "shutdown"
+        } else {
+            "tunnel closed"
+        };
+        for s in sessions.values() {
+            audit_ended(s, why);
+        }
+        if cancel.is_cancelled() {
+            return;
+        }
+        match result {
+            Ok(()) => backoff = MIN_BACKOFF,
+            Err(e) => warn!(error = %e, "debug tunnel to SMS failed"),
+        }
+        tokio::select! {
+            _ = cancel.cancelled() => return,
+            _ = tokio::time::sleep(backoff) => {}
+        }
+        backoff = (backoff * 2).min(MAX_BACKOFF);
+    }
+}
+
+async fn run_tunnel(
+    cfg: &DebugTunnelConfig,
+    node_uuid: &str,
+    node: &NodeServices,
+    channel: Channel,
+    sessions: &mut HashMap<String, DebugSession>,
+) -> Result<(), tonic::Status> {
+    let (tx, rx) = mpsc::channel(64);
+    let hello = debug_tunnel_up::Frame::Hello(DebugTunnelHello {
+        uuid: node_uuid.to_string(),
+    });
+    let _ = tx.send(DebugTunnelUp { frame: Some(hello) }).await;
+    let mut client = NodeServiceClient::new(channel);
+    let mut down = client
+        .debug_tunnel(ReceiverStream::new(rx))
+        .await?
+        .into_inner();
+    info!("Debug tunnel to SMS open");
+
+    let mut tick = interval(Duration::from_secs(1));
+    tick.set_missed_tick_behavior(MissedTickBehavior::Delay);
+    loop {
+        tokio::select! {
+            msg = down.message() => {
+                let Some(frame) = msg? else { return Ok(()) };
+                handle_down(cfg, &node.debug_tunnel, frame, sessions, &tx).await;
+            }
+            _ = tick.tick() => {
+                let now = now_ms();
+                let expired: Vec<String> = sessions
+                    .iter()
+                    .filter(|(_, s)| s.expires_at_ms <= now)
+                    .map(|(id, _)| id.clone())
+                    .collect();
+                for id in expired {
+                    if let Some(s) = sessions.remove(&id) {
+                        audit_ended(&s, "expired");
+                        send_state(&tx, &id, false, 0, "expired").await;
+                    }
+                }
+            }
+        }
+    }
+}
+
+async fn send_state(
+    tx: &mpsc::Sender<DebugTunnelUp>,
+    session_id: &str,
+    active: bool,
+    expires_at_ms: i64,
+    message: &str,
+) {
+    let state = debug_tunnel_up::Frame::State(DebugSessionState {
+        session_id: session_id.to_string(),
+        active,
+        expires_at_ms,
+        message: message.to_string(),
+    });
+    let _ = tx.send(DebugTunnelUp { frame: Some(state) }).await;
+}
+
+async fn handle_down(
+    cfg: &DebugTunnelConfig,
+    routes: &TunnelRoutes,
+    frame: DebugTunnelDown,
+    sessions: &mut HashMap<String, DebugSession>,
+    tx: &mpsc::Sender<DebugTunnelUp>,
+) {
+    match frame.frame {
+        Some(debug_tunnel_down::Frame::Open(open)) => {
+            let Some(mut session) = open.session else {
+                return;
+            };
+            if routes.get().is_none() {
+                send_state(tx, &session.session_id, false, 0, "HTTP gateway not ready").await;
+                return;
+            }
+            session.expires_at_ms = capped_expiry(cfg, now_ms(), open.ttl_s);
+            info!(
+                target: AUDIT_TARGET,
+                session_id = %session.session_id,
+                operator = %session.operator,
+                reason = %session.reason,
+                expires_at_ms = session.expires_at_ms,
+                "debug session opened"
+            );
+            let expires_at_ms = session.expires_at_ms;
+            let id = session.session_id.clone();
+            sessions.insert(id.clone(), session);
+            send_state(tx, &id, true, expires_at_ms, "").await;
+        }
+        Some(debug_tunnel_down::Frame::Close(close)) => {
+            if let Some(s) = sessions.remove(&close.session_id) {
+                audit_ended(&s, &format!("closed by {}", close.operator));
+                send_state(tx, &close.session_id, false, 0, "closed").await;
+            }
+        }
+        Some(debug_tunnel_down::Frame::Request(req)) => {
+            let Some(session) = sessions.get(&req.session_id) else {
+                let resp = error_response(&req.request_id, 410, "debug session is not open");
+                let _ = tx.send(response_frame(resp)).await;
+                return;
+            };
+            let rejected = if !path_allowed(cfg, &req.path) {
+                Some((403, "path is not allowed through the debug tunnel"))
+            } else if req.body.len() > cfg.max_body_bytes {
+                Some((413, "request body too large"))
+            } else {
+                None
+            };
+            if let Some((status, message)) = rejected {
+                audit_request(session, &req, status);
+                let resp = error_response(&req.request_id, status, message);
+                let _ = tx.send(response_frame(resp)).await;
+                return;
+            }
+            let Some(router) = routes.get() else {
+                let resp = error_response(&req.request_id, 503, "HTTP gateway not ready");
+                let _ = tx.send(response_frame(resp)).await;
+                return;
+            };
+            let session = session.clone();
+            let max_body_bytes = cfg.max_body_bytes;
+            let tx = tx.clone();
+            // Slow handlers must not hold up the tunnel / 慢处理器不得阻塞隧道
+            tokio::spawn(async move {
+                let resp = dispatch(router, &req, max_body_bytes).await;
+                audit_request(&session, &req, resp.status);
+                let _ = tx.send(response_frame(resp)).await;
+            });
+        }
+        None => {}
+    }
+}
+
+fn audit_request(session: &DebugSession, req: &DebugHttpRequest, status: u32) {
+    info!(
+        target: AUDIT_TARGET,
+        session_id = %session.session_id,
+        operator = %session.operator,
+        request_id = %req.request_id,
+        method = %req.method,
+        path = %req.path,
+        status,
+        "debug request"
+    );
+}
+
+fn response_frame(resp: DebugHttpResponse) -> DebugTunnelUp {
+    DebugTunnelUp {
+        frame: Some(debug_tunnel_up::Frame::Response(resp)),
+    }
+}
+
+fn error_response(request_id: &str, status: u32, message: &str) -> DebugHttpResponse {
+    let body = serde_json::json!({ "error": message });
+    DebugHttpResponse {
+        request_id: request_id.to_string(),
+        status,
+        headers: HashMap::from([("content-type".to_string(), "application/json".to_string())]),
+        body: body.to_string().into_bytes(),
+    }
+}
+
+/// Answer a request with the tunnel routes / 使用隧道路由应答请求
+async fn dispatch(
+    router: Router,
+    req: &DebugHttpRequest,
+    max_body_bytes: usize,
+) -> DebugHttpResponse {
+    let Ok(method) = Method::from_bytes(req.method.as_bytes()) else {
+        return error_response(&req.request_id, 400, "invalid method");
+    };
+    let mut builder = Request::builder().method(method).uri(req.path.as_str());
+    for (k, v) in &req.headers {
+        if let (Ok(k), Ok(v)) = (HeaderName::try_from(k.as_str()), HeaderValue::from_str(v)) {
+            builder = builder.header(k, v);
+        }
+    }
+    let Ok(request) = builder.body(Body::from(req.body.clone())) else {
+        return error_response(&req.request_id, 400, "invalid request");
+    };
+    let resp = match router.oneshot(request).await {
+        Ok(r) => r,
+        Err(e) => match e {},
+    };
+    let status = resp.status().as_u16() as u32;
+    let headers = resp
+        .headers()
+        .iter()
+        .filter_map(|(k, v)| Some((k.to_string(), v.to_str().ok()?.to_string())))
+        .collect();
+    match axum::body::to_bytes(resp.into_body(), max_body_bytes).await {
+        Ok(body) => DebugHttpResponse {
+            request_id: req.request_id.clone(),
+            status,
+            headers,
+            body: body.to_vec(),
+        },
+        Err(_) => error_response(&req.request_id, 502, "response body too large"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::routing::get;
+
+    #[test]
+    fn test_path_allowlist_and_ttl_cap() {
+        let cfg = DebugTunnelConfig::default();
+        assert!(path_allowed(&cfg, "/admin/introspect?section=tasks"));
+        assert!(path_allowed(&cfg, "/monitoring/stats"));
+        assert!(!path_allowed(&cfg, "/objects/abc"));
+        assert!(!path_allowed(&cfg, "/admin/../objects/abc"));
+
+        assert_eq!(capped_expiry(&cfg, 1_000, 60), 61_000);
+        let max = cfg.max_session_s as i64 * 1000;
+        assert_eq!(
+            capped_expiry(&cfg, 1_000, 10 * cfg.max_session_s),
+            1_000 + max
+        );
+    }
+
+    #[tokio::test]
+    async fn test_dispatch_through_router() {
+        let router = Router::new().route("/monitoring/health", get(|| async { "ok" }));
+        let req = DebugHttpRequest {
+            request_id: "r1".to_string(),
+            method: "GET".to_string(),
+            path: "/monitoring/health".to_string(),
+            ..Default::default()
+        };
+        let resp = dispatch(router.clone(), &req, 1024).await;
+        assert_eq!(resp.request_id, "r1");
+        assert_eq!(resp.status, 200);
+        assert_eq!(resp.body, b"ok");
+
+        let resp = dispatch(router, &req, 1).await;
+        assert_eq!(resp.status, 502);
+    }
+
+    #[tokio::test]
+    async fn test_tunnel_routes_always_authenticate() {
+        use crate::spearlet::config::{HttpApiKey, HttpAuthRole, HttpMtlsAuthConfig};
+
+        let router = Router::new().route("/admin/introspect", get(|| async { "ok" }));
+        let mut req = DebugHttpRequest {
+            method: "GET".to_string(),
+            path: "/admin/introspect".to_string(),
+            ..Default::default()
+        };
+        // Auth off on the listeners and no credentials: nothing gets through
+        // 监听器关闭认证且没有凭证：全部拒绝
+        let mut auth = HttpAuthConfig::default();
+        let open = authenticated(router.clone(), &auth);
+        assert_eq!(dispatch(open, &req, 1024).await.status, 401);
+
+        auth.api_keys.push(HttpApiKey {
+            key: "k".to_string(),
+            role: HttpAuthRole::Admin,
+        });
+        let mut mtls = HttpMtlsAuthConfig::default();
+        mtls.subjects
+            .insert("CN=ops".to_string(), HttpAuthRole::Admin);
+        let subject_header = mtls.subject_header.clone();
+        auth.mtls = Some(mtls);
+        let routes = authenticated(router, &auth);
+        req.headers.insert(subject_header, "CN=ops".to_string());
+        assert_eq!(dispatch(routes.clone(), &req, 1024).await.status, 401);
+        req.headers.insert("x-api-key".to_string(), "k".to_string());
+        assert_eq!(dispatch(routes, &req, 1024).await.status, 200);
+    }
+}
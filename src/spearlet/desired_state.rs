@@ -0,0 +1,701 @@
+//! Declarative desired state / 声明式期望状态
+//!
+//! With `desired_state.enabled` the spearlet reads a spec of workloads, schedules, endpoint
+//! maps and quotas from a git repository, an HTTP API or a local file, and reconciles the
+//! node to it every `poll_interval_s`. Each pass first compares the spec with what is
+//! running and records the differences as drift; with `apply` it then fixes them. The last
+//! result is served as the `desired_state` section of `GET /admin/introspect`.
+//! 启用 `desired_state.enabled` 后，spearlet 从 git 仓库、HTTP API 或本地文件读取包含工作负载、
+//! 定时任务、端点映射与配额的规格，并每隔 `poll_interval_s` 将节点协调到该规格。每轮先将规格与
+//! 实际运行状态比较并把差异记录为漂移；启用 `apply` 时再修正这些差异。最近一次结果作为
+//! `GET /admin/introspect` 的 `desired_state` 分节提供。
+
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::path::Path;
+use std::sync::Arc;
+use std::time::Duration;
+
+use parking_lot::RwLock;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use tokio::task::JoinHandle;
+use tokio::time::{interval, MissedTickBehavior};
+use tokio_util::sync::CancellationToken;
+use tracing::{info, warn};
+
+use crate::spearlet::config::{DesiredStateConfig, SpearletConfig};
+use crate::spearlet::execution::manager::TaskExecutionManager;
+use crate::spearlet::execution::{InvokeContext, InvokeOptions, TaskRef};
+use crate::spearlet::reload::WorkloadFile;
+
+/// Task config key marking tasks created from the desired state
+/// 标记由期望状态创建的任务的任务配置键
+pub const TASK_CONFIG_DESIRED_STATE: &str = "desired_state.source";
+
+/// Invocation metadata key naming the schedule that fired / 标明触发调用的定时任务的元数据键
+pub const METADATA_SCHEDULE: &str = "desired_state.schedule";
+
+const GIT_TIMEOUT: Duration = Duration::from_secs(120);
+const HTTP_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Run a workload periodically / 周期性运行工作负载
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct ScheduleSpec {
+    pub name: String,
+    /// Task id or name / 任务 ID 或名称
+    pub workload: String,
+    pub every_s: u64,
+    /// Entry function; empty for the default / 入口函数；为空时使用默认值
+    pub function: String,
+    /// Text input of each run / 每次运行的文本输入
+    pub input: String,
+}
+
+/// Map `POST /v1/endpoints/{path}` to a workload / 将 `POST /v1/endpoints/{path}` 映射到工作负载
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct EndpointSpec {
+    pub path: String,
+    /// Task id or name / 任务 ID 或名称
+    pub workload: String,
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct QuotaSpec {
+    pub max_concurrent_executions: Option<usize>,
+}
+
+/// What the node should run / 节点应当运行的内容
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct DesiredState {
+    pub workloads: Vec<WorkloadFile>,
+    pub schedules: Vec<ScheduleSpec>,
+    pub endpoints: Vec<EndpointSpec>,
+    pub quotas: QuotaSpec,
+}
+
+/// One difference between the spec and the node / 规格与节点之间的一处差异
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Drift {
+    /// `workload`, `schedule`, `endpoint` or `quota` / `workload`、`schedule`、`endpoint` 或 `quota`
+    pub kind: &'static str,
+    pub name: String,
+    /// `missing`, `changed`, `unexpected` or the differing values
+    /// `missing`、`changed`、`unexpected` 或不同的取值
+    pub detail: String,
+}
+
+impl Drift {
+    fn new(kind: &'static str, name: &str, detail: impl Into<String>) -> Self {
+        Self {
+            kind,
+            name: name.to_string(),
+            detail: detail.into(),
+        }
+    }
+}
+
+/// Result of the last pass / 最近一轮的结果
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct SyncStatus {
+    pub source: String,
+    /// Commit, ETag or content hash of the spec / 规格的提交、ETag 或内容哈希
+    pub revision: String,
+    pub synced_at_ms: i64,
+    /// Drift found before applying / 应用前发现的漂移
+    pub drift: Vec<Drift>,
+    pub applied: bool,
+    pub in_sync: bool,
+    pub errors: Vec<String>,
+}
+
+/// Last pass and endpoint map of one spearlet / 单个 spearlet 的最近一轮结果与端点映射
+#[derive(Default)]
+pub struct DesiredStateSync {
+    status: RwLock<Option<SyncStatus>>,
+    endpoints: RwLock<BTreeMap<String, String>>,
+}
+
+impl DesiredStateSync {
+    /// Result of the last pass, if the reconciler ran / 协调器运行过时返回最近一轮的结果
+    pub fn status(&self) -> Option<SyncStatus> {
+        self.status.read().clone()
+    }
+
+    /// Workload mapped to an endpoint path / 端点路径映射到的工作负载
+    pub fn endpoint(&self, path: &str) -> Option<String> {
+        self.endpoints.read().get(&endpoint_key(path)).cloned()
+    }
+}
+
+fn endpoint_key(path: &str) -> String {
+    path.trim_matches('/').to_string()
+}
+
+/// Parse and check a spec; `json` selects JSON over TOML / 解析并检查规格；`json` 选择 JSON 而非 TOML
+pub fn parse_spec(content: &str, json: bool) -> Result<DesiredState, String> {
+    let spec: DesiredState = if json {
+        serde_json::from_str(content).map_err(|e| e.to_string())?
+    } else {
+        toml::from_str(content).map_err(|e| e.to_string())?
+    };
+    let mut ids = BTreeSet::new();
+    for w in &spec.workloads {
+        if w.name.trim().is_empty() {
+            return Err("workloads: name is required".to_string());
+        }
+        if w.executable_type().is_none() {
+            return Err(format!(
+                "workload {}: unknown runtime {:?}",
+                w.name, w.runtime
+            ));
+        }
+        if !ids.insert(w.task_id()) {
+            return Err(format!("workload {}: duplicate task id", w.task_id()));
+        }
+    }
+    let mut names = BTreeSet::new();
+    for s in &spec.schedules {
+        if s.name.trim().is_empty() || s.workload.trim().is_empty() {
+            return Err("schedules: name and workload are required".to_string());
+        }
+        if s.every_s == 0 {
+            return Err(format!("schedule {}: every_s must be positive", s.name));
+        }
+        if !names.insert(s.name.as_str()) {
+            return Err(format!("schedule {}: duplicate name", s.name));
+        }
+    }
+    let mut paths = BTreeSet::new();
+    for e in &spec.endpoints {
+        let key = endpoint_key(&e.path);
+        if key.is_empty() || e.workload.trim().is_empty() {
+            return Err("endpoints: path and workload are required".to_string());
+        }
+        if !paths.insert(key) {
+            return Err(format!("endpoint {}: duplicate path", e.path));
+        }
+    }
+    Ok(spec)
+}
+
+fn content_hash(content: &[u8]) -> String {
+    let digest = Sha256::digest(content);
+    digest[..8].iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// `{node_uuid}` and `{node_name}` replaced / 替换 `{node_uuid}` 与 `{node_name}`
+fn expand(template: &str, config: &SpearletConfig) -> String {
+    template
+        .replace("{node_uuid}", &config.compute_node_uuid())
+        .replace("{node_name}", &config.node_name)
+}
+
+/// Spec text as (revision, content) / 规格文本，返回（修订，内容）
+async fn fetch(config: &SpearletConfig) -> Result<(String, String), String> {
+    let cfg = &config.desired_state;
+    match cfg.source.as_str() {
+        "file" => {
+            let content = tokio::fs::read_to_string(expand(&cfg.url, config))
+                .await
+                .map_err(|e| format!("read {}: {}", cfg.url, e))?;
+            Ok((content_hash(content.as_bytes()), content))
+        }
+        "http" => fetch_http(cfg, &expand(&cfg.url, config)).await,
+        "git" => {
+            let checkout = Path::new(&config.storage.data_dir).join("desired-state");
+            let revision = git_sync(cfg, &checkout).await?;
+            let file = checkout.join(expand(&cfg.path, config));
+            let content = tokio::fs::read_to_string(&file)
+                .await
+                .map_err(|e| format!("read {}: {}", file.display(), e))?;
+            Ok((revision, content))
+        }
+        other => Err(format!("unknown source {:?}", other)),
+    }
+}
+
+async fn fetch_http(cfg: &DesiredStateConfig, url: &str) -> Result<(String, String), String> {
+    let client = reqwest::Client::builder()
+        .timeout(HTTP_TIMEOUT)
+        .build()
+        .map_err(|e| e.to_string())?;
+    let mut req = client.get(url);
+    if !cfg.token_env.is_empty() {
+        if let Ok(token) = std::env::var(&cfg.token_env) {
+            req = req.bearer_auth(token);
+        }
+    }
+    let resp = req
+        .send()
+        .await
+        .map_err(|e| format!("GET {}: {}", url, e))?;
+    if !resp.status().is_success() {
+        return Err(format!("GET {}: {}", url, resp.status()));
+    }
+    let etag = resp
+        .headers()
+        .get(reqwest::header::ETAG)
+        .and_then(|v| v.to_str().ok())
+        .map(|v| v.trim_matches('"').to_string());
+    let content = resp.text().await.map_err(|e| e.to_string())?;
+    let revision = etag.unwrap_or_else(|| content_hash(content.as_bytes()));
+    Ok((revision, content))
+}
+
+async fn git(args: &[&str]) -> Result<String, String> {
+    let run = tokio::process::Command::new("git")
+        .args(args)
+        .env("GIT_TERMINAL_PROMPT", "0")
+        .kill_on_drop(true)
+        .output();
+    let out = tokio::time::timeout(GIT_TIMEOUT, run)
+        .await
+        .map_err(|_| format!("git {}: timed out", args[0]))?
+        .map_err(|e| format!("git: {}", e))?;
+    if !out.status.success() {
+        return Err(format!(
+            "git {}: {}",
+            args[0],
+            String::from_utf8_lossy(&out.stderr).trim()
+        ));
+    }
+    Ok(String::from_utf8_lossy(&out.stdout).trim().to_string())
+}
+
+/// Bring the shallow checkout to `git_ref`; returns the commit / 将浅克隆更新到 `git_ref`；返回提交
+async fn git_sync(cfg: &DesiredStateConfig, checkout: &Path) -> Result<String, String> {
+    let dir = checkout.display().to_string();
+    if checkout.join(".git").is_dir() {
+        git(&["-C", &dir, "fetch", "--depth", "1", "origin", &cfg.git_ref]).await?;
+        git(&["-C", &dir, "reset", "--hard", "FETCH_HEAD"]).await?;
+    } else {
+        if let Some(parent) = checkout.parent() {
+            let _ = tokio::fs::create_dir_all(parent).await;
+        }
+        let _ = tokio::fs::remove_dir_all(checkout).await;
+        git(&[
+            "clone",
+            "--depth",
+            "1",
+            "--branch",
+            &cfg.git_ref,
+            &cfg.url,
+            &dir,
+        ])
+        .await?;
+    }
+    git(&["-C", &dir, "rev-parse", "HEAD"]).await
+}
+
+struct RunningSchedule {
+    spec: ScheduleSpec,
+    handle: JoinHandle<()>,
+}
+
+/// What this reconciler applied / 本协调器已应用的内容
+#[derive(Default)]
+struct Applied {
+    workloads: BTreeMap<String, WorkloadFile>,
+    schedules: BTreeMap<String, RunningSchedule>,
+}
+
+impl Applied {
+    fn stop_schedules(&mut self) {
+        for (_, s) in std::mem::take(&mut self.schedules) {
+            s.handle.abort();
+        }
+    }
+}
+
+/// Differences between `spec` and the node / `spec` 与节点之间的差异
+fn diff(spec: &DesiredState, applied: &Applied, mgr: &TaskExecutionManager) -> Vec<Drift> {
+    let mut out = Vec::new();
+
+    let wanted: BTreeMap<&str, &WorkloadFile> =
+        spec.workloads.iter().map(|w| (w.task_id(), w)).collect();
+    for (id, w) in &wanted {
+        if mgr.get_task_by_id(id).is_none() {
+            out.push(Drift::new("workload", id, "missing"));
+        } else if applied.workloads.get(*id) != Some(*w) {
+            out.push(Drift::new("workload", id, "changed"));
+        }
+    }
+    for id in applied.workloads.keys() {
+        if !wanted.contains_key(id.as_str()) && mgr.get_task_by_id(id).is_some() {
+            out.push(Drift::new("workload", id, "unexpected"));
+        }
+    }
+
+    let wanted: BTreeMap<&str, &ScheduleSpec> = spec
+        .schedules
+        .iter()
+        .map(|s| (s.name.as_str(), s))
+        .collect();
+    for (name, s) in &wanted {
+        match applied.schedules.get(*name) {
+            Some(r) if r.handle.is_finished() => out.push(Drift::new("schedule", name, "missing")),
+            Some(r) if r.spec != **s => out.push(Drift::new("schedule", name, "changed")),
+            Some(_) => {}
+            None => out.push(Drift::new("schedule", name, "missing")),
+        }
+    }
+    for name in applied.schedules.keys() {
+        if !wanted.contains_key(name.as_str()) {
+            out.push(Drift::new("schedule", name, "unexpected"));
+        }
+    }
+
+    let current = mgr.node().desired_state.endpoints.read().clone();
+    let wanted: BTreeMap<String, &str> = spec
+        .endpoints
+        .iter()
+        .map(|e| (endpoint_key(&e.path), e.workload.as_str()))
+        .collect();
+    for (path, workload) in &wanted {
+        match current.get(path) {
+            Some(w) if w == workload => {}
+            Some(_) => out.push(Drift::new("endpoint", path, "changed")),
+            None => out.push(Drift::new("endpoint", path, "missing")),
+        }
+    }
+    for path in current.keys() {
+        if !wanted.contains_key(path) {
+            out.push(Drift::new("endpoint", path, "unexpected"));
+        }
+    }
+
+    if let Some(want) = spec.quotas.max_concurrent_executions {
+        let have = mgr.max_concurrent_executions();
+        if have != want {
+            out.push(Drift::new(
+                "quota",
+                "max_concurrent_executions",
+                format!("{} != {}", have, want),
+            ));
+        }
+    }
+    out
+}
+
+/// Fix `drift`; returns the errors / 修正 `drift`；返回错误
+async fn apply(
+    spec: &DesiredState,
+    drift: &[Drift],
+    source: &str,
+    applied: &mut Applied,
+    mgr: &Arc<TaskExecutionManager>,
+) -> Vec<String> {
+    let mut errors = Vec::new();
+    for d in drift {
+        match d.kind {
+            "workload" => {
+                if d.detail != "missing" {
+                    mgr.remove_task(&d.name, "desired state changed").await;
+                    applied.workloads.remove(&d.name);
+                }
+                let Some(w) = spec.workloads.iter().find(|w| w.task_id() == d.name) else {
+                    continue;
+                };
+                let mut task = w.to_sms_task(Path::new(source));
+                task.config
+                    .insert(TASK_CONFIG_DESIRED_STATE.to_string(), source.to_string());
+                let registered = match mgr.ensure_artifact_from_sms(&task).await {
+                    Ok(artifact) => mgr.ensure_task_from_sms(&task, &artifact).await,
+                    Err(e) => Err(e),
+                };
+                match registered {
+                    Ok(_) => {
+                        applied.workloads.insert(d.name.clone(), w.clone());
+                    }
+                    Err(e) => errors.push(format!("workload {}: {}", d.name, e)),
+                }
+            }
+            "schedule" => {
+                if let Some(old) = applied.schedules.remove(&d.name) {
+                    old.handle.abort();
+                }
+                if let Some(s) = spec.schedules.iter().find(|s| s.name == d.name) {
+                    let handle = spawn_schedule(s.clone(), mgr.clone());
+                    let spec = s.clone();
+                    applied
+                        .schedules
+                        .insert(d.name.clone(), RunningSchedule { spec, handle });
+                }
+            }
+            "endpoint" => {
+                let map = spec
+                    .endpoints
+                    .iter()
+                    .map(|e| (endpoint_key(&e.path), e.workload.clone()))
+                    .collect();
+                *mgr.node().desired_state.endpoints.write() = map;
+            }
+            "quota" => {
+                if let Some(n) = spec.quotas.max_concurrent_executions {
+                    mgr.set_max_concurrent_executions(n);
+                }
+            }
+            _ => {}
+        }
+    }
+    errors
+}
+
+fn spawn_schedule(s: ScheduleSpec, mgr: Arc<TaskExecutionManager>) -> JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut tick = interval(Duration::from_secs(s.every_s));
+        tick.set_missed_tick_behavior(MissedTickBehavior::Skip);
+        // The first tick fires at once; the first run is one period away
+        // 首次触发是立即的；第一次运行在一个周期之后
+        tick.tick().await;
+        loop {
+            tick.tick().await;
+            let task = mgr
+                .find_task(&s.workload)
+                .map(|t| TaskRef::Id(t.id.clone()))
+                .unwrap_or_else(|| TaskRef::Id(s.workload.clone()));
+            let options = InvokeOptions {
+                function_name: Some(s.function.clone()).filter(|f| !f.is_empty()),
+                content_type: Some("text/plain".to_string()),
+                metadata: HashMap::from([(METADATA_SCHEDULE.to_string(), s.name.clone())]),
+                ..Default::default()
+            };
+            let ctx = InvokeContext::new();
+            let input = s.input.clone().into_bytes();
+            match mgr.invoke(&ctx, task, input, options).await {
+                Ok(r) => {
+                    if let Some(e) = r.error {
+                        warn!(schedule = %s.name, error = %e, "Scheduled run failed");
+                    }
+                }
+                Err(e) => warn!(schedule = %s.name, error = %e, "Scheduled run failed"),
+            }
+        }
+    })
+}
+
+/// Compare, then fix when `apply_changes`; the spec is already parsed
+/// 比较，`apply_changes` 时再修正；规格已解析
+async fn reconcile(
+    spec: &DesiredState,
+    source: &str,
+    apply_changes: bool,
+    applied: &mut Applied,
+    mgr: &Arc<TaskExecutionManager>,
+) -> (Vec<Drift>, Vec<String>) {
+    let drift = diff(spec, applied, mgr);
+    if !apply_changes || drift.is_empty() {
+        return (drift, Vec::new());
+    }
+    let errors = apply(spec, &drift, source, applied, mgr).await;
+    (drift, errors)
+}
+
+/// Keeps the node reconciled to its spec / 使节点与其规格保持一致
+pub struct DesiredStateReconciler {
+    config: Arc<SpearletConfig>,
+    manager: Arc<TaskExecutionManager>,
+    cancel: CancellationToken,
+}
+
+impl DesiredStateReconciler {
+    pub fn new(config: Arc<SpearletConfig>, manager: Arc<TaskExecutionManager>) -> Self {
+        Self {
+            config,
+            manager,
+            cancel: CancellationToken::new(),
+        }
+    }
+
+    pub fn shutdown(&self) {
+        self.cancel.cancel();
+    }
+
+    pub fn start(&self) {
+        let cfg = &self.config.desired_state;
+        if !cfg.enabled {
+            return;
+        }
+        info!(
+            source = %cfg.source,
+            url = %cfg.url,
+            apply = cfg.apply,
+            "Desired state reconciler started"
+        );
+        let config = self.config.clone();
+        let manager = self.manager.clone();
+        let cancel = self.cancel.clone();
+        tokio::spawn(async move {
+            let mut applied = Applied::default();
+            tokio::select! {
+                _ = cancel.cancelled() => {}
+                _ = sync_loop(&config, &manager, &mut applied) => {}
+            }
+            applied.stop_schedules();
+        });
+    }
+}
+
+async fn sync_loop(
+    config: &SpearletConfig,
+    manager: &Arc<TaskExecutionManager>,
+    applied: &mut Applied,
+) {
+    let cfg = &config.desired_state;
+    let source = match cfg.source.as_str() {
+        "git" => format!("{}#{}:{}", cfg.url, cfg.git_ref, expand(&cfg.path, config)),
+        _ => expand(&cfg.url, config),
+    };
+    let json = Path::new(if cfg.source == "git" {
+        &cfg.path
+    } else {
+        &cfg.url
+    })
+    .extension()
+    .is_some_and(|e| e == "json");
+    let mut tick = interval(Duration::from_secs(cfg.poll_interval_s.max(1)));
+    tick.set_missed_tick_behavior(MissedTickBehavior::Delay);
+    let mut last_revision = String::new();
+    loop {
+        tick.tick().await;
+        let mut status = SyncStatus {
+            source: source.clone(),
+            synced_at_ms: chrono::Utc::now().timestamp_millis(),
+            ..Default::default()
+        };
+        // A spec that cannot be read leaves the node as it is / 无法读取规格时节点保持原状
+        let spec = match fetch(config).await {
+            Ok((revision, content)) => {
+                status.revision = revision;
+                parse_spec(&content, json).map_err(|e| format!("spec: {}", e))
+            }
+            Err(e) => Err(e),
+        };
+        match spec {
+            Ok(spec) => {
+                let (drift, errors) = reconcile(&spec, &source, cfg.apply, applied, manager).await;
+                status.applied = cfg.apply && !drift.is_empty();
+                status.in_sync = drift.is_empty() || (cfg.apply && errors.is_empty());
+                status.drift = drift;
+                status.errors = errors;
+            }
+            Err(e) => status.errors.push(e),
+        }
+        log_status(&status, &last_revision);
+        last_revision = status.revision.clone();
+        *manager.node().desired_state.status.write() = Some(status);
+    }
+}
+
+fn log_status(status: &SyncStatus, last_revision: &str) {
+    if !status.revision.is_empty() && status.revision != last_revision {
+        info!(revision = %status.revision, "Desired state revision");
+    }
+    if !status.drift.is_empty() {
+        let drift: Vec<String> = status
+            .drift
+            .iter()
+            .map(|d| format!("{} {}: {}", d.kind, d.name, d.detail))
+            .collect();
+        warn!(
+            revision = %status.revision,
+            applied = status.applied,
+            drift = ?drift,
+            "Desired state drift"
+        );
+    }
+    for e in &status.errors {
+        warn!("Desired state: {}", e);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::manager::TaskExecutionManagerConfig;
+    use crate::spearlet::execution::runtime::RuntimeManager;
+
+    const SPEC: &str = r#"
+[quotas]
+max_concurrent_executions = 3
+
+[[workloads]]
+name = "echo"
+uri = "/bin/echo"
+
+[[schedules]]
+name = "nightly"
+workload = "echo"
+every_s = 3600
+
+[[endpoints]]
+path = "/hooks/echo"
+workload = "echo"
+"#;
+
+    #[test]
+    fn test_parse_spec() {
+        let spec = parse_spec(SPEC, false).unwrap();
+        assert_eq!(spec.workloads[0].task_id(), "echo");
+        assert_eq!(spec.quotas.max_concurrent_executions, Some(3));
+
+        let json = serde_json::to_string(&spec).unwrap();
+        assert_eq!(parse_spec(&json, true).unwrap(), spec);
+
+        let bad = SPEC.replace("every_s = 3600", "every_s = 0");
+        assert!(parse_spec(&bad, false).unwrap_err().contains("every_s"));
+        let dup = format!(
+            "{}\n[[endpoints]]\npath = \"hooks/echo/\"\nworkload = \"x\"\n",
+            SPEC
+        );
+        assert!(parse_spec(&dup, false).unwrap_err().contains("duplicate"));
+    }
+
+    #[tokio::test]
+    async fn test_reconcile_reports_then_fixes_drift() {
+        let cfg = SpearletConfig::default();
+        let manager = TaskExecutionManager::new(
+            TaskExecutionManagerConfig::default(),
+            Arc::new(RuntimeManager::new()),
+            Arc::new(cfg),
+            None,
+        )
+        .await
+        .unwrap();
+        let spec = parse_spec(SPEC, false).unwrap();
+        let mut applied = Applied::default();
+
+        // Report only / 仅报告
+        let (drift, _) = reconcile(&spec, "test", false, &mut applied, &manager).await;
+        let kinds: BTreeSet<&str> = drift.iter().map(|d| d.kind).collect();
+        assert_eq!(kinds.len(), 4, "{:?}", drift);
+        assert!(manager.get_task_by_id("echo").is_none());
+
+        let (_, errors) = reconcile(&spec, "test", true, &mut applied, &manager).await;
+        assert!(errors.is_empty(), "{:?}", errors);
+        assert!(manager.get_task_by_id("echo").is_some());
+        let desired = &manager.node().desired_state;
+        assert_eq!(desired.endpoint("hooks/echo").as_deref(), Some("echo"));
+        assert_eq!(manager.max_concurrent_executions(), 3);
+        let (drift, _) = reconcile(&spec, "test", true, &mut applied, &manager).await;
+        assert!(drift.is_empty(), "{:?}", drift);
+
+        // Removed from the spec / 从规格中移除
+        let (drift, _) = reconcile(
+            &DesiredState::default(),
+            "test",
+            true,
+            &mut applied,
+            &manager,
+        )
+        .await;
+        assert_eq!(drift.len(), 3, "{:?}", drift);
+        assert!(manager.get_task_by_id("echo").is_none());
+        assert!(desired.endpoint("hooks/echo").is_none());
+        assert!(applied.schedules.is_empty());
+    }
+}
@@ -0,0 +1,346 @@
+//! Device profile of the spearlet host
+//! spearlet 主机的设备描述
+//!
+//! The profile maps logical device names to host devices, so workloads and device-bound
+//! hostcalls do not hardcode host device names. It is loaded from `[spearlet.devices]`,
+//! returned by the `device_profile` hostcall and exported to process workloads.
+//! 设备描述将逻辑设备名映射到主机设备，工作负载与设备相关的 hostcall 无需写死主机设备名。
+//! 它从 `[spearlet.devices]` 加载，通过 `device_profile` hostcall 返回，并导出给进程工作负载。
+
+use std::collections::HashMap;
+
+use crate::spearlet::config::{
+    AudioDeviceConfig, CameraDeviceConfig, DeviceProfileConfig, DisplayDeviceConfig,
+    GpioLineConfig, GpuDeviceConfig, SpearletConfig,
+};
+
+/// Environment variable holding the profile JSON / 保存设备描述 JSON 的环境变量
+pub const ENV_DEVICE_PROFILE: &str = "SPEAR_DEVICE_PROFILE";
+
+/// Profile sections, as named in config and in hostcall queries
+/// 设备描述的分区，与配置及 hostcall 查询中的名称一致
+pub const SECTIONS: &[&str] = &[
+    "audio_inputs",
+    "audio_outputs",
+    "displays",
+    "cameras",
+    "gpio",
+    "gpus",
+];
+
+/// Entry that can be selected by logical name / 可按逻辑名称选择的条目
+pub trait ProfileEntry {
+    fn name(&self) -> &str;
+    fn is_default(&self) -> bool {
+        false
+    }
+}
+
+impl ProfileEntry for AudioDeviceConfig {
+    fn name(&self) -> &str {
+        &self.name
+    }
+    fn is_default(&self) -> bool {
+        self.default
+    }
+}
+
+impl ProfileEntry for DisplayDeviceConfig {
+    fn name(&self) -> &str {
+        &self.name
+    }
+    fn is_default(&self) -> bool {
+        self.default
+    }
+}
+
+impl ProfileEntry for CameraDeviceConfig {
+    fn name(&self) -> &str {
+        &self.name
+    }
+    fn is_default(&self) -> bool {
+        self.default
+    }
+}
+
+impl ProfileEntry for GpioLineConfig {
+    fn name(&self) -> &str {
+        &self.name
+    }
+}
+
+impl ProfileEntry for GpuDeviceConfig {
+    fn name(&self) -> &str {
+        &self.name
+    }
+}
+
+/// Select an entry by logical name, or the default entry when `requested` is `None`
+/// 按逻辑名称选择条目；`requested` 为 `None` 时选择默认条目
+///
+/// The default is the entry marked `default`, else the first one.
+/// 默认条目为标记 `default` 的条目，否则为第一个条目。
+pub fn select<'a, T: ProfileEntry>(entries: &'a [T], requested: Option<&str>) -> Option<&'a T> {
+    match requested {
+        Some(name) => entries.iter().find(|e| e.name() == name),
+        None => entries
+            .iter()
+            .find(|e| e.is_default())
+            .or_else(|| entries.first()),
+    }
+}
+
+/// Device profile of the spearlet host / spearlet 主机的设备描述
+#[derive(Debug, Clone, Default)]
+pub struct DeviceProfile {
+    config: DeviceProfileConfig,
+}
+
+impl DeviceProfile {
+    pub fn new(config: DeviceProfileConfig) -> Self {
+        Self { config }
+    }
+
+    /// Profile of the spearlet, empty without config / spearlet 的设备描述，无配置时为空
+    pub fn from_config(config: Option<&SpearletConfig>) -> Self {
+        config
+            .map(|c| Self::new(c.devices.clone()))
+            .unwrap_or_default()
+    }
+
+    pub fn config(&self) -> &DeviceProfileConfig {
+        &self.config
+    }
+
+    /// Audio input for a requested name / 按请求名称解析音频输入
+    ///
+    /// `None` selects the default input. A name that is not in the profile is treated as
+    /// a host device name, so existing workloads keep working.
+    /// `None` 选择默认输入。不在描述中的名称按主机设备名处理，已有工作负载不受影响。
+    pub fn audio_input(&self, requested: Option<&str>) -> Option<&AudioDeviceConfig> {
+        select(&self.config.audio_inputs, requested)
+    }
+
+    pub fn audio_output(&self, requested: Option<&str>) -> Option<&AudioDeviceConfig> {
+        select(&self.config.audio_outputs, requested)
+    }
+
+    pub fn display(&self, requested: Option<&str>) -> Option<&DisplayDeviceConfig> {
+        select(&self.config.displays, requested)
+    }
+
+    pub fn camera(&self, requested: Option<&str>) -> Option<&CameraDeviceConfig> {
+        select(&self.config.cameras, requested)
+    }
+
+    pub fn gpio(&self, name: &str) -> Option<&GpioLineConfig> {
+        select(&self.config.gpio, Some(name))
+    }
+
+    pub fn gpu(&self, requested: Option<&str>) -> Option<&GpuDeviceConfig> {
+        select(&self.config.gpus, requested)
+    }
+
+    /// Whole profile, or one section, as JSON / 以 JSON 返回整个描述或其中一个分区
+    pub fn query(&self, section: Option<&str>) -> Result<serde_json::Value, String> {
+        let all = serde_json::to_value(&self.config).map_err(|e| e.to_string())?;
+        match section.map(str::trim).filter(|s| !s.is_empty()) {
+            None => Ok(all),
+            Some(s) if s == "name" || SECTIONS.contains(&s) => {
+                Ok(all.get(s).cloned().unwrap_or(serde_json::Value::Null))
+            }
+            Some(s) => Err(format!("unknown device profile section: {}", s)),
+        }
+    }
+
+    /// Environment for process workloads; empty for an empty profile
+    /// 进程工作负载的环境变量；描述为空时为空
+    pub fn environment(&self) -> Vec<(String, String)> {
+        if self.is_empty() {
+            return Vec::new();
+        }
+        let mut env = Vec::new();
+        if let Ok(json) = serde_json::to_string(&self.config) {
+            env.push((ENV_DEVICE_PROFILE.to_string(), json));
+        }
+        if let Some(d) = self.audio_input(None).filter(|d| !d.device.is_empty()) {
+            env.push(("SPEAR_AUDIO_INPUT".to_string(), d.device.clone()));
+        }
+        if let Some(d) = self.audio_output(None).filter(|d| !d.device.is_empty()) {
+            env.push(("SPEAR_AUDIO_OUTPUT".to_string(), d.device.clone()));
+        }
+        if let Some(d) = self.camera(None).filter(|d| !d.device.is_empty()) {
+            env.push(("SPEAR_CAMERA".to_string(), d.device.clone()));
+        }
+        if let Some(d) = self.display(None).filter(|d| !d.device.is_empty()) {
+            env.push(("SPEAR_DISPLAY".to_string(), d.device.clone()));
+        }
+        env
+    }
+
+    /// Summary published as node metadata for schedulers / 作为节点元数据发布给调度器的摘要
+    pub fn node_metadata(&self) -> HashMap<String, String> {
+        let mut m = HashMap::new();
+        if self.is_empty() {
+            return m;
+        }
+        let c = &self.config;
+        if !c.name.is_empty() {
+            m.insert("device_profile".to_string(), c.name.clone());
+        }
+        let counts = [
+            ("audio_inputs", c.audio_inputs.len()),
+            ("audio_outputs", c.audio_outputs.len()),
+            ("displays", c.displays.len()),
+            ("cameras", c.cameras.len()),
+            ("gpio", c.gpio.len()),
+            ("gpus", c.gpus.len()),
+        ];
+        for (section, n) in counts {
+            if n > 0 {
+                m.insert(format!("devices.{}", section), n.to_string());
+            }
+        }
+        m
+    }
+
+    pub fn is_empty(&self) -> bool {
+        let c = &self.config;
+        c.name.is_empty()
+            && c.audio_inputs.is_empty()
+            && c.audio_outputs.is_empty()
+            && c.displays.is_empty()
+            && c.cameras.is_empty()
+            && c.gpio.is_empty()
+            && c.gpus.is_empty()
+    }
+}
+
+/// Problems in a profile: missing or duplicate names, several defaults, bad GPIO direction
+/// 设备描述中的问题：缺失或重复的名称、多个默认条目、无效的 GPIO 方向
+pub fn validate(config: &DeviceProfileConfig) -> Vec<String> {
+    let mut problems = Vec::new();
+    check_section("audio_inputs", &config.audio_inputs, &mut problems);
+    check_section("audio_outputs", &config.audio_outputs, &mut problems);
+    check_section("displays", &config.displays, &mut problems);
+    check_section("cameras", &config.cameras, &mut problems);
+    check_section("gpio", &config.gpio, &mut problems);
+    check_section("gpus", &config.gpus, &mut problems);
+    for line in &config.gpio {
+        if !matches!(line.direction.as_str(), "" | "in" | "out") {
+            problems.push(format!(
+                "gpio {}: direction must be \"in\" or \"out\"",
+                line.name
+            ));
+        }
+    }
+    problems
+}
+
+fn check_section<T: ProfileEntry>(section: &str, entries: &[T], problems: &mut Vec<String>) {
+    let mut seen = std::collections::HashSet::new();
+    for e in entries {
+        if e.name().is_empty() {
+            problems.push(format!("{}: entry without name", section));
+        } else if !seen.insert(e.name()) {
+            problems.push(format!("{}: duplicate name {}", section, e.name()));
+        }
+    }
+    if entries.iter().filter(|e| e.is_default()).count() > 1 {
+        problems.push(format!("{}: more than one default", section));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn profile() -> DeviceProfile {
+        DeviceProfile::new(DeviceProfileConfig {
+            name: "kiosk".to_string(),
+            audio_inputs: vec![
+                AudioDeviceConfig {
+                    name: "array".to_string(),
+                    device: "ReSpeaker 4 Mic Array".to_string(),
+                    sample_rate_hz: Some(16000),
+                    ..Default::default()
+                },
+                AudioDeviceConfig {
+                    name: "usb".to_string(),
+                    device: "USB Audio".to_string(),
+                    default: true,
+                    ..Default::default()
+                },
+            ],
+            cameras: vec![CameraDeviceConfig {
+                name: "front".to_string(),
+                device: "/dev/video0".to_string(),
+                width: 1280,
+                height: 720,
+                fps: 30,
+                default: false,
+            }],
+            gpio: vec![GpioLineConfig {
+                name: "relay".to_string(),
+                chip: "gpiochip0".to_string(),
+                line: 17,
+                direction: "out".to_string(),
+                active_low: false,
+            }],
+            ..Default::default()
+        })
+    }
+
+    #[test]
+    fn test_select_default_and_by_name() {
+        let p = profile();
+        assert_eq!(p.audio_input(None).unwrap().device, "USB Audio");
+        assert_eq!(
+            p.audio_input(Some("array")).unwrap().device,
+            "ReSpeaker 4 Mic Array"
+        );
+        assert!(p.audio_input(Some("hw:1,0")).is_none());
+        assert_eq!(p.camera(None).unwrap().device, "/dev/video0");
+        assert_eq!(p.gpio("relay").unwrap().line, 17);
+        assert!(p.display(None).is_none());
+    }
+
+    #[test]
+    fn test_query_sections() {
+        let p = profile();
+        assert_eq!(p.query(None).unwrap()["name"], "kiosk");
+        let cams = p.query(Some("cameras")).unwrap();
+        assert_eq!(cams[0]["fps"], 30);
+        assert_eq!(p.query(Some("gpus")).unwrap(), serde_json::json!([]));
+        assert!(p.query(Some("lidar")).is_err());
+    }
+
+    #[test]
+    fn test_environment_and_metadata() {
+        let p = profile();
+        let env: HashMap<_, _> = p.environment().into_iter().collect();
+        assert_eq!(env.get("SPEAR_AUDIO_INPUT").unwrap(), "USB Audio");
+        assert_eq!(env.get("SPEAR_CAMERA").unwrap(), "/dev/video0");
+        assert!(env.contains_key(ENV_DEVICE_PROFILE));
+        assert!(!env.contains_key("SPEAR_DISPLAY"));
+        let meta = p.node_metadata();
+        assert_eq!(meta.get("device_profile").unwrap(), "kiosk");
+        assert_eq!(meta.get("devices.audio_inputs").unwrap(), "2");
+        assert!(!meta.contains_key("devices.gpus"));
+        assert!(DeviceProfile::default().environment().is_empty());
+    }
+
+    #[test]
+    fn test_validate() {
+        let mut cfg = profile().config().clone();
+        assert!(validate(&cfg).is_empty());
+        cfg.audio_inputs[0].default = true;
+        cfg.gpio.push(GpioLineConfig {
+            name: "relay".to_string(),
+            direction: "both".to_string(),
+            ..Default::default()
+        });
+        let problems = validate(&cfg);
+        assert_eq!(problems.len(), 3, "{:?}", problems);
+    }
+}
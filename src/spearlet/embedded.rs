@@ -0,0 +1,338 @@
+//! Spearlet embedded as a library / 以库形式嵌入的 spearlet
+//!
+//! `SpearletBuilder` creates the execution services without binding a port, installing a
+//! log subscriber or registering with SMS. Each spearlet owns its node-local services
+//! (blob cache, vector store, key-value state, message passing, scratch files and the
+//! rest of `NodeServices`), so several can run in one process. `start` applies them,
+//! `serve` adds the gRPC and HTTP servers only when asked, and `stop` undoes both, so a
+//! spearlet can be started and stopped repeatedly, as tests do. Both follow the subsystem
+//! order of `lifecycle`. The `spearlet` binary is this
+//! plus signal handling, config reload and the SMS background services.
+//! `SpearletBuilder` 创建执行服务，但不绑定端口、不安装日志订阅器、也不向 SMS 注册。每个 spearlet
+//! 持有自己的节点本地服务（blob 缓存、向量存储、键值状态、消息传递、临时文件以及 `NodeServices`
+//! 中的其余部分），因此同一进程中可以运行多个。`start` 应用这些服务，`serve` 仅在需要时启动 gRPC
+//! 与 HTTP 服务器，`stop` 撤销两者，因此 spearlet 可以反复启动和停止，测试即是如此。两者均遵循
+//! `lifecycle` 中的子系统顺序。
+//! `spearlet` 可执行文件即在此之上加入信号处理、配置重载与 SMS 后台服务。
+
+use std::sync::Arc;
+
+use parking_lot::Mutex;
+use tokio::sync::oneshot;
+use tokio::task::JoinHandle;
+use tonic::transport::Channel;
+
+use crate::proto::spearlet::execution_service_client::ExecutionServiceClient;
+use crate::proto::spearlet::invocation_service_client::InvocationServiceClient;
+use crate::proto::spearlet::object_service_client::ObjectServiceClient;
+use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::execution::manager::TaskExecutionManager;
+use crate::spearlet::function_service::FunctionServiceImpl;
+use crate::spearlet::grpc_server::{GrpcServer, HealthService};
+use crate::spearlet::http_gateway::HttpGateway;
+use crate::spearlet::lifecycle::{self, Subsystem};
+use crate::spearlet::message_routing;
+use crate::spearlet::node_services::NodeServices;
+use crate::spearlet::object_service::ObjectServiceImpl;
+use crate::spearlet::shutdown::ShutdownDeadline;
+
+type BoxError = Box<dyn std::error::Error + Send + Sync>;
+
+/// Options for an embedded spearlet / 嵌入式 spearlet 的选项
+#[derive(Default)]
+pub struct SpearletBuilder {
+    config: SpearletConfig,
+    sms_channel: Option<Channel>,
+}
+
+impl SpearletBuilder {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Start from a full configuration; later options override it
+    /// 以完整配置为起点；之后的选项会覆盖它
+    pub fn with_config(mut self, config: SpearletConfig) -> Self {
+        self.config = config;
+        self
+    }
+
+    pub fn with_node_name(mut self, node_name: impl Into<String>) -> Self {
+        self.config.node_name = node_name.into();
+        self
+    }
+
+    /// Address `serve` binds for gRPC / `serve` 绑定的 gRPC 地址
+    pub fn with_grpc_addr(mut self, addr: std::net::SocketAddr) -> Self {
+        self.config.grpc.addr = addr;
+        self
+    }
+
+    /// Address `serve` binds for HTTP / `serve` 绑定的 HTTP 地址
+    pub fn with_http_addr(mut self, addr: std::net::SocketAddr) -> Self {
+        self.config.http.server.addr = addr;
+        self
+    }
+
+    /// Fetch tasks that are not loaded yet from SMS over this channel
+    /// 通过该通道从 SMS 获取尚未加载的任务
+    pub fn with_sms_channel(mut self, channel: Channel) -> Self {
+        self.sms_channel = Some(channel);
+        self
+    }
+
+    pub fn with_max_concurrent_executions(mut self, n: usize) -> Self {
+        self.config.execution.max_concurrent_executions = n;
+        self
+    }
+
+    /// Create the execution services; nothing runs until `start` or `serve`
+    /// 创建执行服务；在 `start` 或 `serve` 之前不运行任何内容
+    pub async fn build(self) -> Result<Spearlet, BoxError> {
+        let config = Arc::new(self.config);
+        let object_service = Arc::new(ObjectServiceImpl::new_with_memory(
+            config.storage.max_object_size,
+        ));
+        let node = NodeServices::new();
+        node.tool_plugins.discover(&config.tool_plugins).await;
+        node.mcp_registry
+            .init(config.clone(), self.sms_channel.clone());
+        let function_service = Arc::new(
+            FunctionServiceImpl::with_node(config.clone(), self.sms_channel.clone(), node.clone())
+                .await?,
+        );
+        Ok(Spearlet {
+            config,
+            sms_channel: self.sms_channel,
+            node,
+            object_service,
+            function_service,
+            started: Mutex::new(false),
+            servers: Mutex::new(None),
+        })
+    }
+}
+
+struct Servers {
+    shutdown: Vec<oneshot::Sender<()>>,
+    handles: Vec<JoinHandle<()>>,
+}
+
+pub struct Spearlet {
+    config: Arc<SpearletConfig>,
+    sms_channel: Option<Channel>,
+    node: Arc<NodeServices>,
+    object_service: Arc<ObjectServiceImpl>,
+    function_service: Arc<FunctionServiceImpl>,
+    started: Mutex<bool>,
+    servers: Mutex<Option<Servers>>,
+}
+
+impl Spearlet {
+    pub fn builder() -> SpearletBuilder {
+        SpearletBuilder::new()
+    }
+
+    pub fn config(&self) -> &Arc<SpearletConfig> {
+        &self.config
+    }
+
+    /// Node-local services of this spearlet / 本 spearlet 的节点本地服务
+    pub fn node(&self) -> &Arc<NodeServices> {
+        &self.node
+    }
+
+    /// Invoke tasks in process with `TaskExecutionManager::invoke`
+    /// 通过 `TaskExecutionManager::invoke` 在进程内调用任务
+    pub fn execution_manager(&self) -> Arc<TaskExecutionManager> {
+        self.function_service.get_execution_manager()
+    }
+
+    pub fn function_service(&self) -> Arc<FunctionServiceImpl> {
+        self.function_service.clone()
+    }
+
+    pub fn object_service(&self) -> Arc<ObjectServiceImpl> {
+        self.object_service.clone()
+    }
+
+    pub fn is_serving(&self) -> bool {
+        self.servers.lock().is_some()
+    }
+
+    /// Apply the node-local services of the configuration and admit hostcalls, in
+    /// `lifecycle::start_order`; calling it again does nothing
+    /// 按 `lifecycle::start_order` 应用配置中的节点本地服务并放行 hostcall；重复调用不产生效果
+    pub fn start(&self) {
+        let mut started = self.started.lock();
+        if *started {
+            return;
+        }
+        for subsystem in lifecycle::start_order() {
+            match subsystem {
+                Subsystem::NodeServices => self.node.apply(&self.config),
+                Subsystem::MessageRouting => {
+                    message_routing::start(&self.node, &self.config, self.sms_channel.clone())
+                }
+                Subsystem::Runtimes => {
+                    self.node.set_hostcalls_open(true);
+                    self.function_service
+                        .get_execution_manager()
+                        .replay_async_journal();
+                }
+                // Started by the binary with the SMS background services; cameras start on
+                // the first subscription; servers start in `serve`
+                // 由可执行文件与 SMS 后台服务一同启动；摄像头在首次订阅时启动；服务器在 `serve` 中启动
+                Subsystem::BackendServices | Subsystem::StreamClasses | Subsystem::Servers => {}
+            }
+        }
+        *started = true;
+    }
+
+    /// Start, then serve gRPC and HTTP on the configured addresses until `stop_serving`
+    /// 启动，然后在配置的地址上提供 gRPC 与 HTTP 服务，直到 `stop_serving`
+    pub fn serve(&self) -> Result<(), BoxError> {
+        self.start();
+        let mut servers = self.servers.lock();
+        if servers.is_some() {
+            return Err("spearlet is already serving".into());
+        }
+        let config = self.config.clone();
+        // The gateway's own calls carry this node's credential / 网关自身的调用携带本节点的凭证
+        let grpc_channel = self
+            .node
+            .local_credential
+            .channel(Channel::from_shared(format!("http://{}", config.grpc.addr))?.connect_lazy());
+
+        let grpc_server = GrpcServer::with_services(
+            config.clone(),
+            self.object_service.clone(),
+            self.function_service.clone(),
+        );
+        let (shutdown_tx_grpc, shutdown_rx_grpc) = oneshot::channel::<()>();
+        let grpc_handle = tokio::spawn(async move {
+            if let Err(e) = grpc_server
+                .start_with_shutdown(async move {
+                    let _ = shutdown_rx_grpc.await;
+                })
+                .await
+            {
+                tracing::error!("gRPC server error: {}", e);
+            }
+        });
+
+        let health_service =
+            HealthService::new(self.object_service.clone(), self.function_service.clone());
+        let http_gateway = HttpGateway::new(
+            config,
+            Arc::new(health_service),
+            self.function_service.clone(),
+            ObjectServiceClient::new(grpc_channel.clone()),
+            InvocationServiceClient::new(grpc_channel.clone()),
+            ExecutionServiceClient::new(grpc_channel),
+        );
+        let (shutdown_tx_http, shutdown_rx_http) = oneshot::channel::<()>();
+        let http_handle = tokio::spawn(async move {
+            if let Err(e) = http_gateway
+                .start_with_shutdown(async move {
+                    let _ = shutdown_rx_http.await;
+                })
+                .await
+            {
+                tracing::error!("HTTP gateway error: {}", e);
+            }
+        });
+
+        *servers = Some(Servers {
+            shutdown: vec![shutdown_tx_http, shutdown_tx_grpc],
+            handles: vec![http_handle, grpc_handle],
+        });
+        Ok(())
+    }
+
+    /// Stop accepting connections and drain them until the deadline, then abort the servers
+    /// 停止接受连接并在截止时间前排空，之后中止服务器
+    pub async fn stop_serving(&self, deadline: &ShutdownDeadline) {
+        let Some(servers) = self.servers.lock().take() else {
+            return;
+        };
+        for tx in servers.shutdown {
+            let _ = tx.send(());
+        }
+        let aborts: Vec<_> = servers.handles.iter().map(|h| h.abort_handle()).collect();
+        let drained = deadline
+            .run("drain connections", async {
+                for h in servers.handles {
+                    let _ = h.await;
+                }
+            })
+            .await;
+        if drained.is_none() {
+            for a in aborts {
+                a.abort();
+            }
+        }
+    }
+
+    /// Stop serving, stop camera streams and workload instances and reset the node-local
+    /// services, in `lifecycle::stop_order`, leaving the spearlet ready for another `start`;
+    /// returns the number of instances stopped
+    /// 按 `lifecycle::stop_order` 停止服务、摄像头流与工作负载实例并重置节点本地服务，使 spearlet
+    /// 可再次 `start`；返回停止的实例数
+    pub async fn stop(&self, deadline: &ShutdownDeadline) -> usize {
+        let was_started = *self.started.lock();
+        let mut stopped = 0;
+        for subsystem in lifecycle::stop_order() {
+            match subsystem {
+                Subsystem::Servers => self.stop_serving(deadline).await,
+                Subsystem::StreamClasses => {
+                    #[cfg(feature = "rtsp")]
+                    {
+                        let streams = self.node.cameras.unsubscribe_all();
+                        if streams > 0 {
+                            tracing::info!(streams, "Camera streams stopped");
+                        }
+                    }
+                    #[cfg(feature = "webrtc")]
+                    {
+                        let sessions = self.node.webrtc.close_all();
+                        if sessions > 0 {
+                            tracing::info!(sessions, "WebRTC sessions closed");
+                        }
+                    }
+                }
+                Subsystem::Runtimes => {
+                    stopped = deadline
+                        .run(
+                            "stop instances",
+                            self.execution_manager()
+                                .stop_all_instances("spearlet shutting down"),
+                        )
+                        .await
+                        .unwrap_or(0);
+                    if was_started {
+                        self.node.set_hostcalls_open(false);
+                    }
+                }
+                // Owned by the binary, which stops them after this / 由可执行文件持有，并在此之后停止
+                Subsystem::BackendServices => {}
+                Subsystem::MessageRouting => {
+                    if was_started {
+                        message_routing::stop(&self.node);
+                    }
+                }
+                Subsystem::NodeServices => self.stop_node_services(),
+            }
+        }
+        stopped
+    }
+
+    fn stop_node_services(&self) {
+        let mut started = self.started.lock();
+        if !*started {
+            return;
+        }
+        self.node.reset(&self.config);
+        *started = false;
+    }
+}
@@ -0,0 +1,453 @@
+//! Energy governor for battery-powered and thermally constrained hosts
+//! 面向电池供电与温度受限主机的能耗调控器
+//!
+//! The governor polls battery and thermal state from sysfs and derives an energy level.
+//! Outside the `normal` level it:
+//! 调控器从 sysfs 轮询电池与温度状态并得出能耗级别。非 `normal` 级别时它会：
+//!
+//! - caps concurrent executions (`EnergyPermit`)
+//!   限制并发执行数（`EnergyPermit`）
+//! - makes the AI router prefer remote backends and cheaper models
+//!   让 AI 路由优先选择远程后端与更廉价的模型
+//! - holds async invocations while `critical`
+//!   在 `critical` 时暂缓异步调用
+//!
+//! The current state is reported by `/readyz`.
+//! 当前状态通过 `/readyz` 报告。
+
+use std::path::Path;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::{Arc, Weak};
+use std::time::{Duration, Instant};
+
+use parking_lot::RwLock;
+use serde::Serialize;
+use tokio::sync::Notify;
+
+use crate::spearlet::config::EnergyConfig;
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
+
+/// Energy level, ordered from least to most constrained / 能耗级别，按受限程度从低到高排序
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum EnergyLevel {
+    #[default]
+    Normal,
+    Constrained,
+    Critical,
+}
+
+impl EnergyLevel {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            EnergyLevel::Normal => "normal",
+            EnergyLevel::Constrained => "constrained",
+            EnergyLevel::Critical => "critical",
+        }
+    }
+}
+
+/// One reading of the power and thermal state / 一次电源与温度状态读数
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct PowerSample {
+    /// Lowest battery capacity in percent / 最低电池电量百分比
+    pub battery_percent: Option<u8>,
+    /// Whether the host runs on battery / 主机是否由电池供电
+    pub on_battery: bool,
+    /// Hottest thermal zone in °C / 最热温区温度（摄氏度）
+    pub max_temp_c: Option<f64>,
+}
+
+fn read_trimmed(path: &Path) -> Option<String> {
+    std::fs::read_to_string(path)
+        .ok()
+        .map(|s| s.trim().to_string())
+}
+
+/// Read battery and thermal state below the configured sysfs roots
+/// 从配置的 sysfs 根目录读取电池与温度状态
+///
+/// Missing directories read as a mains-powered host without thermal zones.
+/// 目录不存在时视为市电供电且无温区的主机。
+pub fn read_sample(cfg: &EnergyConfig) -> PowerSample {
+    let mut sample = PowerSample::default();
+    let mut mains_online = false;
+    let mut discharging = false;
+
+    if let Ok(entries) = std::fs::read_dir(&cfg.power_supply_path) {
+        for entry in entries.flatten() {
+            let dir = entry.path();
+            match read_trimmed(&dir.join("type")).as_deref() {
+                Some("Battery") => {
+                    if let Some(pct) =
+                        read_trimmed(&dir.join("capacity")).and_then(|s| s.parse::<u8>().ok())
+                    {
+                        let pct = pct.min(100);
+                        sample.battery_percent =
+                            Some(sample.battery_percent.map_or(pct, |p| p.min(pct)));
+                    }
+                    if read_trimmed(&dir.join("status")).as_deref() == Some("Discharging") {
+                        discharging = true;
+                    }
+                }
+                Some("Mains") | Some("USB") => {
+                    if read_trimmed(&dir.join("online")).as_deref() == Some("1") {
+                        mains_online = true;
+                    }
+                }
+                _ => {}
+            }
+        }
+    }
+    sample.on_battery = sample.battery_percent.is_some() && (discharging || !mains_online);
+
+    if let Ok(entries) = std::fs::read_dir(&cfg.thermal_path) {
+        for entry in entries.flatten() {
+            if !entry
+                .file_name()
+                .to_string_lossy()
+                .starts_with("thermal_zone")
+            {
+                continue;
+            }
+            // Millidegrees Celsius / 千分之一摄氏度
+            let Some(milli) =
+                read_trimmed(&entry.path().join("temp")).and_then(|s| s.parse::<i64>().ok())
+            else {
+                continue;
+            };
+            let c = milli as f64 / 1000.0;
+            sample.max_temp_c = Some(sample.max_temp_c.map_or(c, |t| t.max(c)));
+        }
+    }
+    sample
+}
+
+/// Energy level of a reading under the configured thresholds / 按配置阈值计算读数的能耗级别
+pub fn evaluate(cfg: &EnergyConfig, sample: &PowerSample) -> EnergyLevel {
+    let battery = match sample.battery_percent {
+        Some(p) if sample.on_battery && p <= cfg.critical_battery_percent => EnergyLevel::Critical,
+        Some(p) if sample.on_battery && p <= cfg.low_battery_percent => EnergyLevel::Constrained,
+        _ => EnergyLevel::Normal,
+    };
+    let thermal = match sample.max_temp_c {
+        Some(t) if t >= cfg.critical_temp_c => EnergyLevel::Critical,
+        Some(t) if t >= cfg.hot_temp_c => EnergyLevel::Constrained,
+        _ => EnergyLevel::Normal,
+    };
+    battery.max(thermal)
+}
+
+/// Governor state as reported by `/readyz` / `/readyz` 报告的调控器状态
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct EnergyStatus {
+    pub enabled: bool,
+    pub level: EnergyLevel,
+    #[serde(flatten)]
+    pub sample: PowerSample,
+    /// Concurrency cap of the current level, if any / 当前级别的并发上限（若有）
+    pub max_concurrency: Option<usize>,
+    pub active_executions: usize,
+    pub checked_at_ms: Option<i64>,
+}
+
+/// Energy governor of one spearlet / 单个 spearlet 的能耗调控器
+pub struct EnergyGovernor {
+    config: RwLock<EnergyConfig>,
+    status: RwLock<EnergyStatus>,
+    active: AtomicUsize,
+    changed: Notify,
+    polling: AtomicBool,
+}
+
+impl Default for EnergyGovernor {
+    fn default() -> Self {
+        Self {
+            config: RwLock::new(EnergyConfig::default()),
+            status: RwLock::new(EnergyStatus::default()),
+            active: AtomicUsize::new(0),
+            changed: Notify::new(),
+            polling: AtomicBool::new(false),
+        }
+    }
+}
+
+impl std::fmt::Debug for EnergyGovernor {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("EnergyGovernor")
+            .field("level", &self.level())
+            .finish_non_exhaustive()
+    }
+}
+
+fn limit_for(cfg: &EnergyConfig, level: EnergyLevel) -> Option<usize> {
+    let n = match level {
+        EnergyLevel::Normal => 0,
+        EnergyLevel::Constrained => cfg.constrained_max_concurrency,
+        EnergyLevel::Critical => cfg.critical_max_concurrency,
+    };
+    (n > 0).then_some(n)
+}
+
+impl EnergyGovernor {
+    /// Apply a reading and wake waiters when the level changes / 应用一次读数，级别变化时唤醒等待者
+    pub fn update(&self, sample: PowerSample) -> EnergyLevel {
+        let level = evaluate(&self.config.read(), &sample);
+        let previous = {
+            let mut s = self.status.write();
+            let previous = s.level;
+            s.level = level;
+            s.sample = sample;
+            s.checked_at_ms = Some(chrono::Utc::now().timestamp_millis());
+            previous
+        };
+        if previous != level {
+            tracing::info!(
+                from = previous.as_str(),
+                to = level.as_str(),
+                "Energy level changed"
+            );
+            self.changed.notify_waiters();
+        }
+        level
+    }
+
+    /// Current energy level; `normal` while the governor is disabled
+    /// 当前能耗级别；调控器关闭时为 `normal`
+    pub fn level(&self) -> EnergyLevel {
+        self.status.read().level
+    }
+
+    /// Current governor state / 当前调控器状态
+    pub fn status(&self) -> EnergyStatus {
+        let mut s = self.status.read().clone();
+        s.max_concurrency = limit_for(&self.config.read(), s.level);
+        s.active_executions = self.active.load(Ordering::SeqCst);
+        s
+    }
+
+    /// Whether AI routing should prefer remote backends / AI 路由是否应优先选择远程后端
+    pub fn prefer_remote(&self) -> bool {
+        self.level() != EnergyLevel::Normal && self.config.read().prefer_remote
+    }
+
+    /// Cheaper replacement for a requested model, if the current level calls for one
+    /// 当前级别需要时，返回请求模型的更廉价替代
+    pub fn model_override(&self, model: &str) -> Option<String> {
+        if self.level() == EnergyLevel::Normal {
+            return None;
+        }
+        self.config
+            .read()
+            .model_overrides
+            .get(model)
+            .filter(|m| !m.is_empty() && m.as_str() != model)
+            .cloned()
+    }
+
+    fn try_acquire(self: &Arc<Self>) -> Option<EnergyPermit> {
+        let limit = limit_for(&self.config.read(), self.level());
+        self.active
+            .fetch_update(Ordering::SeqCst, Ordering::SeqCst, |n| match limit {
+                Some(max) if n >= max => None,
+                _ => Some(n + 1),
+            })
+            .ok()
+            .map(|_| EnergyPermit {
+                governor: self.clone(),
+            })
+    }
+
+    /// Wait for an execution slot under the cap of the current level
+    /// 在当前级别的并发上限下等待一个执行槽位
+    pub async fn acquire(self: &Arc<Self>) -> EnergyPermit {
+        loop {
+            let notified = self.changed.notified();
+            tokio::pin!(notified);
+            notified.as_mut().enable();
+            if let Some(permit) = self.try_acquire() {
+                return permit;
+            }
+            notified.await;
+        }
+    }
+
+    /// Hold an async invocation while the level is critical, up to `max_defer_ms`
+    /// 在级别为 critical 时暂缓异步调用，最长 `max_defer_ms`
+    ///
+    /// Returns how long the caller was held. / 返回调用方被暂缓的时长。
+    pub async fn defer_while_critical(&self) -> Duration {
+        let max = {
+            let cfg = self.config.read();
+            if !cfg.defer_async_when_critical {
+                return Duration::ZERO;
+            }
+            Duration::from_millis(cfg.max_defer_ms)
+        };
+        let start = Instant::now();
+        loop {
+            let notified = self.changed.notified();
+            tokio::pin!(notified);
+            notified.as_mut().enable();
+            if self.level() != EnergyLevel::Critical {
+                break;
+            }
+            let Some(left) = max.checked_sub(start.elapsed()) else {
+                break;
+            };
+            if tokio::time::timeout(left, notified).await.is_err() {
+                break;
+            }
+        }
+        start.elapsed()
+    }
+
+    /// Start the governor, or apply a changed configuration to a running one
+    /// 启动调控器，或将变更的配置应用到运行中的调控器
+    ///
+    /// Disabling resets the level to `normal`. / 关闭时级别重置为 `normal`。
+    pub fn start(self: &Arc<Self>, cfg: &EnergyConfig) {
+        *self.config.write() = cfg.clone();
+        if !cfg.enabled {
+            *self.status.write() = EnergyStatus::default();
+            self.changed.notify_waiters();
+            return;
+        }
+        self.status.write().enabled = true;
+        self.update(read_sample(cfg));
+        // New caps may admit waiters even when the level is unchanged
+        // 即使级别未变，新的上限也可能放行等待者
+        self.changed.notify_waiters();
+        if self.polling.swap(true, Ordering::SeqCst) {
+            return;
+        }
+        let governor = Arc::downgrade(self);
+        supervise("energy-governor", RestartPolicy::default(), move || {
+            poll(governor.clone())
+        });
+    }
+}
+
+/// Execution slot counted against the energy concurrency cap
+/// 计入能耗并发上限的执行槽位
+#[derive(Debug)]
+pub struct EnergyPermit {
+    governor: Arc<EnergyGovernor>,
+}
+
+impl Drop for EnergyPermit {
+    fn drop(&mut self) {
+        self.governor.active.fetch_sub(1, Ordering::SeqCst);
+        self.governor.changed.notify_waiters();
+    }
+}
+
+/// Sample with the current configuration until the spearlet is gone
+/// 以当前配置持续采样直到 spearlet 不复存在
+async fn poll(governor: Weak<EnergyGovernor>) {
+    loop {
+        let Some(interval) = governor.upgrade().map(|g| g.config.read().poll_interval_ms) else {
+            return;
+        };
+        tokio::time::sleep(Duration::from_millis(interval.max(1000))).await;
+        let Some(g) = governor.upgrade() else {
+            return;
+        };
+        let cfg = g.config.read().clone();
+        if cfg.enabled {
+            g.update(read_sample(&cfg));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn write(dir: &Path, rel: &str, value: &str) {
+        let path = dir.join(rel);
+        std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+        std::fs::write(path, value).unwrap();
+    }
+
+    fn config(root: &Path) -> EnergyConfig {
+        EnergyConfig {
+            power_supply_path: root.join("power_supply").to_string_lossy().into_owned(),
+            thermal_path: root.join("thermal").to_string_lossy().into_owned(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_read_sample_from_sysfs() {
+        let dir = tempfile::tempdir().unwrap();
+        let root = dir.path();
+        write(root, "power_supply/BAT0/type", "Battery\n");
+        write(root, "power_supply/BAT0/capacity", "25\n");
+        write(root, "power_supply/BAT0/status", "Discharging\n");
+        write(root, "power_supply/AC/type", "Mains\n");
+        write(root, "power_supply/AC/online", "0\n");
+        write(root, "thermal/thermal_zone0/temp", "48000\n");
+        write(root, "thermal/thermal_zone1/temp", "71500\n");
+        write(root, "thermal/cooling_device0/temp", "99000\n");
+
+        let cfg = config(root);
+        let sample = read_sample(&cfg);
+        assert_eq!(sample.battery_percent, Some(25));
+        assert!(sample.on_battery);
+        assert_eq!(sample.max_temp_c, Some(71.5));
+
+        write(root, "power_supply/AC/online", "1\n");
+        write(root, "power_supply/BAT0/status", "Charging\n");
+        assert!(!read_sample(&cfg).on_battery);
+
+        let empty = config(&root.join("missing"));
+        assert_eq!(read_sample(&empty), PowerSample::default());
+    }
+
+    #[test]
+    fn test_evaluate_thresholds() {
+        let cfg = EnergyConfig::default();
+        let on_battery = |pct| PowerSample {
+            battery_percent: Some(pct),
+            on_battery: true,
+            max_temp_c: Some(40.0),
+        };
+        assert_eq!(evaluate(&cfg, &on_battery(80)), EnergyLevel::Normal);
+        assert_eq!(evaluate(&cfg, &on_battery(30)), EnergyLevel::Constrained);
+        assert_eq!(evaluate(&cfg, &on_battery(5)), EnergyLevel::Critical);
+
+        let charging = PowerSample {
+            on_battery: false,
+            ..on_battery(5)
+        };
+        assert_eq!(evaluate(&cfg, &charging), EnergyLevel::Normal);
+
+        let hot = PowerSample {
+            max_temp_c: Some(90.0),
+            ..on_battery(80)
+        };
+        assert_eq!(evaluate(&cfg, &hot), EnergyLevel::Critical);
+        assert_eq!(
+            evaluate(
+                &cfg,
+                &PowerSample {
+                    max_temp_c: Some(75.0),
+                    ..Default::default()
+                }
+            ),
+            EnergyLevel::Constrained
+        );
+    }
+
+    #[test]
+    fn test_limit_for_level() {
+        let cfg = EnergyConfig {
+            constrained_max_concurrency: 0,
+            ..Default::default()
+        };
+        assert_eq!(limit_for(&cfg, EnergyLevel::Normal), None);
+        assert_eq!(limit_for(&cfg, EnergyLevel::Constrained), None);
+        assert_eq!(limit_for(&cfg, EnergyLevel::Critical), Some(1));
+    }
+}
@@ -0,0 +1,318 @@
+//! Example gallery for `spearlet examples`
+//! `spearlet examples` 的示例库
+//!
+//! Lists the WASM samples bundled under `samples/` and runs one end to end:
+//! build it with `make samples` when the module is missing, upload it to the SMS
+//! file service, register a task that points at it and invoke it through the local
+//! spearlet `/v1/exec` endpoint.
+//! 列出 `samples/` 下自带的 WASM 示例并端到端运行其中一个：模块缺失时通过 `make samples`
+//! 构建，上传到 SMS 文件服务，注册指向该文件的任务，并通过本地 spearlet `/v1/exec` 调用。
+
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use crate::spearlet::config::SpearletConfig;
+
+/// A bundled example workload / 自带示例工作负载
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Example {
+    /// Gallery name / 示例名
+    pub name: &'static str,
+    /// One-line description / 一行描述
+    pub description: &'static str,
+    /// Module path relative to the samples build dir / 相对示例构建目录的模块路径
+    pub module: &'static str,
+    /// Source path relative to the samples dir / 相对示例目录的源码路径
+    pub source: &'static str,
+    /// What the example needs at runtime / 运行时依赖
+    pub requires: &'static str,
+}
+
+const CATALOG: &[Example] = &[
+    Example {
+        name: "hello",
+        description: "minimal WASM workload",
+        module: "hello.wasm",
+        source: "wasm-c/hello.c",
+        requires: "",
+    },
+    Example {
+        name: "chat",
+        description: "single Chat Completion call",
+        module: "chat_completion.wasm",
+        source: "wasm-c/chat_completion.c",
+        requires: "an LLM backend",
+    },
+    Example {
+        name: "chat-tools",
+        description: "Chat Completion with a WASM tool and AUTO_TOOL_CALL",
+        module: "chat_completion_tool_sum.wasm",
+        source: "wasm-c/chat_completion_tool_sum.c",
+        requires: "an LLM backend with tool calling",
+    },
+    Example {
+        name: "chat-js",
+        description: "Chat Completion from a JS entry on the Boa runner",
+        module: "js/js-chat_completion.wasm",
+        source: "wasm-js/chat_completion",
+        requires: "an LLM backend",
+    },
+    Example {
+        name: "asr-agent",
+        description: "microphone capture with realtime ASR",
+        module: "mic_rtasr.wasm",
+        source: "wasm-c/mic_rtasr.c",
+        requires: "a realtime ASR backend and a microphone source",
+    },
+    Example {
+        name: "mcp-fs",
+        description: "MCP filesystem tools injected into a chat session",
+        module: "mcp_fs.wasm",
+        source: "wasm-c/mcp_fs.c",
+        requires: "an LLM backend, SMS MCP configs and npx",
+    },
+    Example {
+        name: "user-stream-echo",
+        description: "WebSocket user stream echoed by the workload",
+        module: "user_stream_echo.wasm",
+        source: "wasm-c/user_stream_echo.c",
+        requires: "a WebSocket client on the execution stream",
+    },
+];
+
+/// All bundled examples / 所有自带示例
+pub fn catalog() -> &'static [Example] {
+    CATALOG
+}
+
+/// Look up an example by name / 按名称查找示例
+pub fn find_example(name: &str) -> Option<&'static Example> {
+    let name = name.trim();
+    CATALOG.iter().find(|e| e.name.eq_ignore_ascii_case(name))
+}
+
+/// Render the gallery listing / 渲染示例列表
+pub fn render_catalog(samples_dir: &Path) -> String {
+    let mut out = String::new();
+    for e in CATALOG {
+        let built = samples_dir.join("build").join(e.module).is_file();
+        out.push_str(&format!(
+            "{:<18} {:<8} {}\n",
+            e.name,
+            if built { "built" } else { "-" },
+            e.description
+        ));
+        if !e.requires.is_empty() {
+            out.push_str(&format!("{:<18} {:<8} requires {}\n", "", "", e.requires));
+        }
+    }
+    out
+}
+
+/// Options for running an example / 运行示例的选项
+#[derive(Debug, Clone)]
+pub struct RunOptions {
+    /// Repository root containing `samples/` and the Makefile / 包含 `samples/` 与 Makefile 的仓库根目录
+    pub repo_root: PathBuf,
+    /// Build with `make samples` when the module is missing / 模块缺失时执行 `make samples`
+    pub build: bool,
+    /// Invocation payload / 调用负载
+    pub payload: String,
+    /// API key for the spearlet HTTP API / spearlet HTTP API 的 API key
+    pub api_key: Option<String>,
+}
+
+/// Runs bundled examples against SMS and the local spearlet / 针对 SMS 与本地 spearlet 运行示例
+pub struct ExampleRunner {
+    client: reqwest::Client,
+    sms_base: String,
+    spearlet_base: String,
+}
+
+impl ExampleRunner {
+    pub fn new(config: &SpearletConfig) -> Self {
+        Self {
+            client: reqwest::Client::builder()
+                .timeout(Duration::from_secs(300))
+                .build()
+                .unwrap_or_default(),
+            sms_base: http_base(&config.sms_http_addr),
+            spearlet_base: local_base(config.http.server.addr),
+        }
+    }
+
+    /// Build, upload, register and invoke an example / 构建、上传、注册并调用示例
+    pub async fn run(&self, example: &Example, opts: &RunOptions) -> Result<String, String> {
+        let module = opts
+            .repo_root
+            .join("samples")
+            .join("build")
+            .join(example.module);
+        if !module.is_file() {
+            if !opts.build {
+                return Err(format!(
+                    "{} not built; run `make samples`",
+                    module.display()
+                ));
+            }
+            println!("==> building samples (make samples)");
+            build_samples(&opts.repo_root).await?;
+            if !module.is_file() {
+                return Err(format!("{} missing after build", module.display()));
+            }
+        }
+
+        println!("==> uploading {}", module.display());
+        let bytes = tokio::fs::read(&module)
+            .await
+            .map_err(|e| format!("read {}: {}", module.display(), e))?;
+        let uri = self.upload(example.module, bytes).await?;
+
+        println!("==> registering task example-{}", example.name);
+        let task_id = self.register(example, &uri).await?;
+
+        println!("==> invoking task {}", task_id);
+        self.invoke(&task_id, opts).await
+    }
+
+    async fn upload(&self, name: &str, bytes: Vec<u8>) -> Result<String, String> {
+        let file_name = Path::new(name)
+            .file_name()
+            .and_then(|n| n.to_str())
+            .unwrap_or(name);
+        let v = self
+            .post_json(
+                self.client
+                    .post(format!("{}/api/v1/files", self.sms_base))
+                    .header("x-file-name", file_name)
+                    .header(reqwest::header::CONTENT_TYPE, "application/wasm")
+                    .body(bytes),
+            )
+            .await?;
+        v.get("uri")
+            .and_then(|u| u.as_str())
+            .map(str::to_string)
+            .ok_or_else(|| format!("upload response without uri: {}", v))
+    }
+
+    async fn register(&self, example: &Example, uri: &str) -> Result<String, String> {
+        let body = serde_json::json!({
+            "name": format!("example-{}", example.name),
+            "description": example.description,
+            "priority": "normal",
+            "endpoint": "",
+            "version": env!("CARGO_PKG_VERSION"),
+            "capabilities": ["wasm"],
+            "executable": {
+                "type": "wasm",
+                "uri": uri,
+                "name": example.module,
+            },
+        });
+        let v = self
+            .post_json(
+                self.client
+                    .post(format!("{}/api/v1/tasks", self.sms_base))
+                    .json(&body),
+            )
+            .await?;
+        v.get("task_id")
+            .and_then(|t| t.as_str())
+            .map(str::to_string)
+            .ok_or_else(|| format!("task registration failed: {}", v))
+    }
+
+    async fn invoke(&self, task_id: &str, opts: &RunOptions) -> Result<String, String> {
+        let mut req = self
+            .client
+            .post(format!("{}/v1/exec", self.spearlet_base))
+            .json(&serde_json::json!({
+                "workload": task_id,
+                "payload": opts.payload,
+            }));
+        if let Some(key) = opts.api_key.as_deref() {
+            req = req.header("x-api-key", key);
+        }
+        let v = self.post_json(req).await?;
+        Ok(serde_json::to_string_pretty(&v).unwrap_or_else(|_| v.to_string()))
+    }
+
+    async fn post_json(&self, req: reqwest::RequestBuilder) -> Result<serde_json::Value, String> {
+        let resp = req.send().await.map_err(|e| e.to_string())?;
+        let status = resp.status();
+        let text = resp.text().await.map_err(|e| e.to_string())?;
+        if !status.is_success() {
+            return Err(format!("HTTP {}: {}", status, text.trim()));
+        }
+        serde_json::from_str(&text).map_err(|e| format!("invalid JSON response: {}", e))
+    }
+}
+
+async fn build_samples(repo_root: &Path) -> Result<(), String> {
+    let status = tokio::process::Command::new("make")
+        .arg("samples")
+        .current_dir(repo_root)
+        .status()
+        .await
+        .map_err(|e| format!("make samples: {}", e))?;
+    if !status.success() {
+        return Err(format!("make samples exited with {}", status));
+    }
+    Ok(())
+}
+
+fn http_base(addr: &str) -> String {
+    let addr = addr.trim().trim_end_matches('/');
+    if addr.starts_with("http://") || addr.starts_with("https://") {
+        addr.to_string()
+    } else {
+        format!("http://{}", addr)
+    }
+}
+
+/// Base URL for reaching the local spearlet; wildcard binds map to loopback
+/// 访问本地 spearlet 的基础 URL；通配地址映射为回环地址
+pub(crate) fn local_base(addr: SocketAddr) -> String {
+    let host = if addr.ip().is_unspecified() {
+        "127.0.0.1".to_string()
+    } else if addr.is_ipv6() {
+        format!("[{}]", addr.ip())
+    } else {
+        addr.ip().to_string()
+    };
+    format!("http://{}:{}", host, addr.port())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_catalog_entries_are_unique_and_bundled() {
+        let root = Path::new(env!("CARGO_MANIFEST_DIR")).join("samples");
+        let mut names: Vec<&str> = catalog().iter().map(|e| e.name).collect();
+        names.sort();
+        names.dedup();
+        assert_eq!(names.len(), catalog().len());
+        for e in catalog() {
+            assert!(root.join(e.source).exists(), "missing source {}", e.source);
+        }
+        assert_eq!(find_example("Chat").map(|e| e.name), Some("chat"));
+        assert!(find_example("nope").is_none());
+    }
+
+    #[test]
+    fn test_base_urls() {
+        assert_eq!(http_base("127.0.0.1:8080/"), "http://127.0.0.1:8080");
+        assert_eq!(http_base("https://sms:8443"), "https://sms:8443");
+        assert_eq!(
+            local_base("0.0.0.0:8081".parse().unwrap()),
+            "http://127.0.0.1:8081"
+        );
+        assert_eq!(
+            local_base("[::1]:8081".parse().unwrap()),
+            "http://[::1]:8081"
+        );
+    }
+}
@@ -0,0 +1,304 @@
+//! gRPC execution gateway for spearlet
+//! spearlet 的 gRPC 执行网关
+//!
+//! Exposes Execute / ExecuteStream / ListWorkloads / ListTasks on top of the same
+//! invocation plumbing used by InvocationService. gRPC deadlines and request metadata
+//! are folded into the invocation so controllers do not need HTTP-style headers.
+//! 基于 InvocationService 同一套调用流程提供 Execute / ExecuteStream / ListWorkloads /
+//! ListTasks。gRPC deadline 与请求元数据会合并进调用，控制器无需使用 HTTP 风格的请求头。
+
+use std::pin::Pin;
+use std::sync::Arc;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use tokio::sync::mpsc;
+use tokio_stream::wrappers::ReceiverStream;
+use tokio_stream::StreamExt;
+use tonic::metadata::MetadataMap;
+use tonic::{Request, Response, Status, Streaming};
+use tracing::debug;
+
+use crate::proto::spearlet::exec_service_server::ExecService;
+use crate::proto::spearlet::{
+    InvokeRequest, InvokeResponse, ListTasksRequest, ListTasksResponse, ListWorkloadsRequest,
+    ListWorkloadsResponse, TaskSummary, Workload,
+};
+use crate::spearlet::config::HttpAuthConfig;
+use crate::spearlet::function_service::FunctionServiceImpl;
+use crate::spearlet::grpc_auth::LOCAL_CREDENTIAL_KEY;
+
+/// Metadata keys never forwarded into the invocation / 不转发到调用中的元数据键
+const RESERVED_METADATA_KEYS: &[&str] = &[
+    "content-type",
+    "te",
+    "user-agent",
+    "authorization",
+    "x-api-key",
+    LOCAL_CREDENTIAL_KEY,
+];
+
+pub struct ExecServiceImpl {
+    function_service: Arc<FunctionServiceImpl>,
+    /// Credential metadata configured in `http.auth`, never forwarded
+    /// `http.auth` 中配置的凭证元数据，不会被转发
+    credential_keys: Vec<String>,
+}
+
+impl ExecServiceImpl {
+    pub fn new(function_service: Arc<FunctionServiceImpl>) -> Self {
+        Self {
+            function_service,
+            credential_keys: Vec::new(),
+        }
+    }
+
+    /// Keep the client certificate header of `auth` out of invocations
+    /// 不将 `auth` 的客户端证书请求头带入调用
+    pub fn with_auth(mut self, auth: &HttpAuthConfig) -> Self {
+        self.credential_keys = auth
+            .mtls
+            .iter()
+            .map(|m| m.subject_header.to_ascii_lowercase())
+            .collect();
+        self
+    }
+
+    /// Fold gRPC deadline and metadata into the request / 将 gRPC deadline 与元数据合并进请求
+    fn apply_metadata(metadata: &MetadataMap, credential_keys: &[String], req: &mut InvokeRequest) {
+        if req.timeout_ms == 0 {
+            if let Some(ms) = grpc_timeout_ms(metadata) {
+                req.timeout_ms = ms;
+            }
+        }
+        for kv in metadata.iter() {
+            let tonic::metadata::KeyAndValueRef::Ascii(k, v) = kv else {
+                continue;
+            };
+            let key = k.as_str();
+            if key.starts_with("grpc-")
+                || RESERVED_METADATA_KEYS.contains(&key)
+                || credential_keys.iter().any(|c| c == key)
+            {
+                continue;
+            }
+            let Ok(value) = v.to_str() else {
+                continue;
+            };
+            req.metadata
+                .entry(key.to_string())
+                .or_insert_with(|| value.to_string());
+        }
+    }
+}
+
+/// Parse the `grpc-timeout` header into milliseconds / 将 `grpc-timeout` 头解析为毫秒
+pub fn grpc_timeout_ms(metadata: &MetadataMap) -> Option<u64> {
+    let raw = metadata.get("grpc-timeout")?.to_str().ok()?;
+    if raw.len() < 2 {
+        return None;
+    }
+    let (digits, unit) = raw.split_at(raw.len() - 1);
+    let value: u64 = digits.parse().ok()?;
+    let ms = match unit {
+        "H" => value.saturating_mul(3_600_000),
+        "M" => value.saturating_mul(60_000),
+        "S" => value.saturating_mul(1_000),
+        "m" => value,
+        "u" => value / 1_000,
+        "n" => value / 1_000_000,
+        _ => return None,
+    };
+    Some(ms.max(1))
+}
+
+fn system_time_to_timestamp(t: SystemTime) -> Option<prost_types::Timestamp> {
+    let d = t.duration_since(UNIX_EPOCH).ok()?;
+    Some(prost_types::Timestamp {
+        seconds: d.as_secs() as i64,
+        nanos: d.subsec_nanos() as i32,
+    })
+}
+
+fn task_status_to_public_str(
+    status: &crate::spearlet::execution::task::TaskStatus,
+) -> &'static str {
+    use crate::spearlet::execution::task::TaskStatus;
+    match status {
+        TaskStatus::Initializing | TaskStatus::Ready => "PENDING",
+        TaskStatus::Running | TaskStatus::Paused | TaskStatus::Scaling | TaskStatus::Stopping => {
+            "RUNNING"
+        }
+        TaskStatus::Stopped => "COMPLETED",
+        TaskStatus::Error(_) => "FAILED",
+    }
+}
+
+#[tonic::async_trait]
+impl ExecService for ExecServiceImpl {
+    type ExecuteStreamStream =
+        Pin<Box<dyn tokio_stream::Stream<Item = Result<InvokeResponse, Status>> + Send + 'static>>;
+
+    async fn execute(
+        &self,
+        request: Request<InvokeRequest>,
+    ) -> Result<Response<InvokeResponse>, Status> {
+        debug!("received exec request");
+        let metadata = request.metadata().clone();
+        let mut req = request.into_inner();
+        Self::apply_metadata(&metadata, &self.credential_keys, &mut req);
+        Ok(Response::new(self.function_service.invoke_once(req).await?))
+    }
+
+    async fn execute_stream(
+        &self,
+        request: Request<Streaming<InvokeRequest>>,
+    ) -> Result<Response<Self::ExecuteStreamStream>, Status> {
+        let metadata = request.metadata().clone();
+        let mut inbound = request.into_inner();
+        let function_service = self.function_service.clone();
+        let credential_keys = self.credential_keys.clone();
+        let (tx, rx) = mpsc::channel(16);
+
+        tokio::spawn(async move {
+            while let Some(item) = inbound.next().await {
+                let out = match item {
+                    Ok(mut req) => {
+                        Self::apply_metadata(&metadata, &credential_keys, &mut req);
+                        function_service.invoke_once(req).await
+                    }
+                    Err(status) => Err(status),
+                };
+                let stop = out.is_err();
+                if tx.send(out).await.is_err() || stop {
+                    break;
+                }
+            }
+        });
+
+        Ok(Response::new(Box::pin(ReceiverStream::new(rx))))
+    }
+
+    async fn list_workloads(
+        &self,
+        request: Request<ListWorkloadsRequest>,
+    ) -> Result<Response<ListWorkloadsResponse>, Status> {
+        let req = request.into_inner();
+        let filter = req.runtime_type.trim().to_ascii_lowercase();
+        let mut workloads: Vec<Workload> = self
+            .function_service
+            .get_execution_manager()
+            .list_artifacts()
+            .into_iter()
+            .filter(|a| filter.is_empty() || a.spec.runtime_type.as_str() == filter)
+            .map(|a| Workload {
+                artifact_id: a.id.clone(),
+                name: a.spec.name.clone(),
+                version: a.spec.version.clone(),
+                runtime_type: a.spec.runtime_type.as_str().to_string(),
+                task_count: a.tasks.len() as u32,
+                labels: a.spec.labels.clone(),
+            })
+            .collect();
+        workloads.sort_by(|a, b| a.artifact_id.cmp(&b.artifact_id));
+        Ok(Response::new(ListWorkloadsResponse { workloads }))
+    }
+
+    async fn list_tasks(
+        &self,
+        request: Request<ListTasksRequest>,
+    ) -> Result<Response<ListTasksResponse>, Status> {
+        let req = request.into_inner();
+        let mut tasks: Vec<TaskSummary> = self
+            .function_service
+            .get_execution_manager()
+            .list_tasks()
+            .into_iter()
+            .filter(|t| req.artifact_id.is_empty() || t.artifact_id() == req.artifact_id)
+            .map(|t| TaskSummary {
+                task_id: t.id.clone(),
+                artifact_id: t.artifact_id().to_string(),
+                name: t.spec.name.clone(),
+                runtime_type: t.spec.runtime_type.as_str().to_string(),
+                status: task_status_to_public_str(&t.status()).to_string(),
+                execution_count: t.metrics.read().total_executions,
+                created_at: system_time_to_timestamp(t.created_at),
+            })
+            .collect();
+        tasks.sort_by(|a, b| a.task_id.cmp(&b.task_id));
+        Ok(Response::new(ListTasksResponse { tasks }))
+    }
+}
+
+#[tonic::async_trait]
+impl ExecService for Arc<ExecServiceImpl> {
+    type ExecuteStreamStream = <ExecServiceImpl as ExecService>::ExecuteStreamStream;
+
+    async fn execute(
+        &self,
+        request: Request<InvokeRequest>,
+    ) -> Result<Response<InvokeResponse>, Status> {
+        (**self).execute(request).await
+    }
+
+    async fn execute_stream(
+        &self,
+        request: Request<Streaming<InvokeRequest>>,
+    ) -> Result<Response<Self::ExecuteStreamStream>, Status> {
+        (**self).execute_stream(request).await
+    }
+
+    async fn list_workloads(
+        &self,
+        request: Request<ListWorkloadsRequest>,
+    ) -> Result<Response<ListWorkloadsResponse>, Status> {
+        (**self).list_workloads(request).await
+    }
+
+    async fn list_tasks(
+        &self,
+        request: Request<ListTasksRequest>,
+    ) -> Result<Response<ListTasksResponse>, Status> {
+        (**self).list_tasks(request).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_grpc_timeout_parsing() {
+        let mut md = MetadataMap::new();
+        assert_eq!(grpc_timeout_ms(&md), None);
+        md.insert("grpc-timeout", "2S".parse().unwrap());
+        assert_eq!(grpc_timeout_ms(&md), Some(2000));
+        md.insert("grpc-timeout", "1500m".parse().unwrap());
+        assert_eq!(grpc_timeout_ms(&md), Some(1500));
+        md.insert("grpc-timeout", "10u".parse().unwrap());
+        assert_eq!(grpc_timeout_ms(&md), Some(1));
+        md.insert("grpc-timeout", "bogus".parse().unwrap());
+        assert_eq!(grpc_timeout_ms(&md), None);
+    }
+
+    #[test]
+    fn test_metadata_is_folded_into_request() {
+        let mut md = MetadataMap::new();
+        md.insert("grpc-timeout", "3S".parse().unwrap());
+        md.insert("x-tenant", "acme".parse().unwrap());
+        md.insert("authorization", "Bearer secret".parse().unwrap());
+        md.insert("x-api-key", "secret".parse().unwrap());
+        md.insert("x-client-cert-subject", "CN=controller".parse().unwrap());
+        let mut req = InvokeRequest::default();
+        let credential_keys = vec!["x-client-cert-subject".to_string()];
+        ExecServiceImpl::apply_metadata(&md, &credential_keys, &mut req);
+        assert_eq!(req.timeout_ms, 3000);
+        assert_eq!(
+            req.metadata.get("x-tenant").map(String::as_str),
+            Some("acme")
+        );
+        assert!(!req.metadata.contains_key("authorization"));
+        assert!(!req.metadata.contains_key("x-api-key"));
+        assert!(!req.metadata.contains_key("x-client-cert-subject"));
+        assert!(!req.metadata.contains_key("grpc-timeout"));
+    }
+}
@@ -0,0 +1,361 @@
+//! HTTP streaming for `POST /v1/exec`
+//! `POST /v1/exec` 的 HTTP 流式响应
+//!
+//! Frames the workload writes to its user stream (the outStream) are forwarded to
+//! the HTTP response as they arrive, so curl and browsers can read incremental
+//! LLM / ASR output without a WebSocket client:
+//! 工作负载写入 user stream（outStream）的帧会在到达时转发到 HTTP 响应，curl 与浏览器
+//! 无需 WebSocket 客户端即可读取增量 LLM / ASR 输出：
+//!
+//! - SSE (`Accept: text/event-stream`): one `frame` event per SSF frame, then a
+//!   final `done` event with the execution result
+//!   SSE：每个 SSF 帧一个 `frame` 事件，最后一个 `done` 事件携带执行结果
+//! - chunked: the raw data section of each frame, written as a transfer chunk
+//!   chunked：每帧的 data 段原样作为一个传输分块写出
+//!
+//! The stream is marked connected before the workload starts, so direct writers
+//! never see `ENOTCONN`; the HTTP side is write-only from the guest's point of view.
+//! 流在工作负载启动前即标记为已连接，直接写入的客户代码不会遇到 `ENOTCONN`；
+//! 对客户代码而言 HTTP 侧只读不写。
+
+use std::convert::Infallible;
+use std::sync::Arc;
+use std::time::Duration;
+
+use axum::body::{Body, Bytes};
+use axum::http::{header, HeaderValue};
+use axum::response::sse::{Event, KeepAlive, Sse};
+use axum::response::{IntoResponse, Response};
+use base64::{engine::general_purpose, Engine as _};
+use futures::StreamExt;
+use tokio::sync::mpsc;
+use tokio_stream::wrappers::ReceiverStream;
+use tracing::debug;
+
+use crate::proto::spearlet::{
+    execution_service_client::ExecutionServiceClient, Error as ProtoError, ExecutionStatus,
+    GetExecutionRequest, Payload,
+};
+use crate::spearlet::clock;
+use crate::spearlet::execution::host_api::{ssf, UserStreams};
+use crate::spearlet::grpc_auth::LocalChannel;
+
+/// Response header carrying the execution id / 携带执行 ID 的响应头
+pub const EXECUTION_ID_HEADER: &str = "x-spear-execution-id";
+
+/// Default user stream bridged to HTTP / 默认桥接到 HTTP 的 user stream
+pub const DEFAULT_STREAM_ID: u32 = 1;
+
+const STATUS_POLL_INTERVAL: Duration = Duration::from_millis(250);
+
+/// HTTP streaming mode / HTTP 流式模式
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ExecStreamMode {
+    Sse,
+    Chunked,
+}
+
+impl ExecStreamMode {
+    /// Pick a mode from the body option and the `Accept` header
+    /// 根据请求体选项与 `Accept` 头选择模式
+    ///
+    /// Returns `Ok(None)` for the WebSocket (`stream_url`) flow.
+    /// 返回 `Ok(None)` 表示 WebSocket（`stream_url`）模式。
+    pub fn select(mode: Option<&str>, accept: Option<&str>) -> Result<Option<Self>, String> {
+        match mode.map(|m| m.trim().to_ascii_lowercase()).as_deref() {
+            Some("sse") => return Ok(Some(Self::Sse)),
+            Some("chunked") => return Ok(Some(Self::Chunked)),
+            Some("ws") | Some("") | None => {}
+            Some(other) => return Err(format!("unknown stream mode: {}", other)),
+        }
+        let wants_sse = accept
+            .map(|a| {
+                a.split(',')
+                    .any(|v| v.trim().starts_with("text/event-stream"))
+            })
+            .unwrap_or(false);
+        Ok(if wants_sse { Some(Self::Sse) } else { None })
+    }
+}
+
+/// Mark the bridged stream connected before the workload runs
+/// 在工作负载运行前将桥接流标记为已连接
+pub fn attach(streams: &UserStreams, execution_id: &str, stream_id: u32) {
+    streams
+        .get_or_create(execution_id)
+        .mark_connected(stream_id);
+}
+
+/// Release the bridged streams; the guest sees `EPIPE` afterwards
+/// 释放桥接流；此后客户代码写入会得到 `EPIPE`
+pub fn detach(streams: &UserStreams, execution_id: &str) {
+    streams.map_ws_close_to_channels(execution_id);
+}
+
+/// Execution result carried by the final event / 最终事件携带的执行结果
+#[derive(Debug, Clone)]
+pub struct ExecOutcome {
+    pub status: i32,
+    pub output: Option<Payload>,
+    pub error: Option<ProtoError>,
+}
+
+impl ExecOutcome {
+    pub fn is_terminal(&self) -> bool {
+        is_terminal(self.status)
+    }
+
+    pub(crate) fn to_json(&self, execution_id: &str) -> serde_json::Value {
+        let output = self.output.clone().unwrap_or_default();
+        let output_value = if output.content_type == "application/json" {
+            serde_json::from_slice(&output.data).unwrap_or(serde_json::Value::Null)
+        } else {
+            std::str::from_utf8(&output.data)
+                .map(|s| serde_json::Value::String(s.to_string()))
+                .unwrap_or(serde_json::Value::Null)
+        };
+        serde_json::json!({
+            "success": self.error.is_none()
+                && self.status == ExecutionStatus::Completed as i32,
+            "execution_id": execution_id,
+            "status": status_str(self.status),
+            "output": output_value,
+            "output_base64": general_purpose::STANDARD.encode(&output.data),
+            "error": self
+                .error
+                .as_ref()
+                .map(|e| serde_json::json!({"code": e.code, "message": e.message})),
+        })
+    }
+}
+
+fn is_terminal(status: i32) -> bool {
+    status == ExecutionStatus::Completed as i32
+        || status == ExecutionStatus::Failed as i32
+        || status == ExecutionStatus::Terminated as i32
+        || status == ExecutionStatus::Timeout as i32
+}
+
+fn status_str(status: i32) -> &'static str {
+    match status {
+        x if x == ExecutionStatus::Pending as i32 => "PENDING",
+        x if x == ExecutionStatus::Running as i32 => "RUNNING",
+        x if x == ExecutionStatus::Completed as i32 => "COMPLETED",
+        x if x == ExecutionStatus::Failed as i32 => "FAILED",
+        x if x == ExecutionStatus::Terminated as i32 => "TERMINATED",
+        x if x == ExecutionStatus::Timeout as i32 => "TIMEOUT",
+        _ => "UNSPECIFIED",
+    }
+}
+
+enum StreamItem {
+    Frame(Vec<u8>),
+    Done(serde_json::Value),
+}
+
+/// Build the streaming response for a started execution / 为已启动的执行构建流式响应
+pub fn respond(
+    streams: Arc<UserStreams>,
+    mode: ExecStreamMode,
+    execution_id: String,
+    stream_id: u32,
+    initial: ExecOutcome,
+    client: ExecutionServiceClient<LocalChannel>,
+) -> Response {
+    let (tx, rx) = mpsc::channel::<StreamItem>(64);
+    crate::spearlet::crash::spawn(
+        "exec-stream",
+        pump(
+            streams,
+            execution_id.clone(),
+            stream_id,
+            initial,
+            client,
+            tx,
+        ),
+    );
+    let items = ReceiverStream::new(rx);
+
+    let mut resp = match mode {
+        ExecStreamMode::Sse => {
+            let events = items.map(|item| {
+                Ok::<_, Infallible>(match item {
+                    StreamItem::Frame(frame) => {
+                        let mut v = frame_json(&frame);
+                        clock::stamp(&mut v);
+                        Event::default().event("frame").data(v.to_string())
+                    }
+                    StreamItem::Done(mut v) => {
+                        clock::stamp(&mut v);
+                        Event::default().event("done").data(v.to_string())
+                    }
+                })
+            });
+            Sse::new(events)
+                .keep_alive(KeepAlive::default())
+                .into_response()
+        }
+        ExecStreamMode::Chunked => {
+            let chunks = items.filter_map(|item| async move {
+                match item {
+                    StreamItem::Frame(frame) => ssf::split_ssf_v1_frame(&frame)
+                        .ok()
+                        .filter(|(_, _, _, data)| !data.is_empty())
+                        .map(|(_, _, _, data)| Ok::<_, Infallible>(Bytes::from(data.to_vec()))),
+                    StreamItem::Done(_) => None,
+                }
+            });
+            let mut resp = Body::from_stream(chunks).into_response();
+            resp.headers_mut().insert(
+                header::CONTENT_TYPE,
+                HeaderValue::from_static("application/octet-stream"),
+            );
+            resp
+        }
+    };
+    if let Ok(v) = HeaderValue::from_str(&execution_id) {
+        resp.headers_mut().insert(EXECUTION_ID_HEADER, v);
+    }
+    resp
+}
+
+async fn pump(
+    streams: Arc<UserStreams>,
+    execution_id: String,
+    stream_id: u32,
+    initial: ExecOutcome,
+    mut client: ExecutionServiceClient<LocalChannel>,
+    tx: mpsc::Sender<StreamItem>,
+) {
+    let mut outcome = initial.is_terminal().then_some(initial);
+    let mut ctl_announced = false;
+    let mut poll = tokio::time::interval(STATUS_POLL_INTERVAL);
+    loop {
+        while let Some(frame) = streams.ws_pop_any_outbound(&execution_id) {
+            if tx.send(StreamItem::Frame(frame)).await.is_err() {
+                debug!(execution_id = %execution_id, "http stream client went away");
+                detach(&streams, &execution_id);
+                return;
+            }
+        }
+        if let Some(o) = outcome.take() {
+            let _ = tx.send(StreamItem::Done(o.to_json(&execution_id))).await;
+            break;
+        }
+
+        tokio::select! {
+            _ = streams.ws_wait_any_outbound(&execution_id) => {}
+            _ = tx.closed() => {
+                detach(&streams, &execution_id);
+                return;
+            }
+            _ = poll.tick() => {
+                // Guests that wait on the ctl fd opened it after `attach`; announce once more
+                // 等待 ctl fd 的客户代码在 `attach` 之后才打开它；再通知一次
+                if !ctl_announced {
+                    if let Some(hub) = streams.get(&execution_id) {
+                        if hub.has_ctl_fds() {
+                            hub.mark_connected(stream_id);
+                            ctl_announced = true;
+                        }
+                    }
+                }
+                outcome = poll_outcome(&mut client, &execution_id).await;
+            }
+        }
+    }
+    detach(&streams, &execution_id);
+}
+
+/// Terminal outcome of an execution, `None` while it is still running
+/// 执行的终态结果，仍在运行时返回 `None`
+pub(crate) async fn poll_outcome(
+    client: &mut ExecutionServiceClient<LocalChannel>,
+    execution_id: &str,
+) -> Option<ExecOutcome> {
+    let req = GetExecutionRequest {
+        execution_id: execution_id.to_string(),
+        include_output: true,
+    };
+    match client.get_execution(req).await {
+        Ok(r) => {
+            let e = r.into_inner();
+            let o = ExecOutcome {
+                status: e.status,
+                output: e.output,
+                error: e.error,
+            };
+            o.is_terminal().then_some(o)
+        }
+        // Records are dropped once the execution is gone / 执行结束后记录可能已被清理
+        Err(s) if s.code() == tonic::Code::NotFound => Some(ExecOutcome {
+            status: ExecutionStatus::Completed as i32,
+            output: None,
+            error: None,
+        }),
+        Err(_) => None,
+    }
+}
+
+/// JSON body of a `frame` event / `frame` 事件的 JSON 内容
+pub(crate) fn frame_json(frame: &[u8]) -> serde_json::Value {
+    let Ok((stream_id, msg_type, meta, data)) = ssf::split_ssf_v1_frame(frame) else {
+        return serde_json::json!({
+            "data_base64": general_purpose::STANDARD.encode(frame),
+        });
+    };
+    let meta = if meta.is_empty() {
+        serde_json::Value::Null
+    } else {
+        serde_json::from_slice(meta).unwrap_or_else(|_| {
+            serde_json::Value::String(String::from_utf8_lossy(meta).into_owned())
+        })
+    };
+    let mut v = serde_json::json!({
+        "stream_id": stream_id,
+        "msg_type": msg_type,
+        "meta": meta,
+    });
+    match std::str::from_utf8(data) {
+        Ok(s) => v["data"] = serde_json::Value::String(s.to_string()),
+        Err(_) => {
+            v["data_base64"] = serde_json::Value::String(general_purpose::STANDARD.encode(data))
+        }
+    }
+    v
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_select_mode() {
+        assert_eq!(ExecStreamMode::select(None, None), Ok(None));
+        assert_eq!(
+            ExecStreamMode::select(None, Some("application/json, text/event-stream")),
+            Ok(Some(ExecStreamMode::Sse))
+        );
+        assert_eq!(
+            ExecStreamMode::select(Some("chunked"), Some("text/event-stream")),
+            Ok(Some(ExecStreamMode::Chunked))
+        );
+        assert_eq!(ExecStreamMode::select(Some("ws"), None), Ok(None));
+        assert!(ExecStreamMode::select(Some("grpc"), None).is_err());
+    }
+
+    #[test]
+    fn test_frame_json() {
+        let frame = ssf::build_ssf_v1_frame(1, 2, br#"{"seq":3}"#, b"hello");
+        let v = frame_json(&frame);
+        assert_eq!(v["stream_id"], 1);
+        assert_eq!(v["msg_type"], 2);
+        assert_eq!(v["meta"]["seq"], 3);
+        assert_eq!(v["data"], "hello");
+
+        let frame = ssf::build_ssf_v1_frame(1, 2, b"", &[0xff, 0xfe]);
+        let v = frame_json(&frame);
+        assert!(v["meta"].is_null());
+        assert_eq!(v["data_base64"], "//4=");
+    }
+}
@@ -0,0 +1,852 @@
+//! Anthropic Messages API backend / Anthropic Messages API 后端
+//!
+//! Serves `chat_completions` from Claude models. Requests arrive in the OpenAI shape every
+//! chat hostcall uses and are rewritten for `POST /v1/messages`: system messages become the
+//! `system` field, tool calls and tool results become `tool_use` and `tool_result` blocks, and
+//! `max_tokens`, which Anthropic requires, defaults to `DEFAULT_MAX_TOKENS`. Answers, streamed
+//! events included, are turned back into `chat.completion` objects and chunks, so workloads
+//! and the tool loop see no difference from an OpenAI backend.
+//! 使用 Claude 模型提供 `chat_completions`。请求以所有 chat hostcall 使用的 OpenAI 形式到达，并被改写为
+//! `POST /v1/messages`：system 消息变为 `system` 字段，工具调用与工具结果变为 `tool_use` 与
+//! `tool_result` 块，Anthropic 必需的 `max_tokens` 默认为 `DEFAULT_MAX_TOKENS`。应答（包括流式事件）
+//! 被转换回 `chat.completion` 对象与 chunk，因此工作负载与工具循环看不到与 OpenAI 后端的区别。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::chat_stream::{ChatStreamAccumulator, SseDecoder};
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, ChatMessage, Operation,
+    Payload, ResultPayload,
+};
+use crate::spearlet::otel;
+use crate::spearlet::param_keys::{chat as chat_keys, mcp as mcp_keys};
+
+pub const ANTHROPIC_VERSION: &str = "2023-06-01";
+pub const DEFAULT_MAX_TOKENS: u64 = 4096;
+
+/// Params passed to Anthropic unchanged; other OpenAI params have no counterpart and are dropped
+/// 原样传给 Anthropic 的参数；其他 OpenAI 参数没有对应项，被丢弃
+const PASSTHROUGH_PARAMS: &[&str] = &["temperature", "top_p", "top_k", "metadata", "thinking"];
+
+fn invalid_request(req: &CanonicalRequestEnvelope, message: &str) -> CanonicalError {
+    CanonicalError {
+        code: "invalid_request".to_string(),
+        message: message.to_string(),
+        retryable: false,
+        operation: Some(req.operation.clone()),
+    }
+}
+
+pub struct AnthropicMessagesBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+impl AnthropicMessagesBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn messages_url(&self) -> String {
+        let base = self.base_url.trim_end_matches('/');
+        if base.contains("/v1") {
+            format!("{}/messages", base)
+        } else {
+            format!("{}/v1/messages", base)
+        }
+    }
+
+    fn build_messages_body(&self, req: &CanonicalRequestEnvelope) -> Result<Value, CanonicalError> {
+        let Payload::ChatCompletions(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected chat_completions payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        let model = p.model.trim();
+        if model.is_empty() {
+            return Err(invalid_request(req, "missing model"));
+        }
+
+        let mut system: Vec<String> = Vec::new();
+        let mut messages: Vec<Value> = Vec::new();
+        for m in p.messages.iter() {
+            let (role, blocks) = match m.role.as_str() {
+                "system" | "developer" => {
+                    system.push(content_text(&m.content));
+                    continue;
+                }
+                "tool" => ("user", vec![tool_result_block(m)]),
+                "assistant" => ("assistant", assistant_blocks(m)),
+                _ => ("user", content_blocks(&m.content)),
+            };
+            if blocks.is_empty() {
+                continue;
+            }
+            // Consecutive turns of one role are merged / 合并同一角色的连续轮次
+            match messages.last_mut() {
+                Some(last) if last["role"] == role => {
+                    if let Some(arr) = last["content"].as_array_mut() {
+                        arr.extend(blocks);
+                    }
+                }
+                _ => messages.push(json!({ "role": role, "content": blocks })),
+            }
+        }
+        if messages.is_empty() {
+            return Err(invalid_request(req, "missing messages"));
+        }
+
+        let mut body = json!({
+            "model": model,
+            "messages": messages,
+            "max_tokens": DEFAULT_MAX_TOKENS,
+        });
+        if !system.is_empty() {
+            body["system"] = Value::String(system.join("\n\n"));
+        }
+        let tools: Vec<Value> = p.tools.iter().filter_map(tool_definition).collect();
+        if !tools.is_empty() {
+            body["tools"] = Value::Array(tools);
+        }
+
+        for (k, v) in p.params.iter() {
+            if k.starts_with(mcp_keys::param::PREFIX) || chat_keys::is_structural_param_key(k) {
+                continue;
+            }
+            match k.as_str() {
+                "max_tokens" | "max_completion_tokens" => {
+                    if let Some(n) = v.as_u64().filter(|n| *n > 0) {
+                        body["max_tokens"] = json!(n);
+                    }
+                }
+                "stop" => {
+                    let stops = match v {
+                        Value::String(s) => vec![Value::String(s.clone())],
+                        Value::Array(a) => a.clone(),
+                        _ => Vec::new(),
+                    };
+                    if !stops.is_empty() {
+                        body["stop_sequences"] = Value::Array(stops);
+                    }
+                }
+                "tool_choice" => {
+                    if let Some(c) = tool_choice(v) {
+                        body["tool_choice"] = c;
+                    }
+                }
+                "user" => {
+                    if let Some(u) = v.as_str() {
+                        body["metadata"] = json!({ "user_id": u });
+                    }
+                }
+                _ if PASSTHROUGH_PARAMS.contains(&k.as_str()) => {
+                    body[k.as_str()] = v.clone();
+                }
+                _ => {}
+            }
+        }
+        Ok(body)
+    }
+
+    fn extract_error_message(v: &Value) -> Option<String> {
+        let e = v.get("error")?;
+        let ty = e.get("type").and_then(|x| x.as_str()).unwrap_or("");
+        let msg = e.get("message").and_then(|x| x.as_str()).unwrap_or("");
+        match (ty.is_empty(), msg.is_empty()) {
+            (true, true) => None,
+            (false, false) => Some(format!("{}: {}", ty, msg)),
+            (false, true) => Some(ty.to_string()),
+            (true, false) => Some(msg.to_string()),
+        }
+    }
+
+    fn upstream_error(status: u16, body: &[u8]) -> CanonicalError {
+        let extra = serde_json::from_slice::<Value>(body)
+            .ok()
+            .and_then(|v| Self::extract_error_message(&v));
+        CanonicalError {
+            code: "upstream_error".to_string(),
+            message: match extra {
+                Some(m) => format!("upstream status: {}: {}", status, m),
+                None => format!("upstream status: {}", status),
+            },
+            // 529 means overloaded / 529 表示过载
+            retryable: status == 429 || status >= 500,
+            operation: Some(Operation::ChatCompletions),
+        }
+    }
+
+    /// Client span under the calling hostcall / 调用方 hostcall 下的 client span
+    fn client_span(&self) -> otel::Span {
+        let mut span = otel::Span::start(
+            "llm.chat_completions",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "anthropic");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        span
+    }
+
+    fn request(
+        &self,
+        client: &reqwest::Client,
+        body: Vec<u8>,
+        traceparent: Option<String>,
+        timeout: Option<Duration>,
+    ) -> reqwest::RequestBuilder {
+        let mut r = client
+            .post(self.messages_url())
+            .header("content-type", "application/json")
+            .header("anthropic-version", ANTHROPIC_VERSION)
+            .body(body);
+        if let Some(key) = self.api_key.as_deref() {
+            r = r.header("x-api-key", key);
+        }
+        if let Some(tp) = traceparent {
+            r = r.header(otel::TRACEPARENT_KEY, tp);
+        }
+        if let Some(t) = timeout {
+            r = r.timeout(t);
+        }
+        r
+    }
+
+    fn messages(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+        on_event: Option<&mut dyn FnMut(Value)>,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let mut body_json = self.build_messages_body(req)?;
+        if let Some(m) = body_json.get("model").and_then(|v| v.as_str()) {
+            span.set_attr("gen_ai.request.model", m);
+        }
+        let stream = on_event.is_some();
+        if stream {
+            body_json["stream"] = Value::Bool(true);
+        }
+        let body_bytes = serde_json::to_vec(&body_json).map_err(|e| CanonicalError {
+            code: "serialization".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+        let traceparent = span.traceparent();
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::ChatCompletions),
+        };
+
+        let (parsed, raw) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = self.request(&client, body_bytes, traceparent, timeout);
+            if stream {
+                r = r.header("accept", "text/event-stream");
+            }
+            let mut resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            span.set_attr("http.response.status_code", status as i64);
+            if !(200..300).contains(&status) {
+                let body = resp.bytes().await.unwrap_or_default();
+                return Err(Self::upstream_error(status, &body));
+            }
+
+            let Some(on_event) = on_event else {
+                let body = resp.bytes().await.map_err(network_error)?.to_vec();
+                let v = serde_json::from_slice::<Value>(&body).map_err(|e| CanonicalError {
+                    code: "invalid_response".to_string(),
+                    message: e.to_string(),
+                    retryable: false,
+                    operation: Some(Operation::ChatCompletions),
+                })?;
+                return Ok((to_chat_completion(&v), Some(body)));
+            };
+
+            let mut decoder = SseDecoder::default();
+            let mut translator = StreamTranslator::default();
+            let mut acc = ChatStreamAccumulator::default();
+            let mut done = false;
+            while !done {
+                let payloads = match resp.chunk().await.map_err(network_error)? {
+                    Some(b) => decoder.push(&b),
+                    None => {
+                        done = true;
+                        decoder.finish()
+                    }
+                };
+                for data in payloads {
+                    let Ok(event) = serde_json::from_str::<Value>(&data) else {
+                        continue;
+                    };
+                    if event.get("type").and_then(|t| t.as_str()) == Some("message_stop") {
+                        done = true;
+                        break;
+                    }
+                    if let Some(chunk) = translator.chunk(&event)? {
+                        for e in acc.push(&chunk) {
+                            on_event(e);
+                        }
+                    }
+                }
+            }
+            Ok::<_, CanonicalError>((acc.finish(), None))
+        })?;
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(parsed),
+            raw,
+        })
+    }
+}
+
+impl BackendAdapter for AnthropicMessagesBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        self.invoke_with(req, None)
+    }
+
+    fn invoke_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: &mut dyn FnMut(Value),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        self.invoke_with(req, Some(on_event))
+    }
+}
+
+impl AnthropicMessagesBackendAdapter {
+    fn invoke_with(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: Option<&mut dyn FnMut(Value)>,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::ChatCompletions {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "anthropic_messages supports chat_completions only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = self.client_span();
+        span.set_attr("gen_ai.request.stream", on_event.is_some());
+        let out = self.messages(req, &mut span, on_event);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+/// Text of an OpenAI message content / OpenAI 消息内容中的文本
+fn content_text(content: &Value) -> String {
+    match content {
+        Value::String(s) => s.clone(),
+        Value::Array(parts) => parts
+            .iter()
+            .filter_map(|p| p.get("text").and_then(|t| t.as_str()))
+            .collect::<Vec<_>>()
+            .join("\n"),
+        Value::Null => String::new(),
+        other => other.to_string(),
+    }
+}
+
+/// Anthropic content blocks of an OpenAI message content / OpenAI 消息内容对应的 Anthropic 内容块
+fn content_blocks(content: &Value) -> Vec<Value> {
+    let Value::Array(parts) = content else {
+        let text = content_text(content);
+        if text.is_empty() {
+            return Vec::new();
+        }
+        return vec![json!({ "type": "text", "text": text })];
+    };
+    parts
+        .iter()
+        .filter_map(|p| match p.get("type").and_then(|t| t.as_str()) {
+            Some("text") => p
+                .get("text")
+                .and_then(|t| t.as_str())
+                .map(|t| json!({ "type": "text", "text": t })),
+            Some("image_url") => {
+                let url = p
+                    .get("image_url")
+                    .and_then(|u| u.get("url").or(Some(u)))
+                    .and_then(|u| u.as_str())?;
+                Some(image_block(url))
+            }
+            _ => None,
+        })
+        .collect()
+}
+
+/// Image block for a URL or a base64 `data:` URL / URL 或 base64 `data:` URL 对应的图片块
+fn image_block(url: &str) -> Value {
+    if let Some((meta, data)) = url
+        .strip_prefix("data:")
+        .and_then(|rest| rest.split_once(','))
+    {
+        if let Some(media_type) = meta.strip_suffix(";base64") {
+            return json!({
+                "type": "image",
+                "source": { "type": "base64", "media_type": media_type, "data": data },
+            });
+        }
+    }
+    json!({ "type": "image", "source": { "type": "url", "url": url } })
+}
+
+fn assistant_blocks(m: &ChatMessage) -> Vec<Value> {
+    let mut blocks = content_blocks(&m.content);
+    for tc in m.tool_calls.iter().flatten() {
+        let input = serde_json::from_str::<Value>(&tc.function.arguments)
+            .ok()
+            .filter(|v| v.is_object())
+            .unwrap_or_else(|| json!({}));
+        blocks.push(json!({
+            "type": "tool_use",
+            "id": tc.id,
+            "name": tc.function.name,
+            "input": input,
+        }));
+    }
+    blocks
+}
+
+fn tool_result_block(m: &ChatMessage) -> Value {
+    json!({
+        "type": "tool_result",
+        "tool_use_id": m.tool_call_id.clone().unwrap_or_default(),
+        "content": content_text(&m.content),
+    })
+}
+
+/// Anthropic tool for an OpenAI function tool / OpenAI 函数工具对应的 Anthropic 工具
+fn tool_definition(tool: &Value) -> Option<Value> {
+    let f = tool.get("function")?;
+    let name = f.get("name")?.as_str()?;
+    let mut out = json!({
+        "name": name,
+        "input_schema": f
+            .get("parameters")
+            .cloned()
+            .unwrap_or_else(|| json!({ "type": "object", "properties": {} })),
+    });
+    if let Some(d) = f.get("description").and_then(|d| d.as_str()) {
+        out["description"] = Value::String(d.to_string());
+    }
+    Some(out)
+}
+
+fn tool_choice(v: &Value) -> Option<Value> {
+    match v {
+        Value::String(s) => match s.as_str() {
+            "auto" => Some(json!({ "type": "auto" })),
+            "required" => Some(json!({ "type": "any" })),
+            "none" => Some(json!({ "type": "none" })),
+            _ => None,
+        },
+        Value::Object(_) => {
+            let name = v["function"]["name"].as_str()?;
+            Some(json!({ "type": "tool", "name": name }))
+        }
+        _ => None,
+    }
+}
+
+fn finish_reason(stop_reason: &str) -> String {
+    match stop_reason {
+        "end_turn" | "stop_sequence" => "stop",
+        "max_tokens" => "length",
+        "tool_use" => "tool_calls",
+        other => other,
+    }
+    .to_string()
+}
+
+fn openai_usage(input: u64, output: u64) -> Value {
+    json!({
+        "prompt_tokens": input,
+        "completion_tokens": output,
+        "total_tokens": input + output,
+    })
+}
+
+/// `chat.completion` object for a Messages API answer / Messages API 应答对应的 `chat.completion` 对象
+fn to_chat_completion(v: &Value) -> Value {
+    let mut text = String::new();
+    let mut tool_calls: Vec<Value> = Vec::new();
+    for block in v["content"].as_array().into_iter().flatten() {
+        match block["type"].as_str() {
+            Some("text") => text.push_str(block["text"].as_str().unwrap_or("")),
+            Some("tool_use") => tool_calls.push(json!({
+                "id": block["id"],
+                "type": "function",
+                "function": {
+                    "name": block["name"],
+                    "arguments": block["input"].to_string(),
+                },
+            })),
+            _ => {}
+        }
+    }
+    let mut message = json!({ "role": "assistant" });
+    message["content"] = if text.is_empty() && !tool_calls.is_empty() {
+        Value::Null
+    } else {
+        Value::String(text)
+    };
+    if !tool_calls.is_empty() {
+        message["tool_calls"] = Value::Array(tool_calls);
+    }
+    let mut out = json!({
+        "id": v["id"],
+        "object": "chat.completion",
+        "created": chrono::Utc::now().timestamp(),
+        "model": v["model"],
+        "choices": [{
+            "index": 0,
+            "message": message,
+            "finish_reason": v["stop_reason"].as_str().map(finish_reason),
+        }],
+    });
+    if let Some(u) = v.get("usage").filter(|u| u.is_object()) {
+        out["usage"] = openai_usage(
+            u["input_tokens"].as_u64().unwrap_or(0),
+            u["output_tokens"].as_u64().unwrap_or(0),
+        );
+    }
+    out
+}
+
+/// Turns Messages API stream events into `chat.completion.chunk` objects
+/// 将 Messages API 流事件转换为 `chat.completion.chunk` 对象
+#[derive(Debug, Default)]
+struct StreamTranslator {
+    id: String,
+    model: String,
+    created: i64,
+    input_tokens: u64,
+    /// Tool call index of each `tool_use` content block / 每个 `tool_use` 内容块的工具调用下标
+    tool_blocks: Vec<(u64, usize)>,
+}
+
+impl StreamTranslator {
+    fn wrap(&self, delta: Value, finish_reason: Option<String>) -> Value {
+        json!({
+            "id": self.id,
+            "object": "chat.completion.chunk",
+            "created": self.created,
+            "model": self.model,
+            "choices": [{ "index": 0, "delta": delta, "finish_reason": finish_reason }],
+        })
+    }
+
+    fn tool_index(&self, block: u64) -> Option<usize> {
+        self.tool_blocks
+            .iter()
+            .find(|(b, _)| *b == block)
+            .map(|(_, i)| *i)
+    }
+
+    fn chunk(&mut self, event: &Value) -> Result<Option<Value>, CanonicalError> {
+        let block = event["index"].as_u64().unwrap_or(0);
+        let chunk = match event["type"].as_str().unwrap_or("") {
+            "message_start" => {
+                let m = &event["message"];
+                self.id = m["id"].as_str().unwrap_or("").to_string();
+                self.model = m["model"].as_str().unwrap_or("").to_string();
+                self.created = chrono::Utc::now().timestamp();
+                self.input_tokens = m["usage"]["input_tokens"].as_u64().unwrap_or(0);
+                Some(self.wrap(json!({ "role": "assistant" }), None))
+            }
+            "content_block_start" => {
+                let cb = &event["content_block"];
+                match cb["type"].as_str() {
+                    Some("tool_use") => {
+                        let index = self.tool_blocks.len();
+                        self.tool_blocks.push((block, index));
+                        Some(self.wrap(
+                            json!({ "tool_calls": [{
+                                "index": index,
+                                "id": cb["id"],
+                                "type": "function",
+                                "function": { "name": cb["name"], "arguments": "" },
+                            }] }),
+                            None,
+                        ))
+                    }
+                    Some("text") => cb["text"]
+                        .as_str()
+                        .filter(|t| !t.is_empty())
+                        .map(|t| self.wrap(json!({ "content": t }), None)),
+                    _ => None,
+                }
+            }
+            "content_block_delta" => {
+                let d = &event["delta"];
+                match d["type"].as_str() {
+                    Some("text_delta") => d["text"]
+                        .as_str()
+                        .map(|t| self.wrap(json!({ "content": t }), None)),
+                    Some("input_json_delta") => match self.tool_index(block) {
+                        Some(index) => d["partial_json"].as_str().map(|j| {
+                            self.wrap(
+                                json!({ "tool_calls": [{
+                                    "index": index,
+                                    "function": { "arguments": j },
+                                }] }),
+                                None,
+                            )
+                        }),
+                        None => None,
+                    },
+                    // Thinking and signatures are not passed on / 不传递思考内容与签名
+                    _ => None,
+                }
+            }
+            "message_delta" => {
+                let reason = event["delta"]["stop_reason"].as_str().map(finish_reason);
+                let mut c = self.wrap(json!({}), reason);
+                let output = event["usage"]["output_tokens"].as_u64().unwrap_or(0);
+                c["usage"] = openai_usage(self.input_tokens, output);
+                Some(c)
+            }
+            "error" => {
+                return Err(CanonicalError {
+                    code: "upstream_error".to_string(),
+                    message: AnthropicMessagesBackendAdapter::extract_error_message(event)
+                        .unwrap_or_else(|| "stream error".to_string()),
+                    retryable: event["error"]["type"] == "overloaded_error",
+                    operation: Some(Operation::ChatCompletions),
+                });
+            }
+            _ => None,
+        };
+        Ok(chunk)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{
+        ChatCompletionsPayload, RoutingHints, ToolCall, ToolCallFunction,
+    };
+    use axum::{http::HeaderMap, routing::post, Json, Router};
+    use std::collections::HashMap;
+    use tokio::net::TcpListener;
+
+    fn msg(role: &str, content: Value) -> ChatMessage {
+        ChatMessage {
+            role: role.to_string(),
+            content,
+            tool_call_id: None,
+            tool_calls: None,
+            name: None,
+        }
+    }
+
+    fn chat_req(
+        messages: Vec<ChatMessage>,
+        params: HashMap<String, Value>,
+    ) -> CanonicalRequestEnvelope {
+        CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::ChatCompletions,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::ChatCompletions(ChatCompletionsPayload {
+                model: "claude-test".to_string(),
+                messages,
+                tools: vec![json!({
+                    "type": "function",
+                    "function": {
+                        "name": "get_weather",
+                        "description": "Weather by city",
+                        "parameters": {"type": "object", "properties": {"city": {"type": "string"}}},
+                    },
+                })],
+                params,
+            }),
+            extra: HashMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_body_translates_roles_tools_and_params() {
+        let adapter =
+            AnthropicMessagesBackendAdapter::new("claude", "https://api.anthropic.com", None);
+        let mut assistant = msg("assistant", Value::Null);
+        assistant.tool_calls = Some(vec![ToolCall {
+            id: "toolu_1".to_string(),
+            ty: "function".to_string(),
+            function: ToolCallFunction {
+                name: "get_weather".to_string(),
+                arguments: "{\"city\":\"Paris\"}".to_string(),
+            },
+        }]);
+        let mut tool = msg("tool", json!("sunny"));
+        tool.tool_call_id = Some("toolu_1".to_string());
+        let mut params = HashMap::new();
+        params.insert("max_tokens".to_string(), json!(256));
+        params.insert("stop".to_string(), json!("END"));
+        params.insert("tool_choice".to_string(), json!("required"));
+        params.insert("presence_penalty".to_string(), json!(0.5));
+        params.insert(chat_keys::MAX_ITERATIONS.to_string(), json!(4));
+        let req = chat_req(
+            vec![
+                msg("system", json!("Be brief.")),
+                msg("user", json!("Weather in Paris?")),
+                assistant,
+                tool,
+                msg("user", json!("Thanks")),
+            ],
+            params,
+        );
+
+        let body = adapter.build_messages_body(&req).unwrap();
+        assert_eq!(body["system"], "Be brief.");
+        assert_eq!(body["max_tokens"], 256);
+        assert_eq!(body["stop_sequences"], json!(["END"]));
+        assert_eq!(body["tool_choice"], json!({"type": "any"}));
+        assert!(body.get("presence_penalty").is_none());
+        assert!(body.get(chat_keys::MAX_ITERATIONS).is_none());
+        assert_eq!(
+            body["tools"][0]["input_schema"]["properties"]["city"]["type"],
+            "string"
+        );
+
+        let messages = body["messages"].as_array().unwrap();
+        assert_eq!(messages.len(), 3);
+        assert_eq!(messages[1]["content"][0]["type"], "tool_use");
+        assert_eq!(messages[1]["content"][0]["input"]["city"], "Paris");
+        // The tool result and the next user turn form one user message
+        // 工具结果与下一个用户轮次组成一条用户消息
+        assert_eq!(messages[2]["role"], "user");
+        assert_eq!(messages[2]["content"][0]["tool_use_id"], "toolu_1");
+        assert_eq!(messages[2]["content"][1]["text"], "Thanks");
+        assert_eq!(
+            adapter.messages_url(),
+            "https://api.anthropic.com/v1/messages"
+        );
+    }
+
+    #[test]
+    fn test_stream_events_become_chunks() {
+        let events = [
+            json!({"type": "message_start", "message": {"id": "msg_1", "model": "claude-test", "usage": {"input_tokens": 12}}}),
+            json!({"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}),
+            json!({"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "Checking"}}),
+            json!({"type": "content_block_start", "index": 1, "content_block": {"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {}}}),
+            json!({"type": "content_block_delta", "index": 1, "delta": {"type": "input_json_delta", "partial_json": "{\"city\":"}}),
+            json!({"type": "content_block_delta", "index": 1, "delta": {"type": "input_json_delta", "partial_json": "\"Paris\"}"}}),
+            json!({"type": "message_delta", "delta": {"stop_reason": "tool_use"}, "usage": {"output_tokens": 7}}),
+        ];
+        let mut t = StreamTranslator::default();
+        let mut acc = ChatStreamAccumulator::default();
+        let mut guest = Vec::new();
+        for e in events.iter() {
+            if let Some(c) = t.chunk(e).unwrap() {
+                guest.extend(acc.push(&c));
+            }
+        }
+        assert_eq!(guest[0]["content"], "Checking");
+        assert_eq!(guest[1]["name"], "get_weather");
+        let out = acc.finish();
+        let call = &out["choices"][0]["message"]["tool_calls"][0];
+        assert_eq!(call["id"], "toolu_1");
+        assert_eq!(call["function"]["arguments"], "{\"city\":\"Paris\"}");
+        assert_eq!(out["choices"][0]["finish_reason"], "tool_calls");
+        assert_eq!(out["usage"]["total_tokens"], 19);
+
+        let err = t
+            .chunk(
+                &json!({"type": "error", "error": {"type": "overloaded_error", "message": "busy"}}),
+            )
+            .unwrap_err();
+        assert!(err.retryable);
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn test_invoke_returns_openai_like_shape() {
+        let app = Router::new().route(
+            "/v1/messages",
+            post(|headers: HeaderMap, Json(body): Json<Value>| async move {
+                assert_eq!(headers["x-api-key"], "sk-ant");
+                assert_eq!(headers["anthropic-version"], ANTHROPIC_VERSION);
+                assert_eq!(body["max_tokens"], DEFAULT_MAX_TOKENS);
+                Json(json!({
+                    "id": "msg_1",
+                    "model": "claude-test",
+                    "content": [{"type": "text", "text": "ok"}],
+                    "stop_reason": "end_turn",
+                    "usage": {"input_tokens": 3, "output_tokens": 1},
+                }))
+            }),
+        );
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(listener, app).await.unwrap();
+        });
+
+        let adapter = AnthropicMessagesBackendAdapter::new(
+            "claude",
+            format!("http://{}", addr),
+            Some("sk-ant".to_string()),
+        );
+        let req = chat_req(vec![msg("user", json!("hi"))], HashMap::new());
+        let resp = tokio::task::spawn_blocking(move || adapter.invoke(&req))
+            .await
+            .unwrap()
+            .unwrap();
+        let ResultPayload::Payload(v) = resp.result else {
+            panic!("unexpected result");
+        };
+        assert_eq!(v["choices"][0]["message"]["content"], "ok");
+        assert_eq!(v["choices"][0]["finish_reason"], "stop");
+        assert_eq!(v["usage"]["prompt_tokens"], 3);
+    }
+}
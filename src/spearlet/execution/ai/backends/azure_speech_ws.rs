@@ -0,0 +1,147 @@
+//! Azure Speech recognition over websocket / 通过 websocket 的 Azure Speech 识别
+//!
+//! `base_url` is the regional speech endpoint, e.g. `https://eastus.stt.speech.microsoft.com`.
+//! The plan connects to the conversation recognition path; the rt-asr transport adds the
+//! language and speaks the Speech websocket protocol. `model`, when set, is the endpoint
+//! id of a custom speech model.
+//! `base_url` 为区域语音端点，例如 `https://eastus.stt.speech.microsoft.com`。计划连接对话识别路径；
+//! rt-asr 传输层添加语种并使用 Speech websocket 协议通信。设置了 `model` 时，它是自定义语音模型的端点 id。
+
+use crate::spearlet::execution::ai::backends::{websocket_url, BackendAdapter};
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+};
+use crate::spearlet::execution::ai::streaming::{
+    AsrProtocol, StreamingPlan, StreamingWebsocketPlan, WebsocketPlan,
+};
+
+const RECOGNITION_PATH: &str = "/speech/recognition/conversation/cognitiveservices/v1";
+
+pub struct AzureSpeechWsBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key_env: Option<String>,
+}
+
+impl AzureSpeechWsBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key_env: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key_env: api_key_env
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+}
+
+impl BackendAdapter for AzureSpeechWsBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        Err(CanonicalError {
+            code: "unsupported_operation".to_string(),
+            message: format!(
+                "azure_speech_ws is streaming-only; invoke() is unsupported for {:?}",
+                req.operation
+            ),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })
+    }
+
+    fn streaming_plan(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<StreamingPlan, CanonicalError> {
+        if req.operation != Operation::SpeechToText {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "azure_speech_ws only supports speech_to_text streaming".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+
+        let model = match &req.payload {
+            Payload::SpeechToText(p) => p.model.clone(),
+            _ => None,
+        };
+        let mut u = websocket_url(&self.base_url)?;
+        if !u.path().contains("/speech/recognition/") {
+            let path = u.path().trim_end_matches('/').to_string();
+            u.set_path(&format!("{path}{RECOGNITION_PATH}"));
+        }
+
+        let mut headers = Vec::new();
+        if let Some(api_key_env) = self.api_key_env.as_deref() {
+            headers.push((
+                "Ocp-Apim-Subscription-Key".to_string(),
+                format!("${{env:{}}}", api_key_env),
+            ));
+        }
+
+        let mut transcription = serde_json::Map::new();
+        if let Some(m) = model {
+            transcription.insert("model".to_string(), serde_json::Value::String(m));
+        }
+        Ok(StreamingPlan::Websocket(StreamingWebsocketPlan {
+            prepare: Vec::new(),
+            websocket: WebsocketPlan {
+                url: u.to_string(),
+                headers,
+                client_events: vec![serde_json::json!({
+                    "type": "session.update",
+                    "session": {
+                        "input_audio_format": "pcm16",
+                        "input_audio_transcription": transcription,
+                    }
+                })],
+                supports_turn_detection: false,
+                protocol: AsrProtocol::AzureSpeech,
+            },
+        }))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::SpeechToTextPayload;
+
+    #[test]
+    fn streaming_plan_targets_conversation_recognition() {
+        let adapter = AzureSpeechWsBackendAdapter::new(
+            "azure-stt",
+            "https://eastus.stt.speech.microsoft.com",
+            Some("AZURE_SPEECH_KEY".to_string()),
+        );
+        let req = CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::SpeechToText,
+            meta: Default::default(),
+            routing: Default::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::SpeechToText(SpeechToTextPayload { model: None }),
+            extra: Default::default(),
+        };
+        let StreamingPlan::Websocket(p) = adapter.streaming_plan(&req).unwrap();
+        assert_eq!(
+            p.websocket.url,
+            "wss://eastus.stt.speech.microsoft.com/speech/recognition/conversation/cognitiveservices/v1"
+        );
+        assert_eq!(p.websocket.protocol, AsrProtocol::AzureSpeech);
+        assert_eq!(p.websocket.headers[0].1, "${env:AZURE_SPEECH_KEY}");
+    }
+}
@@ -0,0 +1,151 @@
+//! Deepgram live transcription over websocket / 通过 websocket 的 Deepgram 实时转写
+//!
+//! The plan connects to `/v1/listen`; the rt-asr transport adds the model, language and
+//! audio format to the query and speaks the Deepgram protocol.
+//! 计划连接 `/v1/listen`；rt-asr 传输层将模型、语种与音频格式加入查询参数，并使用 Deepgram 协议通信。
+
+use crate::spearlet::execution::ai::backends::{websocket_url, BackendAdapter};
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+};
+use crate::spearlet::execution::ai::streaming::{
+    AsrProtocol, StreamingPlan, StreamingWebsocketPlan, WebsocketPlan,
+};
+
+const DEFAULT_MODEL: &str = "nova-3";
+
+pub struct DeepgramListenWsBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key_env: Option<String>,
+}
+
+impl DeepgramListenWsBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key_env: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key_env: api_key_env
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+}
+
+impl BackendAdapter for DeepgramListenWsBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        Err(CanonicalError {
+            code: "unsupported_operation".to_string(),
+            message: format!(
+                "deepgram_listen_ws is streaming-only; invoke() is unsupported for {:?}",
+                req.operation
+            ),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })
+    }
+
+    fn streaming_plan(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<StreamingPlan, CanonicalError> {
+        if req.operation != Operation::SpeechToText {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "deepgram_listen_ws only supports speech_to_text streaming".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+
+        let model = match &req.payload {
+            Payload::SpeechToText(p) => p.model.clone(),
+            _ => None,
+        }
+        .unwrap_or_else(|| DEFAULT_MODEL.to_string());
+        let mut u = websocket_url(&self.base_url)?;
+        let mut path = u.path().trim_end_matches('/').to_string();
+        if !path.ends_with("/v1") {
+            path = format!("{path}/v1");
+        }
+        u.set_path(&format!("{path}/listen"));
+
+        let mut headers = Vec::new();
+        if let Some(api_key_env) = self.api_key_env.as_deref() {
+            headers.push((
+                "authorization".to_string(),
+                format!("Token ${{env:{}}}", api_key_env),
+            ));
+        }
+
+        Ok(StreamingPlan::Websocket(StreamingWebsocketPlan {
+            prepare: Vec::new(),
+            websocket: WebsocketPlan {
+                url: u.to_string(),
+                headers,
+                client_events: vec![serde_json::json!({
+                    "type": "session.update",
+                    "session": {
+                        "input_audio_format": "pcm16",
+                        "input_audio_transcription": {
+                            "model": model,
+                        },
+                    }
+                })],
+                supports_turn_detection: false,
+                protocol: AsrProtocol::Deepgram,
+            },
+        }))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::SpeechToTextPayload;
+
+    #[test]
+    fn streaming_plan_targets_listen_endpoint() {
+        let adapter = DeepgramListenWsBackendAdapter::new(
+            "dg",
+            "https://api.deepgram.com",
+            Some("DEEPGRAM_API_KEY".to_string()),
+        );
+        let req = CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::SpeechToText,
+            meta: Default::default(),
+            routing: Default::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::SpeechToText(SpeechToTextPayload { model: None }),
+            extra: Default::default(),
+        };
+        let StreamingPlan::Websocket(p) = adapter.streaming_plan(&req).unwrap();
+        assert_eq!(p.websocket.url, "wss://api.deepgram.com/v1/listen");
+        assert_eq!(p.websocket.protocol, AsrProtocol::Deepgram);
+        assert_eq!(
+            p.websocket.headers,
+            vec![(
+                "authorization".to_string(),
+                "Token ${env:DEEPGRAM_API_KEY}".to_string()
+            )]
+        );
+        assert_eq!(
+            p.websocket.client_events[0]["session"]["input_audio_transcription"]["model"],
+            DEFAULT_MODEL
+        );
+    }
+}
@@ -0,0 +1,889 @@
+//! Google Gemini `generateContent` backend / Google Gemini `generateContent` 后端
+//!
+//! Serves `chat_completions`, images included, from Gemini models. Requests arrive in the
+//! OpenAI shape every chat hostcall uses and are rewritten for
+//! `POST /v1beta/models/{model}:generateContent`: system messages become `systemInstruction`,
+//! assistant turns use the `model` role, image parts become `inline_data` or `file_data`, and
+//! tool calls and tool results become `functionCall` and `functionResponse` parts. Answers,
+//! streamed ones included, are turned back into `chat.completion` objects and chunks, so
+//! workloads and the tool loop see no difference from an OpenAI backend.
+//! 使用 Gemini 模型提供 `chat_completions`（含图片）。请求以所有 chat hostcall 使用的 OpenAI 形式到达，
+//! 并被改写为 `POST /v1beta/models/{model}:generateContent`：system 消息变为 `systemInstruction`，
+//! assistant 轮次使用 `model` 角色，图片部分变为 `inline_data` 或 `file_data`，工具调用与工具结果变为
+//! `functionCall` 与 `functionResponse` 部分。应答（包括流式应答）被转换回 `chat.completion` 对象与
+//! chunk，因此工作负载与工具循环看不到与 OpenAI 后端的区别。
+
+use serde_json::{json, Map, Value};
+use std::collections::HashMap;
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::chat_stream::{ChatStreamAccumulator, SseDecoder};
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, ChatMessage, Operation,
+    Payload, ResultPayload,
+};
+use crate::spearlet::otel;
+use crate::spearlet::param_keys::{chat as chat_keys, mcp as mcp_keys};
+
+pub const DEFAULT_BASE_URL: &str = "https://generativelanguage.googleapis.com";
+
+/// OpenAI params and their `generationConfig` fields; other params have no counterpart and are dropped
+/// OpenAI 参数及其对应的 `generationConfig` 字段；其他参数没有对应项，被丢弃
+const GENERATION_PARAMS: &[(&str, &str)] = &[
+    ("temperature", "temperature"),
+    ("top_p", "topP"),
+    ("top_k", "topK"),
+    ("seed", "seed"),
+    ("presence_penalty", "presencePenalty"),
+    ("frequency_penalty", "frequencyPenalty"),
+];
+
+/// JSON Schema keywords Gemini rejects in function parameters / Gemini 在函数参数中拒绝的 JSON Schema 关键字
+const UNSUPPORTED_SCHEMA_KEYS: &[&str] = &["$schema", "$id", "additionalProperties"];
+
+/// URL of a model method, e.g. `generateContent` / 模型方法（如 `generateContent`）的 URL
+///
+/// `base_url` may carry the API version (`.../v1beta`); `v1beta` is used otherwise.
+/// `base_url` 可以带有 API 版本（`.../v1beta`）；否则使用 `v1beta`。
+pub(crate) fn model_url(base_url: &str, model: &str, method: &str) -> String {
+    let base = base_url.trim_end_matches('/');
+    let model = model.trim().trim_start_matches("models/");
+    if base.contains("/v1") {
+        format!("{}/models/{}:{}", base, model, method)
+    } else {
+        format!("{}/v1beta/models/{}:{}", base, model, method)
+    }
+}
+
+fn extract_error_message(v: &Value) -> Option<String> {
+    let e = v.get("error")?;
+    let status = e.get("status").and_then(|x| x.as_str()).unwrap_or("");
+    let msg = e.get("message").and_then(|x| x.as_str()).unwrap_or("");
+    match (status.is_empty(), msg.is_empty()) {
+        (true, true) => None,
+        (false, false) => Some(format!("{}: {}", status, msg)),
+        (false, true) => Some(status.to_string()),
+        (true, false) => Some(msg.to_string()),
+    }
+}
+
+pub(crate) fn upstream_error(status: u16, body: &[u8], operation: Operation) -> CanonicalError {
+    let extra = serde_json::from_slice::<Value>(body)
+        .ok()
+        .and_then(|v| extract_error_message(&v));
+    CanonicalError {
+        code: "upstream_error".to_string(),
+        message: match extra {
+            Some(m) => format!("upstream status: {}: {}", status, m),
+            None => format!("upstream status: {}", status),
+        },
+        retryable: status == 429 || status >= 500,
+        operation: Some(operation),
+    }
+}
+
+fn invalid_request(req: &CanonicalRequestEnvelope, message: &str) -> CanonicalError {
+    CanonicalError {
+        code: "invalid_request".to_string(),
+        message: message.to_string(),
+        retryable: false,
+        operation: Some(req.operation.clone()),
+    }
+}
+
+pub struct GeminiChatBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+impl GeminiChatBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn build_body(&self, req: &CanonicalRequestEnvelope) -> Result<Value, CanonicalError> {
+        let Payload::ChatCompletions(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected chat_completions payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        if p.model.trim().is_empty() {
+            return Err(invalid_request(req, "missing model"));
+        }
+
+        let mut system: Vec<Value> = Vec::new();
+        let mut contents: Vec<Value> = Vec::new();
+        // Gemini names function results by function, not by call id; ids repeat across turns,
+        // so each result is matched against the calls seen so far
+        // Gemini 按函数名而非调用 id 标识函数结果；id 在不同轮次间会重复，因此每个结果与此前已出现的调用匹配
+        let mut call_names: HashMap<&str, &str> = HashMap::new();
+        for m in p.messages.iter() {
+            for tc in m.tool_calls.iter().flatten() {
+                call_names.insert(tc.id.as_str(), tc.function.name.as_str());
+            }
+            let (role, parts) = match m.role.as_str() {
+                "system" | "developer" => {
+                    system.extend(content_parts(&m.content));
+                    continue;
+                }
+                "tool" => ("user", vec![function_response_part(m, &call_names)]),
+                "assistant" => ("model", model_parts(m)),
+                _ => ("user", content_parts(&m.content)),
+            };
+            if parts.is_empty() {
+                continue;
+            }
+            // Consecutive turns of one role are merged / 合并同一角色的连续轮次
+            match contents.last_mut() {
+                Some(last) if last["role"] == role => {
+                    if let Some(arr) = last["parts"].as_array_mut() {
+                        arr.extend(parts);
+                    }
+                }
+                _ => contents.push(json!({ "role": role, "parts": parts })),
+            }
+        }
+        if contents.is_empty() {
+            return Err(invalid_request(req, "missing messages"));
+        }
+
+        let mut body = json!({ "contents": contents });
+        if !system.is_empty() {
+            body["systemInstruction"] = json!({ "parts": system });
+        }
+        let functions: Vec<Value> = p.tools.iter().filter_map(function_declaration).collect();
+        if !functions.is_empty() {
+            body["tools"] = json!([{ "functionDeclarations": functions }]);
+        }
+
+        let mut generation = Map::new();
+        for (k, v) in p.params.iter() {
+            if k.starts_with(mcp_keys::param::PREFIX) || chat_keys::is_structural_param_key(k) {
+                continue;
+            }
+            match k.as_str() {
+                "max_tokens" | "max_completion_tokens" => {
+                    if let Some(n) = v.as_u64().filter(|n| *n > 0) {
+                        generation.insert("maxOutputTokens".to_string(), json!(n));
+                    }
+                }
+                "stop" => {
+                    let stops = match v {
+                        Value::String(s) => vec![Value::String(s.clone())],
+                        Value::Array(a) => a.clone(),
+                        _ => Vec::new(),
+                    };
+                    if !stops.is_empty() {
+                        generation.insert("stopSequences".to_string(), Value::Array(stops));
+                    }
+                }
+                "response_format" => match v["type"].as_str() {
+                    Some("json_object") => {
+                        generation
+                            .insert("responseMimeType".to_string(), "application/json".into());
+                    }
+                    Some("json_schema") => {
+                        generation
+                            .insert("responseMimeType".to_string(), "application/json".into());
+                        if let Some(s) = v["json_schema"].get("schema") {
+                            generation.insert("responseSchema".to_string(), sanitize_schema(s));
+                        }
+                    }
+                    _ => {}
+                },
+                "tool_choice" => {
+                    if let Some(c) = function_calling_config(v) {
+                        body["toolConfig"] = json!({ "functionCallingConfig": c });
+                    }
+                }
+                other => {
+                    if let Some((_, field)) = GENERATION_PARAMS.iter().find(|(p, _)| *p == other) {
+                        generation.insert(field.to_string(), v.clone());
+                    }
+                }
+            }
+        }
+        if !generation.is_empty() {
+            body["generationConfig"] = Value::Object(generation);
+        }
+        Ok(body)
+    }
+
+    /// Client span under the calling hostcall / 调用方 hostcall 下的 client span
+    fn client_span(&self) -> otel::Span {
+        let mut span = otel::Span::start(
+            "llm.chat_completions",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "gemini");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        span
+    }
+
+    fn generate(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+        on_event: Option<&mut dyn FnMut(Value)>,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let body_json = self.build_body(req)?;
+        let model = match &req.payload {
+            Payload::ChatCompletions(p) => p.model.trim().to_string(),
+            _ => String::new(),
+        };
+        span.set_attr("gen_ai.request.model", model.as_str());
+        let stream = on_event.is_some();
+        let url = if stream {
+            format!(
+                "{}?alt=sse",
+                model_url(&self.base_url, &model, "streamGenerateContent")
+            )
+        } else {
+            model_url(&self.base_url, &model, "generateContent")
+        };
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+        let traceparent = span.traceparent();
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::ChatCompletions),
+        };
+
+        let (parsed, raw) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client.post(url).json(&body_json);
+            if let Some(key) = self.api_key.as_deref() {
+                r = r.header("x-goog-api-key", key);
+            }
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let mut resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            span.set_attr("http.response.status_code", status as i64);
+            if !(200..300).contains(&status) {
+                let body = resp.bytes().await.unwrap_or_default();
+                return Err(upstream_error(status, &body, Operation::ChatCompletions));
+            }
+
+            let Some(on_event) = on_event else {
+                let body = resp.bytes().await.map_err(network_error)?.to_vec();
+                let v = serde_json::from_slice::<Value>(&body).map_err(|e| CanonicalError {
+                    code: "invalid_response".to_string(),
+                    message: e.to_string(),
+                    retryable: false,
+                    operation: Some(Operation::ChatCompletions),
+                })?;
+                return Ok((to_chat_completion(&v, &model), Some(body)));
+            };
+
+            let mut decoder = SseDecoder::default();
+            let mut translator = StreamTranslator::new(&model);
+            let mut acc = ChatStreamAccumulator::default();
+            let mut done = false;
+            while !done {
+                let payloads = match resp.chunk().await.map_err(network_error)? {
+                    Some(b) => decoder.push(&b),
+                    None => {
+                        done = true;
+                        decoder.finish()
+                    }
+                };
+                for data in payloads {
+                    let Ok(event) = serde_json::from_str::<Value>(&data) else {
+                        continue;
+                    };
+                    for chunk in translator.chunks(&event)? {
+                        for e in acc.push(&chunk) {
+                            on_event(e);
+                        }
+                    }
+                }
+            }
+            Ok::<_, CanonicalError>((acc.finish(), None))
+        })?;
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(parsed),
+            raw,
+        })
+    }
+
+    fn invoke_with(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: Option<&mut dyn FnMut(Value)>,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::ChatCompletions {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "gemini_chat supports chat_completions only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = self.client_span();
+        span.set_attr("gen_ai.request.stream", on_event.is_some());
+        let out = self.generate(req, &mut span, on_event);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+impl BackendAdapter for GeminiChatBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        self.invoke_with(req, None)
+    }
+
+    fn invoke_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: &mut dyn FnMut(Value),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        self.invoke_with(req, Some(on_event))
+    }
+}
+
+/// Gemini parts of an OpenAI message content / OpenAI 消息内容对应的 Gemini 部分
+fn content_parts(content: &Value) -> Vec<Value> {
+    match content {
+        Value::String(s) if s.is_empty() => Vec::new(),
+        Value::String(s) => vec![json!({ "text": s })],
+        Value::Null => Vec::new(),
+        Value::Array(parts) => parts
+            .iter()
+            .filter_map(|p| match p.get("type").and_then(|t| t.as_str()) {
+                Some("text") => p
+                    .get("text")
+                    .and_then(|t| t.as_str())
+                    .map(|t| json!({ "text": t })),
+                Some("image_url") => {
+                    let url = p
+                        .get("image_url")
+                        .and_then(|u| u.get("url").or(Some(u)))
+                        .and_then(|u| u.as_str())?;
+                    Some(image_part(url))
+                }
+                _ => None,
+            })
+            .collect(),
+        other => vec![json!({ "text": other.to_string() })],
+    }
+}
+
+/// Image part for a URL or a base64 `data:` URL / URL 或 base64 `data:` URL 对应的图片部分
+fn image_part(url: &str) -> Value {
+    if let Some((meta, data)) = url
+        .strip_prefix("data:")
+        .and_then(|rest| rest.split_once(','))
+    {
+        if let Some(mime_type) = meta.strip_suffix(";base64") {
+            return json!({ "inline_data": { "mime_type": mime_type, "data": data } });
+        }
+    }
+    json!({ "file_data": { "mime_type": image_mime_type(url), "file_uri": url } })
+}
+
+fn image_mime_type(url: &str) -> &'static str {
+    let path = url
+        .split(['?', '#'])
+        .next()
+        .unwrap_or("")
+        .to_ascii_lowercase();
+    match path.rsplit_once('.').map(|(_, ext)| ext) {
+        Some("png") => "image/png",
+        Some("webp") => "image/webp",
+        Some("gif") => "image/gif",
+        Some("heic") => "image/heic",
+        _ => "image/jpeg",
+    }
+}
+
+fn model_parts(m: &ChatMessage) -> Vec<Value> {
+    let mut parts = content_parts(&m.content);
+    for tc in m.tool_calls.iter().flatten() {
+        let args = serde_json::from_str::<Value>(&tc.function.arguments)
+            .ok()
+            .filter(|v| v.is_object())
+            .unwrap_or_else(|| json!({}));
+        parts.push(json!({ "functionCall": { "name": tc.function.name, "args": args } }));
+    }
+    parts
+}
+
+fn function_response_part(m: &ChatMessage, call_names: &HashMap<&str, &str>) -> Value {
+    let name = m
+        .tool_call_id
+        .as_deref()
+        .and_then(|id| call_names.get(id).copied())
+        .or(m.name.as_deref())
+        .unwrap_or("");
+    // The response must be an object / 结果必须是对象
+    let response = match &m.content {
+        Value::String(s) => serde_json::from_str::<Value>(s)
+            .ok()
+            .filter(|v| v.is_object())
+            .unwrap_or_else(|| json!({ "content": s })),
+        Value::Object(_) => m.content.clone(),
+        other => json!({ "content": other }),
+    };
+    json!({ "functionResponse": { "name": name, "response": response } })
+}
+
+/// Drop the JSON Schema keywords Gemini rejects / 去除 Gemini 拒绝的 JSON Schema 关键字
+fn sanitize_schema(v: &Value) -> Value {
+    match v {
+        Value::Object(m) => Value::Object(
+            m.iter()
+                .filter(|(k, _)| !UNSUPPORTED_SCHEMA_KEYS.contains(&k.as_str()))
+                .map(|(k, v)| (k.clone(), sanitize_schema(v)))
+                .collect(),
+        ),
+        Value::Array(a) => Value::Array(a.iter().map(sanitize_schema).collect()),
+        other => other.clone(),
+    }
+}
+
+/// Gemini function declaration for an OpenAI function tool / OpenAI 函数工具对应的 Gemini 函数声明
+fn function_declaration(tool: &Value) -> Option<Value> {
+    let f = tool.get("function")?;
+    let name = f.get("name")?.as_str()?;
+    let mut out = json!({ "name": name });
+    if let Some(d) = f.get("description").and_then(|d| d.as_str()) {
+        out["description"] = Value::String(d.to_string());
+    }
+    // An object without properties is rejected, so parameterless functions omit it
+    // 没有属性的对象会被拒绝，因此无参数的函数省略该字段
+    let params = f
+        .get("parameters")
+        .filter(|p| p["properties"].as_object().is_some_and(|m| !m.is_empty()));
+    if let Some(p) = params {
+        out["parameters"] = sanitize_schema(p);
+    }
+    Some(out)
+}
+
+fn function_calling_config(v: &Value) -> Option<Value> {
+    match v {
+        Value::String(s) => match s.as_str() {
+            "auto" => Some(json!({ "mode": "AUTO" })),
+            "required" => Some(json!({ "mode": "ANY" })),
+            "none" => Some(json!({ "mode": "NONE" })),
+            _ => None,
+        },
+        Value::Object(_) => {
+            let name = v["function"]["name"].as_str()?;
+            Some(json!({ "mode": "ANY", "allowedFunctionNames": [name] }))
+        }
+        _ => None,
+    }
+}
+
+fn finish_reason(reason: &str, has_calls: bool) -> String {
+    match reason {
+        "STOP" if has_calls => "tool_calls",
+        "STOP" => "stop",
+        "MAX_TOKENS" => "length",
+        "SAFETY" | "RECITATION" | "BLOCKLIST" | "PROHIBITED_CONTENT" | "SPII" | "IMAGE_SAFETY" => {
+            "content_filter"
+        }
+        other => return other.to_ascii_lowercase(),
+    }
+    .to_string()
+}
+
+fn openai_usage(u: &Value) -> Value {
+    let prompt = u["promptTokenCount"].as_u64().unwrap_or(0);
+    // Thinking tokens are billed as output / 思考 token 按输出计费
+    let completion = u["candidatesTokenCount"].as_u64().unwrap_or(0)
+        + u["thoughtsTokenCount"].as_u64().unwrap_or(0);
+    json!({
+        "prompt_tokens": prompt,
+        "completion_tokens": completion,
+        "total_tokens": u["totalTokenCount"].as_u64().unwrap_or(prompt + completion),
+    })
+}
+
+/// Answer parts other than thoughts / 除思考外的应答部分
+fn answer_parts(v: &Value) -> impl Iterator<Item = &Value> {
+    v["candidates"][0]["content"]["parts"]
+        .as_array()
+        .into_iter()
+        .flatten()
+        .filter(|p| p["thought"] != true)
+}
+
+fn tool_call(part: &Value, index: usize) -> Value {
+    let call = &part["functionCall"];
+    let id = call["id"]
+        .as_str()
+        .map(str::to_string)
+        .unwrap_or_else(|| format!("call_{}", index));
+    json!({
+        "id": id,
+        "type": "function",
+        "function": { "name": call["name"], "arguments": call["args"].to_string() },
+    })
+}
+
+/// `chat.completion` object for a `generateContent` answer / `generateContent` 应答对应的 `chat.completion` 对象
+fn to_chat_completion(v: &Value, model: &str) -> Value {
+    let mut text = String::new();
+    let mut tool_calls: Vec<Value> = Vec::new();
+    for part in answer_parts(v) {
+        if let Some(t) = part["text"].as_str() {
+            text.push_str(t);
+        } else if part.get("functionCall").is_some() {
+            tool_calls.push(tool_call(part, tool_calls.len()));
+        }
+    }
+    let reason = match v["candidates"][0]["finishReason"].as_str() {
+        Some(r) => Some(finish_reason(r, !tool_calls.is_empty())),
+        // A blocked prompt yields no candidate / 被拦截的提示不产生候选
+        None if v["promptFeedback"].get("blockReason").is_some() => {
+            Some("content_filter".to_string())
+        }
+        None => None,
+    };
+    let mut message = json!({ "role": "assistant" });
+    message["content"] = if text.is_empty() && !tool_calls.is_empty() {
+        Value::Null
+    } else {
+        Value::String(text)
+    };
+    if !tool_calls.is_empty() {
+        message["tool_calls"] = Value::Array(tool_calls);
+    }
+    let mut out = json!({
+        "id": v["responseId"].as_str().unwrap_or(""),
+        "object": "chat.completion",
+        "created": chrono::Utc::now().timestamp(),
+        "model": v["modelVersion"].as_str().unwrap_or(model),
+        "choices": [{ "index": 0, "message": message, "finish_reason": reason }],
+    });
+    if let Some(u) = v.get("usageMetadata").filter(|u| u.is_object()) {
+        out["usage"] = openai_usage(u);
+    }
+    out
+}
+
+/// Turns streamed `generateContent` answers into `chat.completion.chunk` objects
+/// 将流式 `generateContent` 应答转换为 `chat.completion.chunk` 对象
+#[derive(Debug, Default)]
+struct StreamTranslator {
+    id: String,
+    model: String,
+    created: i64,
+    started: bool,
+    tool_calls: usize,
+}
+
+impl StreamTranslator {
+    fn new(model: &str) -> Self {
+        Self {
+            model: model.to_string(),
+            created: chrono::Utc::now().timestamp(),
+            ..Default::default()
+        }
+    }
+
+    fn wrap(&self, delta: Value, finish_reason: Option<String>) -> Value {
+        json!({
+            "id": self.id,
+            "object": "chat.completion.chunk",
+            "created": self.created,
+            "model": self.model,
+            "choices": [{ "index": 0, "delta": delta, "finish_reason": finish_reason }],
+        })
+    }
+
+    fn chunks(&mut self, event: &Value) -> Result<Vec<Value>, CanonicalError> {
+        if event.get("error").is_some() {
+            let status = event["error"]["code"].as_u64().unwrap_or(0);
+            return Err(CanonicalError {
+                code: "upstream_error".to_string(),
+                message: extract_error_message(event).unwrap_or_else(|| "stream error".to_string()),
+                retryable: status == 429 || status >= 500,
+                operation: Some(Operation::ChatCompletions),
+            });
+        }
+        let mut out = Vec::new();
+        if !self.started {
+            self.started = true;
+            if let Some(id) = event["responseId"].as_str() {
+                self.id = id.to_string();
+            }
+            if let Some(m) = event["modelVersion"].as_str() {
+                self.model = m.to_string();
+            }
+            out.push(self.wrap(json!({ "role": "assistant" }), None));
+        }
+        for part in answer_parts(event) {
+            if let Some(t) = part["text"].as_str().filter(|t| !t.is_empty()) {
+                out.push(self.wrap(json!({ "content": t }), None));
+            } else if part.get("functionCall").is_some() {
+                // Function calls arrive whole / 函数调用整体到达
+                let mut call = tool_call(part, self.tool_calls);
+                call["index"] = json!(self.tool_calls);
+                self.tool_calls += 1;
+                out.push(self.wrap(json!({ "tool_calls": [call] }), None));
+            }
+        }
+        let reason = event["candidates"][0]["finishReason"]
+            .as_str()
+            .map(|r| finish_reason(r, self.tool_calls > 0));
+        let usage = event.get("usageMetadata").filter(|u| u.is_object());
+        if reason.is_some() || usage.is_some() {
+            let mut c = self.wrap(json!({}), reason);
+            if let Some(u) = usage {
+                c["usage"] = openai_usage(u);
+            }
+            out.push(c);
+        }
+        Ok(out)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{
+        ChatCompletionsPayload, RoutingHints, ToolCall, ToolCallFunction,
+    };
+    use axum::{http::HeaderMap, routing::post, Json, Router};
+    use tokio::net::TcpListener;
+
+    fn msg(role: &str, content: Value) -> ChatMessage {
+        ChatMessage {
+            role: role.to_string(),
+            content,
+            tool_call_id: None,
+            tool_calls: None,
+            name: None,
+        }
+    }
+
+    fn chat_req(
+        messages: Vec<ChatMessage>,
+        params: HashMap<String, Value>,
+    ) -> CanonicalRequestEnvelope {
+        CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::ChatCompletions,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::ChatCompletions(ChatCompletionsPayload {
+                model: "gemini-2.0-flash".to_string(),
+                messages,
+                tools: vec![json!({
+                    "type": "function",
+                    "function": {
+                        "name": "get_weather",
+                        "description": "Weather by city",
+                        "parameters": {
+                            "type": "object",
+                            "properties": {"city": {"type": "string"}},
+                            "additionalProperties": false,
+                        },
+                    },
+                })],
+                params,
+            }),
+            extra: HashMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_body_translates_roles_images_tools_and_params() {
+        let adapter = GeminiChatBackendAdapter::new("gemini", DEFAULT_BASE_URL, None);
+        let mut assistant = msg("assistant", Value::Null);
+        assistant.tool_calls = Some(vec![ToolCall {
+            id: "call_0".to_string(),
+            ty: "function".to_string(),
+            function: ToolCallFunction {
+                name: "get_weather".to_string(),
+                arguments: "{\"city\":\"Paris\"}".to_string(),
+            },
+        }]);
+        let mut tool = msg("tool", json!("sunny"));
+        tool.tool_call_id = Some("call_0".to_string());
+        let mut params = HashMap::new();
+        params.insert("max_tokens".to_string(), json!(256));
+        params.insert("top_p".to_string(), json!(0.9));
+        params.insert("stop".to_string(), json!("END"));
+        params.insert("tool_choice".to_string(), json!("required"));
+        params.insert("logprobs".to_string(), json!(true));
+        params.insert(chat_keys::MAX_ITERATIONS.to_string(), json!(4));
+        let req = chat_req(
+            vec![
+                msg("system", json!("Be brief.")),
+                msg(
+                    "user",
+                    json!([
+                        {"type": "text", "text": "Weather here?"},
+                        {"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBOR"}},
+                    ]),
+                ),
+                assistant,
+                tool,
+                msg("user", json!("Thanks")),
+            ],
+            params,
+        );
+
+        let body = adapter.build_body(&req).unwrap();
+        assert_eq!(body["systemInstruction"]["parts"][0]["text"], "Be brief.");
+        let gen = &body["generationConfig"];
+        assert_eq!(gen["maxOutputTokens"], 256);
+        assert_eq!(gen["topP"], 0.9);
+        assert_eq!(gen["stopSequences"], json!(["END"]));
+        assert!(gen.get("logprobs").is_none());
+        assert!(gen.get(chat_keys::MAX_ITERATIONS).is_none());
+        assert_eq!(body["toolConfig"]["functionCallingConfig"]["mode"], "ANY");
+        let decl = &body["tools"][0]["functionDeclarations"][0];
+        assert_eq!(decl["parameters"]["properties"]["city"]["type"], "string");
+        assert!(decl["parameters"].get("additionalProperties").is_none());
+
+        let contents = body["contents"].as_array().unwrap();
+        assert_eq!(contents.len(), 3);
+        assert_eq!(
+            contents[0]["parts"][1]["inline_data"]["mime_type"],
+            "image/png"
+        );
+        assert_eq!(contents[1]["role"], "model");
+        assert_eq!(
+            contents[1]["parts"][0]["functionCall"]["args"]["city"],
+            "Paris"
+        );
+        // The function result and the next user turn form one user turn
+        // 函数结果与下一个用户轮次组成一个用户轮次
+        let result = &contents[2]["parts"][0]["functionResponse"];
+        assert_eq!(result["name"], "get_weather");
+        assert_eq!(result["response"]["content"], "sunny");
+        assert_eq!(contents[2]["parts"][1]["text"], "Thanks");
+
+        assert_eq!(
+            model_url(DEFAULT_BASE_URL, "models/gemini-2.0-flash", "generateContent"),
+            "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.0-flash:generateContent"
+        );
+    }
+
+    #[test]
+    fn test_stream_events_become_chunks() {
+        let events = [
+            json!({"responseId": "r-1", "modelVersion": "gemini-2.0-flash",
+                   "candidates": [{"content": {"role": "model", "parts": [{"text": "Checking"}]}}]}),
+            json!({"candidates": [{"content": {"role": "model", "parts": [
+                       {"functionCall": {"name": "get_weather", "args": {"city": "Paris"}}}]},
+                   "finishReason": "STOP"}],
+                   "usageMetadata": {"promptTokenCount": 12, "candidatesTokenCount": 7, "totalTokenCount": 19}}),
+        ];
+        let mut t = StreamTranslator::new("gemini-2.0-flash");
+        let mut acc = ChatStreamAccumulator::default();
+        let mut guest = Vec::new();
+        for e in events.iter() {
+            for c in t.chunks(e).unwrap() {
+                guest.extend(acc.push(&c));
+            }
+        }
+        assert_eq!(guest[0]["content"], "Checking");
+        assert_eq!(guest[1]["name"], "get_weather");
+        let out = acc.finish();
+        let call = &out["choices"][0]["message"]["tool_calls"][0];
+        assert_eq!(call["id"], "call_0");
+        assert_eq!(call["function"]["arguments"], "{\"city\":\"Paris\"}");
+        assert_eq!(out["choices"][0]["finish_reason"], "tool_calls");
+        assert_eq!(out["usage"]["total_tokens"], 19);
+
+        let err = t
+            .chunks(&json!({"error": {"code": 503, "status": "UNAVAILABLE", "message": "busy"}}))
+            .unwrap_err();
+        assert!(err.retryable);
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn test_invoke_returns_openai_like_shape() {
+        let app = Router::new().route(
+            "/v1beta/models/{method}",
+            post(|headers: HeaderMap, Json(body): Json<Value>| async move {
+                assert_eq!(headers["x-goog-api-key"], "g-key");
+                assert_eq!(body["contents"][0]["parts"][0]["text"], "hi");
+                Json(json!({
+                    "responseId": "r-1",
+                    "modelVersion": "gemini-2.0-flash",
+                    "candidates": [{
+                        "content": {"role": "model", "parts": [{"text": "ok"}]},
+                        "finishReason": "STOP",
+                    }],
+                    "usageMetadata": {"promptTokenCount": 3, "candidatesTokenCount": 1, "totalTokenCount": 4},
+                }))
+            }),
+        );
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(listener, app).await.unwrap();
+        });
+
+        let adapter = GeminiChatBackendAdapter::new(
+            "gemini",
+            format!("http://{}", addr),
+            Some("g-key".to_string()),
+        );
+        let req = chat_req(vec![msg("user", json!("hi"))], HashMap::new());
+        let resp = tokio::task::spawn_blocking(move || adapter.invoke(&req))
+            .await
+            .unwrap()
+            .unwrap();
+        let ResultPayload::Payload(v) = resp.result else {
+            panic!("unexpected result");
+        };
+        assert_eq!(v["choices"][0]["message"]["content"], "ok");
+        assert_eq!(v["choices"][0]["finish_reason"], "stop");
+        assert_eq!(v["usage"]["prompt_tokens"], 3);
+    }
+}
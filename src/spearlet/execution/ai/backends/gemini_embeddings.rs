@@ -0,0 +1,258 @@
+//! Google Gemini `batchEmbedContents` backend / Google Gemini `batchEmbedContents` 后端
+//!
+//! All inputs of a request go out in one batch, and the answer is shaped like that of
+//! `openai_embeddings`. Gemini reports no token usage for embeddings, so `usage` is null.
+//! 一个请求的所有输入作为一批发送，应答的形式与 `openai_embeddings` 相同。Gemini 不报告 embeddings 的
+//! token 用量，因此 `usage` 为 null。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::gemini_chat::{model_url, upstream_error};
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+use crate::spearlet::otel;
+
+pub struct GeminiEmbeddingsBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+/// Vectors of a `batchEmbedContents` answer / `batchEmbedContents` 应答中的向量
+fn parse_embeddings(body: &Value, inputs: usize) -> Result<Vec<Vec<f32>>, String> {
+    let vectors = body
+        .get("embeddings")
+        .and_then(|d| d.as_array())
+        .ok_or("missing embeddings")?
+        .iter()
+        .map(|e| {
+            e.get("values")
+                .and_then(|v| v.as_array())
+                .ok_or("missing embedding values")?
+                .iter()
+                .map(|x| x.as_f64().map(|f| f as f32).ok_or("non-numeric embedding"))
+                .collect::<Result<Vec<f32>, _>>()
+        })
+        .collect::<Result<Vec<_>, _>>()?;
+    if vectors.len() != inputs {
+        return Err(format!(
+            "{} embeddings for {} inputs",
+            vectors.len(),
+            inputs
+        ));
+    }
+    Ok(vectors)
+}
+
+impl GeminiEmbeddingsBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn build_body(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<(String, Value), CanonicalError> {
+        let invalid = |message: &str| CanonicalError {
+            code: "invalid_request".to_string(),
+            message: message.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        };
+        let Payload::Embeddings(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected embeddings payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        let model = p
+            .model
+            .as_deref()
+            .unwrap_or("")
+            .trim()
+            .trim_start_matches("models/");
+        if model.is_empty() {
+            return Err(invalid("missing model"));
+        }
+        if p.input.is_empty() {
+            return Err(invalid("missing input"));
+        }
+        let requests: Vec<Value> = p
+            .input
+            .iter()
+            .map(|text| {
+                let mut r = json!({
+                    "model": format!("models/{}", model),
+                    "content": { "parts": [{ "text": text }] },
+                });
+                if let Some(d) = p.dimensions {
+                    r["outputDimensionality"] = json!(d);
+                }
+                r
+            })
+            .collect();
+        Ok((model.to_string(), json!({ "requests": requests })))
+    }
+
+    fn embed(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let (model, body_json) = self.build_body(req)?;
+        let inputs = body_json["requests"]
+            .as_array()
+            .map(|a| a.len())
+            .unwrap_or(0);
+        span.set_attr("gen_ai.request.model", model.as_str());
+        span.set_attr("spear.embeddings.inputs", inputs as i64);
+        let traceparent = span.traceparent();
+        let url = model_url(&self.base_url, &model, "batchEmbedContents");
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::Embeddings),
+        };
+
+        let (status_u16, body) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client.post(url).json(&body_json);
+            if let Some(key) = self.api_key.as_deref() {
+                r = r.header("x-goog-api-key", key);
+            }
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            let body = resp.bytes().await.map_err(network_error)?;
+            Ok::<_, CanonicalError>((status, body))
+        })?;
+        span.set_attr("http.response.status_code", status_u16 as i64);
+        if !(200..300).contains(&status_u16) {
+            return Err(upstream_error(status_u16, &body, Operation::Embeddings));
+        }
+        let body: Value = serde_json::from_slice(&body).unwrap_or(Value::Null);
+        let vectors = parse_embeddings(&body, inputs).map_err(|m| CanonicalError {
+            code: "invalid_response".to_string(),
+            message: m,
+            retryable: false,
+            operation: Some(Operation::Embeddings),
+        })?;
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": model,
+                "dimensions": vectors.first().map(|v| v.len()).unwrap_or(0),
+                "data": vectors,
+                "usage": Value::Null,
+            })),
+            raw: None,
+        })
+    }
+}
+
+impl BackendAdapter for GeminiEmbeddingsBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::Embeddings {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports embeddings only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = otel::Span::start(
+            "llm.embeddings",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "gemini");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        let out = self.embed(req, &mut span);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{EmbeddingsPayload, RoutingHints};
+    use std::collections::HashMap;
+
+    #[test]
+    fn test_batch_body_and_vectors() {
+        let adapter = GeminiEmbeddingsBackendAdapter::new(
+            "gemini-embed",
+            "https://generativelanguage.googleapis.com",
+            None,
+        );
+        let req = CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::Embeddings,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::Embeddings(EmbeddingsPayload {
+                input: vec!["a".to_string(), "b".to_string()],
+                model: Some("models/text-embedding-004".to_string()),
+                dimensions: Some(256),
+            }),
+            extra: HashMap::new(),
+        };
+        let (model, body) = adapter.build_body(&req).unwrap();
+        assert_eq!(model, "text-embedding-004");
+        assert_eq!(body["requests"][1]["content"]["parts"][0]["text"], "b");
+        assert_eq!(body["requests"][0]["model"], "models/text-embedding-004");
+        assert_eq!(body["requests"][0]["outputDimensionality"], 256);
+
+        let answer = json!({"embeddings": [{"values": [0.5, 0.5]}, {"values": [1.0, 0.0]}]});
+        assert_eq!(parse_embeddings(&answer, 2).unwrap()[1], vec![1.0, 0.0]);
+        assert!(parse_embeddings(&answer, 1).is_err());
+    }
+}
@@ -0,0 +1,147 @@
+//! Google Speech-to-Text backend / Google Speech-to-Text 后端
+//!
+//! Google serves streaming recognition over gRPC only. The rt-asr transport therefore
+//! streams audio to `google.cloud.speech.v1.Speech/StreamingRecognize` on the host and
+//! turns its answers into interim and final transcripts; the plan carries the gRPC
+//! endpoint and the recognition model.
+//! Google 仅通过 gRPC 提供流式识别。因此 rt-asr 传输层在宿主侧将音频流式发送到
+//! `google.cloud.speech.v1.Speech/StreamingRecognize`，并将其应答转换为中间与最终转写；
+//! 计划携带 gRPC 端点与识别模型。
+
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+};
+use crate::spearlet::execution::ai::streaming::{
+    AsrProtocol, StreamingPlan, StreamingWebsocketPlan, WebsocketPlan,
+};
+
+const DEFAULT_MODEL: &str = "latest_long";
+
+pub struct GoogleSpeechBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key_env: Option<String>,
+}
+
+impl GoogleSpeechBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key_env: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key_env: api_key_env
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+}
+
+impl BackendAdapter for GoogleSpeechBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        Err(CanonicalError {
+            code: "unsupported_operation".to_string(),
+            message: format!(
+                "google_speech is streaming-only; invoke() is unsupported for {:?}",
+                req.operation
+            ),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })
+    }
+
+    fn streaming_plan(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<StreamingPlan, CanonicalError> {
+        if req.operation != Operation::SpeechToText {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "google_speech only supports speech_to_text streaming".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+
+        let model = match &req.payload {
+            Payload::SpeechToText(p) => p.model.clone(),
+            _ => None,
+        }
+        .unwrap_or_else(|| DEFAULT_MODEL.to_string());
+        // gRPC takes the origin only / gRPC 只使用源地址
+        let base = self.base_url.trim_end_matches('/');
+        let url = base.strip_suffix("/v1").unwrap_or(base).to_string();
+
+        let mut headers = Vec::new();
+        if let Some(api_key_env) = self.api_key_env.as_deref() {
+            headers.push((
+                "x-goog-api-key".to_string(),
+                format!("${{env:{}}}", api_key_env),
+            ));
+        }
+
+        Ok(StreamingPlan::Websocket(StreamingWebsocketPlan {
+            prepare: Vec::new(),
+            websocket: WebsocketPlan {
+                url,
+                headers,
+                client_events: vec![serde_json::json!({
+                    "type": "session.update",
+                    "session": {
+                        "input_audio_format": "pcm16",
+                        "input_audio_transcription": {
+                            "model": model,
+                        },
+                    }
+                })],
+                supports_turn_detection: false,
+                protocol: AsrProtocol::GoogleSpeech,
+            },
+        }))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::SpeechToTextPayload;
+
+    #[test]
+    fn streaming_plan_targets_grpc_endpoint() {
+        let adapter = GoogleSpeechBackendAdapter::new(
+            "gcp-stt",
+            "https://speech.googleapis.com",
+            Some("GOOGLE_API_KEY".to_string()),
+        );
+        let req = CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::SpeechToText,
+            meta: Default::default(),
+            routing: Default::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::SpeechToText(SpeechToTextPayload {
+                model: Some("telephony".to_string()),
+            }),
+            extra: Default::default(),
+        };
+        let StreamingPlan::Websocket(p) = adapter.streaming_plan(&req).unwrap();
+        assert_eq!(p.websocket.url, "https://speech.googleapis.com");
+        assert_eq!(p.websocket.protocol, AsrProtocol::GoogleSpeech);
+        assert_eq!(
+            p.websocket.client_events[0]["session"]["input_audio_transcription"]["model"],
+            "telephony"
+        );
+    }
+}
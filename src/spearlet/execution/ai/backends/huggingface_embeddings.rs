@@ -0,0 +1,238 @@
+//! Hugging Face feature-extraction backend / Hugging Face 特征提取后端
+//!
+//! Serves text-embeddings-inference (`POST /embed`) and the hosted feature-extraction
+//! pipeline alike: `base_url` is the full endpoint, with `{model}` replaced by the model
+//! name. Token-level answers are mean-pooled into one vector per input.
+//! 同时支持 text-embeddings-inference（`POST /embed`）与托管的特征提取流水线：`base_url` 为完整
+//! 端点，其中的 `{model}` 替换为模型名。按 token 返回的结果会被平均池化为每个输入一个向量。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+use crate::spearlet::otel;
+
+pub struct HuggingFaceEmbeddingsBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+fn as_vector(v: &Value) -> Option<Vec<f32>> {
+    v.as_array()?
+        .iter()
+        .map(|x| x.as_f64().map(|f| f as f32))
+        .collect()
+}
+
+/// One vector per input from a `[[f32]]` or token-level `[[[f32]]]` answer
+/// 从 `[[f32]]` 或按 token 的 `[[[f32]]]` 应答中为每个输入取一个向量
+fn parse_embeddings(body: &Value, inputs: usize) -> Result<Vec<Vec<f32>>, String> {
+    let rows = body.as_array().ok_or("expected an array of embeddings")?;
+    if rows.len() != inputs {
+        return Err(format!("{} embeddings for {} inputs", rows.len(), inputs));
+    }
+    rows.iter()
+        .map(|row| -> Result<Vec<f32>, String> {
+            if let Some(v) = as_vector(row) {
+                return Ok(v);
+            }
+            let tokens = row
+                .as_array()
+                .and_then(|t| t.iter().map(as_vector).collect::<Option<Vec<_>>>())
+                .filter(|t| !t.is_empty())
+                .ok_or("non-numeric embedding")?;
+            let mut pooled = vec![0f32; tokens[0].len()];
+            for t in &tokens {
+                if t.len() != pooled.len() {
+                    return Err("ragged token embeddings".to_string());
+                }
+                for (p, x) in pooled.iter_mut().zip(t) {
+                    *p += x;
+                }
+            }
+            let n = tokens.len() as f32;
+            Ok(pooled.into_iter().map(|p| p / n).collect())
+        })
+        .collect()
+}
+
+impl HuggingFaceEmbeddingsBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn embed(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let invalid = |message: &str| CanonicalError {
+            code: "invalid_request".to_string(),
+            message: message.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        };
+        let Payload::Embeddings(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected embeddings payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        if p.input.is_empty() {
+            return Err(invalid("missing input"));
+        }
+        if p.dimensions.is_some() {
+            return Err(invalid("dimensions not supported by huggingface backends"));
+        }
+        let model = p.model.as_deref().unwrap_or("").trim().to_string();
+        if model.is_empty() && self.base_url.contains("{model}") {
+            return Err(invalid("missing model"));
+        }
+        span.set_attr("gen_ai.request.model", model.as_str());
+        span.set_attr("spear.embeddings.inputs", p.input.len() as i64);
+
+        let url = self.base_url.replace("{model}", &model);
+        let body_json = json!({ "inputs": p.input });
+        let api_key = self.api_key.clone();
+        let traceparent = span.traceparent();
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::Embeddings),
+        };
+
+        let (status_u16, body) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client.post(url).json(&body_json);
+            if let Some(k) = api_key {
+                r = r.header("authorization", format!("Bearer {}", k));
+            }
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            let body = resp.bytes().await.map_err(network_error)?;
+            Ok::<_, CanonicalError>((status, body))
+        })?;
+        span.set_attr("http.response.status_code", status_u16 as i64);
+        let body: Value = serde_json::from_slice(&body).unwrap_or(Value::Null);
+        if !(200..300).contains(&status_u16) {
+            let extra = body
+                .get("error")
+                .and_then(|e| e.as_str())
+                .map(|s| s.to_string());
+            return Err(CanonicalError {
+                code: "upstream_error".to_string(),
+                message: match extra {
+                    Some(m) => format!("upstream status: {}: {}", status_u16, m),
+                    None => format!("upstream status: {}", status_u16),
+                },
+                retryable: status_u16 == 429 || status_u16 >= 500,
+                operation: Some(Operation::Embeddings),
+            });
+        }
+        let vectors = parse_embeddings(&body, p.input.len()).map_err(|m| CanonicalError {
+            code: "invalid_response".to_string(),
+            message: m,
+            retryable: false,
+            operation: Some(Operation::Embeddings),
+        })?;
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": model,
+                "dimensions": vectors.first().map(|v| v.len()).unwrap_or(0),
+                "data": vectors,
+                "usage": Value::Null,
+            })),
+            raw: None,
+        })
+    }
+}
+
+impl BackendAdapter for HuggingFaceEmbeddingsBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::Embeddings {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports embeddings only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = otel::Span::start(
+            "llm.embeddings",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "huggingface");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        let out = self.embed(req, &mut span);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_embeddings_pools_token_vectors() {
+        let sentence = json!([[1.0, 2.0], [3.0, 4.0]]);
+        assert_eq!(
+            parse_embeddings(&sentence, 2).unwrap(),
+            vec![vec![1.0, 2.0], vec![3.0, 4.0]]
+        );
+
+        let tokens = json!([[[1.0, 0.0], [3.0, 2.0]]]);
+        assert_eq!(parse_embeddings(&tokens, 1).unwrap(), vec![vec![2.0, 1.0]]);
+
+        assert!(parse_embeddings(&sentence, 3).is_err());
+        assert!(parse_embeddings(&json!({"error": "x"}), 1).is_err());
+    }
+}
@@ -0,0 +1,202 @@
+//! Local moderation classifier backend / 本地 moderation 分类器后端
+//!
+//! The classifier is an executable on the spearlet host, named by the backend's `base_url`,
+//! so any local model (a Llama Guard runner, a keyword list, an ONNX script) can be plugged
+//! in without rebuilding spearlet. It follows the tool plugin convention: the request
+//! `{"model", "input": [..]}` is written to stdin, and the answer is printed on stdout in
+//! the shape of OpenAI's `/v1/moderations`, `{"results": [{"flagged", "categories",
+//! "category_scores"}]}`, one result per input. A non-zero exit status is an error, with
+//! the message on stderr.
+//! 分类器是 spearlet 主机上的可执行文件，由后端的 `base_url` 指定，因此任何本地模型（Llama Guard
+//! 运行器、关键词列表、ONNX 脚本）都可以在不重新构建 spearlet 的情况下接入。它沿用工具插件的约定：
+//! 请求 `{"model", "input": [..]}` 写入 stdin，应答以 OpenAI `/v1/moderations` 的形式输出到 stdout，
+//! 即 `{"results": [{"flagged", "categories", "category_scores"}]}`，每个输入一个结果。非零退出码
+//! 表示错误，错误信息在 stderr 中。
+
+use std::process::Stdio;
+use std::time::Duration;
+
+use serde_json::{json, Value};
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
+
+use crate::spearlet::execution::ai::backends::openai_moderations::parse_moderation_results;
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+
+/// Time a classifier may take when the request sets no timeout / 请求未设置超时时分类器可用的时间
+const DEFAULT_TIMEOUT: Duration = Duration::from_secs(10);
+/// Largest answer read from a classifier / 从分类器读取的最大应答
+const MAX_OUTPUT_BYTES: usize = 1024 * 1024;
+
+pub struct LocalModerationBackendAdapter {
+    name: String,
+    program: String,
+    model: Option<String>,
+}
+
+impl LocalModerationBackendAdapter {
+    pub fn new(name: impl Into<String>, program: impl Into<String>, model: Option<String>) -> Self {
+        Self {
+            name: name.into(),
+            program: program.into().trim().to_string(),
+            model,
+        }
+    }
+
+    fn error(&self, code: &str, message: impl Into<String>, retryable: bool) -> CanonicalError {
+        CanonicalError {
+            code: code.to_string(),
+            message: message.into(),
+            retryable,
+            operation: Some(Operation::Moderations),
+        }
+    }
+
+    fn run(&self, request: &Value, timeout: Duration) -> Result<Value, CanonicalError> {
+        let rt = tokio::runtime::Runtime::new()
+            .map_err(|e| self.error("runtime_error", e.to_string(), false))?;
+        let stdin = serde_json::to_vec(request)
+            .map_err(|e| self.error("invalid_request", e.to_string(), false))?;
+        let output = rt.block_on(async {
+            let mut child = Command::new(&self.program)
+                .stdin(Stdio::piped())
+                .stdout(Stdio::piped())
+                .stderr(Stdio::piped())
+                .kill_on_drop(true)
+                .spawn()
+                .map_err(|e| {
+                    self.error(
+                        "backend_unavailable",
+                        format!("{}: {}", self.program, e),
+                        false,
+                    )
+                })?;
+            if let Some(mut pipe) = child.stdin.take() {
+                // A classifier may exit without reading its input / 分类器可能不读取输入就退出
+                let _ = pipe.write_all(&stdin).await;
+            }
+            match tokio::time::timeout(timeout, child.wait_with_output()).await {
+                Ok(Ok(out)) => Ok(out),
+                Ok(Err(e)) => Err(self.error("backend_error", e.to_string(), true)),
+                Err(_) => Err(self.error("timeout", "classifier timed out", true)),
+            }
+        })?;
+        if !output.status.success() {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            return Err(self.error(
+                "backend_error",
+                format!(
+                    "classifier exited with {}: {}",
+                    output.status,
+                    stderr.trim()
+                ),
+                false,
+            ));
+        }
+        if output.stdout.len() > MAX_OUTPUT_BYTES {
+            return Err(self.error("invalid_response", "classifier answer too large", false));
+        }
+        serde_json::from_slice(&output.stdout)
+            .map_err(|e| self.error("invalid_response", e.to_string(), false))
+    }
+}
+
+impl BackendAdapter for LocalModerationBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let Payload::Moderations(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports moderations only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        if p.input.is_empty() {
+            return Err(self.error("invalid_request", "missing input", false));
+        }
+        if self.program.is_empty() {
+            return Err(self.error("backend_unavailable", "no classifier configured", false));
+        }
+        let model = p.model.clone().or_else(|| self.model.clone());
+        let timeout = req
+            .timeout_ms
+            .map(Duration::from_millis)
+            .unwrap_or(DEFAULT_TIMEOUT);
+        let body = self.run(&json!({"model": model, "input": p.input}), timeout)?;
+        let results = parse_moderation_results(&body, p.input.len())
+            .map_err(|m| self.error("invalid_response", m, false))?;
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": body.get("model").cloned().unwrap_or(json!(model)),
+                "results": results,
+            })),
+            raw: None,
+        })
+    }
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{ModerationsPayload, RoutingHints};
+    use std::collections::HashMap;
+    use std::os::unix::fs::PermissionsExt;
+
+    fn request(input: &[&str]) -> CanonicalRequestEnvelope {
+        CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "m1".to_string(),
+            operation: Operation::Moderations,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::Moderations(ModerationsPayload {
+                input: input.iter().map(|s| s.to_string()).collect(),
+                model: None,
+            }),
+            extra: HashMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_classifier_answers_in_openai_shape() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("classifier");
+        std::fs::write(
+            &path,
+            "#!/bin/sh\nif grep -q kill; then f=true; else f=false; fi\n\
+             echo \"{\\\"model\\\":\\\"kw\\\",\\\"results\\\":[{\\\"flagged\\\":$f,\\\"categories\\\":{\\\"violence\\\":$f}}]}\"\n",
+        )
+        .unwrap();
+        std::fs::set_permissions(&path, std::fs::Permissions::from_mode(0o755)).unwrap();
+
+        let b = LocalModerationBackendAdapter::new("kw", path.display().to_string(), None);
+        let resp = b.invoke(&request(&["how to kill a process"])).unwrap();
+        let ResultPayload::Payload(v) = resp.result else {
+            panic!("unexpected error");
+        };
+        assert_eq!(v["model"], json!("kw"));
+        assert_eq!(v["results"][0]["flagged"], json!(true));
+
+        // One result for two inputs / 两个输入只有一个结果
+        assert!(b.invoke(&request(&["a", "b"])).is_err());
+        let missing = LocalModerationBackendAdapter::new("kw", "/nonexistent/classifier", None);
+        assert!(missing.invoke(&request(&["a"])).is_err());
+    }
+}
@@ -1,14 +1,51 @@
+pub mod anthropic_messages;
+#[cfg(feature = "rt-asr")]
+pub mod azure_speech_ws;
+#[cfg(feature = "rt-asr")]
+pub mod deepgram_listen_ws;
+pub mod gemini_chat;
+pub mod gemini_embeddings;
+#[cfg(feature = "rt-asr")]
+pub mod google_speech;
+pub mod huggingface_embeddings;
+pub mod local_moderation;
 pub mod ollama_chat;
+pub mod ollama_embeddings;
 pub mod openai_chat_completion;
+pub mod openai_embeddings;
+pub mod openai_endpoint;
+pub mod openai_images;
+pub mod openai_moderations;
 pub mod openai_realtime_ws;
+pub mod openai_responses;
+pub mod openai_speech;
+pub mod stability_image;
 pub mod stub;
 
 pub const KIND_PREFIX_OPENAI: &str = "openai_";
 pub const KIND_OPENAI_CHAT_COMPLETION: &str = "openai_chat_completion";
 pub const KIND_OPENAI_REALTIME_WS: &str = "openai_realtime_ws";
+pub const KIND_OPENAI_RESPONSES: &str = "openai_responses";
+pub const KIND_OPENAI_SPEECH: &str = "openai_speech";
+pub const KIND_OPENAI_EMBEDDINGS: &str = "openai_embeddings";
+pub const KIND_OPENAI_IMAGES: &str = "openai_images";
+pub const KIND_OPENAI_MODERATIONS: &str = "openai_moderations";
+pub const KIND_HUGGINGFACE_EMBEDDINGS: &str = "huggingface_embeddings";
+pub const KIND_STABILITY_IMAGE: &str = "stability_image";
 pub const KIND_OLLAMA_CHAT: &str = "ollama_chat";
+pub const KIND_OLLAMA_EMBEDDINGS: &str = "ollama_embeddings";
+pub const KIND_ANTHROPIC_MESSAGES: &str = "anthropic_messages";
+pub const KIND_GEMINI_CHAT: &str = "gemini_chat";
+pub const KIND_GEMINI_EMBEDDINGS: &str = "gemini_embeddings";
+pub const KIND_LOCAL_MODERATION: &str = "local_moderation";
+pub const KIND_DEEPGRAM_LISTEN_WS: &str = "deepgram_listen_ws";
+pub const KIND_AZURE_SPEECH_WS: &str = "azure_speech_ws";
+pub const KIND_GOOGLE_SPEECH: &str = "google_speech";
 pub const KIND_STUB: &str = "stub";
 
+/// Error code of a backend that cannot stream an operation / 后端无法流式处理某操作时的错误码
+pub const UNSUPPORTED_STREAMING: &str = "unsupported_streaming";
+
 use crate::spearlet::execution::ai::ir::{
     CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope,
 };
@@ -22,15 +59,75 @@ pub trait BackendAdapter: Send + Sync {
         req: &CanonicalRequestEnvelope,
     ) -> Result<CanonicalResponseEnvelope, CanonicalError>;
 
+    /// Invoke with guest events (see `chat_stream`) passed to `on_event` as output arrives.
+    /// Backends without streaming answer in one piece and pass nothing.
+    /// 调用并在输出到达时将 guest 事件（见 `chat_stream`）交给 `on_event`；不支持流式的后端一次性应答且不传递事件。
+    fn invoke_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: &mut dyn FnMut(serde_json::Value),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let _ = on_event;
+        self.invoke(req)
+    }
+
+    /// Invoke an audio-producing request with the audio passed to `on_chunk` as it arrives.
+    /// Backends that answer in one piece pass their `raw` bytes once and return without them.
+    /// 调用产生音频的请求，并在音频到达时交给 `on_chunk`；一次性应答的后端只传递一次 `raw` 字节，返回时不再携带。
+    fn invoke_audio_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_chunk: &mut dyn FnMut(Vec<u8>),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let mut resp = self.invoke(req)?;
+        if let Some(audio) = resp.raw.take().filter(|b| !b.is_empty()) {
+            on_chunk(audio);
+        }
+        Ok(resp)
+    }
+
     fn streaming_plan(
         &self,
         req: &CanonicalRequestEnvelope,
     ) -> Result<StreamingPlan, CanonicalError> {
         Err(CanonicalError {
-            code: "unsupported_streaming".to_string(),
+            code: UNSUPPORTED_STREAMING.to_string(),
             message: "streaming not supported".to_string(),
             retryable: false,
             operation: Some(req.operation.clone()),
         })
     }
 }
+
+/// `base_url` with an `http(s)` scheme turned into `ws(s)`
+/// 将 `base_url` 的 `http(s)` 协议改为 `ws(s)`
+pub(crate) fn websocket_url(base_url: &str) -> Result<url::Url, CanonicalError> {
+    let mut u = url::Url::parse(base_url).map_err(|e| CanonicalError {
+        code: "invalid_configuration".to_string(),
+        message: format!("invalid base_url: {e}"),
+        retryable: false,
+        operation: None,
+    })?;
+
+    let scheme = match u.scheme() {
+        "https" => "wss",
+        "http" => "ws",
+        "wss" => "wss",
+        "ws" => "ws",
+        s => {
+            return Err(CanonicalError {
+                code: "invalid_configuration".to_string(),
+                message: format!("unsupported base_url scheme: {s}"),
+                retryable: false,
+                operation: None,
+            })
+        }
+    };
+    u.set_scheme(scheme).map_err(|_| CanonicalError {
+        code: "invalid_configuration".to_string(),
+        message: "set scheme failed".to_string(),
+        retryable: false,
+        operation: None,
+    })?;
+    Ok(u)
+}
@@ -0,0 +1,246 @@
+//! Ollama `/api/embed` backend / Ollama `/api/embed` 后端
+//!
+//! All inputs of a request go out in one batch, and the answer is shaped like that of
+//! `openai_embeddings`, so the hostcall sees no difference between a local and a hosted model.
+//! 一个请求的所有输入作为一批发送，应答的形式与 `openai_embeddings` 相同，因此 hostcall 看不出本地
+//! 模型与托管模型的区别。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+use crate::spearlet::otel;
+
+pub struct OllamaEmbeddingsBackendAdapter {
+    name: String,
+    base_url: String,
+    fixed_model: Option<String>,
+}
+
+/// Vectors of an `/api/embed` answer / `/api/embed` 应答中的向量
+fn parse_embeddings(body: &Value, inputs: usize) -> Result<Vec<Vec<f32>>, String> {
+    let vectors = body
+        .get("embeddings")
+        .and_then(|d| d.as_array())
+        .ok_or("missing embeddings")?
+        .iter()
+        .map(|v| {
+            v.as_array()
+                .ok_or("missing embedding")?
+                .iter()
+                .map(|x| x.as_f64().map(|f| f as f32).ok_or("non-numeric embedding"))
+                .collect::<Result<Vec<f32>, _>>()
+        })
+        .collect::<Result<Vec<_>, _>>()?;
+    if vectors.len() != inputs {
+        return Err(format!(
+            "{} embeddings for {} inputs",
+            vectors.len(),
+            inputs
+        ));
+    }
+    Ok(vectors)
+}
+
+impl OllamaEmbeddingsBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        fixed_model: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            fixed_model: fixed_model.filter(|s| !s.trim().is_empty()),
+        }
+    }
+
+    fn embed_url(&self) -> String {
+        format!("{}/api/embed", self.base_url.trim_end_matches('/'))
+    }
+
+    fn build_body(&self, req: &CanonicalRequestEnvelope) -> Result<Value, CanonicalError> {
+        let invalid = |message: &str| CanonicalError {
+            code: "invalid_request".to_string(),
+            message: message.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        };
+        let Payload::Embeddings(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected embeddings payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        let model = self
+            .fixed_model
+            .as_deref()
+            .or(p.model.as_deref())
+            .unwrap_or("")
+            .trim();
+        if model.is_empty() {
+            return Err(invalid("missing model"));
+        }
+        if p.input.is_empty() {
+            return Err(invalid("missing input"));
+        }
+        let mut body = json!({
+            "model": model,
+            "input": p.input,
+        });
+        if let Some(d) = p.dimensions {
+            body["dimensions"] = json!(d);
+        }
+        Ok(body)
+    }
+
+    fn embed(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let body_json = self.build_body(req)?;
+        let inputs = body_json["input"].as_array().map(|a| a.len()).unwrap_or(0);
+        if let Some(m) = body_json.get("model").and_then(|v| v.as_str()) {
+            span.set_attr("gen_ai.request.model", m);
+        }
+        span.set_attr("spear.embeddings.inputs", inputs as i64);
+        let traceparent = span.traceparent();
+        let url = self.embed_url();
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::Embeddings),
+        };
+
+        let (status_u16, body) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client.post(url).json(&body_json);
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            let body = resp.bytes().await.map_err(network_error)?;
+            Ok::<_, CanonicalError>((status, body))
+        })?;
+        span.set_attr("http.response.status_code", status_u16 as i64);
+        let body: Value = serde_json::from_slice(&body).unwrap_or(Value::Null);
+        if !(200..300).contains(&status_u16) {
+            let message = match body.get("error").and_then(|v| v.as_str()) {
+                Some(m) => format!("upstream status: {}: {}", status_u16, m),
+                None => format!("upstream status: {}", status_u16),
+            };
+            return Err(CanonicalError {
+                code: "upstream_error".to_string(),
+                message,
+                retryable: status_u16 == 429 || status_u16 >= 500,
+                operation: Some(Operation::Embeddings),
+            });
+        }
+        let vectors = parse_embeddings(&body, inputs).map_err(|m| CanonicalError {
+            code: "invalid_response".to_string(),
+            message: m,
+            retryable: false,
+            operation: Some(Operation::Embeddings),
+        })?;
+        let prompt_tokens = body.get("prompt_eval_count").and_then(|v| v.as_i64());
+        if let Some(t) = prompt_tokens {
+            span.set_attr("gen_ai.usage.input_tokens", t);
+        }
+        let usage = match prompt_tokens {
+            Some(t) => json!({"prompt_tokens": t, "total_tokens": t}),
+            None => Value::Null,
+        };
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": body.get("model").cloned().unwrap_or(body_json["model"].clone()),
+                "dimensions": vectors.first().map(|v| v.len()).unwrap_or(0),
+                "data": vectors,
+                "usage": usage,
+            })),
+            raw: None,
+        })
+    }
+}
+
+impl BackendAdapter for OllamaEmbeddingsBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::Embeddings {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports embeddings only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = otel::Span::start(
+            "llm.embeddings",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "ollama");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        let out = self.embed(req, &mut span);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_embeddings_checks_count() {
+        let body = json!({
+            "model": "nomic-embed-text",
+            "embeddings": [[1.0, 0.0], [0.5, 0.5]],
+            "prompt_eval_count": 6,
+        });
+        let v = parse_embeddings(&body, 2).unwrap();
+        assert_eq!(v, vec![vec![1.0, 0.0], vec![0.5, 0.5]]);
+        assert!(parse_embeddings(&body, 3).is_err());
+        assert!(parse_embeddings(&json!({"embedding": [1.0]}), 1).is_err());
+
+        let adapter = OllamaEmbeddingsBackendAdapter::new(
+            "ollama/nomic-embed-text",
+            "http://127.0.0.1:11434/",
+            Some("nomic-embed-text".to_string()),
+        );
+        assert_eq!(adapter.embed_url(), "http://127.0.0.1:11434/api/embed");
+    }
+}
@@ -2,11 +2,14 @@ use serde_json::{json, Value};
 use std::collections::HashMap;
 use std::time::Duration;
 
+use crate::spearlet::execution::ai::backends::openai_endpoint::EndpointStyle;
 use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::chat_stream::{ChatStreamAccumulator, SseDecoder, DONE_MARKER};
 use crate::spearlet::execution::ai::ir::{
     CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
     ResultPayload,
 };
+use crate::spearlet::otel;
 use crate::spearlet::param_keys::{chat as chat_keys, mcp as mcp_keys};
 
 pub struct OpenAIChatCompletionBackendAdapter {
@@ -14,6 +17,7 @@ pub struct OpenAIChatCompletionBackendAdapter {
     base_url: String,
     api_key: Option<String>,
     fixed_model: Option<String>,
+    style: EndpointStyle,
 }
 
 impl OpenAIChatCompletionBackendAdapter {
@@ -34,6 +38,7 @@ impl OpenAIChatCompletionBackendAdapter {
                 }
             }),
             fixed_model: None,
+            style: EndpointStyle::default(),
         }
     }
 
@@ -44,6 +49,11 @@ impl OpenAIChatCompletionBackendAdapter {
         self
     }
 
+    pub fn with_endpoint_style(mut self, style: EndpointStyle) -> Self {
+        self.style = style;
+        self
+    }
+
     fn build_chat_completions_body(
         &self,
         req: &CanonicalRequestEnvelope,
@@ -113,13 +123,7 @@ impl OpenAIChatCompletionBackendAdapter {
         Ok(body)
     }
 
-    fn join_url(&self, path: &str) -> String {
-        let base = self.base_url.trim_end_matches('/');
-        let p = path.trim_start_matches('/');
-        format!("{}/{}", base, p)
-    }
-
-    fn extract_openai_error_message(json: &Value) -> Option<String> {
+    pub(super) fn extract_openai_error_message(json: &Value) -> Option<String> {
         let e = json.get("error")?;
         let msg = e.get("message").and_then(|v| v.as_str()).unwrap_or("");
         let ty = e.get("type").and_then(|v| v.as_str()).unwrap_or("");
@@ -167,9 +171,68 @@ impl BackendAdapter for OpenAIChatCompletionBackendAdapter {
             });
         }
 
+        let mut span = self.client_span();
+        let out = self.chat_completions(req, &mut span);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+
+    fn invoke_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: &mut dyn FnMut(Value),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::ChatCompletions {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports chat_completions only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+
+        let mut span = self.client_span();
+        span.set_attr("gen_ai.request.stream", true);
+        let out = self.chat_completions_stream(req, &mut span, on_event);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+impl OpenAIChatCompletionBackendAdapter {
+    /// Client span under the calling hostcall / 调用方 hostcall 下的 client span
+    fn client_span(&self) -> otel::Span {
+        let mut span = otel::Span::start(
+            "llm.chat_completions",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "openai");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        span
+    }
+
+    fn chat_completions_url(&self, model: &str) -> String {
+        self.style.url(&self.base_url, "chat/completions", model)
+    }
+
+    fn chat_completions(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
         let api_key = self.api_key.as_deref().unwrap_or("");
 
         let body_json = self.build_chat_completions_body(req)?;
+        if let Some(m) = body_json.get("model").and_then(|v| v.as_str()) {
+            span.set_attr("gen_ai.request.model", m);
+        }
+        let traceparent = span.traceparent();
         let body_bytes = serde_json::to_vec(&body_json).map_err(|e| CanonicalError {
             code: "serialization".to_string(),
             message: e.to_string(),
@@ -177,11 +240,7 @@ impl BackendAdapter for OpenAIChatCompletionBackendAdapter {
             operation: Some(req.operation.clone()),
         })?;
 
-        let url = if self.base_url.contains("/v1") {
-            self.join_url("chat/completions")
-        } else {
-            self.join_url("v1/chat/completions")
-        };
+        let url = self.chat_completions_url(body_json["model"].as_str().unwrap_or(""));
 
         let timeout = req.timeout_ms.map(Duration::from_millis);
 
@@ -198,8 +257,9 @@ impl BackendAdapter for OpenAIChatCompletionBackendAdapter {
                 .post(url)
                 .header("content-type", "application/json")
                 .body(body_bytes);
-            if !api_key.trim().is_empty() {
-                r = r.header("authorization", format!("Bearer {}", api_key.trim()));
+            r = self.style.authorize(r, Some(api_key));
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
             }
             if let Some(t) = timeout {
                 r = r.timeout(t);
@@ -226,6 +286,7 @@ impl BackendAdapter for OpenAIChatCompletionBackendAdapter {
         })?;
 
         let status_u16 = status as u16;
+        span.set_attr("http.response.status_code", status as i64);
         let ok = (200..300).contains(&status_u16);
         let parsed = serde_json::from_slice::<Value>(&resp_body).map_err(|e| CanonicalError {
             code: "invalid_response".to_string(),
@@ -258,6 +319,129 @@ impl BackendAdapter for OpenAIChatCompletionBackendAdapter {
     }
 }
 
+impl OpenAIChatCompletionBackendAdapter {
+    /// `stream: true` request read as server-sent events
+    /// 以 server-sent events 读取的 `stream: true` 请求
+    fn chat_completions_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+        on_event: &mut dyn FnMut(Value),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let api_key = self.api_key.as_deref().unwrap_or("");
+
+        let mut body_json = self.build_chat_completions_body(req)?;
+        if let Some(m) = body_json.get("model").and_then(|v| v.as_str()) {
+            span.set_attr("gen_ai.request.model", m);
+        }
+        body_json["stream"] = Value::Bool(true);
+        // Usage arrives in a last chunk without choices / 用量在最后一个不含 choices 的 chunk 中到达
+        if body_json.get("stream_options").is_none() {
+            body_json["stream_options"] = json!({ "include_usage": true });
+        }
+        let traceparent = span.traceparent();
+        let body_bytes = serde_json::to_vec(&body_json).map_err(|e| CanonicalError {
+            code: "serialization".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let url = self.chat_completions_url(body_json["model"].as_str().unwrap_or(""));
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::ChatCompletions),
+        };
+
+        let parsed = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client
+                .post(url)
+                .header("content-type", "application/json")
+                .header("accept", "text/event-stream")
+                .body(body_bytes);
+            r = self.style.authorize(r, Some(api_key));
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let mut resp = r.send().await.map_err(network_error)?;
+            let status_u16 = resp.status().as_u16();
+            span.set_attr("http.response.status_code", status_u16 as i64);
+            if !(200..300).contains(&status_u16) {
+                let body = resp.bytes().await.unwrap_or_default();
+                let extra = serde_json::from_slice::<Value>(&body)
+                    .ok()
+                    .and_then(|v| Self::extract_openai_error_message(&v));
+                return Err(CanonicalError {
+                    code: "upstream_error".to_string(),
+                    message: match extra {
+                        Some(m) => format!("upstream status: {}: {}", status_u16, m),
+                        None => format!("upstream status: {}", status_u16),
+                    },
+                    retryable: status_u16 == 429 || status_u16 >= 500,
+                    operation: Some(Operation::ChatCompletions),
+                });
+            }
+
+            let mut decoder = SseDecoder::default();
+            let mut acc = ChatStreamAccumulator::default();
+            let mut done = false;
+            while !done {
+                let payloads = match resp.chunk().await.map_err(network_error)? {
+                    Some(b) => decoder.push(&b),
+                    None => {
+                        done = true;
+                        decoder.finish()
+                    }
+                };
+                for data in payloads {
+                    if data.trim() == DONE_MARKER {
+                        done = true;
+                        break;
+                    }
+                    let Ok(chunk) = serde_json::from_str::<Value>(&data) else {
+                        continue;
+                    };
+                    // Some servers report failures inside the stream / 部分服务在流中报告失败
+                    if let Some(m) = Self::extract_openai_error_message(&chunk) {
+                        return Err(CanonicalError {
+                            code: "upstream_error".to_string(),
+                            message: m,
+                            retryable: false,
+                            operation: Some(Operation::ChatCompletions),
+                        });
+                    }
+                    for event in acc.push(&chunk) {
+                        on_event(event);
+                    }
+                }
+            }
+            Ok::<_, CanonicalError>(acc.finish())
+        })?;
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(parsed),
+            raw: None,
+        })
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -294,16 +478,29 @@ mod tests {
     }
 
     #[test]
-    fn test_join_url() {
+    fn test_chat_completions_url() {
         let adapter = OpenAIChatCompletionBackendAdapter::new(
             "openai",
             "https://api.openai.com/v1/",
             Some("k".to_string()),
         );
         assert_eq!(
-            adapter.join_url("chat/completions"),
+            adapter.chat_completions_url("gpt-test"),
             "https://api.openai.com/v1/chat/completions"
         );
+
+        let azure = OpenAIChatCompletionBackendAdapter::new(
+            "azure",
+            "https://acme.openai.azure.com",
+            Some("k".to_string()),
+        )
+        .with_endpoint_style(EndpointStyle::Azure {
+            api_version: "2024-06-01".to_string(),
+        });
+        assert_eq!(
+            azure.chat_completions_url("gpt4o-prod"),
+            "https://acme.openai.azure.com/openai/deployments/gpt4o-prod/chat/completions?api-version=2024-06-01"
+        );
     }
 
     #[test]
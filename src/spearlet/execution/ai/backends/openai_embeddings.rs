@@ -0,0 +1,251 @@
+//! OpenAI `/v1/embeddings` backend / OpenAI `/v1/embeddings` 后端
+//!
+//! All inputs of a request go out in one batch; the vectors come back in input order.
+//! 一个请求的所有输入作为一批发送；向量按输入顺序返回。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::openai_chat_completion::OpenAIChatCompletionBackendAdapter;
+use crate::spearlet::execution::ai::backends::openai_endpoint::EndpointStyle;
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+use crate::spearlet::otel;
+
+pub struct OpenAIEmbeddingsBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+    style: EndpointStyle,
+}
+
+/// Vectors of an `/embeddings` answer, in input order / `/embeddings` 应答中的向量，按输入顺序排列
+fn parse_embeddings(body: &Value, inputs: usize) -> Result<Vec<Vec<f32>>, String> {
+    let data = body
+        .get("data")
+        .and_then(|d| d.as_array())
+        .ok_or("missing data")?;
+    let mut out: Vec<Option<Vec<f32>>> = vec![None; inputs];
+    for (i, item) in data.iter().enumerate() {
+        let index = item
+            .get("index")
+            .and_then(|v| v.as_u64())
+            .map(|v| v as usize)
+            .unwrap_or(i);
+        let vector = item
+            .get("embedding")
+            .and_then(|v| v.as_array())
+            .ok_or("missing embedding")?
+            .iter()
+            .map(|x| x.as_f64().map(|f| f as f32).ok_or("non-numeric embedding"))
+            .collect::<Result<Vec<f32>, _>>()?;
+        let slot = out.get_mut(index).ok_or("embedding index out of range")?;
+        *slot = Some(vector);
+    }
+    out.into_iter()
+        .collect::<Option<Vec<_>>>()
+        .ok_or_else(|| "fewer embeddings than inputs".to_string())
+}
+
+impl OpenAIEmbeddingsBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+            style: EndpointStyle::default(),
+        }
+    }
+
+    pub fn with_endpoint_style(mut self, style: EndpointStyle) -> Self {
+        self.style = style;
+        self
+    }
+
+    fn embeddings_url(&self, model: &str) -> String {
+        self.style.url(&self.base_url, "embeddings", model)
+    }
+
+    fn build_body(&self, req: &CanonicalRequestEnvelope) -> Result<Value, CanonicalError> {
+        let invalid = |message: &str| CanonicalError {
+            code: "invalid_request".to_string(),
+            message: message.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        };
+        let Payload::Embeddings(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected embeddings payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        let model = p.model.as_deref().unwrap_or("").trim();
+        if model.is_empty() {
+            return Err(invalid("missing model"));
+        }
+        if p.input.is_empty() {
+            return Err(invalid("missing input"));
+        }
+        let mut body = json!({
+            "model": model,
+            "input": p.input,
+            "encoding_format": "float",
+        });
+        if let Some(d) = p.dimensions {
+            body["dimensions"] = json!(d);
+        }
+        Ok(body)
+    }
+
+    fn embed(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let body_json = self.build_body(req)?;
+        let inputs = body_json["input"].as_array().map(|a| a.len()).unwrap_or(0);
+        if let Some(m) = body_json.get("model").and_then(|v| v.as_str()) {
+            span.set_attr("gen_ai.request.model", m);
+        }
+        span.set_attr("spear.embeddings.inputs", inputs as i64);
+        let traceparent = span.traceparent();
+        let url = self.embeddings_url(body_json["model"].as_str().unwrap_or(""));
+        let api_key = self.api_key.clone();
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::Embeddings),
+        };
+
+        let (status_u16, body) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client.post(url).json(&body_json);
+            r = self.style.authorize(r, api_key.as_deref());
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            let body = resp.bytes().await.map_err(network_error)?;
+            Ok::<_, CanonicalError>((status, body))
+        })?;
+        span.set_attr("http.response.status_code", status_u16 as i64);
+        let body: Value = serde_json::from_slice(&body).unwrap_or(Value::Null);
+        if !(200..300).contains(&status_u16) {
+            let extra = OpenAIChatCompletionBackendAdapter::extract_openai_error_message(&body);
+            return Err(CanonicalError {
+                code: "upstream_error".to_string(),
+                message: match extra {
+                    Some(m) => format!("upstream status: {}: {}", status_u16, m),
+                    None => format!("upstream status: {}", status_u16),
+                },
+                retryable: status_u16 == 429 || status_u16 >= 500,
+                operation: Some(Operation::Embeddings),
+            });
+        }
+        let vectors = parse_embeddings(&body, inputs).map_err(|m| CanonicalError {
+            code: "invalid_response".to_string(),
+            message: m,
+            retryable: false,
+            operation: Some(Operation::Embeddings),
+        })?;
+        let usage = body.get("usage").cloned().unwrap_or(Value::Null);
+        if let Some(t) = usage.get("prompt_tokens").and_then(|v| v.as_i64()) {
+            span.set_attr("gen_ai.usage.input_tokens", t);
+        }
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": body.get("model").cloned().unwrap_or(body_json["model"].clone()),
+                "dimensions": vectors.first().map(|v| v.len()).unwrap_or(0),
+                "data": vectors,
+                "usage": usage,
+            })),
+            raw: None,
+        })
+    }
+}
+
+impl BackendAdapter for OpenAIEmbeddingsBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::Embeddings {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports embeddings only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = otel::Span::start(
+            "llm.embeddings",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "openai");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        let out = self.embed(req, &mut span);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_embeddings_in_input_order() {
+        let body = json!({
+            "data": [
+                {"index": 1, "embedding": [0.5, 0.5]},
+                {"index": 0, "embedding": [1.0, 0.0]},
+            ]
+        });
+        let v = parse_embeddings(&body, 2).unwrap();
+        assert_eq!(v, vec![vec![1.0, 0.0], vec![0.5, 0.5]]);
+        assert!(parse_embeddings(&body, 3).is_err());
+
+        let adapter = OpenAIEmbeddingsBackendAdapter::new("openai", "https://api.openai.com", None);
+        assert_eq!(
+            adapter.embeddings_url("text-embedding-3-small"),
+            "https://api.openai.com/v1/embeddings"
+        );
+    }
+}
@@ -0,0 +1,123 @@
+//! Endpoint styles of OpenAI-compatible services / OpenAI 兼容服务的端点风格
+//!
+//! OpenAI and most compatible servers take `<base>/v1/<path>` with a bearer token. Azure
+//! OpenAI serves the same API per deployment, at
+//! `<base>/openai/deployments/<deployment>/<path>?api-version=<version>`, and takes the key in
+//! an `api-key` header. The deployment is the request's model, unless `base_url` already
+//! names one.
+//! OpenAI 与大多数兼容服务器使用 `<base>/v1/<path>` 与 bearer token。Azure OpenAI 按部署提供同样的 API，
+//! 地址为 `<base>/openai/deployments/<deployment>/<path>?api-version=<version>`，密钥放在 `api-key`
+//! 请求头中。部署名即请求的模型，除非 `base_url` 已指定部署。
+
+pub const AUTH_STYLE_BEARER: &str = "bearer";
+pub const AUTH_STYLE_AZURE: &str = "azure";
+pub const DEFAULT_AZURE_API_VERSION: &str = "2024-10-21";
+
+const AZURE_DEPLOYMENTS: &str = "/openai/deployments/";
+
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub enum EndpointStyle {
+    #[default]
+    OpenAI,
+    Azure {
+        api_version: String,
+    },
+}
+
+impl EndpointStyle {
+    /// Style of a backend's `auth_style` and `api_version` / 后端 `auth_style` 与 `api_version` 对应的风格
+    pub fn from_config(
+        auth_style: Option<&str>,
+        api_version: Option<&str>,
+    ) -> Result<Self, String> {
+        let api_version = api_version.map(str::trim).filter(|s| !s.is_empty());
+        match auth_style.map(|s| s.trim().to_ascii_lowercase()).as_deref() {
+            None | Some("") | Some(AUTH_STYLE_BEARER) => match api_version {
+                Some(_) => Err("api_version requires auth_style = \"azure\"".to_string()),
+                None => Ok(EndpointStyle::OpenAI),
+            },
+            Some(AUTH_STYLE_AZURE) => Ok(EndpointStyle::Azure {
+                api_version: api_version.unwrap_or(DEFAULT_AZURE_API_VERSION).to_string(),
+            }),
+            Some(other) => Err(format!(
+                "invalid auth_style (expected bearer|azure): {}",
+                other
+            )),
+        }
+    }
+
+    pub fn is_azure(&self) -> bool {
+        matches!(self, EndpointStyle::Azure { .. })
+    }
+
+    /// URL of `path`, such as `chat/completions`, for `model`
+    /// `model` 对应的 `path`（如 `chat/completions`）的 URL
+    pub fn url(&self, base_url: &str, path: &str, model: &str) -> String {
+        let base = base_url.trim_end_matches('/');
+        let path = path.trim_start_matches('/');
+        match self {
+            EndpointStyle::OpenAI => {
+                if base.contains("/v1") {
+                    format!("{}/{}", base, path)
+                } else {
+                    format!("{}/v1/{}", base, path)
+                }
+            }
+            EndpointStyle::Azure { api_version } => {
+                let deployment_base = if base.contains(AZURE_DEPLOYMENTS) {
+                    base.to_string()
+                } else {
+                    format!("{}{}{}", base, AZURE_DEPLOYMENTS, model.trim())
+                };
+                format!("{}/{}?api-version={}", deployment_base, path, api_version)
+            }
+        }
+    }
+
+    /// Add the key to `r` the way the service expects / 按服务要求的方式为 `r` 添加密钥
+    pub fn authorize(
+        &self,
+        r: reqwest::RequestBuilder,
+        api_key: Option<&str>,
+    ) -> reqwest::RequestBuilder {
+        let Some(key) = api_key.map(str::trim).filter(|k| !k.is_empty()) else {
+            return r;
+        };
+        match self {
+            EndpointStyle::OpenAI => r.header("authorization", format!("Bearer {}", key)),
+            EndpointStyle::Azure { .. } => r.header("api-key", key),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_azure_urls_name_the_deployment() {
+        let openai = EndpointStyle::from_config(None, None).unwrap();
+        assert_eq!(
+            openai.url("https://api.openai.com", "chat/completions", "gpt-4o"),
+            "https://api.openai.com/v1/chat/completions"
+        );
+
+        let azure = EndpointStyle::from_config(Some("Azure"), None).unwrap();
+        assert_eq!(
+            azure.url("https://acme.openai.azure.com/", "chat/completions", "gpt4o-prod"),
+            "https://acme.openai.azure.com/openai/deployments/gpt4o-prod/chat/completions?api-version=2024-10-21"
+        );
+        let pinned = EndpointStyle::from_config(Some("azure"), Some("2024-06-01")).unwrap();
+        assert_eq!(
+            pinned.url(
+                "https://acme.openai.azure.com/openai/deployments/embed-small",
+                "embeddings",
+                "ignored"
+            ),
+            "https://acme.openai.azure.com/openai/deployments/embed-small/embeddings?api-version=2024-06-01"
+        );
+
+        assert!(EndpointStyle::from_config(Some("basic"), None).is_err());
+        assert!(EndpointStyle::from_config(None, Some("2024-06-01")).is_err());
+    }
+}
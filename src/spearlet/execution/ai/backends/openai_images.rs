@@ -0,0 +1,277 @@
+//! OpenAI `/v1/images/generations` backend / OpenAI `/v1/images/generations` 后端
+//!
+//! Serves DALL-E and `gpt-image-*` models. `gpt-image-*` models always answer inline, so
+//! `response_format` is only sent to the others.
+//! 支持 DALL-E 与 `gpt-image-*` 模型。`gpt-image-*` 模型总是内联返回，因此只向其他模型发送
+//! `response_format`。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::openai_chat_completion::OpenAIChatCompletionBackendAdapter;
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+use crate::spearlet::otel;
+
+pub struct OpenAIImagesBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+/// Images of an `/images/generations` answer / `/images/generations` 应答中的图像
+fn parse_images(body: &Value) -> Result<Vec<Value>, String> {
+    let data = body
+        .get("data")
+        .and_then(|d| d.as_array())
+        .ok_or("missing data")?;
+    data.iter()
+        .map(|item| {
+            let mut image = serde_json::Map::new();
+            if let Some(b64) = item.get("b64_json").and_then(|v| v.as_str()) {
+                image.insert("b64_json".to_string(), json!(b64));
+                image.insert("mime".to_string(), json!("image/png"));
+            } else if let Some(url) = item.get("url").and_then(|v| v.as_str()) {
+                image.insert("url".to_string(), json!(url));
+            } else {
+                return Err("image without url or b64_json".to_string());
+            }
+            if let Some(p) = item.get("revised_prompt").and_then(|v| v.as_str()) {
+                image.insert("revised_prompt".to_string(), json!(p));
+            }
+            Ok(Value::Object(image))
+        })
+        .collect()
+}
+
+impl OpenAIImagesBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn images_url(&self) -> String {
+        let base = self.base_url.trim_end_matches('/');
+        if base.contains("/v1") {
+            format!("{}/images/generations", base)
+        } else {
+            format!("{}/v1/images/generations", base)
+        }
+    }
+
+    fn build_body(&self, req: &CanonicalRequestEnvelope) -> Result<Value, CanonicalError> {
+        let invalid = |message: &str| CanonicalError {
+            code: "invalid_request".to_string(),
+            message: message.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        };
+        let Payload::ImageGeneration(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected image_generation payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        let model = p.model.as_deref().unwrap_or("").trim();
+        if model.is_empty() {
+            return Err(invalid("missing model"));
+        }
+        if p.prompt.trim().is_empty() {
+            return Err(invalid("missing prompt"));
+        }
+        let mut body = json!({
+            "model": model,
+            "prompt": p.prompt,
+        });
+        if let Some(n) = p.n {
+            body["n"] = json!(n);
+        }
+        if let Some(size) = &p.size {
+            body["size"] = json!(size);
+        }
+        if !model.starts_with("gpt-image") {
+            body["response_format"] = json!(p.response_format.as_deref().unwrap_or("url"));
+        }
+        Ok(body)
+    }
+
+    fn generate(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let body_json = self.build_body(req)?;
+        if let Some(m) = body_json.get("model").and_then(|v| v.as_str()) {
+            span.set_attr("gen_ai.request.model", m);
+        }
+        let traceparent = span.traceparent();
+        let url = self.images_url();
+        let api_key = self.api_key.clone();
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::ImageGeneration),
+        };
+
+        let (status_u16, body) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client.post(url).json(&body_json);
+            if let Some(k) = api_key {
+                r = r.header("authorization", format!("Bearer {}", k));
+            }
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            let body = resp.bytes().await.map_err(network_error)?;
+            Ok::<_, CanonicalError>((status, body))
+        })?;
+        span.set_attr("http.response.status_code", status_u16 as i64);
+        let body: Value = serde_json::from_slice(&body).unwrap_or(Value::Null);
+        if !(200..300).contains(&status_u16) {
+            let extra = OpenAIChatCompletionBackendAdapter::extract_openai_error_message(&body);
+            return Err(CanonicalError {
+                code: "upstream_error".to_string(),
+                message: match extra {
+                    Some(m) => format!("upstream status: {}: {}", status_u16, m),
+                    None => format!("upstream status: {}", status_u16),
+                },
+                retryable: status_u16 == 429 || status_u16 >= 500,
+                operation: Some(Operation::ImageGeneration),
+            });
+        }
+        let images = parse_images(&body).map_err(|m| CanonicalError {
+            code: "invalid_response".to_string(),
+            message: m,
+            retryable: false,
+            operation: Some(Operation::ImageGeneration),
+        })?;
+        span.set_attr("spear.images.count", images.len() as i64);
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": body_json["model"],
+                "created": body.get("created").cloned().unwrap_or(Value::Null),
+                "images": images,
+            })),
+            raw: None,
+        })
+    }
+}
+
+impl BackendAdapter for OpenAIImagesBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::ImageGeneration {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports image_generation only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = otel::Span::start(
+            "llm.image_generation",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "openai");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        let out = self.generate(req, &mut span);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{ImageGenerationPayload, Requirements, RoutingHints};
+    use std::collections::HashMap;
+
+    fn request(model: &str) -> CanonicalRequestEnvelope {
+        CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "img_1".to_string(),
+            operation: Operation::ImageGeneration,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Requirements::default(),
+            timeout_ms: None,
+            payload: Payload::ImageGeneration(ImageGenerationPayload {
+                prompt: "a red fox".to_string(),
+                model: Some(model.to_string()),
+                n: Some(2),
+                size: Some("1024x1024".to_string()),
+                response_format: None,
+            }),
+            extra: HashMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_build_body_and_parse_images() {
+        let adapter = OpenAIImagesBackendAdapter::new("openai", "https://api.openai.com", None);
+        assert_eq!(
+            adapter.images_url(),
+            "https://api.openai.com/v1/images/generations"
+        );
+        let body = adapter.build_body(&request("dall-e-3")).unwrap();
+        assert_eq!(body["response_format"], "url");
+        assert_eq!(body["n"], 2);
+        let body = adapter.build_body(&request("gpt-image-1")).unwrap();
+        assert!(body.get("response_format").is_none());
+
+        let images = parse_images(&json!({
+            "data": [
+                {"url": "https://example.com/a.png", "revised_prompt": "a fox"},
+                {"b64_json": "aGVsbG8="},
+            ]
+        }))
+        .unwrap();
+        assert_eq!(images[0]["url"], "https://example.com/a.png");
+        assert_eq!(images[0]["revised_prompt"], "a fox");
+        assert_eq!(images[1]["mime"], "image/png");
+        assert!(parse_images(&json!({"data": [{}]})).is_err());
+    }
+}
@@ -0,0 +1,273 @@
+//! OpenAI `/v1/moderations` backend / OpenAI `/v1/moderations` 后端
+//!
+//! All inputs of a request go out in one batch; one result per input comes back, in input
+//! order. Local classifiers answer in the same shape, see `local_moderation`.
+//! 一个请求的所有输入作为一批发送；每个输入返回一个结果，按输入顺序排列。本地分类器以同样的形式应答，
+//! 见 `local_moderation`。
+
+use serde_json::{json, Map, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::openai_chat_completion::OpenAIChatCompletionBackendAdapter;
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+use crate::spearlet::otel;
+
+/// Model used when the request names none / 请求未指定模型时使用的模型
+pub const DEFAULT_MODERATION_MODEL: &str = "omni-moderation-latest";
+
+pub struct OpenAIModerationsBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+fn bool_map(v: Option<&Value>) -> Map<String, Value> {
+    v.and_then(|v| v.as_object())
+        .map(|m| {
+            m.iter()
+                .filter_map(|(k, v)| v.as_bool().map(|b| (k.clone(), Value::Bool(b))))
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+fn score_map(v: Option<&Value>) -> Map<String, Value> {
+    v.and_then(|v| v.as_object())
+        .map(|m| {
+            m.iter()
+                .filter_map(|(k, v)| v.as_f64().map(|f| (k.clone(), json!(f.clamp(0.0, 1.0)))))
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+/// Results of a moderation answer, one per input, as `{flagged, categories, category_scores}`
+/// moderation 应答的结果，每个输入一个，形如 `{flagged, categories, category_scores}`
+///
+/// A result that omits `flagged` counts as flagged when any category is set.
+/// 省略 `flagged` 的结果在任一类别为真时视为已标记。
+pub(crate) fn parse_moderation_results(body: &Value, inputs: usize) -> Result<Vec<Value>, String> {
+    let results = body
+        .get("results")
+        .and_then(|d| d.as_array())
+        .ok_or("missing results")?;
+    if results.len() != inputs {
+        return Err(format!(
+            "{} moderation results for {} inputs",
+            results.len(),
+            inputs
+        ));
+    }
+    results
+        .iter()
+        .map(|r| {
+            let categories = bool_map(r.get("categories"));
+            let scores = score_map(r.get("category_scores"));
+            let flagged = match r.get("flagged") {
+                Some(Value::Bool(b)) => *b,
+                Some(_) => return Err("non-boolean flagged".to_string()),
+                None => categories.values().any(|v| v == &Value::Bool(true)),
+            };
+            Ok(json!({
+                "flagged": flagged,
+                "categories": categories,
+                "category_scores": scores,
+            }))
+        })
+        .collect()
+}
+
+impl OpenAIModerationsBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn moderations_url(&self) -> String {
+        let base = self.base_url.trim_end_matches('/');
+        if base.contains("/v1") {
+            format!("{}/moderations", base)
+        } else {
+            format!("{}/v1/moderations", base)
+        }
+    }
+
+    fn moderate(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let Payload::Moderations(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected moderations payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        if p.input.is_empty() {
+            return Err(CanonicalError {
+                code: "invalid_request".to_string(),
+                message: "missing input".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let model = p
+            .model
+            .as_deref()
+            .map(str::trim)
+            .filter(|m| !m.is_empty())
+            .unwrap_or(DEFAULT_MODERATION_MODEL);
+        span.set_attr("gen_ai.request.model", model);
+        span.set_attr("spear.moderations.inputs", p.input.len() as i64);
+        let body_json = json!({"model": model, "input": p.input});
+        let traceparent = span.traceparent();
+        let url = self.moderations_url();
+        let api_key = self.api_key.clone();
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::Moderations),
+        };
+
+        let (status_u16, body) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client.post(url).json(&body_json);
+            if let Some(key) = api_key.as_deref() {
+                r = r.header("authorization", format!("Bearer {}", key));
+            }
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            let body = resp.bytes().await.map_err(network_error)?;
+            Ok::<_, CanonicalError>((status, body))
+        })?;
+        span.set_attr("http.response.status_code", status_u16 as i64);
+        let body: Value = serde_json::from_slice(&body).unwrap_or(Value::Null);
+        if !(200..300).contains(&status_u16) {
+            let extra = OpenAIChatCompletionBackendAdapter::extract_openai_error_message(&body);
+            return Err(CanonicalError {
+                code: "upstream_error".to_string(),
+                message: match extra {
+                    Some(m) => format!("upstream status: {}: {}", status_u16, m),
+                    None => format!("upstream status: {}", status_u16),
+                },
+                retryable: status_u16 == 429 || status_u16 >= 500,
+                operation: Some(Operation::Moderations),
+            });
+        }
+        let results =
+            parse_moderation_results(&body, p.input.len()).map_err(|m| CanonicalError {
+                code: "invalid_response".to_string(),
+                message: m,
+                retryable: false,
+                operation: Some(Operation::Moderations),
+            })?;
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": body.get("model").cloned().unwrap_or(json!(model)),
+                "results": results,
+            })),
+            raw: None,
+        })
+    }
+}
+
+impl BackendAdapter for OpenAIModerationsBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::Moderations {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports moderations only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = otel::Span::start(
+            "llm.moderations",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "openai");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        let out = self.moderate(req, &mut span);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_moderation_results() {
+        let body = json!({
+            "model": "omni-moderation-latest",
+            "results": [
+                {
+                    "flagged": true,
+                    "categories": {"violence": true, "hate": false},
+                    "category_scores": {"violence": 0.91, "hate": 0.02}
+                },
+                {"categories": {"violence": false}}
+            ]
+        });
+        let r = parse_moderation_results(&body, 2).unwrap();
+        assert_eq!(r[0]["flagged"], json!(true));
+        assert_eq!(r[0]["category_scores"]["violence"], json!(0.91));
+        assert_eq!(r[1]["flagged"], json!(false));
+        assert!(parse_moderation_results(&body, 3).is_err());
+        assert!(parse_moderation_results(&json!({}), 1).is_err());
+
+        let adapter =
+            OpenAIModerationsBackendAdapter::new("openai", "https://api.openai.com", None);
+        assert_eq!(
+            adapter.moderations_url(),
+            "https://api.openai.com/v1/moderations"
+        );
+    }
+}
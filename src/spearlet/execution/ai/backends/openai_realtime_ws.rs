@@ -1,11 +1,10 @@
-use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::backends::{websocket_url, BackendAdapter};
 use crate::spearlet::execution::ai::ir::{
     CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope,
 };
 use crate::spearlet::execution::ai::streaming::{
-    StreamingPlan, StreamingWebsocketPlan, WebsocketPlan,
+    AsrProtocol, StreamingPlan, StreamingWebsocketPlan, WebsocketPlan,
 };
-use url::Url;
 
 pub struct OpenAIRealtimeWsBackendAdapter {
     name: String,
@@ -99,40 +98,14 @@ impl BackendAdapter for OpenAIRealtimeWsBackendAdapter {
                     }
                 })],
                 supports_turn_detection: true,
+                protocol: AsrProtocol::OpenaiRealtime,
             },
         }))
     }
 }
 
 fn derive_openai_realtime_ws_url(base_url: &str) -> Result<String, CanonicalError> {
-    let mut u = Url::parse(base_url).map_err(|e| CanonicalError {
-        code: "invalid_configuration".to_string(),
-        message: format!("invalid base_url: {e}"),
-        retryable: false,
-        operation: None,
-    })?;
-
-    let scheme = match u.scheme() {
-        "https" => "wss",
-        "http" => "ws",
-        "wss" => "wss",
-        "ws" => "ws",
-        s => {
-            return Err(CanonicalError {
-                code: "invalid_configuration".to_string(),
-                message: format!("unsupported base_url scheme: {s}"),
-                retryable: false,
-                operation: None,
-            })
-        }
-    };
-    u.set_scheme(scheme).map_err(|_| CanonicalError {
-        code: "invalid_configuration".to_string(),
-        message: "set scheme failed".to_string(),
-        retryable: false,
-        operation: None,
-    })?;
-
+    let mut u = websocket_url(base_url)?;
     let mut path = u.path().trim_end_matches('/').to_string();
     if !path.ends_with("/v1") {
         path = format!("{path}/v1");
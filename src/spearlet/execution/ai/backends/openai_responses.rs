@@ -0,0 +1,940 @@
+//! OpenAI Responses API backend / OpenAI Responses API 后端
+//!
+//! Serves `chat_completions` through `POST /v1/responses`. Unlike Chat Completions, the
+//! provider keeps each answer, so a chat session can continue from `previous_response_id` and
+//! send only its newer messages (see `provider_session`). System messages become
+//! `instructions`, which the provider does not carry over, so they are sent on every call.
+//! Answers, streamed events included, are turned back into `chat.completion` objects and
+//! chunks. Setting the chat param `provider_session` to false sends `store: false` and keeps
+//! every call stateless.
+//! 通过 `POST /v1/responses` 提供 `chat_completions`。与 Chat Completions 不同，提供方会保存每次应答，
+//! 因此 chat 会话可以从 `previous_response_id` 继续，只发送更新的消息（见 `provider_session`）。
+//! system 消息变为 `instructions`，提供方不会沿用它，因此每次调用都会发送。应答（包括流式事件）被转换回
+//! `chat.completion` 对象与 chunk。将 chat 参数 `provider_session` 设为 false 会发送 `store: false`，
+//! 使每次调用都无状态。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::chat_stream::{ChatStreamAccumulator, SseDecoder};
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, ChatMessage, Operation,
+    Payload, ResultPayload,
+};
+use crate::spearlet::execution::ai::provider_session::{ProviderSession, RESULT_KEY};
+use crate::spearlet::otel;
+use crate::spearlet::param_keys::{chat as chat_keys, mcp as mcp_keys};
+
+/// Params passed to the Responses API unchanged / 原样传给 Responses API 的参数
+const PASSTHROUGH_PARAMS: &[&str] = &[
+    "temperature",
+    "top_p",
+    "user",
+    "metadata",
+    "parallel_tool_calls",
+    "reasoning",
+];
+
+/// Error code of a call whose `previous_response_id` the provider no longer knows
+/// 提供方已不认识其 `previous_response_id` 的调用的错误码
+const SESSION_EXPIRED: &str = "provider_session_expired";
+
+fn invalid_request(req: &CanonicalRequestEnvelope, message: &str) -> CanonicalError {
+    CanonicalError {
+        code: "invalid_request".to_string(),
+        message: message.to_string(),
+        retryable: false,
+        operation: Some(req.operation.clone()),
+    }
+}
+
+/// Whether answers are stored for later calls / 应答是否被保存以供后续调用使用
+fn stores(req: &CanonicalRequestEnvelope) -> bool {
+    match &req.payload {
+        Payload::ChatCompletions(p) => p
+            .params
+            .get(chat_keys::PROVIDER_SESSION)
+            .and_then(|v| v.as_bool())
+            .unwrap_or(true),
+        _ => false,
+    }
+}
+
+pub struct OpenAIResponsesBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+impl OpenAIResponsesBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn responses_url(&self) -> String {
+        let base = self.base_url.trim_end_matches('/');
+        if base.contains("/v1") {
+            format!("{}/responses", base)
+        } else {
+            format!("{}/v1/responses", base)
+        }
+    }
+
+    /// Session this call can continue: the response id and the first message to send
+    /// 本次调用可以延续的会话：响应 id 与需要发送的第一条消息
+    fn resume(&self, req: &CanonicalRequestEnvelope) -> Option<(String, usize)> {
+        let Payload::ChatCompletions(p) = &req.payload else {
+            return None;
+        };
+        if !stores(req) {
+            return None;
+        }
+        let s = ProviderSession::from_request(req)?;
+        let at = s.resume_at(&self.name, &p.messages)?;
+        Some((s.response_id, at))
+    }
+
+    fn build_body(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        resume: Option<&(String, usize)>,
+    ) -> Result<Value, CanonicalError> {
+        let Payload::ChatCompletions(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected chat_completions payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        let model = p.model.trim();
+        if model.is_empty() {
+            return Err(invalid_request(req, "missing model"));
+        }
+
+        let instructions: Vec<String> = p
+            .messages
+            .iter()
+            .filter(|m| is_system(m))
+            .map(|m| content_text(&m.content))
+            .filter(|t| !t.is_empty())
+            .collect();
+        let from = resume.map(|(_, at)| *at).unwrap_or(0);
+        let input: Vec<Value> = p.messages[from.min(p.messages.len())..]
+            .iter()
+            .filter(|m| !is_system(m))
+            .flat_map(input_items)
+            .collect();
+        if input.is_empty() {
+            return Err(invalid_request(req, "missing messages"));
+        }
+
+        let mut body = json!({
+            "model": model,
+            "input": input,
+            "store": stores(req),
+        });
+        if !instructions.is_empty() {
+            body["instructions"] = Value::String(instructions.join("\n\n"));
+        }
+        if let Some((id, _)) = resume {
+            body["previous_response_id"] = Value::String(id.clone());
+        }
+        let tools: Vec<Value> = p.tools.iter().filter_map(tool_definition).collect();
+        if !tools.is_empty() {
+            body["tools"] = Value::Array(tools);
+        }
+
+        for (k, v) in p.params.iter() {
+            if k.starts_with(mcp_keys::param::PREFIX) || chat_keys::is_structural_param_key(k) {
+                continue;
+            }
+            match k.as_str() {
+                "max_tokens" | "max_completion_tokens" | "max_output_tokens" => {
+                    if let Some(n) = v.as_u64().filter(|n| *n > 0) {
+                        body["max_output_tokens"] = json!(n);
+                    }
+                }
+                "response_format" => {
+                    if let Some(f) = text_format(v) {
+                        body["text"] = json!({ "format": f });
+                    }
+                }
+                "tool_choice" => {
+                    if let Some(c) = tool_choice(v) {
+                        body["tool_choice"] = c;
+                    }
+                }
+                _ if PASSTHROUGH_PARAMS.contains(&k.as_str()) => {
+                    body[k.as_str()] = v.clone();
+                }
+                _ => {}
+            }
+        }
+        Ok(body)
+    }
+
+    fn extract_error_message(v: &Value) -> Option<String> {
+        let e = v.get("error").filter(|e| e.is_object()).unwrap_or(v);
+        let code = e.get("code").and_then(|x| x.as_str()).unwrap_or("");
+        let msg = e.get("message").and_then(|x| x.as_str()).unwrap_or("");
+        match (code.is_empty(), msg.is_empty()) {
+            (true, true) => None,
+            (false, false) => Some(format!("{}: {}", code, msg)),
+            (false, true) => Some(code.to_string()),
+            (true, false) => Some(msg.to_string()),
+        }
+    }
+
+    fn upstream_error(status: u16, body: &[u8], resumed: bool) -> CanonicalError {
+        let extra = serde_json::from_slice::<Value>(body)
+            .ok()
+            .and_then(|v| Self::extract_error_message(&v));
+        let message = match extra {
+            Some(m) => format!("upstream status: {}: {}", status, m),
+            None => format!("upstream status: {}", status),
+        };
+        if resumed && (status == 400 || status == 404) {
+            return CanonicalError {
+                code: SESSION_EXPIRED.to_string(),
+                message,
+                retryable: false,
+                operation: Some(Operation::ChatCompletions),
+            };
+        }
+        CanonicalError {
+            code: "upstream_error".to_string(),
+            message,
+            retryable: status == 429 || status >= 500,
+            operation: Some(Operation::ChatCompletions),
+        }
+    }
+
+    /// Client span under the calling hostcall / 调用方 hostcall 下的 client span
+    fn client_span(&self) -> otel::Span {
+        let mut span = otel::Span::start(
+            "llm.chat_completions",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "openai");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        span
+    }
+
+    fn respond(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+        mut on_event: Option<&mut dyn FnMut(Value)>,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let resume = self.resume(req);
+        span.set_attr("spear.provider_session.resumed", resume.is_some());
+        match self.call(req, resume.as_ref(), span, on_event.as_deref_mut()) {
+            // The provider dropped the conversation; the full history still answers the call
+            // 提供方已丢弃会话；完整历史仍可应答本次调用
+            Err(e) if e.code == SESSION_EXPIRED => {
+                span.set_attr("spear.provider_session.resumed", false);
+                self.call(req, None, span, on_event)
+            }
+            out => out,
+        }
+    }
+
+    fn call(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        resume: Option<&(String, usize)>,
+        span: &mut otel::Span,
+        on_event: Option<&mut dyn FnMut(Value)>,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let mut body_json = self.build_body(req, resume)?;
+        if let Some(m) = body_json.get("model").and_then(|v| v.as_str()) {
+            span.set_attr("gen_ai.request.model", m);
+        }
+        let stream = on_event.is_some();
+        if stream {
+            body_json["stream"] = Value::Bool(true);
+        }
+        let body_bytes = serde_json::to_vec(&body_json).map_err(|e| CanonicalError {
+            code: "serialization".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+        let traceparent = span.traceparent();
+        let resumed = resume.is_some();
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::ChatCompletions),
+        };
+
+        let (mut parsed, raw) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client
+                .post(self.responses_url())
+                .header("content-type", "application/json")
+                .body(body_bytes);
+            if let Some(key) = self.api_key.as_deref() {
+                r = r.bearer_auth(key);
+            }
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            if stream {
+                r = r.header("accept", "text/event-stream");
+            }
+            let mut resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            span.set_attr("http.response.status_code", status as i64);
+            if !(200..300).contains(&status) {
+                let body = resp.bytes().await.unwrap_or_default();
+                return Err(Self::upstream_error(status, &body, resumed));
+            }
+
+            let Some(on_event) = on_event else {
+                let body = resp.bytes().await.map_err(network_error)?.to_vec();
+                let v = serde_json::from_slice::<Value>(&body).map_err(|e| CanonicalError {
+                    code: "invalid_response".to_string(),
+                    message: e.to_string(),
+                    retryable: false,
+                    operation: Some(Operation::ChatCompletions),
+                })?;
+                let mut out = to_chat_completion(&v);
+                out[RESULT_KEY] = v["id"].clone();
+                return Ok((out, Some(body)));
+            };
+
+            let mut decoder = SseDecoder::default();
+            let mut translator = StreamTranslator::default();
+            let mut acc = ChatStreamAccumulator::default();
+            let mut done = false;
+            while !done {
+                let payloads = match resp.chunk().await.map_err(network_error)? {
+                    Some(b) => decoder.push(&b),
+                    None => {
+                        done = true;
+                        decoder.finish()
+                    }
+                };
+                for data in payloads {
+                    let Ok(event) = serde_json::from_str::<Value>(&data) else {
+                        continue;
+                    };
+                    if let Some(chunk) = translator.chunk(&event)? {
+                        for e in acc.push(&chunk) {
+                            on_event(e);
+                        }
+                    }
+                    if translator.finished {
+                        done = true;
+                        break;
+                    }
+                }
+            }
+            let mut out = acc.finish();
+            out[RESULT_KEY] = Value::String(translator.id);
+            Ok::<_, CanonicalError>((out, None))
+        })?;
+        if !stores(req) {
+            if let Some(o) = parsed.as_object_mut() {
+                o.remove(RESULT_KEY);
+            }
+        }
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(parsed),
+            raw,
+        })
+    }
+
+    fn invoke_with(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: Option<&mut dyn FnMut(Value)>,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::ChatCompletions {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "openai_responses supports chat_completions only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = self.client_span();
+        span.set_attr("gen_ai.request.stream", on_event.is_some());
+        let out = self.respond(req, &mut span, on_event);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+impl BackendAdapter for OpenAIResponsesBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        self.invoke_with(req, None)
+    }
+
+    fn invoke_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: &mut dyn FnMut(Value),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        self.invoke_with(req, Some(on_event))
+    }
+}
+
+fn is_system(m: &ChatMessage) -> bool {
+    m.role == "system" || m.role == "developer"
+}
+
+/// Text of an OpenAI message content / OpenAI 消息内容中的文本
+fn content_text(content: &Value) -> String {
+    match content {
+        Value::String(s) => s.clone(),
+        Value::Array(parts) => parts
+            .iter()
+            .filter_map(|p| p.get("text").and_then(|t| t.as_str()))
+            .collect::<Vec<_>>()
+            .join("\n"),
+        Value::Null => String::new(),
+        other => other.to_string(),
+    }
+}
+
+/// Input content parts of a user message / 用户消息的输入内容片段
+fn input_parts(content: &Value) -> Vec<Value> {
+    let Value::Array(parts) = content else {
+        let text = content_text(content);
+        if text.is_empty() {
+            return Vec::new();
+        }
+        return vec![json!({ "type": "input_text", "text": text })];
+    };
+    parts
+        .iter()
+        .filter_map(|p| match p.get("type").and_then(|t| t.as_str()) {
+            Some("text") => p
+                .get("text")
+                .and_then(|t| t.as_str())
+                .map(|t| json!({ "type": "input_text", "text": t })),
+            Some("image_url") => {
+                let url = p
+                    .get("image_url")
+                    .and_then(|u| u.get("url").or(Some(u)))
+                    .and_then(|u| u.as_str())?;
+                Some(json!({ "type": "input_image", "image_url": url }))
+            }
+            _ => None,
+        })
+        .collect()
+}
+
+/// Responses API input items of a chat message / chat 消息对应的 Responses API 输入项
+fn input_items(m: &ChatMessage) -> Vec<Value> {
+    match m.role.as_str() {
+        "tool" => vec![json!({
+            "type": "function_call_output",
+            "call_id": m.tool_call_id.clone().unwrap_or_default(),
+            "output": content_text(&m.content),
+        })],
+        "assistant" => {
+            let mut items = Vec::new();
+            let text = content_text(&m.content);
+            if !text.is_empty() {
+                items.push(json!({ "role": "assistant", "content": text }));
+            }
+            for tc in m.tool_calls.iter().flatten() {
+                items.push(json!({
+                    "type": "function_call",
+                    "call_id": tc.id,
+                    "name": tc.function.name,
+                    "arguments": tc.function.arguments,
+                }));
+            }
+            items
+        }
+        _ => {
+            let parts = input_parts(&m.content);
+            if parts.is_empty() {
+                return Vec::new();
+            }
+            vec![json!({ "role": "user", "content": parts })]
+        }
+    }
+}
+
+/// Responses API tool for an OpenAI function tool / OpenAI 函数工具对应的 Responses API 工具
+fn tool_definition(tool: &Value) -> Option<Value> {
+    let f = tool.get("function")?;
+    let name = f.get("name")?.as_str()?;
+    let mut out = json!({
+        "type": "function",
+        "name": name,
+        "parameters": f
+            .get("parameters")
+            .cloned()
+            .unwrap_or_else(|| json!({ "type": "object", "properties": {} })),
+    });
+    if let Some(d) = f.get("description").and_then(|d| d.as_str()) {
+        out["description"] = Value::String(d.to_string());
+    }
+    if let Some(s) = f.get("strict").and_then(|s| s.as_bool()) {
+        out["strict"] = Value::Bool(s);
+    }
+    Some(out)
+}
+
+fn tool_choice(v: &Value) -> Option<Value> {
+    match v {
+        Value::String(s) => Some(Value::String(s.clone())),
+        Value::Object(_) => {
+            let name = v["function"]["name"].as_str()?;
+            Some(json!({ "type": "function", "name": name }))
+        }
+        _ => None,
+    }
+}
+
+/// `text.format` for a Chat Completions `response_format` / Chat Completions `response_format` 对应的 `text.format`
+fn text_format(v: &Value) -> Option<Value> {
+    match v.get("type").and_then(|t| t.as_str())? {
+        "json_schema" => {
+            let s = v.get("json_schema")?;
+            let mut f = json!({
+                "type": "json_schema",
+                "name": s.get("name").cloned().unwrap_or_else(|| json!("response")),
+                "schema": s.get("schema").cloned().unwrap_or_else(|| json!({})),
+            });
+            if let Some(strict) = s.get("strict") {
+                f["strict"] = strict.clone();
+            }
+            Some(f)
+        }
+        ty => Some(json!({ "type": ty })),
+    }
+}
+
+fn finish_reason(v: &Value, has_tool_calls: bool) -> String {
+    if v["status"] == "incomplete" {
+        return match v["incomplete_details"]["reason"].as_str() {
+            Some("max_output_tokens") => "length",
+            Some("content_filter") => "content_filter",
+            _ => "stop",
+        }
+        .to_string();
+    }
+    if has_tool_calls {
+        "tool_calls".to_string()
+    } else {
+        "stop".to_string()
+    }
+}
+
+fn openai_usage(u: &Value) -> Value {
+    let input = u["input_tokens"].as_u64().unwrap_or(0);
+    let output = u["output_tokens"].as_u64().unwrap_or(0);
+    json!({
+        "prompt_tokens": input,
+        "completion_tokens": output,
+        "total_tokens": input + output,
+    })
+}
+
+/// `chat.completion` object for a response / 响应对应的 `chat.completion` 对象
+fn to_chat_completion(v: &Value) -> Value {
+    let mut text = String::new();
+    let mut tool_calls: Vec<Value> = Vec::new();
+    for item in v["output"].as_array().into_iter().flatten() {
+        match item["type"].as_str() {
+            Some("message") => {
+                for c in item["content"].as_array().into_iter().flatten() {
+                    if c["type"] == "output_text" {
+                        text.push_str(c["text"].as_str().unwrap_or(""));
+                    }
+                }
+            }
+            Some("function_call") => tool_calls.push(json!({
+                "id": item["call_id"],
+                "type": "function",
+                "function": {
+                    "name": item["name"],
+                    "arguments": item["arguments"].as_str().unwrap_or("{}"),
+                },
+            })),
+            _ => {}
+        }
+    }
+    let reason = finish_reason(v, !tool_calls.is_empty());
+    let mut message = json!({ "role": "assistant" });
+    message["content"] = if text.is_empty() && !tool_calls.is_empty() {
+        Value::Null
+    } else {
+        Value::String(text)
+    };
+    if !tool_calls.is_empty() {
+        message["tool_calls"] = Value::Array(tool_calls);
+    }
+    let mut out = json!({
+        "id": v["id"],
+        "object": "chat.completion",
+        "created": v["created_at"].as_i64().unwrap_or_else(|| chrono::Utc::now().timestamp()),
+        "model": v["model"],
+        "choices": [{ "index": 0, "message": message, "finish_reason": reason }],
+    });
+    if let Some(u) = v.get("usage").filter(|u| u.is_object()) {
+        out["usage"] = openai_usage(u);
+    }
+    out
+}
+
+/// Turns Responses API stream events into `chat.completion.chunk` objects
+/// 将 Responses API 流事件转换为 `chat.completion.chunk` 对象
+#[derive(Debug, Default)]
+struct StreamTranslator {
+    id: String,
+    model: String,
+    created: i64,
+    finished: bool,
+    /// Tool call index of each `function_call` output item / 每个 `function_call` 输出项的工具调用下标
+    tool_items: Vec<(u64, usize)>,
+}
+
+impl StreamTranslator {
+    fn wrap(&self, delta: Value, finish_reason: Option<String>) -> Value {
+        json!({
+            "id": self.id,
+            "object": "chat.completion.chunk",
+            "created": self.created,
+            "model": self.model,
+            "choices": [{ "index": 0, "delta": delta, "finish_reason": finish_reason }],
+        })
+    }
+
+    fn tool_index(&self, item: u64) -> Option<usize> {
+        self.tool_items
+            .iter()
+            .find(|(i, _)| *i == item)
+            .map(|(_, i)| *i)
+    }
+
+    fn chunk(&mut self, event: &Value) -> Result<Option<Value>, CanonicalError> {
+        let item = event["output_index"].as_u64().unwrap_or(0);
+        let chunk = match event["type"].as_str().unwrap_or("") {
+            "response.created" => {
+                let r = &event["response"];
+                self.id = r["id"].as_str().unwrap_or("").to_string();
+                self.model = r["model"].as_str().unwrap_or("").to_string();
+                self.created = r["created_at"]
+                    .as_i64()
+                    .unwrap_or_else(|| chrono::Utc::now().timestamp());
+                Some(self.wrap(json!({ "role": "assistant" }), None))
+            }
+            "response.output_text.delta" => event["delta"]
+                .as_str()
+                .map(|t| self.wrap(json!({ "content": t }), None)),
+            "response.output_item.added" if event["item"]["type"] == "function_call" => {
+                let it = &event["item"];
+                let index = self.tool_items.len();
+                self.tool_items.push((item, index));
+                Some(self.wrap(
+                    json!({ "tool_calls": [{
+                        "index": index,
+                        "id": it["call_id"],
+                        "type": "function",
+                        "function": { "name": it["name"], "arguments": "" },
+                    }] }),
+                    None,
+                ))
+            }
+            "response.function_call_arguments.delta" => match self.tool_index(item) {
+                Some(index) => event["delta"].as_str().map(|d| {
+                    self.wrap(
+                        json!({ "tool_calls": [{
+                            "index": index,
+                            "function": { "arguments": d },
+                        }] }),
+                        None,
+                    )
+                }),
+                None => None,
+            },
+            "response.completed" | "response.incomplete" => {
+                self.finished = true;
+                let r = &event["response"];
+                let reason = finish_reason(r, !self.tool_items.is_empty());
+                let mut c = self.wrap(json!({}), Some(reason));
+                if let Some(u) = r.get("usage").filter(|u| u.is_object()) {
+                    c["usage"] = openai_usage(u);
+                }
+                Some(c)
+            }
+            "response.failed" | "error" => {
+                let e = if event["type"] == "error" {
+                    event
+                } else {
+                    &event["response"]["error"]
+                };
+                return Err(CanonicalError {
+                    code: "upstream_error".to_string(),
+                    message: OpenAIResponsesBackendAdapter::extract_error_message(e)
+                        .unwrap_or_else(|| "stream error".to_string()),
+                    retryable: e["code"] == "server_error" || e["code"] == "rate_limit_exceeded",
+                    operation: Some(Operation::ChatCompletions),
+                });
+            }
+            _ => None,
+        };
+        Ok(chunk)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{
+        ChatCompletionsPayload, RoutingHints, ToolCall, ToolCallFunction,
+    };
+    use axum::{http::HeaderMap, routing::post, Json, Router};
+    use std::collections::HashMap;
+    use std::sync::{Arc, Mutex};
+    use tokio::net::TcpListener;
+
+    fn msg(role: &str, content: Value) -> ChatMessage {
+        ChatMessage {
+            role: role.to_string(),
+            content,
+            tool_call_id: None,
+            tool_calls: None,
+            name: None,
+        }
+    }
+
+    fn chat_req(
+        messages: Vec<ChatMessage>,
+        params: HashMap<String, Value>,
+    ) -> CanonicalRequestEnvelope {
+        CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::ChatCompletions,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::ChatCompletions(ChatCompletionsPayload {
+                model: "gpt-4o-mini".to_string(),
+                messages,
+                tools: vec![json!({
+                    "type": "function",
+                    "function": {
+                        "name": "get_weather",
+                        "parameters": {"type": "object", "properties": {"city": {"type": "string"}}},
+                    },
+                })],
+                params,
+            }),
+            extra: HashMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_body_translates_history_and_resumes() {
+        let adapter = OpenAIResponsesBackendAdapter::new("resp", "https://api.openai.com", None);
+        let mut assistant = msg("assistant", Value::Null);
+        assistant.tool_calls = Some(vec![ToolCall {
+            id: "call_1".to_string(),
+            ty: "function".to_string(),
+            function: ToolCallFunction {
+                name: "get_weather".to_string(),
+                arguments: "{\"city\":\"Paris\"}".to_string(),
+            },
+        }]);
+        let mut tool = msg("tool", json!("sunny"));
+        tool.tool_call_id = Some("call_1".to_string());
+        let mut params = HashMap::new();
+        params.insert("max_tokens".to_string(), json!(64));
+        params.insert("tool_choice".to_string(), json!("auto"));
+        params.insert(
+            "response_format".to_string(),
+            json!({"type": "json_schema", "json_schema": {"name": "w", "schema": {"type": "object"}}}),
+        );
+        params.insert(chat_keys::MAX_ITERATIONS.to_string(), json!(4));
+        let req = chat_req(
+            vec![
+                msg("system", json!("Be brief.")),
+                msg("user", json!("Weather in Paris?")),
+                assistant,
+                tool,
+            ],
+            params,
+        );
+
+        let body = adapter.build_body(&req, None).unwrap();
+        assert_eq!(body["instructions"], "Be brief.");
+        assert_eq!(body["store"], true);
+        assert_eq!(body["max_output_tokens"], 64);
+        assert_eq!(body["text"]["format"]["name"], "w");
+        assert_eq!(body["tools"][0]["name"], "get_weather");
+        assert!(body.get(chat_keys::MAX_ITERATIONS).is_none());
+        let input = body["input"].as_array().unwrap();
+        assert_eq!(input.len(), 3);
+        assert_eq!(input[0]["content"][0]["type"], "input_text");
+        assert_eq!(input[1]["type"], "function_call");
+        assert_eq!(input[2]["call_id"], "call_1");
+
+        // Resuming sends only the tool result, and the instructions again
+        // 延续会话时只发送工具结果，并再次发送 instructions
+        let body = adapter
+            .build_body(&req, Some(&("resp_1".to_string(), 3)))
+            .unwrap();
+        assert_eq!(body["previous_response_id"], "resp_1");
+        assert_eq!(body["input"].as_array().unwrap().len(), 1);
+        assert_eq!(body["input"][0]["type"], "function_call_output");
+        assert_eq!(body["instructions"], "Be brief.");
+        assert_eq!(
+            adapter.responses_url(),
+            "https://api.openai.com/v1/responses"
+        );
+    }
+
+    #[test]
+    fn test_stream_events_become_chunks() {
+        let events = [
+            json!({"type": "response.created", "response": {"id": "resp_1", "model": "gpt-4o-mini", "created_at": 1}}),
+            json!({"type": "response.output_text.delta", "output_index": 0, "delta": "Checking"}),
+            json!({"type": "response.output_item.added", "output_index": 1, "item": {"type": "function_call", "call_id": "call_1", "name": "get_weather"}}),
+            json!({"type": "response.function_call_arguments.delta", "output_index": 1, "delta": "{\"city\":"}),
+            json!({"type": "response.function_call_arguments.delta", "output_index": 1, "delta": "\"Paris\"}"}),
+            json!({"type": "response.completed", "response": {"status": "completed", "usage": {"input_tokens": 12, "output_tokens": 7}}}),
+        ];
+        let mut t = StreamTranslator::default();
+        let mut acc = ChatStreamAccumulator::default();
+        let mut guest = Vec::new();
+        for e in events.iter() {
+            if let Some(c) = t.chunk(e).unwrap() {
+                guest.extend(acc.push(&c));
+            }
+        }
+        assert!(t.finished);
+        assert_eq!(t.id, "resp_1");
+        assert_eq!(guest[0]["content"], "Checking");
+        let out = acc.finish();
+        let call = &out["choices"][0]["message"]["tool_calls"][0];
+        assert_eq!(call["id"], "call_1");
+        assert_eq!(call["function"]["arguments"], "{\"city\":\"Paris\"}");
+        assert_eq!(out["choices"][0]["finish_reason"], "tool_calls");
+        assert_eq!(out["usage"]["total_tokens"], 19);
+
+        let err = t
+            .chunk(&json!({"type": "error", "code": "server_error", "message": "busy"}))
+            .unwrap_err();
+        assert!(err.retryable);
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn test_expired_session_falls_back_to_full_history() {
+        let seen: Arc<Mutex<Vec<Value>>> = Arc::new(Mutex::new(Vec::new()));
+        let seen2 = seen.clone();
+        let app = Router::new().route(
+            "/v1/responses",
+            post(move |headers: HeaderMap, Json(body): Json<Value>| {
+                let seen = seen2.clone();
+                async move {
+                    assert_eq!(headers["authorization"], "Bearer sk-test");
+                    seen.lock().unwrap().push(body.clone());
+                    if body.get("previous_response_id").is_some() {
+                        return (
+                            axum::http::StatusCode::BAD_REQUEST,
+                            Json(json!({"error": {"code": "previous_response_not_found", "message": "gone"}})),
+                        );
+                    }
+                    (
+                        axum::http::StatusCode::OK,
+                        Json(json!({
+                            "id": "resp_2",
+                            "model": "gpt-4o-mini",
+                            "status": "completed",
+                            "output": [{"type": "message", "content": [{"type": "output_text", "text": "ok"}]}],
+                            "usage": {"input_tokens": 3, "output_tokens": 1},
+                        })),
+                    )
+                }
+            }),
+        );
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(listener, app).await.unwrap();
+        });
+
+        let adapter = OpenAIResponsesBackendAdapter::new(
+            "resp",
+            format!("http://{}", addr),
+            Some("sk-test".to_string()),
+        );
+        let first = chat_req(vec![msg("user", json!("hi"))], HashMap::new());
+        let mut answer = json!({ RESULT_KEY: "resp_1" });
+        let session = ProviderSession::from_answer("resp", &first, &mut answer).unwrap();
+        let mut req = chat_req(
+            vec![
+                msg("user", json!("hi")),
+                msg("assistant", json!("hello")),
+                msg("user", json!("again")),
+            ],
+            HashMap::new(),
+        );
+        session.attach(&mut req);
+
+        let resp = tokio::task::spawn_blocking(move || adapter.invoke(&req))
+            .await
+            .unwrap()
+            .unwrap();
+        let ResultPayload::Payload(v) = resp.result else {
+            panic!("unexpected result");
+        };
+        assert_eq!(v["choices"][0]["message"]["content"], "ok");
+        assert_eq!(v[RESULT_KEY], "resp_2");
+        let seen = seen.lock().unwrap();
+        assert_eq!(seen.len(), 2);
+        assert_eq!(seen[0]["input"].as_array().unwrap().len(), 1);
+        assert_eq!(seen[1]["input"].as_array().unwrap().len(), 3);
+    }
+}
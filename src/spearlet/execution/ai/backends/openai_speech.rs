@@ -0,0 +1,297 @@
+//! OpenAI `/v1/audio/speech` backend / OpenAI `/v1/audio/speech` 后端
+//!
+//! The endpoint answers with the encoded audio itself, sent chunked as it is synthesized.
+//! `invoke` returns the whole clip in `raw`; `invoke_audio_stream` hands each body chunk
+//! to the caller as soon as it is read.
+//! 该端点直接以编码后的音频应答，并在合成过程中分块发送。`invoke` 在 `raw` 中返回完整音频；
+//! `invoke_audio_stream` 在读到每个响应体分块后立即交给调用方。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::openai_chat_completion::OpenAIChatCompletionBackendAdapter;
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+use crate::spearlet::otel;
+
+pub const DEFAULT_VOICE: &str = "alloy";
+pub const DEFAULT_FORMAT: &str = "mp3";
+
+/// Encodings the endpoint accepts / 端点接受的编码
+pub const FORMATS: &[&str] = &["mp3", "opus", "aac", "flac", "wav", "pcm"];
+
+pub struct OpenAISpeechBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+impl OpenAISpeechBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn speech_url(&self) -> String {
+        let base = self.base_url.trim_end_matches('/');
+        if base.contains("/v1") {
+            format!("{}/audio/speech", base)
+        } else {
+            format!("{}/v1/audio/speech", base)
+        }
+    }
+
+    fn build_speech_body(&self, req: &CanonicalRequestEnvelope) -> Result<Value, CanonicalError> {
+        let invalid = |message: &str| CanonicalError {
+            code: "invalid_request".to_string(),
+            message: message.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        };
+        let Payload::TextToSpeech(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected text_to_speech payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        let model = p.model.as_deref().unwrap_or("").trim();
+        if model.is_empty() {
+            return Err(invalid("missing model"));
+        }
+        if p.input.trim().is_empty() {
+            return Err(invalid("missing input"));
+        }
+        let format = p.format.as_deref().unwrap_or(DEFAULT_FORMAT);
+        if !FORMATS.contains(&format) {
+            return Err(invalid(&format!("unsupported format: {}", format)));
+        }
+        let mut body = json!({
+            "model": model,
+            "input": p.input,
+            "voice": p.voice.as_deref().unwrap_or(DEFAULT_VOICE),
+            "response_format": format,
+        });
+        if let Some(speed) = p.speed {
+            if !(0.25..=4.0).contains(&speed) {
+                return Err(invalid("speed must be between 0.25 and 4.0"));
+            }
+            body["speed"] = json!(speed);
+        }
+        Ok(body)
+    }
+
+    /// Client span under the calling hostcall / 调用方 hostcall 下的 client span
+    fn client_span(&self) -> otel::Span {
+        let mut span = otel::Span::start(
+            "llm.text_to_speech",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "openai");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        span
+    }
+
+    fn speech(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+        on_chunk: &mut dyn FnMut(Vec<u8>),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let body_json = self.build_speech_body(req)?;
+        if let Some(m) = body_json.get("model").and_then(|v| v.as_str()) {
+            span.set_attr("gen_ai.request.model", m);
+        }
+        let traceparent = span.traceparent();
+        let body_bytes = serde_json::to_vec(&body_json).map_err(|e| CanonicalError {
+            code: "serialization".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let url = self.speech_url();
+        let api_key = self.api_key.clone();
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::TextToSpeech),
+        };
+
+        let total = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client
+                .post(url)
+                .header("content-type", "application/json")
+                .body(body_bytes);
+            if let Some(k) = api_key {
+                r = r.header("authorization", format!("Bearer {}", k));
+            }
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let mut resp = r.send().await.map_err(network_error)?;
+            let status_u16 = resp.status().as_u16();
+            span.set_attr("http.response.status_code", status_u16 as i64);
+            if !(200..300).contains(&status_u16) {
+                let body = resp.bytes().await.unwrap_or_default();
+                let extra = serde_json::from_slice::<Value>(&body).ok().and_then(|v| {
+                    OpenAIChatCompletionBackendAdapter::extract_openai_error_message(&v)
+                });
+                return Err(CanonicalError {
+                    code: "upstream_error".to_string(),
+                    message: match extra {
+                        Some(m) => format!("upstream status: {}: {}", status_u16, m),
+                        None => format!("upstream status: {}", status_u16),
+                    },
+                    retryable: status_u16 == 429 || status_u16 >= 500,
+                    operation: Some(Operation::TextToSpeech),
+                });
+            }
+            let mut total = 0usize;
+            while let Some(chunk) = resp.chunk().await.map_err(network_error)? {
+                if chunk.is_empty() {
+                    continue;
+                }
+                total += chunk.len();
+                on_chunk(chunk.to_vec());
+            }
+            Ok::<_, CanonicalError>(total)
+        })?;
+        span.set_attr("spear.audio.bytes", total as i64);
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": body_json["model"],
+                "voice": body_json["voice"],
+                "format": body_json["response_format"],
+                "bytes": total,
+            })),
+            raw: None,
+        })
+    }
+}
+
+impl BackendAdapter for OpenAISpeechBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let mut audio = Vec::new();
+        let mut resp = self.invoke_audio_stream(req, &mut |chunk| audio.extend(chunk))?;
+        resp.raw = Some(audio);
+        Ok(resp)
+    }
+
+    fn invoke_audio_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_chunk: &mut dyn FnMut(Vec<u8>),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::TextToSpeech {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports text_to_speech only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+
+        let mut span = self.client_span();
+        let out = self.speech(req, &mut span, on_chunk);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{RoutingHints, TextToSpeechPayload};
+    use std::collections::HashMap;
+
+    fn tts_req(format: Option<&str>, speed: Option<f64>) -> CanonicalRequestEnvelope {
+        CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::TextToSpeech,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::TextToSpeech(TextToSpeechPayload {
+                model: Some("tts-1".to_string()),
+                input: "hello".to_string(),
+                voice: None,
+                format: format.map(|s| s.to_string()),
+                speed,
+            }),
+            extra: HashMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_build_speech_body() {
+        let adapter = OpenAISpeechBackendAdapter::new("openai", "https://api.openai.com/v1/", None);
+        assert_eq!(
+            adapter.speech_url(),
+            "https://api.openai.com/v1/audio/speech"
+        );
+
+        let body = adapter.build_speech_body(&tts_req(None, None)).unwrap();
+        assert_eq!(body["voice"], DEFAULT_VOICE);
+        assert_eq!(body["response_format"], DEFAULT_FORMAT);
+        assert!(body.get("speed").is_none());
+
+        let body = adapter
+            .build_speech_body(&tts_req(Some("pcm"), Some(1.5)))
+            .unwrap();
+        assert_eq!(body["response_format"], "pcm");
+        assert_eq!(body["speed"], 1.5);
+
+        let err = adapter
+            .build_speech_body(&tts_req(Some("midi"), None))
+            .unwrap_err();
+        assert_eq!(err.code, "invalid_request");
+        let err = adapter
+            .build_speech_body(&tts_req(None, Some(9.0)))
+            .unwrap_err();
+        assert_eq!(err.code, "invalid_request");
+    }
+}
@@ -0,0 +1,234 @@
+//! Stability text-to-image backend / Stability 文生图后端
+//!
+//! Speaks the JSON text-to-image API (`POST /v1/generation/{engine}/text-to-image`) that
+//! Stability and compatible servers offer: `base_url` is the full endpoint, with `{model}`
+//! replaced by the model name. Images always come back inline as base64.
+//! 使用 Stability 及兼容服务提供的 JSON 文生图接口（`POST /v1/generation/{engine}/text-to-image`）：
+//! `base_url` 为完整端点，其中的 `{model}` 替换为模型名。图像总是以 base64 内联返回。
+
+use serde_json::{json, Value};
+use std::time::Duration;
+
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
+    ResultPayload,
+};
+use crate::spearlet::execution::ai::normalize::image::parse_size;
+use crate::spearlet::otel;
+
+pub struct StabilityImageBackendAdapter {
+    name: String,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+/// Images of a text-to-image answer; failed artifacts are left out
+/// 文生图应答中的图像；失败的产物被略去
+fn parse_artifacts(body: &Value) -> Result<Vec<Value>, String> {
+    let artifacts = body
+        .get("artifacts")
+        .and_then(|d| d.as_array())
+        .ok_or("missing artifacts")?;
+    let images: Vec<Value> = artifacts
+        .iter()
+        .filter(|a| a.get("finishReason").and_then(|v| v.as_str()) != Some("ERROR"))
+        .filter_map(|a| {
+            let b64 = a.get("base64").and_then(|v| v.as_str())?;
+            Some(json!({
+                "b64_json": b64,
+                "mime": "image/png",
+                "seed": a.get("seed").cloned().unwrap_or(Value::Null),
+            }))
+        })
+        .collect();
+    if images.is_empty() {
+        return Err("no images in answer".to_string());
+    }
+    Ok(images)
+}
+
+impl StabilityImageBackendAdapter {
+    pub fn new(
+        name: impl Into<String>,
+        base_url: impl Into<String>,
+        api_key: Option<String>,
+    ) -> Self {
+        Self {
+            name: name.into(),
+            base_url: base_url.into(),
+            api_key: api_key
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty()),
+        }
+    }
+
+    fn generate(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        span: &mut otel::Span,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let invalid = |message: &str| CanonicalError {
+            code: "invalid_request".to_string(),
+            message: message.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        };
+        let Payload::ImageGeneration(p) = &req.payload else {
+            return Err(CanonicalError {
+                code: "payload_mismatch".to_string(),
+                message: "expected image_generation payload".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        };
+        if p.prompt.trim().is_empty() {
+            return Err(invalid("missing prompt"));
+        }
+        let model = p.model.as_deref().unwrap_or("").trim().to_string();
+        if model.is_empty() && self.base_url.contains("{model}") {
+            return Err(invalid("missing model"));
+        }
+        span.set_attr("gen_ai.request.model", model.as_str());
+
+        let mut body_json = json!({
+            "text_prompts": [{"text": p.prompt}],
+            "samples": p.n.unwrap_or(1),
+        });
+        if let Some(size) = &p.size {
+            let (w, h) = parse_size(size).ok_or_else(|| invalid("size must be WIDTHxHEIGHT"))?;
+            body_json["width"] = json!(w);
+            body_json["height"] = json!(h);
+        }
+
+        let url = self.base_url.replace("{model}", &model);
+        let api_key = self.api_key.clone();
+        let traceparent = span.traceparent();
+        let timeout = req.timeout_ms.map(Duration::from_millis);
+
+        let rt = tokio::runtime::Runtime::new().map_err(|e| CanonicalError {
+            code: "runtime_error".to_string(),
+            message: e.to_string(),
+            retryable: false,
+            operation: Some(req.operation.clone()),
+        })?;
+        let network_error = |e: reqwest::Error| CanonicalError {
+            code: "network_error".to_string(),
+            message: e.to_string(),
+            retryable: true,
+            operation: Some(Operation::ImageGeneration),
+        };
+
+        let (status_u16, body) = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let mut r = client
+                .post(url)
+                .header("accept", "application/json")
+                .json(&body_json);
+            if let Some(k) = api_key {
+                r = r.header("authorization", format!("Bearer {}", k));
+            }
+            if let Some(tp) = traceparent {
+                r = r.header(otel::TRACEPARENT_KEY, tp);
+            }
+            if let Some(t) = timeout {
+                r = r.timeout(t);
+            }
+            let resp = r.send().await.map_err(network_error)?;
+            let status = resp.status().as_u16();
+            let body = resp.bytes().await.map_err(network_error)?;
+            Ok::<_, CanonicalError>((status, body))
+        })?;
+        span.set_attr("http.response.status_code", status_u16 as i64);
+        let body: Value = serde_json::from_slice(&body).unwrap_or(Value::Null);
+        if !(200..300).contains(&status_u16) {
+            let extra = body
+                .get("message")
+                .and_then(|e| e.as_str())
+                .map(|s| s.to_string());
+            return Err(CanonicalError {
+                code: "upstream_error".to_string(),
+                message: match extra {
+                    Some(m) => format!("upstream status: {}: {}", status_u16, m),
+                    None => format!("upstream status: {}", status_u16),
+                },
+                retryable: status_u16 == 429 || status_u16 >= 500,
+                operation: Some(Operation::ImageGeneration),
+            });
+        }
+        let images = parse_artifacts(&body).map_err(|m| CanonicalError {
+            code: "invalid_response".to_string(),
+            message: m,
+            retryable: false,
+            operation: Some(Operation::ImageGeneration),
+        })?;
+        span.set_attr("spear.images.count", images.len() as i64);
+
+        Ok(CanonicalResponseEnvelope {
+            version: 1,
+            request_id: req.request_id.clone(),
+            operation: req.operation.clone(),
+            backend: self.name.clone(),
+            result: ResultPayload::Payload(json!({
+                "model": model,
+                "created": Value::Null,
+                "images": images,
+            })),
+            raw: None,
+        })
+    }
+}
+
+impl BackendAdapter for StabilityImageBackendAdapter {
+    fn name(&self) -> &str {
+        &self.name
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        if req.operation != Operation::ImageGeneration {
+            return Err(CanonicalError {
+                code: "unsupported_operation".to_string(),
+                message: "backend supports image_generation only".to_string(),
+                retryable: false,
+                operation: Some(req.operation.clone()),
+            });
+        }
+        let mut span = otel::Span::start(
+            "llm.image_generation",
+            otel::SpanKind::Client,
+            otel::current().as_ref(),
+        );
+        span.set_attr("gen_ai.system", "stability");
+        span.set_attr("spear.backend", self.name.as_str());
+        span.set_attr("server.address", self.base_url.as_str());
+        let out = self.generate(req, &mut span);
+        if let Err(e) = &out {
+            span.set_error(format!("{}: {}", e.code, e.message));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_artifacts_skips_failures() {
+        let body = json!({
+            "artifacts": [
+                {"base64": "aGVsbG8=", "seed": 7, "finishReason": "SUCCESS"},
+                {"base64": "", "seed": 8, "finishReason": "ERROR"},
+            ]
+        });
+        let images = parse_artifacts(&body).unwrap();
+        assert_eq!(images.len(), 1);
+        assert_eq!(images[0]["b64_json"], "aGVsbG8=");
+        assert_eq!(images[0]["seed"], 7);
+        assert!(parse_artifacts(&json!({"artifacts": []})).is_err());
+        assert!(parse_artifacts(&json!({"message": "x"})).is_err());
+    }
+}
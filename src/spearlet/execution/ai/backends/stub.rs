@@ -1,9 +1,12 @@
+use base64::Engine;
 use serde_json::json;
+use sha2::{Digest, Sha256};
 
 use crate::spearlet::execution::ai::backends::BackendAdapter;
 use crate::spearlet::execution::ai::ir::{
-    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Operation, Payload,
-    ResultPayload,
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, EmbeddingsPayload,
+    ImageGenerationPayload, ModerationsPayload, Operation, Payload, ResultPayload,
+    TextToSpeechPayload,
 };
 
 pub struct StubBackendAdapter {
@@ -37,6 +40,72 @@ fn parse_first_two_i64(s: &str) -> Option<(i64, i64)> {
     }
 }
 
+/// Stand-in audio: the input text tagged with the voice / 替代音频：带有音色标记的输入文本
+fn stub_audio(p: &TextToSpeechPayload) -> Vec<u8> {
+    format!("{}:{}", p.voice.as_deref().unwrap_or("stub"), p.input).into_bytes()
+}
+
+/// Length of stub embedding vectors / 替代嵌入向量的长度
+pub const STUB_EMBEDDING_DIMENSIONS: usize = 8;
+
+/// Stand-in embeddings: unit vectors derived from a hash of each input, equal for equal inputs
+/// 替代嵌入：由每个输入的哈希导出的单位向量，相同输入得到相同向量
+fn stub_embeddings(p: &EmbeddingsPayload) -> Vec<Vec<f32>> {
+    p.input
+        .iter()
+        .map(|text| {
+            let digest = Sha256::digest(text.as_bytes());
+            let v: Vec<f32> = digest[..STUB_EMBEDDING_DIMENSIONS]
+                .iter()
+                .map(|b| *b as f32 - 127.5)
+                .collect();
+            let norm = v.iter().map(|x| x * x).sum::<f32>().sqrt();
+            v.into_iter().map(|x| x / norm).collect()
+        })
+        .collect()
+}
+
+/// Stand-in images: `stub://image/{i}` URLs, or the prompt as inline bytes
+/// 替代图像：`stub://image/{i}` URL，或以提示词作为内联字节
+fn stub_images(p: &ImageGenerationPayload) -> Vec<serde_json::Value> {
+    let inline = p.response_format.as_deref() == Some("b64_json");
+    (0..p.n.unwrap_or(1))
+        .map(|i| {
+            if inline {
+                let png = format!("stub:{}", p.prompt);
+                json!({
+                    "b64_json": base64::engine::general_purpose::STANDARD.encode(png),
+                    "mime": "image/png",
+                })
+            } else {
+                json!({"url": format!("stub://image/{}", i)})
+            }
+        })
+        .collect()
+}
+
+/// Inputs containing this are flagged by the stub / 包含该标记的输入会被替代后端标记
+pub const STUB_FLAGGED_MARKER: &str = "[flagged]";
+
+/// Stand-in moderation: `harassment` for inputs carrying `STUB_FLAGGED_MARKER`
+/// 替代 moderation：带有 `STUB_FLAGGED_MARKER` 的输入被标记为 `harassment`
+fn stub_moderations(p: &ModerationsPayload) -> Vec<serde_json::Value> {
+    p.input
+        .iter()
+        .map(|text| {
+            let flagged = text.contains(STUB_FLAGGED_MARKER);
+            json!({
+                "flagged": flagged,
+                "categories": {"harassment": flagged},
+                "category_scores": {"harassment": if flagged { 0.99 } else { 0.01 }},
+            })
+        })
+        .collect()
+}
+
+/// Bytes per chunk when streaming stub audio / 流式输出替代音频时每个分块的字节数
+const STUB_AUDIO_CHUNK_BYTES: usize = 8;
+
 impl StubBackendAdapter {
     pub fn new(name: impl Into<String>) -> Self {
         Self { name: name.into() }
@@ -152,12 +221,78 @@ impl BackendAdapter for StubBackendAdapter {
                     raw: None,
                 })
             }
+            Payload::TextToSpeech(p) => {
+                let format = p.format.clone().unwrap_or_else(|| "pcm".to_string());
+                let audio = stub_audio(p);
+                Ok(CanonicalResponseEnvelope {
+                    version: 1,
+                    request_id: req.request_id.clone(),
+                    operation: Operation::TextToSpeech,
+                    backend: self.name.clone(),
+                    result: ResultPayload::Payload(json!({
+                        "model": p.model,
+                        "voice": p.voice,
+                        "format": format,
+                        "bytes": audio.len(),
+                    })),
+                    raw: Some(audio),
+                })
+            }
+            Payload::Embeddings(p) => Ok(CanonicalResponseEnvelope {
+                version: 1,
+                request_id: req.request_id.clone(),
+                operation: Operation::Embeddings,
+                backend: self.name.clone(),
+                result: ResultPayload::Payload(json!({
+                    "model": p.model,
+                    "dimensions": STUB_EMBEDDING_DIMENSIONS,
+                    "data": stub_embeddings(p),
+                    "usage": {"prompt_tokens": 0, "total_tokens": 0},
+                })),
+                raw: None,
+            }),
+            Payload::ImageGeneration(p) => Ok(CanonicalResponseEnvelope {
+                version: 1,
+                request_id: req.request_id.clone(),
+                operation: Operation::ImageGeneration,
+                backend: self.name.clone(),
+                result: ResultPayload::Payload(json!({
+                    "model": p.model,
+                    "created": chrono::Utc::now().timestamp(),
+                    "images": stub_images(p),
+                })),
+                raw: None,
+            }),
+            Payload::Moderations(p) => Ok(CanonicalResponseEnvelope {
+                version: 1,
+                request_id: req.request_id.clone(),
+                operation: Operation::Moderations,
+                backend: self.name.clone(),
+                result: ResultPayload::Payload(json!({
+                    "model": p.model,
+                    "results": stub_moderations(p),
+                })),
+                raw: None,
+            }),
             _ => Err(CanonicalError {
                 code: "unsupported_operation".to_string(),
-                message: "stub backend only supports chat_completions".to_string(),
+                message: "stub backend only supports chat_completions, text_to_speech, embeddings, image_generation and moderations".to_string(),
                 retryable: false,
                 operation: Some(req.operation.clone()),
             }),
         }
     }
+
+    fn invoke_audio_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_chunk: &mut dyn FnMut(Vec<u8>),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let mut resp = self.invoke(req)?;
+        let audio = resp.raw.take().unwrap_or_default();
+        for chunk in audio.chunks(STUB_AUDIO_CHUNK_BYTES) {
+            on_chunk(chunk.to_vec());
+        }
+        Ok(resp)
+    }
 }
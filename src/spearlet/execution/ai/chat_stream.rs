@@ -0,0 +1,311 @@
+//! Streamed chat completions / 流式 chat completion
+//!
+//! OpenAI-compatible backends answer `stream: true` requests with server-sent events, one
+//! `chat.completion.chunk` per event. [`SseDecoder`] splits the body into event payloads.
+//! [`ChatStreamAccumulator`] turns each chunk into guest events. It also assembles the
+//! `chat.completion` object a non-streamed request would return, tool calls included.
+//! OpenAI 兼容后端以 server-sent events 应答 `stream: true` 请求，每个事件一个
+//! `chat.completion.chunk`。[`SseDecoder`] 将响应体拆分为事件载荷；[`ChatStreamAccumulator`]
+//! 将每个 chunk 转换为 guest 事件，并拼装出与非流式请求相同的 `chat.completion` 对象（包括工具调用）。
+//!
+//! Guest events / guest 事件：
+//!
+//! - `{"type": "delta", "content": "..."}`
+//! - `{"type": "tool_call_delta", "index": 0, "id": "...", "name": "...", "arguments": "..."}`
+//! - `{"type": "done", "finish_reason": "stop"}`
+//! - `{"type": "error", "code": "...", "message": "..."}`
+
+use serde_json::{json, Value};
+
+pub const EVENT_DELTA: &str = "delta";
+pub const EVENT_TOOL_CALL_DELTA: &str = "tool_call_delta";
+pub const EVENT_DONE: &str = "done";
+pub const EVENT_ERROR: &str = "error";
+
+/// `data` payload ending an OpenAI stream / 结束 OpenAI 流的 `data` 载荷
+pub const DONE_MARKER: &str = "[DONE]";
+
+/// Tool calls tracked per response; higher indexes are ignored / 每个响应跟踪的工具调用数，更大的下标被忽略
+const MAX_TOOL_CALLS: usize = 128;
+
+/// Splits a server-sent event body into `data` payloads / 将 server-sent event 响应体拆分为 `data` 载荷
+#[derive(Debug, Default)]
+pub struct SseDecoder {
+    buf: Vec<u8>,
+}
+
+impl SseDecoder {
+    /// Feed body bytes; returns the payload of every completed event
+    /// 输入响应体字节；返回每个已完整事件的载荷
+    pub fn push(&mut self, bytes: &[u8]) -> Vec<String> {
+        // Events may be split anywhere, even inside a UTF-8 sequence
+        // 事件可能在任意位置被切分，甚至在 UTF-8 序列中间
+        self.buf.extend(bytes.iter().filter(|b| **b != b'\r'));
+        let mut out = Vec::new();
+        while let Some(pos) = self.buf.windows(2).position(|w| w == b"\n\n") {
+            let event: Vec<u8> = self.buf.drain(..pos + 2).collect();
+            let text = String::from_utf8_lossy(&event);
+            let data: Vec<&str> = text
+                .lines()
+                .filter_map(|l| l.strip_prefix("data:"))
+                .map(|d| d.strip_prefix(' ').unwrap_or(d))
+                .collect();
+            if !data.is_empty() {
+                out.push(data.join("\n"));
+            }
+        }
+        out
+    }
+
+    /// Flush an event left without its trailing blank line / 输出缺少结尾空行的最后一个事件
+    pub fn finish(&mut self) -> Vec<String> {
+        if self.buf.is_empty() {
+            return Vec::new();
+        }
+        self.push(b"\n\n")
+    }
+}
+
+#[derive(Debug, Default)]
+struct PartialToolCall {
+    id: String,
+    kind: String,
+    name: String,
+    arguments: String,
+}
+
+/// Folds `chat.completion.chunk` objects into one response / 将 `chat.completion.chunk` 对象合并为一个响应
+#[derive(Debug, Default)]
+pub struct ChatStreamAccumulator {
+    id: String,
+    model: String,
+    created: i64,
+    role: String,
+    content: String,
+    tool_calls: Vec<PartialToolCall>,
+    finish_reason: Option<String>,
+    usage: Option<Value>,
+}
+
+impl ChatStreamAccumulator {
+    /// Fold one chunk in; returns the guest events it carries
+    /// 合并一个 chunk；返回其携带的 guest 事件
+    pub fn push(&mut self, chunk: &Value) -> Vec<Value> {
+        if self.id.is_empty() {
+            self.id = str_field(chunk, "id").unwrap_or_default().to_string();
+        }
+        if self.model.is_empty() {
+            self.model = str_field(chunk, "model").unwrap_or_default().to_string();
+        }
+        if self.created == 0 {
+            self.created = chunk.get("created").and_then(|v| v.as_i64()).unwrap_or(0);
+        }
+        if let Some(u) = chunk.get("usage").filter(|u| !u.is_null()) {
+            self.usage = Some(u.clone());
+        }
+        let mut events = Vec::new();
+        let Some(choice) = chunk.get("choices").and_then(|c| c.get(0)) else {
+            return events;
+        };
+        if let Some(delta) = choice.get("delta") {
+            if let Some(role) = str_field(delta, "role") {
+                self.role = role.to_string();
+            }
+            if let Some(c) = str_field(delta, "content").filter(|c| !c.is_empty()) {
+                self.content.push_str(c);
+                events.push(json!({ "type": EVENT_DELTA, "content": c }));
+            }
+            let calls = delta.get("tool_calls").and_then(|v| v.as_array());
+            for (pos, tc) in calls.into_iter().flatten().enumerate() {
+                if let Some(e) = self.push_tool_call(pos, tc) {
+                    events.push(e);
+                }
+            }
+        }
+        if let Some(f) = str_field(choice, "finish_reason") {
+            self.finish_reason = Some(f.to_string());
+        }
+        events
+    }
+
+    fn push_tool_call(&mut self, pos: usize, tc: &Value) -> Option<Value> {
+        let index = tc
+            .get("index")
+            .and_then(|v| v.as_u64())
+            .map(|i| i as usize)
+            .unwrap_or(pos);
+        if index >= MAX_TOOL_CALLS {
+            return None;
+        }
+        while self.tool_calls.len() <= index {
+            self.tool_calls.push(PartialToolCall::default());
+        }
+        let call = &mut self.tool_calls[index];
+        let mut event = json!({ "type": EVENT_TOOL_CALL_DELTA, "index": index });
+        if let Some(id) = str_field(tc, "id") {
+            call.id = id.to_string();
+            event["id"] = id.into();
+        }
+        if let Some(kind) = str_field(tc, "type") {
+            call.kind = kind.to_string();
+        }
+        if let Some(f) = tc.get("function") {
+            if let Some(name) = str_field(f, "name") {
+                call.name.push_str(name);
+                event["name"] = name.into();
+            }
+            if let Some(args) = str_field(f, "arguments") {
+                call.arguments.push_str(args);
+                event["arguments"] = args.into();
+            }
+        }
+        Some(event)
+    }
+
+    /// Finish reason reported so far / 目前报告的结束原因
+    pub fn finish_reason(&self) -> Option<&str> {
+        self.finish_reason.as_deref()
+    }
+
+    /// The assembled `chat.completion` object / 拼装后的 `chat.completion` 对象
+    pub fn finish(self) -> Value {
+        let role = if self.role.is_empty() {
+            "assistant".to_string()
+        } else {
+            self.role
+        };
+        let mut message = json!({ "role": role });
+        message["content"] = if self.content.is_empty() && !self.tool_calls.is_empty() {
+            Value::Null
+        } else {
+            Value::String(self.content)
+        };
+        if !self.tool_calls.is_empty() {
+            let calls: Vec<Value> = self
+                .tool_calls
+                .into_iter()
+                .map(|c| {
+                    let kind = if c.kind.is_empty() {
+                        "function".to_string()
+                    } else {
+                        c.kind
+                    };
+                    json!({
+                        "id": c.id,
+                        "type": kind,
+                        "function": { "name": c.name, "arguments": c.arguments },
+                    })
+                })
+                .collect();
+            message["tool_calls"] = Value::Array(calls);
+        }
+        let mut out = json!({
+            "id": self.id,
+            "object": "chat.completion",
+            "created": self.created,
+            "model": self.model,
+            "choices": [{
+                "index": 0,
+                "message": message,
+                "finish_reason": self.finish_reason,
+            }],
+        });
+        if let Some(u) = self.usage {
+            out["usage"] = u;
+        }
+        out
+    }
+}
+
+fn str_field<'a>(v: &'a Value, key: &str) -> Option<&'a str> {
+    v.get(key).and_then(|x| x.as_str())
+}
+
+/// Events of a response that was not streamed, so guests read both alike
+/// 未流式返回的响应对应的事件，使 guest 以相同方式读取两者
+pub fn events_from_response(resp: &Value) -> Vec<Value> {
+    let message = &resp["choices"][0]["message"];
+    let mut events = Vec::new();
+    if let Some(c) = str_field(message, "content").filter(|c| !c.is_empty()) {
+        events.push(json!({ "type": EVENT_DELTA, "content": c }));
+    }
+    let calls = message.get("tool_calls").and_then(|v| v.as_array());
+    for (index, tc) in calls.into_iter().flatten().enumerate() {
+        events.push(json!({
+            "type": EVENT_TOOL_CALL_DELTA,
+            "index": index,
+            "id": tc["id"],
+            "name": tc["function"]["name"],
+            "arguments": tc["function"]["arguments"],
+        }));
+    }
+    events
+}
+
+/// Last event of a successful stream / 成功的流的最后一个事件
+pub fn done_event(resp: &Value) -> Value {
+    json!({ "type": EVENT_DONE, "finish_reason": resp["choices"][0]["finish_reason"] })
+}
+
+/// Last event of a failed stream / 失败的流的最后一个事件
+pub fn error_event(code: &str, message: &str) -> Value {
+    json!({ "type": EVENT_ERROR, "code": code, "message": message })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_sse_decoder_handles_split_events() {
+        let mut d = SseDecoder::default();
+        assert!(d.push(b"data: {\"a\":").is_empty());
+        let out = d.push(b"1}\r\n\r\ndata: [DONE]\n\n: comment\n\ndata: x");
+        assert_eq!(out, vec!["{\"a\":1}".to_string(), DONE_MARKER.to_string()]);
+        assert_eq!(d.finish(), vec!["x".to_string()]);
+
+        // A multi-byte character split across reads / 跨两次读取的多字节字符
+        let bytes = "data: 你好\n\n".as_bytes();
+        let mut d = SseDecoder::default();
+        assert!(d.push(&bytes[..8]).is_empty());
+        assert_eq!(d.push(&bytes[8..]), vec!["你好".to_string()]);
+    }
+
+    #[test]
+    fn test_accumulator_assembles_content_and_tool_calls() {
+        let chunks = [
+            json!({"id": "c1", "model": "m", "created": 7,
+                "choices": [{"index": 0, "delta": {"role": "assistant", "content": "Hel"}}]}),
+            json!({"choices": [{"index": 0, "delta": {"content": "lo"}}]}),
+            json!({"choices": [{"index": 0, "delta": {"tool_calls": [
+                {"index": 0, "id": "t1", "type": "function",
+                 "function": {"name": "get_weather", "arguments": "{\"ci"}}]}}]}),
+            json!({"choices": [{"index": 0, "delta": {"tool_calls": [
+                {"index": 0, "function": {"arguments": "ty\":\"x\"}"}}]}}]}),
+            json!({"choices": [{"index": 0, "delta": {}, "finish_reason": "tool_calls"}]}),
+            json!({"choices": [], "usage": {"total_tokens": 9}}),
+        ];
+        let mut acc = ChatStreamAccumulator::default();
+        let events: Vec<Value> = chunks.iter().flat_map(|c| acc.push(c)).collect();
+        assert_eq!(events.len(), 4);
+        assert_eq!(events[0]["content"], "Hel");
+        assert_eq!(events[2]["name"], "get_weather");
+        assert_eq!(events[3]["arguments"], "ty\":\"x\"}");
+        assert_eq!(acc.finish_reason(), Some("tool_calls"));
+
+        let resp = acc.finish();
+        let msg = &resp["choices"][0]["message"];
+        assert_eq!(msg["content"], "Hello");
+        assert_eq!(
+            msg["tool_calls"][0]["function"]["arguments"],
+            "{\"city\":\"x\"}"
+        );
+        assert_eq!(resp["usage"]["total_tokens"], 9);
+        assert_eq!(done_event(&resp)["finish_reason"], "tool_calls");
+
+        // The same events come out of the assembled response / 从拼装后的响应得到相同的事件
+        let replay = events_from_response(&resp);
+        assert_eq!(replay[0]["content"], "Hello");
+        assert_eq!(replay[1]["id"], "t1");
+    }
+}
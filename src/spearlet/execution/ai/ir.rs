@@ -11,6 +11,7 @@ pub enum Operation {
     SpeechToText,
     TextToSpeech,
     RealtimeVoice,
+    Moderations,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -78,6 +79,7 @@ impl CanonicalRequestEnvelope {
                 | (Operation::SpeechToText, Payload::SpeechToText(_))
                 | (Operation::TextToSpeech, Payload::TextToSpeech(_))
                 | (Operation::RealtimeVoice, Payload::RealtimeVoice(_))
+                | (Operation::Moderations, Payload::Moderations(_))
         );
         if !ok {
             return Err(CanonicalError {
@@ -138,12 +140,32 @@ pub struct EmbeddingsPayload {
     #[serde(default)]
     pub input: Vec<String>,
     pub model: Option<String>,
+    /// Shorten vectors to this length, where the model supports it / 在模型支持时将向量缩短到该长度
+    #[serde(default)]
+    pub dimensions: Option<u32>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ModerationsPayload {
+    #[serde(default)]
+    pub input: Vec<String>,
+    pub model: Option<String>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct ImageGenerationPayload {
     pub prompt: String,
     pub model: Option<String>,
+    /// Number of images / 图像数量
+    #[serde(default)]
+    pub n: Option<u32>,
+    /// `WIDTHxHEIGHT`, e.g. `1024x1024` / `宽x高`，例如 `1024x1024`
+    #[serde(default)]
+    pub size: Option<String>,
+    /// `url` or `b64_json`; backends without URLs always answer inline
+    /// `url` 或 `b64_json`；不提供 URL 的后端总是内联返回
+    #[serde(default)]
+    pub response_format: Option<String>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -156,6 +178,12 @@ pub struct TextToSpeechPayload {
     pub model: Option<String>,
     pub input: String,
     pub voice: Option<String>,
+    /// Audio container or encoding, e.g. `mp3`, `wav`, `pcm` / 音频容器或编码，例如 `mp3`、`wav`、`pcm`
+    #[serde(default)]
+    pub format: Option<String>,
+    /// Playback speed, 1.0 being normal / 播放速度，1.0 为正常速度
+    #[serde(default)]
+    pub speed: Option<f64>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -172,6 +200,7 @@ pub enum Payload {
     SpeechToText(SpeechToTextPayload),
     TextToSpeech(TextToSpeechPayload),
     RealtimeVoice(RealtimeVoicePayload),
+    Moderations(ModerationsPayload),
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
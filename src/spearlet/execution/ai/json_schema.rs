@@ -0,0 +1,527 @@
+//! JSON Schema checks and repairs for structured output / 结构化输出的 JSON Schema 校验与修复
+//!
+//! Covers the subset of JSON Schema that providers accept for structured output: `type`
+//! (one or a list), `enum`, `const`, `properties`, `required`, `additionalProperties`,
+//! `items`, `minItems`/`maxItems`, `minLength`/`maxLength`, `minimum`/`maximum`,
+//! `exclusiveMinimum`/`exclusiveMaximum`, `anyOf`, `oneOf`, `allOf` and local `$ref`s such
+//! as `#/$defs/step`. Other keywords, `pattern` and `format` among them, are not checked.
+//! 覆盖各提供方结构化输出所接受的 JSON Schema 子集：`type`（单个或列表）、`enum`、`const`、
+//! `properties`、`required`、`additionalProperties`、`items`、`minItems`/`maxItems`、
+//! `minLength`/`maxLength`、`minimum`/`maximum`、`exclusiveMinimum`/`exclusiveMaximum`、`anyOf`、
+//! `oneOf`、`allOf` 以及 `#/$defs/step` 这样的本地 `$ref`。其他关键字（包括 `pattern` 与 `format`）
+//! 不做检查。
+
+use serde_json::{Map, Value};
+
+/// `$ref`s followed in a row before giving up / 放弃之前连续跟随的 `$ref` 数
+const MAX_DEPTH: usize = 64;
+
+fn resolve_ref<'a>(root: &'a Value, r: &str) -> Option<&'a Value> {
+    let pointer = r.strip_prefix('#')?;
+    if pointer.is_empty() {
+        Some(root)
+    } else {
+        root.pointer(pointer)
+    }
+}
+
+fn types_of(schema: &Map<String, Value>) -> Vec<&str> {
+    match schema.get("type") {
+        Some(Value::String(t)) => vec![t.as_str()],
+        Some(Value::Array(ts)) => ts.iter().filter_map(Value::as_str).collect(),
+        _ => Vec::new(),
+    }
+}
+
+fn is_type(t: &str, v: &Value) -> bool {
+    match t {
+        "null" => v.is_null(),
+        "boolean" => v.is_boolean(),
+        "object" => v.is_object(),
+        "array" => v.is_array(),
+        "string" => v.is_string(),
+        "number" => v.is_number(),
+        "integer" => v.is_i64() || v.is_u64() || v.as_f64().is_some_and(|f| f.fract() == 0.0),
+        _ => true,
+    }
+}
+
+fn kind(v: &Value) -> &'static str {
+    match v {
+        Value::Null => "null",
+        Value::Bool(_) => "boolean",
+        Value::Number(_) => "number",
+        Value::String(_) => "string",
+        Value::Array(_) => "array",
+        Value::Object(_) => "object",
+    }
+}
+
+fn at(path: &str) -> &str {
+    if path.is_empty() {
+        "/"
+    } else {
+        path
+    }
+}
+
+/// Problems of `value` under `schema`, each led by its JSON pointer; empty when it is valid
+/// `value` 在 `schema` 下的问题，每条以其 JSON 指针开头；合法时为空
+pub fn validate(schema: &Value, value: &Value) -> Vec<String> {
+    let mut errors = Vec::new();
+    check(schema, schema, value, "", 0, &mut errors);
+    errors
+}
+
+fn valid_at(root: &Value, schema: &Value, value: &Value, depth: usize) -> bool {
+    let mut errors = Vec::new();
+    check(root, schema, value, "", depth, &mut errors);
+    errors.is_empty()
+}
+
+fn check(
+    root: &Value,
+    schema: &Value,
+    value: &Value,
+    path: &str,
+    depth: usize,
+    errors: &mut Vec<String>,
+) {
+    if depth > MAX_DEPTH {
+        errors.push(format!("{}: schema nested too deeply", at(path)));
+        return;
+    }
+    let s = match schema {
+        Value::Bool(true) => return,
+        Value::Bool(false) => {
+            errors.push(format!("{}: no value is allowed", at(path)));
+            return;
+        }
+        Value::Object(s) => s,
+        _ => return,
+    };
+    if let Some(r) = s.get("$ref").and_then(Value::as_str) {
+        match resolve_ref(root, r) {
+            Some(target) => check(root, target, value, path, depth + 1, errors),
+            None => errors.push(format!("{}: unresolved $ref {}", at(path), r)),
+        }
+    }
+
+    let types = types_of(s);
+    if !types.is_empty() && !types.iter().any(|t| is_type(t, value)) {
+        errors.push(format!(
+            "{}: expected {}, got {}",
+            at(path),
+            types.join(" or "),
+            kind(value)
+        ));
+        return;
+    }
+    if let Some(options) = s.get("enum").and_then(Value::as_array) {
+        if !options.contains(value) {
+            errors.push(format!(
+                "{}: {} is not one of {}",
+                at(path),
+                value,
+                Value::from(options.clone())
+            ));
+        }
+    }
+    if let Some(c) = s.get("const") {
+        if c != value {
+            errors.push(format!("{}: expected {}", at(path), c));
+        }
+    }
+
+    match value {
+        Value::String(text) => {
+            let n = text.chars().count() as u64;
+            if let Some(min) = s.get("minLength").and_then(Value::as_u64) {
+                if n < min {
+                    errors.push(format!("{}: shorter than {} characters", at(path), min));
+                }
+            }
+            if let Some(max) = s.get("maxLength").and_then(Value::as_u64) {
+                if n > max {
+                    errors.push(format!("{}: longer than {} characters", at(path), max));
+                }
+            }
+        }
+        Value::Number(n) => {
+            let x = n.as_f64().unwrap_or(0.0);
+            let bound = |k: &str| s.get(k).and_then(Value::as_f64);
+            if bound("minimum").is_some_and(|m| x < m)
+                || bound("exclusiveMinimum").is_some_and(|m| x <= m)
+            {
+                errors.push(format!("{}: {} is too small", at(path), n));
+            }
+            if bound("maximum").is_some_and(|m| x > m)
+                || bound("exclusiveMaximum").is_some_and(|m| x >= m)
+            {
+                errors.push(format!("{}: {} is too large", at(path), n));
+            }
+        }
+        Value::Array(items) => {
+            if let Some(item) = s.get("items") {
+                for (i, v) in items.iter().enumerate() {
+                    check(root, item, v, &format!("{}/{}", path, i), depth + 1, errors);
+                }
+            }
+            let n = items.len() as u64;
+            if s.get("minItems")
+                .and_then(Value::as_u64)
+                .is_some_and(|m| n < m)
+            {
+                errors.push(format!("{}: fewer than {} items", at(path), s["minItems"]));
+            }
+            if s.get("maxItems")
+                .and_then(Value::as_u64)
+                .is_some_and(|m| n > m)
+            {
+                errors.push(format!("{}: more than {} items", at(path), s["maxItems"]));
+            }
+        }
+        Value::Object(map) => {
+            let props = s.get("properties").and_then(Value::as_object);
+            for k in s
+                .get("required")
+                .and_then(Value::as_array)
+                .into_iter()
+                .flatten()
+                .filter_map(Value::as_str)
+            {
+                if !map.contains_key(k) {
+                    errors.push(format!("{}: missing required property {:?}", at(path), k));
+                }
+            }
+            let extra = s.get("additionalProperties");
+            for (k, v) in map {
+                let child = format!("{}/{}", path, k.replace('~', "~0").replace('/', "~1"));
+                if let Some(sub) = props.and_then(|p| p.get(k)) {
+                    check(root, sub, v, &child, depth + 1, errors);
+                    continue;
+                }
+                match extra {
+                    Some(Value::Bool(false)) => {
+                        errors.push(format!("{}: unexpected property {:?}", at(path), k))
+                    }
+                    Some(sub) => check(root, sub, v, &child, depth + 1, errors),
+                    None => {}
+                }
+            }
+        }
+        _ => {}
+    }
+
+    if let Some(all) = s.get("allOf").and_then(Value::as_array) {
+        for sub in all {
+            check(root, sub, value, path, depth + 1, errors);
+        }
+    }
+    if let Some(any) = s.get("anyOf").and_then(Value::as_array) {
+        if !any.iter().any(|sub| valid_at(root, sub, value, depth + 1)) {
+            errors.push(format!("{}: matches none of anyOf", at(path)));
+        }
+    }
+    if let Some(one) = s.get("oneOf").and_then(Value::as_array) {
+        let n = one
+            .iter()
+            .filter(|sub| valid_at(root, sub, value, depth + 1))
+            .count();
+        if n != 1 {
+            errors.push(format!(
+                "{}: matches {} of oneOf, not exactly one",
+                at(path),
+                n
+            ));
+        }
+    }
+}
+
+/// Convert a scalar to type `t` where the intent is plain / 在意图明确时将标量转换为类型 `t`
+fn convert(t: &str, v: &Value) -> Option<Value> {
+    match (t, v) {
+        ("integer", Value::String(s)) => s.trim().parse::<i64>().ok().map(Value::from),
+        ("integer", Value::Number(n)) => n
+            .as_f64()
+            .filter(|f| f.fract() == 0.0 && f.abs() < 9.0e15)
+            .map(|f| Value::from(f as i64)),
+        ("number", Value::String(s)) => s
+            .trim()
+            .parse::<f64>()
+            .ok()
+            .filter(|f| f.is_finite())
+            .map(Value::from),
+        ("boolean", Value::String(s)) => match s.trim().to_ascii_lowercase().as_str() {
+            "true" => Some(Value::Bool(true)),
+            "false" => Some(Value::Bool(false)),
+            _ => None,
+        },
+        ("string", Value::Number(n)) => Some(Value::String(n.to_string())),
+        ("string", Value::Bool(b)) => Some(Value::String(b.to_string())),
+        ("null", Value::String(s)) if s.trim() == "null" => Some(Value::Null),
+        _ => None,
+    }
+}
+
+/// Bring `value` closer to `schema` / 使 `value` 更接近 `schema`
+///
+/// Fixes the slips models make in otherwise sound answers: numbers and booleans sent as
+/// strings, enum values in the wrong case, properties the schema forbids, and required
+/// properties left out that have a `default`. Anything else is left for `validate` to
+/// report.
+/// 修复模型在大体正确的应答中常犯的小错：以字符串给出的数字与布尔值、大小写不符的枚举值、schema
+/// 禁止的属性，以及缺失但带有 `default` 的必需属性。其余问题留给 `validate` 报告。
+pub fn coerce(schema: &Value, value: Value) -> Value {
+    coerce_at(schema, schema, value, 0)
+}
+
+fn coerce_at(root: &Value, schema: &Value, value: Value, depth: usize) -> Value {
+    let Some(s) = schema.as_object().filter(|_| depth <= MAX_DEPTH) else {
+        return value;
+    };
+    if let Some(target) = s
+        .get("$ref")
+        .and_then(Value::as_str)
+        .and_then(|r| resolve_ref(root, r))
+    {
+        return coerce_at(root, target, value, depth + 1);
+    }
+    for key in ["anyOf", "oneOf"] {
+        if let Some(branches) = s.get(key).and_then(Value::as_array) {
+            if branches
+                .iter()
+                .any(|b| valid_at(root, b, &value, depth + 1))
+            {
+                return value;
+            }
+            for b in branches {
+                let c = coerce_at(root, b, value.clone(), depth + 1);
+                if valid_at(root, b, &c, depth + 1) {
+                    return c;
+                }
+            }
+            return value;
+        }
+    }
+
+    let mut value = value;
+    if let Some(all) = s.get("allOf").and_then(Value::as_array) {
+        for b in all {
+            value = coerce_at(root, b, value, depth + 1);
+        }
+    }
+    let types = types_of(s);
+    if !types.is_empty() && !types.iter().any(|t| is_type(t, &value)) {
+        if let Some(v) = types.iter().find_map(|t| convert(t, &value)) {
+            value = v;
+        }
+    }
+    if let (Some(options), Some(text)) = (s.get("enum").and_then(Value::as_array), value.as_str()) {
+        let text = text.trim();
+        if let Some(o) = options
+            .iter()
+            .find(|o| o.as_str().is_some_and(|o| o.eq_ignore_ascii_case(text)))
+        {
+            value = o.clone();
+        }
+    }
+
+    match &mut value {
+        Value::Object(map) => {
+            let props = s.get("properties").and_then(Value::as_object);
+            if s.get("additionalProperties") == Some(&Value::Bool(false)) {
+                map.retain(|k, _| props.is_some_and(|p| p.contains_key(k)));
+            }
+            if let Some(props) = props {
+                for (k, v) in map.iter_mut() {
+                    if let Some(sub) = props.get(k) {
+                        *v = coerce_at(root, sub, std::mem::take(v), depth + 1);
+                    }
+                }
+                let required = s.get("required").and_then(Value::as_array);
+                for k in required.into_iter().flatten().filter_map(Value::as_str) {
+                    if let Some(d) = props.get(k).and_then(|p| p.get("default")) {
+                        map.entry(k.to_string()).or_insert_with(|| d.clone());
+                    }
+                }
+            }
+        }
+        Value::Array(items) => {
+            if let Some(sub) = s.get("items") {
+                for v in items.iter_mut() {
+                    *v = coerce_at(root, sub, std::mem::take(v), depth + 1);
+                }
+            }
+        }
+        _ => {}
+    }
+    value
+}
+
+/// Drop a comma left before a closing bracket / 删除闭合括号前遗留的逗号
+fn drop_trailing_comma(out: &mut String) {
+    let end = out.trim_end().len();
+    if out[..end].ends_with(',') {
+        out.truncate(end - 1);
+    }
+}
+
+/// The first JSON value in `s`, with trailing commas dropped and a cut-off end closed
+/// `s` 中的第一个 JSON 值：删除多余的尾随逗号，并补全被截断的结尾
+fn balance(s: &str) -> String {
+    let mut out = String::with_capacity(s.len() + 8);
+    let mut closers: Vec<char> = Vec::new();
+    let mut in_string = false;
+    let mut escaped = false;
+    for c in s.chars() {
+        if in_string {
+            out.push(c);
+            if escaped {
+                escaped = false;
+            } else if c == '\\' {
+                escaped = true;
+            } else if c == '"' {
+                in_string = false;
+            }
+            continue;
+        }
+        match c {
+            '"' => {
+                in_string = true;
+                out.push(c);
+            }
+            '{' => {
+                closers.push('}');
+                out.push(c);
+            }
+            '[' => {
+                closers.push(']');
+                out.push(c);
+            }
+            '}' | ']' => {
+                if closers.last() != Some(&c) {
+                    continue;
+                }
+                closers.pop();
+                drop_trailing_comma(&mut out);
+                out.push(c);
+                if closers.is_empty() {
+                    // Prose after the value is not part of it / 值之后的文字不属于该值
+                    return out;
+                }
+            }
+            _ => out.push(c),
+        }
+    }
+    // The answer was cut off / 应答被截断
+    if in_string {
+        if escaped {
+            out.pop();
+        }
+        out.push('"');
+    }
+    drop_trailing_comma(&mut out);
+    if out.trim_end().ends_with(':') {
+        out.push_str("null");
+    }
+    while let Some(c) = closers.pop() {
+        drop_trailing_comma(&mut out);
+        out.push(c);
+    }
+    out
+}
+
+/// Parse a model's answer as JSON, repairing it if needed; the flag tells whether it was
+/// 将模型应答解析为 JSON，必要时进行修复；标志表示是否经过修复
+///
+/// Repairs strip Markdown fences and prose around the value, drop trailing commas and close
+/// a value that was cut off.
+/// 修复会去除值周围的 Markdown 围栏与文字、删除多余的尾随逗号，并补全被截断的值。
+pub fn parse_lenient(text: &str) -> Option<(Value, bool)> {
+    let text = text.trim();
+    if let Ok(v) = serde_json::from_str(text) {
+        return Some((v, false));
+    }
+    let start = text.find(['{', '['])?;
+    serde_json::from_str(&balance(&text[start..]))
+        .ok()
+        .map(|v| (v, true))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn schema() -> Value {
+        json!({
+            "type": "object",
+            "properties": {
+                "city": {"type": "string", "minLength": 1},
+                "temp": {"type": "number", "minimum": -90, "maximum": 60},
+                "unit": {"enum": ["C", "F"], "default": "C"},
+                "tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "maxItems": 2}
+            },
+            "required": ["city", "temp", "unit"],
+            "additionalProperties": false,
+            "$defs": {"tag": {"type": "string"}}
+        })
+    }
+
+    #[test]
+    fn test_validate() {
+        let s = schema();
+        assert!(validate(&s, &json!({"city": "Oslo", "temp": 3.5, "unit": "C"})).is_empty());
+
+        let errors = validate(
+            &s,
+            &json!({"city": "", "temp": 99, "tags": ["a", 1, "c"], "wind": 3}),
+        );
+        assert!(errors.contains(&"/: missing required property \"unit\"".to_string()));
+        assert!(errors.contains(&"/: unexpected property \"wind\"".to_string()));
+        assert!(errors.contains(&"/city: shorter than 1 characters".to_string()));
+        assert!(errors.contains(&"/temp: 99 is too large".to_string()));
+        assert!(errors.contains(&"/tags/1: expected string, got number".to_string()));
+        assert!(errors.contains(&"/tags: more than 2 items".to_string()));
+
+        let one = json!({"oneOf": [{"type": "integer"}, {"type": "number"}]});
+        assert_eq!(validate(&one, &json!(1.5)).len(), 0);
+        assert_eq!(validate(&one, &json!(2)).len(), 1);
+    }
+
+    #[test]
+    fn test_coerce() {
+        let s = schema();
+        let fixed = coerce(
+            &s,
+            json!({"city": "Oslo", "temp": "3.5", "unit": "c", "wind": 3}),
+        );
+        assert_eq!(fixed, json!({"city": "Oslo", "temp": 3.5, "unit": "C"}));
+        assert_eq!(
+            coerce(&s, json!({"city": "Oslo", "temp": 1})),
+            json!({"city": "Oslo", "temp": 1, "unit": "C"})
+        );
+        let either = json!({"anyOf": [{"type": "null"}, {"type": "integer"}]});
+        assert_eq!(coerce(&either, json!("7")), json!(7));
+    }
+
+    #[test]
+    fn test_parse_lenient() {
+        assert_eq!(parse_lenient(" [1, 2] "), Some((json!([1, 2]), false)));
+        let fenced = "Here you go:\n```json\n{\"a\": [1, 2,], \"b\": \"x\",}\n```\nAnything else?";
+        assert_eq!(
+            parse_lenient(fenced),
+            Some((json!({"a": [1, 2], "b": "x"}), true))
+        );
+        assert_eq!(
+            parse_lenient("{\"a\": {\"b\": \"cut of"),
+            Some((json!({"a": {"b": "cut of"}}), true))
+        );
+        assert_eq!(
+            parse_lenient("{\"a\": 1, \"b\":"),
+            Some((json!({"a": 1, "b": null}), true))
+        );
+        assert_eq!(parse_lenient("no json here"), None);
+    }
+}
@@ -1,22 +1,38 @@
 pub mod backends;
+pub mod chat_stream;
 pub mod ir;
+pub mod json_schema;
 pub mod media_ref;
 pub mod normalize;
+pub mod provider_session;
 pub mod router;
 pub mod streaming;
 
+use std::cell::Cell;
 use std::fmt;
 use std::sync::Arc;
+use std::time::Instant;
 
+use crate::spearlet::energy::EnergyGovernor;
+use crate::spearlet::execution::ai::backends::UNSUPPORTED_STREAMING;
 use crate::spearlet::execution::ai::ir::{
-    CanonicalRequestEnvelope, CanonicalResponseEnvelope, Payload,
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope, Payload,
 };
+use crate::spearlet::execution::ai::router::registry::BackendInstance;
 use crate::spearlet::execution::ai::router::Router;
 use crate::spearlet::execution::ai::streaming::StreamingInvocation;
+use crate::spearlet::execution::debug_trace::{DebugTraces, TraceKind};
+use crate::spearlet::execution::host_api::errno::SPEAR_ETIMEDOUT;
+use crate::spearlet::node_services::NodeServices;
+use crate::spearlet::usage;
 
 #[derive(Clone)]
 pub struct AiEngine {
     router: Arc<Router>,
+    /// Spearlet the calls run on / 调用所在的 spearlet
+    node: Arc<NodeServices>,
+    /// Task the usage is attributed to / 用量所归属的任务
+    task: Option<String>,
 }
 
 fn has_missing_model(req: &CanonicalRequestEnvelope) -> bool {
@@ -47,9 +63,39 @@ fn has_missing_model(req: &CanonicalRequestEnvelope) -> bool {
             .as_deref()
             .map(|s| s.trim().is_empty())
             .unwrap_or(true),
+        Payload::Moderations(p) => p
+            .model
+            .as_deref()
+            .map(|s| s.trim().is_empty())
+            .unwrap_or(true),
+    }
+}
+
+fn requested_model(req: &CanonicalRequestEnvelope) -> &str {
+    match &req.payload {
+        Payload::ChatCompletions(p) => p.model.as_str(),
+        Payload::Embeddings(p) => p.model.as_deref().unwrap_or(""),
+        Payload::ImageGeneration(p) => p.model.as_deref().unwrap_or(""),
+        Payload::SpeechToText(p) => p.model.as_deref().unwrap_or(""),
+        Payload::TextToSpeech(p) => p.model.as_deref().unwrap_or(""),
+        Payload::RealtimeVoice(p) => p.model.as_deref().unwrap_or(""),
+        Payload::Moderations(p) => p.model.as_deref().unwrap_or(""),
     }
 }
 
+/// Cap the request timeout at what is left of the running hostcall's deadline
+/// 将请求超时限制在当前 hostcall 截止时间的剩余时长之内
+fn with_hostcall_deadline(req: &CanonicalRequestEnvelope) -> Option<CanonicalRequestEnvelope> {
+    let left = crate::spearlet::execution::host_api::deadline::remaining()?;
+    let ms = (left.as_millis() as u64).max(1);
+    if req.timeout_ms.is_some_and(|t| t <= ms) {
+        return None;
+    }
+    let mut out = req.clone();
+    out.timeout_ms = Some(ms);
+    Some(out)
+}
+
 fn with_default_model(
     req: &CanonicalRequestEnvelope,
     default_model: Option<&str>,
@@ -91,10 +137,61 @@ fn with_default_model(
                 p.model = Some(m.to_string());
             }
         }
+        Payload::Moderations(p) => {
+            if p.model.as_deref().map(|s| s.trim()).unwrap_or("") != m {
+                p.model = Some(m.to_string());
+            }
+        }
+    }
+    Some(out)
+}
+
+/// Request with the cheaper model chosen by the energy governor, if any
+/// 使用能耗调控器所选更廉价模型的请求（若有）
+fn with_energy_model(
+    energy: &EnergyGovernor,
+    req: &CanonicalRequestEnvelope,
+) -> Option<CanonicalRequestEnvelope> {
+    let m = energy.model_override(requested_model(req).trim())?;
+    let mut out = req.clone();
+    match &mut out.payload {
+        Payload::ChatCompletions(p) => p.model = m,
+        Payload::Embeddings(p) => p.model = Some(m),
+        Payload::ImageGeneration(p) => p.model = Some(m),
+        Payload::SpeechToText(p) => p.model = Some(m),
+        Payload::TextToSpeech(p) => p.model = Some(m),
+        Payload::RealtimeVoice(p) => p.model = Some(m),
+        Payload::Moderations(p) => p.model = Some(m),
     }
     Some(out)
 }
 
+/// Add a backend call to the debug trace of the current execution
+/// 将一次后端调用加入当前执行的调试追踪
+fn trace_provider_call(
+    traces: &DebugTraces,
+    inst: &BackendInstance,
+    req: &CanonicalRequestEnvelope,
+    started: Instant,
+    error: Option<&str>,
+) {
+    if !traces.enabled() {
+        return;
+    }
+    traces.record(
+        TraceKind::ProviderCall,
+        &inst.name,
+        Some(started.elapsed()),
+        serde_json::json!({
+            "kind": inst.kind,
+            "operation": req.operation,
+            "model": requested_model(req),
+            "endpoint": inst.base_url,
+            "error": error,
+        }),
+    );
+}
+
 impl fmt::Debug for AiEngine {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
         f.debug_struct("AiEngine").finish()
@@ -102,55 +199,279 @@ impl fmt::Debug for AiEngine {
 }
 
 impl AiEngine {
-    pub fn new(router: Router) -> Self {
+    pub fn new(router: Router, node: Arc<NodeServices>) -> Self {
         Self {
             router: Arc::new(router),
+            node,
+            task: None,
         }
     }
 
-    pub fn invoke(
+    /// The same engine, metering its calls as usage of `task_id`
+    /// 相同的引擎，其调用计为 `task_id` 的用量
+    pub fn for_task(&self, task_id: &str) -> Self {
+        Self {
+            router: self.router.clone(),
+            node: self.node.clone(),
+            task: Some(task_id.to_string()),
+        }
+    }
+
+    /// Refuse the call once the task has used up its budget / 任务预算用尽后拒绝调用
+    fn admit(&self) -> Result<(), crate::spearlet::execution::ExecutionError> {
+        match &self.task {
+            Some(task_id) => self.node.usage.admit(task_id).map_err(|message| {
+                crate::spearlet::execution::ExecutionError::ResourceExhausted { message }
+            }),
+            None => Ok(()),
+        }
+    }
+
+    fn meter(&self, req: &CanonicalRequestEnvelope, resp: &CanonicalResponseEnvelope) {
+        if let Some(task_id) = &self.task {
+            self.node
+                .usage
+                .record(task_id, &resp.backend, usage::measure(req, resp));
+        }
+    }
+
+    /// Route a request, trying the energy governor's cheaper model first
+    /// 路由请求，优先尝试能耗调控器选择的更廉价模型
+    fn route_energy_aware(
         &self,
         req: &CanonicalRequestEnvelope,
-    ) -> Result<CanonicalResponseEnvelope, crate::spearlet::execution::ExecutionError> {
+        exclude: &[String],
+    ) -> Result<(BackendInstance, Option<CanonicalRequestEnvelope>), CanonicalError> {
+        if let Some(cheaper) = with_energy_model(&self.node.energy, req) {
+            if let Ok(inst) = self.router.route_excluding(&cheaper, exclude) {
+                return Ok((inst, Some(cheaper)));
+            }
+        }
+        let inst = self.router.route_excluding(req, exclude)?;
+        Ok((inst, None))
+    }
+
+    /// Run `call` on a routed backend, retrying retryable failures with backoff on the
+    /// other backends for the model, and on the failed ones once none is left
+    /// 在路由到的后端上运行 `call`；可重试的失败经退避后改用该模型的其他后端重试，没有其他后端时
+    /// 重试已失败的后端
+    ///
+    /// No retry follows once `delivered` reports output was passed on, or when the hostcall
+    /// deadline would pass during the backoff. The backoff ends early when the execution is
+    /// terminated.
+    /// 一旦 `delivered` 表明输出已传出，或退避期间将超过 hostcall 截止时间，则不再重试。执行被终止时
+    /// 退避提前结束。
+    fn invoke_with_failover<T>(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        delivered: &dyn Fn() -> bool,
+        call: &mut dyn FnMut(
+            &BackendInstance,
+            &CanonicalRequestEnvelope,
+        ) -> Result<T, CanonicalError>,
+    ) -> Result<T, crate::spearlet::execution::ExecutionError> {
         req.validate_basic().map_err(|e| {
             crate::spearlet::execution::ExecutionError::InvalidRequest { message: e.message }
         })?;
-        let inst = self.router.route(req).map_err(|e| {
-            crate::spearlet::execution::ExecutionError::NotSupported {
-                operation: e.message,
+        let health = self.router.health();
+        let cfg = health.config();
+        let attempts = if cfg.enabled {
+            cfg.max_attempts.max(1)
+        } else {
+            1
+        };
+        let mut failed: Vec<String> = Vec::new();
+        let mut last_err: Option<CanonicalError> = None;
+        for attempt in 1..=attempts {
+            let routed = match self.route_energy_aware(req, &failed) {
+                Err(_) if !failed.is_empty() => {
+                    // No other backend left: retry those that failed / 没有其他后端：重试已失败的后端
+                    failed.clear();
+                    self.route_energy_aware(req, &failed)
+                }
+                r => r,
+            };
+            let (inst, cheaper) = match (routed, last_err.take()) {
+                (Ok(r), _) => r,
+                (Err(e), None) => {
+                    return Err(crate::spearlet::execution::ExecutionError::NotSupported {
+                        operation: e.message,
+                    })
+                }
+                (Err(_), Some(e)) => {
+                    return Err(crate::spearlet::execution::ExecutionError::RuntimeError {
+                        message: e.message,
+                    })
+                }
+            };
+            let req = cheaper.as_ref().unwrap_or(req);
+            let req2 = with_default_model(req, inst.model.as_deref());
+            let req_used = req2.as_ref().unwrap_or(req);
+            let req3 = with_hostcall_deadline(req_used);
+            let req_used = req3.as_ref().unwrap_or(req_used);
+            self.node.run_records.record_model_use(
+                &inst.name,
+                requested_model(req_used),
+                &inst.base_url,
+            );
+            let backend_call = health.begin(&inst.name);
+            let started = Instant::now();
+            let out = call(&inst, req_used);
+            trace_provider_call(
+                &self.node.debug_traces,
+                &inst,
+                req_used,
+                started,
+                out.as_ref().err().map(|e| e.message.as_str()),
+            );
+            let e = match out {
+                Ok(v) => {
+                    backend_call.success();
+                    return Ok(v);
+                }
+                Err(e) => e,
+            };
+            if !e.retryable {
+                // The backend answered; the request itself is at fault / 后端已应答，问题在请求本身
+                backend_call.success();
+            } else {
+                backend_call.failure(&e.message);
+            }
+            let wait = health.backoff(attempt);
+            let out_of_time = crate::spearlet::execution::host_api::deadline::remaining()
+                .is_some_and(|left| left <= wait);
+            if !e.retryable || attempt == attempts || delivered() || out_of_time {
+                return Err(crate::spearlet::execution::ExecutionError::RuntimeError {
+                    message: e.message,
+                });
             }
+            tracing::debug!(
+                backend = %inst.name,
+                attempt,
+                wait_ms = wait.as_millis() as u64,
+                error = %e.message,
+                "Retrying LLM request"
+            );
+            if let Err(errno) = crate::spearlet::execution::host_api::deadline::sleep(
+                wait,
+                &self.node.terminations.executions,
+            ) {
+                return Err(if errno == -SPEAR_ETIMEDOUT {
+                    crate::spearlet::execution::ExecutionError::RuntimeError { message: e.message }
+                } else {
+                    crate::spearlet::execution::ExecutionError::ExecutionTerminated {
+                        message: format!("terminated while retrying: {}", e.message),
+                    }
+                });
+            }
+            failed.push(inst.name.clone());
+            last_err = Some(e);
+        }
+        unreachable!("the last attempt always returns")
+    }
+
+    pub fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, crate::spearlet::execution::ExecutionError> {
+        self.admit()?;
+        let resp =
+            self.invoke_with_failover(req, &|| false, &mut |inst, req| inst.adapter.invoke(req))?;
+        self.meter(req, &resp);
+        Ok(resp)
+    }
+
+    /// Invoke a chat request with its output streamed to `on_event`
+    /// 调用 chat 请求，并将输出以流的形式交给 `on_event`
+    pub fn invoke_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: &mut dyn FnMut(serde_json::Value),
+    ) -> Result<CanonicalResponseEnvelope, crate::spearlet::execution::ExecutionError> {
+        self.admit()?;
+        let emitted = Cell::new(false);
+        let resp = self.invoke_with_failover(req, &|| emitted.get(), &mut |inst, req| {
+            inst.adapter.invoke_stream(req, &mut |ev| {
+                emitted.set(true);
+                on_event(ev)
+            })
+        })?;
+        self.meter(req, &resp);
+        Ok(resp)
+    }
+
+    /// Invoke a speech request with the audio passed to `on_chunk` as it arrives
+    /// 调用语音请求，并在音频到达时交给 `on_chunk`
+    pub fn invoke_audio_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_chunk: &mut dyn FnMut(Vec<u8>),
+    ) -> Result<CanonicalResponseEnvelope, crate::spearlet::execution::ExecutionError> {
+        self.admit()?;
+        let emitted = Cell::new(false);
+        let resp = self.invoke_with_failover(req, &|| emitted.get(), &mut |inst, req| {
+            inst.adapter.invoke_audio_stream(req, &mut |chunk| {
+                emitted.set(true);
+                on_chunk(chunk)
+            })
         })?;
-        let req2 = with_default_model(req, inst.model.as_deref());
-        let req_used = req2.as_ref().unwrap_or(req);
-        inst.adapter.invoke(req_used).map_err(|e| {
-            crate::spearlet::execution::ExecutionError::RuntimeError { message: e.message }
-        })
+        self.meter(req, &resp);
+        Ok(resp)
     }
 
     pub fn invoke_streaming(
         &self,
         req: &CanonicalRequestEnvelope,
     ) -> Result<StreamingInvocation, crate::spearlet::execution::ExecutionError> {
+        self.admit()?;
         req.validate_basic().map_err(|e| {
             crate::spearlet::execution::ExecutionError::InvalidRequest { message: e.message }
         })?;
-        let inst = self.router.route(req).map_err(|e| {
-            crate::spearlet::execution::ExecutionError::NotSupported {
-                operation: e.message,
-            }
-        })?;
+        // Backends that cannot stream this operation are passed over
+        // 跳过无法流式处理该操作的后端
+        let mut exclude: Vec<String> = Vec::new();
+        loop {
+            let (inst, cheaper) = self.route_energy_aware(req, &exclude).map_err(|e| {
+                crate::spearlet::execution::ExecutionError::NotSupported {
+                    operation: e.message,
+                }
+            })?;
+            let req = cheaper.as_ref().unwrap_or(req);
 
-        let req2 = with_default_model(req, inst.model.as_deref());
-        let req_used = req2.as_ref().unwrap_or(req);
-        let plan = inst.adapter.streaming_plan(req_used).map_err(|e| {
-            crate::spearlet::execution::ExecutionError::NotSupported {
-                operation: e.message,
+            let req2 = with_default_model(req, inst.model.as_deref());
+            let req_used = req2.as_ref().unwrap_or(req);
+            let started = Instant::now();
+            let plan = inst.adapter.streaming_plan(req_used);
+            match &plan {
+                Err(e) if e.code == UNSUPPORTED_STREAMING => {
+                    exclude.push(inst.name.clone());
+                    continue;
+                }
+                _ => {}
             }
-        })?;
-        Ok(StreamingInvocation {
-            backend: inst.name.clone(),
-            plan,
-        })
+            self.node.run_records.record_model_use(
+                &inst.name,
+                requested_model(req_used),
+                &inst.base_url,
+            );
+            trace_provider_call(
+                &self.node.debug_traces,
+                &inst,
+                req_used,
+                started,
+                plan.as_ref().err().map(|e| e.message.as_str()),
+            );
+            let plan =
+                plan.map_err(
+                    |e| crate::spearlet::execution::ExecutionError::NotSupported {
+                        operation: e.message,
+                    },
+                )?;
+            return Ok(StreamingInvocation {
+                backend: inst.name.clone(),
+                plan,
+            });
+        }
     }
 }
 
@@ -169,6 +490,181 @@ mod tests {
     use crate::spearlet::execution::ai::router::Router;
     use serde_json::Value;
     use std::collections::HashMap;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    /// Backend answering every call with `503` / 对每次调用都返回 `503` 的后端
+    struct UnavailableAdapter {
+        calls: AtomicUsize,
+    }
+
+    impl crate::spearlet::execution::ai::backends::BackendAdapter for UnavailableAdapter {
+        fn name(&self) -> &str {
+            "unavailable"
+        }
+
+        fn invoke(
+            &self,
+            req: &CanonicalRequestEnvelope,
+        ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+            self.calls.fetch_add(1, Ordering::SeqCst);
+            Err(CanonicalError {
+                code: "upstream_error".to_string(),
+                message: "upstream status: 503".to_string(),
+                retryable: true,
+                operation: Some(req.operation.clone()),
+            })
+        }
+    }
+
+    /// Backend whose adapter panics / 适配器会 panic 的后端
+    struct PanickingAdapter;
+
+    impl crate::spearlet::execution::ai::backends::BackendAdapter for PanickingAdapter {
+        fn name(&self) -> &str {
+            "panicking"
+        }
+
+        fn invoke(
+            &self,
+            _req: &CanonicalRequestEnvelope,
+        ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+            panic!("adapter panicked")
+        }
+    }
+
+    fn backend(name: &str, adapter: Arc<dyn backends::BackendAdapter>) -> BackendInstance {
+        BackendInstance {
+            name: name.to_string(),
+            kind: "stub".to_string(),
+            base_url: String::new(),
+            hosting: Hosting::Local,
+            model: Some("failover-model".to_string()),
+            weight: 100,
+            priority: 0,
+            capabilities: Capabilities {
+                ops: vec![Operation::ChatCompletions],
+                features: vec![],
+                transports: vec!["in_process".to_string()],
+            },
+            adapter,
+        }
+    }
+
+    fn chat_req(model: &str) -> CanonicalRequestEnvelope {
+        CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::ChatCompletions,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Requirements::default(),
+            timeout_ms: None,
+            payload: Payload::ChatCompletions(ChatCompletionsPayload {
+                model: model.to_string(),
+                messages: vec![ChatMessage {
+                    role: "user".to_string(),
+                    content: Value::String("hi".to_string()),
+                    tool_call_id: None,
+                    tool_calls: None,
+                    name: None,
+                }],
+                tools: vec![],
+                params: HashMap::new(),
+            }),
+            extra: HashMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_invoke_fails_over_to_another_backend() {
+        let down = Arc::new(UnavailableAdapter {
+            calls: AtomicUsize::new(0),
+        });
+        let router = Router::new(
+            BackendRegistry::new(vec![
+                backend("failover-down", down.clone()),
+                backend(
+                    "failover-up",
+                    Arc::new(StubBackendAdapter::new("failover-up")),
+                ),
+            ]),
+            SelectionPolicy::WeightedRandom,
+        );
+        let resp = AiEngine::new(router, Default::default())
+            .invoke(&chat_req("failover-model"))
+            .unwrap();
+        assert_eq!(resp.backend, "failover-up");
+        assert!(down.calls.load(Ordering::SeqCst) <= 1);
+    }
+
+    #[test]
+    fn test_invoke_retries_a_lone_backend() {
+        let down = Arc::new(UnavailableAdapter {
+            calls: AtomicUsize::new(0),
+        });
+        let router = Router::new(
+            BackendRegistry::new(vec![backend("retry-down", down.clone())]),
+            SelectionPolicy::WeightedRandom,
+        );
+        let engine = AiEngine::new(router, Default::default());
+        let err = engine.invoke(&chat_req("failover-model")).unwrap_err();
+        assert!(err.to_string().contains("503"), "{}", err);
+        let cfg = engine.router.health().config();
+        assert_eq!(down.calls.load(Ordering::SeqCst), cfg.max_attempts as usize);
+    }
+
+    #[test]
+    fn test_panicking_call_is_recorded_as_failure() {
+        let router = Router::new(
+            BackendRegistry::new(vec![backend("panic-backend", Arc::new(PanickingAdapter))]),
+            SelectionPolicy::WeightedRandom,
+        );
+        let engine = AiEngine::new(router, Default::default());
+        let out = std::panic::catch_unwind(std::panic::AssertUnwindSafe(|| {
+            engine.invoke(&chat_req("failover-model"))
+        }));
+        assert!(out.is_err());
+        let health = engine.router.health().snapshot();
+        let s = health.iter().find(|h| h.name == "panic-backend").unwrap();
+        assert_eq!((s.failures, s.successes), (1, 0));
+        assert_eq!(s.last_error.as_deref(), Some("call abandoned"));
+    }
+
+    #[cfg(feature = "rt-asr")]
+    #[test]
+    fn test_invoke_streaming_skips_backends_that_cannot_stream() {
+        let stt = |name: &str, adapter: Arc<dyn backends::BackendAdapter>| {
+            let mut inst = backend(name, adapter);
+            inst.capabilities.ops = vec![Operation::SpeechToText];
+            inst.capabilities.transports = vec![];
+            inst
+        };
+        let router = Router::new(
+            BackendRegistry::new(vec![
+                stt("batch-stt", Arc::new(StubBackendAdapter::new("batch-stt"))),
+                stt(
+                    "grpc-stt",
+                    Arc::new(backends::google_speech::GoogleSpeechBackendAdapter::new(
+                        "grpc-stt",
+                        "https://speech.googleapis.com",
+                        None,
+                    )),
+                ),
+            ]),
+            SelectionPolicy::WeightedRandom,
+        );
+        let req = CanonicalRequestEnvelope {
+            operation: Operation::SpeechToText,
+            payload: Payload::SpeechToText(
+                crate::spearlet::execution::ai::ir::SpeechToTextPayload { model: None },
+            ),
+            ..chat_req("failover-model")
+        };
+        let inv = AiEngine::new(router, Default::default())
+            .invoke_streaming(&req)
+            .unwrap();
+        assert_eq!(inv.backend, "grpc-stt");
+    }
 
     #[test]
     fn test_invoke_fills_default_model_from_backend_instance() {
@@ -192,7 +688,7 @@ mod tests {
             BackendRegistry::new(vec![inst]),
             SelectionPolicy::WeightedRandom,
         );
-        let ai = AiEngine::new(router);
+        let ai = AiEngine::new(router, Default::default());
 
         let req = CanonicalRequestEnvelope {
             version: 1,
@@ -0,0 +1,100 @@
+use std::collections::HashMap;
+
+use serde::Deserialize;
+
+use crate::spearlet::execution::ai::ir::{
+    CanonicalRequestEnvelope, EmbeddingsPayload, Operation, Payload, Requirements, RoutingHints,
+};
+
+/// One text or a batch / 单个文本或一批文本
+#[derive(Debug, Clone, Deserialize)]
+#[serde(untagged)]
+pub enum EmbeddingsInput {
+    One(String),
+    Many(Vec<String>),
+}
+
+impl EmbeddingsInput {
+    pub fn into_vec(self) -> Vec<String> {
+        match self {
+            EmbeddingsInput::One(s) => vec![s],
+            EmbeddingsInput::Many(v) => v,
+        }
+    }
+}
+
+/// Request body of the `embeddings` hostcall / `embeddings` hostcall 的请求体
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct EmbeddingsRequest {
+    pub input: EmbeddingsInput,
+    #[serde(default)]
+    pub model: Option<String>,
+    /// Pin a backend by name / 按名称指定后端
+    #[serde(default)]
+    pub backend: Option<String>,
+    #[serde(default)]
+    pub dimensions: Option<u32>,
+    #[serde(default)]
+    pub timeout_ms: Option<u64>,
+}
+
+fn trimmed(s: Option<String>) -> Option<String> {
+    s.map(|s| s.trim().to_string()).filter(|s| !s.is_empty())
+}
+
+pub fn normalize_embeddings(req: EmbeddingsRequest) -> CanonicalRequestEnvelope {
+    let mut meta = HashMap::new();
+    meta.insert("source".to_string(), "embeddings".to_string());
+
+    CanonicalRequestEnvelope {
+        version: 1,
+        request_id: format!("emb_{}", uuid::Uuid::new_v4()),
+        operation: Operation::Embeddings,
+        meta,
+        routing: RoutingHints {
+            backend: trimmed(req.backend),
+            ..Default::default()
+        },
+        requirements: Requirements::default(),
+        timeout_ms: req.timeout_ms,
+        payload: Payload::Embeddings(EmbeddingsPayload {
+            input: req.input.into_vec(),
+            model: trimmed(req.model),
+            dimensions: req.dimensions,
+        }),
+        extra: HashMap::new(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_normalize_embeddings() {
+        let req: EmbeddingsRequest = serde_json::from_str(
+            r#"{"input": "hello", "model": " text-embedding-3-small ", "backend": "openai-emb"}"#,
+        )
+        .unwrap();
+        let env = normalize_embeddings(req);
+        assert_eq!(env.operation, Operation::Embeddings);
+        assert_eq!(env.routing.backend.as_deref(), Some("openai-emb"));
+        let Payload::Embeddings(p) = env.payload else {
+            panic!("unexpected payload");
+        };
+        assert_eq!(p.input, vec!["hello".to_string()]);
+        assert_eq!(p.model.as_deref(), Some("text-embedding-3-small"));
+
+        let batch: EmbeddingsRequest =
+            serde_json::from_str(r#"{"input": ["a", "b"], "dimensions": 256}"#).unwrap();
+        let Payload::Embeddings(p) = normalize_embeddings(batch).payload else {
+            panic!("unexpected payload");
+        };
+        assert_eq!(p.input.len(), 2);
+        assert_eq!(p.dimensions, Some(256));
+
+        assert!(serde_json::from_str::<EmbeddingsRequest>(r#"{"input": 1}"#).is_err());
+        assert!(serde_json::from_str::<EmbeddingsRequest>(r#"{"input": "a", "x": 1}"#).is_err());
+    }
+}
@@ -0,0 +1,99 @@
+use std::collections::HashMap;
+
+use serde::Deserialize;
+
+use crate::spearlet::execution::ai::ir::{
+    CanonicalRequestEnvelope, ImageGenerationPayload, Operation, Payload, Requirements,
+    RoutingHints,
+};
+
+/// Request body of the `image_generate` hostcall / `image_generate` hostcall 的请求体
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ImageGenerationRequest {
+    pub prompt: String,
+    #[serde(default)]
+    pub model: Option<String>,
+    /// Pin a backend by name / 按名称指定后端
+    #[serde(default)]
+    pub backend: Option<String>,
+    #[serde(default)]
+    pub n: Option<u32>,
+    #[serde(default)]
+    pub size: Option<String>,
+    #[serde(default)]
+    pub response_format: Option<String>,
+    /// Lower the node's cap on inline image bytes / 调低节点的内联图像字节上限
+    #[serde(default)]
+    pub max_inline_bytes: Option<usize>,
+    #[serde(default)]
+    pub timeout_ms: Option<u64>,
+}
+
+fn trimmed(s: Option<String>) -> Option<String> {
+    s.map(|s| s.trim().to_string()).filter(|s| !s.is_empty())
+}
+
+/// Width and height of a `WIDTHxHEIGHT` size / 解析 `宽x高` 形式的尺寸
+pub fn parse_size(size: &str) -> Option<(u32, u32)> {
+    let (w, h) = size.trim().split_once(['x', 'X'])?;
+    let w = w.trim().parse().ok().filter(|v| *v > 0)?;
+    let h = h.trim().parse().ok().filter(|v| *v > 0)?;
+    Some((w, h))
+}
+
+pub fn normalize_image_generation(req: ImageGenerationRequest) -> CanonicalRequestEnvelope {
+    let mut meta = HashMap::new();
+    meta.insert("source".to_string(), "image_generate".to_string());
+
+    CanonicalRequestEnvelope {
+        version: 1,
+        request_id: format!("img_{}", uuid::Uuid::new_v4()),
+        operation: Operation::ImageGeneration,
+        meta,
+        routing: RoutingHints {
+            backend: trimmed(req.backend),
+            ..Default::default()
+        },
+        requirements: Requirements::default(),
+        timeout_ms: req.timeout_ms,
+        payload: Payload::ImageGeneration(ImageGenerationPayload {
+            prompt: req.prompt,
+            model: trimmed(req.model),
+            n: req.n,
+            size: trimmed(req.size),
+            response_format: trimmed(req.response_format),
+        }),
+        extra: HashMap::new(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_normalize_image_generation() {
+        let req: ImageGenerationRequest = serde_json::from_str(
+            r#"{"prompt": "a red fox", "model": " dall-e-3 ", "size": "1024x1024", "response_format": "b64_json"}"#,
+        )
+        .unwrap();
+        let env = normalize_image_generation(req);
+        assert_eq!(env.operation, Operation::ImageGeneration);
+        let Payload::ImageGeneration(p) = env.payload else {
+            panic!("unexpected payload");
+        };
+        assert_eq!(p.model.as_deref(), Some("dall-e-3"));
+        assert_eq!(p.response_format.as_deref(), Some("b64_json"));
+
+        assert_eq!(parse_size("512x768"), Some((512, 768)));
+        assert_eq!(parse_size(" 64 X 64 "), Some((64, 64)));
+        assert_eq!(parse_size("0x64"), None);
+        assert_eq!(parse_size("square"), None);
+
+        assert!(serde_json::from_str::<ImageGenerationRequest>(r#"{"model": "x"}"#).is_err());
+        assert!(
+            serde_json::from_str::<ImageGenerationRequest>(r#"{"prompt": "a", "x": 1}"#).is_err()
+        );
+    }
+}
@@ -1 +1,6 @@
 pub mod chat;
+pub mod embeddings;
+pub mod image;
+pub mod moderations;
+pub mod structured;
+pub mod tts;
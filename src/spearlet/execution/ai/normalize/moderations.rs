@@ -0,0 +1,72 @@
+use std::collections::HashMap;
+
+use serde::Deserialize;
+
+use crate::spearlet::execution::ai::ir::{
+    CanonicalRequestEnvelope, ModerationsPayload, Operation, Payload, Requirements, RoutingHints,
+};
+use crate::spearlet::execution::ai::normalize::embeddings::EmbeddingsInput;
+
+/// Request body of the `moderate` hostcall / `moderate` hostcall 的请求体
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct ModerationsRequest {
+    /// One text or a batch, as for embeddings / 单个文本或一批文本，与 embeddings 相同
+    pub input: EmbeddingsInput,
+    #[serde(default)]
+    pub model: Option<String>,
+    /// Pin a backend by name / 按名称指定后端
+    #[serde(default)]
+    pub backend: Option<String>,
+    #[serde(default)]
+    pub timeout_ms: Option<u64>,
+}
+
+fn trimmed(s: Option<String>) -> Option<String> {
+    s.map(|s| s.trim().to_string()).filter(|s| !s.is_empty())
+}
+
+pub fn normalize_moderations(req: ModerationsRequest, source: &str) -> CanonicalRequestEnvelope {
+    let mut meta = HashMap::new();
+    meta.insert("source".to_string(), source.to_string());
+
+    CanonicalRequestEnvelope {
+        version: 1,
+        request_id: format!("mod_{}", uuid::Uuid::new_v4()),
+        operation: Operation::Moderations,
+        meta,
+        routing: RoutingHints {
+            backend: trimmed(req.backend),
+            ..Default::default()
+        },
+        requirements: Requirements::default(),
+        timeout_ms: req.timeout_ms,
+        payload: Payload::Moderations(ModerationsPayload {
+            input: req.input.into_vec(),
+            model: trimmed(req.model),
+        }),
+        extra: HashMap::new(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_normalize_moderations() {
+        let req: ModerationsRequest =
+            serde_json::from_str(r#"{"input": ["a", "b"], "backend": " guard "}"#).unwrap();
+        let env = normalize_moderations(req, "moderate");
+        assert_eq!(env.operation, Operation::Moderations);
+        assert_eq!(env.routing.backend.as_deref(), Some("guard"));
+        assert_eq!(env.meta.get("source").map(String::as_str), Some("moderate"));
+        let Payload::Moderations(p) = env.payload else {
+            panic!("unexpected payload");
+        };
+        assert_eq!(p.input.len(), 2);
+        assert_eq!(p.model, None);
+
+        assert!(serde_json::from_str::<ModerationsRequest>(r#"{"input": "a", "x": 1}"#).is_err());
+    }
+}
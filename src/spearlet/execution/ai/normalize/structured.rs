@@ -0,0 +1,187 @@
+use std::collections::HashMap;
+
+use serde::Deserialize;
+use serde_json::{json, Value};
+
+use crate::spearlet::execution::ai::ir::{
+    CanonicalRequestEnvelope, ChatCompletionsPayload, ChatMessage, Operation, Payload,
+    Requirements, RoutingHints,
+};
+use crate::spearlet::param_keys::chat as chat_keys;
+
+/// Request body of the `chat_structured` hostcall / `chat_structured` hostcall 的请求体
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct StructuredChatRequest {
+    pub messages: Vec<ChatMessage>,
+    /// JSON Schema the answer must match / 应答必须符合的 JSON Schema
+    pub schema: Value,
+    /// Schema name shown to the provider / 提供给提供方的 schema 名称
+    #[serde(default)]
+    pub name: Option<String>,
+    /// Ask the provider for strict schema adherence / 要求提供方严格遵循 schema
+    #[serde(default)]
+    pub strict: bool,
+    #[serde(default)]
+    pub model: Option<String>,
+    /// Pin a backend by name / 按名称指定后端
+    #[serde(default)]
+    pub backend: Option<String>,
+    #[serde(default)]
+    pub timeout_ms: Option<u64>,
+    /// Times the model is asked to correct an answer that does not match
+    /// 应答不符合时要求模型更正的次数
+    #[serde(default)]
+    pub max_repairs: Option<u32>,
+    /// Further chat parameters, such as `temperature` / 其他对话参数，例如 `temperature`
+    #[serde(default)]
+    pub params: HashMap<String, Value>,
+}
+
+/// How the schema reaches the model / schema 传达给模型的方式
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SchemaEnforcement {
+    /// `response_format` on a backend with `supports_json_schema` / 在支持 `supports_json_schema` 的后端上使用 `response_format`
+    ResponseFormat,
+    /// An instruction in a system message / 系统消息中的指令
+    Prompt,
+}
+
+impl SchemaEnforcement {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            SchemaEnforcement::ResponseFormat => "response_format",
+            SchemaEnforcement::Prompt => "prompt",
+        }
+    }
+}
+
+/// Name used when the request gives none / 请求未提供名称时使用的名称
+pub const DEFAULT_SCHEMA_NAME: &str = "response";
+
+fn trimmed(s: Option<&String>) -> Option<String> {
+    s.map(|s| s.trim().to_string()).filter(|s| !s.is_empty())
+}
+
+/// Whether `name` is accepted by providers: 1 to 64 of `a-z A-Z 0-9 _ -`
+/// `name` 是否为提供方所接受：1 到 64 个 `a-z A-Z 0-9 _ -` 字符
+pub fn valid_schema_name(name: &str) -> bool {
+    (1..=64).contains(&name.len())
+        && name
+            .bytes()
+            .all(|b| b.is_ascii_alphanumeric() || b == b'_' || b == b'-')
+}
+
+pub fn normalize_structured_chat(
+    req: &StructuredChatRequest,
+    messages: &[ChatMessage],
+    how: SchemaEnforcement,
+    source: &str,
+) -> CanonicalRequestEnvelope {
+    let mut meta = HashMap::new();
+    meta.insert("source".to_string(), source.to_string());
+
+    let model = trimmed(req.model.as_ref()).unwrap_or_default();
+    let mut params = req.params.clone();
+    params.remove(chat_keys::RESPONSE_FORMAT);
+    if !model.is_empty() {
+        params.insert(chat_keys::MODEL.to_string(), json!(model));
+    }
+    let mut requirements = Requirements::default();
+    let mut messages = messages.to_vec();
+    match how {
+        SchemaEnforcement::ResponseFormat => {
+            params.insert(
+                chat_keys::RESPONSE_FORMAT.to_string(),
+                json!({
+                    "type": "json_schema",
+                    "json_schema": {
+                        "name": trimmed(req.name.as_ref()).unwrap_or_else(|| DEFAULT_SCHEMA_NAME.to_string()),
+                        "schema": req.schema,
+                        "strict": req.strict,
+                    }
+                }),
+            );
+            requirements
+                .required_features
+                .push("supports_json_schema".to_string());
+        }
+        SchemaEnforcement::Prompt => {
+            messages.insert(
+                0,
+                ChatMessage {
+                    role: "system".to_string(),
+                    content: json!(format!(
+                        "Answer with a single JSON value and nothing else. It must match this JSON Schema:\n{}",
+                        req.schema
+                    )),
+                    tool_call_id: None,
+                    tool_calls: None,
+                    name: None,
+                },
+            );
+        }
+    }
+
+    CanonicalRequestEnvelope {
+        version: 1,
+        request_id: format!("chatcmpl_{}", uuid::Uuid::new_v4()),
+        operation: Operation::ChatCompletions,
+        meta,
+        routing: RoutingHints {
+            backend: trimmed(req.backend.as_ref()),
+            ..Default::default()
+        },
+        requirements,
+        timeout_ms: req.timeout_ms,
+        payload: Payload::ChatCompletions(ChatCompletionsPayload {
+            model,
+            messages,
+            tools: Vec::new(),
+            params,
+        }),
+        extra: HashMap::new(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_normalize_structured_chat() {
+        let req: StructuredChatRequest = serde_json::from_value(json!({
+            "messages": [{"role": "user", "content": "weather in Oslo?"}],
+            "schema": {"type": "object"},
+            "params": {"temperature": 0, "response_format": {"type": "text"}}
+        }))
+        .unwrap();
+
+        let env =
+            normalize_structured_chat(&req, &req.messages, SchemaEnforcement::ResponseFormat, "t");
+        assert_eq!(
+            env.requirements.required_features,
+            vec!["supports_json_schema"]
+        );
+        let Payload::ChatCompletions(p) = &env.payload else {
+            panic!("unexpected payload");
+        };
+        assert_eq!(
+            p.params["response_format"]["json_schema"]["name"],
+            "response"
+        );
+        assert_eq!(p.params["temperature"], 0);
+        assert_eq!(p.messages.len(), 1);
+
+        let env = normalize_structured_chat(&req, &req.messages, SchemaEnforcement::Prompt, "t");
+        assert!(env.requirements.required_features.is_empty());
+        let Payload::ChatCompletions(p) = &env.payload else {
+            panic!("unexpected payload");
+        };
+        assert!(p.params.get("response_format").is_none());
+        assert_eq!(p.messages[0].role, "system");
+
+        assert!(valid_schema_name("weather_report-2"));
+        assert!(!valid_schema_name("weather report"));
+    }
+}
@@ -0,0 +1,73 @@
+use std::collections::HashMap;
+
+use serde_json::Value;
+
+use crate::spearlet::execution::ai::ir::{
+    CanonicalRequestEnvelope, Operation, Payload, Requirements, RoutingHints, TextToSpeechPayload,
+};
+use crate::spearlet::param_keys::tts as tts_keys;
+
+fn str_param(params: &HashMap<String, Value>, key: &str) -> Option<String> {
+    params
+        .get(key)
+        .and_then(|v| v.as_str())
+        .map(|s| s.trim().to_string())
+        .filter(|s| !s.is_empty())
+}
+
+pub fn normalize_tts_session(
+    fd: i32,
+    text: &str,
+    params: &HashMap<String, Value>,
+) -> CanonicalRequestEnvelope {
+    let mut meta = HashMap::new();
+    meta.insert("source".to_string(), "tts".to_string());
+
+    CanonicalRequestEnvelope {
+        version: 1,
+        request_id: format!("tts_{}", fd),
+        operation: Operation::TextToSpeech,
+        meta,
+        routing: RoutingHints {
+            backend: str_param(params, tts_keys::BACKEND),
+            ..Default::default()
+        },
+        requirements: Requirements::default(),
+        timeout_ms: params.get(tts_keys::TIMEOUT_MS).and_then(|v| v.as_u64()),
+        payload: Payload::TextToSpeech(TextToSpeechPayload {
+            model: str_param(params, tts_keys::MODEL),
+            input: text.to_string(),
+            voice: str_param(params, tts_keys::VOICE),
+            format: str_param(params, tts_keys::FORMAT),
+            speed: params.get(tts_keys::SPEED).and_then(|v| v.as_f64()),
+        }),
+        extra: HashMap::new(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_normalize_tts_session() {
+        let mut params = HashMap::new();
+        params.insert(tts_keys::MODEL.to_string(), json!("tts-1"));
+        params.insert(tts_keys::VOICE.to_string(), json!(" nova "));
+        params.insert(tts_keys::SPEED.to_string(), json!(1.25));
+        params.insert(tts_keys::BACKEND.to_string(), json!("openai-tts"));
+
+        let req = normalize_tts_session(7, "hello", &params);
+        assert_eq!(req.operation, Operation::TextToSpeech);
+        assert_eq!(req.routing.backend.as_deref(), Some("openai-tts"));
+        let Payload::TextToSpeech(p) = req.payload else {
+            panic!("unexpected payload");
+        };
+        assert_eq!(p.model.as_deref(), Some("tts-1"));
+        assert_eq!(p.voice.as_deref(), Some("nova"));
+        assert_eq!(p.format, None);
+        assert_eq!(p.speed, Some(1.25));
+        assert_eq!(p.input, "hello");
+    }
+}
@@ -0,0 +1,173 @@
+//! Provider-side conversation state / 提供方侧的会话状态
+//!
+//! Some providers keep a conversation on their side, such as the OpenAI Responses API with
+//! `previous_response_id`. A chat session that is answered by such a backend remembers the
+//! provider's handle together with a fingerprint of the messages the provider already holds.
+//! The next call hands both to the backend through `EXTRA_KEY`. If the same backend answers
+//! and the session still begins with exactly those messages, only the newer messages are
+//! sent. Otherwise the full history goes out as usual, so a changed history, a failover or an
+//! expired handle makes a larger request but never changes the answer.
+//! 部分提供方会在其侧保存会话，例如带 `previous_response_id` 的 OpenAI Responses API。由此类后端应答的
+//! chat 会话会记住提供方的句柄以及提供方已持有消息的指纹。下一次调用通过 `EXTRA_KEY` 将二者交给后端。
+//! 若由同一后端应答且会话仍以这些消息开头，则只发送更新的消息；否则照常发送完整历史，因此历史被修改、
+//! 故障转移或句柄过期只会使请求变大，而不会改变应答。
+
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::execution::ai::ir::{CanonicalRequestEnvelope, ChatMessage, Payload};
+
+/// Request `extra` key carrying the session / 携带会话的请求 `extra` 键
+pub const EXTRA_KEY: &str = "provider_session";
+/// Result key a stateful backend puts its handle under / 有状态后端存放其句柄的结果键
+pub const RESULT_KEY: &str = "provider_response_id";
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ProviderSession {
+    /// Backend that holds the conversation / 持有会话的后端
+    pub backend: String,
+    pub response_id: String,
+    /// Number of leading messages the provider holds / 提供方持有的前导消息数
+    pub messages: usize,
+    pub fingerprint: String,
+}
+
+/// Digest of a message history / 消息历史的摘要
+pub fn fingerprint(messages: &[ChatMessage]) -> String {
+    let mut h = Sha256::new();
+    for m in messages {
+        h.update(serde_json::to_vec(m).unwrap_or_default());
+        h.update([0u8]);
+    }
+    h.finalize().iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+fn chat_messages(req: &CanonicalRequestEnvelope) -> Option<&[ChatMessage]> {
+    match &req.payload {
+        Payload::ChatCompletions(p) => Some(&p.messages),
+        _ => None,
+    }
+}
+
+impl ProviderSession {
+    /// Session left by a stateful backend's answer to `req`, if any
+    /// 有状态后端对 `req` 的应答留下的会话（如有）
+    ///
+    /// The handle is taken out of `result`, so workloads see a plain answer.
+    /// 句柄会从 `result` 中取出，因此工作负载看到的是普通应答。
+    pub fn from_answer(
+        backend: &str,
+        req: &CanonicalRequestEnvelope,
+        result: &mut Value,
+    ) -> Option<Self> {
+        let id = result.as_object_mut()?.remove(RESULT_KEY)?;
+        let id = id.as_str().filter(|s| !s.is_empty())?;
+        let messages = chat_messages(req)?;
+        Some(Self {
+            backend: backend.to_string(),
+            response_id: id.to_string(),
+            messages: messages.len(),
+            fingerprint: fingerprint(messages),
+        })
+    }
+
+    pub fn attach(&self, req: &mut CanonicalRequestEnvelope) {
+        if let Ok(v) = serde_json::to_value(self) {
+            req.extra.insert(EXTRA_KEY.to_string(), v);
+        }
+    }
+
+    pub fn from_request(req: &CanonicalRequestEnvelope) -> Option<Self> {
+        serde_json::from_value(req.extra.get(EXTRA_KEY)?.clone()).ok()
+    }
+
+    /// First message `backend` still needs, when it can continue this session
+    /// `backend` 可以延续该会话时，其仍需要的第一条消息
+    ///
+    /// The provider also holds its own answer, so assistant messages right after the held
+    /// ones, which echo that answer, are skipped as well.
+    /// 提供方也持有其自身的应答，因此紧随已持有消息之后、复述该应答的 assistant 消息同样被跳过。
+    pub fn resume_at(&self, backend: &str, messages: &[ChatMessage]) -> Option<usize> {
+        if self.backend != backend || self.messages == 0 || self.messages > messages.len() {
+            return None;
+        }
+        if fingerprint(&messages[..self.messages]) != self.fingerprint {
+            return None;
+        }
+        let mut at = self.messages;
+        while messages.get(at).is_some_and(|m| m.role == "assistant") {
+            at += 1;
+        }
+        (at < messages.len()).then_some(at)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{ChatCompletionsPayload, Operation, RoutingHints};
+    use serde_json::json;
+    use std::collections::HashMap;
+
+    fn msg(role: &str, content: &str) -> ChatMessage {
+        ChatMessage {
+            role: role.to_string(),
+            content: json!(content),
+            tool_call_id: None,
+            tool_calls: None,
+            name: None,
+        }
+    }
+
+    fn req(messages: Vec<ChatMessage>) -> CanonicalRequestEnvelope {
+        CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r1".to_string(),
+            operation: Operation::ChatCompletions,
+            meta: HashMap::new(),
+            routing: RoutingHints::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::ChatCompletions(ChatCompletionsPayload {
+                model: "gpt-4o-mini".to_string(),
+                messages,
+                tools: Vec::new(),
+                params: HashMap::new(),
+            }),
+            extra: HashMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_session_resumes_only_unchanged_history() {
+        let first = req(vec![msg("system", "Be brief."), msg("user", "Hi")]);
+        let mut answer = json!({"object": "chat.completion", RESULT_KEY: "resp_1"});
+        let s = ProviderSession::from_answer("openai-resp", &first, &mut answer).unwrap();
+        assert!(answer.get(RESULT_KEY).is_none());
+        assert_eq!(s.messages, 2);
+
+        let mut next = req(vec![
+            msg("system", "Be brief."),
+            msg("user", "Hi"),
+            msg("assistant", "Hello!"),
+            msg("user", "Weather?"),
+        ]);
+        s.attach(&mut next);
+        let s = ProviderSession::from_request(&next).unwrap();
+        let Payload::ChatCompletions(p) = &next.payload else {
+            unreachable!()
+        };
+        assert_eq!(s.resume_at("openai-resp", &p.messages), Some(3));
+        assert_eq!(s.resume_at("other", &p.messages), None);
+
+        let edited = vec![
+            msg("system", "Be verbose."),
+            msg("user", "Hi"),
+            msg("user", "?"),
+        ];
+        assert_eq!(s.resume_at("openai-resp", &edited), None);
+        // Nothing new to send / 没有新消息可发送
+        assert_eq!(s.resume_at("openai-resp", &p.messages[..3]), None);
+    }
+}
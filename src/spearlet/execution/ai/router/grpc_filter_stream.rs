@@ -27,8 +27,6 @@ use crate::spearlet::config::RouterGrpcFilterStreamConfig;
 use crate::spearlet::execution::ai::ir::{CanonicalError, CanonicalRequestEnvelope, Operation};
 use crate::spearlet::execution::ai::router::registry::{BackendInstance, Hosting};
 
-static GLOBAL_HUB: OnceLock<Arc<RouterFilterStreamHub>> = OnceLock::new();
-
 fn to_proto_operation(op: &Operation) -> i32 {
     match op {
         Operation::ChatCompletions => ProtoOperation::ChatCompletions as i32,
@@ -37,6 +35,7 @@ fn to_proto_operation(op: &Operation) -> i32 {
         Operation::SpeechToText => ProtoOperation::SpeechToText as i32,
         Operation::TextToSpeech => ProtoOperation::TextToSpeech as i32,
         Operation::RealtimeVoice => ProtoOperation::RealtimeVoice as i32,
+        Operation::Moderations => ProtoOperation::Moderations as i32,
     }
 }
 
@@ -48,6 +47,7 @@ fn to_operation_name(op: &Operation) -> &'static str {
         Operation::SpeechToText => "speech_to_text",
         Operation::TextToSpeech => "text_to_speech",
         Operation::RealtimeVoice => "realtime_voice",
+        Operation::Moderations => "moderations",
     }
 }
 
@@ -66,6 +66,7 @@ fn requested_model(req: &CanonicalRequestEnvelope) -> Option<&str> {
         crate::spearlet::execution::ai::ir::Payload::SpeechToText(p) => p.model.as_deref(),
         crate::spearlet::execution::ai::ir::Payload::TextToSpeech(p) => p.model.as_deref(),
         crate::spearlet::execution::ai::ir::Payload::RealtimeVoice(p) => p.model.as_deref(),
+        crate::spearlet::execution::ai::ir::Payload::Moderations(p) => p.model.as_deref(),
     }
 }
 
@@ -174,23 +175,37 @@ pub struct RouterFilterStreamHub {
     job_rx: parking_lot::Mutex<Option<mpsc::UnboundedReceiver<FilterJob>>>,
 }
 
-impl RouterFilterStreamHub {
-    /// Initialize global hub (idempotent).
-    /// 初始化全局 hub（幂等）。
-    pub fn init_global(config: RouterGrpcFilterStreamConfig) -> Arc<Self> {
-        GLOBAL_HUB
+/// The filter hub of one spearlet, shared by all its routers.
+/// 单个 spearlet 的过滤 hub，由其所有路由器共享。
+#[derive(Default)]
+pub struct RouterFilterHubSlot {
+    hub: OnceLock<Arc<RouterFilterStreamHub>>,
+}
+
+impl RouterFilterHubSlot {
+    /// Initialize the hub (idempotent).
+    /// 初始化 hub（幂等）。
+    pub fn init(&self, config: RouterGrpcFilterStreamConfig) -> Arc<RouterFilterStreamHub> {
+        self.hub
             .get_or_init(|| {
-                let hub = Arc::new(Self::new(config));
+                let hub = Arc::new(RouterFilterStreamHub::new(config));
                 hub.start_background();
                 hub
             })
             .clone()
     }
 
-    /// Get global hub if already initialized.
-    /// 获取已初始化的全局 hub。
-    pub fn global() -> Option<Arc<Self>> {
-        GLOBAL_HUB.get().cloned()
+    /// Get the hub if already initialized.
+    /// 获取已初始化的 hub。
+    pub fn get(&self) -> Option<Arc<RouterFilterStreamHub>> {
+        self.hub.get().cloned()
+    }
+}
+
+impl RouterFilterStreamHub {
+    /// Filter calls waiting for a response / 等待响应的过滤调用数
+    pub fn inflight_count(&self) -> usize {
+        self.inflight.lock().len()
     }
 
     pub fn new(config: RouterGrpcFilterStreamConfig) -> Self {
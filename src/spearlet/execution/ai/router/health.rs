@@ -0,0 +1,324 @@
+//! Backend health and circuit breakers / 后端健康状态与熔断
+//!
+//! Every call to an LLM backend reports back here. A backend whose calls fail with a
+//! retryable error `failure_threshold` times in a row has its circuit opened, and the router
+//! skips it for `open_secs`. After that one trial call is let through: success closes the
+//! circuit, failure opens it again. Errors the backend answered deliberately (bad request,
+//! unknown model) show that it is reachable and count as success.
+//! 每次对 LLM 后端的调用都会在此报告结果。连续 `failure_threshold` 次以可重试错误失败的后端会被打开
+//! 熔断，路由器在 `open_secs` 内跳过它。之后放行一次试探调用：成功则关闭熔断，失败则再次打开。后端
+//! 主动返回的错误（请求错误、未知模型）说明其可达，按成功计。
+
+use std::collections::HashMap;
+use std::time::{Duration, Instant};
+
+use parking_lot::{Mutex, RwLock};
+use serde::Serialize;
+
+use crate::spearlet::config::LlmFailoverConfig;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum CircuitState {
+    Closed,
+    Open,
+    /// A trial call is running / 试探调用进行中
+    HalfOpen,
+}
+
+#[derive(Debug)]
+struct Entry {
+    state: CircuitState,
+    consecutive_failures: u32,
+    opened_at: Option<Instant>,
+    failures: u64,
+    successes: u64,
+    last_error: Option<String>,
+}
+
+impl Default for Entry {
+    fn default() -> Self {
+        Self {
+            state: CircuitState::Closed,
+            consecutive_failures: 0,
+            opened_at: None,
+            failures: 0,
+            successes: 0,
+            last_error: None,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct BackendHealth {
+    pub name: String,
+    pub state: CircuitState,
+    pub consecutive_failures: u32,
+    pub failures: u64,
+    pub successes: u64,
+    pub last_error: Option<String>,
+    /// Time until an open circuit lets a trial call through / 打开的熔断放行试探调用前的剩余时间
+    pub retry_in_ms: Option<u64>,
+}
+
+pub struct ProviderHealth {
+    config: RwLock<LlmFailoverConfig>,
+    entries: Mutex<HashMap<String, Entry>>,
+}
+
+impl Default for ProviderHealth {
+    fn default() -> Self {
+        Self::new(LlmFailoverConfig::default())
+    }
+}
+
+impl ProviderHealth {
+    pub fn new(config: LlmFailoverConfig) -> Self {
+        Self {
+            config: RwLock::new(config),
+            entries: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Apply a new configuration; disabling closes every circuit / 应用新配置；关闭时关闭所有熔断
+    pub fn set_config(&self, config: LlmFailoverConfig) {
+        if !config.enabled {
+            self.entries.lock().clear();
+        }
+        *self.config.write() = config;
+    }
+
+    pub fn config(&self) -> LlmFailoverConfig {
+        self.config.read().clone()
+    }
+
+    fn open_for(&self) -> Duration {
+        Duration::from_secs(self.config.read().open_secs)
+    }
+
+    /// Whether the router may pick `name` / 路由器是否可以选择 `name`
+    pub fn admits(&self, name: &str) -> bool {
+        if !self.config.read().enabled {
+            return true;
+        }
+        let open_for = self.open_for();
+        match self.entries.lock().get(name) {
+            None => true,
+            Some(e) => match e.state {
+                CircuitState::Closed => true,
+                CircuitState::Open => e.opened_at.map_or(true, |t| t.elapsed() >= open_for),
+                CircuitState::HalfOpen => false,
+            },
+        }
+    }
+
+    /// A call to `name` starts; after an open period it is the trial call
+    /// 开始调用 `name`；熔断打开期过后该调用即为试探调用
+    pub fn begin(&self, name: &str) -> BackendCall<'_> {
+        if self.config.read().enabled {
+            if let Some(e) = self.entries.lock().get_mut(name) {
+                if e.state == CircuitState::Open {
+                    e.state = CircuitState::HalfOpen;
+                }
+            }
+        }
+        BackendCall {
+            health: self,
+            name: name.to_string(),
+            done: false,
+        }
+    }
+
+    pub fn record_success(&self, name: &str) {
+        if !self.config.read().enabled {
+            return;
+        }
+        let mut entries = self.entries.lock();
+        let e = entries.entry(name.to_string()).or_default();
+        if e.state != CircuitState::Closed {
+            tracing::info!(backend = %name, "LLM backend circuit closed");
+        }
+        e.state = CircuitState::Closed;
+        e.consecutive_failures = 0;
+        e.opened_at = None;
+        e.successes += 1;
+    }
+
+    pub fn record_failure(&self, name: &str, error: &str) {
+        let cfg = self.config.read().clone();
+        if !cfg.enabled {
+            return;
+        }
+        let mut entries = self.entries.lock();
+        let e = entries.entry(name.to_string()).or_default();
+        e.consecutive_failures += 1;
+        e.failures += 1;
+        e.last_error = Some(error.to_string());
+        if e.state == CircuitState::HalfOpen || e.consecutive_failures >= cfg.failure_threshold {
+            if e.state != CircuitState::Open {
+                tracing::warn!(
+                    backend = %name,
+                    failures = e.consecutive_failures,
+                    error = %error,
+                    "LLM backend circuit opened"
+                );
+            }
+            e.state = CircuitState::Open;
+            e.opened_at = Some(Instant::now());
+        }
+    }
+
+    /// Wait before retry number `retry` (1-based) / 第 `retry` 次重试（从 1 开始）前的等待
+    pub fn backoff(&self, retry: u32) -> Duration {
+        let cfg = self.config.read();
+        let factor = 1u64 << retry.saturating_sub(1).min(16);
+        Duration::from_millis(
+            cfg.backoff_initial_ms
+                .saturating_mul(factor)
+                .min(cfg.backoff_max_ms),
+        )
+    }
+
+    /// Backends that have been called, by name / 已被调用过的后端，按名称排列
+    pub fn snapshot(&self) -> Vec<BackendHealth> {
+        let open_for = self.open_for();
+        let entries = self.entries.lock();
+        let mut out: Vec<BackendHealth> = entries
+            .iter()
+            .map(|(name, e)| BackendHealth {
+                name: name.clone(),
+                state: e.state,
+                consecutive_failures: e.consecutive_failures,
+                failures: e.failures,
+                successes: e.successes,
+                last_error: e.last_error.clone(),
+                retry_in_ms: match (e.state, e.opened_at) {
+                    (CircuitState::Open, Some(t)) => {
+                        Some(open_for.saturating_sub(t.elapsed()).as_millis() as u64)
+                    }
+                    _ => None,
+                },
+            })
+            .collect();
+        out.sort_by(|a, b| a.name.cmp(&b.name));
+        out
+    }
+}
+
+/// A call started by [`ProviderHealth::begin`] / 由 [`ProviderHealth::begin`] 开始的调用
+///
+/// A call dropped without an outcome (a panic or an early return) counts as a failure, so a
+/// trial call can never leave the circuit half-open.
+/// 未记录结果即被丢弃的调用（panic 或提前返回）按失败计，试探调用因此不会使熔断停留在半开状态。
+#[must_use = "dropping the call records a failure"]
+pub struct BackendCall<'a> {
+    health: &'a ProviderHealth,
+    name: String,
+    done: bool,
+}
+
+impl BackendCall<'_> {
+    pub fn success(mut self) {
+        self.done = true;
+        self.health.record_success(&self.name);
+    }
+
+    pub fn failure(mut self, error: &str) {
+        self.done = true;
+        self.health.record_failure(&self.name, error);
+    }
+}
+
+impl Drop for BackendCall<'_> {
+    fn drop(&mut self) {
+        if !self.done {
+            self.health.record_failure(&self.name, "call abandoned");
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn health(failure_threshold: u32, open_secs: u64) -> ProviderHealth {
+        ProviderHealth::new(LlmFailoverConfig {
+            failure_threshold,
+            open_secs,
+            ..Default::default()
+        })
+    }
+
+    #[test]
+    fn test_circuit_opens_and_recovers() {
+        let h = health(2, 0);
+        h.record_failure("a", "502");
+        assert!(h.admits("a"));
+        h.record_failure("a", "503");
+        assert_eq!(h.snapshot()[0].state, CircuitState::Open);
+
+        // Open period over: one trial call / 打开期结束：一次试探调用
+        assert!(h.admits("a"));
+        let call = h.begin("a");
+        assert!(!h.admits("a"));
+        call.failure("503");
+        assert_eq!(h.snapshot()[0].state, CircuitState::Open);
+
+        h.begin("a").success();
+        let s = &h.snapshot()[0];
+        assert_eq!(s.state, CircuitState::Closed);
+        assert_eq!((s.failures, s.successes, s.consecutive_failures), (3, 1, 0));
+    }
+
+    #[test]
+    fn test_abandoned_trial_call_reopens_circuit() {
+        let h = health(1, 0);
+        h.record_failure("a", "503");
+
+        // Early return / 提前返回
+        {
+            let _call = h.begin("a");
+            assert_eq!(h.snapshot()[0].state, CircuitState::HalfOpen);
+        }
+        assert_eq!(h.snapshot()[0].state, CircuitState::Open);
+        assert!(h.admits("a"));
+
+        // Panic / panic
+        let out = std::panic::catch_unwind(std::panic::AssertUnwindSafe(|| {
+            let _call = h.begin("a");
+            panic!("adapter panicked");
+        }));
+        assert!(out.is_err());
+        let s = &h.snapshot()[0];
+        assert_eq!(s.state, CircuitState::Open);
+        assert_eq!(s.last_error.as_deref(), Some("call abandoned"));
+        assert_eq!(s.failures, 3);
+    }
+
+    #[test]
+    fn test_open_circuit_keeps_backend_out() {
+        let h = health(1, 60);
+        h.record_failure("a", "timeout");
+        assert!(!h.admits("a"));
+        assert!(h.admits("b"));
+        assert!(h.snapshot()[0].retry_in_ms.unwrap() > 0);
+
+        h.set_config(LlmFailoverConfig {
+            enabled: false,
+            ..Default::default()
+        });
+        assert!(h.admits("a"));
+        assert!(h.snapshot().is_empty());
+    }
+
+    #[test]
+    fn test_backoff_doubles_up_to_max() {
+        let h = ProviderHealth::new(LlmFailoverConfig {
+            backoff_initial_ms: 100,
+            backoff_max_ms: 350,
+            ..Default::default()
+        });
+        let waits: Vec<u64> = (1..=4).map(|n| h.backoff(n).as_millis() as u64).collect();
+        assert_eq!(waits, vec![100, 200, 350, 350]);
+    }
+}
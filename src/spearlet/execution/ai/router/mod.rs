@@ -1,11 +1,13 @@
 pub mod capabilities;
 pub mod grpc_filter_stream;
+pub mod health;
 pub mod policy;
 pub mod registry;
 
 use std::collections::HashMap;
 use std::sync::Arc;
 
+use crate::spearlet::energy::EnergyGovernor;
 use crate::spearlet::execution::ai::backends::KIND_OPENAI_CHAT_COMPLETION;
 use crate::spearlet::execution::ai::ir::{CanonicalError, CanonicalRequestEnvelope};
 use crate::spearlet::execution::ai::router::policy::SelectionPolicy;
@@ -13,7 +15,9 @@ use crate::spearlet::execution::ai::router::registry::{BackendInstance, BackendR
 use crate::spearlet::execution::ai::{
     backends::openai_chat_completion::OpenAIChatCompletionBackendAdapter, ir::Operation,
 };
-use crate::spearlet::local_models::{global_managed_backends, ManagedBackendRegistry};
+use crate::spearlet::local_models::autosuspend::TrackedAdapter;
+use crate::spearlet::local_models::autosuspend::BackendActivity;
+use crate::spearlet::local_models::ManagedBackendRegistry;
 use parking_lot::RwLock;
 use rand::Rng;
 use tracing::debug;
@@ -26,6 +30,7 @@ fn requested_model(req: &CanonicalRequestEnvelope) -> Option<&str> {
         crate::spearlet::execution::ai::ir::Payload::SpeechToText(p) => p.model.as_deref(),
         crate::spearlet::execution::ai::ir::Payload::TextToSpeech(p) => p.model.as_deref(),
         crate::spearlet::execution::ai::ir::Payload::RealtimeVoice(p) => p.model.as_deref(),
+        crate::spearlet::execution::ai::ir::Payload::Moderations(p) => p.model.as_deref(),
     }
 }
 
@@ -36,6 +41,8 @@ pub struct Router {
     grpc_filter_stream: Option<Arc<grpc_filter_stream::RouterFilterStreamHub>>,
     managed_backends: ManagedBackendRegistry,
     managed_cache: Arc<RwLock<ManagedBackendCache>>,
+    health: Arc<health::ProviderHealth>,
+    energy: Arc<EnergyGovernor>,
 }
 
 struct ManagedBackendCache {
@@ -49,18 +56,27 @@ impl Router {
             registry,
             policy,
             grpc_filter_stream: None,
-            managed_backends: global_managed_backends(),
+            managed_backends: ManagedBackendRegistry::new(),
             managed_cache: Arc::new(RwLock::new(ManagedBackendCache {
                 revision: 0,
                 instances: Arc::new(Vec::new()),
             })),
+            health: Arc::default(),
+            energy: Arc::default(),
         }
     }
 
+    /// Route over `registry` and the backends published in `managed_backends`, skipping
+    /// those whose circuit is open in `health` and preferring remote ones as `energy` asks
+    /// 在 `registry` 与 `managed_backends` 中发布的后端之间路由，跳过 `health` 中熔断已打开的后端，
+    /// 并按 `energy` 的要求优先选择远程后端
     pub fn new_with_filter(
         registry: BackendRegistry,
         policy: SelectionPolicy,
         grpc_filter_stream: Option<Arc<grpc_filter_stream::RouterFilterStreamHub>>,
+        managed_backends: ManagedBackendRegistry,
+        health: Arc<health::ProviderHealth>,
+        energy: Arc<EnergyGovernor>,
     ) -> Self {
         if let Some(h) = grpc_filter_stream.as_ref() {
             h.start_background();
@@ -69,14 +85,21 @@ impl Router {
             registry,
             policy,
             grpc_filter_stream,
-            managed_backends: global_managed_backends(),
+            managed_backends,
             managed_cache: Arc::new(RwLock::new(ManagedBackendCache {
                 revision: 0,
                 instances: Arc::new(Vec::new()),
             })),
+            health,
+            energy,
         }
     }
 
+    /// Health of the backends this router picks from / 本路由器所选后端的健康状态
+    pub fn health(&self) -> &health::ProviderHealth {
+        &self.health
+    }
+
     fn managed_instances(&self) -> Arc<Vec<BackendInstance>> {
         let rev = self.managed_backends.revision();
         {
@@ -87,8 +110,9 @@ impl Router {
         }
 
         let mut out: Vec<BackendInstance> = Vec::new();
+        let activity = self.managed_backends.activity();
         for b in self.managed_backends.list().into_iter() {
-            if let Some(inst) = managed_backend_info_to_instance(b) {
+            if let Some(inst) = managed_backend_info_to_instance(b, activity) {
                 out.push(inst);
             }
         }
@@ -102,6 +126,16 @@ impl Router {
     pub fn route<'a>(
         &'a self,
         req: &CanonicalRequestEnvelope,
+    ) -> Result<BackendInstance, CanonicalError> {
+        self.route_excluding(req, &[])
+    }
+
+    /// Route a request to a backend other than those in `exclude`, skipping open circuits
+    /// 将请求路由到 `exclude` 以外的后端，跳过熔断已打开的后端
+    pub fn route_excluding(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        exclude: &[String],
     ) -> Result<BackendInstance, CanonicalError> {
         let managed = self.managed_instances();
         let mut instances: Vec<&BackendInstance> = Vec::new();
@@ -238,6 +272,11 @@ impl Router {
             }
         }
 
+        // Offload to the cloud when the energy level calls for it / 能耗级别需要时卸载到云端
+        if self.energy.prefer_remote() && candidates.iter().any(|c| c.hosting == Hosting::Remote) {
+            candidates.retain(|c| c.hosting == Hosting::Remote);
+        }
+
         if candidates.is_empty() {
             let mut supporting: Vec<String> = Vec::new();
             for inst in instances.iter().copied() {
@@ -282,6 +321,21 @@ impl Router {
             });
         }
 
+        let health = &self.health;
+        let matching = candidates.len();
+        candidates.retain(|c| !exclude.contains(&c.name) && health.admits(&c.name));
+        if candidates.is_empty() {
+            return Err(CanonicalError {
+                code: "backend_unavailable".to_string(),
+                message: format!(
+                    "all {} candidate backends failed or have an open circuit",
+                    matching
+                ),
+                retryable: true,
+                operation: Some(req.operation.clone()),
+            });
+        }
+
         let candidate_count = candidates.len();
         let candidate_names: Vec<&str> =
             candidates.iter().take(8).map(|c| c.name.as_str()).collect();
@@ -351,11 +405,15 @@ fn parse_operation(s: &str) -> Option<Operation> {
         "speech_to_text" => Some(Operation::SpeechToText),
         "text_to_speech" => Some(Operation::TextToSpeech),
         "realtime_voice" => Some(Operation::RealtimeVoice),
+        "moderations" => Some(Operation::Moderations),
         _ => None,
     }
 }
 
-fn managed_backend_info_to_instance(b: crate::proto::sms::BackendInfo) -> Option<BackendInstance> {
+fn managed_backend_info_to_instance(
+    b: crate::proto::sms::BackendInfo,
+    activity: &Arc<BackendActivity>,
+) -> Option<BackendInstance> {
     if b.name.trim().is_empty() {
         return None;
     }
@@ -382,7 +440,7 @@ fn managed_backend_info_to_instance(b: crate::proto::sms::BackendInfo) -> Option
             if !b.model.trim().is_empty() {
                 a = a.with_fixed_model(b.model.clone());
             }
-            Arc::new(a)
+            Arc::new(TrackedAdapter::new(Arc::new(a), activity.clone()))
         }
         _ => return None,
     };
@@ -514,6 +572,47 @@ mod tests {
         assert_eq!(err.code, "no_candidate_backend");
     }
 
+    #[test]
+    fn test_route_skips_excluded_and_open_backends() {
+        let backend = |name: &str| BackendInstance {
+            name: name.to_string(),
+            kind: "stub".to_string(),
+            base_url: String::new(),
+            hosting: Hosting::Local,
+            model: Some("failover-model".to_string()),
+            weight: 100,
+            priority: 0,
+            capabilities: Capabilities {
+                ops: vec![Operation::ChatCompletions],
+                features: vec![],
+                transports: vec!["http".to_string()],
+            },
+            adapter: Arc::new(StubBackendAdapter::new(name)),
+        };
+        let router = Router::new(
+            BackendRegistry::new(vec![backend("failover-a"), backend("failover-b")]),
+            SelectionPolicy::WeightedRandom,
+        );
+        let req = chat_req("failover-model");
+        let inst = router
+            .route_excluding(&req, &["failover-a".to_string()])
+            .unwrap();
+        assert_eq!(inst.name, "failover-b");
+
+        let threshold = router.health().config().failure_threshold;
+        for _ in 0..threshold {
+            router
+                .health()
+                .record_failure("failover-b", "upstream status: 503");
+        }
+        let err = match router.route_excluding(&req, &["failover-a".to_string()]) {
+            Ok(_) => panic!("expected error"),
+            Err(e) => e,
+        };
+        assert_eq!(err.code, "backend_unavailable");
+        assert_eq!(router.route(&req).unwrap().name, "failover-a");
+    }
+
     #[test]
     fn test_route_fail_open_when_filter_unavailable() {
         let a = BackendInstance {
@@ -542,6 +641,9 @@ mod tests {
             BackendRegistry::new(vec![a]),
             SelectionPolicy::WeightedRandom,
             Some(hub),
+            ManagedBackendRegistry::new(),
+            Arc::default(),
+            Arc::default(),
         );
         let req = chat_req("gpt-4o-mini");
         let inst = router.route(&req).unwrap();
@@ -576,6 +678,9 @@ mod tests {
             BackendRegistry::new(vec![a]),
             SelectionPolicy::WeightedRandom,
             Some(hub),
+            ManagedBackendRegistry::new(),
+            Arc::default(),
+            Arc::default(),
         );
         let req = chat_req("gpt-4o-mini");
         let err = match router.route(&req) {
@@ -17,6 +17,22 @@ pub enum StreamingPrepareStep {
     HttpJson(HttpJsonPlan),
 }
 
+/// Wire protocol of a streaming speech-to-text session / 流式语音转文字会话的线路协议
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AsrProtocol {
+    /// OpenAI realtime events / OpenAI realtime 事件
+    #[default]
+    OpenaiRealtime,
+    /// Deepgram live transcription / Deepgram 实时转写
+    Deepgram,
+    /// Azure Speech websocket protocol / Azure Speech websocket 协议
+    AzureSpeech,
+    /// Google Speech-to-Text `speech:recognize`, one request per committed segment
+    /// Google Speech-to-Text `speech:recognize`，每个已提交片段一次请求
+    GoogleSpeech,
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct WebsocketPlan {
     pub url: String,
@@ -26,6 +42,8 @@ pub struct WebsocketPlan {
     pub client_events: Vec<serde_json::Value>,
     #[serde(default)]
     pub supports_turn_detection: bool,
+    #[serde(default)]
+    pub protocol: AsrProtocol,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
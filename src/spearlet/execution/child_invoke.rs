@@ -0,0 +1,376 @@
+//! Child workload invocation / 子工作负载调用
+//!
+//! Lets a running execution invoke another task on the same spearlet and read back its
+//! result, and with `stream` the frames the child writes to its user stream, so agents can
+//! chain workloads such as ASR → LLM → TTS. Each call gets a handle owned by the calling
+//! execution; handles still open when it finishes are cancelled. Nesting is bounded by
+//! `max_depth` and fan-out by `max_children`.
+//! 允许运行中的执行调用同一 spearlet 上的另一个任务并读取其结果；开启 `stream` 时还可读取子执行写入
+//! user stream 的帧，从而让智能体串联 ASR → LLM → TTS 等工作负载。每次调用得到一个归调用方执行所有的
+//! 句柄；调用方结束时仍未关闭的句柄会被取消。嵌套深度受 `max_depth` 限制，并发子调用数受
+//! `max_children` 限制。
+
+use std::collections::HashMap;
+use std::future::Future;
+use std::sync::atomic::{AtomicU32, Ordering};
+use std::sync::{Arc, Weak};
+use std::time::Duration;
+
+use base64::{engine::general_purpose, Engine as _};
+use dashmap::DashMap;
+use parking_lot::{Mutex, RwLock};
+use serde::Deserialize;
+use serde_json::{json, Value};
+use tokio_util::sync::CancellationToken;
+
+use super::invoke::{ExecutionState, InvokeContext, InvokeOptions, TaskRef};
+use super::manager::TaskExecutionManager;
+use crate::spearlet::config::ChildInvokeConfig;
+use crate::spearlet::exec_stream;
+
+/// Invocation metadata key carrying the nesting depth / 携带嵌套深度的调用元数据键
+pub const DEPTH_METADATA_KEY: &str = "spear.call_depth";
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum ChildError {
+    #[error("child invocation is disabled")]
+    Disabled,
+    #[error("invalid request: {0}")]
+    Invalid(String),
+    #[error("no such child handle: {0}")]
+    NotFound(u32),
+    #[error("nesting deeper than max_depth {0}")]
+    TooDeep(u32),
+    #[error("max_children {0} children are running")]
+    TooMany(usize),
+    #[error("no event yet")]
+    Empty,
+}
+
+/// What a workload asks to run, as JSON / 工作负载请求运行的内容（JSON）
+#[derive(Debug, Clone, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct ChildRequest {
+    /// Task id or name / 任务 ID 或名称
+    pub task: String,
+    /// Entry function; the default entry when empty / 入口函数；为空时使用默认入口
+    pub method: String,
+    pub content_type: String,
+    /// UTF-8 input / UTF-8 输入
+    pub input: Option<String>,
+    pub input_base64: Option<String>,
+    /// Also deliver the child's user stream frames / 同时传递子执行的 user stream 帧
+    pub stream: bool,
+    /// User stream bridged to the caller, 1 by default / 桥接给调用方的 user stream，默认 1
+    pub stream_id: Option<u32>,
+    /// 0 waits as long as the caller runs / 0 表示在调用方运行期间一直等待
+    pub timeout_ms: u64,
+    pub metadata: HashMap<String, String>,
+}
+
+struct Child {
+    parent: String,
+    execution_id: String,
+    stream: bool,
+    cancel: CancellationToken,
+    /// `done` event, set when the child finished / `done` 事件，子执行结束时设置
+    outcome: Arc<Mutex<Option<Vec<u8>>>>,
+    /// Next event, kept while it does not fit the caller's buffer
+    /// 下一个事件；调用方缓冲区放不下时保留
+    pending: Option<(Vec<u8>, bool)>,
+}
+
+/// Child invocations of one spearlet, routed to its manager
+/// 单个 spearlet 的子调用，路由到其管理器
+#[derive(Default)]
+pub struct ChildInvocations {
+    manager: RwLock<Weak<TaskExecutionManager>>,
+    children: DashMap<u32, Child>,
+    depths: DashMap<String, u32>,
+    next_handle: AtomicU32,
+}
+
+impl ChildInvocations {
+    /// Route child invocations to this manager / 将子调用路由到该管理器
+    pub fn set_manager(&self, manager: &Arc<TaskExecutionManager>) {
+        *self.manager.write() = Arc::downgrade(manager);
+    }
+
+    /// Nesting depth of an execution, 0 for one started by a client
+    /// 执行的嵌套深度，由客户端发起的执行为 0
+    pub fn depth(&self, execution_id: &str) -> u32 {
+        self.depths.get(execution_id).map(|d| *d).unwrap_or(0)
+    }
+
+    /// Start a child of `parent`; returns its handle and the future running it, which the
+    /// caller spawns
+    /// 为 `parent` 启动子调用；返回其句柄以及运行它的 future，由调用方负责派生
+    pub fn start(
+        self: &Arc<Self>,
+        parent: &str,
+        cfg: &ChildInvokeConfig,
+        req: ChildRequest,
+    ) -> Result<(u32, impl Future<Output = ()> + Send + 'static), ChildError> {
+        if !cfg.enabled {
+            return Err(ChildError::Disabled);
+        }
+        if req.task.is_empty() {
+            return Err(ChildError::Invalid("task is required".to_string()));
+        }
+        let depth = self.depth(parent) + 1;
+        if depth > cfg.max_depth {
+            return Err(ChildError::TooDeep(cfg.max_depth));
+        }
+        let running = self.children.iter().filter(|c| c.parent == parent).count();
+        if running >= cfg.max_children {
+            return Err(ChildError::TooMany(cfg.max_children));
+        }
+        let manager = self.manager.read().upgrade().ok_or(ChildError::Disabled)?;
+        let input = match (req.input, req.input_base64) {
+            (Some(_), Some(_)) => {
+                return Err(ChildError::Invalid(
+                    "set one of input and input_base64".to_string(),
+                ))
+            }
+            (Some(s), None) => s.into_bytes(),
+            (None, Some(b)) => general_purpose::STANDARD
+                .decode(b)
+                .map_err(|_| ChildError::Invalid("input_base64 is not base64".to_string()))?,
+            (None, None) => Vec::new(),
+        };
+        // Loaded tasks match by name too; others are fetched from SMS by id
+        // 已加载的任务也可按名称匹配；其余任务按 ID 从 SMS 获取
+        let task_id = manager
+            .find_task(&req.task)
+            .map(|t| t.id.clone())
+            .unwrap_or(req.task);
+
+        let execution_id = format!("exec-{}", uuid::Uuid::new_v4());
+        let handle = self.next_handle.fetch_add(1, Ordering::Relaxed) + 1;
+        let cancel = CancellationToken::new();
+        let outcome = Arc::new(Mutex::new(None));
+        if req.stream {
+            exec_stream::attach(&execution_id, req.stream_id.unwrap_or(1));
+        }
+        self.depths.insert(execution_id.clone(), depth);
+        self.children.insert(
+            handle,
+            Child {
+                parent: parent.to_string(),
+                execution_id: execution_id.clone(),
+                stream: req.stream,
+                cancel: cancel.clone(),
+                outcome: outcome.clone(),
+                pending: None,
+            },
+        );
+
+        let mut metadata = req.metadata;
+        metadata.insert(DEPTH_METADATA_KEY.to_string(), depth.to_string());
+        let options = InvokeOptions {
+            function_name: (!req.method.is_empty()).then_some(req.method),
+            content_type: (!req.content_type.is_empty()).then_some(req.content_type),
+            execution_id: Some(execution_id.clone()),
+            metadata,
+            ..Default::default()
+        };
+        let mut ctx = InvokeContext::new().with_cancel(cancel);
+        if req.timeout_ms > 0 {
+            ctx = ctx.with_timeout(Duration::from_millis(req.timeout_ms));
+        }
+        let this = self.clone();
+        let run = async move {
+            let done = match manager
+                .invoke(&ctx, TaskRef::Id(task_id), input, options)
+                .await
+            {
+                Ok(inv) => json!({
+                    "event": "done",
+                    "execution_id": inv.handle.execution_id,
+                    "status": state_str(inv.state),
+                    "output": std::str::from_utf8(&inv.output).ok(),
+                    "output_base64": general_purpose::STANDARD.encode(&inv.output),
+                    "error": inv.error,
+                }),
+                Err(e) => json!({
+                    "event": "done",
+                    "execution_id": execution_id,
+                    "status": match &e {
+                        super::ExecutionError::ExecutionTimeout { .. } => "timeout",
+                        super::ExecutionError::ExecutionTerminated { .. } => "terminated",
+                        _ => "failed",
+                    },
+                    "output": Value::Null,
+                    "output_base64": "",
+                    "error": e.to_string(),
+                }),
+            };
+            this.depths.remove(&execution_id);
+            *outcome.lock() = serde_json::to_vec(&done).ok();
+        };
+        Ok((handle, run))
+    }
+
+    /// Next event of a child as JSON without waiting: a `frame` while the child streams,
+    /// then one `done`, after which the handle is closed. An event longer than `max_len`
+    /// stays queued and is returned so the caller can size its buffer.
+    /// 不等待地以 JSON 返回子调用的下一个事件：子执行流式输出时为 `frame`，之后为一个 `done`，随后句柄
+    /// 关闭。长度超过 `max_len` 的事件仍留在队列中并被返回，以便调用方调整缓冲区大小。
+    pub fn next(&self, parent: &str, handle: u32, max_len: usize) -> Result<Vec<u8>, ChildError> {
+        let mut child = self
+            .children
+            .get_mut(&handle)
+            .filter(|c| c.parent == parent)
+            .ok_or(ChildError::NotFound(handle))?;
+        if child.pending.is_none() {
+            let manager = self.manager.read().upgrade();
+            let frame = child
+                .stream
+                .then(|| {
+                    manager?
+                        .node()
+                        .user_streams
+                        .ws_pop_any_outbound(&child.execution_id)
+                })
+                .flatten();
+            let next = match frame {
+                Some(frame) => {
+                    let mut v = exec_stream::frame_json(&frame);
+                    v["event"] = json!("frame");
+                    serde_json::to_vec(&v).ok().map(|b| (b, false))
+                }
+                None => child.outcome.lock().take().map(|b| (b, true)),
+            };
+            child.pending = next;
+        }
+        let Some((event, last)) = child.pending.as_ref() else {
+            return Err(ChildError::Empty);
+        };
+        if event.len() > max_len {
+            return Ok(event.clone());
+        }
+        let last = *last;
+        let (event, _) = child.pending.take().unwrap_or_default();
+        if last {
+            let stream = child.stream.then(|| child.execution_id.clone());
+            drop(child);
+            self.children.remove(&handle);
+            if let Some(execution_id) = stream {
+                exec_stream::detach(&execution_id);
+            }
+        }
+        Ok(event)
+    }
+
+    /// Cancel a child and close its handle / 取消子调用并关闭其句柄
+    pub fn cancel(&self, parent: &str, handle: u32) -> Result<(), ChildError> {
+        let (_, child) = self
+            .children
+            .remove_if(&handle, |_, c| c.parent == parent)
+            .ok_or(ChildError::NotFound(handle))?;
+        close(child);
+        Ok(())
+    }
+
+    /// Cancel the children a finished execution left open / 取消已结束执行遗留的子调用
+    pub fn finish_parent(&self, parent: &str) {
+        let handles: Vec<u32> = self
+            .children
+            .iter()
+            .filter(|c| c.parent == parent)
+            .map(|c| *c.key())
+            .collect();
+        for handle in handles {
+            if let Some((_, child)) = self.children.remove(&handle) {
+                close(child);
+            }
+        }
+    }
+}
+
+fn state_str(state: ExecutionState) -> &'static str {
+    match state {
+        ExecutionState::Pending => "pending",
+        ExecutionState::Running => "running",
+        ExecutionState::Completed => "completed",
+        ExecutionState::Failed => "failed",
+        ExecutionState::Timeout => "timeout",
+        ExecutionState::Terminated => "terminated",
+    }
+}
+
+fn close(child: Child) {
+    child.cancel.cancel();
+    if child.stream {
+        exec_stream::detach(&child.execution_id);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_request_parsing() {
+        let req: ChildRequest =
+            serde_json::from_str(r#"{"task":"tts","method":"speak","input":"hi","stream":true}"#)
+                .unwrap();
+        assert_eq!(req.task, "tts");
+        assert_eq!(req.method, "speak");
+        assert!(req.stream);
+        assert_eq!(req.timeout_ms, 0);
+        assert!(serde_json::from_str::<ChildRequest>(r#"{"task":"x","bogus":1}"#).is_err());
+    }
+
+    #[test]
+    fn test_start_checks_policy() {
+        let children = Arc::new(ChildInvocations::default());
+        let cfg = ChildInvokeConfig::default();
+        let disabled = ChildInvokeConfig {
+            enabled: false,
+            ..cfg.clone()
+        };
+        let req = || ChildRequest {
+            task: "asr".to_string(),
+            ..Default::default()
+        };
+        assert_eq!(
+            children.start("exec-child-parent", &disabled, req()).err(),
+            Some(ChildError::Disabled)
+        );
+
+        assert!(matches!(
+            children
+                .start("exec-child-parent", &cfg, ChildRequest::default())
+                .err(),
+            Some(ChildError::Invalid(_))
+        ));
+
+        children
+            .depths
+            .insert("exec-child-deep".to_string(), cfg.max_depth);
+        assert_eq!(
+            children.start("exec-child-deep", &cfg, req()).err(),
+            Some(ChildError::TooDeep(cfg.max_depth))
+        );
+
+        // No manager to run the child on / 没有可运行子调用的管理器
+        assert_eq!(
+            children.start("exec-child-parent", &cfg, req()).err(),
+            Some(ChildError::Disabled)
+        );
+    }
+
+    #[test]
+    fn test_unknown_handle() {
+        let children = ChildInvocations::default();
+        assert_eq!(
+            children.next("exec-child-none", u32::MAX, 1024),
+            Err(ChildError::NotFound(u32::MAX))
+        );
+        assert_eq!(
+            children.cancel("exec-child-none", u32::MAX),
+            Err(ChildError::NotFound(u32::MAX))
+        );
+    }
+}
@@ -1,14 +1,15 @@
 // 连接管理器 / Connection Manager
 // 负责管理 spearlet 与 agent 之间的连接 / Manages connections between spearlet and agent
 
+use crate::spearlet::execution::communication::framing::{FrameReader, WireFormat};
 use crate::spearlet::execution::communication::protocol::*;
 use crate::spearlet::execution::manager::TaskExecutionManager;
 use serde::{Deserialize, Serialize};
 use std::collections::HashMap;
 use std::net::SocketAddr;
-use std::sync::{Arc, Mutex, RwLock};
+use std::sync::{Arc, Mutex, OnceLock, RwLock};
 use std::time::{Duration, Instant};
-use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::io::AsyncWriteExt;
 use tokio::net::{TcpListener as TokioTcpListener, TcpStream as TokioTcpStream};
 use tokio::sync::{mpsc, oneshot, Mutex as TokioMutex};
 use tokio::time::interval;
@@ -235,6 +236,8 @@ struct ConnectionHandler {
     message_receiver: Arc<TokioMutex<mpsc::UnboundedReceiver<SpearMessage>>>,
     /// 关闭信号接收器 / Shutdown signal receiver
     shutdown_receiver: Option<oneshot::Receiver<()>>,
+    /// guest 首个字节决定的线路格式 / Wire format set by the guest's first byte
+    wire_format: Arc<OnceLock<WireFormat>>,
     /// 配置 / Configuration
     config: ConnectionManagerConfig,
 }
@@ -273,6 +276,7 @@ impl ConnectionHandler {
             message_sender: message_sender.clone(),
             message_receiver: Arc::new(TokioMutex::new(message_receiver)),
             shutdown_receiver: Some(shutdown_receiver),
+            wire_format: Arc::new(OnceLock::new()),
             config,
         };
 
@@ -335,51 +339,42 @@ impl ConnectionHandler {
         let state = Arc::clone(&self.state);
         let event_sender = self.event_sender.clone();
         let connection_id = self.connection_id.clone();
+        let wire_format = Arc::clone(&self.wire_format);
         let max_message_size = self.config.max_message_size;
 
-        tokio::spawn(async move {
-            let mut buffer = vec![0u8; max_message_size];
+        crate::spearlet::crash::spawn("comm-worker", async move {
+            let mut reader = FrameReader::new(max_message_size);
 
             loop {
                 let mut stream_guard = stream.lock().await;
 
-                // 读取消息长度 / Read message length
-                let mut length_bytes = [0u8; 4];
-                match stream_guard.read_exact(&mut length_bytes).await {
-                    Ok(_) => {}
+                // 读取一帧，首字节决定线路格式 / Read a frame; the first byte settles the wire format
+                let frame = match reader.read_frame(&mut *stream_guard).await {
+                    Ok(frame) => frame,
                     Err(e) => {
-                        error!("Failed to read message length for {}: {}", connection_id, e);
+                        error!("Failed to read message for {}: {}", connection_id, e);
                         break;
                     }
-                }
+                };
 
-                let message_length = u32::from_be_bytes(length_bytes) as usize;
-                if message_length > max_message_size {
-                    error!(
-                        "Message too large for {}: {} bytes",
-                        connection_id, message_length
-                    );
-                    break;
-                }
+                drop(stream_guard);
 
-                // 读取消息内容 / Read message content
-                buffer.resize(message_length, 0);
-                match stream_guard.read_exact(&mut buffer).await {
-                    Ok(_) => {}
-                    Err(e) => {
-                        error!(
-                            "Failed to read message content for {}: {}",
-                            connection_id, e
-                        );
-                        break;
-                    }
+                let Some(format) = reader.format() else {
+                    break;
+                };
+                if wire_format.set(format).is_ok() && format == WireFormat::JsonLines {
+                    info!("Connection {} uses JSON lines", connection_id);
                 }
 
-                drop(stream_guard);
-
                 // 解析消息 / Parse message
-                match SpearMessage::deserialize(&buffer) {
+                match format.decode(&frame) {
                     Ok(message) => {
+                        // 畸形消息关闭连接 / Malformed messages close the connection
+                        if let Err(e) = message.validate(max_message_size) {
+                            error!("Rejected malformed message for {}: {}", connection_id, e);
+                            break;
+                        }
+
                         // 更新最后活跃时间 / Update last activity time
                         {
                             let mut state_guard = state.write().unwrap();
@@ -407,15 +402,20 @@ impl ConnectionHandler {
         let message_receiver = Arc::clone(&self.message_receiver);
         let event_sender = self.event_sender.clone();
         let connection_id = self.connection_id.clone();
+        let wire_format = Arc::clone(&self.wire_format);
 
-        tokio::spawn(async move {
+        crate::spearlet::crash::spawn("comm-worker", async move {
             let mut receiver = message_receiver.lock().await;
             while let Some(message) = receiver.recv().await {
                 drop(receiver);
                 let mut stream_guard = stream.lock().await;
 
-                // 序列化消息 / Serialize message
-                let serialized = match message.serialize() {
+                // 以 guest 选择的格式序列化消息 / Serialize message in the format the guest chose
+                let format = wire_format
+                    .get()
+                    .copied()
+                    .unwrap_or(WireFormat::LengthPrefixed);
+                let frame = match format.encode(&message) {
                     Ok(data) => data,
                     Err(e) => {
                         error!("Failed to serialize message for {}: {}", connection_id, e);
@@ -424,22 +424,9 @@ impl ConnectionHandler {
                     }
                 };
 
-                // 写入消息长度 / Write message length
-                let length_bytes = (serialized.len() as u32).to_be_bytes();
-                if let Err(e) = stream_guard.write_all(&length_bytes).await {
-                    error!(
-                        "Failed to write message length for {}: {}",
-                        connection_id, e
-                    );
-                    break;
-                }
-
-                // 写入消息内容 / Write message content
-                if let Err(e) = stream_guard.write_all(&serialized).await {
-                    error!(
-                        "Failed to write message content for {}: {}",
-                        connection_id, e
-                    );
+                // 写入消息 / Write message
+                if let Err(e) = stream_guard.write_all(&frame).await {
+                    error!("Failed to write message for {}: {}", connection_id, e);
                     break;
                 }
 
@@ -469,7 +456,7 @@ impl ConnectionHandler {
         let connection_id = self.connection_id.clone();
         let heartbeat_timeout = self.config.heartbeat_timeout;
 
-        tokio::spawn(async move {
+        crate::spearlet::crash::spawn("comm-worker", async move {
             let mut interval = interval(heartbeat_timeout);
 
             loop {
@@ -617,7 +604,7 @@ impl ConnectionManager {
         let secret_validator = self.secret_validator.clone();
         let execution_manager = self.execution_manager.clone();
 
-        tokio::spawn(async move {
+        crate::spearlet::crash::spawn("comm-worker", async move {
             let mut receiver = event_receiver.lock().await;
 
             while let Some(event) = receiver.recv().await {
@@ -758,7 +745,7 @@ impl ConnectionManager {
         let shutdown_senders = Arc::clone(&self.shutdown_senders);
         let config = self.config.clone();
 
-        tokio::spawn(async move {
+        crate::spearlet::crash::spawn("comm-worker", async move {
             loop {
                 match listener.accept().await {
                     Ok((stream, remote_addr)) => {
@@ -800,7 +787,7 @@ impl ConnectionManager {
                         }
 
                         // 启动连接处理器 / Start connection handler
-                        tokio::spawn(handler.run());
+                        crate::spearlet::crash::spawn("comm-worker", handler.run());
 
                         info!(
                             "Accepted new connection: {} from {}",
@@ -958,7 +945,11 @@ impl ConnectionManager {
                 error_message: None,
                 session_id: Some(format!("session_{}", connection_id)),
                 server_version: "1.0.0".to_string(),
-                supported_features: vec!["execute".to_string(), "signal".to_string()],
+                supported_features: vec![
+                    "execute".to_string(),
+                    "signal".to_string(),
+                    "json_lines".to_string(),
+                ],
             };
 
             // TODO: 发送响应消息 / Send response message
@@ -995,7 +986,6 @@ impl ConnectionManager {
 #[cfg(test)]
 mod tests {
     use super::*;
-    
 
     #[tokio::test]
     async fn test_connection_manager_creation() {
@@ -0,0 +1,270 @@
+//! Wire formats of the agent connection / agent 连接的线路格式
+//!
+//! Agents normally send each `SpearMessage` as a 4-byte big-endian length followed by the
+//! serialized message. Guests that cannot build binary frames easily, such as shell scripts
+//! or MicroPython, can instead send one JSON object per line (see `JsonLineMessage`). The
+//! format is chosen by the first byte the guest sends: `{` selects JSON lines, anything else
+//! the length prefix. A length prefix never starts with `{`, since that would announce a
+//! frame of almost 2 GiB. The spearlet answers in the format the guest chose.
+//! agent 通常将每个 `SpearMessage` 以 4 字节大端长度加序列化消息的形式发送。难以构造二进制帧的
+//! guest（如 shell 脚本或 MicroPython）可改为每行发送一个 JSON 对象（见 `JsonLineMessage`）。格式由
+//! guest 发送的第一个字节决定：`{` 选择 JSON 行，其他字节选择长度前缀。长度前缀不会以 `{` 开头，
+//! 因为那表示近 2 GiB 的帧。spearlet 以 guest 选择的格式应答。
+
+use std::io;
+
+use serde::{Deserialize, Serialize};
+use tokio::io::{AsyncRead, AsyncReadExt};
+
+use super::protocol::SpearMessage;
+
+/// Bytes read at a time; a frame's buffer grows with the bytes that arrive, not with the
+/// length the guest announces
+/// 每次读取的字节数；帧缓冲区随实际到达的字节增长，而非随 guest 声明的长度增长
+const READ_CHUNK: usize = 64 * 1024;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum WireFormat {
+    /// 4-byte big-endian length, then the message / 4 字节大端长度，随后是消息
+    LengthPrefixed,
+    /// One `JsonLineMessage` per `\n`-terminated line / 每个以 `\n` 结尾的行一个 `JsonLineMessage`
+    JsonLines,
+}
+
+impl WireFormat {
+    /// Format announced by the first byte of a connection / 连接第一个字节所表明的格式
+    pub fn detect(first: u8) -> Self {
+        if first == b'{' {
+            Self::JsonLines
+        } else {
+            Self::LengthPrefixed
+        }
+    }
+
+    /// Encode a message as one frame / 将消息编码为一帧
+    pub fn encode(self, message: &SpearMessage) -> Result<Vec<u8>, serde_json::Error> {
+        match self {
+            Self::LengthPrefixed => {
+                let body = message.serialize()?;
+                let mut out = (body.len() as u32).to_be_bytes().to_vec();
+                out.extend_from_slice(&body);
+                Ok(out)
+            }
+            Self::JsonLines => {
+                let mut out = message.to_json_line()?;
+                out.push(b'\n');
+                Ok(out)
+            }
+        }
+    }
+
+    /// Decode the body of one frame / 解码一帧的内容
+    pub fn decode(self, frame: &[u8]) -> Result<SpearMessage, serde_json::Error> {
+        match self {
+            Self::LengthPrefixed => SpearMessage::deserialize(frame),
+            Self::JsonLines => SpearMessage::from_json_line(frame),
+        }
+    }
+}
+
+/// Reads frames off a connection, settling its format on the first byte
+/// 从连接读取帧，并根据第一个字节确定格式
+pub struct FrameReader {
+    format: Option<WireFormat>,
+    /// Bytes read past the last JSON line / 读取到最后一个 JSON 行之后的字节
+    pending: Vec<u8>,
+    /// Leading bytes of `pending` known to hold no newline / `pending` 中已确认不含换行的前缀长度
+    scanned: usize,
+    max_message_size: usize,
+}
+
+impl FrameReader {
+    pub fn new(max_message_size: usize) -> Self {
+        Self {
+            format: None,
+            pending: Vec::new(),
+            scanned: 0,
+            max_message_size,
+        }
+    }
+
+    /// Format of the connection, once the guest has sent its first byte
+    /// 连接的格式（guest 发送第一个字节之后）
+    pub fn format(&self) -> Option<WireFormat> {
+        self.format
+    }
+
+    fn too_large(&self, len: usize) -> io::Error {
+        io::Error::new(
+            io::ErrorKind::InvalidData,
+            format!("message of {} bytes exceeds {}", len, self.max_message_size),
+        )
+    }
+
+    /// Read the body of the next frame / 读取下一帧的内容
+    pub async fn read_frame<R: AsyncRead + Unpin>(&mut self, r: &mut R) -> io::Result<Vec<u8>> {
+        let format = match self.format {
+            Some(f) => f,
+            None => {
+                let first = r.read_u8().await?;
+                let f = WireFormat::detect(first);
+                self.format = Some(f);
+                self.pending.push(first);
+                f
+            }
+        };
+        match format {
+            WireFormat::LengthPrefixed => {
+                let mut len = [0u8; 4];
+                let have = self.pending.len();
+                len[..have].copy_from_slice(&self.pending);
+                self.pending.clear();
+                r.read_exact(&mut len[have..]).await?;
+                let len = u32::from_be_bytes(len) as usize;
+                if len > self.max_message_size {
+                    return Err(self.too_large(len));
+                }
+                let mut body = Vec::with_capacity(len.min(READ_CHUNK));
+                (&mut *r).take(len as u64).read_to_end(&mut body).await?;
+                if body.len() < len {
+                    return Err(io::ErrorKind::UnexpectedEof.into());
+                }
+                Ok(body)
+            }
+            WireFormat::JsonLines => loop {
+                let newline = self.pending[self.scanned..]
+                    .iter()
+                    .position(|b| *b == b'\n')
+                    .map(|i| self.scanned + i);
+                if let Some(end) = newline {
+                    self.scanned = 0;
+                    let mut line: Vec<u8> = self.pending.drain(..=end).collect();
+                    line.pop();
+                    if line.last() == Some(&b'\r') {
+                        line.pop();
+                    }
+                    if line.len() > self.max_message_size {
+                        return Err(self.too_large(line.len()));
+                    }
+                    if line.iter().all(u8::is_ascii_whitespace) {
+                        continue;
+                    }
+                    return Ok(line);
+                }
+                self.scanned = self.pending.len();
+                if self.pending.len() > self.max_message_size {
+                    return Err(self.too_large(self.pending.len()));
+                }
+                let mut chunk = [0u8; 4096];
+                let n = r.read(&mut chunk).await?;
+                if n == 0 {
+                    return Err(io::ErrorKind::UnexpectedEof.into());
+                }
+                self.pending.extend_from_slice(&chunk[..n]);
+            },
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::communication::protocol::{AuthRequest, MessageType};
+    use std::collections::HashMap;
+
+    fn auth() -> SpearMessage {
+        SpearMessage::auth_request(
+            7,
+            AuthRequest {
+                instance_id: "inst-1".to_string(),
+                token: "secret-token".to_string(),
+                client_version: "1".to_string(),
+                client_type: "process".to_string(),
+                extra_params: HashMap::new(),
+            },
+        )
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_length_prefixed_frames() {
+        let mut wire = WireFormat::LengthPrefixed.encode(&auth()).unwrap();
+        wire.extend(WireFormat::LengthPrefixed.encode(&auth()).unwrap());
+        let mut reader = FrameReader::new(1024);
+        let mut r = wire.as_slice();
+        for _ in 0..2 {
+            let frame = reader.read_frame(&mut r).await.unwrap();
+            let msg = WireFormat::LengthPrefixed.decode(&frame).unwrap();
+            assert_eq!(msg.message_type, MessageType::AuthRequest);
+        }
+        assert_eq!(reader.format(), Some(WireFormat::LengthPrefixed));
+        assert!(reader.read_frame(&mut r).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_json_lines_from_a_shell_script() {
+        let wire = concat!(
+            "{\"type\":\"AuthRequest\",\"id\":1,\"payload\":{\"instance_id\":\"inst-1\",",
+            "\"token\":\"secret-token\",\"client_version\":\"sh\",\"client_type\":\"process\",",
+            "\"extra_params\":{}}}\r\n",
+            "\n",
+            "{\"type\":\"Heartbeat\",\"id\":2}\n",
+        );
+        let mut reader = FrameReader::new(1024);
+        let mut r = wire.as_bytes();
+        let frame = reader.read_frame(&mut r).await.unwrap();
+        assert_eq!(reader.format(), Some(WireFormat::JsonLines));
+        let msg = WireFormat::JsonLines.decode(&frame).unwrap();
+        let req: AuthRequest = msg.parse_payload().unwrap();
+        assert_eq!((msg.request_id, req.token.as_str()), (1, "secret-token"));
+
+        let frame = reader.read_frame(&mut r).await.unwrap();
+        let msg = WireFormat::JsonLines.decode(&frame).unwrap();
+        assert_eq!(msg.message_type, MessageType::Heartbeat);
+        assert!(msg.payload.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_json_line_round_trip_and_limit() {
+        let line = WireFormat::JsonLines.encode(&auth()).unwrap();
+        assert_eq!(line.iter().filter(|b| **b == b'\n').count(), 1);
+        let mut reader = FrameReader::new(1024);
+        let frame = reader.read_frame(&mut line.as_slice()).await.unwrap();
+        let msg = WireFormat::JsonLines.decode(&frame).unwrap();
+        assert_eq!(msg.request_id, 7);
+        let req: AuthRequest = msg.parse_payload().unwrap();
+        assert_eq!(req.instance_id, "inst-1");
+
+        let long = format!(
+            "{{\"type\":\"Heartbeat\",\"id\":1,\"pad\":\"{}\"}}\n",
+            "x".repeat(64)
+        );
+        let mut reader = FrameReader::new(16);
+        let err = reader.read_frame(&mut long.as_bytes()).await.unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+    }
+
+    #[tokio::test]
+    async fn test_truncated_and_split_frames() {
+        // A frame shorter than its announced length / 短于声明长度的帧
+        let mut wire = 1000u32.to_be_bytes().to_vec();
+        wire.extend_from_slice(b"short");
+        let mut reader = FrameReader::new(1 << 20);
+        let err = reader.read_frame(&mut wire.as_slice()).await.unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::UnexpectedEof);
+
+        // A line split across reads / 跨多次读取的行
+        let mut r = tokio_test::io::Builder::new()
+            .read(b"{\"type\":\"Heart")
+            .read(b"beat\",\"id\":3}")
+            .read(b"\n{\"type\":\"Heartbeat\",\"id\":4}\n")
+            .build();
+        let mut reader = FrameReader::new(1024);
+        for id in [3, 4] {
+            let frame = reader.read_frame(&mut r).await.unwrap();
+            let msg = WireFormat::JsonLines.decode(&frame).unwrap();
+            assert_eq!(msg.request_id, id);
+        }
+    }
+}
@@ -15,6 +15,7 @@ use std::time::{Duration, SystemTime};
 pub mod channel;
 pub mod connection_manager;
 pub mod factory;
+pub mod framing;
 pub mod monitoring;
 pub mod protocol;
 pub mod transport;
@@ -29,12 +30,14 @@ pub use connection_manager::{
     ConnectionEvent, ConnectionManager, ConnectionManagerConfig, ConnectionState,
 };
 pub use factory::{CommunicationFactory, CommunicationStrategy, CommunicationStrategyBuilder};
+pub use framing::{FrameReader, WireFormat};
 pub use monitoring::{
     ConnectionMetrics, MessageDirection, MessageMetrics, MonitoringConfig, MonitoringEvent,
     MonitoringService, PerformanceEvent, SystemMetrics,
 };
 pub use protocol::{
-    AuthRequest, AuthResponse, ExecuteRequest, ExecuteResponse, MessageType, SpearMessage,
+    AuthRequest, AuthResponse, ExecuteRequest, ExecuteResponse, JsonLineMessage, MessageType,
+    SpearMessage,
 };
 pub use transport::{Transport, TransportConfig, TransportFactory, TransportStats};
 
@@ -1,6 +1,7 @@
 // 统一的消息协议定义 / Unified message protocol definition
 // 定义了 spearlet 与 agent 之间的通信协议 / Defines communication protocol between spearlet and agent
 
+use base64::Engine;
 use serde::{Deserialize, Serialize};
 use std::collections::HashMap;
 use std::time::SystemTime;
@@ -45,6 +46,26 @@ pub enum MessageType {
     ConnectionClose,
 }
 
+/// 单行 JSON 形式的消息 / A message as one line of JSON
+/// 供无法构造二进制帧的简单 guest 使用，见 `framing` / For simple guests that cannot build binary frames, see `framing`
+///
+/// `type` takes the `MessageType` names (`AuthRequest`, `Signal`, ...) and `payload` the
+/// message's JSON payload as an object. Payloads that are not JSON travel in `payload_base64`.
+/// `type` 取 `MessageType` 的名称（`AuthRequest`、`Signal` 等），`payload` 为消息的 JSON 负载对象。
+/// 非 JSON 的负载通过 `payload_base64` 传输。
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct JsonLineMessage {
+    #[serde(rename = "type")]
+    pub message_type: MessageType,
+    /// 请求ID / Request ID
+    #[serde(default)]
+    pub id: u64,
+    #[serde(default, skip_serializing_if = "serde_json::Value::is_null")]
+    pub payload: serde_json::Value,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payload_base64: Option<String>,
+}
+
 /// 认证请求负载 / Authentication request payload
 /// Agent 连接到 Spearlet 时发送的认证信息 / Authentication info sent when agent connects to spearlet
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -330,6 +351,94 @@ impl SpearMessage {
     pub fn deserialize(data: &[u8]) -> Result<Self, serde_json::Error> {
         serde_json::from_slice(data)
     }
+
+    /// 序列化为单行 JSON / Serialize as one line of JSON
+    pub fn to_json_line(&self) -> Result<Vec<u8>, serde_json::Error> {
+        let (payload, payload_base64) = if self.payload.is_empty() {
+            (serde_json::Value::Null, None)
+        } else {
+            match serde_json::from_slice(&self.payload) {
+                Ok(v) if json_depth(&v) <= constants::MAX_JSON_LINE_PAYLOAD_DEPTH => (v, None),
+                _ => (
+                    serde_json::Value::Null,
+                    Some(base64::engine::general_purpose::STANDARD.encode(&self.payload)),
+                ),
+            }
+        };
+        serde_json::to_vec(&JsonLineMessage {
+            message_type: self.message_type.clone(),
+            id: self.request_id,
+            payload,
+            payload_base64,
+        })
+    }
+
+    /// 从单行 JSON 解析 / Parse from one line of JSON
+    pub fn from_json_line(line: &[u8]) -> Result<Self, serde_json::Error> {
+        let msg: JsonLineMessage = serde_json::from_slice(line)?;
+        let payload = match (msg.payload_base64, msg.payload) {
+            (Some(b64), _) => base64::engine::general_purpose::STANDARD
+                .decode(b64.trim())
+                .map_err(serde::de::Error::custom)?,
+            (None, serde_json::Value::Null) => Vec::new(),
+            (None, v) => serde_json::to_vec(&v)?,
+        };
+        Ok(Self::new(msg.message_type, msg.id, payload))
+    }
+
+    /// 检查消息结构 / Check the structure of a message
+    ///
+    /// A message that decodes can still be malformed: a version this spearlet does not speak,
+    /// a payload above `max_message_size`, or a `StreamData` payload that is not a valid
+    /// `StreamDataMessage`. Guests send such messages by mistake or on purpose; they are
+    /// rejected here, before any handler sees them.
+    /// 能够解码的消息仍可能是畸形的：本 spearlet 不支持的版本、超过 `max_message_size` 的负载，或不是
+    /// 有效 `StreamDataMessage` 的 `StreamData` 负载。guest 可能无意或有意发送此类消息；它们在任何处理器
+    /// 看到之前即在此被拒绝。
+    pub fn validate(&self, max_message_size: usize) -> Result<(), String> {
+        if self.version == 0 || self.version > constants::PROTOCOL_VERSION {
+            return Err(format!("unsupported protocol version {}", self.version));
+        }
+        if self.payload.len() > max_message_size {
+            return Err(format!(
+                "payload of {} bytes exceeds {}",
+                self.payload.len(),
+                max_message_size
+            ));
+        }
+        if self.message_type == MessageType::StreamData {
+            let data: StreamDataMessage = self
+                .parse_payload()
+                .map_err(|e| format!("invalid stream data: {}", e))?;
+            data.validate()?;
+        }
+        Ok(())
+    }
+}
+
+impl StreamDataMessage {
+    /// 检查流数据 / Check the stream data
+    pub fn validate(&self) -> Result<(), String> {
+        if self.stream_id.is_empty() || self.stream_id.len() > constants::MAX_STREAM_ID_LEN {
+            return Err(format!(
+                "stream_id must be 1 to {} bytes",
+                constants::MAX_STREAM_ID_LEN
+            ));
+        }
+        if self.stream_id.chars().any(char::is_control) {
+            return Err("stream_id contains control characters".to_string());
+        }
+        Ok(())
+    }
+}
+
+/// JSON 值的嵌套深度 / Nesting depth of a JSON value
+fn json_depth(v: &serde_json::Value) -> usize {
+    match v {
+        serde_json::Value::Array(a) => 1 + a.iter().map(json_depth).max().unwrap_or(0),
+        serde_json::Value::Object(o) => 1 + o.values().map(json_depth).max().unwrap_or(0),
+        _ => 0,
+    }
 }
 
 /// 协议常量 / Protocol constants
@@ -340,6 +449,14 @@ pub mod constants {
     /// 最大消息大小（字节）/ Maximum message size in bytes
     pub const MAX_MESSAGE_SIZE: usize = 64 * 1024 * 1024; // 64MB
 
+    /// 以 JSON 嵌入单行消息的负载的最大嵌套深度 / Deepest payload embedded as JSON in a line
+    /// 更深的负载以 base64 传输，使整行不超出解析器的递归上限 / Deeper ones travel as base64,
+    /// keeping the line within the parser's recursion limit
+    pub const MAX_JSON_LINE_PAYLOAD_DEPTH: usize = 64;
+
+    /// 流ID最大长度（字节）/ Maximum stream ID length in bytes
+    pub const MAX_STREAM_ID_LEN: usize = 256;
+
     /// 心跳间隔（秒）/ Heartbeat interval in seconds
     pub const HEARTBEAT_INTERVAL_SECS: u64 = 30;
 
@@ -384,6 +501,57 @@ mod tests {
         assert_eq!(auth_req.token, parsed_auth_req.token);
     }
 
+    #[test]
+    fn test_json_line_binary_payload() {
+        // 非 JSON 负载以 base64 传输 / Non-JSON payloads travel as base64
+        let message = SpearMessage::new(MessageType::StreamData, 9, vec![0xff, 0x00, 0x7b]);
+        let line = message.to_json_line().unwrap();
+        let v: serde_json::Value = serde_json::from_slice(&line).unwrap();
+        assert_eq!(v["type"], "StreamData");
+        assert_eq!(v["payload_base64"], "/wB7");
+
+        let parsed = SpearMessage::from_json_line(&line).unwrap();
+        assert_eq!(parsed.request_id, 9);
+        assert_eq!(parsed.payload, message.payload);
+        assert!(SpearMessage::from_json_line(br#"{"type":"Nope"}"#).is_err());
+
+        // Payloads nested too deeply to parse inside a line / 嵌套过深、无法在行内解析的负载
+        let deep = format!("{}{}", "[".repeat(127), "]".repeat(127));
+        let message = SpearMessage::new(MessageType::Signal, 10, deep.clone().into_bytes());
+        let line = message.to_json_line().unwrap();
+        let parsed = SpearMessage::from_json_line(&line).unwrap();
+        assert_eq!(parsed.payload, deep.into_bytes());
+    }
+
+    #[test]
+    fn test_validate_rejects_malformed_messages() {
+        let stream = |id: &str| StreamDataMessage {
+            stream_id: id.to_string(),
+            data: vec![1, 2, 3],
+            is_last: false,
+            sequence: 0,
+        };
+        let message = |data: &StreamDataMessage| {
+            SpearMessage::new(
+                MessageType::StreamData,
+                1,
+                serde_json::to_vec(data).unwrap(),
+            )
+        };
+        assert!(message(&stream("s-1")).validate(1024).is_ok());
+        assert!(message(&stream("")).validate(1024).is_err());
+        assert!(message(&stream("a\nb")).validate(1024).is_err());
+        assert!(message(&stream(&"x".repeat(300))).validate(1024).is_err());
+        assert!(message(&stream("s-1")).validate(8).is_err());
+
+        let mut bad = SpearMessage::new(MessageType::StreamData, 1, b"{}".to_vec());
+        assert!(bad.validate(1024).is_err());
+        bad.message_type = MessageType::Heartbeat;
+        assert!(bad.validate(1024).is_ok());
+        bad.version = 9;
+        assert!(bad.validate(1024).is_err());
+    }
+
     #[test]
     fn test_execution_request() {
         // 测试执行请求 / Test execution request
@@ -0,0 +1,245 @@
+//! Per-invocation debug trace
+//! 单次调用的调试追踪
+//!
+//! A caller sending `Spear-Debug: trace` (or invocation metadata `spear.debug = "trace"`)
+//! gets back an ordered trace of what the execution did: every hostcall with its return
+//! code, tool calls with their arguments and results, chat stream events and model
+//! provider calls. Recording is keyed by execution id like the manifest, and costs one
+//! atomic load per hostcall while no trace is being recorded.
+//! 发送 `Spear-Debug: trace`（或调用元数据 `spear.debug = "trace"`）的调用方会收到执行过程的有序
+//! 追踪：每次 hostcall 及其返回码、工具调用及其参数与结果、chat 流事件以及模型提供方调用。记录与清单
+//! 一样按执行 ID 存放；没有追踪在记录时，每次 hostcall 只多一次原子读取。
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+
+use dashmap::DashMap;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use crate::spearlet::config::DebugTraceConfig;
+
+/// HTTP header asking for a trace / 请求追踪的 HTTP 头
+pub const HEADER: &str = "spear-debug";
+/// Invocation metadata key carrying the header / 携带该请求头的调用元数据键
+pub const METADATA_KEY: &str = "spear.debug";
+/// Result metadata key holding the trace JSON / 存放追踪 JSON 的结果元数据键
+pub const TRACE_METADATA_KEY: &str = "debug_trace";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum TraceKind {
+    Hostcall,
+    ToolCall,
+    StreamEvent,
+    ProviderCall,
+}
+
+/// One recorded step / 一条记录的步骤
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct TraceEvent {
+    pub seq: u64,
+    /// Milliseconds since the execution started / 自执行开始以来的毫秒数
+    pub at_ms: u64,
+    pub kind: TraceKind,
+    pub name: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub duration_us: Option<u64>,
+    #[serde(default, skip_serializing_if = "Value::is_null")]
+    pub detail: Value,
+}
+
+/// Trace of one execution / 单次执行的追踪
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct DebugTrace {
+    pub events: Vec<TraceEvent>,
+    /// Events left out past `max_events` / 超过 `max_events` 而未保留的事件数
+    pub dropped: u64,
+}
+
+impl DebugTrace {
+    /// Store the trace in result metadata / 将追踪写入结果元数据
+    pub fn insert_into(&self, metadata: &mut HashMap<String, String>) {
+        if let Ok(s) = serde_json::to_string(self) {
+            metadata.insert(TRACE_METADATA_KEY.to_string(), s);
+        }
+    }
+
+    /// Read a trace back from result metadata / 从结果元数据读取追踪
+    pub fn from_metadata(metadata: &HashMap<String, String>) -> Option<Self> {
+        metadata
+            .get(TRACE_METADATA_KEY)
+            .and_then(|s| serde_json::from_str(s).ok())
+    }
+}
+
+struct Recording {
+    started: Instant,
+    max_events: usize,
+    max_detail_bytes: usize,
+    trace: DebugTrace,
+}
+
+/// Traces one spearlet is recording / 单个 spearlet 正在记录的追踪
+#[derive(Default)]
+pub struct DebugTraces {
+    recordings: DashMap<String, Recording>,
+    active: AtomicUsize,
+}
+
+/// Whether invocation metadata asks for a trace / 调用元数据是否请求追踪
+pub fn requested(metadata: &HashMap<String, String>) -> bool {
+    metadata
+        .get(METADATA_KEY)
+        .is_some_and(|v| v.split(',').any(|f| f.trim().eq_ignore_ascii_case("trace")))
+}
+
+impl DebugTraces {
+    /// Whether any execution is being traced / 是否有执行正在被追踪
+    pub fn enabled(&self) -> bool {
+        self.active.load(Ordering::Relaxed) > 0
+    }
+
+    /// Start tracing an execution / 开始追踪一次执行
+    pub fn begin(&self, execution_id: &str, cfg: &DebugTraceConfig) {
+        let rec = Recording {
+            started: Instant::now(),
+            max_events: cfg.max_events.max(1),
+            max_detail_bytes: cfg.max_detail_bytes,
+            trace: DebugTrace::default(),
+        };
+        if self
+            .recordings
+            .insert(execution_id.to_string(), rec)
+            .is_none()
+        {
+            self.active.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// Record a step of the current WASM execution / 为当前 WASM 执行记录一个步骤
+    pub fn record(&self, kind: TraceKind, name: &str, duration: Option<Duration>, detail: Value) {
+        if !self.enabled() {
+            return;
+        }
+        let Some(execution_id) = crate::spearlet::execution::host_api::current_wasm_execution_id()
+        else {
+            return;
+        };
+        self.record_for(&execution_id, kind, name, duration, detail);
+    }
+
+    /// Record a step of an execution; does nothing unless it is traced
+    /// 为指定执行记录一个步骤；未被追踪时不做任何事
+    pub fn record_for(
+        &self,
+        execution_id: &str,
+        kind: TraceKind,
+        name: &str,
+        duration: Option<Duration>,
+        mut detail: Value,
+    ) {
+        let Some(mut rec) = self.recordings.get_mut(execution_id) else {
+            return;
+        };
+        if rec.trace.events.len() >= rec.max_events {
+            rec.trace.dropped += 1;
+            return;
+        }
+        clip_strings(&mut detail, rec.max_detail_bytes);
+        let event = TraceEvent {
+            seq: rec.trace.events.len() as u64 + 1,
+            at_ms: rec.started.elapsed().as_millis() as u64,
+            kind,
+            name: name.to_string(),
+            duration_us: duration.map(|d| d.as_micros() as u64),
+            detail,
+        };
+        rec.trace.events.push(event);
+    }
+
+    /// Take the trace of a finished execution / 取出已结束执行的追踪
+    pub fn finish(&self, execution_id: &str) -> Option<DebugTrace> {
+        let (_, rec) = self.recordings.remove(execution_id)?;
+        self.active.fetch_sub(1, Ordering::Relaxed);
+        Some(rec.trace)
+    }
+}
+
+/// Shorten every string in `v` to at most `max` bytes / 将 `v` 中每个字符串截短到至多 `max` 字节
+fn clip_strings(v: &mut Value, max: usize) {
+    match v {
+        Value::String(s) if s.len() > max => {
+            let mut end = max;
+            while !s.is_char_boundary(end) {
+                end -= 1;
+            }
+            s.truncate(end);
+            s.push_str("...");
+        }
+        Value::Array(items) => items.iter_mut().for_each(|i| clip_strings(i, max)),
+        Value::Object(map) => map.values_mut().for_each(|i| clip_strings(i, max)),
+        _ => {}
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_trace_records_in_order_and_caps() {
+        let id = "exec-debug-trace-test";
+        let traces = DebugTraces::default();
+        traces.record_for(id, TraceKind::Hostcall, "untraced", None, Value::Null);
+        traces.begin(
+            id,
+            &DebugTraceConfig {
+                enabled: true,
+                max_events: 2,
+                max_detail_bytes: 4,
+            },
+        );
+        assert!(traces.enabled());
+        traces.record_for(
+            id,
+            TraceKind::Hostcall,
+            "cchat_send",
+            Some(Duration::from_micros(1500)),
+            json!({"rc": 3}),
+        );
+        traces.record_for(
+            id,
+            TraceKind::ToolCall,
+            "lookup",
+            None,
+            json!({"arguments": "{\"city\":\"Paris\"}"}),
+        );
+        traces.record_for(id, TraceKind::StreamEvent, "delta", None, Value::Null);
+
+        let trace = traces.finish(id).unwrap();
+        assert_eq!(trace.dropped, 1);
+        assert_eq!(trace.events.len(), 2);
+        assert_eq!(trace.events[0].seq, 1);
+        assert_eq!(trace.events[0].name, "cchat_send");
+        assert_eq!(trace.events[0].duration_us, Some(1500));
+        assert_eq!(trace.events[1].detail["arguments"], "{\"ci...");
+        assert!(traces.finish(id).is_none());
+        assert!(!traces.enabled());
+
+        let mut metadata = HashMap::new();
+        trace.insert_into(&mut metadata);
+        assert_eq!(DebugTrace::from_metadata(&metadata), Some(trace));
+    }
+
+    #[test]
+    fn test_requested() {
+        let md = |v: &str| HashMap::from([(METADATA_KEY.to_string(), v.to_string())]);
+        assert!(requested(&md("trace")));
+        assert!(requested(&md("verbose, Trace")));
+        assert!(!requested(&md("verbose")));
+        assert!(!requested(&HashMap::new()));
+    }
+}
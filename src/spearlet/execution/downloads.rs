@@ -0,0 +1,517 @@
+//! Artifact Download Manager
+//! Artifact 下载管理器
+//!
+//! Fetches workload-declared artifacts (model weights, datasets) before the first
+//! instance starts. Downloads are resumable (HTTP range requests on a `<name>.part` file),
+//! verified against an optional sha256 checksum and bounded by a disk quota. Every task
+//! downloads into its own directory, so two tasks naming different artifacts alike never
+//! see each other's files. Per-task progress is kept in memory and exposed by the task
+//! status API.
+//! 在首个实例启动前拉取工作负载声明的 artifact（模型权重、数据集）。下载支持断点续传
+//! （基于 `<name>.part` 文件的 HTTP Range 请求），可按 sha256 校验，并受磁盘配额限制。每个任务
+//! 下载到自己的目录中，因此两个任务即使为不同 artifact 取了相同名称，也不会看到彼此的文件。
+//! 每个任务的下载进度保存在内存中，并通过任务状态 API 暴露。
+
+use crate::spearlet::config::DownloadConfig;
+use crate::spearlet::execution::{ExecutionError, ExecutionResult};
+use dashmap::DashMap;
+use futures::StreamExt;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tracing::{info, warn};
+
+/// Task config key holding the JSON list of downloads / 保存下载列表 JSON 的任务配置键
+pub const TASK_CONFIG_DOWNLOADS: &str = "downloads";
+/// Environment variable pointing at the download directory / 指向下载目录的环境变量
+pub const ENV_DOWNLOADS_DIR: &str = "SPEAR_DOWNLOADS_DIR";
+/// Prefix of per-artifact path environment variables / 单个 artifact 路径环境变量前缀
+pub const ENV_DOWNLOAD_PREFIX: &str = "SPEAR_DOWNLOAD_";
+
+const PART_SUFFIX: &str = ".part";
+
+/// A workload-declared artifact / 工作负载声明的 artifact
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DownloadSpec {
+    /// Logical name, also used as file name / 逻辑名称，同时作为文件名
+    pub name: String,
+    /// HTTP(S) source url / HTTP(S) 源地址
+    pub url: String,
+    /// Expected sha256 (hex) / 期望的 sha256（十六进制）
+    #[serde(default)]
+    pub sha256: Option<String>,
+}
+
+/// Download state / 下载状态
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum DownloadState {
+    Pending,
+    Downloading,
+    Verifying,
+    Completed,
+    Failed,
+}
+
+/// Download progress for one artifact / 单个 artifact 的下载进度
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DownloadProgress {
+    pub name: String,
+    pub url: String,
+    pub state: DownloadState,
+    pub downloaded_bytes: u64,
+    pub total_bytes: Option<u64>,
+    pub path: Option<String>,
+    pub error: Option<String>,
+}
+
+impl DownloadProgress {
+    fn pending(spec: &DownloadSpec) -> Self {
+        Self {
+            name: spec.name.clone(),
+            url: spec.url.clone(),
+            state: DownloadState::Pending,
+            downloaded_bytes: 0,
+            total_bytes: None,
+            path: None,
+            error: None,
+        }
+    }
+}
+
+/// Parse the downloads declared in a task config / 解析任务配置中声明的下载项
+pub fn parse_download_specs(
+    task_config: &HashMap<String, String>,
+) -> ExecutionResult<Vec<DownloadSpec>> {
+    let raw = match task_config.get(TASK_CONFIG_DOWNLOADS) {
+        Some(v) if !v.trim().is_empty() => v,
+        _ => return Ok(Vec::new()),
+    };
+    let specs: Vec<DownloadSpec> =
+        serde_json::from_str(raw).map_err(|e| ExecutionError::InvalidConfiguration {
+            message: format!("invalid {}: {}", TASK_CONFIG_DOWNLOADS, e),
+        })?;
+    for s in specs.iter() {
+        if s.name.trim().is_empty() || s.name.contains('/') || s.name.contains("..") {
+            return Err(ExecutionError::InvalidConfiguration {
+                message: format!("invalid download name: {:?}", s.name),
+            });
+        }
+        if !(s.url.starts_with("http://") || s.url.starts_with("https://")) {
+            return Err(ExecutionError::InvalidConfiguration {
+                message: format!("unsupported download url: {}", s.url),
+            });
+        }
+    }
+    Ok(specs)
+}
+
+/// Environment variable name for a downloaded artifact / 已下载 artifact 的环境变量名
+pub fn download_env_key(name: &str) -> String {
+    let mut key = String::from(ENV_DOWNLOAD_PREFIX);
+    for ch in name.chars() {
+        if ch.is_ascii_alphanumeric() {
+            key.push(ch.to_ascii_uppercase());
+        } else {
+            key.push('_');
+        }
+    }
+    key
+}
+
+/// Download manager / 下载管理器
+#[derive(Debug)]
+pub struct DownloadManager {
+    root: PathBuf,
+    quota_bytes: u64,
+    timeout: Duration,
+    client: reqwest::Client,
+    progress: DashMap<String, Vec<DownloadProgress>>,
+    locks: DashMap<String, Arc<tokio::sync::Mutex<()>>>,
+}
+
+impl DownloadManager {
+    /// Create a download manager / 创建下载管理器
+    pub fn new(config: &DownloadConfig, data_dir: &str) -> Self {
+        let root = if config.dir.trim().is_empty() {
+            Path::new(data_dir).join("downloads")
+        } else {
+            PathBuf::from(config.dir.trim())
+        };
+        Self {
+            root,
+            quota_bytes: config.quota_bytes,
+            timeout: Duration::from_secs(config.timeout_s.max(1)),
+            client: reqwest::Client::new(),
+            progress: DashMap::new(),
+            locks: DashMap::new(),
+        }
+    }
+
+    /// Download root / 下载根目录
+    pub fn root(&self) -> &Path {
+        &self.root
+    }
+
+    /// Directory holding the downloads of a task / 保存任务下载内容的目录
+    pub fn task_dir(&self, task_id: &str) -> PathBuf {
+        self.root.join(sanitize_task_id(task_id))
+    }
+
+    /// Progress snapshot for a task / 任务的下载进度快照
+    pub fn progress(&self, task_id: &str) -> Vec<DownloadProgress> {
+        self.progress
+            .get(task_id)
+            .map(|v| v.value().clone())
+            .unwrap_or_default()
+    }
+
+    /// Ensure every artifact is present and verified; returns name -> path
+    /// 确保所有 artifact 已存在且校验通过；返回 名称 -> 路径
+    pub async fn ensure_all(
+        &self,
+        task_id: &str,
+        specs: &[DownloadSpec],
+    ) -> ExecutionResult<HashMap<String, PathBuf>> {
+        let lock = self
+            .locks
+            .entry(task_id.to_string())
+            .or_insert_with(|| Arc::new(tokio::sync::Mutex::new(())))
+            .clone();
+        let _guard = lock.lock().await;
+
+        self.progress.insert(
+            task_id.to_string(),
+            specs.iter().map(DownloadProgress::pending).collect(),
+        );
+        tokio::fs::create_dir_all(self.task_dir(task_id)).await?;
+
+        let mut out = HashMap::new();
+        for (idx, spec) in specs.iter().enumerate() {
+            match self.ensure_one(task_id, idx, spec).await {
+                Ok(path) => {
+                    self.update(task_id, idx, |p| {
+                        p.state = DownloadState::Completed;
+                        p.path = Some(path.to_string_lossy().to_string());
+                    });
+                    out.insert(spec.name.clone(), path);
+                }
+                Err(e) => {
+                    warn!(task_id, name = %spec.name, "artifact download failed: {}", e);
+                    self.update(task_id, idx, |p| {
+                        p.state = DownloadState::Failed;
+                        p.error = Some(e.to_string());
+                    });
+                    return Err(e);
+                }
+            }
+        }
+        Ok(out)
+    }
+
+    async fn ensure_one(
+        &self,
+        task_id: &str,
+        idx: usize,
+        spec: &DownloadSpec,
+    ) -> ExecutionResult<PathBuf> {
+        let dir = self.task_dir(task_id);
+        let target = dir.join(&spec.name);
+        if tokio::fs::try_exists(&target).await.unwrap_or(false) {
+            let len = tokio::fs::metadata(&target).await?.len();
+            self.update(task_id, idx, |p| {
+                p.downloaded_bytes = len;
+                p.total_bytes = Some(len);
+            });
+            match &spec.sha256 {
+                Some(expected) => {
+                    if sha256_file(&target)
+                        .await?
+                        .eq_ignore_ascii_case(expected.trim())
+                    {
+                        return Ok(target);
+                    }
+                    warn!(name = %spec.name, "cached artifact checksum mismatch, re-downloading");
+                    tokio::fs::remove_file(&target).await?;
+                }
+                None => return Ok(target),
+            }
+        }
+
+        let part = dir.join(format!("{}{}", spec.name, PART_SUFFIX));
+        tokio::time::timeout(self.timeout, self.fetch(task_id, idx, spec, &part))
+            .await
+            .map_err(|_| ExecutionError::ExecutionTimeout {
+                timeout_ms: self.timeout.as_millis() as u64,
+            })??;
+
+        if let Some(expected) = &spec.sha256 {
+            self.update(task_id, idx, |p| p.state = DownloadState::Verifying);
+            let actual = sha256_file(&part).await?;
+            if !actual.eq_ignore_ascii_case(expected.trim()) {
+                let _ = tokio::fs::remove_file(&part).await;
+                return Err(ExecutionError::RuntimeError {
+                    message: format!(
+                        "checksum mismatch for {}: expected {}, got {}",
+                        spec.name, expected, actual
+                    ),
+                });
+            }
+        }
+        tokio::fs::rename(&part, &target).await?;
+        info!(task_id, name = %spec.name, path = %target.display(), "artifact downloaded");
+        Ok(target)
+    }
+
+    async fn fetch(
+        &self,
+        task_id: &str,
+        idx: usize,
+        spec: &DownloadSpec,
+        part: &Path,
+    ) -> ExecutionResult<()> {
+        let mut offset = match tokio::fs::metadata(part).await {
+            Ok(m) => m.len(),
+            Err(_) => 0,
+        };
+
+        let resp = loop {
+            let mut req = self.client.get(&spec.url);
+            if offset > 0 {
+                req = req.header(reqwest::header::RANGE, format!("bytes={}-", offset));
+            }
+            let resp = req.send().await.map_err(|e| ExecutionError::RuntimeError {
+                message: format!("download request failed for {}: {}", spec.name, e),
+            })?;
+            if resp.status() == reqwest::StatusCode::RANGE_NOT_SATISFIABLE && offset > 0 {
+                // Partial file is stale; restart from scratch / 部分文件已失效，从头开始
+                let _ = tokio::fs::remove_file(part).await;
+                offset = 0;
+                continue;
+            }
+            break resp;
+        };
+        let status = resp.status();
+        if !status.is_success() {
+            return Err(ExecutionError::RuntimeError {
+                message: format!("download failed for {}: http_status={}", spec.name, status),
+            });
+        }
+        let resumed = offset > 0 && status == reqwest::StatusCode::PARTIAL_CONTENT;
+        if !resumed {
+            offset = 0;
+        }
+        let total = resp.content_length().map(|n| n + offset);
+
+        let left = self.quota_left().await;
+        if let Some(total) = total {
+            self.check_quota(left, total.saturating_sub(offset))?;
+        }
+
+        let mut file = tokio::fs::OpenOptions::new()
+            .create(true)
+            .write(true)
+            .append(resumed)
+            .truncate(!resumed)
+            .open(part)
+            .await?;
+
+        self.update(task_id, idx, |p| {
+            p.state = DownloadState::Downloading;
+            p.downloaded_bytes = offset;
+            p.total_bytes = total;
+        });
+
+        let mut written = offset;
+        let mut stream = resp.bytes_stream();
+        while let Some(chunk) = stream.next().await {
+            let chunk = chunk.map_err(|e| ExecutionError::RuntimeError {
+                message: format!("download stream error for {}: {}", spec.name, e),
+            })?;
+            // Counted against the usage measured once above / 按上面测得一次的用量计数
+            self.check_quota(left, written - offset + chunk.len() as u64)?;
+            file.write_all(&chunk).await?;
+            written += chunk.len() as u64;
+            self.update(task_id, idx, |p| p.downloaded_bytes = written);
+        }
+        file.flush().await?;
+        Ok(())
+    }
+
+    /// Bytes the quota still allows, `None` without a quota / 配额仍允许的字节数；无配额时为 `None`
+    async fn quota_left(&self) -> Option<u64> {
+        if self.quota_bytes == 0 {
+            return None;
+        }
+        Some(self.quota_bytes.saturating_sub(dir_size(&self.root).await))
+    }
+
+    fn check_quota(&self, left: Option<u64>, incoming: u64) -> ExecutionResult<()> {
+        match left {
+            Some(left) if incoming > left => Err(ExecutionError::ResourceExhausted {
+                message: format!(
+                    "download quota exceeded: incoming={} left={} quota={}",
+                    incoming, left, self.quota_bytes
+                ),
+            }),
+            _ => Ok(()),
+        }
+    }
+
+    fn update<F: FnOnce(&mut DownloadProgress)>(&self, task_id: &str, idx: usize, f: F) {
+        if let Some(mut entry) = self.progress.get_mut(task_id) {
+            if let Some(p) = entry.value_mut().get_mut(idx) {
+                f(p);
+            }
+        }
+    }
+}
+
+fn sanitize_task_id(task_id: &str) -> String {
+    task_id
+        .chars()
+        .map(|c| {
+            if c.is_ascii_alphanumeric() || c == '-' || c == '_' {
+                c
+            } else {
+                '_'
+            }
+        })
+        .collect()
+}
+
+async fn dir_size(dir: &Path) -> u64 {
+    let mut total = 0;
+    let mut dirs = vec![dir.to_path_buf()];
+    while let Some(dir) = dirs.pop() {
+        let Ok(mut rd) = tokio::fs::read_dir(&dir).await else {
+            continue;
+        };
+        while let Ok(Some(entry)) = rd.next_entry().await {
+            let Ok(meta) = entry.metadata().await else {
+                continue;
+            };
+            if meta.is_dir() {
+                dirs.push(entry.path());
+            } else if meta.is_file() {
+                total += meta.len();
+            }
+        }
+    }
+    total
+}
+
+async fn sha256_file(path: &Path) -> ExecutionResult<String> {
+    let mut file = tokio::fs::File::open(path).await?;
+    let mut hasher = Sha256::new();
+    let mut buf = vec![0u8; 64 * 1024];
+    loop {
+        let n = file.read(&mut buf).await?;
+        if n == 0 {
+            break;
+        }
+        hasher.update(&buf[..n]);
+    }
+    Ok(hex_lower(&hasher.finalize()))
+}
+
+fn hex_lower(bytes: &[u8]) -> String {
+    let mut s = String::with_capacity(bytes.len() * 2);
+    for b in bytes {
+        s.push_str(&format!("{:02x}", b));
+    }
+    s
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_download_specs() {
+        let mut tc = HashMap::new();
+        assert!(parse_download_specs(&tc).unwrap().is_empty());
+
+        tc.insert(
+            TASK_CONFIG_DOWNLOADS.to_string(),
+            r#"[{"name":"weights.gguf","url":"https://example.com/w.gguf","sha256":"ab"}]"#
+                .to_string(),
+        );
+        let specs = parse_download_specs(&tc).unwrap();
+        assert_eq!(specs.len(), 1);
+        assert_eq!(specs[0].sha256.as_deref(), Some("ab"));
+
+        tc.insert(
+            TASK_CONFIG_DOWNLOADS.to_string(),
+            r#"[{"name":"../x","url":"https://example.com/x"}]"#.to_string(),
+        );
+        assert!(parse_download_specs(&tc).is_err());
+    }
+
+    #[test]
+    fn test_download_env_key() {
+        assert_eq!(
+            download_env_key("weights.gguf"),
+            "SPEAR_DOWNLOAD_WEIGHTS_GGUF"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_cached_artifact_is_verified() {
+        let tmp = tempfile::tempdir().unwrap();
+        let cfg = DownloadConfig {
+            dir: tmp.path().to_string_lossy().to_string(),
+            ..Default::default()
+        };
+        let mgr = DownloadManager::new(&cfg, "/unused");
+        let spec = DownloadSpec {
+            name: "data.bin".to_string(),
+            url: "http://127.0.0.1:9/data.bin".to_string(),
+            sha256: Some(
+                "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824".to_string(),
+            ),
+        };
+        let cached = mgr.task_dir("task-dl").join("data.bin");
+        tokio::fs::create_dir_all(mgr.task_dir("task-dl"))
+            .await
+            .unwrap();
+        tokio::fs::write(&cached, b"hello").await.unwrap();
+
+        let paths = mgr.ensure_all("task-dl", &[spec.clone()]).await.unwrap();
+        assert_eq!(paths["data.bin"], cached);
+        // Another task does not get this task's file / 其他任务不会拿到该任务的文件
+        assert_ne!(mgr.task_dir("task-other"), mgr.task_dir("task-dl"));
+        assert!(mgr.ensure_all("task-other", &[spec]).await.is_err());
+        let progress = mgr.progress("task-dl");
+        assert_eq!(progress[0].state, DownloadState::Completed);
+        assert_eq!(progress[0].downloaded_bytes, 5);
+    }
+
+    #[tokio::test]
+    async fn test_quota_rejects_oversized_download() {
+        let tmp = tempfile::tempdir().unwrap();
+        let cfg = DownloadConfig {
+            dir: tmp.path().to_string_lossy().to_string(),
+            quota_bytes: 4,
+            ..Default::default()
+        };
+        let mgr = DownloadManager::new(&cfg, "/unused");
+        // Downloads of other tasks count too / 其他任务的下载同样计入
+        tokio::fs::create_dir_all(mgr.task_dir("task-other"))
+            .await
+            .unwrap();
+        tokio::fs::write(mgr.task_dir("task-other").join("existing"), b"12345")
+            .await
+            .unwrap();
+        let left = mgr.quota_left().await;
+        assert_eq!(left, Some(0));
+        assert!(matches!(
+            mgr.check_quota(left, 1),
+            Err(ExecutionError::ResourceExhausted { .. })
+        ));
+    }
+}
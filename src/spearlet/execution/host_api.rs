@@ -1,23 +1,44 @@
+mod blobs;
 mod cchat;
+mod compute_hint;
 mod core;
+pub(crate) mod deadline;
+pub(crate) mod dispatch;
+mod embeddings;
 pub(crate) mod errno;
 mod fd;
+mod files;
 mod iface;
+mod image;
+mod invoke;
+mod kv_state;
+pub(crate) mod language;
+pub mod middleware;
+mod message_passing;
 mod mic;
+mod moderation;
+mod onnx;
 pub(crate) mod registry;
 mod rtasr;
+mod rttts;
+mod schedule;
 pub(crate) mod ssf;
+mod structured;
 pub(crate) mod termination;
+mod testing;
+mod tools;
+mod tts;
 pub(crate) mod user_stream;
 mod util;
+mod vector_store;
 
 #[cfg(test)]
 mod tests;
 
 pub use cchat::ChatSessionSnapshot;
-pub use core::{
-    clear_wasm_logs_by_execution, get_wasm_logs_by_execution, set_current_wasm_execution_id,
-    DefaultHostApi, WasmLogEntry,
-};
+pub use core::{set_current_wasm_execution_id, DefaultHostApi, WasmLogEntry, WasmLogs};
+pub(crate) use core::current_wasm_execution_id;
 pub use iface::{HttpCallResult, SpearHostApi};
-pub use user_stream::{map_ws_close_to_channels, ws_pop_any_outbound, ws_push_frame};
+pub use language::{DetectedLanguage, LanguageSource, SessionLanguages};
+pub use onnx::{ONNX_CTL_LIST, ONNX_CTL_LOAD, ONNX_CTL_UNLOAD};
+pub use user_stream::UserStreams;
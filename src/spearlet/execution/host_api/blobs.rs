@@ -0,0 +1,60 @@
+//! Blob cache hostcalls / blob 缓存 hostcall
+//!
+//! `blob_put` copies guest bytes into the node's blob cache once and returns an id;
+//! another task on the node copies the same bytes out with `blob_read` by passing that id
+//! around, in chunks at increasing offsets.
+//! `blob_put` 将 guest 字节一次性复制到节点的 blob 缓存并返回 ID；节点上的另一个任务传递该 ID，
+//! 通过 `blob_read` 以递增的偏移量分块复制出同一份字节。
+
+use super::errno::{SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOENT, SPEAR_ENOMEM, SPEAR_ENOSYS};
+use crate::spearlet::blob_cache::BlobError;
+use crate::spearlet::execution::host_api::DefaultHostApi;
+
+fn errno(e: &BlobError) -> i32 {
+    -match e {
+        BlobError::Disabled => SPEAR_ENOSYS,
+        BlobError::TooLarge(_) => SPEAR_EINVAL,
+        BlobError::Full => SPEAR_ENOMEM,
+        BlobError::NotFound(_) => SPEAR_ENOENT,
+        BlobError::Corrupt(_) => SPEAR_EIO,
+    }
+}
+
+impl DefaultHostApi {
+    /// Store a blob for other tasks; returns its id / 为其他任务存储 blob；返回其 ID
+    pub fn blob_put(&self, data: Vec<u8>) -> Result<String, i32> {
+        let owner = self.task_id.as_deref().unwrap_or("");
+        let bytes = data.len();
+        self.node().blob_cache.put(owner, data).map_err(|e| {
+            tracing::warn!(task_id = %owner, bytes, error = %e, "blob_put failed");
+            errno(&e)
+        })
+    }
+
+    /// Size of a blob in bytes / blob 的字节数
+    pub fn blob_size(&self, id: &str) -> Result<usize, i32> {
+        self.node()
+            .blob_cache
+            .get(id)
+            .map(|b| b.len())
+            .map_err(|e| errno(&e))
+    }
+
+    /// Up to `max_len` bytes of a blob from `offset`; empty at the end
+    /// 从 `offset` 起读取 blob 的至多 `max_len` 字节；到达末尾时为空
+    pub fn blob_read(&self, id: &str, offset: usize, max_len: usize) -> Result<Vec<u8>, i32> {
+        let data = self.node().blob_cache.get(id).map_err(|e| errno(&e))?;
+        if offset > data.len() {
+            return Err(-SPEAR_EINVAL);
+        }
+        let end = data.len().min(offset.saturating_add(max_len));
+        Ok(data[offset..end].to_vec())
+    }
+
+    pub fn blob_release(&self, id: &str) -> i32 {
+        match self.node().blob_cache.release(id) {
+            Ok(()) => 0,
+            Err(e) => errno(&e),
+        }
+    }
+}
@@ -1,20 +1,32 @@
+use crate::spearlet::execution::ai::chat_stream::{done_event, error_event, events_from_response};
 use crate::spearlet::execution::ai::ir::{CanonicalRequestEnvelope, Payload, ResultPayload};
 use crate::spearlet::execution::ai::ir::{ChatMessage, ToolCall};
 use crate::spearlet::execution::ai::normalize::chat::normalize_cchat_session;
-use crate::spearlet::execution::host_api::DefaultHostApi;
-use super::errno::{EACCES, EBADF, EINVAL, EIO};
+use crate::spearlet::execution::ai::provider_session::ProviderSession;
+use crate::spearlet::execution::debug_trace::{DebugTraces, TraceKind};
+use crate::spearlet::execution::host_api::{
+    current_wasm_execution_id, set_current_wasm_execution_id, DefaultHostApi,
+};
+use super::errno::{EACCES, EAGAIN, EBADF, EINVAL, EIO, EPIPE, ETIMEDOUT};
+use super::moderation::{prompt_texts, response_text, screen};
+use crate::spearlet::execution::hostcall::fd_table::FdTable;
 use crate::spearlet::execution::hostcall::types::{
     ChatResponseState, ChatSessionState, FdEntry, FdFlags, FdInner, FdKind, PollEvents,
 };
+use crate::spearlet::otel;
 use serde_json::{json, Value};
 use std::collections::{HashMap, HashSet};
-use std::time::Duration;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
 
 use crate::spearlet::mcp::policy::{
     decide_mcp_exec, filter_and_namespace_openai_tools, server_allowed_tools, McpSessionParams,
 };
 use crate::spearlet::mcp::task_subset::task_default_session_params;
+use crate::spearlet::moderation::Stage;
+use crate::spearlet::node_services::NodeServices;
 use crate::spearlet::param_keys::{chat as chat_keys, mcp as mcp_keys};
+use crate::spearlet::tool_plugins::TOOL_NAMESPACE_PREFIX;
 
 fn redact_canonical_request_for_log(req: &CanonicalRequestEnvelope) -> CanonicalRequestEnvelope {
     let mut out = req.clone();
@@ -40,12 +52,13 @@ fn redact_canonical_request_for_log(req: &CanonicalRequestEnvelope) -> Canonical
         Payload::SpeechToText(_) => {}
         Payload::TextToSpeech(_) => {}
         Payload::RealtimeVoice(_) => {}
+        Payload::Moderations(_) => {}
     }
 
     out
 }
 
-fn should_redact_key(key: &str) -> bool {
+pub(super) fn should_redact_key(key: &str) -> bool {
     let k = key.to_ascii_lowercase();
     k.contains("api_key")
         || k.contains("apikey")
@@ -89,31 +102,134 @@ pub struct ChatSessionSnapshot {
     pub mcp: McpSessionParams,
 }
 
-impl DefaultHostApi {
-    fn cchat_attach_debug_fields(&self, mut v: Value, backend: &str, model: &str) -> Value {
-        let resp_model = v
-            .get("model")
-            .and_then(|x| x.as_str())
-            .unwrap_or("")
-            .trim()
-            .to_string();
-        let model = if model.trim().is_empty() && !resp_model.is_empty() {
-            resp_model.as_str()
-        } else {
-            model
+fn cchat_attach_debug_fields(mut v: Value, backend: &str, model: &str) -> Value {
+    let resp_model = v
+        .get("model")
+        .and_then(|x| x.as_str())
+        .unwrap_or("")
+        .trim()
+        .to_string();
+    let model = if model.trim().is_empty() && !resp_model.is_empty() {
+        resp_model.as_str()
+    } else {
+        model
+    };
+    match v.as_object_mut() {
+        Some(obj) => {
+            obj.insert(
+                "_spear".to_string(),
+                json!({"backend": backend, "model": model}),
+            );
+            v
+        }
+        None => json!({"_spear": {"backend": backend, "model": model}, "result": v}),
+    }
+}
+
+/// `cchat_send` flag: answer at once and stream events to `cchat_recv_delta`
+/// `cchat_send` 标志：立即返回并将事件流式交给 `cchat_recv_delta`
+pub const SEND_FLAG_STREAM: i32 = 4;
+
+/// Add a chat stream event to the debug trace of the current execution
+/// 将 chat 流事件加入当前执行的调试追踪
+fn trace_chat_event(traces: &DebugTraces, event: &Value) {
+    if traces.enabled() {
+        let name = event
+            .get("type")
+            .and_then(|t| t.as_str())
+            .unwrap_or("event");
+        traces.record(TraceKind::StreamEvent, name, None, event.clone());
+    }
+}
+
+fn push_chat_event(traces: &DebugTraces, table: &Arc<FdTable>, resp_fd: i32, event: &Value) {
+    trace_chat_event(traces, event);
+    let Some(entry) = table.get(resp_fd) else {
+        return;
+    };
+    {
+        let Ok(mut e) = entry.lock() else {
+            return;
         };
-        match v.as_object_mut() {
-            Some(obj) => {
-                obj.insert(
-                    "_spear".to_string(),
-                    json!({"backend": backend, "model": model}),
-                );
-                v
-            }
-            None => json!({"_spear": {"backend": backend, "model": model}, "result": v}),
+        if e.closed {
+            return;
+        }
+        let FdInner::ChatResponse(r) = &mut e.inner else {
+            return;
+        };
+        r.events.push_back(serde_json::to_vec(event).unwrap_or_default());
+        e.poll_mask.insert(PollEvents::IN);
+    }
+    table.notify_watchers(resp_fd);
+}
+
+/// Hand the provider session of chat `fd` to the backend / 将 chat `fd` 的提供方会话交给后端
+fn attach_provider_session(table: &Arc<FdTable>, fd: i32, req: &mut CanonicalRequestEnvelope) {
+    let Some(entry) = table.get(fd) else {
+        return;
+    };
+    let Ok(e) = entry.lock() else {
+        return;
+    };
+    if let FdInner::ChatSession(s) = &e.inner {
+        if let Some(session) = &s.provider_session {
+            session.attach(req);
         }
     }
+}
+
+/// Keep the provider session `backend` left in `v` for the next send of chat `fd`
+/// 保存 `backend` 在 `v` 中留下的提供方会话，供 chat `fd` 下一次发送使用
+fn keep_provider_session(
+    table: &Arc<FdTable>,
+    fd: i32,
+    backend: &str,
+    req: &CanonicalRequestEnvelope,
+    v: &mut Value,
+) {
+    let Some(session) = ProviderSession::from_answer(backend, req, v) else {
+        return;
+    };
+    let Some(entry) = table.get(fd) else {
+        return;
+    };
+    let Ok(mut e) = entry.lock() else {
+        return;
+    };
+    if let FdInner::ChatSession(s) = &mut e.inner {
+        s.provider_session = Some(session);
+    }
+}
+
+fn finish_chat_stream(
+    traces: &DebugTraces,
+    table: &Arc<FdTable>,
+    resp_fd: i32,
+    bytes: Vec<u8>,
+    metrics_bytes: Vec<u8>,
+    last: &Value,
+) {
+    trace_chat_event(traces, last);
+    let Some(entry) = table.get(resp_fd) else {
+        return;
+    };
+    {
+        let Ok(mut e) = entry.lock() else {
+            return;
+        };
+        let FdInner::ChatResponse(r) = &mut e.inner else {
+            return;
+        };
+        r.bytes = bytes;
+        r.metrics_bytes = metrics_bytes;
+        r.events.push_back(serde_json::to_vec(last).unwrap_or_default());
+        r.streaming = false;
+        e.poll_mask.insert(PollEvents::IN);
+    }
+    table.notify_watchers(resp_fd);
+}
 
+impl DefaultHostApi {
     pub fn cchat_create(&self) -> i32 {
         let fd = self.fd_table.alloc(FdEntry {
             kind: FdKind::ChatSession,
@@ -338,9 +454,13 @@ impl DefaultHostApi {
     }
 
     pub fn cchat_send(&self, fd: i32, flags: i32) -> Result<i32, i32> {
+        if (flags & SEND_FLAG_STREAM) != 0 {
+            return self.cchat_send_stream(fd, flags);
+        }
         let metrics_enabled = (flags & 1) != 0;
         let snapshot = self.cchat_get_session_snapshot(fd)?;
         let snapshot = self.cchat_inject_mcp_tools(&snapshot);
+        let snapshot = cchat_inject_plugin_tools(self.node(), snapshot);
         let resp_fd = self.fd_table.alloc(FdEntry {
             kind: FdKind::ChatResponse,
             flags: FdFlags::default(),
@@ -350,7 +470,9 @@ impl DefaultHostApi {
             inner: FdInner::ChatResponse(ChatResponseState::default()),
         });
 
-        let req = normalize_cchat_session(&snapshot);
+        let mut req = normalize_cchat_session(&snapshot);
+        self.annotate_language(&mut req);
+        attach_provider_session(&self.fd_table, fd, &mut req);
         tracing::debug!(
             chat_fd = fd,
             response_fd = resp_fd,
@@ -358,6 +480,9 @@ impl DefaultHostApi {
             req = ?redact_canonical_request_for_log(&req),
             "cchat_send canonical request"
         );
+        if let Err(body) = self.screen_prompt(&snapshot.messages) {
+            return self.cchat_put_blocked(resp_fd, &body, metrics_enabled);
+        }
         let resp = match self.ai_engine.invoke(&req) {
             Ok(r) => r,
             Err(e) => {
@@ -379,10 +504,14 @@ impl DefaultHostApi {
         };
 
         let bytes = match resp.result {
-            ResultPayload::Payload(v) => {
-                let v = self.cchat_attach_debug_fields(v, &resp.backend, req_model);
-                serde_json::to_vec(&v).map_err(|_| -EIO)?
-            }
+            ResultPayload::Payload(mut v) => match self.screen_response(&v) {
+                Ok(()) => {
+                    keep_provider_session(&self.fd_table, fd, &resp.backend, &req, &mut v);
+                    let v = cchat_attach_debug_fields(v, &resp.backend, req_model);
+                    serde_json::to_vec(&v).map_err(|_| -EIO)?
+                }
+                Err(body) => serde_json::to_vec(&body).map_err(|_| -EIO)?,
+            },
             ResultPayload::Error(e) => {
                 let body = json!({"error": {"code": e.code, "message": e.message}});
                 serde_json::to_vec(&body).map_err(|_| -EIO)?
@@ -403,6 +532,160 @@ impl DefaultHostApi {
         Ok(resp_fd)
     }
 
+    /// Answer in the background; events are queued on the response fd as they arrive
+    /// 在后台应答；事件到达后排入响应 fd
+    fn cchat_send_stream(&self, fd: i32, flags: i32) -> Result<i32, i32> {
+        let metrics_enabled = (flags & 1) != 0;
+        let snapshot = self.cchat_get_session_snapshot(fd)?;
+        let snapshot = self.cchat_inject_mcp_tools(&snapshot);
+        let snapshot = cchat_inject_plugin_tools(self.node(), snapshot);
+        let resp_fd = self.fd_table.alloc(FdEntry {
+            kind: FdKind::ChatResponse,
+            flags: FdFlags::default(),
+            poll_mask: PollEvents::default(),
+            watchers: HashSet::new(),
+            closed: false,
+            inner: FdInner::ChatResponse(ChatResponseState {
+                streaming: true,
+                ..Default::default()
+            }),
+        });
+
+        let mut req = normalize_cchat_session(&snapshot);
+        self.annotate_language(&mut req);
+        attach_provider_session(&self.fd_table, fd, &mut req);
+        tracing::debug!(
+            chat_fd = fd,
+            response_fd = resp_fd,
+            flags,
+            req = ?redact_canonical_request_for_log(&req),
+            "cchat_send streaming canonical request"
+        );
+        let table = self.fd_table.clone();
+        let engine = self.ai_engine.clone();
+        let node = self.runtime_config.node.clone();
+        let screen_prompt = self
+            .screens(Stage::Prompt)
+            .then(|| prompt_texts(&snapshot.messages));
+        // A screened answer is held back until it passes / 受审核的应答在通过之前暂不交付
+        let screen_response = self.screens(Stage::Response);
+        let messages = snapshot.messages.len() as i64;
+        let trace = otel::current();
+        let execution_id = current_wasm_execution_id();
+        // Adapters block on their own runtime, so this cannot be a tokio task
+        // 适配器会在自身的运行时上阻塞，因此不能使用 tokio 任务
+        let spawned = std::thread::Builder::new()
+            .name("cchat-stream".to_string())
+            .spawn(move || {
+                otel::set_current(trace);
+                set_current_wasm_execution_id(execution_id);
+                if let Some(texts) = screen_prompt {
+                    if let Err(body) = screen(&node.moderation, &engine, Stage::Prompt, texts) {
+                        let last = blocked_event(&body);
+                        let bytes = serde_json::to_vec(&body).unwrap_or_default();
+                        let metrics_bytes = if metrics_enabled {
+                            b"{}".to_vec()
+                        } else {
+                            Vec::new()
+                        };
+                        finish_chat_stream(
+                            &node.debug_traces,
+                            &table,
+                            resp_fd,
+                            bytes,
+                            metrics_bytes,
+                            &last,
+                        );
+                        return;
+                    }
+                }
+                let mut streamed = false;
+                let mut held = Vec::new();
+                let result = engine.invoke_stream(&req, &mut |event| {
+                    streamed = true;
+                    if screen_response {
+                        held.push(event);
+                    } else {
+                        push_chat_event(&node.debug_traces, &table, resp_fd, &event);
+                    }
+                });
+                let req_model = match &req.payload {
+                    Payload::ChatCompletions(p) => p.model.as_str(),
+                    _ => "",
+                };
+                let (body, last) = match result {
+                    Ok(resp) => match resp.result {
+                        ResultPayload::Payload(mut v) => {
+                            let text = response_text(&v);
+                            let verdict = if screen_response && !text.trim().is_empty() {
+                                screen(&node.moderation, &engine, Stage::Response, vec![text])
+                            } else {
+                                Ok(())
+                            };
+                            match verdict {
+                                Ok(()) => {
+                                    keep_provider_session(&table, fd, &resp.backend, &req, &mut v);
+                                    let events = if streamed {
+                                        held
+                                    } else {
+                                        events_from_response(&v)
+                                    };
+                                    for event in events {
+                                        push_chat_event(
+                                            &node.debug_traces,
+                                            &table,
+                                            resp_fd,
+                                            &event,
+                                        );
+                                    }
+                                    let last = done_event(&v);
+                                    (cchat_attach_debug_fields(v, &resp.backend, req_model), last)
+                                }
+                                Err(body) => {
+                                    let last = blocked_event(&body);
+                                    (body, last)
+                                }
+                            }
+                        }
+                        ResultPayload::Error(e) => (
+                            json!({"error": {"code": e.code, "message": e.message}}),
+                            error_event(&e.code, &e.message),
+                        ),
+                    },
+                    Err(e) => (
+                        json!({"error": {"message": e.to_string()}}),
+                        error_event("backend_error", &e.to_string()),
+                    ),
+                };
+                let metrics_bytes = if metrics_enabled {
+                    let usage = body.get("usage").cloned().unwrap_or_else(|| {
+                        json!({
+                            "prompt_tokens": messages,
+                            "completion_tokens": 1,
+                            "total_tokens": messages + 1,
+                        })
+                    });
+                    serde_json::to_vec(&usage).unwrap_or_else(|_| b"{}".to_vec())
+                } else {
+                    Vec::new()
+                };
+                let bytes = serde_json::to_vec(&body).unwrap_or_default();
+                finish_chat_stream(
+                    &node.debug_traces,
+                    &table,
+                    resp_fd,
+                    bytes,
+                    metrics_bytes,
+                    &last,
+                );
+            });
+        if spawned.is_err() {
+            self.fd_table.close(resp_fd);
+            return Err(-EIO);
+        }
+        Ok(resp_fd)
+    }
+
     pub fn cchat_send_with_tools<F>(
         &self,
         fd: i32,
@@ -418,6 +701,10 @@ impl DefaultHostApi {
         if (flags & AUTO_TOOL_CALL) == 0 {
             return self.cchat_send(fd, flags);
         }
+        // Tool calls are streamed to the guest instead / 工具调用改为流式交给 guest
+        if (flags & SEND_FLAG_STREAM) != 0 {
+            return Err(-EINVAL);
+        }
 
         let metrics_enabled = (flags & METRICS_ENABLED) != 0;
         let resp_fd = self.fd_table.alloc(FdEntry {
@@ -438,7 +725,8 @@ impl DefaultHostApi {
                 Err(e) => return Err(e),
             };
 
-            let injected_snapshot = self.cchat_inject_mcp_tools(&snapshot);
+            let injected_snapshot =
+                cchat_inject_plugin_tools(self.node(), self.cchat_inject_mcp_tools(&snapshot));
 
             let max_iterations = snapshot
                 .params
@@ -480,7 +768,9 @@ impl DefaultHostApi {
 
             let tool_name_to_offset = build_tool_name_to_offset(&snapshot.tools);
 
-            let req = normalize_cchat_session(&injected_snapshot);
+            let mut req = normalize_cchat_session(&injected_snapshot);
+            self.annotate_language(&mut req);
+            attach_provider_session(&self.fd_table, fd, &mut req);
             tracing::debug!(
                 chat_fd = fd,
                 response_fd = resp_fd,
@@ -491,6 +781,9 @@ impl DefaultHostApi {
                 req = ?redact_canonical_request_for_log(&req),
                 "cchat_send canonical request"
             );
+            if let Err(body) = self.screen_prompt(&snapshot.messages) {
+                return self.cchat_put_blocked(resp_fd, &body, metrics_enabled);
+            }
             let resp = match self.ai_engine.invoke(&req) {
                 Ok(r) => r,
                 Err(e) => {
@@ -511,7 +804,7 @@ impl DefaultHostApi {
                 _ => "",
             };
 
-            let response_value = match resp.result {
+            let mut response_value = match resp.result {
                 ResultPayload::Payload(v) => v,
                 ResultPayload::Error(e) => {
                     let body = json!({"error": {"code": e.code, "message": e.message}});
@@ -526,17 +819,22 @@ impl DefaultHostApi {
                 }
             };
 
+            keep_provider_session(&self.fd_table, fd, &resp.backend, &req, &mut response_value);
+
             let parsed = parse_openai_tool_calls(&response_value);
 
             match parsed {
                 None => {
+                    if let Err(body) = self.screen_response(&response_value) {
+                        return self.cchat_put_blocked(resp_fd, &body, metrics_enabled);
+                    }
                     let assistant_msg = extract_openai_assistant_message(&response_value);
                     if let Some(m) = assistant_msg {
                         let _ = self.cchat_append_message(fd, m);
                     }
 
                     let response_value =
-                        self.cchat_attach_debug_fields(response_value, &resp.backend, req_model);
+                        cchat_attach_debug_fields(response_value, &resp.backend, req_model);
                     let bytes = serde_json::to_vec(&response_value).map_err(|_| -EIO)?;
                     let metrics_bytes = if metrics_enabled {
                         let usage = json!({
@@ -570,6 +868,7 @@ impl DefaultHostApi {
                         total_tool_calls += 1;
                         let tool_name = tc.function.name.clone();
                         let args = tc.function.arguments.clone();
+                        let started = Instant::now();
                         let out = if let Some(off) = tool_name_to_offset.get(&tool_name).copied() {
                             match tool_exec(off, &args) {
                                 Ok(s) => s,
@@ -586,9 +885,26 @@ impl DefaultHostApi {
                                         .to_string()
                                 }
                             }
+                        } else if tool_name.starts_with(TOOL_NAMESPACE_PREFIX) {
+                            match self.cchat_exec_plugin_tool(&snapshot, &tool_name, &args) {
+                                Ok(s) => s,
+                                Err(msg) => {
+                                    json!({"error": {"code": "plugin_tool_failed", "message": msg}})
+                                        .to_string()
+                                }
+                            }
                         } else {
                             json!({"error": {"code": "unknown_tool", "message": format!("unknown tool: {}", tool_name)}}).to_string()
                         };
+                        let traces = &self.node().debug_traces;
+                        if traces.enabled() {
+                            traces.record(
+                                TraceKind::ToolCall,
+                                &tool_name,
+                                Some(started.elapsed()),
+                                json!({"id": tc.id, "arguments": args, "result": out}),
+                            );
+                        }
                         let _ = self.cchat_append_message(
                             fd,
                             ChatMessage {
@@ -619,9 +935,53 @@ impl DefaultHostApi {
         let FdInner::ChatResponse(r) = &e.inner else {
             return Err(-EBADF);
         };
+        if r.streaming {
+            return Err(-EAGAIN);
+        }
         Ok(r.bytes.clone())
     }
 
+    /// Next event of a streamed response; -EAGAIN until one arrives, -EPIPE after the last
+    /// 流式响应的下一个事件；事件到达前返回 -EAGAIN，最后一个事件之后返回 -EPIPE
+    pub fn cchat_recv_delta(&self, response_fd: i32) -> Result<Vec<u8>, i32> {
+        let Some(entry) = self.fd_table.get(response_fd) else {
+            return Err(-EBADF);
+        };
+        let (event, streaming) = {
+            let mut e = entry.lock().map_err(|_| -EIO)?;
+            let FdInner::ChatResponse(r) = &mut e.inner else {
+                return Err(-EBADF);
+            };
+            let event = r.events.pop_front();
+            let streaming = r.streaming;
+            // A complete response stays readable for cchat_recv / 完成的响应对 cchat_recv 保持可读
+            if streaming && r.events.is_empty() {
+                e.poll_mask.remove(PollEvents::IN);
+            }
+            (event, streaming)
+        };
+        match event {
+            Some(ev) => Ok(ev),
+            None if streaming => Err(-EAGAIN),
+            None => Err(-EPIPE),
+        }
+    }
+
+    /// Put back an event the guest had no room for / 放回 guest 无空间接收的事件
+    pub fn cchat_unread_delta(&self, response_fd: i32, event: Vec<u8>) {
+        let Some(entry) = self.fd_table.get(response_fd) else {
+            return;
+        };
+        let Ok(mut e) = entry.lock() else {
+            return;
+        };
+        let FdInner::ChatResponse(r) = &mut e.inner else {
+            return;
+        };
+        r.events.push_front(event);
+        e.poll_mask.insert(PollEvents::IN);
+    }
+
     pub fn cchat_close(&self, fd: i32) -> i32 {
         self.fd_table.close(fd)
     }
@@ -648,6 +1008,23 @@ impl DefaultHostApi {
         })
     }
 
+    /// Answer a chat call that moderation stopped / 应答被审核拦下的对话调用
+    fn cchat_put_blocked(
+        &self,
+        resp_fd: i32,
+        body: &Value,
+        metrics_enabled: bool,
+    ) -> Result<i32, i32> {
+        let bytes = serde_json::to_vec(body).map_err(|_| -EIO)?;
+        let metrics_bytes = if metrics_enabled {
+            b"{}".to_vec()
+        } else {
+            Vec::new()
+        };
+        self.cchat_put_response(resp_fd, bytes, metrics_bytes)?;
+        Ok(resp_fd)
+    }
+
     fn cchat_put_response(
         &self,
         resp_fd: i32,
@@ -717,7 +1094,7 @@ impl DefaultHostApi {
                 .unwrap_or(12000)
                 .max(100)
                 .min(180_000);
-            let tools_res = self.block_on(async {
+            let tools_res = self.block_on_cancellable(async {
                 tokio::time::timeout(
                     Duration::from_millis(timeout_ms),
                     crate::spearlet::mcp::client::list_tools(server),
@@ -726,8 +1103,8 @@ impl DefaultHostApi {
             });
 
             let tools = match tools_res {
-                Ok(Ok(t)) => t,
-                Ok(Err(e)) => {
+                Ok(Ok(Ok(t))) => t,
+                Ok(Ok(Err(e))) => {
                     tracing::debug!(
                         chat_fd = snapshot.fd,
                         server_id = sid,
@@ -736,7 +1113,7 @@ impl DefaultHostApi {
                     );
                     Vec::new()
                 }
-                Err(_) => {
+                Ok(Err(_)) | Err(_) => {
                     tracing::debug!(
                         chat_fd = snapshot.fd,
                         server_id = sid,
@@ -797,13 +1174,15 @@ impl DefaultHostApi {
 
         let decision = decide_mcp_exec(&snapshot.mcp, &snapshot.params, &server, namespaced)?;
 
-        let out = self.block_on(async {
-            tokio::time::timeout(
-                Duration::from_millis(decision.timeout_ms),
-                crate::spearlet::mcp::client::call_tool(&server, &decision.tool_name, args),
-            )
-            .await
-        });
+        let out = self
+            .block_on_cancellable(async {
+                tokio::time::timeout(
+                    Duration::from_millis(decision.timeout_ms),
+                    crate::spearlet::mcp::client::call_tool(&server, &decision.tool_name, args),
+                )
+                .await
+            })
+            .map_err(cut_short)?;
 
         let v = match out {
             Ok(Ok(v)) => v,
@@ -818,6 +1197,69 @@ impl DefaultHostApi {
     }
 }
 
+impl DefaultHostApi {
+    fn cchat_exec_plugin_tool(
+        &self,
+        snapshot: &ChatSessionSnapshot,
+        namespaced: &str,
+        args: &str,
+    ) -> Result<String, String> {
+        if !plugin_tools_enabled(snapshot) {
+            return Err("tool plugins not enabled for this session".to_string());
+        }
+        let registry = self
+            .node()
+            .tool_plugins
+            .get()
+            .ok_or_else(|| "tool plugins not loaded".to_string())?;
+        let dirs = self.tool_dirs().map_err(|e| e.to_string())?;
+        self.block_on_cancellable(registry.invoke_in(namespaced, args, &dirs))
+            .map_err(cut_short)?
+    }
+}
+
+/// Tool error for a call stopped by the hostcall deadline or termination
+/// 因 hostcall 截止时间或终止而停止的调用对应的工具错误
+/// Stream event for an error body from moderation / 审核错误体对应的流事件
+fn blocked_event(body: &Value) -> Value {
+    let code = body["error"]["code"].as_str().unwrap_or("content_blocked");
+    let message = body["error"]["message"].as_str().unwrap_or_default();
+    error_event(code, message)
+}
+
+fn cut_short(errno: i32) -> String {
+    if errno == -ETIMEDOUT {
+        "hostcall deadline exceeded".to_string()
+    } else {
+        "task terminated".to_string()
+    }
+}
+
+fn plugin_tools_enabled(snapshot: &ChatSessionSnapshot) -> bool {
+    snapshot
+        .params
+        .get(chat_keys::TOOL_PLUGINS)
+        .and_then(|v| v.as_bool())
+        .unwrap_or(false)
+}
+
+/// Append plugin tool definitions when the session opts in / 会话启用时追加插件工具定义
+fn cchat_inject_plugin_tools(
+    node: &NodeServices,
+    mut snapshot: ChatSessionSnapshot,
+) -> ChatSessionSnapshot {
+    if !plugin_tools_enabled(&snapshot) {
+        return snapshot;
+    }
+    let Some(registry) = node.tool_plugins.get() else {
+        return snapshot;
+    };
+    snapshot
+        .tools
+        .extend(registry.openai_tools().into_iter().map(|s| (0, s)));
+    snapshot
+}
+
 fn build_tool_name_to_offset(tools: &[(i32, String)]) -> HashMap<String, i32> {
     let mut m: HashMap<String, i32> = HashMap::new();
     for (off, s) in tools.iter() {
@@ -0,0 +1,58 @@
+//! Compute hint hostcall / 计算提示 hostcall
+//!
+//! `compute_hint` lets a workload announce that its next phase is compute-heavy, so other
+//! tasks make room for it until the phase ends, or back to `normal` when it is done.
+//! `compute_hint` 让工作负载声明接下来的阶段为计算密集，其他任务为其让路直到阶段结束，完成后可声明
+//! 回到 `normal`。
+
+use std::time::Duration;
+
+use serde::Deserialize;
+
+use super::errno::{SPEAR_EINVAL, SPEAR_ENOENT, SPEAR_ENOSYS};
+use crate::spearlet::compute_hints::ComputeResource;
+use crate::spearlet::execution::host_api::{current_wasm_execution_id, DefaultHostApi};
+
+#[derive(Deserialize)]
+#[serde(deny_unknown_fields)]
+struct ComputeHintRequest {
+    phase: String,
+    #[serde(default)]
+    resource: Option<String>,
+    #[serde(default)]
+    duration_ms: Option<u64>,
+}
+
+impl DefaultHostApi {
+    /// Start or end a compute-heavy phase; returns the granted boost in ms, 0 for `normal`
+    /// 开始或结束计算密集阶段；返回授予的提升毫秒数，`normal` 时为 0
+    pub fn compute_hint(&self, req: &[u8]) -> Result<u32, i32> {
+        let req: ComputeHintRequest = serde_json::from_slice(req).map_err(|_| -SPEAR_EINVAL)?;
+        let resource = match req.resource.as_deref() {
+            None => ComputeResource::Cpu,
+            Some(r) => ComputeResource::parse(r).ok_or(-SPEAR_EINVAL)?,
+        };
+        let execution_id = self
+            .execution_id
+            .clone()
+            .or_else(current_wasm_execution_id)
+            .ok_or(-SPEAR_ENOENT)?;
+        match req.phase.as_str() {
+            "normal" => {
+                self.node().compute_hints.end(&execution_id);
+                Ok(0)
+            }
+            "heavy" => {
+                let task_id = self.task_id.as_deref().ok_or(-SPEAR_ENOENT)?;
+                let duration = req.duration_ms.map(Duration::from_millis);
+                let granted = self
+                    .node()
+                    .compute_hints
+                    .begin(&execution_id, task_id, resource, duration)
+                    .ok_or(-SPEAR_ENOSYS)?;
+                Ok(granted.as_millis().min(u32::MAX as u128) as u32)
+            }
+            _ => Err(-SPEAR_EINVAL),
+        }
+    }
+}
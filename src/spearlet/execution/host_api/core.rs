@@ -1,10 +1,13 @@
+use crate::spearlet::device_profile::DeviceProfile;
 use crate::spearlet::execution::ai::router::Router;
 use crate::spearlet::execution::ai::AiEngine;
 use crate::spearlet::execution::host_api::iface::{HttpCallResult, SpearHostApi};
 use crate::spearlet::execution::hostcall::fd_table::FdTable;
 use crate::spearlet::execution::ExecutionError;
-use crate::spearlet::mcp::registry_sync::{global_mcp_registry_sync, McpRegistrySyncService};
+use crate::spearlet::locale::LocaleSettings;
+use crate::spearlet::mcp::registry_sync::McpRegistrySyncService;
 use crate::spearlet::mcp::task_subset::McpTaskPolicy;
+use crate::spearlet::node_services::NodeServices;
 use dashmap::DashMap;
 use parking_lot::Mutex;
 use serde::{Deserialize, Serialize};
@@ -12,7 +15,6 @@ use std::cell::RefCell;
 use std::collections::HashMap;
 use std::collections::VecDeque;
 use std::sync::Arc;
-use std::sync::OnceLock;
 use std::time::{SystemTime, UNIX_EPOCH};
 use tracing::{debug, info, warn};
 
@@ -161,38 +163,50 @@ impl WasmLogRing {
     }
 }
 
-static WASM_LOG_RINGS: OnceLock<DashMap<String, Arc<WasmLogRing>>> = OnceLock::new();
-
-fn wasm_log_rings() -> &'static DashMap<String, Arc<WasmLogRing>> {
-    WASM_LOG_RINGS.get_or_init(DashMap::new)
+/// Log rings of the running wasm executions / 运行中 wasm 执行的日志环
+#[derive(Default)]
+pub struct WasmLogs {
+    rings: DashMap<String, Arc<WasmLogRing>>,
 }
 
 fn wasm_logs_key_for_execution(execution_id: &str) -> String {
     format!("exec:{}", execution_id)
 }
 
-pub fn get_wasm_logs_by_execution(
-    execution_id: &str,
-    since_seq: Option<u64>,
-    limit: usize,
-) -> Vec<WasmLogEntry> {
-    let out = wasm_log_rings()
-        .get(&wasm_logs_key_for_execution(execution_id))
-        .map(|r| r.read(since_seq, limit))
-        .unwrap_or_default();
-    debug!(
-        execution_id = %execution_id,
-        since_seq = since_seq.unwrap_or(0),
-        limit = limit,
-        count = out.len(),
-        logs = ?out,
-        "get_wasm_logs_by_execution"
-    );
-    out
-}
+impl WasmLogs {
+    fn ring(&self, execution_id: &str) -> Arc<WasmLogRing> {
+        self.rings
+            .entry(wasm_logs_key_for_execution(execution_id))
+            .or_insert_with(|| Arc::new(WasmLogRing::new(2048)))
+            .clone()
+    }
+
+    pub fn get_by_execution(
+        &self,
+        execution_id: &str,
+        since_seq: Option<u64>,
+        limit: usize,
+    ) -> Vec<WasmLogEntry> {
+        let out = self
+            .rings
+            .get(&wasm_logs_key_for_execution(execution_id))
+            .map(|r| r.read(since_seq, limit))
+            .unwrap_or_default();
+        debug!(
+            execution_id = %execution_id,
+            since_seq = since_seq.unwrap_or(0),
+            limit = limit,
+            count = out.len(),
+            logs = ?out,
+            "get_wasm_logs_by_execution"
+        );
+        out
+    }
 
-pub fn clear_wasm_logs_by_execution(execution_id: &str) {
-    wasm_log_rings().remove(&wasm_logs_key_for_execution(execution_id));
+    pub fn clear_by_execution(&self, execution_id: &str) {
+        self.rings
+            .remove(&wasm_logs_key_for_execution(execution_id));
+    }
 }
 
 #[derive(Clone, Debug)]
@@ -205,12 +219,20 @@ pub struct DefaultHostApi {
     pub(super) mcp_task_policy: Option<Arc<McpTaskPolicy>>,
     pub(super) instance_id: Option<String>,
     pub(super) execution_id: Option<String>,
-    pub(super) exec_termination: Arc<super::termination::WasmTerminationRegistry>,
-    pub(super) instance_termination: Arc<super::termination::WasmTerminationRegistry>,
+    pub(super) locale: LocaleSettings,
+    pub(super) devices: Arc<DeviceProfile>,
+    pub(super) onnx_last: Arc<super::onnx::LastResult>,
+    pub(super) embeddings_last: Arc<super::onnx::LastResult>,
+    pub(super) moderation_last: Arc<super::onnx::LastResult>,
+    pub(super) structured_last: Arc<super::onnx::LastResult>,
+    pub(super) image_last: Arc<super::onnx::LastResult>,
+    pub(super) tool_last: Arc<super::onnx::LastResult>,
 }
 
 impl DefaultHostApi {
     pub fn new(runtime_config: super::super::runtime::RuntimeConfig) -> Self {
+        let node = runtime_config.node.clone();
+        let runtime_config = node.live_config.with_llm(runtime_config);
         let (registry, policy) =
             super::registry::build_registry_from_runtime_config(&runtime_config);
         let grpc_filter_stream = runtime_config
@@ -224,18 +246,27 @@ impl DefaultHostApi {
                     f
                 })
             })
-            .map(
-                crate::spearlet::execution::ai::router::grpc_filter_stream::RouterFilterStreamHub::init_global,
-            )
-            .or_else(crate::spearlet::execution::ai::router::grpc_filter_stream::RouterFilterStreamHub::global)
+            .map(|f| node.router_filter.init(f))
+            .or_else(|| node.router_filter.get())
             .filter(|h| h.config.enabled);
-        let router = Router::new_with_filter(registry, policy, grpc_filter_stream);
-        let ai_engine = Arc::new(AiEngine::new(router));
+        let router = Router::new_with_filter(
+            registry,
+            policy,
+            grpc_filter_stream,
+            node.managed_backends.clone(),
+            node.provider_health.clone(),
+            node.energy.clone(),
+        );
+        let ai_engine = Arc::new(AiEngine::new(router, runtime_config.node.clone()));
 
         let mcp_registry_sync = runtime_config
             .spearlet_config
             .clone()
-            .map(|cfg| global_mcp_registry_sync(Arc::new(cfg)));
+            .map(|cfg| node.mcp_registry.init(Arc::new(cfg), None));
+        let locale = LocaleSettings::from_config(runtime_config.spearlet_config.as_ref());
+        let devices = Arc::new(DeviceProfile::from_config(
+            runtime_config.spearlet_config.as_ref(),
+        ));
         Self {
             runtime_config,
             fd_table: Arc::new(FdTable::new(1000)),
@@ -245,8 +276,14 @@ impl DefaultHostApi {
             mcp_task_policy: None,
             instance_id: None,
             execution_id: None,
-            exec_termination: super::termination::exec_registry(),
-            instance_termination: super::termination::instance_registry(),
+            locale,
+            devices,
+            onnx_last: Arc::default(),
+            embeddings_last: Arc::default(),
+            moderation_last: Arc::default(),
+            structured_last: Arc::default(),
+            image_last: Arc::default(),
+            tool_last: Arc::default(),
         }
     }
 
@@ -255,6 +292,7 @@ impl DefaultHostApi {
     }
 
     pub fn with_task_policy(mut self, task_id: String, policy: Arc<McpTaskPolicy>) -> Self {
+        self.ai_engine = Arc::new(self.ai_engine.for_task(&task_id));
         self.task_id = Some(task_id);
         self.mcp_task_policy = Some(policy);
         self
@@ -265,15 +303,44 @@ impl DefaultHostApi {
         self
     }
 
+    /// Use the locale and timezone resolved for the workload / 使用为工作负载解析的区域与时区
+    pub fn with_locale(mut self, locale: LocaleSettings) -> Self {
+        self.locale = locale;
+        self
+    }
+
+    pub fn locale(&self) -> &LocaleSettings {
+        &self.locale
+    }
+
+    /// Node-local services of the spearlet running the task / 运行该任务的 spearlet 的节点本地服务
+    pub fn node(&self) -> &NodeServices {
+        &self.runtime_config.node
+    }
+
+    /// Device profile of the spearlet host / spearlet 主机的设备描述
+    pub fn device_profile(&self) -> &DeviceProfile {
+        &self.devices
+    }
+
+    /// Device profile, or one of its sections, as JSON / 以 JSON 返回设备描述或其中一个分区
+    pub fn device_profile_json(&self, section: Option<&str>) -> Result<Vec<u8>, i32> {
+        let v = self
+            .devices
+            .query(section)
+            .map_err(|_| -super::errno::SPEAR_EINVAL)?;
+        serde_json::to_vec(&v).map_err(|_| -super::errno::SPEAR_EIO)
+    }
+
     pub fn check_wasm_termination(&self) -> Option<super::termination::TerminationSnapshot> {
         let exec_id = self.execution_id.clone().or_else(current_wasm_execution_id);
         if let Some(execution_id) = exec_id.as_deref() {
-            if let Some(s) = self.exec_termination.check(execution_id) {
+            if let Some(s) = self.node().terminations.executions.check(execution_id) {
                 return Some(s);
             }
         }
         if let Some(instance_id) = self.instance_id.as_deref() {
-            if let Some(s) = self.instance_termination.check(instance_id) {
+            if let Some(s) = self.node().terminations.instances.check(instance_id) {
                 return Some(s);
             }
         }
@@ -290,12 +357,9 @@ impl DefaultHostApi {
         let task_id = self.task_id.clone();
         let execution_id_for_entry = self.execution_id.clone().or_else(current_wasm_execution_id);
         let instance_id_for_entry = Some(instance_id.clone());
-        let ring_exec = execution_id_for_entry.as_ref().map(|execution_id| {
-            wasm_log_rings()
-                .entry(wasm_logs_key_for_execution(execution_id))
-                .or_insert_with(|| Arc::new(WasmLogRing::new(2048)))
-                .clone()
-        });
+        let ring_exec = execution_id_for_entry
+            .as_ref()
+            .map(|execution_id| self.node().wasm_logs.ring(execution_id));
         if let Some(r) = ring_exec {
             let _ = r.push(
                 ts_ms,
@@ -357,6 +421,7 @@ impl Drop for DefaultHostApi {
         }
         if Arc::strong_count(&self.fd_table) == 1 {
             self.fd_table.close_all();
+            self.node().message_passing.release(self.mp_owner());
         }
     }
 }
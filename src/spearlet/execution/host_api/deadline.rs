@@ -0,0 +1,134 @@
+//! Hostcall deadlines / hostcall 截止时间
+//!
+//! Each wasm hostcall runs under the timeout configured for it in
+//! `spearlet.execution.hostcall_timeouts`. The deadline is kept in a thread-local for the
+//! length of the call, so the code a hostcall reaches (tool plugins, MCP servers, AI
+//! backends) can bound its waits without the deadline being passed through every function.
+//! 每个 wasm hostcall 都在 `spearlet.execution.hostcall_timeouts` 为其配置的超时下运行。截止时间
+//! 在调用期间保存在线程局部变量中，hostcall 所触及的代码（工具插件、MCP 服务、AI 后端）无需逐层
+//! 传参即可限制其等待时间。
+
+use std::cell::Cell;
+use std::time::{Duration, Instant};
+
+use super::errno::SPEAR_ETIMEDOUT;
+use super::termination::WasmTerminationRegistry;
+
+/// How often [`sleep`] looks for termination / [`sleep`] 检查终止的间隔
+const TERMINATION_POLL: Duration = Duration::from_millis(50);
+
+thread_local! {
+    static DEADLINE: Cell<Option<Instant>> = const { Cell::new(None) };
+}
+
+/// Restores the enclosing deadline when dropped / 释放时恢复外层截止时间
+pub(crate) struct DeadlineGuard {
+    prev: Option<Instant>,
+}
+
+impl Drop for DeadlineGuard {
+    fn drop(&mut self) {
+        DEADLINE.with(|d| d.set(self.prev));
+    }
+}
+
+/// Start a hostcall with `timeout`; an enclosing deadline that ends sooner still applies
+/// 以 `timeout` 开始一个 hostcall；更早到期的外层截止时间依然生效
+pub(crate) fn enter(timeout: Option<Duration>) -> DeadlineGuard {
+    let prev = DEADLINE.with(|d| d.get());
+    let next = match (prev, timeout.map(|t| Instant::now() + t)) {
+        (Some(p), Some(n)) => Some(p.min(n)),
+        (p, n) => n.or(p),
+    };
+    DEADLINE.with(|d| d.set(next));
+    DeadlineGuard { prev }
+}
+
+/// Time left before the running hostcall's deadline / 当前 hostcall 距截止时间的剩余时长
+pub(crate) fn remaining() -> Option<Duration> {
+    DEADLINE
+        .with(|d| d.get())
+        .map(|t| t.saturating_duration_since(Instant::now()))
+}
+
+/// Whether the running hostcall is past its deadline / 当前 hostcall 是否已超过截止时间
+pub(crate) fn expired() -> bool {
+    remaining().is_some_and(|r| r.is_zero())
+}
+
+/// Block the calling thread for `wait`, giving up with `-ETIMEDOUT` at the deadline and
+/// with the termination errno once `executions` marks the running execution terminated
+/// 阻塞调用线程 `wait` 时长；到达截止时间时返回 `-ETIMEDOUT`，`executions` 将当前执行标记为终止时
+/// 返回终止 errno
+pub(crate) fn sleep(wait: Duration, executions: &WasmTerminationRegistry) -> Result<(), i32> {
+    let until = Instant::now() + wait;
+    let deadline = DEADLINE.with(|d| d.get()).filter(|d| *d < until);
+    let end = deadline.unwrap_or(until);
+    let execution_id = super::current_wasm_execution_id();
+    loop {
+        if let Some(s) = execution_id.as_deref().and_then(|id| executions.check(id)) {
+            return Err(s.errno);
+        }
+        let now = Instant::now();
+        if now >= end {
+            return match deadline {
+                Some(_) => Err(-SPEAR_ETIMEDOUT),
+                None => Ok(()),
+            };
+        }
+        std::thread::sleep((end - now).min(TERMINATION_POLL));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::host_api::termination::Terminations;
+
+    #[test]
+    fn test_enter_keeps_the_sooner_deadline() {
+        assert!(remaining().is_none());
+        {
+            let _outer = enter(Some(Duration::from_millis(50)));
+            {
+                let _inner = enter(Some(Duration::from_secs(60)));
+                assert!(remaining().unwrap() <= Duration::from_millis(50));
+            }
+            {
+                let _inner = enter(None);
+                assert!(remaining().is_some());
+            }
+            std::thread::sleep(Duration::from_millis(60));
+            assert!(expired());
+        }
+        assert!(remaining().is_none());
+        assert!(!expired());
+    }
+
+    #[test]
+    fn test_sleep_stops_at_deadline_and_termination() {
+        let terminations = Terminations::default();
+        let executions = terminations.executions.clone();
+        assert_eq!(sleep(Duration::from_millis(5), &executions), Ok(()));
+        {
+            let _deadline = enter(Some(Duration::from_millis(30)));
+            let started = Instant::now();
+            assert_eq!(
+                sleep(Duration::from_secs(10), &executions),
+                Err(-SPEAR_ETIMEDOUT)
+            );
+            assert!(started.elapsed() < Duration::from_secs(1));
+        }
+
+        super::super::set_current_wasm_execution_id(Some("exec-sleep".to_string()));
+        let marker = std::thread::spawn(move || {
+            std::thread::sleep(Duration::from_millis(30));
+            terminations.mark_execution_terminated("exec-sleep", -125, None);
+        });
+        let started = Instant::now();
+        assert_eq!(sleep(Duration::from_secs(10), &executions), Err(-125));
+        assert!(started.elapsed() < Duration::from_secs(1));
+        marker.join().unwrap();
+        super::super::set_current_wasm_execution_id(None);
+    }
+}
@@ -0,0 +1,213 @@
+//! Shared slots for slow hostcalls / 慢速 hostcall 的共享槽位
+//!
+//! Hostcalls listed in `spearlet.execution.hostcall_pool.methods` take a slot for as long
+//! as they run. A call first takes one of its task's `max_per_task` slots, then one of the
+//! node's `max_concurrent`; both are `tokio` semaphores held by the spearlet's
+//! [`NodeServices`](crate::spearlet::node_services::NodeServices). Calls wait for node slots
+//! first come, first served, and a task never has more than `max_per_task` calls in that
+//! queue, so a task issuing many slow AI or tool calls cannot starve the others. Waits end
+//! at the hostcall deadline or when the task is terminated.
+//! `spearlet.execution.hostcall_pool.methods` 中列出的 hostcall 在运行期间占用一个槽位。调用先获取
+//! 所属任务 `max_per_task` 个槽位中的一个，再获取节点 `max_concurrent` 个槽位中的一个；两者均为
+//! spearlet 的 [`NodeServices`](crate::spearlet::node_services::NodeServices) 持有的 `tokio`
+//! 信号量。调用按先来先得等待节点槽位，且单个任务在该队列中的调用不超过 `max_per_task` 个，使发出
+//! 大量慢速 AI 或工具调用的任务无法饿死其他任务。等待在 hostcall 截止时间到达或任务被终止时结束。
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::Mutex;
+use tokio::sync::{OwnedSemaphorePermit, Semaphore};
+
+use crate::spearlet::config::HostcallPoolConfig;
+use crate::spearlet::execution::host_api::DefaultHostApi;
+
+/// Waits at least this long are logged / 至少等待这么久的调用会被记录
+const LOGGED_WAIT: Duration = Duration::from_millis(50);
+
+/// Semaphore and the limit it was sized for / 信号量及其对应的上限
+type Slots = (usize, Arc<Semaphore>);
+
+/// Slots for slow hostcalls on one spearlet / 单个 spearlet 上慢速 hostcall 的槽位
+///
+/// A changed limit applies to calls that start after the change.
+/// 上限变更后对之后开始的调用生效。
+#[derive(Debug, Default)]
+pub struct HostcallPool {
+    /// Node-wide slots / 节点级槽位
+    node: Mutex<Option<Slots>>,
+    /// Slots per task, kept while the task holds or waits for one / 各任务的槽位，在任务占用或等待时保留
+    tasks: Arc<Mutex<HashMap<String, Slots>>>,
+}
+
+/// Slot held by a running hostcall / 运行中的 hostcall 占用的槽位
+pub(crate) struct PoolSlot {
+    task: Option<OwnedSemaphorePermit>,
+    node: Option<OwnedSemaphorePermit>,
+    tasks: Arc<Mutex<HashMap<String, Slots>>>,
+    task_id: String,
+}
+
+impl Drop for PoolSlot {
+    fn drop(&mut self) {
+        self.node.take();
+        if self.task.take().is_none() {
+            return;
+        }
+        // Only the map refers to an idle task's semaphore / 空闲任务的信号量只被映射引用
+        let mut tasks = self.tasks.lock();
+        if tasks
+            .get(&self.task_id)
+            .is_some_and(|(_, s)| Arc::strong_count(s) == 1)
+        {
+            tasks.remove(&self.task_id);
+        }
+    }
+}
+
+/// Semaphore of `limit` permits in `slot`, replaced when the limit changed; `None` for 0
+/// `slot` 中具有 `limit` 个许可的信号量，上限变更时替换；为 0 时返回 `None`
+fn sized(slot: &mut Option<Slots>, limit: usize) -> Option<Arc<Semaphore>> {
+    if limit == 0 {
+        *slot = None;
+        return None;
+    }
+    match slot {
+        Some((n, sem)) if *n == limit => Some(sem.clone()),
+        _ => {
+            let sem = Arc::new(Semaphore::new(limit));
+            *slot = Some((limit, sem.clone()));
+            Some(sem)
+        }
+    }
+}
+
+impl HostcallPool {
+    /// Take a slot for `task_id`: one of the task's, then one of the node's
+    /// 为 `task_id` 获取槽位：先取任务的，再取节点的
+    pub(crate) async fn acquire(&self, task_id: &str, cfg: &HostcallPoolConfig) -> PoolSlot {
+        let task_sem = {
+            let mut tasks = self.tasks.lock();
+            let mut slot = tasks.remove(task_id);
+            let sem = sized(&mut slot, cfg.max_per_task);
+            if let Some(slot) = slot {
+                tasks.insert(task_id.to_string(), slot);
+            }
+            sem
+        };
+        let node_sem = sized(&mut self.node.lock(), cfg.max_concurrent);
+        let mut slot = PoolSlot {
+            task: None,
+            node: None,
+            tasks: self.tasks.clone(),
+            task_id: task_id.to_string(),
+        };
+        // Neither semaphore is ever closed / 两个信号量都不会被关闭
+        if let Some(sem) = task_sem {
+            slot.task = sem.acquire_owned().await.ok();
+        }
+        if let Some(sem) = node_sem {
+            slot.node = sem.acquire_owned().await.ok();
+        }
+        slot
+    }
+}
+
+impl DefaultHostApi {
+    /// Take a slot when `method` is a pooled hostcall / 当 `method` 属于受限 hostcall 时获取槽位
+    ///
+    /// Fails with `-ETIMEDOUT` at the hostcall deadline, or with the termination errno.
+    /// 在 hostcall 截止时间返回 `-ETIMEDOUT`，或返回终止 errno。
+    pub(crate) fn enter_hostcall_pool(&self, method: &str) -> Result<Option<PoolSlot>, i32> {
+        let Some(cfg) = self
+            .runtime_config
+            .spearlet_config
+            .as_ref()
+            .map(|c| &c.execution.hostcall_pool)
+        else {
+            return Ok(None);
+        };
+        if !cfg.methods.iter().any(|m| m == method) {
+            return Ok(None);
+        }
+        let task_id = self.task_id.clone().unwrap_or_default();
+        let started = Instant::now();
+        let slot = self.block_on_cancellable(self.node().hostcall_pool.acquire(&task_id, cfg))?;
+        let waited = started.elapsed();
+        if waited >= LOGGED_WAIT {
+            tracing::debug!(
+                task_id = %task_id,
+                method = %method,
+                waited_ms = waited.as_millis() as u64,
+                "Hostcall waited for a pool slot"
+            );
+        }
+        Ok(Some(slot))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::sync::mpsc;
+    use tokio::time::timeout;
+
+    fn config(max_concurrent: usize, max_per_task: usize) -> HostcallPoolConfig {
+        HostcallPoolConfig {
+            max_concurrent,
+            max_per_task,
+            ..Default::default()
+        }
+    }
+
+    async fn waits(pool: &HostcallPool, task_id: &str, cfg: &HostcallPoolConfig) -> bool {
+        timeout(Duration::from_millis(60), pool.acquire(task_id, cfg))
+            .await
+            .is_err()
+    }
+
+    #[tokio::test]
+    async fn test_per_task_cap_leaves_room_for_others() {
+        let pool = HostcallPool::default();
+        let cfg = config(3, 2);
+        let _a1 = pool.acquire("a", &cfg).await;
+        let _a2 = pool.acquire("a", &cfg).await;
+        let b1 = pool.acquire("b", &cfg).await;
+
+        assert!(waits(&pool, "a", &cfg).await);
+        assert!(waits(&pool, "c", &cfg).await);
+        drop(b1);
+        let _c1 = pool.acquire("c", &cfg).await;
+        assert!(!pool.tasks.lock().contains_key("b"));
+    }
+
+    #[tokio::test]
+    async fn test_task_over_its_cap_does_not_queue_ahead() {
+        let pool = Arc::new(HostcallPool::default());
+        let cfg = config(1, 1);
+        let held = pool.acquire("busy", &cfg).await;
+
+        // Task "busy" queues a second call before "quiet" queues one
+        // 任务 "busy" 在 "quiet" 排队前先排了第二个调用
+        let (tx, mut rx) = mpsc::unbounded_channel();
+        let mut joins = Vec::new();
+        for task in ["busy", "quiet"] {
+            let (pool, cfg, tx) = (pool.clone(), cfg.clone(), tx.clone());
+            joins.push(tokio::spawn(async move {
+                let slot = pool.acquire(task, &cfg).await;
+                tx.send(task).unwrap();
+                tokio::time::sleep(Duration::from_millis(20)).await;
+                drop(slot);
+            }));
+            tokio::time::sleep(Duration::from_millis(30)).await;
+        }
+        drop(held);
+        assert_eq!(rx.recv().await, Some("quiet"));
+        assert_eq!(rx.recv().await, Some("busy"));
+        for j in joins {
+            j.await.unwrap();
+        }
+        assert!(pool.tasks.lock().is_empty());
+    }
+}
@@ -0,0 +1,111 @@
+//! Embeddings hostcall / 嵌入向量 hostcall
+//!
+//! The guest sends one JSON request with a text or a batch of texts; the AI router picks a
+//! backend configured with `ops = ["embeddings"]` and the vectors come back as JSON, in
+//! input order. As with `onnx_infer`, a result that does not fit the guest buffer is kept
+//! for the retry. With `response_cache` on, identical requests are answered from the cache.
+//! guest 发送一个包含单个文本或一批文本的 JSON 请求；AI 路由器选择配置了 `ops = ["embeddings"]`
+//! 的后端，向量按输入顺序以 JSON 返回。与 `onnx_infer` 相同，放不进 guest 缓冲区的结果会保留给重试。
+//! 启用 `response_cache` 时，相同的请求由缓存应答。
+
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+
+use super::deadline;
+use super::errno::{SPEAR_EDQUOT, SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOSYS, SPEAR_ETIMEDOUT};
+use crate::spearlet::execution::ai::ir::{Payload, ResultPayload};
+use crate::spearlet::execution::ai::normalize::embeddings::{
+    normalize_embeddings, EmbeddingsRequest,
+};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::execution::ExecutionError;
+use crate::spearlet::response_cache;
+
+/// Texts a single request may carry / 单个请求可携带的文本数
+pub const MAX_EMBEDDINGS_INPUTS: usize = 2048;
+
+/// Total input bytes a single request may carry / 单个请求可携带的输入总字节数
+pub const MAX_EMBEDDINGS_INPUT_BYTES: usize = 1024 * 1024;
+
+fn errno(e: &ExecutionError) -> i32 {
+    if deadline::expired() {
+        return -SPEAR_ETIMEDOUT;
+    }
+    -match e {
+        ExecutionError::InvalidRequest { .. } => SPEAR_EINVAL,
+        ExecutionError::NotSupported { .. } => SPEAR_ENOSYS,
+        ExecutionError::ResourceExhausted { .. } => SPEAR_EDQUOT,
+        _ => SPEAR_EIO,
+    }
+}
+
+impl DefaultHostApi {
+    /// Run an `embeddings` request / 执行 `embeddings` 请求
+    pub fn embeddings(&self, request: &[u8]) -> Result<Vec<u8>, i32> {
+        let digest: [u8; 32] = Sha256::digest(request).into();
+        if let Some((d, out)) = self.embeddings_last.0.lock().take() {
+            if d == digest {
+                return Ok(out);
+            }
+        }
+        let req: EmbeddingsRequest = serde_json::from_slice(request).map_err(|_| -SPEAR_EINVAL)?;
+        let req = normalize_embeddings(req);
+        let Payload::Embeddings(p) = &req.payload else {
+            return Err(-SPEAR_EINVAL);
+        };
+        let bytes: usize = p.input.iter().map(|s| s.len()).sum();
+        if p.input.is_empty()
+            || p.input.len() > MAX_EMBEDDINGS_INPUTS
+            || bytes > MAX_EMBEDDINGS_INPUT_BYTES
+            || p.dimensions == Some(0)
+        {
+            return Err(-SPEAR_EINVAL);
+        }
+        let inputs = p.input.len();
+
+        let cache = &self.node().response_cache;
+        let cache_key = cache
+            .caches("embeddings")
+            .then(|| response_cache::request_key(&req));
+        if let Some(out) = cache_key.as_deref().and_then(|k| cache.get(k)) {
+            *self.embeddings_last.0.lock() = Some((digest, out.clone()));
+            return Ok(out);
+        }
+
+        let resp = self.ai_engine.invoke(&req).map_err(|e| {
+            tracing::warn!(inputs, error = %e, "embeddings failed");
+            errno(&e)
+        })?;
+        let v = match resp.result {
+            ResultPayload::Payload(v) => v,
+            ResultPayload::Error(e) => {
+                tracing::warn!(inputs, code = %e.code, error = %e.message, "embeddings failed");
+                return Err(-SPEAR_EIO);
+            }
+        };
+        let embeddings = v.get("data").cloned().unwrap_or(Value::Null);
+        if embeddings.as_array().map(|a| a.len()) != Some(inputs) {
+            tracing::warn!(inputs, backend = %resp.backend, "embeddings count mismatch");
+            return Err(-SPEAR_EIO);
+        }
+        let out = json!({
+            "backend": resp.backend,
+            "model": v.get("model").cloned().unwrap_or(Value::Null),
+            "dimensions": v.get("dimensions").cloned().unwrap_or(Value::Null),
+            "embeddings": embeddings,
+            "usage": v.get("usage").cloned().unwrap_or(Value::Null),
+        });
+        let out = serde_json::to_vec(&out).map_err(|_| -SPEAR_EIO)?;
+        if let Some(k) = &cache_key {
+            cache.put(k, &out);
+        }
+        *self.embeddings_last.0.lock() = Some((digest, out.clone()));
+        Ok(out)
+    }
+
+    /// The guest received the result; drop the copy kept for a retry
+    /// guest 已收到结果；丢弃为重试保留的副本
+    pub fn embeddings_delivered(&self) {
+        self.embeddings_last.0.lock().take();
+    }
+}
@@ -5,14 +5,18 @@ pub const SPEAR_EBADF: i32 = 9;
 pub const SPEAR_EAGAIN: i32 = 11;
 pub const SPEAR_ENOMEM: i32 = 12;
 pub const SPEAR_EFAULT: i32 = 14;
+pub const SPEAR_EEXIST: i32 = 17;
 pub const SPEAR_EACCES: i32 = 13;
 pub const SPEAR_EINVAL: i32 = 22;
+pub const SPEAR_EFBIG: i32 = 27;
 pub const SPEAR_ENOSPC: i32 = 28;
 pub const SPEAR_EPIPE: i32 = 32;
 pub const SPEAR_ENOSYS: i32 = 38;
 pub const SPEAR_ECONNRESET: i32 = 104;
 pub const SPEAR_ENOTCONN: i32 = 107;
+pub const SPEAR_ESHUTDOWN: i32 = 108;
 pub const SPEAR_ETIMEDOUT: i32 = 110;
+pub const SPEAR_EDQUOT: i32 = 122;
 
 pub const EPERM: i32 = SPEAR_EPERM;
 pub const ENOENT: i32 = SPEAR_ENOENT;
@@ -22,13 +26,17 @@ pub const EAGAIN: i32 = SPEAR_EAGAIN;
 pub const ENOMEM: i32 = SPEAR_ENOMEM;
 pub const EFAULT: i32 = SPEAR_EFAULT;
 pub const EACCES: i32 = SPEAR_EACCES;
+pub const EEXIST: i32 = SPEAR_EEXIST;
 pub const EINVAL: i32 = SPEAR_EINVAL;
+pub const EFBIG: i32 = SPEAR_EFBIG;
 pub const ENOSPC: i32 = SPEAR_ENOSPC;
 pub const EPIPE: i32 = SPEAR_EPIPE;
 pub const ENOSYS: i32 = SPEAR_ENOSYS;
 pub const ECONNRESET: i32 = SPEAR_ECONNRESET;
 pub const ENOTCONN: i32 = SPEAR_ENOTCONN;
+pub const ESHUTDOWN: i32 = SPEAR_ESHUTDOWN;
 pub const ETIMEDOUT: i32 = SPEAR_ETIMEDOUT;
+pub const EDQUOT: i32 = SPEAR_EDQUOT;
 
 pub const SPEAR_OK: i32 = 0;
 
@@ -0,0 +1,74 @@
+//! Scratch file hostcalls / 临时文件 hostcall
+//!
+//! Paths are UTF-8 and scoped to the calling task: relative paths resolve in its scratch
+//! directory and `/mnt/<name>/...` in a shared mount. `file_list` returns the entries of a
+//! directory as a JSON array.
+//! 路径为 UTF-8，作用域为调用任务：相对路径在其临时目录中解析，`/mnt/<name>/...` 在共享挂载中解析。
+//! `file_list` 以 JSON 数组返回目录中的条目。
+
+use super::errno::{
+    SPEAR_EACCES, SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOENT, SPEAR_ENOSPC, SPEAR_ENOSYS,
+};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::scratch_files::FileError;
+
+fn errno(e: &FileError) -> i32 {
+    -match e {
+        FileError::Disabled => SPEAR_ENOSYS,
+        FileError::Invalid(_) => SPEAR_EINVAL,
+        FileError::NotFound(_) => SPEAR_ENOENT,
+        FileError::ReadOnly(_) => SPEAR_EACCES,
+        FileError::Full => SPEAR_ENOSPC,
+        FileError::Io(_) => SPEAR_EIO,
+    }
+}
+
+fn path(bytes: &[u8]) -> Result<&str, i32> {
+    std::str::from_utf8(bytes).map_err(|_| -SPEAR_EINVAL)
+}
+
+impl DefaultHostApi {
+    fn file_task(&self) -> &str {
+        self.task_id.as_deref().unwrap_or("")
+    }
+
+    fn file_failed(&self, op: &str, e: FileError) -> i32 {
+        // A missing file is an answer, not a failure / 文件不存在是一种结果而非失败
+        if !matches!(e, FileError::NotFound(_)) {
+            tracing::warn!(task_id = %self.file_task(), op, error = %e, "file call failed");
+        }
+        errno(&e)
+    }
+
+    pub fn file_read(&self, path_bytes: &[u8]) -> Result<Vec<u8>, i32> {
+        self.node()
+            .scratch_files
+            .read(self.file_task(), path(path_bytes)?)
+            .map_err(|e| self.file_failed("file_read", e))
+    }
+
+    /// Create or replace a file / 创建或替换文件
+    pub fn file_write(&self, path_bytes: &[u8], data: &[u8]) -> Result<(), i32> {
+        self.node()
+            .scratch_files
+            .write(self.file_task(), path(path_bytes)?, data)
+            .map_err(|e| self.file_failed("file_write", e))
+    }
+
+    /// Entries of a directory as a JSON array / 以 JSON 数组返回目录中的条目
+    pub fn file_list(&self, path_bytes: &[u8]) -> Result<Vec<u8>, i32> {
+        let entries = self
+            .node()
+            .scratch_files
+            .list(self.file_task(), path(path_bytes)?)
+            .map_err(|e| self.file_failed("file_list", e))?;
+        serde_json::to_vec(&entries).map_err(|_| -SPEAR_EIO)
+    }
+
+    pub fn file_delete(&self, path_bytes: &[u8]) -> Result<(), i32> {
+        self.node()
+            .scratch_files
+            .delete(self.file_task(), path(path_bytes)?)
+            .map_err(|e| self.file_failed("file_delete", e))
+    }
+}
@@ -0,0 +1,122 @@
+//! Image generation hostcall / 图像生成 hostcall
+//!
+//! The guest sends one JSON request with a prompt; the AI router picks a backend configured
+//! with `ops = ["image_generation"]` (DALL-E or Stability-compatible) and the images come
+//! back as JSON, either as URLs or inline base64. Inline images are capped by
+//! `llm.image_generation.max_inline_bytes`, which a request may lower but not raise; a
+//! larger answer fails with `-EFBIG`. As with `embeddings`, a result that does not fit the
+//! guest buffer is kept for the retry.
+//! guest 发送一个包含提示词的 JSON 请求；AI 路由器选择配置了 `ops = ["image_generation"]` 的后端
+//! （DALL-E 或兼容 Stability 的服务），图像以 JSON 返回，形式为 URL 或内联 base64。内联图像受
+//! `llm.image_generation.max_inline_bytes` 限制，请求可调低但不能调高；超出时返回 `-EFBIG`。
+//! 与 `embeddings` 相同，放不进 guest 缓冲区的结果会保留给重试。
+
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+
+use super::deadline;
+use super::errno::{
+    SPEAR_EDQUOT, SPEAR_EFBIG, SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOSYS, SPEAR_ETIMEDOUT,
+};
+use crate::spearlet::execution::ai::ir::{Payload, ResultPayload};
+use crate::spearlet::execution::ai::normalize::image::{
+    normalize_image_generation, parse_size, ImageGenerationRequest,
+};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::execution::ExecutionError;
+
+/// Images a single request may ask for / 单个请求可生成的图像数
+pub const MAX_IMAGES: u32 = 10;
+
+/// Prompt bytes a single request may carry / 单个请求提示词的最大字节数
+pub const MAX_IMAGE_PROMPT_BYTES: usize = 32 * 1024;
+
+fn errno(e: &ExecutionError) -> i32 {
+    if deadline::expired() {
+        return -SPEAR_ETIMEDOUT;
+    }
+    -match e {
+        ExecutionError::InvalidRequest { .. } => SPEAR_EINVAL,
+        ExecutionError::NotSupported { .. } => SPEAR_ENOSYS,
+        ExecutionError::ResourceExhausted { .. } => SPEAR_EDQUOT,
+        _ => SPEAR_EIO,
+    }
+}
+
+impl DefaultHostApi {
+    /// Run an `image_generate` request / 执行 `image_generate` 请求
+    pub fn image_generate(&self, request: &[u8]) -> Result<Vec<u8>, i32> {
+        let digest: [u8; 32] = Sha256::digest(request).into();
+        if let Some((d, out)) = self.image_last.0.lock().take() {
+            if d == digest {
+                return Ok(out);
+            }
+        }
+        let req: ImageGenerationRequest =
+            serde_json::from_slice(request).map_err(|_| -SPEAR_EINVAL)?;
+        let node_cap = self
+            .runtime_config
+            .spearlet_config
+            .as_ref()
+            .map(|c| c.llm.image_generation.clone())
+            .unwrap_or_default()
+            .max_inline_bytes;
+        let cap = req.max_inline_bytes.map_or(node_cap, |b| b.min(node_cap));
+        let req = normalize_image_generation(req);
+        let Payload::ImageGeneration(p) = &req.payload else {
+            return Err(-SPEAR_EINVAL);
+        };
+        if p.prompt.trim().is_empty()
+            || p.prompt.len() > MAX_IMAGE_PROMPT_BYTES
+            || p.n.is_some_and(|n| n == 0 || n > MAX_IMAGES)
+            || p.size.as_deref().is_some_and(|s| parse_size(s).is_none())
+            || !matches!(
+                p.response_format.as_deref(),
+                None | Some("url" | "b64_json")
+            )
+        {
+            return Err(-SPEAR_EINVAL);
+        }
+
+        let resp = self.ai_engine.invoke(&req).map_err(|e| {
+            tracing::warn!(error = %e, "image_generate failed");
+            errno(&e)
+        })?;
+        let v = match resp.result {
+            ResultPayload::Payload(v) => v,
+            ResultPayload::Error(e) => {
+                tracing::warn!(code = %e.code, error = %e.message, "image_generate failed");
+                return Err(-SPEAR_EIO);
+            }
+        };
+        let images = v.get("images").cloned().unwrap_or(Value::Null);
+        let Some(list) = images.as_array().filter(|a| !a.is_empty()) else {
+            tracing::warn!(backend = %resp.backend, "image_generate returned no images");
+            return Err(-SPEAR_EIO);
+        };
+        let inline: usize = list
+            .iter()
+            .filter_map(|i| i.get("b64_json").and_then(|b| b.as_str()))
+            .map(|b| b.len())
+            .sum();
+        if inline > cap {
+            tracing::warn!(backend = %resp.backend, inline, cap, "image_generate result too large");
+            return Err(-SPEAR_EFBIG);
+        }
+        let out = json!({
+            "backend": resp.backend,
+            "model": v.get("model").cloned().unwrap_or(Value::Null),
+            "created": v.get("created").cloned().unwrap_or(Value::Null),
+            "images": images,
+        });
+        let out = serde_json::to_vec(&out).map_err(|_| -SPEAR_EIO)?;
+        *self.image_last.0.lock() = Some((digest, out.clone()));
+        Ok(out)
+    }
+
+    /// The guest received the result; drop the copy kept for a retry
+    /// guest 已收到结果；丢弃为重试保留的副本
+    pub fn image_generate_delivered(&self) {
+        self.image_last.0.lock().take();
+    }
+}
@@ -0,0 +1,96 @@
+//! Child workload invocation hostcalls / 子工作负载调用 hostcall
+//!
+//! `invoke_start` takes a JSON request and returns a handle at once; `invoke_next` returns
+//! the child's events as JSON, `frame` events while it streams and a final `done`. Waits
+//! are cut into short slices so a terminated caller stops waiting.
+//! `invoke_start` 接收 JSON 请求并立即返回句柄；`invoke_next` 以 JSON 返回子调用的事件：流式输出时为
+//! `frame` 事件，最后为 `done`。等待被切分为短时间片，使被终止的调用方能够停止等待。
+
+use std::time::{Duration, Instant};
+
+use super::errno::{
+    SPEAR_EAGAIN, SPEAR_EBADF, SPEAR_EINVAL, SPEAR_ENOSYS, SPEAR_EPERM, SPEAR_ETIMEDOUT,
+};
+use crate::spearlet::execution::child_invoke::{ChildError, ChildRequest};
+use crate::spearlet::execution::host_api::{current_wasm_execution_id, DefaultHostApi};
+
+const WAIT_SLICE: Duration = Duration::from_millis(10);
+
+fn errno(e: &ChildError) -> i32 {
+    -match e {
+        ChildError::Disabled => SPEAR_ENOSYS,
+        ChildError::Invalid(_) => SPEAR_EINVAL,
+        ChildError::NotFound(_) => SPEAR_EBADF,
+        ChildError::TooDeep(_) => SPEAR_EPERM,
+        ChildError::TooMany(_) | ChildError::Empty => SPEAR_EAGAIN,
+    }
+}
+
+impl DefaultHostApi {
+    fn invoke_parent(&self) -> String {
+        self.execution_id
+            .clone()
+            .or_else(current_wasm_execution_id)
+            .unwrap_or_default()
+    }
+
+    /// Start a child invocation; returns its handle / 启动子调用；返回其句柄
+    pub fn invoke_start(&self, req: &[u8]) -> Result<u32, i32> {
+        let req: ChildRequest = serde_json::from_slice(req).map_err(|_| -SPEAR_EINVAL)?;
+        let cfg = self
+            .runtime_config
+            .spearlet_config
+            .as_ref()
+            .map(|c| c.execution.child_invoke.clone())
+            .unwrap_or_default();
+        let parent = self.invoke_parent();
+        let (handle, run) = self
+            .node()
+            .child_invoke
+            .start(&parent, &cfg, req)
+            .map_err(|e| {
+                tracing::warn!(execution_id = %parent, error = %e, "invoke_start failed");
+                errno(&e)
+            })?;
+        self.spawn_background(run);
+        Ok(handle)
+    }
+
+    /// Next event of a child as JSON; 0 polls once and a negative timeout waits until one
+    /// arrives
+    /// 以 JSON 返回子调用的下一个事件；0 只轮询一次，负数超时一直等待
+    pub fn invoke_next(
+        &self,
+        handle: u32,
+        max_len: usize,
+        timeout_ms: i32,
+    ) -> Result<Vec<u8>, i32> {
+        let parent = self.invoke_parent();
+        let deadline =
+            (timeout_ms > 0).then(|| Instant::now() + Duration::from_millis(timeout_ms as u64));
+        loop {
+            match self.node().child_invoke.next(&parent, handle, max_len) {
+                Err(ChildError::Empty) => {}
+                r => return r.map_err(|e| errno(&e)),
+            }
+            if timeout_ms == 0 {
+                return Err(-SPEAR_EAGAIN);
+            }
+            if deadline.is_some_and(|d| Instant::now() >= d) {
+                return Err(-SPEAR_ETIMEDOUT);
+            }
+            if self.check_wasm_termination().is_some() {
+                return Err(-SPEAR_EAGAIN);
+            }
+            std::thread::sleep(WAIT_SLICE);
+        }
+    }
+
+    /// Cancel a child and close its handle / 取消子调用并关闭其句柄
+    pub fn invoke_cancel(&self, handle: u32) -> Result<(), i32> {
+        self.node()
+            .child_invoke
+            .cancel(&self.invoke_parent(), handle)
+            .map_err(|e| errno(&e))
+    }
+}
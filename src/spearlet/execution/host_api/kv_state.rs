@@ -0,0 +1,74 @@
+//! Key-value state hostcalls / 键值状态 hostcall
+//!
+//! Keys are UTF-8 strings scoped to the calling task, so the task id is the namespace handed
+//! to the store; values are opaque bytes. `kv_list` returns matching keys as a JSON array.
+//! 键为 UTF-8 字符串，作用域为调用任务，因此任务 ID 即交给存储的命名空间；值为不透明字节。
+//! `kv_list` 以 JSON 数组返回匹配的键。
+
+use super::errno::{SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOENT, SPEAR_ENOMEM, SPEAR_ENOSYS};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::kv_state::KvError;
+
+fn errno(e: &KvError) -> i32 {
+    -match e {
+        KvError::Disabled => SPEAR_ENOSYS,
+        KvError::Invalid(_) => SPEAR_EINVAL,
+        KvError::NotFound(_) => SPEAR_ENOENT,
+        KvError::Full => SPEAR_ENOMEM,
+        KvError::Store(_) => SPEAR_EIO,
+    }
+}
+
+fn key(bytes: &[u8]) -> Result<&str, i32> {
+    std::str::from_utf8(bytes).map_err(|_| -SPEAR_EINVAL)
+}
+
+impl DefaultHostApi {
+    fn kv_namespace(&self) -> &str {
+        self.task_id.as_deref().unwrap_or("")
+    }
+
+    fn kv_failed(&self, op: &str, e: KvError) -> i32 {
+        // A missing key is an answer, not a failure / 键不存在是一种结果而非失败
+        if !matches!(e, KvError::NotFound(_)) {
+            tracing::warn!(task_id = %self.kv_namespace(), op, error = %e, "kv state call failed");
+        }
+        errno(&e)
+    }
+
+    pub fn kv_get(&self, key_bytes: &[u8]) -> Result<Vec<u8>, i32> {
+        self.block_on(
+            self.node()
+                .kv_state
+                .get(self.kv_namespace(), key(key_bytes)?),
+        )
+        .map_err(|e| self.kv_failed("kv_get", e))
+    }
+
+    /// Set a key; `ttl_s` of 0 keeps it until deleted / 设置键；`ttl_s` 为 0 时保留至删除
+    pub fn kv_set(&self, key_bytes: &[u8], value: &[u8], ttl_s: u64) -> Result<(), i32> {
+        self.block_on(
+            self.node()
+                .kv_state
+                .set(self.kv_namespace(), key(key_bytes)?, value, ttl_s),
+        )
+        .map_err(|e| self.kv_failed("kv_set", e))
+    }
+
+    pub fn kv_delete(&self, key_bytes: &[u8]) -> Result<(), i32> {
+        self.block_on(
+            self.node()
+                .kv_state
+                .delete(self.kv_namespace(), key(key_bytes)?),
+        )
+        .map_err(|e| self.kv_failed("kv_delete", e))
+    }
+
+    /// Keys starting with `prefix` as a JSON array / 以 JSON 数组返回以 `prefix` 开头的键
+    pub fn kv_list(&self, prefix: &[u8]) -> Result<Vec<u8>, i32> {
+        let keys = self
+            .block_on(self.node().kv_state.list(self.kv_namespace(), key(prefix)?))
+            .map_err(|e| self.kv_failed("kv_list", e))?;
+        serde_json::to_vec(&keys).map_err(|_| -SPEAR_EIO)
+    }
+}
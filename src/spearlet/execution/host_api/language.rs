@@ -0,0 +1,477 @@
+//! Spoken language detection for ASR sessions
+//! ASR 会话的语种检测
+//!
+//! The language of an rt-asr session comes from, in order of precedence:
+//! rt-asr 会话的语种来源（按优先级）：
+//!
+//! 1. the `language` param set by the guest (`configured`), also forwarded to the
+//!    provider as a transcription hint / 客户端设置的 `language` 参数（`configured`），
+//!    同时作为转写提示转发给服务商
+//! 2. a language reported by the provider in its events (`provider`)
+//!    服务商在事件中报告的语种（`provider`）
+//! 3. a local script and stop-word classifier over completed transcripts (`local`)
+//!    基于已完成转写文本的本地文字与停用词分类器（`local`）
+//!
+//! The result is stored per session (execution, else instance) so that later hostcalls
+//! of the same session, such as chat-based translation or TTS, default to it.
+//! 结果按会话（执行，否则实例）保存，使同一会话中后续的 hostcall（如基于对话的翻译或 TTS）
+//! 以其为默认值。
+
+use dashmap::DashMap;
+use serde::Serialize;
+use serde_json::Value;
+
+use crate::spearlet::execution::ai::ir::CanonicalRequestEnvelope;
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::execution::hostcall::fd_table::FdTable;
+use crate::spearlet::execution::hostcall::types::FdInner;
+use crate::spearlet::param_keys::rtasr as rtasr_keys;
+
+/// Request meta key carrying the session language / 携带会话语种的请求 meta 键
+pub const META_LANGUAGE: &str = "language";
+
+/// Local detections below this confidence are ignored / 低于该置信度的本地检测结果将被忽略
+const MIN_LOCAL_CONFIDENCE: f32 = 0.5;
+/// Upper bound of remembered sessions / 记录的会话数上限
+const MAX_SESSIONS: usize = 1024;
+
+/// Where a language came from / 语种来源
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum LanguageSource {
+    Configured,
+    Provider,
+    Local,
+}
+
+/// Language of a session / 会话语种
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct DetectedLanguage {
+    /// ISO 639-1 code such as `en` or `zh` / ISO 639-1 代码，如 `en` 或 `zh`
+    pub code: String,
+    pub source: LanguageSource,
+    pub confidence: f32,
+    pub detected_at_ms: i64,
+}
+
+impl DetectedLanguage {
+    /// Language set explicitly by the guest / 客户端显式设置的语种
+    pub(crate) fn configured(code: String) -> Self {
+        Self::new(code, LanguageSource::Configured, 1.0)
+    }
+
+    fn new(code: String, source: LanguageSource, confidence: f32) -> Self {
+        Self {
+            code,
+            source,
+            confidence,
+            detected_at_ms: chrono::Utc::now().timestamp_millis(),
+        }
+    }
+}
+
+/// Normalize a language tag or English name to its primary ISO 639 code; `auto`
+/// and empty values yield `None`
+/// 将语种标签或英文名称规范化为 ISO 639 主代码；`auto` 与空值返回 `None`
+pub fn normalize_code(s: &str) -> Option<String> {
+    let lower = s.trim().to_ascii_lowercase();
+    let primary = lower.split(['-', '_']).next().unwrap_or("");
+    let code = match primary {
+        "" | "auto" | "und" => return None,
+        "english" => "en",
+        "chinese" | "mandarin" | "cantonese" => "zh",
+        "japanese" => "ja",
+        "korean" => "ko",
+        "spanish" => "es",
+        "french" => "fr",
+        "german" => "de",
+        "italian" => "it",
+        "portuguese" => "pt",
+        "dutch" => "nl",
+        "russian" => "ru",
+        "arabic" => "ar",
+        "hindi" => "hi",
+        "thai" => "th",
+        "greek" => "el",
+        "hebrew" => "he",
+        c if (2..=3).contains(&c.len()) && c.chars().all(|ch| ch.is_ascii_alphabetic()) => c,
+        _ => return None,
+    };
+    Some(code.to_string())
+}
+
+const LANGUAGE_FIELDS: &[&str] = &["language", "detected_language", "language_code", "lang"];
+const NESTED_FIELDS: &[&str] = &["item", "result", "transcription", "metadata", "response"];
+
+/// Language reported by the provider in an event / 服务商在事件中报告的语种
+pub fn provider_hint(ev: &Value) -> Option<String> {
+    let obj = ev.as_object()?;
+    let direct = LANGUAGE_FIELDS
+        .iter()
+        .filter_map(|k| obj.get(*k).and_then(|v| v.as_str()))
+        .find_map(normalize_code);
+    direct.or_else(|| {
+        NESTED_FIELDS
+            .iter()
+            .filter_map(|k| obj.get(*k))
+            .find_map(|v| {
+                let nested = v.as_object()?;
+                LANGUAGE_FIELDS
+                    .iter()
+                    .filter_map(|k| nested.get(*k).and_then(|v| v.as_str()))
+                    .find_map(normalize_code)
+            })
+    })
+}
+
+/// Final transcript text of an event, if it carries one / 事件携带的最终转写文本（如有）
+pub fn completed_transcript(ev: &Value) -> Option<&str> {
+    let ty = ev.get("type").and_then(|v| v.as_str()).unwrap_or("");
+    if !(ty.ends_with(".completed") || ty.ends_with(".done") || ty.ends_with(".final")) {
+        return None;
+    }
+    ["transcript", "text"]
+        .iter()
+        .find_map(|k| ev.get(*k).and_then(|v| v.as_str()))
+        .filter(|s| !s.trim().is_empty())
+}
+
+const STOP_WORDS: &[(&str, &[&str])] = &[
+    (
+        "en",
+        &[
+            "the", "and", "is", "are", "you", "to", "of", "it", "that", "what", "this", "with",
+        ],
+    ),
+    (
+        "es",
+        &[
+            "el", "la", "los", "las", "que", "de", "y", "es", "en", "por", "una", "para",
+        ],
+    ),
+    (
+        "fr",
+        &[
+            "le", "la", "les", "et", "est", "je", "vous", "une", "des", "que", "pas", "pour",
+        ],
+    ),
+    (
+        "de",
+        &[
+            "der", "die", "das", "und", "ist", "ich", "nicht", "ein", "eine", "zu", "mit", "sie",
+        ],
+    ),
+    (
+        "it",
+        &[
+            "il", "lo", "gli", "che", "di", "e", "non", "per", "sono", "una", "della", "ciao",
+        ],
+    ),
+    (
+        "pt",
+        &[
+            "o", "os", "que", "de", "e", "não", "uma", "para", "com", "você", "está", "obrigado",
+        ],
+    ),
+    (
+        "nl",
+        &[
+            "de", "het", "een", "en", "is", "ik", "niet", "van", "dat", "je", "wat", "zijn",
+        ],
+    ),
+];
+
+fn script_of(c: char) -> Option<&'static str> {
+    Some(match c as u32 {
+        0x3040..=0x30FF => "ja",
+        0xAC00..=0xD7AF | 0x1100..=0x11FF => "ko",
+        0x4E00..=0x9FFF | 0x3400..=0x4DBF => "zh",
+        0x0400..=0x04FF => "ru",
+        0x0600..=0x06FF => "ar",
+        0x0900..=0x097F => "hi",
+        0x0E00..=0x0E7F => "th",
+        0x0370..=0x03FF => "el",
+        0x0590..=0x05FF => "he",
+        _ if c.is_alphabetic() => "latin",
+        _ => return None,
+    })
+}
+
+/// Local language classifier; returns the code and a confidence in `0..=1`
+/// 本地语种分类器；返回代码与 `0..=1` 范围内的置信度
+pub fn detect_text(text: &str) -> Option<(String, f32)> {
+    let mut counts: Vec<(&str, usize)> = Vec::new();
+    let mut letters = 0usize;
+    for script in text.chars().filter_map(script_of) {
+        letters += 1;
+        match counts.iter_mut().find(|(s, _)| *s == script) {
+            Some((_, n)) => *n += 1,
+            None => counts.push((script, 1)),
+        }
+    }
+    if letters < 2 {
+        return None;
+    }
+    let count = |s: &str| counts.iter().find(|(x, _)| *x == s).map_or(0, |(_, n)| *n);
+    // Japanese mixes kana with Han characters / 日文混用假名与汉字
+    let kana = count("ja");
+    if kana > 0 {
+        let share = (kana + count("zh")) as f32 / letters as f32;
+        return Some(("ja".to_string(), share.min(1.0)));
+    }
+    let (script, n) = counts.iter().copied().max_by_key(|(_, n)| *n)?;
+    let share = n as f32 / letters as f32;
+    if script != "latin" {
+        return Some((script.to_string(), share));
+    }
+
+    let words: Vec<String> = text
+        .split(|c: char| !c.is_alphabetic())
+        .filter(|w| !w.is_empty())
+        .map(|w| w.to_lowercase())
+        .collect();
+    let scores: Vec<(&str, usize)> = STOP_WORDS
+        .iter()
+        .map(|(lang, list)| {
+            let hits = words.iter().filter(|w| list.contains(&w.as_str())).count();
+            (*lang, hits)
+        })
+        .collect();
+    let mut ranked = scores;
+    ranked.sort_by(|a, b| b.1.cmp(&a.1));
+    let (lang, best) = ranked[0];
+    if best == 0 {
+        return None;
+    }
+    // Margin over the runner-up; short utterances count for less
+    // 相对第二名的领先程度；较短的语句权重较低
+    let margin = best as f32 / (best + ranked[1].1) as f32;
+    let coverage = (best as f32 / 3.0).min(1.0);
+    Some((lang.to_string(), share * margin * coverage))
+}
+
+/// Detect the language of one ASR event / 检测单个 ASR 事件的语种
+pub fn detect_event(ev: &Value) -> Option<DetectedLanguage> {
+    if let Some(code) = provider_hint(ev) {
+        return Some(DetectedLanguage::new(code, LanguageSource::Provider, 1.0));
+    }
+    let (code, confidence) = detect_text(completed_transcript(ev)?)?;
+    (confidence >= MIN_LOCAL_CONFIDENCE)
+        .then(|| DetectedLanguage::new(code, LanguageSource::Local, confidence))
+}
+
+/// Languages of one spearlet's sessions / 单个 spearlet 各会话的语种
+#[derive(Default)]
+pub struct SessionLanguages {
+    sessions: DashMap<String, DetectedLanguage>,
+}
+
+impl SessionLanguages {
+    /// Record the language of a session; a configured language is never replaced by a
+    /// detected one / 记录会话语种；已配置的语种不会被检测结果替换
+    pub(crate) fn record(&self, session: &str, lang: DetectedLanguage) {
+        let map = &self.sessions;
+        if lang.source != LanguageSource::Configured
+            && map
+                .get(session)
+                .is_some_and(|cur| cur.source == LanguageSource::Configured)
+        {
+            return;
+        }
+        if !map.contains_key(session) && map.len() >= MAX_SESSIONS {
+            let oldest = map
+                .iter()
+                .min_by_key(|e| e.value().detected_at_ms)
+                .map(|e| e.key().clone());
+            if let Some(k) = oldest {
+                map.remove(&k);
+            }
+        }
+        map.insert(session.to_string(), lang);
+    }
+
+    /// Language of a session, if known / 会话语种（如已知）
+    pub(crate) fn get(&self, session: &str) -> Option<DetectedLanguage> {
+        self.sessions.get(session).map(|e| e.value().clone())
+    }
+}
+
+/// Inspect an inbound rt-asr event and update the fd and session language
+/// 检查入站 rt-asr 事件并更新 fd 与会话语种
+pub(super) fn observe_rtasr_event(
+    languages: &SessionLanguages,
+    table: &FdTable,
+    fd: i32,
+    session: &str,
+    payload: &[u8],
+) {
+    let Ok(ev) = serde_json::from_slice::<Value>(payload) else {
+        return;
+    };
+    let Some(lang) = detect_event(&ev) else {
+        return;
+    };
+    let Some(entry) = table.get(fd) else {
+        return;
+    };
+    let Ok(mut e) = entry.lock() else {
+        return;
+    };
+    let FdInner::RtAsr(st) = &mut e.inner else {
+        return;
+    };
+    if st
+        .detected_language
+        .as_ref()
+        .is_some_and(|cur| cur.source == LanguageSource::Configured)
+    {
+        return;
+    }
+    st.detected_language = Some(lang.clone());
+    drop(e);
+    languages.record(session, lang);
+}
+
+/// Configured language from rt-asr params / rt-asr 参数中配置的语种
+pub(super) fn configured_language(
+    params: &std::collections::HashMap<String, Value>,
+) -> Option<String> {
+    params
+        .get(rtasr_keys::LANGUAGE)
+        .and_then(|v| v.as_str())
+        .and_then(normalize_code)
+}
+
+/// Forward a configured language to the provider as a transcription hint
+/// 将配置的语种作为转写提示转发给服务商
+pub(super) fn apply_language_to_client_events(client_events: &mut [Value], code: &str) {
+    for ev in client_events.iter_mut() {
+        if ev.get("type").and_then(|x| x.as_str()) != Some("session.update") {
+            continue;
+        }
+        if let Some(t) = ev
+            .get_mut("session")
+            .and_then(|s| s.get_mut("input_audio_transcription"))
+            .and_then(|t| t.as_object_mut())
+        {
+            t.insert("language".to_string(), Value::String(code.to_string()));
+        }
+    }
+}
+
+impl DefaultHostApi {
+    /// Key of the current session: execution, else instance / 当前会话的键：执行，否则实例
+    pub(crate) fn language_session_key(&self) -> String {
+        self.execution_id
+            .clone()
+            .or_else(super::core::current_wasm_execution_id)
+            .or_else(|| self.instance_id.clone())
+            .unwrap_or_else(|| "default".to_string())
+    }
+
+    /// Language detected or configured in the current session / 当前会话检测或配置的语种
+    pub fn session_language(&self) -> Option<DetectedLanguage> {
+        self.node()
+            .session_languages
+            .get(&self.language_session_key())
+    }
+
+    /// Language for a downstream hostcall: an explicit value wins, otherwise the
+    /// session language / 下游 hostcall 使用的语种：显式值优先，否则为会话语种
+    pub fn resolve_language(&self, explicit: Option<&str>) -> Option<String> {
+        explicit
+            .and_then(normalize_code)
+            .or_else(|| self.session_language().map(|l| l.code))
+    }
+
+    /// Attach the session language to an outgoing AI request / 为发出的 AI 请求附加会话语种
+    pub(super) fn annotate_language(&self, req: &mut CanonicalRequestEnvelope) {
+        if req.meta.contains_key(META_LANGUAGE) {
+            return;
+        }
+        if let Some(lang) = self.session_language() {
+            req.meta.insert(META_LANGUAGE.to_string(), lang.code);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_normalize_code() {
+        assert_eq!(normalize_code("en-US").as_deref(), Some("en"));
+        assert_eq!(normalize_code("zh_Hans").as_deref(), Some("zh"));
+        assert_eq!(normalize_code("Japanese").as_deref(), Some("ja"));
+        assert_eq!(normalize_code("auto"), None);
+        assert_eq!(normalize_code("not a language"), None);
+    }
+
+    #[test]
+    fn test_detect_event_prefers_provider() {
+        let ev = json!({
+            "type": "conversation.item.input_audio_transcription.completed",
+            "transcript": "the weather is nice and you know it",
+            "language": "fr-FR",
+        });
+        let lang = detect_event(&ev).unwrap();
+        assert_eq!(lang.code, "fr");
+        assert_eq!(lang.source, LanguageSource::Provider);
+
+        let ev = json!({"type": "result", "result": {"language_code": "de"}});
+        assert_eq!(detect_event(&ev).unwrap().code, "de");
+
+        // Deltas are not classified locally / 增量事件不做本地分类
+        let ev = json!({"type": "x.delta", "delta": "the and is"});
+        assert!(detect_event(&ev).is_none());
+    }
+
+    #[test]
+    fn test_local_classifier() {
+        let done = |t: &str| json!({"type": "transcription.completed", "transcript": t});
+        let cases = [
+            ("今天天气很好，我们去公园吧", "zh"),
+            ("今日はいい天気ですね", "ja"),
+            ("안녕하세요 반갑습니다", "ko"),
+            ("Привет, как дела?", "ru"),
+            ("What is the plan for this week and are you coming?", "en"),
+            ("¿Qué es lo que quieres para la cena de hoy?", "es"),
+            ("Je ne sais pas si vous êtes prêt pour la réunion", "fr"),
+            ("Ich weiß nicht, ob das eine gute Idee ist", "de"),
+        ];
+        for (text, want) in cases {
+            let lang = detect_event(&done(text)).unwrap_or_else(|| panic!("no result: {text}"));
+            assert_eq!(lang.code, want, "{text}");
+            assert_eq!(lang.source, LanguageSource::Local);
+        }
+        assert!(detect_event(&done("OK")).is_none());
+    }
+
+    #[test]
+    fn test_configured_language_is_sticky() {
+        let key = "test-language-sticky";
+        let languages = SessionLanguages::default();
+        languages.record(
+            key,
+            DetectedLanguage::new("es".to_string(), LanguageSource::Configured, 1.0),
+        );
+        languages.record(
+            key,
+            DetectedLanguage::new("en".to_string(), LanguageSource::Provider, 1.0),
+        );
+        assert_eq!(languages.get(key).unwrap().code, "es");
+        assert!(SessionLanguages::default().get(key).is_none());
+
+        let mut events = vec![json!({
+            "type": "session.update",
+            "session": {"input_audio_transcription": {"model": "m"}},
+        })];
+        apply_language_to_client_events(&mut events, "es");
+        assert_eq!(
+            events[0]["session"]["input_audio_transcription"]["language"],
+            "es"
+        );
+    }
+}
@@ -0,0 +1,128 @@
+//! Message passing hostcalls / 消息传递 hostcall
+//!
+//! The calling instance owns at most one mailbox, created by its first `mp_register`; its
+//! instance id (or task id when it has none) identifies it on the bus. Blocking waits are cut
+//! into short slices so a terminated instance stops waiting.
+//! 调用实例至多拥有一个邮箱，由其首次 `mp_register` 创建；总线上以其实例 ID（无实例 ID 时为任务
+//! ID）标识。阻塞等待被切分为短时间片，使被终止的实例能够停止等待。
+
+use std::time::{Duration, Instant};
+
+use super::errno::{
+    SPEAR_EAGAIN, SPEAR_EEXIST, SPEAR_EINVAL, SPEAR_ENOENT, SPEAR_ENOMEM, SPEAR_ENOSYS,
+    SPEAR_EPIPE, SPEAR_ETIMEDOUT,
+};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::message_passing::{MpError, Received};
+
+const WAIT_SLICE: Duration = Duration::from_millis(100);
+
+fn errno(e: &MpError) -> i32 {
+    -match e {
+        MpError::Disabled => SPEAR_ENOSYS,
+        MpError::Invalid(_) => SPEAR_EINVAL,
+        MpError::NameTaken(_) => SPEAR_EEXIST,
+        MpError::NotFound(_) => SPEAR_ENOENT,
+        MpError::TooManyNames => SPEAR_ENOMEM,
+        MpError::QueueFull(_) | MpError::Empty => SPEAR_EAGAIN,
+        MpError::TimedOut => SPEAR_ETIMEDOUT,
+        MpError::Dropped(_) => SPEAR_EPIPE,
+    }
+}
+
+fn name(bytes: &[u8]) -> Result<&str, i32> {
+    std::str::from_utf8(bytes).map_err(|_| -SPEAR_EINVAL)
+}
+
+impl DefaultHostApi {
+    pub(super) fn mp_owner(&self) -> &str {
+        self.instance_id
+            .as_deref()
+            .or(self.task_id.as_deref())
+            .unwrap_or("")
+    }
+
+    /// Run `call` with wait slices until it answers, `timeout_ms` passes or the instance ends;
+    /// 0 polls once and a negative timeout waits until a message arrives
+    /// 以等待时间片运行 `call`，直到得到结果、超过 `timeout_ms` 或实例结束；0 只轮询一次，
+    /// 负数超时一直等待
+    fn mp_wait<T>(
+        &self,
+        timeout_ms: i32,
+        mut call: impl FnMut(Option<Duration>) -> Result<T, MpError>,
+    ) -> Result<T, i32> {
+        if timeout_ms == 0 {
+            return call(Some(Duration::ZERO)).map_err(|e| errno(&e));
+        }
+        let deadline =
+            (timeout_ms > 0).then(|| Instant::now() + Duration::from_millis(timeout_ms as u64));
+        loop {
+            let slice = match deadline {
+                Some(d) => d.saturating_duration_since(Instant::now()).min(WAIT_SLICE),
+                None => WAIT_SLICE,
+            };
+            match call(Some(slice)) {
+                Err(MpError::TimedOut) => {}
+                r => return r.map_err(|e| errno(&e)),
+            }
+            if deadline.is_some_and(|d| Instant::now() >= d) {
+                return Err(-SPEAR_ETIMEDOUT);
+            }
+            if self.check_wasm_termination().is_some() {
+                return Err(-SPEAR_EAGAIN);
+            }
+        }
+    }
+
+    /// Register a name for this instance's mailbox; returns the mailbox id
+    /// 为本实例的邮箱注册名称；返回邮箱 ID
+    pub fn mp_register(&self, name_bytes: &[u8]) -> Result<u32, i32> {
+        self.node()
+            .message_passing
+            .register(self.mp_owner(), name(name_bytes)?)
+            .map_err(|e| {
+                tracing::warn!(owner = %self.mp_owner(), error = %e, "mp_register failed");
+                errno(&e)
+            })
+    }
+
+    pub fn mp_lookup(&self, name_bytes: &[u8]) -> Result<u32, i32> {
+        self.node()
+            .message_passing
+            .lookup(name(name_bytes)?)
+            .map_err(|e| errno(&e))
+    }
+
+    /// Queue a message for a mailbox; returns the message id / 向邮箱发送消息；返回消息 ID
+    pub fn mp_send(&self, mailbox: u32, data: Vec<u8>) -> Result<u32, i32> {
+        self.node()
+            .message_passing
+            .send(self.mp_owner(), mailbox, data)
+            .map_err(|e| errno(&e))
+    }
+
+    /// Next message for this instance; one larger than `max_len` stays queued
+    /// 本实例的下一条消息；超过 `max_len` 的消息仍留在队列中
+    pub fn mp_recv(&self, max_len: usize, timeout_ms: i32) -> Result<Received, i32> {
+        self.mp_wait(timeout_ms, |t| {
+            self.node()
+                .message_passing
+                .recv(self.mp_owner(), max_len, t)
+        })
+    }
+
+    pub fn mp_ack(&self, id: u32) -> Result<(), i32> {
+        self.node()
+            .message_passing
+            .ack(self.mp_owner(), id)
+            .map_err(|e| errno(&e))
+    }
+
+    /// Wait for the receiver to acknowledge a message sent by this instance
+    /// 等待接收方确认本实例发送的消息
+    pub fn mp_wait_ack(&self, id: u32, timeout_ms: i32) -> Result<(), i32> {
+        self.mp_wait(timeout_ms, |t| {
+            self.node().message_passing.wait_ack(self.mp_owner(), id, t)
+        })
+    }
+}
@@ -40,11 +40,34 @@ impl DefaultHostApi {
                 let bytes = payload.ok_or(-SPEAR_EINVAL)?;
                 let v: serde_json::Value =
                     serde_json::from_slice(bytes).map_err(|_| -SPEAR_EINVAL)?;
+                let source = v.get("source").and_then(|x| x.as_str()).unwrap_or("device");
+                let requested_device = v
+                    .get("device")
+                    .and_then(|x| x.get("name"))
+                    .and_then(|x| x.as_str());
+
+                // Logical names and the default input come from the device profile; other
+                // names are host device names
+                // 逻辑名称与默认输入来自设备描述；其他名称按主机设备名处理
+                let profile_input = self.device_profile().audio_input(requested_device);
+                let device_name = match profile_input {
+                    Some(d) if d.device.is_empty() => None,
+                    Some(d) => Some(d.device.clone()),
+                    None => requested_device.map(|s| s.to_string()),
+                };
+
                 let sample_rate_hz = v
                     .get("sample_rate_hz")
                     .and_then(|x| x.as_u64())
-                    .unwrap_or(24000) as u32;
-                let channels = v.get("channels").and_then(|x| x.as_u64()).unwrap_or(1) as u8;
+                    .map(|n| n as u32)
+                    .or_else(|| profile_input.and_then(|d| d.sample_rate_hz))
+                    .unwrap_or(24000);
+                let channels = v
+                    .get("channels")
+                    .and_then(|x| x.as_u64())
+                    .map(|n| n as u8)
+                    .or_else(|| profile_input.and_then(|d| d.channels))
+                    .unwrap_or(1);
                 let frame_ms = v.get("frame_ms").and_then(|x| x.as_u64()).unwrap_or(20) as u32;
                 let format = v
                     .get("format")
@@ -52,13 +75,6 @@ impl DefaultHostApi {
                     .unwrap_or("pcm16")
                     .to_string();
 
-                let source = v.get("source").and_then(|x| x.as_str()).unwrap_or("device");
-                let device_name = v
-                    .get("device")
-                    .and_then(|x| x.get("name"))
-                    .and_then(|x| x.as_str())
-                    .map(|s| s.to_string());
-
                 let max_queue_bytes = v
                     .get("max_queue_bytes")
                     .and_then(|x| x.as_u64())
@@ -0,0 +1,575 @@
+//! Hostcall middleware / hostcall 中间件
+//!
+//! Every wasm hostcall passes through a chain of middlewares before its handler runs, so
+//! concerns shared by all hostcalls live in one place instead of in each handler. A
+//! middleware may reject the call with an errno, hold a guard for the call's length and see
+//! the result afterwards. The built-in chain, in order:
+//! 每个 wasm hostcall 在其处理函数运行前都会经过一条中间件链，使所有 hostcall 共有的逻辑集中在一处，
+//! 而不是散落在各处理函数中。中间件可以用 errno 拒绝调用、在调用期间持有守卫，并在之后看到结果。
+//! 内置链依次为：
+//!
+//! - `lifecycle`: refuses calls once the runtimes are stopped (`-ESHUTDOWN`)
+//!   运行时停止后拒绝调用（`-ESHUTDOWN`）
+//! - `policy`: allow and deny lists (`-EACCES`) / 允许与拒绝列表（`-EACCES`）
+//! - `quota`: calls per task and window (`-EAGAIN`) / 每个任务每个窗口的调用数（`-EAGAIN`）
+//! - `deadline`: the hostcall timeout / hostcall 超时
+//! - `pool`: shared slots for slow hostcalls / 慢速 hostcall 的共享槽位
+//! - `stats`: calls, errors and latency by hostcall / 按 hostcall 统计调用数、错误与延迟
+//! - `log`: requests with secrets redacted / 隐去密钥后的请求
+//!
+//! More middlewares are added with `HostcallChain::register` and run after the built-in ones.
+//! Each spearlet keeps its own chain, with its quotas and stats, in `NodeServices`.
+//! 可通过 `HostcallChain::register` 添加更多中间件，它们在内置中间件之后运行。
+//! 每个 spearlet 在 `NodeServices` 中保有自己的中间件链及其配额与统计。
+
+use std::any::Any;
+use std::collections::{BTreeMap, HashMap};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::{Mutex, RwLock};
+use serde::Serialize;
+use serde_json::Value;
+
+use super::deadline;
+use super::errno::{SPEAR_EACCES, SPEAR_EAGAIN, SPEAR_ESHUTDOWN};
+use crate::spearlet::config::HostcallPolicyConfig;
+use crate::spearlet::execution::host_api::DefaultHostApi;
+
+/// Hostcalls whose first two arguments are a JSON request (pointer, length)
+/// 前两个参数为 JSON 请求（指针、长度）的 hostcall
+pub const REQUEST_HOSTCALLS: &[&str] = &[
+    "embeddings",
+    "moderate",
+    "chat_structured",
+    "image_generate",
+    "tool_invoke",
+    "invoke_start",
+    "schedule_create",
+    "compute_hint",
+];
+
+/// A hostcall about to run / 即将运行的 hostcall
+pub struct HostcallCall<'a> {
+    /// Name without the `spear_` prefix / 不带 `spear_` 前缀的名称
+    pub method: &'a str,
+    pub host: &'a DefaultHostApi,
+    /// JSON request, read only when a middleware asks for it / JSON 请求，仅在中间件需要时读取
+    pub request: Option<&'a [u8]>,
+}
+
+impl HostcallCall<'_> {
+    pub fn task_id(&self) -> &str {
+        self.host.task_id.as_deref().unwrap_or("")
+    }
+
+    fn policy(&self) -> Option<&HostcallPolicyConfig> {
+        self.host
+            .runtime_config
+            .spearlet_config
+            .as_ref()
+            .map(|c| &c.execution.hostcall_policy)
+    }
+}
+
+/// A hostcall that has finished or was rejected / 已结束或被拒绝的 hostcall
+pub struct HostcallDone<'a> {
+    pub method: &'a str,
+    pub task_id: &'a str,
+    /// Return code; `None` when the call trapped / 返回码；调用陷入异常时为 `None`
+    pub rc: Option<i64>,
+    pub elapsed: Duration,
+    /// Middleware that rejected the call / 拒绝该调用的中间件
+    pub rejected_by: Option<&'static str>,
+}
+
+/// Kept for the length of a call and dropped after it / 在调用期间保留，调用结束后释放
+pub type HostcallGuard = Option<Box<dyn Any>>;
+
+pub trait HostcallMiddleware: Send + Sync {
+    fn name(&self) -> &'static str;
+
+    /// Whether `before` needs the JSON request of `method` / `before` 是否需要 `method` 的 JSON 请求
+    fn wants_request(&self, _method: &str) -> bool {
+        false
+    }
+
+    /// Runs before the handler; `Err(rc)` rejects the call with that return code
+    /// 在处理函数之前运行；`Err(rc)` 以该返回码拒绝调用
+    fn before(&self, _call: &HostcallCall<'_>) -> Result<HostcallGuard, i32> {
+        Ok(None)
+    }
+
+    /// Runs after the handler, or after a rejection, in reverse order
+    /// 在处理函数之后或拒绝之后按相反顺序运行
+    fn after(&self, _done: &HostcallDone<'_>) {}
+}
+
+/// Middlewares run around every hostcall / 围绕每个 hostcall 运行的中间件
+pub struct HostcallChain {
+    middlewares: RwLock<Vec<Arc<dyn HostcallMiddleware>>>,
+    stats: StatsTable,
+}
+
+/// A call admitted by the chain / 已被中间件链放行的调用
+pub struct EnteredCall {
+    middlewares: Vec<Arc<dyn HostcallMiddleware>>,
+    guards: Vec<HostcallGuard>,
+    method: String,
+    task_id: String,
+    started: Instant,
+}
+
+impl EnteredCall {
+    /// Report the result to the middlewares and release their guards
+    /// 将结果报告给中间件并释放其守卫
+    pub fn finish(mut self, rc: Option<i64>) {
+        let done = HostcallDone {
+            method: &self.method,
+            task_id: &self.task_id,
+            rc,
+            elapsed: self.started.elapsed(),
+            rejected_by: None,
+        };
+        for m in self.middlewares.iter().rev() {
+            m.after(&done);
+        }
+        release(std::mem::take(&mut self.guards));
+    }
+}
+
+/// Drop guards innermost first, so a deadline guard restores the enclosing one last
+/// 从最内层开始释放守卫，使截止时间守卫最后恢复外层截止时间
+fn release(mut guards: Vec<HostcallGuard>) {
+    while let Some(g) = guards.pop() {
+        drop(g);
+    }
+}
+
+impl HostcallChain {
+    fn new(middlewares: Vec<Arc<dyn HostcallMiddleware>>) -> Self {
+        Self {
+            middlewares: RwLock::new(middlewares),
+            stats: StatsTable::default(),
+        }
+    }
+
+    /// The built-in chain every wasm hostcall runs through / 所有 wasm hostcall 经过的内置中间件链
+    pub fn standard() -> Self {
+        let stats = StatsTable::default();
+        Self {
+            middlewares: RwLock::new(vec![
+                Arc::new(LifecycleMiddleware),
+                Arc::new(PolicyMiddleware),
+                Arc::new(QuotaMiddleware::default()),
+                Arc::new(DeadlineMiddleware),
+                Arc::new(PoolMiddleware),
+                Arc::new(StatsMiddleware(stats.clone())),
+                Arc::new(LogMiddleware),
+            ]),
+            stats,
+        }
+    }
+
+    /// Stats of every hostcall called since start / 启动以来被调用过的每个 hostcall 的统计
+    pub fn stats(&self) -> BTreeMap<String, HostcallStats> {
+        self.stats.lock().clone()
+    }
+
+    /// Add a middleware after the existing ones / 在现有中间件之后添加一个中间件
+    pub fn register(&self, m: Arc<dyn HostcallMiddleware>) {
+        self.middlewares.write().push(m);
+    }
+
+    /// Names of the middlewares in order / 按顺序排列的中间件名称
+    pub fn names(&self) -> Vec<&'static str> {
+        self.middlewares.read().iter().map(|m| m.name()).collect()
+    }
+
+    pub fn wants_request(&self, method: &str) -> bool {
+        self.middlewares
+            .read()
+            .iter()
+            .any(|m| m.wants_request(method))
+    }
+
+    /// Run the `before` hooks; a rejection is reported to every middleware
+    /// 运行 `before` 钩子；拒绝会报告给所有中间件
+    pub fn enter(&self, call: &HostcallCall<'_>) -> Result<EnteredCall, i32> {
+        let middlewares = self.middlewares.read().clone();
+        let started = Instant::now();
+        let mut guards = Vec::with_capacity(middlewares.len());
+        for m in &middlewares {
+            match m.before(call) {
+                Ok(g) => guards.push(g),
+                Err(rc) => {
+                    let done = HostcallDone {
+                        method: call.method,
+                        task_id: call.task_id(),
+                        rc: Some(rc as i64),
+                        elapsed: started.elapsed(),
+                        rejected_by: Some(m.name()),
+                    };
+                    for m in middlewares.iter().rev() {
+                        m.after(&done);
+                    }
+                    release(guards);
+                    return Err(rc);
+                }
+            }
+        }
+        Ok(EnteredCall {
+            middlewares,
+            guards,
+            method: call.method.to_string(),
+            task_id: call.task_id().to_string(),
+            started,
+        })
+    }
+}
+
+struct LifecycleMiddleware;
+
+impl HostcallMiddleware for LifecycleMiddleware {
+    fn name(&self) -> &'static str {
+        "lifecycle"
+    }
+
+    fn before(&self, call: &HostcallCall<'_>) -> Result<HostcallGuard, i32> {
+        if call.host.node().hostcalls_open() {
+            Ok(None)
+        } else {
+            Err(-SPEAR_ESHUTDOWN)
+        }
+    }
+}
+
+struct PolicyMiddleware;
+
+impl HostcallMiddleware for PolicyMiddleware {
+    fn name(&self) -> &'static str {
+        "policy"
+    }
+
+    fn before(&self, call: &HostcallCall<'_>) -> Result<HostcallGuard, i32> {
+        let Some(p) = call.policy() else {
+            return Ok(None);
+        };
+        if !p.allows(call.method) {
+            tracing::debug!(
+                task_id = %call.task_id(),
+                method = %call.method,
+                "Hostcall denied by policy"
+            );
+            return Err(-SPEAR_EACCES);
+        }
+        Ok(None)
+    }
+}
+
+/// Calls counted in the current window of one task and hostcall
+/// 某任务某 hostcall 在当前窗口中的调用计数
+struct QuotaWindow {
+    started: Instant,
+    calls: u64,
+}
+
+#[derive(Default)]
+struct QuotaMiddleware {
+    windows: Mutex<HashMap<(String, String), QuotaWindow>>,
+}
+
+impl HostcallMiddleware for QuotaMiddleware {
+    fn name(&self) -> &'static str {
+        "quota"
+    }
+
+    fn before(&self, call: &HostcallCall<'_>) -> Result<HostcallGuard, i32> {
+        let Some(q) = call.policy().and_then(|p| p.quotas.get(call.method)) else {
+            return Ok(None);
+        };
+        if q.max_calls == 0 {
+            return Ok(None);
+        }
+        let window = Duration::from_secs(q.window_secs.max(1));
+        let now = Instant::now();
+        let mut windows = self.windows.lock();
+        let w = windows
+            .entry((call.task_id().to_string(), call.method.to_string()))
+            .or_insert(QuotaWindow {
+                started: now,
+                calls: 0,
+            });
+        if now.duration_since(w.started) >= window {
+            w.started = now;
+            w.calls = 0;
+        }
+        if w.calls >= q.max_calls {
+            tracing::debug!(
+                task_id = %call.task_id(),
+                method = %call.method,
+                max_calls = q.max_calls,
+                "Hostcall quota exhausted"
+            );
+            return Err(-SPEAR_EAGAIN);
+        }
+        w.calls += 1;
+        Ok(None)
+    }
+}
+
+struct DeadlineMiddleware;
+
+impl HostcallMiddleware for DeadlineMiddleware {
+    fn name(&self) -> &'static str {
+        "deadline"
+    }
+
+    fn before(&self, call: &HostcallCall<'_>) -> Result<HostcallGuard, i32> {
+        let guard = deadline::enter(call.host.hostcall_timeout(call.method));
+        Ok(Some(Box::new(guard)))
+    }
+}
+
+struct PoolMiddleware;
+
+impl HostcallMiddleware for PoolMiddleware {
+    fn name(&self) -> &'static str {
+        "pool"
+    }
+
+    fn before(&self, call: &HostcallCall<'_>) -> Result<HostcallGuard, i32> {
+        let slot = call.host.enter_hostcall_pool(call.method)?;
+        Ok(slot.map(|s| Box::new(s) as Box<dyn Any>))
+    }
+}
+
+/// Calls, errors and latency of one hostcall / 单个 hostcall 的调用数、错误与延迟
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct HostcallStats {
+    pub calls: u64,
+    /// Calls that returned a negative code or trapped / 返回负值或陷入异常的调用
+    pub errors: u64,
+    pub rejected: u64,
+    pub total_ms: u64,
+    pub max_ms: u64,
+}
+
+type StatsTable = Arc<Mutex<BTreeMap<String, HostcallStats>>>;
+
+struct StatsMiddleware(StatsTable);
+
+impl HostcallMiddleware for StatsMiddleware {
+    fn name(&self) -> &'static str {
+        "stats"
+    }
+
+    fn after(&self, done: &HostcallDone<'_>) {
+        let ms = done.elapsed.as_millis() as u64;
+        let mut table = self.0.lock();
+        let s = table.entry(done.method.to_string()).or_default();
+        s.calls += 1;
+        if done.rc.map_or(true, |rc| rc < 0) {
+            s.errors += 1;
+        }
+        if done.rejected_by.is_some() {
+            s.rejected += 1;
+        }
+        s.total_ms += ms;
+        s.max_ms = s.max_ms.max(ms);
+    }
+}
+
+struct LogMiddleware;
+
+impl LogMiddleware {
+    fn enabled(call: &HostcallCall<'_>) -> bool {
+        call.policy().is_some_and(|p| p.log_requests)
+    }
+}
+
+impl HostcallMiddleware for LogMiddleware {
+    fn name(&self) -> &'static str {
+        "log"
+    }
+
+    fn wants_request(&self, method: &str) -> bool {
+        REQUEST_HOSTCALLS.contains(&method)
+    }
+
+    fn before(&self, call: &HostcallCall<'_>) -> Result<HostcallGuard, i32> {
+        if !Self::enabled(call) {
+            return Ok(None);
+        }
+        let request = call
+            .request
+            .map(|b| match serde_json::from_slice::<Value>(b) {
+                Ok(mut v) => {
+                    redact_json(&mut v);
+                    v.to_string()
+                }
+                Err(_) => format!("<{} bytes>", b.len()),
+            });
+        tracing::info!(
+            task_id = %call.task_id(),
+            method = %call.method,
+            request = request.as_deref().unwrap_or(""),
+            "Hostcall"
+        );
+        Ok(None)
+    }
+}
+
+/// Replace the values of secret-looking keys with `***` at any depth
+/// 将任意层级中疑似密钥的键值替换为 `***`
+pub fn redact_json(v: &mut Value) {
+    match v {
+        Value::Object(obj) => {
+            for (k, x) in obj.iter_mut() {
+                if super::cchat::should_redact_key(k) {
+                    *x = Value::String("***".to_string());
+                } else {
+                    redact_json(x);
+                }
+            }
+        }
+        Value::Array(items) => items.iter_mut().for_each(redact_json),
+        _ => {}
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::config::{HostcallQuotaConfig, SpearletConfig};
+    use crate::spearlet::execution::runtime::{ResourcePoolConfig, RuntimeConfig, RuntimeType};
+    use serde_json::json;
+
+    fn api(policy: HostcallPolicyConfig) -> DefaultHostApi {
+        let mut cfg = SpearletConfig::default();
+        cfg.execution.hostcall_policy = policy;
+        let mut api = DefaultHostApi::new(RuntimeConfig {
+            runtime_type: RuntimeType::Wasm,
+            settings: HashMap::new(),
+            global_environment: HashMap::new(),
+            spearlet_config: Some(cfg),
+            resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
+        });
+        api.task_id = Some("task-mw".to_string());
+        api
+    }
+
+    fn call<'a>(host: &'a DefaultHostApi, method: &'a str) -> HostcallCall<'a> {
+        HostcallCall {
+            method,
+            host,
+            request: None,
+        }
+    }
+
+    #[test]
+    fn test_policy_allow_and_deny() {
+        let host = api(HostcallPolicyConfig {
+            allow: vec!["embeddings".to_string(), "tool_invoke".to_string()],
+            deny: vec!["tool_invoke".to_string()],
+            ..Default::default()
+        });
+        let p = PolicyMiddleware;
+        assert!(p.before(&call(&host, "embeddings")).is_ok());
+        assert_eq!(
+            p.before(&call(&host, "tool_invoke")).err(),
+            Some(-SPEAR_EACCES)
+        );
+        assert_eq!(
+            p.before(&call(&host, "image_generate")).err(),
+            Some(-SPEAR_EACCES)
+        );
+    }
+
+    #[test]
+    fn test_quota_per_task_window() {
+        let mut host = api(HostcallPolicyConfig {
+            quotas: HashMap::from([(
+                "cchat_send".to_string(),
+                HostcallQuotaConfig {
+                    max_calls: 2,
+                    window_secs: 3600,
+                },
+            )]),
+            ..Default::default()
+        });
+        let q = QuotaMiddleware::default();
+        assert!(q.before(&call(&host, "cchat_send")).is_ok());
+        assert!(q.before(&call(&host, "cchat_send")).is_ok());
+        assert_eq!(
+            q.before(&call(&host, "cchat_send")).err(),
+            Some(-SPEAR_EAGAIN)
+        );
+        assert!(q.before(&call(&host, "embeddings")).is_ok());
+
+        host.task_id = Some("other-task".to_string());
+        assert!(q.before(&call(&host, "cchat_send")).is_ok());
+    }
+
+    #[test]
+    fn test_chain_reports_rejections_and_releases_guards() {
+        #[derive(Default)]
+        struct Seen(Mutex<Vec<(String, Option<i64>, Option<&'static str>)>>);
+        impl HostcallMiddleware for Seen {
+            fn name(&self) -> &'static str {
+                "seen"
+            }
+            fn after(&self, done: &HostcallDone<'_>) {
+                self.0
+                    .lock()
+                    .push((done.method.to_string(), done.rc, done.rejected_by));
+            }
+        }
+
+        let seen = Arc::new(Seen::default());
+        let chain = HostcallChain::new(vec![
+            Arc::new(PolicyMiddleware),
+            Arc::new(DeadlineMiddleware),
+        ]);
+        chain.register(seen.clone());
+        assert_eq!(chain.names(), vec!["policy", "deadline", "seen"]);
+
+        let host = api(HostcallPolicyConfig {
+            deny: vec!["tool_invoke".to_string()],
+            ..Default::default()
+        });
+        assert_eq!(
+            chain.enter(&call(&host, "tool_invoke")).err(),
+            Some(-SPEAR_EACCES)
+        );
+        let entered = chain.enter(&call(&host, "embeddings")).unwrap();
+        assert!(deadline::remaining().is_some());
+        entered.finish(Some(3));
+        assert!(deadline::remaining().is_none());
+
+        assert_eq!(
+            *seen.0.lock(),
+            vec![
+                (
+                    "tool_invoke".to_string(),
+                    Some(-SPEAR_EACCES as i64),
+                    Some("policy")
+                ),
+                ("embeddings".to_string(), Some(3), None),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_redact_json_nested() {
+        let mut v = json!({
+            "name": "search",
+            "arguments": {"query": "x", "api_key": "sk-1", "items": [{"password": "p"}]}
+        });
+        redact_json(&mut v);
+        assert_eq!(v["arguments"]["api_key"], "***");
+        assert_eq!(v["arguments"]["items"][0]["password"], "***");
+        assert_eq!(v["arguments"]["query"], "x");
+    }
+}
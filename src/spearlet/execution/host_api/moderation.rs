@@ -0,0 +1,282 @@
+//! Moderation hostcall and chat screening / moderation hostcall 与对话审核
+//!
+//! `moderate` sends one text or a batch to a backend configured with
+//! `ops = ["moderations"]` and returns one verdict per input, `{flagged, categories,
+//! category_scores}`, plus a top-level `flagged` that is true when any input is flagged.
+//! The same backends screen the chat traffic of untrusted tasks, see `spearlet::moderation`.
+//! `moderate` 将单个文本或一批文本发送给配置了 `ops = ["moderations"]` 的后端，并为每个输入返回一个
+//! 判定 `{flagged, categories, category_scores}`，以及任一输入被标记时为真的顶层 `flagged`。
+//! 同样的后端也用于审核不受信任任务的对话流量，见 `spearlet::moderation`。
+
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+
+use super::deadline;
+use super::errno::{SPEAR_EDQUOT, SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOSYS, SPEAR_ETIMEDOUT};
+use crate::spearlet::execution::ai::ir::{ChatMessage, Payload, ResultPayload};
+use crate::spearlet::execution::ai::normalize::embeddings::EmbeddingsInput;
+use crate::spearlet::execution::ai::normalize::moderations::{
+    normalize_moderations, ModerationsRequest,
+};
+use crate::spearlet::execution::ai::AiEngine;
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::execution::ExecutionError;
+use crate::spearlet::moderation::{Moderation, Stage};
+
+/// Texts a single request may carry / 单个请求可携带的文本数
+pub const MAX_MODERATION_INPUTS: usize = 32;
+
+/// Total input bytes a single request may carry / 单个请求可携带的输入总字节数
+pub const MAX_MODERATION_INPUT_BYTES: usize = 1024 * 1024;
+
+fn errno(e: &ExecutionError) -> i32 {
+    if deadline::expired() {
+        return -SPEAR_ETIMEDOUT;
+    }
+    -match e {
+        ExecutionError::InvalidRequest { .. } => SPEAR_EINVAL,
+        ExecutionError::NotSupported { .. } => SPEAR_ENOSYS,
+        ExecutionError::ResourceExhausted { .. } => SPEAR_EDQUOT,
+        _ => SPEAR_EIO,
+    }
+}
+
+impl DefaultHostApi {
+    /// Run a `moderate` request / 执行 `moderate` 请求
+    pub fn moderate(&self, request: &[u8]) -> Result<Vec<u8>, i32> {
+        let digest: [u8; 32] = Sha256::digest(request).into();
+        if let Some((d, out)) = self.moderation_last.0.lock().take() {
+            if d == digest {
+                return Ok(out);
+            }
+        }
+        let req: ModerationsRequest = serde_json::from_slice(request).map_err(|_| -SPEAR_EINVAL)?;
+        let req = normalize_moderations(req, "moderate");
+        let Payload::Moderations(p) = &req.payload else {
+            return Err(-SPEAR_EINVAL);
+        };
+        let bytes: usize = p.input.iter().map(|s| s.len()).sum();
+        if p.input.is_empty()
+            || p.input.len() > MAX_MODERATION_INPUTS
+            || bytes > MAX_MODERATION_INPUT_BYTES
+        {
+            return Err(-SPEAR_EINVAL);
+        }
+        let inputs = p.input.len();
+
+        let resp = self.ai_engine.invoke(&req).map_err(|e| {
+            tracing::warn!(inputs, error = %e, "moderate failed");
+            errno(&e)
+        })?;
+        let v = match resp.result {
+            ResultPayload::Payload(v) => v,
+            ResultPayload::Error(e) => {
+                tracing::warn!(inputs, code = %e.code, error = %e.message, "moderate failed");
+                return Err(-SPEAR_EIO);
+            }
+        };
+        let results = v.get("results").cloned().unwrap_or(Value::Null);
+        let Some(list) = results.as_array().filter(|a| a.len() == inputs) else {
+            tracing::warn!(inputs, backend = %resp.backend, "moderation result count mismatch");
+            return Err(-SPEAR_EIO);
+        };
+        let flagged = list
+            .iter()
+            .any(|r| r.get("flagged").and_then(|f| f.as_bool()) == Some(true));
+        let out = json!({
+            "backend": resp.backend,
+            "model": v.get("model").cloned().unwrap_or(Value::Null),
+            "flagged": flagged,
+            "results": results,
+        });
+        let out = serde_json::to_vec(&out).map_err(|_| -SPEAR_EIO)?;
+        *self.moderation_last.0.lock() = Some((digest, out.clone()));
+        Ok(out)
+    }
+
+    /// The guest received the result; drop the copy kept for a retry
+    /// guest 已收到结果；丢弃为重试保留的副本
+    pub fn moderation_delivered(&self) {
+        self.moderation_last.0.lock().take();
+    }
+
+    /// Whether `stage` of this task's chat calls is screened / 本任务对话调用的 `stage` 部分是否受审核
+    pub(super) fn screens(&self, stage: Stage) -> bool {
+        self.task_id
+            .as_deref()
+            .is_some_and(|t| self.node().moderation.screens(t, stage))
+    }
+
+    /// Screen the new messages of a chat prompt when the policy asks for it
+    /// 策略要求时审核对话提示中的新消息
+    pub(super) fn screen_prompt(&self, messages: &[ChatMessage]) -> Result<(), Value> {
+        if !self.screens(Stage::Prompt) {
+            return Ok(());
+        }
+        screen(
+            &self.node().moderation,
+            &self.ai_engine,
+            Stage::Prompt,
+            prompt_texts(messages),
+        )
+    }
+
+    /// Screen a chat answer when the policy asks for it / 策略要求时审核对话应答
+    pub(super) fn screen_response(&self, v: &Value) -> Result<(), Value> {
+        if !self.screens(Stage::Response) {
+            return Ok(());
+        }
+        let text = response_text(v);
+        if text.trim().is_empty() {
+            return Ok(());
+        }
+        screen(
+            &self.node().moderation,
+            &self.ai_engine,
+            Stage::Response,
+            vec![text],
+        )
+    }
+}
+
+/// Text of a chat message, from a string or from the `text` of its parts
+/// 对话消息的文本，取自字符串或各部分的 `text`
+fn message_text(content: &Value) -> String {
+    match content {
+        Value::String(s) => s.clone(),
+        Value::Array(parts) => parts
+            .iter()
+            .filter_map(|p| p.get("text").and_then(|t| t.as_str()))
+            .collect::<Vec<_>>()
+            .join("\n"),
+        _ => String::new(),
+    }
+}
+
+/// Texts of the messages added since the model last answered
+/// 模型上次应答之后新增消息的文本
+pub(super) fn prompt_texts(messages: &[ChatMessage]) -> Vec<String> {
+    let start = messages
+        .iter()
+        .rposition(|m| m.role == "assistant")
+        .map(|i| i + 1)
+        .unwrap_or(0);
+    messages[start..]
+        .iter()
+        .map(|m| message_text(&m.content))
+        .filter(|t| !t.trim().is_empty())
+        .collect()
+}
+
+/// Text of the assistant message in a chat answer / 对话应答中助手消息的文本
+pub(super) fn response_text(v: &Value) -> String {
+    v.get("choices")
+        .and_then(|c| c.get(0))
+        .and_then(|c| c.get("message"))
+        .and_then(|m| m.get("content"))
+        .map(message_text)
+        .unwrap_or_default()
+}
+
+/// Screen `texts` under `policy`; `Err` carries the error body the chat call answers with
+/// 按 `policy` 审核 `texts`；`Err` 携带对话调用返回的错误体
+///
+/// A backend that fails or answers badly blocks as well: screening fails closed.
+/// 后端失败或应答异常同样视为拒绝：审核失败即拒绝。
+pub(super) fn screen(
+    policy: &Moderation,
+    engine: &AiEngine,
+    stage: Stage,
+    texts: Vec<String>,
+) -> Result<(), Value> {
+    if texts.is_empty() {
+        return Ok(());
+    }
+    let cfg = policy.config();
+    let req = normalize_moderations(
+        ModerationsRequest {
+            input: EmbeddingsInput::Many(texts),
+            model: Some(cfg.model.clone()),
+            backend: Some(cfg.backend.clone()),
+            timeout_ms: Some(cfg.timeout_ms),
+        },
+        "cchat_screen",
+    );
+    let inputs = match &req.payload {
+        Payload::Moderations(p) => p.input.len(),
+        _ => 0,
+    };
+    let results = match engine.invoke(&req).map(|r| r.result) {
+        Ok(ResultPayload::Payload(v)) => v
+            .get("results")
+            .and_then(|r| r.as_array())
+            .filter(|a| a.len() == inputs)
+            .cloned()
+            .ok_or_else(|| "moderation result count mismatch".to_string()),
+        Ok(ResultPayload::Error(e)) => Err(format!("{}: {}", e.code, e.message)),
+        Err(e) => Err(e.to_string()),
+    };
+    let results = match results {
+        Ok(r) => r,
+        Err(msg) => {
+            tracing::warn!(stage = stage.as_str(), error = %msg, "moderation screening failed");
+            policy.record(true, true);
+            return Err(json!({"error": {
+                "code": "moderation_unavailable",
+                "message": format!("{} screening failed: {}", stage.as_str(), msg),
+            }}));
+        }
+    };
+    let mut categories: Vec<String> = results
+        .iter()
+        .flat_map(|r| policy.blocking_categories(r))
+        .collect();
+    categories.sort();
+    categories.dedup();
+    let blocked = !categories.is_empty();
+    policy.record(blocked, false);
+    if !blocked {
+        return Ok(());
+    }
+    tracing::info!(stage = stage.as_str(), ?categories, "chat content blocked");
+    Err(json!({"error": {
+        "code": "content_blocked",
+        "message": format!("{} blocked by moderation", stage.as_str()),
+        "categories": categories,
+    }}))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn msg(role: &str, content: Value) -> ChatMessage {
+        ChatMessage {
+            role: role.to_string(),
+            content,
+            tool_call_id: None,
+            tool_calls: None,
+            name: None,
+        }
+    }
+
+    #[test]
+    fn test_prompt_texts_since_last_answer() {
+        let messages = vec![
+            msg("system", json!("be nice")),
+            msg("user", json!("first")),
+            msg("assistant", json!("ok")),
+            msg(
+                "user",
+                json!([{"type": "text", "text": "second"}, {"type": "image_url"}]),
+            ),
+            msg("tool", json!("")),
+        ];
+        assert_eq!(prompt_texts(&messages), vec!["second"]);
+        assert_eq!(prompt_texts(&messages[..2]), vec!["be nice", "first"]);
+        assert_eq!(
+            response_text(&json!({"choices": [{"message": {"content": "hi"}}]})),
+            "hi"
+        );
+    }
+}
@@ -0,0 +1,81 @@
+//! ONNX inference hostcalls / ONNX 推理 hostcall
+//!
+//! Results are JSON. When the guest buffer is too small the result is kept, so the
+//! retry with a larger buffer returns it without running the model again.
+//! 结果为 JSON。guest 缓冲区过小时结果会被保留，用更大的缓冲区重试时直接返回，无需再次运行模型。
+
+use parking_lot::Mutex;
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::execution::host_api::errno::{
+    SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOENT, SPEAR_ENOSYS,
+};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::onnx::{InferRequest, OnnxError};
+
+pub const ONNX_CTL_LIST: i32 = 1;
+pub const ONNX_CTL_LOAD: i32 = 2;
+pub const ONNX_CTL_UNLOAD: i32 = 3;
+
+/// Last result of this instance, keyed by request digest / 本实例最近一次结果，以请求摘要为键
+#[derive(Debug, Default)]
+pub(crate) struct LastResult(Mutex<Option<([u8; 32], Vec<u8>)>>);
+
+fn errno(e: &OnnxError) -> i32 {
+    -match e {
+        OnnxError::Disabled | OnnxError::Runtime(_) => SPEAR_ENOSYS,
+        OnnxError::UnknownModel(_) => SPEAR_ENOENT,
+        OnnxError::BadRequest(_) => SPEAR_EINVAL,
+        OnnxError::Load(_) | OnnxError::Inference(_) => SPEAR_EIO,
+    }
+}
+
+impl DefaultHostApi {
+    /// Run an `onnx_infer` request / 执行 `onnx_infer` 请求
+    pub fn onnx_infer(&self, request: &[u8]) -> Result<Vec<u8>, i32> {
+        let digest: [u8; 32] = Sha256::digest(request).into();
+        if let Some((d, out)) = self.onnx_last.0.lock().take() {
+            if d == digest {
+                return Ok(out);
+            }
+        }
+        let req: InferRequest = serde_json::from_slice(request).map_err(|_| -SPEAR_EINVAL)?;
+        let model = req.model.clone();
+        let resp = self.node().onnx.infer(req).map_err(|e| {
+            tracing::warn!(model = %model, error = %e, "onnx_infer failed");
+            errno(&e)
+        })?;
+        let out = serde_json::to_vec(&resp).map_err(|_| -SPEAR_EIO)?;
+        *self.onnx_last.0.lock() = Some((digest, out.clone()));
+        Ok(out)
+    }
+
+    /// The guest received the result; drop the copy kept for a retry
+    /// guest 已收到结果；丢弃为重试保留的副本
+    pub fn onnx_infer_delivered(&self) {
+        self.onnx_last.0.lock().take();
+    }
+
+    /// `onnx_ctl`: list models, or load or unload one by name
+    /// `onnx_ctl`：列出模型，或按名称加载、卸载模型
+    pub fn onnx_ctl(&self, cmd: i32, arg: &[u8]) -> Result<Vec<u8>, i32> {
+        let m = &self.node().onnx;
+        if !m.config().enabled {
+            return Err(-SPEAR_ENOSYS);
+        }
+        let name = || std::str::from_utf8(arg).map_err(|_| -SPEAR_EINVAL);
+        match cmd {
+            ONNX_CTL_LIST => serde_json::to_vec(&m.list()).map_err(|_| -SPEAR_EIO),
+            ONNX_CTL_LOAD => m.load(name()?).map(|_| Vec::new()).map_err(|e| errno(&e)),
+            ONNX_CTL_UNLOAD => {
+                let name = name()?;
+                if !m.list().iter().any(|s| s.name == name) {
+                    return Err(-SPEAR_ENOENT);
+                }
+                m.unload(name);
+                Ok(Vec::new())
+            }
+            _ => Err(-SPEAR_EINVAL),
+        }
+    }
+}
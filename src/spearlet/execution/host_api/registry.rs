@@ -1,9 +1,32 @@
+use crate::spearlet::execution::ai::backends::anthropic_messages::AnthropicMessagesBackendAdapter;
+#[cfg(feature = "rt-asr")]
+use crate::spearlet::execution::ai::backends::azure_speech_ws::AzureSpeechWsBackendAdapter;
+#[cfg(feature = "rt-asr")]
+use crate::spearlet::execution::ai::backends::deepgram_listen_ws::DeepgramListenWsBackendAdapter;
+use crate::spearlet::execution::ai::backends::gemini_chat::GeminiChatBackendAdapter;
+use crate::spearlet::execution::ai::backends::gemini_embeddings::GeminiEmbeddingsBackendAdapter;
+#[cfg(feature = "rt-asr")]
+use crate::spearlet::execution::ai::backends::google_speech::GoogleSpeechBackendAdapter;
+use crate::spearlet::execution::ai::backends::huggingface_embeddings::HuggingFaceEmbeddingsBackendAdapter;
+use crate::spearlet::execution::ai::backends::local_moderation::LocalModerationBackendAdapter;
 use crate::spearlet::execution::ai::backends::ollama_chat::OllamaChatBackendAdapter;
+use crate::spearlet::execution::ai::backends::ollama_embeddings::OllamaEmbeddingsBackendAdapter;
 use crate::spearlet::execution::ai::backends::openai_chat_completion::OpenAIChatCompletionBackendAdapter;
+use crate::spearlet::execution::ai::backends::openai_embeddings::OpenAIEmbeddingsBackendAdapter;
+use crate::spearlet::execution::ai::backends::openai_endpoint::EndpointStyle;
+use crate::spearlet::execution::ai::backends::openai_images::OpenAIImagesBackendAdapter;
+use crate::spearlet::execution::ai::backends::openai_moderations::OpenAIModerationsBackendAdapter;
 use crate::spearlet::execution::ai::backends::openai_realtime_ws::OpenAIRealtimeWsBackendAdapter;
+use crate::spearlet::execution::ai::backends::openai_responses::OpenAIResponsesBackendAdapter;
+use crate::spearlet::execution::ai::backends::openai_speech::OpenAISpeechBackendAdapter;
+use crate::spearlet::execution::ai::backends::stability_image::StabilityImageBackendAdapter;
 use crate::spearlet::execution::ai::backends::stub::StubBackendAdapter;
 use crate::spearlet::execution::ai::backends::{
-    KIND_OLLAMA_CHAT, KIND_OPENAI_CHAT_COMPLETION, KIND_OPENAI_REALTIME_WS, KIND_STUB,
+    KIND_ANTHROPIC_MESSAGES, KIND_AZURE_SPEECH_WS, KIND_DEEPGRAM_LISTEN_WS, KIND_GEMINI_CHAT,
+    KIND_GEMINI_EMBEDDINGS, KIND_GOOGLE_SPEECH, KIND_HUGGINGFACE_EMBEDDINGS, KIND_LOCAL_MODERATION,
+    KIND_OLLAMA_CHAT, KIND_OLLAMA_EMBEDDINGS, KIND_OPENAI_CHAT_COMPLETION, KIND_OPENAI_EMBEDDINGS,
+    KIND_OPENAI_IMAGES, KIND_OPENAI_MODERATIONS, KIND_OPENAI_REALTIME_WS, KIND_OPENAI_RESPONSES,
+    KIND_OPENAI_SPEECH, KIND_STABILITY_IMAGE, KIND_STUB,
 };
 use crate::spearlet::execution::ai::ir::Operation;
 use crate::spearlet::execution::ai::router::capabilities::Capabilities;
@@ -56,12 +79,39 @@ pub(crate) fn build_registry_from_runtime_config(
             if ops.is_empty() {
                 continue;
             }
+            let style = match EndpointStyle::from_config(
+                b.auth_style.as_deref(),
+                b.api_version.as_deref(),
+            ) {
+                Ok(s) => s,
+                Err(msg) => {
+                    tracing::warn!(backend = %b.name, kind = %b.kind, "invalid backend configuration: {msg}");
+                    continue;
+                }
+            };
+            if style.is_azure()
+                && b.kind != KIND_OPENAI_CHAT_COMPLETION
+                && b.kind != KIND_OPENAI_EMBEDDINGS
+            {
+                tracing::warn!(backend = %b.name, kind = %b.kind, "invalid backend configuration: auth_style azure is supported by openai_chat_completion and openai_embeddings only");
+                continue;
+            }
 
             let adapter: Arc<dyn crate::spearlet::execution::ai::backends::BackendAdapter> = match b
                 .kind
                 .as_str()
             {
-                KIND_OPENAI_CHAT_COMPLETION => {
+                KIND_OPENAI_CHAT_COMPLETION
+                | KIND_OPENAI_RESPONSES
+                | KIND_OPENAI_SPEECH
+                | KIND_OPENAI_EMBEDDINGS
+                | KIND_OPENAI_IMAGES
+                | KIND_OPENAI_MODERATIONS
+                | KIND_HUGGINGFACE_EMBEDDINGS
+                | KIND_STABILITY_IMAGE
+                | KIND_ANTHROPIC_MESSAGES
+                | KIND_GEMINI_CHAT
+                | KIND_GEMINI_EMBEDDINGS => {
                     let api_key = match b.credential_ref.as_deref().map(|s| s.trim()) {
                         Some(r) if !r.is_empty() => {
                             let env_name = match resolve_backend_api_key_env(b, &cred_index) {
@@ -81,13 +131,76 @@ pub(crate) fn build_registry_from_runtime_config(
                         }
                         _ => None,
                     };
-                    Arc::new(OpenAIChatCompletionBackendAdapter::new(
-                        b.name.clone(),
-                        b.base_url.clone(),
-                        api_key,
-                    ))
+                    match b.kind.as_str() {
+                        KIND_OPENAI_RESPONSES => Arc::new(OpenAIResponsesBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key,
+                        )),
+                        KIND_OPENAI_SPEECH => Arc::new(OpenAISpeechBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key,
+                        )),
+                        KIND_OPENAI_EMBEDDINGS => Arc::new(
+                            OpenAIEmbeddingsBackendAdapter::new(
+                                b.name.clone(),
+                                b.base_url.clone(),
+                                api_key,
+                            )
+                            .with_endpoint_style(style),
+                        ),
+                        KIND_OPENAI_IMAGES => Arc::new(OpenAIImagesBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key,
+                        )),
+                        KIND_OPENAI_MODERATIONS => Arc::new(OpenAIModerationsBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key,
+                        )),
+                        KIND_HUGGINGFACE_EMBEDDINGS => {
+                            Arc::new(HuggingFaceEmbeddingsBackendAdapter::new(
+                                b.name.clone(),
+                                b.base_url.clone(),
+                                api_key,
+                            ))
+                        }
+                        KIND_STABILITY_IMAGE => Arc::new(StabilityImageBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key,
+                        )),
+                        KIND_ANTHROPIC_MESSAGES => Arc::new(AnthropicMessagesBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key,
+                        )),
+                        KIND_GEMINI_CHAT => Arc::new(GeminiChatBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key,
+                        )),
+                        KIND_GEMINI_EMBEDDINGS => Arc::new(GeminiEmbeddingsBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key,
+                        )),
+                        _ => Arc::new(
+                            OpenAIChatCompletionBackendAdapter::new(
+                                b.name.clone(),
+                                b.base_url.clone(),
+                                api_key,
+                            )
+                            .with_endpoint_style(style),
+                        ),
+                    }
                 }
-                KIND_OPENAI_REALTIME_WS => {
+                KIND_OPENAI_REALTIME_WS
+                | KIND_DEEPGRAM_LISTEN_WS
+                | KIND_AZURE_SPEECH_WS
+                | KIND_GOOGLE_SPEECH => {
                     let api_key_env = match b.credential_ref.as_deref().map(|s| s.trim()) {
                         Some(r) if !r.is_empty() => {
                             let env_name = match resolve_backend_api_key_env(b, &cred_index) {
@@ -107,17 +220,52 @@ pub(crate) fn build_registry_from_runtime_config(
                         }
                         _ => None,
                     };
-                    Arc::new(OpenAIRealtimeWsBackendAdapter::new(
-                        b.name.clone(),
-                        b.base_url.clone(),
-                        api_key_env,
-                    ))
+                    match b.kind.as_str() {
+                        #[cfg(feature = "rt-asr")]
+                        KIND_DEEPGRAM_LISTEN_WS => Arc::new(DeepgramListenWsBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key_env,
+                        )),
+                        #[cfg(feature = "rt-asr")]
+                        KIND_AZURE_SPEECH_WS => Arc::new(AzureSpeechWsBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key_env,
+                        )),
+                        #[cfg(feature = "rt-asr")]
+                        KIND_GOOGLE_SPEECH => Arc::new(GoogleSpeechBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key_env,
+                        )),
+                        #[cfg(not(feature = "rt-asr"))]
+                        KIND_DEEPGRAM_LISTEN_WS | KIND_AZURE_SPEECH_WS | KIND_GOOGLE_SPEECH => {
+                            tracing::warn!(backend = %b.name, kind = %b.kind, "backend kind needs a build with the rt-asr feature");
+                            continue;
+                        }
+                        _ => Arc::new(OpenAIRealtimeWsBackendAdapter::new(
+                            b.name.clone(),
+                            b.base_url.clone(),
+                            api_key_env,
+                        )),
+                    }
                 }
                 KIND_OLLAMA_CHAT => Arc::new(OllamaChatBackendAdapter::new(
                     b.name.clone(),
                     b.base_url.clone(),
                     b.model.clone(),
                 )),
+                KIND_OLLAMA_EMBEDDINGS => Arc::new(OllamaEmbeddingsBackendAdapter::new(
+                    b.name.clone(),
+                    b.base_url.clone(),
+                    b.model.clone(),
+                )),
+                KIND_LOCAL_MODERATION => Arc::new(LocalModerationBackendAdapter::new(
+                    b.name.clone(),
+                    b.base_url.clone(),
+                    b.model.clone(),
+                )),
                 KIND_STUB => Arc::new(StubBackendAdapter::new(&b.name)),
                 _ => continue,
             };
@@ -198,6 +346,7 @@ fn parse_operation(s: &str) -> Option<Operation> {
         "speech_to_text" => Some(Operation::SpeechToText),
         "text_to_speech" => Some(Operation::TextToSpeech),
         "realtime_voice" => Some(Operation::RealtimeVoice),
+        "moderations" => Some(Operation::Moderations),
         _ => None,
     }
 }
@@ -1,21 +1,56 @@
 use crate::spearlet::execution::ai::ir::{Operation, Payload, RoutingHints, SpeechToTextPayload};
 use crate::spearlet::execution::ai::streaming::{StreamingPlan, StreamingWebsocketPlan};
+use crate::spearlet::execution::host_api::errno::{
+    SPEAR_EAGAIN, SPEAR_EBADF, SPEAR_EDQUOT, SPEAR_EINVAL, SPEAR_EIO, SPEAR_EPIPE,
+};
+use crate::spearlet::execution::host_api::language::{self, DetectedLanguage};
 use crate::spearlet::execution::host_api::DefaultHostApi;
 use crate::spearlet::execution::hostcall::types::{
     FdEntry, FdFlags, FdInner, FdKind, PollEvents, RtAsrConnState, RtAsrSendItem,
 };
-use crate::spearlet::execution::host_api::errno::{SPEAR_EAGAIN, SPEAR_EBADF, SPEAR_EINVAL, SPEAR_EIO};
 use serde_json::json;
 use std::collections::HashMap;
 use std::collections::HashSet;
 
 use crate::spearlet::param_keys::{chat as chat_keys, rtasr as rtasr_keys};
+use crate::spearlet::usage;
 
+mod backend;
+mod channels;
+mod finish;
 mod readiness;
+mod reconnect;
 mod segmentation;
+mod session;
 mod stub;
 mod websocket;
 
+/// Request routed to a speech-to-text backend; backends that cannot stream are skipped
+/// 路由到语音转文字后端的请求；无法流式处理的后端会被跳过
+fn speech_to_text_request(
+    backend: Option<String>,
+    model: Option<String>,
+) -> crate::spearlet::execution::ai::ir::CanonicalRequestEnvelope {
+    crate::spearlet::execution::ai::ir::CanonicalRequestEnvelope {
+        version: 1,
+        request_id: "rtasr_connect".to_string(),
+        operation: Operation::SpeechToText,
+        meta: HashMap::new(),
+        routing: RoutingHints {
+            backend,
+            allowlist: vec![],
+            denylist: vec![],
+        },
+        requirements: crate::spearlet::execution::ai::ir::Requirements {
+            required_features: vec![],
+            required_transports: vec![],
+        },
+        timeout_ms: None,
+        payload: Payload::SpeechToText(SpeechToTextPayload { model }),
+        extra: HashMap::new(),
+    }
+}
+
 impl DefaultHostApi {
     pub fn rtasr_create(&self) -> i32 {
         self.fd_table.alloc(FdEntry {
@@ -42,6 +77,9 @@ impl DefaultHostApi {
         const RTASR_CTL_CLEAR: i32 = 6;
         const RTASR_CTL_SET_AUTOFLUSH: i32 = 7;
         const RTASR_CTL_GET_AUTOFLUSH: i32 = 8;
+        const RTASR_CTL_GET_LANGUAGE: i32 = 9;
+        const RTASR_CTL_UPDATE_SESSION: i32 = 10;
+        const RTASR_CTL_FINISH: i32 = 11;
 
         let Some(entry) = self.fd_table.get(fd) else {
             return Err(-SPEAR_EBADF);
@@ -57,6 +95,7 @@ impl DefaultHostApi {
                 if key.is_empty() {
                     return Err(-SPEAR_EINVAL);
                 }
+                session::validate_param(key, &value)?;
 
                 let notify = {
                     let mut e = entry.lock().map_err(|_| -SPEAR_EIO)?;
@@ -102,11 +141,15 @@ impl DefaultHostApi {
             }
             RTASR_CTL_CONNECT => {
                 let mut spawn_stub = false;
+                let mut stub_channels: Vec<String> = Vec::new();
                 let mut spawn_ws = false;
-                let mut ws_plan: Option<StreamingWebsocketPlan> = None;
+                let mut ws_plans: Vec<(Option<String>, StreamingWebsocketPlan)> = Vec::new();
                 let mut ws_url_override: Option<String> = None;
                 let mut client_secret_override: Option<String> = None;
                 let mut model_override: Option<String> = None;
+                let mut configured_language: Option<String> = None;
+                let mut reconnect_policy = reconnect::ReconnectPolicy::default();
+                let session_key = self.language_session_key();
                 let notify = {
                     let mut e = entry.lock().map_err(|_| -SPEAR_EIO)?;
                     if e.closed {
@@ -123,8 +166,10 @@ impl DefaultHostApi {
                         return Err(-SPEAR_EIO);
                     }
 
+                    let channel_specs = channels::parse_channels(&st.params)?;
                     if !st.stub_connected {
                         st.stub_connected = true;
+                        stub_channels = channel_specs.iter().map(|c| c.id.clone()).collect();
                         st.state = RtAsrConnState::Connected;
                         let transport = st
                             .params
@@ -146,36 +191,35 @@ impl DefaultHostApi {
                         if let Some(s) = st.params.get(rtasr_keys::MODEL).and_then(|x| x.as_str()) {
                             model_override = Some(s.to_string());
                         }
+                        configured_language = language::configured_language(&st.params);
+                        reconnect_policy = reconnect::ReconnectPolicy::from_params(&st.params);
+                        if let Some(code) = &configured_language {
+                            st.detected_language = Some(DetectedLanguage::configured(code.clone()));
+                        }
 
                         if transport == "websocket" {
-                            let req =
-                                crate::spearlet::execution::ai::ir::CanonicalRequestEnvelope {
-                                    version: 1,
-                                    request_id: "rtasr_connect".to_string(),
-                                    operation: Operation::SpeechToText,
-                                    meta: HashMap::new(),
-                                    routing: RoutingHints {
-                                        backend: st
-                                            .params
-                                            .get(chat_keys::BACKEND)
-                                            .and_then(|x| x.as_str())
-                                            .map(|s| s.to_string()),
-                                        allowlist: vec![],
-                                        denylist: vec![],
-                                    },
-                                    requirements:
-                                        crate::spearlet::execution::ai::ir::Requirements {
-                                            required_features: vec![],
-                                            required_transports: vec!["websocket".to_string()],
-                                        },
-                                    timeout_ms: None,
-                                    payload: Payload::SpeechToText(SpeechToTextPayload {
-                                        model: model_override.clone(),
-                                    }),
-                                    extra: HashMap::new(),
+                            let session_backend = st
+                                .params
+                                .get(chat_keys::BACKEND)
+                                .and_then(|x| x.as_str())
+                                .map(|s| s.to_string());
+                            let targets: Vec<Option<&channels::ChannelSpec>> =
+                                if channel_specs.is_empty() {
+                                    vec![None]
+                                } else {
+                                    channel_specs.iter().map(Some).collect()
+                                };
+                            for ch in targets {
+                                let req = speech_to_text_request(
+                                    ch.and_then(|c| c.backend.clone())
+                                        .or_else(|| session_backend.clone()),
+                                    ch.and_then(|c| c.model.clone())
+                                        .or_else(|| model_override.clone()),
+                                );
+                                let Ok(inv) = self.ai_engine.invoke_streaming(&req) else {
+                                    ws_plans.clear();
+                                    break;
                                 };
-
-                            if let Ok(inv) = self.ai_engine.invoke_streaming(&req) {
                                 match inv.plan {
                                     StreamingPlan::Websocket(mut p) => {
                                         if p.websocket.supports_turn_detection {
@@ -184,13 +228,26 @@ impl DefaultHostApi {
                                                 &st.segmentation,
                                             );
                                         }
-                                        ws_plan = Some(p);
-                                        spawn_ws = true;
+                                        let code = ch
+                                            .and_then(|c| c.language.as_ref())
+                                            .or(configured_language.as_ref());
+                                        if let Some(code) = code {
+                                            language::apply_language_to_client_events(
+                                                &mut p.websocket.client_events,
+                                                code,
+                                            );
+                                        }
+                                        session::apply_patch_to_client_events(
+                                            &mut p.websocket.client_events,
+                                            &session::patch_from_params(&st.params),
+                                            p.websocket.supports_turn_detection,
+                                        );
+                                        ws_plans.push((ch.map(|c| c.id.clone()), p));
                                     }
                                 }
-                            } else {
-                                spawn_stub = true;
                             }
+                            spawn_ws = !ws_plans.is_empty();
+                            spawn_stub = !spawn_ws;
                         } else {
                             spawn_stub = true;
                         }
@@ -203,16 +260,23 @@ impl DefaultHostApi {
                 if notify {
                     self.fd_table.notify_watchers(fd);
                 }
+                if let Some(code) = configured_language {
+                    self.node()
+                        .session_languages
+                        .record(&session_key, DetectedLanguage::configured(code));
+                }
                 if spawn_ws {
-                    let plan = ws_plan.ok_or(-SPEAR_EIO)?;
                     self.spawn_rtasr_websocket_tasks(
                         fd,
-                        plan,
+                        ws_plans,
                         ws_url_override,
                         client_secret_override,
+                        session_key,
+                        reconnect_policy,
+                        self.rtasr_session_owner(),
                     );
                 } else if spawn_stub {
-                    self.spawn_rtasr_stub_tasks(fd);
+                    self.spawn_rtasr_stub_tasks(fd, stub_channels, self.rtasr_session_owner());
                 }
                 Ok(None)
             }
@@ -241,6 +305,13 @@ impl DefaultHostApi {
                     "max_send_queue_bytes": st.max_send_queue_bytes,
                     "max_recv_queue_bytes": st.max_recv_queue_bytes,
                     "dropped_events": st.dropped_events,
+                    "reconnects": st.reconnects,
+                    "detected_language": st.detected_language,
+                    "channels": channels::parse_channels(&st.params)
+                        .unwrap_or_default()
+                        .into_iter()
+                        .map(|c| c.id)
+                        .collect::<Vec<_>>(),
                 });
                 let bytes = serde_json::to_vec(&body).map_err(|_| -SPEAR_EIO)?;
                 Ok(Some(bytes))
@@ -392,10 +463,147 @@ impl DefaultHostApi {
                 let bytes = serde_json::to_vec(&body).map_err(|_| -SPEAR_EIO)?;
                 Ok(Some(bytes))
             }
+            RTASR_CTL_GET_LANGUAGE => {
+                let e = entry.lock().map_err(|_| -SPEAR_EIO)?;
+                if e.closed {
+                    return Err(-SPEAR_EBADF);
+                }
+                let FdInner::RtAsr(st) = &e.inner else {
+                    return Err(-SPEAR_EBADF);
+                };
+                let bytes = serde_json::to_vec(&st.detected_language).map_err(|_| -SPEAR_EIO)?;
+                Ok(Some(bytes))
+            }
+            RTASR_CTL_UPDATE_SESSION => {
+                let bytes = payload.ok_or(-SPEAR_EINVAL)?;
+                let v: serde_json::Value =
+                    serde_json::from_slice(bytes).map_err(|_| -SPEAR_EINVAL)?;
+                let up = session::parse_session_update(&v)?;
+                let session_key = self.language_session_key();
+
+                let mut e = entry.lock().map_err(|_| -SPEAR_EIO)?;
+                if e.closed {
+                    return Err(-SPEAR_EBADF);
+                }
+                let old = e.poll_mask;
+                let mut configured = None;
+                {
+                    let FdInner::RtAsr(st) = &mut e.inner else {
+                        return Err(-SPEAR_EBADF);
+                    };
+                    if st.state == RtAsrConnState::Closed {
+                        return Err(-SPEAR_EBADF);
+                    }
+                    if st.state == RtAsrConnState::Error {
+                        return Err(-SPEAR_EIO);
+                    }
+                    // Before CONNECT the update only sets params; a connected websocket
+                    // session is sent a `session.update`
+                    // CONNECT 之前更新仅设置参数；已连接的 websocket 会话会收到 `session.update`
+                    let transport = st.params.get(rtasr_keys::TRANSPORT);
+                    let live = st.stub_connected
+                        && transport.and_then(|x| x.as_str()) == Some("websocket");
+                    if live {
+                        let item = RtAsrSendItem::SessionUpdate(up.patch.clone());
+                        let n = item.byte_len();
+                        if st.send_queue_bytes.saturating_add(n) > st.max_send_queue_bytes {
+                            return Err(-SPEAR_EAGAIN);
+                        }
+                        st.send_queue.push_back(item);
+                        st.send_queue_bytes = st.send_queue_bytes.saturating_add(n);
+                        session::merge_overrides(&mut st.session_overrides, &up.patch);
+                    }
+                    for (k, v) in up.params {
+                        if v.is_null() {
+                            st.params.remove(k);
+                        } else {
+                            st.params.insert(k.to_string(), v);
+                        }
+                    }
+                    if let Some(cfg) = up.segmentation {
+                        let now = std::time::Instant::now();
+                        st.segmentation = cfg;
+                        st.pending_flush = false;
+                        st.buffered_audio_bytes_since_flush = 0;
+                        st.last_flush_at = now;
+                        st.last_audio_at = now;
+                    }
+                    if st.state == RtAsrConnState::Init {
+                        st.state = RtAsrConnState::Configured;
+                    }
+                    match &up.language {
+                        Some(Some(code)) if live => {
+                            let lang = DetectedLanguage::configured(code.clone());
+                            st.detected_language = Some(lang.clone());
+                            configured = Some(lang);
+                        }
+                        Some(None) => st.detected_language = None,
+                        _ => {}
+                    }
+                }
+                self.recompute_rtasr_readiness_locked(&mut e);
+                let notify = e.poll_mask.bits() != old.bits();
+                drop(e);
+                if notify {
+                    self.fd_table.notify_watchers(fd);
+                }
+                if let Some(lang) = configured {
+                    self.node().session_languages.record(&session_key, lang);
+                }
+                Ok(None)
+            }
+            RTASR_CTL_FINISH => {
+                let mut e = entry.lock().map_err(|_| -SPEAR_EIO)?;
+                if e.closed {
+                    return Err(-SPEAR_EBADF);
+                }
+                let old = e.poll_mask;
+                {
+                    let FdInner::RtAsr(st) = &mut e.inner else {
+                        return Err(-SPEAR_EBADF);
+                    };
+                    match st.state {
+                        RtAsrConnState::Error => return Err(-SPEAR_EIO),
+                        RtAsrConnState::Draining | RtAsrConnState::Closed => {}
+                        _ if !st.stub_connected => return Err(-SPEAR_EINVAL),
+                        _ => {
+                            let transport = st.params.get(rtasr_keys::TRANSPORT);
+                            if transport.and_then(|x| x.as_str()) == Some("websocket") {
+                                let n = channels::parse_channels(&st.params).map_or(1, |c| c.len());
+                                finish::begin_finish_locked(st, n, std::time::Instant::now())?;
+                            } else {
+                                // The stub has nothing in flight / stub 没有在途内容
+                                st.send_queue.clear();
+                                st.send_queue_bytes = 0;
+                                finish::complete_finish_locked(st, false, None);
+                            }
+                        }
+                    }
+                }
+                self.recompute_rtasr_readiness_locked(&mut e);
+                let notify = e.poll_mask.bits() != old.bits();
+                drop(e);
+                if notify {
+                    self.fd_table.notify_watchers(fd);
+                }
+                Ok(None)
+            }
             _ => Err(-SPEAR_EINVAL),
         }
     }
 
+    /// Execution and instance the session belongs to / 会话所属的执行与实例
+    fn rtasr_session_owner(&self) -> finish::SessionOwner {
+        finish::SessionOwner {
+            execution_id: self
+                .execution_id
+                .clone()
+                .or_else(super::core::current_wasm_execution_id),
+            instance_id: self.instance_id.clone(),
+            node: self.runtime_config.node.clone(),
+        }
+    }
+
     pub fn rtasr_write(&self, fd: i32, bytes: &[u8]) -> i32 {
         let Some(entry) = self.fd_table.get(fd) else {
             return -SPEAR_EBADF;
@@ -416,9 +624,34 @@ impl DefaultHostApi {
             if st.state == RtAsrConnState::Error {
                 return -SPEAR_EIO;
             }
+            if matches!(st.state, RtAsrConnState::Draining | RtAsrConnState::Closed) {
+                return -SPEAR_EPIPE;
+            }
+            // Audio sent to a realtime backend is metered / 送往实时后端的音频计入用量
+            let metered = match (&self.task_id, st.params.get(rtasr_keys::TRANSPORT)) {
+                (Some(task_id), Some(t)) if t.as_str() == Some("websocket") => {
+                    let backend = st
+                        .params
+                        .get(chat_keys::BACKEND)
+                        .and_then(|x| x.as_str())
+                        .unwrap_or("realtime");
+                    Some((task_id.as_str(), backend.to_string()))
+                }
+                _ => None,
+            };
+            if let Some((task_id, _)) = &metered {
+                if self.node().usage.admit(task_id).is_err() {
+                    return -SPEAR_EDQUOT;
+                }
+            }
             if st.send_queue_bytes.saturating_add(bytes.len()) > st.max_send_queue_bytes {
                 -SPEAR_EAGAIN
             } else {
+                if let Some((task_id, backend)) = &metered {
+                    self.node()
+                        .usage
+                        .record(task_id, backend, usage::audio(bytes.len()));
+                }
                 st.send_queue
                     .push_back(RtAsrSendItem::Audio(bytes.to_vec()));
                 st.send_queue_bytes = st.send_queue_bytes.saturating_add(bytes.len());
@@ -453,6 +686,7 @@ impl DefaultHostApi {
 
         let old = e.poll_mask;
         let mut payload: Option<Vec<u8>> = None;
+        let finished;
         {
             let FdInner::RtAsr(st) = &mut e.inner else {
                 return Err(-SPEAR_EBADF);
@@ -461,6 +695,7 @@ impl DefaultHostApi {
                 st.recv_queue_bytes = st.recv_queue_bytes.saturating_sub(p.len());
                 payload = Some(p);
             }
+            finished = st.state == RtAsrConnState::Closed;
         }
 
         self.recompute_rtasr_readiness_locked(&mut e);
@@ -472,6 +707,8 @@ impl DefaultHostApi {
 
         match payload {
             Some(p) => Ok(p),
+            // Finished and drained / 已结束且已读完
+            None if finished => Err(-SPEAR_EPIPE),
             None => Err(-SPEAR_EAGAIN),
         }
     }
@@ -484,6 +721,10 @@ impl DefaultHostApi {
                 }
             }
         }
-        self.fd_table.close(fd)
+        // The websocket task sees the fd gone, closes the provider socket and exits
+        // websocket 任务发现 fd 已移除后关闭服务商连接并退出
+        let rc = self.fd_table.close(fd);
+        self.fd_table.remove(fd);
+        rc
     }
 }
@@ -0,0 +1,223 @@
+//! Streaming speech-to-text backends of rtasr
+//! rtasr 的流式语音转文字后端
+//!
+//! The transport queues OpenAI realtime events (audio, commits, `session.update`) and
+//! hands the guest events of the same shape. A `StreamingAsrBackend` translates both ways
+//! for the protocol of a plan: it opens the provider session, frames the audio and the
+//! queued events, and turns provider frames into guest events. Providers that revise
+//! their hypotheses report them as `...input_audio_transcription.interim` events carrying
+//! the whole hypothesis so far.
+//! 传输层排队 OpenAI realtime 事件（音频、提交、`session.update`），并向 guest 提供相同形状的事件。
+//! `StreamingAsrBackend` 按计划的协议双向转换：打开服务商会话、封装音频与排队事件，
+//! 并将服务商帧转换为 guest 事件。会修正假设的服务商以 `...input_audio_transcription.interim`
+//! 事件报告当前完整假设。
+
+// The shared framing helpers serve the provider backends / 共享的帧辅助函数供服务商后端使用
+#![cfg_attr(not(feature = "rt-asr"), allow(dead_code))]
+
+use std::pin::Pin;
+use std::sync::Arc;
+
+use futures::{Sink, Stream};
+use serde_json::{json, Map, Value};
+use tokio_tungstenite::tungstenite::Message;
+
+use crate::spearlet::execution::ai::streaming::AsrProtocol;
+
+#[cfg(feature = "rt-asr")]
+mod azure;
+#[cfg(feature = "rt-asr")]
+mod deepgram;
+#[cfg(feature = "rt-asr")]
+mod google;
+
+/// Frames sent to a provider / 发往服务商的帧
+pub(super) type AsrSink = Pin<Box<dyn Sink<Message, Error = String> + Send>>;
+
+/// Frames received from a provider / 从服务商收到的帧
+pub(super) type AsrStream = Pin<Box<dyn Stream<Item = Result<Message, String>> + Send>>;
+
+/// Sample rate of the pcm16 mono audio the guest writes / guest 写入的 pcm16 单声道音频采样率
+pub(super) const SAMPLE_RATE_HZ: u32 = 24_000;
+
+const COMMIT: &str = "input_audio_buffer.commit";
+const CLEAR: &str = "input_audio_buffer.clear";
+const SESSION_UPDATE: &str = "session.update";
+const TRANSCRIPTION_PREFIX: &str = "conversation.item.input_audio_transcription";
+
+/// Wire protocol of one provider connection / 单个服务商连接的线路协议
+pub(super) trait StreamingAsrBackend: Send + Sync {
+    /// URL to connect to, given the provider session / 根据服务商会话得到要连接的 URL
+    fn session_url(&self, url: &str, session: Option<&Map<String, Value>>) -> String {
+        let _ = session;
+        url.to_string()
+    }
+
+    /// A connection served on the host, for providers without a websocket API
+    /// 在宿主侧提供的连接，用于没有 websocket API 的服务商
+    fn local_connection(
+        &self,
+        url: &str,
+        headers: Vec<(String, String)>,
+    ) -> Option<(AsrSink, AsrStream)> {
+        let _ = (url, headers);
+        None
+    }
+
+    /// Frames opening the provider session from the plan's session events
+    /// 根据计划的会话事件打开服务商会话的帧
+    fn create_session(&self, client_events: &[Value]) -> Vec<Message>;
+
+    /// Frames carrying a chunk of audio / 携带一段音频的帧
+    fn send_audio(&self, chunk: &[u8]) -> Vec<Message>;
+
+    /// Frames for a queued event: a commit, a clear, a `session.update` or a guest event
+    /// 排队事件对应的帧：提交、清空、`session.update` 或 guest 事件
+    fn send_event(&self, text: &str) -> Vec<Message>;
+
+    /// Frames keeping an idle connection open / 保持空闲连接的帧
+    fn keepalive(&self) -> Vec<Message> {
+        Vec::new()
+    }
+
+    /// Frames sent before the close frame / 在关闭帧之前发送的帧
+    fn close(&self) -> Vec<Message> {
+        Vec::new()
+    }
+
+    /// Guest events for a provider frame / 服务商帧对应的 guest 事件
+    fn events(&self, msg: Message) -> Vec<Vec<u8>>;
+}
+
+/// A fresh backend for one connection; providers other than OpenAI need the `rt-asr` feature
+/// 为单个连接创建新的后端；OpenAI 以外的服务商需要 `rt-asr` feature
+pub(super) fn backend_for(protocol: AsrProtocol) -> Result<Arc<dyn StreamingAsrBackend>, String> {
+    Ok(match protocol {
+        AsrProtocol::OpenaiRealtime => Arc::new(OpenAiRealtime),
+        #[cfg(feature = "rt-asr")]
+        AsrProtocol::Deepgram => Arc::new(deepgram::Deepgram),
+        #[cfg(feature = "rt-asr")]
+        AsrProtocol::AzureSpeech => Arc::new(azure::AzureSpeech::default()),
+        #[cfg(feature = "rt-asr")]
+        AsrProtocol::GoogleSpeech => Arc::new(google::GoogleSpeech),
+        #[cfg(not(feature = "rt-asr"))]
+        other => {
+            return Err(format!(
+                "{other:?} speech needs a build with the rt-asr feature"
+            ))
+        }
+    })
+}
+
+/// OpenAI realtime: events go out and come back as they are
+/// OpenAI realtime：事件原样发出与返回
+struct OpenAiRealtime;
+
+impl StreamingAsrBackend for OpenAiRealtime {
+    fn create_session(&self, client_events: &[Value]) -> Vec<Message> {
+        client_events
+            .iter()
+            .map(|ev| Message::Text(ev.to_string()))
+            .collect()
+    }
+
+    fn send_audio(&self, chunk: &[u8]) -> Vec<Message> {
+        let audio_b64 = {
+            use base64::Engine;
+            base64::engine::general_purpose::STANDARD.encode(chunk)
+        };
+        let body = json!({
+            "type": "input_audio_buffer.append",
+            "audio": audio_b64,
+        });
+        vec![Message::Text(body.to_string())]
+    }
+
+    fn send_event(&self, text: &str) -> Vec<Message> {
+        vec![Message::Text(text.to_string())]
+    }
+
+    fn events(&self, msg: Message) -> Vec<Vec<u8>> {
+        match msg {
+            Message::Text(s) => vec![s.into_bytes()],
+            Message::Binary(b) => vec![b],
+            _ => Vec::new(),
+        }
+    }
+}
+
+/// `type` of a queued event / 排队事件的 `type`
+fn event_type(text: &str) -> Option<String> {
+    let v: Value = serde_json::from_str(text).ok()?;
+    v.get("type").and_then(|t| t.as_str()).map(str::to_string)
+}
+
+/// A field of `input_audio_transcription` / `input_audio_transcription` 的字段
+fn transcription_field<'a>(
+    session: Option<&'a Map<String, Value>>,
+    field: &str,
+) -> Option<&'a str> {
+    session?
+        .get("input_audio_transcription")?
+        .get(field)?
+        .as_str()
+        .map(str::trim)
+        .filter(|s| !s.is_empty())
+}
+
+/// Locale for a language code, for providers that want a region
+/// 语种代码对应的区域设置，用于需要地区的服务商
+fn locale_for(code: &str) -> String {
+    if code.contains('-') {
+        return code.to_string();
+    }
+    let locale = match code {
+        "en" => "en-US",
+        "zh" => "zh-CN",
+        "ja" => "ja-JP",
+        "ko" => "ko-KR",
+        "es" => "es-ES",
+        "fr" => "fr-FR",
+        "de" => "de-DE",
+        "it" => "it-IT",
+        "pt" => "pt-BR",
+        "nl" => "nl-NL",
+        "ru" => "ru-RU",
+        "ar" => "ar-SA",
+        "hi" => "hi-IN",
+        "th" => "th-TH",
+        "el" => "el-GR",
+        "he" => "he-IL",
+        other => other,
+    };
+    locale.to_string()
+}
+
+fn interim_event(text: &str) -> Vec<u8> {
+    json!({"type": format!("{TRANSCRIPTION_PREFIX}.interim"), "transcript": text})
+        .to_string()
+        .into_bytes()
+}
+
+fn completed_event(text: &str, language: Option<&str>) -> Vec<u8> {
+    let mut ev = json!({"type": format!("{TRANSCRIPTION_PREFIX}.completed"), "transcript": text});
+    if let Some(lang) = language {
+        ev["language"] = Value::String(lang.to_string());
+    }
+    ev.to_string().into_bytes()
+}
+
+fn speech_event(started: bool) -> Vec<u8> {
+    let ty = if started {
+        "input_audio_buffer.speech_started"
+    } else {
+        "input_audio_buffer.speech_stopped"
+    };
+    json!({"type": ty}).to_string().into_bytes()
+}
+
+fn error_event(message: &str) -> Vec<u8> {
+    json!({"type": "error", "error": {"message": message}})
+        .to_string()
+        .into_bytes()
+}
@@ -0,0 +1,241 @@
+//! Azure Speech websocket protocol / Azure Speech websocket 协议
+//!
+//! Messages carry HTTP-like headers: text messages put them before a blank line, binary
+//! audio messages after a two-byte big-endian length. A turn starts with the first audio
+//! after a commit, whose message leads with a WAV header, and ends with an empty audio
+//! message; the service then reports the last `speech.phrase` and `turn.end`.
+//! 消息携带类似 HTTP 的头部：文本消息将其置于空行之前，二进制音频消息置于两字节大端长度之后。
+//! 提交之后的第一段音频开启一个轮次，其消息以 WAV 头开始；空音频消息结束该轮次，
+//! 随后服务端报告最后的 `speech.phrase` 与 `turn.end`。
+
+use parking_lot::Mutex;
+use serde_json::{json, Map, Value};
+use tokio_tungstenite::tungstenite::Message;
+
+use super::{
+    completed_event, error_event, event_type, interim_event, locale_for, speech_event,
+    transcription_field, StreamingAsrBackend, COMMIT, SAMPLE_RATE_HZ,
+};
+
+#[derive(Default)]
+pub(super) struct AzureSpeech {
+    /// Request id of the open turn / 当前轮次的请求 id
+    turn: Mutex<Option<String>>,
+}
+
+fn timestamp() -> String {
+    chrono::Utc::now().to_rfc3339_opts(chrono::SecondsFormat::Millis, true)
+}
+
+fn request_id() -> String {
+    uuid::Uuid::new_v4().simple().to_string()
+}
+
+/// Header of a streamed pcm16 mono WAV of unknown length / 长度未知的 pcm16 单声道 WAV 流头部
+fn wav_header(sample_rate: u32) -> Vec<u8> {
+    let mut h = Vec::with_capacity(44);
+    h.extend_from_slice(b"RIFF");
+    h.extend_from_slice(&0u32.to_le_bytes());
+    h.extend_from_slice(b"WAVEfmt ");
+    h.extend_from_slice(&16u32.to_le_bytes());
+    h.extend_from_slice(&1u16.to_le_bytes());
+    h.extend_from_slice(&1u16.to_le_bytes());
+    h.extend_from_slice(&sample_rate.to_le_bytes());
+    h.extend_from_slice(&(sample_rate * 2).to_le_bytes());
+    h.extend_from_slice(&2u16.to_le_bytes());
+    h.extend_from_slice(&16u16.to_le_bytes());
+    h.extend_from_slice(b"data");
+    h.extend_from_slice(&0u32.to_le_bytes());
+    h
+}
+
+fn audio_message(request_id: &str, audio: &[u8]) -> Message {
+    let headers = format!(
+        "Path: audio\r\nX-RequestId: {}\r\nX-Timestamp: {}\r\nContent-Type: audio/x-wav\r\n",
+        request_id,
+        timestamp()
+    );
+    let mut out = Vec::with_capacity(2 + headers.len() + audio.len());
+    out.extend_from_slice(&(headers.len() as u16).to_be_bytes());
+    out.extend_from_slice(headers.as_bytes());
+    out.extend_from_slice(audio);
+    Message::Binary(out)
+}
+
+/// Path and JSON body of a text message / 文本消息的路径与 JSON 正文
+fn parse_text_message(s: &str) -> Option<(String, Value)> {
+    let (head, body) = s.split_once("\r\n\r\n")?;
+    let path = head.split("\r\n").find_map(|line| {
+        let (k, v) = line.split_once(':')?;
+        k.trim()
+            .eq_ignore_ascii_case("path")
+            .then(|| v.trim().to_ascii_lowercase())
+    })?;
+    let body = serde_json::from_str(body).unwrap_or(Value::Null);
+    Some((path, body))
+}
+
+impl StreamingAsrBackend for AzureSpeech {
+    fn session_url(&self, url: &str, session: Option<&Map<String, Value>>) -> String {
+        let Ok(mut u) = url::Url::parse(url) else {
+            return url.to_string();
+        };
+        let language = locale_for(transcription_field(session, "language").unwrap_or("en"));
+        let present: Vec<String> = u.query_pairs().map(|(k, _)| k.into_owned()).collect();
+        {
+            let mut q = u.query_pairs_mut();
+            if !present.iter().any(|p| p == "language") {
+                q.append_pair("language", &language);
+            }
+            // A custom speech model is addressed by its endpoint id / 自定义语音模型以端点 id 指定
+            if let Some(cid) = transcription_field(session, "model") {
+                if !present.iter().any(|p| p == "cid") {
+                    q.append_pair("cid", cid);
+                }
+            }
+        }
+        u.to_string()
+    }
+
+    fn create_session(&self, _client_events: &[Value]) -> Vec<Message> {
+        let context = json!({
+            "context": {
+                "system": {"version": "1.0.0"},
+                "os": {
+                    "platform": std::env::consts::OS,
+                    "name": "spearlet",
+                    "version": env!("CARGO_PKG_VERSION"),
+                },
+                "audio": {
+                    "source": {
+                        "type": "Stream",
+                        "samplerate": SAMPLE_RATE_HZ,
+                        "bitspersample": 16,
+                        "channelcount": 1,
+                    }
+                },
+            }
+        });
+        vec![Message::Text(format!(
+            "Path: speech.config\r\nX-RequestId: {}\r\nX-Timestamp: {}\r\nContent-Type: application/json\r\n\r\n{}",
+            request_id(),
+            timestamp(),
+            context
+        ))]
+    }
+
+    fn send_audio(&self, chunk: &[u8]) -> Vec<Message> {
+        let mut turn = self.turn.lock();
+        match turn.as_deref() {
+            Some(id) => vec![audio_message(id, chunk)],
+            None => {
+                let id = request_id();
+                let mut audio = wav_header(SAMPLE_RATE_HZ);
+                audio.extend_from_slice(chunk);
+                let msg = audio_message(&id, &audio);
+                *turn = Some(id);
+                vec![msg]
+            }
+        }
+    }
+
+    fn send_event(&self, text: &str) -> Vec<Message> {
+        if event_type(text).as_deref() != Some(COMMIT) {
+            return Vec::new();
+        }
+        // An empty audio message ends the turn / 空音频消息结束轮次
+        match self.turn.lock().take() {
+            Some(id) => vec![audio_message(&id, &[])],
+            None => Vec::new(),
+        }
+    }
+
+    fn events(&self, msg: Message) -> Vec<Vec<u8>> {
+        let Message::Text(s) = msg else {
+            return Vec::new();
+        };
+        let Some((path, body)) = parse_text_message(&s) else {
+            return Vec::new();
+        };
+        let text = |k: &str| {
+            body.get(k)
+                .and_then(|t| t.as_str())
+                .unwrap_or("")
+                .to_string()
+        };
+        match path.as_str() {
+            "speech.hypothesis" | "speech.fragment" => vec![interim_event(&text("Text"))],
+            "speech.phrase" => match text("RecognitionStatus").as_str() {
+                "Success" => {
+                    let language = body
+                        .pointer("/PrimaryLanguage/Language")
+                        .and_then(|l| l.as_str());
+                    vec![completed_event(&text("DisplayText"), language)]
+                }
+                "NoMatch" | "InitialSilenceTimeout" | "BabbleTimeout" => {
+                    vec![completed_event("", None)]
+                }
+                "EndOfDictation" => Vec::new(),
+                status => vec![error_event(&format!("azure speech recognition: {status}"))],
+            },
+            "speech.startdetected" => vec![speech_event(true)],
+            "speech.enddetected" => vec![speech_event(false)],
+            _ => Vec::new(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn audio_parts(msg: &Message) -> (String, Vec<u8>) {
+        let Message::Binary(b) = msg else {
+            panic!("expected a binary message");
+        };
+        let n = u16::from_be_bytes([b[0], b[1]]) as usize;
+        (
+            String::from_utf8(b[2..2 + n].to_vec()).unwrap(),
+            b[2 + n..].to_vec(),
+        )
+    }
+
+    #[test]
+    fn test_azure_turns_and_phrases() {
+        let azure = AzureSpeech::default();
+        let session = json!({"input_audio_transcription": {"language": "de"}});
+        let url = azure.session_url(
+            "wss://eastus.stt.speech.microsoft.com/speech/recognition/conversation/cognitiveservices/v1",
+            session.as_object(),
+        );
+        assert!(url.ends_with("?language=de-DE"));
+
+        // The first audio of a turn leads with a WAV header / 轮次的第一段音频以 WAV 头开始
+        let (head, body) = audio_parts(&azure.send_audio(&[1, 2])[0]);
+        assert!(head.starts_with("Path: audio\r\n"));
+        assert_eq!(&body[..4], b"RIFF");
+        assert_eq!(body.len(), 44 + 2);
+        let (head2, body2) = audio_parts(&azure.send_audio(&[3])[0]);
+        assert_eq!(body2, vec![3]);
+        let id = |h: &str| {
+            h.lines()
+                .find(|l| l.starts_with("X-RequestId"))
+                .map(str::to_string)
+        };
+        assert_eq!(id(&head), id(&head2));
+
+        let commit = json!({"type": "input_audio_buffer.commit"}).to_string();
+        let (_, end) = audio_parts(&azure.send_event(&commit)[0]);
+        assert!(end.is_empty());
+        assert!(azure.send_event(&commit).is_empty());
+
+        let phrase = "X-RequestId: 1\r\nPath: speech.phrase\r\nContent-Type: application/json\r\n\r\n{\"RecognitionStatus\":\"Success\",\"DisplayText\":\"Hallo Welt.\"}";
+        let ev: Value =
+            serde_json::from_slice(&azure.events(Message::Text(phrase.to_string()))[0]).unwrap();
+        assert_eq!(
+            ev["type"],
+            "conversation.item.input_audio_transcription.completed"
+        );
+        assert_eq!(ev["transcript"], "Hallo Welt.");
+    }
+}
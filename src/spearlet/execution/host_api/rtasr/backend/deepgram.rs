@@ -0,0 +1,179 @@
+//! Deepgram live transcription / Deepgram 实时转写
+//!
+//! The session lives in the query of the `/v1/listen` URL; audio goes out as binary
+//! frames and a commit as `Finalize`. Each `Results` frame carries the hypothesis of the
+//! current segment, final once `is_final` is set.
+//! 会话位于 `/v1/listen` URL 的查询参数中；音频以二进制帧发送，提交对应 `Finalize`。
+//! 每个 `Results` 帧携带当前片段的假设，设置 `is_final` 后即为最终结果。
+
+use serde_json::{json, Map, Value};
+use tokio_tungstenite::tungstenite::Message;
+
+use super::{
+    completed_event, error_event, event_type, interim_event, speech_event, transcription_field,
+    StreamingAsrBackend, COMMIT, SAMPLE_RATE_HZ,
+};
+
+pub(super) struct Deepgram;
+
+fn control(ty: &str) -> Message {
+    Message::Text(json!({"type": ty}).to_string())
+}
+
+impl StreamingAsrBackend for Deepgram {
+    fn session_url(&self, url: &str, session: Option<&Map<String, Value>>) -> String {
+        let Ok(mut u) = url::Url::parse(url) else {
+            return url.to_string();
+        };
+        let rate = SAMPLE_RATE_HZ.to_string();
+        let mut params = vec![
+            ("encoding", "linear16"),
+            ("sample_rate", rate.as_str()),
+            ("channels", "1"),
+            ("interim_results", "true"),
+            ("punctuate", "true"),
+            ("vad_events", "true"),
+        ];
+        if let Some(m) = transcription_field(session, "model") {
+            params.push(("model", m));
+        }
+        if let Some(l) = transcription_field(session, "language") {
+            params.push(("language", l));
+        }
+        // Params already in the configured URL win / 已配置在 URL 中的参数优先
+        let present: Vec<String> = u.query_pairs().map(|(k, _)| k.into_owned()).collect();
+        {
+            let mut q = u.query_pairs_mut();
+            for (k, v) in params {
+                if !present.iter().any(|p| p == k) {
+                    q.append_pair(k, v);
+                }
+            }
+        }
+        u.to_string()
+    }
+
+    fn create_session(&self, _client_events: &[Value]) -> Vec<Message> {
+        Vec::new()
+    }
+
+    fn send_audio(&self, chunk: &[u8]) -> Vec<Message> {
+        vec![Message::Binary(chunk.to_vec())]
+    }
+
+    fn send_event(&self, text: &str) -> Vec<Message> {
+        match event_type(text).as_deref() {
+            Some(COMMIT) => vec![control("Finalize")],
+            _ => Vec::new(),
+        }
+    }
+
+    fn keepalive(&self) -> Vec<Message> {
+        vec![control("KeepAlive")]
+    }
+
+    fn close(&self) -> Vec<Message> {
+        vec![control("CloseStream")]
+    }
+
+    fn events(&self, msg: Message) -> Vec<Vec<u8>> {
+        let Message::Text(s) = msg else {
+            return Vec::new();
+        };
+        let Ok(v) = serde_json::from_str::<Value>(&s) else {
+            return Vec::new();
+        };
+        match v.get("type").and_then(|t| t.as_str()).unwrap_or("") {
+            "Results" => {
+                let alt = v.pointer("/channel/alternatives/0");
+                let text = alt
+                    .and_then(|a| a.get("transcript"))
+                    .and_then(|t| t.as_str())
+                    .unwrap_or("");
+                let language = alt
+                    .and_then(|a| a.pointer("/languages/0"))
+                    .and_then(|l| l.as_str());
+                let is_final = v.get("is_final").and_then(|x| x.as_bool()) == Some(true);
+                let from_finalize = v.get("from_finalize").and_then(|x| x.as_bool()) == Some(true);
+                if is_final && (!text.is_empty() || from_finalize) {
+                    vec![completed_event(text, language)]
+                } else if !is_final && !text.is_empty() {
+                    vec![interim_event(text)]
+                } else {
+                    Vec::new()
+                }
+            }
+            "SpeechStarted" => vec![speech_event(true)],
+            "UtteranceEnd" => vec![speech_event(false)],
+            "Error" => {
+                let msg = ["description", "message", "err_msg"]
+                    .iter()
+                    .find_map(|k| v.get(*k).and_then(|m| m.as_str()))
+                    .unwrap_or("deepgram error");
+                vec![error_event(msg)]
+            }
+            _ => Vec::new(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_deepgram_session_and_results() {
+        let session = json!({"input_audio_transcription": {"model": "nova-3", "language": "fr"}});
+        let url = Deepgram.session_url(
+            "wss://api.deepgram.com/v1/listen?sample_rate=16000",
+            session.as_object(),
+        );
+        assert!(url.contains("model=nova-3"));
+        assert!(url.contains("language=fr"));
+        assert!(url.contains("sample_rate=16000"));
+        assert!(!url.contains("sample_rate=24000"));
+
+        let commit = json!({"type": "input_audio_buffer.commit"}).to_string();
+        assert_eq!(
+            Deepgram.send_event(&commit),
+            vec![Message::Text(r#"{"type":"Finalize"}"#.to_string())]
+        );
+
+        let interim = json!({
+            "type": "Results",
+            "is_final": false,
+            "channel": {"alternatives": [{"transcript": "bonjour"}]},
+        });
+        let ev: Value =
+            serde_json::from_slice(&Deepgram.events(Message::Text(interim.to_string()))[0])
+                .unwrap();
+        assert_eq!(
+            ev["type"],
+            "conversation.item.input_audio_transcription.interim"
+        );
+
+        let last = json!({
+            "type": "Results",
+            "is_final": true,
+            "from_finalize": true,
+            "channel": {"alternatives": [{"transcript": "", "languages": ["fr"]}]},
+        });
+        let ev: Value =
+            serde_json::from_slice(&Deepgram.events(Message::Text(last.to_string()))[0]).unwrap();
+        assert_eq!(
+            ev["type"],
+            "conversation.item.input_audio_transcription.completed"
+        );
+        assert_eq!(ev["language"], "fr");
+
+        // Silence between segments is not reported / 片段之间的静音不上报
+        let silence = json!({
+            "type": "Results",
+            "is_final": true,
+            "channel": {"alternatives": [{"transcript": ""}]},
+        });
+        assert!(Deepgram
+            .events(Message::Text(silence.to_string()))
+            .is_empty());
+    }
+}
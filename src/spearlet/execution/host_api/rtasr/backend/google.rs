@@ -0,0 +1,502 @@
+//! Google Speech-to-Text through gRPC `StreamingRecognize`
+//! 通过 gRPC `StreamingRecognize` 的 Google Speech-to-Text
+//!
+//! Google serves streaming recognition over gRPC only, so the connection is served on the
+//! host: audio frames go out on a `StreamingRecognize` call opened with the first audio of
+//! a segment, and the call's answers come back as frames for [`GoogleSpeech::events`].
+//! Interim hypotheses and voice activity arrive while speaking. A commit half-closes the
+//! call so Google finalizes the rest of the segment; the next audio opens a new call. A
+//! call reaching `MAX_STREAM_BYTES` is committed on its own, as Google ends streams after
+//! about five minutes of audio. `session.update` applies from the next call;
+//! `input_audio_buffer.clear` drops the open call without waiting for its results.
+//! Google 仅通过 gRPC 提供流式识别，因此连接在宿主侧提供：片段的首段音频打开一次 `StreamingRecognize`
+//! 调用，音频帧经该调用发出，调用的应答以帧的形式交给 [`GoogleSpeech::events`]。说话过程中即可收到
+//! 中间假设与语音活动事件。提交会半关闭调用，使 Google 完成该片段剩余部分的识别；下一段音频打开新的
+//! 调用。由于 Google 在约五分钟音频后结束流，达到 `MAX_STREAM_BYTES` 的调用会自动提交。
+//! `session.update` 从下一次调用起生效；`input_audio_buffer.clear` 丢弃当前调用，不等待其结果。
+
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+
+use futures::{SinkExt, StreamExt};
+use serde_json::{json, Map, Value};
+use tokio::sync::mpsc;
+use tokio::task::JoinHandle;
+use tokio_tungstenite::tungstenite::Message;
+
+use crate::proto::google_speech::recognition_config::AudioEncoding;
+use crate::proto::google_speech::speech_client::SpeechClient;
+use crate::proto::google_speech::streaming_recognize_request::StreamingRequest;
+use crate::proto::google_speech::streaming_recognize_response::SpeechEventType;
+use crate::proto::google_speech::{
+    RecognitionConfig, SpeechContext, StreamingRecognitionConfig, StreamingRecognizeRequest,
+    StreamingRecognizeResponse,
+};
+
+use super::{
+    completed_event, error_event, event_type, interim_event, locale_for, speech_event,
+    transcription_field, AsrSink, AsrStream, StreamingAsrBackend, CLEAR, COMMIT, SAMPLE_RATE_HZ,
+    SESSION_UPDATE,
+};
+
+/// Longest call: 290 s of 24 kHz pcm16 / 单次调用的最长音频：290 秒 24 kHz pcm16
+const MAX_STREAM_BYTES: usize = SAMPLE_RATE_HZ as usize * 2 * 290;
+
+const CONNECT_TIMEOUT: std::time::Duration = std::time::Duration::from_secs(20);
+
+/// How long a committed call may take to deliver its final results
+/// 已提交调用交付最终结果的时限
+const FINALIZE_TIMEOUT: std::time::Duration = std::time::Duration::from_secs(30);
+
+pub(super) struct GoogleSpeech;
+
+/// Recognition settings sent first on every call / 每次调用首先发送的识别设置
+fn streaming_config(session: Option<&Map<String, Value>>) -> StreamingRecognitionConfig {
+    let language = locale_for(transcription_field(session, "language").unwrap_or("en"));
+    // Prompt terms become phrase hints / 提示词中的词语作为短语提示
+    let speech_contexts = transcription_field(session, "prompt")
+        .map(|p| {
+            vec![SpeechContext {
+                phrases: p
+                    .split([',', '\n'])
+                    .map(str::trim)
+                    .filter(|s| !s.is_empty())
+                    .map(str::to_string)
+                    .collect(),
+            }]
+        })
+        .unwrap_or_default();
+    StreamingRecognitionConfig {
+        config: Some(RecognitionConfig {
+            encoding: AudioEncoding::Linear16 as i32,
+            sample_rate_hertz: SAMPLE_RATE_HZ as i32,
+            language_code: language,
+            speech_contexts,
+            audio_channel_count: 1,
+            enable_automatic_punctuation: true,
+            model: transcription_field(session, "model")
+                .unwrap_or_default()
+                .to_string(),
+        }),
+        single_utterance: false,
+        interim_results: true,
+        enable_voice_activity_events: true,
+    }
+}
+
+/// A call's answer as the frame handed to `events`, in the field names of the REST API
+/// 调用应答对应的、交给 `events` 的帧，字段名与 REST API 一致
+fn response_json(resp: &StreamingRecognizeResponse) -> Value {
+    if let Some(err) = resp.error.as_ref().filter(|e| e.code != 0) {
+        return json!({"error": {"message": format!("recognize failed: {}: {}", err.code, err.message)}});
+    }
+    let results: Vec<Value> = resp
+        .results
+        .iter()
+        .map(|r| {
+            json!({
+                "alternatives": r
+                    .alternatives
+                    .iter()
+                    .take(1)
+                    .map(|a| json!({"transcript": a.transcript}))
+                    .collect::<Vec<_>>(),
+                "isFinal": r.is_final,
+                "languageCode": r.language_code,
+            })
+        })
+        .collect();
+    let mut v = json!({"results": results});
+    if resp.speech_event_type != SpeechEventType::SpeechEventUnspecified as i32 {
+        v["speechEventType"] = Value::String(resp.speech_event_type().as_str_name().to_string());
+    }
+    v
+}
+
+fn error_frame(message: String) -> Message {
+    Message::Text(json!({"error": {"message": message}}).to_string())
+}
+
+/// One open `StreamingRecognize` call / 一次进行中的 `StreamingRecognize` 调用
+struct Call {
+    audio: mpsc::Sender<StreamingRecognizeRequest>,
+    bytes: usize,
+    /// Set once the call is half-closed / 调用半关闭后置位
+    committed: Arc<AtomicBool>,
+    reader: JoinHandle<()>,
+}
+
+impl Call {
+    async fn open(
+        url: &str,
+        headers: &[(String, String)],
+        session: Option<&Map<String, Value>>,
+        output: futures::channel::mpsc::UnboundedSender<Message>,
+    ) -> Result<Self, String> {
+        let mut endpoint = tonic::transport::Endpoint::from_shared(url.to_string())
+            .map_err(|e| format!("invalid endpoint {url}: {e}"))?
+            .connect_timeout(CONNECT_TIMEOUT);
+        if url.starts_with("https://") {
+            endpoint = endpoint
+                .tls_config(tonic::transport::ClientTlsConfig::new().with_native_roots())
+                .map_err(|e| format!("tls: {e}"))?;
+        }
+        let channel = endpoint
+            .connect()
+            .await
+            .map_err(|e| format!("connect to {url} failed: {e}"))?;
+
+        let (audio, rx) = mpsc::channel::<StreamingRecognizeRequest>(64);
+        audio
+            .send(StreamingRecognizeRequest {
+                streaming_request: Some(StreamingRequest::StreamingConfig(streaming_config(
+                    session,
+                ))),
+            })
+            .await
+            .map_err(|_| "recognize call closed".to_string())?;
+        let mut request = tonic::Request::new(tokio_stream::wrappers::ReceiverStream::new(rx));
+        for (k, v) in headers {
+            let key = tonic::metadata::MetadataKey::from_bytes(k.to_ascii_lowercase().as_bytes())
+                .map_err(|e| format!("header {k}: {e}"))?;
+            let value = v.parse().map_err(|e| format!("header {k}: {e}"))?;
+            request.metadata_mut().insert(key, value);
+        }
+        let mut answers = SpeechClient::new(channel)
+            .streaming_recognize(request)
+            .await
+            .map_err(|e| format!("recognize failed: {}: {}", e.code(), e.message()))?
+            .into_inner();
+
+        let committed = Arc::new(AtomicBool::new(false));
+        let reader_committed = committed.clone();
+        let reader = tokio::spawn(async move {
+            // A commit always gets a final, empty when nothing more was heard
+            // 每次提交都会得到最终结果，没有识别到更多内容时为空
+            let mut final_after_commit = false;
+            loop {
+                match answers.message().await {
+                    Ok(Some(resp)) => {
+                        if reader_committed.load(Ordering::Acquire)
+                            && resp.results.iter().any(|r| r.is_final)
+                        {
+                            final_after_commit = true;
+                        }
+                        let frame = Message::Text(response_json(&resp).to_string());
+                        if output.unbounded_send(frame).is_err() {
+                            return;
+                        }
+                    }
+                    Ok(None) => break,
+                    Err(e) => {
+                        let _ = output.unbounded_send(error_frame(format!(
+                            "recognize failed: {}: {}",
+                            e.code(),
+                            e.message()
+                        )));
+                        return;
+                    }
+                }
+            }
+            if !final_after_commit {
+                let empty = json!({"results": [{"alternatives": [], "isFinal": true}]});
+                let _ = output.unbounded_send(Message::Text(empty.to_string()));
+            }
+        });
+        Ok(Self {
+            audio,
+            bytes: 0,
+            committed,
+            reader,
+        })
+    }
+
+    async fn send_audio(&mut self, chunk: Vec<u8>) -> Result<(), String> {
+        self.bytes += chunk.len();
+        self.audio
+            .send(StreamingRecognizeRequest {
+                streaming_request: Some(StreamingRequest::AudioContent(chunk)),
+            })
+            .await
+            .map_err(|_| "recognize call closed".to_string())
+    }
+
+    /// Half-close the call and wait for its final results / 半关闭调用并等待其最终结果
+    async fn commit(self) {
+        self.committed.store(true, Ordering::Release);
+        drop(self.audio);
+        let mut reader = self.reader;
+        if tokio::time::timeout(FINALIZE_TIMEOUT, &mut reader)
+            .await
+            .is_err()
+        {
+            reader.abort();
+        }
+    }
+
+    /// Drop the call and whatever it has not answered yet / 丢弃调用及其尚未应答的内容
+    fn abort(self) {
+        self.reader.abort();
+    }
+}
+
+/// Serve one connection until the sink side closes / 提供单个连接，直到发送端关闭
+async fn run_recognizer(
+    url: String,
+    headers: Vec<(String, String)>,
+    mut input: futures::channel::mpsc::Receiver<Message>,
+    output: futures::channel::mpsc::UnboundedSender<Message>,
+) {
+    let mut session: Option<Map<String, Value>> = None;
+    let mut call: Option<Call> = None;
+    while let Some(msg) = input.next().await {
+        match msg {
+            Message::Binary(b) => {
+                if call.is_none() {
+                    match Call::open(&url, &headers, session.as_ref(), output.clone()).await {
+                        Ok(c) => call = Some(c),
+                        Err(e) => {
+                            if output.unbounded_send(error_frame(e)).is_err() {
+                                return;
+                            }
+                            continue;
+                        }
+                    }
+                }
+                let Some(c) = call.as_mut() else {
+                    continue;
+                };
+                if let Err(e) = c.send_audio(b).await {
+                    call = None;
+                    if output.unbounded_send(error_frame(e)).is_err() {
+                        return;
+                    }
+                    continue;
+                }
+                if c.bytes >= MAX_STREAM_BYTES {
+                    if let Some(c) = call.take() {
+                        c.commit().await;
+                    }
+                }
+            }
+            Message::Text(t) => match event_type(&t).as_deref() {
+                Some(COMMIT) => {
+                    if let Some(c) = call.take() {
+                        c.commit().await;
+                    }
+                }
+                Some(CLEAR) => {
+                    if let Some(c) = call.take() {
+                        c.abort();
+                    }
+                }
+                Some(SESSION_UPDATE) => {
+                    session = serde_json::from_str::<Value>(&t)
+                        .ok()
+                        .and_then(|v| v.get("session").and_then(|s| s.as_object()).cloned());
+                }
+                _ => {}
+            },
+            Message::Close(_) => break,
+            _ => {}
+        }
+    }
+    if let Some(c) = call.take() {
+        c.commit().await;
+    }
+    let _ = output.unbounded_send(Message::Close(None));
+}
+
+impl StreamingAsrBackend for GoogleSpeech {
+    fn local_connection(
+        &self,
+        url: &str,
+        headers: Vec<(String, String)>,
+    ) -> Option<(AsrSink, AsrStream)> {
+        let (in_tx, in_rx) = futures::channel::mpsc::channel::<Message>(64);
+        let (out_tx, out_rx) = futures::channel::mpsc::unbounded::<Message>();
+        tokio::spawn(run_recognizer(url.to_string(), headers, in_rx, out_tx));
+        let sink: AsrSink = Box::pin(in_tx.sink_map_err(|e| format!("recognizer closed: {e}")));
+        let stream: AsrStream = Box::pin(out_rx.map(Ok));
+        Some((sink, stream))
+    }
+
+    fn create_session(&self, client_events: &[Value]) -> Vec<Message> {
+        client_events
+            .iter()
+            .map(|ev| Message::Text(ev.to_string()))
+            .collect()
+    }
+
+    fn send_audio(&self, chunk: &[u8]) -> Vec<Message> {
+        vec![Message::Binary(chunk.to_vec())]
+    }
+
+    fn send_event(&self, text: &str) -> Vec<Message> {
+        match event_type(text).as_deref() {
+            Some(COMMIT | CLEAR | SESSION_UPDATE) => vec![Message::Text(text.to_string())],
+            _ => Vec::new(),
+        }
+    }
+
+    fn events(&self, msg: Message) -> Vec<Vec<u8>> {
+        let Message::Text(s) = msg else {
+            return Vec::new();
+        };
+        let Ok(v) = serde_json::from_str::<Value>(&s) else {
+            return Vec::new();
+        };
+        if let Some(msg) = v.pointer("/error/message").and_then(|m| m.as_str()) {
+            return vec![error_event(msg)];
+        }
+        let mut out = Vec::new();
+        match v.get("speechEventType").and_then(|t| t.as_str()) {
+            Some("SPEECH_ACTIVITY_BEGIN") => out.push(speech_event(true)),
+            Some("SPEECH_ACTIVITY_END") => out.push(speech_event(false)),
+            _ => {}
+        }
+        let results = v
+            .get("results")
+            .and_then(|r| r.as_array())
+            .map(Vec::as_slice)
+            .unwrap_or_default();
+        let transcript = |r: &Value| {
+            r.pointer("/alternatives/0/transcript")
+                .and_then(|t| t.as_str())
+                .unwrap_or("")
+                .trim()
+                .to_string()
+        };
+        let language = |r: &Value| {
+            r.get("languageCode")
+                .and_then(|l| l.as_str())
+                .filter(|l| !l.is_empty())
+                .map(str::to_string)
+        };
+        // Finals come one result per answer; interim answers may split the hypothesis
+        // 最终结果每个应答一个；中间应答可能将假设拆成多段
+        for r in results.iter().filter(|r| r["isFinal"] == true) {
+            out.push(completed_event(&transcript(r), language(r).as_deref()));
+        }
+        let interim = results
+            .iter()
+            .filter(|r| r["isFinal"] != true)
+            .map(transcript)
+            .filter(|t| !t.is_empty())
+            .collect::<Vec<_>>()
+            .join(" ");
+        if !interim.is_empty() {
+            out.push(interim_event(&interim));
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::proto::google_speech::{
+        SpeechRecognitionAlternative, Status, StreamingRecognitionResult,
+    };
+
+    fn events(frame: Value) -> Vec<Value> {
+        GoogleSpeech
+            .events(Message::Text(frame.to_string()))
+            .iter()
+            .map(|e| serde_json::from_slice(e).unwrap())
+            .collect()
+    }
+
+    #[test]
+    fn test_google_streaming_config() {
+        let session = json!({"input_audio_transcription": {
+            "model": "latest_short",
+            "language": "ja",
+            "prompt": "SPEAR, spearlet",
+        }});
+        let cfg = streaming_config(session.as_object());
+        assert!(cfg.interim_results);
+        assert!(cfg.enable_voice_activity_events);
+        let rc = cfg.config.unwrap();
+        assert_eq!(rc.encoding, AudioEncoding::Linear16 as i32);
+        assert_eq!(rc.sample_rate_hertz, 24_000);
+        assert_eq!(rc.language_code, "ja-JP");
+        assert_eq!(rc.model, "latest_short");
+        assert_eq!(rc.speech_contexts[0].phrases, vec!["SPEAR", "spearlet"]);
+
+        let rc = streaming_config(None).config.unwrap();
+        assert_eq!(rc.language_code, "en-US");
+        assert!(rc.speech_contexts.is_empty());
+    }
+
+    #[test]
+    fn test_google_answers_become_guest_events() {
+        let alt = |t: &str| SpeechRecognitionAlternative {
+            transcript: t.to_string(),
+            confidence: 0.9,
+        };
+        let interim = StreamingRecognizeResponse {
+            results: vec![
+                StreamingRecognitionResult {
+                    alternatives: vec![alt("hello")],
+                    ..Default::default()
+                },
+                StreamingRecognitionResult {
+                    alternatives: vec![alt(" wor")],
+                    stability: 0.1,
+                    ..Default::default()
+                },
+            ],
+            ..Default::default()
+        };
+        let evs = events(response_json(&interim));
+        assert_eq!(evs.len(), 1);
+        assert_eq!(
+            evs[0]["type"],
+            "conversation.item.input_audio_transcription.interim"
+        );
+        assert_eq!(evs[0]["transcript"], "hello wor");
+
+        let fin = StreamingRecognizeResponse {
+            results: vec![StreamingRecognitionResult {
+                alternatives: vec![alt("hello world")],
+                is_final: true,
+                language_code: "en-us".to_string(),
+                ..Default::default()
+            }],
+            ..Default::default()
+        };
+        let evs = events(response_json(&fin));
+        assert_eq!(
+            evs[0]["type"],
+            "conversation.item.input_audio_transcription.completed"
+        );
+        assert_eq!(evs[0]["transcript"], "hello world");
+        assert_eq!(evs[0]["language"], "en-us");
+
+        let begin = StreamingRecognizeResponse {
+            speech_event_type: SpeechEventType::SpeechActivityBegin as i32,
+            ..Default::default()
+        };
+        assert_eq!(
+            events(response_json(&begin))[0]["type"],
+            "input_audio_buffer.speech_started"
+        );
+
+        let failed = StreamingRecognizeResponse {
+            error: Some(Status {
+                code: 3,
+                message: "bad audio".to_string(),
+            }),
+            ..Default::default()
+        };
+        assert_eq!(
+            events(response_json(&failed))[0]["error"]["message"],
+            "recognize failed: 3: bad audio"
+        );
+
+        // The empty final sent when a commit heard nothing / 提交未识别到内容时发送的空最终结果
+        let evs = events(json!({"results": [{"alternatives": [], "isFinal": true}]}));
+        assert_eq!(evs[0]["transcript"], "");
+    }
+}
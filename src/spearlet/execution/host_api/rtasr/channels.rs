@@ -0,0 +1,117 @@
+//! Transcript channels of one rtasr session
+//! 单个 rtasr 会话的转写通道
+//!
+//! With a `channels` param, `CONNECT` opens one provider session per channel and every
+//! audio chunk written to the fd goes to all of them, so one microphone can give, for
+//! example, a transcript in the spoken language and one in English. Each channel may pick
+//! its own language, model and backend; unset fields fall back to the session params.
+//! Provider events read from the fd carry the channel id in a `channel` field, while the
+//! session's own events (`spear.rtasr.*`) carry none.
+//! 设置 `channels` 参数后，`CONNECT` 为每个通道打开一个服务商会话，写入 fd 的每段音频都会发送给
+//! 所有通道，因此同一路麦克风可以同时得到例如原语种转写与英文转写。每个通道可以选择自己的语种、
+//! 模型与后端；未设置的字段沿用会话参数。从 fd 读到的服务商事件在 `channel` 字段中带有通道 id，
+//! 会话自身的事件（`spear.rtasr.*`）则不带。
+
+use std::collections::HashMap;
+
+use serde_json::Value;
+
+use super::super::errno::SPEAR_EINVAL;
+use super::super::language::normalize_code;
+use crate::spearlet::param_keys::rtasr as rtasr_keys;
+
+/// Channels one session may open / 单个会话可打开的通道数
+pub(super) const MAX_CHANNELS: usize = 4;
+
+/// One transcript channel / 一个转写通道
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub(super) struct ChannelSpec {
+    pub id: String,
+    /// Language hint; `None` lets the provider detect it / 语种提示；`None` 表示由服务商检测
+    pub language: Option<String>,
+    pub model: Option<String>,
+    pub backend: Option<String>,
+}
+
+/// Read the `channels` param; no param means a single untagged session
+/// 读取 `channels` 参数；未设置时为单个不带标签的会话
+pub(super) fn parse_channels(params: &HashMap<String, Value>) -> Result<Vec<ChannelSpec>, i32> {
+    let Some(v) = params.get(rtasr_keys::CHANNELS).filter(|v| !v.is_null()) else {
+        return Ok(Vec::new());
+    };
+    let list = v.as_array().ok_or(-SPEAR_EINVAL)?;
+    if list.is_empty() || list.len() > MAX_CHANNELS {
+        return Err(-SPEAR_EINVAL);
+    }
+    let mut out: Vec<ChannelSpec> = Vec::with_capacity(list.len());
+    for c in list {
+        let field = |key: &str| {
+            c.get(key)
+                .and_then(|x| x.as_str())
+                .map(|s| s.trim().to_string())
+                .filter(|s| !s.is_empty())
+        };
+        let id = field("id").ok_or(-SPEAR_EINVAL)?;
+        if out.iter().any(|o| o.id == id) {
+            return Err(-SPEAR_EINVAL);
+        }
+        out.push(ChannelSpec {
+            id,
+            language: field("language").and_then(|s| normalize_code(&s)),
+            model: field("model"),
+            backend: field("backend"),
+        });
+    }
+    Ok(out)
+}
+
+/// Add the channel id to a provider event; frames that are not JSON objects pass unchanged
+/// 为服务商事件加上通道 id；不是 JSON 对象的帧原样通过
+pub(super) fn tag_event(payload: Vec<u8>, channel: &str) -> Vec<u8> {
+    let Ok(Value::Object(mut ev)) = serde_json::from_slice::<Value>(&payload) else {
+        return payload;
+    };
+    ev.insert("channel".to_string(), Value::String(channel.to_string()));
+    serde_json::to_vec(&ev).unwrap_or(payload)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn params(channels: Value) -> HashMap<String, Value> {
+        HashMap::from([(rtasr_keys::CHANNELS.to_string(), channels)])
+    }
+
+    #[test]
+    fn test_parse_channels() {
+        assert!(parse_channels(&HashMap::new()).unwrap().is_empty());
+        let got = parse_channels(&params(json!([
+            {"id": "orig", "language": "auto"},
+            {"id": "en", "language": "English", "model": "m", "backend": "b"},
+        ])))
+        .unwrap();
+        assert_eq!(got[0].language, None);
+        assert_eq!(got[1].language.as_deref(), Some("en"));
+        assert_eq!(got[1].backend.as_deref(), Some("b"));
+
+        for bad in [
+            json!([]),
+            json!("en"),
+            json!([{"language": "en"}]),
+            json!([{"id": "a"}, {"id": "a"}]),
+            json!([{"id": "1"}, {"id": "2"}, {"id": "3"}, {"id": "4"}, {"id": "5"}]),
+        ] {
+            assert_eq!(parse_channels(&params(bad)), Err(-SPEAR_EINVAL));
+        }
+    }
+
+    #[test]
+    fn test_tag_event() {
+        let tagged = tag_event(br#"{"type":"x"}"#.to_vec(), "en");
+        let v: Value = serde_json::from_slice(&tagged).unwrap();
+        assert_eq!(v["channel"], "en");
+        assert_eq!(tag_event(b"raw".to_vec(), "en"), b"raw".to_vec());
+    }
+}
@@ -0,0 +1,182 @@
+//! Ending an rtasr session
+//! 结束 rtasr 会话
+//!
+//! `SPEAR_RTA_CTL_FINISH` commits the audio not yet committed, waits for the final
+//! transcript of every channel (bounded by `finish_timeout_ms`), closes the provider
+//! websocket and queues `spear.rtasr.finished`; reads then end with `-EPIPE`. A session
+//! whose execution or instance is terminated is closed and removed from the fd table.
+//! `SPEAR_RTA_CTL_FINISH` 提交尚未提交的音频，等待每个通道的最终转写（受 `finish_timeout_ms`
+//! 限制），关闭服务商 websocket 并排入 `spear.rtasr.finished`；之后读取以 `-EPIPE` 结束。
+//! 所属执行或实例被终止的会话会被关闭并从 fd 表中移除。
+
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use serde_json::json;
+
+use super::segmentation::rtasr_flush_event_text;
+use crate::spearlet::execution::host_api::errno::EAGAIN;
+use crate::spearlet::execution::hostcall::fd_table::FdTable;
+use crate::spearlet::execution::hostcall::types::{
+    FdInner, RtAsrConnState, RtAsrSendItem, RtAsrState,
+};
+use crate::spearlet::node_services::NodeServices;
+use crate::spearlet::param_keys::rtasr as rtasr_keys;
+
+/// Event queued once the session has ended / 会话结束后排入的事件
+pub(super) const EVENT_FINISHED: &str = "spear.rtasr.finished";
+
+const DEFAULT_FINISH_TIMEOUT_MS: u64 = 5000;
+
+/// Execution and instance that opened the fd / 打开该 fd 的执行与实例
+#[derive(Clone, Debug, Default)]
+pub(super) struct SessionOwner {
+    pub execution_id: Option<String>,
+    pub instance_id: Option<String>,
+    /// Spearlet holding their termination marks / 保存其终止标记的 spearlet
+    pub node: Arc<NodeServices>,
+}
+
+impl SessionOwner {
+    /// Whether the owner has been terminated / 所属方是否已被终止
+    pub fn terminated(&self) -> bool {
+        self.execution_id
+            .as_deref()
+            .is_some_and(|id| self.node.terminations.executions.check(id).is_some())
+            || self
+                .instance_id
+                .as_deref()
+                .is_some_and(|id| self.node.terminations.instances.check(id).is_some())
+    }
+}
+
+/// Whether a provider event carries a final transcript (or ends one with an error)
+/// 服务商事件是否携带最终转写（或以错误结束转写）
+pub(super) fn is_final_event(payload: &[u8]) -> bool {
+    let Ok(v) = serde_json::from_slice::<serde_json::Value>(payload) else {
+        return false;
+    };
+    let ty = v.get("type").and_then(|x| x.as_str()).unwrap_or("");
+    ty == "error" || ty.ends_with("transcription.completed")
+}
+
+/// Enter `Draining`: commit the buffered audio and wait for one final transcript per
+/// channel / 进入 `Draining`：提交缓冲的音频，并等待每个通道一个最终转写
+pub(super) fn begin_finish_locked(
+    st: &mut RtAsrState,
+    channels: usize,
+    now: Instant,
+) -> Result<(), i32> {
+    let timeout_ms = st
+        .params
+        .get(rtasr_keys::FINISH_TIMEOUT_MS)
+        .and_then(|x| x.as_u64())
+        .unwrap_or(DEFAULT_FINISH_TIMEOUT_MS);
+    st.finals_pending = 0;
+    if st.buffered_audio_bytes_since_flush > 0 {
+        let txt = rtasr_flush_event_text();
+        let n = txt.len();
+        if st.send_queue_bytes.saturating_add(n) > st.max_send_queue_bytes {
+            return Err(-EAGAIN);
+        }
+        st.send_queue.push_back(RtAsrSendItem::WsText(txt));
+        st.send_queue_bytes = st.send_queue_bytes.saturating_add(n);
+        st.buffered_audio_bytes_since_flush = 0;
+        st.finals_pending = channels.max(1);
+    } else if st.pending_flush {
+        // A commit is on its way already / 已有提交在途
+        st.finals_pending = channels.max(1);
+    }
+    st.state = RtAsrConnState::Draining;
+    st.finish_deadline = Some(now + Duration::from_millis(timeout_ms));
+    Ok(())
+}
+
+/// Count a final transcript while draining / 在排空期间计入一个最终转写
+pub(super) fn note_final_locked(st: &mut RtAsrState) {
+    if st.state == RtAsrConnState::Draining {
+        st.finals_pending = st.finals_pending.saturating_sub(1);
+    }
+}
+
+/// `Some(timed_out)` once a draining session can be closed: the queued audio is sent and
+/// the final transcripts arrived or the timeout passed
+/// 排空中的会话可以关闭时返回 `Some(timed_out)`：排队音频已发送，且最终转写已到达或已超时
+pub(super) fn finish_due(st: &RtAsrState, now: Instant) -> Option<bool> {
+    if st.state != RtAsrConnState::Draining || !st.send_queue.is_empty() {
+        return None;
+    }
+    if st.finals_pending == 0 {
+        return Some(false);
+    }
+    st.finish_deadline.filter(|d| now >= *d).map(|_| true)
+}
+
+/// Close the session and queue `spear.rtasr.finished` / 关闭会话并排入 `spear.rtasr.finished`
+pub(super) fn complete_finish_locked(st: &mut RtAsrState, timed_out: bool, error: Option<&str>) {
+    st.state = RtAsrConnState::Closed;
+    st.finish_deadline = None;
+    let body = json!({
+        "type": EVENT_FINISHED,
+        "timed_out": timed_out,
+        "error": error,
+    });
+    let payload = serde_json::to_vec(&body).unwrap_or_default();
+    // The end of the stream is never dropped / 流结束事件永不丢弃
+    st.recv_queue_bytes = st.recv_queue_bytes.saturating_add(payload.len());
+    st.recv_queue.push_back(payload);
+}
+
+/// Close and remove a session whose execution or instance was terminated
+/// 关闭并移除所属执行或实例已被终止的会话
+pub(super) fn close_terminated_rtasr(table: &FdTable, fd: i32) {
+    if let Some(entry) = table.get(fd) {
+        if let Ok(mut e) = entry.lock() {
+            if let FdInner::RtAsr(st) = &mut e.inner {
+                st.state = RtAsrConnState::Closed;
+            }
+        }
+    }
+    table.close(fd);
+    table.remove(fd);
+    tracing::info!(fd, "rtasr session closed: its task was terminated");
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_finish_waits_for_finals_or_timeout() {
+        let now = Instant::now();
+        let mut st = RtAsrState::default();
+        st.buffered_audio_bytes_since_flush = 640;
+        begin_finish_locked(&mut st, 2, now).unwrap();
+        assert_eq!(st.state, RtAsrConnState::Draining);
+        assert_eq!(st.send_queue.len(), 1);
+
+        // The commit has not been sent yet / 提交尚未发送
+        assert_eq!(finish_due(&st, now), None);
+        st.send_queue.clear();
+        note_final_locked(&mut st);
+        assert_eq!(finish_due(&st, now), None);
+        assert_eq!(
+            finish_due(&st, now + Duration::from_millis(DEFAULT_FINISH_TIMEOUT_MS)),
+            Some(true)
+        );
+        note_final_locked(&mut st);
+        assert_eq!(finish_due(&st, now), Some(false));
+
+        complete_finish_locked(&mut st, false, None);
+        assert_eq!(st.state, RtAsrConnState::Closed);
+        assert!(!is_final_event(&st.recv_queue[0]));
+
+        assert!(is_final_event(
+            br#"{"type":"conversation.item.input_audio_transcription.completed"}"#
+        ));
+        assert!(is_final_event(br#"{"type":"error"}"#));
+        assert!(!is_final_event(
+            br#"{"type":"conversation.item.input_audio_transcription.delta"}"#
+        ));
+    }
+}
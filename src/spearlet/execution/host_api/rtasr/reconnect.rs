@@ -0,0 +1,125 @@
+//! Reconnect policy of websocket rtasr sessions
+//! websocket rtasr 会话的重连策略
+//!
+//! Once a session has been connected, a dropped websocket (read/write error or a close
+//! frame the task did not ask for) is retried with exponential backoff: the provider
+//! session is created again, the session events are replayed and the audio queued in the
+//! meantime is sent. The task sees `spear.rtasr.reconnecting` / `spear.rtasr.reconnected`
+//! events on the fd; only when the attempts run out does the fd enter `Error`.
+//! 会话连接成功后，若 websocket 断开（读写错误或任务未请求的关闭帧），将以指数退避重试：重新创建
+//! 服务商会话、重放会话事件，并发送期间排队的音频。任务会在 fd 上收到 `spear.rtasr.reconnecting` /
+//! `spear.rtasr.reconnected` 事件；仅当重试次数耗尽时 fd 才进入 `Error`。
+
+use std::collections::HashMap;
+use std::time::Duration;
+
+use serde_json::{json, Value};
+
+use crate::spearlet::param_keys::rtasr as rtasr_keys;
+
+/// Event pushed when the websocket dropped / websocket 断开时推送的事件
+pub(super) const EVENT_RECONNECTING: &str = "spear.rtasr.reconnecting";
+/// Event pushed once the session is back / 会话恢复后推送的事件
+pub(super) const EVENT_RECONNECTED: &str = "spear.rtasr.reconnected";
+
+const DEFAULT_MAX_ATTEMPTS: u32 = 5;
+const DEFAULT_BACKOFF_MS: u64 = 500;
+const MAX_BACKOFF: Duration = Duration::from_secs(10);
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub(super) struct ReconnectPolicy {
+    /// Attempts per drop; 0 disables reconnecting / 每次断开的重试次数；0 表示不重连
+    pub max_attempts: u32,
+    pub backoff: Duration,
+}
+
+impl Default for ReconnectPolicy {
+    fn default() -> Self {
+        Self {
+            max_attempts: DEFAULT_MAX_ATTEMPTS,
+            backoff: Duration::from_millis(DEFAULT_BACKOFF_MS),
+        }
+    }
+}
+
+impl ReconnectPolicy {
+    /// Read the policy from the session params / 从会话参数读取策略
+    pub fn from_params(params: &HashMap<String, Value>) -> Self {
+        let d = Self::default();
+        let max_attempts = params
+            .get(rtasr_keys::RECONNECT_MAX_ATTEMPTS)
+            .and_then(|x| x.as_u64())
+            .map(|n| n.min(u32::MAX as u64) as u32)
+            .unwrap_or(d.max_attempts);
+        let backoff = params
+            .get(rtasr_keys::RECONNECT_BACKOFF_MS)
+            .and_then(|x| x.as_u64())
+            .map(Duration::from_millis)
+            .unwrap_or(d.backoff);
+        Self {
+            max_attempts,
+            backoff,
+        }
+    }
+
+    /// Delay before the given attempt (1-based), doubling up to 10s
+    /// 第 n 次（从 1 开始）重试前的等待时间，逐次翻倍，最多 10 秒
+    pub fn delay(&self, attempt: u32) -> Duration {
+        let shift = attempt.saturating_sub(1).min(16);
+        self.backoff.saturating_mul(1 << shift).min(MAX_BACKOFF)
+    }
+}
+
+pub(super) fn reconnecting_event(
+    attempt: u32,
+    policy: &ReconnectPolicy,
+    error: &str,
+    buffered_bytes: usize,
+) -> Vec<u8> {
+    let body = json!({
+        "type": EVENT_RECONNECTING,
+        "attempt": attempt,
+        "max_attempts": policy.max_attempts,
+        "backoff_ms": policy.delay(attempt).as_millis() as u64,
+        "error": error,
+        "buffered_bytes": buffered_bytes,
+    });
+    serde_json::to_vec(&body).unwrap_or_default()
+}
+
+pub(super) fn reconnected_event(attempt: u32, reconnects: u64) -> Vec<u8> {
+    let body = json!({
+        "type": EVENT_RECONNECTED,
+        "attempt": attempt,
+        "reconnects": reconnects,
+    });
+    serde_json::to_vec(&body).unwrap_or_default()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_policy_from_params_and_backoff() {
+        let p = ReconnectPolicy::from_params(&HashMap::new());
+        assert_eq!(p, ReconnectPolicy::default());
+        assert_eq!(p.delay(1), Duration::from_millis(500));
+        assert_eq!(p.delay(3), Duration::from_millis(2000));
+        assert_eq!(p.delay(30), MAX_BACKOFF);
+
+        let params = HashMap::from([
+            (
+                rtasr_keys::RECONNECT_MAX_ATTEMPTS.to_string(),
+                Value::from(0),
+            ),
+            (
+                rtasr_keys::RECONNECT_BACKOFF_MS.to_string(),
+                Value::from(20),
+            ),
+        ]);
+        let p = ReconnectPolicy::from_params(&params);
+        assert_eq!(p.max_attempts, 0);
+        assert_eq!(p.delay(2), Duration::from_millis(40));
+    }
+}
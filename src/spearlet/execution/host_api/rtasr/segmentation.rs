@@ -229,11 +229,10 @@ pub(super) fn maybe_enqueue_autoflush_locked(st: &mut RtAsrState, now: std::time
     st.last_flush_at = now;
 }
 
-pub(super) fn apply_turn_detection_to_client_events(
-    client_events: &mut [serde_json::Value],
-    cfg: &RtAsrSegmentationConfig,
-) {
-    let turn_detection = if cfg.strategy == RtAsrSegmentationStrategy::ServerVad {
+/// `turn_detection` of the provider session for a segmentation config
+/// 分段配置对应的服务商会话 `turn_detection`
+pub(super) fn turn_detection_value(cfg: &RtAsrSegmentationConfig) -> serde_json::Value {
+    if cfg.strategy == RtAsrSegmentationStrategy::ServerVad {
         let vad = cfg.vad.clone().unwrap_or_default();
         let silence_duration_ms = vad.silence_ms;
         let threshold = vad.threshold.unwrap_or(0.5);
@@ -246,8 +245,14 @@ pub(super) fn apply_turn_detection_to_client_events(
         })
     } else {
         serde_json::Value::Null
-    };
+    }
+}
 
+pub(super) fn apply_turn_detection_to_client_events(
+    client_events: &mut [serde_json::Value],
+    cfg: &RtAsrSegmentationConfig,
+) {
+    let turn_detection = turn_detection_value(cfg);
     for ev in client_events.iter_mut() {
         let Some(obj) = ev.as_object_mut() else {
             continue;
@@ -0,0 +1,288 @@
+//! Provider session configuration of rtasr
+//! rtasr 的服务商会话配置
+//!
+//! The transcription model, language, prompt, noise reduction and turn detection reach
+//! the provider in the `session` object of `session.update`. Params set before CONNECT
+//! are applied to the session events of the plan; `SPEAR_RTA_CTL_UPDATE_SESSION` after
+//! CONNECT sends a new `session.update` to every channel and is replayed on reconnect.
+//! 转写模型、语种、提示词、降噪与轮次检测通过 `session.update` 的 `session` 对象传给服务商。
+//! CONNECT 之前设置的参数应用到计划的会话事件；CONNECT 之后的 `SPEAR_RTA_CTL_UPDATE_SESSION`
+//! 向每个通道发送新的 `session.update`，并在重连时重放。
+
+use std::collections::HashMap;
+
+use serde_json::{Map, Value};
+
+use super::super::language::normalize_code;
+use super::segmentation::{parse_segmentation_config, turn_detection_value};
+use crate::spearlet::execution::host_api::errno::EINVAL;
+use crate::spearlet::execution::hostcall::types::RtAsrSegmentationConfig;
+use crate::spearlet::param_keys::rtasr as rtasr_keys;
+
+const SESSION_UPDATE: &str = "session.update";
+const TRANSCRIPTION: &str = "input_audio_transcription";
+const NOISE_REDUCTION: &str = "input_audio_noise_reduction";
+const TURN_DETECTION: &str = "turn_detection";
+
+/// Longest transcription prompt, in bytes / 转写提示词的最大长度（字节）
+pub(super) const MAX_PROMPT_BYTES: usize = 4096;
+
+/// A validated `SPEAR_RTA_CTL_UPDATE_SESSION` request
+/// 经过校验的 `SPEAR_RTA_CTL_UPDATE_SESSION` 请求
+#[derive(Debug, Default)]
+pub(super) struct SessionUpdate {
+    /// Fields merged into the provider session / 合并到服务商会话中的字段
+    pub patch: Map<String, Value>,
+    /// Params to store; `Null` removes the param / 要保存的参数；`Null` 表示删除
+    pub params: Vec<(&'static str, Value)>,
+    /// New language: `Some(None)` returns to detection / 新语种：`Some(None)` 表示恢复自动检测
+    pub language: Option<Option<String>>,
+    pub segmentation: Option<RtAsrSegmentationConfig>,
+}
+
+/// `input_audio_noise_reduction` for a `noise_reduction` value: `near_field`,
+/// `far_field`, or `off`/null to disable it
+/// `noise_reduction` 取值对应的 `input_audio_noise_reduction`：`near_field`、`far_field`，
+/// 或以 `off`/null 关闭
+pub(super) fn noise_reduction_value(v: &Value) -> Result<Value, i32> {
+    match v {
+        Value::Null => Ok(Value::Null),
+        Value::String(s) => match s.as_str() {
+            "off" => Ok(Value::Null),
+            "near_field" | "far_field" => Ok(serde_json::json!({"type": s})),
+            _ => Err(-EINVAL),
+        },
+        _ => Err(-EINVAL),
+    }
+}
+
+fn prompt_value(v: &Value) -> Result<Value, i32> {
+    match v {
+        Value::Null => Ok(Value::Null),
+        Value::String(s) if s.len() <= MAX_PROMPT_BYTES => Ok(v.clone()),
+        _ => Err(-EINVAL),
+    }
+}
+
+/// Check a session param at SET_PARAM / 在 SET_PARAM 时校验会话参数
+pub(super) fn validate_param(key: &str, value: &Value) -> Result<(), i32> {
+    match key {
+        rtasr_keys::NOISE_REDUCTION => noise_reduction_value(value).map(|_| ()),
+        rtasr_keys::PROMPT => prompt_value(value).map(|_| ()),
+        _ => Ok(()),
+    }
+}
+
+/// Session fields from the params, applied at CONNECT / 连接时应用的、来自参数的会话字段
+pub(super) fn patch_from_params(params: &HashMap<String, Value>) -> Map<String, Value> {
+    let mut patch = Map::new();
+    if let Some(v) = params.get(rtasr_keys::NOISE_REDUCTION) {
+        if let Ok(nr) = noise_reduction_value(v) {
+            patch.insert(NOISE_REDUCTION.to_string(), nr);
+        }
+    }
+    if let Some(p) = params.get(rtasr_keys::PROMPT).and_then(|x| x.as_str()) {
+        patch.insert(TRANSCRIPTION.to_string(), serde_json::json!({"prompt": p}));
+    }
+    patch
+}
+
+/// Parse `{"model", "language", "prompt", "noise_reduction", "turn_detection"}`; any
+/// subset may be given. `turn_detection` takes the SET_AUTOFLUSH config.
+/// 解析 `{"model", "language", "prompt", "noise_reduction", "turn_detection"}`，可给出任意子集。
+/// `turn_detection` 接受 SET_AUTOFLUSH 的配置。
+pub(super) fn parse_session_update(v: &Value) -> Result<SessionUpdate, i32> {
+    let obj = v.as_object().ok_or(-EINVAL)?;
+    if obj.is_empty() {
+        return Err(-EINVAL);
+    }
+    let mut up = SessionUpdate::default();
+    let mut transcription = Map::new();
+    for (k, v) in obj {
+        match k.as_str() {
+            "model" => {
+                let m = v.as_str().map(str::trim).filter(|m| !m.is_empty());
+                let m = m.ok_or(-EINVAL)?;
+                transcription.insert("model".to_string(), Value::from(m));
+                up.params.push((rtasr_keys::MODEL, Value::from(m)));
+            }
+            "language" => {
+                let code = match v {
+                    Value::Null => None,
+                    Value::String(s) if s.trim() == "auto" => None,
+                    Value::String(s) => Some(normalize_code(s).ok_or(-EINVAL)?),
+                    _ => return Err(-EINVAL),
+                };
+                let value = code.clone().map_or(Value::Null, Value::from);
+                transcription.insert("language".to_string(), value.clone());
+                up.params.push((rtasr_keys::LANGUAGE, value));
+                up.language = Some(code);
+            }
+            "prompt" => {
+                let p = prompt_value(v)?;
+                transcription.insert("prompt".to_string(), p.clone());
+                up.params.push((rtasr_keys::PROMPT, p));
+            }
+            "noise_reduction" => {
+                up.patch
+                    .insert(NOISE_REDUCTION.to_string(), noise_reduction_value(v)?);
+                up.params.push((rtasr_keys::NOISE_REDUCTION, v.clone()));
+            }
+            "turn_detection" => {
+                let cfg = parse_segmentation_config(v)?;
+                up.patch
+                    .insert(TURN_DETECTION.to_string(), turn_detection_value(&cfg));
+                up.segmentation = Some(cfg);
+            }
+            _ => return Err(-EINVAL),
+        }
+    }
+    if !transcription.is_empty() {
+        up.patch
+            .insert(TRANSCRIPTION.to_string(), Value::Object(transcription));
+    }
+    Ok(up)
+}
+
+/// Merge `patch` into a provider session. `input_audio_transcription` is merged field by
+/// field, a null field removing it; other fields are replaced. `turn_detection` is left
+/// out for providers without turn detection.
+/// 将 `patch` 合并到服务商会话。`input_audio_transcription` 逐字段合并，null 字段表示删除；
+/// 其他字段整体替换。不支持轮次检测的服务商不合并 `turn_detection`。
+pub(super) fn merge_session(
+    session: &mut Map<String, Value>,
+    patch: &Map<String, Value>,
+    supports_turn_detection: bool,
+) {
+    for (k, v) in patch {
+        if k == TURN_DETECTION && !supports_turn_detection {
+            continue;
+        }
+        if k == TRANSCRIPTION {
+            if let Some(fields) = v.as_object() {
+                let t = session
+                    .entry(TRANSCRIPTION.to_string())
+                    .or_insert_with(|| Value::Object(Map::new()));
+                if !t.is_object() {
+                    *t = Value::Object(Map::new());
+                }
+                if let Some(t) = t.as_object_mut() {
+                    for (f, fv) in fields {
+                        if fv.is_null() {
+                            t.remove(f);
+                        } else {
+                            t.insert(f.clone(), fv.clone());
+                        }
+                    }
+                }
+                continue;
+            }
+        }
+        session.insert(k.clone(), v.clone());
+    }
+}
+
+/// Accumulate `patch` into the overrides replayed on reconnect; unlike `merge_session`,
+/// null fields are kept so the replay removes them too
+/// 将 `patch` 累积到重连时重放的覆盖项中；与 `merge_session` 不同，null 字段会保留，以便重放时同样删除
+pub(super) fn merge_overrides(overrides: &mut Map<String, Value>, patch: &Map<String, Value>) {
+    for (k, v) in patch {
+        match (overrides.get_mut(k), v.as_object()) {
+            (Some(Value::Object(cur)), Some(fields)) if k == TRANSCRIPTION => {
+                cur.extend(fields.iter().map(|(f, fv)| (f.clone(), fv.clone())));
+            }
+            _ => {
+                overrides.insert(k.clone(), v.clone());
+            }
+        }
+    }
+}
+
+/// The `session` object of the first `session.update` in the events
+/// 事件中第一个 `session.update` 的 `session` 对象
+pub(super) fn session_of(client_events: &[Value]) -> Option<Map<String, Value>> {
+    client_events
+        .iter()
+        .filter(|ev| ev.get("type").and_then(|x| x.as_str()) == Some(SESSION_UPDATE))
+        .find_map(|ev| ev.get("session").and_then(|s| s.as_object()).cloned())
+}
+
+/// Merge `patch` into every `session.update` of the events
+/// 将 `patch` 合并到事件中的每个 `session.update`
+pub(super) fn apply_patch_to_client_events(
+    client_events: &mut [Value],
+    patch: &Map<String, Value>,
+    supports_turn_detection: bool,
+) {
+    if patch.is_empty() {
+        return;
+    }
+    for ev in client_events.iter_mut() {
+        if ev.get("type").and_then(|x| x.as_str()) != Some(SESSION_UPDATE) {
+            continue;
+        }
+        if let Some(session) = ev.get_mut("session").and_then(|s| s.as_object_mut()) {
+            merge_session(session, patch, supports_turn_detection);
+        }
+    }
+}
+
+pub(super) fn session_update_event_text(session: &Map<String, Value>) -> String {
+    serde_json::json!({"type": SESSION_UPDATE, "session": session}).to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_session_update_merges_into_events() {
+        let mut events = vec![json!({
+            "type": "session.update",
+            "session": {
+                "input_audio_format": "pcm16",
+                "input_audio_transcription": {"model": "m", "language": "en"},
+            }
+        })];
+
+        let up = parse_session_update(&json!({
+            "language": "auto",
+            "prompt": "SPEAR, spearlet",
+            "noise_reduction": "far_field",
+            "turn_detection": {"strategy": "server_vad", "vad": {"silence_ms": 700}},
+        }))
+        .unwrap();
+        assert_eq!(up.language, Some(None));
+        assert!(up.segmentation.is_some());
+
+        apply_patch_to_client_events(&mut events, &up.patch, false);
+        let s = session_of(&events).unwrap();
+        assert_eq!(
+            s["input_audio_transcription"],
+            json!({"model": "m", "prompt": "SPEAR, spearlet"})
+        );
+        assert_eq!(
+            s["input_audio_noise_reduction"],
+            json!({"type": "far_field"})
+        );
+        assert!(s.get("turn_detection").is_none());
+
+        apply_patch_to_client_events(&mut events, &up.patch, true);
+        let s = session_of(&events).unwrap();
+        assert_eq!(s["turn_detection"]["silence_duration_ms"], 700);
+
+        // The override keeps the null so a reconnect drops the language too
+        // 覆盖项保留 null，使重连时同样去掉语种
+        let mut overrides = Map::new();
+        merge_overrides(&mut overrides, &up.patch);
+        assert_eq!(
+            overrides["input_audio_transcription"].get("language"),
+            Some(&Value::Null)
+        );
+
+        assert!(parse_session_update(&json!({})).is_err());
+        assert!(parse_session_update(&json!({"noise_reduction": "loud"})).is_err());
+        assert!(parse_session_update(&json!({"voice": "nova"})).is_err());
+    }
+}
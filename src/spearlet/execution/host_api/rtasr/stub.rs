@@ -2,8 +2,18 @@ use crate::spearlet::execution::host_api::DefaultHostApi;
 use crate::spearlet::execution::hostcall::types::{FdInner, PollEvents, RtAsrConnState};
 use serde_json::json;
 
+use super::channels::tag_event;
+use super::finish::{close_terminated_rtasr, SessionOwner};
+
 impl DefaultHostApi {
-    pub(super) fn spawn_rtasr_stub_tasks(&self, fd: i32) {
+    /// Emit fake transcription events; with channels, each event is emitted once per channel
+    /// 产生模拟转写事件；设置了通道时，每个事件按通道各产生一次
+    pub(super) fn spawn_rtasr_stub_tasks(
+        &self,
+        fd: i32,
+        channels: Vec<String>,
+        owner: SessionOwner,
+    ) {
         let table = self.fd_table.clone();
 
         self.spawn_background(async move {
@@ -11,6 +21,10 @@ impl DefaultHostApi {
             loop {
                 tokio::time::sleep(std::time::Duration::from_millis(10)).await;
 
+                if owner.terminated() {
+                    close_terminated_rtasr(&table, fd);
+                    break;
+                }
                 let Some(entry) = table.get(fd) else {
                     break;
                 };
@@ -30,6 +44,10 @@ impl DefaultHostApi {
                         let FdInner::RtAsr(st) = &mut e.inner else {
                             break;
                         };
+                        // Finished: nothing more to emit / 已结束：不再产生事件
+                        if st.state == RtAsrConnState::Closed {
+                            break;
+                        }
 
                         if let Some(item) = st.send_queue.pop_front() {
                             st.send_queue_bytes =
@@ -71,9 +89,20 @@ impl DefaultHostApi {
                             });
                             let payload =
                                 serde_json::to_vec(&body).unwrap_or_else(|_| b"{}".to_vec());
+                            let payloads = if channels.is_empty() {
+                                vec![payload]
+                            } else {
+                                channels
+                                    .iter()
+                                    .map(|c| tag_event(payload.clone(), c))
+                                    .collect()
+                            };
 
-                            st.recv_queue_bytes = st.recv_queue_bytes.saturating_add(payload.len());
-                            st.recv_queue.push_back(payload);
+                            for payload in payloads {
+                                st.recv_queue_bytes =
+                                    st.recv_queue_bytes.saturating_add(payload.len());
+                                st.recv_queue.push_back(payload);
+                            }
                             while st.recv_queue_bytes > st.max_recv_queue_bytes {
                                 let Some(old) = st.recv_queue.pop_front() else {
                                     st.recv_queue_bytes = 0;
@@ -4,12 +4,53 @@ use crate::spearlet::execution::hostcall::fd_table::FdTable;
 use crate::spearlet::execution::hostcall::types::{
     FdInner, PollEvents, RtAsrConnState, RtAsrSendItem,
 };
+use crate::spearlet::locale::LocaleSettings;
 use std::collections::HashMap;
 
+use super::super::language::observe_rtasr_event;
 use super::super::util::{
     build_ws_request_with_headers, expand_json_templates, expand_template, extract_json_path,
 };
+use super::backend::{backend_for, AsrSink, AsrStream, StreamingAsrBackend};
+use super::channels::tag_event;
+use super::finish::{
+    close_terminated_rtasr, complete_finish_locked, finish_due, is_final_event, note_final_locked,
+    SessionOwner,
+};
+use super::reconnect::{reconnected_event, reconnecting_event, ReconnectPolicy};
 use super::segmentation::maybe_enqueue_autoflush_locked;
+use super::session::{
+    apply_patch_to_client_events, merge_session, session_of, session_update_event_text,
+};
+
+/// An open provider connection and the backend speaking its protocol
+/// 已打开的服务商连接及使用其协议的后端
+struct RtAsrConnection {
+    sink: AsrSink,
+    stream: AsrStream,
+    backend: std::sync::Arc<dyn StreamingAsrBackend>,
+}
+
+/// Idle time after which a connection is sent the backend's keepalive
+/// 空闲多久后向连接发送后端的保活帧
+const KEEPALIVE_INTERVAL: std::time::Duration = std::time::Duration::from_secs(5);
+
+/// A provider session and the channel it serves, if any / 服务商会话及其所属通道（如有）
+type ChannelSession<T> = (Option<String>, T);
+
+/// Provider session of a channel and whether it takes `turn_detection`
+/// 通道的服务商会话及其是否接受 `turn_detection`
+type ProviderSessionConfig = (Option<serde_json::Map<String, serde_json::Value>>, bool);
+
+/// How a connected session ended / 已连接会话的结束方式
+enum SessionEnd {
+    /// The fd was closed locally / fd 已在本地关闭
+    Local,
+    /// The peer sent a close frame / 对端发送了关闭帧
+    PeerClosed,
+    /// The connection dropped / 连接断开
+    Dropped(String),
+}
 
 fn set_rtasr_error(table: &FdTable, fd: i32, msg: String) {
     if let Some(entry) = table.get(fd) {
@@ -24,6 +65,74 @@ fn set_rtasr_error(table: &FdTable, fd: i32, msg: String) {
     }
 }
 
+/// Carry session updates made after CONNECT into the plans, so a reconnect keeps them
+/// 将 CONNECT 之后的会话更新带入计划，使重连后仍然保留
+fn apply_session_overrides(
+    table: &FdTable,
+    fd: i32,
+    plans: &mut [ChannelSession<StreamingWebsocketPlan>],
+) {
+    let overrides = {
+        let Some(entry) = table.get(fd) else {
+            return;
+        };
+        let Ok(e) = entry.lock() else {
+            return;
+        };
+        let FdInner::RtAsr(st) = &e.inner else {
+            return;
+        };
+        st.session_overrides.clone()
+    };
+    for (_, p) in plans.iter_mut() {
+        apply_patch_to_client_events(
+            &mut p.websocket.client_events,
+            &overrides,
+            p.websocket.supports_turn_detection,
+        );
+    }
+}
+
+/// Count a final transcript of a finishing session / 为结束中的会话计入一个最终转写
+fn note_rtasr_final(table: &FdTable, fd: i32) {
+    if let Some(entry) = table.get(fd) {
+        if let Ok(mut e) = entry.lock() {
+            if let FdInner::RtAsr(st) = &mut e.inner {
+                note_final_locked(st);
+            }
+        }
+    }
+}
+
+/// End a finishing session whose websocket went away; false if it was not finishing
+/// 结束 websocket 已断开的结束中会话；若会话不在结束中则返回 false
+fn end_draining_rtasr(table: &FdTable, fd: i32, error: Option<&str>) -> bool {
+    let Some(entry) = table.get(fd) else {
+        return false;
+    };
+    let ended = {
+        let Ok(mut e) = entry.lock() else {
+            return false;
+        };
+        let ended = match &mut e.inner {
+            FdInner::RtAsr(st) if st.state == RtAsrConnState::Draining => {
+                complete_finish_locked(st, false, error);
+                true
+            }
+            _ => false,
+        };
+        if ended {
+            e.poll_mask.insert(PollEvents::IN);
+            e.poll_mask.insert(PollEvents::HUP);
+        }
+        ended
+    };
+    if ended {
+        table.notify_watchers(fd);
+    }
+    ended
+}
+
 fn set_rtasr_hup(table: &FdTable, fd: i32) {
     if let Some(entry) = table.get(fd) {
         if let Ok(mut e) = entry.lock() {
@@ -88,125 +197,168 @@ fn push_rtasr_event(table: &FdTable, fd: i32, payload: Vec<u8>) {
     }
 }
 
-impl DefaultHostApi {
-    pub(super) fn spawn_rtasr_websocket_tasks(
-        &self,
-        fd: i32,
-        plan: StreamingWebsocketPlan,
-        ws_url_override: Option<String>,
-        client_secret_override: Option<String>,
-    ) {
-        let table = self.fd_table.clone();
-        let global_env = self.runtime_config.global_environment.clone();
+fn rtasr_fd_open(table: &FdTable, fd: i32) -> bool {
+    let Some(entry) = table.get(fd) else {
+        return false;
+    };
+    let Ok(e) = entry.lock() else {
+        return false;
+    };
+    match &e.inner {
+        FdInner::RtAsr(st) => {
+            !e.closed && st.state != RtAsrConnState::Closed && st.state != RtAsrConnState::Error
+        }
+        _ => false,
+    }
+}
 
-        self.spawn_background(async move {
-            let mut vars: HashMap<String, String> = HashMap::new();
-            if let Some(s) = client_secret_override {
-                vars.insert("client_secret".to_string(), s);
-            } else {
-                for step in plan.prepare.iter() {
-                    match step {
-                        StreamingPrepareStep::HttpJson(p) => {
-                            let url = expand_template(&p.url, &vars, &global_env);
-                            let body = expand_json_templates(p.body.clone(), &vars, &global_env);
-                            let mut req = reqwest::Client::new()
-                                .request(p.method.parse().unwrap_or(reqwest::Method::POST), url);
-                            for (k, v) in p.headers.iter() {
-                                let hv = expand_template(v, &vars, &global_env);
-                                req = req.header(k, hv);
-                            }
-                            let resp = match tokio::time::timeout(
-                                std::time::Duration::from_secs(20),
-                                req.json(&body).send(),
-                            )
-                            .await
-                            {
-                                Ok(Ok(r)) => r,
-                                Ok(Err(e)) => {
-                                    set_rtasr_error(
-                                        &table,
-                                        fd,
-                                        format!("prepare http request failed: {e}"),
-                                    );
-                                    return;
-                                }
-                                Err(_) => {
-                                    set_rtasr_error(
-                                        &table,
-                                        fd,
-                                        "prepare http request timed out".to_string(),
-                                    );
-                                    return;
-                                }
-                            };
-                            let status = resp.status();
-                            let bytes = match resp.bytes().await {
-                                Ok(b) => b,
-                                Err(e) => {
-                                    set_rtasr_error(
-                                        &table,
-                                        fd,
-                                        format!("prepare http read failed: {e}"),
-                                    );
-                                    return;
-                                }
-                            };
-                            let json_v: serde_json::Value = match serde_json::from_slice(&bytes) {
-                                Ok(v) => v,
-                                Err(e) => {
-                                    set_rtasr_error(
-                                        &table,
-                                        fd,
-                                        format!("prepare http invalid json: {e}"),
-                                    );
-                                    return;
-                                }
-                            };
-                            if !status.is_success() {
-                                let msg = json_v
-                                    .get("error")
-                                    .and_then(|x| x.get("message"))
-                                    .and_then(|x| x.as_str())
-                                    .unwrap_or("upstream error");
-                                set_rtasr_error(
-                                    &table,
-                                    fd,
-                                    format!("prepare http failed: {}: {}", status.as_u16(), msg),
-                                );
-                                return;
-                            }
-                            let extracted = match extract_json_path(&json_v, &p.extract_json_path) {
-                                Some(s) => s,
-                                None => {
-                                    set_rtasr_error(
-                                        &table,
-                                        fd,
-                                        format!("prepare extract failed: {}", p.extract_json_path),
-                                    );
-                                    return;
-                                }
-                            };
-                            vars.insert(p.extract_to_var.clone(), extracted);
-                        }
-                    }
-                }
+fn set_rtasr_reconnecting(
+    table: &FdTable,
+    fd: i32,
+    attempt: u32,
+    policy: &ReconnectPolicy,
+    error: &str,
+) {
+    let Some(entry) = table.get(fd) else {
+        return;
+    };
+    let buffered = {
+        let Ok(mut e) = entry.lock() else {
+            return;
+        };
+        let FdInner::RtAsr(st) = &mut e.inner else {
+            return;
+        };
+        st.state = RtAsrConnState::Connecting;
+        st.last_error = Some(error.to_string());
+        st.send_queue_bytes
+    };
+    push_rtasr_event(
+        table,
+        fd,
+        reconnecting_event(attempt, policy, error, buffered),
+    );
+}
+
+fn set_rtasr_reconnected(table: &FdTable, fd: i32, attempt: u32) {
+    let Some(entry) = table.get(fd) else {
+        return;
+    };
+    let reconnects = {
+        let Ok(mut e) = entry.lock() else {
+            return;
+        };
+        let FdInner::RtAsr(st) = &mut e.inner else {
+            return;
+        };
+        if st.state == RtAsrConnState::Connecting {
+            st.state = RtAsrConnState::Connected;
+        }
+        st.reconnects = st.reconnects.saturating_add(1);
+        st.reconnects
+    };
+    push_rtasr_event(table, fd, reconnected_event(attempt, reconnects));
+}
+
+/// Put back an item whose send failed, so it goes out after the reconnect
+/// 放回发送失败的条目，使其在重连后发出
+fn requeue_rtasr_item(table: &FdTable, fd: i32, item: RtAsrSendItem) {
+    if let Some(entry) = table.get(fd) {
+        if let Ok(mut e) = entry.lock() {
+            if let FdInner::RtAsr(st) = &mut e.inner {
+                st.send_queue_bytes = st.send_queue_bytes.saturating_add(item.byte_len());
+                st.send_queue.push_front(item);
             }
+        }
+    }
+}
 
-            let ws_url = ws_url_override.unwrap_or_else(|| plan.websocket.url.clone());
-
-            let request = match build_ws_request_with_headers(
-                &ws_url,
-                &plan.websocket.headers,
-                &vars,
-                &global_env,
-            ) {
-                Ok(r) => r,
-                Err(e) => {
-                    set_rtasr_error(&table, fd, e);
-                    return;
+/// Run the prepare steps of the plan, e.g. creating the provider session
+/// 执行计划中的准备步骤，例如创建服务商会话
+async fn prepare_rtasr_session(
+    plan: &StreamingWebsocketPlan,
+    vars: &mut HashMap<String, String>,
+    global_env: &HashMap<String, String>,
+) -> Result<(), String> {
+    for step in plan.prepare.iter() {
+        match step {
+            StreamingPrepareStep::HttpJson(p) => {
+                let url = expand_template(&p.url, vars, global_env);
+                let body = expand_json_templates(p.body.clone(), vars, global_env);
+                let mut req = reqwest::Client::new()
+                    .request(p.method.parse().unwrap_or(reqwest::Method::POST), url);
+                for (k, v) in p.headers.iter() {
+                    let hv = expand_template(v, vars, global_env);
+                    req = req.header(k, hv);
                 }
-            };
+                let resp = match tokio::time::timeout(
+                    std::time::Duration::from_secs(20),
+                    req.json(&body).send(),
+                )
+                .await
+                {
+                    Ok(Ok(r)) => r,
+                    Ok(Err(e)) => return Err(format!("prepare http request failed: {e}")),
+                    Err(_) => return Err("prepare http request timed out".to_string()),
+                };
+                let status = resp.status();
+                let bytes = resp
+                    .bytes()
+                    .await
+                    .map_err(|e| format!("prepare http read failed: {e}"))?;
+                let json_v: serde_json::Value = serde_json::from_slice(&bytes)
+                    .map_err(|e| format!("prepare http invalid json: {e}"))?;
+                if !status.is_success() {
+                    let msg = json_v
+                        .get("error")
+                        .and_then(|x| x.get("message"))
+                        .and_then(|x| x.as_str())
+                        .unwrap_or("upstream error");
+                    return Err(format!("prepare http failed: {}: {}", status.as_u16(), msg));
+                }
+                let extracted = extract_json_path(&json_v, &p.extract_json_path)
+                    .ok_or_else(|| format!("prepare extract failed: {}", p.extract_json_path))?;
+                vars.insert(p.extract_to_var.clone(), extracted);
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Create the session, connect and replay the session events
+/// 创建会话、建立连接并重放会话事件
+async fn connect_rtasr_session(
+    plan: &StreamingWebsocketPlan,
+    ws_url: &str,
+    client_secret_override: Option<&str>,
+    global_env: &HashMap<String, String>,
+    locale: &LocaleSettings,
+) -> Result<RtAsrConnection, String> {
+    use futures::{SinkExt, StreamExt};
 
+    // Local date/time variables follow the workload timezone / 本地日期时间变量遵循工作负载时区
+    let mut vars: HashMap<String, String> = locale.template_vars(chrono::Utc::now());
+    if let Some(s) = client_secret_override {
+        vars.insert("client_secret".to_string(), s.to_string());
+    } else {
+        prepare_rtasr_session(plan, &mut vars, global_env).await?;
+    }
+
+    let backend = backend_for(plan.websocket.protocol)?;
+    let session = session_of(&plan.websocket.client_events);
+    let url = backend.session_url(ws_url, session.as_ref());
+    let headers: Vec<(String, String)> = plan
+        .websocket
+        .headers
+        .iter()
+        .map(|(k, v)| (k.clone(), expand_template(v, &vars, global_env)))
+        .collect();
+
+    let (mut sink, stream) = match backend.local_connection(&url, headers) {
+        Some(conn) => conn,
+        None => {
+            let request =
+                build_ws_request_with_headers(&url, &plan.websocket.headers, &vars, global_env)?;
             let (ws_stream, _) =
                 match tokio::time::timeout(std::time::Duration::from_secs(20), async {
                     tokio_tungstenite::connect_async(request).await
@@ -214,220 +366,412 @@ impl DefaultHostApi {
                 .await
                 {
                     Ok(Ok(v)) => v,
-                    Ok(Err(e)) => {
-                        set_rtasr_error(&table, fd, format!("websocket connect failed: {e}"));
-                        return;
-                    }
-                    Err(_) => {
-                        set_rtasr_error(&table, fd, "websocket connect timed out".to_string());
-                        return;
-                    }
+                    Ok(Err(e)) => return Err(format!("websocket connect failed: {e}")),
+                    Err(_) => return Err("websocket connect timed out".to_string()),
                 };
+            let (w, r) = ws_stream.split();
+            let sink: AsrSink = Box::pin(w.sink_map_err(|e| e.to_string()));
+            let stream: AsrStream = Box::pin(r.map(|m| m.map_err(|e| e.to_string())));
+            (sink, stream)
+        }
+    };
 
-            use futures::{SinkExt, StreamExt};
-            let (mut ws_write, mut ws_read) = ws_stream.split();
+    for msg in backend.create_session(&plan.websocket.client_events) {
+        sink.send(msg)
+            .await
+            .map_err(|e| format!("websocket send failed: {e}"))?;
+    }
+    Ok(RtAsrConnection {
+        sink,
+        stream,
+        backend,
+    })
+}
 
-            for ev in plan.websocket.client_events.iter() {
-                let txt = match serde_json::to_string(ev) {
-                    Ok(s) => s,
-                    Err(e) => {
-                        set_rtasr_error(&table, fd, format!("websocket event encode failed: {e}"));
-                        return;
-                    }
-                };
-                if let Err(e) = ws_write
-                    .send(tokio_tungstenite::tungstenite::Message::Text(txt))
-                    .await
-                {
-                    set_rtasr_error(&table, fd, format!("websocket send failed: {e}"));
-                    return;
-                }
-            }
+/// Connect every channel; one failure fails them all
+/// 连接所有通道；任一失败即整体失败
+async fn connect_rtasr_channels(
+    plans: &[ChannelSession<StreamingWebsocketPlan>],
+    ws_url_override: Option<&str>,
+    client_secret_override: Option<&str>,
+    global_env: &HashMap<String, String>,
+    locale: &LocaleSettings,
+) -> Result<Vec<ChannelSession<RtAsrConnection>>, String> {
+    let mut sessions = Vec::with_capacity(plans.len());
+    for (channel, plan) in plans.iter() {
+        let ws_url = ws_url_override.unwrap_or(&plan.websocket.url);
+        let ws =
+            connect_rtasr_session(plan, ws_url, client_secret_override, global_env, locale).await?;
+        sessions.push((channel.clone(), ws));
+    }
+    Ok(sessions)
+}
 
-            let t_writer = {
-                let table = table.clone();
-                tokio::spawn(async move {
-                    let res: Result<(), String> = async {
-                        loop {
-                            let item = {
-                                let Some(entry) = table.get(fd) else {
-                                    return Ok::<(), String>(());
-                                };
-                                let mut e =
-                                    entry.lock().map_err(|_| "fd lock poisoned".to_string())?;
-                                if e.closed {
-                                    return Ok(());
-                                }
-                                let old = e.poll_mask;
-                                let is_closed = e.closed;
-                                let (item, mask) = {
-                                    let FdInner::RtAsr(st) = &mut e.inner else {
-                                        return Err("fd kind mismatch".to_string());
-                                    };
-                                    if st.state == RtAsrConnState::Error
-                                        || st.state == RtAsrConnState::Closed
-                                    {
-                                        return Ok(());
-                                    }
-
-                                    let item = st.send_queue.pop_front();
-                                    if let Some(ref it) = item {
-                                        st.send_queue_bytes =
-                                            st.send_queue_bytes.saturating_sub(it.byte_len());
-                                    }
-
-                                    let mut mask = PollEvents::EMPTY;
-                                    if !st.recv_queue.is_empty() {
-                                        mask.insert(PollEvents::IN);
-                                    }
-                                    let writable = st.send_queue_bytes < st.max_send_queue_bytes
-                                        && st.state != RtAsrConnState::Draining
-                                        && st.state != RtAsrConnState::Closed
-                                        && st.state != RtAsrConnState::Error
-                                        && !is_closed;
-                                    if writable {
-                                        mask.insert(PollEvents::OUT);
-                                    }
-                                    if st.state == RtAsrConnState::Error {
-                                        mask.insert(PollEvents::ERR);
-                                    }
-                                    if is_closed || st.state == RtAsrConnState::Closed {
-                                        mask.insert(PollEvents::HUP);
-                                    }
-                                    (item, mask)
-                                };
+/// Pump audio out to every channel and events in until a connection ends
+/// 持续向所有通道发送音频并接收事件，直到某个连接结束
+async fn run_rtasr_session(
+    table: &FdTable,
+    fd: i32,
+    sessions: Vec<ChannelSession<RtAsrConnection>>,
+    mut provider_sessions: Vec<ProviderSessionConfig>,
+    session_key: &str,
+    owner: &SessionOwner,
+) -> SessionEnd {
+    use futures::{SinkExt, StreamExt};
+    let mut ws_writes = Vec::with_capacity(sessions.len());
+    let mut ws_reads = Vec::with_capacity(sessions.len());
+    for (channel, conn) in sessions {
+        ws_writes.push((conn.sink, conn.backend.clone()));
+        ws_reads.push((channel, conn.stream, conn.backend));
+    }
 
-                                e.poll_mask = mask;
-                                let notify = e.poll_mask.bits() != old.bits();
-                                drop(e);
-                                if notify {
-                                    table.notify_watchers(fd);
-                                }
-                                item
+    let mut t_writer = {
+        let table = table.clone();
+        let owner = owner.clone();
+        tokio::spawn(async move {
+            let mut last_sent = std::time::Instant::now();
+            let res: Result<(), String> = async {
+                loop {
+                    let item = {
+                        let Some(entry) = table.get(fd) else {
+                            return Ok::<(), String>(());
+                        };
+                        let mut e = entry.lock().map_err(|_| "fd lock poisoned".to_string())?;
+                        if e.closed {
+                            return Ok(());
+                        }
+                        let old = e.poll_mask;
+                        let is_closed = e.closed;
+                        let (item, mask) = {
+                            let FdInner::RtAsr(st) = &mut e.inner else {
+                                return Err("fd kind mismatch".to_string());
                             };
+                            if st.state == RtAsrConnState::Error
+                                || st.state == RtAsrConnState::Closed
+                            {
+                                return Ok(());
+                            }
 
-                            let Some(item) = item else {
-                                let mut enqueued = false;
-                                {
-                                    let Some(entry) = table.get(fd) else {
-                                        return Ok::<(), String>(());
-                                    };
-                                    let mut e =
-                                        entry.lock().map_err(|_| "fd lock poisoned".to_string())?;
-                                    if e.closed {
-                                        return Ok(());
-                                    }
-                                    if let FdInner::RtAsr(st) = &mut e.inner {
-                                        let before = st.send_queue_bytes;
-                                        let now = std::time::Instant::now();
-                                        maybe_enqueue_autoflush_locked(st, now);
-                                        enqueued = st.send_queue_bytes != before;
-                                    }
-                                }
-                                if enqueued {
-                                    continue;
-                                }
-                                tokio::time::sleep(std::time::Duration::from_millis(5)).await;
-                                continue;
-                            };
+                            let item = st.send_queue.pop_front();
+                            if let Some(ref it) = item {
+                                st.send_queue_bytes =
+                                    st.send_queue_bytes.saturating_sub(it.byte_len());
+                            }
 
-                            let sent_text = matches!(&item, RtAsrSendItem::WsText(_));
-                            match item {
-                                RtAsrSendItem::Audio(chunk) => {
-                                    let audio_b64 = {
-                                        use base64::Engine;
-                                        base64::engine::general_purpose::STANDARD.encode(&chunk)
-                                    };
-                                    let body = serde_json::json!({
-                                        "type": "input_audio_buffer.append",
-                                        "audio": audio_b64,
-                                    });
-                                    let txt =
-                                        serde_json::to_string(&body).map_err(|e| e.to_string())?;
-                                    ws_write
-                                        .send(tokio_tungstenite::tungstenite::Message::Text(txt))
-                                        .await
-                                        .map_err(|e| format!("websocket send failed: {e}"))?;
+                            let mut mask = PollEvents::EMPTY;
+                            if !st.recv_queue.is_empty() {
+                                mask.insert(PollEvents::IN);
+                            }
+                            let writable = st.send_queue_bytes < st.max_send_queue_bytes
+                                && st.state != RtAsrConnState::Draining
+                                && st.state != RtAsrConnState::Closed
+                                && st.state != RtAsrConnState::Error
+                                && !is_closed;
+                            if writable {
+                                mask.insert(PollEvents::OUT);
+                            }
+                            if st.state == RtAsrConnState::Error {
+                                mask.insert(PollEvents::ERR);
+                            }
+                            if is_closed || st.state == RtAsrConnState::Closed {
+                                mask.insert(PollEvents::HUP);
+                            }
+                            (item, mask)
+                        };
+
+                        e.poll_mask = mask;
+                        let notify = e.poll_mask.bits() != old.bits();
+                        drop(e);
+                        if notify {
+                            table.notify_watchers(fd);
+                        }
+                        item
+                    };
+
+                    let Some(item) = item else {
+                        let mut enqueued = false;
+                        let mut finished = false;
+                        let terminated;
+                        {
+                            let Some(entry) = table.get(fd) else {
+                                return Ok::<(), String>(());
+                            };
+                            let mut e = entry.lock().map_err(|_| "fd lock poisoned".to_string())?;
+                            if e.closed {
+                                return Ok(());
+                            }
+                            if let FdInner::RtAsr(st) = &mut e.inner {
+                                let before = st.send_queue_bytes;
+                                let now = std::time::Instant::now();
+                                maybe_enqueue_autoflush_locked(st, now);
+                                enqueued = st.send_queue_bytes != before;
+                                if let Some(timed_out) = finish_due(st, now) {
+                                    complete_finish_locked(st, timed_out, None);
+                                    finished = true;
                                 }
-                                RtAsrSendItem::WsText(txt) => {
+                            }
+                            if finished {
+                                e.poll_mask.insert(PollEvents::IN);
+                                e.poll_mask.insert(PollEvents::HUP);
+                            }
+                            terminated = owner.terminated();
+                        }
+                        if terminated {
+                            close_terminated_rtasr(&table, fd);
+                            return Ok(());
+                        }
+                        if finished {
+                            table.notify_watchers(fd);
+                            return Ok(());
+                        }
+                        if enqueued {
+                            continue;
+                        }
+                        if last_sent.elapsed() >= KEEPALIVE_INTERVAL {
+                            for (ws_write, backend) in ws_writes.iter_mut() {
+                                for msg in backend.keepalive() {
                                     ws_write
-                                        .send(tokio_tungstenite::tungstenite::Message::Text(txt))
+                                        .send(msg)
                                         .await
                                         .map_err(|e| format!("websocket send failed: {e}"))?;
                                 }
                             }
+                            last_sent = std::time::Instant::now();
+                        }
+                        tokio::time::sleep(std::time::Duration::from_millis(5)).await;
+                        continue;
+                    };
 
-                            if sent_text {
-                                let Some(entry) = table.get(fd) else {
-                                    return Ok::<(), String>(());
+                    let sent_text = matches!(&item, RtAsrSendItem::WsText(_));
+                    for (i, (ws_write, backend)) in ws_writes.iter_mut().enumerate() {
+                        let frames = match &item {
+                            RtAsrSendItem::Audio(chunk) => backend.send_audio(chunk),
+                            RtAsrSendItem::WsText(txt) => backend.send_event(txt),
+                            RtAsrSendItem::SessionUpdate(patch) => {
+                                // Providers without a session.update get none
+                                // 没有 session.update 的服务商不发送
+                                let Some((Some(session), turn_detection)) =
+                                    provider_sessions.get_mut(i)
+                                else {
+                                    continue;
                                 };
-                                let mut e =
-                                    entry.lock().map_err(|_| "fd lock poisoned".to_string())?;
-                                if let FdInner::RtAsr(st) = &mut e.inner {
-                                    st.pending_flush = false;
+                                merge_session(session, patch, *turn_detection);
+                                backend.send_event(&session_update_event_text(session))
+                            }
+                        };
+                        for msg in frames {
+                            if let Err(e) = ws_write.send(msg).await {
+                                // Requeue only what no channel has received yet
+                                // 仅放回尚无通道收到的条目
+                                if i == 0 {
+                                    requeue_rtasr_item(&table, fd, item);
                                 }
+                                return Err(format!("websocket send failed: {e}"));
                             }
                         }
-                        #[allow(unreachable_code)]
-                        Ok(())
                     }
-                    .await;
-                    res
-                })
-            };
-
-            let t_reader = {
-                let table = table.clone();
-                tokio::spawn(async move {
-                    let res: Result<(), String> = async {
-                        loop {
-                            let msg = ws_read
-                                .next()
-                                .await
-                                .ok_or_else(|| "websocket closed".to_string())
-                                .and_then(|r| {
-                                    r.map_err(|e| format!("websocket read failed: {e}"))
-                                })?;
-
-                            let payload: Option<Vec<u8>> = match msg {
-                                tokio_tungstenite::tungstenite::Message::Text(s) => {
-                                    Some(s.into_bytes())
-                                }
-                                tokio_tungstenite::tungstenite::Message::Binary(b) => Some(b),
-                                tokio_tungstenite::tungstenite::Message::Close(_) => {
-                                    set_rtasr_hup(&table, fd);
-                                    return Ok::<(), String>(());
-                                }
-                                _ => None,
-                            };
+                    last_sent = std::time::Instant::now();
+
+                    if sent_text {
+                        let Some(entry) = table.get(fd) else {
+                            return Ok::<(), String>(());
+                        };
+                        let mut e = entry.lock().map_err(|_| "fd lock poisoned".to_string())?;
+                        if let FdInner::RtAsr(st) = &mut e.inner {
+                            st.pending_flush = false;
+                        }
+                    }
+                }
+                #[allow(unreachable_code)]
+                Ok(())
+            }
+            .await;
+            if res.is_ok() {
+                // Close the provider sessions with a close frame / 以关闭帧关闭服务商会话
+                for (ws_write, backend) in ws_writes.iter_mut() {
+                    for msg in backend.close() {
+                        let _ = ws_write.send(msg).await;
+                    }
+                    let _ = ws_write.close().await;
+                }
+            }
+            res
+        })
+    };
+
+    // Language detection follows the first channel / 语种检测以第一个通道为准
+    let t_readers: Vec<_> = ws_reads
+        .into_iter()
+        .enumerate()
+        .map(|(i, (channel, mut ws_read, backend))| {
+            let table = table.clone();
+            let session_key = session_key.to_string();
+            let node = owner.node.clone();
+            tokio::spawn(async move {
+                let res: Result<(), String> = async {
+                    loop {
+                        let msg = ws_read
+                            .next()
+                            .await
+                            .ok_or_else(|| "websocket closed".to_string())
+                            .and_then(|r| r.map_err(|e| format!("websocket read failed: {e}")))?;
 
-                            if let Some(p) = payload {
-                                push_rtasr_event(&table, fd, p);
+                        if let tokio_tungstenite::tungstenite::Message::Close(_) = msg {
+                            return Ok::<(), String>(());
+                        }
+
+                        for p in backend.events(msg) {
+                            if i == 0 {
+                                observe_rtasr_event(
+                                    &node.session_languages,
+                                    &table,
+                                    fd,
+                                    &session_key,
+                                    &p,
+                                );
+                            }
+                            if is_final_event(&p) {
+                                note_rtasr_final(&table, fd);
                             }
+                            let p = match &channel {
+                                Some(c) => tag_event(p, c),
+                                None => p,
+                            };
+                            push_rtasr_event(&table, fd, p);
                         }
-                        #[allow(unreachable_code)]
-                        Ok(())
                     }
-                    .await;
-                    res
-                })
-            };
-
-            let res = tokio::select! {
-                r = t_writer => match r {
-                    Ok(Ok(())) => Ok(()),
-                    Ok(Err(e)) => Err(e),
-                    Err(e) => Err(format!("writer join error: {e}")),
-                },
-                r = t_reader => match r {
-                    Ok(Ok(())) => Ok(()),
-                    Ok(Err(e)) => Err(e),
-                    Err(e) => Err(format!("reader join error: {e}")),
-                },
-            };
-
-            if let Err(e) = res {
-                set_rtasr_error(&table, fd, e);
+                    #[allow(unreachable_code)]
+                    Ok(())
+                }
+                .await;
+                res
+            })
+        })
+        .collect();
+    let reader_aborts: Vec<_> = t_readers.iter().map(|t| t.abort_handle()).collect();
+
+    let end = tokio::select! {
+        r = &mut t_writer => match r {
+            Ok(Ok(())) => SessionEnd::Local,
+            Ok(Err(e)) => SessionEnd::Dropped(e),
+            Err(e) => SessionEnd::Dropped(format!("writer join error: {e}")),
+        },
+        (r, _, _) = futures::future::select_all(t_readers) => match r {
+            Ok(Ok(())) => SessionEnd::PeerClosed,
+            Ok(Err(e)) => SessionEnd::Dropped(e),
+            Err(e) => SessionEnd::Dropped(format!("reader join error: {e}")),
+        },
+    };
+    t_writer.abort();
+    for t in reader_aborts {
+        t.abort();
+    }
+    end
+}
+
+impl DefaultHostApi {
+    pub(super) fn spawn_rtasr_websocket_tasks(
+        &self,
+        fd: i32,
+        mut plans: Vec<ChannelSession<StreamingWebsocketPlan>>,
+        ws_url_override: Option<String>,
+        client_secret_override: Option<String>,
+        session_key: String,
+        reconnect: ReconnectPolicy,
+        owner: SessionOwner,
+    ) {
+        let table = self.fd_table.clone();
+        let global_env = self.runtime_config.global_environment.clone();
+        let locale = self.locale.clone();
+
+        self.spawn_background(async move {
+            // 0 until the first drop, then the number of the current reconnect attempt
+            // 首次断开前为 0，之后为当前重连尝试的序号
+            let mut attempt: u32 = 0;
+            loop {
+                if owner.terminated() {
+                    close_terminated_rtasr(&table, fd);
+                    return;
+                }
+                apply_session_overrides(&table, fd, &mut plans);
+                let connected = connect_rtasr_channels(
+                    &plans,
+                    ws_url_override.as_deref(),
+                    client_secret_override.as_deref(),
+                    &global_env,
+                    &locale,
+                )
+                .await;
+                let ws = match connected {
+                    Ok(ws) => ws,
+                    Err(e) if attempt == 0 => {
+                        set_rtasr_error(&table, fd, e);
+                        return;
+                    }
+                    Err(e) => {
+                        if !rtasr_fd_open(&table, fd) {
+                            return;
+                        }
+                        if attempt >= reconnect.max_attempts {
+                            set_rtasr_error(
+                                &table,
+                                fd,
+                                format!("reconnect failed after {attempt} attempts: {e}"),
+                            );
+                            return;
+                        }
+                        attempt += 1;
+                        set_rtasr_reconnecting(&table, fd, attempt, &reconnect, &e);
+                        tokio::time::sleep(reconnect.delay(attempt)).await;
+                        continue;
+                    }
+                };
+                if attempt > 0 {
+                    set_rtasr_reconnected(&table, fd, attempt);
+                    attempt = 0;
+                }
+
+                let provider_sessions = plans
+                    .iter()
+                    .map(|(_, p)| {
+                        (
+                            session_of(&p.websocket.client_events),
+                            p.websocket.supports_turn_detection,
+                        )
+                    })
+                    .collect();
+                let end =
+                    run_rtasr_session(&table, fd, ws, provider_sessions, &session_key, &owner)
+                        .await;
+                // A drop while finishing ends the session rather than reconnecting
+                // 结束过程中的断开直接结束会话，而不是重连
+                let error = match &end {
+                    SessionEnd::Local => None,
+                    SessionEnd::PeerClosed => Some("websocket closed by peer"),
+                    SessionEnd::Dropped(e) => Some(e.as_str()),
+                };
+                if error.is_some() && end_draining_rtasr(&table, fd, error) {
+                    return;
+                }
+                let reason = match end {
+                    SessionEnd::Local => return,
+                    SessionEnd::PeerClosed if reconnect.max_attempts == 0 => {
+                        set_rtasr_hup(&table, fd);
+                        return;
+                    }
+                    SessionEnd::PeerClosed => "websocket closed by peer".to_string(),
+                    SessionEnd::Dropped(e) => e,
+                };
+                if !rtasr_fd_open(&table, fd) {
+                    return;
+                }
+                if reconnect.max_attempts == 0 {
+                    set_rtasr_error(&table, fd, reason);
+                    return;
+                }
+                attempt = 1;
+                set_rtasr_reconnecting(&table, fd, attempt, &reconnect, &reason);
+                tokio::time::sleep(reconnect.delay(attempt)).await;
             }
         });
     }
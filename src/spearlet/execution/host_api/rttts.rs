@@ -0,0 +1,335 @@
+//! Realtime text-to-speech hostcalls / 实时文本转语音 hostcall
+//!
+//! The speaking counterpart of `rtasr_*`. A guest streams text deltas into an rt-tts fd with
+//! `rttts_write`, typically straight from a streamed chat answer, and reads audio chunks from
+//! the same fd as they are synthesized. Text is cut into segments at sentence and clause
+//! boundaries, so speech starts after the first clause instead of the whole answer. Each
+//! segment is synthesized in order through the streaming TTS of the routed backend.
+//! `rtasr_*` 的发声对应物。guest 通过 `rttts_write` 将文本增量（通常直接来自流式对话应答）写入 rt-tts fd，
+//! 并在合成过程中从同一 fd 读取音频分块。文本在句子与分句边界处切分为片段，因此语音在第一个分句之后即开始，
+//! 而不必等待完整应答。各片段按顺序通过所路由后端的流式 TTS 合成。
+
+use serde_json::{json, Value};
+use std::collections::{HashMap, HashSet};
+
+use super::errno::{EAGAIN, EBADF, EINVAL, EIO, EPIPE};
+use super::tts::{validate_param, MAX_TTS_INPUT_BYTES};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::execution::hostcall::types::{
+    FdEntry, FdFlags, FdInner, FdKind, PollEvents, RtTtsPhase, RtTtsSegment, RtTtsState,
+};
+use crate::spearlet::otel;
+use crate::spearlet::param_keys::{rttts as rttts_keys, tts as tts_keys};
+
+mod segmenter;
+mod worker;
+
+pub const RTTTS_CTL_SET_PARAM: i32 = 1;
+pub const RTTTS_CTL_CONNECT: i32 = 2;
+pub const RTTTS_CTL_GET_STATUS: i32 = 3;
+/// Synthesize the pending text now, even mid-sentence / 立即合成待处理文本，即使句子未完
+pub const RTTTS_CTL_FLUSH: i32 = 4;
+/// Drop pending text and unread audio, e.g. when the user barges in
+/// 丢弃待处理文本与未读音频，例如用户插话时
+pub const RTTTS_CTL_CLEAR: i32 = 5;
+/// No more text; reads end with -EPIPE once the audio is drained
+/// 不再有文本；音频读完后读取以 -EPIPE 结束
+pub const RTTTS_CTL_FINISH: i32 = 6;
+
+fn usize_param(params: &HashMap<String, Value>, key: &str, default: usize) -> usize {
+    params
+        .get(key)
+        .and_then(|v| v.as_u64())
+        .map_or(default, |n| n as usize)
+}
+
+/// Readiness of an rt-tts fd / rt-tts fd 的就绪状态
+pub(super) fn recompute_rttts_readiness(e: &mut FdEntry) {
+    let closed = e.closed;
+    let FdInner::RtTts(st) = &e.inner else {
+        return;
+    };
+    let mut mask = PollEvents::EMPTY;
+    // The end of the audio and an error are readable too / 音频结束与错误同样可读
+    if !st.recv_queue.is_empty() || matches!(st.phase, RtTtsPhase::Done | RtTtsPhase::Error) {
+        mask.insert(PollEvents::IN);
+    }
+    if matches!(st.phase, RtTtsPhase::Init | RtTtsPhase::Streaming)
+        && st.pending.len() < MAX_TTS_INPUT_BYTES
+        && !closed
+    {
+        mask.insert(PollEvents::OUT);
+    }
+    if st.phase == RtTtsPhase::Error {
+        mask.insert(PollEvents::ERR);
+    }
+    if closed || (st.phase == RtTtsPhase::Done && st.recv_queue.is_empty()) {
+        mask.insert(PollEvents::HUP);
+    }
+    e.poll_mask = mask;
+}
+
+/// Hand complete segments of the pending text to the worker
+/// 将待处理文本中的完整片段交给工作线程
+fn dispatch_segments(st: &mut RtTtsState, force: bool) {
+    let Some(tx) = st.segments.clone() else {
+        return;
+    };
+    let min_chars = usize_param(
+        &st.params,
+        rttts_keys::MIN_CHARS,
+        segmenter::DEFAULT_MIN_CHARS,
+    );
+    let max_chars = usize_param(
+        &st.params,
+        rttts_keys::MAX_CHARS,
+        segmenter::DEFAULT_MAX_CHARS,
+    );
+    while let Some(text) = segmenter::next_segment(&mut st.pending, min_chars, max_chars, force) {
+        let seg = RtTtsSegment {
+            generation: st.generation,
+            seq: st.next_seq,
+            text,
+        };
+        if tx.send(seg).is_err() {
+            st.phase = RtTtsPhase::Error;
+            st.last_error = Some("synthesis worker stopped".to_string());
+            return;
+        }
+        st.next_seq += 1;
+        st.in_flight += 1;
+    }
+}
+
+/// Once finishing, the session is done when nothing is left to synthesize
+/// 结束阶段中没有待合成内容时，会话完成
+pub(super) fn maybe_done(st: &mut RtTtsState) {
+    if st.phase == RtTtsPhase::Finishing && st.in_flight == 0 && st.pending.is_empty() {
+        st.phase = RtTtsPhase::Done;
+    }
+}
+
+impl DefaultHostApi {
+    pub fn rttts_create(&self) -> i32 {
+        self.fd_table.alloc(FdEntry {
+            kind: FdKind::RtTts,
+            flags: FdFlags::default(),
+            poll_mask: PollEvents::OUT,
+            watchers: HashSet::new(),
+            closed: false,
+            inner: FdInner::RtTts(Box::default()),
+        })
+    }
+
+    /// Run `f` on the session state and refresh readiness / 在会话状态上执行 `f` 并刷新就绪状态
+    fn with_rttts<T>(
+        &self,
+        fd: i32,
+        f: impl FnOnce(&mut RtTtsState) -> Result<T, i32>,
+    ) -> Result<T, i32> {
+        let entry = self.fd_table.get(fd).ok_or(-EBADF)?;
+        let (out, notify) = {
+            let mut e = entry.lock().map_err(|_| -EIO)?;
+            if e.closed {
+                return Err(-EBADF);
+            }
+            let FdInner::RtTts(st) = &mut e.inner else {
+                return Err(-EBADF);
+            };
+            let out = f(st);
+            let old = e.poll_mask;
+            recompute_rttts_readiness(&mut e);
+            (out, e.poll_mask.bits() != old.bits())
+        };
+        if notify {
+            self.fd_table.notify_watchers(fd);
+        }
+        out
+    }
+
+    pub fn rttts_ctl(
+        &self,
+        fd: i32,
+        cmd: i32,
+        payload: Option<&[u8]>,
+    ) -> Result<Option<Vec<u8>>, i32> {
+        match cmd {
+            RTTTS_CTL_SET_PARAM => {
+                let v: Value =
+                    serde_json::from_slice(payload.ok_or(-EINVAL)?).map_err(|_| -EINVAL)?;
+                let key = v.get("key").and_then(|x| x.as_str()).unwrap_or("");
+                let value = v.get("value").cloned().unwrap_or(Value::Null);
+                let segmentation = matches!(key, rttts_keys::MIN_CHARS | rttts_keys::MAX_CHARS);
+                let valid = match key {
+                    rttts_keys::MIN_CHARS | rttts_keys::MAX_CHARS => {
+                        value.as_u64().is_some_and(|n| (1..=4096).contains(&n))
+                    }
+                    rttts_keys::MAX_RECV_QUEUE_BYTES => value.as_u64().is_some_and(|n| n > 0),
+                    _ => validate_param(key, &value),
+                };
+                if !valid {
+                    return Err(-EINVAL);
+                }
+                self.with_rttts(fd, |st| {
+                    // Synthesis settings are fixed once connected / 连接后合成设置不可更改
+                    if st.phase != RtTtsPhase::Init && !segmentation {
+                        return Err(-EINVAL);
+                    }
+                    if key == rttts_keys::MAX_RECV_QUEUE_BYTES {
+                        st.max_recv_queue_bytes = value.as_u64().unwrap_or_default() as usize;
+                    }
+                    st.params.insert(key.to_string(), value);
+                    if segmentation {
+                        dispatch_segments(st, false);
+                    }
+                    Ok(None)
+                })
+            }
+            RTTTS_CTL_CONNECT => {
+                let explicit = self.with_rttts(fd, |st| {
+                    Ok(st
+                        .params
+                        .get(tts_keys::LANGUAGE)
+                        .and_then(|v| v.as_str())
+                        .map(str::to_string))
+                })?;
+                let language = self.resolve_language(explicit.as_deref());
+                let table = self.fd_table.clone();
+                let engine = self.ai_engine.clone();
+                self.with_rttts(fd, |st| {
+                    if st.phase != RtTtsPhase::Init {
+                        return Ok(None);
+                    }
+                    let (tx, rx) = std::sync::mpsc::channel();
+                    let params = st.params.clone();
+                    let trace = otel::current();
+                    // Adapters block on their own runtime, so this cannot be a tokio task
+                    // 适配器会在自身的运行时上阻塞，因此不能使用 tokio 任务
+                    std::thread::Builder::new()
+                        .name("rttts-worker".to_string())
+                        .spawn(move || {
+                            otel::set_current(trace);
+                            worker::run(table, engine, fd, rx, params, language);
+                        })
+                        .map_err(|_| -EIO)?;
+                    st.segments = Some(tx);
+                    st.phase = RtTtsPhase::Streaming;
+                    dispatch_segments(st, false);
+                    Ok(None)
+                })
+            }
+            RTTTS_CTL_GET_STATUS => self.with_rttts(fd, |st| {
+                let phase = match st.phase {
+                    RtTtsPhase::Init => "Init",
+                    RtTtsPhase::Streaming => "Streaming",
+                    RtTtsPhase::Finishing => "Finishing",
+                    RtTtsPhase::Done => "Done",
+                    RtTtsPhase::Error => "Error",
+                };
+                let body = json!({
+                    "state": phase,
+                    "last_error": st.last_error,
+                    "pending_text_bytes": st.pending.len(),
+                    "segments_in_flight": st.in_flight,
+                    "segments_done": st.segments_done,
+                    "audio_bytes": st.audio_bytes,
+                    "recv_queue_bytes": st.recv_queue_bytes,
+                    "max_recv_queue_bytes": st.max_recv_queue_bytes,
+                    "backend": st.backend,
+                    "format": st.format,
+                });
+                serde_json::to_vec(&body).map(Some).map_err(|_| -EIO)
+            }),
+            RTTTS_CTL_FLUSH => self.with_rttts(fd, |st| {
+                if st.phase == RtTtsPhase::Error {
+                    return Err(-EIO);
+                }
+                dispatch_segments(st, true);
+                Ok(None)
+            }),
+            RTTTS_CTL_CLEAR => self.with_rttts(fd, |st| {
+                st.generation += 1;
+                st.pending.clear();
+                st.in_flight = 0;
+                st.recv_queue.clear();
+                st.recv_queue_bytes = 0;
+                maybe_done(st);
+                Ok(None)
+            }),
+            RTTTS_CTL_FINISH => self.with_rttts(fd, |st| {
+                match st.phase {
+                    RtTtsPhase::Init => return Err(-EINVAL),
+                    RtTtsPhase::Error => return Err(-EIO),
+                    RtTtsPhase::Streaming => {
+                        dispatch_segments(st, true);
+                        if st.phase == RtTtsPhase::Streaming {
+                            st.phase = RtTtsPhase::Finishing;
+                        }
+                    }
+                    RtTtsPhase::Finishing | RtTtsPhase::Done => {}
+                }
+                maybe_done(st);
+                Ok(None)
+            }),
+            _ => Err(-EINVAL),
+        }
+    }
+
+    /// Append a text delta; returns the bytes accepted / 追加文本增量；返回接受的字节数
+    pub fn rttts_write(&self, fd: i32, bytes: &[u8]) -> i32 {
+        let Ok(text) = std::str::from_utf8(bytes) else {
+            return -EINVAL;
+        };
+        let rc = self.with_rttts(fd, |st| {
+            match st.phase {
+                RtTtsPhase::Init | RtTtsPhase::Streaming => {}
+                RtTtsPhase::Error => return Err(-EIO),
+                RtTtsPhase::Finishing | RtTtsPhase::Done => return Err(-EPIPE),
+            }
+            if st.pending.len() + text.len() > MAX_TTS_INPUT_BYTES {
+                return Err(-EAGAIN);
+            }
+            st.pending.push_str(text);
+            dispatch_segments(st, false);
+            Ok(text.len() as i32)
+        });
+        rc.unwrap_or_else(|e| e)
+    }
+
+    /// Up to `max` bytes of audio; -EAGAIN while more may come, -EPIPE once finished and
+    /// drained, -EIO after a failed segment
+    /// 最多 `max` 字节音频；仍可能有后续时返回 -EAGAIN，结束且读完后返回 -EPIPE，片段合成失败后返回 -EIO
+    pub fn rttts_read(&self, fd: i32, max: usize) -> Result<Vec<u8>, i32> {
+        if max == 0 {
+            return Err(-EINVAL);
+        }
+        self.with_rttts(fd, |st| {
+            let Some(mut chunk) = st.recv_queue.pop_front() else {
+                return Err(match st.phase {
+                    RtTtsPhase::Done => -EPIPE,
+                    RtTtsPhase::Error => -EIO,
+                    _ => -EAGAIN,
+                });
+            };
+            if chunk.len() > max {
+                let rest = chunk.split_off(max);
+                st.recv_queue.push_front(rest);
+            }
+            st.recv_queue_bytes = st.recv_queue_bytes.saturating_sub(chunk.len());
+            Ok(chunk)
+        })
+    }
+
+    pub fn rttts_close(&self, fd: i32) -> i32 {
+        if let Some(entry) = self.fd_table.get(fd) {
+            if let Ok(mut e) = entry.lock() {
+                if let FdInner::RtTts(st) = &mut e.inner {
+                    // Stops the worker after its current segment / 工作线程在当前片段后停止
+                    st.segments = None;
+                    st.generation += 1;
+                }
+            }
+        }
+        self.fd_table.close(fd)
+    }
+}
@@ -0,0 +1,111 @@
+//! Cutting streamed text into segments / 将流式文本切分为片段
+//!
+//! A segment ends at the end of a sentence, at a clause mark once it is `min_chars` long, or
+//! at the last space before `max_chars`. Latin `.`, `!`, `?`, `,`, `;` and `:` only count
+//! when followed by whitespace, so `3.14` is not cut while more text may still follow.
+//! 片段在句末结束；长度达到 `min_chars` 后也可在分句符号处结束；或在 `max_chars` 之前的最后一个空白处
+//! 结束。拉丁符号 `.`、`!`、`?`、`,`、`;` 与 `:` 仅在其后为空白时才计入，因此在后续文本到达前不会切开 `3.14`。
+
+/// Length a segment needs before a clause mark may end it / 片段可在分句符号处结束所需的长度
+pub const DEFAULT_MIN_CHARS: usize = 24;
+
+/// Length at which a segment is cut even without punctuation / 即使没有标点也会切分片段的长度
+pub const DEFAULT_MAX_CHARS: usize = 200;
+
+fn is_sentence_end(c: char, next: Option<char>) -> bool {
+    match c {
+        '。' | '！' | '？' | '\n' => true,
+        '.' | '!' | '?' => next.is_some_and(char::is_whitespace),
+        _ => false,
+    }
+}
+
+fn is_clause_end(c: char, next: Option<char>) -> bool {
+    match c {
+        '，' | '；' | '：' | '、' => true,
+        ',' | ';' | ':' => next.is_some_and(char::is_whitespace),
+        _ => false,
+    }
+}
+
+/// Byte offset where the first segment of `text` ends, if one is complete
+/// `text` 中第一个片段结束处的字节偏移（若已完整）
+fn segment_end(text: &str, min_chars: usize, max_chars: usize) -> Option<usize> {
+    let mut count = 0;
+    let mut last_space = None;
+    let mut chars = text.char_indices().peekable();
+    while let Some((i, c)) = chars.next() {
+        count += 1;
+        let next = chars.peek().map(|(_, n)| *n);
+        let end = i + c.len_utf8();
+        if is_sentence_end(c, next) || (count >= min_chars && is_clause_end(c, next)) {
+            return Some(end);
+        }
+        if c.is_whitespace() {
+            last_space = Some(end);
+        }
+        if count >= max_chars {
+            return Some(last_space.unwrap_or(end));
+        }
+    }
+    None
+}
+
+/// Take the next segment off `pending`; with `force` the rest is taken even if incomplete
+/// 从 `pending` 中取出下一个片段；设置 `force` 时即使不完整也取出剩余文本
+pub fn next_segment(
+    pending: &mut String,
+    min_chars: usize,
+    max_chars: usize,
+    force: bool,
+) -> Option<String> {
+    loop {
+        let seg = match segment_end(pending, min_chars, max_chars) {
+            Some(end) => {
+                let rest = pending.split_off(end);
+                std::mem::replace(pending, rest)
+            }
+            None if force && !pending.is_empty() => std::mem::take(pending),
+            None => return None,
+        };
+        let seg = seg.trim();
+        if !seg.is_empty() {
+            return Some(seg.to_string());
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn drain(pending: &mut String, force: bool) -> Vec<String> {
+        std::iter::from_fn(|| next_segment(pending, 10, 30, force)).collect()
+    }
+
+    #[test]
+    fn test_next_segment() {
+        let mut p = "Hello there. Pi is 3.14".to_string();
+        assert_eq!(drain(&mut p, false), vec!["Hello there."]);
+        assert_eq!(p, " Pi is 3.14");
+
+        p.push_str(", roughly; and more");
+        assert_eq!(drain(&mut p, false), vec!["Pi is 3.14,"]);
+        assert_eq!(drain(&mut p, true), vec!["roughly; and more"]);
+        assert!(p.is_empty());
+
+        let mut p = "你好。今天天气很好，我们出去走走".to_string();
+        assert_eq!(drain(&mut p, false), vec!["你好。"]);
+        assert_eq!(p, "今天天气很好，我们出去走走");
+
+        let mut p = "a very long run of words without any punctuation at all".to_string();
+        assert_eq!(
+            drain(&mut p, false),
+            vec!["a very long run of words", "without any punctuation at"]
+        );
+        assert_eq!(p, "all");
+
+        let mut p = "\n\n  ".to_string();
+        assert!(drain(&mut p, true).is_empty());
+    }
+}
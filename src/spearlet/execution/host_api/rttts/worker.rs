@@ -0,0 +1,136 @@
+use std::collections::HashMap;
+use std::sync::mpsc::Receiver;
+use std::sync::Arc;
+
+use serde_json::Value;
+
+use super::{maybe_done, recompute_rttts_readiness};
+use crate::spearlet::execution::ai::ir::ResultPayload;
+use crate::spearlet::execution::ai::normalize::tts::normalize_tts_session;
+use crate::spearlet::execution::ai::AiEngine;
+use crate::spearlet::execution::host_api::language::META_LANGUAGE;
+use crate::spearlet::execution::hostcall::fd_table::FdTable;
+use crate::spearlet::execution::hostcall::types::{FdInner, RtTtsPhase, RtTtsSegment};
+
+/// Whether audio of `generation` is still wanted / `generation` 的音频是否仍然需要
+fn wanted(table: &FdTable, fd: i32, generation: u64) -> bool {
+    let Some(entry) = table.get(fd) else {
+        return false;
+    };
+    let Ok(e) = entry.lock() else {
+        return false;
+    };
+    matches!(&e.inner, FdInner::RtTts(st) if !e.closed && st.generation == generation)
+}
+
+/// Queue a chunk, waiting while the guest has not read enough of the earlier ones
+/// 将分块排入队列；guest 尚未读取足够的先前分块时等待
+fn push_chunk(table: &FdTable, fd: i32, generation: u64, chunk: Vec<u8>) {
+    loop {
+        let Some(entry) = table.get(fd) else {
+            return;
+        };
+        {
+            let Ok(mut e) = entry.lock() else {
+                return;
+            };
+            if e.closed {
+                return;
+            }
+            let FdInner::RtTts(st) = &mut e.inner else {
+                return;
+            };
+            if st.generation != generation {
+                return;
+            }
+            if st.recv_queue_bytes < st.max_recv_queue_bytes || st.recv_queue.is_empty() {
+                st.audio_bytes += chunk.len() as u64;
+                st.recv_queue_bytes += chunk.len();
+                st.recv_queue.push_back(chunk);
+                recompute_rttts_readiness(&mut e);
+                break;
+            }
+        }
+        std::thread::sleep(std::time::Duration::from_millis(10));
+    }
+    table.notify_watchers(fd);
+}
+
+fn finish_segment(
+    table: &FdTable,
+    fd: i32,
+    generation: u64,
+    result: Result<(String, String), String>,
+) {
+    let Some(entry) = table.get(fd) else {
+        return;
+    };
+    {
+        let Ok(mut e) = entry.lock() else {
+            return;
+        };
+        let FdInner::RtTts(st) = &mut e.inner else {
+            return;
+        };
+        if st.generation != generation {
+            return;
+        }
+        st.in_flight = st.in_flight.saturating_sub(1);
+        match result {
+            Ok((backend, format)) => {
+                st.segments_done += 1;
+                st.backend = backend;
+                if !format.is_empty() {
+                    st.format = format;
+                }
+            }
+            Err(msg) => {
+                st.phase = RtTtsPhase::Error;
+                st.last_error = Some(msg);
+            }
+        }
+        maybe_done(st);
+        recompute_rttts_readiness(&mut e);
+    }
+    table.notify_watchers(fd);
+}
+
+/// Synthesize segments in order until the session is closed
+/// 按顺序合成片段，直到会话关闭
+pub(super) fn run(
+    table: Arc<FdTable>,
+    engine: Arc<AiEngine>,
+    fd: i32,
+    segments: Receiver<RtTtsSegment>,
+    params: HashMap<String, Value>,
+    language: Option<String>,
+) {
+    while let Ok(seg) = segments.recv() {
+        if !wanted(&table, fd, seg.generation) {
+            continue;
+        }
+        let mut req = normalize_tts_session(fd, &seg.text, &params);
+        req.request_id = format!("rttts_{}_{}", fd, seg.seq);
+        req.meta.insert("source".to_string(), "rttts".to_string());
+        if let Some(lang) = &language {
+            req.meta.insert(META_LANGUAGE.to_string(), lang.clone());
+        }
+        let result = engine.invoke_audio_stream(&req, &mut |chunk| {
+            push_chunk(&table, fd, seg.generation, chunk);
+        });
+        let result = match result {
+            Ok(resp) => match resp.result {
+                ResultPayload::Payload(v) => {
+                    let format = v.get("format").and_then(|f| f.as_str()).unwrap_or("");
+                    Ok((resp.backend, format.to_string()))
+                }
+                ResultPayload::Error(e) => Err(format!("{}: {}", e.code, e.message)),
+            },
+            Err(e) => Err(e.to_string()),
+        };
+        if let Err(msg) = &result {
+            tracing::warn!(fd, seq = seg.seq, error = %msg, "rttts segment failed");
+        }
+        finish_segment(&table, fd, seg.generation, result);
+    }
+}
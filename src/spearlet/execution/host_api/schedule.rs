@@ -0,0 +1,63 @@
+//! Scheduled invocation hostcalls / 计划调用 hostcall
+//!
+//! Schedules are owned by the calling task, which is also the task a request without `task`
+//! invokes. `schedule_create` returns the new schedule's id and `schedule_list` the task's
+//! schedules as JSON.
+//! 计划归调用任务所有；未指定 `task` 的请求也调用该任务。`schedule_create` 返回新计划的 ID，
+//! `schedule_list` 以 JSON 返回任务的计划。
+
+use super::errno::{SPEAR_EAGAIN, SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOENT, SPEAR_ENOSYS};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::schedules::{ScheduleError, ScheduleRequest};
+
+fn errno(e: &ScheduleError) -> i32 {
+    -match e {
+        ScheduleError::Disabled => SPEAR_ENOSYS,
+        ScheduleError::Invalid(_) => SPEAR_EINVAL,
+        ScheduleError::NotFound(_) => SPEAR_ENOENT,
+        ScheduleError::TooMany(_) => SPEAR_EAGAIN,
+        ScheduleError::Io(_) => SPEAR_EIO,
+    }
+}
+
+impl DefaultHostApi {
+    fn schedule_owner(&self) -> &str {
+        self.task_id.as_deref().unwrap_or("")
+    }
+
+    fn schedule_failed(&self, op: &str, e: ScheduleError) -> i32 {
+        tracing::warn!(task_id = %self.schedule_owner(), op, error = %e, "schedule call failed");
+        errno(&e)
+    }
+
+    /// Schedule an invocation from a JSON request; returns the schedule id
+    /// 以 JSON 请求计划一次调用；返回计划 ID
+    pub fn schedule_create(&self, req: &[u8]) -> Result<Vec<u8>, i32> {
+        let req: ScheduleRequest = serde_json::from_slice(req).map_err(|_| -SPEAR_EINVAL)?;
+        let now_ms = chrono::Utc::now().timestamp_millis();
+        let id = self
+            .node()
+            .schedules
+            .create(self.schedule_owner(), req, now_ms)
+            .map_err(|e| self.schedule_failed("schedule_create", e))?;
+        Ok(id.into_bytes())
+    }
+
+    pub fn schedule_cancel(&self, id: &[u8]) -> Result<(), i32> {
+        let id = std::str::from_utf8(id).map_err(|_| -SPEAR_EINVAL)?;
+        self.node()
+            .schedules
+            .cancel(self.schedule_owner(), id)
+            .map_err(|e| self.schedule_failed("schedule_cancel", e))
+    }
+
+    /// The task's schedules as a JSON array / 以 JSON 数组返回任务的计划
+    pub fn schedule_list(&self) -> Result<Vec<u8>, i32> {
+        let list = self
+            .node()
+            .schedules
+            .list(self.schedule_owner())
+            .map_err(|e| self.schedule_failed("schedule_list", e))?;
+        serde_json::to_vec(&list).map_err(|_| -SPEAR_EIO)
+    }
+}
@@ -4,6 +4,13 @@ const SSF_MAGIC: [u8; 4] = *b"SPST";
 const SSF_VERSION_V1: u16 = 1;
 const SSF_HEADER_MIN: usize = 32;
 
+/// `flags` bit asking the spearlet to report the client's acknowledgement
+/// `flags` 中请求 spearlet 回报客户端确认的位
+pub(crate) const SSF_FLAG_ACK_REQUESTED: u16 = 0x0001;
+/// Frame the spearlet queues to the guest once the client acknowledged a frame
+/// 客户端确认某帧后 spearlet 投递给 guest 的帧
+pub(crate) const SSF_MSG_TYPE_ACK: u16 = 5;
+
 pub(crate) fn parse_ssf_v1_header(frame: &[u8]) -> Result<(u32, u16), i32> {
     if frame.len() < SSF_HEADER_MIN {
         return Err(-EINVAL);
@@ -30,6 +37,15 @@ pub(crate) fn parse_ssf_v1_header(frame: &[u8]) -> Result<(u32, u16), i32> {
     Ok((stream_id, msg_type))
 }
 
+/// Split a frame into `(stream_id, msg_type, meta, data)` / 将帧拆分为 `(stream_id, msg_type, meta, data)`
+pub(crate) fn split_ssf_v1_frame(frame: &[u8]) -> Result<(u32, u16, &[u8], &[u8]), i32> {
+    let (stream_id, msg_type) = parse_ssf_v1_header(frame)?;
+    let header_len = u16::from_le_bytes([frame[6], frame[7]]) as usize;
+    let meta_len = u32::from_le_bytes([frame[24], frame[25], frame[26], frame[27]]) as usize;
+    let body = &frame[header_len..];
+    Ok((stream_id, msg_type, &body[..meta_len], &body[meta_len..]))
+}
+
 pub(crate) fn build_ssf_v1_frame(
     stream_id: u32,
     msg_type: u16,
@@ -51,3 +67,15 @@ pub(crate) fn build_ssf_v1_frame(
     out.extend_from_slice(data);
     out
 }
+
+/// `(stream_id, seq)` of a frame that asks for an acknowledgement
+/// 请求确认的帧的 `(stream_id, seq)`
+pub(crate) fn ssf_v1_ack_request(frame: &[u8]) -> Option<(u32, u64)> {
+    let (stream_id, _) = parse_ssf_v1_header(frame).ok()?;
+    let flags = u16::from_le_bytes([frame[10], frame[11]]);
+    if flags & SSF_FLAG_ACK_REQUESTED == 0 {
+        return None;
+    }
+    let seq = u64::from_le_bytes(frame[16..24].try_into().ok()?);
+    Some((stream_id, seq))
+}
@@ -0,0 +1,164 @@
+//! Structured output hostcall / 结构化输出 hostcall
+//!
+//! `chat_structured` runs a chat whose answer must be a JSON value matching a JSON Schema.
+//! Backends declaring `supports_json_schema` get the schema as `response_format`; others are
+//! told it in a system message. Either way the answer is parsed leniently, coerced and
+//! validated on the host, and a mismatch is sent back to the model for correction up to
+//! `max_repairs` times.
+//! `chat_structured` 执行一次应答必须为符合 JSON Schema 的 JSON 值的对话。声明了
+//! `supports_json_schema` 的后端通过 `response_format` 获得 schema；其他后端则在系统消息中得知。
+//! 无论哪种方式，应答都会在宿主侧被宽松解析、纠正与校验，不符合时最多 `max_repairs` 次交回模型更正。
+
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+
+use super::deadline;
+use super::errno::{SPEAR_EDQUOT, SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOSYS, SPEAR_ETIMEDOUT};
+use super::moderation::response_text;
+use crate::spearlet::execution::ai::ir::{ChatMessage, ResultPayload};
+use crate::spearlet::execution::ai::json_schema;
+use crate::spearlet::execution::ai::normalize::structured::{
+    normalize_structured_chat, valid_schema_name, SchemaEnforcement, StructuredChatRequest,
+};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::execution::ExecutionError;
+
+/// Largest schema a request may carry, in bytes of JSON / 单个请求可携带的最大 schema（JSON 字节数）
+pub const MAX_SCHEMA_BYTES: usize = 64 * 1024;
+
+/// Repairs used when the request sets none / 请求未设置时使用的修复次数
+pub const DEFAULT_MAX_REPAIRS: u32 = 1;
+
+/// Upper bound of `max_repairs` / `max_repairs` 的上限
+pub const MAX_REPAIRS_LIMIT: u32 = 3;
+
+fn errno(e: &ExecutionError) -> i32 {
+    if deadline::expired() {
+        return -SPEAR_ETIMEDOUT;
+    }
+    -match e {
+        ExecutionError::InvalidRequest { .. } => SPEAR_EINVAL,
+        ExecutionError::NotSupported { .. } => SPEAR_ENOSYS,
+        ExecutionError::ResourceExhausted { .. } => SPEAR_EDQUOT,
+        _ => SPEAR_EIO,
+    }
+}
+
+fn message(role: &str, content: String) -> ChatMessage {
+    ChatMessage {
+        role: role.to_string(),
+        content: Value::String(content),
+        tool_call_id: None,
+        tool_calls: None,
+        name: None,
+    }
+}
+
+fn repair_prompt(errors: &[String]) -> String {
+    format!(
+        "That answer does not match the JSON Schema:\n- {}\nAnswer again with only the corrected JSON.",
+        errors.join("\n- ")
+    )
+}
+
+impl DefaultHostApi {
+    /// Run a `chat_structured` request / 执行 `chat_structured` 请求
+    ///
+    /// Errors of the chat itself, a blocked prompt or an answer that still does not match
+    /// after the repairs come back as an error body rather than an errno.
+    /// 对话本身的错误、被拦截的提示或修复后仍不符合的应答以错误体而非 errno 返回。
+    pub fn chat_structured(&self, request: &[u8]) -> Result<Vec<u8>, i32> {
+        let digest: [u8; 32] = Sha256::digest(request).into();
+        if let Some((d, out)) = self.structured_last.0.lock().take() {
+            if d == digest {
+                return Ok(out);
+            }
+        }
+        let req: StructuredChatRequest =
+            serde_json::from_slice(request).map_err(|_| -SPEAR_EINVAL)?;
+        let schema_bytes = serde_json::to_vec(&req.schema).map_or(usize::MAX, |b| b.len());
+        if req.messages.is_empty()
+            || !(req.schema.is_object() || req.schema.is_boolean())
+            || schema_bytes > MAX_SCHEMA_BYTES
+            || req.name.as_deref().is_some_and(|n| !valid_schema_name(n))
+            || req.max_repairs.is_some_and(|n| n > MAX_REPAIRS_LIMIT)
+        {
+            return Err(-SPEAR_EINVAL);
+        }
+        let max_repairs = req.max_repairs.unwrap_or(DEFAULT_MAX_REPAIRS);
+
+        let out = self.run_structured(&req, max_repairs)?;
+        let out = serde_json::to_vec(&out).map_err(|_| -SPEAR_EIO)?;
+        *self.structured_last.0.lock() = Some((digest, out.clone()));
+        Ok(out)
+    }
+
+    /// The guest received the result; drop the copy kept for a retry
+    /// guest 已收到结果；丢弃为重试保留的副本
+    pub fn structured_delivered(&self) {
+        self.structured_last.0.lock().take();
+    }
+
+    fn run_structured(&self, req: &StructuredChatRequest, max_repairs: u32) -> Result<Value, i32> {
+        if let Err(body) = self.screen_prompt(&req.messages) {
+            return Ok(body);
+        }
+        let mut how = SchemaEnforcement::ResponseFormat;
+        let mut messages = req.messages.clone();
+        let mut attempts = 0u32;
+        loop {
+            let env = normalize_structured_chat(req, &messages, how, "chat_structured");
+            let resp = match self.ai_engine.invoke(&env) {
+                Ok(r) => r,
+                Err(ExecutionError::NotSupported { .. })
+                    if how == SchemaEnforcement::ResponseFormat =>
+                {
+                    // No backend takes `response_format`; fall back to the prompt.
+                    // 没有后端接受 `response_format`；退回到提示方式。
+                    how = SchemaEnforcement::Prompt;
+                    continue;
+                }
+                Err(e) => {
+                    tracing::warn!(attempts, error = %e, "chat_structured failed");
+                    return Err(errno(&e));
+                }
+            };
+            attempts += 1;
+            let v = match resp.result {
+                ResultPayload::Payload(v) => v,
+                ResultPayload::Error(e) => {
+                    return Ok(json!({"error": {"code": e.code, "message": e.message}}));
+                }
+            };
+            if let Err(body) = self.screen_response(&v) {
+                return Ok(body);
+            }
+            let text = response_text(&v);
+            let (parsed, repaired) = json_schema::parse_lenient(&text)
+                .unwrap_or_else(|| (Value::String(text.trim().to_string()), true));
+            let value = json_schema::coerce(&req.schema, parsed.clone());
+            let errors = json_schema::validate(&req.schema, &value);
+            if errors.is_empty() {
+                return Ok(json!({
+                    "backend": resp.backend,
+                    "model": v.get("model").cloned().unwrap_or(Value::Null),
+                    "enforced": how.as_str(),
+                    "value": value,
+                    "repaired": repaired || value != parsed || attempts > 1,
+                    "attempts": attempts,
+                }));
+            }
+            if attempts > max_repairs {
+                tracing::info!(attempts, backend = %resp.backend, "chat_structured schema mismatch");
+                return Ok(json!({"error": {
+                    "code": "schema_mismatch",
+                    "message": format!("answer does not match the schema after {} attempts", attempts),
+                    "errors": errors,
+                    "text": text,
+                }}));
+            }
+            messages.push(message("assistant", text));
+            messages.push(message("user", repair_prompt(&errors)));
+        }
+    }
+}
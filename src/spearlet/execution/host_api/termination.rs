@@ -1,7 +1,7 @@
 use dashmap::DashMap;
 use parking_lot::Mutex;
 use std::sync::atomic::{AtomicBool, Ordering};
-use std::sync::{Arc, OnceLock};
+use std::sync::Arc;
 
 #[derive(Clone, Copy, Debug, PartialEq, Eq)]
 pub enum TerminationScope {
@@ -74,31 +74,40 @@ impl WasmTerminationRegistry {
     }
 }
 
-static EXEC_REGISTRY: OnceLock<Arc<WasmTerminationRegistry>> = OnceLock::new();
-static INSTANCE_REGISTRY: OnceLock<Arc<WasmTerminationRegistry>> = OnceLock::new();
-
-pub fn exec_registry() -> Arc<WasmTerminationRegistry> {
-    EXEC_REGISTRY
-        .get_or_init(|| Arc::new(WasmTerminationRegistry::new(TerminationScope::Execution)))
-        .clone()
+/// Termination marks of one spearlet's executions and instances
+/// 单个 spearlet 的执行与实例终止标记
+#[derive(Debug)]
+pub struct Terminations {
+    pub executions: Arc<WasmTerminationRegistry>,
+    pub instances: Arc<WasmTerminationRegistry>,
 }
 
-pub fn instance_registry() -> Arc<WasmTerminationRegistry> {
-    INSTANCE_REGISTRY
-        .get_or_init(|| Arc::new(WasmTerminationRegistry::new(TerminationScope::Instance)))
-        .clone()
+impl Default for Terminations {
+    fn default() -> Self {
+        Self {
+            executions: Arc::new(WasmTerminationRegistry::new(TerminationScope::Execution)),
+            instances: Arc::new(WasmTerminationRegistry::new(TerminationScope::Instance)),
+        }
+    }
 }
 
-pub fn mark_execution_terminated(execution_id: &str, errno: i32, reason: Option<String>) {
-    exec_registry().mark(execution_id, errno, reason);
-}
+impl Terminations {
+    pub fn mark_execution_terminated(
+        &self,
+        execution_id: &str,
+        errno: i32,
+        reason: Option<String>,
+    ) {
+        self.executions.mark(execution_id, errno, reason);
+    }
 
-pub fn clear_execution_termination(execution_id: &str) {
-    exec_registry().clear(execution_id);
-}
+    pub fn clear_execution_termination(&self, execution_id: &str) {
+        self.executions.clear(execution_id);
+    }
 
-pub fn mark_instance_destroyed(instance_id: &str, errno: i32, reason: Option<String>) {
-    instance_registry().mark(instance_id, errno, reason);
+    pub fn mark_instance_destroyed(&self, instance_id: &str, errno: i32, reason: Option<String>) {
+        self.instances.mark(instance_id, errno, reason);
+    }
 }
 
 #[cfg(test)]
@@ -115,14 +124,14 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
         }
     }
 
     #[test]
     fn test_exec_registry_mark_check_clear() {
         let exec_id = "exec-test-1";
-        let reg = exec_registry();
-        reg.clear(exec_id);
+        let reg = Terminations::default().executions;
 
         assert!(reg.check(exec_id).is_none());
 
@@ -139,8 +148,7 @@ mod tests {
     #[test]
     fn test_instance_registry_mark_check_clear() {
         let instance_id = "inst-test-1";
-        let reg = instance_registry();
-        reg.clear(instance_id);
+        let reg = Terminations::default().instances;
 
         assert!(reg.check(instance_id).is_none());
 
@@ -158,21 +166,16 @@ mod tests {
     fn test_default_host_api_prefers_execution_over_instance() {
         let exec_id = "exec-test-2";
         let instance_id = "inst-test-2";
-        exec_registry().clear(exec_id);
-        instance_registry().clear(instance_id);
-
-        mark_execution_terminated(exec_id, -libc::ECANCELED, Some("e".to_string()));
-        mark_instance_destroyed(instance_id, -libc::ECANCELED, Some("i".to_string()));
+        let config = test_runtime_config();
+        let terminations = &config.node.terminations;
+        terminations.mark_execution_terminated(exec_id, -libc::ECANCELED, Some("e".to_string()));
+        terminations.mark_instance_destroyed(instance_id, -libc::ECANCELED, Some("i".to_string()));
 
-        let mut api =
-            DefaultHostApi::new(test_runtime_config()).with_instance_id(instance_id.to_string());
+        let mut api = DefaultHostApi::new(config.clone()).with_instance_id(instance_id.to_string());
         api.set_execution_id(Some(exec_id.to_string()));
 
         let s = api.check_wasm_termination().unwrap();
         assert_eq!(s.scope, TerminationScope::Execution);
         assert_eq!(s.message.as_deref(), Some("e"));
-
-        exec_registry().clear(exec_id);
-        instance_registry().clear(instance_id);
     }
 }
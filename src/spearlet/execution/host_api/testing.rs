@@ -0,0 +1,77 @@
+//! Test-harness hostcalls for workload self-tests
+//! 面向工作负载自测的测试 hostcall
+//!
+//! Only active when `spearlet.test_hostcalls` is enabled; otherwise every call
+//! returns `-ENOSYS` so production nodes expose no extra surface.
+//! 仅在启用 `spearlet.test_hostcalls` 时生效；否则所有调用返回 `-ENOSYS`，
+//! 生产节点不会暴露额外接口。
+
+use crate::spearlet::execution::host_api::errno::{SPEAR_EINVAL, SPEAR_ENOSYS};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::execution::host_api::SpearHostApi;
+
+/// Upper bound for the induced latency / 注入延迟上限（毫秒）
+pub(crate) const TEST_LATENCY_MAX_MS: i32 = 60_000;
+
+/// Largest errno a workload may induce / 工作负载可注入的最大 errno
+const TEST_ERRNO_MAX: i32 = 4095;
+
+impl DefaultHostApi {
+    pub fn test_hostcalls_enabled(&self) -> bool {
+        self.runtime_config
+            .spearlet_config
+            .as_ref()
+            .is_some_and(|c| c.test_hostcalls)
+    }
+
+    /// Echo the input back / 原样返回输入
+    pub fn test_echo(&self, input: &[u8]) -> Result<Vec<u8>, i32> {
+        if !self.test_hostcalls_enabled() {
+            return Err(-SPEAR_ENOSYS);
+        }
+        Ok(input.to_vec())
+    }
+
+    /// Return the requested errno as a hostcall error / 以 hostcall 错误返回指定 errno
+    pub fn test_fail(&self, errno: i32) -> i32 {
+        if !self.test_hostcalls_enabled() {
+            return -SPEAR_ENOSYS;
+        }
+        if !(1..=TEST_ERRNO_MAX).contains(&errno) {
+            return -SPEAR_EINVAL;
+        }
+        -errno
+    }
+
+    /// Block for `ms` and report the observed latency / 阻塞 `ms` 毫秒并返回实际耗时
+    pub fn test_latency(&self, ms: i32) -> i64 {
+        if !self.test_hostcalls_enabled() {
+            return -(SPEAR_ENOSYS as i64);
+        }
+        if !(0..=TEST_LATENCY_MAX_MS).contains(&ms) {
+            return -(SPEAR_EINVAL as i64);
+        }
+        let start = std::time::Instant::now();
+        std::thread::sleep(std::time::Duration::from_millis(ms as u64));
+        start.elapsed().as_millis() as i64
+    }
+
+    /// Snapshot of host state visible to the workload / 工作负载可见的宿主状态快照
+    pub fn test_state(&self) -> Result<Vec<u8>, i32> {
+        if !self.test_hostcalls_enabled() {
+            return Err(-SPEAR_ENOSYS);
+        }
+        let execution_id = self
+            .execution_id
+            .clone()
+            .or_else(super::core::current_wasm_execution_id);
+        let v = serde_json::json!({
+            "task_id": self.task_id,
+            "instance_id": self.instance_id,
+            "execution_id": execution_id,
+            "open_fds": self.fd_table.open_count(),
+            "time_now_ms": self.time_now_ms(),
+        });
+        Ok(v.to_string().into_bytes())
+    }
+}
@@ -4,9 +4,10 @@ use crate::spearlet::execution::ai::ir::{
     RoutingHints, SpeechToTextPayload,
 };
 use crate::spearlet::execution::ai::streaming::StreamingPlan;
-use crate::spearlet::execution::hostcall::fd_table::EP_CTL_ADD;
+use crate::spearlet::execution::hostcall::fd_table::{EP_CTL_ADD, FD_CTL_GET_METRICS};
 use crate::spearlet::execution::hostcall::types::{FdInner, PollEvents};
 use crate::spearlet::execution::runtime::{ResourcePoolConfig, RuntimeConfig, RuntimeType};
+use crate::spearlet::node_services::NodeServices;
 use std::collections::HashMap;
 
 fn chat_req() -> CanonicalRequestEnvelope {
@@ -71,6 +72,8 @@ fn test_cchat_send_pipeline_stub_backend() {
                 "supports_stream".to_string(),
             ],
             transports: vec!["in_process".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let api = DefaultHostApi::new(RuntimeConfig {
@@ -79,6 +82,7 @@ fn test_cchat_send_pipeline_stub_backend() {
         global_environment: HashMap::new(),
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let fd = api.cchat_create();
@@ -94,6 +98,798 @@ fn test_cchat_send_pipeline_stub_backend() {
     assert!(content.contains("sum 7 35"));
 }
 
+#[test]
+fn test_chat_structured_repairs_and_falls_back_to_prompt() {
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "stub".to_string(),
+            kind: "stub".to_string(),
+            base_url: String::new(),
+            hosting: Some("local".to_string()),
+            model: None,
+            credential_ref: None,
+            weight: 100,
+            priority: 0,
+            ops: vec!["chat_completions".to_string()],
+            features: vec!["supports_stream".to_string()],
+            transports: vec!["in_process".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let schema = serde_json::json!({
+        "type": "object",
+        "properties": {"answer": {"type": "integer"}},
+        "required": ["answer"]
+    });
+    let req = serde_json::json!({
+        "messages": [{"role": "user", "content": "{\"answer\": \"42\"}"}],
+        "schema": schema,
+    });
+    let out = api
+        .chat_structured(&serde_json::to_vec(&req).unwrap())
+        .unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&out).unwrap();
+    assert_eq!(v["value"], serde_json::json!({"answer": 42}));
+    assert_eq!(v["enforced"], "prompt");
+    assert_eq!(v["repaired"], true);
+    assert_eq!(v["attempts"], 1);
+
+    let req = serde_json::json!({
+        "messages": [{"role": "user", "content": "no json here"}],
+        "schema": schema,
+    });
+    let out = api
+        .chat_structured(&serde_json::to_vec(&req).unwrap())
+        .unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&out).unwrap();
+    assert_eq!(v["error"]["code"], "schema_mismatch");
+    assert!(!v["error"]["errors"].as_array().unwrap().is_empty());
+
+    let bad = serde_json::json!({"messages": [], "schema": schema});
+    assert_eq!(
+        api.chat_structured(&serde_json::to_vec(&bad).unwrap()),
+        Err(-crate::spearlet::execution::host_api::errno::SPEAR_EINVAL)
+    );
+}
+
+#[test]
+fn test_cchat_send_stream_delivers_deltas_then_response() {
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "stub".to_string(),
+            kind: "stub".to_string(),
+            base_url: String::new(),
+            hosting: Some("local".to_string()),
+            model: None,
+            credential_ref: None,
+            weight: 100,
+            priority: 0,
+            ops: vec!["chat_completions".to_string()],
+            features: vec!["supports_stream".to_string()],
+            transports: vec!["in_process".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let fd = api.cchat_create();
+    assert_eq!(
+        api.cchat_write_msg(fd, "user".to_string(), "sum 7 35".to_string()),
+        0
+    );
+    assert_eq!(
+        api.cchat_send_with_tools(fd, 4 | 2, |_, _| Ok(String::new())),
+        Err(-super::errno::EINVAL)
+    );
+
+    let resp_fd = api.cchat_send(fd, 4).unwrap();
+    let mut events = Vec::new();
+    let deadline = std::time::Instant::now() + std::time::Duration::from_secs(5);
+    loop {
+        match api.cchat_recv_delta(resp_fd) {
+            Ok(b) => events.push(serde_json::from_slice::<serde_json::Value>(&b).unwrap()),
+            Err(e) if e == -super::errno::EAGAIN && std::time::Instant::now() < deadline => {
+                std::thread::sleep(std::time::Duration::from_millis(5));
+            }
+            Err(e) => {
+                assert_eq!(e, -super::errno::EPIPE);
+                break;
+            }
+        }
+    }
+    assert_eq!(events[0]["type"], "delta");
+    assert!(events[0]["content"].as_str().unwrap_or("").contains("sum 7 35"));
+    assert_eq!(events.last().unwrap()["type"], "done");
+
+    let bytes = api.cchat_recv(resp_fd).unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&bytes).unwrap();
+    let content = v["choices"][0]["message"]["content"].as_str().unwrap_or("");
+    assert!(content.contains("sum 7 35"));
+}
+
+#[test]
+fn test_tts_send_whole_and_streamed_audio() {
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "stub".to_string(),
+            kind: "stub".to_string(),
+            base_url: String::new(),
+            hosting: Some("local".to_string()),
+            model: Some("tts-stub".to_string()),
+            credential_ref: None,
+            weight: 100,
+            priority: 0,
+            ops: vec!["text_to_speech".to_string()],
+            features: vec![],
+            transports: vec!["in_process".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let fd = api.tts_create();
+    assert_eq!(api.tts_send(fd, 0), Err(-super::errno::EINVAL));
+    assert_eq!(
+        api.tts_ctl_set_param(fd, "speed", serde_json::json!(10.0)),
+        -super::errno::EINVAL
+    );
+    assert_eq!(
+        api.tts_ctl_set_param(fd, "voice", serde_json::json!("nova")),
+        0
+    );
+    assert_eq!(api.tts_write(fd, "hello "), 0);
+    assert_eq!(api.tts_write(fd, "there"), 0);
+
+    // Whole clip, read through a small buffer / 完整音频，通过小缓冲区读取
+    let audio_fd = api.tts_send(fd, 0).unwrap();
+    let mut audio = Vec::new();
+    loop {
+        match api.tts_read(audio_fd, 5) {
+            Ok(b) => {
+                assert!(b.len() <= 5);
+                audio.extend(b);
+            }
+            Err(e) => {
+                assert_eq!(e, -super::errno::EPIPE);
+                break;
+            }
+        }
+    }
+    assert_eq!(audio, b"nova:hello there".to_vec());
+    let metrics = api
+        .fd_table
+        .fd_ctl(audio_fd, FD_CTL_GET_METRICS, None)
+        .unwrap()
+        .unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&metrics).unwrap();
+    assert_eq!(v["backend"], "stub");
+    assert_eq!(v["bytes"], audio.len());
+
+    // Streamed chunks / 流式分块
+    let audio_fd = api.tts_send(fd, 4).unwrap();
+    let mut streamed = Vec::new();
+    let mut chunks = 0;
+    let deadline = std::time::Instant::now() + std::time::Duration::from_secs(5);
+    loop {
+        match api.tts_read(audio_fd, 1024) {
+            Ok(b) => {
+                chunks += 1;
+                streamed.extend(b);
+            }
+            Err(e) if e == -super::errno::EAGAIN && std::time::Instant::now() < deadline => {
+                std::thread::sleep(std::time::Duration::from_millis(5));
+            }
+            Err(e) => {
+                assert_eq!(e, -super::errno::EPIPE);
+                break;
+            }
+        }
+    }
+    assert_eq!(streamed, audio);
+    assert!(chunks > 1);
+    assert_eq!(api.tts_close(audio_fd), 0);
+    assert_eq!(api.tts_close(fd), 0);
+}
+
+#[test]
+fn test_rttts_streams_text_deltas_to_audio() {
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "stub".to_string(),
+            kind: "stub".to_string(),
+            base_url: String::new(),
+            hosting: Some("local".to_string()),
+            model: Some("tts-stub".to_string()),
+            credential_ref: None,
+            weight: 100,
+            priority: 0,
+            ops: vec!["text_to_speech".to_string()],
+            features: vec![],
+            transports: vec!["in_process".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let fd = api.rttts_create();
+    let set = |key: &str, value: serde_json::Value| {
+        let body = serde_json::json!({"key": key, "value": value}).to_string();
+        api.rttts_ctl(fd, 1, Some(body.as_bytes()))
+    };
+    assert_eq!(set("voice", serde_json::json!("nova")), Ok(None));
+    assert_eq!(
+        set("min_chars", serde_json::json!(0)),
+        Err(-super::errno::EINVAL)
+    );
+    assert_eq!(api.rttts_ctl(fd, 6, None), Err(-super::errno::EINVAL));
+    assert_eq!(api.rttts_ctl(fd, 2, None), Ok(None));
+    assert_eq!(
+        set("voice", serde_json::json!("alloy")),
+        Err(-super::errno::EINVAL)
+    );
+
+    assert_eq!(api.rttts_write(fd, b"Hello there. How "), 17);
+    assert_eq!(api.rttts_write(fd, b"are you"), 7);
+    assert_eq!(api.rttts_ctl(fd, 6, None), Ok(None));
+    assert_eq!(api.rttts_write(fd, b"more"), -super::errno::EPIPE);
+
+    let mut audio = Vec::new();
+    let deadline = std::time::Instant::now() + std::time::Duration::from_secs(5);
+    loop {
+        match api.rttts_read(fd, 1024) {
+            Ok(b) => audio.extend(b),
+            Err(e) if e == -super::errno::EAGAIN && std::time::Instant::now() < deadline => {
+                std::thread::sleep(std::time::Duration::from_millis(5));
+            }
+            Err(e) => {
+                assert_eq!(e, -super::errno::EPIPE);
+                break;
+            }
+        }
+    }
+    assert_eq!(audio, b"nova:Hello there.nova:How are you".to_vec());
+
+    let status = api.rttts_ctl(fd, 3, None).unwrap().unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&status).unwrap();
+    assert_eq!(v["state"], "Done");
+    assert_eq!(v["segments_done"], 2);
+    assert_eq!(v["backend"], "stub");
+    assert_eq!(api.rttts_close(fd), 0);
+}
+
+#[test]
+fn test_embeddings_batch_stub_backend() {
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "stub".to_string(),
+            kind: "stub".to_string(),
+            base_url: String::new(),
+            hosting: Some("local".to_string()),
+            model: Some("emb-stub".to_string()),
+            credential_ref: None,
+            weight: 100,
+            priority: 0,
+            ops: vec!["embeddings".to_string()],
+            features: vec![],
+            transports: vec!["in_process".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    assert_eq!(api.embeddings(b"not json"), Err(-super::errno::EINVAL));
+    assert_eq!(api.embeddings(br#"{"input": []}"#), Err(-super::errno::EINVAL));
+
+    let out = api.embeddings(br#"{"input": ["a", "b", "a"]}"#).unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&out).unwrap();
+    assert_eq!(v["backend"], "stub");
+    assert_eq!(v["model"], "emb-stub");
+    let vectors = v["embeddings"].as_array().unwrap();
+    assert_eq!(vectors.len(), 3);
+    assert_eq!(vectors[0].as_array().unwrap().len(), v["dimensions"].as_u64().unwrap() as usize);
+    assert_eq!(vectors[0], vectors[2]);
+    assert_ne!(vectors[0], vectors[1]);
+
+    // A single text is a batch of one / 单个文本即大小为一的批次
+    let out = api.embeddings(br#"{"input": "a"}"#).unwrap();
+    let v1: serde_json::Value = serde_json::from_slice(&out).unwrap();
+    assert_eq!(v1["embeddings"][0], vectors[0]);
+}
+
+#[test]
+fn test_image_generate_stub_backend() {
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "stub".to_string(),
+            kind: "stub".to_string(),
+            base_url: String::new(),
+            hosting: Some("local".to_string()),
+            model: Some("img-stub".to_string()),
+            credential_ref: None,
+            weight: 100,
+            priority: 0,
+            ops: vec!["image_generation".to_string()],
+            features: vec![],
+            transports: vec!["in_process".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    assert_eq!(
+        api.image_generate(br#"{"prompt": " "}"#),
+        Err(-super::errno::EINVAL)
+    );
+    assert_eq!(
+        api.image_generate(br#"{"prompt": "fox", "n": 0}"#),
+        Err(-super::errno::EINVAL)
+    );
+    assert_eq!(
+        api.image_generate(br#"{"prompt": "fox", "size": "big"}"#),
+        Err(-super::errno::EINVAL)
+    );
+    assert_eq!(
+        api.image_generate(br#"{"prompt": "fox", "response_format": "png"}"#),
+        Err(-super::errno::EINVAL)
+    );
+
+    let out = api.image_generate(br#"{"prompt": "fox", "n": 2}"#).unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&out).unwrap();
+    assert_eq!(v["backend"], "stub");
+    assert_eq!(v["model"], "img-stub");
+    assert_eq!(v["images"][1]["url"], "stub://image/1");
+
+    let out = api
+        .image_generate(br#"{"prompt": "fox", "response_format": "b64_json"}"#)
+        .unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&out).unwrap();
+    assert_eq!(v["images"][0]["mime"], "image/png");
+    assert!(v["images"][0]["b64_json"].as_str().is_some());
+
+    // A request may lower the inline cap / 请求可调低内联上限
+    assert_eq!(
+        api.image_generate(
+            br#"{"prompt": "fox", "response_format": "b64_json", "max_inline_bytes": 8}"#
+        ),
+        Err(-super::errno::EFBIG)
+    );
+}
+
+#[test]
+fn test_tool_list_and_invoke_validate_arguments() {
+    let mut cfg = crate::spearlet::config::ToolPluginConfig::default();
+    cfg.simulation.enabled = true;
+    let registry = futures::executor::block_on(
+        crate::spearlet::tool_plugins::ToolPluginRegistry::discover(&cfg),
+    );
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: None,
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let list: serde_json::Value =
+        serde_json::from_slice(&api.tool_list_in(&registry).unwrap()).unwrap();
+    let gpio = list["tools"]
+        .as_array()
+        .unwrap()
+        .iter()
+        .find(|t| t["name"] == "gpio_write")
+        .unwrap();
+    assert_eq!(gpio["parameters"]["required"][0], "line");
+
+    assert_eq!(
+        api.tool_invoke_in(&registry, br#"{"name": "missing"}"#),
+        Err(-super::errno::ENOENT)
+    );
+    assert_eq!(
+        api.tool_invoke_in(
+            &registry,
+            br#"{"name": "gpio_write", "arguments": {"line": "led", "value": 2}}"#
+        ),
+        Err(-super::errno::EINVAL)
+    );
+    assert!(registry.simulated_actions().is_empty());
+
+    // Arguments may also come as a JSON string / 参数也可以是 JSON 字符串
+    let req = br#"{"name": "mouse_move", "arguments": "{\"x\": 3, \"y\": 4}"}"#;
+    let out: serde_json::Value =
+        serde_json::from_slice(&api.tool_invoke_in(&registry, req).unwrap()).unwrap();
+    assert_eq!(out["name"], "mouse_move");
+    assert!(out["output"].as_str().is_some());
+    // A retry of an undelivered result does not run the tool again
+    // 重试未送达的结果时不会再次运行工具
+    api.tool_invoke_in(&registry, req).unwrap();
+    assert_eq!(registry.simulated_actions().len(), 1);
+    api.tool_invoke_delivered();
+    api.tool_invoke_in(&registry, req).unwrap();
+    assert_eq!(registry.simulated_actions().len(), 2);
+}
+
+#[test]
+fn test_block_on_cancellable_stops_at_deadline_and_termination() {
+    let mut api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: None,
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+    assert_eq!(api.block_on_cancellable(async { 7 }), Ok(7));
+    {
+        let _deadline = deadline::enter(Some(std::time::Duration::from_millis(50)));
+        assert_eq!(
+            api.block_on_cancellable(std::future::pending::<()>()),
+            Err(-super::errno::ETIMEDOUT)
+        );
+    }
+
+    api.execution_id = Some("exec-cancellable".to_string());
+    api.node()
+        .terminations
+        .mark_execution_terminated("exec-cancellable", -125, None);
+    assert_eq!(
+        api.block_on_cancellable(std::future::pending::<()>()),
+        Err(-125)
+    );
+}
+
+#[test]
+fn test_compute_hint_boosts_and_ends() {
+    let mut api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: None,
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+    let heavy = br#"{"phase":"heavy","resource":"gpu","duration_ms":1000}"#;
+    assert_eq!(api.compute_hint(heavy), Err(-super::errno::ENOENT));
+
+    api.execution_id = Some("exec-compute-hint".to_string());
+    api.task_id = Some("task-compute-hint".to_string());
+    assert_eq!(api.compute_hint(heavy), Ok(1000));
+    let boosted = |id: &str| {
+        api.node()
+            .compute_hints
+            .status()
+            .boosts
+            .iter()
+            .any(|b| b.execution_id == id)
+    };
+    assert!(boosted("exec-compute-hint"));
+    assert_eq!(api.compute_hint(br#"{"phase":"normal"}"#), Ok(0));
+    assert!(!boosted("exec-compute-hint"));
+
+    assert_eq!(
+        api.compute_hint(br#"{"phase":"idle"}"#),
+        Err(-super::errno::EINVAL)
+    );
+    assert_eq!(
+        api.compute_hint(br#"{"phase":"heavy","resource":"tpu"}"#),
+        Err(-super::errno::EINVAL)
+    );
+}
+
+#[test]
+fn test_blob_handoff_between_tasks() {
+    let node = NodeServices::new();
+    let store = &node.blob_cache;
+    store.set_config(crate::spearlet::config::BlobCacheConfig {
+        enabled: true,
+        ..Default::default()
+    });
+    let api = || {
+        DefaultHostApi::new(RuntimeConfig {
+            runtime_type: RuntimeType::Wasm,
+            settings: HashMap::new(),
+            global_environment: HashMap::new(),
+            spearlet_config: None,
+            resource_pool: ResourcePoolConfig::default(),
+            node: node.clone(),
+        })
+    };
+    let (producer, consumer) = (api(), api());
+
+    let id = producer.blob_put(b"0123456789".to_vec()).unwrap();
+    assert_eq!(consumer.blob_size(&id), Ok(10));
+    assert_eq!(consumer.blob_read(&id, 0, 4).unwrap(), b"0123".to_vec());
+    assert_eq!(consumer.blob_read(&id, 8, 4).unwrap(), b"89".to_vec());
+    assert!(consumer.blob_read(&id, 10, 4).unwrap().is_empty());
+    assert_eq!(consumer.blob_read(&id, 11, 4), Err(-super::errno::EINVAL));
+
+    assert_eq!(consumer.blob_release(&id), 0);
+    assert_eq!(producer.blob_size(&id), Err(-super::errno::ENOENT));
+    assert_eq!(producer.blob_release(&id), -super::errno::ENOENT);
+}
+
+#[test]
+fn test_vector_store_hostcalls() {
+    let node = NodeServices::new();
+    let store = &node.vector_store;
+    store.set_config(crate::spearlet::config::VectorStoreConfig {
+        enabled: true,
+        ..Default::default()
+    });
+    let mut api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: None,
+        resource_pool: ResourcePoolConfig::default(),
+        node: node.clone(),
+    });
+    api.task_id = Some("task-vs".to_string());
+
+    let create = br#"{"name":"notes","dimensions":3}"#;
+    assert_eq!(api.vs_create(create), Ok(()));
+    assert_eq!(api.vs_create(br#"{"name":"notes"}"#), Err(-super::errno::EINVAL));
+
+    let insert = br#"{"collection":"notes","records":[
+        {"id":"a","vector":[1,0,0],"metadata":{"kind":"todo"}},
+        {"id":"b","vector":[0,1,0]}
+    ]}"#;
+    assert_eq!(api.vs_insert(insert), Ok(2));
+    let bad = br#"{"collection":"notes","records":[{"id":"c","vector":[1,0]}]}"#;
+    assert_eq!(api.vs_insert(bad), Err(-super::errno::EINVAL));
+
+    let out = api
+        .vs_search(br#"{"collection":"notes","vector":[1,0.1,0],"top_k":1}"#)
+        .unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&out).unwrap();
+    assert_eq!(v["matches"][0]["id"], "a");
+    assert_eq!(v["matches"][0]["metadata"]["kind"], "todo");
+    assert_eq!(v["matches"].as_array().unwrap().len(), 1);
+
+    let missing = br#"{"collection":"other","vector":[1,0,0]}"#;
+    assert_eq!(api.vs_search(missing), Err(-super::errno::ENOENT));
+
+    let list: serde_json::Value = serde_json::from_slice(&api.vs_list().unwrap()).unwrap();
+    assert_eq!(list["collections"][0]["name"], "notes");
+    assert_eq!(list["collections"][0]["vectors"], 2);
+
+    assert_eq!(api.vs_delete(br#"{"collection":"notes"}"#), Ok(2));
+    assert_eq!(
+        api.vs_delete(br#"{"collection":"notes"}"#),
+        Err(-super::errno::ENOENT)
+    );
+}
+
+#[test]
+fn test_kv_state_hostcalls() {
+    let dir = tempfile::tempdir().unwrap();
+    let node = NodeServices::new();
+    let state = &node.kv_state;
+    state.set_config(
+        crate::spearlet::config::KvStateConfig {
+            enabled: true,
+            backend: "memory".to_string(),
+            ..Default::default()
+        },
+        dir.path().to_path_buf(),
+    );
+    let new_api = |task: &str| {
+        let mut api = DefaultHostApi::new(RuntimeConfig {
+            runtime_type: RuntimeType::Wasm,
+            settings: HashMap::new(),
+            global_environment: HashMap::new(),
+            spearlet_config: None,
+            resource_pool: ResourcePoolConfig::default(),
+            node: node.clone(),
+        });
+        api.task_id = Some(task.to_string());
+        api
+    };
+    let a = new_api("task-kv-a");
+    let b = new_api("task-kv-b");
+
+    assert_eq!(a.kv_set(b"memory/last", b"hello", 0), Ok(()));
+    assert_eq!(a.kv_set(b"memory/count", b"2", 3600), Ok(()));
+    assert_eq!(a.kv_get(b"memory/last"), Ok(b"hello".to_vec()));
+    assert_eq!(b.kv_get(b"memory/last"), Err(-super::errno::ENOENT));
+    assert_eq!(a.kv_set(&[0xff, 0xfe], b"x", 0), Err(-super::errno::EINVAL));
+
+    let keys: Vec<String> = serde_json::from_slice(&a.kv_list(b"memory/").unwrap()).unwrap();
+    assert_eq!(keys, vec!["memory/count", "memory/last"]);
+
+    assert_eq!(a.kv_delete(b"memory/last"), Ok(()));
+    assert_eq!(a.kv_delete(b"memory/last"), Err(-super::errno::ENOENT));
+    assert_eq!(a.kv_list(b"").unwrap(), br#"["memory/count"]"#.to_vec());
+
+    state.set_config(Default::default(), dir.path().to_path_buf());
+    assert_eq!(a.kv_get(b"memory/count"), Err(-super::errno::ENOSYS));
+}
+
+#[test]
+fn test_file_hostcalls() {
+    let dir = tempfile::tempdir().unwrap();
+    let node = NodeServices::new();
+    let files = &node.scratch_files;
+    files.set_config(
+        crate::spearlet::config::ScratchFilesConfig {
+            enabled: true,
+            ..Default::default()
+        },
+        dir.path().to_path_buf(),
+    );
+    let new_api = |task: &str| {
+        let mut api = DefaultHostApi::new(RuntimeConfig {
+            runtime_type: RuntimeType::Wasm,
+            settings: HashMap::new(),
+            global_environment: HashMap::new(),
+            spearlet_config: None,
+            resource_pool: ResourcePoolConfig::default(),
+            node: node.clone(),
+        });
+        api.task_id = Some(task.to_string());
+        api
+    };
+    let a = new_api("task-file-a");
+    let b = new_api("task-file-b");
+
+    assert_eq!(a.file_write(b"audio/reply.wav", b"RIFF"), Ok(()));
+    assert_eq!(a.file_read(b"audio/reply.wav"), Ok(b"RIFF".to_vec()));
+    assert_eq!(b.file_read(b"audio/reply.wav"), Err(-super::errno::ENOENT));
+    assert_eq!(a.file_read(b"../task-file-b"), Err(-super::errno::EINVAL));
+    assert_eq!(a.file_read(b"/mnt/none/x"), Err(-super::errno::ENOENT));
+
+    let entries: Vec<serde_json::Value> =
+        serde_json::from_slice(&a.file_list(b"audio").unwrap()).unwrap();
+    assert_eq!(
+        entries,
+        vec![serde_json::json!({"name": "reply.wav", "size": 4, "dir": false})]
+    );
+
+    assert_eq!(a.file_delete(b"audio"), Ok(()));
+    assert_eq!(a.file_list(b"").unwrap(), b"[]".to_vec());
+
+    files.set_config(Default::default(), dir.path().to_path_buf());
+    assert_eq!(a.file_read(b"audio/reply.wav"), Err(-super::errno::ENOSYS));
+}
+
+#[test]
+fn test_invoke_hostcalls_reject_bad_input() {
+    let mut api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: None,
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+    api.execution_id = Some("exec-invoke-parent".to_string());
+
+    assert_eq!(api.invoke_start(b"not json"), Err(-super::errno::EINVAL));
+    assert_eq!(
+        api.invoke_start(br#"{"task":"tts","voice":"x"}"#),
+        Err(-super::errno::EINVAL)
+    );
+    assert_eq!(
+        api.invoke_next(u32::MAX, 1024, 0),
+        Err(-super::errno::EBADF)
+    );
+    assert_eq!(api.invoke_cancel(u32::MAX), Err(-super::errno::EBADF));
+}
+
+#[test]
+fn test_message_passing_hostcalls() {
+    let node = NodeServices::new();
+    let bus = &node.message_passing;
+    bus.set_config(crate::spearlet::config::MessagePassingConfig {
+        enabled: true,
+        ..Default::default()
+    });
+    let new_api = |instance: &str| {
+        DefaultHostApi::new(RuntimeConfig {
+            runtime_type: RuntimeType::Wasm,
+            settings: HashMap::new(),
+            global_environment: HashMap::new(),
+            spearlet_config: None,
+            resource_pool: ResourcePoolConfig::default(),
+            node: node.clone(),
+        })
+        .with_instance_id(instance.to_string())
+    };
+    let planner = new_api("inst-mp-planner");
+    let worker = new_api("inst-mp-worker");
+
+    let from = planner.mp_register(b"mp-planner").unwrap();
+    let to = worker.mp_register(b"mp-worker").unwrap();
+    assert_eq!(
+        planner.mp_register(b"mp-worker"),
+        Err(-super::errno::EEXIST)
+    );
+    assert_eq!(planner.mp_lookup(b"mp-worker"), Ok(to));
+    assert_eq!(planner.mp_lookup(b"mp-nobody"), Err(-super::errno::ENOENT));
+
+    assert_eq!(worker.mp_recv(64, 0), Err(-super::errno::EAGAIN));
+    let id = planner.mp_send(to, b"summarize".to_vec()).unwrap();
+    let msg = worker.mp_recv(64, 0).unwrap();
+    assert_eq!(
+        (msg.id, msg.from, msg.data),
+        (id, from, b"summarize".to_vec())
+    );
+    assert_eq!(planner.mp_wait_ack(id, 10), Err(-super::errno::ETIMEDOUT));
+    assert_eq!(planner.mp_ack(id), Err(-super::errno::ENOENT));
+    assert_eq!(worker.mp_ack(id), Ok(()));
+    assert_eq!(planner.mp_wait_ack(id, 0), Ok(()));
+
+    let id = planner.mp_send(to, b"again".to_vec()).unwrap();
+    drop(worker);
+    assert_eq!(planner.mp_lookup(b"mp-worker"), Err(-super::errno::ENOENT));
+    assert_eq!(planner.mp_wait_ack(id, 0), Err(-super::errno::EPIPE));
+
+    bus.set_config(Default::default());
+    assert_eq!(planner.mp_lookup(b"mp-planner"), Err(-super::errno::ENOSYS));
+}
+
 #[test]
 fn test_cchat_send_auto_tool_call_loop_stub_backend() {
     let mut cfg = crate::spearlet::config::SpearletConfig::default();
@@ -115,6 +911,8 @@ fn test_cchat_send_auto_tool_call_loop_stub_backend() {
                 "supports_stream".to_string(),
             ],
             transports: vec!["in_process".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let api = DefaultHostApi::new(RuntimeConfig {
@@ -123,6 +921,7 @@ fn test_cchat_send_auto_tool_call_loop_stub_backend() {
         global_environment: HashMap::new(),
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let fd = api.cchat_create();
@@ -180,6 +979,8 @@ fn test_configured_openai_backend_missing_key_is_filtered() {
             ops: vec!["chat_completions".to_string()],
             features: vec![],
             transports: vec!["http".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let api = DefaultHostApi::new(RuntimeConfig {
@@ -188,6 +989,7 @@ fn test_configured_openai_backend_missing_key_is_filtered() {
         global_environment: HashMap::new(),
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let fd = api.cchat_create();
@@ -226,6 +1028,8 @@ fn test_registry_credential_ref_missing_env_filters_backend() {
             ops: vec!["chat_completions".to_string()],
             features: vec![],
             transports: vec!["http".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let runtime_config = RuntimeConfig {
@@ -234,6 +1038,7 @@ fn test_registry_credential_ref_missing_env_filters_backend() {
         global_environment: HashMap::new(),
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     };
 
     let (reg, _policy) = super::registry::build_registry_from_runtime_config(&runtime_config);
@@ -265,6 +1070,8 @@ fn test_registry_credential_ref_with_env_registers_backend() {
             ops: vec!["chat_completions".to_string()],
             features: vec![],
             transports: vec!["http".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let mut env = HashMap::new();
@@ -275,6 +1082,7 @@ fn test_registry_credential_ref_with_env_registers_backend() {
         global_environment: env,
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     };
 
     let (reg, _policy) = super::registry::build_registry_from_runtime_config(&runtime_config);
@@ -307,6 +1115,8 @@ fn test_registry_openai_chat_completion_kind_alias_registers_backend() {
             ops: vec!["chat_completions".to_string()],
             features: vec![],
             transports: vec!["http".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let mut env = HashMap::new();
@@ -317,6 +1127,7 @@ fn test_registry_openai_chat_completion_kind_alias_registers_backend() {
         global_environment: env,
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     };
 
     let (reg, _policy) = super::registry::build_registry_from_runtime_config(&runtime_config);
@@ -349,6 +1160,8 @@ fn test_realtime_ws_plan_uses_resolved_env_template() {
             ops: vec!["speech_to_text".to_string()],
             features: vec![],
             transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let mut env = HashMap::new();
@@ -359,6 +1172,7 @@ fn test_realtime_ws_plan_uses_resolved_env_template() {
         global_environment: env,
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     };
 
     let (reg, _policy) = super::registry::build_registry_from_runtime_config(&runtime_config);
@@ -384,6 +1198,7 @@ fn test_cchat_response_fd_is_epollin() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -412,6 +1227,7 @@ fn test_close_makes_epollhup() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -446,6 +1262,7 @@ fn test_rtasr_write_backpressure_and_epollout() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -481,6 +1298,7 @@ async fn test_rtasr_read_epollin_and_eagain() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -575,6 +1393,8 @@ async fn test_rtasr_websocket_transport_receives_events() {
             ops: vec!["speech_to_text".to_string()],
             features: vec![],
             transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let mut env = HashMap::new();
@@ -585,6 +1405,7 @@ async fn test_rtasr_websocket_transport_receives_events() {
         global_environment: env,
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -622,11 +1443,269 @@ async fn test_rtasr_websocket_transport_receives_events() {
     let bytes = api.rtasr_read(fd).unwrap();
     let v: serde_json::Value = serde_json::from_slice(&bytes).unwrap();
     assert_eq!(
-        v.get("type").and_then(|x| x.as_str()).unwrap_or(""),
-        "conversation.item.input_audio_transcription.delta"
+        v.get("type").and_then(|x| x.as_str()).unwrap_or(""),
+        "conversation.item.input_audio_transcription.delta"
+    );
+
+    server.await.unwrap();
+}
+
+#[tokio::test]
+async fn test_rtasr_websocket_channels_tag_events() {
+    use futures::{SinkExt, StreamExt};
+    use tokio::net::TcpListener;
+
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    // Each connection answers with the language of its session.update once audio arrives
+    // 每个连接在收到音频后以其 session.update 中的语种作答
+    let server = tokio::spawn(async move {
+        let mut conns = Vec::new();
+        for _ in 0..2 {
+            let (stream, _) = listener.accept().await.unwrap();
+            conns.push(tokio::spawn(async move {
+                let ws = tokio_tungstenite::accept_async(stream).await.unwrap();
+                let (mut w, mut r) = ws.split();
+                let mut lang = "auto".to_string();
+                loop {
+                    let msg = r.next().await.unwrap().unwrap();
+                    let v: serde_json::Value =
+                        serde_json::from_str(msg.to_text().unwrap()).unwrap();
+                    let l = &v["session"]["input_audio_transcription"]["language"];
+                    if let Some(l) = l.as_str() {
+                        lang = l.to_string();
+                    }
+                    if v["type"] == "input_audio_buffer.append" {
+                        break;
+                    }
+                }
+                let msg = serde_json::json!({
+                    "type": "conversation.item.input_audio_transcription.delta",
+                    "delta": lang,
+                });
+                w.send(tokio_tungstenite::tungstenite::Message::Text(
+                    msg.to_string(),
+                ))
+                .await
+                .unwrap();
+                // Stay open until the fd is closed / 保持连接直到 fd 关闭
+                while let Some(Ok(_)) = r.next().await {}
+            }));
+        }
+        for c in conns {
+            c.await.unwrap();
+        }
+    });
+
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .credentials
+        .push(crate::spearlet::config::LlmCredentialConfig {
+            name: "openai_realtime".to_string(),
+            kind: "env".to_string(),
+            api_key_env: "OPENAI_REALTIME_API_KEY".to_string(),
+        });
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "rt-ws".to_string(),
+            kind: "openai_realtime_ws".to_string(),
+            base_url: "https://api.openai.com/v1".to_string(),
+            hosting: Some("remote".to_string()),
+            model: None,
+            credential_ref: Some("openai_realtime".to_string()),
+            weight: 100,
+            priority: 0,
+            ops: vec!["speech_to_text".to_string()],
+            features: vec![],
+            transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+    let mut env = HashMap::new();
+    env.insert("OPENAI_REALTIME_API_KEY".to_string(), "dummy".to_string());
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: env,
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let fd = api.rtasr_create();
+    let ws_url = format!("ws://{}/v1/realtime?intent=transcription", addr);
+    for (key, value) in [
+        ("transport", serde_json::json!("websocket")),
+        ("backend", serde_json::json!("rt-ws")),
+        ("ws_url", serde_json::json!(ws_url)),
+        ("client_secret", serde_json::json!("dummy")),
+        (
+            "channels",
+            serde_json::json!([{"id": "orig"}, {"id": "en", "language": "English"}]),
+        ),
+    ] {
+        let p = serde_json::to_vec(&serde_json::json!({"key": key, "value": value})).unwrap();
+        api.rtasr_ctl(fd, 1, Some(&p)).unwrap();
+    }
+    api.rtasr_ctl(fd, 2, None).unwrap();
+    assert_eq!(api.rtasr_write(fd, b"abc"), 3);
+
+    let mut got = HashMap::new();
+    for _ in 0..200 {
+        if let Ok(bytes) = api.rtasr_read(fd) {
+            let v: serde_json::Value = serde_json::from_slice(&bytes).unwrap();
+            got.insert(
+                v["channel"].as_str().unwrap().to_string(),
+                v["delta"].as_str().unwrap().to_string(),
+            );
+        }
+        if got.len() == 2 {
+            break;
+        }
+        tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+    }
+    assert_eq!(got.get("orig").map(|s| s.as_str()), Some("auto"));
+    assert_eq!(got.get("en").map(|s| s.as_str()), Some("en"));
+
+    let status: serde_json::Value =
+        serde_json::from_slice(&api.rtasr_ctl(fd, 3, None).unwrap().unwrap()).unwrap();
+    assert_eq!(status["channels"], serde_json::json!(["orig", "en"]));
+
+    api.rtasr_close(fd);
+    server.await.unwrap();
+}
+
+#[tokio::test]
+async fn test_rtasr_websocket_reconnects_after_drop() {
+    use futures::{SinkExt, StreamExt};
+    use tokio::net::TcpListener;
+
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    let server = tokio::spawn(async move {
+        // First connection drops without a close frame / 第一个连接不发送关闭帧直接断开
+        let (stream, _) = listener.accept().await.unwrap();
+        let ws = tokio_tungstenite::accept_async(stream).await.unwrap();
+        let (w, mut r) = ws.split();
+        let _ = r.next().await;
+        drop((w, r));
+
+        let (stream, _) = listener.accept().await.unwrap();
+        let ws = tokio_tungstenite::accept_async(stream).await.unwrap();
+        let (mut w, mut r) = ws.split();
+        while let Some(Ok(msg)) = r.next().await {
+            if let tokio_tungstenite::tungstenite::Message::Text(t) = msg {
+                let v: serde_json::Value = serde_json::from_str(&t).unwrap();
+                if v["type"] == "input_audio_buffer.append" && v["audio"] == "ZGVm" {
+                    break;
+                }
+            }
+        }
+        let msg = serde_json::json!({
+            "type": "conversation.item.input_audio_transcription.delta",
+            "delta": "again",
+        });
+        w.send(tokio_tungstenite::tungstenite::Message::Text(
+            serde_json::to_string(&msg).unwrap(),
+        ))
+        .await
+        .unwrap();
+        let _ = r.next().await;
+    });
+
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .credentials
+        .push(crate::spearlet::config::LlmCredentialConfig {
+            name: "openai_realtime".to_string(),
+            kind: "env".to_string(),
+            api_key_env: "OPENAI_REALTIME_API_KEY".to_string(),
+        });
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "rt-ws".to_string(),
+            kind: "openai_realtime_ws".to_string(),
+            base_url: "https://api.openai.com/v1".to_string(),
+            hosting: Some("remote".to_string()),
+            model: None,
+            credential_ref: Some("openai_realtime".to_string()),
+            weight: 100,
+            priority: 0,
+            ops: vec!["speech_to_text".to_string()],
+            features: vec![],
+            transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let mut env = HashMap::new();
+    env.insert("OPENAI_REALTIME_API_KEY".to_string(), "dummy".to_string());
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: env,
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let fd = api.rtasr_create();
+    let ws_url = format!("ws://{}/v1/realtime?intent=transcription", addr);
+    for (k, v) in [
+        ("transport", serde_json::json!("websocket")),
+        ("backend", serde_json::json!("rt-ws")),
+        ("ws_url", serde_json::json!(ws_url)),
+        ("client_secret", serde_json::json!("dummy")),
+        ("reconnect_backoff_ms", serde_json::json!(10)),
+    ] {
+        let p = serde_json::to_vec(&serde_json::json!({"key": k, "value": v})).unwrap();
+        api.rtasr_ctl(fd, 1, Some(&p)).unwrap();
+    }
+    api.rtasr_ctl(fd, 2, None).unwrap();
+    assert_eq!(api.rtasr_write(fd, b"abc"), 3);
+
+    let mut types = Vec::new();
+    let deadline = std::time::Instant::now() + std::time::Duration::from_secs(5);
+    while std::time::Instant::now() < deadline {
+        match api.rtasr_read(fd) {
+            Ok(bytes) => {
+                let v: serde_json::Value = serde_json::from_slice(&bytes).unwrap();
+                let ty = v["type"].as_str().unwrap_or("").to_string();
+                if ty == "spear.rtasr.reconnecting" {
+                    assert_eq!(v["attempt"], 1);
+                    // Audio written during the gap is sent after the reconnect
+                    // 断开期间写入的音频在重连后发送
+                    assert_eq!(api.rtasr_write(fd, b"def"), 3);
+                }
+                let done = ty == "conversation.item.input_audio_transcription.delta";
+                types.push(ty);
+                if done {
+                    break;
+                }
+            }
+            Err(_) => tokio::time::sleep(std::time::Duration::from_millis(10)).await,
+        }
+    }
+    assert_eq!(
+        types,
+        vec![
+            "spear.rtasr.reconnecting",
+            "spear.rtasr.reconnected",
+            "conversation.item.input_audio_transcription.delta",
+        ]
     );
 
-    server.await.unwrap();
+    let status = api.rtasr_ctl(fd, 3, None).unwrap().unwrap();
+    let status: serde_json::Value = serde_json::from_slice(&status).unwrap();
+    assert_eq!(status["state"], "Connected");
+    assert_eq!(status["reconnects"], 1);
+
+    api.rtasr_close(fd);
+    server.abort();
 }
 
 #[test]
@@ -637,6 +1716,7 @@ fn test_rtasr_autoflush_set_and_get() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let fd = api.rtasr_create();
@@ -678,6 +1758,7 @@ fn test_rtasr_autoflush_legacy_payload_is_accepted() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let fd = api.rtasr_create();
@@ -712,6 +1793,7 @@ fn test_rtasr_default_segmentation_is_server_vad() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let fd = api.rtasr_create();
@@ -798,6 +1880,8 @@ async fn test_rtasr_websocket_flush_sends_commit() {
             ops: vec!["speech_to_text".to_string()],
             features: vec![],
             transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let mut env = HashMap::new();
@@ -808,6 +1892,7 @@ async fn test_rtasr_websocket_flush_sends_commit() {
         global_environment: env,
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -853,6 +1938,448 @@ async fn test_rtasr_websocket_flush_sends_commit() {
     server.await.unwrap();
 }
 
+#[tokio::test]
+async fn test_rtasr_websocket_session_config_and_update() {
+    use futures::StreamExt;
+    use tokio::net::TcpListener;
+
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let (tx, rx) = tokio::sync::oneshot::channel::<Vec<serde_json::Value>>();
+
+    // Collect the first two session.update events / 收集前两个 session.update 事件
+    let server = tokio::spawn(async move {
+        let (stream, _) = listener.accept().await.unwrap();
+        let mut ws = tokio_tungstenite::accept_async(stream).await.unwrap();
+        let mut updates = Vec::new();
+        while let Some(Ok(msg)) = ws.next().await {
+            let tokio_tungstenite::tungstenite::Message::Text(s) = msg else {
+                continue;
+            };
+            let v: serde_json::Value = serde_json::from_str(&s).unwrap_or_default();
+            if v.get("type").and_then(|x| x.as_str()) == Some("session.update") {
+                updates.push(v["session"].clone());
+                if updates.len() == 2 {
+                    break;
+                }
+            }
+        }
+        let _ = tx.send(updates);
+    });
+
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .credentials
+        .push(crate::spearlet::config::LlmCredentialConfig {
+            name: "openai_realtime".to_string(),
+            kind: "env".to_string(),
+            api_key_env: "OPENAI_REALTIME_API_KEY".to_string(),
+        });
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "rt-ws".to_string(),
+            kind: "openai_realtime_ws".to_string(),
+            base_url: "https://api.openai.com/v1".to_string(),
+            hosting: Some("remote".to_string()),
+            model: None,
+            credential_ref: Some("openai_realtime".to_string()),
+            weight: 100,
+            priority: 0,
+            ops: vec!["speech_to_text".to_string()],
+            features: vec![],
+            transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let mut env = HashMap::new();
+    env.insert("OPENAI_REALTIME_API_KEY".to_string(), "dummy".to_string());
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: env,
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let fd = api.rtasr_create();
+    let ws_url = format!("ws://{}/v1/realtime?model=gpt-realtime", addr);
+    for (k, v) in [
+        ("transport", serde_json::json!("websocket")),
+        ("backend", serde_json::json!("rt-ws")),
+        ("ws_url", serde_json::json!(ws_url)),
+        ("client_secret", serde_json::json!("dummy")),
+        ("noise_reduction", serde_json::json!("near_field")),
+        ("prompt", serde_json::json!("SPEAR, spearlet")),
+    ] {
+        let p = serde_json::to_vec(&serde_json::json!({"key": k, "value": v})).unwrap();
+        api.rtasr_ctl(fd, 1, Some(&p)).unwrap();
+    }
+    let bad =
+        serde_json::to_vec(&serde_json::json!({"key":"noise_reduction","value":"loud"})).unwrap();
+    assert_eq!(
+        api.rtasr_ctl(fd, 1, Some(&bad)),
+        Err(-crate::spearlet::execution::host_api::errno::SPEAR_EINVAL)
+    );
+
+    api.rtasr_ctl(fd, 2, None).unwrap();
+    let update =
+        serde_json::to_vec(&serde_json::json!({"language": "fr-FR", "noise_reduction": "off"}))
+            .unwrap();
+    api.rtasr_ctl(fd, 10, Some(&update)).unwrap();
+    assert_eq!(
+        api.rtasr_ctl(fd, 10, Some(b"{\"voice\":\"nova\"}")),
+        Err(-crate::spearlet::execution::host_api::errno::SPEAR_EINVAL)
+    );
+
+    let updates = tokio::time::timeout(std::time::Duration::from_secs(5), rx)
+        .await
+        .unwrap()
+        .unwrap();
+    assert_eq!(
+        updates[0]["input_audio_noise_reduction"],
+        serde_json::json!({"type": "near_field"})
+    );
+    assert_eq!(
+        updates[0]["input_audio_transcription"]["prompt"],
+        "SPEAR, spearlet"
+    );
+    let t = &updates[1]["input_audio_transcription"];
+    assert_eq!(t["language"], "fr");
+    assert_eq!(t["prompt"], "SPEAR, spearlet");
+    assert_eq!(t["model"], "gpt-4o-mini-transcribe");
+    assert!(updates[1]["input_audio_noise_reduction"].is_null());
+
+    let lang: serde_json::Value =
+        serde_json::from_slice(&api.rtasr_ctl(fd, 9, None).unwrap().unwrap()).unwrap();
+    assert_eq!(lang["code"], "fr");
+
+    api.rtasr_close(fd);
+    server.await.unwrap();
+}
+
+#[tokio::test]
+async fn test_rtasr_websocket_finish_delivers_final_and_closes() {
+    use futures::{SinkExt, StreamExt};
+    use tokio::net::TcpListener;
+
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let (tx, rx) = tokio::sync::oneshot::channel::<bool>();
+
+    // Answer the commit with a final transcript, then expect a close frame
+    // 以最终转写回应提交，随后等待关闭帧
+    let server = tokio::spawn(async move {
+        let (stream, _) = listener.accept().await.unwrap();
+        let ws = tokio_tungstenite::accept_async(stream).await.unwrap();
+        let (mut w, mut r) = ws.split();
+        let mut close_seen = false;
+        while let Some(Ok(msg)) = r.next().await {
+            let s = match msg {
+                tokio_tungstenite::tungstenite::Message::Text(s) => s,
+                tokio_tungstenite::tungstenite::Message::Close(_) => {
+                    close_seen = true;
+                    break;
+                }
+                _ => continue,
+            };
+            let v: serde_json::Value = serde_json::from_str(&s).unwrap_or_default();
+            if v.get("type").and_then(|x| x.as_str()) == Some("input_audio_buffer.commit") {
+                let msg = serde_json::json!({
+                    "type": "conversation.item.input_audio_transcription.completed",
+                    "transcript": "goodbye",
+                });
+                let _ = w
+                    .send(tokio_tungstenite::tungstenite::Message::Text(
+                        serde_json::to_string(&msg).unwrap(),
+                    ))
+                    .await;
+            }
+        }
+        let _ = tx.send(close_seen);
+    });
+
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .credentials
+        .push(crate::spearlet::config::LlmCredentialConfig {
+            name: "openai_realtime".to_string(),
+            kind: "env".to_string(),
+            api_key_env: "OPENAI_REALTIME_API_KEY".to_string(),
+        });
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "rt-ws".to_string(),
+            kind: "openai_realtime_ws".to_string(),
+            base_url: "https://api.openai.com/v1".to_string(),
+            hosting: Some("remote".to_string()),
+            model: None,
+            credential_ref: Some("openai_realtime".to_string()),
+            weight: 100,
+            priority: 0,
+            ops: vec!["speech_to_text".to_string()],
+            features: vec![],
+            transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let mut env = HashMap::new();
+    env.insert("OPENAI_REALTIME_API_KEY".to_string(), "dummy".to_string());
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: env,
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let fd = api.rtasr_create();
+    let ws_url = format!("ws://{}/v1/realtime?model=gpt-realtime", addr);
+    for (k, v) in [
+        ("transport", serde_json::json!("websocket")),
+        ("backend", serde_json::json!("rt-ws")),
+        ("ws_url", serde_json::json!(ws_url)),
+        ("client_secret", serde_json::json!("dummy")),
+    ] {
+        let p = serde_json::to_vec(&serde_json::json!({"key": k, "value": v})).unwrap();
+        api.rtasr_ctl(fd, 1, Some(&p)).unwrap();
+    }
+    api.rtasr_ctl(fd, 2, None).unwrap();
+    assert_eq!(api.rtasr_write(fd, b"abc"), 3);
+    api.rtasr_ctl(fd, 11, None).unwrap();
+    assert_eq!(
+        api.rtasr_write(fd, b"def"),
+        -crate::spearlet::execution::host_api::errno::SPEAR_EPIPE
+    );
+
+    let mut types = Vec::new();
+    let deadline = std::time::Instant::now() + std::time::Duration::from_secs(5);
+    loop {
+        match api.rtasr_read(fd) {
+            Ok(bytes) => {
+                let v: serde_json::Value = serde_json::from_slice(&bytes).unwrap();
+                if v["type"] == "spear.rtasr.finished" {
+                    assert_eq!(v["timed_out"], false);
+                }
+                types.push(v["type"].as_str().unwrap_or("").to_string());
+            }
+            Err(e) if e == -crate::spearlet::execution::host_api::errno::SPEAR_EPIPE => break,
+            Err(_) => {
+                assert!(std::time::Instant::now() < deadline, "finish timed out");
+                tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            }
+        }
+    }
+    assert_eq!(
+        types,
+        vec![
+            "conversation.item.input_audio_transcription.completed",
+            "spear.rtasr.finished"
+        ]
+    );
+    let status: serde_json::Value =
+        serde_json::from_slice(&api.rtasr_ctl(fd, 3, None).unwrap().unwrap()).unwrap();
+    assert_eq!(status["state"], "Closed");
+
+    assert!(tokio::time::timeout(std::time::Duration::from_secs(5), rx)
+        .await
+        .unwrap()
+        .unwrap());
+    api.rtasr_close(fd);
+    server.await.unwrap();
+}
+
+#[cfg(feature = "rt-asr")]
+#[tokio::test]
+async fn test_rtasr_deepgram_backend_translates_frames() {
+    use futures::{SinkExt, StreamExt};
+    use tokio::net::TcpListener;
+    use tokio_tungstenite::tungstenite::Message;
+
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    // Speak Deepgram: binary audio, `Finalize`, then `CloseStream`
+    // 使用 Deepgram 协议：二进制音频、`Finalize`，随后 `CloseStream`
+    let server = tokio::spawn(async move {
+        let (stream, _) = listener.accept().await.unwrap();
+        let (query_tx, query_rx) = tokio::sync::oneshot::channel::<String>();
+        let ws = tokio_tungstenite::accept_hdr_async(
+            stream,
+            |req: &tokio_tungstenite::tungstenite::handshake::server::Request, resp| {
+                let _ = query_tx.send(req.uri().query().unwrap_or("").to_string());
+                Ok(resp)
+            },
+        )
+        .await
+        .unwrap();
+        let query = query_rx.await.unwrap();
+        let (mut w, mut r) = ws.split();
+        let mut audio = Vec::new();
+        let mut close_stream = false;
+        while let Some(Ok(msg)) = r.next().await {
+            let s = match msg {
+                Message::Binary(b) => {
+                    audio.extend_from_slice(&b);
+                    continue;
+                }
+                Message::Text(s) => s,
+                _ => break,
+            };
+            let v: serde_json::Value = serde_json::from_str(&s).unwrap_or_default();
+            match v.get("type").and_then(|x| x.as_str()) {
+                Some("Finalize") => {
+                    let msg = serde_json::json!({
+                        "type": "Results",
+                        "is_final": true,
+                        "from_finalize": true,
+                        "channel": {"alternatives": [{"transcript": "hello", "languages": ["en"]}]},
+                    });
+                    let _ = w.send(Message::Text(msg.to_string())).await;
+                }
+                Some("CloseStream") => close_stream = true,
+                _ => {}
+            }
+        }
+        (query, audio, close_stream)
+    });
+
+    let mut cfg = crate::spearlet::config::SpearletConfig::default();
+    cfg.llm
+        .credentials
+        .push(crate::spearlet::config::LlmCredentialConfig {
+            name: "deepgram".to_string(),
+            kind: "env".to_string(),
+            api_key_env: "DEEPGRAM_API_KEY".to_string(),
+        });
+    cfg.llm
+        .backends
+        .push(crate::spearlet::config::LlmBackendConfig {
+            name: "dg".to_string(),
+            kind: "deepgram_listen_ws".to_string(),
+            base_url: "https://api.deepgram.com".to_string(),
+            hosting: Some("remote".to_string()),
+            model: None,
+            credential_ref: Some("deepgram".to_string()),
+            weight: 100,
+            priority: 0,
+            ops: vec!["speech_to_text".to_string()],
+            features: vec![],
+            transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
+        });
+
+    let mut env = HashMap::new();
+    env.insert("DEEPGRAM_API_KEY".to_string(), "dummy".to_string());
+    let api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: env,
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+
+    let fd = api.rtasr_create();
+    let ws_url = format!("ws://{}/v1/listen", addr);
+    for (k, v) in [
+        ("transport", serde_json::json!("websocket")),
+        ("backend", serde_json::json!("dg")),
+        ("ws_url", serde_json::json!(ws_url)),
+        ("client_secret", serde_json::json!("dummy")),
+    ] {
+        let p = serde_json::to_vec(&serde_json::json!({"key": k, "value": v})).unwrap();
+        api.rtasr_ctl(fd, 1, Some(&p)).unwrap();
+    }
+    api.rtasr_ctl(fd, 2, None).unwrap();
+    assert_eq!(api.rtasr_write(fd, b"abcd"), 4);
+    api.rtasr_ctl(fd, 11, None).unwrap();
+
+    let mut events = Vec::new();
+    let deadline = std::time::Instant::now() + std::time::Duration::from_secs(5);
+    loop {
+        match api.rtasr_read(fd) {
+            Ok(bytes) => events.push(serde_json::from_slice::<serde_json::Value>(&bytes).unwrap()),
+            Err(e) if e == -crate::spearlet::execution::host_api::errno::SPEAR_EPIPE => break,
+            Err(_) => {
+                assert!(std::time::Instant::now() < deadline, "finish timed out");
+                tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            }
+        }
+    }
+    assert_eq!(events.len(), 2);
+    assert_eq!(
+        events[0]["type"],
+        "conversation.item.input_audio_transcription.completed"
+    );
+    assert_eq!(events[0]["transcript"], "hello");
+    assert_eq!(events[1]["type"], "spear.rtasr.finished");
+    assert_eq!(events[1]["timed_out"], false);
+
+    let (query, audio, close_stream) =
+        tokio::time::timeout(std::time::Duration::from_secs(5), server)
+            .await
+            .unwrap()
+            .unwrap();
+    assert!(query.contains("encoding=linear16"));
+    assert!(query.contains("sample_rate=24000"));
+    assert_eq!(audio, b"abcd");
+    assert!(close_stream);
+    api.rtasr_close(fd);
+}
+
+#[tokio::test]
+async fn test_rtasr_stub_finish_and_termination_cleanup() {
+    let exec_id = "exec-rtasr-cleanup";
+    let mut api = DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: None,
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    });
+    api.set_execution_id(Some(exec_id.to_string()));
+
+    // FINISH needs a connected session / FINISH 需要已连接的会话
+    let finished = api.rtasr_create();
+    assert_eq!(
+        api.rtasr_ctl(finished, 11, None),
+        Err(-crate::spearlet::execution::host_api::errno::SPEAR_EINVAL)
+    );
+    api.rtasr_ctl(finished, 2, None).unwrap();
+    api.rtasr_ctl(finished, 11, None).unwrap();
+    let v: serde_json::Value = serde_json::from_slice(&api.rtasr_read(finished).unwrap()).unwrap();
+    assert_eq!(v["type"], "spear.rtasr.finished");
+    assert_eq!(
+        api.rtasr_read(finished),
+        Err(-crate::spearlet::execution::host_api::errno::SPEAR_EPIPE)
+    );
+
+    // Terminating the execution closes and removes its sessions
+    // 终止执行会关闭并移除其会话
+    let fd = api.rtasr_create();
+    api.rtasr_ctl(fd, 2, None).unwrap();
+    api.node()
+        .terminations
+        .mark_execution_terminated(exec_id, -125, None);
+    let deadline = std::time::Instant::now() + std::time::Duration::from_secs(5);
+    while api.fd_table.get(fd).is_some() {
+        assert!(std::time::Instant::now() < deadline, "session not removed");
+        tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+    }
+    assert_eq!(
+        api.rtasr_ctl(fd, 3, None),
+        Err(-crate::spearlet::execution::host_api::errno::SPEAR_EBADF)
+    );
+}
+
 #[tokio::test]
 async fn test_rtasr_websocket_autoflush_bytes_sends_commit() {
     use futures::{SinkExt, StreamExt};
@@ -912,6 +2439,8 @@ async fn test_rtasr_websocket_autoflush_bytes_sends_commit() {
             ops: vec!["speech_to_text".to_string()],
             features: vec![],
             transports: vec!["websocket".to_string()],
+            auth_style: None,
+            api_version: None,
         });
 
     let mut env = HashMap::new();
@@ -922,6 +2451,7 @@ async fn test_rtasr_websocket_autoflush_bytes_sends_commit() {
         global_environment: env,
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -1000,6 +2530,7 @@ async fn test_mic_read_epollin_and_close_hup() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -1060,6 +2591,7 @@ async fn test_mic_stub_pcm16_base64_loops() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -1131,6 +2663,7 @@ async fn test_user_stream_inbound_read_epollin_and_eagain() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let exec_id = "exec-user-stream-in".to_string();
@@ -1145,7 +2678,10 @@ async fn test_user_stream_inbound_read_epollin_and_eagain() {
     );
 
     let frame = super::ssf::build_ssf_v1_frame(1, 2, b"{}", b"hello");
-    let rc = super::user_stream::ws_push_frame(&exec_id, frame.clone());
+    let rc = api
+        .node()
+        .user_streams
+        .ws_push_frame(&exec_id, frame.clone());
     assert_eq!(rc, 0);
 
     let api2 = api.clone();
@@ -1172,6 +2708,7 @@ async fn test_user_stream_outbound_write_eagain_and_epollout() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let exec_id = "exec-user-stream-out".to_string();
@@ -1185,7 +2722,10 @@ async fn test_user_stream_outbound_write_eagain_and_epollout() {
         0
     );
 
-    super::user_stream::ExecutionUserStreamHub::get_or_create(&exec_id).mark_connected(1);
+    api.node()
+        .user_streams
+        .get_or_create(&exec_id)
+        .mark_connected(1);
 
     let frame_small = super::ssf::build_ssf_v1_frame(1, 2, b"{}", b"1234");
 
@@ -1216,7 +2756,7 @@ async fn test_user_stream_outbound_write_eagain_and_epollout() {
         .iter()
         .any(|(rfd, ev)| *rfd == fd && ((*ev as u32) & PollEvents::OUT.bits()) != 0));
 
-    let drained = super::user_stream::ws_pop_any_outbound(&exec_id);
+    let drained = api.node().user_streams.ws_pop_any_outbound(&exec_id);
     assert!(drained.is_some());
 
     let api3 = api.clone();
@@ -1239,6 +2779,7 @@ async fn test_user_stream_ctl_discovers_stream_ids() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let exec_id = "exec-user-stream-ctl".to_string();
@@ -1253,7 +2794,10 @@ async fn test_user_stream_ctl_discovers_stream_ids() {
     );
 
     let frame = super::ssf::build_ssf_v1_frame(9, 2, b"{}", b"hello");
-    let rc = super::user_stream::ws_push_frame(&exec_id, frame.clone());
+    let rc = api
+        .node()
+        .user_streams
+        .ws_push_frame(&exec_id, frame.clone());
     assert_eq!(rc, 0);
 
     let api2 = api.clone();
@@ -1328,6 +2872,7 @@ async fn test_mic_device_returns_pcm16_frames() {
         global_environment: HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let epfd = api.spear_ep_create();
@@ -1406,3 +2951,50 @@ async fn test_mic_device_returns_pcm16_frames() {
 
     assert_eq!(api.mic_close(mic_fd), 0);
 }
+
+fn test_harness_api(enabled: bool) -> DefaultHostApi {
+    let cfg = crate::spearlet::config::SpearletConfig {
+        test_hostcalls: enabled,
+        ..Default::default()
+    };
+    DefaultHostApi::new(RuntimeConfig {
+        runtime_type: RuntimeType::Wasm,
+        settings: HashMap::new(),
+        global_environment: HashMap::new(),
+        spearlet_config: Some(cfg),
+        resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
+    })
+    .with_instance_id("inst-1".to_string())
+}
+
+#[test]
+fn test_harness_hostcalls_disabled_by_default() {
+    let api = test_harness_api(false);
+    let enosys = -crate::spearlet::execution::host_api::errno::SPEAR_ENOSYS;
+    assert_eq!(api.test_echo(b"x"), Err(enosys));
+    assert_eq!(api.test_fail(5), enosys);
+    assert_eq!(api.test_latency(0), enosys as i64);
+    assert_eq!(api.test_state(), Err(enosys));
+}
+
+#[test]
+fn test_harness_hostcalls_enabled() {
+    let api = test_harness_api(true);
+    assert_eq!(api.test_echo(b"ping").unwrap(), b"ping".to_vec());
+    assert_eq!(api.test_fail(110), -110);
+    assert_eq!(
+        api.test_fail(0),
+        -crate::spearlet::execution::host_api::errno::SPEAR_EINVAL
+    );
+    assert!(api.test_latency(5) >= 5);
+    assert!(api.test_latency(-1) < 0);
+
+    let fd = api.cchat_create();
+    let state: serde_json::Value = serde_json::from_slice(&api.test_state().unwrap()).unwrap();
+    assert_eq!(state["instance_id"], "inst-1");
+    assert_eq!(state["open_fds"], 1);
+    assert_eq!(api.cchat_close(fd), 0);
+    let state: serde_json::Value = serde_json::from_slice(&api.test_state().unwrap()).unwrap();
+    assert_eq!(state["open_fds"], 0);
+}
@@ -0,0 +1,124 @@
+//! Builtin tool hostcalls / 内置工具 hostcall
+//!
+//! `tool_list` returns the tools of the node's plugin registry (plugins and, in simulation
+//! mode, the simulated hardware tools) with their parameter schemas. `tool_invoke` runs one
+//! of them after checking the arguments against its schema. A tool has side effects, so
+//! as with `image_generate` a result that does not fit the guest buffer is kept for the
+//! retry instead of running the tool again. The tool is stopped at the hostcall deadline
+//! (`-ETIMEDOUT`) or when the task is terminated.
+//! `tool_list` 返回节点插件注册表中的工具（插件，以及模拟模式下的模拟硬件工具）及其参数 schema。
+//! `tool_invoke` 依据工具的 schema 校验参数后运行该工具。工具带有副作用，因此与 `image_generate`
+//! 相同，放不进 guest 缓冲区的结果会保留给重试，而不会再次运行工具。到达 hostcall 截止时间
+//! （`-ETIMEDOUT`）或任务被终止时，工具会被停止。
+//!
+//! Plugins run in the task's temporary workspace; `tool_invoke` fails with `-EAGAIN` while
+//! the workspace is full.
+//! 插件在任务的临时工作区中运行；工作区已满时 `tool_invoke` 以 `-EAGAIN` 失败。
+
+use serde::Deserialize;
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+
+use super::errno::{SPEAR_EAGAIN, SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOENT, SPEAR_ENOSYS};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::temp_workspace::TempError;
+use crate::spearlet::tool_plugins::{ToolDirs, ToolPluginRegistry};
+use crate::spearlet::tool_schema;
+
+/// Request of `tool_invoke` / `tool_invoke` 的请求
+#[derive(Debug, Deserialize)]
+struct ToolInvokeRequest {
+    name: String,
+    /// An object, or a JSON string holding one / 对象，或包含对象的 JSON 字符串
+    #[serde(default)]
+    arguments: Value,
+}
+
+impl DefaultHostApi {
+    /// The node's tools as JSON / 以 JSON 返回节点的工具
+    pub fn tool_list(&self) -> Result<Vec<u8>, i32> {
+        let registry = self.node().tool_plugins.get().ok_or(-SPEAR_ENOSYS)?;
+        self.tool_list_in(&registry)
+    }
+
+    pub(super) fn tool_list_in(&self, registry: &ToolPluginRegistry) -> Result<Vec<u8>, i32> {
+        let tools: Vec<Value> = registry
+            .definitions()
+            .into_iter()
+            .map(|(name, description, parameters)| {
+                json!({"name": name, "description": description, "parameters": parameters})
+            })
+            .collect();
+        serde_json::to_vec(&json!({ "tools": tools })).map_err(|_| -SPEAR_EIO)
+    }
+
+    /// Run a `tool_invoke` request / 执行 `tool_invoke` 请求
+    pub fn tool_invoke(&self, request: &[u8]) -> Result<Vec<u8>, i32> {
+        let registry = self.node().tool_plugins.get().ok_or(-SPEAR_ENOSYS)?;
+        self.tool_invoke_in(&registry, request)
+    }
+
+    pub(super) fn tool_invoke_in(
+        &self,
+        registry: &ToolPluginRegistry,
+        request: &[u8],
+    ) -> Result<Vec<u8>, i32> {
+        let digest: [u8; 32] = Sha256::digest(request).into();
+        if let Some((d, out)) = self.tool_last.0.lock().take() {
+            if d == digest {
+                return Ok(out);
+            }
+        }
+        let req: ToolInvokeRequest = serde_json::from_slice(request).map_err(|_| -SPEAR_EINVAL)?;
+        let args = match req.arguments {
+            Value::Null => json!({}),
+            Value::String(s) => serde_json::from_str(&s).map_err(|_| -SPEAR_EINVAL)?,
+            v => v,
+        };
+        let schema = registry.parameters(&req.name).ok_or(-SPEAR_ENOENT)?;
+        if let Err(reason) = tool_schema::validate(&schema, &args) {
+            tracing::warn!(tool = %req.name, %reason, "tool_invoke arguments rejected");
+            return Err(-SPEAR_EINVAL);
+        }
+
+        let dirs = self.tool_dirs().map_err(|e| {
+            tracing::warn!(tool = %req.name, error = %e, "tool_invoke refused");
+            -SPEAR_EAGAIN
+        })?;
+        let output = self
+            .block_on_cancellable(registry.invoke_in(&req.name, &args.to_string(), &dirs))
+            .map_err(|e| {
+                tracing::warn!(tool = %req.name, errno = e, "tool_invoke cut short");
+                e
+            })?
+            .map_err(|e| {
+                tracing::warn!(tool = %req.name, error = %e, "tool_invoke failed");
+                -SPEAR_EIO
+            })?;
+        let out = serde_json::to_vec(&json!({"name": req.name, "output": output}))
+            .map_err(|_| -SPEAR_EIO)?;
+        *self.tool_last.0.lock() = Some((digest, out.clone()));
+        Ok(out)
+    }
+
+    /// Directories the task's plugin calls run with; fails while the temporary workspace is full
+    /// 任务的插件调用所使用的目录；临时工作区已满时失败
+    pub(super) fn tool_dirs(&self) -> Result<ToolDirs, TempError> {
+        let task_id = self.task_id.as_deref().unwrap_or("");
+        let temp = match self.node().temp_workspace.enter(task_id) {
+            Ok(dir) => Some(dir),
+            Err(TempError::Disabled) => None,
+            Err(e) => return Err(e),
+        };
+        Ok(ToolDirs {
+            scratch: self.node().scratch_files.task_dir(task_id).ok(),
+            temp,
+        })
+    }
+
+    /// The guest received the result; drop the copy kept for a retry
+    /// guest 已收到结果；丢弃为重试保留的副本
+    pub fn tool_invoke_delivered(&self) {
+        self.tool_last.0.lock().take();
+    }
+}
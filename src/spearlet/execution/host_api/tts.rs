@@ -0,0 +1,323 @@
+//! Text-to-speech hostcalls / 文本转语音 hostcall
+//!
+//! A guest writes text to a TTS fd, sets `model`/`voice`/`format`/`speed` through `tts_ctl`, then
+//! `tts_send` returns an audio fd. Without `TTS_SEND_FLAG_STREAM` the call returns once the whole
+//! clip is buffered; with it, audio chunks are queued on the fd as the backend synthesizes them.
+//! Either way the guest drains the fd with `tts_read`. With `response_cache` on, a clip already
+//! synthesized for the same text and parameters is queued from the cache as one chunk.
+//! guest 向 TTS fd 写入文本，通过 `tts_ctl` 设置 `model`/`voice`/`format`/`speed`，随后 `tts_send`
+//! 返回音频 fd。未设置 `TTS_SEND_FLAG_STREAM` 时，调用在完整音频缓冲后返回；设置后，音频分块在后端合成时
+//! 排入 fd。两种方式下 guest 均通过 `tts_read` 读取。启用 `response_cache` 时，已为相同文本与参数合成的音频
+//! 从缓存中作为一个分块排入。
+
+use super::errno::{EAGAIN, EBADF, EINVAL, EIO, ENOSPC, EPIPE};
+use crate::spearlet::execution::ai::ir::{Payload, ResultPayload};
+use crate::spearlet::execution::ai::normalize::tts::normalize_tts_session;
+use crate::spearlet::execution::host_api::language::META_LANGUAGE;
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::execution::hostcall::fd_table::FdTable;
+use crate::spearlet::execution::hostcall::types::{
+    FdEntry, FdFlags, FdInner, FdKind, PollEvents, TtsAudioState, TtsSessionState,
+};
+use crate::spearlet::otel;
+use crate::spearlet::param_keys::tts as tts_keys;
+use crate::spearlet::response_cache;
+use serde_json::{json, Value};
+use std::collections::HashSet;
+use std::sync::Arc;
+
+/// `tts_send` flag: return at once and queue audio chunks as they arrive
+/// `tts_send` 标志：立即返回，音频分块到达后排入队列
+pub const TTS_SEND_FLAG_STREAM: i32 = 4;
+
+/// Text a single request may carry / 单个请求可携带的文本上限
+pub const MAX_TTS_INPUT_BYTES: usize = 64 * 1024;
+
+fn push_audio_chunk(table: &Arc<FdTable>, audio_fd: i32, chunk: Vec<u8>) {
+    let Some(entry) = table.get(audio_fd) else {
+        return;
+    };
+    {
+        let Ok(mut e) = entry.lock() else {
+            return;
+        };
+        if e.closed {
+            return;
+        }
+        let FdInner::TtsAudio(a) = &mut e.inner else {
+            return;
+        };
+        a.bytes += chunk.len() as u64;
+        a.chunks.push_back(chunk);
+        e.poll_mask.insert(PollEvents::IN);
+    }
+    table.notify_watchers(audio_fd);
+}
+
+fn finish_audio(table: &Arc<FdTable>, audio_fd: i32, result: Result<(String, String), String>) {
+    let Some(entry) = table.get(audio_fd) else {
+        return;
+    };
+    {
+        let Ok(mut e) = entry.lock() else {
+            return;
+        };
+        let FdInner::TtsAudio(a) = &mut e.inner else {
+            return;
+        };
+        match result {
+            Ok((backend, format)) => {
+                a.backend = backend;
+                if !format.is_empty() {
+                    a.format = format;
+                }
+            }
+            Err(msg) => a.error = Some(msg),
+        }
+        a.streaming = false;
+        // The end of the audio is readable too / 音频结束同样可读
+        e.poll_mask.insert(PollEvents::IN);
+    }
+    table.notify_watchers(audio_fd);
+}
+
+/// Cached clip: a JSON line with backend and format, then the audio
+/// 缓存的音频：一行包含后端与格式的 JSON，随后是音频
+fn encode_cached_clip(backend: &str, format: &str, audio: &[u8]) -> Vec<u8> {
+    let mut out = json!({ "backend": backend, "format": format })
+        .to_string()
+        .into_bytes();
+    out.push(b'\n');
+    out.extend_from_slice(audio);
+    out
+}
+
+fn decode_cached_clip(value: &[u8]) -> Option<(String, String, Vec<u8>)> {
+    let end = value.iter().position(|b| *b == b'\n')?;
+    let head: Value = serde_json::from_slice(&value[..end]).ok()?;
+    let field = |k: &str| head.get(k).and_then(|v| v.as_str()).map(str::to_string);
+    Some((
+        field("backend")?,
+        field("format")?,
+        value[end + 1..].to_vec(),
+    ))
+}
+
+pub(super) fn validate_param(key: &str, value: &Value) -> bool {
+    match key {
+        tts_keys::MODEL
+        | tts_keys::VOICE
+        | tts_keys::FORMAT
+        | tts_keys::LANGUAGE
+        | tts_keys::BACKEND => value.is_string(),
+        tts_keys::SPEED => value
+            .as_f64()
+            .map(|s| (0.25..=4.0).contains(&s))
+            .unwrap_or(false),
+        tts_keys::TIMEOUT_MS => value.as_u64().is_some(),
+        _ => false,
+    }
+}
+
+impl DefaultHostApi {
+    pub fn tts_create(&self) -> i32 {
+        self.fd_table.alloc(FdEntry {
+            kind: FdKind::Tts,
+            flags: FdFlags::default(),
+            poll_mask: PollEvents::default(),
+            watchers: HashSet::new(),
+            closed: false,
+            inner: FdInner::Tts(TtsSessionState::default()),
+        })
+    }
+
+    /// Append text to speak / 追加待朗读的文本
+    pub fn tts_write(&self, fd: i32, text: &str) -> i32 {
+        let Some(entry) = self.fd_table.get(fd) else {
+            return -EBADF;
+        };
+        let mut e = match entry.lock() {
+            Ok(v) => v,
+            Err(_) => return -EIO,
+        };
+        if e.closed {
+            return -EBADF;
+        }
+        let FdInner::Tts(s) = &mut e.inner else {
+            return -EBADF;
+        };
+        if s.text.len() + text.len() > MAX_TTS_INPUT_BYTES {
+            return -ENOSPC;
+        }
+        s.text.push_str(text);
+        0
+    }
+
+    pub fn tts_ctl_set_param(&self, fd: i32, key: &str, value: Value) -> i32 {
+        if !validate_param(key, &value) {
+            return -EINVAL;
+        }
+        let Some(entry) = self.fd_table.get(fd) else {
+            return -EBADF;
+        };
+        let mut e = match entry.lock() {
+            Ok(v) => v,
+            Err(_) => return -EIO,
+        };
+        if e.closed {
+            return -EBADF;
+        }
+        let FdInner::Tts(s) = &mut e.inner else {
+            return -EBADF;
+        };
+        s.params.insert(key.to_string(), value);
+        0
+    }
+
+    /// Synthesize the written text; returns the audio fd
+    /// 合成已写入的文本；返回音频 fd
+    pub fn tts_send(&self, fd: i32, flags: i32) -> Result<i32, i32> {
+        let (text, params) = {
+            let entry = self.fd_table.get(fd).ok_or(-EBADF)?;
+            let e = entry.lock().map_err(|_| -EIO)?;
+            if e.closed {
+                return Err(-EBADF);
+            }
+            let FdInner::Tts(s) = &e.inner else {
+                return Err(-EBADF);
+            };
+            (s.text.clone(), s.params.clone())
+        };
+        if text.trim().is_empty() {
+            return Err(-EINVAL);
+        }
+
+        let mut req = normalize_tts_session(fd, &text, &params);
+        let explicit = params.get(tts_keys::LANGUAGE).and_then(|v| v.as_str());
+        if let Some(lang) = self.resolve_language(explicit) {
+            req.meta.insert(META_LANGUAGE.to_string(), lang);
+        }
+        let format = match &req.payload {
+            Payload::TextToSpeech(p) => p.format.clone().unwrap_or_default(),
+            _ => String::new(),
+        };
+        let cache = &self.node().response_cache;
+        let cache_key = cache
+            .caches("text_to_speech")
+            .then(|| response_cache::request_key(&req));
+        let stream = (flags & TTS_SEND_FLAG_STREAM) != 0;
+        let audio_fd = self.fd_table.alloc(FdEntry {
+            kind: FdKind::TtsAudio,
+            flags: FdFlags::default(),
+            poll_mask: PollEvents::default(),
+            watchers: HashSet::new(),
+            closed: false,
+            inner: FdInner::TtsAudio(TtsAudioState {
+                streaming: true,
+                format,
+                ..Default::default()
+            }),
+        });
+        tracing::debug!(
+            tts_fd = fd,
+            audio_fd,
+            flags,
+            text_bytes = text.len(),
+            "tts_send canonical request"
+        );
+
+        let table = self.fd_table.clone();
+        let engine = self.ai_engine.clone();
+        let run = move || {
+            let cached = cache_key
+                .as_deref()
+                .and_then(|k| cache.get(k))
+                .and_then(|v| decode_cached_clip(&v));
+            if let Some((backend, format, audio)) = cached {
+                if !audio.is_empty() {
+                    push_audio_chunk(&table, audio_fd, audio);
+                }
+                finish_audio(&table, audio_fd, Ok((backend, format)));
+                return;
+            }
+            let mut clip = cache_key.as_ref().map(|_| Vec::new());
+            let result = engine.invoke_audio_stream(&req, &mut |chunk| {
+                if let Some(clip) = clip.as_mut() {
+                    clip.extend_from_slice(&chunk);
+                }
+                push_audio_chunk(&table, audio_fd, chunk);
+            });
+            let result = match result {
+                Ok(resp) => match resp.result {
+                    ResultPayload::Payload(v) => {
+                        let format = v.get("format").and_then(|f| f.as_str()).unwrap_or("");
+                        Ok((resp.backend, format.to_string()))
+                    }
+                    ResultPayload::Error(e) => Err(format!("{}: {}", e.code, e.message)),
+                },
+                Err(e) => Err(e.to_string()),
+            };
+            match (&result, cache_key, clip) {
+                (Ok((backend, format)), Some(k), Some(clip)) => {
+                    cache.put(&k, &encode_cached_clip(backend, format, &clip));
+                }
+                (Err(msg), _, _) => tracing::warn!(audio_fd, error = %msg, "tts_send failed"),
+                _ => {}
+            }
+            finish_audio(&table, audio_fd, result);
+        };
+        if !stream {
+            run();
+            return Ok(audio_fd);
+        }
+        let trace = otel::current();
+        // Adapters block on their own runtime, so this cannot be a tokio task
+        // 适配器会在自身的运行时上阻塞，因此不能使用 tokio 任务
+        let spawned = std::thread::Builder::new()
+            .name("tts-stream".to_string())
+            .spawn(move || {
+                otel::set_current(trace);
+                run();
+            });
+        if spawned.is_err() {
+            self.fd_table.close(audio_fd);
+            return Err(-EIO);
+        }
+        Ok(audio_fd)
+    }
+
+    /// Up to `max` bytes of audio; -EAGAIN while more is coming, -EPIPE at the end,
+    /// -EIO once a failed synthesis is drained
+    /// 最多 `max` 字节音频；仍有后续时返回 -EAGAIN，结束时返回 -EPIPE，失败的合成读完后返回 -EIO
+    pub fn tts_read(&self, audio_fd: i32, max: usize) -> Result<Vec<u8>, i32> {
+        if max == 0 {
+            return Err(-EINVAL);
+        }
+        let entry = self.fd_table.get(audio_fd).ok_or(-EBADF)?;
+        let mut e = entry.lock().map_err(|_| -EIO)?;
+        let FdInner::TtsAudio(a) = &mut e.inner else {
+            return Err(-EBADF);
+        };
+        let Some(mut chunk) = a.chunks.pop_front() else {
+            return Err(if a.streaming {
+                -EAGAIN
+            } else if a.error.is_some() {
+                -EIO
+            } else {
+                -EPIPE
+            });
+        };
+        if chunk.len() > max {
+            let rest = chunk.split_off(max);
+            a.chunks.push_front(rest);
+        }
+        if a.streaming && a.chunks.is_empty() {
+            e.poll_mask.remove(PollEvents::IN);
+        }
+        Ok(chunk)
+    }
+
+    pub fn tts_close(&self, fd: i32) -> i32 {
+        self.fd_table.close(fd)
+    }
+}
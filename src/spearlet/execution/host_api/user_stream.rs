@@ -11,12 +11,24 @@ use crate::spearlet::execution::host_api::errno::{
 };
 use dashmap::DashMap;
 use std::collections::HashSet;
-use std::sync::{Arc, Mutex, OnceLock};
+use std::sync::{Arc, Mutex};
 
-static USER_STREAM_HUBS: OnceLock<DashMap<String, Arc<ExecutionUserStreamHub>>> = OnceLock::new();
+/// User stream hubs of one spearlet's executions, by execution id
+/// 单个 spearlet 各执行的 user stream hub，按执行 id 索引
+#[derive(Default)]
+pub struct UserStreams {
+    hubs: DashMap<String, Arc<ExecutionUserStreamHub>>,
+}
 
-fn user_stream_hubs() -> &'static DashMap<String, Arc<ExecutionUserStreamHub>> {
-    USER_STREAM_HUBS.get_or_init(DashMap::new)
+/// One user stream as reported by `/admin/introspect` / `/admin/introspect` 报告的单个 user stream
+#[derive(Debug, Clone, serde::Serialize)]
+pub struct UserStreamSummary {
+    pub execution_id: String,
+    pub stream_id: u32,
+    pub state: String,
+    pub inbound_frames: usize,
+    pub outbound_frames: usize,
+    pub last_error: Option<String>,
 }
 
 pub(crate) struct ExecutionUserStreamHub {
@@ -26,16 +38,36 @@ pub(crate) struct ExecutionUserStreamHub {
     ctl_fds: Mutex<HashSet<i32>>,
 }
 
-impl ExecutionUserStreamHub {
-    pub(crate) fn get(execution_id: &str) -> Option<Arc<Self>> {
-        user_stream_hubs().get(execution_id).map(|e| e.clone())
+impl UserStreams {
+    /// Every open user stream, sorted by execution and stream / 所有已打开的 user stream，按执行与流排序
+    pub fn summaries(&self) -> Vec<UserStreamSummary> {
+        let mut out = Vec::new();
+        for hub in self.hubs.iter() {
+            for ch in hub.value().streams.iter() {
+                let st = ch.value().lock().unwrap();
+                out.push(UserStreamSummary {
+                    execution_id: hub.key().clone(),
+                    stream_id: st.stream_id,
+                    state: format!("{:?}", st.conn_state).to_ascii_lowercase(),
+                    inbound_frames: st.inbound.len(),
+                    outbound_frames: st.outbound.len(),
+                    last_error: st.last_error.clone(),
+                });
+            }
+        }
+        out.sort_by(|a, b| (&a.execution_id, a.stream_id).cmp(&(&b.execution_id, b.stream_id)));
+        out
     }
 
-    pub(crate) fn get_or_create(execution_id: &str) -> Arc<Self> {
-        user_stream_hubs()
+    pub(crate) fn get(&self, execution_id: &str) -> Option<Arc<ExecutionUserStreamHub>> {
+        self.hubs.get(execution_id).map(|e| e.clone())
+    }
+
+    pub(crate) fn get_or_create(&self, execution_id: &str) -> Arc<ExecutionUserStreamHub> {
+        self.hubs
             .entry(execution_id.to_string())
             .or_insert_with(|| {
-                Arc::new(Self {
+                Arc::new(ExecutionUserStreamHub {
                     streams: DashMap::new(),
                     fd_table: Mutex::new(None),
                     notify_any_outbound: Arc::new(tokio::sync::Notify::new()),
@@ -45,6 +77,58 @@ impl ExecutionUserStreamHub {
             .clone()
     }
 
+    pub fn map_ws_close_to_channels(&self, execution_id: &str) {
+        let Some(hub) = self.get(execution_id) else {
+            return;
+        };
+        hub.mark_closed_all();
+        hub.notify_any_outbound.notify_waiters();
+        self.hubs.remove(execution_id);
+    }
+
+    pub fn ws_push_frame(&self, execution_id: &str, frame: Vec<u8>) -> i32 {
+        let (stream_id, _msg_type) = match super::ssf::parse_ssf_v1_header(&frame) {
+            Ok(v) => v,
+            Err(e) => return e,
+        };
+        let Some(hub) = self.get(execution_id) else {
+            return -SPEAR_ENOTCONN;
+        };
+        hub.mark_connected(stream_id);
+        hub.push_inbound_frame(stream_id, frame)
+    }
+
+    /// Tell the guest the client acknowledged its frame `seq` on `stream_id`
+    /// 告知 guest 客户端已确认其在 `stream_id` 上的帧 `seq`
+    pub fn ws_push_ack(&self, execution_id: &str, stream_id: u32, seq: u64) -> bool {
+        let Some(hub) = self.get(execution_id) else {
+            return false;
+        };
+        let meta = serde_json::json!({ "ack_seq": seq }).to_string();
+        let frame = super::ssf::build_ssf_v1_frame(
+            stream_id,
+            super::ssf::SSF_MSG_TYPE_ACK,
+            meta.as_bytes(),
+            &[],
+        );
+        hub.push_ack_frame(stream_id, frame)
+    }
+
+    pub fn ws_pop_any_outbound(&self, execution_id: &str) -> Option<Vec<u8>> {
+        let hub = self.get(execution_id)?;
+        hub.pop_outbound_frame_any().map(|(_, f)| f)
+    }
+
+    pub(crate) async fn ws_wait_any_outbound(&self, execution_id: &str) {
+        if let Some(hub) = self.get(execution_id) {
+            hub.notify_any_outbound.notified().await;
+        } else {
+            tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+        }
+    }
+}
+
+impl ExecutionUserStreamHub {
     pub(crate) fn attach_fd_table(&self, table: Arc<FdTable>) {
         let mut st = self.fd_table.lock().unwrap();
         if st.is_none() {
@@ -118,6 +202,24 @@ impl ExecutionUserStreamHub {
         0
     }
 
+    /// Queue an ACK for the guest; skipped instead of failing the stream when the stream is
+    /// gone or its inbound queue is full
+    /// 为 guest 排队一个 ACK；流不存在或入站队列已满时跳过，而不是使流失败
+    fn push_ack_frame(&self, stream_id: u32, frame: Vec<u8>) -> bool {
+        let Some(ch) = self.streams.get(&stream_id).map(|e| e.value().clone()) else {
+            return false;
+        };
+        let mut st = ch.lock().unwrap();
+        if st.inbound_bytes.saturating_add(frame.len()) > st.max_inbound_bytes {
+            return false;
+        }
+        st.inbound_bytes = st.inbound_bytes.saturating_add(frame.len());
+        st.inbound.push_back(frame);
+        drop(st);
+        self.recompute_and_notify_attached_fds(&ch);
+        true
+    }
+
     pub(crate) fn pop_outbound_frame_any(&self) -> Option<(u32, Vec<u8>)> {
         for entry in self.streams.iter() {
             let stream_id = *entry.key();
@@ -129,6 +231,13 @@ impl ExecutionUserStreamHub {
         None
     }
 
+    /// Pop from one stream only, leaving the others to their readers
+    /// 仅从单个流弹出，其余流留给各自的读取方
+    pub(crate) fn pop_outbound_frame_on(&self, stream_id: u32) -> Option<Vec<u8>> {
+        let ch = self.streams.get(&stream_id).map(|e| e.value().clone())?;
+        self.pop_outbound_frame(&ch)
+    }
+
     fn pop_outbound_frame(&self, ch: &Arc<Mutex<UserStreamChannel>>) -> Option<Vec<u8>> {
         let mut st = ch.lock().unwrap();
         let frame = st.outbound.pop_front()?;
@@ -183,6 +292,10 @@ impl ExecutionUserStreamHub {
         self.ctl_fds.lock().unwrap().iter().copied().collect()
     }
 
+    pub(crate) fn has_ctl_fds(&self) -> bool {
+        !self.ctl_fds.lock().unwrap().is_empty()
+    }
+
     pub(crate) fn register_ctl_fd(&self, fd: i32) {
         self.ctl_fds.lock().unwrap().insert(fd);
     }
@@ -322,7 +435,7 @@ impl DefaultHostApi {
             return -SPEAR_EINVAL;
         };
 
-        let hub = ExecutionUserStreamHub::get_or_create(&execution_id);
+        let hub = self.node().user_streams.get_or_create(&execution_id);
         hub.attach_fd_table(self.fd_table.clone());
         let ch = hub.get_or_create_channel(stream_id_u32);
 
@@ -452,6 +565,13 @@ impl DefaultHostApi {
                         rc = -SPEAR_EINVAL;
                     } else if c.outbound_bytes.saturating_add(bytes.len()) > c.max_outbound_bytes {
                         rc = -SPEAR_EAGAIN;
+                    } else if self
+                        .node()
+                        .output_caps
+                        .charge(&execution_id, bytes.len())
+                        .is_err()
+                    {
+                        rc = -SPEAR_EPIPE;
                     } else {
                         c.outbound_bytes = c.outbound_bytes.saturating_add(bytes.len());
                         c.outbound.push_back(bytes.to_vec());
@@ -469,7 +589,7 @@ impl DefaultHostApi {
         }
 
         if rc == 0 {
-            let hub = ExecutionUserStreamHub::get_or_create(&execution_id);
+            let hub = self.node().user_streams.get_or_create(&execution_id);
             hub.notify_outbound_waiters(stream_id);
         }
         rc
@@ -484,7 +604,7 @@ impl DefaultHostApi {
                     }
                 }
                 if let FdInner::UserStreamCtl(st) = &e.inner {
-                    let hub = ExecutionUserStreamHub::get_or_create(&st.execution_id);
+                    let hub = self.node().user_streams.get_or_create(&st.execution_id);
                     hub.unregister_ctl_fd(fd);
                 }
             }
@@ -496,7 +616,7 @@ impl DefaultHostApi {
         let Some(execution_id) = super::core::current_wasm_execution_id() else {
             return -SPEAR_ENOTCONN;
         };
-        let hub = ExecutionUserStreamHub::get_or_create(&execution_id);
+        let hub = self.node().user_streams.get_or_create(&execution_id);
         hub.attach_fd_table(self.fd_table.clone());
 
         let fd = self.fd_table.alloc(FdEntry {
@@ -556,40 +676,6 @@ impl DefaultHostApi {
     }
 }
 
-pub fn map_ws_close_to_channels(execution_id: &str) {
-    let Some(hub) = user_stream_hubs().get(execution_id).map(|e| e.clone()) else {
-        return;
-    };
-    hub.mark_closed_all();
-    hub.notify_any_outbound.notify_waiters();
-    user_stream_hubs().remove(execution_id);
-}
-
-pub fn ws_push_frame(execution_id: &str, frame: Vec<u8>) -> i32 {
-    let (stream_id, _msg_type) = match super::ssf::parse_ssf_v1_header(&frame) {
-        Ok(v) => v,
-        Err(e) => return e,
-    };
-    let Some(hub) = ExecutionUserStreamHub::get(execution_id) else {
-        return -SPEAR_ENOTCONN;
-    };
-    hub.mark_connected(stream_id);
-    hub.push_inbound_frame(stream_id, frame)
-}
-
-pub fn ws_pop_any_outbound(execution_id: &str) -> Option<Vec<u8>> {
-    let hub = ExecutionUserStreamHub::get(execution_id)?;
-    hub.pop_outbound_frame_any().map(|(_, f)| f)
-}
-
-pub(crate) async fn ws_wait_any_outbound(execution_id: &str) {
-    if let Some(hub) = ExecutionUserStreamHub::get(execution_id) {
-        hub.notify_any_outbound.notified().await;
-    } else {
-        tokio::time::sleep(std::time::Duration::from_millis(50)).await;
-    }
-}
-
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -657,14 +743,26 @@ mod tests {
 
     #[test]
     fn test_ws_push_frame_rejects_invalid_frame() {
-        let rc = ws_push_frame("exec-1", vec![1, 2, 3]);
+        let rc = UserStreams::default().ws_push_frame("exec-1", vec![1, 2, 3]);
         assert!(rc < 0);
     }
 
     #[test]
     fn test_ws_push_frame_rejects_unknown_execution() {
         let frame = ssf::build_ssf_v1_frame(1, 2, b"{}", b"hello");
-        let rc = ws_push_frame("exec-unknown", frame);
+        let rc = UserStreams::default().ws_push_frame("exec-unknown", frame);
         assert_eq!(rc, -SPEAR_ENOTCONN);
     }
+
+    #[test]
+    fn test_hubs_are_kept_per_registry() {
+        let a = UserStreams::default();
+        let b = UserStreams::default();
+        a.get_or_create("exec-1").mark_connected(1);
+        let frame = ssf::build_ssf_v1_frame(1, 2, b"{}", b"hello");
+        assert_eq!(b.ws_push_frame("exec-1", frame.clone()), -SPEAR_ENOTCONN);
+        assert_eq!(a.ws_push_frame("exec-1", frame), 0);
+        assert_eq!(a.summaries().len(), 1);
+        assert!(b.summaries().is_empty());
+    }
 }
@@ -1,6 +1,12 @@
+use super::deadline;
+use super::errno::SPEAR_ETIMEDOUT;
 use crate::spearlet::execution::host_api::DefaultHostApi;
 use std::collections::HashMap;
 use std::future::Future;
+use std::time::Duration;
+
+/// How often a cancellable wait looks for termination / 可取消的等待检查终止的间隔
+const TERMINATION_POLL: Duration = Duration::from_millis(50);
 
 pub(super) fn expand_template(
     s: &str,
@@ -105,6 +111,51 @@ impl DefaultHostApi {
             .block_on(fut)
     }
 
+    /// Like `block_on`, but gives up with `-ETIMEDOUT` at the hostcall deadline and with the
+    /// termination errno once the task is terminated; the future is dropped either way
+    /// 与 `block_on` 相同，但在 hostcall 截止时间返回 `-ETIMEDOUT`，任务被终止时返回终止 errno；
+    /// 两种情况下 future 都会被丢弃
+    pub(super) fn block_on_cancellable<F>(&self, fut: F) -> Result<F::Output, i32>
+    where
+        F: Future,
+    {
+        let remaining = deadline::remaining();
+        if remaining.is_some_and(|r| r.is_zero()) {
+            return Err(-SPEAR_ETIMEDOUT);
+        }
+        self.block_on(async {
+            let expire = async {
+                match remaining {
+                    Some(r) => tokio::time::sleep(r).await,
+                    None => std::future::pending().await,
+                }
+            };
+            tokio::pin!(fut, expire);
+            let mut poll = tokio::time::interval(TERMINATION_POLL);
+            loop {
+                tokio::select! {
+                    out = &mut fut => return Ok(out),
+                    _ = &mut expire => return Err(-SPEAR_ETIMEDOUT),
+                    _ = poll.tick() => {
+                        if let Some(s) = self.check_wasm_termination() {
+                            return Err(s.errno);
+                        }
+                    }
+                }
+            }
+        })
+    }
+
+    /// Timeout configured for a hostcall / 为 hostcall 配置的超时
+    pub(crate) fn hostcall_timeout(&self, method: &str) -> Option<Duration> {
+        self.runtime_config
+            .spearlet_config
+            .as_ref()?
+            .execution
+            .hostcall_timeouts
+            .timeout(method)
+    }
+
     pub(super) fn spawn_background<F>(&self, fut: F)
     where
         F: Future<Output = ()> + Send + 'static,
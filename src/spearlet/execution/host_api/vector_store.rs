@@ -0,0 +1,89 @@
+//! Vector store hostcalls / 向量存储 hostcall
+//!
+//! Every `vs_*` call takes one JSON request. Collections are scoped to the calling task, so
+//! the task id is the namespace handed to the store. Only `vs_search` and `vs_list` return a
+//! JSON result; the others return a count.
+//! 每个 `vs_*` 调用接收一个 JSON 请求。集合的作用域为调用任务，因此任务 ID 即交给存储的命名空间。
+//! 只有 `vs_search` 与 `vs_list` 返回 JSON 结果；其余调用返回数量。
+
+use serde_json::json;
+
+use super::errno::{SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOENT, SPEAR_ENOMEM, SPEAR_ENOSYS};
+use crate::spearlet::execution::host_api::DefaultHostApi;
+use crate::spearlet::vector_store::{
+    self, CollectionSpec, DeleteRequest, InsertRequest, SearchRequest, VectorError,
+};
+
+fn errno(e: &VectorError) -> i32 {
+    -match e {
+        VectorError::Disabled => SPEAR_ENOSYS,
+        VectorError::UnknownCollection(_) => SPEAR_ENOENT,
+        VectorError::BadRequest(_) => SPEAR_EINVAL,
+        VectorError::Limit(_) => SPEAR_ENOMEM,
+        VectorError::Backend(_) => SPEAR_EIO,
+    }
+}
+
+fn parse<'a, T: serde::Deserialize<'a>>(request: &'a [u8]) -> Result<T, i32> {
+    serde_json::from_slice(request).map_err(|_| -SPEAR_EINVAL)
+}
+
+impl DefaultHostApi {
+    fn vs_namespace(&self) -> &str {
+        self.task_id.as_deref().unwrap_or("")
+    }
+
+    fn vs_failed(&self, op: &str, e: VectorError) -> i32 {
+        tracing::warn!(task_id = %self.vs_namespace(), op, error = %e, "vector store call failed");
+        errno(&e)
+    }
+
+    /// Create a collection / 创建集合
+    pub fn vs_create(&self, request: &[u8]) -> Result<(), i32> {
+        let spec: CollectionSpec = parse(request)?;
+        self.node()
+            .vector_store
+            .create(self.vs_namespace(), &spec)
+            .map_err(|e| self.vs_failed("vs_create", e))
+    }
+
+    /// Insert or replace records; returns how many were written / 插入或替换记录；返回写入数量
+    pub fn vs_insert(&self, request: &[u8]) -> Result<usize, i32> {
+        let req: InsertRequest = parse(request)?;
+        self.node()
+            .vector_store
+            .insert(self.vs_namespace(), req)
+            .map_err(|e| self.vs_failed("vs_insert", e))
+    }
+
+    /// Best matches as JSON / 以 JSON 返回最佳匹配
+    pub fn vs_search(&self, request: &[u8]) -> Result<Vec<u8>, i32> {
+        let req: SearchRequest = parse(request)?;
+        let matches = self
+            .node()
+            .vector_store
+            .search(self.vs_namespace(), &req)
+            .map_err(|e| self.vs_failed("vs_search", e))?;
+        serde_json::to_vec(&json!({ "matches": matches })).map_err(|_| -SPEAR_EIO)
+    }
+
+    /// Delete records or the whole collection; returns the records deleted
+    /// 删除记录或整个集合；返回删除的记录数
+    pub fn vs_delete(&self, request: &[u8]) -> Result<usize, i32> {
+        let req: DeleteRequest = parse(request)?;
+        self.node()
+            .vector_store
+            .delete(self.vs_namespace(), &req)
+            .map_err(|e| self.vs_failed("vs_delete", e))
+    }
+
+    /// The task's collections as JSON / 以 JSON 返回任务的集合
+    pub fn vs_list(&self) -> Result<Vec<u8>, i32> {
+        let collections = self
+            .node()
+            .vector_store
+            .collections(self.vs_namespace())
+            .map_err(|e| self.vs_failed("vs_list", e))?;
+        serde_json::to_vec(&json!({ "collections": collections })).map_err(|_| -SPEAR_EIO)
+    }
+}
@@ -85,6 +85,19 @@ impl FdTable {
         0
     }
 
+    /// Drop a closed entry; its fd then reads as unknown / 移除已关闭的条目；此后该 fd 视为未知
+    pub fn remove(&self, fd: i32) {
+        self.entries
+            .remove_if(&fd, |_, e| e.lock().map(|g| g.closed).unwrap_or(true));
+    }
+
+    pub fn open_count(&self) -> usize {
+        self.entries
+            .iter()
+            .filter(|e| !e.value().lock().map(|g| g.closed).unwrap_or(true))
+            .count()
+    }
+
     pub fn close_all(&self) {
         let fds = self.entries.iter().map(|e| *e.key()).collect::<Vec<_>>();
         for fd in fds {
@@ -322,6 +335,9 @@ impl FdTable {
                     FdKind::Mic => "Mic",
                     FdKind::UserStream => "UserStream",
                     FdKind::UserStreamCtl => "UserStreamCtl",
+                    FdKind::Tts => "Tts",
+                    FdKind::TtsAudio => "TtsAudio",
+                    FdKind::RtTts => "RtTts",
                 };
                 Ok(Some(
                     serde_json::to_vec(&json!({"kind": kind})).unwrap_or_else(|_| b"{}".to_vec()),
@@ -337,6 +353,9 @@ impl FdTable {
                     FdKind::Mic => "Mic",
                     FdKind::UserStream => "UserStream",
                     FdKind::UserStreamCtl => "UserStreamCtl",
+                    FdKind::Tts => "Tts",
+                    FdKind::TtsAudio => "TtsAudio",
+                    FdKind::RtTts => "RtTts",
                 };
                 let mut flags: Vec<&str> = Vec::new();
                 if e.flags.contains(FdFlags::O_NONBLOCK) {
@@ -405,6 +424,19 @@ impl FdTable {
                             serde_json::to_vec(&v).unwrap_or_else(|_| b"{}".to_vec()),
                         ))
                     }
+                    FdInner::TtsAudio(a) => {
+                        let v = json!({
+                            "backend": a.backend.clone(),
+                            "format": a.format.clone(),
+                            "streaming": a.streaming,
+                            "bytes": a.bytes,
+                            "pending_chunks": a.chunks.len(),
+                            "error": a.error.clone(),
+                        });
+                        Ok(Some(
+                            serde_json::to_vec(&v).unwrap_or_else(|_| b"{}".to_vec()),
+                        ))
+                    }
                     _ => Ok(Some(b"{}".to_vec())),
                 }
             }
@@ -3,6 +3,8 @@ use std::collections::{HashMap, HashSet, VecDeque};
 use std::sync::{Arc, Condvar, Mutex};
 
 use crate::spearlet::execution::ai::ir::ChatMessage;
+use crate::spearlet::execution::ai::provider_session::ProviderSession;
+use crate::spearlet::execution::host_api::language::DetectedLanguage;
 use crate::spearlet::mcp::policy::McpSessionParams;
 
 #[derive(Clone, Copy, Debug, PartialEq, Eq, Hash)]
@@ -14,6 +16,9 @@ pub enum FdKind {
     Mic,
     UserStream,
     UserStreamCtl,
+    Tts,
+    TtsAudio,
+    RtTts,
 }
 
 #[derive(Clone, Copy, Debug, PartialEq, Eq)]
@@ -83,6 +88,10 @@ impl PollEvents {
     pub fn insert(&mut self, other: Self) {
         self.0 |= other.0;
     }
+
+    pub fn remove(&mut self, other: Self) {
+        self.0 &= !other.0;
+    }
 }
 
 impl Default for PollEvents {
@@ -97,12 +106,103 @@ pub struct ChatSessionState {
     pub tools: Vec<(i32, String)>,
     pub params: HashMap<String, Value>,
     pub mcp: McpSessionParams,
+    /// Conversation the last answering backend keeps / 最近应答的后端所保存的会话
+    pub provider_session: Option<ProviderSession>,
 }
 
 #[derive(Clone, Debug, Default)]
 pub struct ChatResponseState {
     pub bytes: Vec<u8>,
     pub metrics_bytes: Vec<u8>,
+    /// Stream events not read yet / 尚未读取的流事件
+    pub events: VecDeque<Vec<u8>>,
+    /// Set until a streamed response is complete / 流式响应完成前保持置位
+    pub streaming: bool,
+}
+
+#[derive(Clone, Debug, Default)]
+pub struct TtsSessionState {
+    pub text: String,
+    pub params: HashMap<String, Value>,
+}
+
+#[derive(Clone, Debug, Default)]
+pub struct TtsAudioState {
+    /// Audio chunks not read yet / 尚未读取的音频分块
+    pub chunks: VecDeque<Vec<u8>>,
+    /// Set until the backend has sent the last chunk / 后端发送最后一个分块前保持置位
+    pub streaming: bool,
+    pub format: String,
+    pub backend: String,
+    /// Audio bytes received from the backend / 从后端收到的音频字节数
+    pub bytes: u64,
+    pub error: Option<String>,
+}
+
+/// Phase of a realtime TTS session / 实时 TTS 会话的阶段
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum RtTtsPhase {
+    Init,
+    /// Text is accepted and synthesized as it arrives / 接收文本并在到达时合成
+    Streaming,
+    /// No more text; remaining audio is still coming / 不再接收文本；剩余音频仍在到来
+    Finishing,
+    /// All audio was queued / 全部音频均已排入队列
+    Done,
+    Error,
+}
+
+/// Text handed to the synthesis worker / 交给合成工作线程的文本
+#[derive(Clone, Debug)]
+pub struct RtTtsSegment {
+    /// Session generation, bumped by a clear / 会话代数，清空时递增
+    pub generation: u64,
+    pub seq: u64,
+    pub text: String,
+}
+
+#[derive(Debug)]
+pub struct RtTtsState {
+    pub phase: RtTtsPhase,
+    pub params: HashMap<String, Value>,
+    /// Text not cut into a segment yet / 尚未切分为片段的文本
+    pub pending: String,
+    /// Feeds the synthesis worker; dropped on close / 供给合成工作线程；关闭时丢弃
+    pub segments: Option<std::sync::mpsc::Sender<RtTtsSegment>>,
+    pub generation: u64,
+    pub next_seq: u64,
+    /// Segments sent to the worker and not finished / 已发送给工作线程且未完成的片段数
+    pub in_flight: usize,
+    pub recv_queue: VecDeque<Vec<u8>>,
+    pub recv_queue_bytes: usize,
+    pub max_recv_queue_bytes: usize,
+    pub segments_done: u64,
+    pub audio_bytes: u64,
+    pub backend: String,
+    pub format: String,
+    pub last_error: Option<String>,
+}
+
+impl Default for RtTtsState {
+    fn default() -> Self {
+        Self {
+            phase: RtTtsPhase::Init,
+            params: HashMap::new(),
+            pending: String::new(),
+            segments: None,
+            generation: 0,
+            next_seq: 0,
+            in_flight: 0,
+            recv_queue: VecDeque::new(),
+            recv_queue_bytes: 0,
+            max_recv_queue_bytes: 4 * 1024 * 1024,
+            segments_done: 0,
+            audio_bytes: 0,
+            backend: String::new(),
+            format: String::new(),
+            last_error: None,
+        }
+    }
 }
 
 #[derive(Clone, Copy, Debug, PartialEq, Eq)]
@@ -120,6 +220,8 @@ pub enum RtAsrConnState {
 pub enum RtAsrSendItem {
     Audio(Vec<u8>),
     WsText(String),
+    /// Fields to merge into each channel's provider session / 合并到各通道服务商会话的字段
+    SessionUpdate(serde_json::Map<String, Value>),
 }
 
 impl RtAsrSendItem {
@@ -127,6 +229,7 @@ impl RtAsrSendItem {
         match self {
             RtAsrSendItem::Audio(b) => b.len(),
             RtAsrSendItem::WsText(s) => s.len(),
+            RtAsrSendItem::SessionUpdate(m) => Value::Object(m.clone()).to_string().len(),
         }
     }
 }
@@ -214,12 +317,23 @@ pub struct RtAsrState {
     pub last_error: Option<String>,
     pub stub_connected: bool,
     pub stub_event_seq: u64,
+    /// Websocket reconnects so far / 迄今为止的 websocket 重连次数
+    pub reconnects: u64,
 
     pub segmentation: RtAsrSegmentationConfig,
     pub pending_flush: bool,
     pub buffered_audio_bytes_since_flush: usize,
     pub last_flush_at: std::time::Instant,
     pub last_audio_at: std::time::Instant,
+
+    pub detected_language: Option<DetectedLanguage>,
+    /// Session fields updated after CONNECT, replayed on reconnect
+    /// CONNECT 之后更新的会话字段，重连时重放
+    pub session_overrides: serde_json::Map<String, Value>,
+    /// Final transcripts still awaited after FINISH / FINISH 之后仍在等待的最终转写数
+    pub finals_pending: usize,
+    /// When FINISH stops waiting for them / FINISH 停止等待的时间
+    pub finish_deadline: Option<std::time::Instant>,
 }
 
 impl Default for RtAsrState {
@@ -238,12 +352,18 @@ impl Default for RtAsrState {
             last_error: None,
             stub_connected: false,
             stub_event_seq: 0,
+            reconnects: 0,
 
             segmentation: RtAsrSegmentationConfig::default(),
             pending_flush: false,
             buffered_audio_bytes_since_flush: 0,
             last_flush_at: now,
             last_audio_at: now,
+
+            detected_language: None,
+            session_overrides: serde_json::Map::new(),
+            finals_pending: 0,
+            finish_deadline: None,
         }
     }
 }
@@ -548,6 +668,9 @@ pub enum FdInner {
     Mic(MicState),
     UserStream(Box<UserStreamState>),
     UserStreamCtl(Box<UserStreamCtlState>),
+    Tts(TtsSessionState),
+    TtsAudio(TtsAudioState),
+    RtTts(Box<RtTtsState>),
 }
 
 #[derive(Debug)]
@@ -0,0 +1,385 @@
+//! Embedding API for running tasks / 运行任务的嵌入式 API
+//!
+//! [`TaskExecutionManager::invoke`] is the entry point for components that run tasks
+//! in-process, such as the desired-state scheduler or a platform embedding the spearlet.
+//! It takes an [`InvokeContext`] for cancellation and deadlines, names the task by id or
+//! by name, and returns a typed [`Invocation`] rather than the status strings and proto
+//! fields used on the wire.
+//! [`TaskExecutionManager::invoke`] 是进程内运行任务的组件（如期望状态调度器或嵌入 spearlet 的平台）
+//! 的入口。它接收用于取消与截止时间的 [`InvokeContext`]，按 ID 或名称指定任务，并返回类型化的
+//! [`Invocation`]，而非线上协议使用的状态字符串与 proto 字段。
+
+use std::collections::HashMap;
+use std::time::Duration;
+
+use tokio::time::Instant;
+use tokio_util::sync::CancellationToken;
+
+use super::debug_trace::DebugTrace;
+use super::manager::TaskExecutionManager;
+use super::manifest::{ExecutionManifest, ModelUse};
+use super::runtime::ExecutionMode;
+use super::{ExecutionError, ExecutionResponse, ExecutionResult, DEFAULT_ENTRY_FUNCTION_NAME};
+use crate::proto::spearlet::{ExecutionMode as ProtoExecutionMode, InvokeRequest, Payload};
+
+/// Cancellation and deadline for one call / 单次调用的取消与截止时间
+#[derive(Debug, Clone, Default)]
+pub struct InvokeContext {
+    deadline: Option<Instant>,
+    cancel: CancellationToken,
+}
+
+impl InvokeContext {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Give up `timeout` from now, keeping an earlier deadline / 从现在起 `timeout` 后放弃，保留更早的截止时间
+    pub fn with_timeout(self, timeout: Duration) -> Self {
+        self.with_deadline(Instant::now() + timeout)
+    }
+
+    pub fn with_deadline(mut self, deadline: Instant) -> Self {
+        self.deadline = Some(self.deadline.map_or(deadline, |d| d.min(deadline)));
+        self
+    }
+
+    /// Cancel the call when `token` is cancelled / 在 `token` 取消时取消调用
+    pub fn with_cancel(mut self, token: CancellationToken) -> Self {
+        self.cancel = token;
+        self
+    }
+
+    pub fn deadline(&self) -> Option<Instant> {
+        self.deadline
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        self.cancel.is_cancelled()
+    }
+}
+
+/// The task to run / 要运行的任务
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum TaskRef {
+    /// A task id; tasks not loaded yet are fetched from SMS / 任务 ID；尚未加载的任务会从 SMS 获取
+    Id(String),
+    /// The name of a loaded task / 已加载任务的名称
+    Name(String),
+}
+
+/// Options of one call; everything has a default / 单次调用的选项；均有默认值
+#[derive(Debug, Clone, Default)]
+pub struct InvokeOptions {
+    /// Entry function; the runtime picks one when unset / 入口函数；未设置时由运行时选择
+    pub function_name: Option<String>,
+    pub content_type: Option<String>,
+    /// `Async` returns once the execution started / `Async` 在执行开始后即返回
+    pub mode: ExecutionMode,
+    /// Ids to use instead of generated ones / 用于替代自动生成值的 ID
+    pub execution_id: Option<String>,
+    pub invocation_id: Option<String>,
+    pub headers: HashMap<String, String>,
+    pub metadata: HashMap<String, String>,
+}
+
+/// Where an execution stands / 执行所处的状态
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ExecutionState {
+    Pending,
+    Running,
+    Completed,
+    Failed,
+    Timeout,
+    Terminated,
+}
+
+impl ExecutionState {
+    /// Parse a status as stored in [`ExecutionResponse`] / 解析 [`ExecutionResponse`] 中保存的状态
+    pub fn parse(status: &str) -> Option<Self> {
+        Some(match status {
+            "pending" => Self::Pending,
+            "running" => Self::Running,
+            "completed" => Self::Completed,
+            "failed" => Self::Failed,
+            "timeout" => Self::Timeout,
+            "terminated" => Self::Terminated,
+            _ => return None,
+        })
+    }
+
+    pub fn is_finished(self) -> bool {
+        !matches!(self, Self::Pending | Self::Running)
+    }
+}
+
+/// Identifies an execution for later lookups / 标识执行，供之后查询
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ExecutionHandle {
+    pub task_id: String,
+    pub instance_id: String,
+    pub execution_id: String,
+    pub invocation_id: String,
+}
+
+/// Resources an execution used / 执行所用的资源
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct Usage {
+    /// Model backends called, from the execution manifest / 调用的模型后端，来自执行清单
+    pub models: Vec<ModelUse>,
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct Timing {
+    /// Time in the runtime / 在运行时中的耗时
+    pub execution_ms: u64,
+    /// Time from the call to its answer / 从调用到应答的耗时
+    pub total_ms: u64,
+}
+
+impl Timing {
+    /// Waiting for a permit, an instance or the execution loop / 等待许可、实例或执行循环的耗时
+    pub fn queued_ms(&self) -> u64 {
+        self.total_ms.saturating_sub(self.execution_ms)
+    }
+}
+
+/// Outcome of [`TaskExecutionManager::invoke`] / [`TaskExecutionManager::invoke`] 的结果
+#[derive(Debug, Clone)]
+pub struct Invocation {
+    pub handle: ExecutionHandle,
+    pub state: ExecutionState,
+    pub output: Vec<u8>,
+    /// Set when the workload failed / 工作负载失败时设置
+    pub error: Option<String>,
+    pub usage: Usage,
+    pub timing: Timing,
+    /// Set when metadata `spear.debug` asked for a trace / 元数据 `spear.debug` 请求追踪时设置
+    pub debug_trace: Option<DebugTrace>,
+    pub metadata: HashMap<String, String>,
+}
+
+impl Invocation {
+    fn from_response(resp: ExecutionResponse, total_ms: u64) -> Self {
+        let state = ExecutionState::parse(&resp.status).unwrap_or(ExecutionState::Failed);
+        let models = ExecutionManifest::from_metadata(&resp.metadata)
+            .map(|m| m.models)
+            .unwrap_or_default();
+        Self {
+            handle: ExecutionHandle {
+                task_id: resp.task_id,
+                instance_id: resp.instance_id,
+                execution_id: resp.execution_id,
+                invocation_id: resp.invocation_id,
+            },
+            state,
+            output: resp.output_data,
+            error: resp.error_message,
+            usage: Usage { models },
+            timing: Timing {
+                execution_ms: resp.execution_time_ms,
+                total_ms: total_ms.max(resp.execution_time_ms),
+            },
+            debug_trace: DebugTrace::from_metadata(&resp.metadata),
+            metadata: resp.metadata,
+        }
+    }
+
+    pub fn is_successful(&self) -> bool {
+        self.state == ExecutionState::Completed && self.error.is_none()
+    }
+}
+
+impl TaskExecutionManager {
+    /// Run a task and wait for it, or only for its start in `Async` mode
+    /// 运行任务并等待其完成；`Async` 模式下仅等待其开始
+    ///
+    /// Cancelling the context, or reaching its deadline, terminates the execution and
+    /// fails with `ExecutionTerminated` or `ExecutionTimeout`.
+    /// 取消上下文或到达其截止时间会终止执行，并以 `ExecutionTerminated` 或 `ExecutionTimeout` 失败。
+    pub async fn invoke(
+        &self,
+        ctx: &InvokeContext,
+        task: TaskRef,
+        input: Vec<u8>,
+        options: InvokeOptions,
+    ) -> ExecutionResult<Invocation> {
+        if ctx.is_cancelled() {
+            return Err(ExecutionError::ExecutionTerminated {
+                message: "context cancelled before start".to_string(),
+            });
+        }
+        let task_id = match task {
+            TaskRef::Id(id) => id,
+            TaskRef::Name(name) => match self.find_task(&name) {
+                Some(t) => t.id.clone(),
+                None => return Err(ExecutionError::TaskNotFound { id: name }),
+            },
+        };
+        let execution_id = options
+            .execution_id
+            .unwrap_or_else(|| format!("exec-{}", uuid::Uuid::new_v4()));
+        let started = Instant::now();
+        let timeout_ms = ctx
+            .deadline
+            .map(|d| d.saturating_duration_since(started).as_millis().max(1) as u64);
+        let mode = match options.mode {
+            ExecutionMode::Async => ProtoExecutionMode::Async,
+            ExecutionMode::Sync | ExecutionMode::Unknown => ProtoExecutionMode::Sync,
+        };
+        let req = InvokeRequest {
+            invocation_id: options.invocation_id.unwrap_or_default(),
+            execution_id: execution_id.clone(),
+            task_id,
+            function_name: options
+                .function_name
+                .unwrap_or_else(|| DEFAULT_ENTRY_FUNCTION_NAME.to_string()),
+            input: Some(Payload {
+                content_type: options
+                    .content_type
+                    .unwrap_or_else(|| "application/octet-stream".to_string()),
+                data: input,
+            }),
+            headers: options.headers,
+            timeout_ms: timeout_ms.unwrap_or(0),
+            mode: mode as i32,
+            metadata: options.metadata,
+            ..Default::default()
+        };
+
+        let deadline = async {
+            match ctx.deadline {
+                Some(d) => tokio::time::sleep_until(d).await,
+                None => std::future::pending().await,
+            }
+        };
+        let resp = tokio::select! {
+            r = self.submit_invocation(req) => r?,
+            _ = ctx.cancel.cancelled() => {
+                self.abandon(&execution_id, "context cancelled").await;
+                return Err(ExecutionError::ExecutionTerminated {
+                    message: "context cancelled".to_string(),
+                });
+            }
+            _ = deadline => {
+                self.abandon(&execution_id, "context deadline exceeded").await;
+                return Err(ExecutionError::ExecutionTimeout {
+                    timeout_ms: timeout_ms.unwrap_or(0),
+                });
+            }
+        };
+        let total_ms = started.elapsed().as_millis() as u64;
+        Ok(Invocation::from_response(resp, total_ms))
+    }
+
+    /// Current state of an execution started by [`invoke`](Self::invoke)
+    /// 由 [`invoke`](Self::invoke) 启动的执行的当前状态
+    pub async fn invocation(&self, handle: &ExecutionHandle) -> ExecutionResult<Invocation> {
+        let resp = self
+            .get_execution_status(&handle.execution_id)
+            .await?
+            .ok_or_else(|| ExecutionError::ExecutionNotFound {
+                id: handle.execution_id.clone(),
+            })?;
+        let total_ms = resp.execution_time_ms;
+        Ok(Invocation::from_response(resp, total_ms))
+    }
+
+    /// Stop an execution whose caller went away / 终止调用方已离开的执行
+    async fn abandon(&self, execution_id: &str, reason: &str) {
+        // Not found means it has not reached the manager yet, or already finished
+        // 未找到表示其尚未到达管理器，或已结束
+        let _ = self
+            .terminate_execution(execution_id, Some(reason.to_string()))
+            .await;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::manager::TaskExecutionManagerConfig;
+    use crate::spearlet::execution::runtime::RuntimeManager;
+    use std::sync::Arc;
+    use std::time::SystemTime;
+
+    #[test]
+    fn test_context_keeps_earliest_deadline() {
+        let now = Instant::now();
+        let ctx = InvokeContext::new()
+            .with_deadline(now + Duration::from_secs(1))
+            .with_timeout(Duration::from_secs(60));
+        assert_eq!(ctx.deadline(), Some(now + Duration::from_secs(1)));
+        assert!(!ctx.is_cancelled());
+    }
+
+    #[test]
+    fn test_invocation_from_response() {
+        let mut metadata = HashMap::new();
+        ExecutionManifest {
+            models: vec![ModelUse {
+                backend: "openai".to_string(),
+                model: "gpt-4o-mini".to_string(),
+                endpoint: "https://api.openai.com/v1".to_string(),
+            }],
+            ..Default::default()
+        }
+        .insert_into(&mut metadata);
+        let resp = ExecutionResponse {
+            execution_id: "exec-1".to_string(),
+            invocation_id: "inv-1".to_string(),
+            task_id: "task-1".to_string(),
+            function_name: "main".to_string(),
+            instance_id: "inst-1".to_string(),
+            output_data: b"ok".to_vec(),
+            status: "completed".to_string(),
+            error_message: None,
+            execution_time_ms: 40,
+            metadata,
+            timestamp: SystemTime::now(),
+            mono_ms: 0,
+        };
+        let inv = Invocation::from_response(resp, 55);
+        assert!(inv.is_successful());
+        assert_eq!(inv.handle.instance_id, "inst-1");
+        assert_eq!(inv.usage.models[0].model, "gpt-4o-mini");
+        assert_eq!(inv.timing.queued_ms(), 15);
+        assert_eq!(ExecutionState::parse("bogus"), None);
+    }
+
+    #[tokio::test]
+    async fn test_invoke_errors() {
+        let manager = TaskExecutionManager::new(
+            TaskExecutionManagerConfig::default(),
+            Arc::new(RuntimeManager::new()),
+            Arc::new(crate::spearlet::config::SpearletConfig::default()),
+            None,
+        )
+        .await
+        .unwrap();
+
+        let err = manager
+            .invoke(
+                &InvokeContext::new(),
+                TaskRef::Name("missing".to_string()),
+                Vec::new(),
+                InvokeOptions::default(),
+            )
+            .await
+            .unwrap_err();
+        assert!(matches!(err, ExecutionError::TaskNotFound { id } if id == "missing"));
+
+        let token = CancellationToken::new();
+        token.cancel();
+        let err = manager
+            .invoke(
+                &InvokeContext::new().with_cancel(token),
+                TaskRef::Id("task-1".to_string()),
+                Vec::new(),
+                InvokeOptions::default(),
+            )
+            .await
+            .unwrap_err();
+        assert!(matches!(err, ExecutionError::ExecutionTerminated { .. }));
+    }
+}
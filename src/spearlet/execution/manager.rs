@@ -8,22 +8,29 @@
 use super::runtime::RuntimeType;
 use super::{
     artifact::{Artifact, ArtifactId},
+    downloads::{
+        download_env_key, parse_download_specs, DownloadManager, DownloadProgress,
+        ENV_DOWNLOADS_DIR,
+    },
     instance::{InstanceId, InstanceStatus, TaskInstance},
     runtime::{ExecutionCompletionEvent, ExecutionContext, RuntimeManager},
     scheduler::{InstanceScheduler, SchedulingPolicy},
-    task::{Task, TaskId},
+    task::{LivenessProbeConfig, RestartPolicy, Task, TaskId},
     ExecutionError, ExecutionResult, DEFAULT_ENTRY_FUNCTION_NAME,
 };
 use crate::proto::spearlet::{ExecutionMode as ProtoExecutionMode, InvokeRequest};
+use crate::spearlet::node_services::NodeServices;
 use crate::spearlet::sms_connector::sms_channel_lazy;
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
 use dashmap::DashMap;
 use parking_lot::RwLock;
 use serde::{Deserialize, Serialize};
-use std::sync::atomic::{AtomicU64, Ordering};
-use std::sync::Arc;
+use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
+use std::sync::{Arc, Weak};
 use std::time::{Duration, Instant, SystemTime};
-use tokio::sync::{mpsc, oneshot, Semaphore};
+use tokio::sync::{broadcast, mpsc, oneshot, Semaphore};
 use tokio::time::timeout;
+use tokio_util::sync::CancellationToken;
 use tonic::transport::Channel;
 use tracing::{debug, info, warn};
 
@@ -53,6 +60,8 @@ pub struct TaskExecutionManagerConfig {
     pub instance_creation_timeout_ms: u64,
     /// Health check interval / 健康检查间隔
     pub health_check_interval_ms: u64,
+    /// Liveness probe scheduler tick / 存活探针调度周期
+    pub liveness_probe_tick_ms: u64,
     /// Metrics collection interval / 指标收集间隔
     pub metrics_collection_interval_ms: u64,
     /// Instance heartbeat interval to SMS / Instance 心跳上报间隔（给 SMS 刷新 last_seen）
@@ -76,6 +85,7 @@ impl Default for TaskExecutionManagerConfig {
             max_instances_per_task: 50,
             instance_creation_timeout_ms: 30000,
             health_check_interval_ms: 10000,
+            liveness_probe_tick_ms: 1000,
             metrics_collection_interval_ms: 5000,
             instance_heartbeat_interval_ms: 30000,
             cleanup_interval_ms: 60000,
@@ -86,6 +96,39 @@ impl Default for TaskExecutionManagerConfig {
     }
 }
 
+/// Liveness event kind / 存活事件类型
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum LivenessEventKind {
+    /// Instance missed its probe deadline / 实例未在截止时间内响应探针
+    Unhealthy,
+    /// Instance was replaced per restart policy / 按重启策略替换了实例
+    Restarted,
+    /// Restart budget exhausted, instance left stopped / 重启次数耗尽，实例保持停止
+    RestartLimitReached,
+}
+
+/// Liveness event emitted by the probe loop / 存活探针循环发出的事件
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct LivenessEvent {
+    /// Task ID / 任务 ID
+    pub task_id: String,
+    /// Instance ID / 实例 ID
+    pub instance_id: String,
+    /// Event kind / 事件类型
+    pub kind: LivenessEventKind,
+    /// Human readable reason / 可读原因
+    pub reason: String,
+    /// Event timestamp (ms) / 事件时间戳（毫秒）
+    pub timestamp_ms: i64,
+}
+
+#[derive(Debug, Clone)]
+struct LivenessProbeState {
+    last_probe: Instant,
+    consecutive_failures: u32,
+}
+
 #[derive(Debug)]
 struct ExecutionWorkItem {
     /// Execution ID / 执行 ID
@@ -181,6 +224,8 @@ pub struct TaskExecutionManager {
     executions: Arc<DashMap<String, super::ExecutionResponse>>,
     /// Execution semaphore / 执行信号量
     execution_semaphore: Arc<Semaphore>,
+    /// Current size of the execution semaphore / 执行信号量的当前大小
+    concurrency_limit: Arc<AtomicUsize>,
     /// Statistics / 统计信息
     statistics: Arc<RwLock<ExecutionStatistics>>,
     /// Request counter / 请求计数器
@@ -189,9 +234,23 @@ pub struct TaskExecutionManager {
     work_sender: mpsc::UnboundedSender<ExecutionWorkItem>,
     completion_sender: mpsc::UnboundedSender<ExecutionCompletionEvent>,
     pending_async_executions: Arc<DashMap<String, PendingAsyncExecution>>,
+    /// Completion webhooks by execution ID / 按执行 ID 索引的完成 webhook
+    webhook_callbacks: Arc<DashMap<String, crate::spearlet::webhook::Callback>>,
     sms_channel: Option<Channel>,
+    /// Liveness probe state per instance / 每个实例的存活探针状态
+    liveness_states: Arc<DashMap<InstanceId, LivenessProbeState>>,
+    /// Liveness restarts per task / 每个任务的存活重启次数
+    liveness_restarts: Arc<DashMap<TaskId, u32>>,
+    /// Liveness event broadcaster / 存活事件广播器
+    liveness_events: broadcast::Sender<LivenessEvent>,
+    /// Workload artifact downloads / 工作负载 artifact 下载
+    download_manager: Arc<DownloadManager>,
+    /// Node-local services shared with the runtimes / 与运行时共享的节点本地服务
+    node: Arc<NodeServices>,
     /// Shutdown signal / 关闭信号
     shutdown_sender: Option<oneshot::Sender<()>>,
+    /// Stops the loops that only hold a weak reference / 停止仅持有弱引用的循环
+    shutdown_token: CancellationToken,
 }
 
 impl TaskExecutionManager {
@@ -201,6 +260,25 @@ impl TaskExecutionManager {
         runtime_manager: Arc<RuntimeManager>,
         spearlet_config: Arc<crate::spearlet::config::SpearletConfig>,
         sms_channel: Option<Channel>,
+    ) -> ExecutionResult<Arc<Self>> {
+        Self::with_node(
+            config,
+            runtime_manager,
+            spearlet_config,
+            sms_channel,
+            NodeServices::new(),
+        )
+        .await
+    }
+
+    /// Create a manager using the node services its runtimes were given
+    /// 创建使用其运行时所获节点服务的管理器
+    pub async fn with_node(
+        config: TaskExecutionManagerConfig,
+        runtime_manager: Arc<RuntimeManager>,
+        spearlet_config: Arc<crate::spearlet::config::SpearletConfig>,
+        sms_channel: Option<Channel>,
+        node: Arc<NodeServices>,
     ) -> ExecutionResult<Arc<Self>> {
         let scheduler = Arc::new(InstanceScheduler::new(SchedulingPolicy::RoundRobin));
         let execution_semaphore = Arc::new(Semaphore::new(config.max_concurrent_executions));
@@ -208,6 +286,11 @@ impl TaskExecutionManager {
         let (work_sender, work_receiver) = mpsc::unbounded_channel();
         let (shutdown_sender, shutdown_receiver) = oneshot::channel();
         let (completion_sender, completion_receiver) = mpsc::unbounded_channel();
+        let (liveness_events, _) = broadcast::channel(256);
+        let download_manager = Arc::new(DownloadManager::new(
+            &spearlet_config.downloads,
+            &spearlet_config.storage.data_dir,
+        ));
 
         let sms_channel = if let Some(ch) = sms_channel {
             Some(ch)
@@ -231,61 +314,165 @@ impl TaskExecutionManager {
             instances: Arc::new(DashMap::new()),
             executions: Arc::new(DashMap::new()),
             execution_semaphore,
+            concurrency_limit: Arc::new(AtomicUsize::new(config.max_concurrent_executions)),
             statistics: Arc::new(RwLock::new(ExecutionStatistics::default())),
             request_counter: AtomicU64::new(0),
             work_sender,
             completion_sender,
             pending_async_executions: Arc::new(DashMap::new()),
+            webhook_callbacks: Arc::new(DashMap::new()),
             sms_channel,
+            liveness_states: Arc::new(DashMap::new()),
+            liveness_restarts: Arc::new(DashMap::new()),
+            liveness_events,
+            download_manager,
+            node,
             shutdown_sender: Some(shutdown_sender),
+            shutdown_token: CancellationToken::new(),
         });
 
-        // Start background tasks / 启动后台任务
+        manager.node.child_invoke.set_manager(&manager);
+
+        // Start background tasks under supervision / 在监督下启动后台任务
+        let work_receiver = Arc::new(tokio::sync::Mutex::new(work_receiver));
+        let shutdown_receiver = Arc::new(tokio::sync::Mutex::new(shutdown_receiver));
+        let completion_receiver = Arc::new(tokio::sync::Mutex::new(completion_receiver));
+
         let manager_clone = manager.clone();
-        tokio::spawn(async move {
-            manager_clone
-                .run_execution_work_loop(work_receiver, shutdown_receiver)
-                .await;
+        supervise("execution-work-loop", RestartPolicy::default(), move || {
+            let manager = manager_clone.clone();
+            let work_receiver = work_receiver.clone();
+            let shutdown_receiver = shutdown_receiver.clone();
+            async move {
+                manager
+                    .run_execution_work_loop(work_receiver, shutdown_receiver)
+                    .await
+            }
         });
 
         let manager_clone = manager.clone();
-        tokio::spawn(async move {
-            manager_clone.run_health_check_loop().await;
+        supervise("health-check-loop", RestartPolicy::default(), move || {
+            let manager = manager_clone.clone();
+            async move { manager.run_health_check_loop().await }
         });
 
-        let manager_clone = manager.clone();
-        tokio::spawn(async move {
-            manager_clone
-                .run_async_completion_loop(completion_receiver)
-                .await;
+        // Weak, so the probe loop does not keep a dropped manager alive
+        // 使用弱引用，探针循环不会让已丢弃的管理器继续存活
+        let weak = Arc::downgrade(&manager);
+        let shutdown = manager.shutdown_token.clone();
+        supervise("liveness-probe-loop", RestartPolicy::default(), move || {
+            Self::run_liveness_probe_loop(weak.clone(), shutdown.clone())
         });
 
         let manager_clone = manager.clone();
-        tokio::spawn(async move {
-            manager_clone.run_metrics_collection_loop().await;
-        });
+        supervise(
+            "async-completion-loop",
+            RestartPolicy::default(),
+            move || {
+                let manager = manager_clone.clone();
+                let completion_receiver = completion_receiver.clone();
+                async move { manager.run_async_completion_loop(completion_receiver).await }
+            },
+        );
 
         let manager_clone = manager.clone();
-        tokio::spawn(async move {
-            manager_clone.as_ref().run_instance_heartbeat_loop().await;
+        supervise(
+            "metrics-collection-loop",
+            RestartPolicy::default(),
+            move || {
+                let manager = manager_clone.clone();
+                async move { manager.run_metrics_collection_loop().await }
+            },
+        );
+
+        let manager_clone = manager.clone();
+        supervise(
+            "instance-heartbeat-loop",
+            RestartPolicy::default(),
+            move || {
+                let manager = manager_clone.clone();
+                async move { manager.run_instance_heartbeat_loop().await }
+            },
+        );
+
+        let manager_clone = manager.clone();
+        supervise("cleanup-loop", RestartPolicy::default(), move || {
+            let manager = manager_clone.clone();
+            async move { manager.run_cleanup_loop().await }
         });
 
         let manager_clone = manager.clone();
-        tokio::spawn(async move {
-            manager_clone.run_cleanup_loop().await;
+        supervise("schedule-loop", RestartPolicy::default(), move || {
+            let manager = manager_clone.clone();
+            async move { manager.run_schedule_loop().await }
         });
 
         info!("TaskExecutionManager started with config: {:?}", config);
         Ok(manager)
     }
 
+    /// Artifact download progress for a task / 任务的 artifact 下载进度
+    pub fn download_progress(&self, task_id: &str) -> Vec<DownloadProgress> {
+        self.download_manager.progress(task_id)
+    }
+
+    /// Subscribe to liveness events / 订阅存活事件
+    pub fn subscribe_liveness_events(&self) -> broadcast::Receiver<LivenessEvent> {
+        self.liveness_events.subscribe()
+    }
+
     pub fn list_runtime_types(&self) -> Vec<RuntimeType> {
         self.runtime_manager.list_runtime_types()
     }
 
+    /// Async executions still waiting for completion / 仍在等待完成的异步执行数
+    pub fn pending_async_count(&self) -> usize {
+        self.pending_async_executions.len()
+    }
+
+    /// Node-local services of this spearlet / 本 spearlet 的节点本地服务
+    pub fn node(&self) -> &Arc<NodeServices> {
+        &self.node
+    }
+
     pub async fn submit_invocation(
         &self,
         request: InvokeRequest,
+    ) -> ExecutionResult<super::ExecutionResponse> {
+        self.submit(request, false).await
+    }
+
+    /// Submit async requests the journal still holds from an earlier run
+    /// 重新提交日志中仍保存的上次运行的异步请求
+    pub fn replay_async_journal(self: &Arc<Self>) {
+        let manager = self.clone();
+        tokio::spawn(async move {
+            let pending = manager.node.async_journal.pending().await;
+            if pending.is_empty() {
+                return;
+            }
+            info!(
+                jobs = pending.len(),
+                "Submitting async jobs left by an earlier run"
+            );
+            for job in pending {
+                let execution_id = job.execution_id.clone();
+                if let Err(e) = manager.submit(job.to_request(), true).await {
+                    warn!(execution_id = %execution_id, error = %e, "Replaying async job failed");
+                    manager
+                        .node
+                        .async_journal
+                        .complete(&execution_id, "failed")
+                        .await;
+                }
+            }
+        });
+    }
+
+    async fn submit(
+        &self,
+        request: InvokeRequest,
+        replay: bool,
     ) -> ExecutionResult<super::ExecutionResponse> {
         if request.task_id.is_empty() {
             return Err(ExecutionError::InvalidRequest {
@@ -293,21 +480,6 @@ impl TaskExecutionManager {
             });
         }
 
-        let execution_id = if request.execution_id.is_empty() {
-            format!(
-                "req-{}",
-                self.request_counter.fetch_add(1, Ordering::SeqCst)
-            )
-        } else {
-            request.execution_id.clone()
-        };
-
-        let invocation_id = if request.invocation_id.is_empty() {
-            execution_id.clone()
-        } else {
-            request.invocation_id.clone()
-        };
-
         let mode =
             ProtoExecutionMode::try_from(request.mode).unwrap_or(ProtoExecutionMode::Unspecified);
         let execution_mode = match mode {
@@ -322,6 +494,25 @@ impl TaskExecutionManager {
             execution_mode,
             crate::spearlet::execution::runtime::ExecutionMode::Sync
         );
+        let journal = !wait && self.node.async_journal.enabled();
+
+        let execution_id = if !request.execution_id.is_empty() {
+            request.execution_id.clone()
+        } else if journal {
+            // Journaled ids must not repeat after a restart / 记入日志的 ID 在重启后不得重复
+            format!("req-{}", uuid::Uuid::new_v4())
+        } else {
+            format!(
+                "req-{}",
+                self.request_counter.fetch_add(1, Ordering::SeqCst)
+            )
+        };
+
+        let invocation_id = if request.invocation_id.is_empty() {
+            execution_id.clone()
+        } else {
+            request.invocation_id.clone()
+        };
 
         let input = request.input.clone().unwrap_or_default();
         let function_name = if request.function_name.is_empty() {
@@ -330,10 +521,37 @@ impl TaskExecutionManager {
             request.function_name.clone()
         };
 
+        // Callback keys never reach the workload / 回调键不会传给工作负载
+        let mut metadata = request.metadata.clone();
+        let callback =
+            crate::spearlet::webhook::take_callback(&mut metadata, &self.spearlet_config.webhook)
+                .map_err(|message| ExecutionError::InvalidRequest { message })?;
+        if callback.is_some() && wait {
+            return Err(ExecutionError::InvalidRequest {
+                message: "callback_url requires async mode".to_string(),
+            });
+        }
+        if journal && !replay {
+            if let Some(earlier) = self.journal_async(&request, &execution_id).await? {
+                return Ok(earlier);
+            }
+        }
+
         let mut context_data = std::collections::HashMap::new();
-        for (k, v) in request.metadata.iter() {
+        for (k, v) in metadata.iter() {
             context_data.insert(k.clone(), serde_json::Value::String(v.clone()));
         }
+        self.node.run_records.begin_run(
+            &execution_id,
+            request
+                .metadata
+                .get(super::manifest::PROMPT_TEMPLATE_VERSION_KEY)
+                .cloned(),
+        );
+        let trace_cfg = &self.spearlet_config.execution.debug_trace;
+        if trace_cfg.enabled && super::debug_trace::requested(&request.metadata) {
+            self.node.debug_traces.begin(&execution_id, trace_cfg);
+        }
 
         let execution_context = ExecutionContext {
             execution_id: execution_id.clone(),
@@ -365,6 +583,7 @@ impl TaskExecutionManager {
                 execution_time_ms: 0,
                 metadata: std::collections::HashMap::new(),
                 timestamp: SystemTime::now(),
+                mono_ms: crate::spearlet::clock::mono_ms(),
             },
         );
 
@@ -377,21 +596,77 @@ impl TaskExecutionManager {
             timestamp,
         };
 
+        if let Some(callback) = callback {
+            self.webhook_callbacks
+                .insert(execution_id.clone(), callback);
+        }
+
         // Send to execution loop / 发送到执行循环
-        self.work_sender
-            .send(work_item)
-            .map_err(|_| ExecutionError::RuntimeError {
-                message: "Failed to submit execution request".to_string(),
-            })?;
+        if self.work_sender.send(work_item).is_err() {
+            self.webhook_callbacks.remove(&execution_id);
+            if journal && !replay {
+                self.node.async_journal.forget(&execution_id).await;
+            }
+            return Err(ExecutionError::ChannelClosed {
+                message: "execution loop is not running".to_string(),
+            });
+        }
 
         // Wait for response / 等待响应
         response_receiver
             .await
-            .map_err(|_| ExecutionError::RuntimeError {
-                message: "Execution request was cancelled".to_string(),
+            .map_err(|_| ExecutionError::ChannelClosed {
+                message: "execution request was dropped before completing".to_string(),
             })?
     }
 
+    /// Record an async request before it is queued; returns the earlier execution when the
+    /// request repeats one
+    /// 在排队前记录异步请求；请求重复时返回先前的执行
+    async fn journal_async(
+        &self,
+        request: &InvokeRequest,
+        execution_id: &str,
+    ) -> ExecutionResult<Option<super::ExecutionResponse>> {
+        use crate::spearlet::async_journal::{Admission, JournalError};
+        match self.node.async_journal.accept(request, execution_id).await {
+            Ok(Admission::Accepted) | Err(JournalError::Disabled) => Ok(None),
+            Ok(Admission::Duplicate {
+                execution_id,
+                status,
+            }) => {
+                debug!(execution_id = %execution_id, "Repeated async request answered by the journal");
+                // Output of a finished job is only known while its record is kept
+                // 已结束任务的输出仅在其记录保留期间可知
+                let earlier = self
+                    .executions
+                    .get(&execution_id)
+                    .map(|e| e.value().clone())
+                    .unwrap_or_else(|| super::ExecutionResponse {
+                        execution_id: execution_id.clone(),
+                        invocation_id: execution_id.clone(),
+                        task_id: request.task_id.clone(),
+                        function_name: request.function_name.clone(),
+                        instance_id: String::new(),
+                        output_data: Vec::new(),
+                        status,
+                        error_message: None,
+                        execution_time_ms: 0,
+                        metadata: std::collections::HashMap::new(),
+                        timestamp: SystemTime::now(),
+                        mono_ms: crate::spearlet::clock::mono_ms(),
+                    });
+                Ok(Some(earlier))
+            }
+            Err(JournalError::Full(n)) => Err(ExecutionError::ResourceExhausted {
+                message: format!("{} async jobs are pending", n),
+            }),
+            Err(e) => Err(ExecutionError::RuntimeError {
+                message: e.to_string(),
+            }),
+        }
+    }
+
     /// Get artifact by ID / 根据 ID 获取 artifact
     pub fn get_artifact(&self, artifact_id: &ArtifactId) -> Option<Arc<Artifact>> {
         self.artifacts.get(artifact_id).map(|entry| entry.clone())
@@ -442,6 +717,35 @@ impl TaskExecutionManager {
         stats
     }
 
+    /// Record the reproducibility manifest, and the debug trace if one was asked for, in
+    /// result metadata, then drop the state kept while the execution ran
+    /// 将可复现性清单以及（如有请求）调试追踪写入结果元数据，然后清理执行期间保存的状态
+    fn attach_manifest(
+        &self,
+        task_id: &str,
+        execution_id: &str,
+        metadata: &mut std::collections::HashMap<String, String>,
+    ) {
+        let task = self.tasks.get(task_id).map(|t| t.value().clone());
+        let artifact = task.as_ref().and_then(|t| {
+            self.artifacts
+                .get(&t.artifact_id)
+                .map(|a| a.value().clone())
+        });
+        super::manifest::ExecutionManifest::build(
+            task.as_deref(),
+            artifact.as_deref(),
+            self.node.run_records.finish_run(execution_id),
+        )
+        .insert_into(metadata);
+        if let Some(trace) = self.node.debug_traces.finish(execution_id) {
+            trace.insert_into(metadata);
+        }
+        self.node.output_caps.finish(execution_id);
+        self.node.compute_hints.end(execution_id);
+        self.node.child_invoke.finish_parent(execution_id);
+    }
+
     /// Get execution status by execution ID / 根据执行ID获取执行状态
     pub async fn get_execution_status(
         &self,
@@ -459,15 +763,13 @@ impl TaskExecutionManager {
         reason: Option<String>,
     ) -> ExecutionResult<()> {
         if !self.executions.contains_key(execution_id) {
-            return Err(ExecutionError::InvalidRequest {
-                message: format!("execution not found: {}", execution_id),
+            return Err(ExecutionError::ExecutionNotFound {
+                id: execution_id.to_string(),
             });
         }
-        crate::spearlet::execution::host_api::termination::mark_execution_terminated(
-            execution_id,
-            -libc::ECANCELED,
-            reason,
-        );
+        self.node
+            .terminations
+            .mark_execution_terminated(execution_id, -libc::ECANCELED, reason);
         Ok(())
     }
 
@@ -484,7 +786,7 @@ impl TaskExecutionManager {
                 id: instance_id.to_string(),
             })?;
 
-        crate::spearlet::execution::host_api::termination::mark_instance_destroyed(
+        self.node.terminations.mark_instance_destroyed(
             instance_id,
             -libc::ECANCELED,
             reason.clone(),
@@ -498,7 +800,7 @@ impl TaskExecutionManager {
             .collect();
 
         for execution_id in running_exec_ids {
-            crate::spearlet::execution::host_api::termination::mark_execution_terminated(
+            self.node.terminations.mark_execution_terminated(
                 &execution_id,
                 -libc::ECANCELED,
                 reason
@@ -529,18 +831,66 @@ impl TaskExecutionManager {
             items.retain(|r| r.invocation_id == invocation_id);
         }
 
-        items.sort_by(|a, b| b.timestamp.cmp(&a.timestamp));
+        // Wall-clock steps must not reorder records / 墙上时钟跳变不应打乱记录顺序
+        items.sort_by(|a, b| b.mono_ms.cmp(&a.mono_ms));
         if limit > 0 && items.len() > limit {
             items.truncate(limit);
         }
         items
     }
 
+    /// Destroy every instance, e.g. on process shutdown; returns how many stopped
+    /// 销毁所有实例（如进程关闭时）；返回停止的数量
+    pub async fn stop_all_instances(&self, reason: &str) -> usize {
+        let ids: Vec<String> = self.instances.iter().map(|e| e.key().clone()).collect();
+        let mut stopped = 0;
+        for id in ids {
+            match self.destroy_instance(&id, Some(reason.to_string())).await {
+                Ok(()) => stopped += 1,
+                Err(e) => warn!("Failed to stop instance {}: {}", id, e),
+            }
+        }
+        stopped
+    }
+
+    /// Resize the execution semaphore at runtime / 运行时调整执行信号量大小
+    ///
+    /// A smaller limit takes effect as running executions finish.
+    /// 缩小的上限会随运行中的执行结束而生效。
+    pub fn set_max_concurrent_executions(&self, limit: usize) {
+        let limit = limit.max(1);
+        let previous = self.concurrency_limit.swap(limit, Ordering::SeqCst);
+        if limit > previous {
+            self.execution_semaphore.add_permits(limit - previous);
+        } else if limit < previous {
+            let semaphore = self.execution_semaphore.clone();
+            let excess = (previous - limit) as u32;
+            tokio::spawn(async move {
+                if let Ok(permits) = semaphore.acquire_many_owned(excess).await {
+                    permits.forget();
+                }
+            });
+        }
+        if limit != previous {
+            info!(
+                from = previous,
+                to = limit,
+                "Execution concurrency limit changed"
+            );
+        }
+    }
+
+    /// Current execution concurrency limit / 当前执行并发上限
+    pub fn max_concurrent_executions(&self) -> usize {
+        self.concurrency_limit.load(Ordering::SeqCst)
+    }
+
     /// Shutdown the manager / 关闭管理器
     pub async fn shutdown(&mut self) -> ExecutionResult<()> {
         if let Some(sender) = self.shutdown_sender.take() {
             let _ = sender.send(());
         }
+        self.shutdown_token.cancel();
 
         // Stop all instances / 停止所有实例
         for instance_entry in self.instances.iter() {
@@ -557,10 +907,12 @@ impl TaskExecutionManager {
     /// Main execution loop / 主执行循环
     async fn run_execution_work_loop(
         &self,
-        mut work_receiver: mpsc::UnboundedReceiver<ExecutionWorkItem>,
-        mut shutdown_receiver: oneshot::Receiver<()>,
+        work_receiver: Arc<tokio::sync::Mutex<mpsc::UnboundedReceiver<ExecutionWorkItem>>>,
+        shutdown_receiver: Arc<tokio::sync::Mutex<oneshot::Receiver<()>>>,
     ) {
         info!("Starting execution loop");
+        let mut work_receiver = work_receiver.lock().await;
+        let mut shutdown_receiver = shutdown_receiver.lock().await;
 
         loop {
             tokio::select! {
@@ -568,7 +920,7 @@ impl TaskExecutionManager {
                     let manager = self.clone();
                     tokio::spawn(async move { manager.process_execution_work_item(request).await });
                 }
-                _ = &mut shutdown_receiver => {
+                _ = &mut *shutdown_receiver => {
                     info!("Execution loop shutting down");
                     break;
                 }
@@ -577,11 +929,19 @@ impl TaskExecutionManager {
     }
 
     async fn process_execution_work_item(&self, request: ExecutionWorkItem) {
-        let start_time = Instant::now();
         let execution_id = request.execution_id.clone();
         let function_name = request.execution_context.function_name.clone();
         debug!(execution_id = %execution_id, "Execution request received");
 
+        // Async work stays pending while energy is critical / 能耗处于 critical 时异步任务保持 pending
+        if !request.execution_context.wait {
+            let held = self.node.energy.defer_while_critical().await;
+            if !held.is_zero() {
+                debug!(execution_id = %execution_id, held_ms = held.as_millis() as u64, "Async execution deferred by energy governor");
+            }
+        }
+        let start_time = Instant::now();
+
         // Update statistics / 更新统计信息
         {
             let mut stats = self.statistics.write();
@@ -607,29 +967,99 @@ impl TaskExecutionManager {
                 execution_time_ms: 0,
                 metadata: std::collections::HashMap::new(),
                 timestamp: SystemTime::now(),
+                mono_ms: crate::spearlet::clock::mono_ms(),
             });
 
-        // Acquire execution permit / 获取执行许可
-        let _permit = match self.execution_semaphore.acquire().await {
-            Ok(permit) => permit,
-            Err(_) => {
+        // Other tasks' compute boosts may hold this one / 其他任务的计算提升可能暂缓本次执行
+        let (_compute_permit, held) = self
+            .node
+            .compute_hints
+            .admit(&request.task_id, request.execution_context.wait)
+            .await;
+        if !held.is_zero() {
+            debug!(execution_id = %execution_id, held_ms = held.as_millis() as u64, "Execution deferred by compute boost");
+        }
+
+        // Energy cap applies on top of the configured limit / 能耗上限叠加在配置的上限之上
+        let _energy_permit = self.node.energy.acquire().await;
+
+        let preemption = &self.node.preemption;
+        let task_config = self
+            .tasks
+            .get(&request.task_id)
+            .map(|t| t.spec.task_config.clone());
+        let priority = preemption.priority(&request.task_id, task_config.as_ref());
+        // Only WASM executions stop at a termination mark / 只有 WASM 执行会在终止标记处停止
+        let preemptible = self
+            .tasks
+            .get(&request.task_id)
+            .is_some_and(|t| t.spec.runtime_type == super::RuntimeType::Wasm);
+        let mut requeues = 0;
+        let mut result = loop {
+            // Acquire execution permit / 获取执行许可
+            let Some(_permit) = self
+                .acquire_execution_permit(&execution_id, priority, request.execution_context.wait)
+                .await
+            else {
                 let _ = request
                     .response_sender
                     .send(Err(ExecutionError::RuntimeError {
                         message: "Failed to acquire execution permit".to_string(),
                     }));
                 warn!(execution_id = %execution_id, "Failed to acquire execution permit");
+                self.webhook_callbacks.remove(&execution_id);
                 return;
+            };
+            let slot =
+                preemptible.then(|| preemption.begin(&execution_id, &request.task_id, priority));
+            debug!(execution_id = %execution_id, invocation_id = %request.invocation_id, "Starting execution");
+            let result = self
+                .execute_existing_task_invocation(
+                    request.invocation_id.clone(),
+                    Some(request.task_id.clone()),
+                    request.execution_context.clone(),
+                )
+                .await;
+            let failed = match &result {
+                Ok(resp) => resp.is_completed() && !resp.is_successful(),
+                Err(_) => true,
+            };
+            let action = if failed {
+                preemption.take_victim(&execution_id, requeues)
+            } else {
+                None
+            };
+            drop(slot);
+            if action == Some(crate::spearlet::preemption::PreemptAction::Requeue) {
+                // Runs again from the start once a slot is free / 有空闲槽位后从头重新运行
+                requeues += 1;
+                self.node
+                    .terminations
+                    .clear_execution_termination(&execution_id);
+                info!(execution_id = %execution_id, requeues, "Preempted execution requeued");
+                continue;
             }
+            break result;
         };
-        debug!(execution_id = %execution_id, invocation_id = %request.invocation_id, "Starting execution");
-        let result = self
-            .execute_existing_task_invocation(
-                request.invocation_id.clone(),
-                Some(request.task_id.clone()),
-                request.execution_context,
-            )
-            .await;
+        // The final response counts towards the byte cap / 最终响应计入字节上限
+        if let Ok(resp) = &result {
+            if resp.is_completed() {
+                if let Err(message) = self
+                    .node
+                    .output_caps
+                    .check_response(&execution_id, resp.output_data.len())
+                {
+                    warn!(execution_id = %execution_id, reason = %message, "Execution output capped");
+                    result = Err(ExecutionError::ExecutionTerminated { message });
+                }
+            }
+        }
+        if let Ok(resp) = result.as_mut() {
+            // Async runs get their manifest on completion / 异步执行在完成时生成清单
+            if resp.status != "running" {
+                self.attach_manifest(&request.task_id, &execution_id, &mut resp.metadata);
+            }
+        }
 
         let execution_time = start_time.elapsed();
         let execution_time_ms = execution_time.as_millis() as u64;
@@ -663,6 +1093,19 @@ impl TaskExecutionManager {
                 _ => {}
             }
         }
+        match &result {
+            Ok(resp) if resp.is_completed() => self.node.metrics_window.record_execution(
+                &request.task_id,
+                execution_time_ms,
+                !resp.is_successful(),
+            ),
+            Err(_) => {
+                self.node
+                    .metrics_window
+                    .record_execution(&request.task_id, execution_time_ms, true)
+            }
+            _ => {}
+        }
 
         match &result {
             Ok(resp) => {
@@ -681,6 +1124,8 @@ impl TaskExecutionManager {
                     .get(&execution_id)
                     .map(|entry| entry.value().instance_id.clone())
                     .unwrap_or_default();
+                let mut metadata = std::collections::HashMap::new();
+                self.attach_manifest(&request.task_id, &execution_id, &mut metadata);
                 self.executions.insert(
                     execution_id.clone(),
                     super::ExecutionResponse {
@@ -693,13 +1138,29 @@ impl TaskExecutionManager {
                         status,
                         error_message: Some(e.to_string()),
                         execution_time_ms,
-                        metadata: std::collections::HashMap::new(),
+                        metadata,
                         timestamp: SystemTime::now(),
+                        mono_ms: crate::spearlet::clock::mono_ms(),
                     },
                 );
             }
         }
 
+        // Async runs still running are reported on completion / 仍在运行的异步执行在完成时回调
+        let finished = self
+            .executions
+            .get(&execution_id)
+            .map(|entry| entry.value().clone());
+        if let Some(resp) = finished {
+            if resp.status != "running" {
+                self.node
+                    .async_journal
+                    .complete(&execution_id, &resp.status)
+                    .await;
+                self.dispatch_webhook(&resp);
+            }
+        }
+
         // Publish task result to SMS / 将任务结果回写到SMS
         match &result {
             Ok(resp) if resp.is_completed() => {
@@ -728,7 +1189,11 @@ impl TaskExecutionManager {
             }
             Err(e) => {
                 let completed_at = chrono::Utc::now().timestamp();
-                let mut meta = std::collections::HashMap::new();
+                let mut meta = self
+                    .executions
+                    .get(&execution_id)
+                    .map(|entry| entry.value().metadata.clone())
+                    .unwrap_or_default();
                 meta.insert(
                     "execution_time_ms".to_string(),
                     execution_time_ms.to_string(),
@@ -755,6 +1220,42 @@ impl TaskExecutionManager {
         let _ = request.response_sender.send(result);
     }
 
+    /// Acquire an execution permit, preempting lower-priority executions when allowed
+    /// 获取执行许可，在允许时抢占较低优先级的执行
+    ///
+    /// Every `wait_ms` without a permit preempts one more execution, since the permits it
+    /// frees may go to invocations queued earlier.
+    /// 每经过 `wait_ms` 仍未获得许可就再抢占一个执行，因为释放的许可可能先分给更早排队的调用。
+    async fn acquire_execution_permit(
+        &self,
+        execution_id: &str,
+        priority: i32,
+        interactive: bool,
+    ) -> Option<tokio::sync::SemaphorePermit<'_>> {
+        let preemption = &self.node.preemption;
+        let acquire = self.execution_semaphore.acquire();
+        tokio::pin!(acquire);
+        let Some(wait) = preemption.preemptor_wait(priority, interactive) else {
+            return acquire.await.ok();
+        };
+        loop {
+            match tokio::time::timeout(wait, &mut acquire).await {
+                Ok(permit) => return permit.ok(),
+                Err(_) => {
+                    let Some(victim) = preemption.pick_victim(priority) else {
+                        return acquire.await.ok();
+                    };
+                    info!(execution_id = %execution_id, victim = %victim, "Preempting a lower-priority execution");
+                    self.node.terminations.mark_execution_terminated(
+                        &victim,
+                        -libc::ECANCELED,
+                        Some(format!("preempted by {}", execution_id)),
+                    );
+                }
+            }
+        }
+    }
+
     /// Execute an invocation against an existing task / 执行一次对已有 task 的调用
     async fn execute_existing_task_invocation(
         &self,
@@ -781,16 +1282,34 @@ impl TaskExecutionManager {
         let runtime = self
             .runtime_manager
             .get_runtime(&task.spec.runtime_type)
-            .ok_or_else(|| ExecutionError::RuntimeError {
-                message: format!("Runtime not found for type: {:?}", task.spec.runtime_type),
+            .ok_or_else(|| ExecutionError::RuntimeNotFound {
+                runtime_type: format!("{:?}", task.spec.runtime_type),
             })?;
         let execution_id = execution_context.execution_id.clone();
+        self.node.output_caps.begin(
+            &execution_id,
+            super::output_caps::OutputCaps::for_task(
+                &self.spearlet_config.execution.output_caps,
+                &task.spec.task_config,
+            ),
+        );
+        // Tasks declared compute-heavy run boosted / 声明为计算密集的任务以提升状态运行
+        if let Some(resource) = task
+            .spec
+            .task_config
+            .get(crate::spearlet::compute_hints::TASK_CONFIG_COMPUTE_HINT)
+            .and_then(|v| crate::spearlet::compute_hints::ComputeResource::parse(v))
+        {
+            self.node
+                .compute_hints
+                .begin(&execution_id, task.id(), resource, None);
+        }
         let started_at_ms = chrono::Utc::now().timestamp_millis();
         let mut log_next_seq: u64 = 1;
         let mut wasm_last_seq: u64 = 0;
 
         if instance.config.runtime_type == super::RuntimeType::Wasm {
-            crate::spearlet::execution::host_api::clear_wasm_logs_by_execution(&execution_id);
+            self.node.wasm_logs.clear_by_execution(&execution_id);
         }
 
         self.report_instance_to_sms(
@@ -941,6 +1460,7 @@ impl TaskExecutionManager {
                 error_message: None,
                 metadata,
                 timestamp: SystemTime::now(),
+                mono_ms: crate::spearlet::clock::mono_ms(),
             });
         }
 
@@ -1031,6 +1551,7 @@ impl TaskExecutionManager {
             execution_time_ms: duration_ms,
             metadata,
             timestamp: SystemTime::now(),
+            mono_ms: crate::spearlet::clock::mono_ms(),
         })
     }
 
@@ -1112,11 +1633,10 @@ impl TaskExecutionManager {
         next_seq: &mut u64,
         wasm_last_seq: &mut u64,
     ) -> ExecutionResult<()> {
-        let logs = crate::spearlet::execution::host_api::get_wasm_logs_by_execution(
-            execution_id,
-            Some(*wasm_last_seq),
-            4096,
-        );
+        let logs = self
+            .node
+            .wasm_logs
+            .get_by_execution(execution_id, Some(*wasm_last_seq), 4096);
         debug!(
             execution_id = %execution_id,
             count = logs.len(),
@@ -1265,6 +1785,16 @@ impl TaskExecutionManager {
         self.tasks.get(task_id).map(|t| t.clone())
     }
 
+    /// Look up a task by id, then by name / 先按 ID、再按名称查找任务
+    pub fn find_task(&self, id_or_name: &str) -> Option<Arc<Task>> {
+        self.get_task_by_id(id_or_name).or_else(|| {
+            self.tasks
+                .iter()
+                .find(|t| t.spec.name == id_or_name)
+                .map(|t| t.clone())
+        })
+    }
+
     pub fn create_task_with_id(
         &self,
         task_id: String,
@@ -1309,6 +1839,31 @@ impl TaskExecutionManager {
         self.create_task_with_id(task_id, artifact, spec)
     }
 
+    /// Remove a task after stopping its instances / 停止其实例后移除任务
+    pub async fn remove_task(&self, task_id: &str, reason: &str) -> Option<Arc<Task>> {
+        let ids: Vec<String> = self
+            .instances
+            .iter()
+            .filter(|e| e.value().task_id() == task_id)
+            .map(|e| e.key().clone())
+            .collect();
+        for id in ids {
+            if let Err(e) = self.destroy_instance(&id, Some(reason.to_string())).await {
+                warn!("Failed to stop instance {}: {}", id, e);
+            }
+        }
+        // Instances that failed to stop still give up their ports / 未能停止的实例同样释放端口
+        self.node.service_ports.release_task(task_id);
+        self.node.temp_workspace.purge_task(task_id);
+        self.node.preemption.forget_task(task_id);
+        let (_, task) = self.tasks.remove(task_id)?;
+        if let Some(artifact) = self.artifacts.get(task.artifact_id()) {
+            let _ = artifact.remove_task(task_id);
+        }
+        self.statistics.write().active_tasks = self.tasks.len() as u64;
+        Some(task)
+    }
+
     /// Ensure task exists from SMS Task using provided artifact / 使用提供的Artifact从 SMS Task 确保 Task 存在
     pub async fn ensure_task_from_sms(
         &self,
@@ -1341,6 +1896,9 @@ impl TaskExecutionManager {
             health_check: HealthCheckConfig::default(),
             timeout_config: TimeoutConfig::default(),
         };
+        self.node
+            .preemption
+            .set_task_priority(&sms_task.task_id, sms_task.priority);
         self.ensure_task_with_id(sms_task.task_id.clone(), artifact, task_spec)
     }
 
@@ -1424,8 +1982,8 @@ impl TaskExecutionManager {
         let runtime = self
             .runtime_manager
             .get_runtime(&task.spec.runtime_type)
-            .ok_or_else(|| ExecutionError::RuntimeError {
-                message: format!("Runtime not found for type: {:?}", task.spec.runtime_type),
+            .ok_or_else(|| ExecutionError::RuntimeNotFound {
+                runtime_type: format!("{:?}", task.spec.runtime_type),
             })?;
 
         let mut instance_config = task.create_instance_config();
@@ -1450,6 +2008,28 @@ impl TaskExecutionManager {
                 "Artifact not found in manager when preparing instance; snapshot injection skipped"
             );
         }
+
+        // Fetch declared artifacts before the instance starts / 实例启动前拉取声明的 artifact
+        let downloads = parse_download_specs(&instance_config.task_config)?;
+        if !downloads.is_empty() {
+            let paths = self
+                .download_manager
+                .ensure_all(task.id(), &downloads)
+                .await?;
+            instance_config.environment.insert(
+                ENV_DOWNLOADS_DIR.to_string(),
+                self.download_manager
+                    .task_dir(task.id())
+                    .to_string_lossy()
+                    .to_string(),
+            );
+            for (name, path) in paths {
+                instance_config
+                    .environment
+                    .insert(download_env_key(&name), path.to_string_lossy().to_string());
+            }
+        }
+
         let instance = timeout(
             Duration::from_millis(self.config.instance_creation_timeout_ms),
             runtime.create_instance(&instance_config),
@@ -1491,11 +2071,8 @@ impl TaskExecutionManager {
         let runtime = self
             .runtime_manager
             .get_runtime(&instance.config.runtime_type)
-            .ok_or_else(|| ExecutionError::RuntimeError {
-                message: format!(
-                    "Runtime not found for type: {:?}",
-                    instance.config.runtime_type
-                ),
+            .ok_or_else(|| ExecutionError::RuntimeNotFound {
+                runtime_type: format!("{:?}", instance.config.runtime_type),
             })?;
         runtime.stop_instance(instance).await?;
 
@@ -1510,6 +2087,7 @@ impl TaskExecutionManager {
         );
 
         self.instances.remove(instance.id());
+        self.liveness_states.remove(instance.id());
         self.scheduler.remove_instance(&instance.id).await?;
 
         let task_id = instance.task_id().to_string();
@@ -1560,21 +2138,33 @@ impl TaskExecutionManager {
 
     async fn run_async_completion_loop(
         &self,
-        mut receiver: mpsc::UnboundedReceiver<ExecutionCompletionEvent>,
+        receiver: Arc<tokio::sync::Mutex<mpsc::UnboundedReceiver<ExecutionCompletionEvent>>>,
     ) {
+        let mut receiver = receiver.lock().await;
         while let Some(ev) = receiver.recv().await {
             let _ = self.handle_async_completion(ev).await;
         }
     }
 
+    /// Send the registered completion webhook, if any / 发送已注册的完成 webhook（如有）
+    fn dispatch_webhook(&self, resp: &super::ExecutionResponse) {
+        let Some((_, callback)) = self.webhook_callbacks.remove(&resp.execution_id) else {
+            return;
+        };
+        let cfg = &self.spearlet_config.webhook;
+        let payload =
+            crate::spearlet::webhook::CompletionPayload::from_response(resp, cfg.max_output_bytes);
+        crate::spearlet::webhook::dispatch(callback, payload, cfg);
+    }
+
     async fn handle_async_completion(&self, ev: ExecutionCompletionEvent) -> ExecutionResult<()> {
         let Some((_, pending)) = self.pending_async_executions.remove(&ev.execution_id) else {
             return Ok(());
         };
 
-        crate::spearlet::execution::host_api::user_stream::map_ws_close_to_channels(
-            &ev.execution_id,
-        );
+        self.node
+            .user_streams
+            .map_ws_close_to_channels(&ev.execution_id);
 
         if let Some(inst) = self.instances.get(&pending.instance_id) {
             if inst.value().config.runtime_type == super::RuntimeType::Wasm {
@@ -1660,6 +2250,7 @@ impl TaskExecutionManager {
         if let Some(err) = ev.error_message.as_ref() {
             meta.insert("error_message".to_string(), err.clone());
         }
+        self.attach_manifest(&pending.task_id, &ev.execution_id, &mut meta);
 
         self.report_execution_to_sms(
             pending.invocation_id.clone(),
@@ -1679,7 +2270,7 @@ impl TaskExecutionManager {
             completed_at_ms,
             crate::proto::sms::InstanceStatus::Running as i32,
         );
-        crate::spearlet::execution::host_api::clear_wasm_logs_by_execution(&ev.execution_id);
+        self.node.wasm_logs.clear_by_execution(&ev.execution_id);
 
         self.executions.insert(
             ev.execution_id.clone(),
@@ -1701,8 +2292,20 @@ impl TaskExecutionManager {
                 execution_time_ms: ev.duration_ms,
                 metadata: meta,
                 timestamp: SystemTime::now(),
+                mono_ms: crate::spearlet::clock::mono_ms(),
             },
         );
+        let finished = self
+            .executions
+            .get(&ev.execution_id)
+            .map(|entry| entry.value().clone());
+        if let Some(resp) = finished {
+            self.node
+                .async_journal
+                .complete(&resp.execution_id, &resp.status)
+                .await;
+            self.dispatch_webhook(&resp);
+        }
 
         Ok(())
     }
@@ -1746,6 +2349,228 @@ impl TaskExecutionManager {
         }
     }
 
+    /// Liveness probe loop; ends on shutdown or once the manager is dropped
+    /// 存活探针循环；在关闭或管理器被丢弃后结束
+    async fn run_liveness_probe_loop(manager: Weak<Self>, shutdown: CancellationToken) {
+        let Some(tick_ms) = manager
+            .upgrade()
+            .map(|m| m.config.liveness_probe_tick_ms.max(1))
+        else {
+            return;
+        };
+        let mut interval = tokio::time::interval(Duration::from_millis(tick_ms));
+
+        loop {
+            tokio::select! {
+                _ = shutdown.cancelled() => return,
+                _ = interval.tick() => {}
+            }
+            let Some(manager) = manager.upgrade() else {
+                return;
+            };
+            manager.process_liveness_probes_once().await;
+        }
+    }
+
+    async fn process_liveness_probes_once(&self) {
+        let instances: Vec<Arc<TaskInstance>> =
+            self.instances.iter().map(|e| e.value().clone()).collect();
+        for instance in instances {
+            match instance.status() {
+                InstanceStatus::Ready
+                | InstanceStatus::Running
+                | InstanceStatus::Busy
+                | InstanceStatus::Unhealthy => {}
+                _ => continue,
+            }
+            let task = match self.tasks.get(instance.task_id()) {
+                Some(t) => t.value().clone(),
+                None => continue,
+            };
+            let probe = match task.spec.health_check.liveness_probe.clone() {
+                Some(p) => p,
+                None => continue,
+            };
+            let runtime = match self
+                .runtime_manager
+                .get_runtime(&instance.config.runtime_type)
+            {
+                Some(r) => r,
+                None => continue,
+            };
+
+            let due = self
+                .liveness_states
+                .get(instance.id())
+                .map(|st| st.last_probe.elapsed() >= Duration::from_millis(probe.period_ms))
+                .unwrap_or(true);
+            if !due {
+                continue;
+            }
+
+            let deadline = Duration::from_millis(probe.deadline_ms.max(1));
+            let outcome = timeout(deadline, runtime.liveness_probe(&instance, &probe)).await;
+            let (alive, reason) = match outcome {
+                Ok(Ok(true)) => (true, String::new()),
+                Ok(Ok(false)) => (false, "probe reported not alive".to_string()),
+                Ok(Err(e)) => (false, format!("probe error: {}", e)),
+                Err(_) => (
+                    false,
+                    format!("probe deadline {}ms exceeded", probe.deadline_ms),
+                ),
+            };
+
+            let failures = {
+                let mut st = self
+                    .liveness_states
+                    .entry(instance.id().to_string())
+                    .or_insert(LivenessProbeState {
+                        last_probe: Instant::now(),
+                        consecutive_failures: 0,
+                    });
+                st.last_probe = Instant::now();
+                if alive {
+                    st.consecutive_failures = 0;
+                } else {
+                    st.consecutive_failures = st.consecutive_failures.saturating_add(1);
+                }
+                st.consecutive_failures
+            };
+
+            if alive {
+                // A healthy instance earns the task a fresh restart budget
+                // 健康的实例使任务重新获得完整的重启次数
+                self.liveness_restarts.remove(task.id());
+                continue;
+            }
+
+            warn!(
+                task_id = %task.id(),
+                instance_id = %instance.id(),
+                failures,
+                "Liveness probe failed: {}",
+                reason
+            );
+            if failures < probe.failure_threshold.max(1) {
+                continue;
+            }
+
+            instance.set_status(InstanceStatus::Unhealthy);
+            self.emit_liveness_event(&task, &instance, LivenessEventKind::Unhealthy, &reason)
+                .await;
+            self.handle_liveness_failure(&task, &instance, &probe).await;
+        }
+    }
+
+    async fn handle_liveness_failure(
+        &self,
+        task: &Arc<Task>,
+        instance: &Arc<TaskInstance>,
+        probe: &LivenessProbeConfig,
+    ) {
+        self.liveness_states.remove(instance.id());
+        if let Err(e) = self.stop_instance(instance).await {
+            warn!(
+                "Failed to stop dead instance {} of task {}: {}",
+                instance.id(),
+                task.id(),
+                e
+            );
+        }
+
+        if probe.restart_policy != RestartPolicy::OnFailure {
+            return;
+        }
+        let restarts = self
+            .liveness_restarts
+            .get(task.id())
+            .map(|v| *v)
+            .unwrap_or(0);
+        if probe.max_restarts > 0 && restarts >= probe.max_restarts {
+            self.emit_liveness_event(
+                task,
+                instance,
+                LivenessEventKind::RestartLimitReached,
+                &format!("restart limit {} reached", probe.max_restarts),
+            )
+            .await;
+            return;
+        }
+
+        match self.get_or_create_instance(task).await {
+            Ok(replacement) => {
+                *self
+                    .liveness_restarts
+                    .entry(task.id().to_string())
+                    .or_insert(0) += 1;
+                self.emit_liveness_event(
+                    task,
+                    instance,
+                    LivenessEventKind::Restarted,
+                    &format!("replaced by {}", replacement.id()),
+                )
+                .await;
+            }
+            Err(e) => warn!(
+                "Failed to restart task {} after liveness failure: {}",
+                task.id(),
+                e
+            ),
+        }
+    }
+
+    /// Broadcast a liveness event and report it to the SMS / 广播存活事件并上报 SMS
+    ///
+    /// An unhealthy instance is reported as terminating with the probe outcome in its
+    /// metadata; restarts and an exhausted budget are reported as task status reasons.
+    /// 不健康的实例以 terminating 状态上报，探针结果写入其元数据；重启与次数耗尽作为任务状态
+    /// 原因上报。
+    async fn emit_liveness_event(
+        &self,
+        task: &Arc<Task>,
+        instance: &Arc<TaskInstance>,
+        kind: LivenessEventKind,
+        reason: &str,
+    ) {
+        let timestamp_ms = chrono::Utc::now().timestamp_millis();
+        let _ = self.liveness_events.send(LivenessEvent {
+            task_id: task.id().to_string(),
+            instance_id: instance.id().to_string(),
+            kind,
+            reason: reason.to_string(),
+            timestamp_ms,
+        });
+        match kind {
+            LivenessEventKind::Unhealthy => self.report_instance_with_metadata(
+                task.id().to_string(),
+                instance.id().to_string(),
+                instance.current_execution_id().unwrap_or_default(),
+                timestamp_ms,
+                crate::proto::sms::InstanceStatus::Terminating as i32,
+                std::collections::HashMap::from([
+                    ("liveness".to_string(), "unhealthy".to_string()),
+                    ("liveness_reason".to_string(), reason.to_string()),
+                ]),
+            ),
+            LivenessEventKind::Restarted => {
+                self.publish_task_status(
+                    task.id(),
+                    crate::proto::sms::TaskStatus::Active,
+                    Some(format!("liveness restart: {}", reason)),
+                )
+                .await
+            }
+            LivenessEventKind::RestartLimitReached => {
+                self.publish_task_status(
+                    task.id(),
+                    crate::proto::sms::TaskStatus::Inactive,
+                    Some(format!("liveness: {}", reason)),
+                )
+                .await
+            }
+        }
+    }
+
     /// Metrics collection loop / 指标收集循环
     async fn run_metrics_collection_loop(&self) {
         let mut interval = tokio::time::interval(Duration::from_millis(
@@ -1808,6 +2633,61 @@ impl TaskExecutionManager {
         }
     }
 
+    /// Invoke schedules as they come due / 在计划到期时调用
+    async fn run_schedule_loop(self: Arc<Self>) {
+        let schedules = &self.node.schedules;
+        loop {
+            tokio::time::sleep(Duration::from_millis(schedules.tick_ms())).await;
+            let now_ms = chrono::Utc::now().timestamp_millis();
+            for schedule in schedules.take_due(now_ms) {
+                let manager = self.clone();
+                tokio::spawn(async move { manager.run_schedule(schedule).await });
+            }
+        }
+    }
+
+    async fn run_schedule(&self, schedule: crate::spearlet::schedules::Schedule) {
+        // Loaded tasks match by name too / 已加载的任务也可按名称匹配
+        let task_id = self
+            .find_task(&schedule.task)
+            .map(|t| t.id.clone())
+            .unwrap_or_else(|| schedule.task.clone());
+        let mut metadata = schedule.metadata.clone();
+        metadata.insert(
+            crate::spearlet::schedules::SCHEDULE_METADATA_KEY.to_string(),
+            schedule.id.clone(),
+        );
+        let options = super::invoke::InvokeOptions {
+            function_name: (!schedule.method.is_empty()).then(|| schedule.method.clone()),
+            content_type: (!schedule.content_type.is_empty())
+                .then(|| schedule.content_type.clone()),
+            metadata,
+            ..Default::default()
+        };
+        let ctx = super::invoke::InvokeContext::new();
+        match self
+            .invoke(
+                &ctx,
+                super::invoke::TaskRef::Id(task_id),
+                schedule.input(),
+                options,
+            )
+            .await
+        {
+            Ok(inv) => debug!(
+                schedule_id = %schedule.id,
+                execution_id = %inv.handle.execution_id,
+                "scheduled invocation finished"
+            ),
+            Err(e) => warn!(
+                schedule_id = %schedule.id,
+                task = %schedule.task,
+                error = %e,
+                "scheduled invocation failed"
+            ),
+        }
+    }
+
     /// Cleanup loop / 清理循环
     async fn run_cleanup_loop(&self) {
         let mut interval =
@@ -1839,6 +2719,15 @@ impl TaskExecutionManager {
             for task_entry in self.tasks.iter() {
                 let task_id = task_entry.key().clone();
                 let task = task_entry.value();
+                // Workloads from the local workload directory stay until their file goes away
+                // 本地工作负载目录中的工作负载保留到其文件被删除为止
+                if task
+                    .spec
+                    .task_config
+                    .contains_key(crate::spearlet::reload::TASK_CONFIG_WORKLOAD_FILE)
+                {
+                    continue;
+                }
                 if task.instance_count() == 0 {
                     let idle_duration = task.time_since_update();
                     let not_active = !matches!(
@@ -1932,6 +2821,25 @@ impl TaskExecutionManager {
         current_execution_id: String,
         ts_ms: i64,
         status: i32,
+    ) {
+        self.report_instance_with_metadata(
+            task_id,
+            instance_id,
+            current_execution_id,
+            ts_ms,
+            status,
+            std::collections::HashMap::new(),
+        );
+    }
+
+    fn report_instance_with_metadata(
+        &self,
+        task_id: String,
+        instance_id: String,
+        current_execution_id: String,
+        ts_ms: i64,
+        status: i32,
+        metadata: std::collections::HashMap<String, String>,
     ) {
         let channel = match self.sms_channel.clone() {
             Some(c) => c,
@@ -1950,7 +2858,7 @@ impl TaskExecutionManager {
             updated_at_ms: ts_ms,
             last_seen_ms: ts_ms,
             current_execution_id,
-            metadata: std::collections::HashMap::new(),
+            metadata,
         };
         tokio::spawn(async move {
             let mut client =
@@ -1971,12 +2879,14 @@ impl TaskExecutionManager {
         status: i32,
         started_at_ms: i64,
         completed_at_ms: i64,
-        metadata: std::collections::HashMap<String, String>,
+        mut metadata: std::collections::HashMap<String, String>,
     ) {
         let channel = match self.sms_channel.clone() {
             Some(c) => c,
             None => return,
         };
+        // Debug traces stay with the caller / 调试追踪只交给调用方
+        metadata.remove(super::debug_trace::TRACE_METADATA_KEY);
         let per_attempt = Duration::from_millis(self.spearlet_config.sms_connect_timeout_ms)
             .min(Duration::from_secs(5))
             .max(Duration::from_millis(1));
@@ -2119,13 +3029,21 @@ impl Clone for TaskExecutionManager {
             instances: self.instances.clone(),
             executions: self.executions.clone(),
             execution_semaphore: self.execution_semaphore.clone(),
+            concurrency_limit: self.concurrency_limit.clone(),
             statistics: self.statistics.clone(),
             request_counter: AtomicU64::new(self.request_counter.load(Ordering::SeqCst)),
             work_sender: self.work_sender.clone(),
             completion_sender: self.completion_sender.clone(),
             pending_async_executions: self.pending_async_executions.clone(),
+            webhook_callbacks: self.webhook_callbacks.clone(),
             sms_channel: self.sms_channel.clone(),
+            liveness_states: self.liveness_states.clone(),
+            liveness_restarts: self.liveness_restarts.clone(),
+            liveness_events: self.liveness_events.clone(),
+            download_manager: self.download_manager.clone(),
+            node: self.node.clone(),
             shutdown_sender: None, // Clone doesn't get shutdown sender / 克隆不获取关闭发送器
+            shutdown_token: self.shutdown_token.clone(),
         }
     }
 }
@@ -2135,9 +3053,7 @@ mod tests {
     use super::*;
     use crate::spearlet::execution::instance;
     use crate::spearlet::execution::runtime;
-    use crate::spearlet::execution::runtime::{
-        Runtime, RuntimeCapabilities, RuntimeType,
-    };
+    use crate::spearlet::execution::runtime::{Runtime, RuntimeCapabilities, RuntimeType};
     use async_trait::async_trait;
     use std::collections::HashMap as StdHashMap;
     use tokio::time::sleep;
@@ -2829,4 +3745,215 @@ mod tests {
         assert!(manager.get_instance(&instance.id().to_string()).is_none());
         assert!(task.get_instance(instance.id()).is_none());
     }
+
+    #[tokio::test]
+    async fn test_liveness_probe_failure_restarts_instance() {
+        use crate::spearlet::execution::task::{
+            HealthCheckConfig, LivenessProbeConfig, RestartPolicy, ScalingConfig, TaskSpec,
+            TaskType, TimeoutConfig,
+        };
+        use std::sync::atomic::{AtomicBool, Ordering};
+
+        struct ProbeRuntime {
+            alive: Arc<AtomicBool>,
+        }
+
+        #[async_trait]
+        impl Runtime for ProbeRuntime {
+            fn runtime_type(&self) -> RuntimeType {
+                RuntimeType::Process
+            }
+            async fn create_instance(
+                &self,
+                config: &instance::InstanceConfig,
+            ) -> super::ExecutionResult<Arc<instance::TaskInstance>> {
+                let inst = Arc::new(instance::TaskInstance::new(
+                    config.task_id.clone(),
+                    config.clone(),
+                ));
+                inst.set_status(InstanceStatus::Ready);
+                Ok(inst)
+            }
+            async fn start_instance(
+                &self,
+                _instance: &Arc<instance::TaskInstance>,
+            ) -> super::ExecutionResult<()> {
+                Ok(())
+            }
+            async fn stop_instance(
+                &self,
+                _instance: &Arc<instance::TaskInstance>,
+            ) -> super::ExecutionResult<()> {
+                Ok(())
+            }
+            async fn execute(
+                &self,
+                _instance: &Arc<instance::TaskInstance>,
+                _context: runtime::ExecutionContext,
+            ) -> super::ExecutionResult<runtime::RuntimeExecutionResponse> {
+                Ok(runtime::RuntimeExecutionResponse::default())
+            }
+            async fn health_check(
+                &self,
+                _instance: &Arc<instance::TaskInstance>,
+            ) -> super::ExecutionResult<bool> {
+                Ok(true)
+            }
+            async fn liveness_probe(
+                &self,
+                _instance: &Arc<instance::TaskInstance>,
+                _probe: &LivenessProbeConfig,
+            ) -> super::ExecutionResult<bool> {
+                Ok(self.alive.load(Ordering::SeqCst))
+            }
+            async fn get_metrics(
+                &self,
+                _instance: &Arc<instance::TaskInstance>,
+            ) -> super::ExecutionResult<StdHashMap<String, serde_json::Value>> {
+                Ok(StdHashMap::new())
+            }
+            async fn scale_instance(
+                &self,
+                _instance: &Arc<instance::TaskInstance>,
+                _new_limits: &instance::InstanceResourceLimits,
+            ) -> super::ExecutionResult<()> {
+                Ok(())
+            }
+            async fn cleanup_instance(
+                &self,
+                _instance: &Arc<instance::TaskInstance>,
+            ) -> super::ExecutionResult<()> {
+                Ok(())
+            }
+            fn validate_config(
+                &self,
+                _config: &instance::InstanceConfig,
+            ) -> super::ExecutionResult<()> {
+                Ok(())
+            }
+            fn get_capabilities(&self) -> RuntimeCapabilities {
+                RuntimeCapabilities::default()
+            }
+        }
+
+        let alive = Arc::new(AtomicBool::new(true));
+        let mut rm = RuntimeManager::new();
+        rm.register_runtime(
+            RuntimeType::Process,
+            Box::new(ProbeRuntime {
+                alive: alive.clone(),
+            }),
+        )
+        .unwrap();
+
+        let cfg = TaskExecutionManagerConfig {
+            liveness_probe_tick_ms: 3_600_000,
+            ..Default::default()
+        };
+        let manager = TaskExecutionManager::new(
+            cfg,
+            Arc::new(rm),
+            Arc::new(crate::spearlet::config::SpearletConfig::default()),
+            None,
+        )
+        .await
+        .unwrap();
+
+        let spec_local = crate::spearlet::execution::artifact::ArtifactSpec {
+            name: "artifact-live".to_string(),
+            version: "1.0.0".to_string(),
+            description: None,
+            runtime_type: RuntimeType::Process,
+            runtime_config: StdHashMap::new(),
+            location: None,
+            checksum_sha256: None,
+            environment: StdHashMap::new(),
+            resource_limits: Default::default(),
+            invocation_type: crate::spearlet::execution::artifact::InvocationType::ExistingTask,
+            max_execution_timeout_ms: 30000,
+            labels: StdHashMap::new(),
+        };
+        let artifact = manager
+            .ensure_artifact_with_id("artifact-live".to_string(), spec_local)
+            .unwrap();
+        let task_spec = TaskSpec {
+            name: "task-live".to_string(),
+            task_type: TaskType::HttpHandler,
+            runtime_type: artifact.spec.runtime_type,
+            entry_point: "main".to_string(),
+            handler_config: StdHashMap::new(),
+            task_config: StdHashMap::new(),
+            environment: artifact.spec.environment.clone(),
+            invocation_type: artifact.spec.invocation_type.clone(),
+            min_instances: 1,
+            max_instances: 10,
+            target_concurrency: 100,
+            scaling_config: ScalingConfig::default(),
+            health_check: HealthCheckConfig {
+                liveness_probe: Some(LivenessProbeConfig {
+                    period_ms: 0,
+                    failure_threshold: 2,
+                    restart_policy: RestartPolicy::OnFailure,
+                    max_restarts: 1,
+                    ..Default::default()
+                }),
+                ..Default::default()
+            },
+            timeout_config: TimeoutConfig::default(),
+        };
+        let task = manager
+            .ensure_task_with_id("task-live".to_string(), &artifact, task_spec)
+            .unwrap();
+        let instance = manager.get_or_create_instance(&task).await.unwrap();
+        let mut events = manager.subscribe_liveness_events();
+
+        manager.process_liveness_probes_once().await;
+        assert!(manager.get_instance(&instance.id().to_string()).is_some());
+
+        alive.store(false, Ordering::SeqCst);
+        manager.process_liveness_probes_once().await;
+        assert!(manager.get_instance(&instance.id().to_string()).is_some());
+        manager.process_liveness_probes_once().await;
+
+        assert!(manager.get_instance(&instance.id().to_string()).is_none());
+        assert_eq!(task.instance_count(), 1);
+        assert_eq!(
+            events.try_recv().unwrap().kind,
+            LivenessEventKind::Unhealthy
+        );
+        assert_eq!(
+            events.try_recv().unwrap().kind,
+            LivenessEventKind::Restarted
+        );
+
+        // A healthy probe restores the budget / 健康的探针恢复重启次数
+        alive.store(true, Ordering::SeqCst);
+        manager.process_liveness_probes_once().await;
+        assert!(manager.liveness_restarts.is_empty());
+        alive.store(false, Ordering::SeqCst);
+        manager.process_liveness_probes_once().await;
+        manager.process_liveness_probes_once().await;
+        assert_eq!(task.instance_count(), 1);
+        assert_eq!(
+            events.try_recv().unwrap().kind,
+            LivenessEventKind::Unhealthy
+        );
+        assert_eq!(
+            events.try_recv().unwrap().kind,
+            LivenessEventKind::Restarted
+        );
+
+        // Dying again before a healthy probe exhausts it / 在健康探针之前再次失活则耗尽次数
+        manager.process_liveness_probes_once().await;
+        manager.process_liveness_probes_once().await;
+        assert_eq!(task.instance_count(), 0);
+        assert_eq!(
+            events.try_recv().unwrap().kind,
+            LivenessEventKind::Unhealthy
+        );
+        assert_eq!(
+            events.try_recv().unwrap().kind,
+            LivenessEventKind::RestartLimitReached
+        );
+    }
 }
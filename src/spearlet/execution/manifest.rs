@@ -0,0 +1,198 @@
+//! Reproducibility manifest for executions
+//! 执行的可复现性清单
+//!
+//! Every finished execution carries a manifest in its result metadata under
+//! [`MANIFEST_METADATA_KEY`], so an output can be traced back to the exact module,
+//! workload version, models and prompt template that produced it. The manifest also
+//! travels with the result reported to SMS.
+//! 每个结束的执行都会在结果元数据的 [`MANIFEST_METADATA_KEY`] 下携带清单，从而能把输出
+//! 追溯到产生它的模块、工作负载版本、模型与提示词模板。清单也会随结果一起上报 SMS。
+
+use std::collections::HashMap;
+
+use dashmap::DashMap;
+use serde::{Deserialize, Serialize};
+
+use crate::spearlet::execution::{Artifact, Task};
+
+/// Result metadata key holding the manifest JSON / 存放清单 JSON 的结果元数据键
+pub const MANIFEST_METADATA_KEY: &str = "manifest";
+
+/// Invocation metadata / task config key for the prompt template version
+/// 提示词模板版本所用的调用元数据 / 任务配置键
+pub const PROMPT_TEMPLATE_VERSION_KEY: &str = "prompt_template_version";
+
+/// A model backend used during the execution / 执行过程中使用的模型后端
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ModelUse {
+    pub backend: String,
+    pub model: String,
+    pub endpoint: String,
+}
+
+/// Configuration an execution ran with / 执行所使用的配置
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ExecutionManifest {
+    pub spearlet_version: String,
+    pub task_id: String,
+    pub workload_name: String,
+    pub workload_version: String,
+    pub runtime_type: String,
+    /// Module / image location / 模块或镜像位置
+    pub image: Option<String>,
+    /// `sha256:<hex>` digest of the module / 模块的 `sha256:<hex>` 摘要
+    pub image_digest: Option<String>,
+    pub prompt_template_version: Option<String>,
+    /// Distinct models in first-use order / 按首次使用顺序去重的模型
+    pub models: Vec<ModelUse>,
+}
+
+impl ExecutionManifest {
+    /// Assemble the manifest from the task, its artifact and the run record
+    /// 由任务、其 artifact 与运行记录组装清单
+    pub fn build(task: Option<&Task>, artifact: Option<&Artifact>, run: RunRecord) -> Self {
+        let prompt_template_version = run.prompt_template_version.or_else(|| {
+            task.and_then(|t| t.spec.task_config.get(PROMPT_TEMPLATE_VERSION_KEY))
+                .filter(|v| !v.trim().is_empty())
+                .cloned()
+        });
+        Self {
+            spearlet_version: crate::spearlet::build_info::version().to_string(),
+            task_id: task.map(|t| t.id.clone()).unwrap_or_default(),
+            workload_name: task.map(|t| t.spec.name.clone()).unwrap_or_default(),
+            workload_version: artifact.map(|a| a.spec.version.clone()).unwrap_or_default(),
+            runtime_type: task
+                .map(|t| t.spec.runtime_type.as_str().to_string())
+                .unwrap_or_default(),
+            image: artifact.and_then(|a| a.spec.location.clone()),
+            image_digest: artifact
+                .and_then(|a| a.spec.checksum_sha256.as_deref())
+                .map(str::trim)
+                .filter(|d| !d.is_empty())
+                .map(|d| {
+                    if d.starts_with("sha256:") {
+                        d.to_string()
+                    } else {
+                        format!("sha256:{}", d.to_ascii_lowercase())
+                    }
+                }),
+            prompt_template_version,
+            models: run.models,
+        }
+    }
+
+    /// Store the manifest in result metadata / 将清单写入结果元数据
+    pub fn insert_into(&self, metadata: &mut HashMap<String, String>) {
+        if let Ok(s) = serde_json::to_string(self) {
+            metadata.insert(MANIFEST_METADATA_KEY.to_string(), s);
+        }
+    }
+
+    /// Read a manifest back from result metadata / 从结果元数据读取清单
+    pub fn from_metadata(metadata: &HashMap<String, String>) -> Option<Self> {
+        metadata
+            .get(MANIFEST_METADATA_KEY)
+            .and_then(|s| serde_json::from_str(s).ok())
+    }
+}
+
+/// What happened during one execution / 单次执行期间的记录
+#[derive(Debug, Clone, Default)]
+pub struct RunRecord {
+    pub prompt_template_version: Option<String>,
+    pub models: Vec<ModelUse>,
+}
+
+/// Run records of one spearlet's executions / 单个 spearlet 各执行的运行记录
+#[derive(Default)]
+pub struct RunRecords {
+    records: DashMap<String, RunRecord>,
+}
+
+impl RunRecords {
+    /// Start recording an execution / 开始记录一次执行
+    pub fn begin_run(&self, execution_id: &str, prompt_template_version: Option<String>) {
+        self.records.insert(
+            execution_id.to_string(),
+            RunRecord {
+                prompt_template_version: prompt_template_version.filter(|v| !v.trim().is_empty()),
+                models: Vec::new(),
+            },
+        );
+    }
+
+    /// Record a model call for the current WASM execution / 为当前 WASM 执行记录一次模型调用
+    pub fn record_model_use(&self, backend: &str, model: &str, endpoint: &str) {
+        let Some(execution_id) = crate::spearlet::execution::host_api::current_wasm_execution_id()
+        else {
+            return;
+        };
+        self.record_model_use_for(&execution_id, backend, model, endpoint);
+    }
+
+    /// Record a model call for an execution / 为指定执行记录一次模型调用
+    pub fn record_model_use_for(
+        &self,
+        execution_id: &str,
+        backend: &str,
+        model: &str,
+        endpoint: &str,
+    ) {
+        let use_ = ModelUse {
+            backend: backend.to_string(),
+            model: model.to_string(),
+            endpoint: endpoint.to_string(),
+        };
+        let mut rec = self.records.entry(execution_id.to_string()).or_default();
+        if !rec.models.contains(&use_) {
+            rec.models.push(use_);
+        }
+    }
+
+    /// Take the record of a finished execution / 取出已结束执行的记录
+    pub fn finish_run(&self, execution_id: &str) -> RunRecord {
+        self.records
+            .remove(execution_id)
+            .map(|(_, r)| r)
+            .unwrap_or_default()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_run_record_dedups_models() {
+        let id = "exec-manifest-test";
+        let runs = RunRecords::default();
+        runs.begin_run(id, Some("v3".to_string()));
+        runs.record_model_use_for(id, "openai", "gpt-4o-mini", "https://api.openai.com/v1");
+        runs.record_model_use_for(id, "openai", "gpt-4o-mini", "https://api.openai.com/v1");
+        runs.record_model_use_for(id, "ollama", "llama3", "http://127.0.0.1:11434");
+        let rec = runs.finish_run(id);
+        assert_eq!(rec.prompt_template_version.as_deref(), Some("v3"));
+        assert_eq!(rec.models.len(), 2);
+        assert!(runs.finish_run(id).models.is_empty());
+    }
+
+    #[test]
+    fn test_manifest_metadata_round_trip() {
+        let m = ExecutionManifest::build(
+            None,
+            None,
+            RunRecord {
+                prompt_template_version: Some("v1".to_string()),
+                models: vec![ModelUse {
+                    backend: "openai".to_string(),
+                    model: "gpt-4o".to_string(),
+                    endpoint: "https://api.openai.com/v1".to_string(),
+                }],
+            },
+        );
+        assert_eq!(m.spearlet_version, crate::spearlet::build_info::version());
+        let mut meta = HashMap::new();
+        m.insert_into(&mut meta);
+        assert_eq!(ExecutionManifest::from_metadata(&meta), Some(m));
+    }
+}
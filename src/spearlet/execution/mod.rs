@@ -36,12 +36,18 @@
 pub mod ai;
 pub mod artifact;
 pub mod artifact_fetch;
+pub mod child_invoke;
 pub mod communication;
+pub mod debug_trace;
+pub mod downloads;
 pub mod host_api;
 pub mod hostcall;
 pub mod http_adapter;
 pub mod instance;
+pub mod invoke;
 pub mod manager;
+pub mod manifest;
+pub mod output_caps;
 pub mod pool;
 pub mod runtime;
 pub mod scheduler;
@@ -62,6 +68,10 @@ pub use communication::{
     RuntimeMessage,
 };
 pub use instance::{InstanceId, InstanceMetrics, InstanceStatus, TaskInstance};
+pub use invoke::{
+    ExecutionHandle, ExecutionState, Invocation, InvokeContext, InvokeOptions, TaskRef, Timing,
+    Usage,
+};
 pub use manager::{ExecutionStatistics, TaskExecutionManager, TaskExecutionManagerConfig};
 pub use pool::{InstancePool, InstancePoolConfig, PoolMetrics, ScalingAction, ScalingDecision};
 pub use runtime::{Runtime, RuntimeConfig, RuntimeType};
@@ -110,6 +120,9 @@ pub struct ExecutionResponse {
     pub metadata: HashMap<String, String>,
     /// Timestamp / 时间戳
     pub timestamp: SystemTime,
+    /// Milliseconds since process start, see `clock::mono_ms` / 进程启动以来的毫秒数，见 `clock::mono_ms`
+    #[serde(default)]
+    pub mono_ms: u64,
 }
 
 impl ExecutionResponse {
@@ -139,6 +152,9 @@ pub enum ExecutionError {
     #[error("Instance not found: {id}")]
     InstanceNotFound { id: String },
 
+    #[error("Execution not found: {id}")]
+    ExecutionNotFound { id: String },
+
     #[error("Runtime not found: {runtime_type}")]
     RuntimeNotFound { runtime_type: String },
 
@@ -163,6 +179,11 @@ pub enum ExecutionError {
     #[error("Execution terminated: {message}")]
     ExecutionTerminated { message: String },
 
+    /// The execution loop went away before answering, e.g. during shutdown
+    /// 执行循环在应答前已退出，例如关闭期间
+    #[error("Execution channel closed: {message}")]
+    ChannelClosed { message: String },
+
     #[error("Instance destroyed: {message}")]
     InstanceDestroyed { message: String },
 
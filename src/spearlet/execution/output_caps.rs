@@ -0,0 +1,284 @@
+//! Per-workload output caps
+//! 单个工作负载的输出上限
+//!
+//! Bounds how much a single execution may send back: the bytes written to user streams
+//! plus the final response, and how long it may keep streaming after its first frame.
+//! Limits come from the node (`execution.output_caps`) and from the task config keys
+//! [`TASK_CONFIG_MAX_RESPONSE_BYTES`] and [`TASK_CONFIG_MAX_STREAM_MS`]; the smaller
+//! non-zero value wins. An execution crossing a cap is terminated with a message naming
+//! the cap, which reaches the caller as the `terminated` status of the result.
+//! 限制单次执行可返回的内容：写入用户流的字节加上最终响应，以及在首帧之后可持续流式输出的时长。
+//! 上限来自节点（`execution.output_caps`）与任务配置键 [`TASK_CONFIG_MAX_RESPONSE_BYTES`]、
+//! [`TASK_CONFIG_MAX_STREAM_MS`]，取两者中较小的非零值。超过上限的执行会被终止，终止消息写明
+//! 所触发的上限，调用方在结果中看到 `terminated` 状态。
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use dashmap::DashMap;
+
+use crate::spearlet::config::OutputCapsConfig;
+use crate::spearlet::execution::host_api::termination::WasmTerminationRegistry;
+
+/// Task config key of the response byte cap / 响应字节上限的任务配置键
+pub const TASK_CONFIG_MAX_RESPONSE_BYTES: &str = "output.max_response_bytes";
+/// Task config key of the stream duration cap / 流式输出时长上限的任务配置键
+pub const TASK_CONFIG_MAX_STREAM_MS: &str = "output.max_stream_ms";
+
+/// Caps of one execution; 0 means unlimited / 单次执行的上限；0 表示不限制
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct OutputCaps {
+    pub max_response_bytes: u64,
+    pub max_stream_ms: u64,
+}
+
+impl OutputCaps {
+    /// Combine the node caps with the task config / 合并节点上限与任务配置
+    pub fn for_task(node: &OutputCapsConfig, task_config: &HashMap<String, String>) -> Self {
+        let task = |key: &str| {
+            task_config
+                .get(key)
+                .and_then(|v| v.trim().parse::<u64>().ok())
+                .unwrap_or(0)
+        };
+        Self {
+            max_response_bytes: tighter(
+                node.max_response_bytes,
+                task(TASK_CONFIG_MAX_RESPONSE_BYTES),
+            ),
+            max_stream_ms: tighter(node.max_stream_ms, task(TASK_CONFIG_MAX_STREAM_MS)),
+        }
+    }
+
+    pub fn is_unlimited(&self) -> bool {
+        self.max_response_bytes == 0 && self.max_stream_ms == 0
+    }
+}
+
+/// Smaller non-zero value, 0 when both are 0 / 较小的非零值；两者均为 0 时为 0
+fn tighter(a: u64, b: u64) -> u64 {
+    match (a, b) {
+        (0, v) | (v, 0) => v,
+        (a, b) => a.min(b),
+    }
+}
+
+struct Usage {
+    caps: OutputCaps,
+    sent_bytes: u64,
+    first_frame: Option<Instant>,
+}
+
+impl Usage {
+    fn over_bytes(&self, extra: u64) -> Option<String> {
+        let total = self.sent_bytes.saturating_add(extra);
+        (self.caps.max_response_bytes > 0 && total > self.caps.max_response_bytes).then(|| {
+            format!(
+                "output cap exceeded: response reached {} bytes, max_response_bytes is {}",
+                total, self.caps.max_response_bytes
+            )
+        })
+    }
+
+    fn over_duration(&self) -> Option<String> {
+        let streamed = self.first_frame.map(|t| t.elapsed()).unwrap_or_default();
+        (self.caps.max_stream_ms > 0 && streamed > Duration::from_millis(self.caps.max_stream_ms))
+            .then(|| {
+                format!(
+                    "output cap exceeded: streamed for {} ms, max_stream_ms is {}",
+                    streamed.as_millis(),
+                    self.caps.max_stream_ms
+                )
+            })
+    }
+
+    /// Errno and reason of the first crossed cap / 首个被超过的上限对应的错误码与原因
+    fn exceeded(&self, extra: u64) -> Option<(i32, String)> {
+        self.over_bytes(extra)
+            .map(|r| (-libc::EFBIG, r))
+            .or_else(|| self.over_duration().map(|r| (-libc::ETIME, r)))
+    }
+}
+
+/// Caps of one spearlet's running executions / 单个 spearlet 运行中执行的上限
+pub struct OutputCapMeter {
+    usage: DashMap<String, Usage>,
+    active: AtomicUsize,
+    /// Where a crossed cap marks the execution terminated / 超过上限时在此标记执行终止
+    executions: Arc<WasmTerminationRegistry>,
+}
+
+impl OutputCapMeter {
+    pub fn new(executions: Arc<WasmTerminationRegistry>) -> Self {
+        Self {
+            usage: DashMap::new(),
+            active: AtomicUsize::new(0),
+            executions,
+        }
+    }
+
+    /// Whether any execution runs under a cap / 是否有执行受上限约束
+    pub fn enabled(&self) -> bool {
+        self.active.load(Ordering::Relaxed) > 0
+    }
+
+    /// Start enforcing caps for an execution; unlimited caps are not tracked
+    /// 开始对一次执行施加上限；不限制时不做跟踪
+    pub fn begin(&self, execution_id: &str, caps: OutputCaps) {
+        if caps.is_unlimited() {
+            return;
+        }
+        let u = Usage {
+            caps,
+            sent_bytes: 0,
+            first_frame: None,
+        };
+        if self.usage.insert(execution_id.to_string(), u).is_none() {
+            self.active.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// Account a streamed frame; on a crossed cap the execution is terminated and the frame
+    /// must not be sent
+    /// 计入一个流式帧；超过上限时执行被终止，且该帧不得发送
+    pub fn charge(&self, execution_id: &str, bytes: usize) -> Result<(), String> {
+        if !self.enabled() {
+            return Ok(());
+        }
+        let Some(mut u) = self.usage.get_mut(execution_id) else {
+            return Ok(());
+        };
+        u.first_frame.get_or_insert_with(Instant::now);
+        if let Some((errno, reason)) = u.exceeded(bytes as u64) {
+            drop(u);
+            self.executions
+                .mark(execution_id, errno, Some(reason.clone()));
+            return Err(reason);
+        }
+        u.sent_bytes = u.sent_bytes.saturating_add(bytes as u64);
+        Ok(())
+    }
+
+    /// Terminate the current WASM execution once its stream ran past `max_stream_ms`, even
+    /// when it stopped writing frames
+    /// 当前 WASM 执行的流式输出超过 `max_stream_ms` 后将其终止，即使它已不再写帧
+    pub fn check_current(&self) {
+        if !self.enabled() {
+            return;
+        }
+        let Some(execution_id) = crate::spearlet::execution::host_api::current_wasm_execution_id()
+        else {
+            return;
+        };
+        let exceeded = self.usage.get(&execution_id).and_then(|u| u.exceeded(0));
+        if let Some((errno, reason)) = exceeded {
+            self.executions.mark(&execution_id, errno, Some(reason));
+        }
+    }
+
+    /// Check the final response against what is left of the byte cap
+    /// 检查最终响应是否超出剩余的字节上限
+    pub fn check_response(&self, execution_id: &str, bytes: usize) -> Result<(), String> {
+        let Some(u) = self.usage.get(execution_id) else {
+            return Ok(());
+        };
+        match u.over_bytes(bytes as u64) {
+            Some(reason) => Err(reason),
+            None => Ok(()),
+        }
+    }
+
+    /// Stop tracking a finished execution / 停止跟踪已结束的执行
+    pub fn finish(&self, execution_id: &str) {
+        if self.usage.remove(execution_id).is_some() {
+            self.active.fetch_sub(1, Ordering::Relaxed);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::host_api::termination::Terminations;
+
+    #[test]
+    fn test_for_task_takes_tighter_cap() {
+        let node = OutputCapsConfig {
+            max_response_bytes: 1000,
+            max_stream_ms: 0,
+        };
+        let mut cfg = HashMap::new();
+        assert_eq!(
+            OutputCaps::for_task(&node, &cfg),
+            OutputCaps {
+                max_response_bytes: 1000,
+                max_stream_ms: 0
+            }
+        );
+        cfg.insert(
+            TASK_CONFIG_MAX_RESPONSE_BYTES.to_string(),
+            "5000".to_string(),
+        );
+        cfg.insert(TASK_CONFIG_MAX_STREAM_MS.to_string(), " 250 ".to_string());
+        assert_eq!(
+            OutputCaps::for_task(&node, &cfg),
+            OutputCaps {
+                max_response_bytes: 1000,
+                max_stream_ms: 250
+            }
+        );
+        assert!(OutputCaps::for_task(&OutputCapsConfig::default(), &HashMap::new()).is_unlimited());
+    }
+
+    #[test]
+    fn test_charge_terminates_past_byte_cap() {
+        let id = "exec-output-caps-bytes";
+        let terminations = Terminations::default();
+        let caps = OutputCapMeter::new(terminations.executions.clone());
+        assert!(caps.charge(id, 1 << 20).is_ok());
+        caps.begin(
+            id,
+            OutputCaps {
+                max_response_bytes: 10,
+                max_stream_ms: 0,
+            },
+        );
+        assert!(caps.charge(id, 6).is_ok());
+        assert!(caps.check_response(id, 4).is_ok());
+        assert!(caps.check_response(id, 5).is_err());
+        let reason = caps.charge(id, 5).unwrap_err();
+        assert!(reason.contains("max_response_bytes is 10"), "{}", reason);
+        let s = terminations.executions.check(id).unwrap();
+        assert_eq!(s.errno, -libc::EFBIG);
+        assert_eq!(s.message.as_deref(), Some(reason.as_str()));
+
+        caps.finish(id);
+        assert!(!caps.enabled());
+        assert!(caps.check_response(id, 1 << 20).is_ok());
+    }
+
+    #[test]
+    fn test_charge_terminates_past_stream_duration() {
+        let id = "exec-output-caps-duration";
+        let terminations = Terminations::default();
+        let caps = OutputCapMeter::new(terminations.executions.clone());
+        caps.begin(
+            id,
+            OutputCaps {
+                max_response_bytes: 0,
+                max_stream_ms: 20,
+            },
+        );
+        assert!(caps.charge(id, 1).is_ok());
+        std::thread::sleep(Duration::from_millis(40));
+        let reason = caps.charge(id, 1).unwrap_err();
+        assert!(reason.contains("max_stream_ms is 20"), "{}", reason);
+        assert_eq!(
+            terminations.executions.check(id).unwrap().errno,
+            -libc::ETIME
+        );
+        caps.finish(id);
+    }
+}
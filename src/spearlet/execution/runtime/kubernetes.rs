@@ -4,6 +4,7 @@
 //! This module provides Kubernetes-based execution runtime using Jobs and Pods.
 //! 该模块提供基于 Kubernetes Jobs 和 Pods 的执行运行时。
 
+use super::model_cache::{ModelCacheMount, MODEL_CACHE_VOLUME_NAME};
 use super::{
     ExecutionContext, Runtime, RuntimeCapabilities, RuntimeConfig, RuntimeExecutionResponse,
     RuntimeType, DEFAULT_SHELL_EXECUTABLE,
@@ -12,6 +13,7 @@ use crate::spearlet::execution::{
     instance::{InstanceConfig, InstanceResourceLimits, TaskInstance},
     ExecutionError, ExecutionResult,
 };
+use crate::spearlet::locale::LocaleSettings;
 use async_trait::async_trait;
 use serde::{Deserialize, Serialize};
 use std::collections::HashMap;
@@ -328,6 +330,17 @@ impl KubernetesRuntime {
                 key, value
             ));
         }
+        // Apply the configured locale and timezone / 应用配置的区域与时区
+        let locale = LocaleSettings::resolve(
+            &instance_config.task_config,
+            self.runtime_config.spearlet_config.as_ref(),
+        );
+        for (key, value) in locale.environment() {
+            env_vars.push(format!(
+                "        - name: {}\n          value: \"{}\"",
+                key, value
+            ));
+        }
         for (key, value) in &execution_context.headers {
             env_vars.push(format!(
                 "        - name: HEADER_{}\n          value: \"{}\"",
@@ -336,6 +349,43 @@ impl KubernetesRuntime {
             ));
         }
 
+        // Mount the shared model cache when requested / 按需挂载共享模型缓存
+        let model_cache = ModelCacheMount::resolve(
+            instance_config,
+            self.runtime_config.spearlet_config.as_ref(),
+        );
+        let (mounts_section, volumes_section) = match &model_cache {
+            Some(cache) => {
+                for (key, value) in cache.container_environment() {
+                    env_vars.push(format!(
+                        "        - name: {}\n          value: \"{}\"",
+                        key, value
+                    ));
+                }
+                let source = match &cache.volume_name {
+                    Some(claim) => format!(
+                        "        persistentVolumeClaim:\n          claimName: {}",
+                        claim
+                    ),
+                    None => format!(
+                        "        hostPath:\n          path: {}\n          type: DirectoryOrCreate",
+                        cache.host_path.display()
+                    ),
+                };
+                (
+                    format!(
+                        "        volumeMounts:\n        - name: {}\n          mountPath: {}\n",
+                        MODEL_CACHE_VOLUME_NAME, cache.mount_path
+                    ),
+                    format!(
+                        "      volumes:\n      - name: {}\n{}\n",
+                        MODEL_CACHE_VOLUME_NAME, source
+                    ),
+                )
+            }
+            None => (String::new(), String::new()),
+        };
+
         let env_section = if env_vars.is_empty() {
             String::new()
         } else {
@@ -382,7 +432,7 @@ spec:
         command: ["{}", "-c"]
         args: ["echo 'Execution started'; sleep 10; echo 'Execution completed'"]
 {}
-        resources:
+{}        resources:
           requests:
             cpu: {}
             memory: {}
@@ -397,7 +447,7 @@ spec:
           capabilities:
             drop:
             - ALL
-"#,
+{}"#,
             job_name,
             self.config.namespace,
             execution_context.execution_id,
@@ -431,6 +481,7 @@ spec:
             self.config.image_pull_policy,
             DEFAULT_SHELL_EXECUTABLE,
             env_section,
+            mounts_section,
             self.config.resource_config.cpu_request,
             self.config.resource_config.memory_request,
             self.config
@@ -445,6 +496,7 @@ spec:
                 .ephemeral_storage_limit
                 .as_ref()
                 .unwrap_or(&"2Gi".to_string()),
+            volumes_section,
         )
     }
 
@@ -749,6 +801,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = KubernetesRuntime::new(&runtime_config);
@@ -766,6 +819,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = KubernetesRuntime::new(&runtime_config).unwrap();
@@ -819,6 +873,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = KubernetesRuntime::new(&runtime_config).unwrap();
@@ -864,6 +919,55 @@ mod tests {
         assert!(manifest.contains("test-execution-123"));
     }
 
+    #[test]
+    fn test_job_manifest_mounts_model_cache() {
+        let mut spearlet_config = crate::spearlet::config::SpearletConfig::default();
+        spearlet_config.model_cache.host_path = "/var/cache/spear-models".to_string();
+        let runtime_config = RuntimeConfig {
+            runtime_type: RuntimeType::Kubernetes,
+            settings: HashMap::new(),
+            global_environment: HashMap::new(),
+            spearlet_config: Some(spearlet_config),
+            resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
+        };
+        let runtime = KubernetesRuntime::new(&runtime_config).unwrap();
+
+        let mut task_config = HashMap::new();
+        task_config.insert("needs-model-cache".to_string(), "true".to_string());
+        let instance_config = InstanceConfig {
+            task_id: "task-xyz".to_string(),
+            artifact_id: "artifact-xyz".to_string(),
+            runtime_type: RuntimeType::Kubernetes,
+            runtime_config: HashMap::new(),
+            task_config,
+            artifact: None,
+            environment: HashMap::new(),
+            resource_limits: InstanceResourceLimits::default(),
+            network_config: NetworkConfig::default(),
+            max_concurrent_requests: 10,
+            request_timeout_ms: 30000,
+        };
+        let execution_context = ExecutionContext {
+            execution_id: "exec-cache".to_string(),
+            function_name: crate::spearlet::execution::DEFAULT_ENTRY_FUNCTION_NAME.to_string(),
+            payload: vec![],
+            headers: HashMap::new(),
+            timeout_ms: 30000,
+            execution_mode: crate::spearlet::execution::runtime::ExecutionMode::Sync,
+            wait: true,
+            context_data: HashMap::new(),
+            completion_tx: None,
+        };
+
+        let manifest =
+            runtime.generate_job_manifest(&instance_config, "cache-job", &execution_context);
+        assert!(manifest.contains("volumeMounts:"));
+        assert!(manifest.contains("mountPath: /spear/model-cache"));
+        assert!(manifest.contains("path: /var/cache/spear-models"));
+        assert!(manifest.contains("SPEAR_MODEL_CACHE_DIR"));
+    }
+
     #[test]
     fn test_kubernetes_job_handle() {
         let handle = KubernetesJobHandle {
@@ -890,6 +994,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = KubernetesRuntime::new(&runtime_config).unwrap();
@@ -917,6 +1022,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = KubernetesRuntime::new(&runtime_config).unwrap();
@@ -949,6 +1055,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = KubernetesRuntime::new(&runtime_config).unwrap();
@@ -964,6 +1071,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = KubernetesRuntime::new(&runtime_config).unwrap();
@@ -19,6 +19,7 @@ use crate::spearlet::execution::communication::{
     ConnectionManager, ConnectionManagerConfig, MessageType, SpearMessage,
 };
 use crate::spearlet::execution::instance::{InstanceConfig, InstanceResourceLimits, TaskInstance};
+use crate::spearlet::execution::task::{LivenessProbeConfig, LivenessProbeKind};
 use crate::spearlet::execution::{ExecutionError, ExecutionResult};
 use async_trait::async_trait;
 use serde::{Deserialize, Serialize};
@@ -30,12 +31,14 @@ use tracing::info;
 
 // Re-export runtime implementations / 重新导出运行时实现
 pub mod kubernetes;
+pub mod model_cache;
 pub mod process;
 pub mod wasm;
 #[cfg(feature = "wasmedge")]
 pub mod wasm_hostcalls;
 
 pub use kubernetes::{KubernetesConfig, KubernetesRuntime};
+pub use model_cache::ModelCacheMount;
 pub use process::{ProcessConfig, ProcessRuntime};
 pub use wasm::{WasmConfig, WasmRuntime};
 
@@ -81,6 +84,9 @@ pub struct RuntimeConfig {
     pub spearlet_config: Option<crate::spearlet::config::SpearletConfig>,
     /// Resource pool configuration / 资源池配置
     pub resource_pool: ResourcePoolConfig,
+    /// Node-local services of the owning spearlet / 所属 spearlet 的节点本地服务
+    #[serde(skip)]
+    pub node: Arc<crate::spearlet::node_services::NodeServices>,
 }
 
 // Removed RuntimeEndpoints in favor of passing full SpearletConfig
@@ -386,6 +392,22 @@ impl RuntimeExecutionResponse {
     }
 }
 
+/// Build the execution context used by method liveness probes
+/// 构建方法类存活探针使用的执行上下文
+pub fn liveness_method_context(method: &str, probe: &LivenessProbeConfig) -> ExecutionContext {
+    ExecutionContext {
+        execution_id: format!("liveness-{}", uuid::Uuid::new_v4()),
+        function_name: method.to_string(),
+        payload: Vec::new(),
+        headers: HashMap::new(),
+        timeout_ms: probe.deadline_ms,
+        execution_mode: ExecutionMode::Sync,
+        wait: true,
+        context_data: HashMap::new(),
+        completion_tx: None,
+    }
+}
+
 /// Runtime trait for execution environments / 执行环境的运行时特征
 #[async_trait]
 pub trait Runtime: Send + Sync {
@@ -411,6 +433,25 @@ pub trait Runtime: Send + Sync {
     /// Perform health check on an instance / 对实例执行健康检查
     async fn health_check(&self, instance: &Arc<TaskInstance>) -> ExecutionResult<bool>;
 
+    /// Run a liveness probe against an instance / 对实例执行存活探测
+    /// Defaults to the health check for transport pings and a regular invocation for
+    /// method probes. / 传输层 ping 默认使用健康检查，方法探针默认使用普通调用。
+    async fn liveness_probe(
+        &self,
+        instance: &Arc<TaskInstance>,
+        probe: &LivenessProbeConfig,
+    ) -> ExecutionResult<bool> {
+        match &probe.probe {
+            LivenessProbeKind::TransportPing => self.health_check(instance).await,
+            LivenessProbeKind::Method { name } => {
+                let resp = self
+                    .execute(instance, liveness_method_context(name, probe))
+                    .await?;
+                Ok(!resp.has_failed())
+            }
+        }
+    }
+
     /// Get instance metrics / 获取实例指标
     async fn get_metrics(
         &self,
@@ -0,0 +1,158 @@
+//! Shared Model Cache
+//! 共享模型缓存
+//!
+//! Resolves the node-wide model cache for workloads that declare `needs-model-cache`
+//! in their task config, so agents sharing the same weights reuse one download.
+//! 为在 task config 中声明 `needs-model-cache` 的工作负载解析节点级模型缓存，
+//! 使共享相同权重的 agent 复用同一份下载。
+
+use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::execution::instance::InstanceConfig;
+use std::path::PathBuf;
+
+/// Task config key declaring the need for the shared model cache / 声明需要共享模型缓存的任务配置键
+pub const TASK_CONFIG_NEEDS_MODEL_CACHE: &str = "needs-model-cache";
+/// Environment variable pointing at the cache directory / 指向缓存目录的环境变量
+pub const ENV_MODEL_CACHE_DIR: &str = "SPEAR_MODEL_CACHE_DIR";
+/// Volume name used in generated manifests / 生成清单时使用的卷名
+pub const MODEL_CACHE_VOLUME_NAME: &str = "spear-model-cache";
+
+const DEFAULT_MODEL_CACHE_DIR: &str = "./data/spearlet/model-cache";
+
+/// Cache well-known environment variables redirected to the shared cache
+/// 重定向到共享缓存的常见缓存环境变量
+const CACHE_ENV_VARS: &[(&str, &str)] = &[("HF_HOME", "huggingface"), ("TORCH_HOME", "torch")];
+
+/// Resolved model cache for one workload / 单个工作负载解析后的模型缓存
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ModelCacheMount {
+    /// Directory on the node / 节点上的目录
+    pub host_path: PathBuf,
+    /// Named volume, if configured / 命名卷（如配置）
+    pub volume_name: Option<String>,
+    /// Path inside containers / 容器内路径
+    pub mount_path: String,
+}
+
+impl ModelCacheMount {
+    /// Resolve the cache for an instance, `None` when not requested or disabled
+    /// 解析实例的模型缓存，未声明或被禁用时返回 `None`
+    pub fn resolve(
+        instance_config: &InstanceConfig,
+        spearlet_config: Option<&SpearletConfig>,
+    ) -> Option<Self> {
+        let requested = instance_config
+            .task_config
+            .get(TASK_CONFIG_NEEDS_MODEL_CACHE)
+            .map(|v| matches!(v.trim().to_ascii_lowercase().as_str(), "true" | "1" | "yes"))
+            .unwrap_or(false);
+        if !requested {
+            return None;
+        }
+
+        let defaults = crate::spearlet::config::ModelCacheConfig::default();
+        let (cache_cfg, local_models_dir) = match spearlet_config {
+            Some(c) => (&c.model_cache, c.local_models_dir.as_str()),
+            None => (&defaults, ""),
+        };
+        if !cache_cfg.enabled {
+            return None;
+        }
+
+        let host_path = if !cache_cfg.host_path.trim().is_empty() {
+            PathBuf::from(cache_cfg.host_path.trim())
+        } else if !local_models_dir.trim().is_empty() {
+            PathBuf::from(local_models_dir.trim()).join("cache")
+        } else {
+            PathBuf::from(DEFAULT_MODEL_CACHE_DIR)
+        };
+
+        Some(Self {
+            host_path,
+            volume_name: cache_cfg
+                .volume_name
+                .clone()
+                .filter(|v| !v.trim().is_empty()),
+            mount_path: cache_cfg.mount_path.clone(),
+        })
+    }
+
+    /// Environment for a workload that sees the cache at `root`
+    /// 为在 `root` 处看到缓存的工作负载生成环境变量
+    pub fn environment(root: &str) -> Vec<(String, String)> {
+        let mut env = vec![(ENV_MODEL_CACHE_DIR.to_string(), root.to_string())];
+        for (key, sub) in CACHE_ENV_VARS {
+            env.push((
+                key.to_string(),
+                format!("{}/{}", root.trim_end_matches('/'), sub),
+            ));
+        }
+        env
+    }
+
+    /// Environment for process workloads (host path) / 进程工作负载的环境变量（主机路径）
+    pub fn host_environment(&self) -> Vec<(String, String)> {
+        Self::environment(&self.host_path.to_string_lossy())
+    }
+
+    /// Environment for containerized workloads (mount path) / 容器化工作负载的环境变量（挂载路径）
+    pub fn container_environment(&self) -> Vec<(String, String)> {
+        Self::environment(&self.mount_path)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::instance::{InstanceResourceLimits, NetworkConfig};
+    use crate::spearlet::execution::runtime::RuntimeType;
+    use std::collections::HashMap;
+
+    fn instance_config(needs_cache: bool) -> InstanceConfig {
+        let mut task_config = HashMap::new();
+        if needs_cache {
+            task_config.insert(
+                TASK_CONFIG_NEEDS_MODEL_CACHE.to_string(),
+                "true".to_string(),
+            );
+        }
+        InstanceConfig {
+            task_id: "task-cache".to_string(),
+            artifact_id: "artifact".to_string(),
+            runtime_type: RuntimeType::Process,
+            runtime_config: HashMap::new(),
+            task_config,
+            artifact: None,
+            environment: HashMap::new(),
+            resource_limits: InstanceResourceLimits::default(),
+            network_config: NetworkConfig::default(),
+            max_concurrent_requests: 1,
+            request_timeout_ms: 1000,
+        }
+    }
+
+    #[test]
+    fn test_model_cache_requires_declaration() {
+        let cfg = SpearletConfig::default();
+        assert!(ModelCacheMount::resolve(&instance_config(false), Some(&cfg)).is_none());
+        assert!(ModelCacheMount::resolve(&instance_config(true), Some(&cfg)).is_some());
+    }
+
+    #[test]
+    fn test_model_cache_path_resolution() {
+        let mut cfg = SpearletConfig::default();
+        cfg.local_models_dir = "/var/lib/spear/models".to_string();
+        let m = ModelCacheMount::resolve(&instance_config(true), Some(&cfg)).unwrap();
+        assert_eq!(m.host_path, PathBuf::from("/var/lib/spear/models/cache"));
+
+        cfg.model_cache.host_path = "/mnt/cache".to_string();
+        let m = ModelCacheMount::resolve(&instance_config(true), Some(&cfg)).unwrap();
+        assert_eq!(m.host_path, PathBuf::from("/mnt/cache"));
+        assert!(m
+            .host_environment()
+            .contains(&("HF_HOME".to_string(), "/mnt/cache/huggingface".to_string())));
+
+        cfg.model_cache.enabled = false;
+        assert!(ModelCacheMount::resolve(&instance_config(true), Some(&cfg)).is_none());
+    }
+}
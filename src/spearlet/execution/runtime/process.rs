@@ -4,19 +4,26 @@
 //! This module provides native process-based execution runtime.
 //! 该模块提供基于原生进程的执行运行时。
 
+use super::model_cache::ModelCacheMount;
 use super::{
     ExecutionContext, ListeningStatus, MessageHandler, Runtime, RuntimeCapabilities, RuntimeConfig,
     RuntimeExecutionResponse, RuntimeListeningConfig, RuntimeType,
     DEFAULT_PROCESS_WORKING_DIRECTORY, DEFAULT_SHELL_EXECUTABLE,
 };
+use crate::spearlet::device_profile::DeviceProfile;
 use crate::spearlet::execution::{
     communication::{
         ConnectionManager, ConnectionManagerConfig, MessageDirection, MessageType,
         MonitoringConfig, MonitoringService, SpearMessage,
     },
     instance::{InstanceConfig, InstanceResourceLimits, TaskInstance},
+    task::{LivenessProbeConfig, LivenessProbeKind},
     ExecutionError, ExecutionResult, InstanceStatus,
 };
+use crate::spearlet::locale::LocaleSettings;
+use crate::spearlet::scratch_files;
+use crate::spearlet::service_ports;
+use crate::spearlet::temp_workspace;
 use async_trait::async_trait;
 use serde::{Deserialize, Serialize};
 use std::collections::HashMap;
@@ -24,7 +31,7 @@ use std::net::SocketAddr;
 use std::process::Stdio;
 use std::sync::Arc;
 use std::time::{Duration, Instant};
-use tracing::{debug, info};
+use tracing::{debug, info, warn};
 
 use tokio::process::{Child as TokioChild, Command};
 use tokio::sync::{Mutex, RwLock};
@@ -193,6 +200,13 @@ impl ProcessRuntime {
             .get("executable")
             .and_then(|v| v.as_str())
             .unwrap_or(&self.config.default_executable);
+        let search_paths = self
+            .runtime_config
+            .spearlet_config
+            .as_ref()
+            .map(|c| c.execution.search_paths.as_slice())
+            .unwrap_or_default();
+        let executable = resolve_executable(executable, search_paths);
 
         let mut command = Command::new(executable);
 
@@ -209,6 +223,58 @@ impl ProcessRuntime {
             }
         }
 
+        // Expose the shared model cache when requested / 按需暴露共享模型缓存
+        if let Some(cache) = ModelCacheMount::resolve(
+            instance_config,
+            self.runtime_config.spearlet_config.as_ref(),
+        ) {
+            if let Err(e) = std::fs::create_dir_all(&cache.host_path) {
+                warn!(
+                    "Failed to create model cache dir {}: {}",
+                    cache.host_path.display(),
+                    e
+                );
+            }
+            for (key, value) in cache.host_environment() {
+                command.env(key, value);
+            }
+        }
+
+        // Apply the configured locale and timezone / 应用配置的区域与时区
+        let locale = LocaleSettings::resolve(
+            &instance_config.task_config,
+            self.runtime_config.spearlet_config.as_ref(),
+        );
+        for (key, value) in locale.environment() {
+            command.env(key, value);
+        }
+
+        // Expose the device profile / 暴露设备描述
+        let devices = DeviceProfile::from_config(self.runtime_config.spearlet_config.as_ref());
+        for (key, value) in devices.environment() {
+            command.env(key, value);
+        }
+
+        // Expose the task's scratch directory / 暴露任务的临时目录
+        if let Ok(dir) = self
+            .runtime_config
+            .node
+            .scratch_files
+            .task_dir(&instance_config.task_id)
+        {
+            command.env(scratch_files::ENV_SCRATCH_DIR, dir);
+        }
+
+        // Keep temporary files in the task's workspace / 将临时文件保存在任务的工作区中
+        if let Ok(dir) = self
+            .runtime_config
+            .node
+            .temp_workspace
+            .task_dir(&instance_config.task_id)
+        {
+            command.envs(temp_workspace::environment(&dir));
+        }
+
         // Add instance-specific environment variables / 添加实例特定的环境变量
         for (key, value) in &instance_config.environment {
             command.env(key, value);
@@ -435,6 +501,12 @@ impl Runtime for ProcessRuntime {
         let secret = self.generate_instance_secret(instance.id());
         instance.set_secret(secret);
 
+        let service_names = service_ports::port_names(&config.task_config).map_err(|e| {
+            ExecutionError::InvalidConfiguration {
+                message: e.to_string(),
+            }
+        })?;
+
         let mut command = self.build_process_command(config);
 
         // Add arguments if specified / 如果指定了参数则添加
@@ -448,8 +520,35 @@ impl Runtime for ProcessRuntime {
             }
         }
 
-        let child = command.spawn().map_err(|e| ExecutionError::RuntimeError {
-            message: format!("Failed to spawn process: {}", e),
+        // Reserve the service ports the task serves on / 预留任务提供服务的端口
+        if !service_names.is_empty() {
+            let cfg = self
+                .runtime_config
+                .spearlet_config
+                .as_ref()
+                .map(|c| c.service_ports.clone())
+                .unwrap_or_default();
+            let bindings = self
+                .runtime_config
+                .node
+                .service_ports
+                .allocate(&cfg, &config.task_id, instance.id(), &service_names)
+                .map_err(|e| ExecutionError::RuntimeError {
+                    message: format!("Failed to allocate service ports: {}", e),
+                })?;
+            for (key, value) in service_ports::environment(&bindings) {
+                command.env(key, value);
+            }
+        }
+
+        let child = command.spawn().map_err(|e| {
+            self.runtime_config
+                .node
+                .service_ports
+                .release_instance(instance.id());
+            ExecutionError::RuntimeError {
+                message: format!("Failed to spawn process: {}", e),
+            }
         })?;
 
         let pid = child.id().unwrap_or(0);
@@ -533,6 +632,10 @@ impl Runtime for ProcessRuntime {
             let _ = timeout(Duration::from_secs(5), child.wait()).await;
         }
 
+        self.runtime_config
+            .node
+            .service_ports
+            .release_instance(instance.id());
         instance.set_status(InstanceStatus::Stopped);
         Ok(())
     }
@@ -623,6 +726,39 @@ impl Runtime for ProcessRuntime {
         }
     }
 
+    async fn liveness_probe(
+        &self,
+        instance: &Arc<TaskInstance>,
+        probe: &LivenessProbeConfig,
+    ) -> ExecutionResult<bool> {
+        debug!(
+            "ProcessRuntime::liveness_probe instance_id={}",
+            instance.id()
+        );
+        if let LivenessProbeKind::Method { name } = &probe.probe {
+            let resp = self
+                .execute(instance, super::liveness_method_context(name, probe))
+                .await?;
+            return Ok(!resp.has_failed());
+        }
+
+        // An authenticated agent connection must have shown activity within the deadline
+        // 已认证的 agent 连接必须在截止时间内有活动
+        let connection = self
+            .connection_manager
+            .read()
+            .await
+            .as_ref()
+            .and_then(|cm| cm.get_connection_by_instance(instance.id()));
+        if let Some(conn) = connection {
+            let active_window = Duration::from_millis(probe.period_ms.max(probe.deadline_ms));
+            if conn.last_activity.elapsed() > active_window {
+                return Ok(false);
+            }
+        }
+        self.health_check(instance).await
+    }
+
     async fn get_metrics(
         &self,
         instance: &Arc<TaskInstance>,
@@ -656,6 +792,10 @@ impl Runtime for ProcessRuntime {
             "ProcessRuntime::cleanup_instance instance_id={}",
             instance.id()
         );
+        self.runtime_config
+            .node
+            .service_ports
+            .release_instance(instance.id());
         if let Some(handle) = instance.get_runtime_handle::<ProcessHandle>() {
             self.kill_process_tree(handle.pid).await?;
         }
@@ -859,6 +999,20 @@ impl Runtime for ProcessRuntime {
     }
 }
 
+/// Find a bare executable name in the search paths, else leave it to `PATH`
+/// 在搜索路径中查找不带路径的可执行文件名，找不到时交给 `PATH`
+fn resolve_executable(executable: &str, search_paths: &[String]) -> std::path::PathBuf {
+    if !executable.contains(std::path::MAIN_SEPARATOR) && !executable.contains('/') {
+        for dir in search_paths {
+            let candidate = std::path::Path::new(dir).join(executable);
+            if candidate.is_file() {
+                return candidate;
+            }
+        }
+    }
+    std::path::PathBuf::from(executable)
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -866,6 +1020,19 @@ mod tests {
         InstanceConfig, InstanceResourceLimits, NetworkConfig,
     };
 
+    #[test]
+    fn test_resolve_executable_search_paths() {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::write(dir.path().join("agent"), b"#!/bin/sh\n").unwrap();
+        let paths = vec![
+            "/nonexistent".to_string(),
+            dir.path().to_string_lossy().into_owned(),
+        ];
+        assert_eq!(resolve_executable("agent", &paths), dir.path().join("agent"));
+        assert_eq!(resolve_executable("sh", &paths), std::path::PathBuf::from("sh"));
+        assert_eq!(resolve_executable("./agent", &paths), std::path::PathBuf::from("./agent"));
+    }
+
     #[test]
     fn test_process_config_default() {
         let config = ProcessConfig::default();
@@ -883,6 +1050,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: super::super::ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = ProcessRuntime::new(&runtime_config);
@@ -900,6 +1068,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: super::super::ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = ProcessRuntime::new(&runtime_config).unwrap();
@@ -945,6 +1114,7 @@ mod tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: super::super::ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = ProcessRuntime::new(&runtime_config).unwrap();
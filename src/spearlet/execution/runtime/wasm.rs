@@ -5,7 +5,7 @@
 //! 该模块使用 Wasmtime 提供基于 WebAssembly 的执行运行时。
 
 #[cfg(feature = "wasmedge")]
-use super::wasm_hostcalls::build_spear_import_with_api;
+use super::wasm_hostcalls::build_spear_import_with_locale;
 use super::{
     ExecutionContext, Runtime, RuntimeCapabilities, RuntimeConfig, RuntimeExecutionResponse,
     RuntimeType,
@@ -382,17 +382,28 @@ impl WasmRuntime {
         let task_policy = std::sync::Arc::new(
             crate::spearlet::mcp::task_subset::parse_task_config(&instance.config.task_config),
         );
+        let locale = crate::spearlet::locale::LocaleSettings::resolve(
+            &instance.config.task_config,
+            runtime_config.spearlet_config.as_ref(),
+        );
+        runtime_config
+            .node
+            .moderation
+            .mark_task(&task_id, &instance.config.task_config);
+        let node = runtime_config.node.clone();
 
         let worker = move || {
+            crate::spearlet::crash::set_thread_component("wasm-worker");
             let mut wasi_module = WasiModule::create(None, None, None).unwrap();
             let mut instances: HashMap<String, &mut dyn SyncInst> = HashMap::new();
             instances.insert(wasi_module.name().to_string(), wasi_module.as_mut());
 
-            let mut spear_import = build_spear_import_with_api(
+            let mut spear_import = build_spear_import_with_locale(
                 runtime_config,
                 task_id.clone(),
                 task_policy.clone(),
                 instance_id.clone(),
+                locale,
             )
             .unwrap();
             let spear_name = "spear".to_string();
@@ -431,6 +442,31 @@ impl WasmRuntime {
                             ctx_keys = ?ctx_key_preview,
                             "wasm.worker.invoke.start"
                         );
+                        let parent = context_data
+                            .get(crate::spearlet::otel::TRACEPARENT_KEY)
+                            .and_then(|v| v.as_str())
+                            .and_then(crate::spearlet::otel::TraceContext::parse);
+                        let mut span = crate::spearlet::otel::Span::start(
+                            "wasm.execute",
+                            crate::spearlet::otel::SpanKind::Internal,
+                            parent.as_ref(),
+                        );
+                        span.set_attr("spear.execution_id", execution_id.as_str());
+                        span.set_attr("spear.instance_id", instance_id.as_str());
+                        span.set_attr("spear.function_name", function_name.as_str());
+                        let mut span = span.enter();
+                        // Hostcall logs inherit these fields / hostcall 日志继承这些字段
+                        let log_span = tracing::info_span!(
+                            "execution",
+                            request_id = context_data
+                                .get(crate::spearlet::request_id::METADATA_KEY)
+                                .and_then(|v| v.as_str())
+                                .unwrap_or_default(),
+                            task_id = %task_id,
+                            execution_id = %execution_id,
+                            method = %function_name,
+                        )
+                        .entered();
                         crate::spearlet::execution::host_api::set_current_wasm_execution_id(Some(
                             execution_id.clone(),
                         ));
@@ -461,17 +497,20 @@ impl WasmRuntime {
                             match out {
                                 Ok(values) => Ok(format!("{:?}", values).into_bytes()),
                                 Err(e) => {
-                                    if let Some(s) = crate::spearlet::execution::host_api::termination::instance_registry().check(&instance_id) {
+                                    if let Some(s) = node.terminations.instances.check(&instance_id)
+                                    {
                                         Err(ExecutionError::InstanceDestroyed {
-                                            message: s
-                                                .message
-                                                .unwrap_or_else(|| "instance destroyed".to_string()),
+                                            message: s.message.unwrap_or_else(|| {
+                                                "instance destroyed".to_string()
+                                            }),
                                         })
-                                    } else if let Some(s) = crate::spearlet::execution::host_api::termination::exec_registry().check(&execution_id) {
+                                    } else if let Some(s) =
+                                        node.terminations.executions.check(&execution_id)
+                                    {
                                         Err(ExecutionError::ExecutionTerminated {
-                                            message: s
-                                                .message
-                                                .unwrap_or_else(|| "execution terminated".to_string()),
+                                            message: s.message.unwrap_or_else(|| {
+                                                "execution terminated".to_string()
+                                            }),
                                         })
                                     } else {
                                         Err(ExecutionError::RuntimeError {
@@ -482,7 +521,12 @@ impl WasmRuntime {
                             }
                         };
                         crate::spearlet::execution::host_api::set_current_wasm_execution_id(None);
-                        crate::spearlet::execution::host_api::termination::clear_execution_termination(&execution_id);
+                        node.terminations.clear_execution_termination(&execution_id);
+                        if let Err(e) = &res {
+                            span.span_mut().set_error(e.to_string());
+                        }
+                        drop(log_span);
+                        drop(span);
                         let elapsed_ms = start.elapsed().as_millis() as u64;
                         tracing::debug!(
                             execution_id = %execution_id,
@@ -1184,6 +1228,7 @@ mod wasm_runtime_thread_tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: super::super::ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = WasmRuntime::new(&runtime_config);
@@ -1201,6 +1246,7 @@ mod wasm_runtime_thread_tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: super::super::ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = WasmRuntime::new(&runtime_config).unwrap();
@@ -1222,6 +1268,7 @@ mod wasm_runtime_thread_tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: super::super::ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = WasmRuntime::new(&runtime_config).unwrap();
@@ -1287,6 +1334,7 @@ mod wasm_runtime_thread_tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: super::super::ResourcePoolConfig::default(),
+            node: Default::default(),
         };
 
         let runtime = WasmRuntime::new(&runtime_config).unwrap();
@@ -1524,6 +1572,7 @@ mod wasm_runtime_tests {
             global_environment: HashMap::new(),
             spearlet_config: None,
             resource_pool: super::super::ResourcePoolConfig::default(),
+            node: Default::default(),
         }
     }
 
@@ -1,11 +1,17 @@
-use crate::spearlet::execution::host_api::{DefaultHostApi, SpearHostApi};
+use crate::spearlet::blob_cache::BLOB_ID_LEN;
+use crate::spearlet::execution::debug_trace::TraceKind;
 use crate::spearlet::execution::host_api::errno::{
     SPEAR_EBADF, SPEAR_EFAULT, SPEAR_EINVAL, SPEAR_EIO, SPEAR_ENOSPC, SPEAR_OK,
 };
+use crate::spearlet::execution::host_api::{
+    middleware, DefaultHostApi, SpearHostApi, ONNX_CTL_LIST,
+};
 use crate::spearlet::execution::runtime::{ResourcePoolConfig, RuntimeConfig};
 use crate::spearlet::execution::ExecutionError;
 use crate::spearlet::execution::RuntimeType;
+use crate::spearlet::locale::LocaleSettings;
 use crate::spearlet::mcp::task_subset::McpTaskPolicy;
+use crate::spearlet::otel;
 use crate::spearlet::param_keys::chat as chat_keys;
 use std::time::SystemTime;
 use tracing::debug;
@@ -27,11 +33,106 @@ const SPEAR_ERR_INVALID_CMD: i32 = -SPEAR_EINVAL;
 const SPEAR_ERR_INTERNAL: i32 = -SPEAR_EIO;
 
 const SPEAR_LOG_MAX_BYTES: i32 = 16 * 1024;
+const SPEAR_TEST_ECHO_MAX_BYTES: i32 = 1024 * 1024;
+
+/// Functions of the `spear` import module, in registration order
+/// `spear` 导入模块的函数，按注册顺序排列
+pub const HOSTCALL_NAMES: &[&str] = &[
+    "time_now_ms",
+    "wall_time_s",
+    "tz_offset_s",
+    "device_profile",
+    "onnx_infer",
+    "onnx_ctl",
+    "random_i64",
+    "log",
+    "sleep_ms",
+    "test_echo",
+    "test_fail",
+    "test_latency",
+    "test_state",
+    "cchat_create",
+    "cchat_write_msg",
+    "cchat_write_fn",
+    "cchat_ctl",
+    "cchat_send",
+    "cchat_recv",
+    "cchat_recv_delta",
+    "cchat_close",
+    "tts_create",
+    "tts_write",
+    "tts_ctl",
+    "tts_send",
+    "tts_read",
+    "tts_close",
+    "embeddings",
+    "moderate",
+    "chat_structured",
+    "image_generate",
+    "tool_list",
+    "tool_invoke",
+    "compute_hint",
+    "blob_put",
+    "blob_size",
+    "blob_read",
+    "blob_release",
+    "vs_create",
+    "vs_insert",
+    "vs_search",
+    "vs_delete",
+    "vs_list",
+    "kv_get",
+    "kv_set",
+    "kv_delete",
+    "kv_list",
+    "mp_register",
+    "mp_lookup",
+    "mp_send",
+    "mp_recv",
+    "mp_ack",
+    "mp_wait_ack",
+    "file_read",
+    "file_write",
+    "file_list",
+    "file_delete",
+    "invoke_start",
+    "invoke_next",
+    "invoke_cancel",
+    "schedule_create",
+    "schedule_cancel",
+    "schedule_list",
+    "rtasr_create",
+    "rtasr_ctl",
+    "rtasr_write",
+    "rtasr_read",
+    "rtasr_close",
+    "rttts_create",
+    "rttts_ctl",
+    "rttts_write",
+    "rttts_read",
+    "rttts_close",
+    "mic_create",
+    "mic_ctl",
+    "mic_read",
+    "mic_close",
+    "user_stream_open",
+    "user_stream_read",
+    "user_stream_write",
+    "user_stream_close",
+    "user_stream_ctl_open",
+    "user_stream_ctl_read",
+    "spear_epoll_create",
+    "spear_epoll_ctl",
+    "spear_epoll_wait",
+    "spear_epoll_close",
+    "spear_fd_ctl",
+];
 
 const CTL_SET_PARAM: i32 = 1;
 const CTL_GET_METRICS: i32 = 2;
 
 fn guard_termination(host_data: &DefaultHostApi) -> Result<(), CoreError> {
+    host_data.node().output_caps.check_current();
     if let Some(s) = host_data.check_wasm_termination() {
         let msg = match (s.scope, s.message.as_deref()) {
             (
@@ -70,12 +171,118 @@ macro_rules! guarded {
          frame: &mut CallingFrame,
          input: Vec<WasmValue>|
          -> Result<Vec<WasmValue>, CoreError> {
+            let _span = hostcall_span(stringify!($f));
+            let _log = tracing::debug_span!("hostcall", call = stringify!($f)).entered();
             guard_termination(host_data)?;
-            $f(host_data, instance, frame, input)
+            let request = middleware_request(host_data, instance, &input, stringify!($f));
+            with_middleware(host_data, instance, request, stringify!($f), |h, i| {
+                with_debug_trace(h, stringify!($f), |h| $f(h, i, frame, input))
+            })
+        }
+    };
+}
+
+/// Trace a hostcall that skips the termination guard / 追踪不经终止检查的 hostcall
+macro_rules! traced {
+    ($f:ident) => {
+        |host_data: &mut DefaultHostApi,
+         instance: &mut Instance,
+         frame: &mut CallingFrame,
+         input: Vec<WasmValue>|
+         -> Result<Vec<WasmValue>, CoreError> {
+            let _span = hostcall_span(stringify!($f));
+            let _log = tracing::debug_span!("hostcall", call = stringify!($f)).entered();
+            let request = middleware_request(host_data, instance, &input, stringify!($f));
+            with_middleware(host_data, instance, request, stringify!($f), |h, i| {
+                with_debug_trace(h, stringify!($f), |h| $f(h, i, frame, input))
+            })
         }
     };
 }
 
+/// JSON request of a hostcall, read when a middleware asks for it
+/// hostcall 的 JSON 请求，在中间件需要时读取
+fn middleware_request(
+    host_data: &DefaultHostApi,
+    instance: &mut Instance,
+    input: &[WasmValue],
+    f: &str,
+) -> Option<Vec<u8>> {
+    let method = f.trim_start_matches("spear_");
+    if !middleware::REQUEST_HOSTCALLS.contains(&method)
+        || !host_data.node().hostcall_chain.wants_request(method)
+    {
+        return None;
+    }
+    kv_read_key(instance, input).ok()
+}
+
+/// Run a hostcall through the middleware chain; a rejection becomes its return code
+/// 经中间件链运行 hostcall；被拒绝时以拒绝码作为返回值
+fn with_middleware(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    request: Option<Vec<u8>>,
+    f: &str,
+    call: impl FnOnce(&mut DefaultHostApi, &mut Instance) -> Result<Vec<WasmValue>, CoreError>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let chain = &host_data.node().hostcall_chain;
+    let entered = match chain.enter(&middleware::HostcallCall {
+        method: f.trim_start_matches("spear_"),
+        host: host_data,
+        request: request.as_deref(),
+    }) {
+        Ok(e) => e,
+        Err(rc) => return Ok(vec![WasmValue::from_i32(rc)]),
+    };
+    let out = call(host_data, instance);
+    let rc = match &out {
+        Ok(values) => match values.first() {
+            Some(v) if v.ty() == ValType::I32 => Some(v.to_i32() as i64),
+            Some(v) if v.ty() == ValType::I64 => Some(v.to_i64()),
+            _ => Some(0),
+        },
+        Err(_) => None,
+    };
+    entered.finish(rc);
+    out
+}
+
+/// Run a hostcall, adding it to the execution's debug trace when one is recorded
+/// 运行 hostcall；若该执行正在记录调试追踪则将其加入
+fn with_debug_trace(
+    host_data: &mut DefaultHostApi,
+    f: &str,
+    call: impl FnOnce(&mut DefaultHostApi) -> Result<Vec<WasmValue>, CoreError>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if !host_data.node().debug_traces.enabled() {
+        return call(host_data);
+    }
+    let started = std::time::Instant::now();
+    let out = call(host_data);
+    let detail = match &out {
+        Ok(values) => match values.first() {
+            Some(v) if v.ty() == ValType::I32 => serde_json::json!({"rc": v.to_i32()}),
+            Some(v) if v.ty() == ValType::I64 => serde_json::json!({"rc": v.to_i64()}),
+            _ => serde_json::Value::Null,
+        },
+        Err(e) => serde_json::json!({"error": e.to_string()}),
+    };
+    host_data.node().debug_traces.record(
+        TraceKind::Hostcall,
+        f.strip_prefix("spear_").unwrap_or(f),
+        Some(started.elapsed()),
+        detail,
+    );
+    out
+}
+
+/// Child span of the running execution for one hostcall / 当前执行下单次 hostcall 的子 span
+fn hostcall_span(f: &str) -> Option<otel::EnteredSpan> {
+    let name = format!("hostcall.{}", f.strip_prefix("spear_").unwrap_or(f));
+    otel::enter_child(&name, otel::SpanKind::Internal)
+}
+
 fn get_i32_arg(input: &[WasmValue], idx: usize) -> Option<i32> {
     input.get(idx).map(|v| v.to_i32())
 }
@@ -588,6 +795,32 @@ pub fn cchat_recv(
     Ok(vec![WasmValue::from_i32(wrote)])
 }
 
+pub fn cchat_recv_delta(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 3 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+
+    let response_fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    let out_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+
+    let payload = match host_data.cchat_recv_delta(response_fd) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &payload);
+    if wrote < 0 {
+        // Keep the event for a retry with a larger buffer / 保留事件，供使用更大缓冲区重试
+        host_data.cchat_unread_delta(response_fd, payload);
+    }
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
 pub fn cchat_close(
     host_data: &mut DefaultHostApi,
     _instance: &mut Instance,
@@ -601,6 +834,134 @@ pub fn cchat_close(
     Ok(vec![WasmValue::from_i32(host_data.cchat_close(fd))])
 }
 
+pub fn tts_create(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if !input.is_empty() {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    Ok(vec![WasmValue::from_i32(host_data.tts_create())])
+}
+
+pub fn tts_write(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 3 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+
+    let fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    let text_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let text_len = get_i32_arg(&input, 2).unwrap_or(-1);
+
+    let text = match mem_read(instance, text_ptr, text_len) {
+        Ok(b) => String::from_utf8_lossy(&b).to_string(),
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    Ok(vec![WasmValue::from_i32(host_data.tts_write(fd, &text))])
+}
+
+pub fn tts_ctl(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+
+    let fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    let cmd = get_i32_arg(&input, 1).unwrap_or(SPEAR_ERR_INVALID_CMD);
+    let arg_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let arg_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+
+    if cmd != CTL_SET_PARAM {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INVALID_CMD)]);
+    }
+    let arg_len = match mem_read_u32(instance, arg_len_ptr) {
+        Ok(v) => v as i32,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let bytes = match mem_read(instance, arg_ptr, arg_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let v: serde_json::Value = match serde_json::from_slice(&bytes) {
+        Ok(v) => v,
+        Err(_) => return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INVALID_CMD)]),
+    };
+    let key = v.get("key").and_then(|x| x.as_str()).unwrap_or("");
+    let value = v.get("value").cloned().unwrap_or(serde_json::Value::Null);
+    let rc = host_data.tts_ctl_set_param(fd, key, value);
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+pub fn tts_send(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+
+    let fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    let flags = get_i32_arg(&input, 1).unwrap_or(0);
+    match host_data.tts_send(fd, flags) {
+        Ok(audio_fd) => Ok(vec![WasmValue::from_i32(audio_fd)]),
+        Err(e) => Ok(vec![WasmValue::from_i32(e)]),
+    }
+}
+
+pub fn tts_read(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 3 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+
+    let audio_fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    let out_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+
+    // Audio is a byte stream, so a read fills at most the guest buffer
+    // 音频是字节流，每次读取最多填满 guest 缓冲区
+    let max_len = match mem_read_u32(instance, out_len_ptr) {
+        Ok(v) => v as usize,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let payload = match host_data.tts_read(audio_fd, max_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &payload);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+pub fn tts_close(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 1 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    Ok(vec![WasmValue::from_i32(host_data.tts_close(fd))])
+}
+
 pub fn rtasr_create(
     host_data: &mut DefaultHostApi,
     _instance: &mut Instance,
@@ -714,6 +1075,119 @@ pub fn rtasr_close(
     Ok(vec![WasmValue::from_i32(host_data.rtasr_close(fd))])
 }
 
+pub fn rttts_create(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if !input.is_empty() {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    Ok(vec![WasmValue::from_i32(host_data.rttts_create())])
+}
+
+pub fn rttts_ctl(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+
+    let fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    let cmd = get_i32_arg(&input, 1).unwrap_or(SPEAR_ERR_INVALID_CMD);
+    let arg_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let arg_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+
+    let arg_len = match mem_read_u32(instance, arg_len_ptr) {
+        Ok(v) => v as i32,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+
+    let payload_bytes = if arg_len > 0 {
+        match mem_read(instance, arg_ptr, arg_len) {
+            Ok(b) => Some(b),
+            Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+        }
+    } else {
+        None
+    };
+
+    match host_data.rttts_ctl(fd, cmd, payload_bytes.as_deref()) {
+        Ok(Some(resp)) => {
+            let wrote = mem_write_with_len(instance, arg_ptr, arg_len_ptr, &resp);
+            Ok(vec![WasmValue::from_i32(wrote)])
+        }
+        Ok(None) => Ok(vec![WasmValue::from_i32(SPEAR_OK)]),
+        Err(e) => Ok(vec![WasmValue::from_i32(e)]),
+    }
+}
+
+pub fn rttts_write(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 3 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+
+    let fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    let text_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let text_len = get_i32_arg(&input, 2).unwrap_or(-1);
+
+    let bytes = match mem_read(instance, text_ptr, text_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    Ok(vec![WasmValue::from_i32(host_data.rttts_write(fd, &bytes))])
+}
+
+pub fn rttts_read(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 3 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+
+    let fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    let out_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+
+    // Audio is a byte stream, so a read fills at most the guest buffer
+    // 音频是字节流，每次读取最多填满 guest 缓冲区
+    let max_len = match mem_read_u32(instance, out_len_ptr) {
+        Ok(v) => v as usize,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let payload = match host_data.rttts_read(fd, max_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &payload);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+pub fn rttts_close(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 1 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let fd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_FD);
+    Ok(vec![WasmValue::from_i32(host_data.rttts_close(fd))])
+}
+
 pub fn mic_create(
     host_data: &mut DefaultHostApi,
     _instance: &mut Instance,
@@ -1070,8 +1544,972 @@ pub fn spear_wall_time_s(
     Ok(vec![WasmValue::from_i64(v)])
 }
 
-pub fn spear_sleep_ms(
-    _host_data: &mut DefaultHostApi,
+/// UTC offset in seconds of the workload timezone at the current time
+/// 工作负载时区在当前时刻相对 UTC 的偏移（秒）
+pub fn spear_tz_offset_s(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    _input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let now = SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs() as i64;
+    let v = host_data.locale().timezone.offset_at(now) as i64;
+    Ok(vec![WasmValue::from_i64(v)])
+}
+
+/// Device profile of the spearlet host as JSON; `section_len == 0` returns all sections
+/// spearlet 主机的设备描述（JSON）；`section_len == 0` 时返回全部分区
+pub fn spear_device_profile(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let section_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let section_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let section = if section_len > 0 {
+        let bytes = match mem_read(instance, section_ptr, section_len) {
+            Ok(b) => b,
+            Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+        };
+        match String::from_utf8(bytes) {
+            Ok(s) => Some(s),
+            Err(_) => return Ok(vec![WasmValue::from_i32(-SPEAR_EINVAL)]),
+        }
+    } else {
+        None
+    };
+    let out = match host_data.device_profile_json(section.as_deref()) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Run a configured ONNX model; request and result are JSON
+/// 运行已配置的 ONNX 模型；请求与结果均为 JSON
+pub fn spear_onnx_infer(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let req_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let bytes = match mem_read(instance, req_ptr, req_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let out = match host_data.onnx_infer(&bytes) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    if wrote != SPEAR_ERR_BUFFER_TOO_SMALL {
+        host_data.onnx_infer_delivered();
+    }
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Compute embeddings for a text or a batch; request and result are JSON
+/// 为单个文本或一批文本计算嵌入向量；请求与结果均为 JSON
+pub fn spear_embeddings(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let req_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let bytes = match mem_read(instance, req_ptr, req_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let out = match host_data.embeddings(&bytes) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    if wrote != SPEAR_ERR_BUFFER_TOO_SMALL {
+        host_data.embeddings_delivered();
+    }
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Check a text or a batch with a moderation backend; request and result are JSON
+/// 使用 moderation 后端检查单个文本或一批文本；请求与结果均为 JSON
+pub fn spear_moderate(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let req_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let bytes = match mem_read(instance, req_ptr, req_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let out = match host_data.moderate(&bytes) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    if wrote != SPEAR_ERR_BUFFER_TOO_SMALL {
+        host_data.moderation_delivered();
+    }
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Run a chat whose answer must match a JSON Schema; request and result are JSON
+/// 执行应答必须符合 JSON Schema 的对话；请求与结果均为 JSON
+pub fn spear_chat_structured(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let req_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let bytes = match mem_read(instance, req_ptr, req_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let out = match host_data.chat_structured(&bytes) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    if wrote != SPEAR_ERR_BUFFER_TOO_SMALL {
+        host_data.structured_delivered();
+    }
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Generate images from a prompt; request and result are JSON
+/// 根据提示词生成图像；请求与结果均为 JSON
+pub fn spear_image_generate(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let req_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let bytes = match mem_read(instance, req_ptr, req_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let out = match host_data.image_generate(&bytes) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    if wrote != SPEAR_ERR_BUFFER_TOO_SMALL {
+        host_data.image_generate_delivered();
+    }
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// List the node's builtin tools as JSON / 以 JSON 列出节点的内置工具
+pub fn spear_tool_list(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let out_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out = match host_data.tool_list() {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Run a builtin tool; request and result are JSON / 运行内置工具；请求与结果均为 JSON
+pub fn spear_tool_invoke(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let req_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let bytes = match mem_read(instance, req_ptr, req_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let out = match host_data.tool_invoke(&bytes) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    if wrote != SPEAR_ERR_BUFFER_TOO_SMALL {
+        host_data.tool_invoke_delivered();
+    }
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Start or end a compute-heavy phase; returns the granted boost in ms
+/// 开始或结束计算密集阶段；返回授予的提升毫秒数
+pub fn spear_compute_hint(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    Ok(mp_id_result(host_data.compute_hint(&req)))
+}
+
+/// Copy guest bytes into the blob cache; the id is written to `out_ptr`
+/// 将 guest 字节复制到 blob 缓存；ID 写入 `out_ptr`
+pub fn spear_blob_put(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let data_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let data_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    // Check the id fits before storing, so a short buffer does not leave a blob behind
+    // 存储前先确认 ID 放得下，避免缓冲区过小时遗留 blob
+    match mem_read_u32(instance, out_len_ptr) {
+        Ok(v) if (v as usize) < BLOB_ID_LEN => {
+            let _ = mem_write_u32(instance, out_len_ptr, BLOB_ID_LEN as u32);
+            return Ok(vec![WasmValue::from_i32(SPEAR_ERR_BUFFER_TOO_SMALL)]);
+        }
+        Ok(_) => {}
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    }
+    let data = match mem_read(instance, data_ptr, data_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let id = match host_data.blob_put(data) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, id.as_bytes());
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+fn read_blob_id(instance: &mut Instance, ptr: i32, len: i32) -> Result<String, i32> {
+    let bytes = mem_read(instance, ptr, len)?;
+    String::from_utf8(bytes).map_err(|_| -SPEAR_EINVAL)
+}
+
+/// Size of a cached blob in bytes / 缓存 blob 的字节数
+pub fn spear_blob_size(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let id_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let id_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let id = match read_blob_id(instance, id_ptr, id_len) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let rc = match host_data.blob_size(&id) {
+        Ok(n) => n as i32,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// Copy a chunk of a cached blob from `offset`, filling at most the guest buffer
+/// 从 `offset` 起复制缓存 blob 的一段，最多填满 guest 缓冲区
+pub fn spear_blob_read(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 5 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let id_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let id_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let offset = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 4).unwrap_or(-1);
+    if offset < 0 {
+        return Ok(vec![WasmValue::from_i32(-SPEAR_EINVAL)]);
+    }
+    let id = match read_blob_id(instance, id_ptr, id_len) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let max_len = match mem_read_u32(instance, out_len_ptr) {
+        Ok(v) => v as usize,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let chunk = match host_data.blob_read(&id, offset as usize, max_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &chunk);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Drop a cached blob / 丢弃缓存 blob
+pub fn spear_blob_release(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let id_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let id_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let id = match read_blob_id(instance, id_ptr, id_len) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    Ok(vec![WasmValue::from_i32(host_data.blob_release(&id))])
+}
+
+fn vs_count_call(
+    instance: &mut Instance,
+    input: &[WasmValue],
+    call: impl FnOnce(&[u8]) -> Result<usize, i32>,
+) -> Vec<WasmValue> {
+    if input.len() != 2 {
+        return vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)];
+    }
+    let req_ptr = get_i32_arg(input, 0).unwrap_or(-1);
+    let req_len = get_i32_arg(input, 1).unwrap_or(-1);
+    let bytes = match mem_read(instance, req_ptr, req_len) {
+        Ok(b) => b,
+        Err(e) => return vec![WasmValue::from_i32(e)],
+    };
+    let rc = match call(&bytes) {
+        Ok(n) => n.min(i32::MAX as usize) as i32,
+        Err(e) => e,
+    };
+    vec![WasmValue::from_i32(rc)]
+}
+
+/// Create a vector collection from a JSON spec / 按 JSON 规格创建向量集合
+pub fn spear_vs_create(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    Ok(vs_count_call(instance, &input, |req| {
+        host_data.vs_create(req).map(|_| 0)
+    }))
+}
+
+/// Insert vectors; returns how many were written / 插入向量；返回写入数量
+pub fn spear_vs_insert(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    Ok(vs_count_call(instance, &input, |req| {
+        host_data.vs_insert(req)
+    }))
+}
+
+/// Search a collection; request and matches are JSON / 检索集合；请求与匹配结果均为 JSON
+pub fn spear_vs_search(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let req_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    let bytes = match mem_read(instance, req_ptr, req_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let out = match host_data.vs_search(&bytes) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Delete vectors or a collection; returns the vectors deleted / 删除向量或集合；返回删除的向量数
+pub fn spear_vs_delete(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    Ok(vs_count_call(instance, &input, |req| {
+        host_data.vs_delete(req)
+    }))
+}
+
+/// List the task's collections as JSON / 以 JSON 列出任务的集合
+pub fn spear_vs_list(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let out_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out = match host_data.vs_list() {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+fn kv_read_key(instance: &mut Instance, input: &[WasmValue]) -> Result<Vec<u8>, i32> {
+    let key_ptr = get_i32_arg(input, 0).unwrap_or(-1);
+    let key_len = get_i32_arg(input, 1).unwrap_or(-1);
+    mem_read(instance, key_ptr, key_len)
+}
+
+fn kv_out_call(
+    instance: &mut Instance,
+    input: &[WasmValue],
+    call: impl FnOnce(&[u8]) -> Result<Vec<u8>, i32>,
+) -> Vec<WasmValue> {
+    if input.len() != 4 {
+        return vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)];
+    }
+    let out_ptr = get_i32_arg(input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(input, 3).unwrap_or(-1);
+    let key = match kv_read_key(instance, input) {
+        Ok(b) => b,
+        Err(e) => return vec![WasmValue::from_i32(e)],
+    };
+    let out = match call(&key) {
+        Ok(v) => v,
+        Err(e) => return vec![WasmValue::from_i32(e)],
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    vec![WasmValue::from_i32(wrote)]
+}
+
+/// Read the value of a task key / 读取任务键的值
+pub fn spear_kv_get(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    Ok(kv_out_call(instance, &input, |key| host_data.kv_get(key)))
+}
+
+/// Set a task key; a `ttl_s` of 0 keeps it until deleted / 设置任务键；`ttl_s` 为 0 时保留至删除
+pub fn spear_kv_set(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 5 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let val_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let val_len = get_i32_arg(&input, 3).unwrap_or(-1);
+    let ttl_s = get_i32_arg(&input, 4).unwrap_or(-1);
+    if ttl_s < 0 {
+        return Ok(vec![WasmValue::from_i32(-SPEAR_EINVAL)]);
+    }
+    let key = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let value = match mem_read(instance, val_ptr, val_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let rc = match host_data.kv_set(&key, &value, ttl_s as u64) {
+        Ok(()) => 0,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// Delete a task key / 删除任务键
+pub fn spear_kv_delete(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let key = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let rc = match host_data.kv_delete(&key) {
+        Ok(()) => 0,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// List the task keys starting with a prefix as JSON / 以 JSON 列出以前缀开头的任务键
+pub fn spear_kv_list(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    Ok(kv_out_call(instance, &input, |prefix| {
+        host_data.kv_list(prefix)
+    }))
+}
+
+fn mp_id_result(r: Result<u32, i32>) -> Vec<WasmValue> {
+    vec![WasmValue::from_i32(match r {
+        Ok(id) => id as i32,
+        Err(e) => e,
+    })]
+}
+
+/// Register a name for the caller's mailbox; returns the mailbox id
+/// 为调用方的邮箱注册名称；返回邮箱 ID
+pub fn spear_mp_register(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let name = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    Ok(mp_id_result(host_data.mp_register(&name)))
+}
+
+/// Mailbox id registered under a name / 以名称注册的邮箱 ID
+pub fn spear_mp_lookup(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let name = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    Ok(mp_id_result(host_data.mp_lookup(&name)))
+}
+
+/// Queue a message for a mailbox; returns the message id / 向邮箱发送消息；返回消息 ID
+pub fn spear_mp_send(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 3 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let mailbox = get_i32_arg(&input, 0).unwrap_or(-1);
+    let msg_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let msg_len = get_i32_arg(&input, 2).unwrap_or(-1);
+    if mailbox <= 0 {
+        return Ok(vec![WasmValue::from_i32(-SPEAR_EINVAL)]);
+    }
+    let data = match mem_read(instance, msg_ptr, msg_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    Ok(mp_id_result(host_data.mp_send(mailbox as u32, data)))
+}
+
+/// Receive the next message of the caller's mailbox; `meta_ptr` receives the message id
+/// and the sender's mailbox id
+/// 接收调用方邮箱中的下一条消息；`meta_ptr` 接收消息 ID 与发送方邮箱 ID
+pub fn spear_mp_recv(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let meta_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let timeout_ms = get_i32_arg(&input, 3).unwrap_or(0);
+    let max_len = match mem_read_u32(instance, out_len_ptr) {
+        Ok(v) => v as usize,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let msg = match host_data.mp_recv(max_len, timeout_ms) {
+        Ok(m) => m,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    // An oversized message is still queued; report the length it needs
+    // 过大的消息仍在队列中；报告所需长度
+    if msg.data.len() <= max_len {
+        let mut meta = msg.id.to_le_bytes().to_vec();
+        meta.extend_from_slice(&msg.from.to_le_bytes());
+        if let Err(e) = mem_write(instance, meta_ptr, &meta) {
+            return Ok(vec![WasmValue::from_i32(e)]);
+        }
+    }
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &msg.data);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Acknowledge a received message / 确认已接收的消息
+pub fn spear_mp_ack(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let id = get_i32_arg(&input, 0).unwrap_or(-1);
+    if id <= 0 {
+        return Ok(vec![WasmValue::from_i32(-SPEAR_EINVAL)]);
+    }
+    let rc = match host_data.mp_ack(id as u32) {
+        Ok(()) => 0,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// Wait until the receiver acknowledges a sent message / 等待接收方确认已发送的消息
+pub fn spear_mp_wait_ack(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let id = get_i32_arg(&input, 0).unwrap_or(-1);
+    let timeout_ms = get_i32_arg(&input, 1).unwrap_or(0);
+    if id <= 0 {
+        return Ok(vec![WasmValue::from_i32(-SPEAR_EINVAL)]);
+    }
+    let rc = match host_data.mp_wait_ack(id as u32, timeout_ms) {
+        Ok(()) => 0,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// Read a file of the task's scratch directory or a shared mount
+/// 读取任务临时目录或共享挂载中的文件
+pub fn spear_file_read(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    Ok(kv_out_call(instance, &input, |path| {
+        host_data.file_read(path)
+    }))
+}
+
+/// Create or replace a file / 创建或替换文件
+pub fn spear_file_write(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let data_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let data_len = get_i32_arg(&input, 3).unwrap_or(-1);
+    let path = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let data = match mem_read(instance, data_ptr, data_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let rc = match host_data.file_write(&path, &data) {
+        Ok(()) => 0,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// List a directory as JSON / 以 JSON 列出目录
+pub fn spear_file_list(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    Ok(kv_out_call(instance, &input, |path| {
+        host_data.file_list(path)
+    }))
+}
+
+/// Delete a file or a directory with its contents / 删除文件或目录及其内容
+pub fn spear_file_delete(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let path = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let rc = match host_data.file_delete(&path) {
+        Ok(()) => 0,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// Start invoking another workload from a JSON request; returns the child's handle
+/// 以 JSON 请求开始调用另一个工作负载；返回子调用句柄
+pub fn spear_invoke_start(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let req = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    Ok(mp_id_result(host_data.invoke_start(&req)))
+}
+
+/// Next event of a child as JSON / 以 JSON 返回子调用的下一个事件
+pub fn spear_invoke_next(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let handle = get_i32_arg(&input, 0).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let timeout_ms = get_i32_arg(&input, 3).unwrap_or(0);
+    if handle <= 0 {
+        return Ok(vec![WasmValue::from_i32(-SPEAR_EBADF)]);
+    }
+    let max_len = match mem_read_u32(instance, out_len_ptr) {
+        Ok(v) => v as usize,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let event = match host_data.invoke_next(handle as u32, max_len, timeout_ms) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    // An oversized event is still queued; report the length it needs
+    // 过大的事件仍在队列中；报告所需长度
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &event);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// Cancel a child invocation / 取消子调用
+pub fn spear_invoke_cancel(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let handle = get_i32_arg(&input, 0).unwrap_or(-1);
+    if handle <= 0 {
+        return Ok(vec![WasmValue::from_i32(-SPEAR_EBADF)]);
+    }
+    let rc = match host_data.invoke_cancel(handle as u32) {
+        Ok(()) => 0,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// Schedule a later invocation from a JSON request; writes the schedule id
+/// 以 JSON 请求计划一次稍后的调用；写出计划 ID
+pub fn spear_schedule_create(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    Ok(kv_out_call(instance, &input, |req| {
+        host_data.schedule_create(req)
+    }))
+}
+
+/// Cancel one of the task's schedules / 取消任务的一个计划
+pub fn spear_schedule_cancel(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let id = match kv_read_key(instance, &input) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let rc = match host_data.schedule_cancel(&id) {
+        Ok(()) => 0,
+        Err(e) => e,
+    };
+    Ok(vec![WasmValue::from_i32(rc)])
+}
+
+/// The task's schedules as JSON / 以 JSON 返回任务的计划
+pub fn spear_schedule_list(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 2 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let out_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out = match host_data.schedule_list() {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+/// List, load or unload ONNX models; `arg` holds the model name and receives the list
+/// 列出、加载或卸载 ONNX 模型；`arg` 存放模型名称并接收列表
+pub fn spear_onnx_ctl(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 3 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let cmd = get_i32_arg(&input, 0).unwrap_or(SPEAR_ERR_INVALID_CMD);
+    let arg_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let arg_len_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let arg = if cmd == ONNX_CTL_LIST {
+        Vec::new()
+    } else {
+        let arg_len = match mem_read_u32(instance, arg_len_ptr) {
+            Ok(v) => v as i32,
+            Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+        };
+        match mem_read(instance, arg_ptr, arg_len) {
+            Ok(b) => b,
+            Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+        }
+    };
+    match host_data.onnx_ctl(cmd, &arg) {
+        Ok(out) if cmd == ONNX_CTL_LIST => {
+            let wrote = mem_write_with_len(instance, arg_ptr, arg_len_ptr, &out);
+            Ok(vec![WasmValue::from_i32(wrote)])
+        }
+        Ok(_) => Ok(vec![WasmValue::from_i32(0)]),
+        Err(e) => Ok(vec![WasmValue::from_i32(e)]),
+    }
+}
+
+pub fn spear_sleep_ms(
+    _host_data: &mut DefaultHostApi,
     _instance: &mut Instance,
     _frame: &mut CallingFrame,
     input: Vec<WasmValue>,
@@ -1131,6 +2569,70 @@ pub fn spear_log(
     Ok(vec![WasmValue::from_i32(SPEAR_OK)])
 }
 
+pub fn spear_test_echo(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    if input.len() != 4 {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INTERNAL)]);
+    }
+    let in_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let in_len = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out_ptr = get_i32_arg(&input, 2).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 3).unwrap_or(-1);
+    if in_len > SPEAR_TEST_ECHO_MAX_BYTES {
+        return Ok(vec![WasmValue::from_i32(SPEAR_ERR_INVALID_CMD)]);
+    }
+    let bytes = match mem_read(instance, in_ptr, in_len) {
+        Ok(b) => b,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let out = match host_data.test_echo(&bytes) {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
+pub fn spear_test_fail(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let errno = get_i32_arg(&input, 0).unwrap_or(0);
+    Ok(vec![WasmValue::from_i32(host_data.test_fail(errno))])
+}
+
+pub fn spear_test_latency(
+    host_data: &mut DefaultHostApi,
+    _instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let ms = get_i32_arg(&input, 0).unwrap_or(-1);
+    Ok(vec![WasmValue::from_i64(host_data.test_latency(ms))])
+}
+
+pub fn spear_test_state(
+    host_data: &mut DefaultHostApi,
+    instance: &mut Instance,
+    _frame: &mut CallingFrame,
+    input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let out_ptr = get_i32_arg(&input, 0).unwrap_or(-1);
+    let out_len_ptr = get_i32_arg(&input, 1).unwrap_or(-1);
+    let out = match host_data.test_state() {
+        Ok(v) => v,
+        Err(e) => return Ok(vec![WasmValue::from_i32(e)]),
+    };
+    let wrote = mem_write_with_len(instance, out_ptr, out_len_ptr, &out);
+    Ok(vec![WasmValue::from_i32(wrote)])
+}
+
 pub fn build_spear_import() -> Result<ImportObject<DefaultHostApi>, ExecutionError> {
     let api = DefaultHostApi::new(RuntimeConfig {
         runtime_type: RuntimeType::Wasm,
@@ -1138,72 +2640,329 @@ pub fn build_spear_import() -> Result<ImportObject<DefaultHostApi>, ExecutionErr
         global_environment: std::collections::HashMap::new(),
         spearlet_config: None,
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
     let mut builder =
         ImportObjectBuilder::new("spear", api).map_err(|e| ExecutionError::RuntimeError {
             message: format!("create import builder error: {}", e),
         })?;
-
+
+    builder
+        .with_func::<(), i64>("time_now_ms", guarded!(spear_time_now_ms))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add time_now_ms function error: {}", e),
+        })?;
+    builder
+        .with_func::<(), i64>("wall_time_s", guarded!(spear_wall_time_s))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add wall_time_s function error: {}", e),
+        })?;
+    builder
+        .with_func::<(), i64>("tz_offset_s", guarded!(spear_tz_offset_s))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tz_offset_s function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("device_profile", guarded!(spear_device_profile))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add device_profile function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("onnx_infer", guarded!(spear_onnx_infer))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add onnx_infer function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("onnx_ctl", guarded!(spear_onnx_ctl))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add onnx_ctl function error: {}", e),
+        })?;
+    builder
+        .with_func::<(), i64>("random_i64", guarded!(spear_random_i64))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add random_i64 function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("log", guarded!(spear_log))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add log function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, ()>("sleep_ms", guarded!(spear_sleep_ms))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add sleep_ms function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("test_echo", guarded!(spear_test_echo))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add test_echo function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("test_fail", guarded!(spear_test_fail))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add test_fail function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i64>("test_latency", guarded!(spear_test_latency))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add test_latency function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("test_state", guarded!(spear_test_state))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add test_state function error: {}", e),
+        })?;
+
+    builder
+        .with_func::<(), i32>("cchat_create", guarded!(cchat_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32, i32), i32>("cchat_write_msg", guarded!(cchat_write_msg))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_write_msg function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("cchat_write_fn", guarded!(cchat_write_fn))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_write_fn function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("cchat_ctl", guarded!(cchat_ctl))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_ctl function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("cchat_send", guarded!(cchat_send))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_send function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("cchat_recv", guarded!(cchat_recv))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_recv function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("cchat_recv_delta", guarded!(cchat_recv_delta))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_recv_delta function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("cchat_close", guarded!(cchat_close))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_close function error: {}", e),
+        })?;
+
+    builder
+        .with_func::<(), i32>("tts_create", guarded!(tts_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("tts_write", guarded!(tts_write))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_write function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("tts_ctl", guarded!(tts_ctl))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_ctl function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("tts_send", guarded!(tts_send))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_send function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("tts_read", guarded!(tts_read))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_read function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("tts_close", guarded!(tts_close))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_close function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("embeddings", guarded!(spear_embeddings))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add embeddings function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("moderate", guarded!(spear_moderate))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add moderate function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("chat_structured", guarded!(spear_chat_structured))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add chat_structured function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("image_generate", guarded!(spear_image_generate))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add image_generate function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("tool_list", guarded!(spear_tool_list))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tool_list function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("tool_invoke", guarded!(spear_tool_invoke))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tool_invoke function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("compute_hint", guarded!(spear_compute_hint))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add compute_hint function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("blob_put", guarded!(spear_blob_put))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add blob_put function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("blob_size", guarded!(spear_blob_size))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add blob_size function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32, i32), i32>("blob_read", guarded!(spear_blob_read))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add blob_read function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("blob_release", guarded!(spear_blob_release))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add blob_release function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("vs_create", guarded!(spear_vs_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add vs_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("vs_insert", guarded!(spear_vs_insert))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add vs_insert function error: {}", e),
+        })?;
     builder
-        .with_func::<(), i64>("time_now_ms", guarded!(spear_time_now_ms))
+        .with_func::<(i32, i32, i32, i32), i32>("vs_search", guarded!(spear_vs_search))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add time_now_ms function error: {}", e),
+            message: format!("add vs_search function error: {}", e),
         })?;
     builder
-        .with_func::<(), i64>("wall_time_s", guarded!(spear_wall_time_s))
+        .with_func::<(i32, i32), i32>("vs_delete", guarded!(spear_vs_delete))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add wall_time_s function error: {}", e),
+            message: format!("add vs_delete function error: {}", e),
         })?;
     builder
-        .with_func::<(), i64>("random_i64", guarded!(spear_random_i64))
+        .with_func::<(i32, i32), i32>("vs_list", guarded!(spear_vs_list))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add random_i64 function error: {}", e),
+            message: format!("add vs_list function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32), i32>("log", guarded!(spear_log))
+        .with_func::<(i32, i32, i32, i32), i32>("kv_get", guarded!(spear_kv_get))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add log function error: {}", e),
+            message: format!("add kv_get function error: {}", e),
         })?;
     builder
-        .with_func::<i32, ()>("sleep_ms", guarded!(spear_sleep_ms))
+        .with_func::<(i32, i32, i32, i32, i32), i32>("kv_set", guarded!(spear_kv_set))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add sleep_ms function error: {}", e),
+            message: format!("add kv_set function error: {}", e),
         })?;
-
     builder
-        .with_func::<(), i32>("cchat_create", guarded!(cchat_create))
+        .with_func::<(i32, i32), i32>("kv_delete", guarded!(spear_kv_delete))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add cchat_create function error: {}", e),
+            message: format!("add kv_delete function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32, i32, i32), i32>("cchat_write_msg", guarded!(cchat_write_msg))
+        .with_func::<(i32, i32, i32, i32), i32>("kv_list", guarded!(spear_kv_list))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add cchat_write_msg function error: {}", e),
+            message: format!("add kv_list function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32, i32), i32>("cchat_write_fn", guarded!(cchat_write_fn))
+        .with_func::<(i32, i32), i32>("mp_register", guarded!(spear_mp_register))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add cchat_write_fn function error: {}", e),
+            message: format!("add mp_register function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32, i32), i32>("cchat_ctl", guarded!(cchat_ctl))
+        .with_func::<(i32, i32), i32>("mp_lookup", guarded!(spear_mp_lookup))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add cchat_ctl function error: {}", e),
+            message: format!("add mp_lookup function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32), i32>("cchat_send", guarded!(cchat_send))
+        .with_func::<(i32, i32, i32), i32>("mp_send", guarded!(spear_mp_send))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add cchat_send function error: {}", e),
+            message: format!("add mp_send function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32), i32>("cchat_recv", guarded!(cchat_recv))
+        .with_func::<(i32, i32, i32, i32), i32>("mp_recv", guarded!(spear_mp_recv))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add cchat_recv function error: {}", e),
+            message: format!("add mp_recv function error: {}", e),
         })?;
     builder
-        .with_func::<i32, i32>("cchat_close", guarded!(cchat_close))
+        .with_func::<i32, i32>("mp_ack", guarded!(spear_mp_ack))
         .map_err(|e| ExecutionError::RuntimeError {
-            message: format!("add cchat_close function error: {}", e),
+            message: format!("add mp_ack function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("mp_wait_ack", guarded!(spear_mp_wait_ack))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add mp_wait_ack function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("file_read", guarded!(spear_file_read))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add file_read function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("file_write", guarded!(spear_file_write))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add file_write function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("file_list", guarded!(spear_file_list))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add file_list function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("file_delete", guarded!(spear_file_delete))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add file_delete function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("invoke_start", guarded!(spear_invoke_start))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add invoke_start function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("invoke_next", guarded!(spear_invoke_next))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add invoke_next function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("invoke_cancel", guarded!(spear_invoke_cancel))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add invoke_cancel function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("schedule_create", guarded!(spear_schedule_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add schedule_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("schedule_cancel", guarded!(spear_schedule_cancel))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add schedule_cancel function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("schedule_list", guarded!(spear_schedule_list))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add schedule_list function error: {}", e),
         })?;
 
     builder
@@ -1231,6 +2990,31 @@ pub fn build_spear_import() -> Result<ImportObject<DefaultHostApi>, ExecutionErr
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add rtasr_close function error: {}", e),
         })?;
+    builder
+        .with_func::<(), i32>("rttts_create", guarded!(rttts_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("rttts_ctl", guarded!(rttts_ctl))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_ctl function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("rttts_write", guarded!(rttts_write))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_write function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("rttts_read", guarded!(rttts_read))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_read function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("rttts_close", guarded!(rttts_close))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_close function error: {}", e),
+        })?;
 
     builder
         .with_func::<(), i32>("mic_create", guarded!(mic_create))
@@ -1320,77 +3104,353 @@ pub fn build_spear_import_with_api(
     task_id: String,
     mcp_task_policy: std::sync::Arc<McpTaskPolicy>,
     instance_id: String,
+) -> Result<ImportObject<DefaultHostApi>, ExecutionError> {
+    let locale = LocaleSettings::from_config(runtime_config.spearlet_config.as_ref());
+    build_spear_import_with_locale(
+        runtime_config,
+        task_id,
+        mcp_task_policy,
+        instance_id,
+        locale,
+    )
+}
+
+/// Like `build_spear_import_with_api`, using the locale resolved for the workload
+/// 与 `build_spear_import_with_api` 相同，但使用为工作负载解析的区域与时区
+pub fn build_spear_import_with_locale(
+    runtime_config: RuntimeConfig,
+    task_id: String,
+    mcp_task_policy: std::sync::Arc<McpTaskPolicy>,
+    instance_id: String,
+    locale: LocaleSettings,
 ) -> Result<ImportObject<DefaultHostApi>, ExecutionError> {
     let api = DefaultHostApi::new(runtime_config)
         .with_task_policy(task_id, mcp_task_policy)
-        .with_instance_id(instance_id);
+        .with_instance_id(instance_id)
+        .with_locale(locale);
     let mut builder =
         ImportObjectBuilder::new("spear", api).map_err(|e| ExecutionError::RuntimeError {
             message: format!("create import builder error: {}", e),
         })?;
 
     builder
-        .with_func::<(), i64>("time_now_ms", spear_time_now_ms)
+        .with_func::<(), i64>("time_now_ms", traced!(spear_time_now_ms))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add time_now_ms function error: {}", e),
         })?;
     builder
-        .with_func::<(), i64>("wall_time_s", spear_wall_time_s)
+        .with_func::<(), i64>("wall_time_s", traced!(spear_wall_time_s))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add wall_time_s function error: {}", e),
         })?;
     builder
-        .with_func::<(), i64>("random_i64", spear_random_i64)
+        .with_func::<(), i64>("tz_offset_s", traced!(spear_tz_offset_s))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tz_offset_s function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("device_profile", traced!(spear_device_profile))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add device_profile function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("onnx_infer", traced!(spear_onnx_infer))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add onnx_infer function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("onnx_ctl", traced!(spear_onnx_ctl))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add onnx_ctl function error: {}", e),
+        })?;
+    builder
+        .with_func::<(), i64>("random_i64", traced!(spear_random_i64))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add random_i64 function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32), i32>("log", spear_log)
+        .with_func::<(i32, i32, i32), i32>("log", traced!(spear_log))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add log function error: {}", e),
         })?;
     builder
-        .with_func::<i32, ()>("sleep_ms", spear_sleep_ms)
+        .with_func::<i32, ()>("sleep_ms", traced!(spear_sleep_ms))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add sleep_ms function error: {}", e),
         })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("test_echo", guarded!(spear_test_echo))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add test_echo function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("test_fail", guarded!(spear_test_fail))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add test_fail function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i64>("test_latency", guarded!(spear_test_latency))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add test_latency function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("test_state", guarded!(spear_test_state))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add test_state function error: {}", e),
+        })?;
 
     builder
-        .with_func::<(), i32>("cchat_create", cchat_create)
+        .with_func::<(), i32>("cchat_create", traced!(cchat_create))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add cchat_create function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32, i32, i32), i32>("cchat_write_msg", cchat_write_msg)
+        .with_func::<(i32, i32, i32, i32, i32), i32>("cchat_write_msg", traced!(cchat_write_msg))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add cchat_write_msg function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32, i32), i32>("cchat_write_fn", cchat_write_fn)
+        .with_func::<(i32, i32, i32, i32), i32>("cchat_write_fn", traced!(cchat_write_fn))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add cchat_write_fn function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32, i32), i32>("cchat_ctl", cchat_ctl)
+        .with_func::<(i32, i32, i32, i32), i32>("cchat_ctl", traced!(cchat_ctl))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add cchat_ctl function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32), i32>("cchat_send", cchat_send)
+        .with_func::<(i32, i32), i32>("cchat_send", traced!(cchat_send))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add cchat_send function error: {}", e),
         })?;
     builder
-        .with_func::<(i32, i32, i32), i32>("cchat_recv", cchat_recv)
+        .with_func::<(i32, i32, i32), i32>("cchat_recv", traced!(cchat_recv))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add cchat_recv function error: {}", e),
         })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("cchat_recv_delta", traced!(cchat_recv_delta))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add cchat_recv_delta function error: {}", e),
+        })?;
     builder
         .with_func::<i32, i32>("cchat_close", guarded!(cchat_close))
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add cchat_close function error: {}", e),
         })?;
 
+    builder
+        .with_func::<(), i32>("tts_create", guarded!(tts_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("tts_write", guarded!(tts_write))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_write function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("tts_ctl", guarded!(tts_ctl))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_ctl function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("tts_send", guarded!(tts_send))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_send function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("tts_read", guarded!(tts_read))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_read function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("tts_close", guarded!(tts_close))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tts_close function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("embeddings", traced!(spear_embeddings))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add embeddings function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("moderate", traced!(spear_moderate))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add moderate function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("chat_structured", traced!(spear_chat_structured))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add chat_structured function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("image_generate", traced!(spear_image_generate))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add image_generate function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("tool_list", traced!(spear_tool_list))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tool_list function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("tool_invoke", traced!(spear_tool_invoke))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add tool_invoke function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("compute_hint", traced!(spear_compute_hint))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add compute_hint function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("blob_put", traced!(spear_blob_put))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add blob_put function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("blob_size", traced!(spear_blob_size))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add blob_size function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32, i32), i32>("blob_read", traced!(spear_blob_read))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add blob_read function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("blob_release", traced!(spear_blob_release))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add blob_release function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("vs_create", traced!(spear_vs_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add vs_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("vs_insert", traced!(spear_vs_insert))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add vs_insert function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("vs_search", traced!(spear_vs_search))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add vs_search function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("vs_delete", traced!(spear_vs_delete))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add vs_delete function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("vs_list", traced!(spear_vs_list))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add vs_list function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("kv_get", traced!(spear_kv_get))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add kv_get function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32, i32), i32>("kv_set", traced!(spear_kv_set))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add kv_set function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("kv_delete", traced!(spear_kv_delete))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add kv_delete function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("kv_list", traced!(spear_kv_list))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add kv_list function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("mp_register", traced!(spear_mp_register))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add mp_register function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("mp_lookup", traced!(spear_mp_lookup))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add mp_lookup function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("mp_send", traced!(spear_mp_send))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add mp_send function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("mp_recv", traced!(spear_mp_recv))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add mp_recv function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("mp_ack", traced!(spear_mp_ack))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add mp_ack function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("mp_wait_ack", traced!(spear_mp_wait_ack))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add mp_wait_ack function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("file_read", traced!(spear_file_read))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add file_read function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("file_write", traced!(spear_file_write))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add file_write function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("file_list", traced!(spear_file_list))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add file_list function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("file_delete", traced!(spear_file_delete))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add file_delete function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("invoke_start", traced!(spear_invoke_start))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add invoke_start function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("invoke_next", traced!(spear_invoke_next))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add invoke_next function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("invoke_cancel", traced!(spear_invoke_cancel))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add invoke_cancel function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("schedule_create", traced!(spear_schedule_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add schedule_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("schedule_cancel", traced!(spear_schedule_cancel))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add schedule_cancel function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32), i32>("schedule_list", traced!(spear_schedule_list))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add schedule_list function error: {}", e),
+        })?;
+
     builder
         .with_func::<(), i32>("rtasr_create", guarded!(rtasr_create))
         .map_err(|e| ExecutionError::RuntimeError {
@@ -1416,6 +3476,31 @@ pub fn build_spear_import_with_api(
         .map_err(|e| ExecutionError::RuntimeError {
             message: format!("add rtasr_close function error: {}", e),
         })?;
+    builder
+        .with_func::<(), i32>("rttts_create", guarded!(rttts_create))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_create function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32, i32), i32>("rttts_ctl", guarded!(rttts_ctl))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_ctl function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("rttts_write", guarded!(rttts_write))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_write function error: {}", e),
+        })?;
+    builder
+        .with_func::<(i32, i32, i32), i32>("rttts_read", guarded!(rttts_read))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_read function error: {}", e),
+        })?;
+    builder
+        .with_func::<i32, i32>("rttts_close", guarded!(rttts_close))
+        .map_err(|e| ExecutionError::RuntimeError {
+            message: format!("add rttts_close function error: {}", e),
+        })?;
 
     builder
         .with_func::<(), i32>("mic_create", guarded!(mic_create))
@@ -1504,6 +3589,19 @@ pub fn build_spear_import_with_api(
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_hostcall_names_match_import_builder() {
+        let src = include_str!("wasm_hostcalls.rs");
+        let start = src.find("pub fn build_spear_import_with_locale").unwrap();
+        let end = start + src[start..].find("#[cfg(test)]").unwrap();
+        let registered: Vec<&str> = src[start..end]
+            .split("with_func::<")
+            .skip(1)
+            .filter_map(|s| s.split('"').nth(1))
+            .collect();
+        assert_eq!(registered, HOSTCALL_NAMES);
+    }
+
     #[cfg(feature = "wasmedge")]
     #[test]
     fn test_call_cchat_write_fn() {
@@ -1591,9 +3689,8 @@ mod tests {
                 .try_init();
         });
 
-        use crate::spearlet::execution::host_api::{
-            clear_wasm_logs_by_execution, get_wasm_logs_by_execution, set_current_wasm_execution_id,
-        };
+        use crate::spearlet::execution::host_api::set_current_wasm_execution_id;
+        use crate::spearlet::node_services::NodeServices;
         use std::collections::HashMap;
         use std::sync::Arc;
         use wasmedge_sdk::config::{CommonConfigOptions, ConfigBuilder};
@@ -1603,7 +3700,7 @@ mod tests {
         let instance_id = "inst-test-log".to_string();
         let task_id = "task-test-log".to_string();
         let execution_id = "exec-test-log".to_string();
-        clear_wasm_logs_by_execution(&execution_id);
+        let node = NodeServices::new();
 
         let wat = r#"(module
             (type $log_t (func (param i32 i32 i32) (result i32)))
@@ -1630,6 +3727,7 @@ mod tests {
             global_environment: std::collections::HashMap::new(),
             spearlet_config: None,
             resource_pool: ResourcePoolConfig::default(),
+            node: node.clone(),
         };
         let spear_import = build_spear_import_with_api(
             runtime_config,
@@ -1652,7 +3750,7 @@ mod tests {
         assert_eq!(out.len(), 1);
         assert_eq!(out[0].to_i32(), 0);
 
-        let logs = get_wasm_logs_by_execution(&execution_id, None, 10);
+        let logs = node.wasm_logs.get_by_execution(&execution_id, None, 10);
         assert!(logs.iter().any(|e| e.message.contains("hello")));
     }
 }
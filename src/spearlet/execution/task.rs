@@ -133,6 +133,63 @@ pub struct HealthCheckConfig {
     pub failure_threshold: u32,
     /// Number of consecutive successes before marking healthy / 标记为健康前的连续成功次数
     pub success_threshold: u32,
+    /// Liveness probe for long-running workloads / 长时间运行工作负载的存活探针
+    #[serde(default)]
+    pub liveness_probe: Option<LivenessProbeConfig>,
+}
+
+/// Liveness probe kind / 存活探针类型
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum LivenessProbeKind {
+    /// Transport level ping (agent heartbeat / process liveness) / 传输层 ping（agent 心跳 / 进程存活）
+    TransportPing,
+    /// Invoke a custom method on the instance / 调用实例上的自定义方法
+    Method {
+        /// Method name / 方法名
+        name: String,
+    },
+}
+
+/// Restart policy applied when a liveness probe fails / 存活探针失败时的重启策略
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum RestartPolicy {
+    /// Only mark unhealthy and stop the instance / 仅标记不健康并停止实例
+    Never,
+    /// Replace the instance with a fresh one / 用新实例替换
+    OnFailure,
+}
+
+/// Liveness probe configuration / 存活探针配置
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
+pub struct LivenessProbeConfig {
+    /// Probe kind / 探针类型
+    pub probe: LivenessProbeKind,
+    /// Probe period in milliseconds / 探测周期（毫秒）
+    pub period_ms: u64,
+    /// Deadline for a single probe in milliseconds / 单次探测截止时间（毫秒）
+    pub deadline_ms: u64,
+    /// Consecutive failures before the instance is declared dead / 判定实例失活前的连续失败次数
+    pub failure_threshold: u32,
+    /// Restart policy / 重启策略
+    pub restart_policy: RestartPolicy,
+    /// Maximum restarts per task, 0 for unlimited / 每个任务的最大重启次数，0 表示不限制
+    pub max_restarts: u32,
+}
+
+impl Default for LivenessProbeConfig {
+    fn default() -> Self {
+        Self {
+            probe: LivenessProbeKind::TransportPing,
+            period_ms: 10000,
+            deadline_ms: 3000,
+            failure_threshold: 3,
+            restart_policy: RestartPolicy::Never,
+            max_restarts: 5,
+        }
+    }
 }
 
 impl Default for HealthCheckConfig {
@@ -143,6 +200,7 @@ impl Default for HealthCheckConfig {
             timeout_ms: 5000,   // 5 seconds
             failure_threshold: 3,
             success_threshold: 1,
+            liveness_probe: None,
         }
     }
 }
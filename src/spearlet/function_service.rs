@@ -7,7 +7,7 @@ use std::time::{SystemTime, UNIX_EPOCH};
 use tokio::sync::RwLock;
 use tonic::transport::Channel;
 use tonic::{Request, Response, Status};
-use tracing::debug;
+use tracing::{debug, Instrument};
 use uuid::Uuid;
 
 use crate::proto::spearlet::{
@@ -18,13 +18,17 @@ use crate::proto::spearlet::{
 };
 
 use crate::spearlet::execution::{
+    debug_trace,
     runtime::{ResourcePoolConfig, RuntimeConfig, RuntimeFactory, RuntimeManager},
     ExecutionError, InstancePool, InstancePoolConfig, InstanceScheduler, SchedulingPolicy,
     TaskExecutionManager, TaskExecutionManagerConfig, DEFAULT_ENTRY_FUNCTION_NAME,
 };
+use crate::spearlet::node_services::NodeServices;
+use crate::spearlet::otel;
+use crate::spearlet::request_id;
 use crate::spearlet::SpearletConfig;
 
-fn collect_llm_global_environment(cfg: &SpearletConfig) -> HashMap<String, String> {
+pub(crate) fn collect_llm_global_environment(cfg: &SpearletConfig) -> HashMap<String, String> {
     let mut cred_env: HashMap<String, String> = HashMap::new();
     for c in cfg.llm.credentials.iter() {
         if c.kind.as_str() != "env" {
@@ -64,6 +68,29 @@ fn collect_llm_global_environment(cfg: &SpearletConfig) -> HashMap<String, Strin
     out
 }
 
+/// gRPC status for an execution failure, so callers can branch on the code rather than the text
+/// 执行失败对应的 gRPC 状态，使调用方可按状态码而非文本分支
+fn execution_status(e: &ExecutionError) -> Status {
+    let message = e.to_string();
+    match e {
+        ExecutionError::InvalidRequest { .. } | ExecutionError::InvalidConfiguration { .. } => {
+            Status::invalid_argument(message)
+        }
+        ExecutionError::TaskNotFound { .. }
+        | ExecutionError::ArtifactNotFound { .. }
+        | ExecutionError::InstanceNotFound { .. }
+        | ExecutionError::ExecutionNotFound { .. } => Status::not_found(message),
+        ExecutionError::ResourceExhausted { .. } => Status::resource_exhausted(message),
+        ExecutionError::ConcurrentModification => Status::aborted(message),
+        ExecutionError::ExecutionTimeout { .. } => Status::deadline_exceeded(message),
+        ExecutionError::RuntimeNotFound { .. } | ExecutionError::ChannelClosed { .. } => {
+            Status::unavailable(message)
+        }
+        ExecutionError::NotSupported { .. } => Status::unimplemented(message),
+        _ => Status::internal(message),
+    }
+}
+
 /// Function service statistics / 函数服务统计信息
 #[derive(Debug, Clone)]
 pub struct FunctionServiceStats {
@@ -94,27 +121,47 @@ impl FunctionServiceImpl {
     pub async fn new(
         config: Arc<SpearletConfig>,
         sms_channel: Option<Channel>,
+    ) -> Result<Self, ExecutionError> {
+        Self::with_node(config, sms_channel, NodeServices::new()).await
+    }
+
+    /// Create a function service whose runtimes use `node` / 创建其运行时使用 `node` 的函数服务
+    pub async fn with_node(
+        config: Arc<SpearletConfig>,
+        sms_channel: Option<Channel>,
+        node: Arc<NodeServices>,
     ) -> Result<Self, ExecutionError> {
         let mut rm = RuntimeManager::new();
         let global_environment = collect_llm_global_environment(&config);
         let default_configs: Vec<RuntimeConfig> = RuntimeFactory::available_runtimes()
             .into_iter()
+            .filter(|rt| config.execution.runtime_enabled(rt.as_str()))
             .map(|rt| RuntimeConfig {
                 runtime_type: rt,
                 settings: HashMap::new(),
                 global_environment: global_environment.clone(),
                 spearlet_config: Some((*config).clone()),
                 resource_pool: ResourcePoolConfig::default(),
+                node: node.clone(),
             })
             .collect();
         rm.initialize_runtimes(default_configs)?;
         let runtime_manager = Arc::new(rm);
 
         // Create execution manager / 创建执行管理器
-        let manager_config = TaskExecutionManagerConfig::default();
-        let execution_manager =
-            TaskExecutionManager::new(manager_config, runtime_manager, config.clone(), sms_channel)
-                .await?;
+        let manager_config = TaskExecutionManagerConfig {
+            max_concurrent_executions: config.execution.max_concurrent_executions.max(1),
+            max_instances_per_task: config.execution.max_instances_per_task.max(1),
+            ..Default::default()
+        };
+        let execution_manager = TaskExecutionManager::with_node(
+            manager_config,
+            runtime_manager,
+            config.clone(),
+            sms_channel,
+            node,
+        )
+        .await?;
 
         // Create instance pool / 创建实例池
         let pool_config = InstancePoolConfig::default();
@@ -175,7 +222,10 @@ impl FunctionServiceImpl {
         })
     }
 
-    async fn invoke_once(&self, mut req: InvokeRequest) -> Result<InvokeResponse, Status> {
+    pub(crate) async fn invoke_once(
+        &self,
+        mut req: InvokeRequest,
+    ) -> Result<InvokeResponse, Status> {
         if req.invocation_id.is_empty() {
             req.invocation_id = Uuid::new_v4().to_string();
         }
@@ -192,6 +242,27 @@ impl FunctionServiceImpl {
             req.mode = ExecutionMode::Sync as i32;
         }
 
+        let mut span = otel::Span::start(
+            "spearlet.invoke",
+            otel::SpanKind::Internal,
+            otel::context_from_metadata(&req.metadata).as_ref(),
+        );
+        span.set_attr("spear.task_id", req.task_id.as_str());
+        span.set_attr("spear.execution_id", req.execution_id.as_str());
+        span.set_attr("spear.function_name", req.function_name.as_str());
+        if let Some(tp) = span.traceparent() {
+            req.metadata.insert(otel::TRACEPARENT_KEY.to_string(), tp);
+        }
+        // gRPC callers may not send one / gRPC 调用方可能未携带
+        let rid = request_id::ensure(&mut req.metadata);
+        let log_span = tracing::info_span!(
+            "invoke",
+            request_id = %rid,
+            task_id = %req.task_id,
+            execution_id = %req.execution_id,
+            method = %req.function_name,
+        );
+
         let execution_id = req.execution_id.clone();
         let invocation_id = req.invocation_id.clone();
         let input_ct = req
@@ -203,16 +274,29 @@ impl FunctionServiceImpl {
         let resp = self
             .execution_manager
             .submit_invocation(req)
+            .instrument(log_span)
             .await
-            .map_err(|e| Status::internal(e.to_string()))?;
+            .map_err(|e| {
+                span.set_error(e.to_string());
+                execution_status(&e)
+            })?;
 
         let instance_id = resp.instance_id.clone();
+        span.set_attr("spear.instance_id", instance_id.as_str());
+        if let Some(m) = resp.error_message.as_deref() {
+            span.set_error(m);
+        }
         let status = Self::to_proto_status(resp.status.as_str());
         let error = resp.error_message.clone().map(|m| ProtoError {
             code: "EXECUTION_ERROR".to_string(),
             message: m,
         });
         let completed = resp.is_completed();
+        let debug_trace = resp
+            .metadata
+            .get(debug_trace::TRACE_METADATA_KEY)
+            .cloned()
+            .unwrap_or_default();
         let timestamp = resp.timestamp;
         let output_data = resp.output_data;
 
@@ -232,6 +316,7 @@ impl FunctionServiceImpl {
             } else {
                 None
             },
+            debug_trace,
         })
     }
 
@@ -338,14 +423,7 @@ impl ExecutionService for FunctionServiceImpl {
         self.execution_manager
             .terminate_execution(&req.execution_id, reason)
             .await
-            .map_err(|e| match e {
-                ExecutionError::InvalidRequest { message }
-                    if message.starts_with("execution not found:") =>
-                {
-                    Status::not_found(message)
-                }
-                _ => Status::internal(e.to_string()),
-            })?;
+            .map_err(|e| execution_status(&e))?;
 
         Ok(Response::new(TerminateExecutionResponse {
             success: true,
@@ -457,4 +535,43 @@ mod tests {
         assert!(types.contains(&crate::spearlet::execution::RuntimeType::Wasm));
         assert!(types.contains(&crate::spearlet::execution::RuntimeType::Kubernetes));
     }
+
+    #[test]
+    fn test_execution_status_codes() {
+        let cases = [
+            (
+                ExecutionError::TaskNotFound { id: "t".into() },
+                tonic::Code::NotFound,
+            ),
+            (
+                ExecutionError::ExecutionNotFound { id: "e".into() },
+                tonic::Code::NotFound,
+            ),
+            (
+                ExecutionError::ExecutionTimeout { timeout_ms: 10 },
+                tonic::Code::DeadlineExceeded,
+            ),
+            (
+                ExecutionError::RuntimeNotFound {
+                    runtime_type: "Wasm".into(),
+                },
+                tonic::Code::Unavailable,
+            ),
+            (
+                ExecutionError::ChannelClosed {
+                    message: "gone".into(),
+                },
+                tonic::Code::Unavailable,
+            ),
+            (
+                ExecutionError::RuntimeError {
+                    message: "boom".into(),
+                },
+                tonic::Code::Internal,
+            ),
+        ];
+        for (e, code) in cases {
+            assert_eq!(execution_status(&e).code(), code, "{}", e);
+        }
+    }
 }
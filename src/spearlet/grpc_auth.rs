@@ -0,0 +1,404 @@
+//! Authentication for the spearlet gRPC services
+//! spearlet gRPC 服务认证
+//!
+//! Applies the `http.auth` credentials and invoke/admin roles of [`crate::spearlet::http_auth`]
+//! to every gRPC call. Tonic interceptors cannot see which method is called, so this is a
+//! tower layer on the server that maps the method path to a role, filters the client
+//! certificate header the same way the HTTP listeners do, and answers refused calls with
+//! `UNAUTHENTICATED` or `PERMISSION_DENIED`.
+//!
+//! The spearlet's own HTTP gateway reaches these services over a loopback channel after it
+//! has checked the caller itself; it presents a [`LocalCredential`] that only this node knows.
+//! 将 [`crate::spearlet::http_auth`] 中 `http.auth` 的凭证与 invoke/admin 角色应用到每个
+//! gRPC 调用。tonic 拦截器看不到被调用的方法，因此这里是服务器上的 tower layer：按方法路径
+//! 映射角色，以与 HTTP 监听器相同的方式过滤客户端证书请求头，并以 `UNAUTHENTICATED` 或
+//! `PERMISSION_DENIED` 拒绝调用。
+//!
+//! spearlet 自身的 HTTP 网关在自行校验调用方后通过回环通道访问这些服务；它出示只有本节点知道的
+//! [`LocalCredential`]。
+
+use std::sync::Arc;
+use std::task::{Context, Poll};
+
+use futures::future::BoxFuture;
+use tonic::codegen::http;
+use tonic::service::interceptor::InterceptedService;
+use tonic::service::Interceptor;
+use tonic::transport::Channel;
+use tonic::Status;
+use tower::{Layer, Service};
+use tracing::debug;
+
+use crate::spearlet::config::{HttpAuthConfig, HttpAuthRole};
+use crate::spearlet::http_auth::{
+    authenticate, constant_time_eq, credential_id, AuthError, AuthenticatedClient,
+};
+use crate::spearlet::ip_allowlist::IpAllowlist;
+use crate::spearlet::tls::PeerInfo;
+
+/// Metadata key carrying the [`LocalCredential`] / 携带 [`LocalCredential`] 的元数据键
+pub const LOCAL_CREDENTIAL_KEY: &str = "x-spear-local-credential";
+
+/// Methods open to `invoke` clients; every other method needs `admin`
+/// `invoke` 客户端可调用的方法；其余方法都需要 `admin`
+const INVOKE_METHODS: &[&str] = &[
+    "/spearlet.InvocationService/Invoke",
+    "/spearlet.ExecService/Execute",
+    "/spearlet.ExecService/ExecuteStream",
+    "/spearlet.ExecService/ListWorkloads",
+    "/spearlet.ExecService/ListTasks",
+    "/spearlet.ExecutionService/GetExecution",
+    "/spearlet.ExecutionService/ListExecutions",
+    "/spearlet.ObjectService/GetObject",
+    "/spearlet.ObjectService/ListObjects",
+];
+
+/// Role required for a gRPC method path, `None` for public paths
+/// gRPC 方法路径所需角色，公开路径返回 `None`
+///
+/// Unknown methods need `admin`, so a new mutating RPC is never open by accident.
+/// 未知方法需要 `admin`，新增的修改类 RPC 不会意外开放。
+pub fn required_role(config: &HttpAuthConfig, path: &str) -> Option<HttpAuthRole> {
+    if config.public_paths.iter().any(|p| p == path) {
+        return None;
+    }
+    if INVOKE_METHODS.contains(&path) {
+        Some(HttpAuthRole::Invoke)
+    } else {
+        Some(HttpAuthRole::Admin)
+    }
+}
+
+/// Random credential the HTTP gateway of one spearlet presents to its own gRPC services
+/// 单个 spearlet 的 HTTP 网关向其自身 gRPC 服务出示的随机凭证
+///
+/// It is created with the node and never leaves the process.
+/// 随节点创建，不会离开进程。
+#[derive(Clone)]
+pub struct LocalCredential {
+    value: http::HeaderValue,
+}
+
+impl Default for LocalCredential {
+    fn default() -> Self {
+        let bytes: [u8; 32] = rand::random();
+        let hex: String = bytes.iter().map(|b| format!("{:02x}", b)).collect();
+        Self {
+            value: http::HeaderValue::from_str(&hex).expect("hex is a valid header value"),
+        }
+    }
+}
+
+impl LocalCredential {
+    /// Wrap a loopback channel so every call carries the credential
+    /// 包装回环通道，使每个调用都携带该凭证
+    pub fn channel(&self, channel: Channel) -> LocalChannel {
+        InterceptedService::new(channel, self.clone())
+    }
+
+    fn matches(&self, headers: &http::HeaderMap) -> bool {
+        headers
+            .get(LOCAL_CREDENTIAL_KEY)
+            .is_some_and(|v| constant_time_eq(v.as_bytes(), self.value.as_bytes()))
+    }
+}
+
+impl Interceptor for LocalCredential {
+    fn call(&mut self, mut req: tonic::Request<()>) -> Result<tonic::Request<()>, Status> {
+        if let Ok(value) = tonic::metadata::AsciiMetadataValue::try_from(self.value.as_bytes()) {
+            req.metadata_mut().insert(LOCAL_CREDENTIAL_KEY, value);
+        }
+        Ok(req)
+    }
+}
+
+/// Loopback channel of the HTTP gateway / HTTP 网关的回环通道
+pub type LocalChannel = InterceptedService<Channel, LocalCredential>;
+
+struct GrpcAuth {
+    config: HttpAuthConfig,
+    local: LocalCredential,
+    /// Whether the listener terminates TLS itself / 监听器是否自行终止 TLS
+    tls: bool,
+    proxies: IpAllowlist,
+}
+
+impl GrpcAuth {
+    /// Keep the client certificate header only when the connection vouches for it
+    /// 仅在连接可为其作证时保留客户端证书请求头
+    fn filter_subject<B>(&self, req: &mut http::Request<B>) {
+        let Some(mtls) = self.config.mtls.as_ref() else {
+            return;
+        };
+        let peer = req.extensions().get::<PeerInfo>().cloned();
+        if self.tls {
+            req.headers_mut().remove(mtls.subject_header.as_str());
+            let identity = peer
+                .and_then(|p| p.identity)
+                .and_then(|id| http::HeaderValue::from_str(&id).ok());
+            if let (Some(value), Ok(name)) = (
+                identity,
+                http::HeaderName::from_bytes(mtls.subject_header.as_bytes()),
+            ) {
+                req.headers_mut().insert(name, value);
+            }
+        } else {
+            let trusted = peer.is_some_and(|p| self.proxies.contains(p.remote.ip()));
+            if !trusted
+                && req
+                    .headers_mut()
+                    .remove(mtls.subject_header.as_str())
+                    .is_some()
+            {
+                debug!("dropped client certificate metadata from an untrusted peer");
+            }
+        }
+    }
+
+    fn admit<B>(&self, req: &mut http::Request<B>) -> Result<(), Status> {
+        self.filter_subject(req);
+        // The gateway already checked its caller / 网关已校验过其调用方
+        if self.local.matches(req.headers()) {
+            req.extensions_mut().insert(AuthenticatedClient {
+                role: HttpAuthRole::Admin,
+                id: "node:local".to_string(),
+            });
+            return Ok(());
+        }
+        req.headers_mut().remove(LOCAL_CREDENTIAL_KEY);
+        let Some(required) = required_role(&self.config, req.uri().path()) else {
+            return Ok(());
+        };
+        match authenticate(&self.config, req.headers()) {
+            Ok(role) if role.allows(required) => {
+                let id = credential_id(&self.config, req.headers());
+                req.extensions_mut()
+                    .insert(AuthenticatedClient { role, id });
+                Ok(())
+            }
+            Ok(_) => Err(Status::permission_denied("admin role required")),
+            Err(AuthError::Missing) => Err(Status::unauthenticated("missing credentials")),
+            Err(AuthError::Invalid(m)) => Err(Status::unauthenticated(m)),
+        }
+    }
+}
+
+/// Tower layer enforcing [`HttpAuthConfig`] on gRPC calls
+/// 在 gRPC 调用上执行 [`HttpAuthConfig`] 的 tower layer
+///
+/// Calls that pass carry an [`AuthenticatedClient`] in their extensions.
+/// 通过的调用会在扩展中携带 [`AuthenticatedClient`]。
+#[derive(Clone)]
+pub struct GrpcAuthLayer {
+    auth: Arc<GrpcAuth>,
+}
+
+impl GrpcAuthLayer {
+    /// `tls` tells whether the server terminates TLS itself; `local` is the node's
+    /// gateway credential
+    /// `tls` 表示服务器是否自行终止 TLS；`local` 为本节点网关的凭证
+    pub fn new(config: &HttpAuthConfig, tls: bool, local: LocalCredential) -> Self {
+        let proxies = config
+            .mtls
+            .as_ref()
+            .map(|m| IpAllowlist::parse_lossy(&m.trusted_proxies))
+            .unwrap_or_default();
+        Self {
+            auth: Arc::new(GrpcAuth {
+                config: config.clone(),
+                local,
+                tls,
+                proxies,
+            }),
+        }
+    }
+}
+
+impl<S> Layer<S> for GrpcAuthLayer {
+    type Service = GrpcAuthService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        GrpcAuthService {
+            auth: self.auth.clone(),
+            inner,
+        }
+    }
+}
+
+/// Service produced by [`GrpcAuthLayer`] / 由 [`GrpcAuthLayer`] 生成的服务
+#[derive(Clone)]
+pub struct GrpcAuthService<S> {
+    auth: Arc<GrpcAuth>,
+    inner: S,
+}
+
+impl<S, B> Service<http::Request<B>> for GrpcAuthService<S>
+where
+    S: Service<http::Request<B>, Response = http::Response<tonic::body::BoxBody>>,
+    S::Future: Send + 'static,
+    S::Error: Send + 'static,
+{
+    type Response = S::Response;
+    type Error = S::Error;
+    type Future = BoxFuture<'static, Result<Self::Response, Self::Error>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut req: http::Request<B>) -> Self::Future {
+        match self.auth.admit(&mut req) {
+            Ok(()) => Box::pin(self.inner.call(req)),
+            Err(status) => {
+                debug!(path = %req.uri().path(), "refused gRPC call: {}", status.message());
+                Box::pin(std::future::ready(Ok(status.into_http())))
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::config::{HttpApiKey, HttpMtlsAuthConfig};
+
+    fn config() -> HttpAuthConfig {
+        let mut mtls = HttpMtlsAuthConfig::default();
+        mtls.subjects
+            .insert("CN=controller".to_string(), HttpAuthRole::Admin);
+        HttpAuthConfig {
+            enabled: true,
+            api_keys: vec![HttpApiKey {
+                key: "inv".to_string(),
+                role: HttpAuthRole::Invoke,
+            }],
+            mtls: Some(mtls),
+            ..Default::default()
+        }
+    }
+
+    fn call(
+        path: &str,
+        headers: &[(&'static str, &str)],
+        peer: Option<PeerInfo>,
+    ) -> http::Request<()> {
+        let mut req = http::Request::builder()
+            .method("POST")
+            .uri(path)
+            .body(())
+            .unwrap();
+        for (k, v) in headers {
+            req.headers_mut().insert(*k, v.parse().unwrap());
+        }
+        if let Some(peer) = peer {
+            req.extensions_mut().insert(peer);
+        }
+        req
+    }
+
+    #[test]
+    fn test_required_roles() {
+        let cfg = HttpAuthConfig::default();
+        assert_eq!(
+            required_role(&cfg, "/spearlet.InvocationService/Invoke"),
+            Some(HttpAuthRole::Invoke)
+        );
+        assert_eq!(
+            required_role(&cfg, "/spearlet.ExecService/ExecuteStream"),
+            Some(HttpAuthRole::Invoke)
+        );
+        assert_eq!(
+            required_role(&cfg, "/spearlet.ObjectService/PutObject"),
+            Some(HttpAuthRole::Admin)
+        );
+        assert_eq!(
+            required_role(&cfg, "/spearlet.InstanceService/DestroyInstance"),
+            Some(HttpAuthRole::Admin)
+        );
+        assert_eq!(
+            required_role(&cfg, "/spearlet.Unknown/Method"),
+            Some(HttpAuthRole::Admin)
+        );
+    }
+
+    #[test]
+    fn test_admit_checks_credentials_and_role() {
+        let auth = GrpcAuthLayer::new(&config(), false, LocalCredential::default()).auth;
+        let invoke = "/spearlet.InvocationService/Invoke";
+        let put = "/spearlet.ObjectService/PutObject";
+
+        let err = auth.admit(&mut call(invoke, &[], None)).unwrap_err();
+        assert_eq!(err.code(), tonic::Code::Unauthenticated);
+        let err = auth
+            .admit(&mut call(invoke, &[("x-api-key", "nope")], None))
+            .unwrap_err();
+        assert_eq!(err.code(), tonic::Code::Unauthenticated);
+
+        let mut req = call(invoke, &[("authorization", "Bearer inv")], None);
+        auth.admit(&mut req).unwrap();
+        let client = req.extensions().get::<AuthenticatedClient>().unwrap();
+        assert_eq!(client.role, HttpAuthRole::Invoke);
+
+        let err = auth
+            .admit(&mut call(put, &[("x-api-key", "inv")], None))
+            .unwrap_err();
+        assert_eq!(err.code(), tonic::Code::PermissionDenied);
+    }
+
+    #[test]
+    fn test_subject_metadata_needs_tls_or_trusted_proxy() {
+        let put = "/spearlet.ObjectService/PutObject";
+        let forged = [("x-client-cert-subject", "CN=controller")];
+        let peer = |identity: Option<&str>| PeerInfo {
+            remote: "10.0.0.5:4000".parse().unwrap(),
+            identity: identity.map(str::to_string),
+        };
+
+        // Plain listener, untrusted peer / 明文监听器，不受信任的对端
+        let auth = GrpcAuthLayer::new(&config(), false, LocalCredential::default()).auth;
+        let err = auth
+            .admit(&mut call(put, &forged, Some(peer(None))))
+            .unwrap_err();
+        assert_eq!(err.code(), tonic::Code::Unauthenticated);
+
+        // Plain listener behind a trusted proxy / 位于受信任代理之后的明文监听器
+        let mut cfg = config();
+        cfg.mtls.as_mut().unwrap().trusted_proxies = vec!["10.0.0.5".to_string()];
+        let auth = GrpcAuthLayer::new(&cfg, false, LocalCredential::default()).auth;
+        auth.admit(&mut call(put, &forged, Some(peer(None))))
+            .unwrap();
+
+        // TLS listener: only the verified certificate counts / TLS 监听器：只认已验证的证书
+        let mut cfg = config();
+        let mtls = cfg.mtls.as_mut().unwrap();
+        mtls.subjects
+            .insert("sha256:abcd".to_string(), HttpAuthRole::Admin);
+        mtls.trusted_proxies = vec!["10.0.0.5".to_string()];
+        let auth = GrpcAuthLayer::new(&cfg, true, LocalCredential::default()).auth;
+        let err = auth
+            .admit(&mut call(put, &forged, Some(peer(None))))
+            .unwrap_err();
+        assert_eq!(err.code(), tonic::Code::Unauthenticated);
+        auth.admit(&mut call(put, &forged, Some(peer(Some("sha256:abcd")))))
+            .unwrap();
+    }
+
+    #[test]
+    fn test_local_credential_is_admin_only_for_its_node() {
+        let local = LocalCredential::default();
+        let auth = GrpcAuthLayer::new(&config(), false, local.clone()).auth;
+        let put = "/spearlet.ObjectService/PutObject";
+
+        let mut req = call(put, &[], None);
+        req.headers_mut()
+            .insert(LOCAL_CREDENTIAL_KEY, local.value.clone());
+        auth.admit(&mut req).unwrap();
+
+        let other = LocalCredential::default();
+        let mut req = call(put, &[], None);
+        req.headers_mut()
+            .insert(LOCAL_CREDENTIAL_KEY, other.value.clone());
+        let err = auth.admit(&mut req).unwrap_err();
+        assert_eq!(err.code(), tonic::Code::Unauthenticated);
+    }
+}
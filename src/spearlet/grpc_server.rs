@@ -8,14 +8,18 @@ use tonic::transport::Server;
 
 use tracing::{error, info};
 
+use crate::proto::spearlet::exec_service_server::ExecServiceServer;
 use crate::proto::spearlet::execution_service_server::ExecutionServiceServer;
 use crate::proto::spearlet::instance_service_server::InstanceServiceServer;
 use crate::proto::spearlet::invocation_service_server::InvocationServiceServer;
 use crate::proto::spearlet::object_service_server::ObjectServiceServer;
 use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::exec_service::ExecServiceImpl;
 use crate::spearlet::function_service::FunctionServiceImpl;
+use crate::spearlet::grpc_auth::GrpcAuthLayer;
 use crate::spearlet::instance_service::InstanceServiceImpl;
 use crate::spearlet::object_service::ObjectServiceImpl;
+use crate::spearlet::tls::{self, TlsAcceptor};
 
 /// gRPC server for spearlet / spearlet的gRPC服务器
 pub struct GrpcServer {
@@ -27,6 +31,8 @@ pub struct GrpcServer {
     function_service: Arc<FunctionServiceImpl>,
     /// Instance service implementation / 实例服务实现
     instance_service: Arc<InstanceServiceImpl>,
+    /// Exec gateway service implementation / 执行网关服务实现
+    exec_service: Arc<ExecServiceImpl>,
 }
 
 impl GrpcServer {
@@ -40,14 +46,31 @@ impl GrpcServer {
         ));
         let function_service =
             Arc::new(FunctionServiceImpl::new(config.clone(), sms_channel).await?);
+        Ok(Self::with_services(
+            config,
+            object_service,
+            function_service,
+        ))
+    }
+
+    /// Serve services created elsewhere, e.g. by an embedded spearlet
+    /// 为在别处创建的服务提供 gRPC 服务，例如嵌入式 spearlet
+    pub fn with_services(
+        config: Arc<SpearletConfig>,
+        object_service: Arc<ObjectServiceImpl>,
+        function_service: Arc<FunctionServiceImpl>,
+    ) -> Self {
         let instance_service = Arc::new(InstanceServiceImpl::new(function_service.clone()));
+        let exec_service =
+            Arc::new(ExecServiceImpl::new(function_service.clone()).with_auth(&config.http.auth));
 
-        Ok(Self {
+        Self {
             config,
             object_service,
             function_service,
             instance_service,
-        })
+            exec_service,
+        }
     }
 
     /// Get object service reference / 获取对象服务引用
@@ -62,16 +85,29 @@ impl GrpcServer {
 
     /// Start gRPC server / 启动gRPC服务器
     pub async fn start(self) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
-        let (addr, object_service, invocation_service, execution_service, instance_service) =
-            self.prepare().await?;
-        let server = Server::builder()
+        let auth = self.auth_layer();
+        let (
+            addr,
+            object_service,
+            invocation_service,
+            execution_service,
+            instance_service,
+            exec_service,
+            tls_acceptor,
+        ) = self.prepare().await?;
+        let router = Server::builder()
+            .layer(tower::util::option_layer(auth))
             .add_service(object_service)
             .add_service(invocation_service)
             .add_service(execution_service)
             .add_service(instance_service)
-            .serve(addr);
+            .add_service(exec_service);
+        // One listener for both modes, so every call carries a `PeerInfo`
+        // 两种模式使用同一监听器，使每个调用都携带 `PeerInfo`
+        let listener = tls::Listener::bind(addr, tls_acceptor).await?;
+        let result = router.serve_with_incoming(listener.incoming()).await;
 
-        match server.await {
+        match result {
             Ok(_) => {
                 info!("gRPC server stopped gracefully");
                 Ok(())
@@ -91,16 +127,29 @@ impl GrpcServer {
     where
         F: std::future::Future<Output = ()> + Send + 'static,
     {
-        let (addr, object_service, invocation_service, execution_service, instance_service) =
-            self.prepare().await?;
-        let server = Server::builder()
+        let auth = self.auth_layer();
+        let (
+            addr,
+            object_service,
+            invocation_service,
+            execution_service,
+            instance_service,
+            exec_service,
+            tls_acceptor,
+        ) = self.prepare().await?;
+        let router = Server::builder()
+            .layer(tower::util::option_layer(auth))
             .add_service(object_service)
             .add_service(invocation_service)
             .add_service(execution_service)
             .add_service(instance_service)
-            .serve_with_shutdown(addr, shutdown);
+            .add_service(exec_service);
+        let listener = tls::Listener::bind(addr, tls_acceptor).await?;
+        let result = router
+            .serve_with_incoming_shutdown(listener.incoming(), shutdown)
+            .await;
 
-        match server.await {
+        match result {
             Ok(_) => {
                 info!("gRPC server stopped gracefully");
                 Ok(())
@@ -112,6 +161,20 @@ impl GrpcServer {
         }
     }
 
+    /// Auth layer for `http.auth`, which covers gRPC calls too
+    /// `http.auth` 对应的认证层，同样作用于 gRPC 调用
+    fn auth_layer(&self) -> Option<GrpcAuthLayer> {
+        let auth = &self.config.http.auth;
+        let local = self
+            .function_service
+            .get_execution_manager()
+            .node()
+            .local_credential
+            .clone();
+        auth.enabled
+            .then(|| GrpcAuthLayer::new(auth, self.config.grpc.enable_tls, local))
+    }
+
     async fn prepare(
         self,
     ) -> Result<
@@ -121,6 +184,8 @@ impl GrpcServer {
             InvocationServiceServer<Arc<FunctionServiceImpl>>,
             ExecutionServiceServer<Arc<FunctionServiceImpl>>,
             InstanceServiceServer<Arc<InstanceServiceImpl>>,
+            ExecServiceServer<Arc<ExecServiceImpl>>,
+            Option<Arc<TlsAcceptor>>,
         ),
         Box<dyn std::error::Error + Send + Sync>,
     > {
@@ -143,12 +208,36 @@ impl GrpcServer {
             .max_decoding_message_size(self.config.storage.max_object_size as usize)
             .max_encoding_message_size(self.config.storage.max_object_size as usize);
 
+        let exec_service = ExecServiceServer::new(self.exec_service.clone())
+            .max_decoding_message_size(self.config.storage.max_object_size as usize)
+            .max_encoding_message_size(self.config.storage.max_object_size as usize);
+
+        let tls_acceptor = if self.config.grpc.enable_tls {
+            let acceptor = TlsAcceptor::load(
+                "grpc",
+                self.config.grpc.cert_path.as_deref(),
+                self.config.grpc.key_path.as_deref(),
+                &self.config.tls,
+                tls::ALPN_GRPC,
+            )?;
+            acceptor.watch();
+            info!(
+                "gRPC TLS enabled (client certificates: {})",
+                tls::client_auth_mode(&self.config.tls)
+            );
+            Some(acceptor)
+        } else {
+            None
+        };
+
         Ok((
             addr,
             object_service,
             invocation_service,
             execution_service,
             instance_service,
+            exec_service,
+            tls_acceptor,
         ))
     }
 }
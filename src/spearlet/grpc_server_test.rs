@@ -269,6 +269,76 @@ async fn test_grpc_server_concurrent_creation() {
     assert_eq!(success_count, 5);
 }
 
+#[tokio::test]
+async fn test_grpc_invoke_requires_credentials_when_auth_is_enabled() {
+    use crate::proto::spearlet::invocation_service_client::InvocationServiceClient;
+    use crate::proto::spearlet::object_service_client::ObjectServiceClient;
+    use crate::proto::spearlet::{InvokeRequest, PutObjectRequest};
+    use crate::spearlet::config::{HttpApiKey, HttpAuthRole};
+
+    let port = std::net::TcpListener::bind("127.0.0.1:0")
+        .unwrap()
+        .local_addr()
+        .unwrap()
+        .port();
+    let mut config = create_test_config();
+    config.grpc.addr = format!("127.0.0.1:{}", port).parse().unwrap();
+    config.http.auth.enabled = true;
+    config.http.auth.api_keys = vec![HttpApiKey {
+        key: "inv".to_string(),
+        role: HttpAuthRole::Invoke,
+    }];
+    let server = GrpcServer::new(Arc::new(config), None).await.unwrap();
+    let (stop_tx, stop_rx) = tokio::sync::oneshot::channel::<()>();
+    let handle = tokio::spawn(server.start_with_shutdown(async move {
+        let _ = stop_rx.await;
+    }));
+
+    let url = format!("http://127.0.0.1:{}", port);
+    let mut channel = None;
+    for _ in 0..50 {
+        if let Ok(ch) = tonic::transport::Channel::from_shared(url.clone())
+            .unwrap()
+            .connect()
+            .await
+        {
+            channel = Some(ch);
+            break;
+        }
+        tokio::time::sleep(Duration::from_millis(20)).await;
+    }
+    let channel = channel.expect("gRPC server did not start");
+
+    // No credential / 无凭证
+    let err = InvocationServiceClient::new(channel.clone())
+        .invoke(InvokeRequest::default())
+        .await
+        .unwrap_err();
+    assert_eq!(err.code(), tonic::Code::Unauthenticated);
+
+    // An invoke key reaches the service / invoke key 可到达服务
+    let mut req = tonic::Request::new(InvokeRequest::default());
+    req.metadata_mut()
+        .insert("x-api-key", "inv".parse().unwrap());
+    let res = InvocationServiceClient::new(channel.clone())
+        .invoke(req)
+        .await;
+    assert!(!matches!(res, Err(ref s) if s.code() == tonic::Code::Unauthenticated));
+
+    // but may not write objects / 但不能写入对象
+    let mut req = tonic::Request::new(PutObjectRequest::default());
+    req.metadata_mut()
+        .insert("x-api-key", "inv".parse().unwrap());
+    let err = ObjectServiceClient::new(channel)
+        .put_object(req)
+        .await
+        .unwrap_err();
+    assert_eq!(err.code(), tonic::Code::PermissionDenied);
+
+    let _ = stop_tx.send(());
+    let _ = timeout(Duration::from_secs(5), handle).await;
+}
+
 #[cfg(test)]
 mod integration_tests {
     use super::*;
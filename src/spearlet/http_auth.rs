@@ -0,0 +1,478 @@
+//! HTTP API authentication for spearlet
+//! spearlet HTTP API 认证
+//!
+//! Pluggable credential checks (static API keys, HS256 JWT, client-certificate
+//! subject forwarded by a TLS-terminating proxy) plus a two-level role model:
+//! `invoke` clients may run workloads and read status, `admin` clients may also
+//! mutate objects, executions and workload metadata.
+//! 可插拔的凭证校验（静态 API key、HS256 JWT、由终止 TLS 的代理转发的客户端证书主题），
+//! 以及两级角色模型：`invoke` 客户端可调用工作负载并读取状态，`admin` 客户端还可修改
+//! 对象、执行与工作负载元数据。
+
+use std::sync::Arc;
+
+use axum::{
+    body::Body,
+    extract::State,
+    http::{header, HeaderMap, Method, Request, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Json,
+};
+use base64::{engine::general_purpose, Engine as _};
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::config::{HttpAuthConfig, HttpAuthRole};
+use crate::spearlet::service_ports;
+
+/// Authentication failure / 认证失败
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum AuthError {
+    /// No usable credential / 无可用凭证
+    Missing,
+    /// Credential present but invalid / 凭证存在但无效
+    Invalid(String),
+}
+
+/// Verified caller attached to the request after authentication succeeds
+/// 认证成功后附加到请求上的已验证调用方
+///
+/// Holds a hash of the credential, so raw keys never leave this module.
+/// 保存凭证的哈希，原始 key 不会离开本模块。
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AuthenticatedClient {
+    pub role: HttpAuthRole,
+    pub id: String,
+}
+
+/// Role required for a request, `None` for public paths / 请求所需角色，公开路径返回 `None`
+pub fn required_role(config: &HttpAuthConfig, method: &Method, path: &str) -> Option<HttpAuthRole> {
+    if config.public_paths.iter().any(|p| p == path) {
+        return None;
+    }
+    // Service ports take any method from invoking clients / 服务端口接受调用方的任意方法
+    let invoke_write = path == "/v1/exec"
+        || path == "/functions/execute"
+        || path.starts_with(service_ports::PATH_PREFIX);
+    // Reads under /admin expose internals / /admin 下的读取会暴露内部信息
+    if path.starts_with("/admin/") {
+        return Some(HttpAuthRole::Admin);
+    }
+    if method == Method::GET || method == Method::HEAD || invoke_write {
+        Some(HttpAuthRole::Invoke)
+    } else {
+        Some(HttpAuthRole::Admin)
+    }
+}
+
+/// Resolve the caller role from request headers / 从请求头解析调用方角色
+///
+/// An explicit API key or JWT decides on its own; the client certificate subject is
+/// only consulted without one. The subject header must already be filtered by the
+/// listener (see [`crate::spearlet::tls`]).
+/// 显式的 API key 或 JWT 独立决定结果；仅在没有它们时才参考客户端证书主题。
+/// 主题请求头必须已由监听器过滤（见 [`crate::spearlet::tls`]）。
+pub fn authenticate(
+    config: &HttpAuthConfig,
+    headers: &HeaderMap,
+) -> Result<HttpAuthRole, AuthError> {
+    let bearer = headers
+        .get(header::AUTHORIZATION)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.strip_prefix("Bearer "))
+        .map(str::trim);
+    let api_key = headers
+        .get("x-api-key")
+        .and_then(|v| v.to_str().ok())
+        .map(str::trim)
+        .or(bearer);
+
+    if let Some(key) = api_key {
+        if let Some(entry) = config
+            .api_keys
+            .iter()
+            .find(|k| constant_time_eq(k.key.as_bytes(), key.as_bytes()))
+        {
+            return Ok(entry.role);
+        }
+    }
+
+    if let (Some(token), Some(jwt)) = (bearer, config.jwt.as_ref()) {
+        if token.matches('.').count() == 2 && !jwt.secret.is_empty() {
+            return validate_jwt(jwt, token);
+        }
+    }
+
+    if api_key.is_some() {
+        return Err(AuthError::Invalid("unknown credential".to_string()));
+    }
+
+    if let Some(mtls) = config.mtls.as_ref() {
+        if let Some(subject) = headers
+            .get(mtls.subject_header.as_str())
+            .and_then(|v| v.to_str().ok())
+        {
+            return mtls
+                .subjects
+                .get(subject.trim())
+                .copied()
+                .ok_or_else(|| AuthError::Invalid("unknown client certificate".to_string()));
+        }
+    }
+    Err(AuthError::Missing)
+}
+
+fn validate_jwt(
+    cfg: &crate::spearlet::config::HttpJwtAuthConfig,
+    token: &str,
+) -> Result<HttpAuthRole, AuthError> {
+    let invalid = |m: &str| AuthError::Invalid(m.to_string());
+    let mut parts = token.split('.');
+    let (Some(h), Some(p), Some(sig)) = (parts.next(), parts.next(), parts.next()) else {
+        return Err(invalid("malformed token"));
+    };
+    let decode = |s: &str| {
+        general_purpose::URL_SAFE_NO_PAD
+            .decode(s.trim_end_matches('='))
+            .map_err(|_| invalid("malformed token"))
+    };
+
+    let header: serde_json::Value =
+        serde_json::from_slice(&decode(h)?).map_err(|_| invalid("malformed header"))?;
+    if header.get("alg").and_then(|v| v.as_str()) != Some("HS256") {
+        return Err(invalid("unsupported alg"));
+    }
+    let expected = hmac_sha256(cfg.secret.as_bytes(), format!("{}.{}", h, p).as_bytes());
+    if !constant_time_eq(&expected, &decode(sig)?) {
+        return Err(invalid("bad signature"));
+    }
+
+    let claims: serde_json::Value =
+        serde_json::from_slice(&decode(p)?).map_err(|_| invalid("malformed claims"))?;
+    let now = chrono::Utc::now().timestamp();
+    if let Some(exp) = claims.get("exp").and_then(|v| v.as_i64()) {
+        if now >= exp {
+            return Err(invalid("token expired"));
+        }
+    }
+    if let Some(nbf) = claims.get("nbf").and_then(|v| v.as_i64()) {
+        if now < nbf {
+            return Err(invalid("token not yet valid"));
+        }
+    }
+    if let Some(iss) = cfg.issuer.as_deref() {
+        if claims.get("iss").and_then(|v| v.as_str()) != Some(iss) {
+            return Err(invalid("issuer mismatch"));
+        }
+    }
+    if let Some(aud) = cfg.audience.as_deref() {
+        let ok = match claims.get("aud") {
+            Some(serde_json::Value::String(s)) => s == aud,
+            Some(serde_json::Value::Array(a)) => a.iter().any(|v| v.as_str() == Some(aud)),
+            _ => false,
+        };
+        if !ok {
+            return Err(invalid("audience mismatch"));
+        }
+    }
+
+    match claims.get(cfg.role_claim.as_str()).and_then(|v| v.as_str()) {
+        Some("admin") => Ok(HttpAuthRole::Admin),
+        Some("invoke") => Ok(HttpAuthRole::Invoke),
+        Some(_) => Err(invalid("unknown role")),
+        None => Ok(cfg.default_role),
+    }
+}
+
+/// Hashed identity of the credential that [`authenticate`] accepted
+/// [`authenticate`] 所接受凭证的哈希标识
+pub(crate) fn credential_id(config: &HttpAuthConfig, headers: &HeaderMap) -> String {
+    let value = |name: &str| {
+        headers
+            .get(name)
+            .and_then(|v| v.to_str().ok())
+            .map(str::trim)
+            .filter(|v| !v.is_empty())
+    };
+    let bearer = value(header::AUTHORIZATION.as_str())
+        .and_then(|v| v.strip_prefix("Bearer "))
+        .map(str::trim);
+    let (kind, raw) = match value("x-api-key").or(bearer) {
+        Some(c) => ("key", c),
+        None => (
+            "cert",
+            config
+                .mtls
+                .as_ref()
+                .and_then(|m| value(m.subject_header.as_str()))
+                .unwrap_or_default(),
+        ),
+    };
+    let digest = Sha256::digest(raw.as_bytes());
+    let hex: String = digest[..8].iter().map(|b| format!("{:02x}", b)).collect();
+    format!("{}:{}", kind, hex)
+}
+
+pub(crate) fn hmac_sha256(key: &[u8], msg: &[u8]) -> Vec<u8> {
+    const BLOCK: usize = 64;
+    let mut k = if key.len() > BLOCK {
+        Sha256::digest(key).to_vec()
+    } else {
+        key.to_vec()
+    };
+    k.resize(BLOCK, 0);
+    let ipad: Vec<u8> = k.iter().map(|b| b ^ 0x36).collect();
+    let opad: Vec<u8> = k.iter().map(|b| b ^ 0x5c).collect();
+    let inner = Sha256::new()
+        .chain_update(&ipad)
+        .chain_update(msg)
+        .finalize();
+    Sha256::new()
+        .chain_update(&opad)
+        .chain_update(inner)
+        .finalize()
+        .to_vec()
+}
+
+pub(crate) fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    if a.len() != b.len() {
+        return false;
+    }
+    a.iter().zip(b).fold(0u8, |acc, (x, y)| acc | (x ^ y)) == 0
+}
+
+/// Axum middleware enforcing [`HttpAuthConfig`] / 执行 [`HttpAuthConfig`] 的 axum 中间件
+///
+/// Attaches [`AuthenticatedClient`] to requests that pass.
+/// 为通过的请求附加 [`AuthenticatedClient`]。
+pub async fn auth_middleware(
+    State(config): State<Arc<HttpAuthConfig>>,
+    mut req: Request<Body>,
+    next: Next,
+) -> Response {
+    let Some(required) = required_role(&config, req.method(), req.uri().path()) else {
+        return next.run(req).await;
+    };
+    match authenticate(&config, req.headers()) {
+        Ok(role) if role.allows(required) => {
+            let id = credential_id(&config, req.headers());
+            req.extensions_mut()
+                .insert(AuthenticatedClient { role, id });
+            next.run(req).await
+        }
+        Ok(_) => (
+            StatusCode::FORBIDDEN,
+            Json(serde_json::json!({"error": "forbidden", "message": "admin role required"})),
+        )
+            .into_response(),
+        Err(AuthError::Missing) => (
+            StatusCode::UNAUTHORIZED,
+            [(header::WWW_AUTHENTICATE, "Bearer")],
+            Json(serde_json::json!({"error": "unauthorized", "message": "missing credentials"})),
+        )
+            .into_response(),
+        Err(AuthError::Invalid(m)) => (
+            StatusCode::UNAUTHORIZED,
+            [(header::WWW_AUTHENTICATE, "Bearer")],
+            Json(serde_json::json!({"error": "unauthorized", "message": m})),
+        )
+            .into_response(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::config::{HttpApiKey, HttpJwtAuthConfig, HttpMtlsAuthConfig};
+
+    fn sign(secret: &str, claims: serde_json::Value) -> String {
+        let h = general_purpose::URL_SAFE_NO_PAD.encode(r#"{"alg":"HS256","typ":"JWT"}"#);
+        let p = general_purpose::URL_SAFE_NO_PAD.encode(claims.to_string());
+        let s = hmac_sha256(secret.as_bytes(), format!("{}.{}", h, p).as_bytes());
+        format!("{}.{}.{}", h, p, general_purpose::URL_SAFE_NO_PAD.encode(s))
+    }
+
+    fn headers(pairs: &[(&'static str, &str)]) -> HeaderMap {
+        let mut h = HeaderMap::new();
+        for (k, v) in pairs {
+            h.insert(*k, v.parse().unwrap());
+        }
+        h
+    }
+
+    #[test]
+    fn test_hmac_sha256_known_vector() {
+        // RFC 4231 test case 2
+        let mac = hmac_sha256(b"Jefe", b"what do ya want for nothing?");
+        let hex: String = mac.iter().map(|b| format!("{:02x}", b)).collect();
+        assert_eq!(
+            hex,
+            "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+        );
+    }
+
+    #[test]
+    fn test_required_roles() {
+        let cfg = HttpAuthConfig::default();
+        assert_eq!(required_role(&cfg, &Method::GET, "/health"), None);
+        assert_eq!(
+            required_role(&cfg, &Method::POST, "/v1/exec"),
+            Some(HttpAuthRole::Invoke)
+        );
+        assert_eq!(
+            required_role(&cfg, &Method::GET, "/tasks"),
+            Some(HttpAuthRole::Invoke)
+        );
+        assert_eq!(
+            required_role(&cfg, &Method::PUT, "/objects/a"),
+            Some(HttpAuthRole::Admin)
+        );
+        assert_eq!(
+            required_role(&cfg, &Method::GET, "/admin/introspect"),
+            Some(HttpAuthRole::Admin)
+        );
+        assert_eq!(
+            required_role(&cfg, &Method::DELETE, "/v1/services/agent/ui/items/1"),
+            Some(HttpAuthRole::Invoke)
+        );
+    }
+
+    #[test]
+    fn test_api_key_authentication() {
+        let cfg = HttpAuthConfig {
+            enabled: true,
+            api_keys: vec![
+                HttpApiKey {
+                    key: "inv".to_string(),
+                    role: HttpAuthRole::Invoke,
+                },
+                HttpApiKey {
+                    key: "adm".to_string(),
+                    role: HttpAuthRole::Admin,
+                },
+            ],
+            ..Default::default()
+        };
+        assert_eq!(
+            authenticate(&cfg, &headers(&[("authorization", "Bearer inv")])),
+            Ok(HttpAuthRole::Invoke)
+        );
+        assert_eq!(
+            authenticate(&cfg, &headers(&[("x-api-key", "adm")])),
+            Ok(HttpAuthRole::Admin)
+        );
+        assert!(matches!(
+            authenticate(&cfg, &headers(&[("x-api-key", "nope")])),
+            Err(AuthError::Invalid(_))
+        ));
+        assert_eq!(
+            authenticate(&cfg, &HeaderMap::new()),
+            Err(AuthError::Missing)
+        );
+    }
+
+    #[test]
+    fn test_jwt_authentication() {
+        let cfg = HttpAuthConfig {
+            enabled: true,
+            jwt: Some(HttpJwtAuthConfig {
+                secret: "s3cret".to_string(),
+                audience: Some("spearlet".to_string()),
+                ..Default::default()
+            }),
+            ..Default::default()
+        };
+        let exp = chrono::Utc::now().timestamp() + 60;
+        let admin = sign(
+            "s3cret",
+            serde_json::json!({"role": "admin", "aud": "spearlet", "exp": exp}),
+        );
+        let auth = format!("Bearer {}", admin);
+        assert_eq!(
+            authenticate(&cfg, &headers(&[("authorization", auth.as_str())])),
+            Ok(HttpAuthRole::Admin)
+        );
+
+        let forged = sign(
+            "other",
+            serde_json::json!({"role": "admin", "aud": "spearlet"}),
+        );
+        let auth = format!("Bearer {}", forged);
+        assert!(authenticate(&cfg, &headers(&[("authorization", auth.as_str())])).is_err());
+
+        let expired = sign(
+            "s3cret",
+            serde_json::json!({"aud": "spearlet", "exp": exp - 120}),
+        );
+        let auth = format!("Bearer {}", expired);
+        assert_eq!(
+            authenticate(&cfg, &headers(&[("authorization", auth.as_str())])),
+            Err(AuthError::Invalid("token expired".to_string()))
+        );
+    }
+
+    #[test]
+    fn test_mtls_subject_authentication() {
+        let mut mtls = HttpMtlsAuthConfig::default();
+        mtls.subjects
+            .insert("CN=controller".to_string(), HttpAuthRole::Admin);
+        let cfg = HttpAuthConfig {
+            enabled: true,
+            mtls: Some(mtls),
+            ..Default::default()
+        };
+        assert_eq!(
+            authenticate(
+                &cfg,
+                &headers(&[("x-client-cert-subject", "CN=controller")])
+            ),
+            Ok(HttpAuthRole::Admin)
+        );
+        assert!(authenticate(&cfg, &headers(&[("x-client-cert-subject", "CN=other")])).is_err());
+    }
+
+    #[test]
+    fn test_api_key_takes_precedence_over_subject() {
+        let mut mtls = HttpMtlsAuthConfig::default();
+        mtls.subjects
+            .insert("CN=controller".to_string(), HttpAuthRole::Admin);
+        let cfg = HttpAuthConfig {
+            enabled: true,
+            api_keys: vec![HttpApiKey {
+                key: "inv".to_string(),
+                role: HttpAuthRole::Invoke,
+            }],
+            mtls: Some(mtls),
+            ..Default::default()
+        };
+        // A bad subject does not void a valid key / 错误的主题不会使有效 key 失效
+        assert_eq!(
+            authenticate(
+                &cfg,
+                &headers(&[("x-api-key", "inv"), ("x-client-cert-subject", "CN=forged")])
+            ),
+            Ok(HttpAuthRole::Invoke)
+        );
+        // Nor does a subject upgrade a key / 主题也不会提升 key 的角色
+        assert_eq!(
+            authenticate(
+                &cfg,
+                &headers(&[
+                    ("x-api-key", "inv"),
+                    ("x-client-cert-subject", "CN=controller")
+                ])
+            ),
+            Ok(HttpAuthRole::Invoke)
+        );
+        assert!(matches!(
+            authenticate(
+                &cfg,
+                &headers(&[
+                    ("x-api-key", "nope"),
+                    ("x-client-cert-subject", "CN=controller")
+                ])
+            ),
+            Err(AuthError::Invalid(_))
+        ));
+    }
+}
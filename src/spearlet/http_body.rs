@@ -0,0 +1,183 @@
+//! Request body limits and decoding for the spearlet HTTP gateway
+//! spearlet HTTP 网关的请求体大小限制与解码
+//!
+//! Every request body is read in full up to `http.max_body_bytes` before it reaches
+//! a handler. Larger bodies are rejected with `413 Payload Too Large` instead of
+//! being truncated. Bodies sent with `Content-Encoding: gzip` are decompressed here,
+//! and the limit applies to the decompressed size as well.
+//! 每个请求体在到达处理函数前按 `http.max_body_bytes` 完整读取。超出的请求体返回
+//! `413 Payload Too Large`，而非被截断。`Content-Encoding: gzip` 的请求体在此解压，
+//! 限制同样作用于解压后的大小。
+
+use std::io::Read;
+
+use axum::{
+    body::Body,
+    extract::State,
+    http::{header, HeaderValue, Request, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Json,
+};
+use futures::StreamExt;
+
+/// Why a body was rejected / 请求体被拒绝的原因
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum BodyError {
+    /// Raw or decoded body exceeds the limit / 原始或解码后的请求体超过限制
+    TooLarge { limit: usize },
+    /// `Content-Encoding` other than gzip / gzip 以外的 `Content-Encoding`
+    UnsupportedEncoding(String),
+    /// Body could not be read or decoded / 请求体无法读取或解码
+    Invalid(String),
+}
+
+impl BodyError {
+    fn into_response(self) -> Response {
+        let (status, code, message) = match self {
+            BodyError::TooLarge { limit } => (
+                StatusCode::PAYLOAD_TOO_LARGE,
+                "payload_too_large",
+                format!("request body exceeds {} bytes", limit),
+            ),
+            BodyError::UnsupportedEncoding(e) => (
+                StatusCode::UNSUPPORTED_MEDIA_TYPE,
+                "unsupported_content_encoding",
+                format!("unsupported content-encoding: {}", e),
+            ),
+            BodyError::Invalid(m) => (StatusCode::BAD_REQUEST, "invalid_body", m),
+        };
+        (
+            status,
+            Json(serde_json::json!({"error": code, "message": message})),
+        )
+            .into_response()
+    }
+}
+
+/// Read a body completely, failing once it exceeds `limit` bytes
+/// 完整读取请求体，超过 `limit` 字节即失败
+pub async fn read_limited(body: Body, limit: usize) -> Result<Vec<u8>, BodyError> {
+    let mut stream = body.into_data_stream();
+    let mut buf = Vec::new();
+    while let Some(chunk) = stream.next().await {
+        let chunk = chunk.map_err(|e| BodyError::Invalid(e.to_string()))?;
+        if buf.len() + chunk.len() > limit {
+            return Err(BodyError::TooLarge { limit });
+        }
+        buf.extend_from_slice(&chunk);
+    }
+    Ok(buf)
+}
+
+/// Decompress a gzip body, failing once the output exceeds `limit` bytes
+/// 解压 gzip 请求体，输出超过 `limit` 字节即失败
+pub fn gunzip_limited(data: &[u8], limit: usize) -> Result<Vec<u8>, BodyError> {
+    let mut out = Vec::new();
+    flate2::read::MultiGzDecoder::new(data)
+        .take(limit as u64 + 1)
+        .read_to_end(&mut out)
+        .map_err(|e| BodyError::Invalid(format!("invalid gzip body: {}", e)))?;
+    if out.len() > limit {
+        return Err(BodyError::TooLarge { limit });
+    }
+    Ok(out)
+}
+
+fn is_gzip(encoding: &str) -> Result<bool, BodyError> {
+    match encoding.trim().to_ascii_lowercase().as_str() {
+        "" | "identity" => Ok(false),
+        "gzip" | "x-gzip" => Ok(true),
+        other => Err(BodyError::UnsupportedEncoding(other.to_string())),
+    }
+}
+
+/// Enforce the body limit and decode gzip bodies / 执行请求体大小限制并解码 gzip 请求体
+pub async fn body_limit_middleware(
+    State(limit): State<usize>,
+    req: Request<Body>,
+    next: Next,
+) -> Response {
+    let declared = req
+        .headers()
+        .get(header::CONTENT_LENGTH)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.parse::<u64>().ok());
+    if declared.is_some_and(|n| n > limit as u64) {
+        return BodyError::TooLarge { limit }.into_response();
+    }
+    let gzip = match is_gzip(
+        req.headers()
+            .get(header::CONTENT_ENCODING)
+            .and_then(|v| v.to_str().ok())
+            .unwrap_or(""),
+    ) {
+        Ok(g) => g,
+        Err(e) => return e.into_response(),
+    };
+
+    let (mut parts, body) = req.into_parts();
+    let mut bytes = match read_limited(body, limit).await {
+        Ok(b) => b,
+        Err(e) => return e.into_response(),
+    };
+    if gzip {
+        bytes = match gunzip_limited(&bytes, limit) {
+            Ok(b) => b,
+            Err(e) => return e.into_response(),
+        };
+        parts.headers.remove(header::CONTENT_ENCODING);
+    }
+    parts
+        .headers
+        .insert(header::CONTENT_LENGTH, HeaderValue::from(bytes.len()));
+    next.run(Request::from_parts(parts, Body::from(bytes)))
+        .await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Write;
+
+    fn gzip(data: &[u8]) -> Vec<u8> {
+        let mut enc = flate2::write::GzEncoder::new(Vec::new(), flate2::Compression::default());
+        enc.write_all(data).unwrap();
+        enc.finish().unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_read_limited() {
+        assert_eq!(
+            read_limited(Body::from("hello"), 5).await.unwrap(),
+            b"hello"
+        );
+        assert_eq!(
+            read_limited(Body::from("hello!"), 5).await,
+            Err(BodyError::TooLarge { limit: 5 })
+        );
+    }
+
+    #[test]
+    fn test_gunzip_limited() {
+        let data = vec![b'a'; 4096];
+        let packed = gzip(&data);
+        assert!(packed.len() < 100);
+        assert_eq!(gunzip_limited(&packed, 4096).unwrap(), data);
+        assert_eq!(
+            gunzip_limited(&packed, 4095),
+            Err(BodyError::TooLarge { limit: 4095 })
+        );
+        assert!(matches!(
+            gunzip_limited(b"not gzip", 100),
+            Err(BodyError::Invalid(_))
+        ));
+    }
+
+    #[test]
+    fn test_content_encoding() {
+        assert_eq!(is_gzip(""), Ok(false));
+        assert_eq!(is_gzip("GZIP"), Ok(true));
+        assert!(is_gzip("br").is_err());
+    }
+}
@@ -0,0 +1,185 @@
+//! CORS for browser clients of the spearlet HTTP gateway
+//! spearlet HTTP 网关面向浏览器客户端的 CORS
+//!
+//! Cross-origin requests from the origins in `http.cors.allowed_origins` get the
+//! `Access-Control-*` headers, and preflight requests are answered here before
+//! authentication. Browsers do not apply CORS to WebSocket upgrades, so upgrades that
+//! carry an `Origin` outside the list are rejected with `403` instead.
+//! 来自 `http.cors.allowed_origins` 中来源的跨域请求会带上 `Access-Control-*` 响应头，
+//! 预检请求在认证之前于此应答。浏览器不对 WebSocket 升级应用 CORS，因此携带列表外
+//! `Origin` 的升级请求会以 `403` 拒绝。
+
+use std::sync::Arc;
+use std::time::Duration;
+
+use axum::{
+    extract::{Request, State},
+    http::{header, HeaderName, HeaderValue, Method, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Json,
+};
+use tower_http::cors::{AllowHeaders, AllowOrigin, CorsLayer};
+use tracing::warn;
+
+use crate::spearlet::config::HttpCorsConfig;
+
+/// Match an origin against a pattern; `*` in a pattern stands for any run of
+/// characters without `/`, e.g. `http://localhost:*` or `https://*.example.com`
+/// 将来源与模式匹配；模式中的 `*` 代表不含 `/` 的任意字符串，
+/// 如 `http://localhost:*` 或 `https://*.example.com`
+pub fn origin_matches(pattern: &str, origin: &str) -> bool {
+    if pattern == "*" {
+        return true;
+    }
+    match pattern.split_once('*') {
+        None => pattern.eq_ignore_ascii_case(origin),
+        Some((prefix, suffix)) => {
+            origin.len() >= prefix.len() + suffix.len()
+                && origin[..prefix.len()].eq_ignore_ascii_case(prefix)
+                && origin[origin.len() - suffix.len()..].eq_ignore_ascii_case(suffix)
+                && !origin[prefix.len()..origin.len() - suffix.len()].contains('/')
+        }
+    }
+}
+
+/// Whether a browser on `origin` may use the API / 来自 `origin` 的浏览器是否可使用 API
+pub fn origin_allowed(cfg: &HttpCorsConfig, origin: &str) -> bool {
+    cfg.allowed_origins
+        .iter()
+        .any(|p| origin_matches(p.trim(), origin))
+}
+
+fn header_names(names: &[String]) -> Vec<HeaderName> {
+    names
+        .iter()
+        .filter_map(|h| HeaderName::from_bytes(h.trim().as_bytes()).ok())
+        .collect()
+}
+
+/// Layer for the configured origins; `None` when CORS is off or no origin is listed
+/// 按配置来源构建的 layer；CORS 关闭或未列出来源时返回 `None`
+pub fn cors_layer(enabled: bool, cfg: &HttpCorsConfig) -> Option<CorsLayer> {
+    if !enabled || cfg.allowed_origins.is_empty() {
+        return None;
+    }
+    let any_origin = cfg.allowed_origins.iter().any(|o| o.trim() == "*");
+    let mut credentials = cfg.allow_credentials;
+    if credentials && any_origin {
+        warn!("http.cors: allow_credentials is ignored with allowed_origins = \"*\"");
+        credentials = false;
+    }
+
+    let origins = if any_origin {
+        AllowOrigin::any()
+    } else {
+        let patterns = Arc::new(cfg.clone());
+        AllowOrigin::predicate(move |origin: &HeaderValue, _| {
+            origin.to_str().is_ok_and(|o| origin_allowed(&patterns, o))
+        })
+    };
+    let methods: Vec<Method> = cfg
+        .allowed_methods
+        .iter()
+        .filter_map(|m| Method::from_bytes(m.trim().to_ascii_uppercase().as_bytes()).ok())
+        .collect();
+    // An empty list allows whatever the preflight asks for / 列表为空时允许预检请求的任意请求头
+    let headers = if cfg.allowed_headers.is_empty() {
+        AllowHeaders::mirror_request()
+    } else {
+        AllowHeaders::list(header_names(&cfg.allowed_headers))
+    };
+
+    Some(
+        CorsLayer::new()
+            .allow_origin(origins)
+            .allow_methods(methods)
+            .allow_headers(headers)
+            .expose_headers(header_names(&cfg.exposed_headers))
+            .allow_credentials(credentials)
+            .max_age(Duration::from_secs(cfg.max_age_secs)),
+    )
+}
+
+/// Reject WebSocket upgrades from browser origins that are not allowed
+/// 拒绝来自未被允许的浏览器来源的 WebSocket 升级
+///
+/// Requests without `Origin`, i.e. non-browser clients, pass.
+/// 不带 `Origin` 的请求（即非浏览器客户端）放行。
+pub async fn ws_origin_middleware(
+    State(cfg): State<Arc<HttpCorsConfig>>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let upgrade = req
+        .headers()
+        .get(header::UPGRADE)
+        .and_then(|v| v.to_str().ok())
+        .is_some_and(|v| v.eq_ignore_ascii_case("websocket"));
+    if upgrade {
+        if let Some(origin) = req.headers().get(header::ORIGIN) {
+            let origin = origin.to_str().unwrap_or_default();
+            if !origin_allowed(&cfg, origin) {
+                return (
+                    StatusCode::FORBIDDEN,
+                    Json(serde_json::json!({
+                        "error": "origin_not_allowed",
+                        "message": format!("origin {} is not allowed", origin),
+                    })),
+                )
+                    .into_response();
+            }
+        }
+    }
+    next.run(req).await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_origin_patterns() {
+        assert!(origin_matches("*", "https://anything.example"));
+        assert!(origin_matches(
+            "http://localhost:3000",
+            "http://LOCALHOST:3000"
+        ));
+        assert!(!origin_matches(
+            "http://localhost:3000",
+            "http://localhost:3001"
+        ));
+        assert!(origin_matches(
+            "http://localhost:*",
+            "http://localhost:5173"
+        ));
+        assert!(!origin_matches(
+            "http://localhost:*",
+            "http://localhost.evil.com/x"
+        ));
+        assert!(origin_matches(
+            "https://*.example.com",
+            "https://app.example.com"
+        ));
+        assert!(!origin_matches(
+            "https://*.example.com",
+            "https://example.com"
+        ));
+        assert!(!origin_matches(
+            "https://*.example.com",
+            "https://evil.com/.example.com"
+        ));
+    }
+
+    #[test]
+    fn test_layer_only_with_origins() {
+        let mut cfg = HttpCorsConfig::default();
+        assert!(cors_layer(true, &cfg).is_none());
+        cfg.allowed_origins = vec!["*".to_string()];
+        cfg.allow_credentials = true;
+        assert!(cors_layer(false, &cfg).is_none());
+        // Must not panic on the credentials + wildcard combination
+        // 凭证与通配符组合时不得 panic
+        assert!(cors_layer(true, &cfg).is_some());
+    }
+}
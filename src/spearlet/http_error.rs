@@ -0,0 +1,220 @@
+//! Structured errors of the spearlet HTTP gateway
+//! spearlet HTTP 网关的结构化错误
+//!
+//! Handlers return [`ApiError`], rendered as
+//! `{"success": false, "error": {"code", "message", "details"}}` with a status that fits
+//! the failure: 400 for bad input, 404 for missing resources, 409 for conflicts, 429 when
+//! capacity is exhausted and 500 otherwise. [`error_format_middleware`] also wraps the
+//! empty or plain-text errors produced by extractors, e.g. a malformed JSON body. With
+//! `http.error_format = "text"` errors keep the old plain-text body instead.
+//! 处理函数返回 [`ApiError`]，渲染为 `{"success": false, "error": {"code", "message", "details"}}`，
+//! 并使用与失败相符的状态码：输入错误为 400，资源不存在为 404，冲突为 409，容量耗尽为 429，
+//! 其余为 500。[`error_format_middleware`] 还会包装提取器产生的空错误或纯文本错误，例如格式错误的
+//! JSON 请求体。设置 `http.error_format = "text"` 时错误保持原有的纯文本响应体。
+
+use axum::{
+    extract::{Request, State},
+    http::{header, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Json, Response},
+};
+
+/// `http.error_format` values / `http.error_format` 的取值
+pub const FORMAT_JSON: &str = "json";
+pub const FORMAT_TEXT: &str = "text";
+pub const FORMATS: &[&str] = &[FORMAT_JSON, FORMAT_TEXT];
+
+/// Largest plain-text error body wrapped into the envelope / 包装进信封的纯文本错误体上限
+const MAX_WRAPPED_BODY: usize = 4096;
+
+/// Error returned by gateway handlers / 网关处理函数返回的错误
+#[derive(Debug, Clone)]
+pub struct ApiError {
+    pub status: StatusCode,
+    /// Stable upper-case code, e.g. `NOT_FOUND` / 稳定的大写错误码，如 `NOT_FOUND`
+    pub code: String,
+    pub message: String,
+    pub details: Option<serde_json::Value>,
+}
+
+impl ApiError {
+    pub fn new(status: StatusCode, code: &str, message: impl Into<String>) -> Self {
+        Self {
+            status,
+            code: code.to_string(),
+            message: message.into(),
+            details: None,
+        }
+    }
+
+    pub fn bad_request(message: impl Into<String>) -> Self {
+        Self::new(StatusCode::BAD_REQUEST, "INVALID_ARGUMENT", message)
+    }
+
+    pub fn not_found(message: impl Into<String>) -> Self {
+        Self::new(StatusCode::NOT_FOUND, "NOT_FOUND", message)
+    }
+
+    pub fn conflict(message: impl Into<String>) -> Self {
+        Self::new(StatusCode::CONFLICT, "CONFLICT", message)
+    }
+
+    pub fn internal(message: impl Into<String>) -> Self {
+        Self::new(StatusCode::INTERNAL_SERVER_ERROR, "INTERNAL", message)
+    }
+
+    pub fn with_details(mut self, details: serde_json::Value) -> Self {
+        self.details = Some(details);
+        self
+    }
+
+    /// Map a gRPC status of the local services / 映射本地服务返回的 gRPC 状态
+    pub fn from_grpc(status: &tonic::Status) -> Self {
+        use tonic::Code;
+        let (http, code) = match status.code() {
+            Code::InvalidArgument => (StatusCode::BAD_REQUEST, "INVALID_ARGUMENT"),
+            Code::OutOfRange => (StatusCode::BAD_REQUEST, "OUT_OF_RANGE"),
+            Code::FailedPrecondition => (StatusCode::BAD_REQUEST, "FAILED_PRECONDITION"),
+            Code::NotFound => (StatusCode::NOT_FOUND, "NOT_FOUND"),
+            Code::AlreadyExists => (StatusCode::CONFLICT, "ALREADY_EXISTS"),
+            Code::Aborted => (StatusCode::CONFLICT, "CONFLICT"),
+            Code::ResourceExhausted => (StatusCode::TOO_MANY_REQUESTS, "RESOURCE_EXHAUSTED"),
+            other => {
+                return Self::internal(status.message())
+                    .with_details(serde_json::json!({ "grpc_code": format!("{:?}", other) }));
+            }
+        };
+        Self::new(http, code, status.message())
+    }
+
+    fn body(&self) -> serde_json::Value {
+        let mut error = serde_json::json!({
+            "code": self.code,
+            "message": self.message,
+        });
+        if let Some(details) = &self.details {
+            error["details"] = details.clone();
+        }
+        serde_json::json!({ "success": false, "error": error })
+    }
+}
+
+impl std::fmt::Display for ApiError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}: {}", self.code, self.message)
+    }
+}
+
+impl From<tonic::Status> for ApiError {
+    fn from(status: tonic::Status) -> Self {
+        Self::from_grpc(&status)
+    }
+}
+
+impl IntoResponse for ApiError {
+    fn into_response(self) -> Response {
+        let mut resp = (self.status, Json(self.body())).into_response();
+        // Lets the middleware switch to text without parsing / 供中间件无需解析即可切换为文本
+        resp.extensions_mut().insert(self);
+        resp
+    }
+}
+
+/// Upper-case code of a status without one, e.g. `PAYLOAD_TOO_LARGE`
+/// 无错误码时根据状态码生成的大写错误码，如 `PAYLOAD_TOO_LARGE`
+pub fn status_code_name(status: StatusCode) -> String {
+    status
+        .canonical_reason()
+        .unwrap_or("ERROR")
+        .to_ascii_uppercase()
+        .replace([' ', '-'], "_")
+}
+
+fn is_text_or_empty(resp: &Response) -> bool {
+    match resp.headers().get(header::CONTENT_TYPE) {
+        None => true,
+        Some(v) => v
+            .to_str()
+            .map(|s| s.starts_with("text/plain"))
+            .unwrap_or(false),
+    }
+}
+
+/// Render errors in the configured format / 以配置的格式渲染错误
+///
+/// In `json` mode plain-text or empty error responses are wrapped into the envelope. In
+/// `text` mode [`ApiError`] responses are turned back into a plain-text message.
+/// `json` 模式下纯文本或空的错误响应被包装进信封；`text` 模式下 [`ApiError`] 响应被还原为纯文本消息。
+pub async fn error_format_middleware(
+    State(format): State<&'static str>,
+    req: Request,
+    next: Next,
+) -> Response {
+    let resp = next.run(req).await;
+    let status = resp.status();
+    if !(status.is_client_error() || status.is_server_error()) {
+        return resp;
+    }
+    if format == FORMAT_TEXT {
+        return match resp.extensions().get::<ApiError>() {
+            Some(e) => (e.status, e.message.clone()).into_response(),
+            None => resp,
+        };
+    }
+    if resp.extensions().get::<ApiError>().is_some() || !is_text_or_empty(&resp) {
+        return resp;
+    }
+    let (parts, body) = resp.into_parts();
+    let message = match axum::body::to_bytes(body, MAX_WRAPPED_BODY).await {
+        Ok(b) if !b.is_empty() => String::from_utf8_lossy(&b).trim().to_string(),
+        _ => status.canonical_reason().unwrap_or("error").to_string(),
+    };
+    let mut wrapped = ApiError::new(status, &status_code_name(status), message).into_response();
+    for (name, value) in parts.headers.iter() {
+        if name != header::CONTENT_TYPE && name != header::CONTENT_LENGTH {
+            wrapped.headers_mut().append(name.clone(), value.clone());
+        }
+    }
+    wrapped
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_grpc_codes_map_to_http_statuses() {
+        let cases = [
+            (
+                tonic::Status::invalid_argument("x"),
+                400,
+                "INVALID_ARGUMENT",
+            ),
+            (tonic::Status::not_found("x"), 404, "NOT_FOUND"),
+            (tonic::Status::already_exists("x"), 409, "ALREADY_EXISTS"),
+            (
+                tonic::Status::resource_exhausted("x"),
+                429,
+                "RESOURCE_EXHAUSTED",
+            ),
+            (tonic::Status::internal("x"), 500, "INTERNAL"),
+        ];
+        for (status, http, code) in cases {
+            let e = ApiError::from_grpc(&status);
+            assert_eq!(e.status.as_u16(), http);
+            assert_eq!(e.code, code);
+            assert_eq!(e.message, "x");
+        }
+        let e = ApiError::from_grpc(&tonic::Status::unavailable("down"));
+        assert_eq!(e.body()["error"]["details"]["grpc_code"], "Unavailable");
+    }
+
+    #[test]
+    fn test_status_code_name() {
+        assert_eq!(status_code_name(StatusCode::BAD_REQUEST), "BAD_REQUEST");
+        assert_eq!(
+            status_code_name(StatusCode::UNSUPPORTED_MEDIA_TYPE),
+            "UNSUPPORTED_MEDIA_TYPE"
+        );
+    }
+}
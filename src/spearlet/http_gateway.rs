@@ -5,18 +5,16 @@ use axum::{
     extract::ws::{Message, WebSocket, WebSocketUpgrade},
     extract::{Path, Query, State},
     http::StatusCode,
-    response::{Html, IntoResponse, Json},
-    routing::{delete, get, post, put},
-    Router,
+    response::{Html, IntoResponse, Json, Response},
+    routing::{any, delete, get, post, put},
+    Extension, Router,
 };
 use base64::{engine::general_purpose, Engine as _};
 use futures::{SinkExt, StreamExt};
 use serde::Deserialize;
 use std::collections::HashMap;
-use std::net::SocketAddr;
 use std::sync::Arc;
-use std::time::SystemTime;
-use tonic::transport::Channel;
+use std::time::{Duration, SystemTime};
 use tracing::{debug, error, info};
 
 use crate::proto::spearlet::{
@@ -26,9 +24,41 @@ use crate::proto::spearlet::{
     ListObjectsRequest, PinObjectRequest, PutObjectRequest, RemoveObjectRefRequest,
     TerminateExecutionRequest, UnpinObjectRequest,
 };
-use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::about;
+use crate::spearlet::admin;
+use crate::spearlet::clock;
+use crate::spearlet::config::{SpearletConfig, WebSocketConfig};
+use crate::spearlet::crash;
+use crate::spearlet::debug_tunnel;
+use crate::spearlet::exec_stream::{self, ExecStreamMode};
+use crate::spearlet::execution::debug_trace;
+use crate::spearlet::execution::manager::TaskExecutionManager;
+use crate::spearlet::execution::manifest::ExecutionManifest;
 use crate::spearlet::function_service::FunctionServiceImpl;
+use crate::spearlet::grpc_auth::LocalChannel;
 use crate::spearlet::grpc_server::HealthService;
+use crate::spearlet::http_error::{self, ApiError};
+use crate::spearlet::http_listeners::{self, ListenerManager, ListenerPlan, RouteGroup};
+use crate::spearlet::message_passing::MpError;
+use crate::spearlet::message_routing;
+use crate::spearlet::node_services::NodeServices;
+use crate::spearlet::otel;
+use crate::spearlet::rate_limit::{self, ClientKey, RateLimiter};
+use crate::spearlet::request_id;
+#[cfg(feature = "rtsp")]
+use crate::spearlet::rtsp;
+use crate::spearlet::service_ports;
+use crate::spearlet::stream_mux;
+use crate::spearlet::stream_resume;
+#[cfg(feature = "telephony")]
+use crate::spearlet::telephony;
+#[cfg(feature = "webrtc")]
+use crate::spearlet::webrtc_ingest;
+use crate::spearlet::ws_keepalive::{self, Keepalive, KeepaliveEvent};
+
+/// How often a WebSocket session checks that its execution still holds streams
+/// WebSocket 会话检查其执行是否仍持有流的间隔
+const HUB_CHECK_INTERVAL: Duration = Duration::from_millis(250);
 
 /// HTTP gateway server / HTTP网关服务器
 pub struct HttpGateway {
@@ -37,30 +67,43 @@ pub struct HttpGateway {
     /// Health service / 健康检查服务
     health_service: Arc<HealthService>,
     function_service: Arc<FunctionServiceImpl>,
-    object_client: ObjectServiceClient<Channel>,
-    invocation_client: InvocationServiceClient<Channel>,
-    execution_client: ExecutionServiceClient<Channel>,
+    object_client: ObjectServiceClient<LocalChannel>,
+    invocation_client: InvocationServiceClient<LocalChannel>,
+    execution_client: ExecutionServiceClient<LocalChannel>,
 }
 
 /// Application state / 应用状态
 #[derive(Clone)]
 pub(crate) struct AppState {
-    object_client: ObjectServiceClient<Channel>,
-    invocation_client: InvocationServiceClient<Channel>,
-    execution_client: ExecutionServiceClient<Channel>,
+    object_client: ObjectServiceClient<LocalChannel>,
+    invocation_client: InvocationServiceClient<LocalChannel>,
+    execution_client: ExecutionServiceClient<LocalChannel>,
     health_service: Arc<HealthService>,
     function_service: Arc<FunctionServiceImpl>,
     config: Arc<SpearletConfig>,
+    rate_limiter: Option<Arc<RateLimiter>>,
+}
+
+impl AppState {
+    /// Node-local services of the spearlet behind this gateway / 本网关所属 spearlet 的节点本地服务
+    fn node(&self) -> Arc<NodeServices> {
+        self.function_service.get_execution_manager().node().clone()
+    }
 }
 
 pub(crate) fn new_app_state(
-    object_client: ObjectServiceClient<Channel>,
-    invocation_client: InvocationServiceClient<Channel>,
-    execution_client: ExecutionServiceClient<Channel>,
+    object_client: ObjectServiceClient<LocalChannel>,
+    invocation_client: InvocationServiceClient<LocalChannel>,
+    execution_client: ExecutionServiceClient<LocalChannel>,
     health_service: Arc<HealthService>,
     function_service: Arc<FunctionServiceImpl>,
     config: Arc<SpearletConfig>,
 ) -> AppState {
+    let rate_limiter = config
+        .http
+        .rate_limit
+        .enabled
+        .then(|| Arc::new(RateLimiter::new(config.http.rate_limit.clone())));
     AppState {
         object_client,
         invocation_client,
@@ -68,134 +111,564 @@ pub(crate) fn new_app_state(
         health_service,
         function_service,
         config,
+        rate_limiter,
     }
 }
 
 pub(crate) fn build_router(state: AppState, swagger_enabled: bool) -> Router {
+    let plan = ListenerPlan::single(&state.config.http);
+    build_listener_router(state, &plan, swagger_enabled)
+}
+
+fn group_routes(group: RouteGroup, swagger_enabled: bool) -> Router<AppState> {
+    match group {
+        RouteGroup::Data => {
+            let mut app = Router::new()
+                .route("/objects/{key}", put(put_object))
+                .route("/objects/{key}", get(get_object))
+                .route("/objects", get(list_objects))
+                .route("/objects/{key}/refs", post(add_object_ref))
+                .route("/objects/{key}/refs", delete(remove_object_ref))
+                .route("/objects/{key}/pin", post(pin_object))
+                .route("/objects/{key}/pin", delete(unpin_object))
+                .route("/objects/{key}", delete(delete_object))
+                .route("/v1/exec", post(v1_exec))
+                .route("/functions/execute", post(execute_function))
+                .route("/v1/endpoints/{*path}", post(invoke_endpoint))
+                .route(
+                    "/functions/executions/{execution_id}",
+                    get(get_execution_status),
+                )
+                .route(
+                    "/functions/executions/{execution_id}/cancel",
+                    post(cancel_execution),
+                )
+                .route("/about", get(about_handler))
+                .route("/tasks", get(list_tasks))
+                .route("/tasks/{task_id}", get(get_task))
+                .route("/tasks/{task_id}/executions", get(get_task_executions))
+                .route(
+                    "/api/v1/executions/{execution_id}/streams/ws",
+                    get(user_stream_ws),
+                )
+                .route("/api/v1/streams/ws", get(user_stream_mux_ws))
+                .route("/v1/services/{task}/{service}", any(service_root))
+                .route("/v1/services/{task}/{service}/{*path}", any(proxy_service))
+                .route(message_routing::NAMES_PATH, post(mp_names))
+                .route(message_routing::DELIVER_PATH, post(mp_deliver))
+                .route(message_routing::ACKS_PATH, post(mp_acks));
+
+            #[cfg(feature = "webrtc")]
+            {
+                app = app.route(
+                    "/api/v1/executions/{execution_id}/streams/webrtc",
+                    post(open_webrtc_stream).delete(close_webrtc_stream),
+                );
+            }
+            #[cfg(feature = "rtsp")]
+            {
+                app = app
+                    .route(
+                        "/api/v1/executions/{execution_id}/streams/camera",
+                        post(subscribe_camera),
+                    )
+                    .route(
+                        "/api/v1/executions/{execution_id}/streams/camera/{camera}",
+                        delete(unsubscribe_camera),
+                    )
+                    .route("/api/v1/cameras", get(list_cameras));
+            }
+
+            if swagger_enabled {
+                app = app
+                    .route("/api-docs", get(api_docs))
+                    .route("/api/openapi.json", get(api_docs))
+                    .route("/openapi.json", get(api_docs))
+                    .route("/swagger-ui", get(swagger_ui))
+                    .route("/docs", get(swagger_ui));
+            }
+
+            if std::env::var("SPEAR_E2E").ok().as_deref() == Some("1") {
+                app = app.route("/__e2e/llm/router-filter", get(e2e_llm_router_filter));
+            }
+            app
+        }
+        RouteGroup::Admin => Router::new()
+            .route("/admin/reload", post(admin_reload))
+            .route("/admin/introspect", get(admin_introspect))
+            .route("/admin/introspect/{section}", get(admin_introspect_section)),
+        RouteGroup::Metrics => Router::new()
+            .route("/monitoring/stats", get(get_stats))
+            .route("/monitoring/health", get(get_health_status)),
+        RouteGroup::Provider => {
+            let app = Router::new();
+            #[cfg(feature = "telephony")]
+            let app = app
+                .route(telephony::TWILIO_VOICE_PATH, post(twilio_voice))
+                .route(telephony::TWILIO_MEDIA_PATH, get(twilio_media_ws));
+            app
+        }
+    }
+}
+
+/// Router of one listener: its route groups, the probes and its middlewares
+/// 单个监听器的路由：其路由组、探针与中间件
+pub(crate) fn build_listener_router(
+    state: AppState,
+    plan: &ListenerPlan,
+    swagger_enabled: bool,
+) -> Router {
+    // Probes answer on every listener / 每个监听器都应答探针
     let mut app = Router::new()
         .route("/health", get(health_check))
         .route("/status", get(status_check))
-        .route("/objects/{key}", put(put_object))
-        .route("/objects/{key}", get(get_object))
-        .route("/objects", get(list_objects))
-        .route("/objects/{key}/refs", post(add_object_ref))
-        .route("/objects/{key}/refs", delete(remove_object_ref))
-        .route("/objects/{key}/pin", post(pin_object))
-        .route("/objects/{key}/pin", delete(unpin_object))
-        .route("/objects/{key}", delete(delete_object))
-        .route("/functions/execute", post(execute_function))
-        .route(
-            "/functions/executions/{execution_id}",
-            get(get_execution_status),
-        )
-        .route(
-            "/functions/executions/{execution_id}/cancel",
-            post(cancel_execution),
-        )
-        .route("/tasks", get(list_tasks))
-        .route("/tasks/{task_id}", get(get_task))
-        .route("/tasks/{task_id}/executions", get(get_task_executions))
-        .route("/monitoring/stats", get(get_stats))
-        .route("/monitoring/health", get(get_health_status))
-        .route(
-            "/api/v1/executions/{execution_id}/streams/ws",
-            get(user_stream_ws),
-        );
+        .route("/readyz", get(readiness_check));
+    for group in &plan.groups {
+        app = app.merge(group_routes(*group, swagger_enabled));
+    }
+
+    let auth = state.config.http.auth.clone();
+    let rate_limiter = state.rate_limiter.clone().filter(|_| plan.rate_limit);
+    let max_body_bytes = state.config.http.max_body_bytes;
+    let cors_layer = crate::spearlet::http_cors::cors_layer(
+        state.config.http.cors_enabled && plan.cors,
+        &state.config.http.cors,
+    );
+    let cors = Arc::new(state.config.http.cors.clone());
+    let error_format = if state.config.http.error_format == http_error::FORMAT_TEXT {
+        http_error::FORMAT_TEXT
+    } else {
+        http_error::FORMAT_JSON
+    };
+    let app = app
+        .with_state::<()>(state)
+        .layer(axum::middleware::from_fn_with_state(
+            error_format,
+            http_error::error_format_middleware,
+        ))
+        .layer(axum::middleware::from_fn(panic_middleware))
+        .layer(axum::middleware::from_fn_with_state(
+            max_body_bytes,
+            crate::spearlet::http_body::body_limit_middleware,
+        ))
+        .layer(axum::extract::DefaultBodyLimit::max(max_body_bytes));
+    // Verified callers also count against their credential, inside auth
+    // 已验证的调用方还计入其凭证的限额，位于认证之内
+    let app = match &rate_limiter {
+        Some(limiter) => app.layer(axum::middleware::from_fn_with_state(
+            limiter.clone(),
+            crate::spearlet::rate_limit::credential_rate_limit_middleware,
+        )),
+        None => app,
+    };
+    let app = if auth.enabled && plan.auth {
+        app.layer(axum::middleware::from_fn_with_state(
+            Arc::new(auth),
+            crate::spearlet::http_auth::auth_middleware,
+        ))
+    } else {
+        app
+    };
+    // Every request counts against its source address before auth, whatever
+    // credentials it claims
+    // 每个请求在认证之前计入其来源地址的限额，与其声称的凭证无关
+    let app = match rate_limiter {
+        Some(limiter) => app.layer(axum::middleware::from_fn_with_state(
+            limiter,
+            crate::spearlet::rate_limit::rate_limit_middleware,
+        )),
+        None => app,
+    };
+    let app = app
+        .layer(axum::middleware::from_fn(trace_middleware))
+        .layer(axum::middleware::from_fn(request_id::middleware));
+    // Preflights carry no credentials, so CORS answers them before auth and limits
+    // 预检请求不携带凭证，因此 CORS 在认证与限流之前应答
+    match cors_layer {
+        Some(layer) => app
+            .layer(axum::middleware::from_fn_with_state(
+                cors,
+                crate::spearlet::http_cors::ws_origin_middleware,
+            ))
+            .layer(layer),
+        None => app,
+    }
+}
 
-    if swagger_enabled {
-        app = app
-            .route("/api-docs", get(api_docs))
-            .route("/api/openapi.json", get(api_docs))
-            .route("/swagger-ui", get(swagger_ui))
-            .route("/docs", get(swagger_ui));
+/// Open a server span per request and hand its context to the handler
+/// 为每个请求创建 server span 并将其上下文交给处理函数
+///
+/// The inbound `traceparent` header is replaced with the span's context so
+/// handlers forward it into `InvokeRequest.metadata`.
+/// 入站 `traceparent` 头被替换为该 span 的上下文，处理函数再将其转入 `InvokeRequest.metadata`。
+async fn trace_middleware(
+    mut req: axum::extract::Request,
+    next: axum::middleware::Next,
+) -> axum::response::Response {
+    let parent = req
+        .headers()
+        .get(otel::TRACEPARENT_KEY)
+        .and_then(|v| v.to_str().ok())
+        .and_then(otel::TraceContext::parse);
+    let path = req.uri().path().to_string();
+    let mut span = otel::Span::start(
+        format!("{} {}", req.method(), path),
+        otel::SpanKind::Server,
+        parent.as_ref(),
+    );
+    span.set_attr("http.request.method", req.method().as_str());
+    span.set_attr("url.path", path);
+    if req.headers().contains_key(axum::http::header::UPGRADE) {
+        span.set_attr("spear.websocket", true);
+    }
+    if let Some(tp) = span
+        .traceparent()
+        .and_then(|tp| axum::http::HeaderValue::from_str(&tp).ok())
+    {
+        req.headers_mut().insert(otel::TRACEPARENT_KEY, tp);
     }
 
-    if std::env::var("SPEAR_E2E").ok().as_deref() == Some("1") {
-        app = app.route("/__e2e/llm/router-filter", get(e2e_llm_router_filter));
+    let resp = next.run(req).await;
+    let status = resp.status();
+    span.set_attr("http.response.status_code", status.as_u16() as i64);
+    if status.is_server_error() {
+        span.set_error(status.to_string());
     }
+    resp
+}
 
-    app.with_state::<()>(state)
+/// Turn a handler panic into a 500 response; the panic hook has already recorded it
+/// 将处理函数 panic 转为 500 响应；panic hook 已记录该 panic
+async fn panic_middleware(
+    req: axum::extract::Request,
+    next: axum::middleware::Next,
+) -> axum::response::Response {
+    use futures::FutureExt;
+
+    match crash::scope(
+        "http",
+        std::panic::AssertUnwindSafe(next.run(req)).catch_unwind(),
+    )
+    .await
+    {
+        Ok(resp) => resp,
+        Err(_) => (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            Json(serde_json::json!({"error": "internal_error", "message": "handler panicked"})),
+        )
+            .into_response(),
+    }
+}
+
+/// Forward the request's trace context, request ID and debug options into invocation metadata
+/// 将请求的链路上下文、请求 ID 与调试选项转入调用元数据
+fn with_trace_metadata(
+    mut metadata: HashMap<String, String>,
+    headers: &axum::http::HeaderMap,
+) -> HashMap<String, String> {
+    if let Some(tp) = headers
+        .get(otel::TRACEPARENT_KEY)
+        .and_then(|v| v.to_str().ok())
+    {
+        metadata.insert(otel::TRACEPARENT_KEY.to_string(), tp.to_string());
+    }
+    if let Some(id) = headers
+        .get(request_id::HEADER)
+        .and_then(|v| v.to_str().ok())
+    {
+        metadata
+            .entry(request_id::METADATA_KEY.to_string())
+            .or_insert_with(|| id.to_string());
+    }
+    if let Some(v) = headers
+        .get(debug_trace::HEADER)
+        .and_then(|v| v.to_str().ok())
+    {
+        metadata.insert(debug_trace::METADATA_KEY.to_string(), v.to_string());
+    }
+    metadata
+}
+
+/// Trace asked for with `Spear-Debug: trace`, or null / 通过 `Spear-Debug: trace` 请求的追踪，或 null
+fn debug_trace_value(resp: &crate::proto::spearlet::InvokeResponse) -> serde_json::Value {
+    serde_json::from_str(&resp.debug_trace).unwrap_or(serde_json::Value::Null)
+}
+
+/// Query of `/api/v1/executions/{execution_id}/streams/ws` / 该端点的查询参数
+#[derive(Debug, Default, Deserialize)]
+struct UserStreamWsQuery {
+    /// Token of a dropped session to continue / 要继续的已断开会话的令牌
+    resume_token: Option<String>,
+    /// Last binary message the client received / 客户端收到的最后一条二进制消息
+    #[serde(default)]
+    last_seq: u64,
+    /// The client acknowledges every binary message / 客户端确认每一条二进制消息
+    #[serde(default)]
+    ack: bool,
 }
 
 async fn user_stream_ws(
+    State(state): State<AppState>,
     Path(execution_id): Path<String>,
+    Query(q): Query<UserStreamWsQuery>,
     ws: WebSocketUpgrade,
-) -> impl IntoResponse {
+) -> Response {
     if execution_id.is_empty() {
         return StatusCode::BAD_REQUEST.into_response();
     }
-    ws.on_upgrade(move |socket| user_stream_ws_loop(execution_id, socket))
+    let cfg = state.config.http.ws.clone();
+    let mgr = state.function_service.get_execution_manager();
+    let sessions = mgr.node().stream_resume.clone();
+    let resume = match q.resume_token.as_deref() {
+        Some(token) => match sessions.resume(token, &execution_id, q.last_seq) {
+            Ok(r) => Some(r),
+            Err(e) => return resume_error(e).into_response(),
+        },
+        None if cfg.resume_grace_ms > 0 || q.ack => {
+            let (session, generation) =
+                sessions.open(&execution_id, cfg.resume_buffer_bytes, q.ack);
+            Some((session, generation, Vec::new()))
+        }
+        None => None,
+    };
+    let token = resume.as_ref().map(|(s, _, _)| s.token().to_string());
+    let resumable = cfg.resume_grace_ms > 0;
+    let failed_token = token.clone();
+    let mut resp = ws
+        .on_failed_upgrade(move |_| {
+            if let Some(t) = failed_token {
+                sessions.release(&t);
+            }
+        })
+        .on_upgrade(move |socket| {
+            crash::scope(
+                "user-stream",
+                user_stream_ws_loop(execution_id, socket, cfg, mgr, resume),
+            )
+        });
+    if let Some(v) = token
+        .filter(|_| resumable)
+        .and_then(|t| axum::http::HeaderValue::from_str(&t).ok())
+    {
+        resp.headers_mut().insert(stream_resume::TOKEN_HEADER, v);
+    }
+    resp
 }
 
-async fn user_stream_ws_loop(execution_id: String, socket: WebSocket) {
-    let (mut ws_tx, mut ws_rx) = socket.split();
-    let (out_tx, mut out_rx) = tokio::sync::mpsc::unbounded_channel::<Message>();
-    let mut had_hub = false;
+fn resume_error(e: stream_resume::ResumeError) -> ApiError {
+    match e {
+        stream_resume::ResumeError::Expired => ApiError::new(
+            StatusCode::GONE,
+            "RESUME_EXPIRED",
+            "unknown or expired resume token",
+        ),
+        stream_resume::ResumeError::WrongExecution => ApiError::new(
+            StatusCode::FORBIDDEN,
+            "RESUME_FORBIDDEN",
+            "resume token not allowed for this execution",
+        ),
+        stream_resume::ResumeError::SeqUnavailable => {
+            ApiError::conflict("frames after last_seq are no longer buffered")
+        }
+    }
+}
 
-    let writer = tokio::spawn(async move {
-        while let Some(msg) = out_rx.recv().await {
-            if ws_tx.send(msg).await.is_err() {
-                break;
-            }
+/// Multiplexed user streams for many executions / 多个执行的多路复用 user stream
+/// GET /api/v1/streams/ws
+async fn user_stream_mux_ws(
+    State(state): State<AppState>,
+    headers: axum::http::HeaderMap,
+    ws: WebSocketUpgrade,
+) -> impl IntoResponse {
+    let ctx = stream_mux::MuxContext {
+        invocation_client: state.invocation_client.clone(),
+        execution_client: state.execution_client.clone(),
+        function_service: state.function_service.clone(),
+        streams: state.node().user_streams.clone(),
+        traceparent: headers
+            .get(otel::TRACEPARENT_KEY)
+            .and_then(|v| v.to_str().ok())
+            .map(str::to_string),
+        ws: state.config.http.ws.clone(),
+    };
+    ws.protocols([stream_mux::MUX_SUBPROTOCOL])
+        .on_upgrade(move |socket| crash::scope("user-stream", stream_mux::run(socket, ctx)))
+}
+
+/// How a user-stream socket ended / user stream 连接的结束方式
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum WsEnd {
+    /// The client closed, the execution finished or the session failed
+    /// 客户端关闭、执行结束或会话失败
+    Final,
+    /// The connection dropped; the session may be resumed / 连接断开；会话可被恢复
+    Dropped,
+    /// A resuming connection took the session over / 恢复的连接接管了会话
+    TakenOver,
+}
+
+async fn user_stream_ws_loop(
+    execution_id: String,
+    socket: WebSocket,
+    cfg: WebSocketConfig,
+    mgr: Arc<TaskExecutionManager>,
+    resume: Option<(Arc<stream_resume::ResumeSession>, u64, Vec<Vec<u8>>)>,
+) {
+    let node = mgr.node().clone();
+    let (ws_tx, mut ws_rx) = socket.split();
+    let (out_tx, out_rx) = tokio::sync::mpsc::unbounded_channel::<Message>();
+    let mut writer = ws_keepalive::spawn_writer(ws_tx, out_rx, &cfg);
+    let mut keepalive = Keepalive::new(&cfg);
+    let mut hub_check = tokio::time::interval(HUB_CHECK_INTERVAL);
+    let (session, generation, replay) = match resume {
+        Some((s, g, r)) => (Some(s), g, r),
+        None => (None, 0, Vec::new()),
+    };
+    // A resumed session already had its hub / 恢复的会话此前已有 hub
+    let mut had_hub = generation > 1;
+    for frame in replay {
+        let _ = out_tx.send(Message::Binary(prost::bytes::Bytes::from(frame)));
+    }
+    let pop = || match &session {
+        Some(s) => s.pop_outbound(generation),
+        None => node.user_streams.ws_pop_any_outbound(&execution_id),
+    };
+    let send_outbound = |keepalive: &mut Keepalive| {
+        while let Some(frame) = pop() {
+            keepalive.sent_data();
+            let _ = out_tx.send(Message::Binary(prost::bytes::Bytes::from(frame)));
         }
-    });
+    };
 
-    loop {
-        if !had_hub
-            && crate::spearlet::execution::host_api::user_stream::ExecutionUserStreamHub::get(
-                &execution_id,
-            )
-            .is_some()
-        {
-            had_hub = true;
-        } else if had_hub
-            && crate::spearlet::execution::host_api::user_stream::ExecutionUserStreamHub::get(
-                &execution_id,
-            )
-            .is_none()
-        {
-            let _ = out_tx.send(Message::Close(None));
-            break;
+    let end = loop {
+        if session.as_ref().is_some_and(|s| !s.is_current(generation)) {
+            break WsEnd::TakenOver;
+        }
+        let hub = node.user_streams.get(&execution_id).is_some();
+        had_hub |= hub;
+        if had_hub && !hub {
+            // The execution released its streams; tell the client why the socket closes
+            // 执行已释放其流；告知客户端连接关闭的原因
+            let _ = out_tx.send(ws_keepalive::close_message(
+                ws_keepalive::CLOSE_NORMAL,
+                "execution finished",
+            ));
+            break WsEnd::Final;
         }
 
+        let deadline = keepalive.deadline();
         tokio::select! {
             msg = ws_rx.next() => {
                 let Some(Ok(msg)) = msg else {
-                    break;
+                    break WsEnd::Dropped;
                 };
-                match msg {
-                    Message::Binary(frame) => {
-                        let rc = crate::spearlet::execution::host_api::user_stream::ws_push_frame(
-                            &execution_id,
-                            frame.to_vec(),
-                        );
-                        if rc < 0 {
-                            let _ = out_tx.send(Message::Close(None));
-                            break;
-                        }
-                    }
-                    Message::Close(_) => break,
-                    Message::Ping(p) => {
-                        let _ = out_tx.send(Message::Pong(p));
-                    }
-                    _ => {}
+                if !on_user_stream_ws_message(&node, &execution_id, msg, session.as_deref(), &mut keepalive, &out_tx) {
+                    break WsEnd::Final;
                 }
+                // An ack may have reopened the send window / 确认可能重新打开了发送窗口
+                send_outbound(&mut keepalive);
             }
-            _ = crate::spearlet::execution::host_api::user_stream::ws_wait_any_outbound(&execution_id) => {
-                while let Some(frame) =
-                    crate::spearlet::execution::host_api::user_stream::ws_pop_any_outbound(
-                        &execution_id,
-                    )
-                {
-                    let _ = out_tx.send(Message::Binary(prost::bytes::Bytes::from(frame)));
+            _ = node.user_streams.ws_wait_any_outbound(&execution_id) => {
+                send_outbound(&mut keepalive);
+            }
+            _ = hub_check.tick() => {
+                // Also picks up frames queued while nobody waited, e.g. during a resume
+                // 同时取走无人等待时排队的帧，例如恢复期间
+                send_outbound(&mut keepalive);
+            }
+            _ = ws_keepalive::wait_until(deadline) => {
+                if let Some(end) = on_user_stream_keepalive(&execution_id, &mut keepalive, &cfg, &mgr, &out_tx).await {
+                    break end;
                 }
             }
+            _ = &mut writer => {
+                break WsEnd::Dropped;
+            }
         }
-    }
+    };
 
     drop(out_tx);
-    let _ = writer.await;
-    crate::spearlet::execution::host_api::user_stream::map_ws_close_to_channels(&execution_id);
+    if !writer.is_finished() {
+        let _ = writer.await;
+    }
+    match (end, session) {
+        (WsEnd::TakenOver, _) => {}
+        (WsEnd::Dropped, Some(s)) if cfg.resume_grace_ms > 0 && s.detach(generation) => {
+            node.stream_resume.expire_after(
+                s,
+                generation,
+                Duration::from_millis(cfg.resume_grace_ms),
+            );
+        }
+        (_, session) => {
+            if let Some(s) = session {
+                node.stream_resume.release(s.token());
+            }
+            node.user_streams.map_ws_close_to_channels(&execution_id);
+        }
+    }
+}
+
+/// Handle one client message; false ends the session / 处理一条客户端消息；返回 false 时结束会话
+fn on_user_stream_ws_message(
+    node: &NodeServices,
+    execution_id: &str,
+    msg: Message,
+    session: Option<&stream_resume::ResumeSession>,
+    keepalive: &mut Keepalive,
+    out_tx: &tokio::sync::mpsc::UnboundedSender<Message>,
+) -> bool {
+    keepalive.received(!matches!(msg, Message::Ping(_) | Message::Pong(_)));
+    match msg {
+        Message::Binary(frame) => {
+            let rc = node
+                .user_streams
+                .ws_push_frame(execution_id, frame.to_vec());
+            if rc < 0 {
+                let _ = out_tx.send(ws_keepalive::close_message(
+                    ws_keepalive::CLOSE_INTERNAL_ERROR,
+                    &format!("push failed: {}", rc),
+                ));
+                return false;
+            }
+        }
+        Message::Text(text) => {
+            if let Some(s) = session {
+                s.on_client_text(text.as_str());
+            }
+        }
+        Message::Close(_) => return false,
+        Message::Ping(p) => {
+            let _ = out_tx.send(Message::Pong(p));
+        }
+        _ => {}
+    }
+    true
+}
+
+/// Run due keepalive checks; returns how the session ends, if it must
+/// 执行到期的保活检查；会话必须结束时返回结束方式
+async fn on_user_stream_keepalive(
+    execution_id: &str,
+    keepalive: &mut Keepalive,
+    cfg: &WebSocketConfig,
+    mgr: &TaskExecutionManager,
+    out_tx: &tokio::sync::mpsc::UnboundedSender<Message>,
+) -> Option<WsEnd> {
+    let event = keepalive.poll()?;
+    if ws_keepalive::handle(event, out_tx) {
+        return None;
+    }
+    if event == KeepaliveEvent::ReadTimeout {
+        // The peer vanished; keep the session for a resume / 对端消失；保留会话以待恢复
+        return Some(WsEnd::Dropped);
+    }
+    if event == KeepaliveEvent::IdleTimeout && cfg.terminate_on_idle {
+        let _ = mgr
+            .terminate_execution(execution_id, Some("websocket idle timeout".to_string()))
+            .await;
+    }
+    Some(WsEnd::Final)
 }
 
 #[derive(Deserialize)]
@@ -208,9 +681,11 @@ async fn e2e_llm_router_filter(
     State(state): State<AppState>,
     Query(q): Query<E2eLlmRouterFilterQuery>,
 ) -> impl IntoResponse {
-    let Some(hub) =
-        crate::spearlet::execution::ai::router::grpc_filter_stream::RouterFilterStreamHub::global()
-            .filter(|h| h.config.enabled)
+    let Some(hub) = state
+        .node()
+        .router_filter
+        .get()
+        .filter(|h| h.config.enabled)
     else {
         return (
             StatusCode::BAD_REQUEST,
@@ -253,6 +728,7 @@ async fn e2e_llm_router_filter(
         global_environment: HashMap::new(),
         spearlet_config: Some((*state.config).clone()),
         resource_pool: crate::spearlet::execution::runtime::ResourcePoolConfig::default(),
+        node: Default::default(),
     };
 
     let (registry, _policy) =
@@ -343,9 +819,9 @@ impl HttpGateway {
         config: Arc<SpearletConfig>,
         health_service: Arc<HealthService>,
         function_service: Arc<FunctionServiceImpl>,
-        object_client: ObjectServiceClient<Channel>,
-        invocation_client: InvocationServiceClient<Channel>,
-        execution_client: ExecutionServiceClient<Channel>,
+        object_client: ObjectServiceClient<LocalChannel>,
+        invocation_client: InvocationServiceClient<LocalChannel>,
+        execution_client: ExecutionServiceClient<LocalChannel>,
     ) -> Self {
         Self {
             config,
@@ -359,9 +835,7 @@ impl HttpGateway {
 
     /// Start HTTP gateway server / 启动HTTP网关服务器
     pub async fn start(self) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
-        let (listener, app) = self.prepare().await?;
-        axum::serve(listener, app).await?;
-        Ok(())
+        self.prepare().await?.serve(std::future::pending()).await
     }
 
     /// Start HTTP gateway with shutdown signal / 使用关闭信号启动HTTP网关
@@ -372,18 +846,11 @@ impl HttpGateway {
     where
         F: std::future::Future<Output = ()> + Send + 'static,
     {
-        let (listener, app) = self.prepare().await?;
-        axum::serve(listener, app)
-            .with_graceful_shutdown(shutdown)
-            .await?;
-        Ok(())
+        self.prepare().await?.serve(shutdown).await
     }
 
-    async fn prepare(
-        self,
-    ) -> Result<(tokio::net::TcpListener, Router), Box<dyn std::error::Error + Send + Sync>> {
-        let addr: SocketAddr = self.config.http.server.addr;
-        info!("Starting HTTP gateway on {}", addr);
+    async fn prepare(self) -> Result<ListenerManager, Box<dyn std::error::Error + Send + Sync>> {
+        info!("Starting HTTP gateway on {}", self.config.http.server.addr);
 
         let state = new_app_state(
             self.object_client,
@@ -394,18 +861,37 @@ impl HttpGateway {
             self.config.clone(),
         );
 
-        let app = build_router(state, self.config.http.swagger_enabled);
-
-        let listener = tokio::net::TcpListener::bind(addr).await?;
-        info!("HTTP gateway listening on {}", addr);
-        if self.config.http.swagger_enabled {
-            info!("Swagger UI available at:");
-            info!("  - http://{}/swagger-ui", addr);
-            info!("  - http://{}/docs", addr);
-            info!("  - OpenAPI JSON: http://{}/api/openapi.json", addr);
+        if let Some(limiter) = state.rate_limiter.clone() {
+            let mut changes = state.node().live_config.subscribe();
+            tokio::spawn(async move {
+                while changes.changed().await.is_ok() {
+                    let cfg = changes.borrow_and_update().clone();
+                    if let Some(cfg) = cfg {
+                        limiter.reconfigure(cfg.http.rate_limit.clone());
+                    }
+                }
+            });
         }
 
-        Ok((listener, app))
+        let swagger_enabled = self.config.http.swagger_enabled;
+        if self.config.debug_tunnel.enabled {
+            let plan = debug_tunnel::listener_plan(&self.config.http);
+            let router = build_listener_router(state.clone(), &plan, false);
+            let router = debug_tunnel::authenticated(router, &self.config.http.auth);
+            state.node().debug_tunnel.set(router);
+        }
+        let mut listeners = ListenerManager::new();
+        for plan in http_listeners::plan(&self.config.http) {
+            let app = build_listener_router(state.clone(), &plan, swagger_enabled);
+            listeners.bind(&plan, &self.config, app).await?;
+            if swagger_enabled && plan.serves(RouteGroup::Data) {
+                info!(
+                    "Swagger UI available at {}/swagger-ui and {}/docs",
+                    plan.server.addr, plan.server.addr
+                );
+            }
+        }
+        Ok(listeners)
     }
 }
 
@@ -470,6 +956,411 @@ async fn status_check(
     })))
 }
 
+/// Readiness endpoint / 就绪检查端点
+/// GET /readyz
+async fn readiness_check(State(state): State<AppState>) -> impl IntoResponse {
+    let clock = clock::health();
+    // A skewed clock only fails readiness when configured to / 仅在配置要求时时钟失准才导致未就绪
+    let clock_ready = !(state.config.clock.require_sync_for_ready && clock.status == "skewed");
+    // Required models of the model store must be pulled / 模型仓库中的必需模型必须已拉取
+    let models = state.node().model_store.readiness();
+    let ready = clock_ready && models.ready;
+    let status = if ready {
+        StatusCode::OK
+    } else {
+        StatusCode::SERVICE_UNAVAILABLE
+    };
+    (
+        status,
+        Json(serde_json::json!({
+            "ready": ready,
+            "timestamp": chrono::Utc::now().to_rfc3339(),
+            "checks": {
+                "clock": clock,
+                "compute_hints": state.node().compute_hints.status(),
+                "energy": state.node().energy.status(),
+                "models": models
+            }
+        })),
+    )
+}
+
+/// Node version, capabilities and limits for SDKs / 面向 SDK 的节点版本、能力与限制
+/// GET /about
+async fn about_handler(State(state): State<AppState>) -> Json<about::About> {
+    // Reloaded settings take effect without a restart / 重新加载的设置无需重启即生效
+    let config = state
+        .node()
+        .live_config
+        .current()
+        .unwrap_or_else(|| state.config.clone());
+    let mgr = state.function_service.get_execution_manager();
+    Json(about::about(&config, &mgr))
+}
+
+/// Reload configuration and workloads / 重新加载配置与工作负载
+/// POST /admin/reload
+async fn admin_reload(State(state): State<AppState>) -> axum::response::Response {
+    let Some(reloader) = state.node().live_config.reloader() else {
+        return (
+            StatusCode::SERVICE_UNAVAILABLE,
+            Json(serde_json::json!({"error": "reload is not available"})),
+        )
+            .into_response();
+    };
+    let report = reloader.reload().await;
+    let status = if report.errors.is_empty() {
+        StatusCode::OK
+    } else {
+        StatusCode::UNPROCESSABLE_ENTITY
+    };
+    (status, Json(report)).into_response()
+}
+
+/// Runtime introspection / 运行时自省
+/// GET /admin/introspect
+async fn admin_introspect(State(state): State<AppState>) -> Json<serde_json::Value> {
+    let mgr = state.function_service.get_execution_manager();
+    Json(admin::snapshot(&state.config, &mgr))
+}
+
+/// GET /admin/introspect/:section
+async fn admin_introspect_section(
+    State(state): State<AppState>,
+    Path(section): Path<String>,
+) -> axum::response::Response {
+    let mgr = state.function_service.get_execution_manager();
+    match admin::section(&section, &state.config, &mgr) {
+        Some(v) => Json(v).into_response(),
+        None => (
+            StatusCode::NOT_FOUND,
+            Json(serde_json::json!({
+                "error": format!("unknown section: {}", section),
+                "sections": admin::SECTIONS,
+            })),
+        )
+            .into_response(),
+    }
+}
+
+/// Redirect to the service root so relative links resolve under it
+/// 重定向到服务根路径，使相对链接在其下解析
+/// ANY /v1/services/:task/:service
+async fn service_root(Path((task, service)): Path<(String, String)>) -> Response {
+    axum::response::Redirect::permanent(&format!(
+        "{}{}/{}/",
+        service_ports::PATH_PREFIX,
+        task,
+        service
+    ))
+    .into_response()
+}
+
+/// Forward a request to a port a workload serves / 将请求转发到工作负载提供服务的端口
+/// ANY /v1/services/:task/:service/*path
+async fn proxy_service(
+    State(state): State<AppState>,
+    Path((task, service, path)): Path<(String, String, String)>,
+    method: axum::http::Method,
+    uri: axum::http::Uri,
+    headers: axum::http::HeaderMap,
+    body: axum::body::Bytes,
+) -> Response {
+    let task_id = state
+        .function_service
+        .get_execution_manager()
+        .find_task(&task)
+        .map(|t| t.id.clone())
+        .unwrap_or(task);
+    let Some(binding) = state.node().service_ports.target(&task_id, &service) else {
+        return ApiError::not_found(format!("task {} serves no port {:?}", task_id, service))
+            .into_response();
+    };
+    let path_and_query = match uri.query() {
+        Some(q) => format!("{}?{}", path, q),
+        None => path,
+    };
+    let strip: Vec<&str> = state
+        .config
+        .http
+        .auth
+        .mtls
+        .iter()
+        .map(|m| m.subject_header.as_str())
+        .collect();
+    let timeout = Duration::from_secs(state.config.service_ports.proxy_timeout_secs.max(1));
+    service_ports::forward(
+        &binding,
+        timeout,
+        &method,
+        &path_and_query,
+        &headers,
+        &strip,
+        body,
+    )
+    .await
+}
+
+/// Answer a WebRTC offer with an audio session for an execution / 以执行的音频会话应答 WebRTC offer
+/// POST /api/v1/executions/:execution_id/streams/webrtc
+#[cfg(feature = "webrtc")]
+async fn open_webrtc_stream(
+    State(state): State<AppState>,
+    Path(execution_id): Path<String>,
+    body: axum::body::Bytes,
+) -> axum::response::Response {
+    let req = if body.is_empty() {
+        webrtc_ingest::WebRtcSessionRequest::default()
+    } else {
+        match serde_json::from_slice::<webrtc_ingest::WebRtcSessionRequest>(&body) {
+            Ok(r) => r,
+            Err(e) => {
+                return (
+                    StatusCode::BAD_REQUEST,
+                    Json(serde_json::json!({"error": e.to_string()})),
+                )
+                    .into_response()
+            }
+        }
+    };
+    let node = state.node();
+    match node
+        .webrtc
+        .open(&state.config.webrtc, &execution_id, req)
+        .await
+    {
+        Ok(info) => (StatusCode::CREATED, Json(info)).into_response(),
+        Err(e) => {
+            let status = match e {
+                webrtc_ingest::WebRtcError::Disabled => StatusCode::SERVICE_UNAVAILABLE,
+                webrtc_ingest::WebRtcError::BadRequest(_) => StatusCode::BAD_REQUEST,
+                webrtc_ingest::WebRtcError::Conflict => StatusCode::CONFLICT,
+                webrtc_ingest::WebRtcError::Media(_) => StatusCode::INTERNAL_SERVER_ERROR,
+            };
+            (status, Json(serde_json::json!({"error": e.to_string()}))).into_response()
+        }
+    }
+}
+
+/// DELETE /api/v1/executions/:execution_id/streams/webrtc
+#[cfg(feature = "webrtc")]
+async fn close_webrtc_stream(
+    State(state): State<AppState>,
+    Path(execution_id): Path<String>,
+) -> StatusCode {
+    if state.node().webrtc.close(&execution_id) {
+        StatusCode::NO_CONTENT
+    } else {
+        StatusCode::NOT_FOUND
+    }
+}
+
+/// POST /api/v1/executions/:execution_id/streams/camera
+#[cfg(feature = "rtsp")]
+async fn subscribe_camera(
+    State(state): State<AppState>,
+    Path(execution_id): Path<String>,
+    Json(req): Json<rtsp::CameraSubscribeRequest>,
+) -> axum::response::Response {
+    match state
+        .node()
+        .cameras
+        .subscribe(&state.config.rtsp, &execution_id, req)
+    {
+        Ok(sub) => (StatusCode::CREATED, Json(sub)).into_response(),
+        Err(e) => {
+            let status = match e {
+                rtsp::CameraError::Disabled => StatusCode::SERVICE_UNAVAILABLE,
+                rtsp::CameraError::NotFound(_) => StatusCode::NOT_FOUND,
+                rtsp::CameraError::BadRequest(_) => StatusCode::BAD_REQUEST,
+                rtsp::CameraError::Conflict => StatusCode::CONFLICT,
+            };
+            (status, Json(serde_json::json!({"error": e.to_string()}))).into_response()
+        }
+    }
+}
+
+/// DELETE /api/v1/executions/:execution_id/streams/camera/:camera
+#[cfg(feature = "rtsp")]
+async fn unsubscribe_camera(
+    State(state): State<AppState>,
+    Path((execution_id, camera)): Path<(String, String)>,
+) -> StatusCode {
+    if state.node().cameras.unsubscribe(&execution_id, &camera) {
+        StatusCode::NO_CONTENT
+    } else {
+        StatusCode::NOT_FOUND
+    }
+}
+
+/// GET /api/v1/cameras
+#[cfg(feature = "rtsp")]
+async fn list_cameras(State(state): State<AppState>) -> Json<serde_json::Value> {
+    Json(serde_json::json!({
+        "enabled": state.config.rtsp.enabled,
+        "cameras": state.node().cameras.statuses(&state.config.rtsp),
+    }))
+}
+
+fn mp_error_response(e: MpError) -> axum::response::Response {
+    let status = match e {
+        MpError::Disabled => StatusCode::SERVICE_UNAVAILABLE,
+        MpError::Invalid(_) => StatusCode::BAD_REQUEST,
+        MpError::NotFound(_) => StatusCode::NOT_FOUND,
+        MpError::QueueFull(_) => StatusCode::TOO_MANY_REQUESTS,
+        _ => StatusCode::INTERNAL_SERVER_ERROR,
+    };
+    (status, Json(serde_json::json!({"error": e.to_string()}))).into_response()
+}
+
+/// Names announced by a peer spearlet / 对等 spearlet 公布的名称
+/// POST /api/v1/mp/names
+async fn mp_names(
+    State(state): State<AppState>,
+    Json(req): Json<message_routing::NamesAnnouncement>,
+) -> axum::response::Response {
+    match message_routing::accept_names(&state.node(), req) {
+        Ok(()) => StatusCode::NO_CONTENT.into_response(),
+        Err(e) => mp_error_response(e),
+    }
+}
+
+/// A message delivered by a peer spearlet / 对等 spearlet 投递的消息
+/// POST /api/v1/mp/deliver
+async fn mp_deliver(
+    State(state): State<AppState>,
+    Json(req): Json<message_routing::DeliverRequest>,
+) -> axum::response::Response {
+    match message_routing::accept_delivery(&state.node(), req) {
+        Ok(id) => (StatusCode::ACCEPTED, Json(serde_json::json!({"id": id}))).into_response(),
+        Err(e) => mp_error_response(e),
+    }
+}
+
+/// A peer acknowledged or dropped a message sent from here / 对等节点确认或丢弃了从本地发出的消息
+/// POST /api/v1/mp/acks
+async fn mp_acks(
+    State(state): State<AppState>,
+    Json(req): Json<message_routing::AckNotice>,
+) -> axum::response::Response {
+    match message_routing::accept_ack(&state.node(), req) {
+        Ok(()) => StatusCode::NO_CONTENT.into_response(),
+        Err(e) => mp_error_response(e),
+    }
+}
+
+#[cfg(feature = "telephony")]
+#[derive(Deserialize)]
+struct TwilioVoiceQuery {
+    token: Option<String>,
+    workload: Option<String>,
+}
+
+/// Answer a Twilio call by starting the voice agent / 启动语音智能体以应答 Twilio 来电
+/// POST /api/v1/telephony/twilio/voice
+#[cfg(feature = "telephony")]
+async fn twilio_voice(
+    State(state): State<AppState>,
+    client: Option<Extension<ClientKey>>,
+    Query(q): Query<TwilioVoiceQuery>,
+    headers: axum::http::HeaderMap,
+    axum::extract::Form(form): axum::extract::Form<HashMap<String, String>>,
+) -> axum::response::Response {
+    let cfg = &state.config.telephony;
+    if !cfg.enabled {
+        return StatusCode::NOT_FOUND.into_response();
+    }
+    if !cfg.webhook_token.is_empty() && q.token.as_deref() != Some(cfg.webhook_token.as_str()) {
+        return StatusCode::FORBIDDEN.into_response();
+    }
+    let twiml = |body: String| {
+        (
+            StatusCode::OK,
+            [(axum::http::header::CONTENT_TYPE, "text/xml")],
+            body,
+        )
+            .into_response()
+    };
+    let unavailable = || {
+        twiml(telephony::reject_twiml(
+            "Sorry, the agent is not available.",
+        ))
+    };
+
+    let workload = q
+        .workload
+        .filter(|w| !w.trim().is_empty())
+        .unwrap_or_else(|| cfg.workload.clone());
+    let host = headers
+        .get(axum::http::header::HOST)
+        .and_then(|v| v.to_str().ok());
+    let Some(media_url) = telephony::media_url(cfg, host).filter(|_| !workload.is_empty()) else {
+        return unavailable();
+    };
+    if check_workload_rate_limit(&state, client.as_deref(), &workload).is_err() {
+        return unavailable();
+    }
+
+    let field = |k: &str| form.get(k).cloned().unwrap_or_default();
+    let call_sid = field("CallSid");
+    let execution_id = uuid::Uuid::new_v4().to_string();
+    let streams = state.node().user_streams.clone();
+    exec_stream::attach(&streams, &execution_id, cfg.stream_id);
+    let input = serde_json::json!({
+        "call_sid": call_sid,
+        "from": field("From"),
+        "to": field("To"),
+        "direction": field("Direction"),
+        "stream_id": cfg.stream_id,
+    });
+    let req = InvokeRequest {
+        invocation_id: String::new(),
+        execution_id: execution_id.clone(),
+        task_id: workload.clone(),
+        function_name: String::new(),
+        input: Some(v1_exec_payload(Some(input))),
+        headers: HashMap::new(),
+        environment: HashMap::new(),
+        timeout_ms: 0,
+        session_id: call_sid.clone(),
+        mode: crate::proto::spearlet::ExecutionMode::Async as i32,
+        force_new_instance: false,
+        metadata: with_trace_metadata(
+            HashMap::from([("telephony.call_sid".to_string(), call_sid)]),
+            &headers,
+        ),
+    };
+    let mut client = state.invocation_client.clone();
+    match client.invoke(req).await {
+        Ok(resp) if resp.get_ref().error.is_none() => {
+            let token = state
+                .node()
+                .phone_calls
+                .register_call(&execution_id, cfg.stream_id);
+            twiml(telephony::connect_twiml(&media_url, &token))
+        }
+        other => {
+            if let Err(e) = other {
+                error!("Failed to start voice agent {}: {}", workload, e);
+            }
+            exec_stream::detach(&streams, &execution_id);
+            unavailable()
+        }
+    }
+}
+
+/// Twilio media stream / Twilio 媒体流
+/// GET /api/v1/telephony/twilio/media
+#[cfg(feature = "telephony")]
+async fn twilio_media_ws(State(state): State<AppState>, ws: WebSocketUpgrade) -> impl IntoResponse {
+    if !state.config.telephony.enabled {
+        return StatusCode::NOT_FOUND.into_response();
+    }
+    let calls = state.node().phone_calls.clone();
+    ws.on_upgrade(|socket| crash::scope("telephony", telephony::run_twilio_media(socket, calls)))
+        .into_response()
+}
+
 #[derive(Deserialize)]
 struct PutObjectBody {
     value: String, // Base64 encoded / Base64编码
@@ -477,19 +1368,32 @@ struct PutObjectBody {
     overwrite: Option<bool>,
 }
 
+/// Error for an object call answered with `success: false` / 对象调用以 `success: false` 应答时的错误
+fn object_failure(message: String) -> ApiError {
+    if message.starts_with("Object not found") {
+        ApiError::not_found(message)
+    } else if message.contains("already exists") || message.contains("pinned") {
+        ApiError::conflict(message)
+    } else if message.starts_with("Failed to") {
+        ApiError::internal(message)
+    } else {
+        ApiError::bad_request(message)
+    }
+}
+
 /// Put object endpoint / 存储对象端点
 /// PUT /objects/:key
 async fn put_object(
     Path(key): Path<String>,
     State(state): State<AppState>,
     Json(body): Json<PutObjectBody>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("PUT /objects/{}", key);
 
     // Decode base64 value / 解码base64值
     let value = match general_purpose::STANDARD.decode(&body.value) {
         Ok(v) => v,
-        Err(_) => return Err(StatusCode::BAD_REQUEST),
+        Err(_) => return Err(ApiError::bad_request("value is not valid base64")),
     };
 
     let request = PutObjectRequest {
@@ -503,6 +1407,9 @@ async fn put_object(
     match client.put_object(request).await {
         Ok(response) => {
             let resp = response.into_inner();
+            if !resp.success {
+                return Err(object_failure(resp.message));
+            }
             Ok(Json(serde_json::json!({
                 "success": resp.success,
                 "message": resp.message,
@@ -511,7 +1418,7 @@ async fn put_object(
         }
         Err(e) => {
             error!("Failed to put object {}: {}", key, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -521,7 +1428,7 @@ async fn put_object(
 async fn get_object(
     Path(key): Path<String>,
     State(state): State<AppState>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("GET /objects/{}", key);
 
     let request = GetObjectRequest {
@@ -549,15 +1456,15 @@ async fn get_object(
                         "pinned": object.pinned
                     })))
                 } else {
-                    Err(StatusCode::NOT_FOUND)
+                    Err(ApiError::not_found(format!("object {} not found", key)))
                 }
             } else {
-                Err(StatusCode::NOT_FOUND)
+                Err(ApiError::not_found(format!("object {} not found", key)))
             }
         }
         Err(e) => {
             error!("Failed to get object {}: {}", key, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -574,7 +1481,7 @@ struct ListObjectsQuery {
 async fn list_objects(
     Query(params): Query<ListObjectsQuery>,
     State(state): State<AppState>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("GET /objects with prefix: {:?}", params.prefix);
 
     let request = ListObjectsRequest {
@@ -614,7 +1521,7 @@ async fn list_objects(
         }
         Err(e) => {
             error!("Failed to list objects: {}", e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -630,7 +1537,7 @@ async fn add_object_ref(
     Path(key): Path<String>,
     State(state): State<AppState>,
     Json(body): Json<RefCountBody>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("POST /objects/{}/refs", key);
 
     let request = AddObjectRefRequest {
@@ -642,6 +1549,9 @@ async fn add_object_ref(
     match client.add_object_ref(request).await {
         Ok(response) => {
             let resp = response.into_inner();
+            if !resp.success {
+                return Err(object_failure(resp.message));
+            }
             Ok(Json(serde_json::json!({
                 "success": resp.success,
                 "message": resp.message,
@@ -650,7 +1560,7 @@ async fn add_object_ref(
         }
         Err(e) => {
             error!("Failed to add object ref {}: {}", key, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -661,7 +1571,7 @@ async fn remove_object_ref(
     Path(key): Path<String>,
     State(state): State<AppState>,
     Json(body): Json<RefCountBody>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("DELETE /objects/{}/refs", key);
 
     let request = RemoveObjectRefRequest {
@@ -673,6 +1583,9 @@ async fn remove_object_ref(
     match client.remove_object_ref(request).await {
         Ok(response) => {
             let resp = response.into_inner();
+            if !resp.success {
+                return Err(object_failure(resp.message));
+            }
             Ok(Json(serde_json::json!({
                 "success": resp.success,
                 "message": resp.message,
@@ -681,7 +1594,7 @@ async fn remove_object_ref(
         }
         Err(e) => {
             error!("Failed to remove object ref {}: {}", key, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -691,7 +1604,7 @@ async fn remove_object_ref(
 async fn pin_object(
     Path(key): Path<String>,
     State(state): State<AppState>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("POST /objects/{}/pin", key);
 
     let request = PinObjectRequest { key: key.clone() };
@@ -700,6 +1613,9 @@ async fn pin_object(
     match client.pin_object(request).await {
         Ok(response) => {
             let resp = response.into_inner();
+            if !resp.success {
+                return Err(object_failure(resp.message));
+            }
             Ok(Json(serde_json::json!({
                 "success": resp.success,
                 "message": resp.message
@@ -707,7 +1623,7 @@ async fn pin_object(
         }
         Err(e) => {
             error!("Failed to pin object {}: {}", key, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -717,7 +1633,7 @@ async fn pin_object(
 async fn unpin_object(
     Path(key): Path<String>,
     State(state): State<AppState>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("DELETE /objects/{}/pin", key);
 
     let request = UnpinObjectRequest { key: key.clone() };
@@ -726,6 +1642,9 @@ async fn unpin_object(
     match client.unpin_object(request).await {
         Ok(response) => {
             let resp = response.into_inner();
+            if !resp.success {
+                return Err(object_failure(resp.message));
+            }
             Ok(Json(serde_json::json!({
                 "success": resp.success,
                 "message": resp.message
@@ -733,7 +1652,7 @@ async fn unpin_object(
         }
         Err(e) => {
             error!("Failed to unpin object {}: {}", key, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -749,7 +1668,7 @@ async fn delete_object(
     Path(key): Path<String>,
     Query(params): Query<DeleteObjectQuery>,
     State(state): State<AppState>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("DELETE /objects/{}", key);
 
     let request = DeleteObjectRequest {
@@ -761,6 +1680,9 @@ async fn delete_object(
     match client.delete_object(request).await {
         Ok(response) => {
             let resp = response.into_inner();
+            if !resp.success {
+                return Err(object_failure(resp.message));
+            }
             Ok(Json(serde_json::json!({
                 "success": resp.success,
                 "message": resp.message
@@ -768,7 +1690,7 @@ async fn delete_object(
         }
         Err(e) => {
             error!("Failed to delete object {}: {}", key, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -790,34 +1712,76 @@ struct ExecuteFunctionBody {
     metadata: Option<HashMap<String, String>>,
     input_base64: Option<String>,
     input_content_type: Option<String>,
+    /// Completion webhook of async runs / 异步执行的完成 webhook
+    callback_url: Option<String>,
+    /// Per-call webhook signing secret / 单次调用的 webhook 签名密钥
+    callback_secret: Option<String>,
+    /// Deduplicates async submissions, also read from `Idempotency-Key`
+    /// 对异步提交去重，也可由 `Idempotency-Key` 请求头提供
+    idempotency_key: Option<String>,
 }
 
 /// Execute function endpoint / 执行函数端点
 /// POST /functions/execute
 async fn execute_function(
     State(state): State<AppState>,
+    client: Option<Extension<ClientKey>>,
+    headers: axum::http::HeaderMap,
     Json(body): Json<ExecuteFunctionBody>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, Response> {
     debug!("POST /functions/execute");
 
     let task_id = body.task_id.unwrap_or_default();
     if task_id.is_empty() {
-        return Err(StatusCode::BAD_REQUEST);
+        return Err(ApiError::bad_request("task_id is required").into_response());
     }
+    check_workload_rate_limit(&state, client.as_deref(), &task_id)?;
 
     let mode = body.mode.unwrap_or_else(|| "sync".to_string());
     let mode = mode.to_ascii_lowercase();
     let proto_mode = match mode.as_str() {
         "sync" => crate::proto::spearlet::ExecutionMode::Sync as i32,
         "async" => crate::proto::spearlet::ExecutionMode::Async as i32,
-        _ => return Err(StatusCode::BAD_REQUEST),
+        other => {
+            return Err(ApiError::bad_request(format!(
+                "mode must be sync or async, got {:?}",
+                other
+            ))
+            .into_response())
+        }
     };
 
+    let mut metadata = body.metadata.unwrap_or_default();
+    if let Some(url) = body.callback_url {
+        metadata.insert(
+            crate::spearlet::webhook::METADATA_CALLBACK_URL.to_string(),
+            url,
+        );
+    }
+    if let Some(secret) = body.callback_secret {
+        metadata.insert(
+            crate::spearlet::webhook::METADATA_CALLBACK_SECRET.to_string(),
+            secret,
+        );
+    }
+    let idempotency_key = body.idempotency_key.or_else(|| {
+        headers
+            .get("idempotency-key")
+            .and_then(|v| v.to_str().ok())
+            .map(str::to_string)
+    });
+    if let Some(key) = idempotency_key.filter(|k| !k.trim().is_empty()) {
+        metadata.insert(
+            crate::spearlet::async_journal::METADATA_IDEMPOTENCY_KEY.to_string(),
+            key,
+        );
+    }
+
     let mut input_data = Vec::new();
     if let Some(b64) = body.input_base64.as_ref() {
-        input_data = general_purpose::STANDARD
-            .decode(b64)
-            .map_err(|_| StatusCode::BAD_REQUEST)?;
+        input_data = general_purpose::STANDARD.decode(b64).map_err(|_| {
+            ApiError::bad_request("input_base64 is not valid base64").into_response()
+        })?;
     }
 
     let req = InvokeRequest {
@@ -837,7 +1801,7 @@ async fn execute_function(
         session_id: body.session_id.unwrap_or_default(),
         mode: proto_mode,
         force_new_instance: body.force_new_instance.unwrap_or(false),
-        metadata: body.metadata.unwrap_or_default(),
+        metadata: with_trace_metadata(metadata, &headers),
     };
 
     let mut client = state.invocation_client.clone();
@@ -849,23 +1813,340 @@ async fn execute_function(
                 .as_ref()
                 .map(|p| general_purpose::STANDARD.encode(&p.data))
                 .unwrap_or_default();
-            Ok(Json(serde_json::json!({
+            let mut out = serde_json::json!({
                 "success": true,
                 "invocation_id": resp.invocation_id,
                 "execution_id": resp.execution_id,
                 "instance_id": resp.instance_id,
                 "status": proto_execution_status_to_str(resp.status),
                 "output_base64": output_b64,
-                "error": resp.error.map(|e| serde_json::json!({"code": e.code, "message": e.message}))
-            })))
+                "error": resp.error.as_ref().map(|e| serde_json::json!({"code": e.code, "message": e.message}))
+            });
+            if !resp.debug_trace.is_empty() {
+                out["debug_trace"] = debug_trace_value(&resp);
+            }
+            Ok(Json(out))
+        }
+        Err(e) if e.code() == tonic::Code::InvalidArgument => {
+            debug!("Rejected execution for task {}: {}", task_id, e.message());
+            Err(ApiError::from(e).into_response())
         }
         Err(e) => {
             error!("Failed to execute function for task {}: {}", task_id, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e).into_response())
         }
     }
 }
 
+/// Workload mapped to the path by the desired state / 由期望状态映射到该路径的工作负载
+/// POST /v1/endpoints/{path}
+async fn invoke_endpoint(
+    State(state): State<AppState>,
+    client: Option<Extension<ClientKey>>,
+    Path(path): Path<String>,
+    headers: axum::http::HeaderMap,
+    body: axum::body::Bytes,
+) -> Result<Response, Response> {
+    debug!("POST /v1/endpoints/{}", path);
+
+    let Some(workload) = state.node().desired_state.endpoint(&path) else {
+        return Err(ApiError::not_found(format!("no endpoint {:?}", path)).into_response());
+    };
+    let task_id = state
+        .function_service
+        .get_execution_manager()
+        .find_task(&workload)
+        .map(|t| t.id.clone())
+        .unwrap_or(workload);
+    check_workload_rate_limit(&state, client.as_deref(), &task_id)?;
+
+    let content_type = headers
+        .get(axum::http::header::CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("application/octet-stream")
+        .to_string();
+    let req = InvokeRequest {
+        task_id,
+        input: Some(crate::proto::spearlet::Payload {
+            content_type,
+            data: body.to_vec(),
+        }),
+        mode: crate::proto::spearlet::ExecutionMode::Sync as i32,
+        metadata: with_trace_metadata(HashMap::new(), &headers),
+        ..Default::default()
+    };
+    let mut client = state.invocation_client.clone();
+    let resp = client
+        .invoke(req)
+        .await
+        .map_err(|e| ApiError::from(e).into_response())?
+        .into_inner();
+    if let Some(e) = resp.error {
+        return Err(ApiError::new(StatusCode::BAD_GATEWAY, &e.code, e.message).into_response());
+    }
+    let output = resp.output.unwrap_or_default();
+    Ok((
+        [(axum::http::header::CONTENT_TYPE, output.content_type)],
+        output.data,
+    )
+        .into_response())
+}
+
+/// Apply the rate limit of the target workload, if it sets one
+/// 执行目标工作负载的限流（如已设置）
+fn check_workload_rate_limit(
+    state: &AppState,
+    client: Option<&ClientKey>,
+    task_id: &str,
+) -> Result<(), Response> {
+    let (Some(limiter), Some(client)) = (state.rate_limiter.as_ref(), client) else {
+        return Ok(());
+    };
+    let Some(task) = state
+        .function_service
+        .get_execution_manager()
+        .find_task(task_id)
+    else {
+        return Ok(());
+    };
+    limiter
+        .check_workload(&client.0, &task.id, &task.spec.task_config)
+        .map_err(rate_limit::too_many_requests)
+}
+
+/// Stream options for `/v1/exec` / `/v1/exec` 的流式选项
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+struct V1ExecStreamOptions {
+    /// Run asynchronously and return the user stream URL / 异步执行并返回用户流地址
+    enabled: bool,
+    /// `ws` (default), `sse` or `chunked` / `ws`（默认）、`sse` 或 `chunked`
+    mode: Option<String>,
+    /// User stream bridged to the HTTP response / 桥接到 HTTP 响应的 user stream
+    stream_id: Option<u32>,
+}
+
+/// Typed request body for `POST /v1/exec` / `POST /v1/exec` 的类型化请求体
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct V1ExecBody {
+    /// Task ID or task name / 任务 ID 或任务名称
+    workload: String,
+    /// Expected runtime type (optional) / 期望的运行时类型（可选）
+    #[serde(rename = "type", default)]
+    runtime_type: Option<String>,
+    /// Entry method / 入口方法
+    #[serde(default)]
+    method: Option<String>,
+    /// JSON payload; strings are sent as text / JSON 负载；字符串按文本发送
+    #[serde(default)]
+    payload: Option<serde_json::Value>,
+    #[serde(default)]
+    stream: Option<V1ExecStreamOptions>,
+    #[serde(default)]
+    timeout_ms: Option<u64>,
+    #[serde(default)]
+    session_id: Option<String>,
+    #[serde(default)]
+    metadata: Option<HashMap<String, String>>,
+}
+
+fn v1_exec_error(status: StatusCode, code: &str, message: String) -> axum::response::Response {
+    (
+        status,
+        Json(serde_json::json!({"success": false, "error": {"code": code, "message": message}})),
+    )
+        .into_response()
+}
+
+/// Encode a `/v1/exec` payload / 编码 `/v1/exec` 负载
+pub(crate) fn v1_exec_payload(
+    payload: Option<serde_json::Value>,
+) -> crate::proto::spearlet::Payload {
+    let (content_type, data) = match payload {
+        None | Some(serde_json::Value::Null) => ("application/octet-stream", Vec::new()),
+        Some(serde_json::Value::String(s)) => ("text/plain", s.into_bytes()),
+        Some(v) => (
+            "application/json",
+            serde_json::to_vec(&v).unwrap_or_default(),
+        ),
+    };
+    crate::proto::spearlet::Payload {
+        content_type: content_type.to_string(),
+        data,
+    }
+}
+
+/// Reproducibility manifest of a local execution / 本地执行的可复现性清单
+async fn execution_manifest(state: &AppState, execution_id: &str) -> serde_json::Value {
+    state
+        .function_service
+        .get_execution_manager()
+        .get_execution_status(execution_id)
+        .await
+        .ok()
+        .flatten()
+        .and_then(|r| ExecutionManifest::from_metadata(&r.metadata))
+        .and_then(|m| serde_json::to_value(m).ok())
+        .unwrap_or(serde_json::Value::Null)
+}
+
+/// Typed execution endpoint / 类型化执行端点
+/// POST /v1/exec
+async fn v1_exec(
+    State(state): State<AppState>,
+    client: Option<Extension<ClientKey>>,
+    headers: axum::http::HeaderMap,
+    body: Result<Json<V1ExecBody>, axum::extract::rejection::JsonRejection>,
+) -> axum::response::Response {
+    debug!("POST /v1/exec");
+
+    let body = match body {
+        Ok(Json(b)) => b,
+        Err(e) => return v1_exec_error(StatusCode::BAD_REQUEST, "INVALID_BODY", e.body_text()),
+    };
+    let workload = body.workload.trim().to_string();
+    if workload.is_empty() {
+        return v1_exec_error(
+            StatusCode::BAD_REQUEST,
+            "INVALID_BODY",
+            "workload is required".to_string(),
+        );
+    }
+
+    // Resolve by task id, then by task name; unknown workloads are left to the invoker
+    // 先按任务 ID、再按任务名解析；未知工作负载交由调用方处理
+    let task = state
+        .function_service
+        .get_execution_manager()
+        .find_task(&workload);
+    if let (Some(task), Some(expected)) = (task.as_ref(), body.runtime_type.as_deref()) {
+        let actual = task.spec.runtime_type.as_str();
+        if !expected.trim().eq_ignore_ascii_case(actual) {
+            return v1_exec_error(
+                StatusCode::BAD_REQUEST,
+                "TYPE_MISMATCH",
+                format!(
+                    "workload {} has type {}, not {}",
+                    workload, actual, expected
+                ),
+            );
+        }
+    }
+    let task_id = task.map(|t| t.id.clone()).unwrap_or(workload);
+    if let Err(resp) = check_workload_rate_limit(&state, client.as_deref(), &task_id) {
+        return resp;
+    }
+
+    let stream = body.stream.unwrap_or_default();
+    let accept = headers
+        .get(axum::http::header::ACCEPT)
+        .and_then(|v| v.to_str().ok());
+    let http_stream = match ExecStreamMode::select(stream.mode.as_deref(), accept) {
+        Ok(m) => m,
+        Err(e) => return v1_exec_error(StatusCode::BAD_REQUEST, "INVALID_BODY", e),
+    };
+    let streaming = stream.enabled || http_stream.is_some();
+    let mode = if streaming {
+        crate::proto::spearlet::ExecutionMode::Async
+    } else {
+        crate::proto::spearlet::ExecutionMode::Sync
+    };
+
+    // HTTP streams are attached before the workload can write to them
+    // HTTP 流在工作负载写入前完成挂接
+    let stream_id = stream.stream_id.unwrap_or(exec_stream::DEFAULT_STREAM_ID);
+    let streams = state.node().user_streams.clone();
+    let execution_id = if http_stream.is_some() {
+        let id = uuid::Uuid::new_v4().to_string();
+        exec_stream::attach(&streams, &id, stream_id);
+        id
+    } else {
+        String::new()
+    };
+
+    let req = InvokeRequest {
+        invocation_id: String::new(),
+        execution_id: execution_id.clone(),
+        task_id: task_id.clone(),
+        function_name: body.method.unwrap_or_default(),
+        input: Some(v1_exec_payload(body.payload)),
+        headers: HashMap::new(),
+        environment: HashMap::new(),
+        timeout_ms: body.timeout_ms.unwrap_or(0),
+        session_id: body.session_id.unwrap_or_default(),
+        mode: mode as i32,
+        force_new_instance: false,
+        metadata: with_trace_metadata(body.metadata.unwrap_or_default(), &headers),
+    };
+
+    let mut client = state.invocation_client.clone();
+    let resp = match client.invoke(req).await {
+        Ok(r) => r.into_inner(),
+        Err(e) => {
+            if http_stream.is_some() {
+                exec_stream::detach(&streams, &execution_id);
+            }
+            error!("Failed to execute workload {}: {}", task_id, e);
+            let status = ApiError::from_grpc(&e).status;
+            return v1_exec_error(status, "EXECUTION_ERROR", e.message().to_string());
+        }
+    };
+
+    if let Some(m) = http_stream {
+        let outcome = exec_stream::ExecOutcome {
+            status: resp.status,
+            output: resp.output,
+            error: resp.error,
+        };
+        return exec_stream::respond(
+            streams,
+            m,
+            resp.execution_id,
+            stream_id,
+            outcome,
+            state.execution_client.clone(),
+        );
+    }
+
+    let trace = debug_trace_value(&resp);
+    let output = resp.output.unwrap_or_default();
+    let output_value = if output.content_type == "application/json" {
+        serde_json::from_slice(&output.data).unwrap_or(serde_json::Value::Null)
+    } else {
+        std::str::from_utf8(&output.data)
+            .map(|s| serde_json::Value::String(s.to_string()))
+            .unwrap_or(serde_json::Value::Null)
+    };
+    let manifest = execution_manifest(&state, &resp.execution_id).await;
+    let stream_url = if streaming {
+        Some(format!(
+            "/api/v1/executions/{}/streams/ws",
+            resp.execution_id
+        ))
+    } else {
+        None
+    };
+
+    let mut out = serde_json::json!({
+        "success": resp.error.is_none(),
+        "workload": task_id,
+        "invocation_id": resp.invocation_id,
+        "execution_id": resp.execution_id,
+        "instance_id": resp.instance_id,
+        "status": proto_execution_status_to_str(resp.status),
+        "output": output_value,
+        "output_base64": general_purpose::STANDARD.encode(&output.data),
+        "stream_url": stream_url,
+        "manifest": manifest,
+        "error": resp.error.map(|e| serde_json::json!({"code": e.code, "message": e.message}))
+    });
+    if !trace.is_null() {
+        out["debug_trace"] = trace;
+    }
+    (StatusCode::OK, Json(out)).into_response()
+}
+
 #[derive(Deserialize)]
 struct ExecutionStatusQuery {
     include_output: Option<bool>,
@@ -877,7 +2158,7 @@ async fn get_execution_status(
     State(state): State<AppState>,
     Path(execution_id): Path<String>,
     Query(params): Query<ExecutionStatusQuery>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("GET /functions/executions/{}", execution_id);
 
     let include_output = params.include_output.unwrap_or(false);
@@ -904,16 +2185,16 @@ async fn get_execution_status(
                 "status": proto_execution_status_to_str(exec.status),
                 "output_base64": output_b64,
                 "error": exec.error.map(|e| serde_json::json!({"code": e.code, "message": e.message})),
+                "manifest": execution_manifest(&state, &execution_id).await,
                 "started_at": exec.started_at.map(|t| chrono::DateTime::<chrono::Utc>::from_timestamp(t.seconds, t.nanos as u32).map(|dt| dt.to_rfc3339()).unwrap_or_default()),
                 "completed_at": exec.completed_at.map(|t| chrono::DateTime::<chrono::Utc>::from_timestamp(t.seconds, t.nanos as u32).map(|dt| dt.to_rfc3339()).unwrap_or_default())
             })))
         }
         Err(e) => {
-            if e.code() == tonic::Code::NotFound {
-                return Err(StatusCode::NOT_FOUND);
+            if e.code() != tonic::Code::NotFound {
+                error!("Failed to get execution {}: {}", execution_id, e);
             }
-            error!("Failed to get execution {}: {}", execution_id, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -929,7 +2210,7 @@ async fn cancel_execution(
     State(state): State<AppState>,
     Path(execution_id): Path<String>,
     body: Option<Json<CancelExecutionBody>>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("POST /functions/executions/{}/cancel", execution_id);
 
     let reason = body.and_then(|b| b.0.reason).unwrap_or_default();
@@ -952,7 +2233,7 @@ async fn cancel_execution(
         }
         Err(e) => {
             error!("Failed to terminate execution {}: {}", execution_id, e);
-            Err(StatusCode::INTERNAL_SERVER_ERROR)
+            Err(ApiError::from(e))
         }
     }
 }
@@ -1030,12 +2311,12 @@ async fn list_tasks(
 async fn get_task(
     State(state): State<AppState>,
     Path(task_id): Path<String>,
-) -> Result<Json<serde_json::Value>, StatusCode> {
+) -> Result<Json<serde_json::Value>, ApiError> {
     debug!("GET /tasks/{}", task_id);
 
     let mgr = state.function_service.get_execution_manager();
     let Some(task) = mgr.get_task_by_id(&task_id) else {
-        return Err(StatusCode::NOT_FOUND);
+        return Err(ApiError::not_found(format!("task {} not found", task_id)));
     };
 
     let st = task_status_to_public_str(&task.status());
@@ -1054,6 +2335,7 @@ async fn get_task(
         "created_at": system_time_to_rfc3339(task.created_at),
         "updated_at": system_time_to_rfc3339(updated_at),
         "execution_count": metrics.total_executions,
+        "downloads": mgr.download_progress(&task_id),
         "last_execution": last_exec.map(|e| serde_json::json!({
             "execution_id": e.execution_id,
             "status": e.status,
@@ -1100,7 +2382,8 @@ async fn get_task_executions(
                 "status": e.status,
                 "execution_time_ms": e.execution_time_ms,
                 "error": e.error_message,
-                "timestamp": system_time_to_rfc3339(e.timestamp)
+                "timestamp": system_time_to_rfc3339(e.timestamp),
+                "mono_ms": e.mono_ms
             })
         })
         .collect::<Vec<_>>();
@@ -1111,7 +2394,8 @@ async fn get_task_executions(
         "total": total,
         "limit": limit,
         "offset": offset,
-        "has_more": has_more
+        "has_more": has_more,
+        "boot_id": clock::boot_id()
     })))
 }
 
@@ -1127,6 +2411,7 @@ async fn get_stats(State(state): State<AppState>) -> Result<Json<serde_json::Val
         .function_service
         .get_execution_manager()
         .get_statistics();
+    let usage = state.node().usage.report();
 
     Ok(Json(serde_json::json!({
         "total_executions": exec_stats.total_executions,
@@ -1138,7 +2423,8 @@ async fn get_stats(State(state): State<AppState>) -> Result<Json<serde_json::Val
         "task_count": stats.task_count,
         "artifact_count": stats.artifact_count,
         "instance_count": stats.instance_count,
-        "average_response_time_ms": stats.average_response_time_ms
+        "average_response_time_ms": stats.average_response_time_ms,
+        "ai_usage": {"month": usage.month, "total": usage.total}
     })))
 }
 
@@ -1151,9 +2437,17 @@ async fn get_health_status(
 
     let health = state.health_service.get_health_status().await;
     let stats = state.function_service.get_stats().await;
+    let workers = crate::spearlet::supervisor::worker_statuses();
+    // A worker that keeps dying degrades the node even though it is restarted
+    // 持续崩溃的工作协程即使被重启也会使节点降级
+    let status = if workers.iter().any(|w| w.flapping) {
+        "degraded".to_string()
+    } else {
+        health.status
+    };
 
     Ok(Json(serde_json::json!({
-        "status": health.status,
+        "status": status,
         "timestamp": chrono::Utc::now().to_rfc3339(),
         "details": {
             "node_name": state.config.node_name,
@@ -1164,7 +2458,8 @@ async fn get_health_status(
             "execution_count": health.execution_count,
             "running_executions": health.running_executions,
             "artifact_count": stats.artifact_count,
-            "instance_count": stats.instance_count
+            "instance_count": stats.instance_count,
+            "workers": workers
         }
     })))
 }
@@ -1569,6 +2864,113 @@ async fn api_docs() -> Json<serde_json::Value> {
                     }
                 }
             },
+            "/v1/exec": {
+                "post": {
+                    "tags": ["Functions"],
+                    "summary": "Execute a workload / 执行工作负载",
+                    "description": "Versioned, typed execution endpoint / 版本化的类型化执行端点",
+                    "parameters": [
+                        {"name": "Spear-Debug", "in": "header", "required": false, "schema": {"type": "string", "enum": ["trace"]}, "description": "Return a trace of hostcalls, tool calls, stream events and provider calls / 返回 hostcall、工具调用、流事件与提供方调用的追踪"}
+                    ],
+                    "requestBody": {
+                        "required": true,
+                        "content": {
+                            "application/json": {
+                                "schema": {
+                                    "type": "object",
+                                    "required": ["workload"],
+                                    "additionalProperties": false,
+                                    "properties": {
+                                        "workload": {"type": "string", "description": "Task ID or name / 任务 ID 或名称"},
+                                        "type": {"type": "string", "enum": ["process", "wasm", "kubernetes"], "description": "Expected runtime type / 期望的运行时类型"},
+                                        "method": {"type": "string", "description": "Entry method / 入口方法"},
+                                        "payload": {"description": "JSON payload; strings are sent as text / JSON 负载；字符串按文本发送"},
+                                        "stream": {
+                                            "type": "object",
+                                            "additionalProperties": false,
+                                            "properties": {
+                                                "enabled": {"type": "boolean", "default": false, "description": "Run async and return stream_url / 异步执行并返回 stream_url"},
+                                                "mode": {"type": "string", "enum": ["ws", "sse", "chunked"], "default": "ws", "description": "ws returns stream_url; sse/chunked stream the outStream in the response / ws 返回 stream_url；sse/chunked 在响应中流式输出 outStream"},
+                                                "stream_id": {"type": "integer", "default": 1, "description": "User stream bridged to HTTP / 桥接到 HTTP 的 user stream"}
+                                            }
+                                        },
+                                        "timeout_ms": {"type": "integer"},
+                                        "session_id": {"type": "string"},
+                                        "metadata": {"type": "object", "additionalProperties": {"type": "string"}}
+                                    }
+                                }
+                            }
+                        }
+                    },
+                    "responses": {
+                        "200": {
+                            "description": "Execution result / 执行结果",
+                            "content": {
+                                "application/json": {
+                                    "schema": {
+                                        "type": "object",
+                                        "properties": {
+                                            "success": {"type": "boolean"},
+                                            "workload": {"type": "string"},
+                                            "invocation_id": {"type": "string"},
+                                            "execution_id": {"type": "string"},
+                                            "instance_id": {"type": "string"},
+                                            "status": {"type": "string", "enum": ["PENDING", "RUNNING", "COMPLETED", "FAILED", "TERMINATED", "TIMEOUT", "UNSPECIFIED"]},
+                                            "output": {},
+                                            "output_base64": {"type": "string"},
+                                            "stream_url": {"type": "string", "nullable": true},
+                                            "manifest": {"type": "object", "nullable": true, "description": "Reproducibility manifest / 可复现性清单"},
+                                            "debug_trace": {"type": "object", "description": "With Spear-Debug: trace, the ordered events and a dropped count / 携带 Spear-Debug: trace 时的有序事件与丢弃计数"},
+                                            "error": {"type": "object", "nullable": true}
+                                        }
+                                    }
+                                },
+                                "text/event-stream": {
+                                    "schema": {"type": "string", "description": "`frame` events with outStream frames, then one `done` event / 先是携带 outStream 帧的 `frame` 事件，最后一个 `done` 事件"}
+                                },
+                                "application/octet-stream": {
+                                    "schema": {"type": "string", "format": "binary", "description": "Chunked frame data when stream.mode is chunked / stream.mode 为 chunked 时的分块帧数据"}
+                                }
+                            }
+                        },
+                        "400": {"description": "Invalid body or type mismatch / 请求体无效或类型不匹配"},
+                        "404": {"description": "Workload not found / 工作负载未找到"},
+                        "500": {"description": "Execution error / 执行错误"}
+                    }
+                }
+            },
+            "/functions/execute": {
+                "post": {
+                    "tags": ["Functions"],
+                    "deprecated": true,
+                    "summary": "Execute function (legacy) / 执行函数（旧接口）",
+                    "description": "Kept for compatibility; prefer POST /v1/exec / 为兼容保留；建议使用 POST /v1/exec",
+                    "requestBody": {
+                        "required": true,
+                        "content": {
+                            "application/json": {
+                                "schema": {
+                                    "type": "object",
+                                    "required": ["task_id"],
+                                    "properties": {
+                                        "task_id": {"type": "string"},
+                                        "function_name": {"type": "string"},
+                                        "mode": {"type": "string", "enum": ["sync", "async"]},
+                                        "timeout_ms": {"type": "integer"},
+                                        "input_base64": {"type": "string"},
+                                        "input_content_type": {"type": "string"}
+                                    }
+                                }
+                            }
+                        }
+                    },
+                    "responses": {
+                        "200": {"description": "Execution result / 执行结果"},
+                        "400": {"description": "Invalid request / 无效请求"},
+                        "500": {"description": "Execution error / 执行错误"}
+                    }
+                }
+            },
             "/functions/invoke": {
                 "post": {
                     "tags": ["Functions"],
@@ -10,6 +10,7 @@ use tonic::transport::Channel;
 use crate::config::base::ServerConfig;
 use crate::spearlet::config::{HttpConfig, SpearletConfig, StorageConfig};
 use crate::spearlet::function_service::FunctionServiceImpl;
+use crate::spearlet::grpc_auth::{LocalChannel, LocalCredential};
 use crate::spearlet::grpc_server::HealthService;
 use crate::spearlet::http_gateway::HttpGateway;
 use crate::spearlet::object_service::ObjectServiceImpl;
@@ -24,6 +25,13 @@ fn create_test_config() -> SpearletConfig {
             },
             cors_enabled: true,
             swagger_enabled: true,
+            auth: Default::default(),
+            max_body_bytes: 16 * 1024 * 1024,
+            ws: Default::default(),
+            rate_limit: Default::default(),
+            cors: Default::default(),
+            error_format: "json".to_string(),
+            listeners: Default::default(),
         },
         grpc: ServerConfig {
             addr: "127.0.0.1:0".parse().unwrap(),
@@ -43,13 +51,15 @@ fn create_test_config() -> SpearletConfig {
 fn create_dummy_grpc_clients(
     addr: std::net::SocketAddr,
 ) -> (
-    crate::proto::spearlet::object_service_client::ObjectServiceClient<Channel>,
-    crate::proto::spearlet::invocation_service_client::InvocationServiceClient<Channel>,
-    crate::proto::spearlet::execution_service_client::ExecutionServiceClient<Channel>,
+    crate::proto::spearlet::object_service_client::ObjectServiceClient<LocalChannel>,
+    crate::proto::spearlet::invocation_service_client::InvocationServiceClient<LocalChannel>,
+    crate::proto::spearlet::execution_service_client::ExecutionServiceClient<LocalChannel>,
 ) {
-    let channel = Channel::from_shared(format!("http://{}", addr))
-        .unwrap()
-        .connect_lazy();
+    let channel = LocalCredential::default().channel(
+        Channel::from_shared(format!("http://{}", addr))
+            .unwrap()
+            .connect_lazy(),
+    );
     (
         crate::proto::spearlet::object_service_client::ObjectServiceClient::new(channel.clone()),
         crate::proto::spearlet::invocation_service_client::InvocationServiceClient::new(
@@ -478,7 +488,8 @@ mod new_endpoints_tests {
             .ensure_task_with_id("task-1".to_string(), &artifact, task_spec)
             .unwrap();
 
-        let channel = Endpoint::from_static("http://127.0.0.1:50051").connect_lazy();
+        let channel = LocalCredential::default()
+            .channel(Endpoint::from_static("http://127.0.0.1:50051").connect_lazy());
         let state = crate::spearlet::http_gateway::new_app_state(
             crate::proto::spearlet::object_service_client::ObjectServiceClient::new(
                 channel.clone(),
@@ -504,6 +515,12 @@ mod new_endpoints_tests {
             request: TonicRequest<InvokeRequest>,
         ) -> Result<TonicResponse<InvokeResponse>, Status> {
             let req = request.into_inner();
+            let debug_trace = match req.metadata.get("spear.debug").map(String::as_str) {
+                Some("trace") => {
+                    r#"{"events":[{"seq":1,"at_ms":0,"kind":"hostcall","name":"log"}]}"#
+                }
+                _ => "",
+            };
             Ok(TonicResponse::new(InvokeResponse {
                 invocation_id: if req.invocation_id.is_empty() {
                     "inv-1".to_string()
@@ -524,6 +541,7 @@ mod new_endpoints_tests {
                 error: None,
                 started_at: None,
                 completed_at: None,
+                debug_trace: debug_trace.to_string(),
             }))
         }
     }
@@ -556,6 +574,7 @@ mod new_endpoints_tests {
                 error: None,
                 started_at: None,
                 completed_at: None,
+                debug_trace: String::new(),
             }))
         }
 
@@ -583,7 +602,11 @@ mod new_endpoints_tests {
     }
 
     pub(super) async fn create_router_with_fake_grpc() -> Router {
-        let config = Arc::new(create_test_config());
+        create_router_with_fake_grpc_and_config(create_test_config()).await
+    }
+
+    async fn create_router_with_fake_grpc_and_config(config: SpearletConfig) -> Router {
+        let config = Arc::new(config);
         let object_service = Arc::new(ObjectServiceImpl::new_with_memory(1024 * 1024));
         let function_service = Arc::new(
             FunctionServiceImpl::new(config.clone(), None)
@@ -603,11 +626,13 @@ mod new_endpoints_tests {
                 .unwrap();
         });
 
-        let channel = Endpoint::from_shared(format!("http://{}", addr))
-            .unwrap()
-            .connect()
-            .await
-            .unwrap();
+        let channel = LocalCredential::default().channel(
+            Endpoint::from_shared(format!("http://{}", addr))
+                .unwrap()
+                .connect()
+                .await
+                .unwrap(),
+        );
 
         let state = crate::spearlet::http_gateway::new_app_state(
             crate::proto::spearlet::object_service_client::ObjectServiceClient::new(
@@ -650,6 +675,64 @@ mod new_endpoints_tests {
         );
     }
 
+    #[tokio::test]
+    async fn test_rate_limit_returns_429_with_retry_after() {
+        let mut config = create_test_config();
+        config.http.rate_limit.enabled = true;
+        config.http.rate_limit.requests_per_second = 0.1;
+        config.http.rate_limit.burst = 2;
+        let router = create_router_with_fake_grpc_and_config(config).await;
+
+        let get = |uri: &str, key: &str| {
+            Request::builder()
+                .method(Method::GET)
+                .uri(uri)
+                .header("x-api-key", key)
+                .body(Body::empty())
+                .unwrap()
+        };
+        for _ in 0..2 {
+            let response = router.clone().oneshot(get("/tasks", "a")).await.unwrap();
+            assert_ne!(response.status(), StatusCode::TOO_MANY_REQUESTS);
+        }
+        let response = router.clone().oneshot(get("/tasks", "a")).await.unwrap();
+        assert_eq!(response.status(), StatusCode::TOO_MANY_REQUESTS);
+        assert_eq!(response.headers()["retry-after"], "10");
+
+        // Other clients and exempt paths are unaffected / 其他客户端与豁免路径不受影响
+        let response = router.clone().oneshot(get("/tasks", "b")).await.unwrap();
+        assert_ne!(response.status(), StatusCode::TOO_MANY_REQUESTS);
+        let response = router.clone().oneshot(get("/health", "a")).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+    }
+
+    #[tokio::test]
+    async fn test_about_describes_node() {
+        let router = create_router_with_fake_grpc().await;
+
+        let request = Request::builder()
+            .method(Method::GET)
+            .uri("/about")
+            .body(Body::empty())
+            .unwrap();
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["service"], "spearlet");
+        assert_eq!(json["version"], crate::spearlet::build_info::version());
+        assert_eq!(json["stream_classes"][0]["class"], "rt-vision");
+        assert!(json["features"]["wasmedge"].is_boolean());
+        assert!(json["limits"]["max_concurrent_executions"].is_u64());
+        assert!(json["hostcalls"].is_array());
+        assert!(json["hostcall_middleware"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .any(|m| m == "policy"));
+    }
+
     #[tokio::test]
     async fn test_execute_function_endpoint_invalid_json() {
         let router = create_router_with_fake_grpc().await;
@@ -680,6 +763,251 @@ mod new_endpoints_tests {
         assert_eq!(response.status(), StatusCode::BAD_REQUEST);
     }
 
+    #[tokio::test]
+    async fn test_errors_use_json_envelope() {
+        let router = create_router_with_fake_grpc().await;
+
+        let post = |body: &'static str| {
+            Request::builder()
+                .method(Method::POST)
+                .uri("/functions/execute")
+                .header("Content-Type", "application/json")
+                .body(Body::from(body))
+                .unwrap()
+        };
+        let response = router
+            .clone()
+            .oneshot(post(r#"{"mode":"sync"}"#))
+            .await
+            .unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["success"], false);
+        assert_eq!(json["error"]["code"], "INVALID_ARGUMENT");
+        assert_eq!(json["error"]["message"], "task_id is required");
+
+        // Extractor rejections are wrapped too / 提取器的拒绝同样被包装
+        let response = router.clone().oneshot(post("invalid json")).await.unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["error"]["code"], "BAD_REQUEST");
+        assert!(!json["error"]["message"].as_str().unwrap().is_empty());
+
+        let request = Request::builder()
+            .method(Method::GET)
+            .uri("/functions/executions/missing")
+            .body(Body::empty())
+            .unwrap();
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::NOT_FOUND);
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["error"]["code"], "NOT_FOUND");
+    }
+
+    #[tokio::test]
+    async fn test_text_error_format_keeps_plain_messages() {
+        let mut config = create_test_config();
+        config.http.error_format = "text".to_string();
+        let router = create_router_with_fake_grpc_and_config(config).await;
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/functions/execute")
+            .header("Content-Type", "application/json")
+            .body(Body::from(r#"{"mode":"sync"}"#))
+            .unwrap();
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        assert_eq!(&body[..], b"task_id is required");
+    }
+
+    #[tokio::test]
+    async fn test_v1_exec_endpoint_success() {
+        let router = create_router_with_fake_grpc().await;
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/exec")
+            .header("Content-Type", "application/json")
+            .body(Body::from(
+                r#"{"workload":"task-1","method":"main","payload":{"q":"hi"}}"#,
+            ))
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert!(json["success"].as_bool().unwrap());
+        assert_eq!(json["status"], "COMPLETED");
+        assert_eq!(json["output"], "ok");
+        assert!(json["stream_url"].is_null());
+        assert!(json.get("debug_trace").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_v1_exec_endpoint_returns_debug_trace() {
+        let router = create_router_with_fake_grpc().await;
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/exec")
+            .header("Content-Type", "application/json")
+            .header("Spear-Debug", "trace")
+            .body(Body::from(r#"{"workload":"task-1"}"#))
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["debug_trace"]["events"][0]["kind"], "hostcall");
+        assert_eq!(json["debug_trace"]["events"][0]["name"], "log");
+    }
+
+    #[tokio::test]
+    async fn test_v1_exec_endpoint_accepts_gzip_body() {
+        use std::io::Write;
+
+        let router = create_router_with_fake_grpc().await;
+        let mut enc = flate2::write::GzEncoder::new(Vec::new(), flate2::Compression::default());
+        enc.write_all(br#"{"workload":"task-1","payload":{"q":"hi"}}"#)
+            .unwrap();
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/exec")
+            .header("Content-Type", "application/json")
+            .header("Content-Encoding", "gzip")
+            .body(Body::from(enc.finish().unwrap()))
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+    }
+
+    #[tokio::test]
+    async fn test_v1_exec_endpoint_rejects_oversized_body() {
+        let router = create_router_with_fake_grpc().await;
+        let payload = "x".repeat(16 * 1024 * 1024);
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/exec")
+            .header("Content-Type", "application/json")
+            .body(Body::from(format!(
+                r#"{{"workload":"task-1","payload":"{}"}}"#,
+                payload
+            )))
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::PAYLOAD_TOO_LARGE);
+    }
+
+    #[tokio::test]
+    async fn test_v1_exec_endpoint_rejects_unknown_fields() {
+        let router = create_router_with_fake_grpc().await;
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/exec")
+            .header("Content-Type", "application/json")
+            .body(Body::from(r#"{"workload":"task-1","task_id":"x"}"#))
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    }
+
+    #[tokio::test]
+    async fn test_v1_exec_endpoint_type_mismatch() {
+        let router = create_router_for_task_monitoring().await;
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/exec")
+            .header("Content-Type", "application/json")
+            .body(Body::from(r#"{"workload":"fn1","type":"wasm"}"#))
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["error"]["code"], "TYPE_MISMATCH");
+    }
+
+    #[tokio::test]
+    async fn test_v1_exec_endpoint_sse() {
+        let router = create_router_with_fake_grpc().await;
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/exec")
+            .header("Content-Type", "application/json")
+            .header("Accept", "text/event-stream")
+            .body(Body::from(r#"{"workload":"task-1","payload":"hi"}"#))
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        assert!(response.headers()["content-type"]
+            .to_str()
+            .unwrap()
+            .starts_with("text/event-stream"));
+        assert!(response.headers().contains_key("x-spear-execution-id"));
+
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let text = String::from_utf8(body.to_vec()).unwrap();
+        assert!(text.contains("event: done"));
+        assert!(text.contains(r#""status":"COMPLETED""#));
+    }
+
+    #[tokio::test]
+    async fn test_v1_exec_endpoint_rejects_unknown_stream_mode() {
+        let router = create_router_with_fake_grpc().await;
+
+        let request = Request::builder()
+            .method(Method::POST)
+            .uri("/v1/exec")
+            .header("Content-Type", "application/json")
+            .body(Body::from(
+                r#"{"workload":"task-1","stream":{"mode":"grpc"}}"#,
+            ))
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+    }
+
+    #[tokio::test]
+    async fn test_openapi_json_documents_v1_exec() {
+        let router = create_router_with_fake_grpc().await;
+
+        let request = Request::builder()
+            .method(Method::GET)
+            .uri("/openapi.json")
+            .body(Body::empty())
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert!(json["paths"]["/v1/exec"]["post"].is_object());
+        assert_eq!(
+            json["paths"]["/functions/execute"]["post"]["deprecated"],
+            true
+        );
+    }
+
     #[tokio::test]
     async fn test_get_execution_status_endpoint_success() {
         let router = create_router_with_fake_grpc().await;
@@ -791,6 +1119,27 @@ mod new_endpoints_tests {
         let json: Value = serde_json::from_slice(&body).unwrap();
         assert_eq!(json["task_id"], "task-1");
         assert!(json["executions"].as_array().unwrap().is_empty());
+        assert!(json["boot_id"].is_string());
+    }
+
+    #[tokio::test]
+    async fn test_readyz_reports_clock_health() {
+        let router = create_router_for_task_monitoring().await;
+
+        let request = Request::builder()
+            .method(Method::GET)
+            .uri("/readyz")
+            .body(Body::empty())
+            .unwrap();
+
+        let response = router.clone().oneshot(request).await.unwrap();
+        assert_eq!(response.status(), StatusCode::OK);
+
+        let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+        let json: Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(json["ready"], true);
+        assert!(json["checks"]["clock"]["status"].is_string());
+        assert!(json["checks"]["clock"]["mono_ms"].is_u64());
     }
 
     #[tokio::test]
@@ -829,6 +1178,7 @@ mod new_endpoints_tests {
         let json: Value = serde_json::from_slice(&body).unwrap();
         assert!(json["timestamp"].is_string());
         assert_eq!(json["details"]["task_count"], 1);
+        assert!(json["details"]["workers"].is_array());
     }
 }
 
@@ -893,6 +1243,13 @@ mod integration_tests {
                     },
                     cors_enabled: true,
                     swagger_enabled: true,
+                    auth: Default::default(),
+                    max_body_bytes: 16 * 1024 * 1024,
+                    ws: Default::default(),
+                    rate_limit: Default::default(),
+                    cors: Default::default(),
+                    error_format: "json".to_string(),
+                    listeners: Default::default(),
                 },
                 grpc: ServerConfig {
                     addr: "127.0.0.1:9090".parse().unwrap(),
@@ -915,6 +1272,13 @@ mod integration_tests {
                     },
                     cors_enabled: false,
                     swagger_enabled: false,
+                    auth: Default::default(),
+                    max_body_bytes: 16 * 1024 * 1024,
+                    ws: Default::default(),
+                    rate_limit: Default::default(),
+                    cors: Default::default(),
+                    error_format: "json".to_string(),
+                    listeners: Default::default(),
                 },
                 grpc: ServerConfig {
                     addr: "0.0.0.0:3001".parse().unwrap(),
@@ -979,6 +1343,7 @@ mod integration_tests {
                 global_environment: HashMap::new(),
                 spearlet_config: None,
                 resource_pool: crate::spearlet::execution::runtime::ResourcePoolConfig::default(),
+                node: Default::default(),
             },
         );
 
@@ -1028,4 +1393,151 @@ mod integration_tests {
 
         crate::spearlet::execution::host_api::set_current_wasm_execution_id(None);
     }
+
+    #[tokio::test]
+    async fn test_user_stream_ws_resume_replays_unacked_frames() {
+        use tokio_tungstenite::tungstenite::Message as WsMessage;
+
+        let router = super::new_endpoints_tests::create_router_with_fake_grpc().await;
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(listener, router).await.unwrap();
+        });
+
+        let exec_id = "exec-ws-resume";
+        let url = format!("ws://{}/api/v1/executions/{}/streams/ws", addr, exec_id);
+        let (mut ws, resp) = tokio_tungstenite::connect_async(url.clone()).await.unwrap();
+        let token = resp
+            .headers()
+            .get(crate::spearlet::stream_resume::TOKEN_HEADER)
+            .unwrap()
+            .to_str()
+            .unwrap()
+            .to_string();
+
+        let api = crate::spearlet::execution::host_api::DefaultHostApi::new(
+            crate::spearlet::execution::runtime::RuntimeConfig {
+                runtime_type: crate::spearlet::execution::runtime::RuntimeType::Wasm,
+                settings: HashMap::new(),
+                global_environment: HashMap::new(),
+                spearlet_config: None,
+                resource_pool: crate::spearlet::execution::runtime::ResourcePoolConfig::default(),
+                node: Default::default(),
+            },
+        );
+        crate::spearlet::execution::host_api::set_current_wasm_execution_id(Some(
+            exec_id.to_string(),
+        ));
+        let frame = |data: &[u8]| {
+            crate::spearlet::execution::host_api::ssf::build_ssf_v1_frame(1, 2, b"{}", data)
+        };
+
+        // The first inbound frame connects the stream / 第一个入站帧使流进入已连接状态
+        ws.send(WsMessage::Binary(frame(b"hi"))).await.unwrap();
+        let out_fd = api.user_stream_open(1, 2);
+        for _ in 0..50 {
+            if api.user_stream_write(out_fd, &frame(b"one")) == 0 {
+                break;
+            }
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+        }
+        let msg = ws.next().await.unwrap().unwrap();
+        assert_eq!(msg, WsMessage::Binary(frame(b"one")));
+
+        // Drop without acking; the guest keeps writing / 未确认即断开；guest 继续写入
+        drop(ws);
+        tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+        assert_eq!(api.user_stream_write(out_fd, &frame(b"two")), 0);
+
+        let bad = format!("{}?resume_token=nope", url);
+        assert!(tokio_tungstenite::connect_async(bad).await.is_err());
+
+        let resume = format!("{}?resume_token={}&last_seq=0", url, token);
+        let (mut ws, _) = tokio_tungstenite::connect_async(resume).await.unwrap();
+        let msg = ws.next().await.unwrap().unwrap();
+        assert_eq!(msg, WsMessage::Binary(frame(b"one")));
+        let msg = ws.next().await.unwrap().unwrap();
+        assert_eq!(msg, WsMessage::Binary(frame(b"two")));
+        ws.send(WsMessage::Text(r#"{"type":"ack","seq":2}"#.into()))
+            .await
+            .unwrap();
+
+        ws.close(None).await.unwrap();
+        crate::spearlet::execution::host_api::set_current_wasm_execution_id(None);
+    }
+
+    #[tokio::test]
+    async fn test_user_stream_ws_ack_reaches_guest() {
+        use crate::spearlet::execution::host_api::ssf;
+        use tokio_tungstenite::tungstenite::Message as WsMessage;
+
+        let router = super::new_endpoints_tests::create_router_with_fake_grpc().await;
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(listener, router).await.unwrap();
+        });
+
+        let exec_id = "exec-ws-ack";
+        let url = format!(
+            "ws://{}/api/v1/executions/{}/streams/ws?ack=true",
+            addr, exec_id
+        );
+        let (mut ws, _) = tokio_tungstenite::connect_async(url).await.unwrap();
+
+        let api = crate::spearlet::execution::host_api::DefaultHostApi::new(
+            crate::spearlet::execution::runtime::RuntimeConfig {
+                runtime_type: crate::spearlet::execution::runtime::RuntimeType::Wasm,
+                settings: HashMap::new(),
+                global_environment: HashMap::new(),
+                spearlet_config: None,
+                resource_pool: crate::spearlet::execution::runtime::ResourcePoolConfig::default(),
+                node: Default::default(),
+            },
+        );
+        crate::spearlet::execution::host_api::set_current_wasm_execution_id(Some(
+            exec_id.to_string(),
+        ));
+        let in_fd = api.user_stream_open(1, 1);
+        let out_fd = api.user_stream_open(1, 2);
+
+        ws.send(WsMessage::Binary(ssf::build_ssf_v1_frame(1, 2, b"", b"hi")))
+            .await
+            .unwrap();
+        let mut outbound = ssf::build_ssf_v1_frame(1, 2, b"", b"world");
+        outbound[10..12].copy_from_slice(&ssf::SSF_FLAG_ACK_REQUESTED.to_le_bytes());
+        outbound[16..24].copy_from_slice(&7u64.to_le_bytes());
+        for _ in 0..50 {
+            if api.user_stream_write(out_fd, &outbound) == 0 {
+                break;
+            }
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+        }
+        let msg = ws.next().await.unwrap().unwrap();
+        assert_eq!(msg, WsMessage::Binary(outbound));
+        ws.send(WsMessage::Text(r#"{"type":"ack","seq":1}"#.into()))
+            .await
+            .unwrap();
+
+        let mut ack = None;
+        for _ in 0..50 {
+            match api.user_stream_read(in_fd) {
+                Ok(f) if ssf::parse_ssf_v1_header(&f).unwrap().1 == ssf::SSF_MSG_TYPE_ACK => {
+                    ack = Some(f);
+                    break;
+                }
+                Ok(_) => {}
+                Err(_) => tokio::time::sleep(std::time::Duration::from_millis(10)).await,
+            }
+        }
+        let ack = ack.expect("guest got no ACK");
+        let (stream_id, _, meta, _) = ssf::split_ssf_v1_frame(&ack).unwrap();
+        assert_eq!(stream_id, 1);
+        let meta: Value = serde_json::from_slice(meta).unwrap();
+        assert_eq!(meta["ack_seq"], 7);
+
+        ws.close(None).await.unwrap();
+        crate::spearlet::execution::host_api::set_current_wasm_execution_id(None);
+    }
 }
@@ -0,0 +1,267 @@
+//! Listener manager of the spearlet HTTP gateway
+//! spearlet HTTP 网关的监听器管理
+//!
+//! Routes are split into groups. Data routes are always served on `http.server`; admin,
+//! metrics and provider routes move to their own listener when one is configured under
+//! `http.listeners`. Each listener has its own bind address and TLS settings, and
+//! chooses whether authentication and rate limiting apply. Health probes are answered on
+//! every listener.
+//! 路由被划分为若干组。数据路由始终在 `http.server` 上提供；在 `http.listeners` 下配置了监听器
+//! 时，管理、指标与提供方路由会移到各自的监听器上。每个监听器拥有独立的绑定地址与 TLS 设置，
+//! 并可选择是否应用认证与限流。所有监听器都会应答健康探针。
+
+use axum::Router;
+use tokio::task::JoinSet;
+use tokio_util::sync::CancellationToken;
+use tracing::info;
+
+use crate::config::base::ServerConfig;
+use crate::spearlet::config::{HttpConfig, HttpListenerConfig, SpearletConfig};
+use crate::spearlet::ip_allowlist::IpAllowlist;
+use crate::spearlet::tls;
+
+type BoxError = Box<dyn std::error::Error + Send + Sync>;
+
+/// Route groups of the gateway / 网关的路由组
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum RouteGroup {
+    /// Objects, executions, tasks, streams, cameras and API docs
+    /// 对象、执行、任务、流、摄像头与 API 文档
+    Data,
+    /// `/admin/*`
+    Admin,
+    /// `/monitoring/*`
+    Metrics,
+    /// Callbacks of external providers such as Twilio / Twilio 等外部提供方的回调
+    Provider,
+}
+
+impl RouteGroup {
+    pub const ALL: [RouteGroup; 4] = [
+        RouteGroup::Data,
+        RouteGroup::Admin,
+        RouteGroup::Metrics,
+        RouteGroup::Provider,
+    ];
+}
+
+/// What one listener serves and which middlewares it runs / 单个监听器提供的路由及其中间件
+#[derive(Debug, Clone)]
+pub struct ListenerPlan {
+    /// Also names the TLS acceptor in logs / 同时用作日志中 TLS 接收器的名称
+    pub name: &'static str,
+    pub server: ServerConfig,
+    pub groups: Vec<RouteGroup>,
+    pub auth: bool,
+    pub rate_limit: bool,
+    /// Browser clients only talk to the data listener / 浏览器客户端只访问数据监听器
+    pub cors: bool,
+}
+
+impl ListenerPlan {
+    /// Every group behind every middleware, as on a single port / 所有路由组与中间件，等同于单端口
+    pub fn single(http: &HttpConfig) -> Self {
+        Self {
+            name: "http",
+            server: http.server.clone(),
+            groups: RouteGroup::ALL.to_vec(),
+            auth: true,
+            rate_limit: true,
+            cors: true,
+        }
+    }
+
+    pub fn serves(&self, group: RouteGroup) -> bool {
+        self.groups.contains(&group)
+    }
+}
+
+/// Split the route groups over `http.server` and `http.listeners`
+/// 将路由组分配到 `http.server` 与 `http.listeners`
+pub fn plan(http: &HttpConfig) -> Vec<ListenerPlan> {
+    let mut main = ListenerPlan::single(http);
+    let mut out = Vec::new();
+    let extra: [(&'static str, RouteGroup, &Option<HttpListenerConfig>); 3] = [
+        ("http.admin", RouteGroup::Admin, &http.listeners.admin),
+        ("http.metrics", RouteGroup::Metrics, &http.listeners.metrics),
+        (
+            "http.provider",
+            RouteGroup::Provider,
+            &http.listeners.provider,
+        ),
+    ];
+    for (name, group, cfg) in extra {
+        let Some(cfg) = cfg else { continue };
+        main.groups.retain(|g| *g != group);
+        out.push(ListenerPlan {
+            name,
+            server: cfg.server.clone(),
+            groups: vec![group],
+            auth: cfg.auth,
+            rate_limit: cfg.rate_limit,
+            cors: false,
+        });
+    }
+    out.insert(0, main);
+    out
+}
+
+struct BoundListener {
+    name: &'static str,
+    listener: tls::Listener,
+    app: Router,
+}
+
+/// Binds the planned listeners and serves them until shutdown
+/// 绑定规划的监听器并持续提供服务直到关闭
+#[derive(Default)]
+pub struct ListenerManager {
+    listeners: Vec<BoundListener>,
+}
+
+impl ListenerManager {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Bind a listener for `app`, with TLS when `server.enable_tls`
+    /// 为 `app` 绑定监听器，`server.enable_tls` 时启用 TLS
+    pub async fn bind(
+        &mut self,
+        plan: &ListenerPlan,
+        config: &SpearletConfig,
+        mut app: Router,
+    ) -> Result<(), BoxError> {
+        let tls_acceptor = if plan.server.enable_tls {
+            let acceptor = tls::TlsAcceptor::load(
+                plan.name,
+                plan.server.cert_path.as_deref(),
+                plan.server.key_path.as_deref(),
+                &config.tls,
+                tls::ALPN_HTTP,
+            )?;
+            acceptor.watch();
+            // The subject header is only trusted from a proxy when TLS ends there
+            // 仅当 TLS 在代理处终止时才信任来自代理的主体请求头
+            if let Some(mtls) = config.http.auth.mtls.as_ref() {
+                app = app.layer(axum::middleware::from_fn_with_state(
+                    std::sync::Arc::new(mtls.subject_header.clone()),
+                    tls::peer_identity_middleware,
+                ));
+            }
+            Some(acceptor)
+        } else {
+            // Without TLS only a trusted proxy may vouch for a client certificate
+            // 没有 TLS 时只有受信任的代理可以为客户端证书作证
+            if let Some(mtls) = config.http.auth.mtls.as_ref() {
+                let proxies = IpAllowlist::parse_lossy(&mtls.trusted_proxies);
+                app = app.layer(axum::middleware::from_fn_with_state(
+                    std::sync::Arc::new((mtls.subject_header.clone(), proxies)),
+                    tls::forwarded_identity_middleware,
+                ));
+            }
+            None
+        };
+        let scheme = if tls_acceptor.is_some() {
+            "https"
+        } else {
+            "http"
+        };
+        let addr = plan.server.addr;
+        let listener = tls::Listener::bind(addr, tls_acceptor)
+            .await
+            .map_err(|e| format!("{}: bind {}: {}", plan.name, addr, e))?;
+        info!(
+            listener = plan.name,
+            groups = ?plan.groups,
+            "HTTP listener on {}://{}",
+            scheme,
+            addr
+        );
+        self.listeners.push(BoundListener {
+            name: plan.name,
+            listener,
+            app,
+        });
+        Ok(())
+    }
+
+    /// Serve all listeners; the first one to fail stops the others
+    /// 提供所有监听器的服务；任一监听器失败时停止其余监听器
+    pub async fn serve<F>(self, shutdown: F) -> Result<(), BoxError>
+    where
+        F: std::future::Future<Output = ()> + Send + 'static,
+    {
+        let cancel = CancellationToken::new();
+        let mut set = JoinSet::new();
+        for l in self.listeners {
+            let stop = cancel.clone();
+            set.spawn(async move {
+                axum::serve(
+                    l.listener,
+                    l.app
+                        .layer(axum::middleware::from_fn(tls::peer_addr_middleware))
+                        .into_make_service_with_connect_info::<tls::PeerInfo>(),
+                )
+                .with_graceful_shutdown(async move { stop.cancelled().await })
+                .await
+                .map_err(|e| format!("{}: {}", l.name, e))
+            });
+        }
+        let on_shutdown = cancel.clone();
+        let signal = tokio::spawn(async move {
+            shutdown.await;
+            on_shutdown.cancel();
+        });
+
+        let mut result: Result<(), BoxError> = Ok(());
+        while let Some(joined) = set.join_next().await {
+            let failed = match joined {
+                Ok(Ok(())) => None,
+                Ok(Err(e)) => Some(e),
+                Err(e) => Some(e.to_string()),
+            };
+            if let Some(e) = failed {
+                cancel.cancel();
+                if result.is_ok() {
+                    result = Err(e.into());
+                }
+            }
+        }
+        signal.abort();
+        result
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_plan_moves_groups_to_their_listeners() {
+        let mut http = HttpConfig::default();
+        assert_eq!(plan(&http).len(), 1);
+        assert_eq!(plan(&http)[0].groups, RouteGroup::ALL.to_vec());
+
+        http.listeners.admin = Some(HttpListenerConfig {
+            server: ServerConfig {
+                addr: "127.0.0.1:9101".parse().unwrap(),
+                ..Default::default()
+            },
+            auth: true,
+            rate_limit: false,
+        });
+        http.listeners.metrics = Some(HttpListenerConfig::default());
+        let plans = plan(&http);
+        assert_eq!(plans.len(), 3);
+        assert_eq!(
+            plans[0].groups,
+            vec![RouteGroup::Data, RouteGroup::Provider]
+        );
+        assert!(plans[0].cors);
+        assert_eq!(plans[1].name, "http.admin");
+        assert_eq!(plans[1].groups, vec![RouteGroup::Admin]);
+        assert!(!plans[1].rate_limit && !plans[1].cors);
+        assert!(plans[2].serves(RouteGroup::Metrics));
+    }
+}
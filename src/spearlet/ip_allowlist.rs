@@ -0,0 +1,186 @@
+//! IP address allowlists
+//! IP 地址允许列表
+//!
+//! Entries are single addresses (`10.0.0.5`, `::1`) or CIDR ranges (`10.0.0.0/8`,
+//! `fd00::/8`). Used to decide which peers may set forwarding headers, and which
+//! outbound destinations are internal.
+//! 条目为单个地址（`10.0.0.5`、`::1`）或 CIDR 网段（`10.0.0.0/8`、`fd00::/8`）。
+//! 用于判断哪些对端可以设置转发请求头，以及哪些出站目标属于内部地址。
+
+use std::net::IpAddr;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+struct IpRange {
+    addr: IpAddr,
+    prefix: u8,
+}
+
+impl IpRange {
+    fn parse(s: &str) -> Result<Self, String> {
+        let s = s.trim();
+        let (addr, prefix) = match s.split_once('/') {
+            Some((a, p)) => (a, Some(p)),
+            None => (s, None),
+        };
+        let addr: IpAddr = addr
+            .parse()
+            .map_err(|_| format!("invalid address {:?}", s))?;
+        let max = if addr.is_ipv4() { 32 } else { 128 };
+        let prefix = match prefix {
+            Some(p) => p
+                .parse::<u8>()
+                .ok()
+                .filter(|p| *p <= max)
+                .ok_or_else(|| format!("invalid prefix length in {:?}", s))?,
+            None => max,
+        };
+        Ok(Self { addr, prefix })
+    }
+
+    fn contains(&self, ip: IpAddr) -> bool {
+        match (self.addr, canonical(ip)) {
+            (IpAddr::V4(net), IpAddr::V4(ip)) => {
+                let mask = u32::MAX.checked_shl(32 - self.prefix as u32).unwrap_or(0);
+                u32::from(net) & mask == u32::from(ip) & mask
+            }
+            (IpAddr::V6(net), IpAddr::V6(ip)) => {
+                let mask = u128::MAX.checked_shl(128 - self.prefix as u32).unwrap_or(0);
+                u128::from(net) & mask == u128::from(ip) & mask
+            }
+            _ => false,
+        }
+    }
+}
+
+/// IPv4-mapped IPv6 addresses compare as IPv4 / IPv4 映射的 IPv6 地址按 IPv4 比较
+fn canonical(ip: IpAddr) -> IpAddr {
+    match ip {
+        IpAddr::V6(v6) => v6
+            .to_ipv4_mapped()
+            .map(IpAddr::V4)
+            .unwrap_or(IpAddr::V6(v6)),
+        v4 => v4,
+    }
+}
+
+/// Addresses and CIDR ranges; empty matches nothing / 地址与 CIDR 网段；为空时不匹配任何地址
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct IpAllowlist {
+    ranges: Vec<IpRange>,
+}
+
+impl IpAllowlist {
+    /// Parse every entry, failing on the first invalid one / 解析全部条目，遇到第一个无效条目即失败
+    pub fn parse(entries: &[String]) -> Result<Self, String> {
+        let ranges = entries
+            .iter()
+            .filter(|e| !e.trim().is_empty())
+            .map(|e| IpRange::parse(e))
+            .collect::<Result<Vec<_>, _>>()?;
+        Ok(Self { ranges })
+    }
+
+    /// Parse, skipping invalid entries (reported by `config validate`)
+    /// 解析并跳过无效条目（由 `config validate` 报告）
+    pub fn parse_lossy(entries: &[String]) -> Self {
+        Self {
+            ranges: entries
+                .iter()
+                .filter_map(|e| IpRange::parse(e).ok())
+                .collect(),
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.ranges.is_empty()
+    }
+
+    pub fn contains(&self, ip: IpAddr) -> bool {
+        self.ranges.iter().any(|r| r.contains(ip))
+    }
+}
+
+/// Ranges that are not reachable on the public internet: loopback, private, shared,
+/// link-local (cloud metadata), multicast and reserved
+/// 公网不可达的网段：回环、私有、共享、链路本地（云元数据）、组播与保留地址
+const NON_PUBLIC: &[&str] = &[
+    "0.0.0.0/8",
+    "10.0.0.0/8",
+    "100.64.0.0/10",
+    "127.0.0.0/8",
+    "169.254.0.0/16",
+    "172.16.0.0/12",
+    "192.0.0.0/24",
+    "192.168.0.0/16",
+    "198.18.0.0/15",
+    "224.0.0.0/4",
+    "240.0.0.0/4",
+    "::/128",
+    "::1/128",
+    "64:ff9b::/96",
+    "fc00::/7",
+    "fe80::/10",
+    "fec0::/10",
+    "ff00::/8",
+];
+
+/// Whether an address is routable on the public internet / 地址是否可在公网路由
+pub fn is_public(ip: IpAddr) -> bool {
+    !NON_PUBLIC
+        .iter()
+        .filter_map(|r| IpRange::parse(r).ok())
+        .any(|r| r.contains(ip))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_allowlist_matches_addresses_and_ranges() {
+        let l = IpAllowlist::parse(&[
+            "10.0.0.0/8".to_string(),
+            "192.168.1.7".to_string(),
+            "fd00::/8".to_string(),
+        ])
+        .unwrap();
+        assert!(l.contains("10.20.30.40".parse().unwrap()));
+        assert!(l.contains("::ffff:10.1.1.1".parse().unwrap()));
+        assert!(l.contains("192.168.1.7".parse().unwrap()));
+        assert!(!l.contains("192.168.1.8".parse().unwrap()));
+        assert!(l.contains("fd12::1".parse().unwrap()));
+        assert!(!l.contains("fe80::1".parse().unwrap()));
+        assert!(IpAllowlist::default().is_empty());
+        assert!(!IpAllowlist::default().contains("127.0.0.1".parse().unwrap()));
+
+        assert!(IpAllowlist::parse(&["10.0.0.0/33".to_string()]).is_err());
+        assert!(IpAllowlist::parse(&["proxy.local".to_string()]).is_err());
+        assert_eq!(
+            IpAllowlist::parse_lossy(&["nope".to_string(), "0.0.0.0/0".to_string()])
+                .ranges
+                .len(),
+            1
+        );
+    }
+
+    #[test]
+    fn test_is_public() {
+        for ip in [
+            "127.0.0.1",
+            "10.1.2.3",
+            "172.20.0.1",
+            "192.168.0.10",
+            "169.254.169.254",
+            "100.64.0.1",
+            "0.0.0.0",
+            "::1",
+            "fd00::1",
+            "fe80::1",
+            "::ffff:169.254.169.254",
+        ] {
+            assert!(!is_public(ip.parse().unwrap()), "{}", ip);
+        }
+        assert!(is_public("93.184.216.34".parse().unwrap()));
+        assert!(is_public("2606:4700::1111".parse().unwrap()));
+    }
+}
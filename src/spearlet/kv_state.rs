@@ -0,0 +1,437 @@
+//! Persistent key-value state for tasks / 任务的持久化键值状态
+//!
+//! Backs the `kv_*` hostcalls, so a workload that is otherwise stateless can keep small
+//! amounts of agent state between invocations and across spearlet restarts. Each task gets
+//! its own namespace in a [`KvStore`] under the state directory (sled by default), with one
+//! store key per task key, so a change writes only that key. Keys may carry a TTL and are
+//! dropped once it passes.
+//! 为 `kv_*` hostcall 提供支持，使原本无状态的工作负载能在多次调用之间以及 spearlet 重启后保留少量
+//! 智能体状态。每个任务在状态目录下的 [`KvStore`]（默认为 sled）中拥有独立的命名空间，每个任务键对应
+//! 一个存储键，变更只写入该键。键可以带有 TTL，过期后被丢弃。
+
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+use base64::{engine::general_purpose, Engine as _};
+use parking_lot::{Mutex, RwLock};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::config::{KvStateConfig, SpearletConfig};
+use crate::spearlet::local_store::LocalStore;
+use crate::storage::kv::KvStore;
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum KvError {
+    #[error("kv state is disabled")]
+    Disabled,
+    #[error("invalid key or value: {0}")]
+    Invalid(String),
+    #[error("unknown key: {0}")]
+    NotFound(String),
+    #[error("namespace holds max_namespace_bytes already")]
+    Full,
+    #[error("state store error: {0}")]
+    Store(String),
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Entry {
+    /// Base64 of the value / 值的 base64
+    value: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    expires_at_ms: Option<i64>,
+}
+
+impl Entry {
+    fn live(&self, now_ms: i64) -> bool {
+        self.expires_at_ms.map_or(true, |t| t > now_ms)
+    }
+
+    /// Bytes counted against the namespace / 计入命名空间的字节数
+    fn size(key: &str, value_len: usize) -> usize {
+        key.len() + value_len
+    }
+
+    fn stored_size(&self, key: &str) -> usize {
+        Self::size(key, decoded_len(&self.value))
+    }
+}
+
+fn decoded_len(b64: &str) -> usize {
+    b64.len() / 4 * 3 - b64.chars().rev().take_while(|c| *c == '=').count()
+}
+
+/// Keys and bytes a namespace holds in the store / 命名空间在存储中的键数与字节数
+#[derive(Debug, Clone, Copy, Default)]
+struct Usage {
+    keys: usize,
+    bytes: usize,
+}
+
+impl Usage {
+    fn remove(&mut self, size: usize) {
+        self.keys = self.keys.saturating_sub(1);
+        self.bytes = self.bytes.saturating_sub(size);
+    }
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct KvStats {
+    pub enabled: bool,
+    pub backend: String,
+    pub dir: String,
+    /// Namespaces read since start / 启动以来读取过的命名空间数
+    pub namespaces: usize,
+    pub keys: usize,
+    pub bytes: usize,
+}
+
+/// State directory for a configuration / 配置对应的状态目录
+pub fn state_dir(config: &SpearletConfig) -> PathBuf {
+    if config.kv_state.dir.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("kv")
+    } else {
+        PathBuf::from(&config.kv_state.dir)
+    }
+}
+
+/// Store key prefix of a namespace / 命名空间的存储键前缀
+fn namespace_prefix(namespace: &str) -> String {
+    let digest = Sha256::digest(namespace.as_bytes());
+    let hex: String = digest[..16].iter().map(|b| format!("{:02x}", b)).collect();
+    format!("{}/", hex)
+}
+
+fn store_err(e: impl std::fmt::Display) -> KvError {
+    KvError::Store(e.to_string())
+}
+
+pub struct KvState {
+    config: RwLock<(KvStateConfig, PathBuf)>,
+    store: LocalStore,
+    /// Usage of the namespaces read since start / 启动以来读取过的命名空间的用量
+    usage: Mutex<HashMap<String, Usage>>,
+    /// Serializes calls so namespace limits and TTL sweeps hold
+    /// 串行化调用以保证命名空间上限与 TTL 清理
+    calls: tokio::sync::Mutex<()>,
+}
+
+impl KvState {
+    pub fn new(config: KvStateConfig, dir: PathBuf) -> Self {
+        Self {
+            config: RwLock::new((config, dir)),
+            store: LocalStore::new(),
+            usage: Mutex::new(HashMap::new()),
+            calls: tokio::sync::Mutex::new(()),
+        }
+    }
+
+    /// Apply a new configuration; state is kept in the store and read again on next use
+    /// 应用新配置；状态保留在存储中，下次使用时重新读取
+    pub fn set_config(&self, config: KvStateConfig, dir: PathBuf) {
+        *self.config.write() = (config, dir);
+        self.store.close();
+        self.usage.lock().clear();
+    }
+
+    async fn open(&self) -> Result<(KvStateConfig, Arc<dyn KvStore>), KvError> {
+        let (cfg, dir) = self.config.read().clone();
+        if !cfg.enabled {
+            return Err(KvError::Disabled);
+        }
+        let store = self
+            .store
+            .get(&cfg.backend, &dir)
+            .await
+            .map_err(KvError::Store)?;
+        Ok((cfg, store))
+    }
+
+    async fn read(store: &dyn KvStore, store_key: &str) -> Result<Option<Entry>, KvError> {
+        match store.get(&store_key.to_string()).await.map_err(store_err)? {
+            Some(bytes) => serde_json::from_slice(&bytes).map(Some).map_err(store_err),
+            None => Ok(None),
+        }
+    }
+
+    /// Entries of `namespace` whose keys start with `prefix`, deleting expired ones
+    /// `namespace` 中键以 `prefix` 开头的记录，同时删除已过期的记录
+    async fn scan(
+        &self,
+        store: &dyn KvStore,
+        namespace: &str,
+        prefix: &str,
+        now_ms: i64,
+    ) -> Result<Vec<(String, Entry)>, KvError> {
+        let ns_prefix = namespace_prefix(namespace);
+        let pairs = store
+            .scan_prefix(&format!("{}{}", ns_prefix, prefix))
+            .await
+            .map_err(store_err)?;
+        let mut live = Vec::new();
+        for pair in pairs {
+            let key = pair.key[ns_prefix.len()..].to_string();
+            let entry: Entry = serde_json::from_slice(&pair.value).map_err(store_err)?;
+            if entry.live(now_ms) {
+                live.push((key, entry));
+            } else {
+                self.remove(store, namespace, &key, &entry).await?;
+            }
+        }
+        live.sort_by(|a, b| a.0.cmp(&b.0));
+        Ok(live)
+    }
+
+    /// Delete a stored entry and take it off the namespace usage
+    /// 删除已存储的记录并从命名空间用量中扣除
+    async fn remove(
+        &self,
+        store: &dyn KvStore,
+        namespace: &str,
+        key: &str,
+        entry: &Entry,
+    ) -> Result<(), KvError> {
+        let store_key = format!("{}{}", namespace_prefix(namespace), key);
+        if store.delete(&store_key).await.map_err(store_err)? {
+            if let Some(u) = self.usage.lock().get_mut(namespace) {
+                u.remove(entry.stored_size(key));
+            }
+        }
+        Ok(())
+    }
+
+    /// Usage of `namespace`, counted from the store on first use
+    /// `namespace` 的用量，首次使用时从存储统计
+    async fn usage(
+        &self,
+        store: &dyn KvStore,
+        namespace: &str,
+        now_ms: i64,
+    ) -> Result<Usage, KvError> {
+        if let Some(u) = self.usage.lock().get(namespace) {
+            return Ok(*u);
+        }
+        let live = self.scan(store, namespace, "", now_ms).await?;
+        let usage = Usage {
+            keys: live.len(),
+            bytes: live.iter().map(|(k, e)| e.stored_size(k)).sum(),
+        };
+        self.usage.lock().insert(namespace.to_string(), usage);
+        Ok(usage)
+    }
+
+    fn check_key(cfg: &KvStateConfig, key: &str) -> Result<(), KvError> {
+        if key.is_empty() || key.len() > cfg.max_key_bytes {
+            return Err(KvError::Invalid(format!(
+                "keys must be 1 to {} bytes",
+                cfg.max_key_bytes
+            )));
+        }
+        Ok(())
+    }
+
+    pub async fn get(&self, namespace: &str, key: &str) -> Result<Vec<u8>, KvError> {
+        let (_, store) = self.open().await?;
+        let _call = self.calls.lock().await;
+        let now_ms = chrono::Utc::now().timestamp_millis();
+        let store_key = format!("{}{}", namespace_prefix(namespace), key);
+        let entry = match Self::read(store.as_ref(), &store_key).await? {
+            Some(e) if e.live(now_ms) => e,
+            Some(e) => {
+                self.remove(store.as_ref(), namespace, key, &e).await?;
+                return Err(KvError::NotFound(key.to_string()));
+            }
+            None => return Err(KvError::NotFound(key.to_string())),
+        };
+        general_purpose::STANDARD
+            .decode(&entry.value)
+            .map_err(store_err)
+    }
+
+    /// Set a key; `ttl_s` of 0 keeps it until deleted / 设置键；`ttl_s` 为 0 时保留至删除
+    pub async fn set(
+        &self,
+        namespace: &str,
+        key: &str,
+        value: &[u8],
+        ttl_s: u64,
+    ) -> Result<(), KvError> {
+        let (cfg, store) = self.open().await?;
+        Self::check_key(&cfg, key)?;
+        if value.len() > cfg.max_value_bytes {
+            return Err(KvError::Invalid(format!(
+                "values must be at most {} bytes",
+                cfg.max_value_bytes
+            )));
+        }
+        let _call = self.calls.lock().await;
+        let now_ms = chrono::Utc::now().timestamp_millis();
+        let mut usage = self.usage(store.as_ref(), namespace, now_ms).await?;
+        let store_key = format!("{}{}", namespace_prefix(namespace), key);
+        if let Some(old) = Self::read(store.as_ref(), &store_key).await? {
+            usage.remove(old.stored_size(key));
+        }
+        let size = Entry::size(key, value.len());
+        if usage.bytes + size > cfg.max_namespace_bytes {
+            return Err(KvError::Full);
+        }
+        let ttl_ms = i64::try_from(ttl_s.saturating_mul(1000)).unwrap_or(i64::MAX);
+        let entry = Entry {
+            value: general_purpose::STANDARD.encode(value),
+            expires_at_ms: (ttl_s > 0).then(|| now_ms.saturating_add(ttl_ms)),
+        };
+        let bytes = serde_json::to_vec(&entry).map_err(store_err)?;
+        store.put(&store_key, &bytes).await.map_err(store_err)?;
+        usage.keys += 1;
+        usage.bytes += size;
+        self.usage.lock().insert(namespace.to_string(), usage);
+        Ok(())
+    }
+
+    pub async fn delete(&self, namespace: &str, key: &str) -> Result<(), KvError> {
+        let (_, store) = self.open().await?;
+        let _call = self.calls.lock().await;
+        let now_ms = chrono::Utc::now().timestamp_millis();
+        let store_key = format!("{}{}", namespace_prefix(namespace), key);
+        match Self::read(store.as_ref(), &store_key).await? {
+            Some(e) => {
+                self.remove(store.as_ref(), namespace, key, &e).await?;
+                if e.live(now_ms) {
+                    return Ok(());
+                }
+                Err(KvError::NotFound(key.to_string()))
+            }
+            None => Err(KvError::NotFound(key.to_string())),
+        }
+    }
+
+    /// Keys starting with `prefix`, in order / 以 `prefix` 开头的键，按顺序排列
+    pub async fn list(&self, namespace: &str, prefix: &str) -> Result<Vec<String>, KvError> {
+        let (_, store) = self.open().await?;
+        let _call = self.calls.lock().await;
+        let now_ms = chrono::Utc::now().timestamp_millis();
+        let live = self.scan(store.as_ref(), namespace, prefix, now_ms).await?;
+        Ok(live.into_iter().map(|(k, _)| k).collect())
+    }
+
+    pub fn stats(&self) -> KvStats {
+        let (cfg, dir) = self.config.read().clone();
+        let usage = self.usage.lock();
+        KvStats {
+            enabled: cfg.enabled,
+            backend: cfg.backend,
+            dir: dir.display().to_string(),
+            namespaces: usage.len(),
+            keys: usage.values().map(|u| u.keys).sum(),
+            bytes: usage.values().map(|u| u.bytes).sum(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn state(dir: &Path, backend: &str) -> KvState {
+        KvState::new(
+            KvStateConfig {
+                enabled: true,
+                backend: backend.to_string(),
+                max_namespace_bytes: 64,
+                ..Default::default()
+            },
+            dir.to_path_buf(),
+        )
+    }
+
+    #[cfg(feature = "sled")]
+    #[tokio::test]
+    async fn test_set_get_persists() {
+        let dir = tempfile::tempdir().unwrap();
+        let s = state(dir.path(), "sled");
+        s.set("task-a", "session/1", b"{\"turns\":3}", 0)
+            .await
+            .unwrap();
+        s.set("task-a", "session/2", b"x", 0).await.unwrap();
+        s.set("task-a", "other", b"y", 0).await.unwrap();
+        assert_eq!(
+            s.get("task-a", "session/1").await.unwrap(),
+            b"{\"turns\":3}"
+        );
+        assert_eq!(
+            s.get("task-b", "session/1").await,
+            Err(KvError::NotFound("session/1".to_string()))
+        );
+        drop(s);
+
+        // A new instance reads the state back from the store / 新实例从存储读回状态
+        let s = state(dir.path(), "sled");
+        assert_eq!(
+            s.list("task-a", "session/").await.unwrap(),
+            vec!["session/1", "session/2"]
+        );
+        s.delete("task-a", "session/2").await.unwrap();
+        assert_eq!(
+            s.delete("task-a", "session/2").await,
+            Err(KvError::NotFound("session/2".to_string()))
+        );
+        assert_eq!(s.stats().keys, 2);
+    }
+
+    #[tokio::test]
+    async fn test_limits_and_ttl() {
+        let dir = tempfile::tempdir().unwrap();
+        let s = state(dir.path(), "memory");
+        assert!(matches!(
+            s.set("t", "", b"v", 0).await,
+            Err(KvError::Invalid(_))
+        ));
+        assert_eq!(s.set("t", "k", &[0; 64], 0).await, Err(KvError::Full));
+        s.set("t", "k", &[0; 32], 0).await.unwrap();
+        s.set("t", "k", &[1; 32], 0).await.unwrap();
+        assert_eq!(s.stats().bytes, 33);
+
+        // Expire the key in place / 就地使键过期
+        let store = s.open().await.unwrap().1;
+        let expired = Entry {
+            value: general_purpose::STANDARD.encode([1; 32]),
+            expires_at_ms: Some(1),
+        };
+        store
+            .put(
+                &format!("{}k", namespace_prefix("t")),
+                &serde_json::to_vec(&expired).unwrap(),
+            )
+            .await
+            .unwrap();
+        assert_eq!(
+            s.get("t", "k").await,
+            Err(KvError::NotFound("k".to_string()))
+        );
+        assert_eq!(s.stats().bytes, 0);
+        assert_eq!(store.count().await.unwrap(), 0);
+
+        s.set_config(KvStateConfig::default(), dir.path().to_path_buf());
+        assert_eq!(s.get("t", "k").await, Err(KvError::Disabled));
+    }
+
+    #[tokio::test]
+    async fn test_namespaces_do_not_overlap() {
+        let dir = tempfile::tempdir().unwrap();
+        let s = state(dir.path(), "memory");
+        s.set("a", "k", b"1", 0).await.unwrap();
+        s.set("ab", "k", b"2", 0).await.unwrap();
+        assert_eq!(s.list("a", "").await.unwrap(), vec!["k"]);
+        assert_eq!(s.get("ab", "k").await.unwrap(), b"2");
+    }
+
+    #[test]
+    fn test_decoded_len() {
+        for n in 0..8 {
+            let b64 = general_purpose::STANDARD.encode(vec![7u8; n]);
+            assert_eq!(decoded_len(&b64), n);
+        }
+    }
+}
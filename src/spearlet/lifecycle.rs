@@ -0,0 +1,147 @@
+//! Startup and shutdown order of spearlet subsystems / spearlet 子系统的启动与关闭顺序
+//!
+//! Subsystems rely on each other: instances call into the node services and the AI backends,
+//! camera streams feed instances, and the servers hand requests to all of them. `DEPENDENCIES`
+//! writes this down as a small graph. `start_order` sorts it so that every subsystem starts
+//! after those it depends on, and `stop_order` is the reverse, so nothing is torn down while
+//! something still uses it. `Spearlet::start` and `Spearlet::stop` walk these orders.
+//! 子系统相互依赖：实例调用节点服务与 AI 后端，摄像头流向实例供数，服务器将请求交给上述所有部分。
+//! `DEPENDENCIES` 将其写成一个小型依赖图。`start_order` 对其排序，使每个子系统在其依赖之后启动，
+//! `stop_order` 则相反，因此不会拆除仍被使用的部分。`Spearlet::start` 与 `Spearlet::stop` 按这些顺序执行。
+//!
+//! Hostcalls are admitted only while the runtimes are up; each spearlet keeps this gate in its
+//! `NodeServices`. An instance that outlives the shutdown deadline gets `-ESHUTDOWN` instead of
+//! reaching services that are already reset.
+//! hostcall 仅在运行时运行期间放行；每个 spearlet 在其 `NodeServices` 中保存该开关。超过关闭截止
+//! 时间仍在运行的实例会得到 `-ESHUTDOWN`，而不会访问已被重置的服务。
+
+use std::collections::BTreeSet;
+
+use serde::Serialize;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Subsystem {
+    /// Blobs, vector store, key-value state, mailboxes, scratch files, caches and usage
+    /// blob、向量存储、键值状态、邮箱、临时文件、缓存与用量
+    NodeServices,
+    /// Message routing between spearlets / spearlet 之间的消息路由
+    MessageRouting,
+    /// Local model servers started for model deployments / 为模型部署启动的本地模型服务器
+    BackendServices,
+    /// Runtimes and their workload instances / 运行时及其工作负载实例
+    Runtimes,
+    /// Camera streams and WebRTC sessions fed into executions / 送入执行的摄像头流与 WebRTC 会话
+    StreamClasses,
+    /// gRPC and HTTP servers / gRPC 与 HTTP 服务器
+    Servers,
+}
+
+impl Subsystem {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Subsystem::NodeServices => "node_services",
+            Subsystem::MessageRouting => "message_routing",
+            Subsystem::BackendServices => "backend_services",
+            Subsystem::Runtimes => "runtimes",
+            Subsystem::StreamClasses => "stream_classes",
+            Subsystem::Servers => "servers",
+        }
+    }
+}
+
+/// Each subsystem with those it depends on / 每个子系统及其依赖
+pub const DEPENDENCIES: &[(Subsystem, &[Subsystem])] = &[
+    (Subsystem::NodeServices, &[]),
+    (Subsystem::MessageRouting, &[Subsystem::NodeServices]),
+    (Subsystem::BackendServices, &[]),
+    (
+        Subsystem::Runtimes,
+        &[
+            Subsystem::NodeServices,
+            Subsystem::MessageRouting,
+            Subsystem::BackendServices,
+        ],
+    ),
+    (Subsystem::StreamClasses, &[Subsystem::Runtimes]),
+    (
+        Subsystem::Servers,
+        &[Subsystem::Runtimes, Subsystem::StreamClasses],
+    ),
+];
+
+/// Sort a graph so dependencies come first; ties keep the listed order
+/// 对依赖图排序使依赖在前；无先后要求的保持列出顺序
+pub fn sort(graph: &[(Subsystem, &[Subsystem])]) -> Result<Vec<Subsystem>, String> {
+    let known: BTreeSet<Subsystem> = graph.iter().map(|(s, _)| *s).collect();
+    for (s, deps) in graph {
+        if let Some(d) = deps.iter().find(|d| !known.contains(d)) {
+            return Err(format!(
+                "{} depends on {}, which is not in the graph",
+                s.as_str(),
+                d.as_str()
+            ));
+        }
+    }
+    let mut done: BTreeSet<Subsystem> = BTreeSet::new();
+    let mut order = Vec::with_capacity(graph.len());
+    while order.len() < graph.len() {
+        let Some((next, _)) = graph
+            .iter()
+            .find(|(s, deps)| !done.contains(s) && deps.iter().all(|d| done.contains(d)))
+        else {
+            let left: Vec<&str> = graph
+                .iter()
+                .filter(|(s, _)| !done.contains(s))
+                .map(|(s, _)| s.as_str())
+                .collect();
+            return Err(format!("dependency cycle among {}", left.join(", ")));
+        };
+        done.insert(*next);
+        order.push(*next);
+    }
+    Ok(order)
+}
+
+pub fn start_order() -> Vec<Subsystem> {
+    sort(DEPENDENCIES).expect("subsystem dependencies form a cycle")
+}
+
+pub fn stop_order() -> Vec<Subsystem> {
+    let mut order = start_order();
+    order.reverse();
+    order
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_every_subsystem_starts_after_its_dependencies() {
+        let order = start_order();
+        assert_eq!(order.len(), DEPENDENCIES.len());
+        let pos = |s: Subsystem| order.iter().position(|x| *x == s).unwrap();
+        for (s, deps) in DEPENDENCIES {
+            for d in *deps {
+                assert!(pos(*d) < pos(*s), "{:?} before {:?}", d, s);
+            }
+        }
+        assert_eq!(stop_order().first(), Some(&Subsystem::Servers));
+        assert_eq!(stop_order().last(), Some(&Subsystem::NodeServices));
+    }
+
+    #[test]
+    fn test_sort_reports_cycles_and_unknown_dependencies() {
+        let cycle: &[(Subsystem, &[Subsystem])] = &[
+            (Subsystem::NodeServices, &[]),
+            (Subsystem::Runtimes, &[Subsystem::Servers]),
+            (Subsystem::Servers, &[Subsystem::Runtimes]),
+        ];
+        let err = sort(cycle).unwrap_err();
+        assert!(err.contains("runtimes, servers"), "{}", err);
+
+        let unknown: &[(Subsystem, &[Subsystem])] = &[(Subsystem::Servers, &[Subsystem::Runtimes])];
+        assert!(sort(unknown).unwrap_err().contains("not in the graph"));
+    }
+}
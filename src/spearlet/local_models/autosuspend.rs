@@ -0,0 +1,405 @@
+//! Autosuspend of idle local model servers / 空闲本地模型服务器的自动挂起
+//!
+//! Every request routed to a managed backend passes through `TrackedAdapter`, which counts it
+//! in flight and stamps the backend's last use. With `backend_autosuspend.enabled`, the local
+//! model controller looks for servers that have had no request in flight for
+//! `idle_timeout_secs` and stops them to give their memory back. The backend stays registered
+//! with the router; the next request routed to it starts the server again on its old port and
+//! waits until it is ready.
+//! 每个路由到托管后端的请求都经过 `TrackedAdapter`，由其计为进行中并记录后端的最近使用时间。开启
+//! `backend_autosuspend.enabled` 后，本地模型控制器查找在 `idle_timeout_secs` 内没有进行中请求的
+//! 服务器并将其停止以归还内存。后端仍在路由器中注册；下一个路由到它的请求会在原端口上重新启动服务器
+//! 并等待其就绪。
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::{Mutex, RwLock};
+use reqwest::Client;
+use serde::Serialize;
+use tokio::runtime::Handle;
+use tracing::{info, warn};
+
+use crate::spearlet::config::BackendAutosuspendConfig;
+use crate::spearlet::execution::ai::backends::BackendAdapter;
+use crate::spearlet::execution::ai::ir::{
+    CanonicalError, CanonicalRequestEnvelope, CanonicalResponseEnvelope,
+};
+use crate::spearlet::execution::ai::streaming::StreamingPlan;
+
+use super::llamacpp::LlamaCppSupervisor;
+
+/// Activity of one managed backend / 单个托管后端的活动情况
+#[derive(Debug, Clone, Serialize)]
+pub struct BackendActivityStats {
+    pub name: String,
+    pub suspended: bool,
+    pub in_flight: u32,
+    /// Seconds since the last request ended / 距上一个请求结束的秒数
+    pub idle_secs: u64,
+    pub suspends: u64,
+    pub resumes: u64,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct AutosuspendStats {
+    pub enabled: bool,
+    pub idle_timeout_secs: u64,
+    pub backends: Vec<BackendActivityStats>,
+}
+
+struct Activity {
+    last_used: Instant,
+    in_flight: u32,
+    suspended: bool,
+    suspends: u64,
+    resumes: u64,
+}
+
+impl Activity {
+    fn new(now: Instant) -> Self {
+        Self {
+            last_used: now,
+            in_flight: 0,
+            suspended: false,
+            suspends: 0,
+            resumes: 0,
+        }
+    }
+
+    fn idle_for(&self, now: Instant, timeout: Duration) -> bool {
+        !self.suspended && self.in_flight == 0 && now.duration_since(self.last_used) >= timeout
+    }
+}
+
+/// What starts suspended servers again / 重新启动已挂起服务器的组件
+#[derive(Clone)]
+struct Waker {
+    handle: Handle,
+    supervisor: LlamaCppSupervisor,
+    http: Client,
+}
+
+pub struct BackendActivity {
+    config: RwLock<BackendAutosuspendConfig>,
+    backends: Mutex<HashMap<String, Activity>>,
+    waker: RwLock<Option<Waker>>,
+}
+
+impl Default for BackendActivity {
+    fn default() -> Self {
+        Self::new(BackendAutosuspendConfig::default())
+    }
+}
+
+impl std::fmt::Debug for BackendActivity {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("BackendActivity")
+            .field("config", &*self.config.read())
+            .finish_non_exhaustive()
+    }
+}
+
+impl BackendActivity {
+    pub fn new(config: BackendAutosuspendConfig) -> Self {
+        Self {
+            config: RwLock::new(config),
+            backends: Mutex::new(HashMap::new()),
+            waker: RwLock::new(None),
+        }
+    }
+
+    pub fn set_config(&self, config: BackendAutosuspendConfig) {
+        *self.config.write() = config;
+    }
+
+    pub fn config(&self) -> BackendAutosuspendConfig {
+        self.config.read().clone()
+    }
+
+    /// Let requests start suspended servers of `supervisor` on the current runtime
+    /// 允许请求在当前运行时上重新启动 `supervisor` 中已挂起的服务器
+    pub fn attach(&self, supervisor: LlamaCppSupervisor) {
+        *self.waker.write() = Some(Waker {
+            handle: Handle::current(),
+            supervisor,
+            http: Client::new(),
+        });
+    }
+
+    pub fn detach(&self) {
+        *self.waker.write() = None;
+        self.backends.lock().clear();
+    }
+
+    /// Follow the managed backends currently published; new ones count as just used
+    /// 跟踪当前发布的托管后端；新出现的后端视为刚被使用
+    pub fn track<'a>(&self, names: impl IntoIterator<Item = &'a str>) {
+        let now = Instant::now();
+        let mut backends = self.backends.lock();
+        let mut live: HashMap<String, Activity> = HashMap::new();
+        for name in names {
+            let a = backends.remove(name).unwrap_or_else(|| Activity::new(now));
+            live.insert(name.to_string(), a);
+        }
+        *backends = live;
+    }
+
+    /// Count a request in flight, starting the server first when it is suspended
+    /// 将请求计为进行中；服务器已挂起时先将其启动
+    pub fn begin(&self, name: &str) -> Result<(), String> {
+        let suspended = {
+            let mut backends = self.backends.lock();
+            let a = backends
+                .entry(name.to_string())
+                .or_insert_with(|| Activity::new(Instant::now()));
+            a.in_flight += 1;
+            a.last_used = Instant::now();
+            a.suspended
+        };
+        if !suspended {
+            return Ok(());
+        }
+        match self.wake(name) {
+            Ok(started) => {
+                if let Some(a) = self.backends.lock().get_mut(name) {
+                    a.suspended = false;
+                    if started {
+                        a.resumes += 1;
+                    }
+                }
+                if started {
+                    info!(backend = %name, "Resumed suspended backend service");
+                }
+                Ok(())
+            }
+            Err(e) => {
+                self.end(name);
+                warn!(backend = %name, error = %e, "Resuming backend service failed");
+                Err(e)
+            }
+        }
+    }
+
+    pub fn end(&self, name: &str) {
+        if let Some(a) = self.backends.lock().get_mut(name) {
+            a.in_flight = a.in_flight.saturating_sub(1);
+            a.last_used = Instant::now();
+        }
+    }
+
+    /// Runs on the runtime the supervisor lives on; the caller is a blocking backend thread
+    /// 在 supervisor 所在的运行时上执行；调用者是阻塞的后端线程
+    fn wake(&self, name: &str) -> Result<bool, String> {
+        let Some(w) = self.waker.read().clone() else {
+            return Err(format!("backend {} is suspended", name));
+        };
+        let (tx, rx) = std::sync::mpsc::channel();
+        let name = name.to_string();
+        w.handle.spawn(async move {
+            let _ = tx.send(w.supervisor.resume(&w.http, &name).await);
+        });
+        rx.recv()
+            .unwrap_or_else(|_| Err("backend service resume was cancelled".to_string()))
+    }
+
+    /// Mark the backend suspended if it is still idle; decided under one lock, so a request
+    /// either keeps the server or sees it suspended and starts it again
+    /// 若后端仍空闲则将其标记为已挂起；在同一把锁内决定，因此请求要么保留服务器，要么看到其已挂起并重新启动
+    fn mark_if_idle(&self, name: &str, timeout: Duration) -> bool {
+        let mut backends = self.backends.lock();
+        let Some(a) = backends.get_mut(name) else {
+            return false;
+        };
+        if !a.idle_for(Instant::now(), timeout) {
+            return false;
+        }
+        a.suspended = true;
+        a.suspends += 1;
+        true
+    }
+
+    fn idle(&self, timeout: Duration) -> Vec<String> {
+        let now = Instant::now();
+        self.backends
+            .lock()
+            .iter()
+            .filter(|(_, a)| a.idle_for(now, timeout))
+            .map(|(name, _)| name.clone())
+            .collect()
+    }
+
+    /// Stop the servers idle beyond the timeout; returns how many were stopped
+    /// 停止空闲超过超时时间的服务器；返回停止的数量
+    pub async fn sweep(&self, supervisor: &LlamaCppSupervisor) -> usize {
+        let cfg = self.config();
+        if !cfg.enabled {
+            return 0;
+        }
+        let timeout = Duration::from_secs(cfg.idle_timeout_secs);
+        let mut stopped = 0;
+        for name in self.idle(timeout) {
+            if supervisor
+                .suspend(&name, || self.mark_if_idle(&name, timeout))
+                .await
+            {
+                info!(
+                    backend = %name,
+                    idle_timeout_secs = cfg.idle_timeout_secs,
+                    "Suspended idle backend service"
+                );
+                stopped += 1;
+            }
+        }
+        stopped
+    }
+
+    pub fn stats(&self) -> AutosuspendStats {
+        let cfg = self.config();
+        let now = Instant::now();
+        let mut backends: Vec<BackendActivityStats> = self
+            .backends
+            .lock()
+            .iter()
+            .map(|(name, a)| BackendActivityStats {
+                name: name.clone(),
+                suspended: a.suspended,
+                in_flight: a.in_flight,
+                idle_secs: if a.in_flight > 0 {
+                    0
+                } else {
+                    now.duration_since(a.last_used).as_secs()
+                },
+                suspends: a.suspends,
+                resumes: a.resumes,
+            })
+            .collect();
+        backends.sort_by(|a, b| a.name.cmp(&b.name));
+        AutosuspendStats {
+            enabled: cfg.enabled,
+            idle_timeout_secs: cfg.idle_timeout_secs,
+            backends,
+        }
+    }
+}
+
+/// Marks a request in flight until dropped / 在被丢弃前将请求标记为进行中
+struct InFlight<'a> {
+    activity: &'a BackendActivity,
+    name: &'a str,
+}
+
+impl<'a> InFlight<'a> {
+    fn begin(
+        activity: &'a BackendActivity,
+        name: &'a str,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<Self, CanonicalError> {
+        activity.begin(name).map_err(|message| CanonicalError {
+            code: "backend_unavailable".to_string(),
+            message,
+            retryable: true,
+            operation: Some(req.operation.clone()),
+        })?;
+        Ok(Self { activity, name })
+    }
+}
+
+impl Drop for InFlight<'_> {
+    fn drop(&mut self) {
+        self.activity.end(self.name);
+    }
+}
+
+/// Adapter of a managed backend that records its use and resumes it when suspended
+/// 托管后端的适配器，记录其使用情况并在挂起时将其恢复
+pub struct TrackedAdapter {
+    inner: Arc<dyn BackendAdapter>,
+    activity: Arc<BackendActivity>,
+}
+
+impl TrackedAdapter {
+    pub fn new(inner: Arc<dyn BackendAdapter>, activity: Arc<BackendActivity>) -> Self {
+        Self { inner, activity }
+    }
+
+    fn in_flight(&self, req: &CanonicalRequestEnvelope) -> Result<InFlight<'_>, CanonicalError> {
+        InFlight::begin(&self.activity, self.inner.name(), req)
+    }
+}
+
+impl BackendAdapter for TrackedAdapter {
+    fn name(&self) -> &str {
+        self.inner.name()
+    }
+
+    fn invoke(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let _in_flight = self.in_flight(req)?;
+        self.inner.invoke(req)
+    }
+
+    fn invoke_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_event: &mut dyn FnMut(serde_json::Value),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let _in_flight = self.in_flight(req)?;
+        self.inner.invoke_stream(req, on_event)
+    }
+
+    fn invoke_audio_stream(
+        &self,
+        req: &CanonicalRequestEnvelope,
+        on_chunk: &mut dyn FnMut(Vec<u8>),
+    ) -> Result<CanonicalResponseEnvelope, CanonicalError> {
+        let _in_flight = self.in_flight(req)?;
+        self.inner.invoke_audio_stream(req, on_chunk)
+    }
+
+    fn streaming_plan(
+        &self,
+        req: &CanonicalRequestEnvelope,
+    ) -> Result<StreamingPlan, CanonicalError> {
+        let _in_flight = self.in_flight(req)?;
+        self.inner.streaming_plan(req)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_idle_backends_exclude_busy_and_suspended() {
+        let activity = BackendActivity::new(BackendAutosuspendConfig::default());
+        activity.track(["a", "b", "c"]);
+        activity.begin("b").unwrap();
+        activity.backends.lock().get_mut("c").unwrap().suspended = true;
+
+        let mut idle = activity.idle(Duration::ZERO);
+        idle.sort();
+        assert_eq!(idle, vec!["a".to_string()]);
+        assert!(activity.idle(Duration::from_secs(60)).is_empty());
+
+        activity.end("b");
+        assert!(activity.mark_if_idle("b", Duration::ZERO));
+        assert!(!activity.mark_if_idle("b", Duration::ZERO));
+
+        // Tracking again keeps known backends and drops removed ones
+        // 再次跟踪保留已知后端并移除已删除的后端
+        activity.track(["b", "c"]);
+        let stats = activity.stats();
+        assert_eq!(stats.backends.len(), 2);
+        assert!(stats.backends[0].suspended && stats.backends[1].suspended);
+        assert_eq!(stats.backends[0].suspends, 1);
+        assert!(!stats.enabled);
+
+        // No waker: a suspended backend cannot be used / 没有唤醒者：无法使用已挂起的后端
+        assert!(activity.begin("c").is_err());
+        assert_eq!(activity.stats().backends[1].in_flight, 0);
+    }
+}
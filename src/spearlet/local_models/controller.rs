@@ -50,14 +50,48 @@ impl LocalModelController {
         self.cancel.cancel();
     }
 
+    /// Stop reconciling and wait for every server it started to exit
+    /// 停止协调并等待其启动的所有服务器退出
+    pub async fn stop(&self) {
+        self.cancel.cancel();
+        self.llamacpp.stop_all().await;
+    }
+
     pub fn start(&self) {
         let Some(channel) = self.sms_channel.clone() else {
             return;
         };
+        self.managed_backends
+            .activity()
+            .attach(self.llamacpp.clone());
         let this = self.clone();
         tokio::spawn(async move {
             this.run_loop(channel).await;
         });
+        let this = self.clone();
+        tokio::spawn(async move {
+            this.autosuspend_loop().await;
+        });
+    }
+
+    /// Stop idle servers while `backend_autosuspend` is enabled / 在开启 `backend_autosuspend` 时停止空闲的服务器
+    async fn autosuspend_loop(&self) {
+        loop {
+            let interval = self
+                .managed_backends
+                .activity()
+                .config()
+                .check_interval_secs
+                .max(1);
+            tokio::select! {
+                _ = self.cancel.cancelled() => {
+                    self.managed_backends.activity().detach();
+                    return;
+                }
+                _ = tokio::time::sleep(Duration::from_secs(interval)) => {}
+            }
+            self.managed_backends.activity().sweep(&self.llamacpp).await;
+        }
     }
 
     async fn run_loop(&self, channel: Channel) {
@@ -270,6 +304,9 @@ impl LocalModelController {
 
         seen_spec.retain(|id, _| live_ids.contains(id));
         self.llamacpp.stop_removed(&live_ids).await;
+        self.managed_backends
+            .activity()
+            .track(managed_backend_infos.iter().map(|b| b.name.as_str()));
         self.managed_backends.set_backends(managed_backend_infos);
     }
 
@@ -0,0 +1,618 @@
+//! Local model lifecycle / 本地模型生命周期
+//!
+//! Keeps the models listed in `model_store` present on the node. File models (whisper,
+//! piper, ONNX) go through the artifact download manager, so they resume, are checked
+//! against their sha256 and count against the store quota; a changed url or checksum
+//! pulls the model again. Ollama models are pulled through the Ollama API and pinned by
+//! digest. Readiness is reported by `/readyz` and the provider listing.
+//! 保证 `model_store` 中列出的模型存在于节点上。文件模型（whisper、piper、ONNX）经由 artifact
+//! 下载管理器拉取，因此支持断点续传、按 sha256 校验并计入仓库配额；url 或校验和变化时重新
+//! 拉取。Ollama 模型通过 Ollama API 拉取并按摘要固定版本。就绪状态通过 `/readyz` 与提供方列表报告。
+
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+use parking_lot::RwLock;
+use serde::{Deserialize, Serialize};
+use tokio::sync::Notify;
+
+use crate::spearlet::config::{
+    DownloadConfig, ManagedModelConfig, ModelStoreConfig, SpearletConfig,
+};
+use crate::spearlet::execution::downloads::{DownloadManager, DownloadSpec};
+use crate::spearlet::local_models::DEFAULT_LOCAL_MODELS_DIR;
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
+
+/// Versions of the files in the store, kept next to them / 仓库中文件的版本，与文件放在一起
+const MANIFEST: &str = ".manifest.json";
+
+pub const KIND_OLLAMA: &str = "ollama";
+pub const KINDS: &[&str] = &["whisper", "piper", "onnx", "file", KIND_OLLAMA];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ModelState {
+    Pending,
+    Pulling,
+    Ready,
+    Failed,
+}
+
+/// State of one managed model / 单个受管模型的状态
+#[derive(Debug, Clone, Serialize)]
+pub struct ManagedModelStatus {
+    pub name: String,
+    pub kind: String,
+    pub state: ModelState,
+    pub required: bool,
+    /// File in the store; `None` for Ollama models / 仓库中的文件；Ollama 模型为 `None`
+    pub path: Option<String>,
+    pub size_bytes: u64,
+    /// Progress while pulling / 拉取中的进度
+    pub downloaded_bytes: u64,
+    pub total_bytes: Option<u64>,
+    pub error: Option<String>,
+    /// Last time the model was checked (RFC 3339) / 最近一次检查时间（RFC 3339）
+    pub checked_at: Option<String>,
+}
+
+/// Disk usage of the store / 仓库的磁盘占用
+#[derive(Debug, Clone, Serialize)]
+pub struct StoreUsage {
+    pub dir: String,
+    pub used_bytes: u64,
+    pub quota_bytes: u64,
+}
+
+/// Store state as reported by `/readyz` / `/readyz` 报告的仓库状态
+#[derive(Debug, Clone, Serialize)]
+pub struct StoreReadiness {
+    pub enabled: bool,
+    /// Every required model is ready / 所有必需模型均已就绪
+    pub ready: bool,
+    pub usage: StoreUsage,
+    pub models: Vec<ManagedModelStatus>,
+}
+
+/// Version a file was pulled at / 文件被拉取时的版本
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+struct Pin {
+    file: String,
+    url: String,
+    sha256: String,
+}
+
+#[derive(Debug, Clone)]
+struct Settings {
+    config: ModelStoreConfig,
+    root: PathBuf,
+    ollama_url: String,
+}
+
+pub struct ModelLifecycleManager {
+    settings: RwLock<Settings>,
+    downloads: RwLock<Arc<DownloadManager>>,
+    status: RwLock<BTreeMap<String, ManagedModelStatus>>,
+    http: reqwest::Client,
+    /// One reconcile at a time / 同一时间只进行一次协调
+    reconciling: tokio::sync::Mutex<()>,
+    wake: Notify,
+    running: AtomicBool,
+}
+
+impl ManagedModelConfig {
+    /// File name in the store / 仓库中的文件名
+    pub fn file_name(&self) -> &str {
+        if self.file.is_empty() {
+            &self.name
+        } else {
+            &self.file
+        }
+    }
+}
+
+/// Store directory for a configuration / 配置对应的仓库目录
+pub fn store_dir(cfg: &SpearletConfig) -> PathBuf {
+    if !cfg.model_store.dir.trim().is_empty() {
+        return PathBuf::from(cfg.model_store.dir.trim());
+    }
+    let base = if cfg.local_models_dir.trim().is_empty() {
+        DEFAULT_LOCAL_MODELS_DIR
+    } else {
+        cfg.local_models_dir.trim()
+    };
+    Path::new(base).join("store")
+}
+
+fn download_manager(cfg: &ModelStoreConfig, root: &Path) -> DownloadManager {
+    let dl = DownloadConfig {
+        dir: root.to_string_lossy().into_owned(),
+        quota_bytes: cfg.quota_bytes,
+        timeout_s: cfg.download_timeout_s,
+    };
+    DownloadManager::new(&dl, "")
+}
+
+fn download_key(name: &str) -> String {
+    format!("model:{}", name)
+}
+
+/// Ollama reports untagged models as `:latest` / Ollama 将未带标签的模型报告为 `:latest`
+fn ollama_tag(name: &str) -> String {
+    if name.contains(':') {
+        name.to_string()
+    } else {
+        format!("{}:latest", name)
+    }
+}
+
+impl Default for ModelLifecycleManager {
+    fn default() -> Self {
+        Self::new(
+            ModelStoreConfig::default(),
+            PathBuf::from(DEFAULT_LOCAL_MODELS_DIR).join("store"),
+            String::new(),
+        )
+    }
+}
+
+impl ModelLifecycleManager {
+    pub fn new(config: ModelStoreConfig, root: PathBuf, ollama_url: String) -> Self {
+        let downloads = Arc::new(download_manager(&config, &root));
+        let m = Self {
+            settings: RwLock::new(Settings {
+                config: ModelStoreConfig::default(),
+                root: root.clone(),
+                ollama_url: String::new(),
+            }),
+            downloads: RwLock::new(downloads),
+            status: RwLock::new(BTreeMap::new()),
+            http: reqwest::Client::new(),
+            reconciling: tokio::sync::Mutex::new(()),
+            wake: Notify::new(),
+            running: AtomicBool::new(false),
+        };
+        m.set_config(config, root, ollama_url);
+        m
+    }
+
+    /// Apply the configuration and check the store now and every `check_interval_s`
+    /// 应用配置，并立即及每隔 `check_interval_s` 检查仓库
+    pub fn start(self: &Arc<Self>, cfg: &SpearletConfig) {
+        let store = &cfg.model_store;
+        let ollama_url = if store.ollama_url.trim().is_empty() {
+            cfg.llm.discovery.ollama.base_url.clone()
+        } else {
+            store.ollama_url.trim().to_string()
+        };
+        self.set_config(store.clone(), store_dir(cfg), ollama_url);
+        if !store.enabled {
+            return;
+        }
+        if self.running.swap(true, Ordering::SeqCst) {
+            // The running loop checks again right away / 运行中的循环立即重新检查
+            self.wake.notify_one();
+            return;
+        }
+        let manager = Arc::downgrade(self);
+        supervise("model-store", RestartPolicy::default(), move || {
+            let manager = manager.clone();
+            async move {
+                loop {
+                    let Some(m) = manager.upgrade() else {
+                        return;
+                    };
+                    m.reconcile().await;
+                    let interval = m.settings.read().config.check_interval_s.max(10);
+                    tokio::select! {
+                        _ = tokio::time::sleep(Duration::from_secs(interval)) => {}
+                        _ = m.wake.notified() => {}
+                    }
+                }
+            }
+        });
+    }
+
+    /// Replace the desired state; models no longer listed are forgotten
+    /// 替换期望状态；不再列出的模型被移除
+    pub fn set_config(&self, config: ModelStoreConfig, root: PathBuf, ollama_url: String) {
+        {
+            let current = self.settings.read();
+            if current.root != root
+                || current.config.quota_bytes != config.quota_bytes
+                || current.config.download_timeout_s != config.download_timeout_s
+            {
+                *self.downloads.write() = Arc::new(download_manager(&config, &root));
+            }
+        }
+        let mut status = self.status.write();
+        status.retain(|name, _| config.models.iter().any(|m| &m.name == name));
+        for m in &config.models {
+            let s = status
+                .entry(m.name.clone())
+                .or_insert_with(|| ManagedModelStatus {
+                    name: m.name.clone(),
+                    kind: m.kind.clone(),
+                    state: ModelState::Pending,
+                    required: m.required,
+                    path: None,
+                    size_bytes: 0,
+                    downloaded_bytes: 0,
+                    total_bytes: None,
+                    error: None,
+                    checked_at: None,
+                });
+            s.kind = m.kind.clone();
+            s.required = m.required;
+        }
+        drop(status);
+        *self.settings.write() = Settings {
+            config,
+            root,
+            ollama_url,
+        };
+    }
+
+    /// Models with download progress filled in / 填入下载进度的模型列表
+    pub fn list(&self) -> Vec<ManagedModelStatus> {
+        let downloads = self.downloads.read().clone();
+        let mut out: Vec<ManagedModelStatus> = self.status.read().values().cloned().collect();
+        for s in out.iter_mut().filter(|s| s.state == ModelState::Pulling) {
+            if let Some(p) = downloads.progress(&download_key(&s.name)).first() {
+                s.downloaded_bytes = p.downloaded_bytes;
+                s.total_bytes = p.total_bytes;
+            }
+        }
+        out
+    }
+
+    /// State of a model by name, if the store manages it / 按名称查询受管模型的状态
+    pub fn state_of(&self, name: &str) -> Option<ModelState> {
+        if !self.settings.read().config.enabled {
+            return None;
+        }
+        let status = self.status.read();
+        status
+            .get(name)
+            .or_else(|| {
+                status
+                    .values()
+                    .find(|s| s.kind == KIND_OLLAMA && ollama_tag(&s.name) == ollama_tag(name))
+            })
+            .map(|s| s.state)
+    }
+
+    pub fn usage(&self) -> StoreUsage {
+        let s = self.settings.read();
+        StoreUsage {
+            dir: s.root.to_string_lossy().into_owned(),
+            used_bytes: dir_size(&s.root),
+            quota_bytes: s.config.quota_bytes,
+        }
+    }
+
+    pub fn readiness(&self) -> StoreReadiness {
+        let enabled = self.settings.read().config.enabled;
+        let models = if enabled { self.list() } else { Vec::new() };
+        StoreReadiness {
+            enabled,
+            ready: models
+                .iter()
+                .all(|m| !m.required || m.state == ModelState::Ready),
+            usage: self.usage(),
+            models,
+        }
+    }
+
+    fn set_state(&self, name: &str, f: impl FnOnce(&mut ManagedModelStatus)) {
+        if let Some(s) = self.status.write().get_mut(name) {
+            f(s);
+        }
+    }
+
+    /// Bring every listed model to its desired version / 将所有列出的模型调整到期望版本
+    pub async fn reconcile(&self) {
+        let _guard = self.reconciling.lock().await;
+        let settings = self.settings.read().clone();
+        if !settings.config.enabled {
+            return;
+        }
+        if let Err(e) = tokio::fs::create_dir_all(&settings.root).await {
+            tracing::warn!(dir = %settings.root.display(), error = %e, "model store dir");
+        }
+        let downloads = self.downloads.read().clone();
+        let mut pins = read_manifest(&settings.root);
+
+        for model in &settings.config.models {
+            self.set_state(&model.name, |s| {
+                if s.state != ModelState::Ready {
+                    s.state = ModelState::Pulling;
+                }
+            });
+            let pulled = if model.kind == KIND_OLLAMA {
+                self.pull_ollama(&settings, model)
+                    .await
+                    .map(|size| (None, size))
+            } else {
+                self.pull_file(&settings.root, &downloads, &mut pins, model)
+                    .await
+                    .map(|(path, size)| (Some(path), size))
+            };
+            let now = chrono::Utc::now().to_rfc3339();
+            match pulled {
+                Ok((path, size)) => self.set_state(&model.name, |s| {
+                    s.state = ModelState::Ready;
+                    s.path = path.map(|p| p.to_string_lossy().into_owned());
+                    s.size_bytes = size;
+                    s.downloaded_bytes = size;
+                    s.total_bytes = Some(size);
+                    s.error = None;
+                    s.checked_at = Some(now);
+                }),
+                Err(e) => {
+                    tracing::warn!(model = %model.name, error = %e, "model pull failed");
+                    self.set_state(&model.name, |s| {
+                        s.state = ModelState::Failed;
+                        s.error = Some(e);
+                        s.checked_at = Some(now);
+                    });
+                }
+            }
+        }
+
+        pins.retain(|name, _| settings.config.models.iter().any(|m| &m.name == name));
+        write_manifest(&settings.root, &pins);
+        if settings.config.prune {
+            prune(&settings.root, &settings.config.models);
+        }
+    }
+
+    async fn pull_file(
+        &self,
+        root: &Path,
+        downloads: &DownloadManager,
+        pins: &mut HashMap<String, Pin>,
+        model: &ManagedModelConfig,
+    ) -> Result<(PathBuf, u64), String> {
+        let file = model.file_name();
+        let target = root.join(file);
+        let pin = Pin {
+            file: file.to_string(),
+            url: model.url.clone(),
+            sha256: model.sha256.trim().to_ascii_lowercase(),
+        };
+        // Without a checksum only the pin tells an outdated file apart
+        // 没有校验和时只能通过版本记录识别过期文件
+        if pin.sha256.is_empty() && pins.get(&model.name) != Some(&pin) && target.exists() {
+            tracing::info!(model = %model.name, "model version changed, pulling again");
+            std::fs::remove_file(&target).map_err(|e| e.to_string())?;
+        }
+        let spec = DownloadSpec {
+            name: file.to_string(),
+            url: model.url.clone(),
+            sha256: (!pin.sha256.is_empty()).then(|| pin.sha256.clone()),
+        };
+        let paths = downloads
+            .ensure_all(&download_key(&model.name), &[spec])
+            .await
+            .map_err(|e| e.to_string())?;
+        let path = paths.get(file).cloned().unwrap_or(target);
+        let size = std::fs::metadata(&path).map(|m| m.len()).unwrap_or(0);
+        pins.insert(model.name.clone(), pin);
+        Ok((path, size))
+    }
+
+    /// Pull an Ollama model unless the wanted digest is installed; returns its size
+    /// 除非已安装期望的摘要，否则拉取 Ollama 模型；返回其大小
+    async fn pull_ollama(
+        &self,
+        settings: &Settings,
+        model: &ManagedModelConfig,
+    ) -> Result<u64, String> {
+        let base = settings.ollama_url.trim_end_matches('/');
+        let digest = model.sha256.trim().to_ascii_lowercase();
+        let wanted = |m: &OllamaModel| digest.is_empty() || m.digest.eq_ignore_ascii_case(&digest);
+        if let Some(m) = self.ollama_installed(base, &model.name).await? {
+            if wanted(&m) {
+                return Ok(m.size);
+            }
+            tracing::info!(model = %model.name, "ollama model digest changed, pulling again");
+        }
+        let resp = self
+            .http
+            .post(format!("{}/api/pull", base))
+            .json(&serde_json::json!({"model": model.name, "stream": false}))
+            .timeout(Duration::from_secs(
+                settings.config.download_timeout_s.max(1),
+            ))
+            .send()
+            .await
+            .map_err(|e| format!("ollama pull: {}", e))?;
+        if !resp.status().is_success() {
+            let status = resp.status();
+            let body = resp.text().await.unwrap_or_default();
+            return Err(format!(
+                "ollama pull: http_status={} {}",
+                status,
+                body.trim()
+            ));
+        }
+        match self.ollama_installed(base, &model.name).await? {
+            Some(m) if wanted(&m) => Ok(m.size),
+            Some(m) => Err(format!(
+                "ollama digest mismatch: expected {}, got {}",
+                digest, m.digest
+            )),
+            None => Err("ollama pull finished but the model is not listed".to_string()),
+        }
+    }
+
+    async fn ollama_installed(
+        &self,
+        base: &str,
+        name: &str,
+    ) -> Result<Option<OllamaModel>, String> {
+        let tags: OllamaTags = self
+            .http
+            .get(format!("{}/api/tags", base))
+            .timeout(Duration::from_secs(10))
+            .send()
+            .await
+            .and_then(|r| r.error_for_status())
+            .map_err(|e| format!("ollama tags: {}", e))?
+            .json()
+            .await
+            .map_err(|e| format!("ollama tags: {}", e))?;
+        let tag = ollama_tag(name);
+        Ok(tags.models.into_iter().find(|m| ollama_tag(&m.name) == tag))
+    }
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct OllamaTags {
+    #[serde(default)]
+    models: Vec<OllamaModel>,
+}
+
+#[derive(Debug, Deserialize)]
+struct OllamaModel {
+    name: String,
+    #[serde(default)]
+    size: u64,
+    #[serde(default)]
+    digest: String,
+}
+
+fn read_manifest(root: &Path) -> HashMap<String, Pin> {
+    std::fs::read(root.join(MANIFEST))
+        .ok()
+        .and_then(|b| serde_json::from_slice(&b).ok())
+        .unwrap_or_default()
+}
+
+fn write_manifest(root: &Path, pins: &HashMap<String, Pin>) {
+    let res = serde_json::to_vec_pretty(pins)
+        .map_err(std::io::Error::other)
+        .and_then(|b| std::fs::write(root.join(MANIFEST), b));
+    if let Err(e) = res {
+        tracing::warn!(dir = %root.display(), error = %e, "model store manifest not written");
+    }
+}
+
+/// Remove files no model lists, including stale partial downloads
+/// 删除未被任何模型列出的文件，包括过期的部分下载
+fn prune(root: &Path, models: &[ManagedModelConfig]) {
+    let keep: HashSet<String> = models
+        .iter()
+        .filter(|m| m.kind != KIND_OLLAMA)
+        .flat_map(|m| {
+            let file = m.file_name();
+            let part = Path::new(file).with_extension("part");
+            [file.to_string(), part.to_string_lossy().into_owned()]
+        })
+        .chain([MANIFEST.to_string()])
+        .collect();
+    let Ok(rd) = std::fs::read_dir(root) else {
+        return;
+    };
+    for entry in rd.flatten() {
+        let name = entry.file_name().to_string_lossy().into_owned();
+        if keep.contains(&name) || !entry.file_type().is_ok_and(|t| t.is_file()) {
+            continue;
+        }
+        match std::fs::remove_file(entry.path()) {
+            Ok(()) => tracing::info!(file = %name, "pruned from model store"),
+            Err(e) => tracing::warn!(file = %name, error = %e, "model store prune failed"),
+        }
+    }
+}
+
+fn dir_size(dir: &Path) -> u64 {
+    std::fs::read_dir(dir)
+        .map(|rd| {
+            rd.flatten()
+                .filter_map(|e| e.metadata().ok())
+                .filter(|m| m.is_file())
+                .map(|m| m.len())
+                .sum()
+        })
+        .unwrap_or(0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const HELLO_SHA256: &str = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824";
+
+    fn model(name: &str, sha256: &str) -> ManagedModelConfig {
+        ManagedModelConfig {
+            name: name.to_string(),
+            kind: "whisper".to_string(),
+            url: format!("http://127.0.0.1:9/{}", name),
+            sha256: sha256.to_string(),
+            ..Default::default()
+        }
+    }
+
+    fn store(root: &Path, models: Vec<ManagedModelConfig>) -> ModelLifecycleManager {
+        let cfg = ModelStoreConfig {
+            enabled: true,
+            prune: true,
+            models,
+            ..Default::default()
+        };
+        ModelLifecycleManager::new(cfg, root.to_path_buf(), String::new())
+    }
+
+    #[tokio::test]
+    async fn test_reconcile_verifies_and_prunes() {
+        let tmp = tempfile::tempdir().unwrap();
+        std::fs::write(tmp.path().join("base.bin"), b"hello").unwrap();
+        std::fs::write(tmp.path().join("stale.bin"), b"old").unwrap();
+        let m = store(tmp.path(), vec![model("base.bin", HELLO_SHA256)]);
+        assert!(!m.readiness().ready);
+
+        m.reconcile().await;
+        let r = m.readiness();
+        assert!(r.ready);
+        assert_eq!(r.models[0].state, ModelState::Ready);
+        assert_eq!(r.models[0].size_bytes, 5);
+        assert!(!tmp.path().join("stale.bin").exists());
+        assert_eq!(m.state_of("base.bin"), Some(ModelState::Ready));
+
+        // A new checksum pulls again; the source is unreachable
+        // 新的校验和触发重新拉取；源不可达
+        let cfg = ModelStoreConfig {
+            enabled: true,
+            models: vec![model("base.bin", &"0".repeat(64))],
+            ..Default::default()
+        };
+        m.set_config(cfg, tmp.path().to_path_buf(), String::new());
+        m.reconcile().await;
+        let r = m.readiness();
+        assert!(!r.ready);
+        assert_eq!(r.models[0].state, ModelState::Failed);
+        assert!(r.models[0].error.is_some());
+    }
+
+    #[test]
+    fn test_optional_models_and_ollama_tags() {
+        let tmp = tempfile::tempdir().unwrap();
+        let mut optional = model("tts.onnx", "");
+        optional.required = false;
+        let llm = ManagedModelConfig {
+            name: "llama3".to_string(),
+            kind: KIND_OLLAMA.to_string(),
+            required: false,
+            ..Default::default()
+        };
+        let m = store(tmp.path(), vec![optional, llm]);
+        assert!(m.readiness().ready);
+        assert_eq!(m.state_of("llama3:latest"), Some(ModelState::Pending));
+        assert_eq!(m.state_of("other"), None);
+    }
+}
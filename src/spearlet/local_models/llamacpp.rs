@@ -30,10 +30,45 @@ struct Inner {
 
 struct ManagedProc {
     spec_key: String,
-    child: Child,
+    /// `None` while suspended / 挂起期间为 `None`
+    child: Option<Child>,
+    launch: Launch,
     backend: BackendInfo,
 }
 
+/// How a server is started, kept to start it again after a suspend
+/// 服务器的启动方式，保留以便挂起后再次启动
+struct Launch {
+    program: String,
+    args: Vec<String>,
+    base_url: String,
+    ready_timeout: Option<Duration>,
+}
+
+impl Launch {
+    fn spawn(&self) -> Result<Child, String> {
+        let mut cmd = Command::new(&self.program);
+        cmd.kill_on_drop(true);
+        cmd.stdin(Stdio::null());
+        cmd.stdout(Stdio::null());
+        cmd.stderr(Stdio::null());
+        cmd.args(&self.args);
+        cmd.spawn().map_err(|e| {
+            format!(
+                "failed to spawn llama server command (hint: install llama-server in spearlet image, or set params.server_cmd / server_mode=raw): {}",
+                e
+            )
+        })
+    }
+
+    async fn wait_ready(&self, http: &Client) -> Result<(), String> {
+        match self.ready_timeout {
+            Some(t) => wait_ready(http, &self.base_url, t).await,
+            None => Ok(()),
+        }
+    }
+}
+
 impl LlamaCppSupervisor {
     pub fn new(cfg: &SpearletConfig) -> Self {
         let local_models_dir = if cfg.local_models_dir.trim().is_empty() {
@@ -59,7 +94,7 @@ impl LlamaCppSupervisor {
             .collect();
         for id in to_stop {
             if let Some(mut p) = inner.procs.remove(&id) {
-                let _ = terminate_child(&mut p.child).await;
+                p.stop().await;
             }
         }
     }
@@ -69,17 +104,62 @@ impl LlamaCppSupervisor {
         let keys: Vec<String> = inner.procs.keys().cloned().collect();
         for id in keys {
             if let Some(mut p) = inner.procs.remove(&id) {
-                let _ = terminate_child(&mut p.child).await;
+                p.stop().await;
             }
         }
     }
 
+    /// Stop the server behind `backend_name` if `still_idle` agrees; the backend stays
+    /// registered and is started again by `resume`
+    /// 若 `still_idle` 认可则停止 `backend_name` 对应的服务器；后端保持注册，由 `resume` 重新启动
+    pub async fn suspend(&self, backend_name: &str, still_idle: impl Fn() -> bool) -> bool {
+        let mut inner = self.inner.lock().await;
+        let Some(p) = inner
+            .procs
+            .values_mut()
+            .find(|p| p.backend.name == backend_name && p.child.is_some())
+        else {
+            return false;
+        };
+        if !still_idle() {
+            return false;
+        }
+        p.stop().await;
+        true
+    }
+
+    /// Start a suspended server again on its old port; returns whether it was started
+    /// 在原端口上重新启动已挂起的服务器；返回是否进行了启动
+    pub async fn resume(&self, http: &Client, backend_name: &str) -> Result<bool, String> {
+        // Held until ready, so concurrent callers wait for the same start
+        // 持有至就绪，使并发调用者等待同一次启动
+        let mut inner = self.inner.lock().await;
+        let Some(p) = inner
+            .procs
+            .values_mut()
+            .find(|p| p.backend.name == backend_name)
+        else {
+            return Err(format!("managed backend {} is gone", backend_name));
+        };
+        if let Some(child) = p.child.as_mut() {
+            if !matches!(child.try_wait(), Ok(Some(_))) {
+                return Ok(false);
+            }
+        }
+        p.child = Some(p.launch.spawn()?);
+        if let Err(e) = p.launch.wait_ready(http).await {
+            p.stop().await;
+            return Err(e);
+        }
+        Ok(true)
+    }
+
     pub async fn get_backend(&self, deployment_id: &str) -> Option<BackendInfo> {
         let mut inner = self.inner.lock().await;
         let Some(p) = inner.procs.get_mut(deployment_id) else {
             return None;
         };
-        if let Ok(Some(_)) = p.child.try_wait() {
+        if let Some(Ok(Some(_))) = p.child.as_mut().map(|c| c.try_wait()) {
             inner.procs.remove(deployment_id);
             return None;
         }
@@ -98,13 +178,15 @@ impl LlamaCppSupervisor {
             let mut inner = self.inner.lock().await;
             if let Some(p) = inner.procs.get_mut(deployment_id) {
                 if p.spec_key == spec_key {
-                    if let Ok(Some(_)) = p.child.try_wait() {
+                    if let Some(Ok(Some(_))) = p.child.as_mut().map(|c| c.try_wait()) {
                         inner.procs.remove(deployment_id);
                     } else {
+                        // Running, or suspended until the next request
+                        // 正在运行，或挂起至下一个请求
                         return Ok(p.backend.clone());
                     }
                 } else {
-                    let _ = terminate_child(&mut p.child).await;
+                    p.stop().await;
                     inner.procs.remove(deployment_id);
                 }
             }
@@ -129,59 +211,59 @@ impl LlamaCppSupervisor {
             .filter(|s| !s.trim().is_empty())
             .unwrap_or_else(|| "llama-server".to_string());
 
-        let mut cmd = Command::new(server_cmd);
-        cmd.kill_on_drop(true);
-        cmd.stdin(Stdio::null());
-        cmd.stdout(Stdio::null());
-        cmd.stderr(Stdio::null());
-
+        let mut args: Vec<String> = Vec::new();
         if server_mode == "raw" {
             let raw_args = params.get("server_cmd_args").cloned().unwrap_or_default();
-            let args = split_args(&raw_args);
+            args = split_args(&raw_args);
             if args.is_empty() {
                 return Err("server_mode=raw requires server_cmd_args".to_string());
             }
-            cmd.args(args);
         } else {
             let model_path = resolve_model_path(&self.local_models_dir, model, params)?;
             if !model_path.exists() {
                 download_model(http, &model_path, params).await?;
             }
 
-            cmd.arg("-m").arg(model_path);
-            cmd.arg("--host").arg("127.0.0.1");
-            cmd.arg("--port").arg(port.to_string());
+            args.push("-m".to_string());
+            args.push(model_path.display().to_string());
+            args.push("--host".to_string());
+            args.push("127.0.0.1".to_string());
+            args.push("--port".to_string());
+            args.push(port.to_string());
 
             if let Some(n_threads) = params
                 .get("threads")
                 .cloned()
                 .filter(|v| !v.trim().is_empty())
             {
-                cmd.arg("--threads").arg(n_threads);
+                args.push("--threads".to_string());
+                args.push(n_threads);
             }
             if let Some(ctx) = params
                 .get("ctx_size")
                 .cloned()
                 .filter(|v| !v.trim().is_empty())
             {
-                cmd.arg("--ctx-size").arg(ctx);
+                args.push("--ctx-size".to_string());
+                args.push(ctx);
             }
         }
 
-        let child = cmd.spawn().map_err(|e| {
-            format!(
-                "failed to spawn llama server command (hint: install llama-server in spearlet image, or set params.server_cmd / server_mode=raw): {}",
-                e
-            )
-        })?;
-
-        if ready_probe != "none" {
+        let ready_timeout = (ready_probe != "none").then(|| {
             let start_timeout_s = params
                 .get("start_timeout_s")
                 .and_then(|s| s.trim().parse::<u64>().ok())
                 .unwrap_or(120);
-            wait_ready(http, &base_url, Duration::from_secs(start_timeout_s)).await?;
-        }
+            Duration::from_secs(start_timeout_s)
+        });
+        let launch = Launch {
+            program: server_cmd,
+            args,
+            base_url: base_url.clone(),
+            ready_timeout,
+        };
+        let child = launch.spawn()?;
+        launch.wait_ready(http).await?;
 
         let backend = BackendInfo {
             name: format!("managed/llamacpp/{}", sanitize_name(model)),
@@ -204,7 +286,8 @@ impl LlamaCppSupervisor {
             deployment_id.to_string(),
             ManagedProc {
                 spec_key: spec_key.to_string(),
-                child,
+                child: Some(child),
+                launch,
                 backend: backend.clone(),
             },
         );
@@ -213,6 +296,14 @@ impl LlamaCppSupervisor {
     }
 }
 
+impl ManagedProc {
+    async fn stop(&mut self) {
+        if let Some(mut child) = self.child.take() {
+            let _ = terminate_child(&mut child).await;
+        }
+    }
+}
+
 async fn allocate_local_port() -> std::io::Result<u16> {
     let l = TcpListener::bind(("127.0.0.1", 0)).await?;
     Ok(l.local_addr()?.port())
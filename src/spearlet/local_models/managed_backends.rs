@@ -1,14 +1,17 @@
 use std::sync::atomic::{AtomicU64, Ordering};
-use std::sync::{Arc, OnceLock};
+use std::sync::Arc;
 
 use parking_lot::RwLock;
 
 use crate::proto::sms::BackendInfo;
 
+use super::autosuspend::BackendActivity;
+
 #[derive(Clone, Debug, Default)]
 pub struct ManagedBackendRegistry {
     backends: Arc<RwLock<Vec<BackendInfo>>>,
     revision: Arc<AtomicU64>,
+    activity: Arc<BackendActivity>,
 }
 
 impl ManagedBackendRegistry {
@@ -29,12 +32,9 @@ impl ManagedBackendRegistry {
     pub fn revision(&self) -> u64 {
         self.revision.load(Ordering::Relaxed)
     }
-}
 
-static GLOBAL_MANAGED_BACKENDS: OnceLock<ManagedBackendRegistry> = OnceLock::new();
-
-pub fn global_managed_backends() -> ManagedBackendRegistry {
-    GLOBAL_MANAGED_BACKENDS
-        .get_or_init(ManagedBackendRegistry::new)
-        .clone()
+    /// Use of these backends, for autosuspend / 这些后端的使用情况，用于自动挂起
+    pub fn activity(&self) -> &Arc<BackendActivity> {
+        &self.activity
+    }
 }
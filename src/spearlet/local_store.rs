@@ -0,0 +1,92 @@
+//! Node-local KV stores for spearlet state / spearlet 状态使用的节点本地 KV 存储
+//!
+//! Task state and the async journal keep their records in a [`KvStore`] under the spearlet
+//! data directory, one key per record, so a write touches only that record. The store is
+//! opened on first use and closed when the owning subsystem is reconfigured.
+//! 任务状态与异步日志把记录保存在 spearlet 数据目录下的 [`KvStore`] 中，每条记录一个键，写入只涉及
+//! 该记录。存储在首次使用时打开，所属子系统重新配置时关闭。
+
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+use parking_lot::Mutex;
+
+use crate::storage::kv::{create_kv_store_from_config, KvStore, KvStoreConfig};
+
+/// Backends that keep their data across restarts / 重启后保留数据的后端
+pub const PERSISTENT_BACKENDS: &[&str] = &["sled", "rocksdb"];
+
+/// A store opened on first use / 首次使用时打开的存储
+#[derive(Default)]
+pub struct LocalStore {
+    open: Mutex<Option<(String, PathBuf, Arc<dyn KvStore>)>>,
+    /// Serializes opening, since a backend may lock its directory
+    /// 串行化打开操作，因为后端可能会锁定其目录
+    opening: tokio::sync::Mutex<()>,
+}
+
+impl LocalStore {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    fn current(&self, backend: &str, dir: &Path) -> Option<Arc<dyn KvStore>> {
+        match self.open.lock().as_ref() {
+            Some((b, d, store)) if b == backend && d == dir => Some(store.clone()),
+            _ => None,
+        }
+    }
+
+    /// The `backend` store in `dir`; another backend or directory closes the open one first
+    /// `dir` 中的 `backend` 存储；后端或目录不同时先关闭已打开的存储
+    pub async fn get(&self, backend: &str, dir: &Path) -> Result<Arc<dyn KvStore>, String> {
+        if let Some(store) = self.current(backend, dir) {
+            return Ok(store);
+        }
+        let _opening = self.opening.lock().await;
+        if let Some(store) = self.current(backend, dir) {
+            return Ok(store);
+        }
+        self.close();
+        let mut config = KvStoreConfig {
+            backend: backend.to_string(),
+            ..Default::default()
+        };
+        if PERSISTENT_BACKENDS.contains(&backend) {
+            std::fs::create_dir_all(dir).map_err(|e| format!("{}: {}", dir.display(), e))?;
+            config = config.with_param("path", dir.display().to_string());
+        }
+        let store: Arc<dyn KvStore> = create_kv_store_from_config(&config)
+            .await
+            .map_err(|e| format!("{} store in {}: {}", backend, dir.display(), e))?
+            .into();
+        *self.open.lock() = Some((backend.to_string(), dir.to_path_buf(), store.clone()));
+        Ok(store)
+    }
+
+    /// Close the store; calls still running keep it open until they finish
+    /// 关闭存储；仍在进行的调用结束前存储保持打开
+    pub fn close(&self) {
+        self.open.lock().take();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_store_is_reused_until_reconfigured() {
+        let dir = tempfile::tempdir().unwrap();
+        let local = LocalStore::new();
+        let a = local.get("memory", dir.path()).await.unwrap();
+        a.put(&"k".to_string(), &b"v".to_vec()).await.unwrap();
+        let b = local.get("memory", dir.path()).await.unwrap();
+        assert!(Arc::ptr_eq(&a, &b));
+
+        local.close();
+        let c = local.get("memory", dir.path()).await.unwrap();
+        assert_eq!(c.get(&"k".to_string()).await.unwrap(), None);
+        assert!(local.get("nope", dir.path()).await.is_err());
+    }
+}
@@ -0,0 +1,776 @@
+//! Locale and timezone settings for workloads
+//! 工作负载的区域与时区设置
+//!
+//! Without this module every workload sees the host defaults: a process started by
+//! the spearlet inherits no `TZ`, WASM guests only get UTC time, and template
+//! variables carry no local date. The timezone and locale are configured per spearlet
+//! (`spearlet.locale`) and can be overridden per workload through the task config keys
+//! `timezone` and `locale`.
+//! 若无本模块，所有工作负载都只能看到主机默认值：spearlet 启动的进程不继承 `TZ`，WASM
+//! 只能拿到 UTC 时间，模板变量也不含本地日期。时区与区域按 spearlet 配置
+//! （`spearlet.locale`），并可通过任务配置键 `timezone` 与 `locale` 按工作负载覆盖。
+//!
+//! Timezones are resolved without extra crates: `UTC`, fixed offsets such as `+08:00`
+//! or `UTC-5`, IANA names read from the system zoneinfo database (`$ZONEINFO` or
+//! `/usr/share/zoneinfo`), and POSIX TZ strings such as `CET-1CEST,M3.5.0,M10.5.0/3`.
+//! 时区解析不依赖额外 crate：支持 `UTC`、`+08:00` 或 `UTC-5` 等固定偏移、从系统 zoneinfo
+//! 数据库（`$ZONEINFO` 或 `/usr/share/zoneinfo`）读取的 IANA 名称，以及
+//! `CET-1CEST,M3.5.0,M10.5.0/3` 等 POSIX TZ 字符串。
+
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+use chrono::{DateTime, Datelike, FixedOffset, NaiveDate, NaiveDateTime, Utc};
+
+use crate::spearlet::config::SpearletConfig;
+
+/// Task config key overriding the timezone of one workload / 覆盖单个工作负载时区的任务配置键
+pub const TASK_CONFIG_TIMEZONE: &str = "timezone";
+/// Task config key overriding the locale of one workload / 覆盖单个工作负载区域的任务配置键
+pub const TASK_CONFIG_LOCALE: &str = "locale";
+
+const ZONEINFO_DIRS: &[&str] = &[
+    "/usr/share/zoneinfo",
+    "/usr/lib/zoneinfo",
+    "/usr/share/lib/zoneinfo",
+];
+
+/// One DST switch rule of the form `Mm.w.d[/time]` / `Mm.w.d[/time]` 形式的夏令时切换规则
+#[derive(Debug, Clone, PartialEq)]
+struct SwitchRule {
+    month: u32,
+    /// 1..=5, 5 meaning the last one in the month / 1..=5，5 表示当月最后一个
+    week: u32,
+    /// 0 = Sunday / 0 表示周日
+    weekday: u32,
+    /// Local time of the switch in seconds / 切换的本地时间（秒）
+    time_s: i64,
+}
+
+impl SwitchRule {
+    /// UTC instant of the switch in `year` while `offset_before` is in effect
+    /// `offset_before` 生效时该规则在 `year` 年切换的 UTC 时刻
+    fn instant(&self, year: i32, offset_before: i32) -> Option<i64> {
+        let first = NaiveDate::from_ymd_opt(year, self.month, 1)?;
+        let lead = (7 + self.weekday - first.weekday().num_days_from_sunday()) % 7;
+        let mut day = 1 + lead + (self.week - 1) * 7;
+        let (ny, nm) = if self.month == 12 {
+            (year + 1, 1)
+        } else {
+            (year, self.month + 1)
+        };
+        let days_in_month = NaiveDate::from_ymd_opt(ny, nm, 1)?
+            .signed_duration_since(first)
+            .num_days() as u32;
+        while day > days_in_month {
+            day -= 7;
+        }
+        let date = NaiveDate::from_ymd_opt(year, self.month, day)?;
+        let local = date.and_hms_opt(0, 0, 0)?.and_utc().timestamp() + self.time_s;
+        Some(local - offset_before as i64)
+    }
+}
+
+/// Daylight saving part of a POSIX TZ string / POSIX TZ 字符串中的夏令时部分
+#[derive(Debug, Clone, PartialEq)]
+struct DstRule {
+    offset: i32,
+    start: SwitchRule,
+    end: SwitchRule,
+}
+
+/// Parsed POSIX TZ string; offsets are seconds east of UTC
+/// 解析后的 POSIX TZ 字符串；偏移为 UTC 以东的秒数
+#[derive(Debug, Clone, PartialEq)]
+struct PosixTz {
+    std_offset: i32,
+    dst: Option<DstRule>,
+}
+
+impl PosixTz {
+    fn offset_at(&self, t: i64) -> i32 {
+        let Some(dst) = &self.dst else {
+            return self.std_offset;
+        };
+        let Some(year) = DateTime::from_timestamp(t + self.std_offset as i64, 0).map(|d| d.year())
+        else {
+            return self.std_offset;
+        };
+        let (Some(start), Some(end)) = (
+            dst.start.instant(year, self.std_offset),
+            dst.end.instant(year, dst.offset),
+        ) else {
+            return self.std_offset;
+        };
+        let in_dst = if start < end {
+            start <= t && t < end
+        } else {
+            // Southern hemisphere: DST spans the turn of the year / 南半球：夏令时跨年
+            !(end <= t && t < start)
+        };
+        if in_dst {
+            dst.offset
+        } else {
+            self.std_offset
+        }
+    }
+}
+
+/// Minimal cursor over a POSIX TZ string / POSIX TZ 字符串的简单游标
+struct Cursor<'a> {
+    s: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Cursor<'a> {
+    fn peek(&self) -> Option<u8> {
+        self.s.get(self.pos).copied()
+    }
+
+    fn eat(&mut self, c: u8) -> bool {
+        if self.peek() == Some(c) {
+            self.pos += 1;
+            true
+        } else {
+            false
+        }
+    }
+
+    fn done(&self) -> bool {
+        self.pos >= self.s.len()
+    }
+
+    fn number(&mut self) -> Option<i64> {
+        let start = self.pos;
+        while self.peek().is_some_and(|c| c.is_ascii_digit()) {
+            self.pos += 1;
+        }
+        std::str::from_utf8(&self.s[start..self.pos])
+            .ok()?
+            .parse()
+            .ok()
+    }
+
+    fn name(&mut self) -> Option<()> {
+        if self.eat(b'<') {
+            while self.peek()? != b'>' {
+                self.pos += 1;
+            }
+            self.pos += 1;
+            return Some(());
+        }
+        let start = self.pos;
+        while self.peek().is_some_and(|c| c.is_ascii_alphabetic()) {
+            self.pos += 1;
+        }
+        (self.pos - start >= 3).then_some(())
+    }
+
+    /// `[+-]hh[:mm[:ss]]` in seconds / `[+-]hh[:mm[:ss]]`，单位秒
+    fn hms(&mut self) -> Option<i64> {
+        let sign = if self.eat(b'-') {
+            -1
+        } else {
+            self.eat(b'+');
+            1
+        };
+        let mut secs = self.number()? * 3600;
+        if self.eat(b':') {
+            secs += self.number()? * 60;
+            if self.eat(b':') {
+                secs += self.number()?;
+            }
+        }
+        Some(sign * secs)
+    }
+
+    fn switch_rule(&mut self) -> Option<SwitchRule> {
+        if !self.eat(b'M') {
+            // Julian-day forms are not supported / 不支持儒略日形式
+            return None;
+        }
+        let month = self.number()? as u32;
+        self.eat(b'.').then_some(())?;
+        let week = self.number()? as u32;
+        self.eat(b'.').then_some(())?;
+        let weekday = self.number()? as u32;
+        let time_s = if self.eat(b'/') { self.hms()? } else { 7200 };
+        ((1..=12).contains(&month) && (1..=5).contains(&week) && weekday <= 6).then_some(
+            SwitchRule {
+                month,
+                week,
+                weekday,
+                time_s,
+            },
+        )
+    }
+}
+
+fn parse_posix(spec: &str) -> Option<PosixTz> {
+    let mut c = Cursor {
+        s: spec.as_bytes(),
+        pos: 0,
+    };
+    c.name()?;
+    // POSIX offsets count west of UTC / POSIX 偏移以 UTC 以西为正
+    let std_offset = -c.hms()? as i32;
+    if c.done() {
+        return Some(PosixTz {
+            std_offset,
+            dst: None,
+        });
+    }
+    c.name()?;
+    let offset = if c.done() || c.peek() == Some(b',') {
+        std_offset + 3600
+    } else {
+        -c.hms()? as i32
+    };
+    let (start, end) = if c.done() {
+        // Default rule of POSIX implementations (US) / POSIX 实现的默认规则（美国）
+        let mut d = Cursor {
+            s: b"M3.2.0,M11.1.0",
+            pos: 0,
+        };
+        let start = d.switch_rule()?;
+        d.eat(b',');
+        (start, d.switch_rule()?)
+    } else {
+        c.eat(b',').then_some(())?;
+        let start = c.switch_rule()?;
+        c.eat(b',').then_some(())?;
+        (start, c.switch_rule()?)
+    };
+    c.done().then_some(PosixTz {
+        std_offset,
+        dst: Some(DstRule { offset, start, end }),
+    })
+}
+
+/// Transition table loaded from a TZif file / 从 TZif 文件加载的切换表
+#[derive(Debug, Clone, PartialEq)]
+struct Tzif {
+    /// (UTC instant, offset after it), sorted / （UTC 时刻，其后的偏移），已排序
+    transitions: Vec<(i64, i32)>,
+    initial: i32,
+    /// Rule for instants after the last transition / 最后一次切换之后的规则
+    footer: Option<PosixTz>,
+}
+
+impl Tzif {
+    fn offset_at(&self, t: i64) -> i32 {
+        match self.transitions.last() {
+            Some((last, _)) if t >= *last && self.footer.is_some() => {
+                self.footer.as_ref().map(|f| f.offset_at(t)).unwrap_or(0)
+            }
+            None => self
+                .footer
+                .as_ref()
+                .map(|f| f.offset_at(t))
+                .unwrap_or(self.initial),
+            Some(_) => match self.transitions.partition_point(|(at, _)| *at <= t) {
+                0 => self.initial,
+                i => self.transitions[i - 1].1,
+            },
+        }
+    }
+}
+
+fn be_u32(data: &[u8], at: usize) -> Option<u32> {
+    Some(u32::from_be_bytes(data.get(at..at + 4)?.try_into().ok()?))
+}
+
+fn be_i64(data: &[u8], at: usize) -> Option<i64> {
+    Some(i64::from_be_bytes(data.get(at..at + 8)?.try_into().ok()?))
+}
+
+/// Parse one header and data block; returns the table and the end offset
+/// 解析一个头部与数据块；返回切换表与结束位置
+fn parse_tzif_block(data: &[u8], at: usize, time_size: usize) -> Option<(Tzif, usize)> {
+    if data.get(at..at + 4)? != b"TZif" {
+        return None;
+    }
+    let count = |i: usize| be_u32(data, at + 20 + i * 4).map(|v| v as usize);
+    let (isut, isstd, leap, timecnt, typecnt, charcnt) = (
+        count(0)?,
+        count(1)?,
+        count(2)?,
+        count(3)?,
+        count(4)?,
+        count(5)?,
+    );
+    if typecnt == 0 {
+        return None;
+    }
+    let times_at = at + 44;
+    let idx_at = times_at + timecnt * time_size;
+    let types_at = idx_at + timecnt;
+    let end = types_at + typecnt * 6 + charcnt + leap * (time_size + 4) + isstd + isut;
+    if data.len() < end {
+        return None;
+    }
+
+    let mut types = Vec::with_capacity(typecnt);
+    for i in 0..typecnt {
+        let p = types_at + i * 6;
+        types.push((be_u32(data, p)? as i32, data[p + 4] != 0));
+    }
+    let mut transitions = Vec::with_capacity(timecnt);
+    for i in 0..timecnt {
+        let p = times_at + i * time_size;
+        let t = if time_size == 8 {
+            be_i64(data, p)?
+        } else {
+            be_u32(data, p)? as i32 as i64
+        };
+        let (offset, _) = *types.get(data[idx_at + i] as usize)?;
+        transitions.push((t, offset));
+    }
+    let initial = types.iter().find(|(_, dst)| !dst).unwrap_or(&types[0]).0;
+    Some((
+        Tzif {
+            transitions,
+            initial,
+            footer: None,
+        },
+        end,
+    ))
+}
+
+fn parse_tzif(data: &[u8]) -> Option<Tzif> {
+    let (v1, end) = parse_tzif_block(data, 0, 4)?;
+    if data[4] < b'2' {
+        return Some(v1);
+    }
+    let (mut v2, end) = parse_tzif_block(data, end, 8)?;
+    // Footer: "\n<POSIX TZ>\n" / 尾部："\n<POSIX TZ>\n"
+    let footer = data.get(end..).unwrap_or_default();
+    if let Some(s) = footer
+        .strip_prefix(b"\n")
+        .and_then(|f| f.split(|b| *b == b'\n').next())
+        .and_then(|f| std::str::from_utf8(f).ok())
+    {
+        v2.footer = parse_posix(s.trim());
+    }
+    Some(v2)
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Rules {
+    Fixed(i32),
+    Posix(PosixTz),
+    Tzif(Tzif),
+}
+
+/// A resolved timezone / 已解析的时区
+#[derive(Debug, Clone, PartialEq)]
+pub struct TimeZone {
+    name: String,
+    rules: Arc<Rules>,
+    /// Follows the host default rather than an explicit setting / 跟随主机默认而非显式设置
+    host: bool,
+}
+
+fn format_offset(secs: i32) -> String {
+    let sign = if secs < 0 { '-' } else { '+' };
+    let abs = secs.unsigned_abs();
+    format!("{}{:02}:{:02}", sign, abs / 3600, (abs % 3600) / 60)
+}
+
+fn parse_fixed(spec: &str) -> Option<i32> {
+    let upper = spec.to_ascii_uppercase();
+    let rest = upper
+        .strip_prefix("UTC")
+        .or_else(|| upper.strip_prefix("GMT"))
+        .unwrap_or(&upper);
+    let (sign, digits) = match rest.as_bytes().first()? {
+        b'+' => (1, &rest[1..]),
+        b'-' => (-1, &rest[1..]),
+        _ => return None,
+    };
+    let (h, m) = match digits.split_once(':') {
+        Some((h, m)) => (h, m),
+        None if digits.len() == 4 => digits.split_at(2),
+        None => (digits, "0"),
+    };
+    let (h, m): (i32, i32) = (h.parse().ok()?, m.parse().ok()?);
+    (h <= 14 && m < 60 && !digits.is_empty()).then_some(sign * (h * 3600 + m * 60))
+}
+
+fn zoneinfo_path(name: &str) -> Option<PathBuf> {
+    let valid = !name.starts_with('/')
+        && !name
+            .split('/')
+            .any(|p| p.is_empty() || p == "." || p == "..")
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '/' | '_' | '-' | '+'));
+    if !valid {
+        return None;
+    }
+    let env_dir = std::env::var("ZONEINFO").ok().filter(|d| !d.is_empty());
+    env_dir
+        .iter()
+        .map(String::as_str)
+        .chain(ZONEINFO_DIRS.iter().copied())
+        .map(|dir| PathBuf::from(dir).join(name))
+        .find(|p| p.is_file())
+}
+
+impl TimeZone {
+    /// UTC / 协调世界时
+    pub fn utc() -> Self {
+        Self {
+            name: "UTC".to_string(),
+            rules: Arc::new(Rules::Fixed(0)),
+            host: false,
+        }
+    }
+
+    /// Host default: `$TZ`, then `/etc/localtime`, then UTC
+    /// 主机默认：依次尝试 `$TZ`、`/etc/localtime`，最后为 UTC
+    pub fn host() -> Self {
+        let from_env = std::env::var("TZ")
+            .ok()
+            .map(|v| v.trim_start_matches(':').trim().to_string())
+            .filter(|v| !v.is_empty())
+            .and_then(|v| Self::parse(&v).ok());
+        let tz = from_env.or_else(|| {
+            let data = std::fs::read("/etc/localtime").ok()?;
+            Some(Self {
+                name: "localtime".to_string(),
+                rules: Arc::new(Rules::Tzif(parse_tzif(&data)?)),
+                host: true,
+            })
+        });
+        let mut tz = tz.unwrap_or_else(Self::utc);
+        tz.host = true;
+        tz
+    }
+
+    /// Parse a timezone setting; an empty string means the host default
+    /// 解析时区设置；空字符串表示主机默认
+    pub fn parse(spec: &str) -> Result<Self, String> {
+        let spec = spec.trim();
+        if spec.is_empty() {
+            return Ok(Self::host());
+        }
+        if matches!(
+            spec.to_ascii_uppercase().as_str(),
+            "UTC" | "Z" | "GMT" | "ETC/UTC"
+        ) {
+            return Ok(Self::utc());
+        }
+        if let Some(secs) = parse_fixed(spec) {
+            return Ok(Self {
+                name: format_offset(secs),
+                rules: Arc::new(Rules::Fixed(secs)),
+                host: false,
+            });
+        }
+        if let Some(path) = zoneinfo_path(spec) {
+            let data = std::fs::read(&path)
+                .map_err(|e| format!("read zoneinfo {}: {}", path.display(), e))?;
+            let tzif = parse_tzif(&data)
+                .ok_or_else(|| format!("invalid zoneinfo file {}", path.display()))?;
+            return Ok(Self {
+                name: spec.to_string(),
+                rules: Arc::new(Rules::Tzif(tzif)),
+                host: false,
+            });
+        }
+        if let Some(posix) = parse_posix(spec) {
+            return Ok(Self {
+                name: spec.to_string(),
+                rules: Arc::new(Rules::Posix(posix)),
+                host: false,
+            });
+        }
+        Err(format!("unknown timezone '{}'", spec))
+    }
+
+    /// Name as configured, e.g. `Asia/Shanghai` or `+08:00` / 配置的名称，如 `Asia/Shanghai` 或 `+08:00`
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    /// Whether this is the host default / 是否为主机默认
+    pub fn is_host(&self) -> bool {
+        self.host
+    }
+
+    /// Offset from UTC in seconds at a Unix timestamp / 指定 Unix 时间戳处相对 UTC 的偏移（秒）
+    pub fn offset_at(&self, unix_s: i64) -> i32 {
+        match self.rules.as_ref() {
+            Rules::Fixed(secs) => *secs,
+            Rules::Posix(p) => p.offset_at(unix_s),
+            Rules::Tzif(t) => t.offset_at(unix_s),
+        }
+    }
+
+    /// Convert a UTC instant to local time / 将 UTC 时刻转换为本地时间
+    pub fn to_local(&self, at: DateTime<Utc>) -> DateTime<FixedOffset> {
+        let offset = FixedOffset::east_opt(self.offset_at(at.timestamp()))
+            .unwrap_or_else(|| FixedOffset::east_opt(0).unwrap());
+        at.with_timezone(&offset)
+    }
+
+    /// Resolve a local wall-clock time, e.g. a schedule entry, to UTC. Times skipped
+    /// by a DST switch resolve with the offset before the switch.
+    /// 将本地墙上时间（如调度条目）解析为 UTC。被夏令时切换跳过的时间按切换前的偏移解析。
+    pub fn to_utc(&self, local: NaiveDateTime) -> DateTime<Utc> {
+        let wall = local.and_utc().timestamp();
+        // Offsets a day around cover any single switch; the earlier one wins on overlaps
+        // 前后一天的偏移覆盖任意一次切换；重叠时取较早的时刻
+        let before = self.offset_at(wall - 86_400);
+        let after = self.offset_at(wall + 86_400);
+        let utc = [before, after]
+            .into_iter()
+            .map(|o| wall - o as i64)
+            .find(|utc| self.offset_at(*utc) as i64 == wall - utc)
+            .unwrap_or(wall - before as i64);
+        DateTime::from_timestamp(utc, 0).unwrap_or_default()
+    }
+
+    /// Value for the `TZ` environment variable of a workload / 工作负载 `TZ` 环境变量的取值
+    pub fn tz_env(&self) -> String {
+        match self.rules.as_ref() {
+            Rules::Fixed(0) => "UTC".to_string(),
+            Rules::Fixed(secs) => {
+                let name = format_offset(*secs).replace(':', "");
+                format!("<{}>{}", name, format_offset(-*secs))
+            }
+            _ => self.name.clone(),
+        }
+    }
+}
+
+/// Locale and timezone of one workload / 单个工作负载的区域与时区
+#[derive(Debug, Clone, PartialEq)]
+pub struct LocaleSettings {
+    pub timezone: TimeZone,
+    /// BCP 47 or POSIX locale such as `zh-CN`; `None` follows the host
+    /// BCP 47 或 POSIX 区域，如 `zh-CN`；`None` 表示跟随主机
+    pub locale: Option<String>,
+}
+
+impl Default for LocaleSettings {
+    fn default() -> Self {
+        Self {
+            timezone: TimeZone::host(),
+            locale: None,
+        }
+    }
+}
+
+impl LocaleSettings {
+    /// Spearlet-wide settings / spearlet 级设置
+    pub fn from_config(spearlet_config: Option<&SpearletConfig>) -> Self {
+        Self::resolve(&HashMap::new(), spearlet_config)
+    }
+
+    /// Settings of a workload: task config keys override the spearlet config. An
+    /// invalid timezone is logged and falls back to the next level.
+    /// 工作负载的设置：任务配置键覆盖 spearlet 配置。无效时区会记录日志并回退到上一级。
+    pub fn resolve(
+        task_config: &HashMap<String, String>,
+        spearlet_config: Option<&SpearletConfig>,
+    ) -> Self {
+        let node = spearlet_config.map(|c| &c.locale);
+        let timezone = [
+            task_config.get(TASK_CONFIG_TIMEZONE).map(String::as_str),
+            node.map(|c| c.timezone.as_str()),
+        ]
+        .into_iter()
+        .flatten()
+        .filter(|s| !s.trim().is_empty())
+        .find_map(|spec| match TimeZone::parse(spec) {
+            Ok(tz) => Some(tz),
+            Err(e) => {
+                tracing::warn!(timezone = spec, error = %e, "Ignoring invalid timezone");
+                None
+            }
+        })
+        .unwrap_or_else(TimeZone::host);
+        let locale = [task_config.get(TASK_CONFIG_LOCALE), node.map(|c| &c.locale)]
+            .into_iter()
+            .flatten()
+            .map(|s| s.trim())
+            .find(|s| !s.is_empty())
+            .map(str::to_string);
+        Self { timezone, locale }
+    }
+
+    /// Current local time / 当前本地时间
+    pub fn now(&self) -> DateTime<FixedOffset> {
+        self.timezone.to_local(Utc::now())
+    }
+
+    /// Environment variables for process and container workloads; only explicit
+    /// settings are exported so that unset values keep following the host
+    /// 进程与容器工作负载的环境变量；仅导出显式设置，未设置的值继续跟随主机
+    pub fn environment(&self) -> Vec<(String, String)> {
+        let mut out = Vec::new();
+        if !self.timezone.is_host() {
+            out.push(("TZ".to_string(), self.timezone.tz_env()));
+        }
+        if let Some(locale) = &self.locale {
+            let posix = if locale.contains('.') || locale == "C" || locale == "POSIX" {
+                locale.clone()
+            } else {
+                format!("{}.UTF-8", locale.replace('-', "_"))
+            };
+            out.push(("LANG".to_string(), posix.clone()));
+            out.push(("LC_ALL".to_string(), posix));
+            out.push(("SPEAR_LOCALE".to_string(), locale.clone()));
+        }
+        out
+    }
+
+    /// Time and locale variables for template rendering at `at`
+    /// 模板渲染在 `at` 时刻使用的时间与区域变量
+    pub fn template_vars(&self, at: DateTime<Utc>) -> HashMap<String, String> {
+        let local = self.timezone.to_local(at);
+        let mut vars = HashMap::new();
+        vars.insert(
+            "now".to_string(),
+            local.to_rfc3339_opts(chrono::SecondsFormat::Secs, false),
+        );
+        vars.insert("date".to_string(), local.format("%Y-%m-%d").to_string());
+        vars.insert("time".to_string(), local.format("%H:%M:%S").to_string());
+        vars.insert("weekday".to_string(), local.format("%A").to_string());
+        vars.insert("timezone".to_string(), self.timezone.name().to_string());
+        vars.insert(
+            "utc_offset".to_string(),
+            format_offset(local.offset().local_minus_utc()),
+        );
+        vars.insert(
+            "locale".to_string(),
+            self.locale.clone().unwrap_or_default(),
+        );
+        vars
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use chrono::TimeZone as _;
+
+    fn ts(y: i32, mo: u32, d: u32, h: u32, mi: u32) -> i64 {
+        Utc.with_ymd_and_hms(y, mo, d, h, mi, 0)
+            .unwrap()
+            .timestamp()
+    }
+
+    #[test]
+    fn test_fixed_offsets() {
+        let tz = TimeZone::parse("+08:00").unwrap();
+        assert_eq!(tz.name(), "+08:00");
+        assert_eq!(tz.offset_at(0), 8 * 3600);
+        assert_eq!(tz.tz_env(), "<+0800>-08:00");
+        assert_eq!(TimeZone::parse("UTC-0530").unwrap().offset_at(0), -19_800);
+        assert_eq!(TimeZone::parse("GMT+5").unwrap().offset_at(0), 5 * 3600);
+        assert_eq!(TimeZone::parse("utc").unwrap().tz_env(), "UTC");
+        assert!(TimeZone::parse("+25:00").is_err());
+        assert!(TimeZone::parse("../../etc/passwd").is_err());
+    }
+
+    #[test]
+    fn test_posix_rules() {
+        let tz = TimeZone::parse("CET-1CEST,M3.5.0,M10.5.0/3").unwrap();
+        assert_eq!(tz.offset_at(ts(2024, 3, 31, 0, 59)), 3600);
+        assert_eq!(tz.offset_at(ts(2024, 3, 31, 1, 0)), 7200);
+        assert_eq!(tz.offset_at(ts(2024, 10, 27, 0, 59)), 7200);
+        assert_eq!(tz.offset_at(ts(2024, 10, 27, 1, 0)), 3600);
+
+        // Southern hemisphere / 南半球
+        let tz = TimeZone::parse("AEST-10AEDT,M10.1.0,M4.1.0/3").unwrap();
+        assert_eq!(tz.offset_at(ts(2024, 1, 15, 0, 0)), 11 * 3600);
+        assert_eq!(tz.offset_at(ts(2024, 7, 15, 0, 0)), 10 * 3600);
+
+        // Local 02:30 does not exist on the spring switch / 春季切换当天本地 02:30 不存在
+        let tz = TimeZone::parse("EST5EDT").unwrap();
+        let local = NaiveDate::from_ymd_opt(2024, 3, 10)
+            .unwrap()
+            .and_hms_opt(2, 30, 0)
+            .unwrap();
+        assert_eq!(tz.to_utc(local).timestamp(), ts(2024, 3, 10, 7, 30));
+        let local = NaiveDate::from_ymd_opt(2024, 7, 1)
+            .unwrap()
+            .and_hms_opt(9, 0, 0)
+            .unwrap();
+        assert_eq!(tz.to_utc(local).timestamp(), ts(2024, 7, 1, 13, 0));
+    }
+
+    fn tzif_v2(transitions: &[(i64, u8)], types: &[(i32, bool)], footer: &str) -> Vec<u8> {
+        let header = |timecnt: usize, typecnt: usize, charcnt: usize| {
+            let mut h = b"TZif2".to_vec();
+            h.extend([0u8; 15]);
+            for n in [0, 0, 0, timecnt, typecnt, charcnt] {
+                h.extend((n as u32).to_be_bytes());
+            }
+            h
+        };
+        // Empty v1 block with a single UTC type / 仅含一个 UTC 类型的空 v1 块
+        let mut out = header(0, 1, 1);
+        out.extend([0, 0, 0, 0, 0, 0, 0]);
+        out.extend(header(transitions.len(), types.len(), 1));
+        for (t, _) in transitions {
+            out.extend(t.to_be_bytes());
+        }
+        out.extend(transitions.iter().map(|(_, i)| *i));
+        for (off, dst) in types {
+            out.extend(off.to_be_bytes());
+            out.extend([*dst as u8, 0]);
+        }
+        out.push(0);
+        out.extend(format!("\n{}\n", footer).into_bytes());
+        out
+    }
+
+    #[test]
+    fn test_tzif_with_footer() {
+        // Shanghai-like table: one historic DST period, then a fixed rule
+        // 类似上海的表：一段历史夏令时，之后为固定规则
+        let data = tzif_v2(
+            &[(ts(1991, 4, 13, 18, 0), 1), (ts(1991, 9, 14, 17, 0), 0)],
+            &[(28_800, false), (32_400, true)],
+            "CST-8",
+        );
+        let tzif = parse_tzif(&data).unwrap();
+        assert_eq!(tzif.offset_at(ts(1980, 1, 1, 0, 0)), 28_800);
+        assert_eq!(tzif.offset_at(ts(1991, 6, 1, 0, 0)), 32_400);
+        assert_eq!(tzif.offset_at(ts(2030, 6, 1, 0, 0)), 28_800);
+        assert!(parse_tzif(&data[..40]).is_none());
+    }
+
+    #[test]
+    fn test_resolve_task_overrides_node() {
+        let mut cfg = SpearletConfig::default();
+        cfg.locale.timezone = "+01:00".to_string();
+        cfg.locale.locale = "de-DE".to_string();
+
+        let node = LocaleSettings::from_config(Some(&cfg));
+        assert_eq!(node.timezone.name(), "+01:00");
+        let env: HashMap<_, _> = node.environment().into_iter().collect();
+        assert_eq!(env.get("LANG").map(String::as_str), Some("de_DE.UTF-8"));
+
+        let mut task = HashMap::new();
+        task.insert(TASK_CONFIG_TIMEZONE.to_string(), "+09:00".to_string());
+        task.insert(TASK_CONFIG_LOCALE.to_string(), "ja-JP".to_string());
+        let s = LocaleSettings::resolve(&task, Some(&cfg));
+        assert_eq!(s.timezone.name(), "+09:00");
+        let vars = s.template_vars(Utc.with_ymd_and_hms(2024, 12, 31, 20, 0, 0).unwrap());
+        assert_eq!(vars["date"], "2025-01-01");
+        assert_eq!(vars["time"], "05:00:00");
+        assert_eq!(vars["utc_offset"], "+09:00");
+        assert_eq!(vars["locale"], "ja-JP");
+
+        // Invalid task value falls back to the node setting / 无效任务值回退到节点设置
+        task.insert(TASK_CONFIG_TIMEZONE.to_string(), "Nowhere/Land".to_string());
+        let s = LocaleSettings::resolve(&task, Some(&cfg));
+        assert_eq!(s.timezone.name(), "+01:00");
+    }
+}
@@ -0,0 +1,805 @@
+//! Remote log shipping / 远程日志投递
+//!
+//! Operators often cannot log in to the devices they run, so the spearlet can ship its
+//! own logs to Loki (push API) or to an OTLP/HTTP collector. [`ShipLayer`] captures
+//! events from the tracing subscriber, capped at `max_lines_per_second`, and the shipper
+//! uploads them in batches within a byte budget per hour. Batches that cannot be sent are
+//! spooled to disk and uploaded once the endpoint is reachable again, also after a
+//! restart. When the spool is full the oldest batches are dropped. Dropped lines are
+//! reported in a warning line of their own.
+//! 运维人员常常无法登录其运行的设备，因此 spearlet 可以把自身日志投递到 Loki（推送 API）
+//! 或 OTLP/HTTP 采集器。[`ShipLayer`] 从 tracing subscriber 采集事件，受 `max_lines_per_second`
+//! 限制；投递器按批次上传，受每小时字节预算限制。无法发送的批次会写入磁盘缓存，在端点恢复
+//! 可达后（包括重启后）再上传。缓存满时丢弃最旧的批次。丢弃的行数会以一条单独的警告日志上报。
+
+use std::collections::{BTreeMap, VecDeque};
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, OnceLock};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use parking_lot::Mutex;
+use serde::{Deserialize, Serialize};
+use tokio::sync::mpsc;
+use tokio::task::JoinHandle;
+use tokio::time::{interval, timeout, MissedTickBehavior};
+use tokio_util::sync::CancellationToken;
+use tracing::field::{Field, Visit};
+use tracing::{info, warn, Event, Level, Subscriber};
+use tracing_subscriber::layer::Context;
+use tracing_subscriber::Layer;
+
+use crate::spearlet::config::{LogShippingConfig, SpearletConfig};
+use crate::spearlet::metrics_export::ByteBudget;
+use crate::spearlet::otel;
+
+/// `log_shipping.protocol` values / `log_shipping.protocol` 的取值
+pub const PROTOCOL_LOKI: &str = "loki";
+pub const PROTOCOL_OTLP: &str = "otlp";
+pub const PROTOCOLS: &[&str] = &[PROTOCOL_LOKI, PROTOCOL_OTLP];
+
+/// Never shipped, so failed uploads do not feed on their own logs
+/// 从不投递，避免上传失败的日志反过来被投递
+const SKIPPED_TARGETS: &[&str] = &[module_path!(), "hyper", "reqwest", "h2", "rustls"];
+
+const MAX_MESSAGE_BYTES: usize = 8 * 1024;
+const MAX_FIELDS: usize = 32;
+const UPLOAD_TIMEOUT: Duration = Duration::from_secs(10);
+const MAX_BACKOFF: Duration = Duration::from_secs(60);
+
+/// One captured log event / 一条采集到的日志事件
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LogRecord {
+    pub time_unix_nanos: u64,
+    /// Lower-case level, e.g. `warn` / 小写级别，如 `warn`
+    pub level: String,
+    pub target: String,
+    pub message: String,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub fields: BTreeMap<String, String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub trace_id: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub span_id: Option<String>,
+}
+
+impl LogRecord {
+    fn now(level: Level, target: &str, message: String) -> Self {
+        Self {
+            time_unix_nanos: unix_nanos(),
+            level: level.as_str().to_ascii_lowercase(),
+            target: target.to_string(),
+            message,
+            fields: BTreeMap::new(),
+            trace_id: None,
+            span_id: None,
+        }
+    }
+}
+
+fn unix_nanos() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_nanos() as u64
+}
+
+fn truncate(mut s: String, max: usize) -> String {
+    if s.len() > max {
+        let mut end = max;
+        while !s.is_char_boundary(end) {
+            end -= 1;
+        }
+        s.truncate(end);
+    }
+    s
+}
+
+/// Lines allowed per one-second window / 每个一秒窗口允许的行数
+#[derive(Debug)]
+struct LineLimiter {
+    /// 0 means unlimited / 0 表示不限制
+    per_second: u32,
+    window_start: Instant,
+    used: u32,
+}
+
+impl LineLimiter {
+    fn new(per_second: u32, now: Instant) -> Self {
+        Self {
+            per_second,
+            window_start: now,
+            used: 0,
+        }
+    }
+
+    fn allow(&mut self, now: Instant) -> bool {
+        if self.per_second == 0 {
+            return true;
+        }
+        if now.saturating_duration_since(self.window_start) >= Duration::from_secs(1) {
+            self.window_start = now;
+            self.used = 0;
+        }
+        if self.used >= self.per_second {
+            return false;
+        }
+        self.used += 1;
+        true
+    }
+}
+
+struct Sink {
+    tx: mpsc::Sender<LogRecord>,
+    max_level: Level,
+    limiter: Mutex<LineLimiter>,
+    /// Lines lost to the rate cap or a full queue / 因速率上限或队列已满丢失的行数
+    dropped: AtomicU64,
+}
+
+static SINK: OnceLock<Sink> = OnceLock::new();
+
+#[derive(Default)]
+struct FieldVisitor {
+    message: String,
+    fields: BTreeMap<String, String>,
+}
+
+impl FieldVisitor {
+    fn put(&mut self, field: &Field, value: String) {
+        if field.name() == "message" {
+            self.message = value;
+        } else if self.fields.len() < MAX_FIELDS {
+            self.fields.insert(field.name().to_string(), value);
+        }
+    }
+}
+
+impl Visit for FieldVisitor {
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.put(field, value.to_string());
+    }
+
+    fn record_debug(&mut self, field: &Field, value: &dyn std::fmt::Debug) {
+        self.put(field, format!("{:?}", value));
+    }
+}
+
+/// Layer feeding the shipper; inert until [`LogShipper::start`]
+/// 向投递器提供日志的 layer；在 [`LogShipper::start`] 之前不做任何事
+#[derive(Debug, Clone, Copy, Default)]
+pub struct ShipLayer;
+
+impl<S: Subscriber> Layer<S> for ShipLayer {
+    fn on_event(&self, event: &Event<'_>, _ctx: Context<'_, S>) {
+        let Some(sink) = SINK.get() else {
+            return;
+        };
+        let meta = event.metadata();
+        if *meta.level() > sink.max_level
+            || SKIPPED_TARGETS.iter().any(|t| meta.target().starts_with(t))
+        {
+            return;
+        }
+        if !sink.limiter.lock().allow(Instant::now()) {
+            sink.dropped.fetch_add(1, Ordering::Relaxed);
+            return;
+        }
+        let mut visitor = FieldVisitor::default();
+        event.record(&mut visitor);
+        let mut record = LogRecord::now(
+            *meta.level(),
+            meta.target(),
+            truncate(visitor.message, MAX_MESSAGE_BYTES),
+        );
+        record.fields = visitor.fields;
+        if let Some(ctx) = otel::current() {
+            record.trace_id = Some(otel::encode_hex(&ctx.trace_id));
+            record.span_id = Some(otel::encode_hex(&ctx.span_id));
+        }
+        if sink.tx.try_send(record).is_err() {
+            sink.dropped.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+}
+
+#[derive(Debug)]
+struct Spooled {
+    seq: u64,
+    lines: u64,
+    bytes: u64,
+    /// `None` once written to the spool directory / 写入缓存目录后为 `None`
+    body: Option<Vec<u8>>,
+}
+
+/// Batches waiting for upload, oldest first / 等待上传的批次，最旧的在前
+///
+/// Batches stay in memory while uploads succeed and are written to the directory once an
+/// upload fails, so a healthy node does not wear its flash.
+/// 上传成功时批次留在内存中，上传失败后才写入目录，避免正常节点磨损闪存。
+#[derive(Debug)]
+struct Spool {
+    dir: Option<PathBuf>,
+    max_bytes: u64,
+    batches: VecDeque<Spooled>,
+    bytes: u64,
+    next_seq: u64,
+    /// Lines in batches dropped for space / 因空间不足丢弃的批次中的行数
+    dropped_lines: u64,
+}
+
+impl Spool {
+    /// Open the spool and pick up batches left by a previous run
+    /// 打开缓存并接管上次运行遗留的批次
+    fn open(dir: Option<PathBuf>, max_bytes: u64) -> Self {
+        let mut spool = Self {
+            dir,
+            max_bytes: max_bytes.max(1),
+            batches: VecDeque::new(),
+            bytes: 0,
+            next_seq: 1,
+            dropped_lines: 0,
+        };
+        if let Some(dir) = spool.dir.clone() {
+            if let Err(e) = std::fs::create_dir_all(&dir) {
+                warn!(dir = %dir.display(), error = %e, "log spool unavailable, using memory");
+                spool.dir = None;
+                return spool;
+            }
+            let mut found: Vec<Spooled> = std::fs::read_dir(&dir)
+                .into_iter()
+                .flatten()
+                .flatten()
+                .filter_map(|e| {
+                    let (seq, lines) = parse_file_name(&e.file_name().to_string_lossy())?;
+                    let bytes = e.metadata().ok()?.len();
+                    Some(Spooled {
+                        seq,
+                        lines,
+                        bytes,
+                        body: None,
+                    })
+                })
+                .collect();
+            found.sort_by_key(|b| b.seq);
+            for b in found {
+                spool.next_seq = spool.next_seq.max(b.seq + 1);
+                spool.bytes += b.bytes;
+                spool.batches.push_back(b);
+            }
+            spool.trim();
+        }
+        spool
+    }
+
+    fn len(&self) -> usize {
+        self.batches.len()
+    }
+
+    fn is_empty(&self) -> bool {
+        self.batches.is_empty()
+    }
+
+    fn push(&mut self, records: &[LogRecord]) {
+        if records.is_empty() {
+            return;
+        }
+        let Ok(body) = serde_json::to_vec(records) else {
+            return;
+        };
+        let bytes = body.len() as u64;
+        self.batches.push_back(Spooled {
+            seq: self.next_seq,
+            lines: records.len() as u64,
+            bytes,
+            body: Some(body),
+        });
+        self.next_seq += 1;
+        self.bytes += bytes;
+        self.trim();
+    }
+
+    fn trim(&mut self) {
+        while self.bytes > self.max_bytes && self.batches.len() > 1 {
+            if let Some(b) = self.batches.pop_front() {
+                self.dropped_lines += b.lines;
+                self.forget(&b);
+            }
+        }
+    }
+
+    fn forget(&mut self, b: &Spooled) {
+        self.bytes = self.bytes.saturating_sub(b.bytes);
+        if b.body.is_none() {
+            if let Some(dir) = &self.dir {
+                let _ = std::fs::remove_file(dir.join(file_name(b.seq, b.lines)));
+            }
+        }
+    }
+
+    /// Oldest batch; unreadable files are skipped / 最旧的批次；跳过无法读取的文件
+    fn front(&mut self) -> Option<Vec<LogRecord>> {
+        loop {
+            let b = self.batches.front()?;
+            let body = match (&b.body, &self.dir) {
+                (Some(body), _) => Some(body.clone()),
+                (None, Some(dir)) => std::fs::read(dir.join(file_name(b.seq, b.lines))).ok(),
+                (None, None) => None,
+            };
+            if let Some(records) = body.and_then(|v| serde_json::from_slice(&v).ok()) {
+                return Some(records);
+            }
+            self.pop_front();
+        }
+    }
+
+    fn pop_front(&mut self) {
+        if let Some(b) = self.batches.pop_front() {
+            self.forget(&b);
+        }
+    }
+
+    /// Write batches held in memory to the directory / 将内存中的批次写入目录
+    fn persist(&mut self) {
+        let Some(dir) = self.dir.clone() else {
+            return;
+        };
+        for b in self.batches.iter_mut() {
+            let Some(body) = b.body.as_ref() else {
+                continue;
+            };
+            match std::fs::write(dir.join(file_name(b.seq, b.lines)), body) {
+                Ok(()) => b.body = None,
+                Err(e) => {
+                    warn!(dir = %dir.display(), error = %e, "log spool write failed");
+                    return;
+                }
+            }
+        }
+    }
+}
+
+fn file_name(seq: u64, lines: u64) -> String {
+    format!("{:020}-{}.json", seq, lines)
+}
+
+fn parse_file_name(name: &str) -> Option<(u64, u64)> {
+    let (seq, lines) = name.strip_suffix(".json")?.split_once('-')?;
+    Some((seq.parse().ok()?, lines.parse().ok()?))
+}
+
+/// Spool directory of the shipper / 投递器的缓存目录
+pub fn spool_dir(config: &SpearletConfig) -> PathBuf {
+    if config.log_shipping.spool_dir.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("log-spool")
+    } else {
+        PathBuf::from(&config.log_shipping.spool_dir)
+    }
+}
+
+/// Upload URL for the configured protocol / 所配置协议的上传 URL
+pub fn push_url(protocol: &str, endpoint: &str) -> String {
+    let base = endpoint.trim().trim_end_matches('/');
+    let path = if protocol == PROTOCOL_OTLP {
+        "/v1/logs"
+    } else {
+        "/loki/api/v1/push"
+    };
+    if base.ends_with(path) {
+        base.to_string()
+    } else {
+        format!("{}{}", base, path)
+    }
+}
+
+/// Stream labels (Loki) or resource attributes (OTLP) of this node
+/// 本节点的流标签（Loki）或资源属性（OTLP）
+fn node_labels(config: &SpearletConfig) -> Vec<(String, String)> {
+    let cfg = &config.log_shipping;
+    let mut labels: BTreeMap<String, String> = if cfg.protocol == PROTOCOL_OTLP {
+        BTreeMap::from([
+            ("service.name".to_string(), "spearlet".to_string()),
+            (
+                "service.instance.id".to_string(),
+                config.compute_node_uuid(),
+            ),
+            ("host.name".to_string(), config.node_name.clone()),
+        ])
+    } else {
+        BTreeMap::from([
+            ("service_name".to_string(), "spearlet".to_string()),
+            ("node".to_string(), config.node_name.clone()),
+        ])
+    };
+    labels.extend(cfg.labels.clone());
+    labels.into_iter().collect()
+}
+
+fn line_json(r: &LogRecord) -> serde_json::Value {
+    let mut line = serde_json::json!({ "msg": r.message, "target": r.target });
+    for (k, v) in &r.fields {
+        line[k] = serde_json::Value::String(v.clone());
+    }
+    if let Some(t) = &r.trace_id {
+        line["trace_id"] = serde_json::Value::String(t.clone());
+    }
+    if let Some(s) = &r.span_id {
+        line["span_id"] = serde_json::Value::String(s.clone());
+    }
+    line
+}
+
+/// Encode records as a Loki push request, one stream per level
+/// 将记录编码为 Loki 推送请求，每个级别一个流
+pub fn encode_loki(labels: &[(String, String)], records: &[LogRecord]) -> serde_json::Value {
+    let mut by_level: BTreeMap<&str, Vec<serde_json::Value>> = BTreeMap::new();
+    for r in records {
+        by_level
+            .entry(r.level.as_str())
+            .or_default()
+            .push(serde_json::json!([
+                r.time_unix_nanos.to_string(),
+                line_json(r).to_string()
+            ]));
+    }
+    let streams: Vec<serde_json::Value> = by_level
+        .into_iter()
+        .map(|(level, values)| {
+            let mut stream: serde_json::Map<String, serde_json::Value> = labels
+                .iter()
+                .map(|(k, v)| (k.clone(), serde_json::Value::String(v.clone())))
+                .collect();
+            stream.insert("level".to_string(), level.into());
+            serde_json::json!({ "stream": stream, "values": values })
+        })
+        .collect();
+    serde_json::json!({ "streams": streams })
+}
+
+fn severity_number(level: &str) -> i32 {
+    match level {
+        "trace" => 1,
+        "debug" => 5,
+        "info" => 9,
+        "warn" => 13,
+        _ => 17,
+    }
+}
+
+fn string_attr(key: &str, value: &str) -> serde_json::Value {
+    serde_json::json!({ "key": key, "value": { "stringValue": value } })
+}
+
+/// Encode records as an OTLP/HTTP JSON logs request / 将记录编码为 OTLP/HTTP JSON 日志请求
+pub fn encode_otlp(labels: &[(String, String)], records: &[LogRecord]) -> serde_json::Value {
+    let log_records: Vec<serde_json::Value> = records
+        .iter()
+        .map(|r| {
+            let mut attributes = vec![string_attr("target", &r.target)];
+            attributes.extend(r.fields.iter().map(|(k, v)| string_attr(k, v)));
+            let mut v = serde_json::json!({
+                "timeUnixNano": r.time_unix_nanos.to_string(),
+                "severityNumber": severity_number(&r.level),
+                "severityText": r.level.to_ascii_uppercase(),
+                "body": { "stringValue": r.message },
+                "attributes": attributes,
+            });
+            if let Some(t) = &r.trace_id {
+                v["traceId"] = serde_json::Value::String(t.clone());
+            }
+            if let Some(s) = &r.span_id {
+                v["spanId"] = serde_json::Value::String(s.clone());
+            }
+            v
+        })
+        .collect();
+    serde_json::json!({
+        "resourceLogs": [{
+            "resource": {
+                "attributes": labels.iter().map(|(k, v)| string_attr(k, v)).collect::<Vec<_>>(),
+            },
+            "scopeLogs": [{
+                "scope": { "name": env!("CARGO_PKG_NAME"), "version": env!("CARGO_PKG_VERSION") },
+                "logRecords": log_records,
+            }],
+        }],
+    })
+}
+
+struct Uploader {
+    client: reqwest::Client,
+    url: String,
+    protocol: String,
+    headers: Vec<(String, String)>,
+    labels: Vec<(String, String)>,
+}
+
+impl Uploader {
+    async fn send(&self, body: Vec<u8>) -> Result<(), String> {
+        let mut req = self
+            .client
+            .post(&self.url)
+            .header(reqwest::header::CONTENT_TYPE, "application/json")
+            .body(body);
+        for (k, v) in &self.headers {
+            req = req.header(k.as_str(), v.as_str());
+        }
+        match req.send().await {
+            Ok(r) if r.status().is_success() => Ok(()),
+            Ok(r) => Err(format!("rejected with {}", r.status())),
+            Err(e) => Err(e.to_string()),
+        }
+    }
+
+    fn encode(&self, records: &[LogRecord]) -> Vec<u8> {
+        let body = if self.protocol == PROTOCOL_OTLP {
+            encode_otlp(&self.labels, records)
+        } else {
+            encode_loki(&self.labels, records)
+        };
+        serde_json::to_vec(&body).unwrap_or_default()
+    }
+}
+
+/// Upload spooled batches until one fails or the budget runs out; `false` on failure
+/// 上传缓存的批次，直到某次失败或预算耗尽；失败时返回 `false`
+async fn drain(uploader: &Uploader, spool: &mut Spool, budget: &mut ByteBudget) -> bool {
+    budget.refill(Instant::now());
+    while let Some(records) = spool.front() {
+        let body = uploader.encode(&records);
+        let size = body.len() as u64;
+        // A batch larger than the whole budget goes once the bucket is full
+        // 大于整个预算的批次在令牌桶满时发送
+        if size > budget.available() && !budget.is_full() {
+            break;
+        }
+        if let Err(e) = uploader.send(body).await {
+            warn!(
+                url = %uploader.url,
+                error = %e,
+                spooled = spool.len(),
+                "log upload failed"
+            );
+            return false;
+        }
+        budget.spend(size);
+        spool.pop_front();
+    }
+    true
+}
+
+/// Warning line carrying the count of dropped lines / 携带丢弃行数的警告日志
+fn dropped_record(sink: &Sink, spool: &mut Spool) -> Option<LogRecord> {
+    let dropped =
+        sink.dropped.swap(0, Ordering::Relaxed) + std::mem::take(&mut spool.dropped_lines);
+    if dropped == 0 {
+        return None;
+    }
+    let mut r = LogRecord::now(
+        Level::WARN,
+        module_path!(),
+        format!("log shipping dropped {} lines", dropped),
+    );
+    r.fields.insert("dropped".to_string(), dropped.to_string());
+    Some(r)
+}
+
+enum Step {
+    Record(LogRecord),
+    Tick,
+    Stop,
+}
+
+async fn ship_loop(
+    cfg: LogShippingConfig,
+    uploader: Uploader,
+    mut spool: Spool,
+    mut rx: mpsc::Receiver<LogRecord>,
+    cancel: CancellationToken,
+) {
+    let sink = SINK.get();
+    let batch_size = cfg.batch_size.max(1);
+    let mut pending: Vec<LogRecord> = Vec::with_capacity(batch_size);
+    let mut budget = ByteBudget::new(cfg.bandwidth_bytes_per_hour, Instant::now());
+    let mut backoff = Duration::from_secs(1);
+    let mut retry_at = Instant::now();
+    let mut tick = interval(Duration::from_millis(cfg.flush_interval_ms.max(100)));
+    tick.set_missed_tick_behavior(MissedTickBehavior::Delay);
+
+    loop {
+        let step = tokio::select! {
+            _ = cancel.cancelled() => Step::Stop,
+            r = rx.recv() => r.map(Step::Record).unwrap_or(Step::Stop),
+            _ = tick.tick() => Step::Tick,
+        };
+        match step {
+            Step::Record(r) => {
+                pending.push(r);
+                if pending.len() < batch_size {
+                    continue;
+                }
+            }
+            Step::Tick => {
+                if let Some(r) = sink.and_then(|s| dropped_record(s, &mut spool)) {
+                    pending.push(r);
+                }
+            }
+            Step::Stop => break,
+        }
+        spool.push(&pending);
+        pending.clear();
+        if spool.is_empty() || Instant::now() < retry_at {
+            continue;
+        }
+        if drain(&uploader, &mut spool, &mut budget).await {
+            backoff = Duration::from_secs(1);
+        } else {
+            spool.persist();
+            retry_at = Instant::now() + backoff;
+            backoff = (backoff * 2).min(MAX_BACKOFF);
+        }
+    }
+
+    // Written first so nothing is lost if the shutdown deadline cuts the last upload short
+    // 先写入磁盘，即使关闭截止时间打断最后一次上传也不会丢失
+    while let Ok(r) = rx.try_recv() {
+        pending.push(r);
+    }
+    spool.push(&pending);
+    spool.persist();
+    if Instant::now() >= retry_at {
+        let _ = timeout(UPLOAD_TIMEOUT, drain(&uploader, &mut spool, &mut budget)).await;
+    }
+}
+
+/// Ships captured logs to the configured endpoint / 将采集的日志投递到配置的端点
+#[derive(Debug)]
+pub struct LogShipper {
+    config: Arc<SpearletConfig>,
+    cancel: CancellationToken,
+    handle: Mutex<Option<JoinHandle<()>>>,
+}
+
+impl LogShipper {
+    pub fn new(config: Arc<SpearletConfig>) -> Self {
+        Self {
+            config,
+            cancel: CancellationToken::new(),
+            handle: Mutex::new(None),
+        }
+    }
+
+    pub fn start(&self) {
+        let cfg = self.config.log_shipping.clone();
+        if !cfg.enabled {
+            return;
+        }
+        let max_level = Level::from_str(&cfg.level).unwrap_or(Level::INFO);
+        let (tx, rx) = mpsc::channel(cfg.queue_capacity.max(1));
+        let sink = Sink {
+            tx,
+            max_level,
+            limiter: Mutex::new(LineLimiter::new(cfg.max_lines_per_second, Instant::now())),
+            dropped: AtomicU64::new(0),
+        };
+        if SINK.set(sink).is_err() {
+            return;
+        }
+        let spool = Spool::open(Some(spool_dir(&self.config)), cfg.max_spool_bytes);
+        let uploader = Uploader {
+            client: reqwest::Client::builder()
+                .timeout(UPLOAD_TIMEOUT)
+                .build()
+                .unwrap_or_default(),
+            url: push_url(&cfg.protocol, &cfg.endpoint),
+            protocol: cfg.protocol.clone(),
+            headers: cfg.headers.clone().into_iter().collect(),
+            labels: node_labels(&self.config),
+        };
+        info!(
+            url = %uploader.url,
+            protocol = %cfg.protocol,
+            level = %max_level,
+            spooled = spool.len(),
+            "Log shipping started"
+        );
+        let cancel = self.cancel.clone();
+        *self.handle.lock() = Some(tokio::spawn(ship_loop(cfg, uploader, spool, rx, cancel)));
+    }
+
+    /// Stop capturing and make one last upload; unsent lines stay spooled
+    /// 停止采集并做最后一次上传；未发送的行保留在缓存中
+    pub async fn shutdown(&self) {
+        self.cancel.cancel();
+        let handle = self.handle.lock().take();
+        if let Some(h) = handle {
+            let _ = h.await;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn record(level: &str, message: &str) -> LogRecord {
+        LogRecord {
+            time_unix_nanos: 1_700_000_000_000_000_000,
+            level: level.to_string(),
+            target: "spear_next::spearlet".to_string(),
+            message: message.to_string(),
+            fields: BTreeMap::from([("task_id".to_string(), "t1".to_string())]),
+            trace_id: None,
+            span_id: None,
+        }
+    }
+
+    #[test]
+    fn test_encode_loki_and_otlp() {
+        let labels = vec![("node".to_string(), "edge-1".to_string())];
+        let records = vec![
+            record("info", "a"),
+            record("warn", "b"),
+            record("info", "c"),
+        ];
+        let v = encode_loki(&labels, &records);
+        let streams = v["streams"].as_array().unwrap();
+        assert_eq!(streams.len(), 2);
+        assert_eq!(streams[0]["stream"]["level"], "info");
+        assert_eq!(streams[0]["stream"]["node"], "edge-1");
+        assert_eq!(streams[0]["values"].as_array().unwrap().len(), 2);
+        let line: serde_json::Value =
+            serde_json::from_str(streams[0]["values"][0][1].as_str().unwrap()).unwrap();
+        assert_eq!(line["msg"], "a");
+        assert_eq!(line["task_id"], "t1");
+
+        let v = encode_otlp(&labels, &records[1..2]);
+        let r = &v["resourceLogs"][0]["scopeLogs"][0]["logRecords"][0];
+        assert_eq!(r["severityNumber"], 13);
+        assert_eq!(r["body"]["stringValue"], "b");
+        assert_eq!(
+            push_url(PROTOCOL_OTLP, "http://c:4318/"),
+            "http://c:4318/v1/logs"
+        );
+        assert_eq!(
+            push_url(PROTOCOL_LOKI, "http://loki:3100"),
+            "http://loki:3100/loki/api/v1/push"
+        );
+    }
+
+    #[test]
+    fn test_spool_persists_reloads_and_trims() {
+        let dir = tempfile::tempdir().unwrap();
+        let mut spool = Spool::open(Some(dir.path().to_path_buf()), 1 << 20);
+        spool.push(&[record("info", "a")]);
+        spool.push(&[record("info", "b"), record("info", "c")]);
+        spool.persist();
+        assert_eq!(std::fs::read_dir(dir.path()).unwrap().count(), 2);
+
+        // A restarted shipper picks the batches up in order / 重启后的投递器按顺序接管批次
+        let mut spool = Spool::open(Some(dir.path().to_path_buf()), 1 << 20);
+        assert_eq!(spool.front().unwrap()[0].message, "a");
+        spool.pop_front();
+        assert_eq!(spool.front().unwrap().len(), 2);
+        spool.push(&[record("info", "d")]);
+        assert_eq!(spool.next_seq, 4);
+
+        let mut small = Spool::open(None, 1);
+        small.push(&[record("info", "a")]);
+        small.push(&[record("info", "b"), record("info", "c")]);
+        assert_eq!(small.len(), 1);
+        assert_eq!(small.dropped_lines, 1);
+    }
+
+    #[test]
+    fn test_line_limiter() {
+        let start = Instant::now();
+        let mut limiter = LineLimiter::new(2, start);
+        assert!(limiter.allow(start));
+        assert!(limiter.allow(start));
+        assert!(!limiter.allow(start));
+        assert!(limiter.allow(start + Duration::from_secs(1)));
+        assert!(LineLimiter::new(0, start).allow(start));
+    }
+}
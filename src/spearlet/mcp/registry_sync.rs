@@ -136,29 +136,32 @@ async fn refresh_once(
     Ok(resp.revision)
 }
 
-static GLOBAL_MCP_REGISTRY_SYNC: OnceLock<Arc<McpRegistrySyncService>> = OnceLock::new();
-
-pub fn global_mcp_registry_sync(config: Arc<SpearletConfig>) -> Arc<McpRegistrySyncService> {
-    GLOBAL_MCP_REGISTRY_SYNC
-        .get_or_init(|| {
-            let svc = Arc::new(McpRegistrySyncService::new(config, None));
-            svc.start();
-            svc
-        })
-        .clone()
+/// The registry sync of one spearlet, started once / 单个 spearlet 的注册表同步，只启动一次
+#[derive(Default)]
+pub struct McpRegistrySlot {
+    svc: OnceLock<Arc<McpRegistrySyncService>>,
 }
 
-pub fn global_mcp_registry_sync_with_channel(
-    config: Arc<SpearletConfig>,
-    sms_channel: Option<Channel>,
-) -> Arc<McpRegistrySyncService> {
-    GLOBAL_MCP_REGISTRY_SYNC
-        .get_or_init(|| {
-            let svc = Arc::new(McpRegistrySyncService::new(config, sms_channel));
-            svc.start();
-            svc
-        })
-        .clone()
+impl McpRegistrySlot {
+    /// Start the sync if it is not running yet (idempotent) / 若同步尚未运行则启动（幂等）
+    pub fn init(
+        &self,
+        config: Arc<SpearletConfig>,
+        sms_channel: Option<Channel>,
+    ) -> Arc<McpRegistrySyncService> {
+        self.svc
+            .get_or_init(|| {
+                let svc = Arc::new(McpRegistrySyncService::new(config, sms_channel));
+                svc.start();
+                svc
+            })
+            .clone()
+    }
+
+    /// The service, if started / 服务（若已启动）
+    pub fn get(&self) -> Option<Arc<McpRegistrySyncService>> {
+        self.svc.get().cloned()
+    }
 }
 
 async fn sync_loop(
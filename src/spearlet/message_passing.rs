@@ -0,0 +1,856 @@
+//! Message passing between tasks on one spearlet / 同一 spearlet 上任务之间的消息传递
+//!
+//! Backs the `mp_*` hostcalls. A running instance registers one or more names for its
+//! mailbox; another instance looks a name up and sends messages to the mailbox id, where
+//! they queue until the owner receives them. Delivery is at most once: a received message
+//! leaves the queue. The receiver acknowledges a message once it has handled it, and the
+//! sender can wait for that acknowledgement. Mailboxes live as long as the instance that
+//! registered them; unacknowledged messages of a dropped mailbox are reported to their
+//! senders as lost.
+//!
+//! With routing on, names registered on peer spearlets resolve to local proxy mailbox ids.
+//! Messages for those, and acknowledgements of messages that came from a peer, are queued
+//! as `Outgoing` work for `message_routing`, which carries them over HTTP.
+//! 为 `mp_*` hostcall 提供支持。运行中的实例为其邮箱注册一个或多个名称；另一个实例查找名称并向
+//! 邮箱 ID 发送消息，消息排队直到所有者接收。投递至多一次：接收后的消息即离开队列。接收方处理完
+//! 消息后进行确认，发送方可以等待该确认。邮箱的生命周期与注册它的实例相同；被丢弃邮箱中未确认的
+//! 消息会以丢失的形式报告给发送方。
+//!
+//! 开启路由后，在对等 spearlet 上注册的名称解析为本地代理邮箱 ID。发往这些邮箱的消息，以及对来自
+//! 对等节点的消息的确认，作为 `Outgoing` 工作排队，由 `message_routing` 通过 HTTP 传送。
+
+use std::collections::{HashMap, VecDeque};
+use std::time::{Duration, Instant};
+
+use parking_lot::{Condvar, Mutex, RwLock};
+use serde::Serialize;
+use tokio::sync::Notify;
+
+use crate::spearlet::config::MessagePassingConfig;
+
+/// Longest mailbox name in bytes / 邮箱名称的最大字节数
+pub const MAX_NAME_LEN: usize = 128;
+
+/// Delivery keys remembered to drop redelivered messages / 为丢弃重复投递而记住的投递键数
+const SEEN_KEYS: usize = 4096;
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum MpError {
+    #[error("message passing is disabled")]
+    Disabled,
+    #[error("invalid request: {0}")]
+    Invalid(String),
+    #[error("name {0:?} is registered by another instance")]
+    NameTaken(String),
+    #[error("not found: {0}")]
+    NotFound(String),
+    #[error("max_names reached")]
+    TooManyNames,
+    #[error("mailbox {0} is full")]
+    QueueFull(u32),
+    #[error("no message")]
+    Empty,
+    #[error("timed out")]
+    TimedOut,
+    #[error("message {0} was dropped before it was acknowledged")]
+    Dropped(u32),
+}
+
+/// A message taken from a mailbox / 从邮箱取出的消息
+#[derive(Debug, Clone, PartialEq)]
+pub struct Received {
+    pub id: u32,
+    /// Mailbox of the sender, 0 when it has none / 发送方的邮箱，无邮箱时为 0
+    pub from: u32,
+    pub data: Vec<u8>,
+}
+
+/// Work for the router that carries messages to other spearlets
+/// 交给路由器、发往其他 spearlet 的工作
+#[derive(Debug, Clone, PartialEq)]
+pub enum Outgoing {
+    /// Deliver message `id` to mailbox `to` on `peer`; `key` is the same on every retry
+    /// 将消息 `id` 投递到 `peer` 上的邮箱 `to`；每次重试的 `key` 相同
+    Deliver {
+        key: String,
+        peer: String,
+        to: u32,
+        from: u32,
+        id: u32,
+        data: Vec<u8>,
+    },
+    /// Tell `peer` its message `id` was acknowledged or dropped
+    /// 告知 `peer` 其消息 `id` 已被确认或丢弃
+    Ack {
+        peer: String,
+        id: u32,
+        dropped: bool,
+    },
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum AckState {
+    Queued,
+    Delivered,
+    Acked,
+    Dropped,
+}
+
+struct Ack {
+    sender: String,
+    mailbox: u32,
+    state: AckState,
+    /// Peer and message id of a message that came from another spearlet
+    /// 来自其他 spearlet 的消息的对等节点与消息 ID
+    origin: Option<(String, u32)>,
+}
+
+struct Mailbox {
+    owner: String,
+    names: Vec<String>,
+    queue: VecDeque<Received>,
+}
+
+#[derive(Default)]
+struct Bus {
+    names: HashMap<String, u32>,
+    mailboxes: HashMap<u32, Mailbox>,
+    by_owner: HashMap<String, u32>,
+    acks: HashMap<u32, Ack>,
+    last_mailbox: u32,
+    last_message: u32,
+    /// Proxy mailbox id to peer and its mailbox id / 代理邮箱 ID 到对等节点及其邮箱 ID
+    remotes: HashMap<u32, (String, u32)>,
+    /// Names announced by each peer, with when they were announced / 各对等节点公布的名称及公布时间
+    peer_names: HashMap<String, (Instant, HashMap<String, u32>)>,
+    outbox: VecDeque<Outgoing>,
+    names_changed: bool,
+    seen: HashMap<String, u32>,
+    seen_order: VecDeque<String>,
+}
+
+impl Bus {
+    /// Local id standing for mailbox `id` on `peer` / 代表 `peer` 上邮箱 `id` 的本地 ID
+    fn proxy(&mut self, peer: &str, id: u32) -> u32 {
+        if let Some((proxy, _)) = self
+            .remotes
+            .iter()
+            .find(|(_, (p, r))| p == peer && *r == id)
+        {
+            return *proxy;
+        }
+        let Bus {
+            mailboxes,
+            remotes,
+            last_mailbox,
+            ..
+        } = self;
+        let proxy = next_id(last_mailbox, |id| {
+            mailboxes.contains_key(&id) || remotes.contains_key(&id)
+        });
+        self.remotes.insert(proxy, (peer.to_string(), id));
+        proxy
+    }
+
+    /// Drop a message record, telling its origin peer if it came from one
+    /// 丢弃消息记录；若来自对等节点则告知该节点
+    fn drop_ack(&mut self, id: u32) {
+        let Some(ack) = self.acks.get_mut(&id) else {
+            return;
+        };
+        match ack.origin.take() {
+            Some((peer, origin)) => {
+                self.acks.remove(&id);
+                self.outbox.push_back(Outgoing::Ack {
+                    peer,
+                    id: origin,
+                    dropped: true,
+                });
+            }
+            None => ack.state = AckState::Dropped,
+        }
+    }
+}
+
+/// Next id after `last`, kept in `1..=i32::MAX` so hostcalls can return it
+/// `last` 之后的 ID，保持在 `1..=i32::MAX` 以便 hostcall 返回
+fn next_id(last: &mut u32, taken: impl Fn(u32) -> bool) -> u32 {
+    loop {
+        *last = if *last >= i32::MAX as u32 {
+            1
+        } else {
+            *last + 1
+        };
+        if !taken(*last) {
+            return *last;
+        }
+    }
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct MailboxInfo {
+    pub id: u32,
+    pub owner: String,
+    pub names: Vec<String>,
+    pub queued: usize,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct MpStats {
+    pub enabled: bool,
+    pub mailboxes: Vec<MailboxInfo>,
+    /// Messages sent but not acknowledged yet / 已发送但尚未确认的消息数
+    pub pending_acks: usize,
+    /// Peers that announced names / 已公布名称的对等节点数
+    pub peers: usize,
+    pub remote_names: usize,
+    /// Deliveries and acknowledgements waiting for the router / 等待路由器处理的投递与确认数
+    pub outbox: usize,
+}
+
+pub struct MessageBus {
+    config: RwLock<MessagePassingConfig>,
+    bus: Mutex<Bus>,
+    changed: Condvar,
+    routed: Notify,
+}
+
+impl MessageBus {
+    pub fn new(config: MessagePassingConfig) -> Self {
+        Self {
+            config: RwLock::new(config),
+            bus: Mutex::new(Bus::default()),
+            changed: Condvar::new(),
+            routed: Notify::new(),
+        }
+    }
+
+    /// Apply a new configuration; disabling drops every mailbox
+    /// 应用新配置；关闭时丢弃所有邮箱
+    pub fn set_config(&self, config: MessagePassingConfig) {
+        let enabled = config.enabled;
+        let routing = enabled && config.routing.enabled;
+        *self.config.write() = config;
+        if !enabled {
+            let owners: Vec<String> = self.bus.lock().by_owner.keys().cloned().collect();
+            for owner in owners {
+                self.release(&owner);
+            }
+        }
+        if !routing {
+            let mut bus = self.bus.lock();
+            let proxies: Vec<u32> = bus.remotes.keys().copied().collect();
+            let sent: Vec<u32> = bus
+                .acks
+                .iter()
+                .filter(|(_, a)| proxies.contains(&a.mailbox))
+                .map(|(id, _)| *id)
+                .collect();
+            for id in sent {
+                bus.drop_ack(id);
+            }
+            bus.remotes.clear();
+            bus.peer_names.clear();
+            bus.outbox.clear();
+            drop(bus);
+            self.changed.notify_all();
+        }
+    }
+
+    pub fn routing_enabled(&self) -> bool {
+        let cfg = self.config.read();
+        cfg.enabled && cfg.routing.enabled
+    }
+
+    fn config(&self) -> Result<MessagePassingConfig, MpError> {
+        let cfg = self.config.read().clone();
+        if !cfg.enabled {
+            return Err(MpError::Disabled);
+        }
+        Ok(cfg)
+    }
+
+    /// Register `name` for the owner's mailbox; returns the mailbox id
+    /// 为所有者的邮箱注册 `name`；返回邮箱 ID
+    pub fn register(&self, owner: &str, name: &str) -> Result<u32, MpError> {
+        let cfg = self.config()?;
+        if name.is_empty() || name.len() > MAX_NAME_LEN || name.chars().any(char::is_control) {
+            return Err(MpError::Invalid(format!(
+                "names must be 1 to {} bytes without control characters",
+                MAX_NAME_LEN
+            )));
+        }
+        let mut bus = self.bus.lock();
+        let own = bus.by_owner.get(owner).copied();
+        if let Some(id) = bus.names.get(name).copied() {
+            return if Some(id) == own {
+                Ok(id)
+            } else {
+                Err(MpError::NameTaken(name.to_string()))
+            };
+        }
+        let id = match own {
+            Some(id) => id,
+            None => {
+                let Bus {
+                    mailboxes,
+                    remotes,
+                    last_mailbox,
+                    ..
+                } = &mut *bus;
+                let id = next_id(last_mailbox, |id| {
+                    mailboxes.contains_key(&id) || remotes.contains_key(&id)
+                });
+                bus.mailboxes.insert(
+                    id,
+                    Mailbox {
+                        owner: owner.to_string(),
+                        names: Vec::new(),
+                        queue: VecDeque::new(),
+                    },
+                );
+                bus.by_owner.insert(owner.to_string(), id);
+                id
+            }
+        };
+        let mailbox = bus.mailboxes.get_mut(&id).expect("mailbox of owner");
+        if mailbox.names.len() >= cfg.max_names {
+            return Err(MpError::TooManyNames);
+        }
+        mailbox.names.push(name.to_string());
+        bus.names.insert(name.to_string(), id);
+        bus.names_changed = true;
+        drop(bus);
+        self.routed.notify_one();
+        Ok(id)
+    }
+
+    /// Mailbox id of a name, registered here or announced by a peer
+    /// 名称对应的邮箱 ID，在本地注册或由对等节点公布
+    pub fn lookup(&self, name: &str) -> Result<u32, MpError> {
+        self.config()?;
+        let mut bus = self.bus.lock();
+        if let Some(id) = bus.names.get(name) {
+            return Ok(*id);
+        }
+        let mut remote: Vec<(&String, u32)> = bus
+            .peer_names
+            .iter()
+            .filter_map(|(peer, (_, names))| names.get(name).map(|id| (peer, *id)))
+            .collect();
+        // The same peer wins every time / 每次都选择同一对等节点
+        remote.sort();
+        let Some((peer, id)) = remote.first().map(|(p, id)| (p.to_string(), *id)) else {
+            return Err(MpError::NotFound(format!("name {:?}", name)));
+        };
+        Ok(bus.proxy(&peer, id))
+    }
+
+    /// Queue `data` in a mailbox; returns the message id / 将 `data` 放入邮箱队列；返回消息 ID
+    pub fn send(&self, sender: &str, to: u32, data: Vec<u8>) -> Result<u32, MpError> {
+        let cfg = self.config()?;
+        if data.len() > cfg.max_message_bytes {
+            return Err(MpError::Invalid(format!(
+                "messages must be at most {} bytes",
+                cfg.max_message_bytes
+            )));
+        }
+        let mut bus = self.bus.lock();
+        let from = bus.by_owner.get(sender).copied().unwrap_or(0);
+        if let Some((peer, remote)) = bus.remotes.get(&to).cloned() {
+            let queued = bus
+                .outbox
+                .iter()
+                .filter(|o| matches!(o, Outgoing::Deliver { .. }))
+                .count();
+            if queued >= cfg.max_queue_messages {
+                return Err(MpError::QueueFull(to));
+            }
+            let Bus {
+                acks, last_message, ..
+            } = &mut *bus;
+            let id = next_id(last_message, |id| acks.contains_key(&id));
+            bus.acks.insert(
+                id,
+                Ack {
+                    sender: sender.to_string(),
+                    mailbox: to,
+                    state: AckState::Queued,
+                    origin: None,
+                },
+            );
+            bus.outbox.push_back(Outgoing::Deliver {
+                key: uuid::Uuid::new_v4().simple().to_string(),
+                peer,
+                to: remote,
+                from,
+                id,
+                data,
+            });
+            drop(bus);
+            self.routed.notify_one();
+            return Ok(id);
+        }
+        let Some(mailbox) = bus.mailboxes.get(&to) else {
+            return Err(MpError::NotFound(format!("mailbox {}", to)));
+        };
+        if mailbox.queue.len() >= cfg.max_queue_messages {
+            return Err(MpError::QueueFull(to));
+        }
+        let Bus {
+            acks, last_message, ..
+        } = &mut *bus;
+        let id = next_id(last_message, |id| acks.contains_key(&id));
+        bus.acks.insert(
+            id,
+            Ack {
+                sender: sender.to_string(),
+                mailbox: to,
+                state: AckState::Queued,
+                origin: None,
+            },
+        );
+        let mailbox = bus.mailboxes.get_mut(&to).expect("checked above");
+        mailbox.queue.push_back(Received { id, from, data });
+        drop(bus);
+        self.changed.notify_all();
+        Ok(id)
+    }
+
+    /// Wait until `done` yields a result; `None` waits forever / 等待 `done` 给出结果；`None` 表示一直等待
+    fn wait<T>(
+        &self,
+        timeout: Option<Duration>,
+        mut done: impl FnMut(&mut Bus) -> Option<Result<T, MpError>>,
+    ) -> Result<T, MpError> {
+        let deadline = timeout.map(|t| Instant::now() + t);
+        let mut bus = self.bus.lock();
+        loop {
+            if let Some(r) = done(&mut bus) {
+                return r;
+            }
+            match deadline {
+                _ if timeout == Some(Duration::ZERO) => return Err(MpError::Empty),
+                Some(d) if Instant::now() >= d => return Err(MpError::TimedOut),
+                Some(d) => {
+                    self.changed.wait_until(&mut bus, d);
+                }
+                None => self.changed.wait(&mut bus),
+            }
+        }
+    }
+
+    /// Next message of the owner's mailbox; one larger than `max_len` is returned but stays queued
+    /// 所有者邮箱中的下一条消息；超过 `max_len` 的消息会被返回但仍留在队列中
+    pub fn recv(
+        &self,
+        owner: &str,
+        max_len: usize,
+        timeout: Option<Duration>,
+    ) -> Result<Received, MpError> {
+        self.config()?;
+        let owner = owner.to_string();
+        self.wait(timeout, |bus| {
+            let Some(id) = bus.by_owner.get(&owner).copied() else {
+                return Some(Err(MpError::NotFound("mailbox of caller".to_string())));
+            };
+            let mailbox = bus.mailboxes.get_mut(&id)?;
+            let head = mailbox.queue.front()?;
+            if head.data.len() > max_len {
+                return Some(Ok(head.clone()));
+            }
+            let msg = mailbox.queue.pop_front()?;
+            if let Some(ack) = bus.acks.get_mut(&msg.id) {
+                ack.state = AckState::Delivered;
+            }
+            Some(Ok(msg))
+        })
+    }
+
+    /// Acknowledge a message received by the owner / 确认所有者已接收的消息
+    pub fn ack(&self, owner: &str, id: u32) -> Result<(), MpError> {
+        self.config()?;
+        let mut bus = self.bus.lock();
+        let mailbox = bus.by_owner.get(owner).copied();
+        match bus.acks.get_mut(&id) {
+            Some(ack) if Some(ack.mailbox) == mailbox && ack.state != AckState::Queued => {
+                if let Some((peer, origin)) = ack.origin.take() {
+                    bus.acks.remove(&id);
+                    bus.outbox.push_back(Outgoing::Ack {
+                        peer,
+                        id: origin,
+                        dropped: false,
+                    });
+                    drop(bus);
+                    self.routed.notify_one();
+                    return Ok(());
+                }
+                if ack.state == AckState::Delivered {
+                    ack.state = AckState::Acked;
+                }
+            }
+            _ => return Err(MpError::NotFound(format!("message {}", id))),
+        }
+        drop(bus);
+        self.changed.notify_all();
+        Ok(())
+    }
+
+    /// Wait for the receiver to acknowledge a message the owner sent
+    /// 等待接收方确认所有者发送的消息
+    pub fn wait_ack(&self, owner: &str, id: u32, timeout: Option<Duration>) -> Result<(), MpError> {
+        self.config()?;
+        self.wait(timeout, |bus| {
+            let state = match bus.acks.get(&id) {
+                Some(ack) if ack.sender == owner => ack.state,
+                _ => return Some(Err(MpError::NotFound(format!("message {}", id)))),
+            };
+            match state {
+                AckState::Acked => {
+                    bus.acks.remove(&id);
+                    Some(Ok(()))
+                }
+                AckState::Dropped => {
+                    bus.acks.remove(&id);
+                    Some(Err(MpError::Dropped(id)))
+                }
+                AckState::Queued | AckState::Delivered => None,
+            }
+        })
+    }
+
+    /// Drop the owner's mailbox, names and acknowledgement records, e.g. when its instance ends
+    /// 丢弃所有者的邮箱、名称与确认记录，例如其实例结束时
+    pub fn release(&self, owner: &str) {
+        let mut bus = self.bus.lock();
+        bus.acks.retain(|_, a| a.sender != owner);
+        if let Some(id) = bus.by_owner.remove(owner) {
+            if let Some(mailbox) = bus.mailboxes.remove(&id) {
+                for name in &mailbox.names {
+                    bus.names.remove(name);
+                }
+                bus.names_changed |= !mailbox.names.is_empty();
+            }
+            let unacked: Vec<u32> = bus
+                .acks
+                .iter()
+                .filter(|(_, a)| a.mailbox == id && a.state != AckState::Acked)
+                .map(|(id, _)| *id)
+                .collect();
+            for id in unacked {
+                bus.drop_ack(id);
+            }
+        }
+        drop(bus);
+        self.changed.notify_all();
+        self.routed.notify_one();
+    }
+
+    pub fn stats(&self) -> MpStats {
+        let enabled = self.config.read().enabled;
+        let bus = self.bus.lock();
+        let mut mailboxes: Vec<MailboxInfo> = bus
+            .mailboxes
+            .iter()
+            .map(|(id, m)| MailboxInfo {
+                id: *id,
+                owner: m.owner.clone(),
+                names: m.names.clone(),
+                queued: m.queue.len(),
+            })
+            .collect();
+        mailboxes.sort_by_key(|m| m.id);
+        MpStats {
+            enabled,
+            mailboxes,
+            pending_acks: bus
+                .acks
+                .values()
+                .filter(|a| matches!(a.state, AckState::Queued | AckState::Delivered))
+                .count(),
+            peers: bus.peer_names.len(),
+            remote_names: bus.peer_names.values().map(|(_, n)| n.len()).sum(),
+            outbox: bus.outbox.len(),
+        }
+    }
+
+    /// Signalled when there is work for the router / 有路由器工作时发出通知
+    pub fn routed(&self) -> &Notify {
+        &self.routed
+    }
+
+    /// Queued router work, and whether local names changed since the last call
+    /// 排队的路由器工作，以及自上次调用以来本地名称是否变化
+    pub fn take_outgoing(&self) -> (Vec<Outgoing>, bool) {
+        let mut bus = self.bus.lock();
+        let changed = std::mem::take(&mut bus.names_changed);
+        (bus.outbox.drain(..).collect(), changed)
+    }
+
+    /// Names registered on this spearlet / 在本 spearlet 上注册的名称
+    pub fn local_names(&self) -> HashMap<String, u32> {
+        self.bus.lock().names.clone()
+    }
+
+    /// Replace the names announced by `peer` / 替换 `peer` 公布的名称
+    pub fn set_peer_names(&self, peer: &str, names: HashMap<String, u32>) {
+        self.bus
+            .lock()
+            .peer_names
+            .insert(peer.to_string(), (Instant::now(), names));
+    }
+
+    /// Forget peers that have not announced names for `ttl` / 遗忘在 `ttl` 内未公布名称的对等节点
+    pub fn expire_peers(&self, ttl: Duration) {
+        self.bus
+            .lock()
+            .peer_names
+            .retain(|_, (at, _)| at.elapsed() < ttl);
+    }
+
+    /// Queue a message delivered by `peer`; a redelivery with the same key returns the first id
+    /// 将 `peer` 投递的消息放入队列；相同键的重复投递返回首次的 ID
+    pub fn deliver_remote(
+        &self,
+        key: &str,
+        peer: &str,
+        msg: Received,
+        to: u32,
+    ) -> Result<u32, MpError> {
+        let cfg = self.config()?;
+        if !cfg.routing.enabled {
+            return Err(MpError::Disabled);
+        }
+        if msg.data.len() > cfg.max_message_bytes {
+            return Err(MpError::Invalid(format!(
+                "messages must be at most {} bytes",
+                cfg.max_message_bytes
+            )));
+        }
+        let mut bus = self.bus.lock();
+        if let Some(id) = bus.seen.get(key) {
+            return Ok(*id);
+        }
+        let Some(mailbox) = bus.mailboxes.get(&to) else {
+            return Err(MpError::NotFound(format!("mailbox {}", to)));
+        };
+        if mailbox.queue.len() >= cfg.max_queue_messages {
+            return Err(MpError::QueueFull(to));
+        }
+        let from = if peer.is_empty() || msg.from == 0 {
+            0
+        } else {
+            bus.proxy(peer, msg.from)
+        };
+        let Bus {
+            acks, last_message, ..
+        } = &mut *bus;
+        let id = next_id(last_message, |id| acks.contains_key(&id));
+        bus.acks.insert(
+            id,
+            Ack {
+                sender: peer.to_string(),
+                mailbox: to,
+                state: AckState::Queued,
+                origin: (!peer.is_empty()).then(|| (peer.to_string(), msg.id)),
+            },
+        );
+        bus.mailboxes
+            .get_mut(&to)
+            .expect("checked above")
+            .queue
+            .push_back(Received {
+                id,
+                from,
+                data: msg.data,
+            });
+        bus.seen.insert(key.to_string(), id);
+        bus.seen_order.push_back(key.to_string());
+        if bus.seen_order.len() > SEEN_KEYS {
+            if let Some(old) = bus.seen_order.pop_front() {
+                bus.seen.remove(&old);
+            }
+        }
+        drop(bus);
+        self.changed.notify_all();
+        Ok(id)
+    }
+
+    /// A peer acknowledged or dropped message `id` sent from here, or it could not be delivered
+    /// 对等节点确认或丢弃了从本地发出的消息 `id`，或该消息无法投递
+    pub fn remote_ack(&self, id: u32, dropped: bool) {
+        let mut bus = self.bus.lock();
+        let proxy = bus
+            .acks
+            .get(&id)
+            .map(|a| a.mailbox)
+            .filter(|m| bus.remotes.contains_key(m));
+        if proxy.is_none() {
+            return;
+        }
+        if let Some(ack) = bus.acks.get_mut(&id) {
+            ack.state = if dropped {
+                AckState::Dropped
+            } else {
+                AckState::Acked
+            };
+        }
+        drop(bus);
+        self.changed.notify_all();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Arc;
+
+    fn bus() -> MessageBus {
+        MessageBus::new(MessagePassingConfig {
+            enabled: true,
+            max_queue_messages: 2,
+            ..Default::default()
+        })
+    }
+
+    #[test]
+    fn test_register_lookup_send_recv_ack() {
+        let bus = bus();
+        let a = bus.register("inst-a", "planner").unwrap();
+        assert_eq!(bus.register("inst-a", "planner"), Ok(a));
+        assert_eq!(bus.register("inst-a", "planner-2"), Ok(a));
+        assert_eq!(
+            bus.register("inst-b", "planner"),
+            Err(MpError::NameTaken("planner".to_string()))
+        );
+        let b = bus.register("inst-b", "worker").unwrap();
+        assert_ne!(a, b);
+
+        let to = bus.lookup("worker").unwrap();
+        let id = bus.send("inst-a", to, b"task 1".to_vec()).unwrap();
+        bus.send("inst-a", to, b"task 2".to_vec()).unwrap();
+        assert_eq!(
+            bus.send("inst-a", to, b"task 3".to_vec()),
+            Err(MpError::QueueFull(to))
+        );
+
+        // Too small a buffer leaves the message queued / 缓冲区过小时消息仍留在队列中
+        let peeked = bus.recv("inst-b", 2, Some(Duration::ZERO)).unwrap();
+        assert_eq!(peeked.id, id);
+        let msg = bus.recv("inst-b", 64, Some(Duration::ZERO)).unwrap();
+        assert_eq!(
+            msg,
+            Received {
+                id,
+                from: a,
+                data: b"task 1".to_vec()
+            }
+        );
+        assert_eq!(
+            bus.wait_ack("inst-a", id, Some(Duration::ZERO)),
+            Err(MpError::Empty)
+        );
+        bus.ack("inst-b", id).unwrap();
+        bus.wait_ack("inst-a", id, Some(Duration::ZERO)).unwrap();
+        assert!(matches!(
+            bus.wait_ack("inst-a", id, Some(Duration::ZERO)),
+            Err(MpError::NotFound(_))
+        ));
+        assert_eq!(bus.stats().pending_acks, 1);
+    }
+
+    #[test]
+    fn test_release_reports_dropped() {
+        let bus = Arc::new(bus());
+        let to = bus.register("inst-b", "worker").unwrap();
+        let id = bus.send("inst-a", to, b"x".to_vec()).unwrap();
+
+        let waiter = {
+            let bus = bus.clone();
+            std::thread::spawn(move || bus.wait_ack("inst-a", id, Some(Duration::from_secs(5))))
+        };
+        std::thread::sleep(Duration::from_millis(20));
+        bus.release("inst-b");
+        assert_eq!(waiter.join().unwrap(), Err(MpError::Dropped(id)));
+        assert!(matches!(bus.lookup("worker"), Err(MpError::NotFound(_))));
+    }
+
+    #[test]
+    fn test_recv_waits_for_send() {
+        let bus = Arc::new(bus());
+        let to = bus.register("inst-b", "worker").unwrap();
+        let receiver = {
+            let bus = bus.clone();
+            std::thread::spawn(move || bus.recv("inst-b", 64, Some(Duration::from_secs(5))))
+        };
+        std::thread::sleep(Duration::from_millis(20));
+        bus.send("inst-a", to, b"hi".to_vec()).unwrap();
+        assert_eq!(receiver.join().unwrap().unwrap().data, b"hi");
+        assert_eq!(
+            bus.recv("inst-b", 64, Some(Duration::from_millis(10))),
+            Err(MpError::TimedOut)
+        );
+
+        bus.set_config(MessagePassingConfig::default());
+        assert_eq!(bus.lookup("worker"), Err(MpError::Disabled));
+        assert!(bus.stats().mailboxes.is_empty());
+    }
+
+    #[test]
+    fn test_routing_to_peer() {
+        let mut cfg = MessagePassingConfig {
+            enabled: true,
+            ..Default::default()
+        };
+        cfg.routing.enabled = true;
+        let bus = MessageBus::new(cfg);
+        let a = bus.register("inst-a", "planner").unwrap();
+        assert!(bus.take_outgoing().1);
+
+        let peer = "http://10.0.0.2:8081";
+        bus.set_peer_names(peer, HashMap::from([("worker".to_string(), 7)]));
+        let to = bus.lookup("worker").unwrap();
+        assert_eq!(bus.lookup("worker"), Ok(to));
+        let id = bus.send("inst-a", to, b"task".to_vec()).unwrap();
+        let (outgoing, _) = bus.take_outgoing();
+        let key = match outgoing.as_slice() {
+            [Outgoing::Deliver {
+                key,
+                peer: p,
+                to: 7,
+                from,
+                id: sent,
+                ..
+            }] if p == peer && *from == a && *sent == id => key.clone(),
+            other => panic!("unexpected outgoing {:?}", other),
+        };
+        assert!(!key.is_empty());
+        bus.remote_ack(id, false);
+        bus.wait_ack("inst-a", id, Some(Duration::ZERO)).unwrap();
+
+        // A redelivery is dropped and the ack goes back to the peer
+        // 重复投递被丢弃，确认发回对等节点
+        let msg = Received {
+            id: 42,
+            from: 7,
+            data: b"result".to_vec(),
+        };
+        let local = bus.deliver_remote("k1", peer, msg.clone(), a).unwrap();
+        assert_eq!(bus.deliver_remote("k1", peer, msg, a), Ok(local));
+        let got = bus.recv("inst-a", 64, Some(Duration::ZERO)).unwrap();
+        assert_eq!(got.from, to);
+        assert_eq!(
+            bus.recv("inst-a", 64, Some(Duration::ZERO)),
+            Err(MpError::Empty)
+        );
+        bus.ack("inst-a", got.id).unwrap();
+        assert_eq!(
+            bus.take_outgoing().0,
+            vec![Outgoing::Ack {
+                peer: peer.to_string(),
+                id: 42,
+                dropped: false
+            }]
+        );
+    }
+}
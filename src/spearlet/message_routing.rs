@@ -0,0 +1,329 @@
+//! Message routing between spearlets / spearlet 之间的消息路由
+//!
+//! Carries the `Outgoing` work of the message bus to peer spearlets over HTTP and announces
+//! the local mailbox names to them. Peers come from `message_passing.routing.peers` and,
+//! with `discover_peers`, from the active nodes known to SMS. Delivery is at least once: a
+//! message is retried with backoff until the peer accepts it or `retry_for_ms` passes, and
+//! the receiving bus drops redeliveries by key. A peer answering 404 has no such mailbox,
+//! so the message is reported to its sender as dropped.
+//! 通过 HTTP 将消息总线的 `Outgoing` 工作传送到对等 spearlet，并向其公布本地邮箱名称。对等节点来自
+//! `message_passing.routing.peers`，开启 `discover_peers` 时还包括 SMS 已知的活跃节点。投递至少
+//! 一次：消息以退避方式重试，直到对等节点接受或超过 `retry_for_ms`，接收方总线按键丢弃重复投递。
+//! 对等节点返回 404 表示没有该邮箱，此时消息以丢弃的形式报告给发送方。
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Weak};
+use std::time::{Duration, Instant};
+
+use base64::{engine::general_purpose, Engine as _};
+use parking_lot::RwLock;
+use serde::{Deserialize, Serialize};
+use tonic::transport::Channel;
+use tracing::{debug, warn};
+
+use crate::proto::sms::node_service_client::NodeServiceClient;
+use crate::proto::sms::ListNodesRequest;
+use crate::spearlet::config::{MessageRoutingConfig, SpearletConfig};
+use crate::spearlet::message_passing::{MpError, Outgoing, Received};
+use crate::spearlet::node_services::NodeServices;
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
+
+pub const NAMES_PATH: &str = "/api/v1/mp/names";
+pub const DELIVER_PATH: &str = "/api/v1/mp/deliver";
+pub const ACKS_PATH: &str = "/api/v1/mp/acks";
+
+const HTTP_TIMEOUT: Duration = Duration::from_secs(10);
+const MAX_BACKOFF: Duration = Duration::from_secs(5);
+
+/// Names of the mailboxes on the announcing spearlet / 发布方 spearlet 上的邮箱名称
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct NamesAnnouncement {
+    pub url: String,
+    pub names: HashMap<String, u32>,
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct DeliverRequest {
+    /// Same on every retry of one message / 同一消息的每次重试都相同
+    pub key: String,
+    /// Sender's spearlet; empty when it cannot be reached / 发送方 spearlet；无法访问时为空
+    pub from_url: String,
+    /// Sender's mailbox there, 0 for none / 发送方在该处的邮箱，无邮箱时为 0
+    pub from: u32,
+    /// Message id on the sender's spearlet / 发送方 spearlet 上的消息 ID
+    pub id: u32,
+    pub to: u32,
+    /// Base64 payload / Base64 负载
+    pub data: String,
+}
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+pub struct AckNotice {
+    pub id: u32,
+    pub dropped: bool,
+}
+
+/// Routing state of one spearlet / 单个 spearlet 的路由状态
+#[derive(Default)]
+pub struct MessageRouter {
+    config: RwLock<MessageRoutingConfig>,
+    sms_channel: RwLock<Option<Channel>>,
+    running: AtomicBool,
+}
+
+/// Start routing, or apply a changed configuration; a `None` channel keeps the known one
+/// 启动路由或应用变更的配置；通道为 `None` 时保留已知通道
+pub fn start(node: &Arc<NodeServices>, cfg: &SpearletConfig, sms_channel: Option<Channel>) {
+    let r = &node.message_routing;
+    *r.config.write() = cfg.message_passing.routing.clone();
+    if sms_channel.is_some() {
+        *r.sms_channel.write() = sms_channel;
+    }
+    node.message_passing.routed().notify_one();
+    if !(cfg.message_passing.enabled && cfg.message_passing.routing.enabled) {
+        return;
+    }
+    if r.running.swap(true, Ordering::SeqCst) {
+        return;
+    }
+    let weak = Arc::downgrade(node);
+    supervise("message-routing", RestartPolicy::default(), move || {
+        run(weak.clone())
+    });
+}
+
+/// Stop routing until the next `start`; messages for peers wait in the mailboxes
+/// 停止路由直到下一次 `start`；发往对等节点的消息在邮箱中等待
+pub fn stop(node: &NodeServices) {
+    *node.message_routing.config.write() = MessageRoutingConfig::default();
+    node.message_passing.routed().notify_one();
+}
+
+/// Route until the spearlet owning the services is dropped / 持续路由直到持有这些服务的 spearlet 被丢弃
+async fn run(weak: Weak<NodeServices>) {
+    let client = reqwest::Client::builder()
+        .timeout(HTTP_TIMEOUT)
+        .build()
+        .unwrap_or_default();
+    let mut peers: Vec<String> = Vec::new();
+    let mut last_sync: Option<Instant> = None;
+    while let Some(node) = weak.upgrade() {
+        let bus = &node.message_passing;
+        let cfg = node.message_routing.config.read().clone();
+        let interval = Duration::from_millis(cfg.sync_interval_ms.max(1000));
+        if cfg.enabled && bus.routing_enabled() {
+            let (outgoing, names_changed) = bus.take_outgoing();
+            let due = last_sync.map_or(true, |t| t.elapsed() >= interval);
+            if due {
+                peers = resolve_peers(&node, &cfg).await;
+                bus.expire_peers(interval * 3);
+                last_sync = Some(Instant::now());
+            }
+            if due || names_changed {
+                announce(&node, &client, &cfg, &peers).await;
+            }
+            for item in outgoing {
+                tokio::spawn(send_with_retry(
+                    node.clone(),
+                    client.clone(),
+                    cfg.clone(),
+                    item,
+                ));
+            }
+        }
+        tokio::select! {
+            _ = bus.routed().notified() => {}
+            _ = tokio::time::sleep(interval) => {}
+        }
+    }
+}
+
+/// Configured peers plus the active nodes known to SMS, without this spearlet
+/// 配置的对等节点加上 SMS 已知的活跃节点，不含本 spearlet
+async fn resolve_peers(node: &NodeServices, cfg: &MessageRoutingConfig) -> Vec<String> {
+    let mut peers: Vec<String> = cfg
+        .peers
+        .iter()
+        .map(|p| p.trim_end_matches('/').to_string())
+        .collect();
+    let channel = node.message_routing.sms_channel.read().clone();
+    if let (true, Some(channel)) = (cfg.discover_peers, channel) {
+        let req = ListNodesRequest {
+            status_filter: "active".to_string(),
+        };
+        match NodeServiceClient::new(channel).list_nodes(req).await {
+            Ok(resp) => peers.extend(
+                resp.into_inner()
+                    .nodes
+                    .into_iter()
+                    .filter(|n| !n.ip_address.is_empty() && n.http_port > 0)
+                    .map(|n| format!("http://{}:{}", n.ip_address, n.http_port)),
+            ),
+            Err(e) => warn!(error = %e, "message routing: listing SMS nodes failed"),
+        }
+    }
+    let own = cfg.advertise_url.trim_end_matches('/');
+    peers.retain(|p| p != own);
+    peers.sort();
+    peers.dedup();
+    peers
+}
+
+fn post<T: Serialize>(
+    client: &reqwest::Client,
+    cfg: &MessageRoutingConfig,
+    url: String,
+    body: &T,
+) -> reqwest::RequestBuilder {
+    let mut req = client.post(url).json(body);
+    if !cfg.token_env.is_empty() {
+        if let Ok(token) = std::env::var(&cfg.token_env) {
+            req = req.bearer_auth(token);
+        }
+    }
+    req
+}
+
+async fn announce(
+    node: &NodeServices,
+    client: &reqwest::Client,
+    cfg: &MessageRoutingConfig,
+    peers: &[String],
+) {
+    // Without an address peers could not deliver to us / 没有地址时对等节点无法向本节点投递
+    if cfg.advertise_url.is_empty() {
+        return;
+    }
+    let body = NamesAnnouncement {
+        url: cfg.advertise_url.trim_end_matches('/').to_string(),
+        names: node.message_passing.local_names(),
+    };
+    for peer in peers {
+        let url = format!("{}{}", peer, NAMES_PATH);
+        if let Err(e) = post(client, cfg, url, &body).send().await {
+            debug!(peer = %peer, error = %e, "message routing: announcing names failed");
+        }
+    }
+}
+
+/// Send one item until the peer accepts it or `retry_for_ms` passes
+/// 发送一项工作，直到对等节点接受或超过 `retry_for_ms`
+async fn send_with_retry(
+    node: Arc<NodeServices>,
+    client: reqwest::Client,
+    cfg: MessageRoutingConfig,
+    item: Outgoing,
+) {
+    let (peer, req) = match &item {
+        Outgoing::Deliver {
+            key,
+            peer,
+            to,
+            from,
+            id,
+            data,
+        } => {
+            let body = DeliverRequest {
+                key: key.clone(),
+                from_url: cfg.advertise_url.trim_end_matches('/').to_string(),
+                from: *from,
+                id: *id,
+                to: *to,
+                data: general_purpose::STANDARD.encode(data),
+            };
+            (
+                peer,
+                post(&client, &cfg, format!("{}{}", peer, DELIVER_PATH), &body),
+            )
+        }
+        Outgoing::Ack { peer, id, dropped } => {
+            let body = AckNotice {
+                id: *id,
+                dropped: *dropped,
+            };
+            (
+                peer,
+                post(&client, &cfg, format!("{}{}", peer, ACKS_PATH), &body),
+            )
+        }
+    };
+    let sent_id = match &item {
+        Outgoing::Deliver { id, .. } => Some(*id),
+        Outgoing::Ack { .. } => None,
+    };
+    let deadline = Instant::now() + Duration::from_millis(cfg.retry_for_ms);
+    let mut backoff = Duration::from_millis(200);
+    loop {
+        let attempt = req.try_clone().map(|r| r.send());
+        let status = match attempt {
+            Some(fut) => fut.await.map(|r| r.status()),
+            None => return,
+        };
+        match status {
+            Ok(s) if s.is_success() => return,
+            Ok(s) if s == reqwest::StatusCode::NOT_FOUND => {
+                if let Some(id) = sent_id {
+                    node.message_passing.remote_ack(id, true);
+                }
+                return;
+            }
+            Ok(s) => debug!(peer = %peer, status = %s, "message routing: peer refused"),
+            Err(e) => debug!(peer = %peer, error = %e, "message routing: peer unreachable"),
+        }
+        if Instant::now() + backoff >= deadline {
+            warn!(peer = %peer, "message routing: giving up after retry_for_ms");
+            if let Some(id) = sent_id {
+                node.message_passing.remote_ack(id, true);
+            }
+            return;
+        }
+        tokio::time::sleep(backoff).await;
+        backoff = (backoff * 2).min(MAX_BACKOFF);
+    }
+}
+
+/// Record the names a peer announced / 记录对等节点公布的名称
+pub fn accept_names(node: &NodeServices, req: NamesAnnouncement) -> Result<(), MpError> {
+    let bus = &node.message_passing;
+    if !bus.routing_enabled() {
+        return Err(MpError::Disabled);
+    }
+    if req.url.is_empty() {
+        return Err(MpError::Invalid("url is required".to_string()));
+    }
+    bus.set_peer_names(req.url.trim_end_matches('/'), req.names);
+    Ok(())
+}
+
+/// Queue a message a peer delivered; returns its id here / 将对等节点投递的消息入队；返回其在本地的 ID
+pub fn accept_delivery(node: &NodeServices, req: DeliverRequest) -> Result<u32, MpError> {
+    if req.key.is_empty() {
+        return Err(MpError::Invalid("key is required".to_string()));
+    }
+    let data = general_purpose::STANDARD
+        .decode(&req.data)
+        .map_err(|_| MpError::Invalid("data is not base64".to_string()))?;
+    node.message_passing.deliver_remote(
+        &req.key,
+        req.from_url.trim_end_matches('/'),
+        Received {
+            id: req.id,
+            from: req.from,
+            data,
+        },
+        req.to,
+    )
+}
+
+pub fn accept_ack(node: &NodeServices, req: AckNotice) -> Result<(), MpError> {
+    let bus = &node.message_passing;
+    if !bus.routing_enabled() {
+        return Err(MpError::Disabled);
+    }
+    bus.remote_ack(req.id, req.dropped);
+    Ok(())
+}
@@ -0,0 +1,503 @@
+//! Federated metrics export / 联邦指标导出
+//!
+//! Instead of being scraped, each spearlet sums its executions into fixed windows and ships
+//! the closed windows to the SMS over the node service. Windows wait in a bounded outbox
+//! while the SMS is unreachable and the oldest are dropped when it is full. Uploads are
+//! limited by a byte budget per hour.
+//! spearlet 不再被抓取，而是把执行情况汇总到固定窗口中，并通过节点服务把已关闭的窗口发送给
+//! SMS。SMS 不可达时窗口在有界发件箱中等待，满时丢弃最旧的窗口。上传受每小时字节预算限制。
+
+use std::collections::{HashMap, VecDeque};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use parking_lot::Mutex;
+use prost::Message;
+use tokio::time::{interval, timeout, MissedTickBehavior};
+use tokio_util::sync::CancellationToken;
+use tonic::transport::Channel;
+use tracing::{debug, info, warn};
+
+use crate::proto::sms::{
+    node_service_client::NodeServiceClient, NodeMetricsWindow, ReportNodeMetricsRequest, TaskUsage,
+};
+use crate::spearlet::config::{MetricsExportConfig, SpearletConfig};
+use crate::spearlet::execution::manager::TaskExecutionManager;
+use crate::spearlet::node_services::NodeServices;
+
+/// Task id under which tasks beyond the per-window limit are summed
+/// 超出每窗口上限的任务汇总所用的任务 ID
+pub const OTHER_TASKS: &str = "_other";
+
+const REPORT_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Usage summed since the current window opened / 当前窗口开启以来汇总的用量
+#[derive(Debug, Default)]
+struct Window {
+    start_ms: i64,
+    executions: u64,
+    failed_executions: u64,
+    execution_time_ms: u64,
+    max_execution_time_ms: u64,
+    tasks: HashMap<String, TaskUsage>,
+}
+
+impl Window {
+    fn opened_at(start_ms: i64) -> Self {
+        Self {
+            start_ms,
+            ..Default::default()
+        }
+    }
+
+    fn add(&mut self, task_id: &str, duration_ms: u64, failed: bool) {
+        self.executions += 1;
+        self.execution_time_ms += duration_ms;
+        self.max_execution_time_ms = self.max_execution_time_ms.max(duration_ms);
+        let task = self.tasks.entry(task_id.to_string()).or_default();
+        task.executions += 1;
+        task.execution_time_ms += duration_ms;
+        if failed {
+            self.failed_executions += 1;
+            task.failed_executions += 1;
+        }
+    }
+
+    /// Close the window, keeping the `max_tasks` busiest tasks
+    /// 关闭窗口，保留最繁忙的 `max_tasks` 个任务
+    fn close(
+        self,
+        seq: u64,
+        end_ms: i64,
+        max_tasks: usize,
+        gauges: HashMap<String, f64>,
+    ) -> NodeMetricsWindow {
+        let mut tasks: Vec<(String, TaskUsage)> = self.tasks.into_iter().collect();
+        tasks.sort_by(|a, b| {
+            b.1.executions
+                .cmp(&a.1.executions)
+                .then_with(|| a.0.cmp(&b.0))
+        });
+        let rest = if tasks.len() > max_tasks {
+            tasks.split_off(max_tasks)
+        } else {
+            Vec::new()
+        };
+        let other_tasks = rest.len() as u64;
+        let mut tasks: HashMap<String, TaskUsage> = tasks.into_iter().collect();
+        if !rest.is_empty() {
+            let other = tasks.entry(OTHER_TASKS.to_string()).or_default();
+            for (_, u) in rest {
+                other.executions += u.executions;
+                other.failed_executions += u.failed_executions;
+                other.execution_time_ms += u.execution_time_ms;
+            }
+        }
+        NodeMetricsWindow {
+            seq,
+            start_ms: self.start_ms,
+            end_ms,
+            executions: self.executions,
+            failed_executions: self.failed_executions,
+            execution_time_ms: self.execution_time_ms,
+            max_execution_time_ms: self.max_execution_time_ms,
+            tasks,
+            gauges,
+            other_tasks,
+        }
+    }
+}
+
+fn now_ms() -> i64 {
+    chrono::Utc::now().timestamp_millis()
+}
+
+/// The open window of one spearlet, summed while its export runs
+/// 单个 spearlet 的当前窗口，在其导出运行期间汇总
+#[derive(Debug)]
+pub struct MetricsWindow {
+    enabled: AtomicBool,
+    current: Mutex<Window>,
+}
+
+impl Default for MetricsWindow {
+    fn default() -> Self {
+        Self {
+            enabled: AtomicBool::new(false),
+            current: Mutex::new(Window::opened_at(now_ms())),
+        }
+    }
+}
+
+impl MetricsWindow {
+    /// Count a finished execution into the current window; no-op while export is off
+    /// 将已结束的执行计入当前窗口；导出关闭时不做任何事
+    pub fn record_execution(&self, task_id: &str, duration_ms: u64, failed: bool) {
+        if !self.enabled.load(Ordering::Relaxed) {
+            return;
+        }
+        self.current.lock().add(task_id, duration_ms, failed);
+    }
+
+    /// Swap in a fresh window and return the closed one / 换入新窗口并返回已关闭的窗口
+    fn rotate(&self, now: i64) -> Window {
+        std::mem::replace(&mut *self.current.lock(), Window::opened_at(now))
+    }
+}
+
+/// Closed windows waiting for upload / 等待上传的已关闭窗口
+#[derive(Debug)]
+struct Outbox {
+    windows: VecDeque<NodeMetricsWindow>,
+    capacity: usize,
+    dropped: u64,
+}
+
+impl Outbox {
+    fn new(capacity: usize) -> Self {
+        Self {
+            windows: VecDeque::new(),
+            capacity: capacity.max(1),
+            dropped: 0,
+        }
+    }
+
+    fn push(&mut self, window: NodeMetricsWindow) {
+        while self.windows.len() >= self.capacity {
+            self.windows.pop_front();
+            self.dropped += 1;
+        }
+        self.windows.push_back(window);
+    }
+
+    /// Oldest windows whose encoded size fits in `budget` bytes. When nothing fits and
+    /// `force_one` is set the oldest window is returned alone, so a window larger than
+    /// the whole budget cannot block the outbox.
+    /// 编码大小不超过 `budget` 字节的最旧窗口。若没有窗口放得下且设置了 `force_one`，则单独
+    /// 返回最旧的窗口，避免大于整个预算的窗口阻塞发件箱。
+    fn take(&mut self, budget: u64, force_one: bool) -> (Vec<NodeMetricsWindow>, u64) {
+        let mut out = Vec::new();
+        let mut bytes = 0u64;
+        while let Some(w) = self.windows.front() {
+            let len = w.encoded_len() as u64;
+            if bytes + len > budget && !(out.is_empty() && force_one) {
+                break;
+            }
+            bytes += len;
+            out.extend(self.windows.pop_front());
+        }
+        (out, bytes)
+    }
+
+    /// Put back windows that were not acknowledged / 放回未被确认的窗口
+    fn requeue(&mut self, windows: Vec<NodeMetricsWindow>) {
+        for w in windows.into_iter().rev() {
+            self.windows.push_front(w);
+        }
+        while self.windows.len() > self.capacity {
+            self.windows.pop_front();
+            self.dropped += 1;
+        }
+    }
+}
+
+/// Token bucket over uploaded bytes / 上传字节的令牌桶
+#[derive(Debug)]
+pub(crate) struct ByteBudget {
+    /// 0 means unlimited / 0 表示不限制
+    per_hour: u64,
+    tokens: f64,
+    refilled_at: Instant,
+}
+
+impl ByteBudget {
+    pub(crate) fn new(per_hour: u64, now: Instant) -> Self {
+        Self {
+            per_hour,
+            tokens: per_hour as f64,
+            refilled_at: now,
+        }
+    }
+
+    pub(crate) fn refill(&mut self, now: Instant) {
+        if self.per_hour == 0 {
+            return;
+        }
+        let elapsed = now
+            .saturating_duration_since(self.refilled_at)
+            .as_secs_f64();
+        self.tokens =
+            (self.tokens + elapsed * self.per_hour as f64 / 3600.0).min(self.per_hour as f64);
+        self.refilled_at = now;
+    }
+
+    pub(crate) fn available(&self) -> u64 {
+        if self.per_hour == 0 {
+            u64::MAX
+        } else {
+            self.tokens as u64
+        }
+    }
+
+    pub(crate) fn is_full(&self) -> bool {
+        self.per_hour == 0 || self.tokens >= self.per_hour as f64
+    }
+
+    pub(crate) fn spend(&mut self, bytes: u64) {
+        if self.per_hour > 0 {
+            self.tokens = (self.tokens - bytes as f64).max(0.0);
+        }
+    }
+}
+
+fn gauges(manager: Option<&TaskExecutionManager>) -> HashMap<String, f64> {
+    let mut out = HashMap::new();
+    if let Some(m) = manager {
+        let stats = m.get_statistics();
+        out.insert("running_executions".into(), stats.running_executions as f64);
+        out.insert("pending_executions".into(), stats.pending_executions as f64);
+        out.insert("active_instances".into(), stats.active_instances as f64);
+        out.insert("active_tasks".into(), stats.active_tasks as f64);
+        // AI usage of the month so far / 本月至今的 AI 用量
+        let usage = m.node().usage.report().total;
+        out.insert("ai_input_tokens".into(), usage.input_tokens as f64);
+        out.insert("ai_output_tokens".into(), usage.output_tokens as f64);
+        out.insert("ai_characters".into(), usage.characters as f64);
+        out.insert("ai_audio_secs".into(), usage.audio_ms as f64 / 1000.0);
+        out.insert("ai_cost".into(), usage.cost);
+    }
+    out
+}
+
+#[derive(Debug)]
+pub struct MetricsExporter {
+    config: Arc<SpearletConfig>,
+    sms_channel: Option<Channel>,
+    execution_manager: Option<Arc<TaskExecutionManager>>,
+    node: Arc<NodeServices>,
+    cancel: CancellationToken,
+}
+
+impl MetricsExporter {
+    pub fn new(
+        config: Arc<SpearletConfig>,
+        sms_channel: Option<Channel>,
+        execution_manager: Option<Arc<TaskExecutionManager>>,
+    ) -> Self {
+        let node = execution_manager
+            .as_ref()
+            .map(|m| m.node().clone())
+            .unwrap_or_else(NodeServices::new);
+        Self {
+            config,
+            sms_channel,
+            execution_manager,
+            node,
+            cancel: CancellationToken::new(),
+        }
+    }
+
+    pub fn shutdown(&self) {
+        self.cancel.cancel();
+    }
+
+    pub fn start(&self) {
+        let cfg = self.config.metrics_export.clone();
+        if !cfg.enabled {
+            return;
+        }
+        let Some(channel) = self.sms_channel.clone() else {
+            warn!("metrics export enabled but no SMS channel");
+            return;
+        };
+        let node = self.node.clone();
+        node.metrics_window.enabled.store(true, Ordering::Relaxed);
+        node.metrics_window.rotate(now_ms());
+        info!(
+            window_s = cfg.window_s,
+            flush_interval_s = cfg.flush_interval_s,
+            bandwidth_bytes_per_hour = cfg.bandwidth_bytes_per_hour,
+            "Metrics export started"
+        );
+        let node_uuid = self.config.compute_node_uuid();
+        let manager = self.execution_manager.clone();
+        let cancel = self.cancel.clone();
+        tokio::spawn(async move {
+            let window = &node.metrics_window;
+            export_loop(cfg, node_uuid, channel, window, manager, cancel).await;
+            window.enabled.store(false, Ordering::Relaxed);
+        });
+    }
+}
+
+async fn export_loop(
+    cfg: MetricsExportConfig,
+    node_uuid: String,
+    channel: Channel,
+    window: &MetricsWindow,
+    manager: Option<Arc<TaskExecutionManager>>,
+    cancel: CancellationToken,
+) {
+    let mut client = NodeServiceClient::new(channel);
+    let mut outbox = Outbox::new(cfg.buffer_windows);
+    let mut budget = ByteBudget::new(cfg.bandwidth_bytes_per_hour, Instant::now());
+    let mut seq = 0u64;
+    let mut window_tick = interval(Duration::from_secs(cfg.window_s.max(1)));
+    let mut flush_tick = interval(Duration::from_secs(cfg.flush_interval_s.max(1)));
+    window_tick.set_missed_tick_behavior(MissedTickBehavior::Delay);
+    flush_tick.set_missed_tick_behavior(MissedTickBehavior::Delay);
+    // Both fire immediately; skip that first tick / 两者都会立即触发；跳过首次触发
+    window_tick.tick().await;
+    flush_tick.tick().await;
+
+    loop {
+        tokio::select! {
+            _ = cancel.cancelled() => {
+                // Last partial window, sent once without waiting for the budget
+                // 最后一个不完整窗口，不等待预算只发送一次
+                seq += 1;
+                outbox.push(close_current(seq, &cfg, window, manager.as_deref()));
+                budget = ByteBudget::new(0, Instant::now());
+                flush(&mut client, &node_uuid, &mut outbox, &mut budget).await;
+                break;
+            }
+            _ = window_tick.tick() => {
+                seq += 1;
+                outbox.push(close_current(seq, &cfg, window, manager.as_deref()));
+            }
+            _ = flush_tick.tick() => {
+                flush(&mut client, &node_uuid, &mut outbox, &mut budget).await;
+            }
+        }
+    }
+}
+
+fn close_current(
+    seq: u64,
+    cfg: &MetricsExportConfig,
+    window: &MetricsWindow,
+    manager: Option<&TaskExecutionManager>,
+) -> NodeMetricsWindow {
+    let now = now_ms();
+    window
+        .rotate(now)
+        .close(seq, now, cfg.max_tasks_per_window, gauges(manager))
+}
+
+async fn flush(
+    client: &mut NodeServiceClient<Channel>,
+    node_uuid: &str,
+    outbox: &mut Outbox,
+    budget: &mut ByteBudget,
+) {
+    budget.refill(Instant::now());
+    let (windows, bytes) = outbox.take(budget.available(), budget.is_full());
+    if windows.is_empty() {
+        return;
+    }
+    budget.spend(bytes);
+    let count = windows.len();
+    let req = ReportNodeMetricsRequest {
+        uuid: node_uuid.to_string(),
+        windows: windows.clone(),
+        dropped_windows: outbox.dropped,
+    };
+    match timeout(REPORT_TIMEOUT, client.report_node_metrics(req)).await {
+        Ok(Ok(resp)) if resp.get_ref().success => {
+            debug!(windows = count, bytes, "Metrics windows reported");
+        }
+        Ok(Ok(_)) => {
+            debug!("SMS rejected metrics windows, node not registered yet");
+            outbox.requeue(windows);
+        }
+        Ok(Err(e)) => {
+            debug!(error = %e, "Metrics report failed");
+            outbox.requeue(windows);
+        }
+        Err(_) => {
+            debug!("Metrics report timed out");
+            outbox.requeue(windows);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_window_folds_tasks_beyond_limit() {
+        let mut w = Window::opened_at(1_000);
+        for _ in 0..3 {
+            w.add("a", 10, false);
+        }
+        w.add("b", 50, true);
+        w.add("b", 5, false);
+        w.add("c", 7, false);
+        w.add("d", 1, true);
+
+        let closed = w.close(4, 61_000, 2, HashMap::new());
+        assert_eq!(closed.seq, 4);
+        assert_eq!(closed.executions, 7);
+        assert_eq!(closed.failed_executions, 2);
+        assert_eq!(closed.execution_time_ms, 93);
+        assert_eq!(closed.max_execution_time_ms, 50);
+        assert_eq!(closed.other_tasks, 2);
+        assert_eq!(closed.tasks.len(), 3);
+        assert_eq!(closed.tasks["a"].executions, 3);
+        assert_eq!(closed.tasks["b"].failed_executions, 1);
+        let other = &closed.tasks[OTHER_TASKS];
+        assert_eq!(other.executions, 2);
+        assert_eq!(other.failed_executions, 1);
+        assert_eq!(other.execution_time_ms, 8);
+    }
+
+    fn window(seq: u64) -> NodeMetricsWindow {
+        NodeMetricsWindow {
+            seq,
+            start_ms: seq as i64 * 60_000,
+            end_ms: (seq as i64 + 1) * 60_000,
+            executions: seq,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_outbox_drops_oldest_and_respects_budget() {
+        let mut outbox = Outbox::new(3);
+        for seq in 1..=5 {
+            outbox.push(window(seq));
+        }
+        assert_eq!(outbox.dropped, 2);
+
+        let one = window(3).encoded_len() as u64;
+        let (batch, bytes) = outbox.take(one, false);
+        assert_eq!(batch.iter().map(|w| w.seq).collect::<Vec<_>>(), vec![3]);
+        assert_eq!(bytes, one);
+        assert!(outbox.take(0, false).0.is_empty());
+        assert_eq!(outbox.take(0, true).0.len(), 1);
+
+        outbox.requeue(batch);
+        assert_eq!(
+            outbox.windows.iter().map(|w| w.seq).collect::<Vec<_>>(),
+            vec![3, 5]
+        );
+    }
+
+    #[test]
+    fn test_byte_budget_refills_over_time() {
+        let start = Instant::now();
+        let mut budget = ByteBudget::new(3600, start);
+        assert!(budget.is_full());
+        budget.spend(3000);
+        assert_eq!(budget.available(), 600);
+        budget.refill(start + Duration::from_secs(100));
+        assert_eq!(budget.available(), 700);
+        budget.refill(start + Duration::from_secs(10_000));
+        assert!(budget.is_full());
+
+        let unlimited = ByteBudget::new(0, start);
+        assert_eq!(unlimited.available(), u64::MAX);
+    }
+}
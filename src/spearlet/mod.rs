@@ -27,21 +27,87 @@
 //!                         └─────────────────┘
 //! ```
 
+pub mod about;
+pub mod admin;
+pub mod async_journal;
 pub mod backend_reporter;
+pub mod blob_cache;
+pub mod build_info;
+pub mod clock;
+pub mod compute_hints;
 pub mod config;
+pub mod config_check;
+pub mod config_rollout;
+pub mod crash;
+pub mod debug_tunnel;
+pub mod desired_state;
+pub mod device_profile;
+pub mod embedded;
+pub mod energy;
+pub mod examples;
+pub mod exec_service;
+pub mod exec_stream;
 pub mod execution;
 pub mod function_service;
+pub mod grpc_auth;
 pub mod grpc_server;
+pub mod http_auth;
+pub mod http_body;
+pub mod http_cors;
+pub mod http_error;
+pub mod http_listeners;
 pub mod http_gateway;
 pub mod instance_service;
+pub mod ip_allowlist;
+pub mod kv_state;
+pub mod lifecycle;
 pub mod local_models;
+pub mod local_store;
+pub mod message_passing;
+pub mod message_routing;
+pub mod locale;
+pub mod log_shipping;
 pub mod mcp;
+pub mod metrics_export;
+pub mod moderation;
+pub mod node_services;
 pub mod object_service;
 pub mod ollama_discovery;
+pub mod onnx;
+pub mod otel;
+pub mod output_diff;
 pub mod param_keys;
+pub mod preemption;
+pub mod rate_limit;
 pub mod registration;
+pub mod reload;
+pub mod request_id;
+pub mod response_cache;
+pub mod rtp;
+#[cfg(feature = "rtsp")]
+pub mod rtsp;
+pub mod schedules;
+pub mod scratch_files;
+pub mod service_ports;
+pub mod shutdown;
 pub mod sms_connector;
+pub mod stream_mux;
+pub mod stream_resume;
+pub mod supervisor;
 pub mod task_events;
+#[cfg(feature = "telephony")]
+pub mod telephony;
+pub mod temp_workspace;
+pub mod tls;
+pub mod tool_plugins;
+pub mod tool_schema;
+pub mod tool_simulation;
+pub mod usage;
+pub mod vector_store;
+pub mod webhook;
+#[cfg(feature = "webrtc")]
+pub mod webrtc_ingest;
+pub mod ws_keepalive;
 
 #[cfg(test)]
 mod config_test;
@@ -58,6 +124,8 @@ mod registration_test;
 
 // Re-export commonly used types / 重新导出常用类型
 pub use config::{AppConfig, CliArgs, SpearletConfig};
+pub use embedded::{Spearlet, SpearletBuilder};
+pub use exec_service::ExecServiceImpl;
 pub use function_service::{FunctionServiceImpl, FunctionServiceStats};
 pub use grpc_server::{GrpcServer, HealthService};
 pub use http_gateway::HttpGateway;
@@ -0,0 +1,204 @@
+//! Content moderation policy / 内容审核策略
+//!
+//! Workloads can check text themselves with the `moderate` hostcall. On top of that, the
+//! spearlet can screen the chat traffic of workloads it does not trust: with the policy on,
+//! `cchat_send` of an untrusted task sends the new messages of the prompt to a moderation
+//! backend before the model sees them, and the model's answer before the task sees it. A
+//! task is untrusted when it is listed in `untrusted_tasks` or its task config sets
+//! `moderation.untrusted = "true"`. Screening fails closed: when no moderation backend
+//! answers, the chat call fails too.
+//! 工作负载可以通过 `moderate` hostcall 自行检查文本。此外，spearlet 可以对其不信任的工作负载的对话流量
+//! 进行审核：开启策略后，不受信任任务的 `cchat_send` 会在模型看到之前将提示中的新消息发送给 moderation
+//! 后端，并在任务看到之前审核模型的应答。任务列在 `untrusted_tasks` 中或其任务配置设置了
+//! `moderation.untrusted = "true"` 时即为不受信任。审核失败即拒绝：没有 moderation 后端应答时，对话调用
+//! 同样失败。
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicU64, Ordering};
+
+use dashmap::DashSet;
+use parking_lot::RwLock;
+use serde::Serialize;
+use serde_json::Value;
+
+use crate::spearlet::config::ModerationConfig;
+use crate::spearlet::param_keys::moderation as moderation_keys;
+
+/// Part of a chat call that is screened / 被审核的对话调用部分
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Stage {
+    Prompt,
+    Response,
+}
+
+impl Stage {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Stage::Prompt => "prompt",
+            Stage::Response => "response",
+        }
+    }
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct ModerationStats {
+    pub enabled: bool,
+    /// Tasks flagged through their task config / 通过任务配置标记的任务数
+    pub flagged_tasks: usize,
+    pub untrusted_tasks: usize,
+    pub screened: u64,
+    pub blocked: u64,
+    /// Screenings that failed, and so blocked the call / 失败并因此拒绝调用的审核次数
+    pub errors: u64,
+}
+
+#[derive(Default)]
+pub struct Moderation {
+    config: RwLock<ModerationConfig>,
+    flagged: DashSet<String>,
+    screened: AtomicU64,
+    blocked: AtomicU64,
+    errors: AtomicU64,
+}
+
+impl Moderation {
+    pub fn set_config(&self, config: ModerationConfig) {
+        *self.config.write() = config;
+    }
+
+    pub fn config(&self) -> ModerationConfig {
+        self.config.read().clone()
+    }
+
+    /// Record whether a task's config flags it untrusted / 记录任务配置是否将其标记为不受信任
+    pub fn mark_task(&self, task_id: &str, task_config: &HashMap<String, String>) {
+        let untrusted = task_config
+            .get(moderation_keys::task_config::UNTRUSTED)
+            .map(|v| {
+                matches!(
+                    v.trim().to_ascii_lowercase().as_str(),
+                    "true" | "1" | "yes" | "on"
+                )
+            })
+            .unwrap_or(false);
+        if untrusted {
+            self.flagged.insert(task_id.to_string());
+        } else {
+            self.flagged.remove(task_id);
+        }
+    }
+
+    /// Whether `stage` of the task's chat calls is screened / 任务对话调用的 `stage` 部分是否受审核
+    pub fn screens(&self, task_id: &str, stage: Stage) -> bool {
+        let cfg = self.config.read();
+        let on = match stage {
+            Stage::Prompt => cfg.screen_prompts,
+            Stage::Response => cfg.screen_responses,
+        };
+        cfg.enabled
+            && on
+            && (self.flagged.contains(task_id) || cfg.untrusted_tasks.iter().any(|t| t == task_id))
+    }
+
+    /// Categories of `result` that block under the policy; empty when it passes
+    /// `result` 中按策略应拒绝的类别；通过时为空
+    ///
+    /// `result` is one entry of a moderation answer, `{flagged, categories}`.
+    /// `result` 是 moderation 应答中的一项，形如 `{flagged, categories}`。
+    pub fn blocking_categories(&self, result: &Value) -> Vec<String> {
+        let flagged = result.get("flagged").and_then(|v| v.as_bool()) == Some(true);
+        let mut set: Vec<String> = result
+            .get("categories")
+            .and_then(|v| v.as_object())
+            .map(|m| {
+                m.iter()
+                    .filter(|(_, v)| v.as_bool() == Some(true))
+                    .map(|(k, _)| k.clone())
+                    .collect()
+            })
+            .unwrap_or_default();
+        let cfg = self.config.read();
+        if cfg.block_categories.is_empty() {
+            if flagged && set.is_empty() {
+                set.push("flagged".to_string());
+            } else if !flagged {
+                set.clear();
+            }
+        } else {
+            set.retain(|c| cfg.block_categories.iter().any(|b| b == c));
+        }
+        set.sort();
+        set
+    }
+
+    /// Count a screening and its outcome / 统计一次审核及其结果
+    pub fn record(&self, blocked: bool, failed: bool) {
+        self.screened.fetch_add(1, Ordering::Relaxed);
+        if blocked {
+            self.blocked.fetch_add(1, Ordering::Relaxed);
+        }
+        if failed {
+            self.errors.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    pub fn stats(&self) -> ModerationStats {
+        let cfg = self.config.read();
+        ModerationStats {
+            enabled: cfg.enabled,
+            flagged_tasks: self.flagged.len(),
+            untrusted_tasks: cfg.untrusted_tasks.len(),
+            screened: self.screened.load(Ordering::Relaxed),
+            blocked: self.blocked.load(Ordering::Relaxed),
+            errors: self.errors.load(Ordering::Relaxed),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_policy_screens_untrusted_tasks_only() {
+        let m = Moderation::default();
+        m.set_config(ModerationConfig {
+            enabled: true,
+            untrusted_tasks: vec!["listed".to_string()],
+            ..Default::default()
+        });
+        let mut task_config = HashMap::new();
+        task_config.insert("moderation.untrusted".to_string(), "true".to_string());
+        m.mark_task("flagged", &task_config);
+
+        assert!(m.screens("listed", Stage::Prompt));
+        assert!(m.screens("flagged", Stage::Response));
+        assert!(!m.screens("other", Stage::Prompt));
+
+        m.mark_task("flagged", &HashMap::new());
+        assert!(!m.screens("flagged", Stage::Prompt));
+    }
+
+    #[test]
+    fn test_blocking_categories() {
+        let m = Moderation::default();
+        let result = json!({
+            "flagged": true,
+            "categories": {"violence": true, "hate": false, "harassment": true}
+        });
+        assert_eq!(
+            m.blocking_categories(&result),
+            vec!["harassment", "violence"]
+        );
+        assert!(m
+            .blocking_categories(&json!({"flagged": false, "categories": {"hate": true}}))
+            .is_empty());
+
+        m.set_config(ModerationConfig {
+            block_categories: vec!["hate".to_string()],
+            ..Default::default()
+        });
+        assert!(m.blocking_categories(&result).is_empty());
+    }
+}
@@ -0,0 +1,410 @@
+//! Node-local services of one spearlet / 单个 spearlet 的节点本地服务
+//!
+//! `NodeServices` holds the state that the hostcalls, the execution manager and the HTTP
+//! gateway of one spearlet share: the blob cache, the vector store, key-value state,
+//! schedules, the async journal, mailboxes and their routing, scratch files, temporary
+//! workspaces, the response cache, usage, moderation, preemption, managed backends, camera
+//! subscriptions, WebRTC sessions, phone calls, user streams and their resumable sockets,
+//! child invocations, the hostcall middleware chain and the slots of slow hostcalls, the
+//! live configuration with its reloader and rollout overlay, desired-state results,
+//! provider health and the router filter hub, the energy governor, compute hints, the ONNX
+//! and model-store managers, service ports, the debug tunnel routes, tool plugins, the MCP
+//! registry sync, the metrics window, the gateway's loopback credential, the gate that
+//! admits hostcalls, and what is kept per running execution: termination marks, output
+//! caps, debug traces, run records, wasm logs and session languages. A `Spearlet` owns one
+//! and hands it to its runtimes in `RuntimeConfig::node`, so two spearlets in one process
+//! keep their state apart. Every service starts off; `apply` turns on what the
+//! configuration asks for and `reset` turns it off again.
+//! `NodeServices` 保存单个 spearlet 的 hostcall、执行管理器与 HTTP 网关共享的状态：blob 缓存、
+//! 向量存储、键值状态、计划、异步日志、邮箱及其路由、临时文件、临时工作区、响应缓存、用量、审核、
+//! 抢占、托管后端、摄像头订阅、WebRTC 会话、来电、user stream 及其可恢复连接、子调用、hostcall
+//! 中间件链与慢速 hostcall 槽位、即时配置及其重载器与发布覆盖、期望状态结果、后端健康与路由过滤
+//! hub、能耗调控器、计算提示、ONNX 与模型仓库管理器、服务端口、调试隧道路由、工具插件、MCP 注册表
+//! 同步、指标窗口、网关回环凭证、放行 hostcall 的开关，以及每个运行中执行的状态：终止标记、输出
+//! 上限、调试追踪、运行记录、wasm 日志与会话语种。每个 `Spearlet` 持有一个，并通过
+//! `RuntimeConfig::node` 交给其运行时，因此同一进程中的两个 spearlet 互不共享状态。所有服务初始
+//! 均为关闭；`apply` 开启配置要求的服务，`reset` 再将其关闭。
+//!
+//! What belongs to the process stays process-wide: the log file writer, log shipping, the
+//! trace exporter, the crash hook, the clock monitor, supervised worker statuses, the storage
+//! factory and the shared HTTP client.
+//! 属于进程的内容仍为进程级：日志文件写入器、日志上送、追踪导出器、崩溃钩子、时钟监控、被监督
+//! 工作协程的状态、存储工厂与共享 HTTP 客户端。
+
+use std::fmt;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+
+use crate::spearlet::async_journal::{self, AsyncJournal};
+use crate::spearlet::blob_cache::BlobCache;
+use crate::spearlet::compute_hints::ComputeHints;
+use crate::spearlet::config::{SpearletConfig, TempWorkspaceConfig};
+use crate::spearlet::config_rollout::ConfigRollout;
+use crate::spearlet::debug_tunnel::TunnelRoutes;
+use crate::spearlet::desired_state::DesiredStateSync;
+use crate::spearlet::energy::EnergyGovernor;
+use crate::spearlet::execution::ai::router::grpc_filter_stream::RouterFilterHubSlot;
+use crate::spearlet::execution::ai::router::health::ProviderHealth;
+use crate::spearlet::execution::child_invoke::ChildInvocations;
+use crate::spearlet::execution::debug_trace::DebugTraces;
+use crate::spearlet::execution::host_api::dispatch::HostcallPool;
+use crate::spearlet::execution::host_api::middleware::HostcallChain;
+use crate::spearlet::execution::host_api::termination::Terminations;
+use crate::spearlet::execution::host_api::{SessionLanguages, UserStreams, WasmLogs};
+use crate::spearlet::execution::manifest::RunRecords;
+use crate::spearlet::execution::output_caps::OutputCapMeter;
+use crate::spearlet::grpc_auth::LocalCredential;
+use crate::spearlet::kv_state::{self, KvState};
+use crate::spearlet::local_models::lifecycle::{self as model_lifecycle, ModelLifecycleManager};
+use crate::spearlet::local_models::ManagedBackendRegistry;
+use crate::spearlet::mcp::registry_sync::McpRegistrySlot;
+use crate::spearlet::message_passing::MessageBus;
+use crate::spearlet::message_routing::MessageRouter;
+use crate::spearlet::metrics_export::MetricsWindow;
+use crate::spearlet::moderation::Moderation;
+use crate::spearlet::onnx::OnnxManager;
+use crate::spearlet::preemption::Preemption;
+use crate::spearlet::reload::LiveConfig;
+use crate::spearlet::response_cache::{self, ResponseCache};
+#[cfg(feature = "rtsp")]
+use crate::spearlet::rtsp::CameraRegistry;
+use crate::spearlet::schedules::{self, Schedules};
+use crate::spearlet::scratch_files::{self, ScratchFiles};
+use crate::spearlet::service_ports::ServicePorts;
+use crate::spearlet::stream_resume::ResumeSessions;
+#[cfg(feature = "telephony")]
+use crate::spearlet::telephony::PhoneCalls;
+use crate::spearlet::temp_workspace::{self, TempWorkspace};
+use crate::spearlet::tool_plugins::ToolPlugins;
+use crate::spearlet::usage::{self, UsageMeter};
+use crate::spearlet::vector_store::VectorStore;
+#[cfg(feature = "webrtc")]
+use crate::spearlet::webrtc_ingest::WebRtcSessions;
+
+/// Configuration sections `apply_section` knows / `apply_section` 识别的配置分节
+pub const SECTIONS: &[&str] = &[
+    "blob_cache",
+    "vector_store",
+    "kv_state",
+    "schedules",
+    "async_journal",
+    "message_passing",
+    "scratch_files",
+    "temp_workspace",
+    "response_cache",
+    "usage",
+    "moderation",
+    "preemption",
+    "backend_autosuspend",
+];
+
+pub struct NodeServices {
+    pub blob_cache: BlobCache,
+    pub vector_store: VectorStore,
+    pub kv_state: KvState,
+    pub schedules: Schedules,
+    pub async_journal: AsyncJournal,
+    pub message_passing: MessageBus,
+    pub message_routing: MessageRouter,
+    pub scratch_files: ScratchFiles,
+    pub temp_workspace: TempWorkspace,
+    pub response_cache: ResponseCache,
+    pub usage: UsageMeter,
+    pub moderation: Moderation,
+    pub preemption: Arc<Preemption>,
+    /// Backends started for model deployments, and their autosuspend activity
+    /// 为模型部署启动的后端及其自动挂起活动
+    pub managed_backends: ManagedBackendRegistry,
+    /// User streams of the running executions / 运行中执行的 user stream
+    pub user_streams: Arc<UserStreams>,
+    /// User-stream WebSockets that may be resumed / 可恢复的 user stream WebSocket
+    pub stream_resume: Arc<ResumeSessions>,
+    #[cfg(feature = "telephony")]
+    pub phone_calls: Arc<PhoneCalls>,
+    #[cfg(feature = "rtsp")]
+    pub cameras: CameraRegistry,
+    #[cfg(feature = "webrtc")]
+    pub webrtc: WebRtcSessions,
+    /// Child invocations, routed to this spearlet's execution manager
+    /// 子调用，路由到本 spearlet 的执行管理器
+    pub child_invoke: Arc<ChildInvocations>,
+    /// Termination marks the running executions and instances check
+    /// 运行中的执行与实例检查的终止标记
+    pub terminations: Terminations,
+    /// Output caps of the running executions / 运行中执行的输出上限
+    pub output_caps: OutputCapMeter,
+    /// Debug traces being recorded / 正在记录的调试追踪
+    pub debug_traces: DebugTraces,
+    /// What the running executions used, for their manifests / 运行中执行所用内容，用于其清单
+    pub run_records: RunRecords,
+    /// Languages detected or configured per ASR session / 每个 ASR 会话检测或配置的语种
+    pub session_languages: SessionLanguages,
+    /// Logs the wasm executions wrote, until reported to SMS / wasm 执行写入的日志，直至上报 SMS
+    pub wasm_logs: WasmLogs,
+    /// Middlewares every hostcall runs through, with their quotas and stats
+    /// 每个 hostcall 经过的中间件及其配额与统计
+    pub hostcall_chain: HostcallChain,
+    /// Slots slow hostcalls take while they run / 慢速 hostcall 运行期间占用的槽位
+    pub hostcall_pool: HostcallPool,
+    /// Settings reloaded live, and the reloader applying them
+    /// 即时重新加载的设置及应用它们的重载器
+    pub live_config: LiveConfig,
+    /// Configuration overlay assigned by an SMS rollout / SMS 发布分配的配置覆盖
+    pub config_rollout: ConfigRollout,
+    /// Last desired-state pass and the endpoints it mapped / 最近一轮期望状态结果及其映射的端点
+    pub desired_state: DesiredStateSync,
+    /// Circuit breakers of the LLM backends / LLM 后端的熔断器
+    pub provider_health: Arc<ProviderHealth>,
+    /// Router filter hub, started by the first runtime that asks for it
+    /// 路由过滤 hub，由首个需要它的运行时启动
+    pub router_filter: RouterFilterHubSlot,
+    /// Energy governor capping executions on battery or heat / 在电池或高温时限制执行的能耗调控器
+    pub energy: Arc<EnergyGovernor>,
+    /// Compute boosts other tasks make room for / 其他任务为之让路的计算提升
+    pub compute_hints: Arc<ComputeHints>,
+    /// ONNX models loaded for inference / 为推理加载的 ONNX 模型
+    pub onnx: Arc<OnnxManager>,
+    /// Models kept present in the model store / 保持存在于模型仓库中的模型
+    pub model_store: Arc<ModelLifecycleManager>,
+    /// Ports handed out to process instances / 分配给进程实例的端口
+    pub service_ports: ServicePorts,
+    /// Routes the debug tunnel answers with / 调试隧道用于应答的路由
+    pub debug_tunnel: TunnelRoutes,
+    /// Out-of-process tool plugins, discovered when the spearlet is built
+    /// 进程外工具插件，在构建 spearlet 时发现
+    pub tool_plugins: ToolPlugins,
+    /// MCP servers registered with the SMS / 在 SMS 注册的 MCP 服务器
+    pub mcp_registry: McpRegistrySlot,
+    /// Executions summed for the metrics export / 为指标导出汇总的执行
+    pub metrics_window: MetricsWindow,
+    /// What the HTTP gateway presents to the gRPC services of this node
+    /// HTTP 网关向本节点 gRPC 服务出示的凭证
+    pub local_credential: LocalCredential,
+    /// Open until the runtimes stop / 在运行时停止前保持打开
+    hostcalls_open: AtomicBool,
+}
+
+impl Default for NodeServices {
+    fn default() -> Self {
+        let config = SpearletConfig::default();
+        let terminations = Terminations::default();
+        let user_streams = Arc::new(UserStreams::default());
+        Self {
+            blob_cache: BlobCache::new(Default::default()),
+            vector_store: VectorStore::new(Default::default()),
+            kv_state: KvState::new(Default::default(), kv_state::state_dir(&config)),
+            schedules: Schedules::new(Default::default(), schedules::schedule_dir(&config)),
+            async_journal: AsyncJournal::new(
+                Default::default(),
+                async_journal::journal_dir(&config),
+            ),
+            message_passing: MessageBus::new(Default::default()),
+            message_routing: MessageRouter::default(),
+            scratch_files: ScratchFiles::new(
+                Default::default(),
+                scratch_files::scratch_dir(&config),
+            ),
+            temp_workspace: TempWorkspace::new(
+                TempWorkspaceConfig {
+                    enabled: false,
+                    ..Default::default()
+                },
+                temp_workspace::workspace_dir(&config),
+            ),
+            response_cache: ResponseCache::new(
+                Default::default(),
+                response_cache::cache_dir(&config),
+            ),
+            usage: UsageMeter::new(Default::default(), None),
+            moderation: Moderation::default(),
+            preemption: Arc::default(),
+            managed_backends: ManagedBackendRegistry::new(),
+            stream_resume: Arc::new(ResumeSessions::new(user_streams.clone())),
+            #[cfg(feature = "telephony")]
+            phone_calls: Arc::new(PhoneCalls::new(user_streams.clone())),
+            #[cfg(feature = "rtsp")]
+            cameras: CameraRegistry::new(user_streams.clone()),
+            #[cfg(feature = "webrtc")]
+            webrtc: WebRtcSessions::new(user_streams.clone()),
+            user_streams,
+            child_invoke: Arc::default(),
+            output_caps: OutputCapMeter::new(terminations.executions.clone()),
+            debug_traces: DebugTraces::default(),
+            run_records: RunRecords::default(),
+            terminations,
+            session_languages: SessionLanguages::default(),
+            wasm_logs: WasmLogs::default(),
+            hostcall_chain: HostcallChain::standard(),
+            hostcall_pool: HostcallPool::default(),
+            live_config: LiveConfig::default(),
+            config_rollout: ConfigRollout::default(),
+            desired_state: DesiredStateSync::default(),
+            provider_health: Arc::default(),
+            router_filter: RouterFilterHubSlot::default(),
+            energy: Arc::default(),
+            compute_hints: Arc::default(),
+            onnx: Arc::new(OnnxManager::new(Default::default())),
+            model_store: Arc::default(),
+            service_ports: ServicePorts::default(),
+            debug_tunnel: TunnelRoutes::default(),
+            tool_plugins: ToolPlugins::default(),
+            mcp_registry: McpRegistrySlot::default(),
+            metrics_window: MetricsWindow::default(),
+            local_credential: LocalCredential::default(),
+            hostcalls_open: AtomicBool::new(true),
+        }
+    }
+}
+
+impl fmt::Debug for NodeServices {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("NodeServices")
+            .field("hostcalls_open", &self.hostcalls_open())
+            .finish_non_exhaustive()
+    }
+}
+
+impl NodeServices {
+    pub fn new() -> Arc<Self> {
+        Arc::new(Self::default())
+    }
+
+    /// Apply every section of the configuration / 应用配置的所有分节
+    pub fn apply(&self, config: &SpearletConfig) {
+        for section in SECTIONS {
+            self.apply_section(section, config);
+        }
+        self.provider_health.set_config(config.llm.failover.clone());
+        self.energy.start(&config.energy);
+        self.compute_hints.configure(&config.compute_hints);
+        self.onnx.start(&config.onnx);
+        self.model_store.start(config);
+        // Workspaces of an earlier run belong to no task now / 之前运行的工作区已不属于任何任务
+        let stale = self.temp_workspace.clear();
+        if stale > 0 {
+            tracing::info!(stale, "Removed temporary workspaces of an earlier run");
+        }
+    }
+
+    /// Apply one section of the configuration; `false` if no service reads it
+    /// 应用配置中的一个分节；没有服务读取该分节时返回 `false`
+    pub fn apply_section(&self, section: &str, config: &SpearletConfig) -> bool {
+        match section {
+            "blob_cache" => self.blob_cache.set_config(config.blob_cache.clone()),
+            "vector_store" => self.vector_store.set_config(config.vector_store.clone()),
+            "kv_state" => self
+                .kv_state
+                .set_config(config.kv_state.clone(), kv_state::state_dir(config)),
+            "schedules" => self
+                .schedules
+                .set_config(config.schedules.clone(), schedules::schedule_dir(config)),
+            "async_journal" => self.async_journal.set_config(
+                config.async_journal.clone(),
+                async_journal::journal_dir(config),
+            ),
+            "message_passing" => self
+                .message_passing
+                .set_config(config.message_passing.clone()),
+            "scratch_files" => self.scratch_files.set_config(
+                config.scratch_files.clone(),
+                scratch_files::scratch_dir(config),
+            ),
+            "temp_workspace" => self.temp_workspace.set_config(
+                config.temp_workspace.clone(),
+                temp_workspace::workspace_dir(config),
+            ),
+            "response_cache" => self.response_cache.set_config(
+                config.response_cache.clone(),
+                response_cache::cache_dir(config),
+            ),
+            "usage" => self
+                .usage
+                .set_config(config.usage.clone(), Some(usage::state_file(config))),
+            "moderation" => self.moderation.set_config(config.moderation.clone()),
+            "preemption" => self.preemption.set_config(config.preemption.clone()),
+            "backend_autosuspend" => self
+                .managed_backends
+                .activity()
+                .set_config(config.backend_autosuspend.clone()),
+            _ => return false,
+        }
+        true
+    }
+
+    /// Turn every service off again, keeping the directories of `config`; usage is saved first
+    /// 再次关闭所有服务，保留 `config` 中的目录；先保存用量
+    pub fn reset(&self, config: &SpearletConfig) {
+        self.blob_cache.set_config(Default::default());
+        self.vector_store.set_config(Default::default());
+        self.kv_state
+            .set_config(Default::default(), kv_state::state_dir(config));
+        self.schedules
+            .set_config(Default::default(), schedules::schedule_dir(config));
+        self.async_journal
+            .set_config(Default::default(), async_journal::journal_dir(config));
+        self.message_passing.set_config(Default::default());
+        self.scratch_files
+            .set_config(Default::default(), scratch_files::scratch_dir(config));
+        self.temp_workspace.clear();
+        self.temp_workspace.set_config(
+            TempWorkspaceConfig {
+                enabled: false,
+                ..Default::default()
+            },
+            temp_workspace::workspace_dir(config),
+        );
+        self.response_cache
+            .set_config(Default::default(), response_cache::cache_dir(config));
+        self.usage.save();
+        self.moderation.set_config(Default::default());
+        self.preemption.set_config(Default::default());
+        self.managed_backends
+            .activity()
+            .set_config(Default::default());
+        self.provider_health.set_config(Default::default());
+        self.energy.start(&Default::default());
+        self.compute_hints.configure(&Default::default());
+        self.onnx.start(&Default::default());
+        self.model_store.set_config(
+            Default::default(),
+            model_lifecycle::store_dir(config),
+            String::new(),
+        );
+    }
+
+    /// Whether hostcalls reach the services; a spearlet that never started keeps it open
+    /// hostcall 是否可访问服务；从未启动的 spearlet 保持打开
+    pub fn hostcalls_open(&self) -> bool {
+        self.hostcalls_open.load(Ordering::SeqCst)
+    }
+
+    pub(crate) fn set_hostcalls_open(&self, open: bool) {
+        self.hostcalls_open.store(open, Ordering::SeqCst);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_services_of_two_nodes_are_separate() {
+        let mut config = SpearletConfig::default();
+        config.blob_cache.enabled = true;
+        config.message_passing.enabled = true;
+        let (a, b) = (NodeServices::new(), NodeServices::new());
+        a.apply(&config);
+        assert!(a.message_passing.stats().enabled);
+        assert!(!b.message_passing.stats().enabled);
+
+        let id = a.blob_cache.put("task", b"payload".to_vec()).unwrap();
+        assert!(b.blob_cache.get(&id).is_err());
+
+        b.set_hostcalls_open(false);
+        assert!(a.hostcalls_open() && !b.hostcalls_open());
+
+        a.reset(&config);
+        assert!(!a.message_passing.stats().enabled);
+        assert!(!a.apply_section("llm", &config));
+    }
+}
@@ -6,7 +6,7 @@ use reqwest::Url;
 use serde::Deserialize;
 
 use crate::spearlet::config::{LlmBackendConfig, SpearletConfig};
-use crate::spearlet::execution::ai::backends::KIND_OLLAMA_CHAT;
+use crate::spearlet::execution::ai::backends::{KIND_OLLAMA_CHAT, KIND_OLLAMA_EMBEDDINGS};
 
 #[derive(Debug, Deserialize)]
 struct OllamaPsResponse {
@@ -16,6 +16,26 @@ struct OllamaPsResponse {
 #[derive(Debug, Deserialize)]
 struct OllamaPsModel {
     name: String,
+    #[serde(default)]
+    details: OllamaModelDetails,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct OllamaModelDetails {
+    #[serde(default)]
+    family: String,
+    #[serde(default)]
+    families: Option<Vec<String>>,
+}
+
+/// Embedding models are BERT-family encoders or carry "embed" in their name
+/// 嵌入模型为 BERT 系列编码器，或名称中含有 "embed"
+fn is_embedding_model(m: &OllamaPsModel) -> bool {
+    let repo = m.name.split(':').next().unwrap_or("").to_ascii_lowercase();
+    repo.contains("embed")
+        || std::iter::once(&m.details.family)
+            .chain(m.details.families.iter().flatten())
+            .any(|f| f.to_ascii_lowercase().contains("bert"))
 }
 
 pub async fn maybe_import_ollama_serving_models(cfg: &mut SpearletConfig) -> Result<usize> {
@@ -36,7 +56,13 @@ pub async fn maybe_import_ollama_serving_models(cfg: &mut SpearletConfig) -> Res
         .timeout(Duration::from_millis(discovery.timeout_ms))
         .build()?;
 
-    let mut model_names = fetch_model_names(&client, &base_url, discovery.scope.as_str()).await?;
+    let models = fetch_models(&client, &base_url, discovery.scope.as_str()).await?;
+    let embedding: HashSet<String> = models
+        .iter()
+        .filter(|m| is_embedding_model(m))
+        .map(|m| m.name.clone())
+        .collect();
+    let mut model_names: Vec<String> = models.into_iter().map(|m| m.name).collect();
 
     model_names.sort();
     model_names.dedup();
@@ -67,18 +93,33 @@ pub async fn maybe_import_ollama_serving_models(cfg: &mut SpearletConfig) -> Res
             }
         }
 
+        let (kind, ops, features) = if embedding.contains(&model) {
+            (
+                KIND_OLLAMA_EMBEDDINGS,
+                vec!["embeddings".to_string()],
+                Vec::new(),
+            )
+        } else {
+            (
+                KIND_OLLAMA_CHAT,
+                discovery.default_ops.clone(),
+                discovery.default_features.clone(),
+            )
+        };
         cfg.llm.backends.push(LlmBackendConfig {
             name: derived,
-            kind: KIND_OLLAMA_CHAT.to_string(),
+            kind: kind.to_string(),
             base_url: discovery.base_url.clone(),
             hosting: Some("local".to_string()),
             model: Some(model),
             credential_ref: None,
             weight: discovery.default_weight,
             priority: discovery.default_priority,
-            ops: discovery.default_ops.clone(),
-            features: discovery.default_features.clone(),
+            ops,
+            features,
             transports: discovery.default_transports.clone(),
+            auth_style: None,
+            api_version: None,
         });
 
         imported += 1;
@@ -87,11 +128,11 @@ pub async fn maybe_import_ollama_serving_models(cfg: &mut SpearletConfig) -> Res
     Ok(imported)
 }
 
-async fn fetch_model_names(
+async fn fetch_models(
     client: &reqwest::Client,
     base_url: &Url,
     scope: &str,
-) -> Result<Vec<String>> {
+) -> Result<Vec<OllamaPsModel>> {
     let endpoint = match scope {
         "serving" => "api/ps",
         "installed" => "api/tags",
@@ -113,16 +154,15 @@ async fn fetch_model_names(
     }
 
     let parsed: OllamaPsResponse = serde_json::from_slice(&body)?;
-    let mut model_names: Vec<String> = parsed
+    let mut models: Vec<OllamaPsModel> = parsed
         .models
         .unwrap_or_default()
         .into_iter()
-        .map(|m| m.name)
-        .filter(|s| !s.trim().is_empty())
+        .filter(|m| !m.name.trim().is_empty())
         .collect();
-    model_names.sort();
-    model_names.dedup();
-    Ok(model_names)
+    models.sort_by(|a, b| a.name.cmp(&b.name));
+    models.dedup_by(|a, b| a.name == b.name);
+    Ok(models)
 }
 
 fn apply_allow_deny(mut models: Vec<String>, allow: &[String], deny: &[String]) -> Vec<String> {
@@ -234,7 +274,8 @@ mod tests {
             json!({
                 "models": [
                     {"name": "llama3:latest"},
-                    {"name": "qwen2.5:7b"}
+                    {"name": "qwen2.5:7b"},
+                    {"name": "nomic-embed-text:latest", "details": {"family": "nomic-bert"}}
                 ]
             }),
         )
@@ -246,6 +287,14 @@ mod tests {
         cfg.llm.discovery.ollama.base_url = base_url;
 
         let n = maybe_import_ollama_serving_models(&mut cfg).await.unwrap();
-        assert_eq!(n, 2);
+        assert_eq!(n, 3);
+        let embed = cfg
+            .llm
+            .backends
+            .iter()
+            .find(|b| b.name == "ollama/nomic-embed-text_latest")
+            .unwrap();
+        assert_eq!(embed.kind, KIND_OLLAMA_EMBEDDINGS);
+        assert_eq!(embed.ops, vec!["embeddings".to_string()]);
     }
 }
@@ -0,0 +1,576 @@
+//! On-device ONNX inference / 端侧 ONNX 推理
+//!
+//! Configured models are run in-process for the `onnx_infer` hostcall, so workloads get
+//! classification, detection and embeddings without a separate inference service.
+//! Models load on first use, or at startup with `preload`, and stay warm until they are
+//! the least recently used one beyond `max_loaded_models` or sit idle for `idle_unload_s`.
+//! 配置的模型在进程内为 `onnx_infer` hostcall 运行，工作负载无需单独的推理服务即可完成
+//! 分类、检测与向量计算。模型在首次使用时加载（设置 `preload` 时在启动时加载），并保持预热，
+//! 直到超出 `max_loaded_models` 时成为最久未使用者，或闲置超过 `idle_unload_s`。
+
+#[cfg(feature = "onnx")]
+pub mod ort;
+pub mod tensor;
+
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use base64::Engine;
+use parking_lot::{Mutex, RwLock};
+use serde::{Deserialize, Serialize};
+
+use crate::spearlet::config::{OnnxConfig, OnnxModelConfig};
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
+use tensor::{DType, Image, PixelFormat, Tensor};
+
+#[derive(Debug, thiserror::Error)]
+pub enum OnnxError {
+    #[error("onnx inference is disabled")]
+    Disabled,
+    #[error("unknown model: {0}")]
+    UnknownModel(String),
+    #[error("invalid request: {0}")]
+    BadRequest(String),
+    #[error("onnxruntime unavailable: {0}")]
+    Runtime(String),
+    #[error("failed to load model {0}")]
+    Load(String),
+    #[error("inference failed: {0}")]
+    Inference(String),
+}
+
+/// Loads models / 加载模型
+pub trait Backend: Send + Sync {
+    fn load(&self, path: &Path) -> Result<Box<dyn Session>, OnnxError>;
+}
+
+/// A loaded model / 已加载的模型
+pub trait Session: Send + Sync {
+    fn inputs(&self) -> &[String];
+    fn outputs(&self) -> &[String];
+    /// Outputs in the order of `outputs` / 按 `outputs` 顺序返回的输出
+    fn run(
+        &self,
+        inputs: &[(String, Tensor)],
+        outputs: &[String],
+    ) -> Result<Vec<Tensor>, OnnxError>;
+}
+
+/// Tensor on the wire; `data` is base64 of little-endian elements
+/// 传输格式的张量；`data` 为小端元素的 base64
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TensorJson {
+    pub dtype: DType,
+    pub shape: Vec<i64>,
+    pub data: String,
+}
+
+impl TensorJson {
+    fn decode(self) -> Result<Tensor, OnnxError> {
+        let data = base64::engine::general_purpose::STANDARD
+            .decode(self.data.as_bytes())
+            .map_err(|e| OnnxError::BadRequest(format!("tensor data: {}", e)))?;
+        Tensor::new(self.dtype, self.shape, data)
+    }
+
+    fn encode(t: &Tensor) -> Self {
+        Self {
+            dtype: t.dtype,
+            shape: t.shape.clone(),
+            data: base64::engine::general_purpose::STANDARD.encode(&t.data),
+        }
+    }
+}
+
+/// Decoded image on the wire / 传输格式的已解码图像
+#[derive(Debug, Clone, Deserialize)]
+pub struct ImageJson {
+    pub width: u32,
+    pub height: u32,
+    #[serde(default)]
+    pub format: PixelFormat,
+    pub data: String,
+}
+
+/// Request of `onnx_infer` / `onnx_infer` 的请求
+#[derive(Debug, Clone, Deserialize)]
+pub struct InferRequest {
+    pub model: String,
+    /// Named input tensors / 命名的输入张量
+    #[serde(default)]
+    pub inputs: HashMap<String, TensorJson>,
+    /// Image for the first input, preprocessed as the model configures
+    /// 用于第一个输入的图像，按模型配置进行预处理
+    #[serde(default)]
+    pub image: Option<ImageJson>,
+    /// Also return every output tensor / 同时返回全部输出张量
+    #[serde(default)]
+    pub raw: bool,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct InferResponse {
+    pub model: String,
+    pub task: String,
+    pub elapsed_ms: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub classes: Option<Vec<tensor::Class>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub detections: Option<Vec<tensor::Detection>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub embedding: Option<Vec<f32>>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub outputs: Option<HashMap<String, TensorJson>>,
+}
+
+/// Model state reported by `list` / `list` 报告的模型状态
+#[derive(Debug, Clone, Serialize)]
+pub struct ModelStatus {
+    pub name: String,
+    pub task: String,
+    pub loaded: bool,
+    pub preload: bool,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub inputs: Vec<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub outputs: Vec<String>,
+    pub runs: u64,
+}
+
+struct Loaded {
+    session: Arc<dyn Session>,
+    labels: Arc<Vec<String>>,
+    last_used: Mutex<Instant>,
+    runs: AtomicU64,
+}
+
+type BackendFactory = Box<dyn Fn(&OnnxConfig) -> Result<Arc<dyn Backend>, OnnxError> + Send + Sync>;
+
+pub struct OnnxManager {
+    config: RwLock<OnnxConfig>,
+    factory: BackendFactory,
+    backend: Mutex<Option<Arc<dyn Backend>>>,
+    loaded: RwLock<HashMap<String, Arc<Loaded>>>,
+    /// Serializes loads so a model is not loaded twice / 串行化加载，避免重复加载同一模型
+    load_lock: Mutex<()>,
+    sweeping: AtomicBool,
+}
+
+impl OnnxManager {
+    #[cfg(feature = "onnx")]
+    pub fn new(config: OnnxConfig) -> Self {
+        Self::with_factory(
+            config,
+            Box::new(|cfg: &OnnxConfig| {
+                let b = ort::OrtBackend::open(&cfg.library_path, cfg.intra_op_threads)?;
+                Ok(Arc::new(b) as Arc<dyn Backend>)
+            }),
+        )
+    }
+
+    /// Without the `onnx` feature every load fails / 未启用 `onnx` feature 时所有加载均失败
+    #[cfg(not(feature = "onnx"))]
+    pub fn new(config: OnnxConfig) -> Self {
+        Self::with_factory(
+            config,
+            Box::new(|_: &OnnxConfig| {
+                Err(OnnxError::Runtime(
+                    "built without the onnx feature".to_string(),
+                ))
+            }),
+        )
+    }
+
+    pub fn with_factory(config: OnnxConfig, factory: BackendFactory) -> Self {
+        Self {
+            config: RwLock::new(config),
+            factory,
+            backend: Mutex::new(None),
+            loaded: RwLock::new(HashMap::new()),
+            load_lock: Mutex::new(()),
+            sweeping: AtomicBool::new(false),
+        }
+    }
+
+    pub fn config(&self) -> OnnxConfig {
+        self.config.read().clone()
+    }
+
+    /// Apply the configuration, preload models and start unloading idle ones
+    /// 应用配置、预加载模型并开始卸载闲置模型
+    pub fn start(self: &Arc<Self>, cfg: &OnnxConfig) {
+        self.set_config(cfg.clone());
+        if !cfg.enabled {
+            return;
+        }
+        for model in cfg.models.iter().filter(|m| m.preload) {
+            if let Err(e) = self.load(&model.name) {
+                tracing::warn!(model = %model.name, error = %e, "onnx model preload failed");
+            }
+        }
+        if self.sweeping.swap(true, Ordering::SeqCst) {
+            return;
+        }
+        let manager = Arc::downgrade(self);
+        supervise("onnx-idle-unload", RestartPolicy::default(), move || {
+            let manager = manager.clone();
+            async move {
+                loop {
+                    tokio::time::sleep(Duration::from_secs(30)).await;
+                    let Some(m) = manager.upgrade() else {
+                        return;
+                    };
+                    m.sweep_idle(Instant::now());
+                }
+            }
+        });
+    }
+
+    /// Apply a new configuration; models removed or pointing at other files are unloaded
+    /// 应用新配置；被移除或改指其他文件的模型会被卸载
+    pub fn set_config(&self, config: OnnxConfig) {
+        let mut current = self.config.write();
+        let mut loaded = self.loaded.write();
+        if current.library_path != config.library_path
+            || current.intra_op_threads != config.intra_op_threads
+        {
+            // Sessions keep the runtime they were created with / 会话保留创建时所用的运行时
+            *self.backend.lock() = None;
+            loaded.clear();
+        }
+        loaded.retain(|name, _| {
+            let old = current.models.iter().find(|m| &m.name == name);
+            let new = config.models.iter().find(|m| &m.name == name);
+            // Changed files load again on next use / 文件变更后在下次使用时重新加载
+            match (old, new) {
+                (Some(o), Some(n)) => o.path == n.path && o.labels_path == n.labels_path,
+                _ => false,
+            }
+        });
+        *current = config;
+    }
+
+    fn model_config(&self, name: &str) -> Result<OnnxModelConfig, OnnxError> {
+        let cfg = self.config.read();
+        if !cfg.enabled {
+            return Err(OnnxError::Disabled);
+        }
+        cfg.models
+            .iter()
+            .find(|m| m.name == name)
+            .cloned()
+            .ok_or_else(|| OnnxError::UnknownModel(name.to_string()))
+    }
+
+    fn backend(&self) -> Result<Arc<dyn Backend>, OnnxError> {
+        let cfg = self.config.read().clone();
+        let mut slot = self.backend.lock();
+        if let Some(b) = slot.as_ref() {
+            return Ok(b.clone());
+        }
+        let b = (self.factory)(&cfg)?;
+        *slot = Some(b.clone());
+        Ok(b)
+    }
+
+    /// The loaded model, loading it if needed / 已加载的模型，必要时加载
+    fn get(&self, model: &OnnxModelConfig) -> Result<Arc<Loaded>, OnnxError> {
+        if let Some(l) = self.loaded.read().get(&model.name) {
+            *l.last_used.lock() = Instant::now();
+            return Ok(l.clone());
+        }
+        let _guard = self.load_lock.lock();
+        if let Some(l) = self.loaded.read().get(&model.name) {
+            return Ok(l.clone());
+        }
+        let started = Instant::now();
+        let session: Arc<dyn Session> = self.backend()?.load(Path::new(&model.path))?.into();
+        let labels = if model.labels_path.is_empty() {
+            Vec::new()
+        } else {
+            std::fs::read_to_string(&model.labels_path)
+                .map_err(|e| OnnxError::Load(format!("{}: {}", model.labels_path, e)))?
+                .lines()
+                .map(|l| l.trim().to_string())
+                .collect()
+        };
+        tracing::info!(
+            model = %model.name,
+            inputs = ?session.inputs(),
+            outputs = ?session.outputs(),
+            elapsed_ms = started.elapsed().as_millis() as u64,
+            "onnx model loaded"
+        );
+        let loaded = Arc::new(Loaded {
+            session,
+            labels: Arc::new(labels),
+            last_used: Mutex::new(Instant::now()),
+            runs: AtomicU64::new(0),
+        });
+        self.loaded
+            .write()
+            .insert(model.name.clone(), loaded.clone());
+        self.evict_lru();
+        Ok(loaded)
+    }
+
+    /// Unload least recently used models beyond the limit; preloaded models stay
+    /// 卸载超出上限的最久未使用模型；预加载模型保留
+    fn evict_lru(&self) {
+        let cfg = self.config.read();
+        let mut loaded = self.loaded.write();
+        while loaded.len() > cfg.max_loaded_models.max(1) {
+            let victim = loaded
+                .iter()
+                .filter(|(name, _)| !cfg.models.iter().any(|m| &m.name == *name && m.preload))
+                .min_by_key(|(_, l)| *l.last_used.lock())
+                .map(|(name, _)| name.clone());
+            let Some(name) = victim else { break };
+            loaded.remove(&name);
+            tracing::info!(model = %name, "onnx model unloaded (least recently used)");
+        }
+    }
+
+    /// Unload models idle for `idle_unload_s` / 卸载闲置超过 `idle_unload_s` 的模型
+    pub fn sweep_idle(&self, now: Instant) {
+        let cfg = self.config.read();
+        if cfg.idle_unload_s == 0 {
+            return;
+        }
+        let idle = Duration::from_secs(cfg.idle_unload_s);
+        self.loaded.write().retain(|name, l| {
+            let preload = cfg.models.iter().any(|m| &m.name == name && m.preload);
+            let keep = preload || now.duration_since(*l.last_used.lock()) < idle;
+            if !keep {
+                tracing::info!(model = %name, "onnx model unloaded (idle)");
+            }
+            keep
+        });
+    }
+
+    pub fn load(&self, name: &str) -> Result<(), OnnxError> {
+        let model = self.model_config(name)?;
+        self.get(&model).map(|_| ())
+    }
+
+    /// Unload a model; returns whether it was loaded / 卸载模型；返回其是否曾被加载
+    pub fn unload(&self, name: &str) -> bool {
+        self.loaded.write().remove(name).is_some()
+    }
+
+    pub fn list(&self) -> Vec<ModelStatus> {
+        let cfg = self.config.read();
+        let loaded = self.loaded.read();
+        cfg.models
+            .iter()
+            .map(|m| {
+                let l = loaded.get(&m.name);
+                ModelStatus {
+                    name: m.name.clone(),
+                    task: m.task.clone(),
+                    loaded: l.is_some(),
+                    preload: m.preload,
+                    inputs: l.map(|l| l.session.inputs().to_vec()).unwrap_or_default(),
+                    outputs: l.map(|l| l.session.outputs().to_vec()).unwrap_or_default(),
+                    runs: l.map(|l| l.runs.load(Ordering::Relaxed)).unwrap_or(0),
+                }
+            })
+            .collect()
+    }
+
+    /// Run a request; blocks the calling thread / 执行请求；阻塞调用线程
+    pub fn infer(&self, req: InferRequest) -> Result<InferResponse, OnnxError> {
+        let model = self.model_config(&req.model)?;
+        let loaded = self.get(&model)?;
+        let session = &loaded.session;
+        let started = Instant::now();
+
+        let mut inputs = Vec::with_capacity(req.inputs.len() + 1);
+        // Detection boxes are scaled back to the supplied image / 检测框换算回所提供的图像
+        let mut scale = (1.0f32, 1.0f32);
+        if let Some(img) = req.image {
+            let first = session
+                .inputs()
+                .first()
+                .ok_or_else(|| OnnxError::BadRequest("model has no inputs".to_string()))?;
+            let pixels = base64::engine::general_purpose::STANDARD
+                .decode(img.data.as_bytes())
+                .map_err(|e| OnnxError::BadRequest(format!("image data: {}", e)))?;
+            let image = Image {
+                width: img.width,
+                height: img.height,
+                format: img.format,
+                pixels: &pixels,
+            };
+            inputs.push((first.clone(), tensor::image_tensor(&image, &model.image)?));
+            scale = (
+                img.width as f32 / model.image.width.max(1) as f32,
+                img.height as f32 / model.image.height.max(1) as f32,
+            );
+        }
+        for (name, t) in req.inputs {
+            if !session.inputs().contains(&name) {
+                return Err(OnnxError::BadRequest(format!("unknown input {}", name)));
+            }
+            if inputs.iter().any(|(n, _)| *n == name) {
+                return Err(OnnxError::BadRequest(format!("input {} given twice", name)));
+            }
+            inputs.push((name, t.decode()?));
+        }
+        if inputs.is_empty() {
+            return Err(OnnxError::BadRequest("no inputs or image".to_string()));
+        }
+
+        let names = session.outputs().to_vec();
+        let outputs = session.run(&inputs, &names)?;
+        loaded.runs.fetch_add(1, Ordering::Relaxed);
+        *loaded.last_used.lock() = Instant::now();
+
+        let main = if model.output.is_empty() {
+            outputs.first()
+        } else {
+            names
+                .iter()
+                .position(|n| *n == model.output)
+                .and_then(|i| outputs.get(i))
+        }
+        .ok_or_else(|| OnnxError::Inference(format!("no output {:?}", model.output)))?;
+
+        let mut resp = InferResponse {
+            model: model.name.clone(),
+            task: model.task.clone(),
+            ..Default::default()
+        };
+        match model.task.as_str() {
+            "classification" => {
+                resp.classes = Some(tensor::classify(main, &model, &loaded.labels)?);
+            }
+            "detection" => {
+                resp.detections = Some(tensor::detect(main, &model, &loaded.labels, scale)?);
+            }
+            "embedding" => resp.embedding = Some(tensor::embed(main, &model)?),
+            _ => {}
+        }
+        let summarized =
+            resp.classes.is_some() || resp.detections.is_some() || resp.embedding.is_some();
+        if req.raw || !summarized {
+            resp.outputs = Some(
+                names
+                    .into_iter()
+                    .zip(outputs.iter().map(TensorJson::encode))
+                    .collect(),
+            );
+        }
+        resp.elapsed_ms = started.elapsed().as_millis() as u64;
+        Ok(resp)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::AtomicUsize;
+    use std::sync::OnceLock;
+
+    /// Adds one to every f32 element / 将每个 f32 元素加一
+    struct PlusOne;
+
+    impl Session for PlusOne {
+        fn inputs(&self) -> &[String] {
+            static N: OnceLock<Vec<String>> = OnceLock::new();
+            N.get_or_init(|| vec!["x".to_string()])
+        }
+        fn outputs(&self) -> &[String] {
+            static N: OnceLock<Vec<String>> = OnceLock::new();
+            N.get_or_init(|| vec!["y".to_string()])
+        }
+        fn run(&self, inputs: &[(String, Tensor)], _: &[String]) -> Result<Vec<Tensor>, OnnxError> {
+            let t = &inputs[0].1;
+            let v: Vec<f32> = t.to_f32().unwrap().iter().map(|v| v + 1.0).collect();
+            Ok(vec![Tensor::from_f32(t.shape.clone(), &v)])
+        }
+    }
+
+    struct Fake(Arc<AtomicUsize>);
+
+    impl Backend for Fake {
+        fn load(&self, _: &Path) -> Result<Box<dyn Session>, OnnxError> {
+            self.0.fetch_add(1, Ordering::SeqCst);
+            Ok(Box::new(PlusOne))
+        }
+    }
+
+    fn manager(loads: Arc<AtomicUsize>) -> OnnxManager {
+        let model = |name: &str, task: &str| OnnxModelConfig {
+            name: name.to_string(),
+            path: format!("/models/{}.onnx", name),
+            task: task.to_string(),
+            ..Default::default()
+        };
+        OnnxManager::with_factory(
+            OnnxConfig {
+                enabled: true,
+                max_loaded_models: 1,
+                models: vec![model("raw", "raw"), model("emb", "embedding")],
+                ..Default::default()
+            },
+            Box::new(move |_: &OnnxConfig| Ok(Arc::new(Fake(loads.clone())) as Arc<dyn Backend>)),
+        )
+    }
+
+    fn request(model: &str, values: &[f32]) -> InferRequest {
+        let t = Tensor::from_f32(vec![1, values.len() as i64], values);
+        InferRequest {
+            model: model.to_string(),
+            inputs: HashMap::from([("x".to_string(), TensorJson::encode(&t))]),
+            image: None,
+            raw: false,
+        }
+    }
+
+    #[test]
+    fn test_infer_and_warm_cache() {
+        let loads = Arc::new(AtomicUsize::new(0));
+        let m = manager(loads.clone());
+
+        let r = m.infer(request("raw", &[1.0, 2.0])).unwrap();
+        let y = r.outputs.unwrap().remove("y").unwrap().decode().unwrap();
+        assert_eq!(y.to_f32().unwrap(), vec![2.0, 3.0]);
+        m.infer(request("raw", &[0.0])).unwrap();
+        assert_eq!(loads.load(Ordering::SeqCst), 1);
+
+        // A second model pushes the first out / 第二个模型将第一个挤出
+        let r = m.infer(request("emb", &[2.0, 3.0])).unwrap();
+        assert_eq!(r.embedding.unwrap(), vec![0.6, 0.8]);
+        assert!(r.outputs.is_none());
+        let listed = m.list();
+        assert!(!listed[0].loaded && listed[1].loaded && listed[1].runs == 1);
+
+        m.sweep_idle(Instant::now() + Duration::from_secs(3600));
+        assert!(m.list().iter().all(|s| !s.loaded));
+    }
+
+    #[test]
+    fn test_bad_requests() {
+        let m = manager(Arc::new(AtomicUsize::new(0)));
+        assert!(matches!(
+            m.infer(request("missing", &[1.0])),
+            Err(OnnxError::UnknownModel(_))
+        ));
+        let mut req = request("raw", &[1.0]);
+        req.inputs.get_mut("x").unwrap().shape = vec![2];
+        assert!(matches!(m.infer(req), Err(OnnxError::BadRequest(_))));
+        let mut req = request("raw", &[1.0]);
+        req.inputs = HashMap::from([("z".to_string(), req.inputs.remove("x").unwrap())]);
+        assert!(matches!(m.infer(req), Err(OnnxError::BadRequest(_))));
+
+        m.set_config(OnnxConfig::default());
+        assert!(matches!(
+            m.infer(request("raw", &[1.0])),
+            Err(OnnxError::Disabled)
+        ));
+    }
+}
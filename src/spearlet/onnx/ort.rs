@@ -0,0 +1,472 @@
+//! onnxruntime backend over its C API / 基于 C API 的 onnxruntime 后端
+//!
+//! The shared library is opened at runtime, the same way onnxruntime-go does, so the
+//! spearlet builds and runs without it and only nodes that serve models need it installed.
+//! `OrtApi` is a table of function pointers that onnxruntime only appends to; the slots
+//! below are those of `onnxruntime_c_api.h` and are valid for every release since 1.0.
+//! 共享库在运行时打开（与 onnxruntime-go 的方式相同），因此 spearlet 无需该库即可构建和运行，
+//! 只有提供模型的节点需要安装它。`OrtApi` 是一张只追加的函数指针表；下面的槽位取自
+//! `onnxruntime_c_api.h`，自 1.0 起的所有版本均有效。
+
+use std::ffi::{c_char, c_void, CStr, CString};
+use std::path::Path;
+use std::sync::Arc;
+
+use super::tensor::{DType, Tensor};
+use super::{Backend, OnnxError, Session};
+
+/// API version requested from the library / 向库请求的 API 版本
+const ORT_API_VERSION: u32 = 11;
+const ORT_LOGGING_LEVEL_WARNING: i32 = 2;
+const ORT_ENABLE_ALL: i32 = 99;
+const ORT_ARENA_ALLOCATOR: i32 = 1;
+const ORT_MEM_TYPE_DEFAULT: i32 = 0;
+
+type Ptr = *mut c_void;
+type Status = *mut c_void;
+
+#[repr(C)]
+struct OrtApiBase {
+    get_api: unsafe extern "C" fn(version: u32) -> *const *const c_void,
+    get_version_string: unsafe extern "C" fn() -> *const c_char,
+}
+
+/// Slots of `OrtApi` / `OrtApi` 中的槽位
+mod slot {
+    pub const GET_ERROR_MESSAGE: usize = 2;
+    pub const CREATE_ENV: usize = 3;
+    pub const CREATE_SESSION: usize = 7;
+    pub const RUN: usize = 9;
+    pub const CREATE_SESSION_OPTIONS: usize = 10;
+    pub const SET_SESSION_GRAPH_OPTIMIZATION_LEVEL: usize = 23;
+    pub const SET_INTRA_OP_NUM_THREADS: usize = 24;
+    pub const SESSION_GET_INPUT_COUNT: usize = 30;
+    pub const SESSION_GET_OUTPUT_COUNT: usize = 31;
+    pub const SESSION_GET_INPUT_NAME: usize = 36;
+    pub const SESSION_GET_OUTPUT_NAME: usize = 37;
+    pub const CREATE_TENSOR_WITH_DATA_AS_ORT_VALUE: usize = 49;
+    pub const GET_TENSOR_MUTABLE_DATA: usize = 51;
+    pub const GET_TENSOR_ELEMENT_TYPE: usize = 60;
+    pub const GET_DIMENSIONS_COUNT: usize = 61;
+    pub const GET_DIMENSIONS: usize = 62;
+    pub const GET_TENSOR_TYPE_AND_SHAPE: usize = 65;
+    pub const CREATE_CPU_MEMORY_INFO: usize = 69;
+    pub const ALLOCATOR_FREE: usize = 76;
+    pub const GET_ALLOCATOR_WITH_DEFAULT_OPTIONS: usize = 78;
+    pub const RELEASE_ENV: usize = 92;
+    pub const RELEASE_STATUS: usize = 93;
+    pub const RELEASE_MEMORY_INFO: usize = 94;
+    pub const RELEASE_SESSION: usize = 95;
+    pub const RELEASE_VALUE: usize = 96;
+    pub const RELEASE_TENSOR_TYPE_AND_SHAPE_INFO: usize = 99;
+    pub const RELEASE_SESSION_OPTIONS: usize = 100;
+}
+
+/// The functions used, resolved once / 用到的函数，只解析一次
+struct Api {
+    get_error_message: unsafe extern "C" fn(Status) -> *const c_char,
+    create_env: unsafe extern "C" fn(i32, *const c_char, *mut Ptr) -> Status,
+    create_session: unsafe extern "C" fn(Ptr, *const c_char, Ptr, *mut Ptr) -> Status,
+    #[allow(clippy::type_complexity)]
+    run: unsafe extern "C" fn(
+        Ptr,
+        *const c_void,
+        *const *const c_char,
+        *const Ptr,
+        usize,
+        *const *const c_char,
+        usize,
+        *mut Ptr,
+    ) -> Status,
+    create_session_options: unsafe extern "C" fn(*mut Ptr) -> Status,
+    set_graph_optimization_level: unsafe extern "C" fn(Ptr, i32) -> Status,
+    set_intra_op_num_threads: unsafe extern "C" fn(Ptr, i32) -> Status,
+    session_get_input_count: unsafe extern "C" fn(Ptr, *mut usize) -> Status,
+    session_get_output_count: unsafe extern "C" fn(Ptr, *mut usize) -> Status,
+    session_get_input_name: unsafe extern "C" fn(Ptr, usize, Ptr, *mut *mut c_char) -> Status,
+    session_get_output_name: unsafe extern "C" fn(Ptr, usize, Ptr, *mut *mut c_char) -> Status,
+    create_tensor_with_data:
+        unsafe extern "C" fn(Ptr, Ptr, usize, *const i64, usize, i32, *mut Ptr) -> Status,
+    get_tensor_mutable_data: unsafe extern "C" fn(Ptr, *mut Ptr) -> Status,
+    get_tensor_element_type: unsafe extern "C" fn(Ptr, *mut i32) -> Status,
+    get_dimensions_count: unsafe extern "C" fn(Ptr, *mut usize) -> Status,
+    get_dimensions: unsafe extern "C" fn(Ptr, *mut i64, usize) -> Status,
+    get_tensor_type_and_shape: unsafe extern "C" fn(Ptr, *mut Ptr) -> Status,
+    create_cpu_memory_info: unsafe extern "C" fn(i32, i32, *mut Ptr) -> Status,
+    allocator_free: unsafe extern "C" fn(Ptr, Ptr) -> Status,
+    get_allocator_with_default_options: unsafe extern "C" fn(*mut Ptr) -> Status,
+    release_env: unsafe extern "C" fn(Ptr),
+    release_status: unsafe extern "C" fn(Status),
+    release_memory_info: unsafe extern "C" fn(Ptr),
+    release_session: unsafe extern "C" fn(Ptr),
+    release_value: unsafe extern "C" fn(Ptr),
+    release_tensor_type_and_shape_info: unsafe extern "C" fn(Ptr),
+    release_session_options: unsafe extern "C" fn(Ptr),
+}
+
+impl Api {
+    /// # Safety
+    /// `table` must be an `OrtApi` returned by `GetApi`. / `table` 必须是 `GetApi` 返回的 `OrtApi`。
+    unsafe fn resolve(table: *const *const c_void) -> Self {
+        macro_rules! f {
+            ($slot:ident) => {
+                std::mem::transmute::<*const c_void, _>(*table.add(slot::$slot))
+            };
+        }
+        Self {
+            get_error_message: f!(GET_ERROR_MESSAGE),
+            create_env: f!(CREATE_ENV),
+            create_session: f!(CREATE_SESSION),
+            run: f!(RUN),
+            create_session_options: f!(CREATE_SESSION_OPTIONS),
+            set_graph_optimization_level: f!(SET_SESSION_GRAPH_OPTIMIZATION_LEVEL),
+            set_intra_op_num_threads: f!(SET_INTRA_OP_NUM_THREADS),
+            session_get_input_count: f!(SESSION_GET_INPUT_COUNT),
+            session_get_output_count: f!(SESSION_GET_OUTPUT_COUNT),
+            session_get_input_name: f!(SESSION_GET_INPUT_NAME),
+            session_get_output_name: f!(SESSION_GET_OUTPUT_NAME),
+            create_tensor_with_data: f!(CREATE_TENSOR_WITH_DATA_AS_ORT_VALUE),
+            get_tensor_mutable_data: f!(GET_TENSOR_MUTABLE_DATA),
+            get_tensor_element_type: f!(GET_TENSOR_ELEMENT_TYPE),
+            get_dimensions_count: f!(GET_DIMENSIONS_COUNT),
+            get_dimensions: f!(GET_DIMENSIONS),
+            get_tensor_type_and_shape: f!(GET_TENSOR_TYPE_AND_SHAPE),
+            create_cpu_memory_info: f!(CREATE_CPU_MEMORY_INFO),
+            allocator_free: f!(ALLOCATOR_FREE),
+            get_allocator_with_default_options: f!(GET_ALLOCATOR_WITH_DEFAULT_OPTIONS),
+            release_env: f!(RELEASE_ENV),
+            release_status: f!(RELEASE_STATUS),
+            release_memory_info: f!(RELEASE_MEMORY_INFO),
+            release_session: f!(RELEASE_SESSION),
+            release_value: f!(RELEASE_VALUE),
+            release_tensor_type_and_shape_info: f!(RELEASE_TENSOR_TYPE_AND_SHAPE_INFO),
+            release_session_options: f!(RELEASE_SESSION_OPTIONS),
+        }
+    }
+
+    /// Turn a returned status into a result, releasing it / 将返回的状态转换为结果并释放
+    fn check(&self, status: Status) -> Result<(), String> {
+        if status.is_null() {
+            return Ok(());
+        }
+        // SAFETY: a non-null status is owned by the caller until released
+        let msg = unsafe {
+            let msg = CStr::from_ptr((self.get_error_message)(status))
+                .to_string_lossy()
+                .into_owned();
+            (self.release_status)(status);
+            msg
+        };
+        Err(msg)
+    }
+}
+
+/// Library and environment shared by all sessions / 所有会话共享的库与环境
+struct Runtime {
+    api: Api,
+    env: Ptr,
+    version: String,
+}
+
+// SAFETY: OrtEnv is thread-safe and only released on drop
+unsafe impl Send for Runtime {}
+unsafe impl Sync for Runtime {}
+
+impl Drop for Runtime {
+    fn drop(&mut self) {
+        // The library itself stays mapped / 库本身保持映射
+        unsafe { (self.api.release_env)(self.env) };
+    }
+}
+
+/// onnxruntime loaded from a shared library / 从共享库加载的 onnxruntime
+pub struct OrtBackend {
+    rt: Arc<Runtime>,
+    intra_op_threads: u32,
+}
+
+impl OrtBackend {
+    fn default_library() -> &'static str {
+        if cfg!(target_os = "macos") {
+            "libonnxruntime.dylib"
+        } else {
+            "libonnxruntime.so"
+        }
+    }
+
+    /// Open the library and create the environment / 打开库并创建环境
+    pub fn open(library_path: &str, intra_op_threads: u32) -> Result<Self, OnnxError> {
+        let lib = if library_path.is_empty() {
+            Self::default_library()
+        } else {
+            library_path
+        };
+        let unavailable = |e: String| OnnxError::Runtime(format!("{}: {}", lib, e));
+        let c_lib = CString::new(lib).map_err(|e| unavailable(e.to_string()))?;
+        // SAFETY: dlopen/dlsym with valid C strings; the handle is never closed
+        let base = unsafe {
+            let handle = libc::dlopen(c_lib.as_ptr(), libc::RTLD_NOW | libc::RTLD_LOCAL);
+            if handle.is_null() {
+                return Err(unavailable(dl_error()));
+            }
+            let sym = libc::dlsym(handle, c"OrtGetApiBase".as_ptr());
+            if sym.is_null() {
+                return Err(unavailable(dl_error()));
+            }
+            let get_api_base: unsafe extern "C" fn() -> *const OrtApiBase =
+                std::mem::transmute(sym);
+            &*get_api_base()
+        };
+        // SAFETY: OrtApiBase functions are valid for the life of the process
+        let (table, version) = unsafe {
+            let version = CStr::from_ptr((base.get_version_string)())
+                .to_string_lossy()
+                .into_owned();
+            ((base.get_api)(ORT_API_VERSION), version)
+        };
+        if table.is_null() {
+            return Err(unavailable(format!(
+                "onnxruntime {} does not support API version {}",
+                version, ORT_API_VERSION
+            )));
+        }
+        // SAFETY: table was returned by GetApi
+        let api = unsafe { Api::resolve(table) };
+        let mut env: Ptr = std::ptr::null_mut();
+        api.check(unsafe {
+            (api.create_env)(ORT_LOGGING_LEVEL_WARNING, c"spearlet".as_ptr(), &mut env)
+        })
+        .map_err(unavailable)?;
+        tracing::info!(version = %version, library = %lib, "onnxruntime loaded");
+        Ok(Self {
+            rt: Arc::new(Runtime { api, env, version }),
+            intra_op_threads,
+        })
+    }
+
+    pub fn version(&self) -> &str {
+        &self.rt.version
+    }
+}
+
+fn dl_error() -> String {
+    // SAFETY: dlerror returns a thread-local string or null
+    unsafe {
+        let e = libc::dlerror();
+        if e.is_null() {
+            "unknown error".to_string()
+        } else {
+            CStr::from_ptr(e).to_string_lossy().into_owned()
+        }
+    }
+}
+
+impl Backend for OrtBackend {
+    fn load(&self, path: &Path) -> Result<Box<dyn Session>, OnnxError> {
+        let api = &self.rt.api;
+        let failed = |e: String| OnnxError::Load(format!("{}: {}", path.display(), e));
+        let c_path =
+            CString::new(path.to_string_lossy().as_bytes()).map_err(|e| failed(e.to_string()))?;
+        let mut options: Ptr = std::ptr::null_mut();
+        api.check(unsafe { (api.create_session_options)(&mut options) })
+            .map_err(failed)?;
+        let mut session: Ptr = std::ptr::null_mut();
+        let created = (|| {
+            api.check(unsafe { (api.set_graph_optimization_level)(options, ORT_ENABLE_ALL) })?;
+            if self.intra_op_threads > 0 {
+                let n = self.intra_op_threads.min(i32::MAX as u32) as i32;
+                api.check(unsafe { (api.set_intra_op_num_threads)(options, n) })?;
+            }
+            api.check(unsafe {
+                (api.create_session)(self.rt.env, c_path.as_ptr(), options, &mut session)
+            })
+        })();
+        unsafe { (api.release_session_options)(options) };
+        created.map_err(failed)?;
+
+        let mut s = OrtSession {
+            rt: self.rt.clone(),
+            session,
+            inputs: Vec::new(),
+            outputs: Vec::new(),
+        };
+        s.inputs = s
+            .names(api.session_get_input_count, api.session_get_input_name)
+            .map_err(failed)?;
+        s.outputs = s
+            .names(api.session_get_output_count, api.session_get_output_name)
+            .map_err(failed)?;
+        Ok(Box::new(s))
+    }
+}
+
+/// A loaded model; `Run` may be called from several threads / 已加载的模型；`Run` 可被多线程调用
+struct OrtSession {
+    rt: Arc<Runtime>,
+    session: Ptr,
+    inputs: Vec<String>,
+    outputs: Vec<String>,
+}
+
+// SAFETY: OrtSession::Run is thread-safe; the session is only released on drop
+unsafe impl Send for OrtSession {}
+unsafe impl Sync for OrtSession {}
+
+impl Drop for OrtSession {
+    fn drop(&mut self) {
+        unsafe { (self.rt.api.release_session)(self.session) };
+    }
+}
+
+type CountFn = unsafe extern "C" fn(Ptr, *mut usize) -> Status;
+type NameFn = unsafe extern "C" fn(Ptr, usize, Ptr, *mut *mut c_char) -> Status;
+
+impl OrtSession {
+    fn names(&self, count: CountFn, name: NameFn) -> Result<Vec<String>, String> {
+        let api = &self.rt.api;
+        let mut n = 0usize;
+        api.check(unsafe { count(self.session, &mut n) })?;
+        let mut alloc: Ptr = std::ptr::null_mut();
+        api.check(unsafe { (api.get_allocator_with_default_options)(&mut alloc) })?;
+        let mut out = Vec::with_capacity(n);
+        for i in 0..n {
+            let mut p: *mut c_char = std::ptr::null_mut();
+            api.check(unsafe { name(self.session, i, alloc, &mut p) })?;
+            // SAFETY: the name is a C string allocated by `alloc`
+            unsafe {
+                out.push(CStr::from_ptr(p).to_string_lossy().into_owned());
+                api.check((api.allocator_free)(alloc, p as Ptr))?;
+            }
+        }
+        Ok(out)
+    }
+
+    /// Copy an output value into a tensor / 将输出值复制为张量
+    fn read(&self, value: Ptr) -> Result<Tensor, String> {
+        let api = &self.rt.api;
+        let mut info: Ptr = std::ptr::null_mut();
+        api.check(unsafe { (api.get_tensor_type_and_shape)(value, &mut info) })?;
+        let shape = (|| {
+            let mut ty = 0i32;
+            api.check(unsafe { (api.get_tensor_element_type)(info, &mut ty) })?;
+            let mut rank = 0usize;
+            api.check(unsafe { (api.get_dimensions_count)(info, &mut rank) })?;
+            let mut dims = vec![0i64; rank];
+            api.check(unsafe { (api.get_dimensions)(info, dims.as_mut_ptr(), rank) })?;
+            Ok::<_, String>((ty, dims))
+        })();
+        unsafe { (api.release_tensor_type_and_shape_info)(info) };
+        let (ty, dims) = shape?;
+        let dtype = DType::from_onnx(ty)
+            .ok_or_else(|| format!("unsupported output element type {}", ty))?;
+        let count = dims.iter().map(|d| (*d).max(0) as usize).product::<usize>();
+        let len = count * dtype.size();
+        let mut data: Ptr = std::ptr::null_mut();
+        api.check(unsafe { (api.get_tensor_mutable_data)(value, &mut data) })?;
+        let bytes = if len == 0 {
+            Vec::new()
+        } else {
+            // SAFETY: the tensor holds `count` elements of `dtype`
+            unsafe { std::slice::from_raw_parts(data as *const u8, len).to_vec() }
+        };
+        Tensor::new(dtype, dims, bytes).map_err(|e| e.to_string())
+    }
+}
+
+impl Session for OrtSession {
+    fn inputs(&self) -> &[String] {
+        &self.inputs
+    }
+
+    fn outputs(&self) -> &[String] {
+        &self.outputs
+    }
+
+    fn run(
+        &self,
+        inputs: &[(String, Tensor)],
+        outputs: &[String],
+    ) -> Result<Vec<Tensor>, OnnxError> {
+        let api = &self.rt.api;
+        let failed = OnnxError::Inference;
+        let c_in: Vec<CString> = inputs
+            .iter()
+            .map(|(n, _)| CString::new(n.as_str()))
+            .collect::<Result<_, _>>()
+            .map_err(|e| failed(e.to_string()))?;
+        let c_out: Vec<CString> = outputs
+            .iter()
+            .map(|n| CString::new(n.as_str()))
+            .collect::<Result<_, _>>()
+            .map_err(|e| failed(e.to_string()))?;
+        // Tensor data is borrowed by onnxruntime; 8-byte aligned copies outlive the run
+        // 张量数据由 onnxruntime 借用；8 字节对齐的副本在推理期间一直有效
+        let mut buffers: Vec<Vec<u64>> = inputs
+            .iter()
+            .map(|(_, t)| {
+                let mut buf = vec![0u64; t.data.len().div_ceil(8)];
+                // SAFETY: buf spans at least t.data.len() bytes
+                unsafe {
+                    std::ptr::copy_nonoverlapping(
+                        t.data.as_ptr(),
+                        buf.as_mut_ptr() as *mut u8,
+                        t.data.len(),
+                    )
+                };
+                buf
+            })
+            .collect();
+
+        let mut mem: Ptr = std::ptr::null_mut();
+        api.check(unsafe {
+            (api.create_cpu_memory_info)(ORT_ARENA_ALLOCATOR, ORT_MEM_TYPE_DEFAULT, &mut mem)
+        })
+        .map_err(failed)?;
+        let mut values: Vec<Ptr> = Vec::with_capacity(inputs.len());
+        let mut results: Vec<Ptr> = vec![std::ptr::null_mut(); outputs.len()];
+        let ran = (|| {
+            for ((_, t), buf) in inputs.iter().zip(buffers.iter_mut()) {
+                let mut v: Ptr = std::ptr::null_mut();
+                api.check(unsafe {
+                    (api.create_tensor_with_data)(
+                        mem,
+                        buf.as_mut_ptr() as Ptr,
+                        t.data.len(),
+                        t.shape.as_ptr(),
+                        t.shape.len(),
+                        t.dtype.onnx(),
+                        &mut v,
+                    )
+                })?;
+                values.push(v);
+            }
+            let in_names: Vec<*const c_char> = c_in.iter().map(|c| c.as_ptr()).collect();
+            let out_names: Vec<*const c_char> = c_out.iter().map(|c| c.as_ptr()).collect();
+            api.check(unsafe {
+                (api.run)(
+                    self.session,
+                    std::ptr::null(),
+                    in_names.as_ptr(),
+                    values.as_ptr(),
+                    values.len(),
+                    out_names.as_ptr(),
+                    out_names.len(),
+                    results.as_mut_ptr(),
+                )
+            })?;
+            results
+                .iter()
+                .map(|v| self.read(*v))
+                .collect::<Result<Vec<_>, _>>()
+        })();
+        unsafe {
+            for v in values.into_iter().chain(results.into_iter()) {
+                if !v.is_null() {
+                    (api.release_value)(v);
+                }
+            }
+            (api.release_memory_info)(mem);
+        }
+        ran.map_err(failed)
+    }
+}
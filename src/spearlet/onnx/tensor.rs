@@ -0,0 +1,452 @@
+//! Tensors, image preprocessing and task outputs / 张量、图像预处理与任务输出
+
+use serde::{Deserialize, Serialize};
+
+use super::OnnxError;
+use crate::spearlet::config::{OnnxImageConfig, OnnxModelConfig};
+
+/// Element type of a tensor / 张量元素类型
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DType {
+    F32,
+    F64,
+    I64,
+    I32,
+    U8,
+    I8,
+    Bool,
+}
+
+impl DType {
+    pub fn size(&self) -> usize {
+        match self {
+            DType::F64 | DType::I64 => 8,
+            DType::F32 | DType::I32 => 4,
+            DType::U8 | DType::I8 | DType::Bool => 1,
+        }
+    }
+
+    /// `ONNXTensorElementDataType` value / `ONNXTensorElementDataType` 取值
+    pub fn onnx(&self) -> i32 {
+        match self {
+            DType::F32 => 1,
+            DType::U8 => 2,
+            DType::I8 => 3,
+            DType::I32 => 6,
+            DType::I64 => 7,
+            DType::Bool => 9,
+            DType::F64 => 11,
+        }
+    }
+
+    pub fn from_onnx(v: i32) -> Option<Self> {
+        Some(match v {
+            1 => DType::F32,
+            2 => DType::U8,
+            3 => DType::I8,
+            6 => DType::I32,
+            7 => DType::I64,
+            9 => DType::Bool,
+            11 => DType::F64,
+            _ => return None,
+        })
+    }
+
+    pub fn parse(s: &str) -> Option<Self> {
+        serde_json::from_value(serde_json::Value::String(s.to_string())).ok()
+    }
+}
+
+/// A dense tensor with little-endian element bytes / 元素以小端字节存放的稠密张量
+#[derive(Debug, Clone, PartialEq)]
+pub struct Tensor {
+    pub dtype: DType,
+    pub shape: Vec<i64>,
+    pub data: Vec<u8>,
+}
+
+impl Tensor {
+    pub fn new(dtype: DType, shape: Vec<i64>, data: Vec<u8>) -> Result<Self, OnnxError> {
+        let count = shape.iter().try_fold(1usize, |acc, d| {
+            usize::try_from(*d).ok().and_then(|d| acc.checked_mul(d))
+        });
+        match count.and_then(|c| c.checked_mul(dtype.size())) {
+            Some(len) if len == data.len() => Ok(Self { dtype, shape, data }),
+            Some(len) => Err(OnnxError::BadRequest(format!(
+                "shape {:?} needs {} bytes of {:?}, got {}",
+                shape,
+                len,
+                dtype,
+                data.len()
+            ))),
+            None => Err(OnnxError::BadRequest(format!("invalid shape {:?}", shape))),
+        }
+    }
+
+    pub fn from_f32(shape: Vec<i64>, values: &[f32]) -> Self {
+        Self {
+            dtype: DType::F32,
+            shape,
+            data: values.iter().flat_map(|v| v.to_le_bytes()).collect(),
+        }
+    }
+
+    pub fn len(&self) -> usize {
+        self.data.len() / self.dtype.size()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.data.is_empty()
+    }
+
+    /// Elements widened to `f32`; `None` for booleans / 元素转换为 `f32`；布尔类型返回 `None`
+    pub fn to_f32(&self) -> Option<Vec<f32>> {
+        let d = &self.data;
+        Some(match self.dtype {
+            DType::F32 => d
+                .chunks_exact(4)
+                .map(|c| f32::from_le_bytes([c[0], c[1], c[2], c[3]]))
+                .collect(),
+            DType::F64 => d
+                .chunks_exact(8)
+                .map(|c| f64::from_le_bytes(c.try_into().unwrap()) as f32)
+                .collect(),
+            DType::I64 => d
+                .chunks_exact(8)
+                .map(|c| i64::from_le_bytes(c.try_into().unwrap()) as f32)
+                .collect(),
+            DType::I32 => d
+                .chunks_exact(4)
+                .map(|c| i32::from_le_bytes([c[0], c[1], c[2], c[3]]) as f32)
+                .collect(),
+            DType::U8 => d.iter().map(|b| *b as f32).collect(),
+            DType::I8 => d.iter().map(|b| *b as i8 as f32).collect(),
+            DType::Bool => return None,
+        })
+    }
+}
+
+/// Pixel layout of a supplied image / 所提供图像的像素格式
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum PixelFormat {
+    #[default]
+    Rgb,
+    Rgba,
+    Bgr,
+    Gray,
+}
+
+impl PixelFormat {
+    fn channels(&self) -> usize {
+        match self {
+            PixelFormat::Rgb | PixelFormat::Bgr => 3,
+            PixelFormat::Rgba => 4,
+            PixelFormat::Gray => 1,
+        }
+    }
+}
+
+/// Decoded pixels; compressed formats are decoded by the workload
+/// 已解码的像素；压缩格式由工作负载自行解码
+#[derive(Debug, Clone)]
+pub struct Image<'a> {
+    pub width: u32,
+    pub height: u32,
+    pub format: PixelFormat,
+    pub pixels: &'a [u8],
+}
+
+impl Image<'_> {
+    /// RGB of a pixel / 像素的 RGB 值
+    fn rgb(&self, x: usize, y: usize) -> [f32; 3] {
+        let c = self.format.channels();
+        let i = (y * self.width as usize + x) * c;
+        let p = &self.pixels[i..i + c];
+        match self.format {
+            PixelFormat::Rgb | PixelFormat::Rgba => [p[0] as f32, p[1] as f32, p[2] as f32],
+            PixelFormat::Bgr => [p[2] as f32, p[1] as f32, p[0] as f32],
+            PixelFormat::Gray => [p[0] as f32; 3],
+        }
+    }
+
+    /// Bilinear sample at fractional source coordinates / 在源图小数坐标处做双线性采样
+    fn sample(&self, fx: f32, fy: f32) -> [f32; 3] {
+        let max_x = self.width as usize - 1;
+        let max_y = self.height as usize - 1;
+        let fx = fx.clamp(0.0, max_x as f32);
+        let fy = fy.clamp(0.0, max_y as f32);
+        let (x0, y0) = (fx.floor() as usize, fy.floor() as usize);
+        let (x1, y1) = ((x0 + 1).min(max_x), (y0 + 1).min(max_y));
+        let (tx, ty) = (fx - x0 as f32, fy - y0 as f32);
+        let (a, b) = (self.rgb(x0, y0), self.rgb(x1, y0));
+        let (c, d) = (self.rgb(x0, y1), self.rgb(x1, y1));
+        let mut out = [0.0; 3];
+        for k in 0..3 {
+            let top = a[k] + (b[k] - a[k]) * tx;
+            let bottom = c[k] + (d[k] - c[k]) * tx;
+            out[k] = top + (bottom - top) * ty;
+        }
+        out
+    }
+}
+
+/// Resize and normalize an image into the model's input tensor
+/// 将图像缩放并归一化为模型输入张量
+pub fn image_tensor(img: &Image<'_>, cfg: &OnnxImageConfig) -> Result<Tensor, OnnxError> {
+    let expected = img.width as usize * img.height as usize * img.format.channels();
+    if img.width == 0 || img.height == 0 || img.pixels.len() != expected {
+        return Err(OnnxError::BadRequest(format!(
+            "image of {}x{} {:?} needs {} bytes, got {}",
+            img.width,
+            img.height,
+            img.format,
+            expected,
+            img.pixels.len()
+        )));
+    }
+    let dtype = match DType::parse(&cfg.dtype) {
+        Some(d @ (DType::F32 | DType::U8)) => d,
+        _ => {
+            return Err(OnnxError::BadRequest(format!(
+                "unsupported image dtype {}",
+                cfg.dtype
+            )))
+        }
+    };
+    let nchw = match cfg.layout.as_str() {
+        "nchw" => true,
+        "nhwc" => false,
+        other => return Err(OnnxError::BadRequest(format!("unknown layout {}", other))),
+    };
+    let (w, h) = (cfg.width as usize, cfg.height as usize);
+    let sx = img.width as f32 / w as f32;
+    let sy = img.height as f32 / h as f32;
+    let mut values = vec![0f32; 3 * w * h];
+    for y in 0..h {
+        for x in 0..w {
+            // Pixel centers line up between both grids / 两个网格的像素中心对齐
+            let mut px = img.sample((x as f32 + 0.5) * sx - 0.5, (y as f32 + 0.5) * sy - 0.5);
+            if cfg.bgr {
+                px.swap(0, 2);
+            }
+            for (k, v) in px.into_iter().enumerate() {
+                let v = if dtype == DType::F32 {
+                    (v / 255.0 - cfg.mean[k]) / cfg.std[k]
+                } else {
+                    v.round()
+                };
+                let idx = if nchw {
+                    k * w * h + y * w + x
+                } else {
+                    (y * w + x) * 3 + k
+                };
+                values[idx] = v;
+            }
+        }
+    }
+    let shape = if nchw {
+        vec![1, 3, h as i64, w as i64]
+    } else {
+        vec![1, h as i64, w as i64, 3]
+    };
+    Ok(match dtype {
+        DType::U8 => Tensor {
+            dtype,
+            shape,
+            data: values.iter().map(|v| v.clamp(0.0, 255.0) as u8).collect(),
+        },
+        _ => Tensor::from_f32(shape, &values),
+    })
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct Class {
+    pub index: usize,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub label: Option<String>,
+    pub score: f32,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct Detection {
+    /// `[x1, y1, x2, y2]` in pixels of the supplied image / 以所提供图像像素计的 `[x1, y1, x2, y2]`
+    #[serde(rename = "box")]
+    pub bbox: [f32; 4],
+    pub score: f32,
+    pub class: usize,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub label: Option<String>,
+}
+
+fn label(labels: &[String], i: usize) -> Option<String> {
+    labels.get(i).cloned()
+}
+
+fn values(t: &Tensor) -> Result<Vec<f32>, OnnxError> {
+    t.to_f32()
+        .ok_or_else(|| OnnxError::Inference(format!("{:?} output is not numeric", t.dtype)))
+}
+
+/// Top classes of the first row / 第一行中分数最高的类别
+pub fn classify(
+    t: &Tensor,
+    cfg: &OnnxModelConfig,
+    labels: &[String],
+) -> Result<Vec<Class>, OnnxError> {
+    let all = values(t)?;
+    let width = t.shape.last().copied().unwrap_or(0).max(0) as usize;
+    let mut row = all[..width.min(all.len())].to_vec();
+    if cfg.softmax {
+        let max = row.iter().cloned().fold(f32::NEG_INFINITY, f32::max);
+        let sum: f32 = row
+            .iter_mut()
+            .map(|v| {
+                *v = (*v - max).exp();
+                *v
+            })
+            .sum();
+        if sum > 0.0 {
+            row.iter_mut().for_each(|v| *v /= sum);
+        }
+    }
+    let mut order: Vec<usize> = (0..row.len()).collect();
+    order.sort_by(|a, b| row[*b].total_cmp(&row[*a]));
+    Ok(order
+        .into_iter()
+        .take(cfg.top_k.max(1))
+        .map(|i| Class {
+            index: i,
+            label: label(labels, i),
+            score: row[i],
+        })
+        .collect())
+}
+
+/// Embedding of the first row / 第一行的向量
+pub fn embed(t: &Tensor, cfg: &OnnxModelConfig) -> Result<Vec<f32>, OnnxError> {
+    let all = values(t)?;
+    let width = t.shape.last().copied().unwrap_or(0).max(0) as usize;
+    let mut v = all[..width.min(all.len())].to_vec();
+    if cfg.normalize {
+        let norm = v.iter().map(|x| x * x).sum::<f32>().sqrt();
+        if norm > 0.0 {
+            v.iter_mut().for_each(|x| *x /= norm);
+        }
+    }
+    Ok(v)
+}
+
+/// Detections from rows of `x1, y1, x2, y2, score, class`, as exported with NMS applied
+/// 从 `x1, y1, x2, y2, score, class` 行中提取检测结果（对应已做 NMS 的导出模型）
+///
+/// Boxes are scaled from model input pixels by `scale`. / 框按 `scale` 从模型输入像素换算。
+pub fn detect(
+    t: &Tensor,
+    cfg: &OnnxModelConfig,
+    labels: &[String],
+    scale: (f32, f32),
+) -> Result<Vec<Detection>, OnnxError> {
+    if t.shape.last() != Some(&6) {
+        return Err(OnnxError::Inference(format!(
+            "detection output has shape {:?}; expected rows of x1, y1, x2, y2, score, class",
+            t.shape
+        )));
+    }
+    let (sx, sy) = scale;
+    let mut out: Vec<Detection> = values(t)?
+        .chunks_exact(6)
+        .filter(|r| r[4] >= cfg.score_threshold)
+        .map(|r| {
+            let class = r[5].max(0.0) as usize;
+            Detection {
+                bbox: [r[0] * sx, r[1] * sy, r[2] * sx, r[3] * sy],
+                score: r[4],
+                class,
+                label: label(labels, class),
+            }
+        })
+        .collect();
+    out.sort_by(|a, b| b.score.total_cmp(&a.score));
+    out.truncate(cfg.max_detections);
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_image_tensor_resizes_and_normalizes() {
+        // 2x1 image: red, blue / 2x1 图像：红、蓝
+        let pixels = [255, 0, 0, 0, 0, 255];
+        let img = Image {
+            width: 2,
+            height: 1,
+            format: PixelFormat::Rgb,
+            pixels: &pixels,
+        };
+        let cfg = OnnxImageConfig {
+            width: 2,
+            height: 2,
+            mean: [0.0; 3],
+            std: [1.0; 3],
+            ..Default::default()
+        };
+        let t = image_tensor(&img, &cfg).unwrap();
+        assert_eq!(t.shape, vec![1, 3, 2, 2]);
+        let v = t.to_f32().unwrap();
+        // R plane keeps the left column, B plane the right one / R 平面保留左列，B 平面保留右列
+        assert_eq!(&v[0..4], &[1.0, 0.0, 1.0, 0.0]);
+        assert_eq!(&v[8..12], &[0.0, 1.0, 0.0, 1.0]);
+
+        let nhwc = image_tensor(
+            &img,
+            &OnnxImageConfig {
+                layout: "nhwc".to_string(),
+                dtype: "u8".to_string(),
+                ..cfg
+            },
+        )
+        .unwrap();
+        assert_eq!(nhwc.shape, vec![1, 2, 2, 3]);
+        assert_eq!(&nhwc.data[0..6], &[255, 0, 0, 0, 0, 255]);
+        assert!(image_tensor(
+            &Image {
+                pixels: &pixels[..5],
+                ..img
+            },
+            &OnnxImageConfig::default()
+        )
+        .is_err());
+    }
+
+    #[test]
+    fn test_task_outputs() {
+        let cfg = OnnxModelConfig {
+            top_k: 2,
+            score_threshold: 0.5,
+            ..Default::default()
+        };
+        let labels = vec!["cat".to_string(), "dog".to_string(), "fox".to_string()];
+        let logits = Tensor::from_f32(vec![1, 3], &[1.0, 3.0, 2.0]);
+        let top = classify(&logits, &cfg, &labels).unwrap();
+        assert_eq!(top.len(), 2);
+        assert_eq!(top[0].label.as_deref(), Some("dog"));
+        assert!(top[0].score > top[1].score && top[0].score < 1.0);
+
+        let e = embed(&Tensor::from_f32(vec![1, 2], &[3.0, 4.0]), &cfg).unwrap();
+        assert_eq!(e, vec![0.6, 0.8]);
+
+        let rows = Tensor::from_f32(
+            vec![1, 2, 6],
+            &[0.0, 0.0, 10.0, 10.0, 0.9, 1.0, 5.0, 5.0, 6.0, 6.0, 0.1, 0.0],
+        );
+        let d = detect(&rows, &cfg, &labels, (2.0, 1.0)).unwrap();
+        assert_eq!(d.len(), 1);
+        assert_eq!(d[0].bbox, [0.0, 0.0, 20.0, 10.0]);
+        assert_eq!(d[0].label.as_deref(), Some("dog"));
+        assert!(detect(&logits, &cfg, &labels, (1.0, 1.0)).is_err());
+    }
+}
@@ -0,0 +1,581 @@
+//! OpenTelemetry tracing for spearlet
+//! spearlet 的 OpenTelemetry 链路追踪
+//!
+//! A small tracer that follows the W3C Trace Context (`traceparent`) and exports
+//! spans as OTLP/HTTP JSON. The invocation path is instrumented end to end:
+//! 遵循 W3C Trace Context（`traceparent`）并以 OTLP/HTTP JSON 导出 span 的轻量 tracer。
+//! 调用链路端到端埋点：
+//!
+//! - HTTP / WebSocket requests open a server span / HTTP / WebSocket 请求创建 server span
+//! - the context rides in `InvokeRequest.metadata["traceparent"]` through the
+//!   transport layer into the WASM worker / 上下文通过 `InvokeRequest.metadata["traceparent"]`
+//!   经传输层到达 WASM worker
+//! - every hostcall and backend call becomes a child span of the execution
+//!   每个 hostcall 与后端调用都成为执行的子 span
+//!
+//! When tracing is disabled spans are inert, but incoming contexts are still
+//! passed through so downstream services keep the caller's trace.
+//! 追踪关闭时 span 不做任何事，但入站上下文仍会透传，下游服务可延续调用方链路。
+
+use std::cell::RefCell;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, OnceLock};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use tokio::sync::mpsc;
+use tracing::{debug, warn};
+
+use crate::spearlet::config::OtelConfig;
+
+/// Metadata / header key carrying the trace context / 携带链路上下文的元数据键
+pub const TRACEPARENT_KEY: &str = "traceparent";
+
+const FLAG_SAMPLED: u8 = 0x01;
+
+/// W3C trace context / W3C 链路上下文
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct TraceContext {
+    pub trace_id: [u8; 16],
+    pub span_id: [u8; 8],
+    pub flags: u8,
+}
+
+impl TraceContext {
+    /// Parse a `traceparent` value / 解析 `traceparent` 值
+    pub fn parse(raw: &str) -> Option<Self> {
+        let mut parts = raw.trim().split('-');
+        let version = parts.next()?;
+        let trace_id = parts.next()?;
+        let span_id = parts.next()?;
+        let flags = parts.next()?;
+        if version.len() != 2 || version == "ff" || trace_id.len() != 32 || span_id.len() != 16 {
+            return None;
+        }
+        // Version 00 has exactly four fields / 版本 00 恰好四段
+        if version == "00" && parts.next().is_some() {
+            return None;
+        }
+        let mut ctx = TraceContext {
+            trace_id: [0; 16],
+            span_id: [0; 8],
+            flags: u8::from_str_radix(flags, 16).ok()?,
+        };
+        decode_hex(trace_id, &mut ctx.trace_id)?;
+        decode_hex(span_id, &mut ctx.span_id)?;
+        if ctx.trace_id == [0; 16] || ctx.span_id == [0; 8] {
+            return None;
+        }
+        Some(ctx)
+    }
+
+    /// Format as a `traceparent` value / 格式化为 `traceparent` 值
+    pub fn to_traceparent(&self) -> String {
+        format!(
+            "00-{}-{}-{:02x}",
+            encode_hex(&self.trace_id),
+            encode_hex(&self.span_id),
+            self.flags
+        )
+    }
+
+    pub fn is_sampled(&self) -> bool {
+        self.flags & FLAG_SAMPLED != 0
+    }
+
+    fn child(&self) -> Self {
+        Self {
+            trace_id: self.trace_id,
+            span_id: random_span_id(),
+            flags: self.flags,
+        }
+    }
+
+    fn root(sample_ratio: f64) -> Self {
+        let mut trace_id = [0u8; 16];
+        while trace_id == [0; 16] {
+            trace_id = rand::random();
+        }
+        // Sample on the low trace-id bits so the decision is reproducible
+        // 基于 trace-id 低位采样，使决策可复现
+        let low = u64::from_be_bytes(trace_id[8..].try_into().unwrap_or([0; 8]));
+        let sampled = sample_ratio >= 1.0 || (low as f64 / u64::MAX as f64) < sample_ratio;
+        Self {
+            trace_id,
+            span_id: random_span_id(),
+            flags: if sampled { FLAG_SAMPLED } else { 0 },
+        }
+    }
+}
+
+/// Read a trace context from a metadata map / 从元数据中读取链路上下文
+pub fn context_from_metadata(
+    metadata: &std::collections::HashMap<String, String>,
+) -> Option<TraceContext> {
+    metadata
+        .get(TRACEPARENT_KEY)
+        .and_then(|v| TraceContext::parse(v))
+}
+
+fn random_span_id() -> [u8; 8] {
+    let mut id = [0u8; 8];
+    while id == [0; 8] {
+        id = rand::random();
+    }
+    id
+}
+
+pub(crate) fn encode_hex(bytes: &[u8]) -> String {
+    const HEX: &[u8; 16] = b"0123456789abcdef";
+    let mut out = String::with_capacity(bytes.len() * 2);
+    for b in bytes {
+        out.push(HEX[(b >> 4) as usize] as char);
+        out.push(HEX[(b & 0x0f) as usize] as char);
+    }
+    out
+}
+
+fn decode_hex(s: &str, out: &mut [u8]) -> Option<()> {
+    if s.len() != out.len() * 2 {
+        return None;
+    }
+    for (i, chunk) in s.as_bytes().chunks(2).enumerate() {
+        let hi = (chunk[0] as char).to_digit(16)?;
+        let lo = (chunk[1] as char).to_digit(16)?;
+        out[i] = ((hi << 4) | lo) as u8;
+    }
+    Some(())
+}
+
+/// OTLP span kind / OTLP span 类型
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SpanKind {
+    Internal = 1,
+    Server = 2,
+    Client = 3,
+}
+
+/// Span attribute value / span 属性值
+#[derive(Debug, Clone, PartialEq)]
+pub enum AttrValue {
+    Str(String),
+    Int(i64),
+    Bool(bool),
+}
+
+impl From<&str> for AttrValue {
+    fn from(v: &str) -> Self {
+        AttrValue::Str(v.to_string())
+    }
+}
+
+impl From<String> for AttrValue {
+    fn from(v: String) -> Self {
+        AttrValue::Str(v)
+    }
+}
+
+impl From<i64> for AttrValue {
+    fn from(v: i64) -> Self {
+        AttrValue::Int(v)
+    }
+}
+
+impl From<bool> for AttrValue {
+    fn from(v: bool) -> Self {
+        AttrValue::Bool(v)
+    }
+}
+
+/// A finished span ready for export / 待导出的已结束 span
+#[derive(Debug, Clone)]
+pub struct SpanData {
+    pub name: String,
+    pub kind: SpanKind,
+    pub context: TraceContext,
+    pub parent_span_id: Option<[u8; 8]>,
+    pub start_unix_nanos: u64,
+    pub end_unix_nanos: u64,
+    pub attributes: Vec<(String, AttrValue)>,
+    pub error: Option<String>,
+}
+
+/// An in-flight span; exported when dropped / 进行中的 span；drop 时导出
+#[derive(Debug)]
+pub struct Span {
+    data: Option<SpanData>,
+    context: Option<TraceContext>,
+}
+
+impl Span {
+    /// Start a span under `parent`, or a new root / 在 `parent` 下创建 span，或新建根 span
+    pub fn start(name: impl Into<String>, kind: SpanKind, parent: Option<&TraceContext>) -> Self {
+        let Some(tracer) = global_tracer() else {
+            return Self {
+                data: None,
+                context: parent.copied(),
+            };
+        };
+        let context = match parent {
+            Some(p) => p.child(),
+            None => TraceContext::root(tracer.sample_ratio),
+        };
+        if !context.is_sampled() {
+            return Self {
+                data: None,
+                context: Some(context),
+            };
+        }
+        Self {
+            data: Some(SpanData {
+                name: name.into(),
+                kind,
+                context,
+                parent_span_id: parent.map(|p| p.span_id),
+                start_unix_nanos: unix_nanos(),
+                end_unix_nanos: 0,
+                attributes: Vec::new(),
+                error: None,
+            }),
+            context: Some(context),
+        }
+    }
+
+    /// Context to propagate downstream / 向下游传播的上下文
+    pub fn context(&self) -> Option<TraceContext> {
+        self.context
+    }
+
+    /// `traceparent` for downstream calls / 下游调用使用的 `traceparent`
+    pub fn traceparent(&self) -> Option<String> {
+        self.context.map(|c| c.to_traceparent())
+    }
+
+    pub fn is_recording(&self) -> bool {
+        self.data.is_some()
+    }
+
+    pub fn set_attr(&mut self, key: &str, value: impl Into<AttrValue>) {
+        if let Some(d) = self.data.as_mut() {
+            d.attributes.push((key.to_string(), value.into()));
+        }
+    }
+
+    pub fn set_error(&mut self, message: impl Into<String>) {
+        if let Some(d) = self.data.as_mut() {
+            d.error = Some(message.into());
+        }
+    }
+
+    /// Make this span the thread's current span until the guard drops
+    /// 在 guard 释放前将该 span 设为当前线程的当前 span
+    pub fn enter(self) -> EnteredSpan {
+        let prev = set_current(self.context);
+        EnteredSpan { span: self, prev }
+    }
+}
+
+impl Drop for Span {
+    fn drop(&mut self) {
+        let Some(mut data) = self.data.take() else {
+            return;
+        };
+        data.end_unix_nanos = unix_nanos().max(data.start_unix_nanos);
+        if let Some(t) = global_tracer() {
+            t.submit(data);
+        }
+    }
+}
+
+/// Span set as the thread's current span / 设为线程当前 span 的 span
+#[derive(Debug)]
+pub struct EnteredSpan {
+    span: Span,
+    prev: Option<TraceContext>,
+}
+
+impl EnteredSpan {
+    pub fn span_mut(&mut self) -> &mut Span {
+        &mut self.span
+    }
+}
+
+impl Drop for EnteredSpan {
+    fn drop(&mut self) {
+        set_current(self.prev);
+    }
+}
+
+thread_local! {
+    static CURRENT_CONTEXT: RefCell<Option<TraceContext>> = const { RefCell::new(None) };
+}
+
+/// Replace the thread's current context, returning the previous one
+/// 替换线程当前上下文并返回之前的上下文
+pub fn set_current(ctx: Option<TraceContext>) -> Option<TraceContext> {
+    CURRENT_CONTEXT.with(|c| std::mem::replace(&mut *c.borrow_mut(), ctx))
+}
+
+/// The thread's current context / 线程当前上下文
+pub fn current() -> Option<TraceContext> {
+    CURRENT_CONTEXT.with(|c| *c.borrow())
+}
+
+/// Child span of the current context, entered for its lifetime
+/// 当前上下文的子 span，在其生命周期内处于 entered 状态
+pub fn enter_child(name: &str, kind: SpanKind) -> Option<EnteredSpan> {
+    if global_tracer().is_none() {
+        return None;
+    }
+    let parent = current();
+    Some(Span::start(name, kind, parent.as_ref()).enter())
+}
+
+fn unix_nanos() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_nanos() as u64
+}
+
+/// Span exporter front end / span 导出前端
+#[derive(Debug)]
+pub struct Tracer {
+    tx: mpsc::Sender<SpanData>,
+    sample_ratio: f64,
+    dropped: AtomicU64,
+}
+
+impl Tracer {
+    fn submit(&self, span: SpanData) {
+        if self.tx.try_send(span).is_err() {
+            let n = self.dropped.fetch_add(1, Ordering::Relaxed) + 1;
+            if n.is_power_of_two() {
+                warn!(dropped = n, "otel span queue full, dropping spans");
+            }
+        }
+    }
+
+    /// Spans dropped because the queue was full / 因队列已满而丢弃的 span 数
+    pub fn dropped(&self) -> u64 {
+        self.dropped.load(Ordering::Relaxed)
+    }
+}
+
+static GLOBAL_TRACER: OnceLock<Arc<Tracer>> = OnceLock::new();
+
+/// Global tracer, if tracing is enabled / 全局 tracer（若已启用）
+pub fn global_tracer() -> Option<&'static Arc<Tracer>> {
+    GLOBAL_TRACER.get()
+}
+
+/// Start the OTLP exporter; must run inside a tokio runtime
+/// 启动 OTLP 导出器；需在 tokio 运行时内调用
+pub fn init_global_tracer(config: &OtelConfig) -> Option<Arc<Tracer>> {
+    if !config.enabled {
+        return None;
+    }
+    if let Some(t) = GLOBAL_TRACER.get() {
+        return Some(t.clone());
+    }
+    let (tx, rx) = mpsc::channel(config.queue_capacity.max(1));
+    let tracer = Arc::new(Tracer {
+        tx,
+        sample_ratio: config.sample_ratio.clamp(0.0, 1.0),
+        dropped: AtomicU64::new(0),
+    });
+    let tracer = GLOBAL_TRACER.get_or_init(|| tracer).clone();
+    tokio::spawn(export_loop(config.clone(), rx));
+    Some(tracer)
+}
+
+async fn export_loop(config: OtelConfig, mut rx: mpsc::Receiver<SpanData>) {
+    let endpoint = traces_url(&config.otlp_endpoint);
+    let client = reqwest::Client::builder()
+        .timeout(Duration::from_secs(10))
+        .build()
+        .unwrap_or_default();
+    let batch_size = config.batch_size.max(1);
+    let mut tick = tokio::time::interval(Duration::from_millis(config.flush_interval_ms.max(100)));
+    let mut batch: Vec<SpanData> = Vec::with_capacity(batch_size);
+    loop {
+        let flush = tokio::select! {
+            span = rx.recv() => match span {
+                Some(s) => {
+                    batch.push(s);
+                    batch.len() >= batch_size
+                }
+                None => true,
+            },
+            _ = tick.tick() => !batch.is_empty(),
+        };
+        if flush && !batch.is_empty() {
+            let body = encode_otlp(&config.service_name, &batch);
+            batch.clear();
+            let mut req = client.post(&endpoint).json(&body);
+            for (k, v) in config.headers.iter() {
+                req = req.header(k.as_str(), v.as_str());
+            }
+            match req.send().await {
+                Ok(r) if r.status().is_success() => debug!("otel spans exported"),
+                Ok(r) => warn!(status = %r.status(), "otel export rejected"),
+                Err(e) => warn!(error = %e, "otel export failed"),
+            }
+        }
+        if rx.is_closed() && rx.is_empty() && batch.is_empty() {
+            break;
+        }
+    }
+}
+
+fn traces_url(endpoint: &str) -> String {
+    let base = endpoint.trim().trim_end_matches('/');
+    if base.ends_with("/v1/traces") {
+        base.to_string()
+    } else {
+        format!("{}/v1/traces", base)
+    }
+}
+
+fn encode_attr(key: &str, value: &AttrValue) -> serde_json::Value {
+    let v = match value {
+        AttrValue::Str(s) => serde_json::json!({ "stringValue": s }),
+        AttrValue::Int(i) => serde_json::json!({ "intValue": i.to_string() }),
+        AttrValue::Bool(b) => serde_json::json!({ "boolValue": b }),
+    };
+    serde_json::json!({ "key": key, "value": v })
+}
+
+/// Encode spans as an OTLP/HTTP JSON export request / 将 span 编码为 OTLP/HTTP JSON 导出请求
+pub fn encode_otlp(service_name: &str, spans: &[SpanData]) -> serde_json::Value {
+    let spans: Vec<serde_json::Value> = spans
+        .iter()
+        .map(|s| {
+            let mut v = serde_json::json!({
+                "traceId": encode_hex(&s.context.trace_id),
+                "spanId": encode_hex(&s.context.span_id),
+                "name": s.name,
+                "kind": s.kind as i32,
+                "startTimeUnixNano": s.start_unix_nanos.to_string(),
+                "endTimeUnixNano": s.end_unix_nanos.to_string(),
+                "attributes": s
+                    .attributes
+                    .iter()
+                    .map(|(k, v)| encode_attr(k, v))
+                    .collect::<Vec<_>>(),
+                "status": match &s.error {
+                    Some(m) => serde_json::json!({ "code": 2, "message": m }),
+                    None => serde_json::json!({ "code": 0 }),
+                },
+            });
+            if let Some(p) = s.parent_span_id {
+                v["parentSpanId"] = serde_json::Value::String(encode_hex(&p));
+            }
+            v
+        })
+        .collect();
+    serde_json::json!({
+        "resourceSpans": [{
+            "resource": {
+                "attributes": [encode_attr("service.name", &AttrValue::from(service_name))],
+            },
+            "scopeSpans": [{
+                "scope": { "name": env!("CARGO_PKG_NAME"), "version": env!("CARGO_PKG_VERSION") },
+                "spans": spans,
+            }],
+        }],
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const TP: &str = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01";
+
+    #[test]
+    fn test_traceparent_round_trip() {
+        let ctx = TraceContext::parse(TP).unwrap();
+        assert!(ctx.is_sampled());
+        assert_eq!(ctx.to_traceparent(), TP);
+
+        let child = ctx.child();
+        assert_eq!(child.trace_id, ctx.trace_id);
+        assert_ne!(child.span_id, ctx.span_id);
+    }
+
+    #[test]
+    fn test_traceparent_rejects_invalid() {
+        assert!(TraceContext::parse("").is_none());
+        assert!(
+            TraceContext::parse("00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+                .is_none()
+        );
+        assert!(
+            TraceContext::parse("ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+                .is_none()
+        );
+        assert!(
+            TraceContext::parse("00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01").is_none()
+        );
+        assert!(TraceContext::parse(&format!("{}-extra", TP)).is_none());
+    }
+
+    #[test]
+    fn test_root_sampling_ratio() {
+        assert!(TraceContext::root(1.0).is_sampled());
+        assert!(!TraceContext::root(0.0).is_sampled());
+    }
+
+    #[test]
+    fn test_disabled_span_passes_context_through() {
+        if global_tracer().is_some() {
+            return;
+        }
+        let parent = TraceContext::parse(TP).unwrap();
+        let span = Span::start("x", SpanKind::Internal, Some(&parent));
+        assert!(!span.is_recording());
+        assert_eq!(span.context(), Some(parent));
+        assert!(enter_child("y", SpanKind::Internal).is_none());
+    }
+
+    #[test]
+    fn test_current_context_scoping() {
+        let ctx = TraceContext::parse(TP).unwrap();
+        assert_eq!(current(), None);
+        {
+            let _g = Span {
+                data: None,
+                context: Some(ctx),
+            }
+            .enter();
+            assert_eq!(current(), Some(ctx));
+        }
+        assert_eq!(current(), None);
+    }
+
+    #[test]
+    fn test_encode_otlp() {
+        let ctx = TraceContext::parse(TP).unwrap();
+        let span = SpanData {
+            name: "hostcall.cchat_send".to_string(),
+            kind: SpanKind::Internal,
+            context: ctx.child(),
+            parent_span_id: Some(ctx.span_id),
+            start_unix_nanos: 1,
+            end_unix_nanos: 2,
+            attributes: vec![("spear.fd".to_string(), AttrValue::Int(7))],
+            error: Some("boom".to_string()),
+        };
+        let v = encode_otlp("spearlet", &[span]);
+        let s = &v["resourceSpans"][0]["scopeSpans"][0]["spans"][0];
+        assert_eq!(s["traceId"], "4bf92f3577b34da6a3ce929d0e0e4736");
+        assert_eq!(s["parentSpanId"], "00f067aa0ba902b7");
+        assert_eq!(s["attributes"][0]["value"]["intValue"], "7");
+        assert_eq!(s["status"]["code"], 2);
+        assert_eq!(
+            v["resourceSpans"][0]["resource"]["attributes"][0]["value"]["stringValue"],
+            "spearlet"
+        );
+        assert_eq!(traces_url("http://c:4318/"), "http://c:4318/v1/traces");
+    }
+}
@@ -0,0 +1,467 @@
+//! Differential output comparison for `spearlet diff`
+//! `spearlet diff` 的差异输出比较
+//!
+//! Replays recorded payloads against two workloads (two versions of a workload, or
+//! the same workload with different invocation metadata such as a model mapping)
+//! through `POST /v1/exec`, and reports output differences, latency and cost side
+//! by side for regression review before a rollout.
+//! 通过 `POST /v1/exec` 将录制的负载分别回放到两个工作负载（同一工作负载的两个版本，
+//! 或使用不同调用元数据（如模型映射）的同一工作负载），并并排报告输出差异、延迟与成本，
+//! 用于发布前的回归评审。
+
+use std::collections::HashMap;
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+use serde::Serialize;
+
+use crate::spearlet::config::SpearletConfig;
+
+/// Largest output (in lines) diffed line by line / 逐行比较的最大输出行数
+const MAX_DIFF_LINES: usize = 2_000;
+
+/// One side of the comparison / 比较的一侧
+#[derive(Debug, Clone, Default)]
+pub struct DiffTarget {
+    /// Task id or name / 任务 ID 或名称
+    pub workload: String,
+    /// Invocation metadata, e.g. a model mapping / 调用元数据，如模型映射
+    pub metadata: HashMap<String, String>,
+}
+
+/// Result of one invocation / 单次调用结果
+#[derive(Debug, Clone, Serialize)]
+pub struct CaseRun {
+    pub status: String,
+    pub output: serde_json::Value,
+    pub latency_ms: u64,
+    /// `backend/model` pairs from the execution manifest / 执行清单中的 `backend/model`
+    pub models: Vec<String>,
+    /// Cost reported by the execution, if any / 执行上报的成本（如有）
+    pub cost: Option<f64>,
+    pub error: Option<String>,
+}
+
+/// Comparison of one payload / 单个负载的比较
+#[derive(Debug, Clone, Serialize)]
+pub struct CaseDiff {
+    pub index: usize,
+    pub payload: serde_json::Value,
+    pub identical: bool,
+    pub a: CaseRun,
+    pub b: CaseRun,
+    /// Unified-style line diff (`-` a, `+` b) / 统一格式的行差异（`-` 为 a，`+` 为 b）
+    pub diff: Vec<String>,
+}
+
+/// Per-side aggregate / 单侧汇总
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct SideSummary {
+    pub errors: usize,
+    pub latency_mean_ms: u64,
+    pub latency_p50_ms: u64,
+    pub latency_max_ms: u64,
+    pub cost_total: Option<f64>,
+    pub models: Vec<String>,
+}
+
+/// Full report / 完整报告
+#[derive(Debug, Clone, Serialize)]
+pub struct DiffReport {
+    pub workload_a: String,
+    pub workload_b: String,
+    pub total: usize,
+    pub identical: usize,
+    pub changed: usize,
+    pub a: SideSummary,
+    pub b: SideSummary,
+    pub cases: Vec<CaseDiff>,
+}
+
+/// Load payloads from a JSON array or a JSON Lines file / 从 JSON 数组或 JSON Lines 文件加载负载
+pub fn load_payloads(path: &Path) -> Result<Vec<serde_json::Value>, String> {
+    let text =
+        std::fs::read_to_string(path).map_err(|e| format!("read {}: {}", path.display(), e))?;
+    parse_payloads(&text)
+}
+
+fn parse_payloads(text: &str) -> Result<Vec<serde_json::Value>, String> {
+    if text.trim_start().starts_with('[') {
+        return match serde_json::from_str(text) {
+            Ok(serde_json::Value::Array(items)) => Ok(items),
+            Ok(_) => Err("payload file must be a JSON array".to_string()),
+            Err(e) => Err(format!("invalid payload file: {}", e)),
+        };
+    }
+    text.lines()
+        .enumerate()
+        .filter(|(_, l)| !l.trim().is_empty())
+        .map(|(i, l)| {
+            serde_json::from_str(l).map_err(|e| format!("line {}: invalid JSON: {}", i + 1, e))
+        })
+        .collect()
+}
+
+/// Replays payloads against two targets / 将负载回放到两个目标
+pub struct DiffRunner {
+    client: reqwest::Client,
+    base_url: String,
+    api_key: Option<String>,
+}
+
+impl DiffRunner {
+    /// Runner against the spearlet described by `config` / 针对 `config` 所描述 spearlet 的运行器
+    pub fn from_config(config: &SpearletConfig, api_key: Option<String>) -> Self {
+        Self::new(
+            crate::spearlet::examples::local_base(config.http.server.addr),
+            api_key,
+            Duration::from_secs(300),
+        )
+    }
+
+    pub fn new(base_url: String, api_key: Option<String>, timeout: Duration) -> Self {
+        Self {
+            client: reqwest::Client::builder()
+                .timeout(timeout)
+                .build()
+                .unwrap_or_default(),
+            base_url: base_url.trim_end_matches('/').to_string(),
+            api_key,
+        }
+    }
+
+    /// Run every payload on both sides; the sides alternate order to spread warm-up bias
+    /// 在两侧运行每个负载；两侧交替先后以分摊预热偏差
+    pub async fn run(
+        &self,
+        a: &DiffTarget,
+        b: &DiffTarget,
+        payloads: &[serde_json::Value],
+    ) -> DiffReport {
+        let mut cases = Vec::with_capacity(payloads.len());
+        for (index, payload) in payloads.iter().enumerate() {
+            let (ra, rb) = if index % 2 == 0 {
+                let ra = self.invoke(a, payload).await;
+                (ra, self.invoke(b, payload).await)
+            } else {
+                let rb = self.invoke(b, payload).await;
+                (self.invoke(a, payload).await, rb)
+            };
+            cases.push(compare_case(index, payload.clone(), ra, rb));
+        }
+        build_report(&a.workload, &b.workload, cases)
+    }
+
+    async fn invoke(&self, target: &DiffTarget, payload: &serde_json::Value) -> CaseRun {
+        let mut req =
+            self.client
+                .post(format!("{}/v1/exec", self.base_url))
+                .json(&serde_json::json!({
+                    "workload": target.workload,
+                    "payload": payload,
+                    "metadata": target.metadata,
+                }));
+        if let Some(key) = self.api_key.as_deref() {
+            req = req.header("x-api-key", key);
+        }
+        let started = Instant::now();
+        let resp = req.send().await;
+        let latency_ms = started.elapsed().as_millis() as u64;
+        let failed = |error: String| CaseRun {
+            status: "ERROR".to_string(),
+            output: serde_json::Value::Null,
+            latency_ms,
+            models: Vec::new(),
+            cost: None,
+            error: Some(error),
+        };
+        let resp = match resp {
+            Ok(r) => r,
+            Err(e) => return failed(e.to_string()),
+        };
+        let http_status = resp.status();
+        let v: serde_json::Value = match resp.json().await {
+            Ok(v) => v,
+            Err(e) => return failed(format!("HTTP {}: {}", http_status, e)),
+        };
+        run_from_response(&v, latency_ms)
+    }
+}
+
+fn run_from_response(v: &serde_json::Value, latency_ms: u64) -> CaseRun {
+    let models = v["manifest"]["models"]
+        .as_array()
+        .map(|ms| {
+            ms.iter()
+                .map(|m| {
+                    format!(
+                        "{}/{}",
+                        m["backend"].as_str().unwrap_or(""),
+                        m["model"].as_str().unwrap_or("")
+                    )
+                })
+                .collect()
+        })
+        .unwrap_or_default();
+    let error = v["error"].as_object().map(|e| {
+        format!(
+            "{}: {}",
+            e.get("code").and_then(|c| c.as_str()).unwrap_or(""),
+            e.get("message").and_then(|m| m.as_str()).unwrap_or("")
+        )
+    });
+    CaseRun {
+        status: v["status"].as_str().unwrap_or("UNKNOWN").to_string(),
+        output: v["output"].clone(),
+        latency_ms,
+        models,
+        cost: v["cost"].as_f64().or_else(|| v["cost"]["total"].as_f64()),
+        error,
+    }
+}
+
+fn output_text(v: &serde_json::Value) -> String {
+    match v {
+        serde_json::Value::String(s) => s.clone(),
+        serde_json::Value::Null => String::new(),
+        other => serde_json::to_string_pretty(other).unwrap_or_else(|_| other.to_string()),
+    }
+}
+
+fn compare_case(index: usize, payload: serde_json::Value, a: CaseRun, b: CaseRun) -> CaseDiff {
+    let identical = a.output == b.output && a.error.is_none() && b.error.is_none();
+    let diff = if identical {
+        Vec::new()
+    } else {
+        line_diff(&output_text(&a.output), &output_text(&b.output))
+    };
+    CaseDiff {
+        index,
+        payload,
+        identical,
+        a,
+        b,
+        diff,
+    }
+}
+
+/// Line diff based on the longest common subsequence / 基于最长公共子序列的行差异
+fn line_diff(a: &str, b: &str) -> Vec<String> {
+    let la: Vec<&str> = a.lines().collect();
+    let lb: Vec<&str> = b.lines().collect();
+    if la.len() > MAX_DIFF_LINES || lb.len() > MAX_DIFF_LINES {
+        return vec![format!(
+            "outputs differ ({} vs {} lines, too large to diff)",
+            la.len(),
+            lb.len()
+        )];
+    }
+    let (n, m) = (la.len(), lb.len());
+    let mut lcs = vec![vec![0u32; m + 1]; n + 1];
+    for i in (0..n).rev() {
+        for j in (0..m).rev() {
+            lcs[i][j] = if la[i] == lb[j] {
+                lcs[i + 1][j + 1] + 1
+            } else {
+                lcs[i + 1][j].max(lcs[i][j + 1])
+            };
+        }
+    }
+    let mut out = Vec::new();
+    let (mut i, mut j) = (0, 0);
+    while i < n && j < m {
+        if la[i] == lb[j] {
+            i += 1;
+            j += 1;
+        } else if lcs[i + 1][j] >= lcs[i][j + 1] {
+            out.push(format!("- {}", la[i]));
+            i += 1;
+        } else {
+            out.push(format!("+ {}", lb[j]));
+            j += 1;
+        }
+    }
+    out.extend(la[i..].iter().map(|l| format!("- {}", l)));
+    out.extend(lb[j..].iter().map(|l| format!("+ {}", l)));
+    out
+}
+
+fn summarize<'a>(runs: impl Iterator<Item = &'a CaseRun>) -> SideSummary {
+    let runs: Vec<&CaseRun> = runs.collect();
+    let mut latencies: Vec<u64> = runs.iter().map(|r| r.latency_ms).collect();
+    latencies.sort_unstable();
+    let mut models: Vec<String> = runs.iter().flat_map(|r| r.models.clone()).collect();
+    models.sort();
+    models.dedup();
+    let costs: Vec<f64> = runs.iter().filter_map(|r| r.cost).collect();
+    SideSummary {
+        errors: runs.iter().filter(|r| r.error.is_some()).count(),
+        latency_mean_ms: if latencies.is_empty() {
+            0
+        } else {
+            latencies.iter().sum::<u64>() / latencies.len() as u64
+        },
+        latency_p50_ms: latencies.get(latencies.len() / 2).copied().unwrap_or(0),
+        latency_max_ms: latencies.last().copied().unwrap_or(0),
+        cost_total: if costs.is_empty() {
+            None
+        } else {
+            Some(costs.iter().sum())
+        },
+        models,
+    }
+}
+
+fn build_report(workload_a: &str, workload_b: &str, cases: Vec<CaseDiff>) -> DiffReport {
+    let identical = cases.iter().filter(|c| c.identical).count();
+    DiffReport {
+        workload_a: workload_a.to_string(),
+        workload_b: workload_b.to_string(),
+        total: cases.len(),
+        identical,
+        changed: cases.len() - identical,
+        a: summarize(cases.iter().map(|c| &c.a)),
+        b: summarize(cases.iter().map(|c| &c.b)),
+        cases,
+    }
+}
+
+impl DiffReport {
+    /// Human-readable report / 人类可读的报告
+    pub fn render_text(&self) -> String {
+        let mut out = format!("a: {}\nb: {}\n\n", self.workload_a, self.workload_b);
+        for c in &self.cases {
+            out.push_str(&format!(
+                "#{:<4} {:<9} a {:>6}ms {:<10} b {:>6}ms {:<10} ({:+}ms)\n",
+                c.index,
+                if c.identical { "same" } else { "changed" },
+                c.a.latency_ms,
+                c.a.status,
+                c.b.latency_ms,
+                c.b.status,
+                c.b.latency_ms as i64 - c.a.latency_ms as i64
+            ));
+            for (side, run) in [("a", &c.a), ("b", &c.b)] {
+                if let Some(e) = &run.error {
+                    out.push_str(&format!("      {} error: {}\n", side, e));
+                }
+            }
+            for line in &c.diff {
+                out.push_str(&format!("      {}\n", line));
+            }
+        }
+        out.push_str(&format!(
+            "\n{} cases: {} identical, {} changed\n",
+            self.total, self.identical, self.changed
+        ));
+        for (side, s) in [("a", &self.a), ("b", &self.b)] {
+            out.push_str(&format!(
+                "{}: errors {}, latency mean {}ms p50 {}ms max {}ms, cost {}, models [{}]\n",
+                side,
+                s.errors,
+                s.latency_mean_ms,
+                s.latency_p50_ms,
+                s.latency_max_ms,
+                s.cost_total
+                    .map(|c| format!("{:.6}", c))
+                    .unwrap_or_else(|| "n/a".to_string()),
+                s.models.join(", ")
+            ));
+        }
+        out
+    }
+}
+
+/// Parse `key=value` metadata flags / 解析 `key=value` 形式的元数据参数
+pub fn parse_metadata(pairs: &[String]) -> Result<HashMap<String, String>, String> {
+    pairs
+        .iter()
+        .map(|p| {
+            p.split_once('=')
+                .map(|(k, v)| (k.trim().to_string(), v.to_string()))
+                .filter(|(k, _)| !k.is_empty())
+                .ok_or_else(|| format!("invalid metadata {:?}, expected key=value", p))
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn run(output: serde_json::Value, latency_ms: u64) -> CaseRun {
+        CaseRun {
+            status: "COMPLETED".to_string(),
+            output,
+            latency_ms,
+            models: vec!["openai/gpt-4o".to_string()],
+            cost: Some(0.5),
+            error: None,
+        }
+    }
+
+    #[test]
+    fn test_parse_payloads() {
+        let items = parse_payloads("{\"q\":1}\n\n\"hi\"\n").unwrap();
+        assert_eq!(
+            items,
+            vec![serde_json::json!({"q": 1}), serde_json::json!("hi")]
+        );
+        assert_eq!(parse_payloads("[1, 2]").unwrap().len(), 2);
+        assert!(parse_payloads("{bad").is_err());
+    }
+
+    #[test]
+    fn test_line_diff() {
+        assert!(line_diff("a\nb", "a\nb").is_empty());
+        assert_eq!(line_diff("a\nb\nc", "a\nx\nc"), vec!["- b", "+ x"]);
+        assert_eq!(line_diff("", "new"), vec!["+ new"]);
+    }
+
+    #[test]
+    fn test_report_summary() {
+        let cases = vec![
+            compare_case(
+                0,
+                serde_json::json!("p0"),
+                run("same".into(), 100),
+                run("same".into(), 80),
+            ),
+            compare_case(
+                1,
+                serde_json::json!("p1"),
+                run("old".into(), 300),
+                run("new".into(), 60),
+            ),
+        ];
+        let r = build_report("chat@1", "chat@2", cases);
+        assert_eq!((r.total, r.identical, r.changed), (2, 1, 1));
+        assert_eq!(r.a.latency_mean_ms, 200);
+        assert_eq!(r.b.latency_max_ms, 80);
+        assert_eq!(r.a.cost_total, Some(1.0));
+        assert_eq!(r.cases[1].diff, vec!["- old", "+ new"]);
+        let text = r.render_text();
+        assert!(text.contains("2 cases: 1 identical, 1 changed"));
+    }
+
+    #[test]
+    fn test_run_from_response() {
+        let v = serde_json::json!({
+            "status": "FAILED",
+            "output": null,
+            "manifest": {"models": [{"backend": "ollama", "model": "llama3"}]},
+            "error": {"code": "EXECUTION_ERROR", "message": "boom"}
+        });
+        let r = run_from_response(&v, 5);
+        assert_eq!(r.models, vec!["ollama/llama3"]);
+        assert_eq!(r.error.as_deref(), Some("EXECUTION_ERROR: boom"));
+        assert!(r.cost.is_none());
+    }
+
+    #[test]
+    fn test_parse_metadata() {
+        let m = parse_metadata(&["model=gpt-4o".to_string()]).unwrap();
+        assert_eq!(m["model"], "gpt-4o");
+        assert!(parse_metadata(&["novalue".to_string()]).is_err());
+    }
+}
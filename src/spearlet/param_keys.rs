@@ -11,6 +11,8 @@ pub mod chat {
     pub const MAX_TOTAL_TOOL_CALLS: &str = "max_total_tool_calls";
     pub const MAX_TOOL_CALLS: &str = "max_tool_calls";
     pub const MAX_ITERATIONS: &str = "max_iterations";
+    pub const TOOL_PLUGINS: &str = "tool_plugins";
+    pub const PROVIDER_SESSION: &str = "provider_session";
 
     pub fn is_structural_param_key(key: &str) -> bool {
         matches!(
@@ -26,6 +28,8 @@ pub mod chat {
                 | MAX_TOTAL_TOOL_CALLS
                 | MAX_TOOL_CALLS
                 | MAX_ITERATIONS
+                | TOOL_PLUGINS
+                | PROVIDER_SESSION
         )
     }
 }
@@ -56,6 +60,12 @@ pub mod mcp {
     }
 }
 
+pub mod moderation {
+    pub mod task_config {
+        pub const UNTRUSTED: &str = "moderation.untrusted";
+    }
+}
+
 pub mod rtasr {
     pub const TRANSPORT: &str = "transport";
     pub const WS_URL: &str = "ws_url";
@@ -63,4 +73,27 @@ pub mod rtasr {
     pub const MODEL: &str = "model";
     pub const MAX_SEND_QUEUE_BYTES: &str = "max_send_queue_bytes";
     pub const MAX_RECV_QUEUE_BYTES: &str = "max_recv_queue_bytes";
+    pub const LANGUAGE: &str = "language";
+    pub const RECONNECT_MAX_ATTEMPTS: &str = "reconnect_max_attempts";
+    pub const RECONNECT_BACKOFF_MS: &str = "reconnect_backoff_ms";
+    pub const CHANNELS: &str = "channels";
+    pub const NOISE_REDUCTION: &str = "noise_reduction";
+    pub const PROMPT: &str = "prompt";
+    pub const FINISH_TIMEOUT_MS: &str = "finish_timeout_ms";
+}
+
+pub mod tts {
+    pub const MODEL: &str = "model";
+    pub const VOICE: &str = "voice";
+    pub const FORMAT: &str = "format";
+    pub const SPEED: &str = "speed";
+    pub const LANGUAGE: &str = "language";
+    pub const BACKEND: &str = "backend";
+    pub const TIMEOUT_MS: &str = "timeout_ms";
+}
+
+pub mod rttts {
+    pub const MIN_CHARS: &str = "min_chars";
+    pub const MAX_CHARS: &str = "max_chars";
+    pub const MAX_RECV_QUEUE_BYTES: &str = "max_recv_queue_bytes";
 }
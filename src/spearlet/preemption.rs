@@ -0,0 +1,324 @@
+//! Preemption of low-priority executions / 低优先级执行的抢占
+//!
+//! Executions holding a slot of `execution.max_concurrent_executions` are tracked with the
+//! priority of their task. When all slots are taken, an invocation allowed to preempt
+//! waits `wait_ms` for one to free up, then picks a victim: the running execution with the
+//! lowest priority, and among those the one started last, so the least work is lost. The
+//! victim is terminated like `terminate_execution`, at its next hostcall, and the execution
+//! manager requeues or fails it per `action`.
+//! 占用 `execution.max_concurrent_executions` 槽位的执行会连同其任务的优先级一起被跟踪。所有槽位
+//! 均被占用时，允许抢占的调用先等待 `wait_ms`，随后选出被抢占者：优先级最低的运行中执行，其中最晚
+//! 开始的一个，以尽量减少损失的工作。被抢占者与 `terminate_execution` 一样在其下一次 hostcall 时
+//! 终止，执行管理器按 `action` 将其重新排队或使其失败。
+//!
+//! A task's priority is its `preemption.priority` task config, else the priority of its SMS
+//! task, else `normal`.
+//! 任务的优先级取自其 `preemption.priority` 任务配置，其次为其 SMS 任务的优先级，默认为 `normal`。
+
+use std::collections::{HashMap, HashSet};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use dashmap::DashMap;
+use parking_lot::{Mutex, RwLock};
+use serde::Serialize;
+
+use crate::proto::sms::TaskPriority;
+use crate::spearlet::config::PreemptionConfig;
+
+/// Task config key setting a task's priority / 设置任务优先级的任务配置键
+pub const TASK_CONFIG_PRIORITY: &str = "preemption.priority";
+
+/// What happens to a preempted execution / 被抢占执行的处理方式
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum PreemptAction {
+    /// Run it again from the start / 从头重新运行
+    Requeue,
+    /// Fail it / 使其失败
+    Terminate,
+}
+
+impl PreemptAction {
+    pub fn parse(s: &str) -> Option<Self> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "requeue" => Some(PreemptAction::Requeue),
+            "terminate" => Some(PreemptAction::Terminate),
+            _ => None,
+        }
+    }
+}
+
+/// Parse a priority name; unknown names are `None` / 解析优先级名称；未知名称返回 `None`
+pub fn parse_priority(s: &str) -> Option<i32> {
+    let p = match s.trim().to_ascii_lowercase().as_str() {
+        "low" => TaskPriority::Low,
+        "normal" => TaskPriority::Normal,
+        "high" => TaskPriority::High,
+        "urgent" => TaskPriority::Urgent,
+        _ => return None,
+    };
+    Some(p as i32)
+}
+
+fn priority_name(p: i32) -> &'static str {
+    match TaskPriority::try_from(p) {
+        Ok(TaskPriority::Low) => "low",
+        Ok(TaskPriority::Normal) => "normal",
+        Ok(TaskPriority::High) => "high",
+        Ok(TaskPriority::Urgent) => "urgent",
+        _ => "unknown",
+    }
+}
+
+/// One running execution as seen by the admin endpoint / 管理端看到的一个运行中执行
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct RunningExecution {
+    pub execution_id: String,
+    pub task_id: String,
+    pub priority: &'static str,
+    pub running_ms: u64,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct PreemptionStats {
+    pub enabled: bool,
+    pub running: Vec<RunningExecution>,
+    /// Executions terminated to make room / 为腾出槽位而终止的执行数
+    pub preempted: u64,
+    pub requeued: u64,
+    /// Preempted executions that failed instead of running again / 被抢占后失败而未重新运行的执行数
+    pub failed: u64,
+}
+
+struct Slot {
+    task_id: String,
+    priority: i32,
+    started: Instant,
+}
+
+#[derive(Default)]
+pub struct Preemption {
+    config: RwLock<PreemptionConfig>,
+    /// Priorities of SMS tasks / SMS 任务的优先级
+    task_priorities: DashMap<String, i32>,
+    running: Mutex<HashMap<String, Slot>>,
+    /// Victims whose termination is on its way / 正在终止中的被抢占者
+    victims: Mutex<HashSet<String>>,
+    preempted: AtomicU64,
+    requeued: AtomicU64,
+    failed: AtomicU64,
+}
+
+impl Preemption {
+    pub fn set_config(&self, config: PreemptionConfig) {
+        *self.config.write() = config;
+    }
+
+    /// Record the priority of an SMS task / 记录 SMS 任务的优先级
+    pub fn set_task_priority(&self, task_id: &str, priority: i32) {
+        if TaskPriority::try_from(priority).is_ok_and(|p| p != TaskPriority::Unknown) {
+            self.task_priorities.insert(task_id.to_string(), priority);
+        } else {
+            self.task_priorities.remove(task_id);
+        }
+    }
+
+    pub fn forget_task(&self, task_id: &str) {
+        self.task_priorities.remove(task_id);
+    }
+
+    /// Priority of a task given its task config / 根据任务配置得出的任务优先级
+    pub fn priority(&self, task_id: &str, task_config: Option<&HashMap<String, String>>) -> i32 {
+        task_config
+            .and_then(|c| c.get(TASK_CONFIG_PRIORITY))
+            .and_then(|v| parse_priority(v))
+            .or_else(|| self.task_priorities.get(task_id).map(|p| *p))
+            .unwrap_or(TaskPriority::Normal as i32)
+    }
+
+    /// How long an invocation waits for a slot before preempting; `None` when it may not
+    /// 调用在抢占前等待槽位的时间；不允许抢占时为 `None`
+    pub fn preemptor_wait(&self, priority: i32, interactive: bool) -> Option<Duration> {
+        let cfg = self.config.read();
+        let min = parse_priority(&cfg.min_preemptor_priority)?;
+        (cfg.enabled && priority >= min && (interactive || !cfg.interactive_only))
+            .then(|| Duration::from_millis(cfg.wait_ms))
+    }
+
+    /// Track an execution that took a slot / 跟踪占用槽位的执行
+    pub fn begin(self: &Arc<Self>, execution_id: &str, task_id: &str, priority: i32) -> SlotGuard {
+        self.running.lock().insert(
+            execution_id.to_string(),
+            Slot {
+                task_id: task_id.to_string(),
+                priority,
+                started: Instant::now(),
+            },
+        );
+        SlotGuard {
+            preemption: self.clone(),
+            execution_id: execution_id.to_string(),
+        }
+    }
+
+    /// Pick and mark the execution to preempt for a preemptor of `priority`
+    /// 为优先级为 `priority` 的抢占方选出并标记被抢占的执行
+    pub fn pick_victim(&self, priority: i32) -> Option<String> {
+        let cfg = self.config.read();
+        let max = parse_priority(&cfg.max_victim_priority)?;
+        let running = self.running.lock();
+        let mut victims = self.victims.lock();
+        let id = running
+            .iter()
+            .filter(|(id, s)| {
+                s.priority <= max
+                    && s.priority < priority
+                    && !victims.contains(*id)
+                    && !cfg.protected_tasks.iter().any(|t| t == &s.task_id)
+            })
+            .min_by(|(_, a), (_, b)| {
+                a.priority
+                    .cmp(&b.priority)
+                    .then_with(|| b.started.cmp(&a.started))
+            })
+            .map(|(id, _)| id.clone())?;
+        victims.insert(id.clone());
+        self.preempted.fetch_add(1, Ordering::Relaxed);
+        Some(id)
+    }
+
+    /// Whether an execution was preempted; clears the mark / 执行是否被抢占；同时清除标记
+    ///
+    /// Returns the action to take, counting it. `attempts` is how often the execution was
+    /// requeued already.
+    /// 返回应采取的处理方式并计数。`attempts` 为该执行已重新排队的次数。
+    pub fn take_victim(&self, execution_id: &str, attempts: u32) -> Option<PreemptAction> {
+        if !self.victims.lock().remove(execution_id) {
+            return None;
+        }
+        let cfg = self.config.read();
+        let action = match PreemptAction::parse(&cfg.action) {
+            Some(PreemptAction::Requeue) if attempts < cfg.max_requeues => PreemptAction::Requeue,
+            _ => PreemptAction::Terminate,
+        };
+        match action {
+            PreemptAction::Requeue => self.requeued.fetch_add(1, Ordering::Relaxed),
+            PreemptAction::Terminate => self.failed.fetch_add(1, Ordering::Relaxed),
+        };
+        Some(action)
+    }
+
+    pub fn stats(&self) -> PreemptionStats {
+        let now = Instant::now();
+        let mut running: Vec<RunningExecution> = self
+            .running
+            .lock()
+            .iter()
+            .map(|(id, s)| RunningExecution {
+                execution_id: id.clone(),
+                task_id: s.task_id.clone(),
+                priority: priority_name(s.priority),
+                running_ms: now.saturating_duration_since(s.started).as_millis() as u64,
+            })
+            .collect();
+        running.sort_by(|a, b| a.execution_id.cmp(&b.execution_id));
+        PreemptionStats {
+            enabled: self.config.read().enabled,
+            running,
+            preempted: self.preempted.load(Ordering::Relaxed),
+            requeued: self.requeued.load(Ordering::Relaxed),
+            failed: self.failed.load(Ordering::Relaxed),
+        }
+    }
+}
+
+/// A tracked execution; dropping it frees the slot / 被跟踪的执行；丢弃时释放槽位
+///
+/// Call `take_victim` before dropping it. / 应在丢弃之前调用 `take_victim`。
+pub struct SlotGuard {
+    preemption: Arc<Preemption>,
+    execution_id: String,
+}
+
+impl Drop for SlotGuard {
+    fn drop(&mut self) {
+        self.preemption.running.lock().remove(&self.execution_id);
+        // A victim that finished before its termination took effect / 终止生效前已结束的被抢占者
+        self.preemption.victims.lock().remove(&self.execution_id);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const LOW: i32 = TaskPriority::Low as i32;
+    const NORMAL: i32 = TaskPriority::Normal as i32;
+    const HIGH: i32 = TaskPriority::High as i32;
+
+    fn tracker(cfg: PreemptionConfig) -> Arc<Preemption> {
+        let p: Arc<Preemption> = Arc::default();
+        p.set_config(cfg);
+        p
+    }
+
+    #[test]
+    fn test_priority_sources() {
+        let p = tracker(PreemptionConfig::default());
+        assert_eq!(p.priority("t1", None), NORMAL);
+        p.set_task_priority("t1", LOW);
+        assert_eq!(p.priority("t1", None), LOW);
+        let mut task_config = HashMap::new();
+        task_config.insert(TASK_CONFIG_PRIORITY.to_string(), "High".to_string());
+        assert_eq!(p.priority("t1", Some(&task_config)), HIGH);
+
+        assert_eq!(p.preemptor_wait(HIGH, true), None);
+        let p = tracker(PreemptionConfig {
+            enabled: true,
+            ..Default::default()
+        });
+        assert_eq!(
+            p.preemptor_wait(HIGH, true),
+            Some(Duration::from_millis(200))
+        );
+        assert_eq!(p.preemptor_wait(HIGH, false), None);
+        assert_eq!(p.preemptor_wait(NORMAL, true), None);
+    }
+
+    #[test]
+    fn test_pick_victim() {
+        let p = tracker(PreemptionConfig {
+            enabled: true,
+            max_victim_priority: "normal".to_string(),
+            max_requeues: 1,
+            protected_tasks: vec!["keep".to_string()],
+            ..Default::default()
+        });
+        let _a = p.begin("e-normal", "t1", NORMAL);
+        let _b = p.begin("e-low-old", "t2", LOW);
+        std::thread::sleep(Duration::from_millis(2));
+        let _c = p.begin("e-low-new", "t2", LOW);
+        let _d = p.begin("e-keep", "keep", LOW);
+
+        // Lowest priority first, and the one started last among those
+        // 优先选择最低优先级，其中最晚开始的一个
+        assert_eq!(p.pick_victim(HIGH).as_deref(), Some("e-low-new"));
+        assert_eq!(p.pick_victim(HIGH).as_deref(), Some("e-low-old"));
+        assert_eq!(p.pick_victim(NORMAL), None);
+        assert_eq!(p.pick_victim(HIGH).as_deref(), Some("e-normal"));
+        assert_eq!(p.pick_victim(HIGH), None);
+
+        assert_eq!(p.take_victim("e-low-new", 0), Some(PreemptAction::Requeue));
+        assert_eq!(p.take_victim("e-low-new", 0), None);
+        assert_eq!(
+            p.take_victim("e-low-old", 1),
+            Some(PreemptAction::Terminate)
+        );
+
+        drop(_c);
+        let st = p.stats();
+        assert_eq!(st.running.len(), 3);
+        assert_eq!((st.preempted, st.requeued, st.failed), (3, 1, 1));
+    }
+}
@@ -0,0 +1,448 @@
+//! HTTP and WebSocket rate limiting for spearlet
+//! spearlet 的 HTTP 与 WebSocket 限流
+//!
+//! Every request first takes a token from the bucket of its source address: the peer IP,
+//! or the `X-Forwarded-For` client when the peer is a trusted proxy. This runs before
+//! authentication, so floods and credential guessing are throttled per address whatever
+//! headers they send. Once authentication succeeds the request also takes a token from
+//! the bucket of its verified credential, so one key used from many addresses is
+//! limited too. Requests over a limit get `429 Too Many Requests` with `Retry-After`.
+//! Invocations are additionally checked against the limit of the target workload, set
+//! by the task config keys `rate_limit.rps` and `rate_limit.burst`.
+//! 每个请求先从其来源地址的令牌桶中取令牌：对端 IP，或对端为可信代理时的
+//! `X-Forwarded-For` 客户端。该检查在认证之前进行，因此无论携带何种请求头，洪泛与凭证猜测
+//! 都按地址受限。认证成功后，请求还会从其已验证凭证的令牌桶中取令牌，从多个地址使用同一
+//! key 同样受限。超出限制的请求返回带 `Retry-After` 的 `429 Too Many Requests`。
+//! 调用还会按目标工作负载的限制检查，该限制由任务配置键 `rate_limit.rps` 与
+//! `rate_limit.burst` 设置。
+
+use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use axum::{
+    body::Body,
+    extract::{ConnectInfo, State},
+    http::{header, HeaderMap, Request, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Json,
+};
+use dashmap::DashMap;
+use parking_lot::RwLock;
+
+use crate::spearlet::config::HttpRateLimitConfig;
+use crate::spearlet::http_auth::AuthenticatedClient;
+use crate::spearlet::ip_allowlist::IpAllowlist;
+
+/// Task config key of the workload rate (requests per second) / 工作负载速率（每秒请求数）的任务配置键
+pub const TASK_CONFIG_RATE_LIMIT_RPS: &str = "rate_limit.rps";
+/// Task config key of the workload burst / 工作负载突发数的任务配置键
+pub const TASK_CONFIG_RATE_LIMIT_BURST: &str = "rate_limit.burst";
+
+/// Sustained rate and burst of one bucket / 单个令牌桶的持续速率与突发数
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct RateRule {
+    pub per_second: f64,
+    pub burst: u32,
+}
+
+impl RateRule {
+    /// Workload rule from its task config, `None` when unset / 从任务配置读取工作负载规则，未设置时为 `None`
+    ///
+    /// A missing burst defaults to one second worth of requests.
+    /// 未设置突发数时默认为一秒的请求量。
+    pub fn from_task_config(task_config: &HashMap<String, String>) -> Option<Self> {
+        let per_second = task_config
+            .get(TASK_CONFIG_RATE_LIMIT_RPS)
+            .and_then(|v| v.trim().parse::<f64>().ok())
+            .filter(|v| v.is_finite() && *v > 0.0)?;
+        let burst = task_config
+            .get(TASK_CONFIG_RATE_LIMIT_BURST)
+            .and_then(|v| v.trim().parse::<u32>().ok())
+            .unwrap_or_else(|| per_second.ceil() as u32);
+        Some(Self { per_second, burst })
+    }
+
+    fn capacity(&self) -> f64 {
+        self.burst.max(1) as f64
+    }
+}
+
+#[derive(Debug)]
+struct TokenBucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+impl TokenBucket {
+    fn new(rule: RateRule, now: Instant) -> Self {
+        Self {
+            tokens: rule.capacity(),
+            updated: now,
+        }
+    }
+
+    /// Take one token, or return how long until one is available
+    /// 取出一个令牌，否则返回距下一个令牌可用的时长
+    fn take(&mut self, rule: RateRule, now: Instant) -> Result<(), Duration> {
+        let elapsed = now.saturating_duration_since(self.updated).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * rule.per_second).min(rule.capacity());
+        self.updated = now;
+        if self.tokens >= 1.0 {
+            self.tokens -= 1.0;
+            return Ok(());
+        }
+        Err(Duration::from_secs_f64(
+            (1.0 - self.tokens) / rule.per_second.max(f64::MIN_POSITIVE),
+        ))
+    }
+
+    fn is_full(&self, rule: RateRule, now: Instant) -> bool {
+        let elapsed = now.saturating_duration_since(self.updated).as_secs_f64();
+        self.tokens + elapsed * rule.per_second >= rule.capacity()
+    }
+}
+
+/// Client key attached to the request by the middleware / 中间件附加到请求上的客户端键
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ClientKey(pub String);
+
+/// Token buckets of all clients / 所有客户端的令牌桶
+#[derive(Debug)]
+pub struct RateLimiter {
+    config: RwLock<HttpRateLimitConfig>,
+    proxies: RwLock<IpAllowlist>,
+    buckets: DashMap<String, (RateRule, TokenBucket)>,
+}
+
+impl RateLimiter {
+    pub fn new(config: HttpRateLimitConfig) -> Self {
+        Self {
+            proxies: RwLock::new(IpAllowlist::parse_lossy(&config.trusted_proxies)),
+            config: RwLock::new(config),
+            buckets: DashMap::new(),
+        }
+    }
+
+    /// Apply changed limits; existing buckets switch to the new default rule
+    /// 应用变更的限制；现有令牌桶切换到新的默认规则
+    pub fn reconfigure(&self, config: HttpRateLimitConfig) {
+        *self.proxies.write() = IpAllowlist::parse_lossy(&config.trusted_proxies);
+        *self.config.write() = config;
+    }
+
+    /// Default per-client rule / 默认的每客户端规则
+    pub fn default_rule(&self) -> RateRule {
+        let config = self.config.read();
+        RateRule {
+            per_second: config.requests_per_second,
+            burst: config.burst,
+        }
+    }
+
+    /// Check a client against the default rule / 按默认规则检查客户端
+    pub fn check_client(&self, client: &str) -> Result<(), Duration> {
+        self.check(client.to_string(), self.default_rule(), Instant::now())
+    }
+
+    /// Check a client against the rule of a workload, if it has one
+    /// 按工作负载的规则（如有）检查客户端
+    pub fn check_workload(
+        &self,
+        client: &str,
+        task_id: &str,
+        task_config: &HashMap<String, String>,
+    ) -> Result<(), Duration> {
+        match RateRule::from_task_config(task_config) {
+            Some(rule) => self.check(format!("{}|task:{}", client, task_id), rule, Instant::now()),
+            None => Ok(()),
+        }
+    }
+
+    fn check(&self, key: String, rule: RateRule, now: Instant) -> Result<(), Duration> {
+        if self.buckets.len() >= self.config.read().max_clients.max(1)
+            && !self.buckets.contains_key(&key)
+        {
+            self.evict_full(now);
+        }
+        let mut entry = self
+            .buckets
+            .entry(key)
+            .or_insert_with(|| (rule, TokenBucket::new(rule, now)));
+        let (stored_rule, bucket) = entry.value_mut();
+        *stored_rule = rule;
+        bucket.take(rule, now)
+    }
+
+    /// Drop buckets that have refilled; they behave like new ones
+    /// 移除已回满的令牌桶；它们与新建的令牌桶行为相同
+    fn evict_full(&self, now: Instant) {
+        self.buckets
+            .retain(|_, (rule, bucket)| !bucket.is_full(*rule, now));
+    }
+
+    pub fn is_exempt(&self, path: &str) -> bool {
+        self.config.read().exempt_paths.iter().any(|p| p == path)
+    }
+
+    /// Key of the source address of a request / 请求来源地址的键
+    ///
+    /// `X-Forwarded-For` is only read when the peer is a trusted proxy; its entries are
+    /// walked from the right, skipping further trusted proxies, so a client cannot pick
+    /// its own key by prepending addresses.
+    /// 仅当对端为可信代理时才读取 `X-Forwarded-For`；从右向左遍历其条目并跳过其他可信代理，
+    /// 客户端无法通过在前面追加地址来选择自己的键。
+    pub fn client_key(&self, headers: &HeaderMap, peer: Option<SocketAddr>) -> String {
+        let Some(peer) = peer.map(|p| p.ip()) else {
+            return "ip:unknown".to_string();
+        };
+        format!("ip:{}", self.source_ip(headers, peer))
+    }
+
+    fn source_ip(&self, headers: &HeaderMap, peer: IpAddr) -> IpAddr {
+        let proxies = self.proxies.read();
+        if !self.config.read().trust_forwarded_for || !proxies.contains(peer) {
+            return peer;
+        }
+        let forwarded: Vec<&str> = headers
+            .get_all("x-forwarded-for")
+            .iter()
+            .filter_map(|v| v.to_str().ok())
+            .flat_map(|v| v.split(','))
+            .collect();
+        let mut client = peer;
+        for hop in forwarded.iter().rev() {
+            let Ok(ip) = hop.trim().parse::<IpAddr>() else {
+                break;
+            };
+            client = ip;
+            if !proxies.contains(ip) {
+                break;
+            }
+        }
+        client
+    }
+}
+
+/// `429 Too Many Requests` with `Retry-After` in whole seconds
+/// 带 `Retry-After`（整秒）的 `429 Too Many Requests`
+pub fn too_many_requests(retry_after: Duration) -> Response {
+    let secs = retry_after.as_secs_f64().ceil().max(1.0) as u64;
+    (
+        StatusCode::TOO_MANY_REQUESTS,
+        [(header::RETRY_AFTER, secs.to_string())],
+        Json(serde_json::json!({
+            "error": "rate_limited",
+            "message": "too many requests",
+            "retry_after_s": secs,
+        })),
+    )
+        .into_response()
+}
+
+/// Axum middleware enforcing the per-address limit, before authentication
+/// 在认证之前执行每地址限制的 axum 中间件
+///
+/// Also attaches [`ClientKey`] so handlers can apply workload limits.
+/// 同时附加 [`ClientKey`]，供处理函数执行工作负载限制。
+pub async fn rate_limit_middleware(
+    State(limiter): State<Arc<RateLimiter>>,
+    mut req: Request<Body>,
+    next: Next,
+) -> Response {
+    if limiter.is_exempt(req.uri().path()) {
+        return next.run(req).await;
+    }
+    let peer = req
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .map(|c| c.0);
+    let key = limiter.client_key(req.headers(), peer);
+    if let Err(retry_after) = limiter.check_client(&key) {
+        return too_many_requests(retry_after);
+    }
+    req.extensions_mut().insert(ClientKey(key));
+    next.run(req).await
+}
+
+/// Axum middleware enforcing the per-credential limit, after authentication
+/// 在认证之后执行每凭证限制的 axum 中间件
+///
+/// Only requests carrying an [`AuthenticatedClient`] are counted; their [`ClientKey`]
+/// becomes the credential, so workload limits follow the caller across addresses.
+/// 仅计入携带 [`AuthenticatedClient`] 的请求；其 [`ClientKey`] 改为该凭证，
+/// 使工作负载限制跨地址跟随调用方。
+pub async fn credential_rate_limit_middleware(
+    State(limiter): State<Arc<RateLimiter>>,
+    mut req: Request<Body>,
+    next: Next,
+) -> Response {
+    let Some(client) = req.extensions().get::<AuthenticatedClient>() else {
+        return next.run(req).await;
+    };
+    if limiter.is_exempt(req.uri().path()) {
+        return next.run(req).await;
+    }
+    let key = client.id.clone();
+    if let Err(retry_after) = limiter.check_client(&key) {
+        return too_many_requests(retry_after);
+    }
+    req.extensions_mut().insert(ClientKey(key));
+    next.run(req).await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn limiter(rps: f64, burst: u32) -> RateLimiter {
+        RateLimiter::new(HttpRateLimitConfig {
+            enabled: true,
+            requests_per_second: rps,
+            burst,
+            ..Default::default()
+        })
+    }
+
+    #[test]
+    fn test_bucket_burst_and_refill() {
+        let l = limiter(2.0, 3);
+        let rule = l.default_rule();
+        let t0 = Instant::now();
+        for _ in 0..3 {
+            assert!(l.check("c".to_string(), rule, t0).is_ok());
+        }
+        let wait = l.check("c".to_string(), rule, t0).unwrap_err();
+        assert!(wait > Duration::from_millis(400) && wait <= Duration::from_millis(500));
+        assert!(l
+            .check("c".to_string(), rule, t0 + Duration::from_millis(500))
+            .is_ok());
+        assert!(l.check("other".to_string(), rule, t0).is_ok());
+    }
+
+    #[test]
+    fn test_workload_rule() {
+        let mut cfg = HashMap::new();
+        assert!(RateRule::from_task_config(&cfg).is_none());
+        cfg.insert(TASK_CONFIG_RATE_LIMIT_RPS.to_string(), "0.5".to_string());
+        assert_eq!(
+            RateRule::from_task_config(&cfg),
+            Some(RateRule {
+                per_second: 0.5,
+                burst: 1
+            })
+        );
+        let l = limiter(100.0, 100);
+        assert!(l.check_workload("c", "task-1", &cfg).is_ok());
+        let wait = l.check_workload("c", "task-1", &cfg).unwrap_err();
+        assert!(wait > Duration::from_secs(1));
+        assert!(l.check_workload("c", "task-2", &HashMap::new()).is_ok());
+    }
+
+    #[test]
+    fn test_client_key() {
+        let l = limiter(1.0, 1);
+        let peer: SocketAddr = "10.0.0.7:5555".parse().unwrap();
+        let mut h = HeaderMap::new();
+        h.insert("x-forwarded-for", "1.2.3.4, 10.0.0.1".parse().unwrap());
+        assert_eq!(l.client_key(&h, Some(peer)), "ip:10.0.0.7");
+        // Credentials never pick the bucket / 凭证从不决定令牌桶
+        h.insert(header::AUTHORIZATION, "Bearer secret".parse().unwrap());
+        assert_eq!(l.client_key(&h, Some(peer)), "ip:10.0.0.7");
+
+        let trusted = RateLimiter::new(HttpRateLimitConfig {
+            trust_forwarded_for: true,
+            trusted_proxies: vec!["10.0.0.0/24".to_string()],
+            ..Default::default()
+        });
+        let mut h = HeaderMap::new();
+        h.insert(
+            "x-forwarded-for",
+            "6.6.6.6, 1.2.3.4, 10.0.0.1".parse().unwrap(),
+        );
+        assert_eq!(trusted.client_key(&h, Some(peer)), "ip:1.2.3.4");
+        // Only a trusted peer may forward / 仅可信对端可以转发
+        let outsider: SocketAddr = "8.8.8.8:5555".parse().unwrap();
+        assert_eq!(trusted.client_key(&h, Some(outsider)), "ip:8.8.8.8");
+    }
+
+    #[tokio::test]
+    async fn test_rotating_fake_keys_are_limited() {
+        use crate::spearlet::config::{HttpApiKey, HttpAuthConfig, HttpAuthRole};
+        use tower::ServiceExt;
+
+        let limiter = Arc::new(limiter(0.001, 3));
+        let auth = Arc::new(HttpAuthConfig {
+            enabled: true,
+            api_keys: vec![HttpApiKey {
+                key: "good".to_string(),
+                role: HttpAuthRole::Invoke,
+            }],
+            ..Default::default()
+        });
+        let app = axum::Router::new()
+            .route("/tasks", axum::routing::get(|| async { "ok" }))
+            .layer(axum::middleware::from_fn_with_state(
+                limiter.clone(),
+                credential_rate_limit_middleware,
+            ))
+            .layer(axum::middleware::from_fn_with_state(
+                auth,
+                crate::spearlet::http_auth::auth_middleware,
+            ))
+            .layer(axum::middleware::from_fn_with_state(
+                limiter.clone(),
+                rate_limit_middleware,
+            ));
+        let send = |key: String, peer: &str| {
+            let mut req = Request::builder()
+                .uri("/tasks")
+                .header("x-api-key", key)
+                .body(Body::empty())
+                .unwrap();
+            req.extensions_mut()
+                .insert(ConnectInfo(peer.parse::<SocketAddr>().unwrap()));
+            app.clone().oneshot(req)
+        };
+
+        let mut statuses = Vec::new();
+        for i in 0..5 {
+            let resp = send(format!("guess-{}", i), "203.0.113.9:4000")
+                .await
+                .unwrap();
+            statuses.push(resp.status());
+        }
+        assert_eq!(&statuses[..3], &[StatusCode::UNAUTHORIZED; 3]);
+        assert_eq!(&statuses[3..], &[StatusCode::TOO_MANY_REQUESTS; 2]);
+
+        // The same valid key from many addresses shares one credential bucket
+        // 从多个地址使用同一有效 key 共享一个凭证令牌桶
+        let mut statuses = Vec::new();
+        for i in 0..4 {
+            let peer = format!("198.51.100.{}:4000", i + 1);
+            statuses.push(send("good".to_string(), &peer).await.unwrap().status());
+        }
+        assert_eq!(&statuses[..3], &[StatusCode::OK; 3]);
+        assert_eq!(statuses[3], StatusCode::TOO_MANY_REQUESTS);
+    }
+
+    #[test]
+    fn test_eviction_keeps_limited_clients() {
+        let l = RateLimiter::new(HttpRateLimitConfig {
+            requests_per_second: 1.0,
+            burst: 1,
+            max_clients: 2,
+            ..Default::default()
+        });
+        let rule = l.default_rule();
+        let t0 = Instant::now();
+        assert!(l.check("a".to_string(), rule, t0).is_ok());
+        assert!(l.check("b".to_string(), rule, t0).is_ok());
+        let later = t0 + Duration::from_secs(5);
+        assert!(l.check("c".to_string(), rule, later).is_ok());
+        assert_eq!(l.buckets.len(), 1);
+        assert!(l.check("c".to_string(), rule, later).is_err());
+    }
+}
@@ -16,6 +16,9 @@ use crate::proto::sms::{
     RegisterNodeRequest, UpdateNodeResourceRequest,
 };
 use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::config_rollout;
+use crate::spearlet::device_profile::DeviceProfile;
+use crate::spearlet::node_services::NodeServices;
 
 /// Registration state / 注册状态
 #[derive(Debug, Clone)]
@@ -73,6 +76,8 @@ pub struct RegistrationService {
     state: Arc<RwLock<RegistrationState>>,
     /// Disconnection start time / 断线开始时间
     disconnect_since: Arc<RwLock<Option<Instant>>>,
+    /// Services of the spearlet reporting through the heartbeats / 通过心跳上报的 spearlet 服务
+    node: Arc<NodeServices>,
     cancel_token: CancellationToken,
 }
 
@@ -85,10 +90,17 @@ impl RegistrationService {
             node_client: Arc::new(RwLock::new(None)),
             state: Arc::new(RwLock::new(RegistrationState::NotRegistered)),
             disconnect_since: Arc::new(RwLock::new(None)),
+            node: NodeServices::new(),
             cancel_token: CancellationToken::new(),
         }
     }
 
+    /// Report for the spearlet owning `node` / 为持有 `node` 的 spearlet 上报
+    pub fn with_node(mut self, node: Arc<NodeServices>) -> Self {
+        self.node = node;
+        self
+    }
+
     /// Start registration service / 启动注册服务
     pub async fn start(&self) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
         info!("Starting Spearlet registration service");
@@ -125,6 +137,7 @@ impl RegistrationService {
         let node_client = self.node_client.clone();
         let state = self.state.clone();
         let disconnect_since = self.disconnect_since.clone();
+        let node = self.node.clone();
         let cancel_token = self.cancel_token.clone();
 
         tokio::spawn(async move {
@@ -184,7 +197,9 @@ impl RegistrationService {
                             "Heartbeat tick: interval={}s, node_name={}, sms_grpc_addr={}",
                             config.heartbeat_interval, config.node_name, config.sms_grpc_addr
                         );
-                        if let Err(e) = Self::send_heartbeat(&config, &node_client, &state).await {
+                        if let Err(e) =
+                            Self::send_heartbeat(&config, &node, &node_client, &state).await
+                        {
                             warn!("Heartbeat failed: {}", e);
                             // Try reconnect immediately / 立即尝试重连
                             if let Err(re) =
@@ -278,6 +293,7 @@ impl RegistrationService {
             metadata: {
                 let mut m = std::collections::HashMap::new();
                 m.insert("name".to_string(), config.node_name.clone());
+                m.extend(DeviceProfile::new(config.devices.clone()).node_metadata());
                 m
             },
         };
@@ -307,6 +323,7 @@ impl RegistrationService {
     /// Send heartbeat to SMS / 向SMS发送心跳
     async fn send_heartbeat(
         config: &SpearletConfig,
+        node: &NodeServices,
         node_client: &Arc<RwLock<Option<NodeServiceClient<Channel>>>>,
         state: &Arc<RwLock<RegistrationState>>,
     ) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
@@ -322,7 +339,7 @@ impl RegistrationService {
         let request = tonic::Request::new(HeartbeatRequest {
             uuid: node_uuid.clone(),
             timestamp: ts,
-            health_info: std::collections::HashMap::new(),
+            health_info: config_rollout::health_info(node, config),
         });
 
         let per_attempt = Duration::from_millis(config.sms_connect_timeout_ms)
@@ -331,8 +348,12 @@ impl RegistrationService {
         let resp = timeout(per_attempt, client.heartbeat(request))
             .await
             .map_err(|_| std::io::Error::other("heartbeat timeout"))??;
-        let server_ts = resp.get_ref().server_timestamp;
-        debug!("Heartbeat ACK: uuid={}, server_ts={}", node_uuid, server_ts);
+        let resp = resp.into_inner();
+        debug!(
+            "Heartbeat ACK: uuid={}, server_ts={}",
+            node_uuid, resp.server_timestamp
+        );
+        config_rollout::offer(node, config, resp.config_rollout).await;
 
         if let Err(e) = Self::send_resource_report(client, config).await {
             warn!("Resource report failed: {}", e);
@@ -328,7 +328,47 @@ async fn test_connect_fails_with_unreachable_sms() {
         sms_connect_timeout_ms: 15000,
         sms_connect_retry_ms: 500,
         reconnect_total_timeout_ms: 300000,
+        shutdown_timeout_ms: 30_000,
         llm: crate::spearlet::config::LlmConfig::default(),
+        model_cache: crate::spearlet::config::ModelCacheConfig::default(),
+        downloads: crate::spearlet::config::DownloadConfig::default(),
+        tool_plugins: crate::spearlet::config::ToolPluginConfig::default(),
+        test_hostcalls: false,
+        otel: Default::default(),
+        crash: Default::default(),
+        clock: Default::default(),
+        locale: Default::default(),
+        webhook: Default::default(),
+        devices: Default::default(),
+        energy: Default::default(),
+        compute_hints: Default::default(),
+        execution: Default::default(),
+        reload: Default::default(),
+        webrtc: Default::default(),
+        telephony: Default::default(),
+        tls: Default::default(),
+        rtsp: Default::default(),
+        onnx: Default::default(),
+        model_store: Default::default(),
+        metrics_export: Default::default(),
+        log_shipping: Default::default(),
+        debug_tunnel: Default::default(),
+        desired_state: Default::default(),
+        config_rollout: Default::default(),
+        blob_cache: Default::default(),
+        vector_store: Default::default(),
+        kv_state: Default::default(),
+        schedules: Default::default(),
+        async_journal: Default::default(),
+        message_passing: Default::default(),
+        scratch_files: Default::default(),
+        temp_workspace: Default::default(),
+        service_ports: Default::default(),
+        response_cache: Default::default(),
+        usage: Default::default(),
+        moderation: Default::default(),
+        preemption: Default::default(),
+        backend_autosuspend: Default::default(),
     };
 
     let cfg = Arc::new(cfg);
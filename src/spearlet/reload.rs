@@ -0,0 +1,774 @@
+//! Hot reload of configuration and local workloads
+//! 配置与本地工作负载的热加载
+//!
+//! The spearlet polls the configuration file it was started with and the workload
+//! directory (`reload.workloads_dir`), and applies changes without a restart.
+//! `POST /admin/reload` runs the same reload on demand. LLM backends, execution
+//! concurrency, HTTP rate limits, energy thresholds, ONNX models, the model store and
+//! workloads are applied live; other changed settings are reported as needing a restart.
+//! spearlet 轮询启动时使用的配置文件与工作负载目录（`reload.workloads_dir`），无需重启即可
+//! 应用变更。`POST /admin/reload` 按需执行同样的重新加载。LLM 后端、执行并发、HTTP 限流、
+//! 能耗阈值、ONNX 模型、模型仓库与工作负载即时生效；其他变更的设置报告为需要重启。
+
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Weak};
+use std::time::{Duration, SystemTime};
+
+use parking_lot::RwLock;
+use serde::{Deserialize, Serialize};
+use tokio::sync::{watch, Mutex};
+
+use crate::proto::sms::{ExecutableType, Task as SmsTask, TaskExecutable};
+use crate::spearlet::config::SpearletConfig;
+use crate::spearlet::config_check;
+use crate::spearlet::execution::manager::TaskExecutionManager;
+use crate::spearlet::execution::runtime::RuntimeConfig;
+use crate::spearlet::function_service::collect_llm_global_environment;
+use crate::spearlet::message_routing;
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
+
+/// Task config key holding the workload file a task came from
+/// 存放任务来源工作负载文件的任务配置键
+pub const TASK_CONFIG_WORKLOAD_FILE: &str = "workload.file";
+
+/// Settings applied without a restart; a prefix covers everything below it
+/// 无需重启即可应用的设置；前缀涵盖其下的全部设置
+const LIVE_SETTINGS: &[&str] = &[
+    "llm",
+    "energy",
+    "compute_hints",
+    "onnx",
+    "model_store",
+    "blob_cache",
+    "vector_store",
+    "kv_state",
+    "schedules",
+    "async_journal",
+    "message_passing",
+    "scratch_files",
+    "temp_workspace",
+    "response_cache",
+    "usage",
+    "moderation",
+    "preemption",
+    "backend_autosuspend",
+    "reload",
+    "execution.max_concurrent_executions",
+    "http.rate_limit",
+];
+
+/// A workload defined by a file in the workload directory / 由工作负载目录中的文件定义的工作负载
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct WorkloadFile {
+    pub name: String,
+    /// Task id used by invocations; defaults to `name` / 调用使用的任务 ID；默认为 `name`
+    pub task_id: String,
+    pub description: String,
+    pub version: String,
+    /// `process` (default), `wasm` or `kubernetes` / `process`（默认）、`wasm` 或 `kubernetes`
+    pub runtime: String,
+    /// Module, binary or image location / 模块、二进制或镜像位置
+    pub uri: String,
+    pub checksum_sha256: String,
+    pub env: BTreeMap<String, String>,
+    /// Task config, e.g. `rate_limit.rps` / 任务配置，例如 `rate_limit.rps`
+    pub config: BTreeMap<String, String>,
+}
+
+impl WorkloadFile {
+    pub fn task_id(&self) -> &str {
+        if self.task_id.is_empty() {
+            &self.name
+        } else {
+            &self.task_id
+        }
+    }
+
+    pub(crate) fn executable_type(&self) -> Option<ExecutableType> {
+        match self.runtime.to_ascii_lowercase().as_str() {
+            "" | "process" => Some(ExecutableType::Process),
+            "wasm" => Some(ExecutableType::Wasm),
+            "kubernetes" => Some(ExecutableType::Container),
+            _ => None,
+        }
+    }
+
+    /// The same shape SMS hands out, so local workloads take the SMS path
+    /// 与 SMS 下发的结构相同，使本地工作负载走 SMS 的路径
+    pub fn to_sms_task(&self, path: &Path) -> SmsTask {
+        let mut config: HashMap<String, String> = self.config.clone().into_iter().collect();
+        config.insert(
+            TASK_CONFIG_WORKLOAD_FILE.to_string(),
+            path.display().to_string(),
+        );
+        SmsTask {
+            task_id: self.task_id().to_string(),
+            name: self.name.clone(),
+            description: self.description.clone(),
+            version: self.version.clone(),
+            config,
+            executable: Some(TaskExecutable {
+                r#type: self.executable_type().unwrap_or(ExecutableType::Process) as i32,
+                uri: self.uri.clone(),
+                name: self.name.clone(),
+                checksum_sha256: self.checksum_sha256.clone(),
+                args: Vec::new(),
+                env: self.env.clone().into_iter().collect(),
+            }),
+            ..Default::default()
+        }
+    }
+}
+
+/// Workloads found in the workload directory / 在工作负载目录中找到的工作负载
+#[derive(Debug, Default)]
+pub struct WorkloadScan {
+    /// By task id / 按任务 ID 索引
+    pub workloads: BTreeMap<String, (PathBuf, WorkloadFile)>,
+    /// Files that could not be used; their workloads are left as they are
+    /// 无法使用的文件；其工作负载保持不变
+    pub failed: BTreeSet<PathBuf>,
+    pub errors: Vec<String>,
+}
+
+fn is_workload_file(path: &Path) -> bool {
+    path.is_file()
+        && path
+            .extension()
+            .and_then(|e| e.to_str())
+            .is_some_and(|e| e == "toml" || e == "json")
+}
+
+fn parse_workload(path: &Path) -> Result<WorkloadFile, String> {
+    let content = std::fs::read_to_string(path).map_err(|e| e.to_string())?;
+    let w: WorkloadFile = if path.extension().is_some_and(|e| e == "json") {
+        serde_json::from_str(&content).map_err(|e| e.to_string())?
+    } else {
+        toml::from_str(&content).map_err(|e| e.to_string())?
+    };
+    if w.name.trim().is_empty() {
+        return Err("name is required".to_string());
+    }
+    if w.executable_type().is_none() {
+        return Err(format!("unknown runtime {:?}", w.runtime));
+    }
+    Ok(w)
+}
+
+fn workload_files(dir: &Path) -> Vec<PathBuf> {
+    let mut files: Vec<PathBuf> = std::fs::read_dir(dir)
+        .map(|rd| {
+            rd.filter_map(|e| e.ok())
+                .map(|e| e.path())
+                .filter(|p| is_workload_file(p))
+                .collect()
+        })
+        .unwrap_or_default();
+    files.sort();
+    files
+}
+
+/// Read every `*.toml` and `*.json` workload file in `dir` / 读取 `dir` 中所有 `*.toml` 与 `*.json` 工作负载文件
+pub fn load_workloads(dir: &Path) -> WorkloadScan {
+    let mut scan = WorkloadScan::default();
+    if !dir.is_dir() {
+        scan.errors
+            .push(format!("workloads_dir: not a directory: {}", dir.display()));
+        return scan;
+    }
+    for path in workload_files(dir) {
+        match parse_workload(&path) {
+            Ok(w) => {
+                let id = w.task_id().to_string();
+                if let Some((first, _)) = scan.workloads.get(&id) {
+                    scan.errors.push(format!(
+                        "{}: task id {} already defined in {}",
+                        path.display(),
+                        id,
+                        first.display()
+                    ));
+                    scan.failed.insert(path);
+                    continue;
+                }
+                scan.workloads.insert(id, (path, w));
+            }
+            Err(e) => {
+                scan.errors.push(format!("{}: {}", path.display(), e));
+                scan.failed.insert(path);
+            }
+        }
+    }
+    scan
+}
+
+/// Changed settings as (applied live, needing a restart), by dotted path
+/// 按点分路径列出变更的设置：（即时生效，需要重启）
+pub fn split_changes(old: &SpearletConfig, new: &SpearletConfig) -> (Vec<String>, Vec<String>) {
+    let old_value = serde_json::to_value(old).unwrap_or_default();
+    let new_value = serde_json::to_value(new).unwrap_or_default();
+    let mut applied = Vec::new();
+    let mut restart = Vec::new();
+    collect_changes("", &old_value, &new_value, &mut applied, &mut restart);
+    // The rate limit middleware is only installed at startup / 限流中间件仅在启动时安装
+    if old.http.rate_limit.enabled != new.http.rate_limit.enabled {
+        applied.retain(|p| p != "http.rate_limit");
+        restart.push("http.rate_limit.enabled".to_string());
+    }
+    (applied, restart)
+}
+
+fn collect_changes(
+    prefix: &str,
+    old: &serde_json::Value,
+    new: &serde_json::Value,
+    applied: &mut Vec<String>,
+    restart: &mut Vec<String>,
+) {
+    let (Some(o), Some(n)) = (old.as_object(), new.as_object()) else {
+        return;
+    };
+    let keys: BTreeSet<&String> = o.keys().chain(n.keys()).collect();
+    for k in keys {
+        let (ov, nv) = (o.get(k), n.get(k));
+        if ov == nv {
+            continue;
+        }
+        let path = if prefix.is_empty() {
+            k.clone()
+        } else {
+            format!("{}.{}", prefix, k)
+        };
+        let below = format!("{}.", path);
+        if LIVE_SETTINGS.contains(&path.as_str()) {
+            applied.push(path);
+        } else if LIVE_SETTINGS.iter().any(|l| l.starts_with(&below)) {
+            let null = serde_json::Value::Null;
+            collect_changes(
+                &path,
+                ov.unwrap_or(&null),
+                nv.unwrap_or(&null),
+                applied,
+                restart,
+            );
+        } else {
+            restart.push(path);
+        }
+    }
+}
+
+fn merge_json(base: &mut serde_json::Value, overlay: &serde_json::Value) {
+    match (base, overlay) {
+        (serde_json::Value::Object(b), serde_json::Value::Object(o)) => {
+            for (k, v) in o {
+                merge_json(b.entry(k.clone()).or_insert(serde_json::Value::Null), v);
+            }
+        }
+        (b, o) => *b = o.clone(),
+    }
+}
+
+/// `config` with the tables of `overlay` merged in, key by key
+/// 将 `overlay` 的各表逐键合并进 `config`
+pub fn with_overlay(
+    config: SpearletConfig,
+    overlay: Option<&serde_json::Value>,
+) -> Result<SpearletConfig, String> {
+    let Some(overlay) = overlay else {
+        return Ok(config);
+    };
+    if !overlay.is_object() {
+        return Err("overlay must be a JSON object".to_string());
+    }
+    let unknown = config_check::unknown_keys(&serde_json::json!({ "spearlet": overlay }));
+    if !unknown.is_empty() {
+        return Err(format!(
+            "invalid overlay: unknown keys {}",
+            unknown.join(", ")
+        ));
+    }
+    let mut value = serde_json::to_value(&config).map_err(|e| e.to_string())?;
+    merge_json(&mut value, overlay);
+    serde_json::from_value(value).map_err(|e| format!("invalid overlay: {}", e))
+}
+
+/// Outcome of a reload / 一次重新加载的结果
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct ReloadReport {
+    /// Settings applied live / 即时生效的设置
+    pub applied: Vec<String>,
+    /// Changed settings that take effect after a restart / 重启后才生效的已变更设置
+    pub restart_required: Vec<String>,
+    pub workloads_added: Vec<String>,
+    pub workloads_updated: Vec<String>,
+    pub workloads_removed: Vec<String>,
+    pub errors: Vec<String>,
+}
+
+impl ReloadReport {
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+}
+
+/// Configuration reloaded on one spearlet, and the reloader applying it
+/// 单个 spearlet 上重新加载的配置及应用它的重载器
+pub struct LiveConfig {
+    config: watch::Sender<Option<Arc<SpearletConfig>>>,
+    llm: RwLock<Option<Arc<SpearletConfig>>>,
+    reloader: RwLock<Weak<Reloader>>,
+}
+
+impl Default for LiveConfig {
+    fn default() -> Self {
+        Self {
+            config: watch::channel(None).0,
+            llm: RwLock::new(None),
+            reloader: RwLock::new(Weak::new()),
+        }
+    }
+}
+
+impl LiveConfig {
+    /// Last reloaded configuration; `None` until something was applied live
+    /// 最近一次重新加载的配置；在有设置即时生效之前为 `None`
+    pub fn current(&self) -> Option<Arc<SpearletConfig>> {
+        self.config.borrow().clone()
+    }
+
+    /// Notified whenever settings are applied live / 每当有设置即时生效时收到通知
+    pub fn subscribe(&self) -> watch::Receiver<Option<Arc<SpearletConfig>>> {
+        self.config.subscribe()
+    }
+
+    /// Swap reloaded LLM settings into a runtime config built at startup
+    /// 将重新加载的 LLM 设置换入启动时构建的运行时配置
+    ///
+    /// Only once `llm` itself was reloaded, so backends imported at startup stay otherwise.
+    /// 仅在 `llm` 本身被重新加载后才替换，否则保留启动时导入的后端。
+    pub fn with_llm(&self, mut runtime_config: RuntimeConfig) -> RuntimeConfig {
+        let Some(live) = self.llm.read().clone() else {
+            return runtime_config;
+        };
+        if let Some(cfg) = runtime_config.spearlet_config.as_mut() {
+            cfg.llm = live.llm.clone();
+            runtime_config
+                .global_environment
+                .extend(collect_llm_global_environment(&live));
+        }
+        runtime_config
+    }
+
+    /// Reloader used by `POST /admin/reload`, once started / 启动后供 `POST /admin/reload` 使用的重载器
+    pub fn reloader(&self) -> Option<Arc<Reloader>> {
+        self.reloader.read().upgrade()
+    }
+}
+
+/// Loads the configuration the way the spearlet did at startup
+/// 以 spearlet 启动时的方式加载配置
+pub type ConfigLoader = Box<dyn Fn() -> Result<SpearletConfig, String> + Send + Sync>;
+
+type FileStamp = (PathBuf, Option<(SystemTime, u64)>);
+
+struct LoadedWorkload {
+    path: PathBuf,
+    spec: WorkloadFile,
+}
+
+struct ReloadState {
+    config: SpearletConfig,
+    /// Merged over every loaded configuration / 合并到每次加载的配置之上
+    overlay: Option<serde_json::Value>,
+    workloads: BTreeMap<String, LoadedWorkload>,
+    stamps: Vec<FileStamp>,
+}
+
+/// Applies configuration and workload changes / 应用配置与工作负载的变更
+pub struct Reloader {
+    loader: ConfigLoader,
+    config_file: Option<PathBuf>,
+    manager: Arc<TaskExecutionManager>,
+    state: Mutex<ReloadState>,
+}
+
+impl Reloader {
+    /// `config` is the configuration the spearlet is running with
+    /// `config` 为 spearlet 当前运行所用的配置
+    pub fn new(
+        loader: ConfigLoader,
+        config_file: Option<PathBuf>,
+        config: SpearletConfig,
+        manager: Arc<TaskExecutionManager>,
+    ) -> Self {
+        Self {
+            loader,
+            config_file,
+            manager,
+            state: Mutex::new(ReloadState {
+                config,
+                overlay: None,
+                workloads: BTreeMap::new(),
+                stamps: Vec::new(),
+            }),
+        }
+    }
+
+    /// Reload the configuration file and the workload directory / 重新加载配置文件与工作负载目录
+    pub async fn reload(&self) -> ReloadReport {
+        let mut state = self.state.lock().await;
+        let mut report = ReloadReport::default();
+        match (self.loader)().and_then(|c| with_overlay(c, state.overlay.as_ref())) {
+            Ok(new) => {
+                self.apply_config(&state.config, &new, &mut report);
+                state.config = new;
+            }
+            // Keep running with the last good configuration / 继续使用上一份有效配置
+            Err(e) => report.errors.push(format!("config: {}", e)),
+        }
+        let dir = state.config.reload.workloads_dir.clone();
+        self.reconcile_workloads(&dir, &mut state.workloads, &mut report)
+            .await;
+        state.stamps = self.stamps(&dir);
+        report
+    }
+
+    /// Run with `overlay` merged over the loaded configuration; only live settings may change
+    /// 将 `overlay` 合并到加载的配置之上运行；只允许变更即时生效的设置
+    pub async fn set_overlay(
+        &self,
+        overlay: Option<serde_json::Value>,
+    ) -> Result<ReloadReport, String> {
+        let base = (self.loader)()?;
+        let new = with_overlay(base.clone(), overlay.as_ref())?;
+        let (_, restart) = split_changes(&base, &new);
+        if !restart.is_empty() {
+            return Err(format!(
+                "overlay changes settings that need a restart: {}",
+                restart.join(", ")
+            ));
+        }
+        let mut state = self.state.lock().await;
+        let mut report = ReloadReport::default();
+        self.apply_config(&state.config, &new, &mut report);
+        state.config = new;
+        state.overlay = overlay;
+        Ok(report)
+    }
+
+    pub fn manager(&self) -> Arc<TaskExecutionManager> {
+        self.manager.clone()
+    }
+
+    fn apply_config(&self, old: &SpearletConfig, new: &SpearletConfig, report: &mut ReloadReport) {
+        let (applied, restart) = split_changes(old, new);
+        if !applied.is_empty() {
+            let new = Arc::new(new.clone());
+            let node = self.manager.node();
+            if applied.iter().any(|p| p == "llm") {
+                *node.live_config.llm.write() = Some(new.clone());
+                node.provider_health.set_config(new.llm.failover.clone());
+            }
+            if applied.iter().any(|p| p == "energy") {
+                node.energy.start(&new.energy);
+            }
+            if applied.iter().any(|p| p == "compute_hints") {
+                node.compute_hints.configure(&new.compute_hints);
+            }
+            if applied.iter().any(|p| p == "onnx") {
+                node.onnx.start(&new.onnx);
+            }
+            if applied.iter().any(|p| p == "model_store") {
+                node.model_store.start(&new);
+            }
+            for section in &applied {
+                node.apply_section(section, &new);
+            }
+            if applied.iter().any(|p| p == "message_passing") {
+                message_routing::start(node, &new, None);
+            }
+            self.manager
+                .set_max_concurrent_executions(new.execution.max_concurrent_executions);
+            node.live_config.config.send_replace(Some(new));
+        }
+        report.applied = applied;
+        report.restart_required = restart;
+    }
+
+    async fn reconcile_workloads(
+        &self,
+        dir: &str,
+        known: &mut BTreeMap<String, LoadedWorkload>,
+        report: &mut ReloadReport,
+    ) {
+        let scan = if dir.trim().is_empty() {
+            WorkloadScan::default()
+        } else {
+            load_workloads(Path::new(dir))
+        };
+        report.errors.extend(scan.errors);
+
+        let gone: Vec<String> = known
+            .iter()
+            .filter(|(id, w)| !scan.workloads.contains_key(*id) && !scan.failed.contains(&w.path))
+            .map(|(id, _)| id.clone())
+            .collect();
+        for id in gone {
+            known.remove(&id);
+            self.manager.remove_task(&id, "workload file removed").await;
+            report.workloads_removed.push(id);
+        }
+
+        for (id, (path, spec)) in scan.workloads {
+            let updated = match known.get(&id) {
+                Some(w) if w.spec == spec && w.path == path => continue,
+                Some(_) => {
+                    self.manager.remove_task(&id, "workload file changed").await;
+                    true
+                }
+                None => false,
+            };
+            let task = spec.to_sms_task(&path);
+            let registered = match self.manager.ensure_artifact_from_sms(&task).await {
+                Ok(artifact) => self.manager.ensure_task_from_sms(&task, &artifact).await,
+                Err(e) => Err(e),
+            };
+            if let Err(e) = registered {
+                report.errors.push(format!("{}: {}", path.display(), e));
+                known.remove(&id);
+                continue;
+            }
+            if updated {
+                report.workloads_updated.push(id.clone());
+            } else {
+                report.workloads_added.push(id.clone());
+            }
+            known.insert(id, LoadedWorkload { path, spec });
+        }
+    }
+
+    fn stamps(&self, dir: &str) -> Vec<FileStamp> {
+        let mut files: Vec<PathBuf> = self.config_file.iter().cloned().collect();
+        if !dir.trim().is_empty() {
+            files.extend(workload_files(Path::new(dir)));
+        }
+        files
+            .into_iter()
+            .map(|p| {
+                let stamp = std::fs::metadata(&p)
+                    .ok()
+                    .and_then(|m| Some((m.modified().ok()?, m.len())));
+                (p, stamp)
+            })
+            .collect()
+    }
+
+    /// Poll for file changes and reload when something changed / 轮询文件变化，有变化时重新加载
+    async fn watch(&self) {
+        loop {
+            let (enabled, interval, dir) = {
+                let state = self.state.lock().await;
+                let r = &state.config.reload;
+                (
+                    r.watch,
+                    r.poll_interval_ms.max(200),
+                    r.workloads_dir.clone(),
+                )
+            };
+            tokio::time::sleep(Duration::from_millis(interval)).await;
+            if !enabled {
+                continue;
+            }
+            let stamps = self.stamps(&dir);
+            if stamps == self.state.lock().await.stamps {
+                continue;
+            }
+            log_report(&self.reload().await);
+        }
+    }
+}
+
+fn log_report(report: &ReloadReport) {
+    if !report.is_empty() {
+        tracing::info!(
+            applied = ?report.applied,
+            restart_required = ?report.restart_required,
+            workloads_added = ?report.workloads_added,
+            workloads_updated = ?report.workloads_updated,
+            workloads_removed = ?report.workloads_removed,
+            "Configuration reloaded"
+        );
+    }
+    for e in &report.errors {
+        tracing::warn!("Reload: {}", e);
+    }
+}
+
+/// Load the workload directory, then watch for changes / 加载工作负载目录，然后监视变化
+pub async fn start(reloader: Reloader) -> Arc<Reloader> {
+    let reloader = Arc::new(reloader);
+    *reloader.manager.node().live_config.reloader.write() = Arc::downgrade(&reloader);
+    log_report(&reloader.reload().await);
+    let watcher = reloader.clone();
+    supervise("config-reload", RestartPolicy::default(), move || {
+        let reloader = watcher.clone();
+        async move { reloader.watch().await }
+    });
+    reloader
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::manager::TaskExecutionManagerConfig;
+    use crate::spearlet::execution::runtime::RuntimeManager;
+
+    #[test]
+    fn test_load_workloads() {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::write(
+            dir.path().join("echo.toml"),
+            r#"
+name = "echo"
+runtime = "wasm"
+uri = "file:///opt/echo.wasm"
+
+[config]
+"rate_limit.rps" = "5"
+"#,
+        )
+        .unwrap();
+        std::fs::write(
+            dir.path().join("zz-dup.json"),
+            r#"{"name": "other", "task_id": "echo"}"#,
+        )
+        .unwrap();
+        std::fs::write(
+            dir.path().join("bad.toml"),
+            "name = \"x\"\nruntime = \"docker\"\n",
+        )
+        .unwrap();
+        std::fs::write(dir.path().join("README.md"), "not a workload").unwrap();
+
+        let scan = load_workloads(dir.path());
+        assert_eq!(scan.workloads.len(), 1);
+        assert_eq!(scan.failed.len(), 2);
+        assert_eq!(scan.errors.len(), 2);
+        let (path, w) = &scan.workloads["echo"];
+        let task = w.to_sms_task(path);
+        assert_eq!(task.task_id, "echo");
+        assert_eq!(task.executable.unwrap().r#type, ExecutableType::Wasm as i32);
+        assert_eq!(task.config["rate_limit.rps"], "5");
+        assert!(task.config.contains_key(TASK_CONFIG_WORKLOAD_FILE));
+    }
+
+    #[test]
+    fn test_split_changes() {
+        let old = SpearletConfig::default();
+        let mut new = old.clone();
+        new.execution.max_concurrent_executions = 8;
+        new.execution.runtimes = vec!["wasm".to_string()];
+        new.energy.low_battery_percent = 30;
+        new.http.rate_limit.burst = 5;
+        new.grpc.addr = "127.0.0.1:6000".parse().unwrap();
+
+        let (applied, restart) = split_changes(&old, &new);
+        assert_eq!(
+            applied,
+            vec![
+                "energy",
+                "execution.max_concurrent_executions",
+                "http.rate_limit"
+            ]
+        );
+        assert_eq!(restart, vec!["execution.runtimes", "grpc"]);
+
+        new.http.rate_limit.enabled = true;
+        let (applied, restart) = split_changes(&old, &new);
+        assert!(!applied.contains(&"http.rate_limit".to_string()));
+        assert!(restart.contains(&"http.rate_limit.enabled".to_string()));
+    }
+
+    #[tokio::test]
+    async fn test_reload_reconciles_workloads() {
+        let dir = tempfile::tempdir().unwrap();
+        let mut cfg = SpearletConfig::default();
+        cfg.reload.workloads_dir = dir.path().display().to_string();
+        let manager = TaskExecutionManager::new(
+            TaskExecutionManagerConfig::default(),
+            Arc::new(RuntimeManager::new()),
+            Arc::new(cfg.clone()),
+            None,
+        )
+        .await
+        .unwrap();
+        let loaded = cfg.clone();
+        let reloader = Reloader::new(
+            Box::new(move || Ok(loaded.clone())),
+            None,
+            cfg,
+            manager.clone(),
+        );
+
+        let file = dir.path().join("echo.toml");
+        std::fs::write(&file, "name = \"echo\"\nuri = \"/bin/echo\"\n").unwrap();
+        let report = reloader.reload().await;
+        assert_eq!(report.workloads_added, vec!["echo"]);
+        assert!(report.applied.is_empty() && report.errors.is_empty());
+        assert!(manager.get_task_by_id("echo").is_some());
+
+        assert!(reloader.reload().await.is_empty());
+
+        std::fs::write(
+            &file,
+            "name = \"echo\"\nuri = \"/bin/echo\"\nversion = \"2\"\n",
+        )
+        .unwrap();
+        let report = reloader.reload().await;
+        assert_eq!(report.workloads_updated, vec!["echo"]);
+        assert_eq!(manager.get_task_by_id("echo").unwrap().spec.name, "echo");
+
+        std::fs::remove_file(&file).unwrap();
+        let report = reloader.reload().await;
+        assert_eq!(report.workloads_removed, vec!["echo"]);
+        assert!(manager.get_task_by_id("echo").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_set_overlay() {
+        let cfg = SpearletConfig::default();
+        let manager = TaskExecutionManager::new(
+            TaskExecutionManagerConfig::default(),
+            Arc::new(RuntimeManager::new()),
+            Arc::new(cfg.clone()),
+            None,
+        )
+        .await
+        .unwrap();
+        let loaded = cfg.clone();
+        let reloader = Reloader::new(Box::new(move || Ok(loaded.clone())), None, cfg, manager);
+
+        let overlay = serde_json::json!({"execution": {"max_concurrent_executions": 3}});
+        let report = reloader.set_overlay(Some(overlay)).await.unwrap();
+        assert_eq!(report.applied, vec!["execution.max_concurrent_executions"]);
+        // The overlay survives a reload of the file / 重新加载文件后覆盖仍然生效
+        assert!(reloader.reload().await.is_empty());
+
+        let err = reloader
+            .set_overlay(Some(
+                serde_json::json!({"grpc": {"addr": "127.0.0.1:6000"}}),
+            ))
+            .await
+            .unwrap_err();
+        assert!(err.contains("grpc"), "{}", err);
+        let err = reloader
+            .set_overlay(Some(serde_json::json!({"no_such_key": 1})))
+            .await
+            .unwrap_err();
+        assert!(err.contains("no_such_key"), "{}", err);
+
+        let report = reloader.set_overlay(None).await.unwrap();
+        assert_eq!(report.applied, vec!["execution.max_concurrent_executions"]);
+    }
+}
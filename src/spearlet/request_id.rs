@@ -0,0 +1,107 @@
+//! Correlation IDs for invocations / 调用的关联 ID
+//!
+//! Every HTTP request and every invocation started over WebSocket gets a request ID.
+//! A caller may supply one in `X-Request-Id`, otherwise the spearlet generates it.
+//! The ID is echoed in the response, rides in `InvokeRequest.metadata["request_id"]`
+//! into the WASM worker, and is a field of the tracing span around the request and
+//! the execution, so every log line written on the way, hostcalls included, carries it.
+//! 每个 HTTP 请求以及每个经 WebSocket 启动的调用都会获得一个请求 ID。调用方可在
+//! `X-Request-Id` 中提供，否则由 spearlet 生成。该 ID 会在响应中回显，经
+//! `InvokeRequest.metadata["request_id"]` 到达 WASM worker，并作为请求与执行所在
+//! tracing span 的字段，因此沿途写出的每行日志（包括 hostcall）都带有它。
+
+use std::collections::HashMap;
+
+use axum::http::HeaderValue;
+use tracing::Instrument;
+
+/// Header carrying the ID / 携带 ID 的请求头
+pub const HEADER: &str = "x-request-id";
+/// Invocation metadata key / 调用元数据键
+pub const METADATA_KEY: &str = "request_id";
+const MAX_LEN: usize = 128;
+
+/// A fresh ID / 新的 ID
+pub fn generate() -> String {
+    uuid::Uuid::new_v4().simple().to_string()
+}
+
+/// Accept a caller's ID if it is short and printable; anything else is replaced so
+/// IDs can be logged and echoed safely
+/// 调用方的 ID 足够短且可打印时才接受；否则替换，以便安全地记录与回显
+pub fn accept(id: &str) -> Option<&str> {
+    let id = id.trim();
+    let ok = !id.is_empty()
+        && id.len() <= MAX_LEN
+        && id
+            .bytes()
+            .all(|b| b.is_ascii_alphanumeric() || matches!(b, b'-' | b'_' | b'.' | b':'));
+    ok.then_some(id)
+}
+
+/// The ID in invocation metadata, inserting a new one if missing or unusable
+/// 调用元数据中的 ID；缺失或不可用时插入新的 ID
+pub fn ensure(metadata: &mut HashMap<String, String>) -> String {
+    let id = metadata
+        .get(METADATA_KEY)
+        .and_then(|v| accept(v))
+        .map(str::to_string)
+        .unwrap_or_else(generate);
+    metadata.insert(METADATA_KEY.to_string(), id.clone());
+    id
+}
+
+/// Assign the request an ID and log everything it causes under it
+/// 为请求分配 ID，并将其引发的所有日志归于该 ID 之下
+pub async fn middleware(
+    mut req: axum::extract::Request,
+    next: axum::middleware::Next,
+) -> axum::response::Response {
+    let id = req
+        .headers()
+        .get(HEADER)
+        .and_then(|v| v.to_str().ok())
+        .and_then(accept)
+        .map(str::to_string)
+        .unwrap_or_else(generate);
+    let value = HeaderValue::from_str(&id).expect("request id is a valid header value");
+    // Handlers forward the header into invocation metadata / 处理函数将该请求头转入调用元数据
+    req.headers_mut().insert(HEADER, value.clone());
+    let span = tracing::info_span!(
+        "http",
+        request_id = %id,
+        method = %req.method(),
+        path = %req.uri().path(),
+    );
+    let mut resp = next.run(req).instrument(span).await;
+    resp.headers_mut().insert(HEADER, value);
+    resp
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_accepts_only_safe_ids() {
+        assert_eq!(accept(" abc-123:x.y_z "), Some("abc-123:x.y_z"));
+        assert_eq!(accept(""), None);
+        assert_eq!(accept("a b"), None);
+        assert_eq!(accept("line\nbreak"), None);
+        assert_eq!(accept(&"x".repeat(MAX_LEN + 1)), None);
+        assert_eq!(generate().len(), 32);
+    }
+
+    #[test]
+    fn test_ensure_keeps_or_replaces() {
+        let mut m = HashMap::new();
+        let id = ensure(&mut m);
+        assert_eq!(m.get(METADATA_KEY), Some(&id));
+
+        m.insert(METADATA_KEY.to_string(), "client-7".to_string());
+        assert_eq!(ensure(&mut m), "client-7");
+
+        m.insert(METADATA_KEY.to_string(), "bad id".to_string());
+        assert_ne!(ensure(&mut m), "bad id");
+    }
+}
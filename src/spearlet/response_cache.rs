@@ -0,0 +1,421 @@
+//! Cache of deterministic hostcall results / 确定性 hostcall 结果的缓存
+//!
+//! Edge workloads often ask for the same embeddings or the same spoken prompt again and
+//! again, and each time a backend is paid and waited for. Results of the operations listed
+//! in `response_cache.operations` are kept under a key hashed from the operation, the
+//! routing hints and the normalized request (model and input included), so an identical
+//! request is answered without calling a backend. Entries live in memory and are evicted
+//! least recently used first; with `disk` they are also written below `dir`, where they
+//! outlive restarts and are trimmed oldest first. Only successful results are stored.
+//! 边缘工作负载经常反复请求相同的嵌入向量或相同的语音提示，每次都要为后端付费并等待。
+//! `response_cache.operations` 中列出的操作的结果以操作、路由提示与规范化请求（含模型与输入）
+//! 计算出的键保存，相同的请求无需调用后端即可得到应答。条目保存在内存中，按最近最少使用淘汰；
+//! 设置 `disk` 时还写入 `dir` 下，可跨重启保留，并按写入先后裁剪。只保存成功的结果。
+
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, Instant, SystemTime};
+
+use parking_lot::{Mutex, RwLock};
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::config::{ResponseCacheConfig, SpearletConfig};
+use crate::spearlet::execution::ai::ir::CanonicalRequestEnvelope;
+
+/// Operations whose results may be cached / 结果可以缓存的操作
+pub const OPERATIONS: &[&str] = &["embeddings", "text_to_speech"];
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct CacheStats {
+    pub enabled: bool,
+    pub operations: Vec<String>,
+    pub entries: usize,
+    pub bytes: u64,
+    pub hits: u64,
+    /// Hits answered from disk / 由磁盘应答的命中
+    pub disk_hits: u64,
+    pub misses: u64,
+    pub evictions: u64,
+    /// Directory of disk entries, when `disk` is set / 磁盘条目所在目录（设置 `disk` 时）
+    pub dir: Option<String>,
+}
+
+/// Directory of disk entries for a configuration / 配置对应的磁盘条目目录
+pub fn cache_dir(config: &SpearletConfig) -> PathBuf {
+    if config.response_cache.dir.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("response-cache")
+    } else {
+        PathBuf::from(&config.response_cache.dir)
+    }
+}
+
+/// Key of a request: `<operation>/<sha256 of the parts>` / 请求的键：`<operation>/<各部分的 sha256>`
+pub fn key(operation: &str, parts: &[&[u8]]) -> String {
+    let mut h = Sha256::new();
+    h.update(operation.as_bytes());
+    for p in parts {
+        // Length first, so parts cannot run into each other / 先写长度，避免各部分相互混淆
+        h.update((p.len() as u64).to_be_bytes());
+        h.update(p);
+    }
+    let hex: String = h.finalize().iter().map(|b| format!("{:02x}", b)).collect();
+    format!("{}/{}", operation, hex)
+}
+
+/// Operation name of a canonical request, e.g. `text_to_speech` / 规范请求的操作名，例如 `text_to_speech`
+pub fn operation_name(req: &CanonicalRequestEnvelope) -> String {
+    serde_json::to_value(&req.operation)
+        .ok()
+        .and_then(|v| v.as_str().map(str::to_string))
+        .unwrap_or_default()
+}
+
+/// Key of a canonical request from its routing hints, metadata and payload; the request id
+/// and timeout do not change the result and are left out
+/// 由路由提示、元数据与负载计算规范请求的键；请求 ID 与超时不影响结果，因此不计入
+pub fn request_key(req: &CanonicalRequestEnvelope) -> String {
+    let meta: BTreeMap<&String, &String> = req.meta.iter().collect();
+    let routing = serde_json::to_vec(&req.routing).unwrap_or_default();
+    let meta = serde_json::to_vec(&meta).unwrap_or_default();
+    let payload = serde_json::to_vec(&req.payload).unwrap_or_default();
+    key(&operation_name(req), &[&routing, &meta, &payload])
+}
+
+struct Entry {
+    value: Vec<u8>,
+    stored: Instant,
+    tick: u64,
+}
+
+#[derive(Default)]
+struct Lru {
+    entries: HashMap<String, Entry>,
+    /// Keys by last use / 按最后使用时间排列的键
+    order: BTreeMap<u64, String>,
+    tick: u64,
+    bytes: u64,
+}
+
+impl Lru {
+    fn touch(&mut self, key: &str) {
+        self.tick += 1;
+        let tick = self.tick;
+        if let Some(e) = self.entries.get_mut(key) {
+            self.order.remove(&e.tick);
+            e.tick = tick;
+            self.order.insert(tick, key.to_string());
+        }
+    }
+
+    fn remove(&mut self, key: &str) {
+        if let Some(e) = self.entries.remove(key) {
+            self.order.remove(&e.tick);
+            self.bytes -= e.value.len() as u64;
+        }
+    }
+
+    fn insert(&mut self, key: &str, value: Vec<u8>) {
+        self.remove(key);
+        self.tick += 1;
+        self.bytes += value.len() as u64;
+        self.order.insert(self.tick, key.to_string());
+        self.entries.insert(
+            key.to_string(),
+            Entry {
+                value,
+                stored: Instant::now(),
+                tick: self.tick,
+            },
+        );
+    }
+
+    /// Evict the least recently used entries until both limits hold; returns how many
+    /// 淘汰最近最少使用的条目，直到满足两项限制；返回淘汰数量
+    fn evict(&mut self, max_entries: usize, max_bytes: u64) -> u64 {
+        let mut evicted = 0;
+        while self.entries.len() > max_entries || (max_bytes > 0 && self.bytes > max_bytes) {
+            let Some((_, key)) = self.order.pop_first() else {
+                break;
+            };
+            if let Some(e) = self.entries.remove(&key) {
+                self.bytes -= e.value.len() as u64;
+            }
+            evicted += 1;
+        }
+        evicted
+    }
+}
+
+/// Files below `dir` with their size and modification time / `dir` 下的文件及其大小与修改时间
+fn disk_files(dir: &Path, out: &mut Vec<(PathBuf, u64, SystemTime)>) {
+    let Ok(entries) = std::fs::read_dir(dir) else {
+        return;
+    };
+    for e in entries.flatten() {
+        let Ok(meta) = e.metadata() else {
+            continue;
+        };
+        if meta.is_dir() {
+            disk_files(&e.path(), out);
+        } else {
+            let modified = meta.modified().unwrap_or(SystemTime::UNIX_EPOCH);
+            out.push((e.path(), meta.len(), modified));
+        }
+    }
+}
+
+pub struct ResponseCache {
+    config: RwLock<(ResponseCacheConfig, PathBuf)>,
+    lru: Mutex<Lru>,
+    hits: AtomicU64,
+    disk_hits: AtomicU64,
+    misses: AtomicU64,
+    evictions: AtomicU64,
+}
+
+impl ResponseCache {
+    pub fn new(config: ResponseCacheConfig, dir: PathBuf) -> Self {
+        Self {
+            config: RwLock::new((config, dir)),
+            lru: Mutex::new(Lru::default()),
+            hits: AtomicU64::new(0),
+            disk_hits: AtomicU64::new(0),
+            misses: AtomicU64::new(0),
+            evictions: AtomicU64::new(0),
+        }
+    }
+
+    /// Apply a new configuration; disabling drops the memory entries, disk entries stay
+    /// 应用新配置；关闭时丢弃内存条目，磁盘条目保留
+    pub fn set_config(&self, config: ResponseCacheConfig, dir: PathBuf) {
+        {
+            let mut lru = self.lru.lock();
+            if config.enabled {
+                let evicted = lru.evict(config.max_entries, config.max_memory_bytes);
+                self.evictions.fetch_add(evicted, Ordering::Relaxed);
+            } else {
+                *lru = Lru::default();
+            }
+        }
+        *self.config.write() = (config, dir);
+    }
+
+    /// Whether results of `operation` are cached / `operation` 的结果是否被缓存
+    pub fn caches(&self, operation: &str) -> bool {
+        let cfg = &self.config.read().0;
+        cfg.enabled && cfg.operations.iter().any(|o| o == operation)
+    }
+
+    fn path(dir: &Path, key: &str) -> PathBuf {
+        dir.join(key)
+    }
+
+    /// The cached result for `key`, if any / `key` 对应的缓存结果（如有）
+    pub fn get(&self, key: &str) -> Option<Vec<u8>> {
+        let (cfg, dir) = self.config.read().clone();
+        if !cfg.enabled {
+            return None;
+        }
+        let ttl = (cfg.ttl_secs > 0).then(|| Duration::from_secs(cfg.ttl_secs));
+        {
+            let mut lru = self.lru.lock();
+            let expired = match lru.entries.get(key) {
+                Some(e) => ttl.map_or(false, |t| e.stored.elapsed() >= t),
+                None => true,
+            };
+            if !expired {
+                lru.touch(key);
+                self.hits.fetch_add(1, Ordering::Relaxed);
+                return lru.entries.get(key).map(|e| e.value.clone());
+            }
+            lru.remove(key);
+        }
+        if cfg.disk {
+            let path = Self::path(&dir, key);
+            let fresh = std::fs::metadata(&path)
+                .and_then(|m| m.modified())
+                .map(|t| ttl.map_or(true, |ttl| t.elapsed().map_or(true, |age| age < ttl)));
+            match fresh {
+                Ok(true) => {
+                    if let Ok(value) = std::fs::read(&path) {
+                        let mut lru = self.lru.lock();
+                        lru.insert(key, value.clone());
+                        let evicted = lru.evict(cfg.max_entries, cfg.max_memory_bytes);
+                        self.evictions.fetch_add(evicted, Ordering::Relaxed);
+                        self.hits.fetch_add(1, Ordering::Relaxed);
+                        self.disk_hits.fetch_add(1, Ordering::Relaxed);
+                        return Some(value);
+                    }
+                }
+                Ok(false) => {
+                    let _ = std::fs::remove_file(&path);
+                }
+                Err(_) => {}
+            }
+        }
+        self.misses.fetch_add(1, Ordering::Relaxed);
+        None
+    }
+
+    /// Store a successful result for `key` / 以 `key` 保存成功的结果
+    pub fn put(&self, key: &str, value: &[u8]) {
+        let (cfg, dir) = self.config.read().clone();
+        if !cfg.enabled || (cfg.max_entry_bytes > 0 && value.len() as u64 > cfg.max_entry_bytes) {
+            return;
+        }
+        {
+            let mut lru = self.lru.lock();
+            lru.insert(key, value.to_vec());
+            let evicted = lru.evict(cfg.max_entries, cfg.max_memory_bytes);
+            self.evictions.fetch_add(evicted, Ordering::Relaxed);
+        }
+        if cfg.disk {
+            if let Err(e) = self.write_disk(&dir, key, value, cfg.max_disk_bytes) {
+                tracing::warn!(key = %key, error = %e, "Failed to write response cache entry");
+            }
+        }
+    }
+
+    fn write_disk(&self, dir: &Path, key: &str, value: &[u8], max: u64) -> std::io::Result<()> {
+        let path = Self::path(dir, key);
+        if let Some(parent) = path.parent() {
+            std::fs::create_dir_all(parent)?;
+        }
+        // Readers never see half an entry / 读取方不会看到写了一半的条目
+        let tmp = path.with_extension("tmp");
+        std::fs::write(&tmp, value)?;
+        std::fs::rename(&tmp, &path)?;
+        if max > 0 {
+            self.trim_disk(dir, max, &path);
+        }
+        Ok(())
+    }
+
+    /// Remove the oldest disk entries other than `keep` while more than `max` bytes are stored
+    /// 磁盘条目超过 `max` 字节时删除除 `keep` 以外最早写入的条目
+    fn trim_disk(&self, dir: &Path, max: u64, keep: &Path) {
+        let mut files = Vec::new();
+        disk_files(dir, &mut files);
+        let mut total: u64 = files.iter().map(|f| f.1).sum();
+        if total <= max {
+            return;
+        }
+        files.sort_by_key(|f| f.2);
+        for (path, len, _) in files {
+            if total <= max {
+                break;
+            }
+            if path != keep && std::fs::remove_file(&path).is_ok() {
+                total -= len;
+                self.evictions.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+    }
+
+    pub fn stats(&self) -> CacheStats {
+        let (cfg, dir) = self.config.read().clone();
+        let lru = self.lru.lock();
+        CacheStats {
+            enabled: cfg.enabled,
+            operations: cfg.operations.clone(),
+            entries: lru.entries.len(),
+            bytes: lru.bytes,
+            hits: self.hits.load(Ordering::Relaxed),
+            disk_hits: self.disk_hits.load(Ordering::Relaxed),
+            misses: self.misses.load(Ordering::Relaxed),
+            evictions: self.evictions.load(Ordering::Relaxed),
+            dir: cfg.disk.then(|| dir.display().to_string()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn cache(dir: &Path, cfg: ResponseCacheConfig) -> ResponseCache {
+        ResponseCache::new(
+            ResponseCacheConfig {
+                enabled: true,
+                ..cfg
+            },
+            dir.join("response-cache"),
+        )
+    }
+
+    #[test]
+    fn test_key_covers_every_part() {
+        let a = key("embeddings", &[b"model-a", b"hello"]);
+        assert!(a.starts_with("embeddings/"));
+        assert_eq!(a, key("embeddings", &[b"model-a", b"hello"]));
+        assert_ne!(a, key("embeddings", &[b"model-b", b"hello"]));
+        assert_ne!(a, key("embeddings", &[b"model-ah", b"ello"]));
+        assert_ne!(a, key("text_to_speech", &[b"model-a", b"hello"]));
+    }
+
+    #[test]
+    fn test_request_key_ignores_request_id() {
+        use crate::spearlet::execution::ai::normalize::tts::normalize_tts_session;
+        use std::collections::HashMap;
+
+        let params = HashMap::new();
+        let a = normalize_tts_session(3, "hello", &params);
+        let b = normalize_tts_session(9, "hello", &params);
+        let c = normalize_tts_session(3, "hello!", &params);
+        assert_eq!(operation_name(&a), "text_to_speech");
+        assert_eq!(request_key(&a), request_key(&b));
+        assert_ne!(request_key(&a), request_key(&c));
+    }
+
+    #[test]
+    fn test_least_recently_used_is_evicted() {
+        let dir = tempfile::tempdir().unwrap();
+        let c = cache(
+            dir.path(),
+            ResponseCacheConfig {
+                max_entries: 2,
+                max_entry_bytes: 4,
+                ..Default::default()
+            },
+        );
+        c.put("embeddings/a", b"aa");
+        c.put("embeddings/b", b"bb");
+        assert_eq!(c.get("embeddings/a"), Some(b"aa".to_vec()));
+        c.put("embeddings/c", b"cc");
+        assert_eq!(c.get("embeddings/b"), None);
+        assert!(c.get("embeddings/c").is_some());
+        c.put("embeddings/d", b"too large");
+        assert_eq!(c.get("embeddings/d"), None);
+
+        let s = c.stats();
+        assert_eq!((s.entries, s.bytes), (2, 4));
+        assert_eq!((s.hits, s.misses, s.evictions), (2, 2, 1));
+        assert!(s.dir.is_none());
+    }
+
+    #[test]
+    fn test_disk_entries_outlive_memory() {
+        let dir = tempfile::tempdir().unwrap();
+        let cfg = ResponseCacheConfig {
+            disk: true,
+            max_disk_bytes: 6,
+            ..Default::default()
+        };
+        let c = cache(dir.path(), cfg.clone());
+        c.put("text_to_speech/a", b"aaaa");
+        c.put("text_to_speech/b", b"bbbb");
+
+        // A new process finds what fits the disk budget / 新进程可找到磁盘预算内的条目
+        let c = cache(dir.path(), cfg);
+        assert_eq!(c.get("text_to_speech/b"), Some(b"bbbb".to_vec()));
+        assert_eq!(c.get("text_to_speech/a"), None);
+        assert_eq!(c.stats().disk_hits, 1);
+
+        c.set_config(ResponseCacheConfig::default(), dir.path().join("x"));
+        assert!(!c.caches("embeddings"));
+        assert_eq!(c.get("text_to_speech/b"), None);
+        assert_eq!(c.stats().entries, 0);
+    }
+}
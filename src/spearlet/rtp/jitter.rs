@@ -0,0 +1,183 @@
+//! Jitter buffer for inbound RTP / 入站 RTP 的抖动缓冲
+//!
+//! Packets are released in sequence order. A missing packet is waited for until
+//! `depth` later packets have arrived, then reported as lost so the reader can fill
+//! the gap. Packets older than the playout point are dropped as late.
+//! 数据包按序号顺序释放。缺失的数据包会等待到其后已到达 `depth` 个数据包为止，随后报告为
+//! 丢失，以便读取方填补空缺。早于播放点的数据包作为迟到包丢弃。
+
+use std::collections::BTreeMap;
+
+use serde::Serialize;
+
+/// A sequence jump larger than this restarts the buffer, e.g. after a source switch
+/// 序号跳变超过该值时重置缓冲，例如音源切换之后
+const MAX_SEQ_JUMP: u16 = 1000;
+
+/// Next unit of playout / 下一个播放单元
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Playout {
+    Packet {
+        seq: u16,
+        timestamp: u32,
+        payload: Vec<u8>,
+    },
+    /// The packet never arrived in time / 数据包未能及时到达
+    Lost { seq: u16 },
+}
+
+/// Counters reported when a session ends / 会话结束时报告的计数
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize)]
+pub struct JitterStats {
+    pub received: u64,
+    pub lost: u64,
+    /// Late or duplicate packets / 迟到或重复的数据包
+    pub late: u64,
+    pub resets: u64,
+}
+
+#[derive(Debug)]
+pub struct JitterBuffer {
+    depth: usize,
+    /// Extended sequence number of the next packet to play / 下一个待播放数据包的扩展序号
+    next: Option<u64>,
+    pending: BTreeMap<u64, (u32, Vec<u8>)>,
+    stats: JitterStats,
+}
+
+impl JitterBuffer {
+    pub fn new(depth: usize) -> Self {
+        Self {
+            depth: depth.max(1),
+            next: None,
+            pending: BTreeMap::new(),
+            stats: JitterStats::default(),
+        }
+    }
+
+    pub fn stats(&self) -> JitterStats {
+        self.stats
+    }
+
+    pub fn push(&mut self, seq: u16, timestamp: u32, payload: Vec<u8>) {
+        self.stats.received += 1;
+        let next = *self.next.get_or_insert(seq as u64);
+        let offset = seq.wrapping_sub(next as u16);
+        let ext = if offset <= MAX_SEQ_JUMP {
+            next + offset as u64
+        } else if offset > u16::MAX - MAX_SEQ_JUMP {
+            // Behind the playout point / 落后于播放点
+            self.stats.late += 1;
+            return;
+        } else {
+            self.stats.resets += 1;
+            self.pending.clear();
+            self.next = Some(seq as u64);
+            seq as u64
+        };
+        if self.pending.insert(ext, (timestamp, payload)).is_some() {
+            self.stats.late += 1;
+        }
+    }
+
+    /// Next packet or loss that is ready to play / 下一个可播放的数据包或丢失
+    pub fn pop(&mut self) -> Option<Playout> {
+        let next = self.next?;
+        if let Some((timestamp, payload)) = self.pending.remove(&next) {
+            self.next = Some(next + 1);
+            return Some(Playout::Packet {
+                seq: next as u16,
+                timestamp,
+                payload,
+            });
+        }
+        if self.pending.len() >= self.depth {
+            self.next = Some(next + 1);
+            self.stats.lost += 1;
+            return Some(Playout::Lost { seq: next as u16 });
+        }
+        None
+    }
+
+    /// Release everything still held, reporting gaps as losses / 释放仍持有的全部数据包，空缺报告为丢失
+    pub fn drain(&mut self) -> Vec<Playout> {
+        let mut out = Vec::new();
+        while let Some(next) = self.next.filter(|_| !self.pending.is_empty()) {
+            match self.pending.remove(&next) {
+                Some((timestamp, payload)) => out.push(Playout::Packet {
+                    seq: next as u16,
+                    timestamp,
+                    payload,
+                }),
+                None => {
+                    self.stats.lost += 1;
+                    out.push(Playout::Lost { seq: next as u16 });
+                }
+            }
+            self.next = Some(next + 1);
+        }
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn seqs(out: &[Playout]) -> Vec<(u16, bool)> {
+        out.iter()
+            .map(|p| match p {
+                Playout::Packet { seq, .. } => (*seq, true),
+                Playout::Lost { seq } => (*seq, false),
+            })
+            .collect()
+    }
+
+    fn pop_all(jb: &mut JitterBuffer) -> Vec<Playout> {
+        std::iter::from_fn(|| jb.pop()).collect()
+    }
+
+    #[test]
+    fn test_reorders_across_wraparound() {
+        let mut jb = JitterBuffer::new(3);
+        let mut out = Vec::new();
+        for seq in [65534u16, 0, 65535, 1] {
+            jb.push(seq, seq as u32, vec![]);
+            out.extend(pop_all(&mut jb));
+        }
+        assert_eq!(
+            seqs(&out),
+            vec![(65534, true), (65535, true), (0, true), (1, true)]
+        );
+        jb.push(65535, 0, vec![]);
+        assert_eq!(jb.stats().late, 1);
+        assert!(jb.pop().is_none());
+    }
+
+    #[test]
+    fn test_gap_is_lost_after_depth_packets() {
+        let mut jb = JitterBuffer::new(2);
+        jb.push(10, 0, vec![]);
+        assert_eq!(seqs(&pop_all(&mut jb)), vec![(10, true)]);
+        jb.push(12, 0, vec![]);
+        assert!(jb.pop().is_none());
+        jb.push(13, 0, vec![]);
+        assert_eq!(
+            seqs(&pop_all(&mut jb)),
+            vec![(11, false), (12, true), (13, true)]
+        );
+        jb.push(15, 0, vec![]);
+        assert_eq!(seqs(&jb.drain()), vec![(14, false), (15, true)]);
+        assert_eq!(jb.stats().lost, 2);
+    }
+
+    #[test]
+    fn test_large_jump_resets() {
+        let mut jb = JitterBuffer::new(2);
+        jb.push(100, 0, vec![]);
+        pop_all(&mut jb);
+        jb.push(30000, 0, vec![]);
+        assert_eq!(seqs(&pop_all(&mut jb)), vec![(30000, true)]);
+        assert_eq!(jb.stats().resets, 1);
+    }
+}
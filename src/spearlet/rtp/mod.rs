@@ -0,0 +1,10 @@
+//! RTP building blocks shared by the media paths / 各媒体路径共用的 RTP 组件
+//!
+//! Packet parsing and the G.711 / L16 payloads are used by the RTSP camera client and
+//! the telephony bridge; the jitter buffer reorders the audio of WebRTC sessions, see
+//! [`crate::spearlet::webrtc_ingest`].
+//! 数据包解析与 G.711 / L16 负载供 RTSP 摄像头客户端与电话桥接使用；抖动缓冲为 WebRTC
+//! 会话的音频重排，见 [`crate::spearlet::webrtc_ingest`]。
+
+pub mod jitter;
+pub mod packet;
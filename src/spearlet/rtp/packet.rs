@@ -0,0 +1,255 @@
+//! RTP packets (RFC 3550) and the G.711 / L16 audio payloads
+//! RTP 数据包（RFC 3550）与 G.711 / L16 音频负载
+
+use serde::{Deserialize, Serialize};
+
+const RTP_VERSION: u8 = 2;
+const RTP_HEADER_LEN: usize = 12;
+
+/// Audio codec of an RTP session / RTP 会话的音频编解码
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum AudioCodec {
+    /// G.711 μ-law, 8 kHz / G.711 μ 律，8 kHz
+    Pcmu,
+    /// G.711 A-law, 8 kHz / G.711 A 律，8 kHz
+    Pcma,
+    /// 16-bit linear PCM, big endian / 16 位线性 PCM，大端
+    L16,
+}
+
+impl AudioCodec {
+    pub fn parse(s: &str) -> Option<Self> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "pcmu" | "g711u" | "ulaw" => Some(Self::Pcmu),
+            "pcma" | "g711a" | "alaw" => Some(Self::Pcma),
+            "l16" => Some(Self::L16),
+            _ => None,
+        }
+    }
+
+    /// Name used in SDP `rtpmap` / SDP `rtpmap` 中使用的名称
+    pub fn rtpmap_name(self) -> &'static str {
+        match self {
+            Self::Pcmu => "PCMU",
+            Self::Pcma => "PCMA",
+            Self::L16 => "L16",
+        }
+    }
+
+    /// Static payload type for G.711, a dynamic one for L16 / G.711 使用静态负载类型，L16 使用动态类型
+    pub fn payload_type(self) -> u8 {
+        match self {
+            Self::Pcmu => 0,
+            Self::Pcma => 8,
+            Self::L16 => 96,
+        }
+    }
+
+    pub fn default_sample_rate(self) -> u32 {
+        match self {
+            Self::Pcmu | Self::Pcma => 8000,
+            Self::L16 => 16000,
+        }
+    }
+
+    /// Decode a payload to PCM samples / 将负载解码为 PCM 采样
+    pub fn decode(self, payload: &[u8]) -> Vec<i16> {
+        match self {
+            Self::Pcmu => payload.iter().map(|&b| ulaw_to_linear(b)).collect(),
+            Self::Pcma => payload.iter().map(|&b| alaw_to_linear(b)).collect(),
+            Self::L16 => payload
+                .chunks_exact(2)
+                .map(|c| i16::from_be_bytes([c[0], c[1]]))
+                .collect(),
+        }
+    }
+
+    /// Encode PCM samples to a payload / 将 PCM 采样编码为负载
+    pub fn encode(self, samples: &[i16]) -> Vec<u8> {
+        match self {
+            Self::Pcmu => samples.iter().map(|&s| linear_to_ulaw(s)).collect(),
+            Self::Pcma => samples.iter().map(|&s| linear_to_alaw(s)).collect(),
+            Self::L16 => samples.iter().flat_map(|s| s.to_be_bytes()).collect(),
+        }
+    }
+}
+
+/// One RTP packet / 一个 RTP 数据包
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RtpPacket<'a> {
+    pub marker: bool,
+    pub payload_type: u8,
+    pub seq: u16,
+    pub timestamp: u32,
+    pub ssrc: u32,
+    pub payload: &'a [u8],
+}
+
+impl<'a> RtpPacket<'a> {
+    /// Parse a datagram; `None` for anything that is not RTP v2
+    /// 解析数据报；非 RTP v2 时返回 `None`
+    ///
+    /// CSRC lists, header extensions and padding are skipped.
+    /// 跳过 CSRC 列表、头部扩展与填充。
+    pub fn parse(buf: &'a [u8]) -> Option<Self> {
+        if buf.len() < RTP_HEADER_LEN || buf[0] >> 6 != RTP_VERSION {
+            return None;
+        }
+        let padding = buf[0] & 0x20 != 0;
+        let extension = buf[0] & 0x10 != 0;
+        let csrc_count = (buf[0] & 0x0f) as usize;
+        let mut start = RTP_HEADER_LEN + 4 * csrc_count;
+        if extension {
+            let words = buf.get(start + 2..start + 4)?;
+            start += 4 + 4 * u16::from_be_bytes([words[0], words[1]]) as usize;
+        }
+        let mut end = buf.len();
+        if padding {
+            end = end.checked_sub(*buf.last()? as usize)?;
+        }
+        if start > end {
+            return None;
+        }
+        Some(Self {
+            marker: buf[1] & 0x80 != 0,
+            payload_type: buf[1] & 0x7f,
+            seq: u16::from_be_bytes([buf[2], buf[3]]),
+            timestamp: u32::from_be_bytes([buf[4], buf[5], buf[6], buf[7]]),
+            ssrc: u32::from_be_bytes([buf[8], buf[9], buf[10], buf[11]]),
+            payload: &buf[start..end],
+        })
+    }
+
+    /// Serialize with a plain 12-byte header / 以 12 字节基本头部序列化
+    pub fn to_bytes(&self) -> Vec<u8> {
+        let mut out = Vec::with_capacity(RTP_HEADER_LEN + self.payload.len());
+        out.push(RTP_VERSION << 6);
+        out.push((self.marker as u8) << 7 | (self.payload_type & 0x7f));
+        out.extend_from_slice(&self.seq.to_be_bytes());
+        out.extend_from_slice(&self.timestamp.to_be_bytes());
+        out.extend_from_slice(&self.ssrc.to_be_bytes());
+        out.extend_from_slice(self.payload);
+        out
+    }
+}
+
+fn ulaw_to_linear(u: u8) -> i16 {
+    let u = !u;
+    let t = ((((u & 0x0f) as i16) << 3) + 0x84) << ((u & 0x70) >> 4);
+    if u & 0x80 != 0 {
+        0x84 - t
+    } else {
+        t - 0x84
+    }
+}
+
+fn linear_to_ulaw(pcm: i16) -> u8 {
+    const BIAS: i32 = 0x84;
+    const CLIP: i32 = 32635;
+    let mut s = pcm as i32;
+    let sign = if s < 0 {
+        s = -s;
+        0x80
+    } else {
+        0
+    };
+    s = s.min(CLIP) + BIAS;
+    let mut exponent = 7;
+    let mut mask = 0x4000;
+    while exponent > 0 && s & mask == 0 {
+        exponent -= 1;
+        mask >>= 1;
+    }
+    let mantissa = (s >> (exponent + 3)) & 0x0f;
+    !(sign | (exponent << 4) | mantissa) as u8
+}
+
+fn alaw_to_linear(a: u8) -> i16 {
+    let a = a ^ 0x55;
+    let mut t = ((a & 0x0f) as i16) << 4;
+    match (a & 0x70) >> 4 {
+        0 => t += 8,
+        1 => t += 0x108,
+        seg => t = (t + 0x108) << (seg - 1),
+    }
+    if a & 0x80 != 0 {
+        t
+    } else {
+        -t
+    }
+}
+
+fn linear_to_alaw(pcm: i16) -> u8 {
+    let mut s = pcm as i32;
+    let sign = if s >= 0 {
+        0x80
+    } else {
+        s = -s - 1;
+        0
+    };
+    let (exponent, mantissa) = if s < 256 {
+        (0, s >> 4)
+    } else {
+        let mut e = 1;
+        while e < 7 && s >= 256 << e {
+            e += 1;
+        }
+        (e, (s >> (e + 3)) & 0x0f)
+    };
+    ((sign | (exponent << 4) | mantissa) ^ 0x55) as u8
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_and_build() {
+        let payload = [1u8, 2, 3, 4];
+        let pkt = RtpPacket {
+            marker: true,
+            payload_type: 8,
+            seq: 65535,
+            timestamp: 160,
+            ssrc: 0xdeadbeef,
+            payload: &payload,
+        };
+        let bytes = pkt.to_bytes();
+        assert_eq!(RtpPacket::parse(&bytes), Some(pkt.clone()));
+
+        // One CSRC, a one-word extension and two bytes of padding
+        // 一个 CSRC、一字长扩展与两字节填充
+        let mut ext = bytes[..12].to_vec();
+        ext[0] |= 0x20 | 0x10 | 0x01;
+        ext.extend_from_slice(&[0, 0, 0, 9]);
+        ext.extend_from_slice(&[0xbe, 0xde, 0, 1, 0, 0, 0, 0]);
+        ext.extend_from_slice(&payload);
+        ext.extend_from_slice(&[0, 2]);
+        assert_eq!(RtpPacket::parse(&ext).unwrap().payload, &payload);
+
+        assert!(RtpPacket::parse(&bytes[..8]).is_none());
+        assert!(RtpPacket::parse(&[0u8; 12]).is_none());
+    }
+
+    #[test]
+    fn test_g711_round_trip() {
+        for b in 0..=255u8 {
+            let pcm = ulaw_to_linear(b);
+            if pcm != 0 {
+                assert_eq!(linear_to_ulaw(pcm), b, "ulaw {b:#x}");
+            }
+            assert_eq!(linear_to_alaw(alaw_to_linear(b)), b, "alaw {b:#x}");
+        }
+        assert_eq!(linear_to_ulaw(0), 0xff);
+        assert_eq!(linear_to_alaw(0), 0xd5);
+        assert_eq!(ulaw_to_linear(linear_to_ulaw(i16::MIN)), -32124);
+    }
+
+    #[test]
+    fn test_l16_is_big_endian() {
+        let codec = AudioCodec::L16;
+        assert_eq!(codec.encode(&[1, -2]), vec![0, 1, 0xff, 0xfe]);
+        assert_eq!(codec.decode(&[0, 1, 0xff, 0xfe, 7]), vec![1, -2]);
+    }
+}
@@ -0,0 +1,231 @@
+//! H.264 over RTP (RFC 6184) to Annex B access units
+//! RTP 承载的 H.264（RFC 6184）还原为 Annex B 访问单元
+//!
+//! Single NAL units, STAP-A and FU-A packets are supported, which covers IP cameras
+//! in non-interleaved mode. An access unit ends at the RTP marker bit or when the
+//! timestamp changes. Units that lost a packet are dropped, and the next unit is
+//! flagged so the receiver can wait for a keyframe.
+//! 支持单 NAL 单元、STAP-A 与 FU-A 数据包，覆盖非交错模式下的 IP 摄像头。访问单元在 RTP
+//! marker 位或时间戳变化时结束。丢包的单元会被丢弃，下一个单元带有标记，便于接收方等待关键帧。
+
+use crate::spearlet::rtp::packet::RtpPacket;
+
+const START_CODE: [u8; 4] = [0, 0, 0, 1];
+const NAL_IDR: u8 = 5;
+const NAL_SPS: u8 = 7;
+const NAL_PPS: u8 = 8;
+const NAL_STAP_A: u8 = 24;
+const NAL_FU_A: u8 = 28;
+
+/// One decoded picture's worth of NAL units / 一幅图像对应的全部 NAL 单元
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AccessUnit {
+    /// Annex B byte stream / Annex B 字节流
+    pub data: Vec<u8>,
+    pub keyframe: bool,
+    /// RTP timestamp, 90 kHz / RTP 时间戳，90 kHz
+    pub timestamp: u32,
+    /// Units before this one were lost / 此前的单元有丢失
+    pub after_loss: bool,
+}
+
+#[derive(Debug, Default)]
+pub struct Depacketizer {
+    /// SPS and PPS, prepended to keyframes that lack them / SPS 与 PPS，补在缺少它们的关键帧前
+    sps: Option<Vec<u8>>,
+    pps: Option<Vec<u8>>,
+    nals: Vec<Vec<u8>>,
+    timestamp: Option<u32>,
+    fragment: Option<Vec<u8>>,
+    last_seq: Option<u16>,
+    /// The unit being built is missing data / 正在构建的单元缺少数据
+    corrupt: bool,
+    lost: bool,
+}
+
+impl Depacketizer {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Seed SPS/PPS from SDP `sprop-parameter-sets` / 使用 SDP `sprop-parameter-sets` 预置 SPS/PPS
+    pub fn set_parameter_sets(&mut self, nals: Vec<Vec<u8>>) {
+        for nal in nals {
+            self.remember(&nal);
+        }
+    }
+
+    fn remember(&mut self, nal: &[u8]) {
+        match nal.first().map(|h| h & 0x1f) {
+            Some(NAL_SPS) => self.sps = Some(nal.to_vec()),
+            Some(NAL_PPS) => self.pps = Some(nal.to_vec()),
+            _ => {}
+        }
+    }
+
+    /// Feed one packet; returns the units it completes, usually none or one
+    /// 输入一个数据包；返回由它完成的单元，通常为零个或一个
+    pub fn push(&mut self, pkt: &RtpPacket<'_>) -> Vec<AccessUnit> {
+        let mut done = Vec::new();
+        if let Some(last) = self.last_seq {
+            if pkt.seq != last.wrapping_add(1) {
+                self.corrupt = true;
+                self.fragment = None;
+            }
+        }
+        self.last_seq = Some(pkt.seq);
+        if self.timestamp.is_some_and(|ts| ts != pkt.timestamp) {
+            // Marker of the previous unit was lost / 上一单元的 marker 丢失
+            done.extend(self.finish());
+        }
+        self.timestamp = Some(pkt.timestamp);
+        self.read_payload(pkt.payload);
+        if pkt.marker {
+            done.extend(self.finish());
+        }
+        done
+    }
+
+    fn read_payload(&mut self, payload: &[u8]) {
+        let Some(&header) = payload.first() else {
+            return;
+        };
+        match header & 0x1f {
+            1..=23 => self.nals.push(payload.to_vec()),
+            NAL_STAP_A => {
+                let mut rest = &payload[1..];
+                while rest.len() >= 2 {
+                    let size = u16::from_be_bytes([rest[0], rest[1]]) as usize;
+                    if size == 0 || rest.len() < 2 + size {
+                        self.corrupt = true;
+                        break;
+                    }
+                    self.nals.push(rest[2..2 + size].to_vec());
+                    rest = &rest[2 + size..];
+                }
+            }
+            NAL_FU_A => {
+                let Some(&fu) = payload.get(1) else {
+                    self.corrupt = true;
+                    return;
+                };
+                let (start, end) = (fu & 0x80 != 0, fu & 0x40 != 0);
+                if start {
+                    let mut nal = vec![(header & 0xe0) | (fu & 0x1f)];
+                    nal.extend_from_slice(&payload[2..]);
+                    self.fragment = Some(nal);
+                } else if let Some(nal) = self.fragment.as_mut() {
+                    nal.extend_from_slice(&payload[2..]);
+                } else {
+                    // Middle of a fragment whose start was lost / 起始分片已丢失的中间分片
+                    self.corrupt = true;
+                    return;
+                }
+                if end {
+                    if let Some(nal) = self.fragment.take() {
+                        self.nals.push(nal);
+                    }
+                }
+            }
+            // STAP-B, MTAP and FU-B only appear in interleaved mode / 仅在交错模式中出现
+            _ => self.corrupt = true,
+        }
+    }
+
+    fn finish(&mut self) -> Option<AccessUnit> {
+        let nals = std::mem::take(&mut self.nals);
+        let timestamp = self.timestamp.take()?;
+        if self.fragment.take().is_some() {
+            self.corrupt = true;
+        }
+        if std::mem::take(&mut self.corrupt) || nals.is_empty() {
+            self.lost = true;
+            return None;
+        }
+        for nal in &nals {
+            self.remember(nal);
+        }
+        let keyframe = nals.iter().any(|n| n[0] & 0x1f == NAL_IDR);
+        let has_params = nals.iter().any(|n| n[0] & 0x1f == NAL_SPS);
+        let mut data = Vec::with_capacity(nals.iter().map(|n| n.len() + 4).sum::<usize>());
+        if keyframe && !has_params {
+            for nal in [&self.sps, &self.pps].into_iter().flatten() {
+                data.extend_from_slice(&START_CODE);
+                data.extend_from_slice(nal);
+            }
+        }
+        for nal in &nals {
+            data.extend_from_slice(&START_CODE);
+            data.extend_from_slice(nal);
+        }
+        Some(AccessUnit {
+            data,
+            keyframe,
+            timestamp,
+            after_loss: std::mem::take(&mut self.lost),
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn pkt(seq: u16, ts: u32, marker: bool, payload: &[u8]) -> RtpPacket<'_> {
+        RtpPacket {
+            marker,
+            payload_type: 96,
+            seq,
+            timestamp: ts,
+            ssrc: 1,
+            payload,
+        }
+    }
+
+    #[test]
+    fn test_stap_and_fragments_make_a_keyframe() {
+        let mut d = Depacketizer::new();
+        // STAP-A carrying SPS and PPS / 携带 SPS 与 PPS 的 STAP-A
+        let stap = [0x78, 0, 2, 0x67, 0xaa, 0, 2, 0x68, 0xbb];
+        assert!(d.push(&pkt(1, 100, false, &stap)).is_empty());
+        // IDR split into two FU-A fragments / 拆为两个 FU-A 分片的 IDR
+        assert!(d.push(&pkt(2, 100, false, &[0x7c, 0x85, 1, 2])).is_empty());
+        let au = d.push(&pkt(3, 100, true, &[0x7c, 0x45, 3])).remove(0);
+        assert!(au.keyframe && !au.after_loss);
+        let expected: [&[u8]; 6] = [
+            &START_CODE,
+            &[0x67, 0xaa],
+            &START_CODE,
+            &[0x68, 0xbb],
+            &START_CODE,
+            &[0x65, 1, 2, 3],
+        ];
+        assert_eq!(au.data, expected.concat());
+
+        // A later IDR gets the cached parameter sets / 之后的 IDR 补上缓存的参数集
+        let au = d.push(&pkt(4, 200, true, &[0x65, 9])).remove(0);
+        assert!(au.data.starts_with(&[0, 0, 0, 1, 0x67, 0xaa]));
+    }
+
+    #[test]
+    fn test_loss_drops_unit_and_flags_next() {
+        let mut d = Depacketizer::new();
+        assert!(d.push(&pkt(10, 100, false, &[0x7c, 0x81, 1])).is_empty());
+        // seq 11 lost / seq 11 丢失
+        assert!(d.push(&pkt(12, 100, true, &[0x7c, 0x41, 3])).is_empty());
+        let au = d.push(&pkt(13, 200, true, &[0x41, 7])).remove(0);
+        assert!(au.after_loss && !au.keyframe);
+        assert_eq!(au.data, vec![0, 0, 0, 1, 0x41, 7]);
+    }
+
+    #[test]
+    fn test_timestamp_change_ends_unit_without_marker() {
+        let mut d = Depacketizer::new();
+        assert!(d.push(&pkt(1, 100, false, &[0x41, 1])).is_empty());
+        let au = d.push(&pkt(2, 200, false, &[0x41, 2])).remove(0);
+        assert_eq!(au.timestamp, 100);
+        let units = d.push(&pkt(3, 200, true, &[0x41, 3]));
+        assert_eq!(units.len(), 1);
+        assert_eq!(units[0].data.len(), 12);
+    }
+}
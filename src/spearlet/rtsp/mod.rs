@@ -0,0 +1,688 @@
+//! RTSP camera ingestion for vision workloads / 面向视觉工作负载的 RTSP 摄像头接入
+//!
+//! Cameras are listed in `rtsp.cameras`. A workload subscribes with
+//! `POST /api/v1/executions/{id}/streams/camera`, and frames then arrive on its user
+//! stream as `rt-vision` SSF DATA frames: one H.264 access unit in Annex B form per
+//! frame, with a JSON header naming the camera. A camera is pulled only while someone
+//! subscribes, a single connection serves all subscribers, and a dropped connection is
+//! retried with exponential backoff. With the motion pre-filter on, idle scenes are
+//! held back and only frames with activity reach the workload.
+//! 摄像头在 `rtsp.cameras` 中列出。工作负载通过 `POST /api/v1/executions/{id}/streams/camera`
+//! 订阅，随后帧以 `rt-vision` SSF DATA 帧到达其 user stream：每帧为一个 Annex B 形式的 H.264
+//! 访问单元，JSON 头部注明摄像头。仅在有订阅时拉取摄像头，所有订阅者共用一条连接，
+//! 连接断开后按指数退避重试。开启运动预过滤后，空闲画面会被扣留，只有有活动的帧送达工作负载。
+
+pub mod client;
+pub mod h264;
+pub mod motion;
+
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+use dashmap::DashMap;
+use parking_lot::Mutex;
+use serde::{Deserialize, Serialize};
+use tokio::sync::{broadcast, mpsc, oneshot};
+use tokio::time::Instant;
+use tracing::{debug, info, warn};
+
+use crate::spearlet::config::{RtspCameraConfig, RtspConfig};
+use crate::spearlet::exec_stream::DEFAULT_STREAM_ID;
+use crate::spearlet::execution::host_api::ssf;
+use crate::spearlet::execution::host_api::user_stream::ExecutionUserStreamHub;
+use crate::spearlet::execution::host_api::UserStreams;
+use crate::spearlet::rtp::packet::RtpPacket;
+
+use client::{CameraUrl, Client, Incoming, RtspError};
+use h264::Depacketizer;
+use motion::{MotionFilter, Pass};
+
+/// Stream class named in every frame header / 每个帧头部中注明的流类别
+pub const STREAM_CLASS: &str = "rt-vision";
+const SSF_MSG_DATA: u16 = 2;
+/// Frames buffered per subscriber before it starts skipping / 订阅者开始跳帧前缓冲的帧数
+const FRAME_BUFFER: usize = 64;
+/// RTP clock rate of video / 视频的 RTP 时钟频率
+const VIDEO_CLOCK_HZ: u64 = 90_000;
+
+/// One access unit from a camera / 来自摄像头的一个访问单元
+#[derive(Debug)]
+pub struct VideoFrame {
+    pub data: Vec<u8>,
+    pub keyframe: bool,
+    pub after_loss: bool,
+    /// Presentation time since the stream started / 自流开始以来的显示时间
+    pub pts_ms: u64,
+    pub captured_at_ms: i64,
+}
+
+/// Camera state reported by `GET /api/v1/cameras` / `GET /api/v1/cameras` 报告的摄像头状态
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct CameraStatus {
+    pub name: String,
+    pub connected: bool,
+    pub subscribers: usize,
+    pub frames: u64,
+    pub reconnects: u64,
+    pub last_error: Option<String>,
+}
+
+struct Camera {
+    id: u64,
+    cfg: RtspCameraConfig,
+    tx: broadcast::Sender<Arc<VideoFrame>>,
+    status: Mutex<CameraStatus>,
+}
+
+/// Body of `POST .../streams/camera` / `POST .../streams/camera` 的请求体
+#[derive(Debug, Clone, Deserialize)]
+#[serde(default)]
+pub struct CameraSubscribeRequest {
+    pub camera: String,
+    pub stream_id: u32,
+    /// Lower cap for this subscriber only / 仅对该订阅者生效的更低上限
+    pub max_fps: Option<f64>,
+    /// Override the camera's `motion.enabled` / 覆盖摄像头的 `motion.enabled`
+    pub motion: Option<bool>,
+}
+
+impl Default for CameraSubscribeRequest {
+    fn default() -> Self {
+        Self {
+            camera: String::new(),
+            stream_id: DEFAULT_STREAM_ID,
+            max_fps: None,
+            motion: None,
+        }
+    }
+}
+
+/// A subscription as returned to the caller / 返回给调用方的订阅
+#[derive(Debug, Clone, Serialize)]
+pub struct CameraSubscription {
+    pub execution_id: String,
+    pub camera: String,
+    pub stream_id: u32,
+    pub class: &'static str,
+    pub codec: &'static str,
+    /// Effective frame-rate cap; `0` means none / 生效的帧率上限；`0` 表示无
+    pub max_fps: f64,
+    /// Only frames with motion are passed on / 仅放行有运动的帧
+    pub motion: bool,
+}
+
+#[derive(Debug)]
+pub enum CameraError {
+    Disabled,
+    NotFound(String),
+    BadRequest(String),
+    /// Already subscribed to this camera / 已订阅该摄像头
+    Conflict,
+}
+
+impl std::fmt::Display for CameraError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Disabled => write!(f, "rtsp ingestion is disabled"),
+            Self::NotFound(name) => write!(f, "unknown camera: {}", name),
+            Self::BadRequest(msg) => write!(f, "{}", msg),
+            Self::Conflict => write!(f, "execution is already subscribed to this camera"),
+        }
+    }
+}
+
+struct Subscription {
+    id: u64,
+    stop: Option<oneshot::Sender<()>>,
+}
+
+/// Cameras being pulled and the subscriptions to them / 正在拉取的摄像头及其订阅
+#[derive(Clone, Default)]
+pub struct CameraRegistry {
+    cameras: Arc<DashMap<String, Arc<Camera>>>,
+    /// Keyed by (execution id, camera) / 以（执行 id，摄像头）为键
+    subscriptions: Arc<DashMap<(String, String), Subscription>>,
+    next_id: Arc<AtomicU64>,
+    /// User streams the frames are delivered to / 帧所投递到的 user stream
+    streams: Arc<UserStreams>,
+}
+
+impl CameraRegistry {
+    pub fn new(streams: Arc<UserStreams>) -> Self {
+        Self {
+            streams,
+            ..Default::default()
+        }
+    }
+
+    /// Status of every configured camera / 所有已配置摄像头的状态
+    pub fn statuses(&self, cfg: &RtspConfig) -> Vec<CameraStatus> {
+        cfg.cameras
+            .iter()
+            .map(|c| match self.cameras.get(&c.name) {
+                Some(cam) => {
+                    let mut s = cam.status.lock().clone();
+                    s.subscribers = cam.tx.receiver_count();
+                    s
+                }
+                None => CameraStatus {
+                    name: c.name.clone(),
+                    ..Default::default()
+                },
+            })
+            .collect()
+    }
+
+    /// Start feeding a camera into the execution's user stream
+    /// 开始将摄像头画面送入执行的 user stream
+    pub fn subscribe(
+        &self,
+        cfg: &RtspConfig,
+        execution_id: &str,
+        req: CameraSubscribeRequest,
+    ) -> Result<CameraSubscription, CameraError> {
+        if !cfg.enabled {
+            return Err(CameraError::Disabled);
+        }
+        let cam_cfg = cfg
+            .cameras
+            .iter()
+            .find(|c| c.name == req.camera)
+            .ok_or_else(|| CameraError::NotFound(req.camera.clone()))?;
+        if req.max_fps.is_some_and(|f| !f.is_finite() || f <= 0.0) {
+            return Err(CameraError::BadRequest(
+                "max_fps must be positive".to_string(),
+            ));
+        }
+        let max_fps = match (cam_cfg.max_fps > 0.0, req.max_fps) {
+            (true, Some(f)) => f.min(cam_cfg.max_fps),
+            (false, Some(f)) => f,
+            (_, None) => cam_cfg.max_fps.max(0.0),
+        };
+        let motion = req.motion.unwrap_or(cam_cfg.motion.enabled);
+
+        let key = (execution_id.to_string(), req.camera.clone());
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+        let (stop_tx, stop_rx) = oneshot::channel();
+        match self.subscriptions.entry(key) {
+            dashmap::mapref::entry::Entry::Occupied(_) => return Err(CameraError::Conflict),
+            dashmap::mapref::entry::Entry::Vacant(v) => {
+                v.insert(Subscription {
+                    id,
+                    stop: Some(stop_tx),
+                });
+            }
+        }
+
+        // Subscribing under the map entry keeps a retiring puller from missing us
+        // 在映射项内订阅，避免正在退出的拉流任务漏掉本订阅
+        let rx = self
+            .cameras
+            .entry(req.camera.clone())
+            .or_insert_with(|| self.start_camera(cam_cfg.clone(), cfg.clone()))
+            .tx
+            .subscribe();
+
+        let hub = self.streams.get_or_create(execution_id);
+        hub.mark_connected(req.stream_id);
+        let link = Link {
+            id,
+            execution_id: execution_id.to_string(),
+            camera: req.camera.clone(),
+            stream_id: req.stream_id,
+        };
+        crate::spearlet::crash::spawn(
+            "rtsp-subscriber",
+            forward(
+                self.clone(),
+                rx,
+                hub,
+                link,
+                FrameGate::new(max_fps),
+                motion.then(|| MotionFilter::new(&cam_cfg.motion)),
+                stop_rx,
+            ),
+        );
+
+        Ok(CameraSubscription {
+            execution_id: execution_id.to_string(),
+            camera: req.camera,
+            stream_id: req.stream_id,
+            class: STREAM_CLASS,
+            codec: "h264",
+            max_fps,
+            motion,
+        })
+    }
+
+    /// Stop every subscription, e.g. on shutdown; returns how many stopped
+    /// 停止所有订阅（如关闭时）；返回停止的数量
+    pub fn unsubscribe_all(&self) -> usize {
+        let keys: Vec<(String, String)> =
+            self.subscriptions.iter().map(|e| e.key().clone()).collect();
+        keys.iter()
+            .filter(|(execution_id, camera)| self.unsubscribe(execution_id, camera))
+            .count()
+    }
+
+    /// Stop a subscription; `false` if there is none / 停止订阅；不存在时返回 `false`
+    pub fn unsubscribe(&self, execution_id: &str, camera: &str) -> bool {
+        match self
+            .subscriptions
+            .remove(&(execution_id.to_string(), camera.to_string()))
+        {
+            Some((_, mut s)) => {
+                if let Some(stop) = s.stop.take() {
+                    let _ = stop.send(());
+                }
+                true
+            }
+            None => false,
+        }
+    }
+
+    fn start_camera(&self, cfg: RtspCameraConfig, rtsp: RtspConfig) -> Arc<Camera> {
+        let (tx, _) = broadcast::channel(FRAME_BUFFER);
+        let camera = Arc::new(Camera {
+            id: self.next_id.fetch_add(1, Ordering::Relaxed),
+            status: Mutex::new(CameraStatus {
+                name: cfg.name.clone(),
+                ..Default::default()
+            }),
+            cfg,
+            tx,
+        });
+        crate::spearlet::crash::spawn("rtsp-camera", pull(self.clone(), camera.clone(), rtsp));
+        camera
+    }
+
+    /// Remove the camera once nobody listens; `false` if a subscriber showed up
+    /// 无人订阅时移除摄像头；若出现了订阅者则返回 `false`
+    fn retire(&self, camera: &Camera) -> bool {
+        self.cameras.remove_if(&camera.cfg.name, |_, c| {
+            c.id == camera.id && c.tx.receiver_count() == 0
+        });
+        !self
+            .cameras
+            .get(&camera.cfg.name)
+            .is_some_and(|c| c.id == camera.id)
+    }
+}
+
+/// Drop frames above the rate cap without breaking decoding
+/// 丢弃超出帧率上限的帧，同时不破坏解码
+///
+/// H.264 frames depend on earlier ones, so after any skipped frame delivery resumes at
+/// the next keyframe. A cap below the camera rate therefore tends toward keyframes only.
+/// H.264 帧依赖之前的帧，因此跳过任一帧后会从下一个关键帧恢复投递。
+/// 上限低于摄像头帧率时，投递趋向于只剩关键帧。
+#[derive(Debug)]
+struct FrameGate {
+    interval: Option<Duration>,
+    next_due: Option<Instant>,
+    need_keyframe: bool,
+}
+
+impl FrameGate {
+    fn new(max_fps: f64) -> Self {
+        Self {
+            interval: (max_fps > 0.0).then(|| Duration::from_secs_f64(1.0 / max_fps)),
+            next_due: None,
+            // Decoders start at a keyframe / 解码器从关键帧开始
+            need_keyframe: true,
+        }
+    }
+
+    fn admit(&mut self, keyframe: bool, after_loss: bool, now: Instant) -> bool {
+        if after_loss {
+            self.need_keyframe = true;
+        }
+        if self.need_keyframe && !keyframe {
+            return false;
+        }
+        if let Some(interval) = self.interval {
+            if self.next_due.is_some_and(|due| now < due) {
+                self.need_keyframe = true;
+                return false;
+            }
+            // Keep the cadence unless we fell a whole interval behind
+            // 保持节奏，除非已落后整整一个间隔
+            let base = self
+                .next_due
+                .filter(|due| now.duration_since(*due) < interval)
+                .unwrap_or(now);
+            self.next_due = Some(base + interval);
+        }
+        self.need_keyframe = false;
+        true
+    }
+
+    /// Frames were skipped upstream / 上游跳过了帧
+    fn skipped(&mut self) {
+        self.need_keyframe = true;
+    }
+}
+
+/// Where a subscription delivers frames / 订阅的帧投递位置
+struct Link {
+    /// Id of the subscription / 订阅的 id
+    id: u64,
+    execution_id: String,
+    camera: String,
+    stream_id: u32,
+}
+
+impl Link {
+    /// `false` once the stream refuses the frame / 流拒绝该帧时返回 `false`
+    fn deliver(
+        &self,
+        hub: &ExecutionUserStreamHub,
+        frame: &VideoFrame,
+        pass: Option<Pass>,
+    ) -> bool {
+        let mut meta = serde_json::json!({
+            "class": STREAM_CLASS,
+            "camera": self.camera,
+            "codec": "h264",
+            "format": "annexb",
+            "keyframe": frame.keyframe,
+            "pts_ms": frame.pts_ms,
+            "captured_at_ms": frame.captured_at_ms,
+        });
+        if let Some(pass) = pass {
+            meta["motion"] = serde_json::Value::Bool(pass == Pass::Motion);
+        }
+        let bytes = ssf::build_ssf_v1_frame(
+            self.stream_id,
+            SSF_MSG_DATA,
+            meta.to_string().as_bytes(),
+            &frame.data,
+        );
+        hub.push_inbound_frame(self.stream_id, bytes) == 0
+    }
+}
+
+async fn forward(
+    registry: CameraRegistry,
+    mut rx: broadcast::Receiver<Arc<VideoFrame>>,
+    hub: Arc<ExecutionUserStreamHub>,
+    link: Link,
+    mut gate: FrameGate,
+    mut filter: Option<MotionFilter>,
+    mut stop: oneshot::Receiver<()>,
+) {
+    let mut tick = tokio::time::interval(Duration::from_secs(1));
+    let mut delivered = 0u64;
+    let reason = loop {
+        tokio::select! {
+            _ = &mut stop => break "closed",
+            r = rx.recv() => match r {
+                Ok(frame) => {
+                    let now = Instant::now();
+                    let passed = match filter.as_mut() {
+                        Some(f) => f
+                            .push(frame, now)
+                            .into_iter()
+                            .map(|(f, p)| (f, Some(p)))
+                            .collect(),
+                        None => vec![(frame, None)],
+                    };
+                    let mut rejected = false;
+                    for (frame, pass) in passed {
+                        if !gate.admit(frame.keyframe, frame.after_loss, now) {
+                            continue;
+                        }
+                        if !link.deliver(&hub, &frame, pass) {
+                            rejected = true;
+                            break;
+                        }
+                        delivered += 1;
+                    }
+                    if rejected {
+                        break "user stream rejected frame";
+                    }
+                }
+                Err(broadcast::error::RecvError::Lagged(n)) => {
+                    debug!(
+                        execution_id = %link.execution_id,
+                        camera = %link.camera,
+                        n,
+                        "subscriber lagged"
+                    );
+                    gate.skipped();
+                    if let Some(f) = filter.as_mut() {
+                        f.skipped();
+                    }
+                }
+                Err(broadcast::error::RecvError::Closed) => break "camera stopped",
+            },
+            _ = tick.tick() => {
+                if registry.streams.get(&link.execution_id).is_none() {
+                    break "execution finished";
+                }
+            }
+        }
+    };
+    registry
+        .subscriptions
+        .remove_if(&(link.execution_id.clone(), link.camera.clone()), |_, s| {
+            s.id == link.id
+        });
+    info!(
+        execution_id = %link.execution_id,
+        camera = %link.camera,
+        reason,
+        delivered,
+        "camera subscription ended"
+    );
+}
+
+async fn pull(registry: CameraRegistry, camera: Arc<Camera>, cfg: RtspConfig) {
+    let min_backoff = Duration::from_millis(cfg.reconnect_min_ms.max(1));
+    let max_backoff = Duration::from_millis(cfg.reconnect_max_ms).max(min_backoff);
+    let mut backoff = min_backoff;
+    loop {
+        let started = Instant::now();
+        let result = run_session(&camera, &cfg).await;
+        camera.status.lock().connected = false;
+        match result {
+            // Nobody listened for `linger_ms` / `linger_ms` 内无人订阅
+            Ok(()) => {
+                if registry.retire(&camera) {
+                    break;
+                }
+                continue;
+            }
+            Err(e) => {
+                warn!(camera = %camera.cfg.name, "rtsp session failed: {}", e);
+                let mut status = camera.status.lock();
+                status.last_error = Some(e.to_string());
+                status.reconnects += 1;
+            }
+        }
+        if camera.tx.receiver_count() == 0 && registry.retire(&camera) {
+            break;
+        }
+        if started.elapsed() >= max_backoff {
+            backoff = min_backoff;
+        }
+        tokio::time::sleep(backoff).await;
+        backoff = (backoff * 2).min(max_backoff);
+    }
+    info!(camera = %camera.cfg.name, "camera released");
+}
+
+/// Pull frames until the connection fails or nobody listens for `linger_ms`
+/// 拉取帧，直到连接失败或 `linger_ms` 内无人订阅
+async fn run_session(camera: &Camera, cfg: &RtspConfig) -> Result<(), RtspError> {
+    let timeout = Duration::from_millis(cfg.timeout_ms.max(1));
+    let linger = Duration::from_millis(cfg.linger_ms);
+    let url = CameraUrl::parse(&camera.cfg.url)?;
+    let client = Client::connect(url, timeout).await?;
+    let (track, keepalive_every, mut reader, mut control) = client.play().await?;
+    info!(camera = %camera.cfg.name, control = %track.control, "camera playing");
+    camera.status.lock().connected = true;
+
+    // The reader is not cancel safe, so it gets a task and a channel
+    // 读取端不可安全取消，因此放在独立任务中并通过通道传递
+    let (in_tx, mut in_rx) = mpsc::channel::<Result<Incoming, RtspError>>(FRAME_BUFFER);
+    let reader_task = tokio::spawn(async move {
+        loop {
+            let item = reader.read_incoming().await;
+            let failed = item.is_err();
+            if in_tx.send(item).await.is_err() || failed {
+                break;
+            }
+        }
+    });
+
+    let mut depacketizer = Depacketizer::new();
+    depacketizer.set_parameter_sets(track.parameter_sets.clone());
+    let mut keepalive = tokio::time::interval_at(Instant::now() + keepalive_every, keepalive_every);
+    let mut check = tokio::time::interval(Duration::from_secs(1));
+    let mut last_rx = Instant::now();
+    let mut unwatched_since: Option<Instant> = None;
+    let mut first_ts: Option<u32> = None;
+
+    let result = loop {
+        tokio::select! {
+            item = in_rx.recv() => {
+                let payload = match item {
+                    Some(Ok(Incoming::Data { channel: 0, payload })) => payload,
+                    Some(Ok(_)) => continue,
+                    Some(Err(e)) => break Err(e),
+                    None => break Err(RtspError::Protocol("reader stopped".to_string())),
+                };
+                let Some(pkt) = RtpPacket::parse(&payload) else {
+                    continue;
+                };
+                if pkt.payload_type != track.payload_type {
+                    continue;
+                }
+                last_rx = Instant::now();
+                for au in depacketizer.push(&pkt) {
+                    let base = *first_ts.get_or_insert(au.timestamp);
+                    let ticks = au.timestamp.wrapping_sub(base) as u64;
+                    let frame = VideoFrame {
+                        data: au.data,
+                        keyframe: au.keyframe,
+                        after_loss: au.after_loss,
+                        pts_ms: ticks * 1000 / VIDEO_CLOCK_HZ,
+                        captured_at_ms: chrono::Utc::now().timestamp_millis(),
+                    };
+                    camera.status.lock().frames += 1;
+                    // No receivers is handled by the linger check / 无接收者的情况由 linger 检查处理
+                    let _ = camera.tx.send(Arc::new(frame));
+                }
+            }
+            _ = keepalive.tick() => {
+                if let Err(e) = control.keepalive().await {
+                    break Err(e);
+                }
+            }
+            _ = check.tick() => {
+                if last_rx.elapsed() >= timeout {
+                    break Err(RtspError::Timeout);
+                }
+                if camera.tx.receiver_count() > 0 {
+                    unwatched_since = None;
+                } else if unwatched_since.get_or_insert_with(Instant::now).elapsed() >= linger {
+                    break Ok(());
+                }
+            }
+        }
+    };
+    reader_task.abort();
+    control.teardown().await;
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_frame_gate_caps_rate_on_keyframes() {
+        let t0 = Instant::now();
+        let ms = |n: u64| t0 + Duration::from_millis(n);
+        let mut gate = FrameGate::new(5.0);
+        // Waits for the first keyframe / 等待第一个关键帧
+        assert!(!gate.admit(false, false, ms(0)));
+        assert!(gate.admit(true, false, ms(10)));
+        // Too early: skipped, then the rest of the GOP too / 过早：跳过，随后整个 GOP 也跳过
+        assert!(!gate.admit(false, false, ms(50)));
+        assert!(!gate.admit(false, false, ms(300)));
+        assert!(gate.admit(true, false, ms(400)));
+
+        let mut uncapped = FrameGate::new(0.0);
+        assert!(uncapped.admit(true, false, ms(0)));
+        assert!(uncapped.admit(false, false, ms(1)));
+        assert!(!uncapped.admit(false, true, ms(2)));
+        uncapped.skipped();
+        assert!(!uncapped.admit(false, false, ms(3)));
+        assert!(uncapped.admit(true, false, ms(4)));
+    }
+
+    #[test]
+    fn test_subscribe_validates_request() {
+        let registry = CameraRegistry::default();
+        let mut cfg = RtspConfig::default();
+        let req = |camera: &str, max_fps| CameraSubscribeRequest {
+            camera: camera.to_string(),
+            max_fps,
+            ..Default::default()
+        };
+        assert!(matches!(
+            registry.subscribe(&cfg, "cam-exec", req("door", None)),
+            Err(CameraError::Disabled)
+        ));
+        cfg.enabled = true;
+        assert!(matches!(
+            registry.subscribe(&cfg, "cam-exec", req("door", None)),
+            Err(CameraError::NotFound(_))
+        ));
+        cfg.cameras.push(RtspCameraConfig {
+            name: "door".to_string(),
+            url: "rtsp://127.0.0.1:1/live".to_string(),
+            max_fps: 10.0,
+            ..Default::default()
+        });
+        assert!(matches!(
+            registry.subscribe(&cfg, "cam-exec", req("door", Some(0.0))),
+            Err(CameraError::BadRequest(_))
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_subscription_caps_fps_and_rejects_duplicates() {
+        let cfg = RtspConfig {
+            enabled: true,
+            cameras: vec![RtspCameraConfig {
+                name: "yard".to_string(),
+                url: "rtsp://127.0.0.1:1/live".to_string(),
+                max_fps: 10.0,
+                ..Default::default()
+            }],
+            reconnect_min_ms: 60_000,
+            ..Default::default()
+        };
+        let req = |max_fps| CameraSubscribeRequest {
+            camera: "yard".to_string(),
+            max_fps,
+            ..Default::default()
+        };
+        let registry = CameraRegistry::default();
+        let sub = registry
+            .subscribe(&cfg, "cam-sub-exec", req(Some(25.0)))
+            .unwrap();
+        assert_eq!((sub.max_fps, sub.class), (10.0, STREAM_CLASS));
+        assert!(!sub.motion);
+        assert!(matches!(
+            registry.subscribe(&cfg, "cam-sub-exec", req(None)),
+            Err(CameraError::Conflict)
+        ));
+        assert!(registry.unsubscribe("cam-sub-exec", "yard"));
+        assert!(!registry.unsubscribe("cam-sub-exec", "yard"));
+    }
+}
@@ -0,0 +1,225 @@
+//! Motion pre-filter for camera subscriptions / 摄像头订阅的运动预过滤
+//!
+//! Frames are never decoded. An encoder spends few bits on predicted frames of a still
+//! scene and many once something moves, so the size of each non-key frame is compared
+//! with a running baseline. Idle scenes are held back, and when motion starts the
+//! frames since the last keyframe are released first so the receiver can decode from
+//! the start of the group of pictures.
+//! 帧从不解码。编码器在静止画面的预测帧上花费的比特很少，一旦有物体运动则会大幅增加，
+//! 因此将每个非关键帧的大小与滚动基线比较。空闲画面会被扣留；运动开始时先放出自上一个
+//! 关键帧以来的帧，使接收方能从图像组起点开始解码。
+
+use std::sync::Arc;
+use std::time::Duration;
+
+use tokio::time::Instant;
+
+use super::VideoFrame;
+use crate::spearlet::config::RtspMotionConfig;
+
+/// Frames kept while idle before the pre-roll is given up / 空闲时放弃预录前保留的帧数
+const PREROLL_LIMIT: usize = 300;
+/// Baseline weight of a still frame / 静止帧的基线权重
+const ALPHA_IDLE: f64 = 0.05;
+/// Lets a lasting change, e.g. rain or a light switched on, become the new baseline
+/// 使持续的变化（如下雨或开灯）逐渐成为新的基线
+const ALPHA_MOVING: f64 = 0.005;
+
+/// Why a frame was let through / 帧被放行的原因
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Pass {
+    Motion,
+    /// Periodic keyframe of an idle scene / 空闲画面的周期性关键帧
+    Heartbeat,
+}
+
+#[derive(Debug)]
+pub struct MotionFilter {
+    threshold: f64,
+    min_bytes: f64,
+    hold: Duration,
+    warmup_frames: u32,
+    heartbeat: Option<Duration>,
+    baseline: Option<f64>,
+    scored: u32,
+    /// Frames since the last keyframe, held while idle / 空闲时保留的自上一个关键帧以来的帧
+    preroll: Vec<Arc<VideoFrame>>,
+    active_until: Option<Instant>,
+    /// Output continues the last frame passed on / 输出与上一个放行的帧连续
+    continuous: bool,
+    last_heartbeat: Option<Instant>,
+}
+
+impl MotionFilter {
+    pub fn new(cfg: &RtspMotionConfig) -> Self {
+        Self {
+            threshold: cfg.threshold,
+            min_bytes: cfg.min_bytes as f64,
+            hold: Duration::from_millis(cfg.hold_ms),
+            warmup_frames: cfg.warmup_frames,
+            heartbeat: (cfg.idle_keyframe_interval_ms > 0)
+                .then(|| Duration::from_millis(cfg.idle_keyframe_interval_ms)),
+            baseline: None,
+            scored: 0,
+            preroll: Vec::new(),
+            active_until: None,
+            continuous: false,
+            last_heartbeat: None,
+        }
+    }
+
+    /// Score a predicted frame against the baseline and update it
+    /// 将预测帧与基线比较打分并更新基线
+    fn moving(&mut self, size: f64) -> bool {
+        self.scored = self.scored.saturating_add(1);
+        let Some(baseline) = self.baseline else {
+            self.baseline = Some(size);
+            return false;
+        };
+        if self.scored <= self.warmup_frames {
+            // Plain mean while learning the scene / 学习画面期间使用简单平均
+            self.baseline = Some(baseline + (size - baseline) / self.scored as f64);
+            return false;
+        }
+        let moving = size >= baseline * self.threshold && size - baseline >= self.min_bytes;
+        let alpha = if moving { ALPHA_MOVING } else { ALPHA_IDLE };
+        self.baseline = Some(baseline + (size - baseline) * alpha);
+        moving
+    }
+
+    /// Feed one camera frame; returns the frames to pass on, oldest first
+    /// 输入一个摄像头帧；返回需放行的帧，最早的在前
+    pub fn push(&mut self, frame: Arc<VideoFrame>, now: Instant) -> Vec<(Arc<VideoFrame>, Pass)> {
+        if frame.after_loss {
+            self.skipped();
+        }
+        if frame.keyframe {
+            self.preroll.clear();
+        } else if self.moving(frame.data.len() as f64) {
+            self.active_until = Some(now + self.hold);
+        }
+
+        if self.active_until.is_some_and(|until| now < until) {
+            if self.continuous {
+                return vec![(frame, Pass::Motion)];
+            }
+            let mut out: Vec<_> = std::mem::take(&mut self.preroll)
+                .into_iter()
+                .map(|f| (f, Pass::Motion))
+                .collect();
+            if out.is_empty() && !frame.keyframe {
+                // Nothing decodable yet; wait for a keyframe / 尚无可解码的帧；等待关键帧
+                return out;
+            }
+            out.push((frame, Pass::Motion));
+            self.continuous = true;
+            return out;
+        }
+
+        self.continuous = false;
+        if frame.keyframe {
+            let due = self.heartbeat.is_some_and(|every| {
+                !self
+                    .last_heartbeat
+                    .is_some_and(|last| now.duration_since(last) < every)
+            });
+            if due {
+                self.last_heartbeat = Some(now);
+                return vec![(frame, Pass::Heartbeat)];
+            }
+        }
+        // The pre-roll must start at a keyframe to be decodable / 预录必须从关键帧开始才可解码
+        if frame.keyframe || !self.preroll.is_empty() {
+            if self.preroll.len() >= PREROLL_LIMIT {
+                self.preroll.clear();
+            } else {
+                self.preroll.push(frame);
+            }
+        }
+        Vec::new()
+    }
+
+    /// Frames were lost before reaching the filter / 帧在到达过滤器前已丢失
+    pub fn skipped(&mut self) {
+        self.preroll.clear();
+        self.continuous = false;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn frame(size: usize, keyframe: bool) -> Arc<VideoFrame> {
+        Arc::new(VideoFrame {
+            data: vec![0; size],
+            keyframe,
+            after_loss: false,
+            pts_ms: 0,
+            captured_at_ms: 0,
+        })
+    }
+
+    fn cfg() -> RtspMotionConfig {
+        RtspMotionConfig {
+            enabled: true,
+            warmup_frames: 5,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_still_scene_is_held_back() {
+        let mut f = MotionFilter::new(&cfg());
+        let t0 = Instant::now();
+        for i in 0..100u64 {
+            let out = f.push(frame(400, i % 25 == 0), t0 + Duration::from_millis(i * 40));
+            assert!(out.is_empty(), "frame {}", i);
+        }
+    }
+
+    #[test]
+    fn test_motion_releases_preroll_then_holds() {
+        let mut f = MotionFilter::new(&cfg());
+        let t0 = Instant::now();
+        let at = |i: u64| t0 + Duration::from_millis(i * 40);
+        assert!(f.push(frame(20_000, true), at(0)).is_empty());
+        for i in 1..10 {
+            assert!(f.push(frame(400, false), at(i)).is_empty());
+        }
+        // Something moves: keyframe plus nine still frames come first
+        // 有物体运动：关键帧与九个静止帧先行放出
+        let out = f.push(frame(4_000, false), at(10));
+        assert_eq!(out.len(), 11);
+        assert!(out[0].0.keyframe && out.iter().all(|(_, p)| *p == Pass::Motion));
+
+        // Still again, but within hold_ms / 再次静止，但仍在 hold_ms 内
+        assert_eq!(f.push(frame(400, false), at(11)).len(), 1);
+        // After hold_ms the scene is idle; motion without a pre-roll waits for a keyframe
+        // hold_ms 之后画面空闲；没有预录的运动需等待关键帧
+        let later = at(11) + Duration::from_millis(cfg().hold_ms);
+        assert!(f.push(frame(400, false), later).is_empty());
+        assert!(f.push(frame(4_000, false), later).is_empty());
+        assert_eq!(f.push(frame(20_000, true), later).len(), 1);
+    }
+
+    #[test]
+    fn test_idle_heartbeat_keyframes() {
+        let mut f = MotionFilter::new(&RtspMotionConfig {
+            idle_keyframe_interval_ms: 1_000,
+            ..cfg()
+        });
+        let t0 = Instant::now();
+        let out = f.push(frame(20_000, true), t0);
+        assert_eq!(out[0].1, Pass::Heartbeat);
+        assert!(f.push(frame(400, false), t0).is_empty());
+        assert!(f
+            .push(frame(20_000, true), t0 + Duration::from_millis(500))
+            .is_empty());
+        assert_eq!(
+            f.push(frame(20_000, true), t0 + Duration::from_millis(1_000))
+                .len(),
+            1
+        );
+    }
+}
@@ -0,0 +1,450 @@
+//! Scheduled follow-up invocations / 计划的后续调用
+//!
+//! Backs the `schedule_*` hostcalls, so a running workload can ask for a later invocation of
+//! itself or of another task, once or at an interval. This covers "remind me later" and
+//! agents that continue their own work without an external cron. Schedules belong to the
+//! task that created them and are kept in one JSON file under the schedule directory,
+//! rewritten through a rename on every change, so they survive spearlet restarts. The
+//! execution manager polls `take_due` and invokes what it returns.
+//! 为 `schedule_*` hostcall 提供支持，使运行中的工作负载可以请求稍后调用自身或另一个任务，一次或按
+//! 间隔重复，从而支持“稍后提醒”以及无需外部 cron 即可自行继续工作的智能体。计划归创建它的任务所有，
+//! 保存在计划目录下的一个 JSON 文件中；每次变更都通过重命名重写该文件，因此 spearlet 重启后仍然保留。
+//! 执行管理器轮询 `take_due` 并调用其返回的计划。
+
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
+
+use base64::{engine::general_purpose, Engine as _};
+use parking_lot::{Mutex, RwLock};
+use serde::{Deserialize, Serialize};
+
+use crate::spearlet::config::{SchedulesConfig, SpearletConfig};
+
+/// Invocation metadata key carrying the schedule id / 携带计划 ID 的调用元数据键
+pub const SCHEDULE_METADATA_KEY: &str = "spear.schedule_id";
+
+const FILE_NAME: &str = "schedules.json";
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum ScheduleError {
+    #[error("schedules are disabled")]
+    Disabled,
+    #[error("invalid request: {0}")]
+    Invalid(String),
+    #[error("unknown schedule: {0}")]
+    NotFound(String),
+    #[error("task holds max_per_task {0} schedules already")]
+    TooMany(usize),
+    #[error("schedule file error: {0}")]
+    Io(String),
+}
+
+/// What a workload asks to schedule, as JSON / 工作负载请求计划的内容（JSON）
+#[derive(Debug, Clone, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+pub struct ScheduleRequest {
+    /// Task id or name; the calling task when empty / 任务 ID 或名称；为空时为调用方任务
+    pub task: String,
+    /// Entry function; the default entry when empty / 入口函数；为空时使用默认入口
+    pub method: String,
+    pub content_type: String,
+    /// UTF-8 input / UTF-8 输入
+    pub input: Option<String>,
+    pub input_base64: Option<String>,
+    /// First run this long from now / 自现在起经过该时长后首次运行
+    pub delay_ms: u64,
+    /// First run at this Unix time in milliseconds, instead of `delay_ms`
+    /// 在该 Unix 毫秒时间首次运行，代替 `delay_ms`
+    pub at_ms: Option<i64>,
+    /// Run again this often; 0 runs once / 按该间隔重复运行；0 表示只运行一次
+    pub interval_ms: u64,
+    pub metadata: HashMap<String, String>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Schedule {
+    pub id: String,
+    /// Task that created the schedule / 创建该计划的任务
+    pub owner: String,
+    pub task: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub method: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub content_type: String,
+    #[serde(default)]
+    pub input_base64: String,
+    pub next_run_ms: i64,
+    #[serde(default)]
+    pub interval_ms: u64,
+    /// Times the schedule came due / 计划到期的次数
+    #[serde(default)]
+    pub runs: u64,
+    #[serde(default, skip_serializing_if = "HashMap::is_empty")]
+    pub metadata: HashMap<String, String>,
+}
+
+impl Schedule {
+    pub fn input(&self) -> Vec<u8> {
+        general_purpose::STANDARD
+            .decode(&self.input_base64)
+            .unwrap_or_default()
+    }
+}
+
+/// On-disk form of the schedules / 计划的磁盘格式
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct SchedulesFile {
+    schedules: Vec<Schedule>,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct ScheduleStats {
+    pub enabled: bool,
+    pub dir: String,
+    pub schedules: usize,
+    pub recurring: usize,
+    /// Owning tasks / 拥有计划的任务数
+    pub tasks: usize,
+    /// Earliest pending run, Unix milliseconds / 最早的待运行时间（Unix 毫秒）
+    pub next_run_ms: Option<i64>,
+}
+
+/// Schedule directory for a configuration / 配置对应的计划目录
+pub fn schedule_dir(config: &SpearletConfig) -> PathBuf {
+    if config.schedules.dir.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("schedules")
+    } else {
+        PathBuf::from(&config.schedules.dir)
+    }
+}
+
+pub struct Schedules {
+    config: RwLock<(SchedulesConfig, PathBuf)>,
+    /// Schedules by id, read from disk on first use / 按 ID 索引的计划，首次使用时从磁盘读取
+    loaded: Mutex<Option<BTreeMap<String, Schedule>>>,
+}
+
+impl Schedules {
+    pub fn new(config: SchedulesConfig, dir: PathBuf) -> Self {
+        Self {
+            config: RwLock::new((config, dir)),
+            loaded: Mutex::new(None),
+        }
+    }
+
+    /// Apply a new configuration; schedules are kept on disk and read again on next use
+    /// 应用新配置；计划保留在磁盘上，下次使用时重新读取
+    pub fn set_config(&self, config: SchedulesConfig, dir: PathBuf) {
+        *self.config.write() = (config, dir);
+        *self.loaded.lock() = None;
+    }
+
+    /// How often the manager looks for due schedules / 管理器查找到期计划的间隔
+    pub fn tick_ms(&self) -> u64 {
+        self.config.read().0.tick_ms.max(100)
+    }
+
+    fn load(dir: &Path) -> Result<BTreeMap<String, Schedule>, ScheduleError> {
+        let path = dir.join(FILE_NAME);
+        let file: SchedulesFile = match std::fs::read(&path) {
+            Ok(bytes) => serde_json::from_slice(&bytes)
+                .map_err(|e| ScheduleError::Io(format!("{}: {}", path.display(), e)))?,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => SchedulesFile::default(),
+            Err(e) => return Err(ScheduleError::Io(format!("{}: {}", path.display(), e))),
+        };
+        Ok(file
+            .schedules
+            .into_iter()
+            .map(|s| (s.id.clone(), s))
+            .collect())
+    }
+
+    fn save(dir: &Path, entries: &BTreeMap<String, Schedule>) -> Result<(), ScheduleError> {
+        let io = |e: std::io::Error| ScheduleError::Io(e.to_string());
+        std::fs::create_dir_all(dir).map_err(io)?;
+        let file = SchedulesFile {
+            schedules: entries.values().cloned().collect(),
+        };
+        let bytes = serde_json::to_vec(&file).map_err(|e| ScheduleError::Io(e.to_string()))?;
+        let path = dir.join(FILE_NAME);
+        let tmp = path.with_extension("json.tmp");
+        std::fs::write(&tmp, bytes).map_err(io)?;
+        std::fs::rename(&tmp, &path).map_err(io)
+    }
+
+    /// Run `f` on the schedules; `f` returns whether it changed anything
+    /// 在计划上执行 `f`；`f` 返回是否有改动
+    fn with_entries<T>(
+        &self,
+        f: impl FnOnce(
+            &SchedulesConfig,
+            &mut BTreeMap<String, Schedule>,
+        ) -> Result<(T, bool), ScheduleError>,
+    ) -> Result<T, ScheduleError> {
+        let (cfg, dir) = self.config.read().clone();
+        if !cfg.enabled {
+            return Err(ScheduleError::Disabled);
+        }
+        let mut loaded = self.loaded.lock();
+        if loaded.is_none() {
+            *loaded = Some(Self::load(&dir)?);
+        }
+        let entries = loaded.as_mut().expect("loaded above");
+        let (out, changed) = f(&cfg, entries)?;
+        if changed {
+            Self::save(&dir, entries)?;
+        }
+        Ok(out)
+    }
+
+    /// Add a schedule for `owner`; returns its id / 为 `owner` 添加计划；返回其 ID
+    pub fn create(
+        &self,
+        owner: &str,
+        req: ScheduleRequest,
+        now_ms: i64,
+    ) -> Result<String, ScheduleError> {
+        self.with_entries(|cfg, entries| {
+            if owner.is_empty() {
+                return Err(ScheduleError::Invalid(
+                    "the caller has no task id".to_string(),
+                ));
+            }
+            if req.interval_ms > 0 && req.interval_ms < cfg.min_interval_ms {
+                return Err(ScheduleError::Invalid(format!(
+                    "interval_ms must be 0 or at least {}",
+                    cfg.min_interval_ms
+                )));
+            }
+            let next_run_ms = match (req.at_ms, req.delay_ms) {
+                (Some(_), d) if d > 0 => {
+                    return Err(ScheduleError::Invalid(
+                        "set one of at_ms and delay_ms".to_string(),
+                    ))
+                }
+                (Some(at), _) => at,
+                (None, d) => now_ms.saturating_add(i64::try_from(d).unwrap_or(i64::MAX)),
+            };
+            let input = match (req.input, req.input_base64) {
+                (Some(_), Some(_)) => {
+                    return Err(ScheduleError::Invalid(
+                        "set one of input and input_base64".to_string(),
+                    ))
+                }
+                (Some(s), None) => s.into_bytes(),
+                (None, Some(b)) => general_purpose::STANDARD.decode(b).map_err(|_| {
+                    ScheduleError::Invalid("input_base64 is not base64".to_string())
+                })?,
+                (None, None) => Vec::new(),
+            };
+            if input.len() > cfg.max_input_bytes {
+                return Err(ScheduleError::Invalid(format!(
+                    "input must be at most {} bytes",
+                    cfg.max_input_bytes
+                )));
+            }
+            let owned = entries.values().filter(|s| s.owner == owner).count();
+            if owned >= cfg.max_per_task {
+                return Err(ScheduleError::TooMany(cfg.max_per_task));
+            }
+
+            let id = format!("sched-{}", uuid::Uuid::new_v4());
+            let task = if req.task.is_empty() {
+                owner.to_string()
+            } else {
+                req.task
+            };
+            entries.insert(
+                id.clone(),
+                Schedule {
+                    id: id.clone(),
+                    owner: owner.to_string(),
+                    task,
+                    method: req.method,
+                    content_type: req.content_type,
+                    input_base64: general_purpose::STANDARD.encode(input),
+                    next_run_ms,
+                    interval_ms: req.interval_ms,
+                    runs: 0,
+                    metadata: req.metadata,
+                },
+            );
+            Ok((id, true))
+        })
+    }
+
+    /// Remove one of `owner`'s schedules / 移除 `owner` 的一个计划
+    pub fn cancel(&self, owner: &str, id: &str) -> Result<(), ScheduleError> {
+        self.with_entries(|_, entries| {
+            if !entries.get(id).is_some_and(|s| s.owner == owner) {
+                return Err(ScheduleError::NotFound(id.to_string()));
+            }
+            entries.remove(id);
+            Ok(((), true))
+        })
+    }
+
+    /// `owner`'s schedules, soonest first / `owner` 的计划，最早到期者在前
+    pub fn list(&self, owner: &str) -> Result<Vec<Schedule>, ScheduleError> {
+        self.with_entries(|_, entries| {
+            let mut out: Vec<Schedule> = entries
+                .values()
+                .filter(|s| s.owner == owner)
+                .cloned()
+                .collect();
+            out.sort_by_key(|s| s.next_run_ms);
+            Ok((out, false))
+        })
+    }
+
+    /// Schedules due at `now_ms`. One-shot schedules are removed and recurring ones move to
+    /// their next run; runs missed while the spearlet was down are folded into one.
+    /// 在 `now_ms` 到期的计划。一次性计划被移除，重复计划移到下一次运行；spearlet 停止期间错过的运行
+    /// 合并为一次。
+    pub fn take_due(&self, now_ms: i64) -> Vec<Schedule> {
+        let r = self.with_entries(|_, entries| {
+            let due: Vec<Schedule> = entries
+                .values()
+                .filter(|s| s.next_run_ms <= now_ms)
+                .cloned()
+                .collect();
+            for s in &due {
+                if s.interval_ms == 0 {
+                    entries.remove(&s.id);
+                } else if let Some(e) = entries.get_mut(&s.id) {
+                    let interval = i64::try_from(s.interval_ms).unwrap_or(i64::MAX);
+                    e.next_run_ms = now_ms.saturating_add(interval);
+                    e.runs += 1;
+                }
+            }
+            let changed = !due.is_empty();
+            Ok((due, changed))
+        });
+        match r {
+            Ok(due) => due,
+            Err(ScheduleError::Disabled) => Vec::new(),
+            Err(e) => {
+                tracing::warn!(error = %e, "taking due schedules failed");
+                Vec::new()
+            }
+        }
+    }
+
+    pub fn stats(&self) -> ScheduleStats {
+        let (cfg, dir) = self.config.read().clone();
+        let loaded = self.loaded.lock();
+        let entries = loaded.as_ref();
+        let all = || entries.into_iter().flat_map(|e| e.values());
+        let mut tasks: Vec<&str> = all().map(|s| s.owner.as_str()).collect();
+        tasks.sort_unstable();
+        tasks.dedup();
+        ScheduleStats {
+            enabled: cfg.enabled,
+            dir: dir.display().to_string(),
+            schedules: all().count(),
+            recurring: all().filter(|s| s.interval_ms > 0).count(),
+            tasks: tasks.len(),
+            next_run_ms: all().map(|s| s.next_run_ms).min(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn schedules(dir: &Path) -> Schedules {
+        Schedules::new(
+            SchedulesConfig {
+                enabled: true,
+                max_per_task: 2,
+                min_interval_ms: 1000,
+                ..Default::default()
+            },
+            dir.to_path_buf(),
+        )
+    }
+
+    fn req(json: &str) -> ScheduleRequest {
+        serde_json::from_str(json).unwrap()
+    }
+
+    #[test]
+    fn test_create_list_cancel_persists() {
+        let dir = tempfile::tempdir().unwrap();
+        let s = schedules(dir.path());
+        let later = s
+            .create("agent", req(r#"{"delay_ms":5000,"input":"ping"}"#), 0)
+            .unwrap();
+        let soon = s
+            .create("agent", req(r#"{"task":"tts","at_ms":100}"#), 0)
+            .unwrap();
+        assert_eq!(
+            s.create("agent", req(r#"{"delay_ms":1}"#), 0),
+            Err(ScheduleError::TooMany(2))
+        );
+
+        // A new instance reads the schedules back from disk / 新实例从磁盘读回计划
+        let s = schedules(dir.path());
+        let listed = s.list("agent").unwrap();
+        assert_eq!(listed.len(), 2);
+        assert_eq!(listed[0].id, soon);
+        assert_eq!(listed[0].task, "tts");
+        assert_eq!(listed[1].task, "agent");
+        assert_eq!(listed[1].input(), b"ping");
+        assert!(s.list("other").unwrap().is_empty());
+
+        assert_eq!(
+            s.cancel("other", &later),
+            Err(ScheduleError::NotFound(later.clone()))
+        );
+        s.cancel("agent", &later).unwrap();
+        assert_eq!(s.stats().schedules, 1);
+    }
+
+    #[test]
+    fn test_take_due_runs_once_or_again() {
+        let dir = tempfile::tempdir().unwrap();
+        let s = schedules(dir.path());
+        s.create("a", req(r#"{"delay_ms":10}"#), 0).unwrap();
+        let every = s
+            .create("a", req(r#"{"delay_ms":10,"interval_ms":1000}"#), 0)
+            .unwrap();
+        assert!(s.take_due(5).is_empty());
+
+        // A late tick folds missed runs into one / 迟到的轮询将错过的运行合并为一次
+        assert_eq!(s.take_due(5000).len(), 2);
+        let left = s.list("a").unwrap();
+        assert_eq!(left.len(), 1);
+        assert_eq!(left[0].id, every);
+        assert_eq!(left[0].next_run_ms, 6000);
+        assert_eq!(left[0].runs, 1);
+        assert!(s.take_due(5999).is_empty());
+        assert_eq!(s.take_due(6000).len(), 1);
+    }
+
+    #[test]
+    fn test_invalid_requests() {
+        let dir = tempfile::tempdir().unwrap();
+        let s = schedules(dir.path());
+        for bad in [
+            r#"{"interval_ms":10}"#,
+            r#"{"at_ms":1,"delay_ms":1}"#,
+            r#"{"input":"a","input_base64":"YQ=="}"#,
+        ] {
+            assert!(matches!(
+                s.create("a", req(bad), 0),
+                Err(ScheduleError::Invalid(_))
+            ));
+        }
+        assert!(matches!(
+            s.create("", req("{}"), 0),
+            Err(ScheduleError::Invalid(_))
+        ));
+        assert!(serde_json::from_str::<ScheduleRequest>(r#"{"cron":"* * *"}"#).is_err());
+
+        s.set_config(SchedulesConfig::default(), dir.path().to_path_buf());
+        assert_eq!(s.list("a"), Err(ScheduleError::Disabled));
+        assert!(s.take_due(i64::MAX).is_empty());
+    }
+}
@@ -0,0 +1,413 @@
+//! Task scratch files / 任务临时文件
+//!
+//! Backs the `file_*` hostcalls. Each task gets a scratch directory of its own, and every
+//! relative path a task names resolves inside it; `/mnt/<name>/...` reaches a configured
+//! shared mount instead. Paths may not climb out with `..`, and symlinks leading outside
+//! their directory are refused, so a task only reaches its own files and the mounts. Process
+//! workloads and tool plugins get the same directory in `SPEAR_SCRATCH_DIR`, which lets them
+//! exchange artifacts such as audio files or generated images with WASM code.
+//! 为 `file_*` hostcall 提供支持。每个任务拥有独立的临时目录，任务给出的相对路径都在其中解析；
+//! `/mnt/<name>/...` 则指向配置的共享挂载。路径不能通过 `..` 跳出，指向目录之外的符号链接会被拒绝，
+//! 因此任务只能访问自己的文件与挂载。进程工作负载与工具插件通过 `SPEAR_SCRATCH_DIR` 获得同一目录，
+//! 从而可以与 WASM 代码交换音频文件、生成的图片等产物。
+
+use std::path::{Component, Path, PathBuf};
+
+use parking_lot::RwLock;
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::config::{ScratchFilesConfig, SpearletConfig};
+
+/// Path prefix naming a shared mount / 表示共享挂载的路径前缀
+pub const MOUNT_PREFIX: &str = "/mnt/";
+/// Environment variable pointing at the task's scratch directory / 指向任务临时目录的环境变量
+pub const ENV_SCRATCH_DIR: &str = "SPEAR_SCRATCH_DIR";
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum FileError {
+    #[error("scratch files are disabled")]
+    Disabled,
+    #[error("invalid path or data: {0}")]
+    Invalid(String),
+    #[error("no such file: {0}")]
+    NotFound(String),
+    #[error("read-only mount: {0}")]
+    ReadOnly(String),
+    #[error("scratch directory holds max_task_bytes already")]
+    Full,
+    #[error("file error: {0}")]
+    Io(String),
+}
+
+/// One entry of a directory listing / 目录列表中的一项
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct FileEntry {
+    pub name: String,
+    pub size: u64,
+    pub dir: bool,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct ScratchStats {
+    pub enabled: bool,
+    pub dir: String,
+    pub mounts: Vec<String>,
+    /// Scratch directories on disk / 磁盘上的临时目录数
+    pub tasks: usize,
+}
+
+/// Scratch directory for a configuration / 配置对应的临时目录
+pub fn scratch_dir(config: &SpearletConfig) -> PathBuf {
+    if config.scratch_files.dir.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("scratch")
+    } else {
+        PathBuf::from(&config.scratch_files.dir)
+    }
+}
+
+/// A path resolved against its root / 相对其根目录解析后的路径
+struct Resolved {
+    root: PathBuf,
+    path: PathBuf,
+    read_only: bool,
+    /// Inside the task's scratch directory rather than a mount / 位于任务临时目录而非挂载中
+    scratch: bool,
+}
+
+fn io_error(path: &str, e: std::io::Error) -> FileError {
+    if e.kind() == std::io::ErrorKind::NotFound {
+        FileError::NotFound(path.to_string())
+    } else {
+        FileError::Io(format!("{}: {}", path, e))
+    }
+}
+
+/// Refuse a path whose nearest existing ancestor lies outside `root`, as through a symlink
+/// 拒绝最近的已存在祖先位于 `root` 之外的路径（例如经由符号链接）
+fn check_inside(root: &Path, path: &Path, shown: &str) -> Result<(), FileError> {
+    let Ok(root) = root.canonicalize() else {
+        return Ok(());
+    };
+    let mut probe = path;
+    loop {
+        if let Ok(real) = probe.canonicalize() {
+            if real.starts_with(&root) {
+                return Ok(());
+            }
+            return Err(FileError::Invalid(format!(
+                "{} leaves its directory",
+                shown
+            )));
+        }
+        match probe.parent() {
+            Some(p) => probe = p,
+            None => return Ok(()),
+        }
+    }
+}
+
+/// Bytes of the files below `dir` / `dir` 下文件的字节数
+fn dir_bytes(dir: &Path) -> u64 {
+    let Ok(entries) = std::fs::read_dir(dir) else {
+        return 0;
+    };
+    entries
+        .flatten()
+        .map(|e| match e.metadata() {
+            Ok(m) if m.is_dir() => dir_bytes(&e.path()),
+            Ok(m) => m.len(),
+            Err(_) => 0,
+        })
+        .sum()
+}
+
+pub struct ScratchFiles {
+    config: RwLock<(ScratchFilesConfig, PathBuf)>,
+}
+
+impl ScratchFiles {
+    pub fn new(config: ScratchFilesConfig, dir: PathBuf) -> Self {
+        Self {
+            config: RwLock::new((config, dir)),
+        }
+    }
+
+    /// Apply a new configuration; files stay where they are / 应用新配置；文件保留在原处
+    pub fn set_config(&self, config: ScratchFilesConfig, dir: PathBuf) {
+        *self.config.write() = (config, dir);
+    }
+
+    fn task_root(dir: &Path, task_id: &str) -> PathBuf {
+        let digest = Sha256::digest(task_id.as_bytes());
+        let hex: String = digest[..16].iter().map(|b| format!("{:02x}", b)).collect();
+        dir.join(hex)
+    }
+
+    /// The task's scratch directory, created and made absolute for other processes
+    /// 任务的临时目录，已创建并转为绝对路径，供其他进程使用
+    pub fn task_dir(&self, task_id: &str) -> Result<PathBuf, FileError> {
+        let (cfg, dir) = self.config.read().clone();
+        if !cfg.enabled {
+            return Err(FileError::Disabled);
+        }
+        let root = Self::task_root(&dir, task_id);
+        std::fs::create_dir_all(&root).map_err(|e| FileError::Io(e.to_string()))?;
+        root.canonicalize()
+            .map_err(|e| FileError::Io(e.to_string()))
+    }
+
+    fn resolve(
+        &self,
+        task_id: &str,
+        path: &str,
+    ) -> Result<(ScratchFilesConfig, Resolved), FileError> {
+        let (cfg, dir) = self.config.read().clone();
+        if !cfg.enabled {
+            return Err(FileError::Disabled);
+        }
+        if path.contains('\0') {
+            return Err(FileError::Invalid("paths may not contain NUL".to_string()));
+        }
+        let (root, rest, read_only, scratch) = match path.strip_prefix(MOUNT_PREFIX) {
+            Some(rest) => {
+                let (name, rest) = rest.split_once('/').unwrap_or((rest, ""));
+                let mount = cfg
+                    .mounts
+                    .iter()
+                    .find(|m| m.name == name)
+                    .ok_or_else(|| FileError::NotFound(format!("{}{}", MOUNT_PREFIX, name)))?;
+                (PathBuf::from(&mount.path), rest, mount.read_only, false)
+            }
+            None => (Self::task_root(&dir, task_id), path, false, true),
+        };
+        let mut full = root.clone();
+        for c in Path::new(rest).components() {
+            match c {
+                Component::Normal(p) => full.push(p),
+                Component::CurDir | Component::RootDir => {}
+                Component::ParentDir | Component::Prefix(_) => {
+                    return Err(FileError::Invalid(format!("{} may not use ..", path)));
+                }
+            }
+        }
+        check_inside(&root, &full, path)?;
+        Ok((
+            cfg,
+            Resolved {
+                root,
+                path: full,
+                read_only,
+                scratch,
+            },
+        ))
+    }
+
+    pub fn read(&self, task_id: &str, path: &str) -> Result<Vec<u8>, FileError> {
+        let (cfg, r) = self.resolve(task_id, path)?;
+        let meta = std::fs::metadata(&r.path).map_err(|e| io_error(path, e))?;
+        if meta.is_dir() {
+            return Err(FileError::Invalid(format!("{} is a directory", path)));
+        }
+        if meta.len() > cfg.max_file_bytes {
+            return Err(FileError::Invalid(format!(
+                "{} is larger than max_file_bytes",
+                path
+            )));
+        }
+        std::fs::read(&r.path).map_err(|e| io_error(path, e))
+    }
+
+    /// Create or replace a file, creating its parent directories
+    /// 创建或替换文件，并创建其父目录
+    pub fn write(&self, task_id: &str, path: &str, data: &[u8]) -> Result<(), FileError> {
+        let (cfg, r) = self.resolve(task_id, path)?;
+        if r.read_only {
+            return Err(FileError::ReadOnly(path.to_string()));
+        }
+        let Some(file_name) = r.path.file_name().filter(|_| r.path != r.root) else {
+            return Err(FileError::Invalid(format!("{} names a directory", path)));
+        };
+        if data.len() as u64 > cfg.max_file_bytes {
+            return Err(FileError::Invalid(format!(
+                "files must be at most {} bytes",
+                cfg.max_file_bytes
+            )));
+        }
+        if r.scratch {
+            let old = std::fs::metadata(&r.path).map(|m| m.len()).unwrap_or(0);
+            if dir_bytes(&r.root).saturating_sub(old) + data.len() as u64 > cfg.max_task_bytes {
+                return Err(FileError::Full);
+            }
+        }
+        if let Some(parent) = r.path.parent() {
+            std::fs::create_dir_all(parent).map_err(|e| io_error(path, e))?;
+        }
+        // Readers never see a partial file / 读取方不会看到写了一半的文件
+        let tmp = r
+            .path
+            .with_file_name(format!(".{}.tmp", file_name.to_string_lossy()));
+        std::fs::write(&tmp, data).map_err(|e| io_error(path, e))?;
+        std::fs::rename(&tmp, &r.path).map_err(|e| io_error(path, e))
+    }
+
+    /// Entries of a directory, by name; a task's empty scratch directory lists nothing
+    /// 目录中的条目，按名称排序；任务尚未使用的临时目录列表为空
+    pub fn list(&self, task_id: &str, path: &str) -> Result<Vec<FileEntry>, FileError> {
+        let (_, r) = self.resolve(task_id, path)?;
+        let entries = match std::fs::read_dir(&r.path) {
+            Ok(entries) => entries,
+            Err(e) if r.scratch && r.path == r.root && e.kind() == std::io::ErrorKind::NotFound => {
+                return Ok(Vec::new());
+            }
+            Err(e) => return Err(io_error(path, e)),
+        };
+        let mut out: Vec<FileEntry> = entries
+            .flatten()
+            .filter_map(|e| {
+                let meta = e.metadata().ok()?;
+                Some(FileEntry {
+                    name: e.file_name().to_string_lossy().into_owned(),
+                    size: if meta.is_dir() { 0 } else { meta.len() },
+                    dir: meta.is_dir(),
+                })
+            })
+            .collect();
+        out.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(out)
+    }
+
+    /// Remove a file, or a directory with everything in it / 删除文件，或删除目录及其全部内容
+    pub fn delete(&self, task_id: &str, path: &str) -> Result<(), FileError> {
+        let (_, r) = self.resolve(task_id, path)?;
+        if r.read_only {
+            return Err(FileError::ReadOnly(path.to_string()));
+        }
+        if r.path == r.root {
+            return Err(FileError::Invalid(format!("{} is the root", path)));
+        }
+        let meta = std::fs::symlink_metadata(&r.path).map_err(|e| io_error(path, e))?;
+        if meta.is_dir() {
+            std::fs::remove_dir_all(&r.path).map_err(|e| io_error(path, e))
+        } else {
+            std::fs::remove_file(&r.path).map_err(|e| io_error(path, e))
+        }
+    }
+
+    pub fn stats(&self) -> ScratchStats {
+        let (cfg, dir) = self.config.read().clone();
+        ScratchStats {
+            enabled: cfg.enabled,
+            dir: dir.display().to_string(),
+            mounts: cfg.mounts.iter().map(|m| m.name.clone()).collect(),
+            tasks: std::fs::read_dir(&dir).map(|d| d.count()).unwrap_or(0),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::config::SharedMountConfig;
+
+    fn files(dir: &Path, mounts: Vec<SharedMountConfig>) -> ScratchFiles {
+        ScratchFiles::new(
+            ScratchFilesConfig {
+                enabled: true,
+                max_task_bytes: 16,
+                mounts,
+                ..Default::default()
+            },
+            dir.join("scratch"),
+        )
+    }
+
+    #[test]
+    fn test_task_files_are_scoped() {
+        let dir = tempfile::tempdir().unwrap();
+        let f = files(dir.path(), Vec::new());
+        assert_eq!(f.list("task-a", "").unwrap(), Vec::new());
+        f.write("task-a", "out/speech.wav", b"RIFF").unwrap();
+        f.write("task-a", "/notes.txt", b"hi").unwrap();
+        assert_eq!(f.read("task-a", "out/speech.wav").unwrap(), b"RIFF");
+        assert_eq!(
+            f.read("task-b", "out/speech.wav"),
+            Err(FileError::NotFound("out/speech.wav".to_string()))
+        );
+        assert_eq!(
+            f.list("task-a", "/").unwrap(),
+            vec![
+                FileEntry {
+                    name: "notes.txt".to_string(),
+                    size: 2,
+                    dir: false
+                },
+                FileEntry {
+                    name: "out".to_string(),
+                    size: 0,
+                    dir: true
+                },
+            ]
+        );
+        assert!(matches!(
+            f.read("task-a", "out/../../x"),
+            Err(FileError::Invalid(_))
+        ));
+        assert_eq!(f.write("task-a", "big", &[0; 16]), Err(FileError::Full));
+        // Replacing a file only counts the difference / 替换文件只计算差值
+        f.write("task-a", "notes.txt", &[0; 12]).unwrap();
+
+        f.delete("task-a", "out").unwrap();
+        assert!(matches!(f.delete("task-a", ""), Err(FileError::Invalid(_))));
+        assert_eq!(f.stats().tasks, 1);
+        assert!(f.task_dir("task-a").unwrap().is_absolute());
+
+        f.set_config(Default::default(), dir.path().to_path_buf());
+        assert_eq!(f.read("task-a", "notes.txt"), Err(FileError::Disabled));
+    }
+
+    #[test]
+    fn test_shared_mounts() {
+        let dir = tempfile::tempdir().unwrap();
+        let shared = dir.path().join("shared");
+        let models = dir.path().join("models");
+        std::fs::create_dir_all(&models).unwrap();
+        std::fs::write(models.join("voice.onnx"), b"onnx").unwrap();
+        let f = files(
+            dir.path(),
+            vec![
+                SharedMountConfig {
+                    name: "shared".to_string(),
+                    path: shared.display().to_string(),
+                    read_only: false,
+                },
+                SharedMountConfig {
+                    name: "models".to_string(),
+                    path: models.display().to_string(),
+                    read_only: true,
+                },
+            ],
+        );
+        f.write("task-a", "/mnt/shared/img/cat.png", b"png")
+            .unwrap();
+        assert_eq!(f.read("task-b", "/mnt/shared/img/cat.png").unwrap(), b"png");
+        assert_eq!(f.read("task-b", "/mnt/models/voice.onnx").unwrap(), b"onnx");
+        assert_eq!(
+            f.write("task-a", "/mnt/models/x", b"x"),
+            Err(FileError::ReadOnly("/mnt/models/x".to_string()))
+        );
+        assert_eq!(
+            f.read("task-a", "/mnt/other/x"),
+            Err(FileError::NotFound("/mnt/other".to_string()))
+        );
+
+        #[cfg(unix)]
+        {
+            std::os::unix::fs::symlink(&models, shared.join("escape")).unwrap();
+            assert!(matches!(
+                f.read("task-a", "/mnt/shared/escape/voice.onnx"),
+                Err(FileError::Invalid(_))
+            ));
+        }
+    }
+}
@@ -0,0 +1,416 @@
+//! Service ports of long-lived workloads / 长期运行工作负载的服务端口
+//!
+//! A process workload that serves something of its own, such as an agent with a small web
+//! UI, lists port names in the task config key `service.ports` (`ui,api`). Each instance then
+//! gets a free port per name from `service_ports.port_min..=port_max`, passed in
+//! `SPEAR_PORT_<NAME>` together with the public base path in `SPEAR_SERVICE_BASE_<NAME>`. The
+//! gateway forwards `/v1/services/<task>/<name>/...` to the port behind the usual HTTP
+//! authentication, and the ports are released when the instance stops or the task is removed.
+//! 自身提供服务的进程工作负载（如带有小型 Web UI 的智能体）在任务配置键 `service.ports` 中列出端口
+//! 名称（`ui,api`）。每个实例随后为每个名称从 `service_ports.port_min..=port_max` 获得一个空闲端口，
+//! 通过 `SPEAR_PORT_<NAME>` 传入，公开的基础路径通过 `SPEAR_SERVICE_BASE_<NAME>` 传入。网关在常规
+//! HTTP 认证之后将 `/v1/services/<task>/<name>/...` 转发到该端口，实例停止或任务移除时释放端口。
+
+use std::collections::HashMap;
+use std::sync::OnceLock;
+use std::time::Duration;
+
+use axum::body::{Body, Bytes};
+use axum::http::{HeaderMap, HeaderName, HeaderValue, Method, StatusCode};
+use axum::response::{IntoResponse, Response};
+use parking_lot::{Mutex, RwLock};
+use serde::Serialize;
+
+use crate::spearlet::config::ServicePortsConfig;
+use crate::spearlet::http_error::{self, ApiError};
+
+/// Task config key listing the port names of a task / 列出任务端口名称的任务配置键
+pub const TASK_CONFIG_SERVICE_PORTS: &str = "service.ports";
+/// Path prefix the gateway forwards to service ports / 网关转发到服务端口的路径前缀
+pub const PATH_PREFIX: &str = "/v1/services/";
+/// Prefix of the variables holding each port / 保存各端口的环境变量前缀
+pub const ENV_PORT_PREFIX: &str = "SPEAR_PORT_";
+/// Prefix of the variables holding each public base path / 保存各公开基础路径的环境变量前缀
+pub const ENV_BASE_PREFIX: &str = "SPEAR_SERVICE_BASE_";
+
+/// Headers that belong to one connection and are not forwarded / 属于单个连接、不被转发的请求头
+const HOP_BY_HOP: &[&str] = &[
+    "connection",
+    "keep-alive",
+    "proxy-authenticate",
+    "proxy-authorization",
+    "te",
+    "trailer",
+    "transfer-encoding",
+    "upgrade",
+    "host",
+    "content-length",
+];
+
+/// Gateway credentials, which the workload must not see / 网关凭证，不应被工作负载看到
+const CREDENTIAL_HEADERS: &[&str] = &["authorization", "x-api-key"];
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum ServicePortError {
+    #[error("service ports are disabled")]
+    Disabled,
+    #[error("invalid service.ports: {0}")]
+    Invalid(String),
+    #[error("no free port left in the service port range")]
+    Exhausted,
+}
+
+/// A port held by one instance of a task / 任务某个实例占用的端口
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct ServiceBinding {
+    pub task_id: String,
+    pub instance_id: String,
+    pub name: String,
+    pub host: String,
+    pub port: u16,
+}
+
+impl ServiceBinding {
+    /// Public path the gateway serves the port under / 网关提供该端口服务的公开路径
+    pub fn base_path(&self) -> String {
+        format!("{}{}/{}", PATH_PREFIX, self.task_id, self.name)
+    }
+}
+
+/// Port names from `service.ports`; empty when the key is missing
+/// 来自 `service.ports` 的端口名称；未设置该键时为空
+pub fn port_names(task_config: &HashMap<String, String>) -> Result<Vec<String>, ServicePortError> {
+    let Some(raw) = task_config.get(TASK_CONFIG_SERVICE_PORTS) else {
+        return Ok(Vec::new());
+    };
+    let mut names: Vec<String> = Vec::new();
+    for name in raw.split(',').map(str::trim).filter(|n| !n.is_empty()) {
+        let valid = name
+            .chars()
+            .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '_' || c == '-');
+        if !valid {
+            return Err(ServicePortError::Invalid(format!(
+                "{:?} may only hold a-z, 0-9, '_' and '-'",
+                name
+            )));
+        }
+        if names.iter().any(|n| n == name) {
+            return Err(ServicePortError::Invalid(format!(
+                "{:?} is listed twice",
+                name
+            )));
+        }
+        names.push(name.to_string());
+    }
+    Ok(names)
+}
+
+/// Variables telling the workload its ports and base paths / 告知工作负载其端口与基础路径的环境变量
+pub fn environment(bindings: &[ServiceBinding]) -> Vec<(String, String)> {
+    let mut env = Vec::new();
+    for b in bindings {
+        let key = b.name.to_ascii_uppercase().replace('-', "_");
+        env.push((format!("{}{}", ENV_PORT_PREFIX, key), b.port.to_string()));
+        env.push((format!("{}{}", ENV_BASE_PREFIX, key), b.base_path()));
+    }
+    env
+}
+
+/// Ports handed out to instances / 分配给实例的端口
+pub struct ServicePorts {
+    /// Bindings by instance id / 按实例 ID 记录的绑定
+    bindings: RwLock<HashMap<String, Vec<ServiceBinding>>>,
+    /// Where the next search for a free port starts / 下一次查找空闲端口的起点
+    cursor: Mutex<u16>,
+}
+
+impl Default for ServicePorts {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl ServicePorts {
+    pub fn new() -> Self {
+        Self {
+            bindings: RwLock::new(HashMap::new()),
+            cursor: Mutex::new(0),
+        }
+    }
+
+    /// Reserve a port for each name for an instance / 为实例的每个名称预留一个端口
+    ///
+    /// A port is free when no instance holds it and it can be bound on `bind_host`. Ports
+    /// are searched from where the last search stopped, so a port an instance just gave up
+    /// is not handed out again right away.
+    /// 端口在未被任何实例占用且可在 `bind_host` 上绑定时视为空闲。查找从上次结束的位置继续，因此
+    /// 实例刚释放的端口不会立即再次分配。
+    pub fn allocate(
+        &self,
+        cfg: &ServicePortsConfig,
+        task_id: &str,
+        instance_id: &str,
+        names: &[String],
+    ) -> Result<Vec<ServiceBinding>, ServicePortError> {
+        if names.is_empty() {
+            return Ok(Vec::new());
+        }
+        if !cfg.enabled {
+            return Err(ServicePortError::Disabled);
+        }
+        if names.len() > cfg.max_ports_per_task {
+            return Err(ServicePortError::Invalid(format!(
+                "{} ports listed, max_ports_per_task is {}",
+                names.len(),
+                cfg.max_ports_per_task
+            )));
+        }
+        let (min, max) = (cfg.port_min, cfg.port_max);
+        if min == 0 || max < min {
+            return Err(ServicePortError::Exhausted);
+        }
+        let span = u32::from(max - min) + 1;
+
+        let mut bindings = self.bindings.write();
+        let mut cursor = self.cursor.lock();
+        let mut taken: Vec<u16> = bindings.values().flatten().map(|b| b.port).collect();
+        let mut out = Vec::with_capacity(names.len());
+        for name in names {
+            let mut found = None;
+            for step in 0..span {
+                let port = min + ((u32::from(*cursor) + step) % span) as u16;
+                if !taken.contains(&port)
+                    && std::net::TcpListener::bind((cfg.bind_host.as_str(), port)).is_ok()
+                {
+                    *cursor = ((u32::from(port - min) + 1) % span) as u16;
+                    found = Some(port);
+                    break;
+                }
+            }
+            let port = found.ok_or(ServicePortError::Exhausted)?;
+            taken.push(port);
+            out.push(ServiceBinding {
+                task_id: task_id.to_string(),
+                instance_id: instance_id.to_string(),
+                name: name.clone(),
+                host: cfg.bind_host.clone(),
+                port,
+            });
+        }
+        bindings.insert(instance_id.to_string(), out.clone());
+        Ok(out)
+    }
+
+    /// Give up the ports of an instance / 释放实例的端口
+    pub fn release_instance(&self, instance_id: &str) -> usize {
+        self.bindings
+            .write()
+            .remove(instance_id)
+            .map_or(0, |b| b.len())
+    }
+
+    /// Give up the ports of every instance of a task / 释放任务所有实例的端口
+    pub fn release_task(&self, task_id: &str) -> usize {
+        let mut bindings = self.bindings.write();
+        let before: usize = bindings.values().map(Vec::len).sum();
+        bindings.retain(|_, b| b.first().map_or(true, |b| b.task_id != task_id));
+        before - bindings.values().map(Vec::len).sum::<usize>()
+    }
+
+    /// Port a request for `task_id`'s `name` goes to; the first instance when there are several
+    /// `task_id` 的 `name` 请求所转发到的端口；有多个实例时取第一个
+    pub fn target(&self, task_id: &str, name: &str) -> Option<ServiceBinding> {
+        let bindings = self.bindings.read();
+        let mut matches: Vec<&ServiceBinding> = bindings
+            .values()
+            .flatten()
+            .filter(|b| b.task_id == task_id && b.name == name)
+            .collect();
+        matches.sort_by(|a, b| a.instance_id.cmp(&b.instance_id));
+        matches.first().map(|b| (*b).clone())
+    }
+
+    /// All bindings, by task and name / 全部绑定，按任务与名称排序
+    pub fn list(&self) -> Vec<ServiceBinding> {
+        let mut out: Vec<ServiceBinding> =
+            self.bindings.read().values().flatten().cloned().collect();
+        out.sort_by(|a, b| {
+            (&a.task_id, &a.name, &a.instance_id).cmp(&(&b.task_id, &b.name, &b.instance_id))
+        });
+        out
+    }
+}
+
+fn client() -> &'static reqwest::Client {
+    static CLIENT: OnceLock<reqwest::Client> = OnceLock::new();
+    CLIENT.get_or_init(|| {
+        reqwest::Client::builder()
+            .redirect(reqwest::redirect::Policy::none())
+            .build()
+            .unwrap_or_default()
+    })
+}
+
+fn error_response(status: StatusCode, message: String) -> Response {
+    ApiError::new(status, &http_error::status_code_name(status), message).into_response()
+}
+
+/// Forward a request to a service port and stream the answer back
+/// 将请求转发到服务端口并以流式返回应答
+///
+/// `path_and_query` is the part after the binding's base path. `strip` names extra request
+/// headers to drop besides hop-by-hop headers and gateway credentials.
+/// `path_and_query` 为绑定基础路径之后的部分。`strip` 指定除逐跳请求头与网关凭证之外额外丢弃的请求头。
+pub async fn forward(
+    binding: &ServiceBinding,
+    timeout: Duration,
+    method: &Method,
+    path_and_query: &str,
+    headers: &HeaderMap,
+    strip: &[&str],
+    body: Bytes,
+) -> Response {
+    let url = format!(
+        "http://{}:{}/{}",
+        binding.host,
+        binding.port,
+        path_and_query.trim_start_matches('/')
+    );
+    let Ok(method) = reqwest::Method::from_bytes(method.as_str().as_bytes()) else {
+        return error_response(StatusCode::METHOD_NOT_ALLOWED, "invalid method".to_string());
+    };
+    let mut req = client().request(method, url.as_str()).timeout(timeout);
+    for (k, v) in headers {
+        let name = k.as_str();
+        if HOP_BY_HOP.contains(&name)
+            || CREDENTIAL_HEADERS.contains(&name)
+            || strip.iter().any(|s| s.eq_ignore_ascii_case(name))
+        {
+            continue;
+        }
+        req = req.header(name, v.as_bytes());
+    }
+    req = req
+        .header("x-forwarded-prefix", binding.base_path())
+        .body(body.to_vec());
+
+    let resp = match req.send().await {
+        Ok(r) => r,
+        Err(e) if e.is_timeout() => {
+            return error_response(
+                StatusCode::GATEWAY_TIMEOUT,
+                format!("service {} timed out", binding.name),
+            )
+        }
+        Err(e) => {
+            return error_response(
+                StatusCode::BAD_GATEWAY,
+                format!("service {} unreachable: {}", binding.name, e),
+            )
+        }
+    };
+    let status = StatusCode::from_u16(resp.status().as_u16()).unwrap_or(StatusCode::BAD_GATEWAY);
+    let mut out_headers = HeaderMap::new();
+    for (k, v) in resp.headers() {
+        if HOP_BY_HOP.contains(&k.as_str()) {
+            continue;
+        }
+        if let (Ok(k), Ok(v)) = (
+            HeaderName::from_bytes(k.as_str().as_bytes()),
+            HeaderValue::from_bytes(v.as_bytes()),
+        ) {
+            out_headers.append(k, v);
+        }
+    }
+    let mut response = Body::from_stream(resp.bytes_stream()).into_response();
+    *response.status_mut() = status;
+    *response.headers_mut() = out_headers;
+    response
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn config(port_min: u16, port_max: u16) -> ServicePortsConfig {
+        ServicePortsConfig {
+            port_min,
+            port_max,
+            ..Default::default()
+        }
+    }
+
+    fn names(list: &[&str]) -> Vec<String> {
+        list.iter().map(|n| n.to_string()).collect()
+    }
+
+    #[test]
+    fn test_port_names() {
+        let mut tc = HashMap::new();
+        assert!(port_names(&tc).unwrap().is_empty());
+        tc.insert(
+            TASK_CONFIG_SERVICE_PORTS.to_string(),
+            " ui, api ,".to_string(),
+        );
+        assert_eq!(port_names(&tc).unwrap(), names(&["ui", "api"]));
+        tc.insert(TASK_CONFIG_SERVICE_PORTS.to_string(), "ui,ui".to_string());
+        assert!(port_names(&tc).is_err());
+        tc.insert(TASK_CONFIG_SERVICE_PORTS.to_string(), "Web UI".to_string());
+        assert!(port_names(&tc).is_err());
+    }
+
+    #[test]
+    fn test_allocate_route_and_release() {
+        let ports = ServicePorts::new();
+        // Keep one port of the range busy / 占用范围内的一个端口
+        let busy = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let busy_port = busy.local_addr().unwrap().port();
+        let cfg = config(
+            busy_port.saturating_sub(1).max(1),
+            busy_port.saturating_add(2),
+        );
+
+        let a = ports
+            .allocate(&cfg, "agent", "i1", &names(&["ui", "api"]))
+            .unwrap();
+        assert_eq!(a.len(), 2);
+        assert!(a.iter().all(|b| b.port != busy_port));
+        assert_ne!(a[0].port, a[1].port);
+        assert_eq!(ports.target("agent", "ui").unwrap().port, a[0].port);
+        assert_eq!(a[0].base_path(), "/v1/services/agent/ui");
+
+        let env = environment(&a);
+        assert!(env.contains(&("SPEAR_PORT_UI".to_string(), a[0].port.to_string())));
+        assert!(env.contains(&(
+            "SPEAR_SERVICE_BASE_API".to_string(),
+            "/v1/services/agent/api".to_string()
+        )));
+
+        assert_eq!(
+            ports.allocate(&cfg, "other", "i2", &names(&["ui", "api"])),
+            Err(ServicePortError::Exhausted)
+        );
+        assert_eq!(ports.release_task("agent"), 2);
+        assert!(ports.target("agent", "ui").is_none());
+        assert!(ports.allocate(&cfg, "other", "i2", &names(&["ui"])).is_ok());
+        assert_eq!(ports.release_instance("i2"), 1);
+        assert!(ports.list().is_empty());
+    }
+
+    #[test]
+    fn test_allocate_limits() {
+        let ports = ServicePorts::new();
+        let mut cfg = config(20000, 20010);
+        cfg.max_ports_per_task = 1;
+        assert!(matches!(
+            ports.allocate(&cfg, "t", "i", &names(&["a", "b"])),
+            Err(ServicePortError::Invalid(_))
+        ));
+        cfg.enabled = false;
+        assert_eq!(
+            ports.allocate(&cfg, "t", "i", &names(&["a"])),
+            Err(ServicePortError::Disabled)
+        );
+        assert!(ports.allocate(&cfg, "t", "i", &[]).unwrap().is_empty());
+    }
+}
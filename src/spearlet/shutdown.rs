@@ -0,0 +1,110 @@
+//! Graceful shutdown helpers for the spearlet server
+//! spearlet 服务的优雅关闭辅助
+//!
+//! The server waits for SIGINT or SIGTERM, then drains HTTP and gRPC connections
+//! and stops workload instances within `shutdown_timeout_ms`. A second signal
+//! during shutdown exits immediately.
+//! 服务等待 SIGINT 或 SIGTERM，然后在 `shutdown_timeout_ms` 内排空 HTTP 与 gRPC 连接并
+//! 停止工作负载实例。关闭过程中再次收到信号则立即退出。
+
+use std::future::Future;
+use std::time::Duration;
+
+use tokio::time::Instant;
+
+/// Exit code used when a second signal forces the exit / 再次收到信号强制退出时的退出码
+pub const FORCED_EXIT_CODE: i32 = 130;
+
+/// Wait for SIGINT (Ctrl-C) or SIGTERM, returning the signal name
+/// 等待 SIGINT（Ctrl-C）或 SIGTERM，返回信号名
+pub async fn wait_for_signal() -> &'static str {
+    #[cfg(unix)]
+    {
+        use tokio::signal::unix::{signal, SignalKind};
+        match signal(SignalKind::terminate()) {
+            Ok(mut term) => {
+                tokio::select! {
+                    _ = tokio::signal::ctrl_c() => "SIGINT",
+                    _ = term.recv() => "SIGTERM",
+                }
+            }
+            Err(e) => {
+                tracing::warn!(error = %e, "SIGTERM handler unavailable, waiting for Ctrl-C only");
+                let _ = tokio::signal::ctrl_c().await;
+                "SIGINT"
+            }
+        }
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = tokio::signal::ctrl_c().await;
+        "SIGINT"
+    }
+}
+
+/// Exit the process on the next signal / 下一次收到信号时退出进程
+pub fn exit_on_second_signal() {
+    tokio::spawn(async {
+        let sig = wait_for_signal().await;
+        tracing::warn!(
+            signal = sig,
+            "Second signal received, exiting without cleanup"
+        );
+        std::process::exit(FORCED_EXIT_CODE);
+    });
+}
+
+/// Shared deadline for the shutdown steps / 关闭各步骤共享的截止时间
+#[derive(Debug, Clone, Copy)]
+pub struct ShutdownDeadline {
+    deadline: Instant,
+}
+
+impl ShutdownDeadline {
+    pub fn new(timeout: Duration) -> Self {
+        Self {
+            deadline: Instant::now() + timeout,
+        }
+    }
+
+    /// Run a step until the deadline; `None` if it did not finish in time
+    /// 在截止时间前运行一个步骤；未按时完成时返回 `None`
+    pub async fn run<F: Future>(&self, step: &str, fut: F) -> Option<F::Output> {
+        match tokio::time::timeout_at(self.deadline, fut).await {
+            Ok(v) => Some(v),
+            Err(_) => {
+                tracing::warn!(step, "Shutdown step did not finish before the deadline");
+                None
+            }
+        }
+    }
+
+    pub fn remaining(&self) -> Duration {
+        self.deadline.saturating_duration_since(Instant::now())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test(start_paused = true)]
+    async fn test_deadline_is_shared_across_steps() {
+        let d = ShutdownDeadline::new(Duration::from_millis(100));
+        assert_eq!(
+            d.run("fast", async {
+                tokio::time::sleep(Duration::from_millis(60)).await;
+                1
+            })
+            .await,
+            Some(1)
+        );
+        assert!(d.remaining() <= Duration::from_millis(40));
+        assert_eq!(
+            d.run("slow", tokio::time::sleep(Duration::from_millis(60)))
+                .await,
+            None
+        );
+        assert_eq!(d.remaining(), Duration::ZERO);
+    }
+}
@@ -0,0 +1,551 @@
+//! Multiplexed user streams over one WebSocket
+//! 单个 WebSocket 上的多路 user stream
+//!
+//! `GET /api/v1/streams/ws` carries the user streams of several executions on one
+//! connection. Every data message names its execution, so a client can run many
+//! concurrent streaming invocations without opening a socket per execution:
+//! `GET /api/v1/streams/ws` 在一个连接上承载多个执行的 user stream。每条数据消息都带有
+//! 所属执行，客户端无需为每个执行单独建连即可并发运行多个流式调用：
+//!
+//! - binary: `u16` big-endian id length, the execution id, then one SSF frame
+//!   二进制：`u16` 大端 ID 长度、执行 ID，随后是一个 SSF 帧
+//! - text: JSON control messages tagged by `op` ([`MuxControl`], [`MuxEvent`])
+//!   文本：以 `op` 区分的 JSON 控制消息（[`MuxControl`]、[`MuxEvent`]）
+//!
+//! Closing one execution (by the client, or because it finished) leaves the others
+//! and the connection untouched; closing the connection closes them all.
+//! 关闭某个执行（客户端主动或执行结束）不影响其他执行与连接；关闭连接则关闭全部执行。
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::Duration;
+
+use axum::extract::ws::{Message, WebSocket};
+use futures::StreamExt;
+use serde::{Deserialize, Serialize};
+use tokio::sync::mpsc;
+use tokio::task::JoinHandle;
+
+use crate::proto::spearlet::{
+    execution_service_client::ExecutionServiceClient,
+    invocation_service_client::InvocationServiceClient, ExecutionMode, InvokeRequest,
+};
+use crate::spearlet::clock;
+use crate::spearlet::config::WebSocketConfig;
+use crate::spearlet::exec_stream::{self, ExecOutcome};
+use crate::spearlet::execution::host_api::UserStreams;
+use crate::spearlet::function_service::FunctionServiceImpl;
+use crate::spearlet::grpc_auth::LocalChannel;
+use crate::spearlet::ws_keepalive::{self, Keepalive, KeepaliveEvent};
+
+/// WebSocket subprotocol / WebSocket 子协议
+pub const MUX_SUBPROTOCOL: &str = "spear.stream.mux.v1";
+
+const STATUS_POLL_INTERVAL: Duration = Duration::from_millis(250);
+
+/// Client → spearlet control message / 客户端 → spearlet 控制消息
+#[derive(Debug, Clone, PartialEq, Deserialize)]
+#[serde(tag = "op", rename_all = "snake_case")]
+pub enum MuxControl {
+    /// Start an invocation with its streams bound to this connection
+    /// 启动一次调用，并将其流绑定到本连接
+    Exec {
+        /// Client correlation id echoed in the reply / 在回复中回显的客户端关联 ID
+        #[serde(rename = "ref", default)]
+        ref_id: Option<String>,
+        workload: String,
+        #[serde(default)]
+        method: Option<String>,
+        #[serde(default)]
+        payload: Option<serde_json::Value>,
+        #[serde(default)]
+        metadata: HashMap<String, String>,
+        #[serde(default)]
+        stream_id: Option<u32>,
+        #[serde(default)]
+        timeout_ms: Option<u64>,
+        #[serde(default)]
+        session_id: Option<String>,
+    },
+    /// Bind an execution started elsewhere (e.g. `POST /v1/exec`)
+    /// 绑定在其他地方启动的执行（如 `POST /v1/exec`）
+    Attach { execution_id: String },
+    /// Release one execution's streams / 释放某个执行的流
+    Close { execution_id: String },
+}
+
+/// Spearlet → client control message / spearlet → 客户端控制消息
+#[derive(Debug, Clone, PartialEq, Serialize)]
+#[serde(tag = "op", rename_all = "snake_case")]
+pub enum MuxEvent {
+    Started {
+        #[serde(rename = "ref", skip_serializing_if = "Option::is_none")]
+        ref_id: Option<String>,
+        execution_id: String,
+        /// Correlation ID of the invocation's logs / 该调用日志的关联 ID
+        request_id: String,
+    },
+    Attached {
+        execution_id: String,
+    },
+    /// The execution finished; `result` matches the SSE `done` event
+    /// 执行结束；`result` 与 SSE `done` 事件一致
+    Done {
+        execution_id: String,
+        result: serde_json::Value,
+    },
+    Closed {
+        execution_id: String,
+        reason: String,
+    },
+    Error {
+        #[serde(rename = "ref", skip_serializing_if = "Option::is_none")]
+        ref_id: Option<String>,
+        #[serde(skip_serializing_if = "Option::is_none")]
+        execution_id: Option<String>,
+        message: String,
+    },
+}
+
+impl MuxEvent {
+    fn message(&self) -> Message {
+        let mut v = serde_json::to_value(self).unwrap_or_default();
+        clock::stamp(&mut v);
+        Message::Text(v.to_string().into())
+    }
+}
+
+/// Prefix an SSF frame with its execution id / 为 SSF 帧加上执行 ID 前缀
+pub fn encode_data(execution_id: &str, frame: &[u8]) -> Vec<u8> {
+    let id = execution_id.as_bytes();
+    let mut out = Vec::with_capacity(2 + id.len() + frame.len());
+    out.extend_from_slice(&(id.len() as u16).to_be_bytes());
+    out.extend_from_slice(id);
+    out.extend_from_slice(frame);
+    out
+}
+
+/// Split a data message into execution id and SSF frame / 将数据消息拆分为执行 ID 与 SSF 帧
+pub fn decode_data(msg: &[u8]) -> Result<(&str, &[u8]), String> {
+    if msg.len() < 2 {
+        return Err("data message too short".to_string());
+    }
+    let n = u16::from_be_bytes([msg[0], msg[1]]) as usize;
+    let id = msg
+        .get(2..2 + n)
+        .ok_or_else(|| "execution id truncated".to_string())?;
+    let id = std::str::from_utf8(id).map_err(|_| "execution id is not UTF-8".to_string())?;
+    if id.is_empty() {
+        return Err("empty execution id".to_string());
+    }
+    Ok((id, &msg[2 + n..]))
+}
+
+/// Services the mux needs to start invocations / 多路复用启动调用所需的服务
+#[derive(Clone)]
+pub struct MuxContext {
+    pub invocation_client: InvocationServiceClient<LocalChannel>,
+    pub execution_client: ExecutionServiceClient<LocalChannel>,
+    pub function_service: Arc<FunctionServiceImpl>,
+    /// User streams of this spearlet's executions / 本 spearlet 各执行的 user stream
+    pub streams: Arc<UserStreams>,
+    /// Inbound `traceparent`, forwarded to started invocations / 入站 `traceparent`，转发给启动的调用
+    pub traceparent: Option<String>,
+    /// Keepalive settings / 保活设置
+    pub ws: WebSocketConfig,
+}
+
+/// Serve one multiplexed connection / 服务一个多路复用连接
+pub async fn run(socket: WebSocket, ctx: MuxContext) {
+    let (ws_tx, mut ws_rx) = socket.split();
+    let (out_tx, mut out_rx) = mpsc::unbounded_channel::<Message>();
+    let (sink_tx, sink_rx) = mpsc::unbounded_channel::<Message>();
+    let (fin_tx, mut fin_rx) = mpsc::unbounded_channel::<String>();
+    let mut forwarders: HashMap<String, JoinHandle<()>> = HashMap::new();
+    let mut writer = ws_keepalive::spawn_writer(ws_tx, sink_rx, &ctx.ws);
+    let mut keepalive = Keepalive::new(&ctx.ws);
+
+    loop {
+        let deadline = keepalive.deadline();
+        tokio::select! {
+            msg = ws_rx.next() => {
+                let Some(Ok(msg)) = msg else {
+                    break;
+                };
+                keepalive.received(!matches!(msg, Message::Ping(_) | Message::Pong(_)));
+                match msg {
+                    Message::Binary(data) => handle_data(&ctx, &data, &mut forwarders, &out_tx),
+                    Message::Text(text) => {
+                        handle_control(&ctx, &text, &mut forwarders, &out_tx, &fin_tx).await;
+                    }
+                    Message::Ping(p) => {
+                        let _ = out_tx.send(Message::Pong(p));
+                    }
+                    Message::Close(_) => break,
+                    _ => {}
+                }
+            }
+            Some(msg) = out_rx.recv() => {
+                if matches!(msg, Message::Binary(_)) {
+                    keepalive.sent_data();
+                }
+                let _ = sink_tx.send(msg);
+            }
+            Some(id) = fin_rx.recv() => {
+                forwarders.remove(&id);
+            }
+            _ = ws_keepalive::wait_until(deadline) => {
+                if !on_keepalive(&ctx, &mut keepalive, &forwarders, &sink_tx).await {
+                    break;
+                }
+            }
+            _ = &mut writer => {
+                break;
+            }
+        }
+    }
+
+    let ids: Vec<String> = forwarders.keys().cloned().collect();
+    for id in ids {
+        close_one(&ctx, &mut forwarders, &id);
+    }
+    drop(sink_tx);
+    if !writer.is_finished() {
+        let _ = writer.await;
+    }
+}
+
+/// Run due keepalive checks; false ends the connection / 执行到期的保活检查；返回 false 时结束连接
+async fn on_keepalive(
+    ctx: &MuxContext,
+    keepalive: &mut Keepalive,
+    forwarders: &HashMap<String, JoinHandle<()>>,
+    sink_tx: &mpsc::UnboundedSender<Message>,
+) -> bool {
+    let Some(event) = keepalive.poll() else {
+        return true;
+    };
+    if ws_keepalive::handle(event, sink_tx) {
+        return true;
+    }
+    if event == KeepaliveEvent::IdleTimeout && ctx.ws.terminate_on_idle {
+        let mgr = ctx.function_service.get_execution_manager();
+        for id in forwarders.keys() {
+            let _ = mgr
+                .terminate_execution(id, Some("websocket idle timeout".to_string()))
+                .await;
+        }
+    }
+    false
+}
+
+fn handle_data(
+    ctx: &MuxContext,
+    data: &[u8],
+    forwarders: &mut HashMap<String, JoinHandle<()>>,
+    out_tx: &mpsc::UnboundedSender<Message>,
+) {
+    let (id, frame) = match decode_data(data) {
+        Ok(v) => v,
+        Err(message) => {
+            let _ = out_tx.send(
+                MuxEvent::Error {
+                    ref_id: None,
+                    execution_id: None,
+                    message,
+                }
+                .message(),
+            );
+            return;
+        }
+    };
+    if !forwarders.contains_key(id) {
+        let _ = out_tx.send(
+            MuxEvent::Error {
+                ref_id: None,
+                execution_id: Some(id.to_string()),
+                message: "execution not open on this connection".to_string(),
+            }
+            .message(),
+        );
+        return;
+    }
+    let rc = ctx.streams.ws_push_frame(id, frame.to_vec());
+    if rc < 0 {
+        let id = id.to_string();
+        close_one(ctx, forwarders, &id);
+        let _ = out_tx.send(
+            MuxEvent::Closed {
+                execution_id: id,
+                reason: format!("push failed: {}", rc),
+            }
+            .message(),
+        );
+    }
+}
+
+async fn handle_control(
+    ctx: &MuxContext,
+    text: &str,
+    forwarders: &mut HashMap<String, JoinHandle<()>>,
+    out_tx: &mpsc::UnboundedSender<Message>,
+    fin_tx: &mpsc::UnboundedSender<String>,
+) {
+    let ctl: MuxControl = match serde_json::from_str(text) {
+        Ok(c) => c,
+        Err(e) => {
+            let _ = out_tx.send(
+                MuxEvent::Error {
+                    ref_id: None,
+                    execution_id: None,
+                    message: format!("invalid control message: {}", e),
+                }
+                .message(),
+            );
+            return;
+        }
+    };
+    match ctl {
+        MuxControl::Exec {
+            ref_id,
+            workload,
+            method,
+            payload,
+            mut metadata,
+            stream_id,
+            timeout_ms,
+            session_id,
+        } => {
+            let mgr = ctx.function_service.get_execution_manager();
+            let task_id = mgr
+                .find_task(workload.trim())
+                .map(|t| t.id.clone())
+                .unwrap_or_else(|| workload.trim().to_string());
+            let execution_id = uuid::Uuid::new_v4().to_string();
+            exec_stream::attach(
+                &ctx.streams,
+                &execution_id,
+                stream_id.unwrap_or(exec_stream::DEFAULT_STREAM_ID),
+            );
+            if let Some(tp) = ctx.traceparent.as_ref() {
+                metadata.insert(
+                    crate::spearlet::otel::TRACEPARENT_KEY.to_string(),
+                    tp.clone(),
+                );
+            }
+            // Each invocation gets its own ID; a client-supplied one is kept
+            // 每个调用拥有自己的 ID；保留客户端提供的 ID
+            let rid = crate::spearlet::request_id::ensure(&mut metadata);
+            let req = InvokeRequest {
+                invocation_id: String::new(),
+                execution_id: execution_id.clone(),
+                task_id,
+                function_name: method.unwrap_or_default(),
+                input: Some(crate::spearlet::http_gateway::v1_exec_payload(payload)),
+                headers: HashMap::new(),
+                environment: HashMap::new(),
+                timeout_ms: timeout_ms.unwrap_or(0),
+                session_id: session_id.unwrap_or_default(),
+                mode: ExecutionMode::Async as i32,
+                force_new_instance: false,
+                metadata,
+            };
+            let mut client = ctx.invocation_client.clone();
+            match client.invoke(req).await {
+                Ok(r) => {
+                    let r = r.into_inner();
+                    let initial = ExecOutcome {
+                        status: r.status,
+                        output: r.output,
+                        error: r.error,
+                    };
+                    let _ = out_tx.send(
+                        MuxEvent::Started {
+                            ref_id,
+                            execution_id: execution_id.clone(),
+                            request_id: rid,
+                        }
+                        .message(),
+                    );
+                    open_one(ctx, forwarders, out_tx, fin_tx, execution_id, Some(initial));
+                }
+                Err(e) => {
+                    exec_stream::detach(&ctx.streams, &execution_id);
+                    let _ = out_tx.send(
+                        MuxEvent::Error {
+                            ref_id,
+                            execution_id: None,
+                            message: e.message().to_string(),
+                        }
+                        .message(),
+                    );
+                }
+            }
+        }
+        MuxControl::Attach { execution_id } => {
+            if ctx.streams.get(&execution_id).is_none() {
+                let _ = out_tx.send(
+                    MuxEvent::Error {
+                        ref_id: None,
+                        execution_id: Some(execution_id),
+                        message: "no user stream for execution".to_string(),
+                    }
+                    .message(),
+                );
+                return;
+            }
+            let _ = out_tx.send(
+                MuxEvent::Attached {
+                    execution_id: execution_id.clone(),
+                }
+                .message(),
+            );
+            open_one(ctx, forwarders, out_tx, fin_tx, execution_id, None);
+        }
+        MuxControl::Close { execution_id } => {
+            if close_one(ctx, forwarders, &execution_id) {
+                let _ = out_tx.send(
+                    MuxEvent::Closed {
+                        execution_id,
+                        reason: "client".to_string(),
+                    }
+                    .message(),
+                );
+            }
+        }
+    }
+}
+
+fn open_one(
+    ctx: &MuxContext,
+    forwarders: &mut HashMap<String, JoinHandle<()>>,
+    out_tx: &mpsc::UnboundedSender<Message>,
+    fin_tx: &mpsc::UnboundedSender<String>,
+    execution_id: String,
+    initial: Option<ExecOutcome>,
+) {
+    if forwarders.contains_key(&execution_id) {
+        return;
+    }
+    let task = crate::spearlet::crash::spawn(
+        "stream-mux",
+        forward(
+            ctx.streams.clone(),
+            execution_id.clone(),
+            initial,
+            ctx.execution_client.clone(),
+            out_tx.clone(),
+            fin_tx.clone(),
+        ),
+    );
+    forwarders.insert(execution_id, task);
+}
+
+fn close_one(
+    ctx: &MuxContext,
+    forwarders: &mut HashMap<String, JoinHandle<()>>,
+    execution_id: &str,
+) -> bool {
+    let Some(task) = forwarders.remove(execution_id) else {
+        return false;
+    };
+    task.abort();
+    exec_stream::detach(&ctx.streams, execution_id);
+    true
+}
+
+/// Forward one execution's outbound frames until it ends / 转发单个执行的出站帧直到其结束
+async fn forward(
+    streams: Arc<UserStreams>,
+    execution_id: String,
+    initial: Option<ExecOutcome>,
+    mut client: ExecutionServiceClient<LocalChannel>,
+    out_tx: mpsc::UnboundedSender<Message>,
+    fin_tx: mpsc::UnboundedSender<String>,
+) {
+    let mut outcome = initial.filter(|o| o.is_terminal());
+    let mut had_hub = false;
+    let mut poll = tokio::time::interval(STATUS_POLL_INTERVAL);
+    loop {
+        while let Some(frame) = streams.ws_pop_any_outbound(&execution_id) {
+            let msg = Message::Binary(encode_data(&execution_id, &frame).into());
+            if out_tx.send(msg).is_err() {
+                return;
+            }
+        }
+        let hub = streams.get(&execution_id).is_some();
+        had_hub |= hub;
+        if let Some(o) = outcome.take() {
+            let _ = out_tx.send(
+                MuxEvent::Done {
+                    execution_id: execution_id.clone(),
+                    result: o.to_json(&execution_id),
+                }
+                .message(),
+            );
+            break;
+        }
+        if had_hub && !hub {
+            break;
+        }
+        tokio::select! {
+            _ = streams.ws_wait_any_outbound(&execution_id) => {}
+            _ = poll.tick() => {
+                outcome = exec_stream::poll_outcome(&mut client, &execution_id).await;
+            }
+        }
+    }
+    exec_stream::detach(&streams, &execution_id);
+    let _ = out_tx.send(
+        MuxEvent::Closed {
+            execution_id: execution_id.clone(),
+            reason: "completed".to_string(),
+        }
+        .message(),
+    );
+    let _ = fin_tx.send(execution_id);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_data_round_trip() {
+        let frame =
+            crate::spearlet::execution::host_api::ssf::build_ssf_v1_frame(1, 2, b"{}", b"hi");
+        let msg = encode_data("exec-1", &frame);
+        let (id, f) = decode_data(&msg).unwrap();
+        assert_eq!(id, "exec-1");
+        assert_eq!(f, frame.as_slice());
+        assert!(decode_data(&[0]).is_err());
+        assert!(decode_data(&[0, 9, b'a']).is_err());
+        assert!(decode_data(&[0, 0]).is_err());
+    }
+
+    #[test]
+    fn test_control_messages() {
+        let c: MuxControl =
+            serde_json::from_str(r#"{"op":"exec","ref":"a","workload":"chat","payload":{"q":1}}"#)
+                .unwrap();
+        assert!(matches!(c, MuxControl::Exec { ref ref_id, .. } if ref_id.as_deref() == Some("a")));
+        let c: MuxControl = serde_json::from_str(r#"{"op":"close","execution_id":"e1"}"#).unwrap();
+        assert_eq!(
+            c,
+            MuxControl::Close {
+                execution_id: "e1".to_string()
+            }
+        );
+        assert!(serde_json::from_str::<MuxControl>(r#"{"op":"nope"}"#).is_err());
+
+        let v = serde_json::to_value(MuxEvent::Closed {
+            execution_id: "e1".to_string(),
+            reason: "client".to_string(),
+        })
+        .unwrap();
+        assert_eq!(
+            v,
+            serde_json::json!({"op": "closed", "execution_id": "e1", "reason": "client"})
+        );
+    }
+}
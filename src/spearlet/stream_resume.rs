@@ -0,0 +1,393 @@
+//! Resumption of dropped user-stream WebSockets
+//! 断开的 user stream WebSocket 的会话恢复
+//!
+//! `GET /api/v1/executions/{execution_id}/streams/ws` answers the upgrade with a
+//! `Spear-Resume-Token` header. When the socket drops, the execution keeps its streams for
+//! `resume_grace_ms`: what the guest writes meanwhile stays queued, and the frames already
+//! sent are kept until the client acknowledges them. A client that reconnects with
+//! `?resume_token=<token>&last_seq=<n>` continues the same session; the frames after `n`
+//! are replayed first. `seq` counts the binary messages the spearlet sent on the session,
+//! starting at 1, and the client acknowledges with a text message `{"type":"ack","seq":n}`.
+//! `GET /api/v1/executions/{execution_id}/streams/ws` 在升级响应中返回 `Spear-Resume-Token` 头。
+//! 连接断开后，执行会在 `resume_grace_ms` 内保留其流：期间 guest 写入的内容继续排队，已发送的帧
+//! 保留到客户端确认为止。客户端以 `?resume_token=<token>&last_seq=<n>` 重连即可继续同一会话，
+//! `n` 之后的帧会先被重放。`seq` 为 spearlet 在该会话上发送的二进制消息计数，从 1 开始；客户端
+//! 通过文本消息 `{"type":"ack","seq":n}` 确认。
+//!
+//! Acknowledging is optional. Without it, frames beyond `resume_buffer_bytes` are evicted
+//! and resuming past them fails. A client that connects with `?ack=true` promises to
+//! acknowledge: sending pauses while `resume_buffer_bytes` are unacknowledged, so nothing is
+//! evicted and the guest sees backpressure instead. Either way a guest frame flagged
+//! `SSF_FLAG_ACK_REQUESTED` is answered with an `ACK` frame on its stream once the client
+//! acknowledged it.
+//! 确认是可选的。不确认时，超出 `resume_buffer_bytes` 的帧会被淘汰，越过它们的恢复将失败。以
+//! `?ack=true` 连接的客户端承诺进行确认：未确认字节达到 `resume_buffer_bytes` 时暂停发送，不淘汰
+//! 任何帧，guest 改为感知背压。无论哪种方式，带 `SSF_FLAG_ACK_REQUESTED` 标志的 guest 帧在客户端
+//! 确认后，都会在其流上收到一个 `ACK` 帧。
+
+use std::collections::VecDeque;
+use std::sync::Arc;
+use std::time::Duration;
+
+use base64::Engine;
+use dashmap::DashMap;
+use parking_lot::Mutex;
+use rand::RngCore;
+use serde::Deserialize;
+
+use crate::spearlet::execution::host_api::{ssf, UserStreams};
+
+/// Upgrade response header carrying the token / 携带令牌的升级响应头
+pub const TOKEN_HEADER: &str = "spear-resume-token";
+
+fn make_token() -> String {
+    let mut bytes = [0u8; 32];
+    rand::thread_rng().fill_bytes(&mut bytes);
+    base64::engine::general_purpose::URL_SAFE_NO_PAD.encode(bytes)
+}
+
+/// Why a resumption was refused / 拒绝恢复的原因
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ResumeError {
+    /// Unknown token, or its grace period ended / 令牌未知或宽限期已过
+    Expired,
+    /// The token belongs to another execution / 令牌属于其他执行
+    WrongExecution,
+    /// Frames after `last_seq` are no longer buffered / `last_seq` 之后的帧已不在缓冲区中
+    SeqUnavailable,
+}
+
+/// Control message sent by the client / 客户端发送的控制消息
+#[derive(Debug, Deserialize)]
+struct ClientControl {
+    #[serde(rename = "type")]
+    kind: String,
+    #[serde(default)]
+    seq: u64,
+}
+
+#[derive(Default)]
+struct SessionState {
+    /// Bumped on every (re)attach; older connections stop / 每次（重新）接入时递增；旧连接随之停止
+    generation: u64,
+    attached: bool,
+    /// Seq of the last frame sent / 最近发送帧的 seq
+    last_sent: u64,
+    /// Sent frames not yet acknowledged / 已发送但尚未确认的帧
+    unacked: VecDeque<(u64, Vec<u8>)>,
+    unacked_bytes: usize,
+    /// Highest seq dropped from the buffer without an ack / 未经确认即被移出缓冲区的最大 seq
+    evicted: u64,
+}
+
+impl SessionState {
+    /// Number a sent frame and buffer it, evicting the oldest beyond `cap` bytes
+    /// 为已发送帧编号并缓冲，超出 `cap` 字节时淘汰最旧的帧
+    fn keep(&mut self, frame: Vec<u8>, cap: usize) {
+        self.last_sent += 1;
+        self.unacked_bytes += frame.len();
+        self.unacked.push_back((self.last_sent, frame));
+        while self.unacked_bytes > cap {
+            let Some((seq, f)) = self.unacked.pop_front() else {
+                break;
+            };
+            self.unacked_bytes -= f.len();
+            self.evicted = seq;
+        }
+    }
+}
+
+/// One resumable session / 单个可恢复会话
+pub struct ResumeSession {
+    token: String,
+    execution_id: String,
+    max_buffer_bytes: usize,
+    /// The client acknowledges every frame; sending pauses instead of evicting
+    /// 客户端确认每一帧；以暂停发送代替淘汰
+    acked: bool,
+    state: Mutex<SessionState>,
+    streams: Arc<UserStreams>,
+}
+
+impl ResumeSession {
+    pub fn token(&self) -> &str {
+        &self.token
+    }
+
+    /// Whether the connection holding `generation` still owns the session
+    /// 持有 `generation` 的连接是否仍拥有该会话
+    pub fn is_current(&self, generation: u64) -> bool {
+        self.state.lock().generation == generation
+    }
+
+    /// Pop the next guest frame and keep it for replay; nothing once another connection
+    /// took over
+    /// 弹出下一个 guest 帧并保留以备重放；会话被其他连接接管后不再弹出
+    pub fn pop_outbound(&self, generation: u64) -> Option<Vec<u8>> {
+        let mut st = self.state.lock();
+        if st.generation != generation {
+            return None;
+        }
+        if self.acked && st.unacked_bytes >= self.max_buffer_bytes {
+            return None;
+        }
+        let frame = self.streams.ws_pop_any_outbound(&self.execution_id)?;
+        st.keep(frame.clone(), self.evict_above());
+        Some(frame)
+    }
+
+    /// Buffered bytes beyond which the oldest frames are evicted / 超过后淘汰最旧帧的缓冲字节数
+    fn evict_above(&self) -> usize {
+        if self.acked {
+            usize::MAX
+        } else {
+            self.max_buffer_bytes
+        }
+    }
+
+    /// Drop frames the client acknowledged and answer those that asked for it
+    /// 丢弃客户端已确认的帧，并回应请求确认的帧
+    pub fn ack(&self, seq: u64) {
+        let mut done = Vec::new();
+        {
+            let mut st = self.state.lock();
+            while st.unacked.front().is_some_and(|(s, _)| *s <= seq) {
+                if let Some((_, f)) = st.unacked.pop_front() {
+                    st.unacked_bytes -= f.len();
+                    done.push(f);
+                }
+            }
+        }
+        for (stream_id, guest_seq) in done.iter().filter_map(|f| ssf::ssf_v1_ack_request(f)) {
+            self.streams
+                .ws_push_ack(&self.execution_id, stream_id, guest_seq);
+        }
+    }
+
+    /// Handle a text message from the client / 处理客户端的文本消息
+    pub fn on_client_text(&self, text: &str) {
+        if let Ok(c) = serde_json::from_str::<ClientControl>(text) {
+            if c.kind == "ack" {
+                self.ack(c.seq);
+            }
+        }
+    }
+
+    /// The connection holding `generation` dropped; true when the session now waits for a
+    /// resume
+    /// 持有 `generation` 的连接已断开；会话转入等待恢复时返回 true
+    pub fn detach(&self, generation: u64) -> bool {
+        let mut st = self.state.lock();
+        if st.generation != generation {
+            return false;
+        }
+        st.attached = false;
+        true
+    }
+}
+
+/// Resumable sessions of one spearlet, by token / 单个 spearlet 的可恢复会话，按令牌索引
+pub struct ResumeSessions {
+    sessions: DashMap<String, Arc<ResumeSession>>,
+    streams: Arc<UserStreams>,
+}
+
+impl ResumeSessions {
+    pub fn new(streams: Arc<UserStreams>) -> Self {
+        Self {
+            sessions: DashMap::new(),
+            streams,
+        }
+    }
+
+    /// Start a session for a new connection; returns it with the connection's generation
+    /// 为新连接创建会话；返回会话及该连接的 generation
+    pub fn open(
+        &self,
+        execution_id: &str,
+        max_buffer_bytes: usize,
+        acked: bool,
+    ) -> (Arc<ResumeSession>, u64) {
+        let session = Arc::new(ResumeSession {
+            token: make_token(),
+            execution_id: execution_id.to_string(),
+            max_buffer_bytes,
+            acked,
+            state: Mutex::new(SessionState {
+                generation: 1,
+                attached: true,
+                ..Default::default()
+            }),
+            streams: self.streams.clone(),
+        });
+        self.sessions.insert(session.token.clone(), session.clone());
+        (session, 1)
+    }
+
+    /// Attach a reconnecting client; returns the session, the new generation and the frames
+    /// to replay
+    /// 接入重连的客户端；返回会话、新的 generation 以及待重放的帧
+    pub fn resume(
+        &self,
+        token: &str,
+        execution_id: &str,
+        last_seq: u64,
+    ) -> Result<(Arc<ResumeSession>, u64, Vec<Vec<u8>>), ResumeError> {
+        let session = self
+            .sessions
+            .get(token)
+            .map(|e| e.clone())
+            .ok_or(ResumeError::Expired)?;
+        if session.execution_id != execution_id {
+            return Err(ResumeError::WrongExecution);
+        }
+        let mut st = session.state.lock();
+        if last_seq > st.last_sent || last_seq < st.evicted {
+            return Err(ResumeError::SeqUnavailable);
+        }
+        st.generation += 1;
+        st.attached = true;
+        let generation = st.generation;
+        drop(st);
+        session.ack(last_seq);
+        let replay = session
+            .state
+            .lock()
+            .unacked
+            .iter()
+            .map(|(_, f)| f.clone())
+            .collect();
+        Ok((session, generation, replay))
+    }
+
+    /// End a session for good / 彻底结束会话
+    pub fn release(&self, token: &str) {
+        self.sessions.remove(token);
+    }
+
+    /// Close the execution's streams unless the client resumes within `grace`
+    /// 若客户端未在 `grace` 内恢复，则关闭该执行的流
+    pub fn expire_after(
+        self: &Arc<Self>,
+        session: Arc<ResumeSession>,
+        generation: u64,
+        grace: Duration,
+    ) {
+        let this = self.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(grace).await;
+            let expired = {
+                let st = session.state.lock();
+                st.generation == generation && !st.attached
+            };
+            if expired {
+                this.release(&session.token);
+                this.streams.map_ws_close_to_channels(&session.execution_id);
+            }
+        });
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn sessions() -> ResumeSessions {
+        ResumeSessions::new(Arc::default())
+    }
+
+    fn send(s: &ResumeSession, data: &[u8]) {
+        s.state.lock().keep(data.to_vec(), s.evict_above());
+    }
+
+    #[test]
+    fn test_resume_replays_unacked_frames() {
+        let r = sessions();
+        let exec = "exec-resume-replay";
+        let (s, gen) = r.open(exec, 1024, false);
+        for d in [b"a", b"b", b"c"] {
+            send(&s, d);
+        }
+        s.on_client_text(r#"{"type":"ack","seq":1}"#);
+        assert!(s.detach(gen));
+
+        assert_eq!(
+            r.resume(s.token(), "other", 1).err(),
+            Some(ResumeError::WrongExecution)
+        );
+        assert_eq!(
+            r.resume(s.token(), exec, 4).err(),
+            Some(ResumeError::SeqUnavailable)
+        );
+        let (s2, gen2, replay) = r.resume(s.token(), exec, 2).unwrap();
+        assert_eq!(replay, vec![b"c".to_vec()]);
+        // The old connection lost the session / 旧连接已失去会话
+        assert!(!s2.is_current(gen));
+        assert!(!s2.detach(gen));
+        assert!(s2.is_current(gen2));
+
+        r.release(s.token());
+        assert_eq!(
+            r.resume(s.token(), exec, 3).err(),
+            Some(ResumeError::Expired)
+        );
+    }
+
+    #[test]
+    fn test_buffer_cap_evicts_oldest() {
+        let r = sessions();
+        let (s, gen) = r.open("exec-resume-cap", 2, false);
+        for d in [b"a", b"b", b"c"] {
+            send(&s, d);
+        }
+        s.detach(gen);
+        assert_eq!(
+            r.resume(s.token(), "exec-resume-cap", 0).err(),
+            Some(ResumeError::SeqUnavailable)
+        );
+        let (_, _, replay) = r.resume(s.token(), "exec-resume-cap", 1).unwrap();
+        assert_eq!(replay, vec![b"b".to_vec(), b"c".to_vec()]);
+        r.release(s.token());
+    }
+
+    #[test]
+    fn test_acked_session_pauses_instead_of_evicting() {
+        let r = sessions();
+        let exec = "exec-resume-acked";
+        let (s, gen) = r.open(exec, 2, true);
+        for d in [b"a", b"b", b"c"] {
+            send(&s, d);
+        }
+        // The window is full, so nothing more is popped / 窗口已满，不再弹出
+        assert_eq!(s.pop_outbound(gen), None);
+        s.detach(gen);
+        let (_, _, replay) = r.resume(s.token(), exec, 0).unwrap();
+        assert_eq!(replay.len(), 3);
+        r.release(s.token());
+    }
+
+    #[test]
+    fn test_ack_answers_flagged_guest_frames() {
+        let exec = "exec-resume-guest-ack";
+        let streams = Arc::new(UserStreams::default());
+        let r = ResumeSessions::new(streams.clone());
+        streams.get_or_create(exec).mark_connected(3);
+        let (s, _) = r.open(exec, 1024, false);
+        let mut flagged = ssf::build_ssf_v1_frame(3, 2, b"", b"x");
+        flagged[10..12].copy_from_slice(&ssf::SSF_FLAG_ACK_REQUESTED.to_le_bytes());
+        flagged[16..24].copy_from_slice(&42u64.to_le_bytes());
+        send(&s, &flagged);
+        send(&s, &ssf::build_ssf_v1_frame(3, 2, b"", b"y"));
+        s.ack(2);
+
+        let inbound = streams
+            .summaries()
+            .into_iter()
+            .find(|u| u.execution_id == exec && u.stream_id == 3)
+            .map(|u| u.inbound_frames);
+        assert_eq!(inbound, Some(1));
+        assert_eq!(ssf::ssf_v1_ack_request(&flagged), Some((3, 42)));
+        r.release(s.token());
+        streams.map_ws_close_to_channels(exec);
+    }
+}
@@ -0,0 +1,275 @@
+//! Supervision of long-running internal workers
+//! 长期运行的内部工作协程的监督
+//!
+//! Background loops such as the execution work loop are started once. If one of them
+//! panics, the spearlet would keep running but silently stop doing that job. A
+//! supervised worker is restarted with exponential backoff instead, every restart is
+//! reported as an alert (error log plus a `worker.restart` error span), and the state
+//! of every worker is visible in `/monitoring/health`.
+//! 执行工作循环等后台循环只启动一次。若其中之一 panic，spearlet 仍在运行却静默地不再做该
+//! 工作。被监督的工作协程会以指数退避重启，每次重启都作为告警上报（错误日志加 `worker.restart`
+//! 错误 span），所有工作协程的状态可在 `/monitoring/health` 中查看。
+//!
+//! A worker that returns normally is considered finished and is not restarted.
+//! 正常返回的工作协程视为已结束，不会被重启。
+
+use std::collections::VecDeque;
+use std::future::Future;
+use std::sync::OnceLock;
+use std::time::Duration;
+
+use dashmap::DashMap;
+use serde::Serialize;
+use tokio::task::JoinHandle;
+use tokio::time::Instant;
+
+use crate::spearlet::{crash, otel};
+
+/// Worker state / 工作协程状态
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum WorkerState {
+    Running,
+    /// Died and waiting for the backoff to elapse / 已退出，等待退避结束
+    Restarting,
+    /// Returned normally / 正常返回
+    Stopped,
+}
+
+/// Snapshot of one supervised worker / 单个被监督工作协程的快照
+#[derive(Debug, Clone, Serialize)]
+pub struct WorkerStatus {
+    pub name: String,
+    pub state: WorkerState,
+    pub restarts: u64,
+    /// Restarted more than `flap_threshold` times within `flap_window`
+    /// 在 `flap_window` 内重启超过 `flap_threshold` 次
+    pub flapping: bool,
+    pub last_failure: Option<String>,
+    pub last_failure_at_ms: Option<i64>,
+    #[serde(skip)]
+    flapping_until: Option<Instant>,
+}
+
+/// Restart policy / 重启策略
+#[derive(Debug, Clone)]
+pub struct RestartPolicy {
+    pub initial_backoff: Duration,
+    pub max_backoff: Duration,
+    pub flap_threshold: usize,
+    pub flap_window: Duration,
+}
+
+impl Default for RestartPolicy {
+    fn default() -> Self {
+        Self {
+            initial_backoff: Duration::from_millis(100),
+            max_backoff: Duration::from_secs(30),
+            flap_threshold: 5,
+            flap_window: Duration::from_secs(300),
+        }
+    }
+}
+
+fn registry() -> &'static DashMap<String, WorkerStatus> {
+    static REGISTRY: OnceLock<DashMap<String, WorkerStatus>> = OnceLock::new();
+    REGISTRY.get_or_init(DashMap::new)
+}
+
+fn set_state(name: &str, state: WorkerState) {
+    registry()
+        .entry(name.to_string())
+        .and_modify(|s| s.state = state)
+        .or_insert_with(|| WorkerStatus {
+            name: name.to_string(),
+            state,
+            restarts: 0,
+            flapping: false,
+            last_failure: None,
+            last_failure_at_ms: None,
+            flapping_until: None,
+        });
+}
+
+fn record_failure(name: &str, reason: &str, flapping_until: Option<Instant>) -> u64 {
+    let mut entry = registry()
+        .entry(name.to_string())
+        .or_insert_with(|| WorkerStatus {
+            name: name.to_string(),
+            state: WorkerState::Restarting,
+            restarts: 0,
+            flapping: false,
+            last_failure: None,
+            last_failure_at_ms: None,
+            flapping_until: None,
+        });
+    entry.state = WorkerState::Restarting;
+    entry.restarts += 1;
+    entry.last_failure = Some(reason.to_string());
+    entry.last_failure_at_ms = Some(chrono::Utc::now().timestamp_millis());
+    if flapping_until.is_some() {
+        entry.flapping_until = flapping_until;
+    }
+    entry.restarts
+}
+
+/// Status of all supervised workers, sorted by name / 所有被监督工作协程的状态（按名称排序）
+pub fn worker_statuses() -> Vec<WorkerStatus> {
+    let now = Instant::now();
+    let mut out: Vec<WorkerStatus> = registry()
+        .iter()
+        .map(|e| {
+            let mut s = e.value().clone();
+            s.flapping = s.state != WorkerState::Stopped
+                && s.flapping_until.is_some_and(|until| now < until);
+            s
+        })
+        .collect();
+    out.sort_by(|a, b| a.name.cmp(&b.name));
+    out
+}
+
+fn panic_message(err: tokio::task::JoinError) -> String {
+    if err.is_cancelled() {
+        return "task was cancelled".to_string();
+    }
+    let payload = err.into_panic();
+    if let Some(s) = payload.downcast_ref::<&str>() {
+        format!("panicked: {}", s)
+    } else if let Some(s) = payload.downcast_ref::<String>() {
+        format!("panicked: {}", s)
+    } else {
+        "panicked".to_string()
+    }
+}
+
+fn alert(name: &'static str, reason: &str, restarts: u64, flapping: bool, backoff: Duration) {
+    tracing::error!(
+        worker = name,
+        reason,
+        restarts,
+        flapping,
+        backoff_ms = backoff.as_millis() as u64,
+        "Internal worker died, restarting"
+    );
+    let parent = otel::current();
+    let mut span = otel::Span::start("worker.restart", otel::SpanKind::Internal, parent.as_ref());
+    span.set_attr("spear.worker", name);
+    span.set_attr("spear.worker.restarts", restarts as i64);
+    span.set_attr("spear.worker.flapping", flapping);
+    span.set_error(reason.to_string());
+}
+
+/// Run a worker under supervision / 在监督下运行工作协程
+///
+/// `factory` builds a fresh future for every (re)start. The worker runs in its own
+/// task tagged with `name` for crash reports.
+/// `factory` 为每次（重新）启动构建新的 future。工作协程在以 `name` 标记的独立任务中运行，
+/// 便于崩溃报告归属。
+pub fn supervise<F, Fut>(
+    name: &'static str,
+    policy: RestartPolicy,
+    mut factory: F,
+) -> JoinHandle<()>
+where
+    F: FnMut() -> Fut + Send + 'static,
+    Fut: Future<Output = ()> + Send + 'static,
+{
+    tokio::spawn(async move {
+        let mut backoff = policy.initial_backoff;
+        let mut failures: VecDeque<Instant> = VecDeque::new();
+        loop {
+            set_state(name, WorkerState::Running);
+            let started = Instant::now();
+            let reason = match crash::spawn(name, factory()).await {
+                Ok(()) => {
+                    set_state(name, WorkerState::Stopped);
+                    tracing::info!(worker = name, "Internal worker stopped");
+                    return;
+                }
+                Err(e) => panic_message(e),
+            };
+
+            let now = Instant::now();
+            // A worker that stayed up longer than the longest backoff starts over
+            // 运行时间超过最长退避的工作协程重新计算退避
+            if now.duration_since(started) >= policy.max_backoff {
+                backoff = policy.initial_backoff;
+            }
+            failures.push_back(now);
+            while failures
+                .front()
+                .is_some_and(|t| now.duration_since(*t) > policy.flap_window)
+            {
+                failures.pop_front();
+            }
+            let flapping = failures.len() > policy.flap_threshold;
+            let restarts =
+                record_failure(name, &reason, flapping.then(|| now + policy.flap_window));
+            alert(name, &reason, restarts, flapping, backoff);
+
+            tokio::time::sleep(backoff).await;
+            backoff = (backoff * 2).min(policy.max_backoff);
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::Arc;
+
+    fn status(name: &str) -> WorkerStatus {
+        worker_statuses()
+            .into_iter()
+            .find(|s| s.name == name)
+            .unwrap()
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn test_restarts_after_panic_until_clean_exit() {
+        let runs = Arc::new(AtomicUsize::new(0));
+        let r = runs.clone();
+        let handle = supervise("test-panicky", RestartPolicy::default(), move || {
+            let r = r.clone();
+            async move {
+                if r.fetch_add(1, Ordering::SeqCst) < 2 {
+                    panic!("boom");
+                }
+            }
+        });
+        handle.await.unwrap();
+        assert_eq!(runs.load(Ordering::SeqCst), 3);
+        let s = status("test-panicky");
+        assert_eq!(s.state, WorkerState::Stopped);
+        assert_eq!(s.restarts, 2);
+        assert_eq!(s.last_failure.as_deref(), Some("panicked: boom"));
+        assert!(!s.flapping);
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn test_flapping_worker_keeps_restarting() {
+        let runs = Arc::new(AtomicUsize::new(0));
+        let r = runs.clone();
+        let policy = RestartPolicy {
+            initial_backoff: Duration::from_millis(10),
+            max_backoff: Duration::from_millis(10),
+            flap_threshold: 2,
+            flap_window: Duration::from_secs(60),
+        };
+        let handle = supervise("test-flapping", policy, move || {
+            let r = r.clone();
+            async move {
+                r.fetch_add(1, Ordering::SeqCst);
+                panic!("always");
+            }
+        });
+        tokio::time::sleep(Duration::from_millis(55)).await;
+        assert!(runs.load(Ordering::SeqCst) >= 4);
+        let s = status("test-flapping");
+        assert!(s.flapping);
+        assert_eq!(s.state, WorkerState::Restarting);
+        handle.abort();
+    }
+}
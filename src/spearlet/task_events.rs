@@ -9,6 +9,7 @@ use crate::proto::sms::{
 };
 use crate::spearlet::config::SpearletConfig;
 use crate::spearlet::execution::manager::TaskExecutionManager;
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
 use tracing::{debug, info, warn};
 
 pub struct TaskEventSubscriber {
@@ -59,30 +60,45 @@ impl TaskEventSubscriber {
         let sms_channel = self.sms_channel.clone();
         let exec_mgr = self.execution_manager.clone();
         let last_event_id = self.last_event_id.clone();
-        tokio::spawn(async move {
-            let node_uuid = cfg.compute_node_uuid();
-            info!(node_uuid = %node_uuid, sms_grpc_addr = %cfg.sms_grpc_addr, "TaskEventSubscriber starting");
-            let Some(channel) = sms_channel else {
-                warn!("TaskEventSubscriber disabled: sms_channel is not initialized");
-                return;
-            };
-            loop {
-                let mut client = TaskServiceClient::new(channel.clone());
-                let last = *last_event_id.read().await;
-                let req = SubscribeTaskEventsRequest {
-                    node_uuid: node_uuid.clone(),
-                    last_event_id: last,
-                };
-                debug!(node_uuid = %node_uuid, last_event_id = last, "Subscribing to task events");
-                let per_attempt = Duration::from_millis(cfg.sms_connect_timeout_ms)
-                    .min(Duration::from_secs(5))
-                    .max(Duration::from_millis(1));
-                let mut stream = match tokio::time::timeout(
-                    per_attempt,
-                    client.subscribe_task_events(req),
+        supervise(
+            "task-event-subscriber",
+            RestartPolicy::default(),
+            move || {
+                Self::run(
+                    cfg.clone(),
+                    sms_channel.clone(),
+                    exec_mgr.clone(),
+                    last_event_id.clone(),
                 )
-                .await
-                {
+            },
+        );
+    }
+
+    async fn run(
+        cfg: Arc<SpearletConfig>,
+        sms_channel: Option<Channel>,
+        exec_mgr: Arc<TaskExecutionManager>,
+        last_event_id: Arc<RwLock<i64>>,
+    ) {
+        let node_uuid = cfg.compute_node_uuid();
+        info!(node_uuid = %node_uuid, sms_grpc_addr = %cfg.sms_grpc_addr, "TaskEventSubscriber starting");
+        let Some(channel) = sms_channel else {
+            warn!("TaskEventSubscriber disabled: sms_channel is not initialized");
+            return;
+        };
+        loop {
+            let mut client = TaskServiceClient::new(channel.clone());
+            let last = *last_event_id.read().await;
+            let req = SubscribeTaskEventsRequest {
+                node_uuid: node_uuid.clone(),
+                last_event_id: last,
+            };
+            debug!(node_uuid = %node_uuid, last_event_id = last, "Subscribing to task events");
+            let per_attempt = Duration::from_millis(cfg.sms_connect_timeout_ms)
+                .min(Duration::from_secs(5))
+                .max(Duration::from_millis(1));
+            let mut stream =
+                match tokio::time::timeout(per_attempt, client.subscribe_task_events(req)).await {
                     Ok(Ok(r)) => r.into_inner(),
                     Ok(Err(e)) => {
                         warn!(error = %e, "SubscribeTaskEvents RPC failed, retrying");
@@ -95,30 +111,29 @@ impl TaskEventSubscriber {
                         continue;
                     }
                 };
-                loop {
-                    match stream.next().await {
-                        Some(Ok(ev)) => {
-                            debug!(event_id = ev.event_id, kind = ev.kind, task_id = %ev.task_id, node_uuid = %ev.node_uuid, "Received task event");
-                            *last_event_id.write().await = ev.event_id;
-                            Self::store_cursor(&cfg, ev.event_id);
-                            Self::handle_event(&cfg, &mut client, &exec_mgr, ev).await;
-                        }
-                        Some(Err(e)) => {
-                            warn!(error = %e, "Event stream error, reconnecting");
-                            break;
-                        }
-                        None => {
-                            break;
-                        }
+            loop {
+                match stream.next().await {
+                    Some(Ok(ev)) => {
+                        debug!(event_id = ev.event_id, kind = ev.kind, task_id = %ev.task_id, node_uuid = %ev.node_uuid, "Received task event");
+                        *last_event_id.write().await = ev.event_id;
+                        Self::store_cursor(&cfg, ev.event_id);
+                        Self::handle_event(&cfg, &mut client, &exec_mgr, ev).await;
+                    }
+                    Some(Err(e)) => {
+                        warn!(error = %e, "Event stream error, reconnecting");
+                        break;
+                    }
+                    None => {
+                        break;
                     }
                 }
-                debug!(
-                    delay_ms = cfg.sms_connect_retry_ms,
-                    "Reconnect delay before resubscribing"
-                );
-                tokio::time::sleep(Duration::from_millis(cfg.sms_connect_retry_ms)).await;
             }
-        });
+            debug!(
+                delay_ms = cfg.sms_connect_retry_ms,
+                "Reconnect delay before resubscribing"
+            );
+            tokio::time::sleep(Duration::from_millis(cfg.sms_connect_retry_ms)).await;
+        }
     }
 
     async fn handle_event(
@@ -0,0 +1,493 @@
+//! Telephony media bridge for phone agents / 面向电话智能体的电话媒体桥接
+//!
+//! An incoming Twilio call hits the voice webhook, which starts the configured voice
+//! agent workload and answers with TwiML that opens a media stream WebSocket. The
+//! bridge then moves call audio between that socket and the execution's user stream:
+//! caller audio arrives as 8 kHz PCM frames, and PCM the workload writes back (for
+//! example rt-tts output) is resampled, μ-law encoded and played to the caller.
+//! Twilio 来电触发语音 webhook，后者启动配置的语音智能体工作负载，并以打开媒体流
+//! WebSocket 的 TwiML 应答。随后桥接在该连接与执行的 user stream 之间搬运通话音频：
+//! 来电音频以 8 kHz PCM 帧到达，工作负载写回的 PCM（例如 rt-tts 输出）经重采样与
+//! μ 律编码后播放给来电方。
+//!
+//! SIP trunks use the WebRTC endpoint through a gateway instead, see
+//! [`crate::spearlet::webrtc_ingest`].
+//! SIP 中继改为经网关使用 WebRTC 端点，见 [`crate::spearlet::webrtc_ingest`]。
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use axum::extract::ws::{Message, WebSocket};
+use base64::{engine::general_purpose, Engine as _};
+use dashmap::DashMap;
+use futures::{SinkExt, StreamExt};
+use serde::Deserialize;
+use tracing::{debug, info};
+
+use crate::spearlet::config::TelephonyConfig;
+use crate::spearlet::execution::host_api::{ssf, UserStreams};
+use crate::spearlet::rtp::packet::AudioCodec;
+
+pub const TWILIO_VOICE_PATH: &str = "/api/v1/telephony/twilio/voice";
+pub const TWILIO_MEDIA_PATH: &str = "/api/v1/telephony/twilio/media";
+
+/// Twilio media streams carry 8 kHz μ-law / Twilio 媒体流承载 8 kHz μ 律
+pub const TWILIO_SAMPLE_RATE: u32 = 8000;
+
+const SSF_MSG_DATA: u16 = 2;
+
+/// How long an answered call may take to open its media stream / 已应答来电打开媒体流的最长时间
+const CALL_SETUP_TIMEOUT: Duration = Duration::from_secs(60);
+
+/// A call answered by the webhook whose media stream has not connected yet
+/// 已由 webhook 应答、媒体流尚未连接的来电
+struct PendingCall {
+    execution_id: String,
+    stream_id: u32,
+    created: Instant,
+}
+
+/// Calls of one spearlet, bridged to its executions' user streams
+/// 单个 spearlet 的来电，桥接到其执行的 user stream
+pub struct PhoneCalls {
+    pending: DashMap<String, PendingCall>,
+    streams: Arc<UserStreams>,
+}
+
+impl PhoneCalls {
+    pub fn new(streams: Arc<UserStreams>) -> Self {
+        Self {
+            pending: DashMap::new(),
+            streams,
+        }
+    }
+
+    /// Remember an answered call; the returned token is passed back as a stream parameter
+    /// 记录已应答的来电；返回的令牌会作为流参数传回
+    pub fn register_call(&self, execution_id: &str, stream_id: u32) -> String {
+        self.pending
+            .retain(|_, c| c.created.elapsed() < CALL_SETUP_TIMEOUT);
+        let token = uuid::Uuid::new_v4().simple().to_string();
+        self.pending.insert(
+            token.clone(),
+            PendingCall {
+                execution_id: execution_id.to_string(),
+                stream_id,
+                created: Instant::now(),
+            },
+        );
+        token
+    }
+
+    fn take_call(&self, token: &str) -> Option<PendingCall> {
+        self.pending
+            .remove(token)
+            .map(|(_, c)| c)
+            .filter(|c| c.created.elapsed() < CALL_SETUP_TIMEOUT)
+    }
+}
+
+/// WebSocket URL of the media endpoint / 媒体端点的 WebSocket URL
+///
+/// Uses `public_base_url`, or the request `Host` over TLS when it is unset.
+/// 使用 `public_base_url`；未设置时使用请求的 `Host` 并假定 TLS。
+pub fn media_url(cfg: &TelephonyConfig, host: Option<&str>) -> Option<String> {
+    let base = match cfg.public_base_url.trim_end_matches('/') {
+        "" => format!("wss://{}", host.filter(|h| !h.is_empty())?),
+        b => match (b.strip_prefix("https://"), b.strip_prefix("http://")) {
+            (Some(rest), _) => format!("wss://{}", rest),
+            (_, Some(rest)) => format!("ws://{}", rest),
+            _ => b.to_string(),
+        },
+    };
+    Some(format!("{}{}", base, TWILIO_MEDIA_PATH))
+}
+
+/// TwiML connecting the call to the media stream / 将来电连接到媒体流的 TwiML
+pub fn connect_twiml(media_url: &str, token: &str) -> String {
+    format!(
+        concat!(
+            r#"<?xml version="1.0" encoding="UTF-8"?>"#,
+            r#"<Response><Connect><Stream url="{}">"#,
+            r#"<Parameter name="token" value="{}"/>"#,
+            "</Stream></Connect></Response>"
+        ),
+        xml_escape(media_url),
+        xml_escape(token)
+    )
+}
+
+/// TwiML that apologizes and hangs up / 致歉并挂断的 TwiML
+pub fn reject_twiml(message: &str) -> String {
+    format!(
+        r#"<?xml version="1.0" encoding="UTF-8"?><Response><Say>{}</Say><Hangup/></Response>"#,
+        xml_escape(message)
+    )
+}
+
+fn xml_escape(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+/// Linear-interpolation resampler for mono PCM / 单声道 PCM 的线性插值重采样
+pub fn resample(samples: &[i16], from: u32, to: u32) -> Vec<i16> {
+    if from == to || from == 0 || to == 0 || samples.is_empty() {
+        return samples.to_vec();
+    }
+    let (from, to) = (from as u64, to as u64);
+    let out_len = (samples.len() as u64 * to / from) as usize;
+    (0..out_len)
+        .map(|i| {
+            let pos = i as u64 * from;
+            let idx = (pos / to) as usize;
+            let a = samples[idx] as i64;
+            let b = *samples.get(idx + 1).unwrap_or(&samples[idx]) as i64;
+            (a + (b - a) * (pos % to) as i64 / to as i64) as i16
+        })
+        .collect()
+}
+
+/// Media stream messages from Twilio / 来自 Twilio 的媒体流消息
+#[derive(Debug, Deserialize)]
+#[serde(tag = "event", rename_all = "lowercase")]
+enum TwilioEvent {
+    Start {
+        start: StreamStart,
+    },
+    Media {
+        media: MediaChunk,
+    },
+    Dtmf {
+        dtmf: Dtmf,
+    },
+    Mark {
+        mark: Mark,
+    },
+    Stop,
+    #[serde(other)]
+    Other,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct StreamStart {
+    stream_sid: String,
+    #[serde(default)]
+    call_sid: String,
+    #[serde(default)]
+    custom_parameters: HashMap<String, String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct MediaChunk {
+    #[serde(default)]
+    track: String,
+    payload: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct Dtmf {
+    digit: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct Mark {
+    name: String,
+}
+
+/// A call whose media stream is bridged / 媒体流已桥接的来电
+struct Call {
+    execution_id: String,
+    stream_id: u32,
+    stream_sid: String,
+    call_sid: String,
+}
+
+impl Call {
+    fn push(
+        &self,
+        streams: &UserStreams,
+        meta: serde_json::Value,
+        data: &[u8],
+    ) -> Result<(), &'static str> {
+        let frame = ssf::build_ssf_v1_frame(
+            self.stream_id,
+            SSF_MSG_DATA,
+            meta.to_string().as_bytes(),
+            data,
+        );
+        let hub = streams
+            .get(&self.execution_id)
+            .ok_or("execution finished")?;
+        match hub.push_inbound_frame(self.stream_id, frame) {
+            0 => Ok(()),
+            _ => Err("user stream rejected audio"),
+        }
+    }
+}
+
+/// Serve one Twilio media stream / 服务一个 Twilio 媒体流
+pub async fn run_twilio_media(socket: WebSocket, calls: Arc<PhoneCalls>) {
+    let (mut tx, mut rx) = socket.split();
+    let mut call: Option<Call> = None;
+
+    let reason = loop {
+        let execution_id = call.as_ref().map(|c| c.execution_id.clone());
+        tokio::select! {
+            msg = rx.next() => {
+                let Some(Ok(msg)) = msg else {
+                    break "socket closed";
+                };
+                let text = match msg {
+                    Message::Text(t) => t,
+                    Message::Close(_) => break "socket closed",
+                    _ => continue,
+                };
+                let Ok(event) = serde_json::from_str::<TwilioEvent>(&text) else {
+                    continue;
+                };
+                match on_event(&calls, &mut call, event) {
+                    Ok(true) => {}
+                    Ok(false) => break "call ended",
+                    Err(reason) => break reason,
+                }
+            }
+            _ = wait_outbound(&calls.streams, execution_id.as_deref()) => {
+                let Some(c) = call.as_ref() else {
+                    continue;
+                };
+                let Some(hub) = calls.streams.get(&c.execution_id) else {
+                    break "execution finished";
+                };
+                let mut sent = Ok(());
+                while let Some(frame) = hub.pop_outbound_frame_on(c.stream_id) {
+                    if let Some(m) = outbound_message(&c.stream_sid, &frame) {
+                        sent = tx.send(Message::Text(m.to_string().into())).await;
+                        if sent.is_err() {
+                            break;
+                        }
+                    }
+                }
+                if sent.is_err() {
+                    break "socket closed";
+                }
+            }
+        }
+    };
+
+    let _ = tx.close().await;
+    if let Some(c) = call {
+        calls.streams.map_ws_close_to_channels(&c.execution_id);
+        info!(
+            execution_id = %c.execution_id,
+            call_sid = %c.call_sid,
+            reason,
+            "telephony media stream ended"
+        );
+    }
+}
+
+async fn wait_outbound(streams: &UserStreams, execution_id: Option<&str>) {
+    match execution_id {
+        Some(id) => {
+            let _ =
+                tokio::time::timeout(Duration::from_millis(200), streams.ws_wait_any_outbound(id))
+                    .await;
+        }
+        None => std::future::pending().await,
+    }
+}
+
+/// Apply one Twilio message; `Ok(false)` when the call ended / 处理一条 Twilio 消息；通话结束时返回 `Ok(false)`
+fn on_event(
+    calls: &PhoneCalls,
+    call: &mut Option<Call>,
+    event: TwilioEvent,
+) -> Result<bool, &'static str> {
+    if let TwilioEvent::Start { start } = event {
+        if call.is_some() {
+            return Ok(true);
+        }
+        let pending = start
+            .custom_parameters
+            .get("token")
+            .and_then(|t| calls.take_call(t))
+            .ok_or("unknown call")?;
+        debug!(
+            execution_id = %pending.execution_id,
+            call_sid = %start.call_sid,
+            "telephony media stream started"
+        );
+        *call = Some(Call {
+            execution_id: pending.execution_id,
+            stream_id: pending.stream_id,
+            stream_sid: start.stream_sid,
+            call_sid: start.call_sid,
+        });
+        return Ok(true);
+    }
+    let Some(c) = call.as_ref() else {
+        return Ok(!matches!(event, TwilioEvent::Stop));
+    };
+    match event {
+        TwilioEvent::Media { media } if media.track != "outbound" => {
+            let Ok(ulaw) = general_purpose::STANDARD.decode(media.payload.as_bytes()) else {
+                return Ok(true);
+            };
+            let data: Vec<u8> = AudioCodec::Pcmu
+                .decode(&ulaw)
+                .iter()
+                .flat_map(|s| s.to_le_bytes())
+                .collect();
+            let meta = serde_json::json!({
+                "codec": "pcm_s16le",
+                "sample_rate": TWILIO_SAMPLE_RATE,
+                "channels": 1,
+            });
+            c.push(&calls.streams, meta, &data)?;
+        }
+        TwilioEvent::Dtmf { dtmf } => {
+            c.push(
+                &calls.streams,
+                serde_json::json!({"event": "dtmf", "digit": dtmf.digit}),
+                &[],
+            )?;
+        }
+        TwilioEvent::Mark { mark } => {
+            c.push(
+                &calls.streams,
+                serde_json::json!({"event": "mark", "name": mark.name}),
+                &[],
+            )?;
+        }
+        TwilioEvent::Stop => return Ok(false),
+        _ => {}
+    }
+    Ok(true)
+}
+
+/// Turn a frame the workload wrote into a Twilio message / 将工作负载写入的帧转换为 Twilio 消息
+///
+/// Meta `{"event": "clear"}` stops playback (barge-in), `{"event": "mark", "name": ..}`
+/// asks for a mark once playback reaches it; anything else is PCM at `sample_rate`.
+/// meta 为 `{"event": "clear"}` 时停止播放（打断），`{"event": "mark", "name": ..}`
+/// 请求在播放到该处时回报 mark；其余为 `sample_rate` 采样率的 PCM。
+fn outbound_message(stream_sid: &str, frame: &[u8]) -> Option<serde_json::Value> {
+    let (_, msg_type, meta, data) = ssf::split_ssf_v1_frame(frame).ok()?;
+    if msg_type != SSF_MSG_DATA {
+        return None;
+    }
+    let meta: serde_json::Value = serde_json::from_slice(meta).unwrap_or_default();
+    match meta["event"].as_str() {
+        Some("clear") => Some(serde_json::json!({"event": "clear", "streamSid": stream_sid})),
+        Some("mark") => Some(serde_json::json!({
+            "event": "mark",
+            "streamSid": stream_sid,
+            "mark": {"name": meta["name"]},
+        })),
+        _ if data.len() < 2 => None,
+        _ => {
+            let rate = meta["sample_rate"]
+                .as_u64()
+                .unwrap_or(TWILIO_SAMPLE_RATE as u64) as u32;
+            let pcm: Vec<i16> = data
+                .chunks_exact(2)
+                .map(|c| i16::from_le_bytes([c[0], c[1]]))
+                .collect();
+            let ulaw = AudioCodec::Pcmu.encode(&resample(&pcm, rate, TWILIO_SAMPLE_RATE));
+            Some(serde_json::json!({
+                "event": "media",
+                "streamSid": stream_sid,
+                "media": {"payload": general_purpose::STANDARD.encode(ulaw)},
+            }))
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_twiml_and_media_url() {
+        let twiml = connect_twiml("wss://a.example/m", "t&1");
+        assert!(twiml.contains(r#"<Stream url="wss://a.example/m">"#));
+        assert!(twiml.contains(r#"value="t&amp;1""#));
+
+        let mut cfg = TelephonyConfig::default();
+        assert_eq!(
+            media_url(&cfg, Some("edge:8081")).as_deref(),
+            Some("wss://edge:8081/api/v1/telephony/twilio/media")
+        );
+        assert_eq!(media_url(&cfg, None), None);
+        cfg.public_base_url = "http://voice.local/".to_string();
+        assert_eq!(
+            media_url(&cfg, Some("ignored")).as_deref(),
+            Some("ws://voice.local/api/v1/telephony/twilio/media")
+        );
+    }
+
+    #[test]
+    fn test_resample() {
+        assert_eq!(resample(&[0, 100, 200, 300], 16000, 8000), vec![0, 200]);
+        assert_eq!(resample(&[0, 100], 8000, 16000), vec![0, 50, 100, 100]);
+        assert_eq!(resample(&[7, 8], 8000, 8000), vec![7, 8]);
+    }
+
+    #[test]
+    fn test_call_flow() {
+        let exec = "telephony-test-exec";
+        let calls = PhoneCalls::new(Arc::default());
+        calls.streams.get_or_create(exec).mark_connected(1);
+        let token = calls.register_call(exec, 1);
+
+        let mut call = None;
+        let start = serde_json::json!({
+            "event": "start",
+            "streamSid": "MZ1",
+            "start": {"streamSid": "MZ1", "callSid": "CA1", "customParameters": {"token": token}}
+        });
+        let ev = serde_json::from_value(start.clone()).unwrap();
+        assert_eq!(on_event(&calls, &mut call, ev), Ok(true));
+        assert_eq!(call.as_ref().unwrap().stream_sid, "MZ1");
+
+        let media = serde_json::json!({
+            "event": "media",
+            "media": {"track": "inbound", "payload": general_purpose::STANDARD.encode([0xffu8; 4])}
+        });
+        let ev = serde_json::from_value(media).unwrap();
+        assert_eq!(on_event(&calls, &mut call, ev), Ok(true));
+        let connected = serde_json::json!({"event": "connected", "protocol": "Call"});
+        let ev = serde_json::from_value(connected).unwrap();
+        assert_eq!(on_event(&calls, &mut call, ev), Ok(true));
+        let ev = serde_json::from_value(serde_json::json!({"event": "stop"})).unwrap();
+        assert_eq!(on_event(&calls, &mut call, ev), Ok(false));
+
+        // Tokens are single use / 令牌只能使用一次
+        let mut again = None;
+        let ev = serde_json::from_value(start).unwrap();
+        assert_eq!(on_event(&calls, &mut again, ev), Err("unknown call"));
+        calls.streams.map_ws_close_to_channels(exec);
+    }
+
+    #[test]
+    fn test_outbound_messages() {
+        let audio =
+            ssf::build_ssf_v1_frame(1, SSF_MSG_DATA, br#"{"sample_rate":16000}"#, &[0u8; 640]);
+        let m = outbound_message("MZ1", &audio).unwrap();
+        assert_eq!(m["event"], "media");
+        let payload = general_purpose::STANDARD
+            .decode(m["media"]["payload"].as_str().unwrap())
+            .unwrap();
+        assert_eq!(payload.len(), 160);
+
+        let clear = ssf::build_ssf_v1_frame(1, SSF_MSG_DATA, br#"{"event":"clear"}"#, &[]);
+        assert_eq!(outbound_message("MZ1", &clear).unwrap()["event"], "clear");
+        let empty = ssf::build_ssf_v1_frame(1, SSF_MSG_DATA, b"", &[]);
+        assert!(outbound_message("MZ1", &empty).is_none());
+    }
+}
@@ -0,0 +1,261 @@
+//! Managed temporary workspaces / 受管的临时工作区
+//!
+//! Tools and process workloads used to leave their temporary files (synthesized speech,
+//! screenshots, downloads) in the spearlet's working directory or the system temp
+//! directory, where nothing removed them. Each task now gets a temporary workspace of its
+//! own. Tool plugins run inside it, and tools and process workloads find it in `TMPDIR` and
+//! `SPEAR_TMP_DIR`. Files older than `max_file_age_secs` are removed whenever a tool call
+//! enters the workspace, a full workspace refuses further tool calls until files expire, and
+//! the whole workspace is removed with its task. Unlike scratch files, nothing in it is
+//! meant to outlive the call that wrote it.
+//! 工具与进程工作负载过去会把临时文件（合成语音、截图、下载内容）留在 spearlet 的工作目录或系统临时
+//! 目录中，且无人清理。现在每个任务拥有独立的临时工作区。工具插件在其中运行，工具与进程工作负载通过
+//! `TMPDIR` 与 `SPEAR_TMP_DIR` 得到它。每当工具调用进入工作区时，删除早于 `max_file_age_secs` 的文件；
+//! 工作区已满时拒绝后续工具调用直到文件过期；任务移除时删除整个工作区。与临时文件（scratch files）
+//! 不同，其中的内容不应在写入它的调用之后继续保留。
+
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime};
+
+use parking_lot::RwLock;
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::config::{SpearletConfig, TempWorkspaceConfig};
+
+/// Environment variable pointing at the task's temporary workspace / 指向任务临时工作区的环境变量
+pub const ENV_TMP_DIR: &str = "SPEAR_TMP_DIR";
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum TempError {
+    #[error("temporary workspaces are disabled")]
+    Disabled,
+    #[error("temporary workspace holds {used} of {max} bytes")]
+    Full { used: u64, max: u64 },
+    #[error("temporary workspace error: {0}")]
+    Io(String),
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct TempStats {
+    pub enabled: bool,
+    pub dir: String,
+    /// Workspaces on disk / 磁盘上的工作区数
+    pub tasks: usize,
+    pub bytes: u64,
+}
+
+/// Workspace directory for a configuration / 配置对应的工作区目录
+pub fn workspace_dir(config: &SpearletConfig) -> PathBuf {
+    if config.temp_workspace.dir.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("tmp")
+    } else {
+        PathBuf::from(&config.temp_workspace.dir)
+    }
+}
+
+/// Variables pointing programs at a workspace / 将程序指向工作区的环境变量
+pub fn environment(dir: &Path) -> Vec<(&'static str, PathBuf)> {
+    ["TMPDIR", "TMP", "TEMP", ENV_TMP_DIR]
+        .into_iter()
+        .map(|k| (k, dir.to_path_buf()))
+        .collect()
+}
+
+/// Bytes of the files below `dir` / `dir` 下文件的字节数
+fn dir_bytes(dir: &Path) -> u64 {
+    let Ok(entries) = std::fs::read_dir(dir) else {
+        return 0;
+    };
+    entries
+        .flatten()
+        .map(|e| match e.metadata() {
+            Ok(m) if m.is_dir() => dir_bytes(&e.path()),
+            Ok(m) => m.len(),
+            Err(_) => 0,
+        })
+        .sum()
+}
+
+/// Remove files last modified before `cutoff`, then directories left empty
+/// 删除最后修改时间早于 `cutoff` 的文件，以及随后变空的目录
+fn remove_expired(dir: &Path, cutoff: SystemTime) -> usize {
+    let Ok(entries) = std::fs::read_dir(dir) else {
+        return 0;
+    };
+    let mut removed = 0;
+    for e in entries.flatten() {
+        let path = e.path();
+        let Ok(meta) = std::fs::symlink_metadata(&path) else {
+            continue;
+        };
+        if meta.is_dir() {
+            removed += remove_expired(&path, cutoff);
+            // Only succeeds once the directory is empty / 仅在目录为空时成功
+            let _ = std::fs::remove_dir(&path);
+        } else if meta.modified().map_or(false, |t| t < cutoff)
+            && std::fs::remove_file(&path).is_ok()
+        {
+            removed += 1;
+        }
+    }
+    removed
+}
+
+pub struct TempWorkspace {
+    config: RwLock<(TempWorkspaceConfig, PathBuf)>,
+}
+
+impl TempWorkspace {
+    pub fn new(config: TempWorkspaceConfig, dir: PathBuf) -> Self {
+        Self {
+            config: RwLock::new((config, dir)),
+        }
+    }
+
+    /// Apply a new configuration; workspaces stay where they are / 应用新配置；工作区保留在原处
+    pub fn set_config(&self, config: TempWorkspaceConfig, dir: PathBuf) {
+        *self.config.write() = (config, dir);
+    }
+
+    fn task_root(dir: &Path, task_id: &str) -> PathBuf {
+        let digest = Sha256::digest(task_id.as_bytes());
+        let hex: String = digest[..16].iter().map(|b| format!("{:02x}", b)).collect();
+        dir.join(hex)
+    }
+
+    /// The task's workspace, created and made absolute for other processes
+    /// 任务的工作区，已创建并转为绝对路径，供其他进程使用
+    pub fn task_dir(&self, task_id: &str) -> Result<PathBuf, TempError> {
+        let (cfg, dir) = self.config.read().clone();
+        if !cfg.enabled {
+            return Err(TempError::Disabled);
+        }
+        let root = Self::task_root(&dir, task_id);
+        std::fs::create_dir_all(&root).map_err(|e| TempError::Io(e.to_string()))?;
+        root.canonicalize()
+            .map_err(|e| TempError::Io(e.to_string()))
+    }
+
+    /// The task's workspace for a tool call: expired files are removed first, and a full
+    /// workspace is refused
+    /// 供工具调用使用的任务工作区：先删除过期文件，工作区已满时拒绝
+    pub fn enter(&self, task_id: &str) -> Result<PathBuf, TempError> {
+        let root = self.task_dir(task_id)?;
+        let cfg = self.config.read().0.clone();
+        if cfg.max_file_age_secs > 0 {
+            let cutoff = SystemTime::now()
+                .checked_sub(Duration::from_secs(cfg.max_file_age_secs))
+                .unwrap_or(SystemTime::UNIX_EPOCH);
+            let removed = remove_expired(&root, cutoff);
+            if removed > 0 {
+                tracing::debug!(task_id = %task_id, removed, "Expired temporary files removed");
+            }
+        }
+        if cfg.max_task_bytes > 0 {
+            let used = dir_bytes(&root);
+            if used >= cfg.max_task_bytes {
+                return Err(TempError::Full {
+                    used,
+                    max: cfg.max_task_bytes,
+                });
+            }
+        }
+        Ok(root)
+    }
+
+    /// Remove the task's workspace with everything in it / 删除任务的工作区及其全部内容
+    pub fn purge_task(&self, task_id: &str) -> bool {
+        let dir = self.config.read().1.clone();
+        let root = Self::task_root(&dir, task_id);
+        match std::fs::remove_dir_all(&root) {
+            Ok(()) => true,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => false,
+            Err(e) => {
+                tracing::warn!(task_id = %task_id, error = %e, "Failed to remove temporary workspace");
+                false
+            }
+        }
+    }
+
+    /// Remove every workspace, e.g. those left by an earlier run; returns how many
+    /// 删除全部工作区（例如之前运行遗留的）；返回删除的数量
+    pub fn clear(&self) -> usize {
+        let dir = self.config.read().1.clone();
+        let Ok(entries) = std::fs::read_dir(&dir) else {
+            return 0;
+        };
+        entries
+            .flatten()
+            .filter(|e| e.path().is_dir() && std::fs::remove_dir_all(e.path()).is_ok())
+            .count()
+    }
+
+    pub fn stats(&self) -> TempStats {
+        let (cfg, dir) = self.config.read().clone();
+        TempStats {
+            enabled: cfg.enabled,
+            dir: dir.display().to_string(),
+            tasks: std::fs::read_dir(&dir).map(|d| d.count()).unwrap_or(0),
+            bytes: dir_bytes(&dir),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn workspace(dir: &Path, max_task_bytes: u64) -> TempWorkspace {
+        TempWorkspace::new(
+            TempWorkspaceConfig {
+                max_task_bytes,
+                ..Default::default()
+            },
+            dir.join("tmp"),
+        )
+    }
+
+    #[test]
+    fn test_quota_and_purge() {
+        let dir = tempfile::tempdir().unwrap();
+        let ws = workspace(dir.path(), 8);
+        let a = ws.enter("task-a").unwrap();
+        let b = ws.enter("task-b").unwrap();
+        assert_ne!(a, b);
+        std::fs::write(a.join("speech.wav"), [0u8; 8]).unwrap();
+        assert_eq!(ws.enter("task-a"), Err(TempError::Full { used: 8, max: 8 }));
+        assert!(ws.enter("task-b").is_ok());
+        assert_eq!(ws.stats().tasks, 2);
+
+        assert!(ws.purge_task("task-a"));
+        assert!(!a.exists());
+        assert!(!ws.purge_task("task-a"));
+        assert_eq!(ws.clear(), 1);
+        assert_eq!(ws.stats().tasks, 0);
+    }
+
+    #[test]
+    fn test_expired_files_are_removed() {
+        let dir = tempfile::tempdir().unwrap();
+        let ws = workspace(dir.path(), 0);
+        let root = ws.enter("task").unwrap();
+        std::fs::create_dir_all(root.join("shots")).unwrap();
+        std::fs::write(root.join("shots/old.png"), b"png").unwrap();
+        std::fs::write(root.join("new.wav"), b"wav").unwrap();
+
+        let future = SystemTime::now() + Duration::from_secs(1);
+        assert_eq!(remove_expired(&root, future), 2);
+        assert!(!root.join("shots").exists());
+        assert!(root.exists());
+
+        ws.set_config(
+            TempWorkspaceConfig {
+                enabled: false,
+                ..Default::default()
+            },
+            dir.path().join("tmp"),
+        );
+        assert_eq!(ws.enter("task"), Err(TempError::Disabled));
+    }
+}
@@ -0,0 +1,661 @@
+//! TLS termination for the spearlet listeners / spearlet 监听器的 TLS 终止
+//!
+//! Both the gRPC and HTTP listeners terminate TLS with tokio-rustls when `enable_tls` is
+//! set. [`TlsAcceptor`] holds the current server configuration and rebuilds it when the
+//! certificate, key or client CA files change on disk, so rotated certificates apply
+//! to new connections without a restart. Client certificates are verified against
+//! `tls.client_ca_path` and can be required; the verified certificate stays with its
+//! connection and reaches HTTP handlers as [`PeerInfo`].
+//! 当设置 `enable_tls` 时，gRPC 与 HTTP 监听器均使用 tokio-rustls 终止 TLS。[`TlsAcceptor`]
+//! 持有当前服务端配置，并在证书、私钥或客户端 CA 文件变化时重建，轮换后的证书无需重启即可
+//! 用于新连接。客户端证书按 `tls.client_ca_path` 校验，并可设为必需；已验证的证书随其连接
+//! 保存，并以 [`PeerInfo`] 的形式传给 HTTP 处理函数。
+
+use std::io;
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
+use std::pin::Pin;
+use std::sync::Arc;
+use std::task::{Context, Poll};
+use std::time::{Duration, SystemTime};
+
+use parking_lot::{Mutex, RwLock};
+use rustls::pki_types::pem::PemObject;
+use rustls::pki_types::{CertificateDer, PrivateKeyDer};
+use rustls::server::WebPkiClientVerifier;
+use rustls::{RootCertStore, ServerConfig, SupportedProtocolVersion};
+use sha2::{Digest, Sha256};
+use tokio::io::{AsyncRead, AsyncWrite, ReadBuf};
+use tokio::net::{TcpListener, TcpStream};
+use tokio::sync::mpsc;
+use tokio::task::JoinHandle;
+use tracing::{debug, info, warn};
+
+use crate::spearlet::config::TlsConfig;
+use crate::spearlet::ip_allowlist::IpAllowlist;
+use crate::spearlet::supervisor::{supervise, RestartPolicy};
+
+/// ALPN for gRPC listeners / gRPC 监听器的 ALPN
+pub const ALPN_GRPC: &[&[u8]] = &[b"h2"];
+/// ALPN for the HTTP gateway / HTTP 网关的 ALPN
+pub const ALPN_HTTP: &[&[u8]] = &[b"http/1.1"];
+
+/// Names of the cipher suites `tls.cipher_suites` may list / `tls.cipher_suites` 可列出的密码套件名称
+///
+/// All of them are AEAD suites with forward secrecy. / 均为具备前向保密的 AEAD 套件。
+pub fn known_cipher_suites() -> Vec<&'static str> {
+    rustls::crypto::ring::default_provider()
+        .cipher_suites
+        .iter()
+        .filter_map(|s| s.suite().as_str())
+        .collect()
+}
+
+fn protocol_versions(min: &str) -> Result<&'static [&'static SupportedProtocolVersion], String> {
+    static TLS13_ONLY: &[&SupportedProtocolVersion] = &[&rustls::version::TLS13];
+    match min.trim() {
+        "" | "1.2" => Ok(rustls::ALL_VERSIONS),
+        "1.3" => Ok(TLS13_ONLY),
+        other => Err(format!(
+            "tls.min_version: unsupported {:?} (expected 1.2 or 1.3)",
+            other
+        )),
+    }
+}
+
+fn load_certs(path: &Path) -> Result<Vec<CertificateDer<'static>>, String> {
+    let certs = CertificateDer::pem_file_iter(path)
+        .and_then(|it| it.collect::<Result<Vec<_>, _>>())
+        .map_err(|e| format!("{}: {}", path.display(), e))?;
+    if certs.is_empty() {
+        return Err(format!("{}: no certificates found", path.display()));
+    }
+    Ok(certs)
+}
+
+/// Build a rustls server configuration / 构建 rustls 服务端配置
+pub fn build_server_config(
+    cert_path: &Path,
+    key_path: &Path,
+    settings: &TlsConfig,
+    alpn: &[&[u8]],
+) -> Result<ServerConfig, String> {
+    let mut provider = rustls::crypto::ring::default_provider();
+    if !settings.cipher_suites.is_empty() {
+        let known = known_cipher_suites();
+        if let Some(bad) = settings
+            .cipher_suites
+            .iter()
+            .find(|s| !known.contains(&s.as_str()))
+        {
+            return Err(format!("tls.cipher_suites: unknown suite {}", bad));
+        }
+        provider.cipher_suites.retain(|s| {
+            s.suite()
+                .as_str()
+                .is_some_and(|name| settings.cipher_suites.iter().any(|c| c == name))
+        });
+    }
+    let provider = Arc::new(provider);
+    let builder = ServerConfig::builder_with_provider(provider.clone())
+        .with_protocol_versions(protocol_versions(&settings.min_version)?)
+        .map_err(|e| format!("tls: {}", e))?;
+
+    let builder = if settings.client_ca_path.is_empty() {
+        if settings.require_client_cert {
+            return Err("tls.require_client_cert needs tls.client_ca_path".to_string());
+        }
+        builder.with_no_client_auth()
+    } else {
+        let mut roots = RootCertStore::empty();
+        for cert in load_certs(Path::new(&settings.client_ca_path))? {
+            roots
+                .add(cert)
+                .map_err(|e| format!("{}: {}", settings.client_ca_path, e))?;
+        }
+        let verifier = WebPkiClientVerifier::builder_with_provider(Arc::new(roots), provider);
+        let verifier = if settings.require_client_cert {
+            verifier
+        } else {
+            verifier.allow_unauthenticated()
+        };
+        builder.with_client_cert_verifier(verifier.build().map_err(|e| format!("tls: {}", e))?)
+    };
+
+    let certs = load_certs(cert_path)?;
+    let key = PrivateKeyDer::from_pem_file(key_path)
+        .map_err(|e| format!("{}: {}", key_path.display(), e))?;
+    let mut config = builder
+        .with_single_cert(certs, key)
+        .map_err(|e| format!("tls: {}", e))?;
+    config.alpn_protocols = alpn.iter().map(|p| p.to_vec()).collect();
+    Ok(config)
+}
+
+/// Client certificate policy for logs / 用于日志的客户端证书策略
+pub fn client_auth_mode(settings: &TlsConfig) -> &'static str {
+    match (
+        settings.client_ca_path.is_empty(),
+        settings.require_client_cert,
+    ) {
+        (true, _) => "off",
+        (false, false) => "optional",
+        (false, true) => "required",
+    }
+}
+
+/// Modification time and size of a watched file / 被监视文件的修改时间与大小
+type FileStamp = Option<(SystemTime, u64)>;
+
+fn stamp(path: &Path) -> FileStamp {
+    let meta = std::fs::metadata(path).ok()?;
+    Some((meta.modified().ok()?, meta.len()))
+}
+
+/// Current TLS configuration of one listener / 单个监听器的当前 TLS 配置
+pub struct TlsAcceptor {
+    name: &'static str,
+    cert_path: PathBuf,
+    key_path: PathBuf,
+    settings: TlsConfig,
+    alpn: &'static [&'static [u8]],
+    current: RwLock<Arc<ServerConfig>>,
+    stamps: Mutex<Vec<FileStamp>>,
+}
+
+impl TlsAcceptor {
+    /// Load the certificate and key; errors name the offending file
+    /// 加载证书与私钥；错误信息指明出错的文件
+    pub fn load(
+        name: &'static str,
+        cert_path: Option<&str>,
+        key_path: Option<&str>,
+        settings: &TlsConfig,
+        alpn: &'static [&'static [u8]],
+    ) -> Result<Arc<Self>, String> {
+        let cert_path = cert_path
+            .filter(|p| !p.is_empty())
+            .ok_or_else(|| format!("{}: cert_path is required when TLS is enabled", name))?;
+        let key_path = key_path
+            .filter(|p| !p.is_empty())
+            .ok_or_else(|| format!("{}: key_path is required when TLS is enabled", name))?;
+        let cert_path = PathBuf::from(cert_path);
+        let key_path = PathBuf::from(key_path);
+        let config = build_server_config(&cert_path, &key_path, settings, alpn)?;
+        let acceptor = Self {
+            name,
+            cert_path,
+            key_path,
+            settings: settings.clone(),
+            alpn,
+            current: RwLock::new(Arc::new(config)),
+            stamps: Mutex::new(Vec::new()),
+        };
+        *acceptor.stamps.lock() = acceptor.stamps_now();
+        Ok(Arc::new(acceptor))
+    }
+
+    fn watched(&self) -> Vec<PathBuf> {
+        let mut files = vec![self.cert_path.clone(), self.key_path.clone()];
+        if !self.settings.client_ca_path.is_empty() {
+            files.push(PathBuf::from(&self.settings.client_ca_path));
+        }
+        files
+    }
+
+    fn stamps_now(&self) -> Vec<FileStamp> {
+        self.watched().iter().map(|p| stamp(p)).collect()
+    }
+
+    /// Rebuild when a watched file changed; `Ok(true)` if it did
+    /// 被监视文件变化时重建；发生重建时返回 `Ok(true)`
+    ///
+    /// On error the previous configuration stays in use. / 出错时继续使用先前的配置。
+    pub fn reload_if_changed(&self) -> Result<bool, String> {
+        let now = self.stamps_now();
+        if *self.stamps.lock() == now {
+            return Ok(false);
+        }
+        // Failed builds are retried only after the files change again
+        // 构建失败时仅在文件再次变化后重试
+        *self.stamps.lock() = now;
+        let config =
+            build_server_config(&self.cert_path, &self.key_path, &self.settings, self.alpn)?;
+        *self.current.write() = Arc::new(config);
+        Ok(true)
+    }
+
+    pub fn config(&self) -> Arc<ServerConfig> {
+        self.current.read().clone()
+    }
+
+    /// Poll the files every `tls.reload_interval_ms` / 每隔 `tls.reload_interval_ms` 轮询文件
+    pub fn watch(self: &Arc<Self>) {
+        if self.settings.reload_interval_ms == 0 {
+            return;
+        }
+        let interval = Duration::from_millis(self.settings.reload_interval_ms);
+        let acceptor = self.clone();
+        supervise("tls-reload", RestartPolicy::default(), move || {
+            let acceptor = acceptor.clone();
+            async move {
+                loop {
+                    tokio::time::sleep(interval).await;
+                    match acceptor.reload_if_changed() {
+                        Ok(true) => info!(listener = acceptor.name, "TLS certificates reloaded"),
+                        Ok(false) => {}
+                        Err(e) => warn!(
+                            listener = acceptor.name,
+                            "TLS reload failed, keeping previous certificates: {}", e
+                        ),
+                    }
+                }
+            }
+        });
+    }
+}
+
+/// Identity string of a certificate / 证书的标识字符串
+pub fn cert_fingerprint(der: &[u8]) -> String {
+    let digest = Sha256::digest(der);
+    let hex: String = digest.iter().map(|b| format!("{:02x}", b)).collect();
+    format!("sha256:{}", hex)
+}
+
+/// Time a client gets to finish the TLS handshake / 客户端完成 TLS 握手的时限
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Connection accepted by a [`Listener`] / [`Listener`] 接受的连接
+pub enum ServerIo {
+    Plain(TcpStream),
+    Tls(Box<tokio_rustls::server::TlsStream<TcpStream>>),
+}
+
+impl ServerIo {
+    fn tcp(&self) -> &TcpStream {
+        match self {
+            Self::Plain(s) => s,
+            Self::Tls(s) => s.get_ref().0,
+        }
+    }
+
+    /// Identity of the verified client certificate, as `sha256:<hex>`
+    /// 已验证客户端证书的标识，格式为 `sha256:<hex>`
+    pub fn peer_identity(&self) -> Option<String> {
+        match self {
+            Self::Plain(_) => None,
+            Self::Tls(s) => s
+                .get_ref()
+                .1
+                .peer_certificates()
+                .and_then(|c| c.first())
+                .map(|cert| cert_fingerprint(cert)),
+        }
+    }
+}
+
+impl AsyncRead for ServerIo {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        match self.get_mut() {
+            Self::Plain(s) => Pin::new(s).poll_read(cx, buf),
+            Self::Tls(s) => Pin::new(s.as_mut()).poll_read(cx, buf),
+        }
+    }
+}
+
+impl AsyncWrite for ServerIo {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        match self.get_mut() {
+            Self::Plain(s) => Pin::new(s).poll_write(cx, buf),
+            Self::Tls(s) => Pin::new(s.as_mut()).poll_write(cx, buf),
+        }
+    }
+
+    fn poll_flush(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        match self.get_mut() {
+            Self::Plain(s) => Pin::new(s).poll_flush(cx),
+            Self::Tls(s) => Pin::new(s.as_mut()).poll_flush(cx),
+        }
+    }
+
+    fn poll_shutdown(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        match self.get_mut() {
+            Self::Plain(s) => Pin::new(s).poll_shutdown(cx),
+            Self::Tls(s) => Pin::new(s.as_mut()).poll_shutdown(cx),
+        }
+    }
+}
+
+/// gRPC calls see the same [`PeerInfo`] as HTTP requests, as a plain request extension
+/// gRPC 调用看到与 HTTP 请求相同的 [`PeerInfo`]，以普通请求扩展的形式提供
+impl tonic::transport::server::Connected for ServerIo {
+    type ConnectInfo = PeerInfo;
+
+    fn connect_info(&self) -> Self::ConnectInfo {
+        PeerInfo {
+            // An unknown peer is never a trusted proxy / 未知对端永远不是受信任的代理
+            remote: self
+                .tcp()
+                .peer_addr()
+                .unwrap_or_else(|_| SocketAddr::from(([0, 0, 0, 0], 0))),
+            identity: self.peer_identity(),
+        }
+    }
+}
+
+/// Peer of an HTTP connection, set as `ConnectInfo<PeerInfo>` on every request
+/// HTTP 连接的对端，作为 `ConnectInfo<PeerInfo>` 设置在每个请求上
+#[derive(Debug, Clone)]
+pub struct PeerInfo {
+    pub remote: SocketAddr,
+    /// Verified client certificate, as `sha256:<hex>` / 已验证的客户端证书，格式为 `sha256:<hex>`
+    pub identity: Option<String>,
+}
+
+impl axum::extract::connect_info::Connected<axum::serve::IncomingStream<'_, Listener>>
+    for PeerInfo
+{
+    fn connect_info(stream: axum::serve::IncomingStream<'_, Listener>) -> Self {
+        Self {
+            remote: *stream.remote_addr(),
+            identity: stream.io().peer_identity(),
+        }
+    }
+}
+
+/// TCP listener that terminates TLS when an acceptor is set
+/// 设置了 acceptor 时终止 TLS 的 TCP 监听器
+///
+/// Connections are accepted on a background task and TLS handshakes run on their own
+/// tasks, so a slow or silent client never holds up the others.
+/// 连接在后台任务中接受，TLS 握手各自在独立任务中进行，因此慢速或无响应的客户端不会阻塞其他连接。
+pub struct Listener {
+    local_addr: SocketAddr,
+    accepted: mpsc::Receiver<(ServerIo, SocketAddr)>,
+    task: JoinHandle<()>,
+}
+
+impl Listener {
+    pub async fn bind(addr: SocketAddr, tls: Option<Arc<TlsAcceptor>>) -> io::Result<Self> {
+        let tcp = TcpListener::bind(addr).await?;
+        let local_addr = tcp.local_addr()?;
+        let (tx, accepted) = mpsc::channel(64);
+        let task = tokio::spawn(Self::accept_loop(tcp, tls, tx));
+        Ok(Self {
+            local_addr,
+            accepted,
+            task,
+        })
+    }
+
+    async fn accept_loop(
+        tcp: TcpListener,
+        tls: Option<Arc<TlsAcceptor>>,
+        tx: mpsc::Sender<(ServerIo, SocketAddr)>,
+    ) {
+        loop {
+            let (stream, remote) = match tcp.accept().await {
+                Ok(v) => v,
+                Err(e) => {
+                    // e.g. out of file descriptors; back off instead of spinning
+                    // 例如文件描述符耗尽；退避而非空转
+                    debug!("accept failed: {}", e);
+                    tokio::time::sleep(Duration::from_millis(100)).await;
+                    continue;
+                }
+            };
+            let _ = stream.set_nodelay(true);
+            let Some(acceptor) = tls.as_ref() else {
+                if tx.send((ServerIo::Plain(stream), remote)).await.is_err() {
+                    return;
+                }
+                continue;
+            };
+            // The configuration is taken per connection so reloaded certificates apply
+            // 每个连接单独获取配置，使重新加载的证书生效
+            let acceptor = tokio_rustls::TlsAcceptor::from(acceptor.config());
+            let tx = tx.clone();
+            tokio::spawn(async move {
+                match tokio::time::timeout(HANDSHAKE_TIMEOUT, acceptor.accept(stream)).await {
+                    Ok(Ok(tls)) => {
+                        let io = ServerIo::Tls(Box::new(tls));
+                        if io.peer_identity().is_some() {
+                            debug!(remote = %remote, "TLS client certificate verified");
+                        }
+                        let _ = tx.send((io, remote)).await;
+                    }
+                    Ok(Err(e)) => debug!(remote = %remote, "TLS handshake failed: {}", e),
+                    Err(_) => debug!(remote = %remote, "TLS handshake timed out"),
+                }
+            });
+        }
+    }
+
+    pub async fn accept_io(&mut self) -> (ServerIo, SocketAddr) {
+        match self.accepted.recv().await {
+            Some(conn) => conn,
+            // The accept loop only stops once the listener is dropped
+            // 接受循环仅在监听器被丢弃后才会停止
+            None => std::future::pending().await,
+        }
+    }
+
+    /// Accepted connections as a stream, for tonic / 以流形式提供已接受的连接，供 tonic 使用
+    pub fn incoming(self) -> impl futures::Stream<Item = io::Result<ServerIo>> {
+        futures::stream::unfold(self, |mut l| async move {
+            let (io, _) = l.accept_io().await;
+            Some((Ok(io), l))
+        })
+    }
+}
+
+impl Drop for Listener {
+    fn drop(&mut self) {
+        self.task.abort();
+    }
+}
+
+impl axum::serve::Listener for Listener {
+    type Io = ServerIo;
+    type Addr = SocketAddr;
+
+    async fn accept(&mut self) -> (Self::Io, Self::Addr) {
+        self.accept_io().await
+    }
+
+    fn local_addr(&self) -> io::Result<Self::Addr> {
+        Ok(self.local_addr)
+    }
+}
+
+/// Also expose the peer address as `ConnectInfo<SocketAddr>`, which limiters and handlers
+/// read
+/// 同时以 `ConnectInfo<SocketAddr>` 提供对端地址，供限流器与处理函数读取
+pub async fn peer_addr_middleware(
+    mut req: axum::extract::Request,
+    next: axum::middleware::Next,
+) -> axum::response::Response {
+    let remote = req
+        .extensions()
+        .get::<axum::extract::ConnectInfo<PeerInfo>>()
+        .map(|ci| ci.0.remote);
+    if let Some(remote) = remote {
+        req.extensions_mut()
+            .insert(axum::extract::ConnectInfo(remote));
+    }
+    next.run(req).await
+}
+
+/// Replace the client certificate header with the verified TLS identity
+/// 以已验证的 TLS 标识替换客户端证书请求头
+///
+/// Clients of a TLS listener cannot forge the header; it is removed and set only
+/// when the connection presented a verified certificate.
+/// TLS 监听器的客户端无法伪造该请求头；它会被移除，仅在连接出示了已验证证书时设置。
+pub async fn peer_identity_middleware(
+    axum::extract::State(header): axum::extract::State<Arc<String>>,
+    mut req: axum::extract::Request,
+    next: axum::middleware::Next,
+) -> axum::response::Response {
+    req.headers_mut().remove(header.as_str());
+    let identity = req
+        .extensions()
+        .get::<axum::extract::ConnectInfo<PeerInfo>>()
+        .and_then(|ci| ci.0.identity.as_deref())
+        .and_then(|id| axum::http::HeaderValue::from_str(id).ok());
+    if let (Some(value), Ok(name)) = (
+        identity,
+        axum::http::HeaderName::from_bytes(header.as_bytes()),
+    ) {
+        req.headers_mut().insert(name, value);
+    }
+    next.run(req).await
+}
+
+/// Drop the client certificate header unless a trusted proxy sent the request
+/// 除非请求来自受信任的代理，否则移除客户端证书请求头
+///
+/// Plain-HTTP listeners cannot see certificates, so the header is only accepted from
+/// the TLS-terminating proxies in `http.auth.mtls.trusted_proxies`.
+/// 明文 HTTP 监听器看不到证书，因此只接受来自 `http.auth.mtls.trusted_proxies` 中
+/// TLS 终止代理的该请求头。
+pub async fn forwarded_identity_middleware(
+    axum::extract::State(state): axum::extract::State<Arc<(String, IpAllowlist)>>,
+    mut req: axum::extract::Request,
+    next: axum::middleware::Next,
+) -> axum::response::Response {
+    let (header, proxies) = state.as_ref();
+    let trusted = req
+        .extensions()
+        .get::<axum::extract::ConnectInfo<SocketAddr>>()
+        .is_some_and(|ci| proxies.contains(ci.0.ip()));
+    if !trusted && req.headers_mut().remove(header.as_str()).is_some() {
+        debug!("dropped client certificate header from an untrusted peer");
+    }
+    next.run(req).await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_protocol_versions_and_suites() {
+        assert_eq!(protocol_versions("1.3").unwrap().len(), 1);
+        assert_eq!(protocol_versions("").unwrap().len(), 2);
+        assert!(protocol_versions("1.0").is_err());
+        let known = known_cipher_suites();
+        assert!(known.contains(&"TLS13_AES_128_GCM_SHA256"));
+        assert!(known
+            .iter()
+            .all(|s| s.contains("GCM") || s.contains("CHACHA20")));
+    }
+
+    #[test]
+    fn test_load_reports_missing_files() {
+        let settings = TlsConfig::default();
+        let err = TlsAcceptor::load("grpc", None, Some("k.pem"), &settings, ALPN_GRPC)
+            .err()
+            .unwrap();
+        assert!(err.contains("cert_path is required"), "{}", err);
+
+        let err = TlsAcceptor::load(
+            "grpc",
+            Some("/nonexistent/cert.pem"),
+            Some("/nonexistent/key.pem"),
+            &settings,
+            ALPN_GRPC,
+        )
+        .err()
+        .unwrap();
+        assert!(err.contains("/nonexistent/cert.pem"), "{}", err);
+
+        let bad_suite = TlsConfig {
+            cipher_suites: vec!["TLS_RSA_WITH_RC4_128_SHA".to_string()],
+            ..Default::default()
+        };
+        let err = build_server_config(
+            Path::new("/nonexistent/cert.pem"),
+            Path::new("/nonexistent/key.pem"),
+            &bad_suite,
+            ALPN_HTTP,
+        )
+        .unwrap_err();
+        assert!(err.contains("unknown suite"), "{}", err);
+    }
+
+    #[tokio::test]
+    async fn test_plain_listener_has_no_peer_identity() {
+        let mut listener = Listener::bind("127.0.0.1:0".parse().unwrap(), None)
+            .await
+            .unwrap();
+        let addr = axum::serve::Listener::local_addr(&listener).unwrap();
+        let client = TcpStream::connect(addr).await.unwrap();
+        let (io, remote) = listener.accept_io().await;
+        assert_eq!(remote, client.local_addr().unwrap());
+        assert_eq!(io.peer_identity(), None);
+    }
+
+    #[tokio::test]
+    async fn test_identity_header_comes_from_the_connection() {
+        use tower::ServiceExt;
+
+        let app = axum::Router::new()
+            .route(
+                "/",
+                axum::routing::get(
+                    |axum::extract::ConnectInfo(remote): axum::extract::ConnectInfo<SocketAddr>,
+                     headers: axum::http::HeaderMap| async move {
+                        let id = headers
+                            .get("x-client-cert")
+                            .and_then(|v| v.to_str().ok())
+                            .unwrap_or("-")
+                            .to_string();
+                        format!("{} {}", remote, id)
+                    },
+                ),
+            )
+            .layer(axum::middleware::from_fn_with_state(
+                Arc::new("x-client-cert".to_string()),
+                peer_identity_middleware,
+            ))
+            .layer(axum::middleware::from_fn(peer_addr_middleware));
+        let call = |identity: Option<&str>| {
+            let mut req = axum::http::Request::builder()
+                .uri("/")
+                .header("x-client-cert", "sha256:forged")
+                .body(axum::body::Body::empty())
+                .unwrap();
+            req.extensions_mut()
+                .insert(axum::extract::ConnectInfo(PeerInfo {
+                    remote: "10.0.0.7:4000".parse().unwrap(),
+                    identity: identity.map(str::to_string),
+                }));
+            let app = app.clone();
+            async move {
+                let resp = app.oneshot(req).await.unwrap();
+                let body = axum::body::to_bytes(resp.into_body(), 1024).await.unwrap();
+                String::from_utf8(body.to_vec()).unwrap()
+            }
+        };
+        assert_eq!(call(Some("sha256:abc")).await, "10.0.0.7:4000 sha256:abc");
+        assert_eq!(call(None).await, "10.0.0.7:4000 -");
+    }
+
+    #[test]
+    fn test_cert_fingerprint() {
+        let id = cert_fingerprint(b"abc");
+        assert_eq!(
+            id,
+            "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+        );
+    }
+}
@@ -0,0 +1,527 @@
+//! Out-of-process tool plugins
+//! 进程外工具插件
+//!
+//! Tools that pull in heavy dependencies (desktop automation, headless browsers,
+//! telephony SDKs, ...) are shipped as standalone executables in a plugins directory
+//! instead of being compiled into spearlet. Every executable speaks a tiny protocol:
+//! 依赖较重的工具（桌面自动化、无头浏览器、电话 SDK 等）以独立可执行文件形式放在插件目录中，
+//! 而不是编译进 spearlet。每个可执行文件遵循一个简单协议：
+//!
+//! - `<plugin> describe` prints `{"tools":[{"name","description","parameters"}]}` on stdout
+//!   `<plugin> describe` 在 stdout 输出 `{"tools":[{"name","description","parameters"}]}`
+//! - `<plugin> invoke <tool>` reads the JSON arguments on stdin and prints the result on
+//!   stdout; a non-zero exit status is a tool error (stderr carries the message)
+//!   `<plugin> invoke <tool>` 从 stdin 读取 JSON 参数并在 stdout 输出结果；
+//!   非零退出码表示工具错误（stderr 为错误信息）
+//!
+//! Plugins are discovered once at start. Chat sessions opt in with the
+//! `tool_plugins` param; tools are exposed to the model as `plugin__<name>`.
+//! 插件在启动时发现一次。chat 会话通过 `tool_plugins` 参数启用；工具以 `plugin__<name>`
+//! 的名字暴露给模型。
+//!
+//! When scratch files are enabled, `SPEAR_SCRATCH_DIR` points a plugin at the calling task's
+//! scratch directory, so it can read or leave files (audio, images) the task sees too.
+//! 启用临时文件时，`SPEAR_SCRATCH_DIR` 指向调用任务的临时目录，插件可以在其中读取或留下任务同样
+//! 可见的文件（音频、图片）。
+//!
+//! A plugin runs inside the calling task's temporary workspace, which is also its `TMPDIR`,
+//! so files it writes to its working directory are removed with the task.
+//! 插件在调用任务的临时工作区中运行，该目录同时是其 `TMPDIR`，因此写入工作目录的文件会随任务删除。
+//!
+//! In simulation mode the registry also offers the tools of `tool_simulation`, which
+//! shadow plugin tools of the same name.
+//! 模拟模式下注册表还提供 `tool_simulation` 中的工具，它们会遮蔽同名的插件工具。
+
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::process::Stdio;
+use std::sync::{Arc, OnceLock};
+use std::time::Duration;
+
+use serde::Deserialize;
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
+use tracing::{debug, info, warn};
+
+use crate::spearlet::config::ToolPluginConfig;
+use crate::spearlet::scratch_files::ENV_SCRATCH_DIR;
+use crate::spearlet::temp_workspace;
+use crate::spearlet::tool_simulation::{simulated_tools, SimulatedAction, ToolSimulator};
+
+/// Namespace prefix for plugin tools / 插件工具的命名空间前缀
+pub const TOOL_NAMESPACE_PREFIX: &str = "plugin__";
+
+/// Directories of the calling task a plugin runs with / 插件运行时使用的调用任务目录
+#[derive(Debug, Clone, Default)]
+pub struct ToolDirs {
+    /// Passed as `SPEAR_SCRATCH_DIR` / 作为 `SPEAR_SCRATCH_DIR` 传入
+    pub scratch: Option<PathBuf>,
+    /// Working directory and `TMPDIR` / 工作目录与 `TMPDIR`
+    pub temp: Option<PathBuf>,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+struct DescribeOutput {
+    #[serde(default)]
+    tools: Vec<DescribedTool>,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+struct DescribedTool {
+    name: String,
+    #[serde(default)]
+    description: String,
+    #[serde(default)]
+    parameters: Option<serde_json::Value>,
+}
+
+/// A tool provided by a plugin executable / 插件可执行文件提供的工具
+#[derive(Debug, Clone)]
+pub struct PluginTool {
+    pub name: String,
+    pub description: String,
+    pub parameters: serde_json::Value,
+    pub binary: PathBuf,
+}
+
+/// Registry of discovered plugin tools / 已发现插件工具的注册表
+#[derive(Debug, Default)]
+pub struct ToolPluginRegistry {
+    tools: HashMap<String, PluginTool>,
+    invoke_timeout: Duration,
+    max_output_bytes: usize,
+    simulator: Option<ToolSimulator>,
+}
+
+impl ToolPluginRegistry {
+    /// Scan the plugins directory / 扫描插件目录
+    pub async fn discover(config: &ToolPluginConfig) -> Self {
+        let mut registry = Self {
+            tools: HashMap::new(),
+            invoke_timeout: Duration::from_millis(config.invoke_timeout_ms.max(1)),
+            max_output_bytes: config.max_output_bytes,
+            simulator: None,
+        };
+        if config.simulation.enabled {
+            info!(
+                log = %config.simulation.log_path,
+                "tool simulation enabled; hardware tools are recorded, not executed"
+            );
+            registry.simulator = Some(ToolSimulator::new(&config.simulation));
+        }
+        let dir = config.dir.trim();
+        if dir.is_empty() {
+            return registry;
+        }
+
+        let mut entries = match tokio::fs::read_dir(dir).await {
+            Ok(e) => e,
+            Err(e) => {
+                warn!(dir, error = %e, "tool plugins directory unreadable");
+                return registry;
+            }
+        };
+        let mut binaries = Vec::new();
+        while let Ok(Some(entry)) = entries.next_entry().await {
+            let path = entry.path();
+            if is_executable(&path) {
+                // Absolute, since plugins run in another working directory
+                // 使用绝对路径，因为插件在其他工作目录中运行
+                binaries.push(path.canonicalize().unwrap_or(path));
+            }
+        }
+        binaries.sort();
+
+        let describe_timeout = Duration::from_millis(config.describe_timeout_ms.max(1));
+        for binary in binaries {
+            let described = match describe(&binary, describe_timeout).await {
+                Ok(d) => d,
+                Err(e) => {
+                    warn!(plugin = %binary.display(), error = %e, "tool plugin describe failed");
+                    continue;
+                }
+            };
+            for tool in described.tools {
+                if tool.name.trim().is_empty() {
+                    continue;
+                }
+                if registry.tools.contains_key(&tool.name) {
+                    warn!(plugin = %binary.display(), tool = %tool.name, "duplicate plugin tool ignored");
+                    continue;
+                }
+                debug!(plugin = %binary.display(), tool = %tool.name, "tool plugin registered");
+                registry.tools.insert(
+                    tool.name.clone(),
+                    PluginTool {
+                        name: tool.name,
+                        description: tool.description,
+                        parameters: tool
+                            .parameters
+                            .unwrap_or_else(|| serde_json::json!({"type": "object"})),
+                        binary: binary.clone(),
+                    },
+                );
+            }
+        }
+        info!(dir, tools = registry.tools.len(), "tool plugins discovered");
+        registry
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.tools.is_empty() && self.simulator.is_none()
+    }
+
+    /// Simulated tools are offered / 提供模拟工具
+    pub fn simulating(&self) -> bool {
+        self.simulator.is_some()
+    }
+
+    /// Sorted tool names / 排序后的工具名
+    pub fn tool_names(&self) -> Vec<String> {
+        let mut names: Vec<String> = self.tools.keys().cloned().collect();
+        if self.simulator.is_some() {
+            names.extend(simulated_tools().into_iter().map(|(n, _, _)| n.to_string()));
+        }
+        names.sort();
+        names.dedup();
+        names
+    }
+
+    /// Actions recorded in simulation mode / 模拟模式下记录的动作
+    pub fn simulated_actions(&self) -> Vec<SimulatedAction> {
+        self.simulator
+            .as_ref()
+            .map(|s| s.actions())
+            .unwrap_or_default()
+    }
+
+    /// `(name, description, parameters)` of every tool, sorted by name
+    /// 所有工具的 `(name, description, parameters)`，按名称排序
+    pub fn definitions(&self) -> Vec<(String, String, serde_json::Value)> {
+        let simulated: HashMap<&str, (&str, serde_json::Value)> = if self.simulator.is_some() {
+            simulated_tools()
+                .into_iter()
+                .map(|(n, d, p)| (n, (d, p)))
+                .collect()
+        } else {
+            HashMap::new()
+        };
+        self.tool_names()
+            .into_iter()
+            .filter_map(|name| {
+                let (description, parameters) = match simulated.get(name.as_str()) {
+                    Some((d, p)) => (d.to_string(), p.clone()),
+                    None => {
+                        let t = self.tools.get(&name)?;
+                        (t.description.clone(), t.parameters.clone())
+                    }
+                };
+                Some((name, description, parameters))
+            })
+            .collect()
+    }
+
+    /// Parameter schema of a tool by its namespaced or plain name
+    /// 按带命名空间或原始名称获取工具的参数 schema
+    pub fn parameters(&self, name: &str) -> Option<serde_json::Value> {
+        let plain = name.strip_prefix(TOOL_NAMESPACE_PREFIX).unwrap_or(name);
+        if self.simulator.is_some() {
+            if let Some((_, _, p)) = simulated_tools().into_iter().find(|(n, _, _)| *n == plain) {
+                return Some(p);
+            }
+        }
+        self.tools.get(plain).map(|t| t.parameters.clone())
+    }
+
+    /// OpenAI-style tool definitions with namespaced names / 带命名空间的 OpenAI 风格工具定义
+    pub fn openai_tools(&self) -> Vec<String> {
+        self.definitions()
+            .into_iter()
+            .map(|(name, description, parameters)| {
+                serde_json::json!({
+                    "type": "function",
+                    "function": {
+                        "name": format!("{}{}", TOOL_NAMESPACE_PREFIX, name),
+                        "description": description,
+                        "parameters": parameters,
+                    }
+                })
+                .to_string()
+            })
+            .collect()
+    }
+
+    /// Invoke a tool by its namespaced or plain name / 按带命名空间或原始名称调用工具
+    pub async fn invoke(&self, name: &str, args: &str) -> Result<String, String> {
+        self.invoke_in(name, args, &ToolDirs::default()).await
+    }
+
+    /// Invoke a tool with the directories of the calling task / 使用调用任务的目录调用工具
+    pub async fn invoke_in(
+        &self,
+        name: &str,
+        args: &str,
+        dirs: &ToolDirs,
+    ) -> Result<String, String> {
+        let plain = name.strip_prefix(TOOL_NAMESPACE_PREFIX).unwrap_or(name);
+        if let Some(sim) = self.simulator.as_ref() {
+            if sim.provides(plain) || (self.tools.contains_key(plain) && sim.intercepts(plain)) {
+                return sim.invoke(plain, args);
+            }
+        }
+        let tool = self
+            .tools
+            .get(plain)
+            .ok_or_else(|| format!("unknown plugin tool: {}", plain))?;
+
+        let mut command = Command::new(&tool.binary);
+        if let Some(dir) = dirs.scratch.as_deref() {
+            command.env(ENV_SCRATCH_DIR, dir);
+        }
+        if let Some(dir) = dirs.temp.as_deref() {
+            command.current_dir(dir);
+            command.envs(temp_workspace::environment(dir));
+        }
+        let mut child = command
+            .arg("invoke")
+            .arg(&tool.name)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .kill_on_drop(true)
+            .spawn()
+            .map_err(|e| format!("plugin spawn failed: {}", e))?;
+        if let Some(mut stdin) = child.stdin.take() {
+            // A plugin may exit without reading its input; the exit status reports that
+            // 插件可能不读取输入就退出；由退出码反映该情况
+            let _ = stdin.write_all(args.as_bytes()).await;
+        }
+
+        let output = tokio::time::timeout(self.invoke_timeout, child.wait_with_output())
+            .await
+            .map_err(|_| "plugin tool timeout".to_string())?
+            .map_err(|e| format!("plugin wait failed: {}", e))?;
+        if !output.status.success() {
+            return Err(format!(
+                "plugin tool exited with {}: {}",
+                output.status,
+                String::from_utf8_lossy(&output.stderr).trim()
+            ));
+        }
+        let mut out = String::from_utf8_lossy(&output.stdout)
+            .trim_end()
+            .to_string();
+        if self.max_output_bytes > 0 && out.len() > self.max_output_bytes {
+            let mut cut = self.max_output_bytes;
+            while !out.is_char_boundary(cut) {
+                cut -= 1;
+            }
+            out.truncate(cut);
+        }
+        Ok(out)
+    }
+}
+
+async fn describe(binary: &Path, limit: Duration) -> Result<DescribeOutput, String> {
+    let output = tokio::time::timeout(
+        limit,
+        Command::new(binary)
+            .arg("describe")
+            .stdin(Stdio::null())
+            .kill_on_drop(true)
+            .output(),
+    )
+    .await
+    .map_err(|_| "describe timeout".to_string())?
+    .map_err(|e| e.to_string())?;
+    if !output.status.success() {
+        return Err(format!("describe exited with {}", output.status));
+    }
+    serde_json::from_slice(&output.stdout).map_err(|e| format!("invalid describe output: {}", e))
+}
+
+#[cfg(unix)]
+fn is_executable(path: &Path) -> bool {
+    use std::os::unix::fs::PermissionsExt;
+    std::fs::metadata(path)
+        .map(|m| m.is_file() && m.permissions().mode() & 0o111 != 0)
+        .unwrap_or(false)
+}
+
+#[cfg(not(unix))]
+fn is_executable(path: &Path) -> bool {
+    path.is_file()
+}
+
+/// The plugin registry of one spearlet, discovered once / 单个 spearlet 的插件注册表，只发现一次
+#[derive(Default)]
+pub struct ToolPlugins {
+    registry: OnceLock<Arc<ToolPluginRegistry>>,
+}
+
+impl ToolPlugins {
+    /// Discover plugins once for the spearlet / 为 spearlet 发现一次插件
+    pub async fn discover(&self, config: &ToolPluginConfig) -> Arc<ToolPluginRegistry> {
+        if let Some(r) = self.registry.get() {
+            return r.clone();
+        }
+        let registry = Arc::new(ToolPluginRegistry::discover(config).await);
+        self.registry.get_or_init(|| registry).clone()
+    }
+
+    /// The registry, if discovered / 插件注册表（若已发现）
+    pub fn get(&self) -> Option<Arc<ToolPluginRegistry>> {
+        self.registry.get().cloned()
+    }
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::PermissionsExt;
+
+    fn write_plugin(dir: &Path, name: &str, script: &str) {
+        let path = dir.join(name);
+        std::fs::write(&path, script).unwrap();
+        std::fs::set_permissions(&path, std::fs::Permissions::from_mode(0o755)).unwrap();
+    }
+
+    const ECHO_PLUGIN: &str = r#"#!/bin/sh
+case "$1" in
+  describe) echo '{"tools":[{"name":"echo","description":"echo args","parameters":{"type":"object"}}]}' ;;
+  invoke) cat ;;
+  *) exit 2 ;;
+esac
+"#;
+
+    #[tokio::test]
+    async fn test_discover_and_invoke_plugin() {
+        let tmp = tempfile::tempdir().unwrap();
+        write_plugin(tmp.path(), "echo-plugin", ECHO_PLUGIN);
+        std::fs::write(tmp.path().join("README"), "not a plugin").unwrap();
+
+        let cfg = ToolPluginConfig {
+            dir: tmp.path().to_string_lossy().to_string(),
+            ..Default::default()
+        };
+        let reg = ToolPluginRegistry::discover(&cfg).await;
+        assert_eq!(reg.tool_names(), vec!["echo".to_string()]);
+
+        let defs = reg.openai_tools();
+        let v: serde_json::Value = serde_json::from_str(&defs[0]).unwrap();
+        assert_eq!(v["function"]["name"], "plugin__echo");
+
+        let out = reg.invoke("plugin__echo", r#"{"x":1}"#).await.unwrap();
+        assert_eq!(out, r#"{"x":1}"#);
+        assert!(reg.invoke("plugin__missing", "{}").await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_plugin_runs_in_temp_dir() {
+        let tmp = tempfile::tempdir().unwrap();
+        write_plugin(
+            tmp.path(),
+            "shot-plugin",
+            "#!/bin/sh\nif [ \"$1\" = describe ]; then echo '{\"tools\":[{\"name\":\"shot\"}]}'; else printf png > shot.png; echo \"$TMPDIR\"; fi\n",
+        );
+        let cfg = ToolPluginConfig {
+            dir: tmp.path().to_string_lossy().to_string(),
+            ..Default::default()
+        };
+        let reg = ToolPluginRegistry::discover(&cfg).await;
+        let temp = tempfile::tempdir().unwrap();
+        let out = reg
+            .invoke_in(
+                "plugin__shot",
+                "{}",
+                &ToolDirs {
+                    temp: Some(temp.path().to_path_buf()),
+                    ..Default::default()
+                },
+            )
+            .await
+            .unwrap();
+        assert_eq!(out, temp.path().to_string_lossy());
+        assert!(temp.path().join("shot.png").exists());
+    }
+
+    #[tokio::test]
+    async fn test_plugin_sees_scratch_dir() {
+        let tmp = tempfile::tempdir().unwrap();
+        write_plugin(
+            tmp.path(),
+            "scratch-plugin",
+            "#!/bin/sh\nif [ \"$1\" = describe ]; then echo '{\"tools\":[{\"name\":\"save\"}]}'; else printf wav > \"$SPEAR_SCRATCH_DIR/out.wav\"; echo out.wav; fi\n",
+        );
+        let cfg = ToolPluginConfig {
+            dir: tmp.path().to_string_lossy().to_string(),
+            ..Default::default()
+        };
+        let reg = ToolPluginRegistry::discover(&cfg).await;
+        let scratch = tempfile::tempdir().unwrap();
+        let out = reg
+            .invoke_in(
+                "plugin__save",
+                "{}",
+                &ToolDirs {
+                    scratch: Some(scratch.path().to_path_buf()),
+                    ..Default::default()
+                },
+            )
+            .await
+            .unwrap();
+        assert_eq!(out, "out.wav");
+        assert_eq!(
+            std::fs::read(scratch.path().join("out.wav")).unwrap(),
+            b"wav"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_plugin_failure_is_reported() {
+        let tmp = tempfile::tempdir().unwrap();
+        write_plugin(
+            tmp.path(),
+            "fail-plugin",
+            "#!/bin/sh\nif [ \"$1\" = describe ]; then echo '{\"tools\":[{\"name\":\"fail\"}]}'; else echo boom >&2; exit 1; fi\n",
+        );
+        let cfg = ToolPluginConfig {
+            dir: tmp.path().to_string_lossy().to_string(),
+            ..Default::default()
+        };
+        let reg = ToolPluginRegistry::discover(&cfg).await;
+        let err = reg.invoke("fail", "{}").await.unwrap_err();
+        assert!(err.contains("boom"));
+    }
+
+    #[tokio::test]
+    async fn test_simulation_shadows_and_intercepts_plugins() {
+        let tmp = tempfile::tempdir().unwrap();
+        write_plugin(tmp.path(), "echo-plugin", ECHO_PLUGIN);
+        let mut cfg = ToolPluginConfig {
+            dir: tmp.path().to_string_lossy().to_string(),
+            ..Default::default()
+        };
+        cfg.simulation.enabled = true;
+        cfg.simulation.intercept = vec!["echo".to_string()];
+        let reg = ToolPluginRegistry::discover(&cfg).await;
+        assert!(reg.tool_names().contains(&"screenshot".to_string()));
+        assert!(reg.tool_names().contains(&"echo".to_string()));
+        assert_eq!(reg.openai_tools().len(), reg.tool_names().len());
+
+        let out = reg.invoke("plugin__echo", r#"{"x":1}"#).await.unwrap();
+        assert!(out.contains("\"simulated\":true"));
+        reg.invoke("plugin__mouse_move", r#"{"x":1,"y":2}"#)
+            .await
+            .unwrap();
+        let actions = reg.simulated_actions();
+        assert_eq!(actions.len(), 2);
+        assert_eq!(actions[0].tool, "echo");
+    }
+
+    #[tokio::test]
+    async fn test_empty_dir_disables_plugins() {
+        let reg = ToolPluginRegistry::discover(&ToolPluginConfig::default()).await;
+        assert!(reg.is_empty());
+    }
+}
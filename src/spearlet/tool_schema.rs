@@ -0,0 +1,159 @@
+//! Tool argument validation against JSON Schema
+//! 依据 JSON Schema 校验工具参数
+//!
+//! Covers the part of JSON Schema that tool `parameters` use in practice: `type` (a name or
+//! a list of names), `enum`, `const`, `properties`, `required`, `additionalProperties: false`,
+//! `items`, `minimum`/`maximum`, `minLength`/`maxLength` and `minItems`/`maxItems`. Other
+//! keywords are ignored, so an unknown schema never rejects arguments.
+//! 覆盖工具 `parameters` 实际使用的 JSON Schema 子集：`type`（单个类型名或类型名列表）、`enum`、
+//! `const`、`properties`、`required`、`additionalProperties: false`、`items`、`minimum`/`maximum`、
+//! `minLength`/`maxLength` 与 `minItems`/`maxItems`。其余关键字被忽略，未知的 schema 不会拒绝参数。
+
+use serde_json::Value;
+
+/// Check `value` against `schema`; the error names the offending path, e.g. `$.keys[1]`
+/// 依据 `schema` 校验 `value`；错误中指明出错路径，例如 `$.keys[1]`
+pub fn validate(schema: &Value, value: &Value) -> Result<(), String> {
+    check(schema, value, "$")
+}
+
+fn type_matches(name: &str, value: &Value) -> bool {
+    match name {
+        "object" => value.is_object(),
+        "array" => value.is_array(),
+        "string" => value.is_string(),
+        "boolean" => value.is_boolean(),
+        "null" => value.is_null(),
+        "number" => value.is_number(),
+        "integer" => value.is_i64() || value.is_u64(),
+        _ => true,
+    }
+}
+
+fn check(schema: &Value, value: &Value, path: &str) -> Result<(), String> {
+    let Some(schema) = schema.as_object() else {
+        return Ok(());
+    };
+    match schema.get("type") {
+        Some(Value::String(t)) if !type_matches(t, value) => {
+            return Err(format!("{}: expected {}", path, t));
+        }
+        Some(Value::Array(ts)) => {
+            let names: Vec<&str> = ts.iter().filter_map(|t| t.as_str()).collect();
+            if !names.iter().any(|t| type_matches(t, value)) {
+                return Err(format!("{}: expected one of {}", path, names.join(", ")));
+            }
+        }
+        _ => {}
+    }
+    if let Some(options) = schema.get("enum").and_then(|e| e.as_array()) {
+        if !options.contains(value) {
+            return Err(format!("{}: not one of the allowed values", path));
+        }
+    }
+    if let Some(c) = schema.get("const") {
+        if c != value {
+            return Err(format!("{}: must be {}", path, c));
+        }
+    }
+    let limit = |key: &str| schema.get(key).and_then(|v| v.as_f64());
+    if let Some(n) = value.as_f64() {
+        if limit("minimum").is_some_and(|m| n < m) || limit("maximum").is_some_and(|m| n > m) {
+            return Err(format!("{}: out of range", path));
+        }
+    }
+    if let Some(s) = value.as_str() {
+        let len = s.chars().count() as f64;
+        if limit("minLength").is_some_and(|m| len < m)
+            || limit("maxLength").is_some_and(|m| len > m)
+        {
+            return Err(format!("{}: length out of range", path));
+        }
+    }
+    if let Some(items) = value.as_array() {
+        let len = items.len() as f64;
+        if limit("minItems").is_some_and(|m| len < m) || limit("maxItems").is_some_and(|m| len > m)
+        {
+            return Err(format!("{}: item count out of range", path));
+        }
+        if let Some(item_schema) = schema.get("items") {
+            for (i, item) in items.iter().enumerate() {
+                check(item_schema, item, &format!("{}[{}]", path, i))?;
+            }
+        }
+    }
+    if let Some(obj) = value.as_object() {
+        if let Some(required) = schema.get("required").and_then(|r| r.as_array()) {
+            for key in required.iter().filter_map(|k| k.as_str()) {
+                if !obj.contains_key(key) {
+                    return Err(format!("{}: missing {}", path, key));
+                }
+            }
+        }
+        let properties = schema.get("properties").and_then(|p| p.as_object());
+        let closed = schema.get("additionalProperties") == Some(&Value::Bool(false));
+        for (key, v) in obj {
+            match properties.and_then(|p| p.get(key)) {
+                Some(prop) => check(prop, v, &format!("{}.{}", path, key))?,
+                None if closed => return Err(format!("{}: unexpected {}", path, key)),
+                None => {}
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_validate_object_arguments() {
+        let schema = json!({
+            "type": "object",
+            "properties": {
+                "line": {"type": "string", "minLength": 1},
+                "value": {"type": "integer", "enum": [0, 1]},
+                "keys": {"type": "array", "items": {"type": "string"}, "maxItems": 3},
+            },
+            "required": ["line", "value"],
+            "additionalProperties": false,
+        });
+        assert!(validate(&schema, &json!({"line": "a", "value": 1})).is_ok());
+        assert!(validate(&schema, &json!({"line": "a", "value": 1, "keys": ["x"]})).is_ok());
+
+        let err = |v: Value| validate(&schema, &v).unwrap_err();
+        assert_eq!(err(json!({"line": "a"})), "$: missing value");
+        assert_eq!(
+            err(json!({"line": "a", "value": 2})),
+            "$.value: not one of the allowed values"
+        );
+        assert_eq!(
+            err(json!({"line": "a", "value": 1.5})),
+            "$.value: expected integer"
+        );
+        assert_eq!(
+            err(json!({"line": "", "value": 0})),
+            "$.line: length out of range"
+        );
+        assert_eq!(
+            err(json!({"line": "a", "value": 0, "keys": ["x", 2]})),
+            "$.keys[1]: expected string"
+        );
+        assert_eq!(
+            err(json!({"line": "a", "value": 0, "x": 1})),
+            "$: unexpected x"
+        );
+        assert_eq!(err(json!([])), "$: expected object");
+    }
+
+    #[test]
+    fn test_validate_ignores_unknown_keywords() {
+        let schema = json!({"type": ["number", "null"], "minimum": 0, "format": "whatever"});
+        assert!(validate(&schema, &json!(3)).is_ok());
+        assert!(validate(&schema, &Value::Null).is_ok());
+        assert!(validate(&schema, &json!(-1)).is_err());
+        assert!(validate(&json!(true), &json!({"any": 1})).is_ok());
+    }
+}
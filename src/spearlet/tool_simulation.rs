@@ -0,0 +1,424 @@
+//! Simulated hardware tools
+//! 模拟硬件工具
+//!
+//! With `tool_plugins.simulation.enabled`, the mouse, keyboard, screenshot and GPIO tools
+//! below are offered to chat sessions in place of real desktop or board plugins. Every
+//! call is validated like a real action, recorded to an action log and answered with a
+//! plausible result; nothing touches the host. Automation agents can then be developed
+//! and tested on CI machines without a display or GPIO lines.
+//! 启用 `tool_plugins.simulation.enabled` 后，下列鼠标、键盘、截屏与 GPIO 工具代替真实的
+//! 桌面或板级插件提供给 chat 会话。每次调用像真实动作一样校验，记录到动作日志并返回合理的
+//! 结果，不会操作主机。自动化智能体因此可在没有显示器或 GPIO 的 CI 机器上开发与测试。
+
+use std::collections::HashMap;
+use std::io::Write;
+use std::path::PathBuf;
+
+use base64::Engine;
+use parking_lot::Mutex;
+use serde::Serialize;
+use serde_json::{json, Value};
+
+use crate::spearlet::clock;
+use crate::spearlet::config::ToolSimulationConfig;
+
+/// Simulated tools: name, description and JSON schema of the arguments
+/// 模拟工具：名称、描述与参数的 JSON schema
+pub fn simulated_tools() -> Vec<(&'static str, &'static str, Value)> {
+    let int = || json!({"type": "integer"});
+    let string = || json!({"type": "string"});
+    vec![
+        (
+            "mouse_move",
+            "Move the mouse pointer to screen coordinates",
+            object_schema(json!({"x": int(), "y": int()}), &["x", "y"]),
+        ),
+        (
+            "mouse_click",
+            "Click a mouse button, at the given coordinates or the current pointer",
+            object_schema(
+                json!({
+                    "x": int(),
+                    "y": int(),
+                    "button": {"type": "string", "enum": ["left", "right", "middle"]},
+                    "count": int(),
+                }),
+                &[],
+            ),
+        ),
+        (
+            "mouse_scroll",
+            "Scroll the mouse wheel",
+            object_schema(json!({"dx": int(), "dy": int()}), &[]),
+        ),
+        (
+            "keyboard_type",
+            "Type text",
+            object_schema(json!({"text": string()}), &["text"]),
+        ),
+        (
+            "keyboard_press",
+            "Press a key combination, e.g. [\"ctrl\", \"c\"]",
+            object_schema(
+                json!({"keys": {"type": "array", "items": string()}}),
+                &["keys"],
+            ),
+        ),
+        (
+            "screenshot",
+            "Capture the screen as a PNG image",
+            object_schema(json!({}), &[]),
+        ),
+        (
+            "gpio_write",
+            "Set a GPIO line to 0 or 1",
+            object_schema(
+                json!({"line": string(), "value": {"type": "integer", "enum": [0, 1]}}),
+                &["line", "value"],
+            ),
+        ),
+        (
+            "gpio_read",
+            "Read a GPIO line",
+            object_schema(json!({"line": string()}), &["line"]),
+        ),
+    ]
+}
+
+fn object_schema(properties: Value, required: &[&str]) -> Value {
+    json!({"type": "object", "properties": properties, "required": required})
+}
+
+/// One recorded action / 一条记录的动作
+#[derive(Debug, Clone, Serialize)]
+pub struct SimulatedAction {
+    pub seq: u64,
+    pub tool: String,
+    pub args: Value,
+    /// Whether the action was accepted / 动作是否被接受
+    pub ok: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+#[derive(Debug, Default)]
+struct State {
+    seq: u64,
+    pointer: (i64, i64),
+    gpio: HashMap<String, u8>,
+    actions: Vec<SimulatedAction>,
+}
+
+/// Records hardware tool calls instead of executing them / 记录而不执行硬件工具调用
+#[derive(Debug)]
+pub struct ToolSimulator {
+    log_path: Option<PathBuf>,
+    width: u32,
+    height: u32,
+    intercept: Vec<String>,
+    state: Mutex<State>,
+}
+
+/// Actions kept in memory / 内存中保留的动作数
+const MAX_ACTIONS: usize = 10_000;
+
+impl ToolSimulator {
+    pub fn new(config: &ToolSimulationConfig) -> Self {
+        let log_path = Some(config.log_path.trim())
+            .filter(|p| !p.is_empty())
+            .map(PathBuf::from);
+        Self {
+            log_path,
+            width: config.screen_width.clamp(1, 8192),
+            height: config.screen_height.clamp(1, 8192),
+            intercept: config.intercept.clone(),
+            state: Mutex::new(State::default()),
+        }
+    }
+
+    /// Whether a tool name is a simulated tool / 工具名是否为模拟工具
+    pub fn provides(&self, name: &str) -> bool {
+        simulated_tools().iter().any(|(n, _, _)| *n == name)
+    }
+
+    /// Whether a plugin tool is recorded instead of run / 插件工具是否只记录而不运行
+    pub fn intercepts(&self, name: &str) -> bool {
+        self.intercept.iter().any(|t| t == "*" || t == name)
+    }
+
+    /// Recorded actions, oldest first / 已记录的动作，按时间先后
+    pub fn actions(&self) -> Vec<SimulatedAction> {
+        self.state.lock().actions.clone()
+    }
+
+    /// Validate, record and answer a tool call / 校验、记录并应答一次工具调用
+    pub fn invoke(&self, tool: &str, args: &str) -> Result<String, String> {
+        let args: Value = if args.trim().is_empty() {
+            json!({})
+        } else {
+            serde_json::from_str(args).map_err(|e| format!("invalid arguments: {}", e))?
+        };
+        let mut state = self.state.lock();
+        state.seq += 1;
+        let seq = state.seq;
+        let result = self.apply(&mut state, tool, &args);
+        let action = SimulatedAction {
+            seq,
+            tool: tool.to_string(),
+            args,
+            ok: result.is_ok(),
+            error: result.as_ref().err().cloned(),
+        };
+        self.append_log(&action);
+        if state.actions.len() >= MAX_ACTIONS {
+            state.actions.remove(0);
+        }
+        state.actions.push(action);
+        drop(state);
+
+        let mut out = result?;
+        if let Some(obj) = out.as_object_mut() {
+            obj.insert("simulated".to_string(), true.into());
+            obj.insert("seq".to_string(), seq.into());
+        }
+        Ok(out.to_string())
+    }
+
+    fn apply(&self, state: &mut State, tool: &str, args: &Value) -> Result<Value, String> {
+        match tool {
+            "mouse_move" => {
+                let (x, y) = self.point(args)?.ok_or("x and y are required")?;
+                state.pointer = (x, y);
+                Ok(json!({"x": x, "y": y}))
+            }
+            "mouse_click" => {
+                if let Some(p) = self.point(args)? {
+                    state.pointer = p;
+                }
+                let button = args
+                    .get("button")
+                    .and_then(|v| v.as_str())
+                    .unwrap_or("left");
+                if !matches!(button, "left" | "right" | "middle") {
+                    return Err(format!("unknown button: {}", button));
+                }
+                let count = args.get("count").and_then(|v| v.as_u64()).unwrap_or(1);
+                if !(1..=3).contains(&count) {
+                    return Err("count must be 1 to 3".to_string());
+                }
+                let (x, y) = state.pointer;
+                Ok(json!({"x": x, "y": y, "button": button, "count": count}))
+            }
+            "mouse_scroll" => {
+                let dx = args.get("dx").and_then(|v| v.as_i64()).unwrap_or(0);
+                let dy = args.get("dy").and_then(|v| v.as_i64()).unwrap_or(0);
+                Ok(json!({"dx": dx, "dy": dy}))
+            }
+            "keyboard_type" => {
+                let text = args
+                    .get("text")
+                    .and_then(|v| v.as_str())
+                    .ok_or("text is required")?;
+                Ok(json!({"chars": text.chars().count()}))
+            }
+            "keyboard_press" => {
+                let keys: Vec<&str> = args
+                    .get("keys")
+                    .and_then(|v| v.as_array())
+                    .ok_or("keys is required")?
+                    .iter()
+                    .filter_map(|k| k.as_str())
+                    .collect();
+                if keys.is_empty() {
+                    return Err("keys must not be empty".to_string());
+                }
+                Ok(json!({"keys": keys}))
+            }
+            "screenshot" => {
+                let png = blank_png(self.width, self.height);
+                Ok(json!({
+                    "width": self.width,
+                    "height": self.height,
+                    "format": "png",
+                    "data_b64": base64::engine::general_purpose::STANDARD.encode(png),
+                }))
+            }
+            "gpio_write" => {
+                let line = gpio_line(args)?;
+                let value = match args.get("value").and_then(|v| v.as_u64()) {
+                    Some(v @ (0 | 1)) => v as u8,
+                    _ => return Err("value must be 0 or 1".to_string()),
+                };
+                state.gpio.insert(line.to_string(), value);
+                Ok(json!({"line": line, "value": value}))
+            }
+            "gpio_read" => {
+                let line = gpio_line(args)?;
+                let value = state.gpio.get(line).copied().unwrap_or(0);
+                Ok(json!({"line": line, "value": value}))
+            }
+            // Intercepted plugin tools are only recorded / 被拦截的插件工具仅作记录
+            _ if self.intercepts(tool) => Ok(json!({})),
+            _ => Err(format!("unknown simulated tool: {}", tool)),
+        }
+    }
+
+    /// Coordinates from `x`/`y`, checked against the screen / 从 `x`/`y` 读取坐标并按屏幕范围检查
+    fn point(&self, args: &Value) -> Result<Option<(i64, i64)>, String> {
+        let x = args.get("x").and_then(|v| v.as_i64());
+        let y = args.get("y").and_then(|v| v.as_i64());
+        match (x, y) {
+            (None, None) => Ok(None),
+            (Some(x), Some(y)) => {
+                if x < 0 || y < 0 || x >= self.width as i64 || y >= self.height as i64 {
+                    return Err(format!(
+                        "({}, {}) is outside the {}x{} screen",
+                        x, y, self.width, self.height
+                    ));
+                }
+                Ok(Some((x, y)))
+            }
+            _ => Err("x and y must be given together".to_string()),
+        }
+    }
+
+    fn append_log(&self, action: &SimulatedAction) {
+        let Some(path) = self.log_path.as_ref() else {
+            tracing::info!(tool = %action.tool, seq = action.seq, ok = action.ok, "Simulated tool action");
+            return;
+        };
+        let mut line = serde_json::to_value(action).unwrap_or_default();
+        clock::stamp(&mut line);
+        let res = std::fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .and_then(|mut f| writeln!(f, "{}", line));
+        if let Err(e) = res {
+            tracing::warn!(path = %path.display(), error = %e, "Failed to write simulated action");
+        }
+    }
+}
+
+fn gpio_line(args: &Value) -> Result<&str, String> {
+    args.get("line")
+        .and_then(|v| v.as_str())
+        .map(str::trim)
+        .filter(|s| !s.is_empty())
+        .ok_or_else(|| "line is required".to_string())
+}
+
+/// Uniform gray 8-bit grayscale PNG / 纯灰色 8 位灰度 PNG
+fn blank_png(width: u32, height: u32) -> Vec<u8> {
+    fn chunk(out: &mut Vec<u8>, kind: &[u8; 4], data: &[u8]) {
+        out.extend_from_slice(&(data.len() as u32).to_be_bytes());
+        let mut crc = flate2::Crc::new();
+        crc.update(kind);
+        crc.update(data);
+        out.extend_from_slice(kind);
+        out.extend_from_slice(data);
+        out.extend_from_slice(&crc.sum().to_be_bytes());
+    }
+
+    let mut ihdr = Vec::with_capacity(13);
+    ihdr.extend_from_slice(&width.to_be_bytes());
+    ihdr.extend_from_slice(&height.to_be_bytes());
+    // Bit depth 8, grayscale, deflate, adaptive filtering, no interlace
+    // 位深 8、灰度、deflate、自适应滤波、无隔行
+    ihdr.extend_from_slice(&[8, 0, 0, 0, 0]);
+
+    // Each row: filter type 0, then one byte per pixel / 每行：滤波类型 0，之后每像素一字节
+    let mut row = vec![0x80u8; width as usize + 1];
+    row[0] = 0;
+    let mut z = flate2::write::ZlibEncoder::new(Vec::new(), flate2::Compression::default());
+    for _ in 0..height {
+        let _ = z.write_all(&row);
+    }
+    let idat = z.finish().unwrap_or_default();
+
+    let mut out = vec![0x89, b'P', b'N', b'G', 0x0d, 0x0a, 0x1a, 0x0a];
+    chunk(&mut out, b"IHDR", &ihdr);
+    chunk(&mut out, b"IDAT", &idat);
+    chunk(&mut out, b"IEND", &[]);
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn simulator(log_path: &str) -> ToolSimulator {
+        ToolSimulator::new(&ToolSimulationConfig {
+            enabled: true,
+            log_path: log_path.to_string(),
+            screen_width: 800,
+            screen_height: 600,
+            intercept: vec!["open_browser".to_string()],
+        })
+    }
+
+    #[test]
+    fn test_mouse_and_keyboard_are_recorded() {
+        let sim = simulator("");
+        sim.invoke("mouse_move", r#"{"x":10,"y":20}"#).unwrap();
+        let out: Value =
+            serde_json::from_str(&sim.invoke("mouse_click", r#"{"button":"right"}"#).unwrap())
+                .unwrap();
+        assert_eq!(out["x"], 10);
+        assert_eq!(out["y"], 20);
+        assert_eq!(out["simulated"], true);
+        assert!(sim.invoke("mouse_move", r#"{"x":900,"y":20}"#).is_err());
+        sim.invoke("keyboard_press", r#"{"keys":["ctrl","s"]}"#)
+            .unwrap();
+
+        let actions = sim.actions();
+        assert_eq!(actions.len(), 4);
+        assert_eq!(actions[1].tool, "mouse_click");
+        assert!(!actions[2].ok);
+        assert_eq!(actions[3].seq, 4);
+    }
+
+    #[test]
+    fn test_gpio_and_intercepted_plugin() {
+        let sim = simulator("");
+        let read = |line: &str| -> Value {
+            let args = json!({ "line": line }).to_string();
+            serde_json::from_str(&sim.invoke("gpio_read", &args).unwrap()).unwrap()
+        };
+        assert_eq!(read("relay")["value"], 0);
+        sim.invoke("gpio_write", r#"{"line":"relay","value":1}"#)
+            .unwrap();
+        assert_eq!(read("relay")["value"], 1);
+        assert!(sim
+            .invoke("gpio_write", r#"{"line":"relay","value":2}"#)
+            .is_err());
+
+        assert!(sim.intercepts("open_browser"));
+        assert!(sim.invoke("open_browser", r#"{"url":"x"}"#).is_ok());
+        assert!(sim.invoke("format_disk", "{}").is_err());
+    }
+
+    #[test]
+    fn test_screenshot_png_and_log_file() {
+        let dir = tempfile::tempdir().unwrap();
+        let log = dir.path().join("actions.jsonl");
+        let sim = simulator(&log.to_string_lossy());
+        let out: Value = serde_json::from_str(&sim.invoke("screenshot", "").unwrap()).unwrap();
+        let png = base64::engine::general_purpose::STANDARD
+            .decode(out["data_b64"].as_str().unwrap())
+            .unwrap();
+        assert_eq!(&png[..8], b"\x89PNG\r\n\x1a\n");
+        assert_eq!(&png[16..24], &[0, 0, 3, 32, 0, 0, 2, 88]);
+
+        sim.invoke("keyboard_type", r#"{"text":"hello"}"#).unwrap();
+        let lines: Vec<Value> = std::fs::read_to_string(&log)
+            .unwrap()
+            .lines()
+            .map(|l| serde_json::from_str(l).unwrap())
+            .collect();
+        assert_eq!(lines.len(), 2);
+        assert_eq!(lines[1]["tool"], "keyboard_type");
+        assert_eq!(lines[1]["args"]["text"], "hello");
+        assert!(lines[1]["ts_ms"].is_i64());
+    }
+}
@@ -0,0 +1,431 @@
+//! AI usage accounting / AI 用量统计
+//!
+//! Every successful call a task makes to an AI backend is metered: tokens for chat and
+//! embeddings as the backend reports them, characters of text sent to speech synthesis, and
+//! seconds of audio sent to realtime transcription. Usage is summed per task and backend for
+//! the current calendar month (UTC), priced with `usage.prices`, and written to a state file
+//! so a restart does not reset it. A task that has reached one of its `usage.budgets` caps
+//! has further AI calls refused until the month ends or the budget is raised. Calls made
+//! outside a task are not metered.
+//! 任务对 AI 后端的每次成功调用都会被计量：chat 与嵌入按后端上报的 token 计，语音合成按送出的
+//! 文本字符数计，实时转写按送出的音频秒数计。用量按任务与后端汇总到当前自然月（UTC），按
+//! `usage.prices` 计价，并写入状态文件，重启不会清零。达到 `usage.budgets` 任一上限的任务，其后续
+//! AI 调用将被拒绝，直到本月结束或预算提高。任务之外的调用不计量。
+
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+
+use parking_lot::{Mutex, RwLock};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use crate::spearlet::config::{SpearletConfig, UsageBudgetConfig, UsageConfig, UsagePriceConfig};
+use crate::spearlet::execution::ai::ir::{
+    CanonicalRequestEnvelope, CanonicalResponseEnvelope, Payload, ResultPayload,
+};
+
+/// Longest time recorded usage waits before it is written / 已记录的用量等待写入的最长时间
+const SAVE_INTERVAL: Duration = Duration::from_secs(10);
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+#[serde(default)]
+pub struct Usage {
+    pub calls: u64,
+    pub input_tokens: u64,
+    pub output_tokens: u64,
+    pub characters: u64,
+    pub audio_ms: u64,
+    /// Priced with the prices in force at each call / 按每次调用时的价格计价
+    pub cost: f64,
+}
+
+impl Usage {
+    pub fn add(&mut self, other: &Usage) {
+        self.calls += other.calls;
+        self.input_tokens += other.input_tokens;
+        self.output_tokens += other.output_tokens;
+        self.characters += other.characters;
+        self.audio_ms += other.audio_ms;
+        self.cost += other.cost;
+    }
+
+    /// This usage with its cost at `price` / 按 `price` 计价后的用量
+    fn priced(mut self, price: Option<&UsagePriceConfig>) -> Self {
+        if let Some(p) = price {
+            self.cost = p.per_call * self.calls as f64
+                + p.input_per_million_tokens * self.input_tokens as f64 / 1e6
+                + p.output_per_million_tokens * self.output_tokens as f64 / 1e6
+                + p.per_million_characters * self.characters as f64 / 1e6
+                + p.per_audio_minute * self.audio_ms as f64 / 60_000.0;
+        }
+        self
+    }
+
+    /// The first cap of `budget` this usage has reached / 本用量已达到的 `budget` 中第一个上限
+    fn reached(&self, budget: &UsageBudgetConfig) -> Option<String> {
+        let tokens = self.input_tokens + self.output_tokens;
+        if budget.max_cost > 0.0 && self.cost >= budget.max_cost {
+            Some(format!("cost {:.4} of {}", self.cost, budget.max_cost))
+        } else if budget.max_tokens > 0 && tokens >= budget.max_tokens {
+            Some(format!("{} of {} tokens", tokens, budget.max_tokens))
+        } else if budget.max_characters > 0 && self.characters >= budget.max_characters {
+            Some(format!(
+                "{} of {} characters",
+                self.characters, budget.max_characters
+            ))
+        } else if budget.max_audio_secs > 0 && self.audio_ms / 1000 >= budget.max_audio_secs {
+            Some(format!(
+                "{} of {} audio seconds",
+                self.audio_ms / 1000,
+                budget.max_audio_secs
+            ))
+        } else {
+            None
+        }
+    }
+}
+
+/// Usage of one successful call / 单次成功调用的用量
+pub fn measure(req: &CanonicalRequestEnvelope, resp: &CanonicalResponseEnvelope) -> Usage {
+    let mut u = Usage {
+        calls: 1,
+        ..Default::default()
+    };
+    if let ResultPayload::Payload(v) = &resp.result {
+        let reported = |keys: &[&str]| {
+            keys.iter()
+                .find_map(|k| v.get("usage")?.get(*k)?.as_u64())
+                .unwrap_or(0)
+        };
+        u.input_tokens = reported(&["prompt_tokens", "input_tokens"]);
+        u.output_tokens = reported(&["completion_tokens", "output_tokens"]);
+        if let Some(secs) = v.get("duration").and_then(Value::as_f64) {
+            u.audio_ms = (secs * 1000.0) as u64;
+        }
+    }
+    if let Payload::TextToSpeech(p) = &req.payload {
+        u.characters = p.input.chars().count() as u64;
+    }
+    u
+}
+
+/// Audio sent to a realtime transcription session / 送往实时转写会话的音频
+pub fn audio(bytes: usize) -> Usage {
+    // 24 kHz 16-bit mono PCM, the realtime default / 24 kHz 16 位单声道 PCM，实时接口的默认格式
+    Usage {
+        audio_ms: bytes as u64 / 48,
+        ..Default::default()
+    }
+}
+
+/// Usage of the month, by task id and then backend / 本月用量，按任务 ID 再按后端
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+#[serde(default)]
+struct Ledger {
+    /// `YYYY-MM` in UTC / UTC 下的 `YYYY-MM`
+    month: String,
+    tasks: BTreeMap<String, BTreeMap<String, Usage>>,
+}
+
+impl Ledger {
+    fn roll(&mut self, month: &str) {
+        if self.month != month {
+            self.month = month.to_string();
+            self.tasks.clear();
+        }
+    }
+
+    fn task_total(&self, task_id: &str) -> Usage {
+        let mut total = Usage::default();
+        for u in self.tasks.get(task_id).into_iter().flat_map(|b| b.values()) {
+            total.add(u);
+        }
+        total
+    }
+}
+
+fn current_month() -> String {
+    chrono::Utc::now().format("%Y-%m").to_string()
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct TaskUsage {
+    pub task_id: String,
+    pub total: Usage,
+    pub backends: BTreeMap<String, Usage>,
+    pub budget: Option<UsageBudgetConfig>,
+    /// The cap the task has reached, if any / 任务已达到的上限（如有）
+    pub exhausted: Option<String>,
+}
+
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct UsageReport {
+    pub enabled: bool,
+    pub month: String,
+    pub total: Usage,
+    pub tasks: Vec<TaskUsage>,
+}
+
+/// State file for a configuration / 配置对应的状态文件
+pub fn state_file(config: &SpearletConfig) -> PathBuf {
+    if config.usage.state_file.trim().is_empty() {
+        Path::new(&config.storage.data_dir).join("usage.json")
+    } else {
+        PathBuf::from(&config.usage.state_file)
+    }
+}
+
+fn load(path: &Path) -> Option<Ledger> {
+    let bytes = std::fs::read(path).ok()?;
+    match serde_json::from_slice(&bytes) {
+        Ok(l) => Some(l),
+        Err(e) => {
+            tracing::warn!(path = %path.display(), error = %e, "Ignoring unreadable usage state");
+            None
+        }
+    }
+}
+
+pub struct UsageMeter {
+    /// Configuration and state file; no file keeps usage in memory only
+    /// 配置与状态文件；没有文件时用量只保存在内存中
+    config: RwLock<(UsageConfig, Option<PathBuf>)>,
+    ledger: Mutex<Ledger>,
+    saved_at: Mutex<Option<Instant>>,
+}
+
+impl UsageMeter {
+    pub fn new(config: UsageConfig, state_file: Option<PathBuf>) -> Self {
+        let ledger = state_file.as_deref().and_then(load).unwrap_or_default();
+        Self {
+            config: RwLock::new((config, state_file)),
+            ledger: Mutex::new(ledger),
+            saved_at: Mutex::new(None),
+        }
+    }
+
+    /// Apply a new configuration; a new state file is read when nothing was metered yet
+    /// 应用新配置；尚未计量任何用量时读取新的状态文件
+    pub fn set_config(&self, config: UsageConfig, state_file: Option<PathBuf>) {
+        {
+            let mut ledger = self.ledger.lock();
+            if ledger.tasks.is_empty() {
+                if let Some(l) = state_file.as_deref().and_then(load) {
+                    *ledger = l;
+                }
+            }
+        }
+        *self.config.write() = (config, state_file);
+    }
+
+    /// Whether `task_id` may make another AI call; `Err` names the cap it reached
+    /// `task_id` 是否可以再次调用 AI；`Err` 给出已达到的上限
+    pub fn admit(&self, task_id: &str) -> Result<(), String> {
+        let cfg = self.config.read().0.clone();
+        if !cfg.enabled {
+            return Ok(());
+        }
+        let Some(budget) = cfg.budgets.get(task_id) else {
+            return Ok(());
+        };
+        let mut ledger = self.ledger.lock();
+        ledger.roll(&current_month());
+        match ledger.task_total(task_id).reached(budget) {
+            Some(cap) => Err(format!("usage budget of task {} reached: {}", task_id, cap)),
+            None => Ok(()),
+        }
+    }
+
+    /// Add the usage of a call by `task_id` to `backend` / 累加 `task_id` 对 `backend` 的一次调用用量
+    pub fn record(&self, task_id: &str, backend: &str, usage: Usage) {
+        let cfg = self.config.read().0.clone();
+        if !cfg.enabled {
+            return;
+        }
+        let usage = usage.priced(cfg.prices.get(backend));
+        {
+            let mut ledger = self.ledger.lock();
+            ledger.roll(&current_month());
+            ledger
+                .tasks
+                .entry(task_id.to_string())
+                .or_default()
+                .entry(backend.to_string())
+                .or_default()
+                .add(&usage);
+        }
+        let due = {
+            let mut saved_at = self.saved_at.lock();
+            let due = saved_at.map_or(true, |t| t.elapsed() >= SAVE_INTERVAL);
+            if due {
+                *saved_at = Some(Instant::now());
+            }
+            due
+        };
+        if due {
+            self.save();
+        }
+    }
+
+    /// Write the ledger to the state file / 将用量写入状态文件
+    pub fn save(&self) {
+        let Some(path) = self.config.read().1.clone() else {
+            return;
+        };
+        let Ok(bytes) = serde_json::to_vec(&*self.ledger.lock()) else {
+            return;
+        };
+        let tmp = path.with_extension("tmp");
+        let written = path
+            .parent()
+            .map_or(Ok(()), std::fs::create_dir_all)
+            .and_then(|_| std::fs::write(&tmp, bytes))
+            .and_then(|_| std::fs::rename(&tmp, &path));
+        if let Err(e) = written {
+            tracing::warn!(path = %path.display(), error = %e, "Failed to save usage state");
+        }
+    }
+
+    /// Usage of the month with every task's budget / 本月用量及各任务的预算
+    pub fn report(&self) -> UsageReport {
+        let cfg = self.config.read().0.clone();
+        let mut ledger = self.ledger.lock();
+        ledger.roll(&current_month());
+        let mut total = Usage::default();
+        let tasks = ledger
+            .tasks
+            .iter()
+            .map(|(task_id, backends)| {
+                let t = ledger.task_total(task_id);
+                total.add(&t);
+                let budget = cfg.budgets.get(task_id).cloned();
+                TaskUsage {
+                    task_id: task_id.clone(),
+                    exhausted: budget.as_ref().and_then(|b| t.reached(b)),
+                    total: t,
+                    backends: backends.clone(),
+                    budget,
+                }
+            })
+            .collect();
+        UsageReport {
+            enabled: cfg.enabled,
+            month: ledger.month.clone(),
+            total,
+            tasks,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::spearlet::execution::ai::ir::{Operation, TextToSpeechPayload};
+    use serde_json::json;
+    use std::collections::HashMap;
+
+    fn tokens(input: u64, output: u64) -> Usage {
+        Usage {
+            calls: 1,
+            input_tokens: input,
+            output_tokens: output,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_budget_caps_calls() {
+        let mut cfg = UsageConfig::default();
+        cfg.prices.insert(
+            "openai".to_string(),
+            UsagePriceConfig {
+                input_per_million_tokens: 1_000_000.0,
+                ..Default::default()
+            },
+        );
+        cfg.budgets.insert(
+            "agent".to_string(),
+            UsageBudgetConfig {
+                max_tokens: 100,
+                ..Default::default()
+            },
+        );
+        let m = UsageMeter::new(cfg, None);
+        m.record("agent", "openai", tokens(40, 20));
+        m.record("agent", "ollama", tokens(30, 0));
+        assert!(m.admit("agent").is_ok());
+        m.record("agent", "ollama", tokens(5, 5));
+        assert!(m.admit("agent").unwrap_err().contains("100 of 100 tokens"));
+        m.record("other", "openai", tokens(1000, 0));
+        assert!(m.admit("other").is_ok());
+
+        let r = m.report();
+        assert_eq!(r.tasks.len(), 2);
+        let agent = &r.tasks[0];
+        assert_eq!((agent.total.calls, agent.total.cost), (3, 40.0));
+        assert_eq!(agent.backends["ollama"].input_tokens, 35);
+        assert!(agent.exhausted.is_some());
+        assert_eq!(r.total.input_tokens, 1075);
+    }
+
+    #[test]
+    fn test_usage_survives_restart_within_the_month() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("usage.json");
+        let m = UsageMeter::new(UsageConfig::default(), Some(path.clone()));
+        m.record("agent", "openai", tokens(7, 3));
+        let m = UsageMeter::new(UsageConfig::default(), Some(path.clone()));
+        assert_eq!(m.report().total.output_tokens, 3);
+
+        let mut stale: Ledger = serde_json::from_slice(&std::fs::read(&path).unwrap()).unwrap();
+        stale.month = "1999-12".to_string();
+        std::fs::write(&path, serde_json::to_vec(&stale).unwrap()).unwrap();
+        let m = UsageMeter::new(UsageConfig::default(), Some(path));
+        assert!(m.report().tasks.is_empty());
+    }
+
+    #[test]
+    fn test_measure_reads_reported_usage() {
+        let req = CanonicalRequestEnvelope {
+            version: 1,
+            request_id: "r".to_string(),
+            operation: Operation::TextToSpeech,
+            meta: HashMap::new(),
+            routing: Default::default(),
+            requirements: Default::default(),
+            timeout_ms: None,
+            payload: Payload::TextToSpeech(TextToSpeechPayload {
+                model: None,
+                input: "héllo".to_string(),
+                voice: None,
+                format: None,
+                speed: None,
+            }),
+            extra: HashMap::new(),
+        };
+        let resp = CanonicalResponseEnvelope {
+            version: 1,
+            request_id: "r".to_string(),
+            operation: Operation::TextToSpeech,
+            backend: "b".to_string(),
+            result: ResultPayload::Payload(json!({
+                "usage": {"input_tokens": 4, "completion_tokens": 9},
+                "duration": 1.5,
+            })),
+            raw: None,
+        };
+        let u = measure(&req, &resp);
+        assert_eq!(
+            (
+                u.calls,
+                u.input_tokens,
+                u.output_tokens,
+                u.characters,
+                u.audio_ms
+            ),
+            (1, 4, 9, 5, 1500)
+        );
+        assert_eq!(audio(48_000).audio_ms, 1000);
+    }
+}
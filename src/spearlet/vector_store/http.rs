@@ -0,0 +1,97 @@
+//! Blocking JSON client for REST vector databases / 面向 REST 向量数据库的阻塞式 JSON 客户端
+//!
+//! Backend calls are synchronous, like the hostcalls that make them, so each client drives
+//! reqwest on a small runtime of its own.
+//! 后端调用与发起它们的 hostcall 一样是同步的，因此每个客户端在自有的小型运行时上驱动 reqwest。
+
+use std::time::Duration;
+
+use reqwest::Method;
+use serde_json::Value;
+
+use super::{token, VectorError};
+use crate::spearlet::config::VectorStoreConfig;
+
+pub struct JsonClient {
+    /// Taken on drop, which may happen inside async code / 在析构时取出，析构可能发生在异步代码中
+    rt: Option<tokio::runtime::Runtime>,
+    client: reqwest::Client,
+    base_url: String,
+    /// Header carrying the token, and its value / 携带令牌的请求头及其值
+    auth: Option<(&'static str, String)>,
+}
+
+impl JsonClient {
+    /// `auth_header` receives the token read from `token_env`; `bearer` prefixes it
+    /// `auth_header` 携带从 `token_env` 读取的令牌；`bearer` 时加上前缀
+    pub fn new(
+        config: &VectorStoreConfig,
+        auth_header: &'static str,
+        bearer: bool,
+    ) -> Result<Self, VectorError> {
+        let rt = tokio::runtime::Builder::new_multi_thread()
+            .worker_threads(1)
+            .thread_name("vector-store-http")
+            .enable_all()
+            .build()
+            .map_err(|e| VectorError::Backend(e.to_string()))?;
+        let client = reqwest::Client::builder()
+            .timeout(Duration::from_millis(config.timeout_ms))
+            .build()
+            .map_err(|e| VectorError::Backend(e.to_string()))?;
+        let auth = token(config).map(|t| {
+            let value = if bearer { format!("Bearer {}", t) } else { t };
+            (auth_header, value)
+        });
+        Ok(Self {
+            rt: Some(rt),
+            client,
+            base_url: config.url.trim_end_matches('/').to_string(),
+            auth,
+        })
+    }
+
+    /// Send `body` and return the status with the parsed answer / 发送 `body` 并返回状态码与解析后的应答
+    pub fn call(
+        &self,
+        method: Method,
+        path: &str,
+        body: Option<&Value>,
+    ) -> Result<(u16, Value), VectorError> {
+        let mut r = self
+            .client
+            .request(method, format!("{}{}", self.base_url, path));
+        if let Some((name, value)) = &self.auth {
+            r = r.header(*name, value);
+        }
+        if let Some(b) = body {
+            r = r.json(b);
+        }
+        let Some(rt) = &self.rt else {
+            return Err(VectorError::Backend("client is shut down".to_string()));
+        };
+        rt.block_on(async move {
+            let resp = r
+                .send()
+                .await
+                .map_err(|e| VectorError::Backend(e.to_string()))?;
+            let status = resp.status().as_u16();
+            let bytes = resp
+                .bytes()
+                .await
+                .map_err(|e| VectorError::Backend(e.to_string()))?;
+            Ok((
+                status,
+                serde_json::from_slice(&bytes).unwrap_or(Value::Null),
+            ))
+        })
+    }
+}
+
+impl Drop for JsonClient {
+    fn drop(&mut self) {
+        if let Some(rt) = self.rt.take() {
+            rt.shutdown_background();
+        }
+    }
+}
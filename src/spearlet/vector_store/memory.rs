@@ -0,0 +1,160 @@
+//! In-memory vector backend / 内存向量后端
+//!
+//! Searches compare the query against every vector of the collection, which is fast enough
+//! for the tens of thousands of vectors an edge workload keeps. Nothing survives a restart.
+//! 检索时将查询与集合中的每个向量比较，对边缘工作负载保存的数万个向量而言足够快。重启后数据不保留。
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+use parking_lot::RwLock;
+use serde_json::{Map, Value};
+
+use super::{
+    check_query, check_records, matches_filter, CollectionInfo, CollectionSpec, Match, Record,
+    VectorBackend, VectorError,
+};
+use crate::spearlet::config::VectorStoreConfig;
+
+struct Collection {
+    spec: CollectionSpec,
+    records: HashMap<String, Record>,
+}
+
+pub struct MemoryBackend {
+    max_vectors: AtomicUsize,
+    /// By (namespace, collection name) / 按（命名空间，集合名）索引
+    collections: RwLock<HashMap<(String, String), Collection>>,
+}
+
+impl MemoryBackend {
+    pub fn new(config: &VectorStoreConfig) -> Self {
+        Self {
+            max_vectors: AtomicUsize::new(config.max_vectors),
+            collections: RwLock::new(HashMap::new()),
+        }
+    }
+}
+
+fn key(namespace: &str, name: &str) -> (String, String) {
+    (namespace.to_string(), name.to_string())
+}
+
+impl VectorBackend for MemoryBackend {
+    fn name(&self) -> &str {
+        "memory"
+    }
+
+    fn create(&self, namespace: &str, spec: &CollectionSpec) -> Result<(), VectorError> {
+        let mut collections = self.collections.write();
+        match collections.get(&key(namespace, &spec.name)) {
+            Some(c) if c.spec == *spec => Ok(()),
+            Some(_) => Err(VectorError::BadRequest(format!(
+                "collection {} exists with another spec",
+                spec.name
+            ))),
+            None => {
+                collections.insert(
+                    key(namespace, &spec.name),
+                    Collection {
+                        spec: spec.clone(),
+                        records: HashMap::new(),
+                    },
+                );
+                Ok(())
+            }
+        }
+    }
+
+    fn drop_collection(&self, namespace: &str, name: &str) -> Result<(), VectorError> {
+        self.collections
+            .write()
+            .remove(&key(namespace, name))
+            .map(|_| ())
+            .ok_or_else(|| VectorError::UnknownCollection(name.to_string()))
+    }
+
+    fn upsert(&self, namespace: &str, name: &str, records: Vec<Record>) -> Result<(), VectorError> {
+        let mut collections = self.collections.write();
+        let c = collections
+            .get_mut(&key(namespace, name))
+            .ok_or_else(|| VectorError::UnknownCollection(name.to_string()))?;
+        check_records(&c.spec, &records)?;
+        let added = records
+            .iter()
+            .filter(|r| !c.records.contains_key(&r.id))
+            .count();
+        let max_vectors = self.max_vectors.load(Ordering::Relaxed);
+        if c.records.len() + added > max_vectors {
+            return Err(VectorError::Limit(format!(
+                "{} vectors per collection",
+                max_vectors
+            )));
+        }
+        for r in records {
+            c.records.insert(r.id.clone(), r);
+        }
+        Ok(())
+    }
+
+    fn search(
+        &self,
+        namespace: &str,
+        name: &str,
+        vector: &[f32],
+        top_k: usize,
+        filter: &Map<String, Value>,
+    ) -> Result<Vec<Match>, VectorError> {
+        let collections = self.collections.read();
+        let c = collections
+            .get(&key(namespace, name))
+            .ok_or_else(|| VectorError::UnknownCollection(name.to_string()))?;
+        check_query(&c.spec, vector)?;
+        let mut matches: Vec<Match> = c
+            .records
+            .values()
+            .filter(|r| matches_filter(&r.metadata, filter))
+            .map(|r| Match {
+                id: r.id.clone(),
+                score: c.spec.metric.score(vector, &r.vector),
+                metadata: r.metadata.clone(),
+            })
+            .collect();
+        // Ties are broken by id so results do not depend on map order
+        // 得分相同时按 ID 排序，使结果不依赖映射顺序
+        matches.sort_by(|a, b| b.score.total_cmp(&a.score).then_with(|| a.id.cmp(&b.id)));
+        matches.truncate(top_k);
+        Ok(matches)
+    }
+
+    fn delete(&self, namespace: &str, name: &str, ids: &[String]) -> Result<usize, VectorError> {
+        let mut collections = self.collections.write();
+        let c = collections
+            .get_mut(&key(namespace, name))
+            .ok_or_else(|| VectorError::UnknownCollection(name.to_string()))?;
+        Ok(ids
+            .iter()
+            .filter(|id| c.records.remove(*id).is_some())
+            .count())
+    }
+
+    fn collections(&self, namespace: &str) -> Result<Vec<CollectionInfo>, VectorError> {
+        let mut out: Vec<CollectionInfo> = self
+            .collections
+            .read()
+            .iter()
+            .filter(|((ns, _), _)| ns == namespace)
+            .map(|(_, c)| CollectionInfo {
+                spec: c.spec.clone(),
+                vectors: c.records.len(),
+            })
+            .collect();
+        out.sort_by(|a, b| a.spec.name.cmp(&b.spec.name));
+        Ok(out)
+    }
+
+    fn set_limits(&self, config: &VectorStoreConfig) {
+        self.max_vectors
+            .store(config.max_vectors, Ordering::Relaxed);
+    }
+}
@@ -0,0 +1,424 @@
+//! Milvus vector backend / Milvus 向量后端
+//!
+//! Talks to the Milvus RESTful API (v2). Each task collection becomes a Milvus collection
+//! named by [`physical_name`], with a VarChar `id` primary key, a `vector` field and a JSON
+//! `metadata` field. A catalog collection, `<prefix>_catalog`, maps those back to the task
+//! and collection name and keeps the spec; Milvus requires a vector field there too, so it
+//! carries a constant two-dimensional one.
+//! 使用 Milvus RESTful API（v2）。每个任务集合对应一个以 [`physical_name`] 命名的 Milvus 集合，
+//! 包含 VarChar 主键 `id`、`vector` 字段与 JSON 字段 `metadata`。目录集合 `<prefix>_catalog`
+//! 记录其所属任务、集合名与规格；Milvus 要求目录中也有向量字段，因此带有一个固定的二维向量。
+
+use std::collections::HashMap;
+
+use parking_lot::{Mutex, RwLock};
+use reqwest::Method;
+use serde_json::{json, Map, Value};
+
+use super::http::JsonClient;
+use super::{
+    check_query, check_records, physical_name, CollectionInfo, CollectionSpec, Match, Metric,
+    Record, VectorBackend, VectorError,
+};
+use crate::spearlet::config::VectorStoreConfig;
+
+/// Milvus error code for a collection that does not exist / Milvus 中集合不存在的错误码
+const COLLECTION_NOT_FOUND: i64 = 100;
+
+/// Longest record id Milvus keeps / Milvus 可保存的最长记录 ID
+const MAX_ID_LEN: usize = 512;
+
+pub struct MilvusBackend {
+    http: JsonClient,
+    prefix: String,
+    batch_size: usize,
+    catalog_ready: Mutex<bool>,
+    /// Specs read from the catalog / 从目录读取的规格
+    specs: RwLock<HashMap<(String, String), CollectionSpec>>,
+}
+
+fn metric_type(metric: Metric) -> &'static str {
+    match metric {
+        Metric::Cosine => "COSINE",
+        Metric::Dot => "IP",
+        Metric::Euclidean => "L2",
+    }
+}
+
+/// A string literal in a Milvus filter expression / Milvus 过滤表达式中的字符串字面量
+fn literal(s: &str) -> String {
+    Value::String(s.to_string()).to_string()
+}
+
+/// Metadata filter as a Milvus boolean expression / 以 Milvus 布尔表达式表示的元数据过滤
+fn expression(filter: &Map<String, Value>) -> Result<String, VectorError> {
+    let terms = filter
+        .iter()
+        .map(|(k, v)| {
+            if !(v.is_string() || v.is_number() || v.is_boolean()) {
+                return Err(VectorError::BadRequest(format!(
+                    "filter value of {} must be a string, number or boolean",
+                    k
+                )));
+            }
+            Ok(format!("metadata[{}] == {}", literal(k), v))
+        })
+        .collect::<Result<Vec<_>, _>>()?;
+    Ok(terms.join(" and "))
+}
+
+fn ids_expression(ids: &[String]) -> String {
+    let list: Vec<String> = ids.iter().map(|id| literal(id)).collect();
+    format!("id in [{}]", list.join(", "))
+}
+
+impl MilvusBackend {
+    pub fn new(config: &VectorStoreConfig) -> Result<Self, VectorError> {
+        Ok(Self {
+            http: JsonClient::new(config, "authorization", true)?,
+            prefix: config.collection_prefix.clone(),
+            batch_size: config.batch_size.max(1),
+            catalog_ready: Mutex::new(false),
+            specs: RwLock::new(HashMap::new()),
+        })
+    }
+
+    fn catalog(&self) -> String {
+        format!("{}_catalog", self.prefix)
+    }
+
+    /// POST to the v2 API; the `data` of a successful answer, or the error code
+    /// 向 v2 API 发送 POST；成功时返回应答的 `data`，否则返回错误码
+    fn post(&self, op: &str, path: &str, body: Value) -> Result<Result<Value, i64>, VectorError> {
+        let (status, answer) =
+            self.http
+                .call(Method::POST, &format!("/v2/vectordb/{}", path), Some(&body))?;
+        if !(200..300).contains(&status) {
+            return Err(VectorError::Backend(format!(
+                "milvus {}: status {}",
+                op, status
+            )));
+        }
+        let code = answer["code"].as_i64().unwrap_or(0);
+        if code == 0 {
+            return Ok(Ok(answer.get("data").cloned().unwrap_or(Value::Null)));
+        }
+        if code == COLLECTION_NOT_FOUND {
+            return Ok(Err(code));
+        }
+        Err(VectorError::Backend(format!(
+            "milvus {}: code {} {}",
+            op,
+            code,
+            answer["message"].as_str().unwrap_or("")
+        )))
+    }
+
+    /// Like [`Self::post`] on a task collection, turning a missing collection into an error
+    /// 与 [`Self::post`] 相同但作用于任务集合，集合缺失时转换为错误
+    fn post_on(
+        &self,
+        op: &str,
+        namespace: &str,
+        name: &str,
+        path: &str,
+        body: Value,
+    ) -> Result<Value, VectorError> {
+        self.post(op, path, body)?.map_err(|_| {
+            self.specs
+                .write()
+                .remove(&(namespace.to_string(), name.to_string()));
+            VectorError::UnknownCollection(name.to_string())
+        })
+    }
+
+    fn ensure_catalog(&self) -> Result<(), VectorError> {
+        let mut ready = self.catalog_ready.lock();
+        if *ready {
+            return Ok(());
+        }
+        let has = self.post(
+            "read catalog",
+            "collections/has",
+            json!({"collectionName": self.catalog()}),
+        )?;
+        if !has.ok().and_then(|d| d["has"].as_bool()).unwrap_or(false) {
+            let varchar = |name: &str, primary: bool| {
+                json!({
+                    "fieldName": name,
+                    "dataType": "VarChar",
+                    "isPrimary": primary,
+                    "elementTypeParams": {"max_length": MAX_ID_LEN},
+                })
+            };
+            let body = json!({
+                "collectionName": self.catalog(),
+                "schema": {
+                    "autoId": false,
+                    "enableDynamicField": false,
+                    "fields": [
+                        varchar("key", true),
+                        varchar("namespace", false),
+                        varchar("name", false),
+                        {"fieldName": "dimensions", "dataType": "Int64"},
+                        varchar("metric", false),
+                        {"fieldName": "v", "dataType": "FloatVector", "elementTypeParams": {"dim": 2}},
+                    ],
+                },
+                "indexParams": [{"fieldName": "v", "indexName": "v", "metricType": "L2", "indexType": "AUTOINDEX"}],
+            });
+            self.post("create catalog", "collections/create", body)?
+                .map_err(|c| VectorError::Backend(format!("milvus create catalog: code {}", c)))?;
+        }
+        *ready = true;
+        Ok(())
+    }
+
+    fn catalog_query(&self, filter: String) -> Result<Vec<CollectionSpec>, VectorError> {
+        self.ensure_catalog()?;
+        let body = json!({
+            "collectionName": self.catalog(),
+            "filter": filter,
+            "outputFields": ["name", "dimensions", "metric"],
+            "limit": 1000,
+        });
+        let rows = self
+            .post("read catalog", "entities/query", body)?
+            .map_err(|c| VectorError::Backend(format!("milvus read catalog: code {}", c)))?;
+        Ok(rows
+            .as_array()
+            .map(|a| a.as_slice())
+            .unwrap_or_default()
+            .iter()
+            .map(|r| CollectionSpec {
+                name: r["name"].as_str().unwrap_or("").to_string(),
+                dimensions: r["dimensions"].as_u64().unwrap_or(0) as usize,
+                metric: Metric::parse(r["metric"].as_str().unwrap_or("")).unwrap_or_default(),
+            })
+            .collect())
+    }
+
+    fn spec(&self, namespace: &str, name: &str) -> Result<CollectionSpec, VectorError> {
+        let key = (namespace.to_string(), name.to_string());
+        if let Some(spec) = self.specs.read().get(&key) {
+            return Ok(spec.clone());
+        }
+        let physical = physical_name(&self.prefix, namespace, name);
+        let spec = self
+            .catalog_query(format!("key == {}", literal(&physical)))?
+            .into_iter()
+            .next()
+            .ok_or_else(|| VectorError::UnknownCollection(name.to_string()))?;
+        self.specs.write().insert(key, spec.clone());
+        Ok(spec)
+    }
+}
+
+impl VectorBackend for MilvusBackend {
+    fn name(&self) -> &str {
+        "milvus"
+    }
+
+    fn create(&self, namespace: &str, spec: &CollectionSpec) -> Result<(), VectorError> {
+        match self.spec(namespace, &spec.name) {
+            Ok(existing) if existing == *spec => return Ok(()),
+            Ok(_) => {
+                return Err(VectorError::BadRequest(format!(
+                    "collection {} exists with another spec",
+                    spec.name
+                )))
+            }
+            Err(VectorError::UnknownCollection(_)) => {}
+            Err(e) => return Err(e),
+        }
+        let physical = physical_name(&self.prefix, namespace, &spec.name);
+        let body = json!({
+            "collectionName": physical,
+            "schema": {
+                "autoId": false,
+                "enableDynamicField": false,
+                "fields": [
+                    {"fieldName": "id", "dataType": "VarChar", "isPrimary": true, "elementTypeParams": {"max_length": MAX_ID_LEN}},
+                    {"fieldName": "vector", "dataType": "FloatVector", "elementTypeParams": {"dim": spec.dimensions}},
+                    {"fieldName": "metadata", "dataType": "JSON"},
+                ],
+            },
+            "indexParams": [{
+                "fieldName": "vector",
+                "indexName": "vector",
+                "metricType": metric_type(spec.metric),
+                "indexType": "AUTOINDEX",
+            }],
+        });
+        self.post("create collection", "collections/create", body)?
+            .map_err(|c| VectorError::Backend(format!("milvus create collection: code {}", c)))?;
+        let body = json!({
+            "collectionName": self.catalog(),
+            "data": [{
+                "key": physical,
+                "namespace": namespace,
+                "name": spec.name,
+                "dimensions": spec.dimensions,
+                "metric": spec.metric.as_str(),
+                "v": [0.0, 0.0],
+            }],
+        });
+        self.post("write catalog", "entities/upsert", body)?
+            .map_err(|c| VectorError::Backend(format!("milvus write catalog: code {}", c)))?;
+        self.specs
+            .write()
+            .insert((namespace.to_string(), spec.name.clone()), spec.clone());
+        Ok(())
+    }
+
+    fn drop_collection(&self, namespace: &str, name: &str) -> Result<(), VectorError> {
+        self.spec(namespace, name)?;
+        let physical = physical_name(&self.prefix, namespace, name);
+        // Already gone is fine; the catalog entry is removed either way
+        // 已不存在也无妨；目录条目都会被删除
+        let _ = self.post(
+            "drop collection",
+            "collections/drop",
+            json!({"collectionName": physical}),
+        )?;
+        let body = json!({
+            "collectionName": self.catalog(),
+            "filter": format!("key == {}", literal(&physical)),
+        });
+        self.post("write catalog", "entities/delete", body)?
+            .map_err(|c| VectorError::Backend(format!("milvus write catalog: code {}", c)))?;
+        self.specs
+            .write()
+            .remove(&(namespace.to_string(), name.to_string()));
+        Ok(())
+    }
+
+    fn upsert(&self, namespace: &str, name: &str, records: Vec<Record>) -> Result<(), VectorError> {
+        let spec = self.spec(namespace, name)?;
+        check_records(&spec, &records)?;
+        if records.iter().any(|r| r.id.len() > MAX_ID_LEN) {
+            return Err(VectorError::BadRequest(format!(
+                "record ids must be at most {} bytes",
+                MAX_ID_LEN
+            )));
+        }
+        let physical = physical_name(&self.prefix, namespace, name);
+        for batch in records.chunks(self.batch_size) {
+            let data: Vec<Value> = batch
+                .iter()
+                .map(|r| json!({"id": r.id, "vector": r.vector, "metadata": r.metadata}))
+                .collect();
+            let body = json!({"collectionName": physical, "data": data});
+            self.post_on("upsert", namespace, name, "entities/upsert", body)?;
+        }
+        Ok(())
+    }
+
+    fn search(
+        &self,
+        namespace: &str,
+        name: &str,
+        vector: &[f32],
+        top_k: usize,
+        filter: &Map<String, Value>,
+    ) -> Result<Vec<Match>, VectorError> {
+        let spec = self.spec(namespace, name)?;
+        check_query(&spec, vector)?;
+        let mut body = json!({
+            "collectionName": physical_name(&self.prefix, namespace, name),
+            "data": [vector],
+            "annsField": "vector",
+            "limit": top_k,
+            "outputFields": ["id", "metadata"],
+        });
+        if !filter.is_empty() {
+            body["filter"] = json!(expression(filter)?);
+        }
+        let hits = self.post_on("search", namespace, name, "entities/search", body)?;
+        Ok(hits
+            .as_array()
+            .map(|a| a.as_slice())
+            .unwrap_or_default()
+            .iter()
+            .map(|h| {
+                let distance = h["distance"].as_f64().unwrap_or(0.0) as f32;
+                Match {
+                    id: h["id"].as_str().unwrap_or("").to_string(),
+                    // L2 comes back squared / L2 距离以平方形式返回
+                    score: if spec.metric == Metric::Euclidean {
+                        -distance.max(0.0).sqrt()
+                    } else {
+                        distance
+                    },
+                    metadata: h["metadata"].as_object().cloned().unwrap_or_default(),
+                }
+            })
+            .collect())
+    }
+
+    fn delete(&self, namespace: &str, name: &str, ids: &[String]) -> Result<usize, VectorError> {
+        self.spec(namespace, name)?;
+        if ids.is_empty() {
+            return Ok(0);
+        }
+        let physical = physical_name(&self.prefix, namespace, name);
+        let body = json!({
+            "collectionName": physical,
+            "filter": ids_expression(ids),
+            "outputFields": ["id"],
+            "limit": ids.len(),
+        });
+        let found = self
+            .post_on("delete", namespace, name, "entities/query", body)?
+            .as_array()
+            .map(|a| a.len())
+            .unwrap_or(0);
+        let body = json!({"collectionName": physical, "filter": ids_expression(ids)});
+        self.post_on("delete", namespace, name, "entities/delete", body)?;
+        Ok(found)
+    }
+
+    fn collections(&self, namespace: &str) -> Result<Vec<CollectionInfo>, VectorError> {
+        let specs = self.catalog_query(format!("namespace == {}", literal(namespace)))?;
+        let mut out = Vec::new();
+        for spec in specs {
+            let body = json!({
+                "collectionName": physical_name(&self.prefix, namespace, &spec.name),
+                "filter": "",
+                "outputFields": ["count(*)"],
+            });
+            let vectors = match self.post_on("count", namespace, &spec.name, "entities/query", body)
+            {
+                Ok(rows) => rows[0]["count(*)"].as_u64().unwrap_or(0) as usize,
+                Err(VectorError::UnknownCollection(_)) => 0,
+                Err(e) => return Err(e),
+            };
+            out.push(CollectionInfo { spec, vectors });
+        }
+        out.sort_by(|a, b| a.spec.name.cmp(&b.spec.name));
+        Ok(out)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_filter_expressions() {
+        let filter = json!({"lang": "en", "page": 3})
+            .as_object()
+            .unwrap()
+            .clone();
+        assert_eq!(
+            expression(&filter).unwrap(),
+            r#"metadata["lang"] == "en" and metadata["page"] == 3"#
+        );
+        let bad = json!({"tags": ["a"]}).as_object().unwrap().clone();
+        assert!(matches!(expression(&bad), Err(VectorError::BadRequest(_))));
+        assert_eq!(
+            ids_expression(&["a".to_string(), "b\"c".to_string()]),
+            r#"id in ["a", "b\"c"]"#
+        );
+    }
+}
@@ -0,0 +1,518 @@
+//! Vector store for retrieval workloads / 面向检索工作负载的向量存储
+//!
+//! Backs the `vs_*` hostcalls, so agents can keep and search embeddings without bundling a
+//! vector database client. Collections are kept per task: two tasks may use the same
+//! collection name without seeing each other's vectors. The backend is pluggable; the
+//! default keeps everything in memory and searches by brute force, while `qdrant`, `milvus`
+//! and `pgvector` keep collections in an external database that outlives the spearlet. The
+//! `qdrant` and `milvus` clients are built with the `vector-db` feature, `pgvector` with its own.
+//! 为 `vs_*` hostcall 提供支持，使智能体无需自带向量数据库客户端即可保存与检索嵌入向量。集合按任务
+//! 隔离：两个任务可以使用同名集合而互不可见。后端可插拔；默认后端将全部数据保存在内存中并以暴力方式检索，
+//! `qdrant`、`milvus` 与 `pgvector` 则将集合保存在生命周期长于 spearlet 的外部数据库中。
+//! `qdrant` 与 `milvus` 客户端随 `vector-db` feature 构建，`pgvector` 随其同名 feature 构建。
+
+#[cfg(feature = "vector-db")]
+mod http;
+pub mod memory;
+#[cfg(feature = "vector-db")]
+pub mod milvus;
+#[cfg(feature = "pgvector")]
+pub mod pgvector;
+#[cfg(feature = "vector-db")]
+pub mod qdrant;
+
+use std::sync::Arc;
+
+use parking_lot::RwLock;
+use serde::{Deserialize, Serialize};
+use serde_json::{Map, Value};
+use sha2::{Digest, Sha256};
+
+use crate::spearlet::config::VectorStoreConfig;
+
+/// Backends `backend` may name / `backend` 可选用的后端
+pub const BACKENDS: &[&str] = &["memory", "qdrant", "milvus", "pgvector"];
+
+#[derive(Debug, thiserror::Error, PartialEq)]
+pub enum VectorError {
+    #[error("vector store is disabled")]
+    Disabled,
+    #[error("unknown collection: {0}")]
+    UnknownCollection(String),
+    #[error("invalid request: {0}")]
+    BadRequest(String),
+    #[error("limit reached: {0}")]
+    Limit(String),
+    #[error("backend error: {0}")]
+    Backend(String),
+}
+
+/// Similarity measure of a collection / 集合的相似度度量
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Metric {
+    #[default]
+    Cosine,
+    Dot,
+    /// Scored as the negated distance, so higher is closer / 以距离的相反数计分，越高越近
+    Euclidean,
+}
+
+impl Metric {
+    /// Score of `b` against `a`; higher is more similar / `b` 相对 `a` 的得分；越高越相似
+    pub fn score(self, a: &[f32], b: &[f32]) -> f32 {
+        let dot: f32 = a.iter().zip(b).map(|(x, y)| x * y).sum();
+        match self {
+            Metric::Dot => dot,
+            Metric::Cosine => {
+                let na = a.iter().map(|x| x * x).sum::<f32>().sqrt();
+                let nb = b.iter().map(|x| x * x).sum::<f32>().sqrt();
+                if na == 0.0 || nb == 0.0 {
+                    0.0
+                } else {
+                    dot / (na * nb)
+                }
+            }
+            Metric::Euclidean => -a
+                .iter()
+                .zip(b)
+                .map(|(x, y)| (x - y) * (x - y))
+                .sum::<f32>()
+                .sqrt(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct CollectionSpec {
+    pub name: String,
+    pub dimensions: usize,
+    #[serde(default)]
+    pub metric: Metric,
+}
+
+/// One stored vector / 单个已存储的向量
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Record {
+    pub id: String,
+    pub vector: Vec<f32>,
+    /// Returned with matches and used by search filters / 随匹配结果返回，并用于检索过滤
+    #[serde(default)]
+    pub metadata: Map<String, Value>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct Match {
+    pub id: String,
+    pub score: f32,
+    pub metadata: Map<String, Value>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct CollectionInfo {
+    #[serde(flatten)]
+    pub spec: CollectionSpec,
+    pub vectors: usize,
+}
+
+impl Metric {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Metric::Cosine => "cosine",
+            Metric::Dot => "dot",
+            Metric::Euclidean => "euclidean",
+        }
+    }
+
+    pub fn parse(s: &str) -> Option<Self> {
+        match s {
+            "cosine" => Some(Metric::Cosine),
+            "dot" => Some(Metric::Dot),
+            "euclidean" => Some(Metric::Euclidean),
+            _ => None,
+        }
+    }
+}
+
+/// Name of a task's collection inside an external database, safe as an identifier there
+/// 任务集合在外部数据库中的名称，可安全用作其中的标识符
+pub fn physical_name(prefix: &str, namespace: &str, name: &str) -> String {
+    let digest = Sha256::digest(format!("{}\0{}", namespace, name).as_bytes());
+    let hex: String = digest[..8].iter().map(|b| format!("{:02x}", b)).collect();
+    format!("{}_{}", prefix, hex)
+}
+
+/// Reject records whose length differs from the collection's / 拒绝长度与集合不一致的记录
+pub fn check_records(spec: &CollectionSpec, records: &[Record]) -> Result<(), VectorError> {
+    match records.iter().find(|r| r.vector.len() != spec.dimensions) {
+        Some(r) => Err(VectorError::BadRequest(format!(
+            "record {} has {} dimensions, collection has {}",
+            r.id,
+            r.vector.len(),
+            spec.dimensions
+        ))),
+        None => Ok(()),
+    }
+}
+
+pub fn check_query(spec: &CollectionSpec, vector: &[f32]) -> Result<(), VectorError> {
+    if vector.len() != spec.dimensions {
+        return Err(VectorError::BadRequest(format!(
+            "query has {} dimensions, collection has {}",
+            vector.len(),
+            spec.dimensions
+        )));
+    }
+    Ok(())
+}
+
+/// Whether `metadata` carries every key of `filter` with an equal value
+/// `metadata` 是否包含 `filter` 的每个键且值相等
+pub fn matches_filter(metadata: &Map<String, Value>, filter: &Map<String, Value>) -> bool {
+    filter.iter().all(|(k, v)| metadata.get(k) == Some(v))
+}
+
+/// Where vectors are kept; `namespace` separates tasks / 向量的存放位置；`namespace` 用于隔离任务
+pub trait VectorBackend: Send + Sync {
+    fn name(&self) -> &str;
+
+    /// Create a collection; creating it again with the same spec is not an error
+    /// 创建集合；以相同规格再次创建不视为错误
+    fn create(&self, namespace: &str, spec: &CollectionSpec) -> Result<(), VectorError>;
+
+    fn drop_collection(&self, namespace: &str, name: &str) -> Result<(), VectorError>;
+
+    /// Insert records, replacing those with the same id / 插入记录，替换 ID 相同的记录
+    fn upsert(&self, namespace: &str, name: &str, records: Vec<Record>) -> Result<(), VectorError>;
+
+    /// Best `top_k` matches whose metadata passes `filter` / 元数据通过 `filter` 的最佳 `top_k` 个匹配
+    fn search(
+        &self,
+        namespace: &str,
+        name: &str,
+        vector: &[f32],
+        top_k: usize,
+        filter: &Map<String, Value>,
+    ) -> Result<Vec<Match>, VectorError>;
+
+    /// Delete records by id; returns how many existed / 按 ID 删除记录；返回实际存在的数量
+    fn delete(&self, namespace: &str, name: &str, ids: &[String]) -> Result<usize, VectorError>;
+
+    fn collections(&self, namespace: &str) -> Result<Vec<CollectionInfo>, VectorError>;
+
+    /// Pick up limits from a reloaded configuration / 从重载的配置中获取上限
+    fn set_limits(&self, _config: &VectorStoreConfig) {}
+}
+
+/// `vs_insert` request / `vs_insert` 请求
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct InsertRequest {
+    pub collection: String,
+    pub records: Vec<Record>,
+}
+
+/// `vs_search` request / `vs_search` 请求
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct SearchRequest {
+    pub collection: String,
+    pub vector: Vec<f32>,
+    #[serde(default = "default_top_k")]
+    pub top_k: usize,
+    /// Metadata keys the matches must carry with these values / 匹配结果必须具有的元数据键值
+    #[serde(default)]
+    pub filter: Map<String, Value>,
+}
+
+fn default_top_k() -> usize {
+    10
+}
+
+/// `vs_delete` request; without `ids` the whole collection is dropped
+/// `vs_delete` 请求；未给出 `ids` 时删除整个集合
+#[derive(Debug, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct DeleteRequest {
+    pub collection: String,
+    #[serde(default)]
+    pub ids: Option<Vec<String>>,
+}
+
+/// The backend `config` names; external ones connect on first use
+/// `config` 指定的后端；外部后端在首次使用时连接
+pub fn build_backend(config: &VectorStoreConfig) -> Result<Arc<dyn VectorBackend>, VectorError> {
+    Ok(match config.backend.as_str() {
+        #[cfg(feature = "vector-db")]
+        "qdrant" => Arc::new(qdrant::QdrantBackend::new(config)?),
+        #[cfg(feature = "vector-db")]
+        "milvus" => Arc::new(milvus::MilvusBackend::new(config)?),
+        #[cfg(feature = "pgvector")]
+        "pgvector" => Arc::new(pgvector::PgVectorBackend::new(config)),
+        "memory" => Arc::new(memory::MemoryBackend::new(config)),
+        other => {
+            return Err(VectorError::BadRequest(format!(
+                "backend {} is unknown or not built in",
+                other
+            )))
+        }
+    })
+}
+
+/// The backend for `config`, falling back to memory when it cannot be built
+/// `config` 对应的后端；无法构建时回退到内存后端
+fn backend_for(config: &VectorStoreConfig) -> Arc<dyn VectorBackend> {
+    if !config.enabled {
+        return Arc::new(memory::MemoryBackend::new(config));
+    }
+    build_backend(config).unwrap_or_else(|e| {
+        tracing::error!(backend = %config.backend, error = %e, "vector store backend unavailable; using memory");
+        Arc::new(memory::MemoryBackend::new(config))
+    })
+}
+
+/// The token named by `token_env`, if any / `token_env` 指定的令牌（如有）
+#[cfg(any(feature = "vector-db", feature = "pgvector"))]
+fn token(config: &VectorStoreConfig) -> Option<String> {
+    let name = config.token_env.trim();
+    if name.is_empty() {
+        return None;
+    }
+    std::env::var(name)
+        .ok()
+        .map(|v| v.trim().to_string())
+        .filter(|v| !v.is_empty())
+}
+
+/// Whether going from `a` to `b` needs a new backend / 从 `a` 切换到 `b` 是否需要新的后端
+fn backend_changed(a: &VectorStoreConfig, b: &VectorStoreConfig) -> bool {
+    a.backend != b.backend
+        || a.url != b.url
+        || a.token_env != b.token_env
+        || a.collection_prefix != b.collection_prefix
+        || a.timeout_ms != b.timeout_ms
+}
+
+/// Checks requests against the configured limits and hands them to the backend
+/// 按配置的上限检查请求并交给后端处理
+pub struct VectorStore {
+    config: RwLock<VectorStoreConfig>,
+    backend: RwLock<Arc<dyn VectorBackend>>,
+}
+
+impl VectorStore {
+    pub fn new(config: VectorStoreConfig) -> Self {
+        let backend = backend_for(&config);
+        Self {
+            config: RwLock::new(config),
+            backend: RwLock::new(backend),
+        }
+    }
+
+    pub fn config(&self) -> VectorStoreConfig {
+        self.config.read().clone()
+    }
+
+    /// Apply a new configuration; switching backends or databases starts from the new
+    /// backend's collections, and in-memory collections are lost
+    /// 应用新配置；切换后端或数据库后使用新后端中的集合，内存中的集合会丢失
+    pub fn set_config(&self, config: VectorStoreConfig) {
+        let mut current = self.config.write();
+        if !config.enabled || !current.enabled || backend_changed(&current, &config) {
+            *self.backend.write() = backend_for(&config);
+        } else {
+            self.backend.read().set_limits(&config);
+        }
+        *current = config;
+    }
+
+    /// Replace the backend, e.g. with an external database / 替换后端，例如换成外部数据库
+    pub fn set_backend(&self, backend: Arc<dyn VectorBackend>) {
+        *self.backend.write() = backend;
+    }
+
+    fn backend(&self) -> Result<Arc<dyn VectorBackend>, VectorError> {
+        if !self.config.read().enabled {
+            return Err(VectorError::Disabled);
+        }
+        Ok(self.backend.read().clone())
+    }
+
+    pub fn create(&self, namespace: &str, spec: &CollectionSpec) -> Result<(), VectorError> {
+        let backend = self.backend()?;
+        let cfg = self.config();
+        if spec.name.trim().is_empty() {
+            return Err(VectorError::BadRequest(
+                "collection name is empty".to_string(),
+            ));
+        }
+        if spec.dimensions == 0 || spec.dimensions > cfg.max_dimensions {
+            return Err(VectorError::BadRequest(format!(
+                "dimensions must be between 1 and {}",
+                cfg.max_dimensions
+            )));
+        }
+        let existing = backend.collections(namespace)?;
+        if existing.len() >= cfg.max_collections
+            && !existing.iter().any(|c| c.spec.name == spec.name)
+        {
+            return Err(VectorError::Limit(format!(
+                "{} collections per task",
+                cfg.max_collections
+            )));
+        }
+        backend.create(namespace, spec)
+    }
+
+    pub fn insert(&self, namespace: &str, req: InsertRequest) -> Result<usize, VectorError> {
+        let backend = self.backend()?;
+        let n = req.records.len();
+        if req.records.iter().any(|r| r.id.is_empty()) {
+            return Err(VectorError::BadRequest("record id is empty".to_string()));
+        }
+        backend.upsert(namespace, &req.collection, req.records)?;
+        Ok(n)
+    }
+
+    pub fn search(&self, namespace: &str, req: &SearchRequest) -> Result<Vec<Match>, VectorError> {
+        let backend = self.backend()?;
+        if req.top_k == 0 {
+            return Err(VectorError::BadRequest(
+                "top_k must be positive".to_string(),
+            ));
+        }
+        backend.search(
+            namespace,
+            &req.collection,
+            &req.vector,
+            req.top_k,
+            &req.filter,
+        )
+    }
+
+    /// Delete records, or the collection without `ids`; returns the records deleted
+    /// 删除记录，未给出 `ids` 时删除集合；返回删除的记录数
+    pub fn delete(&self, namespace: &str, req: &DeleteRequest) -> Result<usize, VectorError> {
+        let backend = self.backend()?;
+        match &req.ids {
+            Some(ids) => backend.delete(namespace, &req.collection, ids),
+            None => {
+                let vectors = backend
+                    .collections(namespace)?
+                    .into_iter()
+                    .find(|c| c.spec.name == req.collection)
+                    .map(|c| c.vectors)
+                    .ok_or_else(|| VectorError::UnknownCollection(req.collection.clone()))?;
+                backend.drop_collection(namespace, &req.collection)?;
+                Ok(vectors)
+            }
+        }
+    }
+
+    pub fn collections(&self, namespace: &str) -> Result<Vec<CollectionInfo>, VectorError> {
+        self.backend()?.collections(namespace)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn store() -> VectorStore {
+        VectorStore::new(VectorStoreConfig {
+            enabled: true,
+            max_collections: 1,
+            ..Default::default()
+        })
+    }
+
+    fn record(id: &str, vector: Vec<f32>, lang: &str) -> Record {
+        Record {
+            id: id.to_string(),
+            vector,
+            metadata: json!({"lang": lang}).as_object().unwrap().clone(),
+        }
+    }
+
+    #[test]
+    fn test_search_ranks_and_filters() {
+        let s = store();
+        let spec = CollectionSpec {
+            name: "docs".to_string(),
+            dimensions: 2,
+            metric: Metric::Cosine,
+        };
+        s.create("task-a", &spec).unwrap();
+        s.create("task-a", &spec).unwrap();
+        let other = CollectionSpec {
+            name: "other".to_string(),
+            ..spec.clone()
+        };
+        assert!(matches!(
+            s.create("task-a", &other),
+            Err(VectorError::Limit(_))
+        ));
+
+        let records = vec![
+            record("x", vec![1.0, 0.0], "en"),
+            record("y", vec![0.0, 1.0], "en"),
+            record("z", vec![0.9, 0.1], "zh"),
+        ];
+        let req = InsertRequest {
+            collection: "docs".to_string(),
+            records,
+        };
+        assert_eq!(s.insert("task-a", req).unwrap(), 3);
+
+        let mut search = SearchRequest {
+            collection: "docs".to_string(),
+            vector: vec![1.0, 0.0],
+            top_k: 2,
+            filter: Map::new(),
+        };
+        let ids: Vec<String> = s
+            .search("task-a", &search)
+            .unwrap()
+            .into_iter()
+            .map(|m| m.id)
+            .collect();
+        assert_eq!(ids, vec!["x", "z"]);
+
+        search.filter = json!({"lang": "en"}).as_object().unwrap().clone();
+        let ids: Vec<String> = s
+            .search("task-a", &search)
+            .unwrap()
+            .into_iter()
+            .map(|m| m.id)
+            .collect();
+        assert_eq!(ids, vec!["x", "y"]);
+
+        // Other tasks do not see the collection / 其他任务看不到该集合
+        assert_eq!(
+            s.search("task-b", &search),
+            Err(VectorError::UnknownCollection("docs".to_string()))
+        );
+
+        let delete = DeleteRequest {
+            collection: "docs".to_string(),
+            ids: Some(vec!["x".to_string(), "missing".to_string()]),
+        };
+        assert_eq!(s.delete("task-a", &delete).unwrap(), 1);
+        let drop = DeleteRequest {
+            collection: "docs".to_string(),
+            ids: None,
+        };
+        assert_eq!(s.delete("task-a", &drop).unwrap(), 2);
+        assert!(s.collections("task-a").unwrap().is_empty());
+    }
+
+    #[test]
+    fn test_metric_scores() {
+        assert_eq!(Metric::Dot.score(&[1.0, 2.0], &[3.0, 4.0]), 11.0);
+        assert_eq!(Metric::Euclidean.score(&[0.0, 0.0], &[3.0, 4.0]), -5.0);
+        assert_eq!(Metric::Cosine.score(&[0.0, 0.0], &[1.0, 0.0]), 0.0);
+    }
+}
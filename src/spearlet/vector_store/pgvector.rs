@@ -0,0 +1,355 @@
+//! PostgreSQL pgvector backend / PostgreSQL pgvector 后端
+//!
+//! Built with the `pgvector` feature. All collections share two tables: `<prefix>_collections`
+//! holds the specs and `<prefix>_vectors` the records, keyed by task and collection, so no
+//! DDL runs per collection. Both tables and the `vector` extension are created on first
+//! connect. Upserts of one call run in a single transaction.
+//! 通过 `pgvector` 特性构建。所有集合共用两张表：`<prefix>_collections` 保存规格，`<prefix>_vectors`
+//! 保存记录，均以任务与集合为键，因此不会按集合执行 DDL。两张表与 `vector` 扩展在首次连接时创建。
+//! 同一次调用的写入在单个事务中完成。
+
+use std::collections::HashMap;
+use std::str::FromStr;
+use std::time::Duration;
+
+use parking_lot::Mutex;
+use postgres::types::ToSql;
+use postgres::{Client, NoTls};
+use serde_json::{Map, Value};
+
+use super::{
+    check_query, check_records, token, CollectionInfo, CollectionSpec, Match, Metric, Record,
+    VectorBackend, VectorError,
+};
+use crate::spearlet::config::VectorStoreConfig;
+
+impl From<postgres::Error> for VectorError {
+    fn from(e: postgres::Error) -> Self {
+        VectorError::Backend(e.to_string())
+    }
+}
+
+pub struct PgVectorBackend {
+    url: String,
+    password: Option<String>,
+    timeout: Duration,
+    prefix: String,
+    batch_size: usize,
+    client: Mutex<Option<Client>>,
+}
+
+/// `[1,2,3]`, the text form of a pgvector value / pgvector 值的文本形式 `[1,2,3]`
+fn vector_literal(v: &[f32]) -> String {
+    let parts: Vec<String> = v.iter().map(|x| x.to_string()).collect();
+    format!("[{}]", parts.join(","))
+}
+
+/// Distance operator of a metric / 度量对应的距离运算符
+fn operator(metric: Metric) -> &'static str {
+    match metric {
+        Metric::Cosine => "<=>",
+        // The negated inner product / 内积的相反数
+        Metric::Dot => "<#>",
+        Metric::Euclidean => "<->",
+    }
+}
+
+/// Score of a distance from [`operator`]; higher is closer / [`operator`] 距离对应的得分；越高越近
+fn score(metric: Metric, distance: f64) -> f32 {
+    match metric {
+        Metric::Cosine => (1.0 - distance) as f32,
+        Metric::Dot | Metric::Euclidean => -distance as f32,
+    }
+}
+
+fn check_filter(filter: &Map<String, Value>) -> Result<(), VectorError> {
+    match filter.iter().find(|(_, v)| v.is_array() || v.is_object()) {
+        Some((k, _)) => Err(VectorError::BadRequest(format!(
+            "filter value of {} must be a string, number, boolean or null",
+            k
+        ))),
+        None => Ok(()),
+    }
+}
+
+impl PgVectorBackend {
+    pub fn new(config: &VectorStoreConfig) -> Self {
+        Self {
+            url: config.url.clone(),
+            password: token(config),
+            timeout: Duration::from_millis(config.timeout_ms),
+            prefix: config.collection_prefix.clone(),
+            batch_size: config.batch_size.max(1),
+            client: Mutex::new(None),
+        }
+    }
+
+    fn collections_table(&self) -> String {
+        format!("{}_collections", self.prefix)
+    }
+
+    fn vectors_table(&self) -> String {
+        format!("{}_vectors", self.prefix)
+    }
+
+    fn connect(&self) -> Result<Client, VectorError> {
+        let mut config = postgres::Config::from_str(&self.url)
+            .map_err(|e| VectorError::Backend(format!("invalid url: {}", e)))?;
+        config.connect_timeout(self.timeout);
+        if let Some(p) = &self.password {
+            config.password(p);
+        }
+        let mut client = config.connect(NoTls)?;
+        client.batch_execute(&format!(
+            "CREATE EXTENSION IF NOT EXISTS vector;
+             CREATE TABLE IF NOT EXISTS {c} (
+                 namespace TEXT NOT NULL,
+                 name TEXT NOT NULL,
+                 dimensions INT NOT NULL,
+                 metric TEXT NOT NULL,
+                 PRIMARY KEY (namespace, name)
+             );
+             CREATE TABLE IF NOT EXISTS {v} (
+                 namespace TEXT NOT NULL,
+                 collection TEXT NOT NULL,
+                 id TEXT NOT NULL,
+                 embedding vector NOT NULL,
+                 metadata JSONB NOT NULL DEFAULT '{{}}',
+                 PRIMARY KEY (namespace, collection, id),
+                 FOREIGN KEY (namespace, collection) REFERENCES {c} ON DELETE CASCADE
+             );",
+            c = self.collections_table(),
+            v = self.vectors_table(),
+        ))?;
+        Ok(client)
+    }
+
+    /// Run `f` on the connection, connecting again after a lost one
+    /// 在连接上执行 `f`，连接断开后重新连接
+    fn with_client<T>(
+        &self,
+        f: impl FnOnce(&mut Client) -> Result<T, VectorError>,
+    ) -> Result<T, VectorError> {
+        let mut guard = self.client.lock();
+        if guard.as_ref().map_or(true, |c| c.is_closed()) {
+            *guard = Some(self.connect()?);
+        }
+        let client = guard.as_mut().expect("connected above");
+        let out = f(client);
+        if client.is_closed() {
+            *guard = None;
+        }
+        out
+    }
+
+    fn spec(
+        &self,
+        client: &mut Client,
+        namespace: &str,
+        name: &str,
+    ) -> Result<CollectionSpec, VectorError> {
+        let sql = format!(
+            "SELECT dimensions, metric FROM {} WHERE namespace = $1 AND name = $2",
+            self.collections_table()
+        );
+        let row = client
+            .query_opt(&sql, &[&namespace, &name])?
+            .ok_or_else(|| VectorError::UnknownCollection(name.to_string()))?;
+        let dimensions: i32 = row.get(0);
+        let metric: String = row.get(1);
+        Ok(CollectionSpec {
+            name: name.to_string(),
+            dimensions: dimensions as usize,
+            metric: Metric::parse(&metric).unwrap_or_default(),
+        })
+    }
+}
+
+impl VectorBackend for PgVectorBackend {
+    fn name(&self) -> &str {
+        "pgvector"
+    }
+
+    fn create(&self, namespace: &str, spec: &CollectionSpec) -> Result<(), VectorError> {
+        self.with_client(|client| {
+            let sql = format!(
+                "INSERT INTO {} (namespace, name, dimensions, metric) VALUES ($1, $2, $3, $4)
+                 ON CONFLICT DO NOTHING",
+                self.collections_table()
+            );
+            let dimensions = spec.dimensions as i32;
+            client.execute(
+                &sql,
+                &[&namespace, &spec.name, &dimensions, &spec.metric.as_str()],
+            )?;
+            if self.spec(client, namespace, &spec.name)? != *spec {
+                return Err(VectorError::BadRequest(format!(
+                    "collection {} exists with another spec",
+                    spec.name
+                )));
+            }
+            Ok(())
+        })
+    }
+
+    fn drop_collection(&self, namespace: &str, name: &str) -> Result<(), VectorError> {
+        self.with_client(|client| {
+            let sql = format!(
+                "DELETE FROM {} WHERE namespace = $1 AND name = $2",
+                self.collections_table()
+            );
+            match client.execute(&sql, &[&namespace, &name])? {
+                0 => Err(VectorError::UnknownCollection(name.to_string())),
+                _ => Ok(()),
+            }
+        })
+    }
+
+    fn upsert(&self, namespace: &str, name: &str, records: Vec<Record>) -> Result<(), VectorError> {
+        // A statement may not touch a row twice, so the last record of an id wins here
+        // 同一语句不能两次修改同一行，因此同一 ID 以最后一条记录为准
+        let mut last: HashMap<String, usize> = HashMap::new();
+        for (i, r) in records.iter().enumerate() {
+            last.insert(r.id.clone(), i);
+        }
+        let records: Vec<Record> = records
+            .into_iter()
+            .enumerate()
+            .filter(|(i, r)| last[&r.id] == *i)
+            .map(|(_, r)| r)
+            .collect();
+        self.with_client(|client| {
+            let spec = self.spec(client, namespace, name)?;
+            check_records(&spec, &records)?;
+            let mut tx = client.transaction()?;
+            for batch in records.chunks(self.batch_size) {
+                let mut values = Vec::with_capacity(batch.len());
+                let mut params: Vec<String> = vec![namespace.to_string(), name.to_string()];
+                for r in batch {
+                    let i = params.len();
+                    values.push(format!(
+                        "($1, $2, ${}, ${}::text::vector, ${}::text::jsonb)",
+                        i + 1,
+                        i + 2,
+                        i + 3
+                    ));
+                    params.push(r.id.clone());
+                    params.push(vector_literal(&r.vector));
+                    params.push(Value::Object(r.metadata.clone()).to_string());
+                }
+                let sql = format!(
+                    "INSERT INTO {} (namespace, collection, id, embedding, metadata) VALUES {}
+                     ON CONFLICT (namespace, collection, id)
+                     DO UPDATE SET embedding = EXCLUDED.embedding, metadata = EXCLUDED.metadata",
+                    self.vectors_table(),
+                    values.join(", ")
+                );
+                let refs: Vec<&(dyn ToSql + Sync)> =
+                    params.iter().map(|p| p as &(dyn ToSql + Sync)).collect();
+                tx.execute(&sql, &refs)?;
+            }
+            tx.commit()?;
+            Ok(())
+        })
+    }
+
+    fn search(
+        &self,
+        namespace: &str,
+        name: &str,
+        vector: &[f32],
+        top_k: usize,
+        filter: &Map<String, Value>,
+    ) -> Result<Vec<Match>, VectorError> {
+        check_filter(filter)?;
+        self.with_client(|client| {
+            let spec = self.spec(client, namespace, name)?;
+            check_query(&spec, vector)?;
+            let sql = format!(
+                "SELECT id, metadata::text, (embedding {} $3::text::vector)::float8 AS d
+                 FROM {} WHERE namespace = $1 AND collection = $2 AND metadata @> $4::text::jsonb
+                 ORDER BY d LIMIT $5",
+                operator(spec.metric),
+                self.vectors_table()
+            );
+            let query = vector_literal(vector);
+            let filter = Value::Object(filter.clone()).to_string();
+            let limit = top_k.min(i64::MAX as usize) as i64;
+            let rows = client.query(&sql, &[&namespace, &name, &query, &filter, &limit])?;
+            Ok(rows
+                .iter()
+                .map(|row| {
+                    let metadata: String = row.get(1);
+                    let distance: f64 = row.get(2);
+                    Match {
+                        id: row.get(0),
+                        score: score(spec.metric, distance),
+                        metadata: serde_json::from_str(&metadata).unwrap_or_default(),
+                    }
+                })
+                .collect())
+        })
+    }
+
+    fn delete(&self, namespace: &str, name: &str, ids: &[String]) -> Result<usize, VectorError> {
+        self.with_client(|client| {
+            self.spec(client, namespace, name)?;
+            let sql = format!(
+                "DELETE FROM {} WHERE namespace = $1 AND collection = $2 AND id = ANY($3)",
+                self.vectors_table()
+            );
+            let ids = ids.to_vec();
+            Ok(client.execute(&sql, &[&namespace, &name, &ids])? as usize)
+        })
+    }
+
+    fn collections(&self, namespace: &str) -> Result<Vec<CollectionInfo>, VectorError> {
+        self.with_client(|client| {
+            let sql = format!(
+                "SELECT c.name, c.dimensions, c.metric,
+                        (SELECT count(*) FROM {v} v WHERE v.namespace = c.namespace AND v.collection = c.name)
+                 FROM {c} c WHERE c.namespace = $1 ORDER BY c.name",
+                c = self.collections_table(),
+                v = self.vectors_table(),
+            );
+            Ok(client
+                .query(&sql, &[&namespace])?
+                .iter()
+                .map(|row| {
+                    let dimensions: i32 = row.get(1);
+                    let metric: String = row.get(2);
+                    let vectors: i64 = row.get(3);
+                    CollectionInfo {
+                        spec: CollectionSpec {
+                            name: row.get(0),
+                            dimensions: dimensions as usize,
+                            metric: Metric::parse(&metric).unwrap_or_default(),
+                        },
+                        vectors: vectors as usize,
+                    }
+                })
+                .collect())
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_vector_literal_and_scores() {
+        assert_eq!(vector_literal(&[1.0, -0.5, 0.25]), "[1,-0.5,0.25]");
+        assert_eq!(operator(Metric::Cosine), "<=>");
+        assert_eq!(score(Metric::Cosine, 0.25), 0.75);
+        assert_eq!(score(Metric::Dot, -3.0), 3.0);
+        let bad = serde_json::json!({"tags": ["a"]})
+            .as_object()
+            .unwrap()
+            .clone();
+        assert!(matches!(
+            check_filter(&bad),
+            Err(VectorError::BadRequest(_))
+        ));
+    }
+}
@@ -0,0 +1,392 @@
+//! Qdrant vector backend / Qdrant 向量后端
+//!
+//! Each task collection becomes a Qdrant collection named by [`physical_name`]. A catalog
+//! collection, `<prefix>_catalog`, maps those back to the task and collection name and keeps
+//! the spec, so collections are found again after a restart. Qdrant point ids must be UUIDs,
+//! so record ids are hashed into one and kept in the payload as `_id`.
+//! 每个任务集合对应一个以 [`physical_name`] 命名的 Qdrant 集合。目录集合 `<prefix>_catalog`
+//! 记录其所属任务、集合名与规格，使重启后仍能找回集合。Qdrant 的点 ID 必须是 UUID，因此记录 ID
+//! 被哈希为 UUID，原始 ID 以 `_id` 保存在 payload 中。
+
+use std::collections::HashMap;
+
+use parking_lot::{Mutex, RwLock};
+use reqwest::Method;
+use serde_json::{json, Map, Value};
+use uuid::Uuid;
+
+use super::http::JsonClient;
+use super::{
+    check_query, check_records, physical_name, CollectionInfo, CollectionSpec, Match, Metric,
+    Record, VectorBackend, VectorError,
+};
+use crate::spearlet::config::VectorStoreConfig;
+
+pub struct QdrantBackend {
+    http: JsonClient,
+    prefix: String,
+    batch_size: usize,
+    catalog_ready: Mutex<bool>,
+    /// Specs read from the catalog / 从目录读取的规格
+    specs: RwLock<HashMap<(String, String), CollectionSpec>>,
+}
+
+fn point_id(id: &str) -> String {
+    Uuid::new_v5(&Uuid::NAMESPACE_OID, id.as_bytes()).to_string()
+}
+
+fn distance(metric: Metric) -> &'static str {
+    match metric {
+        Metric::Cosine => "Cosine",
+        Metric::Dot => "Dot",
+        Metric::Euclidean => "Euclid",
+    }
+}
+
+/// The `result` of a successful answer / 成功应答中的 `result`
+fn result(op: &str, (status, body): (u16, Value)) -> Result<Value, VectorError> {
+    if (200..300).contains(&status) {
+        return Ok(body.get("result").cloned().unwrap_or(Value::Null));
+    }
+    let detail = body
+        .pointer("/status/error")
+        .and_then(|v| v.as_str())
+        .unwrap_or("");
+    Err(VectorError::Backend(format!(
+        "qdrant {}: status {} {}",
+        op, status, detail
+    )))
+}
+
+/// Metadata filter as Qdrant `must` conditions / 以 Qdrant `must` 条件表示的元数据过滤
+fn conditions(filter: &Map<String, Value>) -> Result<Vec<Value>, VectorError> {
+    filter
+        .iter()
+        .map(|(k, v)| {
+            if k.is_empty()
+                || !k
+                    .chars()
+                    .all(|c| c.is_ascii_alphanumeric() || c == '_' || c == '-')
+            {
+                return Err(VectorError::BadRequest(format!(
+                    "unsupported filter key {:?}",
+                    k
+                )));
+            }
+            if !(v.is_string() || v.is_boolean() || v.is_i64() || v.is_u64()) {
+                return Err(VectorError::BadRequest(format!(
+                    "filter value of {} must be a string, integer or boolean",
+                    k
+                )));
+            }
+            Ok(json!({"key": format!("metadata.{}", k), "match": {"value": v}}))
+        })
+        .collect()
+}
+
+impl QdrantBackend {
+    pub fn new(config: &VectorStoreConfig) -> Result<Self, VectorError> {
+        Ok(Self {
+            http: JsonClient::new(config, "api-key", false)?,
+            prefix: config.collection_prefix.clone(),
+            batch_size: config.batch_size.max(1),
+            catalog_ready: Mutex::new(false),
+            specs: RwLock::new(HashMap::new()),
+        })
+    }
+
+    fn catalog(&self) -> String {
+        format!("{}_catalog", self.prefix)
+    }
+
+    fn ensure_catalog(&self) -> Result<(), VectorError> {
+        let mut ready = self.catalog_ready.lock();
+        if *ready {
+            return Ok(());
+        }
+        let path = format!("/collections/{}", self.catalog());
+        let (status, body) = self.http.call(Method::GET, &path, None)?;
+        if status == 404 {
+            let body = json!({"vectors": {"size": 1, "distance": "Dot"}});
+            result(
+                "create catalog",
+                self.http.call(Method::PUT, &path, Some(&body))?,
+            )?;
+        } else {
+            result("read catalog", (status, body))?;
+        }
+        *ready = true;
+        Ok(())
+    }
+
+    fn spec(&self, namespace: &str, name: &str) -> Result<CollectionSpec, VectorError> {
+        let key = (namespace.to_string(), name.to_string());
+        if let Some(spec) = self.specs.read().get(&key) {
+            return Ok(spec.clone());
+        }
+        self.ensure_catalog()?;
+        let path = format!(
+            "/collections/{}/points/{}",
+            self.catalog(),
+            point_id(&physical_name(&self.prefix, namespace, name))
+        );
+        let answer = self.http.call(Method::GET, &path, None)?;
+        if answer.0 == 404 {
+            return Err(VectorError::UnknownCollection(name.to_string()));
+        }
+        let point = result("read catalog", answer)?;
+        let payload = point.get("payload").cloned().unwrap_or(Value::Null);
+        let spec = CollectionSpec {
+            name: name.to_string(),
+            dimensions: payload["dimensions"].as_u64().unwrap_or(0) as usize,
+            metric: Metric::parse(payload["metric"].as_str().unwrap_or("")).unwrap_or_default(),
+        };
+        self.specs.write().insert(key, spec.clone());
+        Ok(spec)
+    }
+
+    /// Turn a 404 on a catalogued collection into `UnknownCollection`
+    /// 将已登记集合上的 404 转换为 `UnknownCollection`
+    fn checked(
+        &self,
+        op: &str,
+        namespace: &str,
+        name: &str,
+        answer: (u16, Value),
+    ) -> Result<Value, VectorError> {
+        if answer.0 == 404 {
+            self.specs
+                .write()
+                .remove(&(namespace.to_string(), name.to_string()));
+            return Err(VectorError::UnknownCollection(name.to_string()));
+        }
+        result(op, answer)
+    }
+}
+
+impl VectorBackend for QdrantBackend {
+    fn name(&self) -> &str {
+        "qdrant"
+    }
+
+    fn create(&self, namespace: &str, spec: &CollectionSpec) -> Result<(), VectorError> {
+        match self.spec(namespace, &spec.name) {
+            Ok(existing) if existing == *spec => return Ok(()),
+            Ok(_) => {
+                return Err(VectorError::BadRequest(format!(
+                    "collection {} exists with another spec",
+                    spec.name
+                )))
+            }
+            Err(VectorError::UnknownCollection(_)) => {}
+            Err(e) => return Err(e),
+        }
+        let physical = physical_name(&self.prefix, namespace, &spec.name);
+        let body = json!({"vectors": {"size": spec.dimensions, "distance": distance(spec.metric)}});
+        let answer = self.http.call(
+            Method::PUT,
+            &format!("/collections/{}", physical),
+            Some(&body),
+        )?;
+        // Left over from a create that did not reach the catalog / 上次创建未写入目录时遗留的集合
+        if answer.0 != 409 {
+            result("create collection", answer)?;
+        }
+        let body = json!({"points": [{
+            "id": point_id(&physical),
+            "vector": [1.0],
+            "payload": {
+                "namespace": namespace,
+                "name": spec.name,
+                "dimensions": spec.dimensions,
+                "metric": spec.metric.as_str(),
+            },
+        }]});
+        let path = format!("/collections/{}/points?wait=true", self.catalog());
+        result(
+            "write catalog",
+            self.http.call(Method::PUT, &path, Some(&body))?,
+        )?;
+        self.specs
+            .write()
+            .insert((namespace.to_string(), spec.name.clone()), spec.clone());
+        Ok(())
+    }
+
+    fn drop_collection(&self, namespace: &str, name: &str) -> Result<(), VectorError> {
+        self.spec(namespace, name)?;
+        let physical = physical_name(&self.prefix, namespace, name);
+        let answer = self
+            .http
+            .call(Method::DELETE, &format!("/collections/{}", physical), None)?;
+        if answer.0 != 404 {
+            result("drop collection", answer)?;
+        }
+        let body = json!({"points": [point_id(&physical)]});
+        let path = format!("/collections/{}/points/delete?wait=true", self.catalog());
+        result(
+            "write catalog",
+            self.http.call(Method::POST, &path, Some(&body))?,
+        )?;
+        self.specs
+            .write()
+            .remove(&(namespace.to_string(), name.to_string()));
+        Ok(())
+    }
+
+    fn upsert(&self, namespace: &str, name: &str, records: Vec<Record>) -> Result<(), VectorError> {
+        let spec = self.spec(namespace, name)?;
+        check_records(&spec, &records)?;
+        let path = format!(
+            "/collections/{}/points?wait=true",
+            physical_name(&self.prefix, namespace, name)
+        );
+        for batch in records.chunks(self.batch_size) {
+            let points: Vec<Value> = batch
+                .iter()
+                .map(|r| {
+                    json!({
+                        "id": point_id(&r.id),
+                        "vector": r.vector,
+                        "payload": {"_id": r.id, "metadata": r.metadata},
+                    })
+                })
+                .collect();
+            let body = json!({ "points": points });
+            let answer = self.http.call(Method::PUT, &path, Some(&body))?;
+            self.checked("upsert", namespace, name, answer)?;
+        }
+        Ok(())
+    }
+
+    fn search(
+        &self,
+        namespace: &str,
+        name: &str,
+        vector: &[f32],
+        top_k: usize,
+        filter: &Map<String, Value>,
+    ) -> Result<Vec<Match>, VectorError> {
+        let spec = self.spec(namespace, name)?;
+        check_query(&spec, vector)?;
+        let mut body = json!({"vector": vector, "limit": top_k, "with_payload": true});
+        if !filter.is_empty() {
+            body["filter"] = json!({ "must": conditions(filter)? });
+        }
+        let path = format!(
+            "/collections/{}/points/search",
+            physical_name(&self.prefix, namespace, name)
+        );
+        let answer = self.http.call(Method::POST, &path, Some(&body))?;
+        let hits = self.checked("search", namespace, name, answer)?;
+        Ok(hits
+            .as_array()
+            .map(|a| a.as_slice())
+            .unwrap_or_default()
+            .iter()
+            .map(|h| {
+                let score = h["score"].as_f64().unwrap_or(0.0) as f32;
+                Match {
+                    id: h["payload"]["_id"].as_str().unwrap_or("").to_string(),
+                    // Qdrant reports the Euclidean distance itself / Qdrant 直接返回欧氏距离
+                    score: if spec.metric == Metric::Euclidean {
+                        -score
+                    } else {
+                        score
+                    },
+                    metadata: h["payload"]["metadata"]
+                        .as_object()
+                        .cloned()
+                        .unwrap_or_default(),
+                }
+            })
+            .collect())
+    }
+
+    fn delete(&self, namespace: &str, name: &str, ids: &[String]) -> Result<usize, VectorError> {
+        self.spec(namespace, name)?;
+        let physical = physical_name(&self.prefix, namespace, name);
+        let points: Vec<String> = ids.iter().map(|id| point_id(id)).collect();
+        let body = json!({"ids": points, "with_payload": false, "with_vector": false});
+        let path = format!("/collections/{}/points", physical);
+        let answer = self.http.call(Method::POST, &path, Some(&body))?;
+        let found = self
+            .checked("delete", namespace, name, answer)?
+            .as_array()
+            .map(|a| a.len())
+            .unwrap_or(0);
+        let body = json!({ "points": points });
+        let path = format!("/collections/{}/points/delete?wait=true", physical);
+        let answer = self.http.call(Method::POST, &path, Some(&body))?;
+        self.checked("delete", namespace, name, answer)?;
+        Ok(found)
+    }
+
+    fn collections(&self, namespace: &str) -> Result<Vec<CollectionInfo>, VectorError> {
+        self.ensure_catalog()?;
+        let body = json!({
+            "filter": {"must": [{"key": "namespace", "match": {"value": namespace}}]},
+            "limit": 1000,
+            "with_payload": true,
+        });
+        let path = format!("/collections/{}/points/scroll", self.catalog());
+        let page = result(
+            "read catalog",
+            self.http.call(Method::POST, &path, Some(&body))?,
+        )?;
+        let mut out = Vec::new();
+        for p in page["points"]
+            .as_array()
+            .map(|a| a.as_slice())
+            .unwrap_or_default()
+        {
+            let name = p["payload"]["name"].as_str().unwrap_or("").to_string();
+            let spec = CollectionSpec {
+                name: name.clone(),
+                dimensions: p["payload"]["dimensions"].as_u64().unwrap_or(0) as usize,
+                metric: Metric::parse(p["payload"]["metric"].as_str().unwrap_or(""))
+                    .unwrap_or_default(),
+            };
+            let path = format!(
+                "/collections/{}/points/count",
+                physical_name(&self.prefix, namespace, &name)
+            );
+            let answer = self
+                .http
+                .call(Method::POST, &path, Some(&json!({"exact": true})))?;
+            let vectors = if answer.0 == 404 {
+                0
+            } else {
+                result("count", answer)?["count"].as_u64().unwrap_or(0) as usize
+            };
+            out.push(CollectionInfo { spec, vectors });
+        }
+        out.sort_by(|a, b| a.spec.name.cmp(&b.spec.name));
+        Ok(out)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_filter_conditions() {
+        let filter = json!({"lang": "en", "page": 3})
+            .as_object()
+            .unwrap()
+            .clone();
+        let c = conditions(&filter).unwrap();
+        assert_eq!(
+            c[0],
+            json!({"key": "metadata.lang", "match": {"value": "en"}})
+        );
+        assert_eq!(c[1], json!({"key": "metadata.page", "match": {"value": 3}}));
+
+        let bad = json!({"score": 0.5}).as_object().unwrap().clone();
+        assert!(matches!(conditions(&bad), Err(VectorError::BadRequest(_))));
+        let bad = json!({"a.b": "x"}).as_object().unwrap().clone();
+        assert!(matches!(conditions(&bad), Err(VectorError::BadRequest(_))));
+        assert_eq!(point_id("n1"), point_id("n1"));
+    }
+}
@@ -0,0 +1,602 @@
+//! Completion webhooks for async invocations
+//! 异步调用的完成 webhook
+//!
+//! A caller of the async API registers a callback through the invocation metadata keys
+//! `callback_url` and `callback_secret`. When the execution finishes or fails, the
+//! spearlet POSTs a JSON summary to the URL, so schedulers do not need to poll.
+//! 异步 API 的调用方通过调用元数据键 `callback_url` 与 `callback_secret` 注册回调。执行完成或
+//! 失败时，spearlet 向该地址 POST 一份 JSON 摘要，调度器无需轮询。
+//!
+//! Each delivery is signed with HMAC-SHA256 over `"{timestamp}.{body}"` and carries
+//! `X-Spear-Signature: t=<timestamp>,v1=<hex>`. Failed deliveries are retried with
+//! exponential backoff.
+//! 每次投递以 HMAC-SHA256 对 `"{timestamp}.{body}"` 签名，并携带
+//! `X-Spear-Signature: t=<timestamp>,v1=<hex>`。投递失败时按指数退避重试。
+//!
+//! Callers choose the URL, so the node must not be usable to reach internal services:
+//! the host is resolved before each delivery and refused when any address is not
+//! public (unless `allow_private_networks`), the connection is pinned to the checked
+//! addresses, and redirects are not followed.
+//! 回调地址由调用方选择，因此不能借节点访问内部服务：每次投递前解析主机，任一地址非公网时
+//! 拒绝（除非设置 `allow_private_networks`），连接固定到已检查的地址，且不跟随重定向。
+
+use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
+use std::time::Duration;
+
+use base64::{engine::general_purpose, Engine as _};
+use serde::{Deserialize, Serialize};
+use tracing::{debug, warn};
+
+use crate::spearlet::config::WebhookConfig;
+use crate::spearlet::crash::spawn;
+use crate::spearlet::execution::ExecutionResponse;
+use crate::spearlet::http_auth::{constant_time_eq, hmac_sha256};
+use crate::spearlet::ip_allowlist;
+
+/// Metadata key of the callback URL / 回调地址的元数据键
+pub const METADATA_CALLBACK_URL: &str = "callback_url";
+/// Metadata key of the per-call signing secret / 单次调用签名密钥的元数据键
+pub const METADATA_CALLBACK_SECRET: &str = "callback_secret";
+
+/// Signature header / 签名头
+pub const HEADER_SIGNATURE: &str = "X-Spear-Signature";
+/// Event header / 事件头
+pub const HEADER_EVENT: &str = "X-Spear-Event";
+/// Delivery ID header, stable across retries / 投递 ID 头，重试时保持不变
+pub const HEADER_DELIVERY: &str = "X-Spear-Delivery";
+
+/// Event sent when the execution completed / 执行完成时发送的事件
+pub const EVENT_COMPLETED: &str = "execution.completed";
+/// Event sent when the execution failed, timed out or was terminated
+/// 执行失败、超时或被终止时发送的事件
+pub const EVENT_FAILED: &str = "execution.failed";
+
+/// Registered callback of one execution / 单次执行注册的回调
+#[derive(Clone)]
+pub struct Callback {
+    /// Target URL / 目标地址
+    pub url: String,
+    /// Signing secret / 签名密钥
+    secret: String,
+}
+
+impl std::fmt::Debug for Callback {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Callback")
+            .field("url", &self.url)
+            .finish_non_exhaustive()
+    }
+}
+
+/// Body POSTed to the callback URL / POST 到回调地址的请求体
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CompletionPayload {
+    /// `execution.completed` or `execution.failed` / `execution.completed` 或 `execution.failed`
+    pub event: String,
+    pub execution_id: String,
+    pub invocation_id: String,
+    pub task_id: String,
+    pub function_name: String,
+    pub instance_id: String,
+    /// Final status such as `completed`, `failed` or `timeout` / 最终状态，如 `completed`、`failed` 或 `timeout`
+    pub status: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub error_message: Option<String>,
+    pub execution_time_ms: u64,
+    /// Completion wall-clock time (ms) / 完成时的墙上时间（毫秒）
+    pub completed_at_ms: i64,
+    /// Output size in bytes / 输出字节数
+    pub output_size: usize,
+    /// Output bytes, present when within `max_output_bytes` / 输出字节，不超过 `max_output_bytes` 时提供
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub output_base64: Option<String>,
+}
+
+impl CompletionPayload {
+    /// Build the payload of a finished execution / 根据已结束的执行构建请求体
+    pub fn from_response(resp: &ExecutionResponse, max_output_bytes: usize) -> Self {
+        let event = if resp.status == "completed" && resp.error_message.is_none() {
+            EVENT_COMPLETED
+        } else {
+            EVENT_FAILED
+        };
+        let output_base64 =
+            if !resp.output_data.is_empty() && resp.output_data.len() <= max_output_bytes {
+                Some(general_purpose::STANDARD.encode(&resp.output_data))
+            } else {
+                None
+            };
+        Self {
+            event: event.to_string(),
+            execution_id: resp.execution_id.clone(),
+            invocation_id: resp.invocation_id.clone(),
+            task_id: resp.task_id.clone(),
+            function_name: resp.function_name.clone(),
+            instance_id: resp.instance_id.clone(),
+            status: resp.status.clone(),
+            error_message: resp.error_message.clone(),
+            execution_time_ms: resp.execution_time_ms,
+            completed_at_ms: chrono::Utc::now().timestamp_millis(),
+            output_size: resp.output_data.len(),
+            output_base64,
+        }
+    }
+}
+
+/// Remove the callback keys from invocation metadata and validate them
+/// 从调用元数据中移除回调键并校验
+///
+/// The keys are removed even on error so the secret never reaches the workload.
+/// Returns `Ok(None)` when no callback was requested.
+/// 即使出错也会移除这些键，确保密钥不会传给工作负载。未请求回调时返回 `Ok(None)`。
+pub fn take_callback(
+    metadata: &mut HashMap<String, String>,
+    config: &WebhookConfig,
+) -> Result<Option<Callback>, String> {
+    let url = metadata.remove(METADATA_CALLBACK_URL);
+    let secret = metadata.remove(METADATA_CALLBACK_SECRET);
+    let Some(url) = url.map(|u| u.trim().to_string()).filter(|u| !u.is_empty()) else {
+        return Ok(None);
+    };
+    if !config.enabled {
+        return Err("callback webhooks are disabled on this spearlet".to_string());
+    }
+    validate_url(&url, config)?;
+    let secret = secret
+        .filter(|s| !s.is_empty())
+        .unwrap_or_else(|| config.signing_secret.clone());
+    if secret.is_empty() {
+        return Err(format!(
+            "{} requires {} or a spearlet signing secret",
+            METADATA_CALLBACK_URL, METADATA_CALLBACK_SECRET
+        ));
+    }
+    Ok(Some(Callback { url, secret }))
+}
+
+fn validate_url(raw: &str, config: &WebhookConfig) -> Result<(), String> {
+    let url = url::Url::parse(raw).map_err(|e| format!("invalid callback_url: {}", e))?;
+    match url.scheme() {
+        "https" => {}
+        "http" if config.allow_http => {}
+        "http" => return Err("callback_url must use https".to_string()),
+        other => return Err(format!("unsupported callback_url scheme: {}", other)),
+    }
+    let host = url
+        .host_str()
+        .ok_or_else(|| "callback_url has no host".to_string())?
+        .to_ascii_lowercase();
+    if !config.allowed_hosts.is_empty()
+        && !config.allowed_hosts.iter().any(|h| host_allowed(h, &host))
+    {
+        return Err(format!("callback host not allowed: {}", host));
+    }
+    // Literal addresses are refused at once; names are checked when resolved
+    // 字面地址立即拒绝；主机名在解析时检查
+    if let Some(ip) = literal_ip(&url) {
+        check_address(ip, config)?;
+    }
+    Ok(())
+}
+
+fn literal_ip(url: &url::Url) -> Option<IpAddr> {
+    match url.host()? {
+        url::Host::Ipv4(ip) => Some(IpAddr::V4(ip)),
+        url::Host::Ipv6(ip) => Some(IpAddr::V6(ip)),
+        url::Host::Domain(_) => None,
+    }
+}
+
+fn check_address(ip: IpAddr, config: &WebhookConfig) -> Result<(), String> {
+    if config.allow_private_networks || ip_allowlist::is_public(ip) {
+        Ok(())
+    } else {
+        Err(format!("callback address not allowed: {}", ip))
+    }
+}
+
+/// Resolve the callback host and check every address / 解析回调主机并检查每个地址
+///
+/// Returns the host name and the checked addresses to pin the connection to.
+/// 返回主机名及用于固定连接的已检查地址。
+async fn resolve_checked(
+    raw: &str,
+    config: &WebhookConfig,
+) -> Result<(String, Vec<SocketAddr>), String> {
+    validate_url(raw, config)?;
+    let url = url::Url::parse(raw).map_err(|e| format!("invalid callback_url: {}", e))?;
+    let host = url.host_str().unwrap_or_default().to_string();
+    let port = url.port_or_known_default().unwrap_or(443);
+    if let Some(ip) = literal_ip(&url) {
+        return Ok((host, vec![SocketAddr::new(ip, port)]));
+    }
+    let addrs: Vec<SocketAddr> = tokio::net::lookup_host((host.as_str(), port))
+        .await
+        .map_err(|e| format!("resolve {}: {}", host, e))?
+        .collect();
+    if addrs.is_empty() {
+        return Err(format!("resolve {}: no addresses", host));
+    }
+    for addr in &addrs {
+        check_address(addr.ip(), config)?;
+    }
+    Ok((host, addrs))
+}
+
+fn host_allowed(pattern: &str, host: &str) -> bool {
+    let pattern = pattern.trim().to_ascii_lowercase();
+    match pattern.strip_prefix("*.") {
+        Some(suffix) => host
+            .strip_suffix(suffix)
+            .map(|rest| rest.ends_with('.'))
+            .unwrap_or(false),
+        None => pattern == host,
+    }
+}
+
+/// Signature header value for a body sent at `timestamp` (Unix seconds)
+/// 在 `timestamp`（Unix 秒）发送的请求体对应的签名头取值
+pub fn sign(secret: &str, timestamp: i64, body: &[u8]) -> String {
+    let mut msg = format!("{}.", timestamp).into_bytes();
+    msg.extend_from_slice(body);
+    let mac = hmac_sha256(secret.as_bytes(), &msg);
+    let hex: String = mac.iter().map(|b| format!("{:02x}", b)).collect();
+    format!("t={},v1={}", timestamp, hex)
+}
+
+/// Verify a signature header, as a receiver would / 以接收方的方式校验签名头
+///
+/// Rejects timestamps further than `tolerance_s` from `now_s`.
+/// 时间戳与 `now_s` 相差超过 `tolerance_s` 时拒绝。
+pub fn verify(secret: &str, header: &str, body: &[u8], now_s: i64, tolerance_s: i64) -> bool {
+    let mut timestamp = None;
+    let mut signatures = Vec::new();
+    for part in header.split(',') {
+        match part.trim().split_once('=') {
+            Some(("t", v)) => timestamp = v.parse::<i64>().ok(),
+            Some(("v1", v)) => signatures.push(v),
+            _ => {}
+        }
+    }
+    let Some(ts) = timestamp else {
+        return false;
+    };
+    if (now_s - ts).abs() > tolerance_s {
+        return false;
+    }
+    let expected = sign(secret, ts, body);
+    let expected = expected.rsplit("v1=").next().unwrap_or_default();
+    signatures
+        .iter()
+        .any(|s| constant_time_eq(s.as_bytes(), expected.as_bytes()))
+}
+
+/// Deliver the payload in the background / 在后台投递请求体
+pub fn dispatch(callback: Callback, payload: CompletionPayload, config: &WebhookConfig) {
+    let config = config.clone();
+    spawn("webhook", async move {
+        let _ = deliver(&callback, &payload, &config).await;
+    });
+}
+
+/// Deliver the payload, retrying until a 2xx response or `max_attempts`
+/// 投递请求体，直到收到 2xx 响应或达到 `max_attempts`
+///
+/// 4xx responses other than 408 and 429 are not retried. Returns the number of attempts
+/// on success.
+/// 除 408 与 429 以外的 4xx 响应不会重试。成功时返回投递次数。
+pub async fn deliver(
+    callback: &Callback,
+    payload: &CompletionPayload,
+    config: &WebhookConfig,
+) -> Result<u32, String> {
+    let body = serde_json::to_vec(payload).map_err(|e| e.to_string())?;
+    let delivery_id = uuid::Uuid::new_v4().to_string();
+    let max_attempts = config.max_attempts.max(1);
+    let mut backoff = Duration::from_millis(config.initial_backoff_ms);
+    let mut last_error = String::new();
+    for attempt in 1..=max_attempts {
+        // Resolved per attempt so a changed DNS answer is checked too
+        // 每次投递都重新解析，DNS 应答变化时同样会被检查
+        let client = match client_for(&callback.url, config).await {
+            Ok(c) => c,
+            Err(e) => {
+                last_error = e;
+                break;
+            }
+        };
+        let timestamp = chrono::Utc::now().timestamp();
+        let resp = client
+            .post(&callback.url)
+            .header("Content-Type", "application/json")
+            .header(HEADER_SIGNATURE, sign(&callback.secret, timestamp, &body))
+            .header(HEADER_EVENT, payload.event.as_str())
+            .header(HEADER_DELIVERY, delivery_id.as_str())
+            .body(body.clone())
+            .send()
+            .await;
+        let retryable = match resp {
+            Ok(r) if r.status().is_success() => {
+                debug!(
+                    execution_id = %payload.execution_id,
+                    url = %callback.url,
+                    attempt,
+                    "webhook delivered"
+                );
+                return Ok(attempt);
+            }
+            Ok(r) => {
+                let status = r.status();
+                last_error = format!("status {}", status.as_u16());
+                // Redirects are refused, not followed / 拒绝而非跟随重定向
+                !status.is_redirection()
+                    && (!status.is_client_error()
+                        || status.as_u16() == 408
+                        || status.as_u16() == 429)
+            }
+            Err(e) => {
+                last_error = e.to_string();
+                true
+            }
+        };
+        if !retryable || attempt == max_attempts {
+            break;
+        }
+        tokio::time::sleep(backoff).await;
+        backoff = backoff.saturating_mul(2);
+    }
+    warn!(
+        execution_id = %payload.execution_id,
+        url = %callback.url,
+        error = %last_error,
+        "webhook delivery failed"
+    );
+    Err(last_error)
+}
+
+/// Client bound to the checked addresses of the callback host, without redirects
+/// 绑定到回调主机已检查地址且不跟随重定向的客户端
+async fn client_for(url: &str, config: &WebhookConfig) -> Result<reqwest::Client, String> {
+    let (host, addrs) = resolve_checked(url, config).await?;
+    let builder = reqwest::Client::builder()
+        .timeout(Duration::from_millis(config.timeout_ms.max(1)))
+        .redirect(reqwest::redirect::Policy::none())
+        .resolve_to_addrs(&host, &addrs);
+    builder.build().map_err(|e| e.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicU32, Ordering};
+    use std::sync::Arc;
+
+    fn response(status: &str) -> ExecutionResponse {
+        ExecutionResponse {
+            execution_id: "exec-1".to_string(),
+            invocation_id: "inv-1".to_string(),
+            task_id: "task-1".to_string(),
+            function_name: "__default__".to_string(),
+            instance_id: "inst-1".to_string(),
+            output_data: b"ok".to_vec(),
+            status: status.to_string(),
+            error_message: None,
+            execution_time_ms: 12,
+            metadata: HashMap::new(),
+            timestamp: std::time::SystemTime::now(),
+            mono_ms: 0,
+        }
+    }
+
+    #[test]
+    fn test_sign_and_verify() {
+        let body = br#"{"event":"execution.completed"}"#;
+        let header = sign("s3cret", 1_760_000_000, body);
+        assert!(header.starts_with("t=1760000000,v1="));
+        assert!(verify("s3cret", &header, body, 1_760_000_030, 300));
+        assert!(!verify("other", &header, body, 1_760_000_030, 300));
+        assert!(!verify("s3cret", &header, b"{}", 1_760_000_030, 300));
+        assert!(!verify("s3cret", &header, body, 1_760_001_000, 300));
+    }
+
+    #[test]
+    fn test_take_callback_strips_and_validates() {
+        let mut cfg = WebhookConfig::default();
+        let mut meta = HashMap::new();
+        meta.insert(
+            METADATA_CALLBACK_URL.to_string(),
+            "https://sched.example.com/cb".to_string(),
+        );
+        meta.insert(METADATA_CALLBACK_SECRET.to_string(), "k".to_string());
+        meta.insert("trace".to_string(), "1".to_string());
+        let cb = take_callback(&mut meta, &cfg).unwrap().unwrap();
+        assert_eq!(cb.url, "https://sched.example.com/cb");
+        assert_eq!(meta.len(), 1);
+
+        let mut meta = HashMap::new();
+        meta.insert(
+            METADATA_CALLBACK_URL.to_string(),
+            "https://sched.example.com/cb".to_string(),
+        );
+        assert!(take_callback(&mut meta, &cfg).is_err());
+        assert!(meta.is_empty());
+
+        cfg.signing_secret = "node".to_string();
+        cfg.allowed_hosts = vec!["*.example.com".to_string()];
+        let mut meta = HashMap::new();
+        meta.insert(
+            METADATA_CALLBACK_URL.to_string(),
+            "https://a.example.com/cb".to_string(),
+        );
+        assert!(take_callback(&mut meta, &cfg).unwrap().is_some());
+        let mut meta = HashMap::new();
+        meta.insert(
+            METADATA_CALLBACK_URL.to_string(),
+            "https://example.org/cb".to_string(),
+        );
+        assert!(take_callback(&mut meta, &cfg).is_err());
+        let mut meta = HashMap::new();
+        meta.insert(
+            METADATA_CALLBACK_URL.to_string(),
+            "file:///etc/passwd".to_string(),
+        );
+        assert!(take_callback(&mut meta, &cfg).is_err());
+        assert!(take_callback(&mut HashMap::new(), &cfg).unwrap().is_none());
+    }
+
+    #[test]
+    fn test_internal_destinations_are_refused_by_default() {
+        let cfg = WebhookConfig {
+            signing_secret: "node".to_string(),
+            ..Default::default()
+        };
+        for url in [
+            "http://sched.example.com/cb",
+            "https://169.254.169.254/latest/meta-data",
+            "https://127.0.0.1:8080/cb",
+            "https://10.0.0.3/cb",
+            "https://[::1]/cb",
+        ] {
+            let mut meta = HashMap::new();
+            meta.insert(METADATA_CALLBACK_URL.to_string(), url.to_string());
+            assert!(take_callback(&mut meta, &cfg).is_err(), "{}", url);
+        }
+
+        let open = WebhookConfig {
+            allow_http: true,
+            allow_private_networks: true,
+            ..cfg
+        };
+        let mut meta = HashMap::new();
+        meta.insert(
+            METADATA_CALLBACK_URL.to_string(),
+            "http://10.0.0.3/cb".to_string(),
+        );
+        assert!(take_callback(&mut meta, &open).unwrap().is_some());
+    }
+
+    #[tokio::test]
+    async fn test_deliver_checks_resolved_addresses_and_redirects() {
+        let hits = Arc::new(AtomicU32::new(0));
+        let hits_srv = hits.clone();
+        let app = axum::Router::new()
+            .route(
+                "/cb",
+                axum::routing::post(|| async {
+                    axum::response::Redirect::temporary("http://169.254.169.254/")
+                }),
+            )
+            .route(
+                "/internal",
+                axum::routing::post(move || {
+                    let hits = hits_srv.clone();
+                    async move {
+                        hits.fetch_add(1, Ordering::SeqCst);
+                        axum::http::StatusCode::NO_CONTENT
+                    }
+                }),
+            );
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            let _ = axum::serve(listener, app).await;
+        });
+        let payload = CompletionPayload::from_response(&response("completed"), 1024);
+
+        // `localhost` resolves to loopback / `localhost` 解析为回环地址
+        let cfg = WebhookConfig {
+            initial_backoff_ms: 10,
+            allow_http: true,
+            ..Default::default()
+        };
+        let cb = Callback {
+            url: format!("http://localhost:{}/internal", addr.port()),
+            secret: "k".to_string(),
+        };
+        let err = deliver(&cb, &payload, &cfg).await.unwrap_err();
+        assert!(err.contains("not allowed"), "{}", err);
+        assert_eq!(hits.load(Ordering::SeqCst), 0);
+
+        // A redirect fails the delivery without being followed or retried
+        // 重定向使投递失败，既不跟随也不重试
+        let cfg = WebhookConfig {
+            allow_private_networks: true,
+            ..cfg
+        };
+        let cb = Callback {
+            url: format!("http://{}/cb", addr),
+            secret: "k".to_string(),
+        };
+        assert_eq!(
+            deliver(&cb, &payload, &cfg).await,
+            Err("status 307".to_string())
+        );
+    }
+
+    #[test]
+    fn test_payload_event_and_output() {
+        let p = CompletionPayload::from_response(&response("completed"), 1024);
+        assert_eq!(p.event, EVENT_COMPLETED);
+        assert_eq!(p.output_base64.as_deref(), Some("b2s="));
+        let p = CompletionPayload::from_response(&response("timeout"), 1);
+        assert_eq!(p.event, EVENT_FAILED);
+        assert_eq!(p.output_size, 2);
+        assert!(p.output_base64.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_deliver_retries_and_signs() {
+        let hits = Arc::new(AtomicU32::new(0));
+        let hits_srv = hits.clone();
+        let app = axum::Router::new().route(
+            "/cb",
+            axum::routing::post(
+                move |headers: axum::http::HeaderMap, body: axum::body::Bytes| {
+                    let hits = hits_srv.clone();
+                    async move {
+                        let n = hits.fetch_add(1, Ordering::SeqCst);
+                        let sig = headers
+                            .get(HEADER_SIGNATURE)
+                            .and_then(|v| v.to_str().ok())
+                            .unwrap_or_default();
+                        let now = chrono::Utc::now().timestamp();
+                        if !verify("k", sig, &body, now, 60) {
+                            return axum::http::StatusCode::UNAUTHORIZED;
+                        }
+                        if n == 0 {
+                            axum::http::StatusCode::SERVICE_UNAVAILABLE
+                        } else {
+                            axum::http::StatusCode::NO_CONTENT
+                        }
+                    }
+                },
+            ),
+        );
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            let _ = axum::serve(listener, app).await;
+        });
+
+        let cfg = WebhookConfig {
+            initial_backoff_ms: 10,
+            allow_http: true,
+            allow_private_networks: true,
+            ..Default::default()
+        };
+        let cb = Callback {
+            url: format!("http://{}/cb", addr),
+            secret: "k".to_string(),
+        };
+        let payload = CompletionPayload::from_response(&response("completed"), 1024);
+        assert_eq!(deliver(&cb, &payload, &cfg).await, Ok(2));
+
+        let bad = Callback {
+            secret: "wrong".to_string(),
+            ..cb
+        };
+        assert!(deliver(&bad, &payload, &cfg).await.is_err());
+        assert_eq!(hits.load(Ordering::SeqCst), 3);
+    }
+}
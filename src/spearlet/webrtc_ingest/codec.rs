@@ -0,0 +1,101 @@
+//! Opus for WebRTC sessions / WebRTC 会话使用的 Opus 编解码
+//!
+//! The user stream carries mono 16-bit PCM at the session's rate. libopus resamples
+//! internally, so one decoder and one encoder at that rate cover both directions.
+//! user stream 承载会话采样率下的单声道 16 位 PCM。libopus 内部完成重采样，因此该采样率下的
+//! 一个解码器与一个编码器即可覆盖两个方向。
+
+use opus::{Application, Channels};
+
+/// Longest Opus packet / 最长的 Opus 数据包时长
+const MAX_PACKET_MS: usize = 120;
+/// Room for one encoded packet / 一个编码数据包的空间
+const MAX_ENCODED: usize = 1500;
+
+/// Sample rates libopus decodes to and encodes from / libopus 支持解码输出与编码输入的采样率
+pub const SAMPLE_RATES: &[u32] = &[8000, 12000, 16000, 24000, 48000];
+
+/// Decodes inbound Opus to PCM / 将入站 Opus 解码为 PCM
+pub struct OpusDecoder {
+    inner: opus::Decoder,
+    buf: Vec<i16>,
+    /// Samples in one frame, used for concealment / 一帧的采样数，用于丢包补偿
+    frame: usize,
+}
+
+impl OpusDecoder {
+    pub fn new(sample_rate: u32, frame: usize) -> Result<Self, String> {
+        let inner = opus::Decoder::new(sample_rate, Channels::Mono)
+            .map_err(|e| format!("opus decoder: {}", e))?;
+        Ok(Self {
+            inner,
+            buf: vec![0; sample_rate as usize * MAX_PACKET_MS / 1000],
+            frame,
+        })
+    }
+
+    /// Decode one packet; a corrupt packet is concealed like a lost one
+    /// 解码一个数据包；损坏的数据包按丢失处理并补偿
+    pub fn decode(&mut self, payload: &[u8]) -> Vec<i16> {
+        match self.inner.decode(payload, &mut self.buf, false) {
+            Ok(n) => self.buf[..n].to_vec(),
+            Err(_) => self.conceal(),
+        }
+    }
+
+    /// One frame of audio standing in for a lost packet / 替代一个丢失数据包的一帧音频
+    pub fn conceal(&mut self) -> Vec<i16> {
+        let frame = self.frame.min(self.buf.len());
+        match self.inner.decode(&[], &mut self.buf[..frame], false) {
+            Ok(n) => self.buf[..n].to_vec(),
+            Err(_) => vec![0; frame],
+        }
+    }
+}
+
+/// Encodes the workload's PCM to Opus / 将工作负载的 PCM 编码为 Opus
+pub struct OpusEncoder {
+    inner: opus::Encoder,
+    buf: Vec<u8>,
+}
+
+impl OpusEncoder {
+    pub fn new(sample_rate: u32) -> Result<Self, String> {
+        let inner = opus::Encoder::new(sample_rate, Channels::Mono, Application::Voip)
+            .map_err(|e| format!("opus encoder: {}", e))?;
+        Ok(Self {
+            inner,
+            buf: vec![0; MAX_ENCODED],
+        })
+    }
+
+    /// Encode exactly one frame / 编码恰好一帧
+    pub fn encode(&mut self, pcm: &[i16]) -> Result<Vec<u8>, String> {
+        let n = self
+            .inner
+            .encode(pcm, &mut self.buf)
+            .map_err(|e| format!("opus encode: {}", e))?;
+        Ok(self.buf[..n].to_vec())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_opus_round_trip_and_concealment() {
+        let frame = 320;
+        let tone: Vec<i16> = (0..frame)
+            .map(|i| ((i as f32 * 0.17).sin() * 8000.0) as i16)
+            .collect();
+        let mut enc = OpusEncoder::new(16000).unwrap();
+        let mut dec = OpusDecoder::new(16000, frame).unwrap();
+        let packet = enc.encode(&tone).unwrap();
+        assert!(!packet.is_empty() && packet.len() < tone.len() * 2);
+        assert_eq!(dec.decode(&packet).len(), frame);
+        assert_eq!(dec.conceal().len(), frame);
+        assert_eq!(dec.decode(&[0xff; 3]).len(), frame);
+        assert!(enc.encode(&tone[..100]).is_err());
+    }
+}
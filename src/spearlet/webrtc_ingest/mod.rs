@@ -0,0 +1,616 @@
+//! WebRTC audio ingestion for user streams / 面向 user stream 的 WebRTC 音频接入
+//!
+//! `POST /api/v1/executions/{id}/streams/webrtc` takes an SDP offer and answers it with
+//! a peer connection bound to that execution. ICE, DTLS-SRTP, RTCP and NACK are handled
+//! by webrtc-rs. Inbound Opus is reordered by a jitter buffer, decoded to 16-bit PCM and
+//! pushed to the execution's user stream as SSF DATA frames; PCM the workload writes
+//! back to the same stream is encoded to Opus and sent on the answer's audio track.
+//! `POST /api/v1/executions/{id}/streams/webrtc` 接收 SDP offer，并以绑定到该执行的对等连接
+//! 应答。ICE、DTLS-SRTP、RTCP 与 NACK 由 webrtc-rs 处理。入站 Opus 经抖动缓冲重排、解码为
+//! 16 位 PCM 后，以 SSF DATA 帧推入该执行的 user stream；工作负载写回同一流的 PCM 被编码为
+//! Opus，并通过应答中的音轨发送。
+//!
+//! Browsers connect directly. SIP trunks connect through an SBC or media gateway that
+//! offers WebRTC.
+//! 浏览器可直接连接。SIP 中继通过支持 WebRTC 的 SBC 或媒体网关连接。
+
+mod codec;
+
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+use bytes::Bytes;
+use dashmap::DashMap;
+use serde::{Deserialize, Serialize};
+use tokio::sync::{mpsc, oneshot, watch};
+use tracing::info;
+use webrtc::api::interceptor_registry::register_default_interceptors;
+use webrtc::api::media_engine::{MediaEngine, MIME_TYPE_OPUS};
+use webrtc::api::setting_engine::SettingEngine;
+use webrtc::api::APIBuilder;
+use webrtc::ice::udp_network::{EphemeralUDP, UDPNetwork};
+use webrtc::ice_transport::ice_candidate_type::RTCIceCandidateType;
+use webrtc::ice_transport::ice_server::RTCIceServer;
+use webrtc::interceptor::registry::Registry;
+use webrtc::media::Sample;
+use webrtc::peer_connection::configuration::RTCConfiguration;
+use webrtc::peer_connection::peer_connection_state::RTCPeerConnectionState;
+use webrtc::peer_connection::sdp::session_description::RTCSessionDescription;
+use webrtc::peer_connection::RTCPeerConnection;
+use webrtc::rtp_transceiver::rtp_codec::{
+    RTCRtpCodecCapability, RTCRtpCodecParameters, RTPCodecType,
+};
+use webrtc::track::track_local::track_local_static_sample::TrackLocalStaticSample;
+use webrtc::track::track_local::TrackLocal;
+use webrtc::track::track_remote::TrackRemote;
+
+use crate::spearlet::config::WebRtcConfig;
+use crate::spearlet::exec_stream::DEFAULT_STREAM_ID;
+use crate::spearlet::execution::host_api::ssf;
+use crate::spearlet::execution::host_api::user_stream::ExecutionUserStreamHub;
+use crate::spearlet::execution::host_api::UserStreams;
+use crate::spearlet::rtp::jitter::{JitterBuffer, Playout};
+
+use codec::{OpusDecoder, OpusEncoder, SAMPLE_RATES};
+
+const SSF_MSG_DATA: u16 = 2;
+/// Opus frame duration, also the pacing of outbound audio / Opus 帧时长，也是出站音频的节拍
+const FRAME_MS: u32 = 20;
+/// Dynamic payload type offered for Opus / 为 Opus 提供的动态负载类型
+const OPUS_PAYLOAD_TYPE: u8 = 111;
+/// How long to wait for candidates before answering / 应答前等待候选的时长
+const GATHER_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Body of `POST .../streams/webrtc` / `POST .../streams/webrtc` 的请求体
+#[derive(Debug, Clone, Deserialize)]
+#[serde(default)]
+pub struct WebRtcSessionRequest {
+    pub stream_id: u32,
+    /// Rate of the PCM on the user stream, both ways / user stream 上双向 PCM 的采样率
+    pub sample_rate: u32,
+    /// SDP offer of the peer, with its candidates / 对端的 SDP offer，含其候选
+    pub sdp: String,
+}
+
+impl Default for WebRtcSessionRequest {
+    fn default() -> Self {
+        Self {
+            stream_id: DEFAULT_STREAM_ID,
+            sample_rate: 48000,
+            sdp: String::new(),
+        }
+    }
+}
+
+/// An open session as returned to the caller / 返回给调用方的已打开会话
+#[derive(Debug, Clone, Serialize)]
+pub struct WebRtcSessionInfo {
+    pub execution_id: String,
+    pub stream_id: u32,
+    pub codec: &'static str,
+    pub sample_rate: u32,
+    /// SDP answer carrying every local candidate / 携带全部本地候选的 SDP 应答
+    pub sdp: String,
+}
+
+#[derive(Debug)]
+pub enum WebRtcError {
+    Disabled,
+    BadRequest(String),
+    /// The execution already has a session / 该执行已有会话
+    Conflict,
+    /// The media stack failed / 媒体栈出错
+    Media(String),
+}
+
+impl std::fmt::Display for WebRtcError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Disabled => write!(f, "webrtc ingestion is disabled"),
+            Self::BadRequest(msg) => write!(f, "{}", msg),
+            Self::Conflict => write!(f, "execution already has a webrtc session"),
+            Self::Media(msg) => write!(f, "webrtc: {}", msg),
+        }
+    }
+}
+
+struct Session {
+    id: u64,
+    stop: Option<oneshot::Sender<()>>,
+}
+
+/// Open sessions by execution id / 按执行 id 索引的已打开会话
+#[derive(Clone, Default)]
+pub struct WebRtcSessions {
+    sessions: Arc<DashMap<String, Session>>,
+    next_id: Arc<AtomicU64>,
+    /// User streams the frames are delivered to / 帧所投递到的 user stream
+    streams: Arc<UserStreams>,
+}
+
+impl WebRtcSessions {
+    pub fn new(streams: Arc<UserStreams>) -> Self {
+        Self {
+            streams,
+            ..Default::default()
+        }
+    }
+
+    /// Answer a peer's offer with a session bridged to the execution's user stream
+    /// 以桥接到执行 user stream 的会话应答对端的 offer
+    pub async fn open(
+        &self,
+        cfg: &WebRtcConfig,
+        execution_id: &str,
+        req: WebRtcSessionRequest,
+    ) -> Result<WebRtcSessionInfo, WebRtcError> {
+        if !cfg.enabled {
+            return Err(WebRtcError::Disabled);
+        }
+        if !SAMPLE_RATES.contains(&req.sample_rate) {
+            return Err(WebRtcError::BadRequest(format!(
+                "unsupported sample_rate {}; use one of {:?}",
+                req.sample_rate, SAMPLE_RATES
+            )));
+        }
+        if req.sdp.trim().is_empty() {
+            return Err(WebRtcError::BadRequest("sdp offer is required".to_string()));
+        }
+        let offer = RTCSessionDescription::offer(req.sdp)
+            .map_err(|e| WebRtcError::BadRequest(format!("invalid sdp offer: {}", e)))?;
+        if self.sessions.contains_key(execution_id) {
+            return Err(WebRtcError::Conflict);
+        }
+
+        let link = Link {
+            id: self.next_id.fetch_add(1, Ordering::Relaxed),
+            execution_id: execution_id.to_string(),
+            stream_id: req.stream_id,
+            sample_rate: req.sample_rate,
+        };
+        let decoder = OpusDecoder::new(link.sample_rate, link.samples_per_frame())
+            .map_err(WebRtcError::Media)?;
+        let encoder = OpusEncoder::new(link.sample_rate).map_err(WebRtcError::Media)?;
+        let pc = peer_connection(cfg).await.map_err(WebRtcError::Media)?;
+        let (sdp, media) = match negotiate(&pc, offer).await {
+            Ok(v) => v,
+            Err(e) => {
+                let _ = pc.close().await;
+                return Err(e);
+            }
+        };
+
+        let (stop_tx, stop_rx) = oneshot::channel();
+        let registered = match self.sessions.entry(execution_id.to_string()) {
+            dashmap::mapref::entry::Entry::Occupied(_) => false,
+            dashmap::mapref::entry::Entry::Vacant(v) => {
+                v.insert(Session {
+                    id: link.id,
+                    stop: Some(stop_tx),
+                });
+                true
+            }
+        };
+        if !registered {
+            let _ = pc.close().await;
+            return Err(WebRtcError::Conflict);
+        }
+
+        let hub = self.streams.get_or_create(execution_id);
+        hub.mark_connected(req.stream_id);
+        let info = WebRtcSessionInfo {
+            execution_id: execution_id.to_string(),
+            stream_id: req.stream_id,
+            codec: "opus",
+            sample_rate: req.sample_rate,
+            sdp,
+        };
+        crate::spearlet::crash::spawn(
+            "webrtc-session",
+            run(
+                self.clone(),
+                media,
+                hub,
+                link,
+                (decoder, encoder),
+                cfg.clone(),
+                stop_rx,
+            ),
+        );
+        Ok(info)
+    }
+
+    /// Stop the execution's session; `false` if there is none / 停止该执行的会话；不存在时返回 `false`
+    pub fn close(&self, execution_id: &str) -> bool {
+        match self.sessions.remove(execution_id) {
+            Some((_, mut s)) => {
+                if let Some(stop) = s.stop.take() {
+                    let _ = stop.send(());
+                }
+                true
+            }
+            None => false,
+        }
+    }
+
+    /// Stop every session, e.g. on shutdown; returns how many stopped
+    /// 停止所有会话（如关闭时）；返回停止的数量
+    pub fn close_all(&self) -> usize {
+        let ids: Vec<String> = self.sessions.iter().map(|e| e.key().clone()).collect();
+        ids.iter().filter(|id| self.close(id)).count()
+    }
+}
+
+/// Opus as offered by browsers / 浏览器提供的 Opus 参数
+fn opus_capability() -> RTCRtpCodecCapability {
+    RTCRtpCodecCapability {
+        mime_type: MIME_TYPE_OPUS.to_string(),
+        clock_rate: 48000,
+        channels: 2,
+        sdp_fmtp_line: "minptime=10;useinbandfec=1".to_string(),
+        rtcp_feedback: vec![],
+    }
+}
+
+/// A peer connection that negotiates Opus only / 仅协商 Opus 的对等连接
+async fn peer_connection(cfg: &WebRtcConfig) -> Result<Arc<RTCPeerConnection>, String> {
+    let mut media = MediaEngine::default();
+    media
+        .register_codec(
+            RTCRtpCodecParameters {
+                capability: opus_capability(),
+                payload_type: OPUS_PAYLOAD_TYPE,
+                ..Default::default()
+            },
+            RTPCodecType::Audio,
+        )
+        .map_err(|e| e.to_string())?;
+    let registry =
+        register_default_interceptors(Registry::new(), &mut media).map_err(|e| e.to_string())?;
+
+    let mut setting = SettingEngine::default();
+    if cfg.port_min != 0 || cfg.port_max != 0 {
+        let ports = EphemeralUDP::new(cfg.port_min, cfg.port_max).map_err(|e| e.to_string())?;
+        setting.set_udp_network(UDPNetwork::Ephemeral(ports));
+    }
+    if !cfg.advertise_host.is_empty() {
+        setting.set_nat_1to1_ips(vec![cfg.advertise_host.clone()], RTCIceCandidateType::Host);
+    }
+
+    let api = APIBuilder::new()
+        .with_media_engine(media)
+        .with_interceptor_registry(registry)
+        .with_setting_engine(setting)
+        .build();
+    let ice_servers = cfg
+        .ice_servers
+        .iter()
+        .map(|s| RTCIceServer {
+            urls: s.urls.clone(),
+            username: s.username.clone(),
+            credential: s.credential.clone(),
+            ..Default::default()
+        })
+        .collect();
+    let pc = api
+        .new_peer_connection(RTCConfiguration {
+            ice_servers,
+            ..Default::default()
+        })
+        .await
+        .map_err(|e| e.to_string())?;
+    Ok(Arc::new(pc))
+}
+
+/// Handles of a negotiated connection / 已协商连接的句柄
+struct Media {
+    pc: Arc<RTCPeerConnection>,
+    outbound: Arc<TrackLocalStaticSample>,
+    inbound: mpsc::Receiver<Arc<TrackRemote>>,
+    state: watch::Receiver<RTCPeerConnectionState>,
+}
+
+/// Apply the offer and build the answer; candidates are not trickled, so the answer
+/// waits for gathering to finish
+/// 应用 offer 并生成应答；候选不以 trickle 方式发送，因此应答等待候选收集完成
+async fn negotiate(
+    pc: &Arc<RTCPeerConnection>,
+    offer: RTCSessionDescription,
+) -> Result<(String, Media), WebRtcError> {
+    let media_err = |e: webrtc::Error| WebRtcError::Media(e.to_string());
+
+    let outbound = Arc::new(TrackLocalStaticSample::new(
+        opus_capability(),
+        "audio".to_string(),
+        "spear".to_string(),
+    ));
+    let sender = pc
+        .add_track(Arc::clone(&outbound) as Arc<dyn TrackLocal + Send + Sync>)
+        .await
+        .map_err(media_err)?;
+    // RTCP has to be read for the interceptors to see it / 必须读取 RTCP，拦截器才能处理
+    tokio::spawn(async move {
+        let mut buf = vec![0u8; 1500];
+        while sender.read(&mut buf).await.is_ok() {}
+    });
+
+    let (track_tx, inbound) = mpsc::channel(1);
+    pc.on_track(Box::new(move |track, _, _| {
+        if track.kind() == RTPCodecType::Audio {
+            let _ = track_tx.try_send(track);
+        }
+        Box::pin(async {})
+    }));
+    let (state_tx, state) = watch::channel(RTCPeerConnectionState::New);
+    pc.on_peer_connection_state_change(Box::new(move |s| {
+        let _ = state_tx.send(s);
+        Box::pin(async {})
+    }));
+
+    pc.set_remote_description(offer)
+        .await
+        .map_err(|e| WebRtcError::BadRequest(format!("sdp offer: {}", e)))?;
+    let answer = pc
+        .create_answer(None)
+        .await
+        .map_err(|e| WebRtcError::BadRequest(format!("sdp offer: {}", e)))?;
+    let mut gathered = pc.gathering_complete_promise().await;
+    pc.set_local_description(answer).await.map_err(media_err)?;
+    let _ = tokio::time::timeout(GATHER_TIMEOUT, gathered.recv()).await;
+    let sdp = pc
+        .local_description()
+        .await
+        .map(|d| d.sdp)
+        .ok_or_else(|| WebRtcError::Media("no local description".to_string()))?;
+    Ok((
+        sdp,
+        Media {
+            pc: Arc::clone(pc),
+            outbound,
+            inbound,
+            state,
+        },
+    ))
+}
+
+/// Where a session delivers its audio / 会话音频的投递位置
+struct Link {
+    /// Id of the session / 会话的 id
+    id: u64,
+    execution_id: String,
+    stream_id: u32,
+    sample_rate: u32,
+}
+
+impl Link {
+    fn samples_per_frame(&self) -> usize {
+        (self.sample_rate * FRAME_MS / 1000) as usize
+    }
+
+    /// Push one playout unit as a DATA frame; `false` once the stream refuses it
+    /// 将一个播放单元作为 DATA 帧推入；流拒绝时返回 `false`
+    fn deliver(
+        &self,
+        hub: &ExecutionUserStreamHub,
+        decoder: &mut OpusDecoder,
+        playout: Playout,
+    ) -> bool {
+        let mut meta = serde_json::json!({
+            "codec": "pcm_s16le",
+            "sample_rate": self.sample_rate,
+            "channels": 1,
+        });
+        let samples = match playout {
+            Playout::Packet {
+                seq,
+                timestamp,
+                payload,
+            } => {
+                meta["seq"] = seq.into();
+                meta["rtp_timestamp"] = timestamp.into();
+                decoder.decode(&payload)
+            }
+            Playout::Lost { seq } => {
+                meta["seq"] = seq.into();
+                meta["lost"] = true.into();
+                decoder.conceal()
+            }
+        };
+        let data: Vec<u8> = samples.iter().flat_map(|s| s.to_le_bytes()).collect();
+        let frame = ssf::build_ssf_v1_frame(
+            self.stream_id,
+            SSF_MSG_DATA,
+            meta.to_string().as_bytes(),
+            &data,
+        );
+        hub.push_inbound_frame(self.stream_id, frame) == 0
+    }
+
+    /// Move the workload's outbound PCM into `pending` until a frame is buffered
+    /// 将工作负载的出站 PCM 移入 `pending`，直到缓冲满一帧
+    fn fill(&self, hub: &ExecutionUserStreamHub, pending: &mut Vec<i16>) {
+        while pending.len() < self.samples_per_frame() {
+            let Some(frame) = hub.pop_outbound_frame_on(self.stream_id) else {
+                return;
+            };
+            if let Ok((_, SSF_MSG_DATA, _, data)) = ssf::split_ssf_v1_frame(&frame) {
+                pending.extend(
+                    data.chunks_exact(2)
+                        .map(|c| i16::from_le_bytes([c[0], c[1]])),
+                );
+            }
+        }
+    }
+}
+
+/// Forward the peer's RTP until its track ends / 转发对端 RTP 直到其音轨结束
+async fn read_track(track: Arc<TrackRemote>, tx: mpsc::Sender<(u16, u32, Bytes)>) {
+    while let Ok((pkt, _)) = track.read_rtp().await {
+        let item = (
+            pkt.header.sequence_number,
+            pkt.header.timestamp,
+            pkt.payload,
+        );
+        if tx.send(item).await.is_err() {
+            return;
+        }
+    }
+}
+
+async fn run(
+    sessions: WebRtcSessions,
+    media: Media,
+    hub: Arc<ExecutionUserStreamHub>,
+    link: Link,
+    (mut decoder, mut encoder): (OpusDecoder, OpusEncoder),
+    cfg: WebRtcConfig,
+    mut stop: oneshot::Receiver<()>,
+) {
+    let Media {
+        pc,
+        outbound,
+        mut inbound,
+        mut state,
+    } = media;
+    let depth = (cfg.jitter_buffer_ms / FRAME_MS).max(1) as usize;
+    let mut jitter = JitterBuffer::new(depth);
+    let (rtp_tx, mut rtp_rx) = mpsc::channel(64);
+    let mut reader = None;
+    let mut pending: Vec<i16> = Vec::new();
+    let mut tick = tokio::time::interval(Duration::from_millis(FRAME_MS as u64));
+    let idle = Duration::from_millis(cfg.idle_timeout_ms);
+    let mut last_rx = tokio::time::Instant::now();
+
+    let reason = loop {
+        tokio::select! {
+            _ = &mut stop => break "closed",
+            Some(track) = inbound.recv(), if reader.is_none() => {
+                reader = Some(tokio::spawn(read_track(track, rtp_tx.clone())));
+            }
+            changed = state.changed() => {
+                let s = *state.borrow();
+                if changed.is_err()
+                    || matches!(s, RTCPeerConnectionState::Failed | RTCPeerConnectionState::Closed)
+                {
+                    break "peer connection closed";
+                }
+            }
+            Some((seq, timestamp, payload)) = rtp_rx.recv() => {
+                last_rx = tokio::time::Instant::now();
+                jitter.push(seq, timestamp, Vec::from(payload));
+                let mut accepted = true;
+                while let Some(playout) = jitter.pop() {
+                    accepted &= link.deliver(&hub, &mut decoder, playout);
+                }
+                if !accepted {
+                    break "user stream rejected audio";
+                }
+            }
+            _ = tick.tick() => {
+                if sessions.streams.get(&link.execution_id).is_none() {
+                    break "execution finished";
+                }
+                if last_rx.elapsed() >= idle {
+                    break "idle timeout";
+                }
+                link.fill(&hub, &mut pending);
+                let n = link.samples_per_frame();
+                if pending.len() >= n {
+                    let frame: Vec<i16> = pending.drain(..n).collect();
+                    if let Ok(data) = encoder.encode(&frame) {
+                        let sample = Sample {
+                            data: Bytes::from(data),
+                            duration: Duration::from_millis(FRAME_MS as u64),
+                            ..Default::default()
+                        };
+                        let _ = outbound.write_sample(&sample).await;
+                    }
+                }
+            }
+        }
+    };
+
+    if let Some(reader) = reader {
+        reader.abort();
+    }
+    let _ = pc.close().await;
+    sessions
+        .sessions
+        .remove_if(&link.execution_id, |_, s| s.id == link.id);
+    sessions
+        .streams
+        .map_ws_close_to_channels(&link.execution_id);
+    info!(
+        execution_id = %link.execution_id,
+        reason,
+        stats = ?jitter.stats(),
+        "webrtc session ended"
+    );
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// An offer as a browser sending microphone audio would make
+    /// 与发送麦克风音频的浏览器所生成的 offer 相同
+    async fn browser_offer(cfg: &WebRtcConfig) -> (Arc<RTCPeerConnection>, String) {
+        let pc = peer_connection(cfg).await.unwrap();
+        pc.add_transceiver_from_kind(RTPCodecType::Audio, None)
+            .await
+            .unwrap();
+        let offer = pc.create_offer(None).await.unwrap();
+        let mut gathered = pc.gathering_complete_promise().await;
+        pc.set_local_description(offer).await.unwrap();
+        let _ = tokio::time::timeout(GATHER_TIMEOUT, gathered.recv()).await;
+        let sdp = pc.local_description().await.unwrap().sdp;
+        (pc, sdp)
+    }
+
+    #[tokio::test]
+    async fn test_open_validates_request() {
+        let mut cfg = WebRtcConfig::default();
+        let sessions = WebRtcSessions::default();
+        let req = WebRtcSessionRequest::default;
+        assert!(matches!(
+            sessions.open(&cfg, "webrtc-exec", req()).await,
+            Err(WebRtcError::Disabled)
+        ));
+
+        cfg.enabled = true;
+        let (peer, offer) = browser_offer(&cfg).await;
+        let bad_rate = WebRtcSessionRequest {
+            sample_rate: 44100,
+            sdp: offer.clone(),
+            ..req()
+        };
+        let bad_sdp = WebRtcSessionRequest {
+            sdp: "not sdp".to_string(),
+            ..req()
+        };
+        for r in [req(), bad_rate, bad_sdp] {
+            assert!(matches!(
+                sessions.open(&cfg, "webrtc-exec", r).await,
+                Err(WebRtcError::BadRequest(_))
+            ));
+        }
+
+        let ok = || WebRtcSessionRequest {
+            sample_rate: 16000,
+            sdp: offer.clone(),
+            ..req()
+        };
+        let info = sessions.open(&cfg, "webrtc-exec", ok()).await.unwrap();
+        assert_eq!((info.codec, info.sample_rate), ("opus", 16000));
+        assert!(info.sdp.contains("a=fingerprint:sha-256 "), "{}", info.sdp);
+        assert!(info.sdp.contains("opus/48000/2"), "{}", info.sdp);
+        assert!(matches!(
+            sessions.open(&cfg, "webrtc-exec", ok()).await,
+            Err(WebRtcError::Conflict)
+        ));
+        assert!(sessions.close("webrtc-exec"));
+        assert!(!sessions.close("webrtc-exec"));
+        peer.close().await.unwrap();
+    }
+}
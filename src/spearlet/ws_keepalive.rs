@@ -0,0 +1,227 @@
+//! Keepalive, deadlines and idle timeout for streaming WebSockets
+//! 流式 WebSocket 的保活、读写截止时间与空闲超时
+//!
+//! NATs and proxies drop quiet connections without telling either side, so a
+//! streaming session could hang forever with its execution still running. The
+//! spearlet now pings the client every `ping_interval_ms`, closes the socket when
+//! nothing arrives within `read_timeout_ms` or a write blocks for `write_timeout_ms`,
+//! and ends sessions that carry no data for `idle_timeout_ms`.
+//! NAT 与代理会在不通知双方的情况下丢弃静默连接，流式会话可能永久挂起而执行仍在运行。
+//! spearlet 现在每隔 `ping_interval_ms` 向客户端发送 ping，在 `read_timeout_ms` 内未收到
+//! 任何消息或写入阻塞超过 `write_timeout_ms` 时关闭连接，并结束 `idle_timeout_ms` 内没有数据
+//! 的会话。
+
+use std::time::Duration;
+
+use axum::extract::ws::{CloseFrame, Message, WebSocket};
+use futures::stream::SplitSink;
+use futures::SinkExt;
+use tokio::sync::mpsc;
+use tokio::task::JoinHandle;
+use tokio::time::Instant;
+use tracing::debug;
+
+use crate::spearlet::config::WebSocketConfig;
+
+/// Normal closure, sent when the backing execution finished / 正常关闭，执行结束时发送
+pub const CLOSE_NORMAL: u16 = 1000;
+/// Going away, sent on idle timeout / 离开，空闲超时时发送
+pub const CLOSE_GOING_AWAY: u16 = 1001;
+/// Internal error, e.g. a frame could not be delivered / 内部错误，如帧无法投递
+pub const CLOSE_INTERNAL_ERROR: u16 = 1011;
+
+/// Close message with a code and reason / 带关闭码与原因的关闭消息
+pub fn close_message(code: u16, reason: &str) -> Message {
+    Message::Close(Some(CloseFrame {
+        code,
+        reason: reason.into(),
+    }))
+}
+
+fn enabled(ms: u64) -> Option<Duration> {
+    (ms > 0).then(|| Duration::from_millis(ms))
+}
+
+/// What the session should do now / 会话此刻应执行的动作
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum KeepaliveEvent {
+    /// Send a ping / 发送 ping
+    Ping,
+    /// Nothing received within the read timeout / 读超时内未收到任何消息
+    ReadTimeout,
+    /// No data in either direction within the idle timeout / 空闲超时内双向都没有数据
+    IdleTimeout,
+}
+
+/// Keepalive state of one connection / 单个连接的保活状态
+#[derive(Debug, Clone)]
+pub struct Keepalive {
+    ping_interval: Option<Duration>,
+    read_timeout: Option<Duration>,
+    idle_timeout: Option<Duration>,
+    next_ping: Instant,
+    last_received: Instant,
+    last_data: Instant,
+}
+
+impl Keepalive {
+    pub fn new(cfg: &WebSocketConfig) -> Self {
+        let now = Instant::now();
+        let ping_interval = enabled(cfg.ping_interval_ms);
+        Self {
+            ping_interval,
+            read_timeout: enabled(cfg.read_timeout_ms),
+            idle_timeout: enabled(cfg.idle_timeout_ms),
+            next_ping: now + ping_interval.unwrap_or_default(),
+            last_received: now,
+            last_data: now,
+        }
+    }
+
+    /// Any message arrived; `data` is false for ping/pong / 收到任意消息；ping/pong 时 `data` 为 false
+    pub fn received(&mut self, data: bool) {
+        let now = Instant::now();
+        self.last_received = now;
+        if data {
+            self.last_data = now;
+        }
+    }
+
+    /// Data was sent to the client / 已向客户端发送数据
+    pub fn sent_data(&mut self) {
+        self.last_data = Instant::now();
+    }
+
+    /// Earliest instant at which `poll` has something to report
+    /// `poll` 有事件可报告的最早时刻
+    pub fn deadline(&self) -> Option<Instant> {
+        [
+            self.ping_interval.map(|_| self.next_ping),
+            self.read_timeout.map(|d| self.last_received + d),
+            self.idle_timeout.map(|d| self.last_data + d),
+        ]
+        .into_iter()
+        .flatten()
+        .min()
+    }
+
+    /// Event due now, if any / 当前到期的事件（如有）
+    pub fn poll(&mut self) -> Option<KeepaliveEvent> {
+        let now = Instant::now();
+        if self
+            .read_timeout
+            .is_some_and(|d| now >= self.last_received + d)
+        {
+            return Some(KeepaliveEvent::ReadTimeout);
+        }
+        if self.idle_timeout.is_some_and(|d| now >= self.last_data + d) {
+            return Some(KeepaliveEvent::IdleTimeout);
+        }
+        if let Some(interval) = self.ping_interval {
+            if now >= self.next_ping {
+                self.next_ping = now + interval;
+                return Some(KeepaliveEvent::Ping);
+            }
+        }
+        None
+    }
+}
+
+/// Sleep until a keepalive deadline; forever when all checks are off
+/// 休眠到保活截止时间；全部关闭时永久等待
+pub async fn wait_until(deadline: Option<Instant>) {
+    match deadline {
+        Some(at) => tokio::time::sleep_until(at).await,
+        None => std::future::pending().await,
+    }
+}
+
+/// Act on a keepalive event; returns false when the session must end
+/// 处理保活事件；会话必须结束时返回 false
+pub fn handle(event: KeepaliveEvent, out_tx: &mpsc::UnboundedSender<Message>) -> bool {
+    match event {
+        KeepaliveEvent::Ping => out_tx.send(Message::Ping(Default::default())).is_ok(),
+        KeepaliveEvent::ReadTimeout => {
+            debug!("websocket read timeout, closing");
+            false
+        }
+        KeepaliveEvent::IdleTimeout => {
+            debug!("websocket idle timeout, closing");
+            let _ = out_tx.send(close_message(CLOSE_GOING_AWAY, "idle timeout"));
+            false
+        }
+    }
+}
+
+/// Drain `out_rx` into the socket; the task ends when a write fails or exceeds
+/// `write_timeout_ms`, or after a close message
+/// 将 `out_rx` 写入 socket；写入失败或超过 `write_timeout_ms`，或发送关闭消息后任务结束
+pub fn spawn_writer(
+    mut ws_tx: SplitSink<WebSocket, Message>,
+    mut out_rx: mpsc::UnboundedReceiver<Message>,
+    cfg: &WebSocketConfig,
+) -> JoinHandle<()> {
+    let write_timeout = enabled(cfg.write_timeout_ms);
+    tokio::spawn(async move {
+        while let Some(msg) = out_rx.recv().await {
+            let closing = matches!(msg, Message::Close(_));
+            let sent = match write_timeout {
+                Some(d) => matches!(tokio::time::timeout(d, ws_tx.send(msg)).await, Ok(Ok(()))),
+                None => ws_tx.send(msg).await.is_ok(),
+            };
+            if !sent {
+                debug!("websocket write failed or timed out");
+                break;
+            }
+            if closing {
+                break;
+            }
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn cfg(ping: u64, read: u64, idle: u64) -> WebSocketConfig {
+        WebSocketConfig {
+            ping_interval_ms: ping,
+            read_timeout_ms: read,
+            idle_timeout_ms: idle,
+            ..Default::default()
+        }
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn test_ping_then_read_timeout() {
+        let mut ka = Keepalive::new(&cfg(100, 250, 0));
+        assert_eq!(ka.poll(), None);
+        wait_until(ka.deadline()).await;
+        assert_eq!(ka.poll(), Some(KeepaliveEvent::Ping));
+        wait_until(ka.deadline()).await;
+        assert_eq!(ka.poll(), Some(KeepaliveEvent::Ping));
+        // A pong keeps the connection alive / pong 使连接保持存活
+        ka.received(false);
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        assert_eq!(ka.poll(), Some(KeepaliveEvent::Ping));
+        tokio::time::sleep(Duration::from_millis(60)).await;
+        assert_eq!(ka.poll(), Some(KeepaliveEvent::ReadTimeout));
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn test_idle_timeout_ignores_pongs() {
+        let mut ka = Keepalive::new(&cfg(0, 0, 1_000));
+        tokio::time::sleep(Duration::from_millis(600)).await;
+        ka.received(false);
+        tokio::time::sleep(Duration::from_millis(300)).await;
+        ka.sent_data();
+        tokio::time::sleep(Duration::from_millis(900)).await;
+        assert_eq!(ka.poll(), None);
+        wait_until(ka.deadline()).await;
+        assert_eq!(ka.poll(), Some(KeepaliveEvent::IdleTimeout));
+
+        let ka = Keepalive::new(&cfg(0, 0, 0));
+        assert!(ka.deadline().is_none());
+    }
+}
@@ -0,0 +1,182 @@
+use std::time::Duration;
+
+use spear_next::spearlet::compute_hints::ComputeResource;
+use spear_next::spearlet::config::{ChildInvokeConfig, MessagePassingConfig};
+use spear_next::spearlet::execution::child_invoke::{ChildError, ChildRequest};
+use spear_next::spearlet::shutdown::ShutdownDeadline;
+use spear_next::spearlet::{Spearlet, SpearletConfig};
+
+fn config() -> SpearletConfig {
+    SpearletConfig {
+        message_passing: MessagePassingConfig {
+            enabled: true,
+            ..Default::default()
+        },
+        ..Default::default()
+    }
+}
+
+#[tokio::test]
+async fn test_embedded_spearlet_lifecycle() {
+    let spearlet = Spearlet::builder()
+        .with_config(config())
+        .with_node_name("embedded-test")
+        .with_max_concurrent_executions(2)
+        .build()
+        .await
+        .unwrap();
+    assert_eq!(spearlet.config().node_name, "embedded-test");
+    let other = Spearlet::builder()
+        .with_config(config())
+        .build()
+        .await
+        .unwrap();
+
+    for _ in 0..2 {
+        spearlet.start();
+        assert!(!spearlet.is_serving());
+        let bus = &spearlet.node().message_passing;
+        assert!(bus.stats().enabled);
+        bus.register("embedded-inst", "embedded-mailbox").unwrap();
+        // Each spearlet has its own services / 每个 spearlet 拥有自己的服务
+        assert!(!other.node().message_passing.stats().enabled);
+
+        let deadline = ShutdownDeadline::new(Duration::from_secs(5));
+        assert_eq!(spearlet.stop(&deadline).await, 0);
+        // Stopping resets node services, so the next start begins clean
+        // 停止会重置节点服务，使下一次启动从干净状态开始
+        assert!(!bus.stats().enabled);
+    }
+}
+
+#[tokio::test]
+async fn test_embedded_spearlet_serve_twice_fails() {
+    let mut cfg = config();
+    cfg.grpc.addr = "127.0.0.1:0".parse().unwrap();
+    cfg.http.server.addr = "127.0.0.1:0".parse().unwrap();
+    let spearlet = Spearlet::builder().with_config(cfg).build().await.unwrap();
+
+    spearlet.serve().unwrap();
+    assert!(spearlet.is_serving());
+    assert!(spearlet.serve().is_err());
+
+    let deadline = ShutdownDeadline::new(Duration::from_secs(5));
+    spearlet.stop_serving(&deadline).await;
+    assert!(!spearlet.is_serving());
+    spearlet.stop(&deadline).await;
+}
+
+/// Register a task named `name` that only this spearlet knows
+/// 注册一个仅本 spearlet 知道的名为 `name` 的任务
+async fn load_task(spearlet: &Spearlet, name: &str) {
+    let mgr = spearlet.execution_manager();
+    let sms_task = spear_next::proto::sms::Task {
+        task_id: format!("task-{name}"),
+        name: name.to_string(),
+        executable: Some(spear_next::proto::sms::TaskExecutable {
+            r#type: 5,
+            uri: "file:///bin/false".to_string(),
+            ..Default::default()
+        }),
+        ..Default::default()
+    };
+    let artifact = mgr.ensure_artifact_from_sms(&sms_task).await.unwrap();
+    mgr.ensure_task_from_sms(&sms_task, &artifact)
+        .await
+        .unwrap();
+}
+
+#[tokio::test]
+async fn test_embedded_spearlets_own_child_invocations() {
+    let a = Spearlet::builder()
+        .with_config(config())
+        .build()
+        .await
+        .unwrap();
+    let b = Spearlet::builder()
+        .with_config(config())
+        .build()
+        .await
+        .unwrap();
+    load_task(&a, "child-a").await;
+    load_task(&b, "child-b").await;
+
+    let cfg = ChildInvokeConfig::default();
+    for (spearlet, other, task) in [(&a, &b, "child-a"), (&b, &a, "child-b")] {
+        let children = &spearlet.node().child_invoke;
+        let req = ChildRequest {
+            task: task.to_string(),
+            timeout_ms: 5000,
+            ..Default::default()
+        };
+        let (handle, run) = children.start("exec-embedded-parent", &cfg, req).unwrap();
+        // Handles of one spearlet mean nothing to the other / 一个 spearlet 的句柄对另一个无意义
+        assert_eq!(
+            other
+                .node()
+                .child_invoke
+                .next("exec-embedded-parent", handle, 1 << 16),
+            Err(ChildError::NotFound(handle))
+        );
+        run.await;
+
+        let done: serde_json::Value = serde_json::from_slice(
+            &children
+                .next("exec-embedded-parent", handle, 1 << 16)
+                .unwrap(),
+        )
+        .unwrap();
+        assert_eq!(done["event"], "done");
+        // The child ran on the spearlet that knows the task; the other one would have
+        // asked SMS for it
+        // 子调用运行在知道该任务的 spearlet 上；另一个 spearlet 会向 SMS 查询该任务
+        let error = done["error"].as_str().unwrap_or_default();
+        assert!(!error.contains("sms_grpc_addr"), "{task}: {error}");
+    }
+}
+
+#[tokio::test]
+async fn test_embedded_spearlets_keep_node_state_apart() {
+    let mut cfg_a = config();
+    cfg_a.tool_plugins.simulation.enabled = true;
+    let mut cfg_b = config();
+    cfg_b.compute_hints.enabled = false;
+    let a = Spearlet::builder()
+        .with_config(cfg_a)
+        .build()
+        .await
+        .unwrap();
+    let b = Spearlet::builder()
+        .with_config(cfg_b)
+        .build()
+        .await
+        .unwrap();
+    a.start();
+    b.start();
+
+    // Each spearlet discovers its own plugins and starts its own registry sync
+    // 每个 spearlet 发现自己的插件并启动自己的注册表同步
+    assert!(a.node().tool_plugins.get().unwrap().simulating());
+    assert!(!b.node().tool_plugins.get().unwrap().simulating());
+    let (sync_a, sync_b) = (a.node().mcp_registry.get(), b.node().mcp_registry.get());
+    assert!(!std::sync::Arc::ptr_eq(&sync_a.unwrap(), &sync_b.unwrap()));
+
+    // A boost on one spearlet holds back nothing on the other
+    // 一个 spearlet 上的提升不会影响另一个
+    let granted = a.node().compute_hints.begin(
+        "exec-boost",
+        "task-boost",
+        ComputeResource::Cpu,
+        Some(Duration::from_secs(1)),
+    );
+    assert!(granted.is_some());
+    assert_eq!(a.node().compute_hints.status().boosts.len(), 1);
+    assert!(!b.node().compute_hints.status().enabled);
+    assert!(b.node().compute_hints.status().boosts.is_empty());
+    assert!(b.node().router_filter.get().is_none());
+    assert!(b.node().live_config.current().is_none());
+
+    let deadline = ShutdownDeadline::new(Duration::from_secs(5));
+    a.stop(&deadline).await;
+    b.stop(&deadline).await;
+}
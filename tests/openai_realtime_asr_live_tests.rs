@@ -42,6 +42,8 @@ fn test_openai_realtime_asr_websocket_connect() {
         ops: vec!["speech_to_text".to_string()],
         features: vec![],
         transports: vec!["websocket".to_string()],
+        auth_style: None,
+        api_version: None,
     });
 
     let mut global_env = HashMap::new();
@@ -53,6 +55,7 @@ fn test_openai_realtime_asr_websocket_connect() {
         global_environment: global_env,
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     });
 
     let fd = api.rtasr_create();
@@ -53,6 +53,7 @@ impl spear_next::proto::spearlet::invocation_service_server::InvocationService
                 error: None,
                 started_at: None,
                 completed_at: None,
+                debug_trace: String::new(),
             })),
         }
     }
@@ -112,6 +113,7 @@ impl spear_next::proto::spearlet::invocation_service_server::InvocationService
                 error: None,
                 started_at: None,
                 completed_at: None,
+                debug_trace: String::new(),
             })),
         }
     }
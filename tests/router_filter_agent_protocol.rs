@@ -23,6 +23,7 @@ use spear_next::spearlet::execution::ai::router::registry::{
     BackendInstance, BackendRegistry, Hosting,
 };
 use spear_next::spearlet::execution::ai::router::Router;
+use spear_next::spearlet::local_models::ManagedBackendRegistry;
 
 const BLACKLIST_KEYWORDS: &[&str] = &[
     "secret",
@@ -149,6 +150,9 @@ async fn protocol_keyword_filter_server_drops_remote_candidates() {
         BackendRegistry::new(vec![local.clone(), remote]),
         SelectionPolicy::WeightedRandom,
         Some(hub),
+        ManagedBackendRegistry::new(),
+        Arc::default(),
+        Arc::default(),
     );
 
     let req = CanonicalRequestEnvelope {
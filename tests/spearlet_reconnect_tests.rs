@@ -68,7 +68,34 @@ fn make_spearlet_config(sms_grpc_addr: String) -> Arc<SpearletConfig> {
         sms_connect_timeout_ms: 3_000,
         sms_connect_retry_ms: 200,
         reconnect_total_timeout_ms: 30_000,
+        shutdown_timeout_ms: 30_000,
         llm: spear_next::spearlet::config::LlmConfig::default(),
+        model_cache: spear_next::spearlet::config::ModelCacheConfig::default(),
+        downloads: spear_next::spearlet::config::DownloadConfig::default(),
+        tool_plugins: spear_next::spearlet::config::ToolPluginConfig::default(),
+        test_hostcalls: false,
+        otel: Default::default(),
+        crash: Default::default(),
+        clock: Default::default(),
+        locale: Default::default(),
+        webhook: Default::default(),
+        devices: Default::default(),
+        energy: Default::default(),
+        execution: Default::default(),
+        reload: Default::default(),
+        webrtc: Default::default(),
+        telephony: Default::default(),
+        tls: Default::default(),
+        rtsp: Default::default(),
+        onnx: Default::default(),
+        model_store: Default::default(),
+        metrics_export: Default::default(),
+        log_shipping: Default::default(),
+        debug_tunnel: Default::default(),
+        desired_state: Default::default(),
+        config_rollout: Default::default(),
+        blob_cache: Default::default(),
+        vector_store: Default::default(),
     })
 }
 
@@ -48,6 +48,8 @@ fn test_wasm_to_openai_chat_completion_e2e() {
             "supports_stream".to_string(),
         ],
         transports: vec!["http".to_string()],
+        auth_style: None,
+        api_version: None,
     });
 
     let mut global_env = HashMap::new();
@@ -59,6 +61,7 @@ fn test_wasm_to_openai_chat_completion_e2e() {
         global_environment: global_env,
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: Default::default(),
     };
 
     let wat = format!(
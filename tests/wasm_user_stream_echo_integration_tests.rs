@@ -5,14 +5,13 @@
 #[tokio::test]
 async fn test_wasm_user_stream_echo_roundtrip() {
     use spear_next::spearlet::config::SpearletConfig;
-    use spear_next::spearlet::execution::host_api::{
-        map_ws_close_to_channels, set_current_wasm_execution_id, ws_pop_any_outbound, ws_push_frame,
-    };
+    use spear_next::spearlet::execution::host_api::set_current_wasm_execution_id;
     use spear_next::spearlet::execution::runtime::wasm_hostcalls::build_spear_import_with_api;
     use spear_next::spearlet::execution::runtime::{
         ResourcePoolConfig, RuntimeConfig, RuntimeType,
     };
     use spear_next::spearlet::mcp::task_subset::McpTaskPolicy;
+    use spear_next::spearlet::node_services::NodeServices;
     use std::collections::HashMap;
     use std::sync::Arc;
     use std::time::Duration;
@@ -143,12 +142,14 @@ async fn test_wasm_user_stream_echo_roundtrip() {
     let mut cfg = SpearletConfig::default();
     cfg.sms_http_addr = "127.0.0.1:8080".to_string();
 
+    let node = NodeServices::new();
     let runtime_config = RuntimeConfig {
         runtime_type: RuntimeType::Wasm,
         settings: HashMap::new(),
         global_environment: HashMap::new(),
         spearlet_config: Some(cfg),
         resource_pool: ResourcePoolConfig::default(),
+        node: node.clone(),
     };
 
     let (done_tx, done_rx) = std::sync::mpsc::channel::<Result<i32, String>>();
@@ -186,12 +187,12 @@ async fn test_wasm_user_stream_echo_roundtrip() {
     });
 
     tokio::time::sleep(Duration::from_millis(20)).await;
-    let rc = ws_push_frame(&exec_id, inbound.clone());
+    let rc = node.user_streams.ws_push_frame(&exec_id, inbound.clone());
     assert_eq!(rc, 0);
 
     let echoed = tokio::time::timeout(Duration::from_secs(2), async {
         loop {
-            if let Some(frame) = ws_pop_any_outbound(&exec_id) {
+            if let Some(frame) = node.user_streams.ws_pop_any_outbound(&exec_id) {
                 return frame;
             }
             tokio::time::sleep(Duration::from_millis(10)).await;
@@ -201,7 +202,7 @@ async fn test_wasm_user_stream_echo_roundtrip() {
     .unwrap();
     assert_eq!(echoed, inbound);
 
-    map_ws_close_to_channels(&exec_id);
+    node.user_streams.map_ws_close_to_channels(&exec_id);
 
     let done = tokio::task::spawn_blocking(move || done_rx.recv_timeout(Duration::from_secs(2)))
         .await